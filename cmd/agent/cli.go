@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/edgetainer/edgetainer/internal/agent/control"
+	"github.com/edgetainer/edgetainer/internal/agent/docker"
+	"github.com/edgetainer/edgetainer/internal/agent/health"
+	"github.com/edgetainer/edgetainer/internal/shared/config"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+// cliOptions holds the flags shared by all CLI subcommands
+type cliOptions struct {
+	lines   int
+	noDeps  bool
+	rolling bool
+}
+
+// cliCommands lists the subcommands that talk to a running agent
+var cliCommands = map[string]func(*control.Client, cliOptions, []string) error{
+	"status":   runStatus,
+	"apps":     runApps,
+	"logs":     runLogs,
+	"resync":   runResync,
+	"restart":  runRestart,
+	"history":  runHistory,
+	"rollback": runRollback,
+}
+
+// isCLICommand reports whether the argument is a local CLI subcommand
+func isCLICommand(arg string) bool {
+	_, ok := cliCommands[arg]
+	return ok
+}
+
+// runCLI executes a local CLI subcommand against the running agent
+func runCLI(name string, args []string) int {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	cfgPath := fs.String("config", "agent-config.yaml", "Path to configuration file")
+	socket := fs.String("socket", "", "Path to the agent control socket (overrides config)")
+	lines := fs.Int("n", 100, "Number of log lines to show (logs only)")
+	noDeps := fs.Bool("no-deps", false, "Do not restart the services the named ones depend on (restart only)")
+	rolling := fs.Bool("rolling", false, "Restart the containers of scaled services one at a time (restart only)")
+	fs.Parse(args)
+
+	socketPath := *socket
+	if socketPath == "" {
+		socketPath = config.DefaultControlSocket
+		if cfg, err := config.LoadAgentConfig(*cfgPath); err == nil {
+			socketPath = cfg.Control.Socket
+		}
+	}
+
+	client := control.NewClient(socketPath)
+	if err := cliCommands[name](client, cliOptions{lines: *lines, noDeps: *noDeps, rolling: *rolling}, fs.Args()); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+// runStatus prints the agent status
+func runStatus(client *control.Client, opts cliOptions, args []string) error {
+	data, err := client.Status()
+	if err != nil {
+		return err
+	}
+
+	var status health.Status
+	if err := json.Unmarshal(data, &status); err != nil {
+		return fmt.Errorf("failed to parse status: %w", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Device:\t%s\n", status.DeviceID)
+	fmt.Fprintf(w, "Healthy:\t%v\n", status.Healthy)
+	fmt.Fprintf(w, "Agent uptime:\t%s\n", status.Uptime)
+
+	tunnel := "disconnected"
+	if status.Tunnel.Connected {
+		tunnel = fmt.Sprintf("connected since %s", status.Tunnel.ConnectedSince.Format("2006-01-02 15:04:05"))
+	}
+	server := status.Tunnel.Server
+	if status.Tunnel.Backup {
+		server += ", backup"
+	}
+	fmt.Fprintf(w, "Tunnel:\t%s (%s)\n", tunnel, server)
+	if status.Tunnel.LastError != "" {
+		fmt.Fprintf(w, "Last tunnel error:\t%s\n", status.Tunnel.LastError)
+	}
+	if clock := status.Tunnel.Clock; clock != nil {
+		fmt.Fprintf(w, "Clock skew:\t%+.3fs (checked %s)\n", clock.Skew, clock.CheckedAt.Format("2006-01-02 15:04:05"))
+	}
+
+	if status.LastDeploy != nil {
+		result := "succeeded"
+		if !status.LastDeploy.Success {
+			result = "failed: " + status.LastDeploy.Error
+		}
+		fmt.Fprintf(w, "Last deploy:\t%s %s at %s %s\n", status.LastDeploy.Application, status.LastDeploy.Version,
+			status.LastDeploy.Timestamp.Format("2006-01-02 15:04:05"), result)
+	}
+
+	if status.Metrics != nil {
+		fmt.Fprintf(w, "CPU:\t%.1f%%\n", status.Metrics.CPUUsage)
+		fmt.Fprintf(w, "Memory:\t%.1f%%\n", status.Metrics.MemoryUsage)
+		fmt.Fprintf(w, "Load:\t%.2f %.2f %.2f\n", status.Metrics.LoadAvg[0], status.Metrics.LoadAvg[1], status.Metrics.LoadAvg[2])
+	}
+
+	fmt.Fprintf(w, "Apps:\t%d\n", len(status.Apps))
+	for _, app := range status.Apps {
+		fmt.Fprintf(w, "  %s\t%s (%d/%d running)\n", app.Name, app.Version, app.Running, app.Containers)
+	}
+
+	return w.Flush()
+}
+
+// runApps prints the applications and their containers
+func runApps(client *control.Client, opts cliOptions, args []string) error {
+	data, err := client.Apps()
+	if err != nil {
+		return err
+	}
+
+	var apps map[string]*docker.Application
+	if err := json.Unmarshal(data, &apps); err != nil {
+		return fmt.Errorf("failed to parse apps: %w", err)
+	}
+
+	names := make([]string, 0, len(apps))
+	for name := range apps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "APP\tVERSION\tCONTAINER\tIMAGE\tSTATE\tSTATUS")
+	for _, name := range names {
+		app := apps[name]
+		if len(app.Containers) == 0 {
+			fmt.Fprintf(w, "%s\t%s\t-\t-\t-\t-\n", app.Name, app.Version)
+			continue
+		}
+		for _, c := range app.Containers {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", app.Name, app.Version, c.Name, c.Image, c.State, c.Status)
+		}
+	}
+
+	return w.Flush()
+}
+
+// runLogs prints the logs of a container
+func runLogs(client *control.Client, opts cliOptions, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: edgetainer-agent logs [--config path] [-n lines] <app> <container>")
+	}
+
+	data, err := client.Logs(args[0], args[1], opts.lines)
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stdout.Write(data)
+	return err
+}
+
+// runResync forces the agent to reload its state and reconnect
+func runResync(client *control.Client, opts cliOptions, args []string) error {
+	data, err := client.Resync()
+	if err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	if err := json.Indent(&out, data, "", "  "); err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+
+	fmt.Println(out.String())
+	return nil
+}
+
+// runRestart restarts the services of an application in dependency order
+func runRestart(client *control.Client, opts cliOptions, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: edgetainer-agent restart [--no-deps] [--rolling] <app> [service...]")
+	}
+
+	data, err := client.Restart(args[0], args[1:], opts.noDeps, opts.rolling)
+	if err != nil {
+		return err
+	}
+
+	var results []protocol.ServiceRestartResult
+	if err := json.Unmarshal(data, &results); err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+
+	failed := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVICE\tSTATUS\tCONTAINERS\tDURATION\tERROR")
+	for _, result := range results {
+		if result.Status != protocol.RestartDone {
+			failed++
+		}
+		errMsg := result.Error
+		if errMsg == "" {
+			errMsg = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%.1fs\t%s\n", result.Service, result.Status, result.Containers, result.Duration, errMsg)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d services were not restarted", failed, len(results))
+	}
+	return nil
+}
+
+// runHistory prints the deployments of an application on the device
+func runHistory(client *control.Client, opts cliOptions, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: edgetainer-agent history <app>")
+	}
+
+	data, err := client.History(args[0])
+	if err != nil {
+		return err
+	}
+
+	var records []docker.DeploymentRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FINISHED\tVERSION\tRESULT\tCOMPOSE\tENV\tROLLBACK")
+	for _, record := range records {
+		result := "succeeded"
+		if !record.Success {
+			result = "failed: " + record.Error
+		}
+		rollback := "-"
+		if record.Restorable {
+			rollback = "available"
+		}
+		if record.Rollback {
+			result += " (rolled back to)"
+		}
+		if record.RestorePoint != "" {
+			result += " (restore point)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", record.FinishedAt.Format("2006-01-02 15:04:05"), record.Version, result,
+			shortHash(record.ComposeHash), shortHash(record.EnvHash), rollback)
+	}
+
+	return w.Flush()
+}
+
+// runRollback deploys an earlier version of an application again
+func runRollback(client *control.Client, opts cliOptions, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("usage: edgetainer-agent rollback <app> [version]")
+	}
+
+	version := ""
+	if len(args) == 2 {
+		version = args[1]
+	}
+	data, err := client.Rollback(args[0], version)
+	if err != nil {
+		return err
+	}
+
+	var record docker.DeploymentRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+
+	fmt.Printf("Rolled back %s to version %s\n", args[0], record.Version)
+	return nil
+}
+
+// shortHash shortens a sha256:<hex> hash for display
+func shortHash(hash string) string {
+	hash = strings.TrimPrefix(hash, "sha256:")
+	if len(hash) > 12 {
+		hash = hash[:12]
+	}
+	return hash
+}
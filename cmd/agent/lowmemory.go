@@ -0,0 +1,26 @@
+package main
+
+import (
+	"os"
+	"runtime/debug"
+
+	"github.com/edgetainer/edgetainer/internal/shared/logging"
+)
+
+// Go runtime settings of the low memory mode
+const (
+	lowMemoryGCPercent = 50       // Collect garbage once the heap grew by half instead of doubled
+	lowMemoryLimit     = 24 << 20 // Heap size the runtime collects harder to stay below
+)
+
+// applyLowMemoryRuntime makes the Go runtime collect garbage sooner, unless
+// GOGC or GOMEMLIMIT are set in the environment
+func applyLowMemoryRuntime(logger *logging.Logger) {
+	if os.Getenv("GOGC") == "" {
+		debug.SetGCPercent(lowMemoryGCPercent)
+	}
+	if os.Getenv("GOMEMLIMIT") == "" {
+		debug.SetMemoryLimit(lowMemoryLimit)
+	}
+	logger.Info("Low memory mode enabled, see docs/low-memory.md")
+}
@@ -6,13 +6,30 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
+	_ "time/tzdata" // Containers often lack the timezone database
 
+	"github.com/edgetainer/edgetainer/internal/agent/artifacts"
+	"github.com/edgetainer/edgetainer/internal/agent/autonomy"
+	"github.com/edgetainer/edgetainer/internal/agent/commands"
+	"github.com/edgetainer/edgetainer/internal/agent/control"
+	"github.com/edgetainer/edgetainer/internal/agent/diagnostics"
+	"github.com/edgetainer/edgetainer/internal/agent/display"
 	"github.com/edgetainer/edgetainer/internal/agent/docker"
+	"github.com/edgetainer/edgetainer/internal/agent/health"
+	"github.com/edgetainer/edgetainer/internal/agent/journal"
+	"github.com/edgetainer/edgetainer/internal/agent/location"
+	"github.com/edgetainer/edgetainer/internal/agent/plugins"
+	"github.com/edgetainer/edgetainer/internal/agent/pullproxy"
 	"github.com/edgetainer/edgetainer/internal/agent/ssh"
 	"github.com/edgetainer/edgetainer/internal/agent/system"
 	"github.com/edgetainer/edgetainer/internal/shared/config"
 	"github.com/edgetainer/edgetainer/internal/shared/logging"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+	"github.com/edgetainer/edgetainer/internal/shared/tracing"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
@@ -21,6 +38,7 @@ var (
 	configPath = flag.String("config", "agent-config.yaml", "Path to configuration file")
 	logLevel   = flag.String("log-level", "info", "Log level (debug, info, warn, error)")
 	version    = flag.Bool("version", false, "Print version information")
+	lowMemory  = flag.Bool("low-memory", false, "Reduce memory and CPU use for small devices, like system.low_memory")
 )
 
 // These variables are set during build time
@@ -31,6 +49,11 @@ var (
 )
 
 func main() {
+	// Local diagnostics subcommands talk to an already running agent
+	if len(os.Args) > 1 && isCLICommand(os.Args[1]) {
+		os.Exit(runCLI(os.Args[1], os.Args[2:]))
+	}
+
 	// Parse command line flags
 	flag.Parse()
 
@@ -71,17 +94,69 @@ func main() {
 		}
 	}
 
+	if *lowMemory {
+		cfg.ApplyLowMemory()
+	}
+
+	if !protocol.IsShutdownPolicy(cfg.Shutdown.Policy) {
+		logger.Warn(fmt.Sprintf("Unknown shutdown policy %q, leaving applications running", cfg.Shutdown.Policy))
+		cfg.Shutdown.Policy = protocol.ShutdownLeaveRunning
+	}
+
+	// Log to the configured file as well, -log-level takes precedence
+	agentLogLevel := cfg.Logging.Level
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "log-level" {
+			agentLogLevel = *logLevel
+		}
+	})
+	var tunnel atomic.Pointer[ssh.Client]
+	rotation := logging.Rotation{
+		MaxSizeMB:  cfg.Logging.MaxSizeMB,
+		MaxAgeDays: cfg.Logging.MaxAgeDays,
+		MaxBackups: cfg.Logging.MaxBackups,
+		Compress:   cfg.Logging.Compress,
+	}
+	if cfg.Logging.Ship {
+		// Rotated files are kept until they reach the server
+		rotation.BeforeRemove = func(path string) error {
+			client := tunnel.Load()
+			if client == nil {
+				return fmt.Errorf("tunnel not started")
+			}
+			return client.SendLogFile(path)
+		}
+	}
+	if err := logging.Initialize(agentLogLevel, cfg.Logging.LogFile, rotation); err != nil {
+		logger.Error("Failed to open log file, logging to the console only", err)
+	}
+	logger = logging.WithComponent("agent")
+
+	if cfg.System.LowMemory {
+		applyLowMemoryRuntime(logger)
+	}
+
 	// Create a context that will be canceled on SIGINT or SIGTERM
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	// Handle termination signals
-	signalCh := make(chan os.Signal, 1)
-	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		sig := <-signalCh
-		logger.Info(fmt.Sprintf("Received signal %s, shutting down", sig))
-		cancel()
+	// Export traces to the configured collector
+	shutdownTracing, err := tracing.Setup(ctx, "edgetainer-agent", BuildVersion, tracing.Options{
+		Enabled:     cfg.Tracing.Enabled,
+		Endpoint:    cfg.Tracing.Endpoint,
+		Insecure:    cfg.Tracing.Insecure,
+		Headers:     cfg.Tracing.Headers,
+		SampleRatio: cfg.Tracing.SampleRatio,
+	})
+	if err != nil {
+		logger.Fatal("Failed to set up tracing", err)
+	}
+	defer func() {
+		flushCtx, flushCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer flushCancel()
+		if err := shutdownTracing(flushCtx); err != nil {
+			logger.Warn(fmt.Sprintf("Failed to flush traces: %v", err))
+		}
 	}()
 
 	// Initialize system monitor
@@ -89,18 +164,176 @@ func main() {
 	if err != nil {
 		logger.Fatal("Failed to initialize system monitor", err)
 	}
+	sysMonitor.SetInterval(time.Duration(cfg.Intervals.Metrics) * time.Second)
+	sysMonitor.SetHostRoot(cfg.System.HostRoot)
+	sysMonitor.SetProtection(protectionSettings(cfg))
+
+	// Log in the timezone of the device rather than the one of the container
+	if timezone, err := sysMonitor.HostTimezone(); err == nil && timezone != "" {
+		if err := logging.SetTimezone(timezone); err != nil {
+			logger.Warn(fmt.Sprintf("Failed to log in timezone %s: %v", timezone, err))
+		}
+	}
 
 	// Initialize Docker manager
 	dockerMgr, err := docker.NewManager(ctx, cfg.Docker.ComposeDir, cfg.Docker.NetworkName)
 	if err != nil {
 		logger.Fatal("Failed to initialize Docker manager", err)
 	}
+	dockerMgr.SetPullRetry(max(cfg.Pull.Retries, 0), time.Duration(cfg.Pull.RetryDelay)*time.Second)
+	dockerMgr.SetResourceLimits(cfg.Resources)
+	dockerMgr.SetServiceDefaults(autonomy.ServiceDefaults(cfg))
+
+	// Optionally route image pulls through a rate limiting proxy
+	var pullProxy *pullproxy.Proxy
+	if cfg.Pull.ProxyListen != "" {
+		pullProxy = pullproxy.New(cfg.Pull.ProxyListen, cfg.Pull.RateLimit)
+		if err := pullProxy.Start(); err != nil {
+			logger.Error("Failed to start pull proxy", err)
+			pullProxy = nil
+		} else {
+			dockerMgr.SetPullProxy(pullProxy)
+		}
+	}
 
 	// Initialize SSH client for tunnel
 	sshClient, err := ssh.NewClient(ctx, cfg.Server.Host, cfg.SSH.Port, cfg.Device.ID, cfg.SSH.Key)
 	if err != nil {
 		logger.Fatal("Failed to initialize SSH client", err)
 	}
+	sshClient.SetKeepaliveInterval(time.Duration(cfg.Intervals.Keepalive) * time.Second)
+	sshClient.SetKeyAlgorithms(cfg.SSH.KeyAlgorithms, cfg.SSH.HostKeyAlgorithms)
+	setFailover(sshClient, cfg)
+	sshClient.SetForwardLimits(time.Duration(cfg.Forwards.IdleTimeout)*time.Second,
+		time.Duration(cfg.Forwards.MaxDuration)*time.Second, cfg.Forwards.MaxConnections)
+	sshClient.SetBuildInfo(protocol.BuildInfo{
+		Version:  BuildVersion,
+		Commit:   BuildCommit,
+		Date:     BuildDate,
+		Features: protocol.AgentFeatures,
+	})
+	attestHardware(sysMonitor, sshClient, cfg.System.AttestHardware, logger)
+	platforms := devicePlatforms(cfg)
+	sshClient.SetPlatforms(platforms)
+	dockerMgr.SetPlatforms(platforms)
+	reportOS(sysMonitor, sshClient, logger)
+	tunnel.Store(sshClient)
+
+	// Report image pull progress of deployments through the tunnel
+	dockerMgr.SetPullProgressHandler(func(progress *protocol.PullProgress) {
+		if err := sshClient.SendPullProgress(progress); err != nil {
+			logger.Debug(fmt.Sprintf("Failed to send pull progress: %v", err))
+		}
+	})
+	dockerMgr.SetDeployStageHandler(func(stage *protocol.DeployStage) {
+		if err := sshClient.SendDeployStage(stage); err != nil {
+			logger.Debug(fmt.Sprintf("Failed to send deployment stage: %v", err))
+		}
+	})
+
+	// Download the artifacts of deployed versions over the tunnel or their URL
+	artifactCache, err := artifacts.NewCache(cfg.Artifacts.CacheDir, time.Duration(cfg.Artifacts.MaxAgeDays)*24*time.Hour)
+	if err != nil {
+		logger.Error("Failed to create artifact cache, deployments with artifacts will fail", err)
+	} else {
+		artifactCache.SetSource(sshClient.FetchArtifact)
+		dockerMgr.SetArtifactCache(artifactCache)
+	}
+
+	// Read the device position from a GPS receiver if one is configured
+	var tracker *location.Tracker
+	if cfg.Location.Source != "" {
+		source, err := location.NewSource(cfg.Location.Source, cfg.Location.GPSD, cfg.Location.Device, cfg.Location.Baud)
+		if err != nil {
+			logger.Warn(fmt.Sprintf("Not reporting location: %v", err))
+		} else {
+			tracker = location.NewTracker(source)
+		}
+	}
+
+	// Report the device status, clock skew and location to the server
+	heartbeater := health.NewHeartbeater(sshClient, dockerMgr, sysMonitor, tracker, time.Duration(cfg.Intervals.Heartbeat)*time.Second)
+
+	// Apply configuration changes without restarting the agent
+	cfgReloader := newReloader(*configPath, cfg, sshClient, dockerMgr, sysMonitor, pullProxy, heartbeater)
+	go cfgReloader.Watch(ctx, time.Duration(cfg.Reload.WatchInterval)*time.Second)
+
+	// Handle termination and reload signals
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		for sig := range signalCh {
+			if sig == syscall.SIGHUP {
+				logger.Info("Received SIGHUP, reloading configuration")
+				if err := cfgReloader.Reload(); err != nil {
+					logger.Error("Failed to reload configuration", err)
+				}
+				continue
+			}
+
+			logger.Info(fmt.Sprintf("Received signal %s, shutting down", sig))
+			cancel()
+			return
+		}
+	}()
+
+	// A decommission from the server stops the agent like a signal would, but
+	// may override the shutdown policy
+	var shutdownMu sync.Mutex
+	shutdownPolicy := ""
+	shutdownReason := protocol.ShutdownReasonSignal
+	decommission := func(policy string) {
+		shutdownMu.Lock()
+		shutdownReason = protocol.ShutdownReasonDecommission
+		if policy != "" {
+			shutdownPolicy = policy
+		}
+		shutdownMu.Unlock()
+
+		// Give the command response time to reach the server
+		time.Sleep(time.Second)
+		cancel()
+	}
+
+	// Handle commands sent by the server through the tunnel
+	cmdHandler := commands.NewHandler(dockerMgr, sysMonitor, decommission)
+	sshClient.SetCommandHandler(cmdHandler.Handle)
+
+	// Collect diagnostics bundles on request and upload them through the tunnel
+	collector := diagnostics.NewCollector(dockerMgr, sysMonitor, cfgReloader.Current)
+	collector.SetUploader(sshClient.SendBundle)
+	cmdHandler.SetDiagnostics(collector)
+
+	// Capture packets on request, streaming them through the tunnel
+	capturer := diagnostics.NewCapturer(cfgReloader.Current)
+	capturer.SetSender(sshClient.SendCaptureChunk)
+	cmdHandler.SetCapturer(capturer)
+
+	// Run plugins contributing metrics to heartbeats and custom commands
+	pluginMgr := plugins.NewManager(cfgReloader.Current)
+	if pluginMgr.Enabled() {
+		if err := pluginMgr.Discover(ctx); err != nil {
+			logger.Warn(err.Error())
+		}
+	}
+	heartbeater.SetPlugins(pluginMgr)
+	cmdHandler.SetPlugins(pluginMgr)
+
+	// Drive the kiosk display as configured by the server
+	displayMgr := display.NewManager(cfgReloader.Current)
+	cmdHandler.SetDisplay(displayMgr)
+
+	// Report and restart the host services listed in the configuration
+	heartbeater.SetHostServices(cfgReloader.Current)
+	cmdHandler.SetHostServices(cfgReloader.Current)
+
+	// Ship the journal of the host units listed in the configuration
+	journalShipper := journal.NewShipper(cfgReloader.Current, sshClient.SendJournal)
+
+	// Keep applications running and apply staged updates without the
+	// server, reporting what was done once it can be reached
+	autonomyRunner := autonomy.NewRunner(cfgReloader.Current, dockerMgr, sshClient.SendAutonomy)
+	dockerMgr.SetAutonomyHandler(autonomyRunner.Record)
 
 	// Start the services
 	sysMonitor.Start()
@@ -115,14 +348,123 @@ func main() {
 		logger.Fatal("Failed to connect SSH client", err)
 	}
 
+	if tracker != nil {
+		go tracker.Run(ctx)
+	}
+	go heartbeater.Run(ctx)
+	go displayMgr.Run(ctx)
+	go journalShipper.Run(ctx)
+	go autonomyRunner.Run(ctx)
+
+	// Start local health endpoint
+	healthServer := health.NewServer(cfg.Health.Listen, cfg.Device.ID, sshClient, dockerMgr, sysMonitor)
+	if cfg.Health.Enabled {
+		if err := healthServer.Start(); err != nil {
+			logger.Error("Failed to start health endpoint", err)
+		}
+	}
+
+	// Start local control socket for on-site diagnostics
+	controlServer := control.NewServer(cfg.Control.Socket, healthServer, sshClient, dockerMgr)
+	if err := controlServer.Start(); err != nil {
+		logger.Error("Failed to start control socket", err)
+	}
+
 	// Main agent loop - wait for termination
 	<-ctx.Done()
 
+	// Apply the shutdown policy to running applications and report the final
+	// state to the server while the tunnel is still up
+	finalCfg := cfgReloader.Current()
+	shutdownMu.Lock()
+	if shutdownPolicy == "" {
+		shutdownPolicy = finalCfg.Shutdown.Policy
+	}
+	report := &protocol.ShutdownReport{
+		DeviceID:  cfg.Device.ID,
+		Reason:    shutdownReason,
+		Policy:    shutdownPolicy,
+		Timestamp: time.Now(),
+	}
+	shutdownMu.Unlock()
+
+	logger.Info(fmt.Sprintf("Applying shutdown policy %s", report.Policy))
+	report.Apps = dockerMgr.ApplyShutdownPolicy(report.Policy, finalCfg.Shutdown.CriticalApps)
+	if err := sshClient.SendShutdownReport(report, 5*time.Second); err != nil {
+		logger.Warn(fmt.Sprintf("Failed to report final state to server: %v", err))
+	}
+
 	// Perform graceful shutdown
 	logger.Info("Shutting down services")
+	controlServer.Shutdown()
+	healthServer.Shutdown()
+	if pullProxy != nil {
+		pullProxy.Stop()
+	}
 	sshClient.Disconnect()
 	dockerMgr.Stop()
 	sysMonitor.Stop()
 
 	logger.Info("Edgetainer agent stopped")
 }
+
+// protectionSettings returns the resources guaranteed to the agent and the
+// Docker daemon as configured
+func protectionSettings(cfg *config.AgentConfig) system.ProtectionSettings {
+	return system.ProtectionSettings{
+		Enabled:        cfg.Protection.Enabled,
+		AgentUnit:      cfg.Protection.AgentUnit,
+		DockerUnit:     cfg.Protection.DockerUnit,
+		AgentMemoryMB:  cfg.Protection.AgentMemoryMB,
+		DockerMemoryMB: cfg.Protection.DockerMemoryMB,
+		CPUWeight:      cfg.Protection.CPUWeight,
+		OOMScoreAdjust: cfg.Protection.OOMScoreAdjust,
+		Interval:       time.Duration(cfg.Protection.CheckInterval) * time.Second,
+	}
+}
+
+// setFailover sets the backup servers of the tunnel as configured
+func setFailover(sshClient *ssh.Client, cfg *config.AgentConfig) {
+	backups := make([]ssh.Endpoint, 0, len(cfg.Server.Backups))
+	for _, backup := range cfg.Server.Backups {
+		// Validated when the configuration was loaded
+		host, port, _ := config.ParseEndpoint(backup, cfg.SSH.Port)
+		backups = append(backups, ssh.Endpoint{Host: host, Port: port})
+	}
+	sshClient.SetFailover(backups, time.Duration(cfg.Server.FailoverAfter)*time.Second,
+		time.Duration(cfg.Server.FailbackInterval)*time.Second)
+}
+
+// devicePlatforms returns the platforms the device runs images of, its own
+// first and then those configured as emulated
+func devicePlatforms(cfg *config.AgentConfig) []string {
+	platforms, _ := protocol.NormalizePlatforms(append([]string{system.Platform()}, cfg.Docker.EmulatedPlatforms...))
+	return platforms
+}
+
+// reportOS reports the operating system of the host in heartbeats, which the
+// server checks the requirements of deployments against
+func reportOS(sysMonitor *system.Monitor, sshClient *ssh.Client, logger *logging.Logger) {
+	info, err := sysMonitor.OSInfo()
+	if err != nil {
+		logger.Warn(fmt.Sprintf("Failed to identify the operating system: %v", err))
+	}
+	sshClient.SetOSInfo(info)
+}
+
+// attestHardware reports the hardware ID of the device in heartbeats when
+// enabled, so the server can bind the device to its hardware
+func attestHardware(sysMonitor *system.Monitor, sshClient *ssh.Client, enabled bool, logger *logging.Logger) {
+	if !enabled {
+		sshClient.SetHardwareID("")
+		return
+	}
+
+	hardwareID, err := sysMonitor.HardwareID()
+	if err != nil {
+		logger.Warn(fmt.Sprintf("Failed to attest hardware, reporting none: %v", err))
+		sshClient.SetHardwareID("")
+		return
+	}
+	sshClient.SetHardwareID(hardwareID)
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/agent/autonomy"
+	"github.com/edgetainer/edgetainer/internal/agent/docker"
+	"github.com/edgetainer/edgetainer/internal/agent/health"
+	"github.com/edgetainer/edgetainer/internal/agent/pullproxy"
+	"github.com/edgetainer/edgetainer/internal/agent/ssh"
+	"github.com/edgetainer/edgetainer/internal/agent/system"
+	"github.com/edgetainer/edgetainer/internal/shared/config"
+	"github.com/edgetainer/edgetainer/internal/shared/logging"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+// reloader re-reads the agent configuration and applies the changes to the
+// running services. Settings that can be changed in place are applied without
+// touching the tunnel; the tunnel is only re-dialed when the server address or
+// key changes.
+type reloader struct {
+	path       string
+	sshClient  *ssh.Client
+	dockerMgr  *docker.Manager
+	sysMonitor *system.Monitor
+	pullProxy  *pullproxy.Proxy // Nil when the pull proxy is disabled
+	heartbeat  *health.Heartbeater
+	logger     *logging.Logger
+
+	mu      sync.Mutex
+	cfg     *config.AgentConfig
+	modTime time.Time
+}
+
+// newReloader creates a reloader for the configuration loaded from path
+func newReloader(path string, cfg *config.AgentConfig, sshClient *ssh.Client, dockerMgr *docker.Manager, sysMonitor *system.Monitor, pullProxy *pullproxy.Proxy, heartbeat *health.Heartbeater) *reloader {
+	r := &reloader{
+		path:       path,
+		cfg:        cfg,
+		sshClient:  sshClient,
+		dockerMgr:  dockerMgr,
+		sysMonitor: sysMonitor,
+		pullProxy:  pullProxy,
+		heartbeat:  heartbeat,
+		logger:     logging.WithComponent("config-reload"),
+	}
+
+	if info, err := os.Stat(path); err == nil {
+		r.modTime = info.ModTime()
+	}
+
+	return r
+}
+
+// Current returns the configuration currently in effect
+func (r *reloader) Current() *config.AgentConfig {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.cfg
+}
+
+// Watch polls the configuration file and reloads it when it changes. Polling
+// keeps the agent free of platform specific file notification code.
+func (r *reloader) Watch(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			info, err := os.Stat(r.path)
+			if err != nil {
+				continue
+			}
+
+			r.mu.Lock()
+			changed := !info.ModTime().Equal(r.modTime)
+			r.mu.Unlock()
+
+			if changed {
+				r.logger.Info("Configuration file changed")
+				if err := r.Reload(); err != nil {
+					r.logger.Error("Failed to reload configuration", err)
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Reload re-reads the configuration file and applies what changed. An invalid
+// file leaves the current configuration in effect.
+func (r *reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if info, err := os.Stat(r.path); err == nil {
+		r.modTime = info.ModTime()
+	}
+
+	next, err := config.LoadAgentConfig(r.path)
+	if err != nil {
+		return err
+	}
+
+	if next.Shutdown.Policy != "" && !protocol.IsShutdownPolicy(next.Shutdown.Policy) {
+		return fmt.Errorf("unknown shutdown policy: %s", next.Shutdown.Policy)
+	}
+
+	prev := r.cfg
+
+	// The low memory mode, from the file or -low-memory, lasts until restart
+	if prev.System.LowMemory {
+		next.ApplyLowMemory()
+	} else if next.System.LowMemory {
+		r.logger.Warn("Low memory mode enabled, restart the agent to apply it fully")
+	}
+
+	// The device identity cannot change under a running tunnel
+	if next.Device.ID != prev.Device.ID {
+		r.logger.Warn("Device ID changed in configuration, keeping the current ID until restart")
+		next.Device.ID = prev.Device.ID
+	}
+
+	if next.Logging.Level != prev.Logging.Level {
+		if err := logging.SetLevel(next.Logging.Level); err != nil {
+			return err
+		}
+		r.logger.Info(fmt.Sprintf("Log level set to %s", next.Logging.Level))
+	}
+
+	if next.Intervals.Metrics != prev.Intervals.Metrics {
+		r.sysMonitor.SetInterval(time.Duration(next.Intervals.Metrics) * time.Second)
+	}
+
+	if next.Intervals.Keepalive != prev.Intervals.Keepalive {
+		r.sshClient.SetKeepaliveInterval(time.Duration(next.Intervals.Keepalive) * time.Second)
+		r.logger.Info(fmt.Sprintf("Keepalive interval set to %ds", next.Intervals.Keepalive))
+	}
+
+	if !reflect.DeepEqual(next.SSH.KeyAlgorithms, prev.SSH.KeyAlgorithms) || !reflect.DeepEqual(next.SSH.HostKeyAlgorithms, prev.SSH.HostKeyAlgorithms) {
+		r.sshClient.SetKeyAlgorithms(next.SSH.KeyAlgorithms, next.SSH.HostKeyAlgorithms)
+		r.logger.Info("Key algorithms updated, they apply from the next connection")
+	}
+
+	if next.Forwards != prev.Forwards {
+		r.sshClient.SetForwardLimits(time.Duration(next.Forwards.IdleTimeout)*time.Second,
+			time.Duration(next.Forwards.MaxDuration)*time.Second, next.Forwards.MaxConnections)
+		r.logger.Info("Forwarded connection limits updated")
+	}
+
+	if next.Intervals.Heartbeat != prev.Intervals.Heartbeat {
+		r.heartbeat.SetInterval(time.Duration(next.Intervals.Heartbeat) * time.Second)
+		r.logger.Info(fmt.Sprintf("Heartbeat interval set to %ds", next.Intervals.Heartbeat))
+	}
+
+	if next.System.HostRoot != prev.System.HostRoot {
+		r.sysMonitor.SetHostRoot(next.System.HostRoot)
+		reportOS(r.sysMonitor, r.sshClient, r.logger)
+	}
+	if next.System != prev.System {
+		attestHardware(r.sysMonitor, r.sshClient, next.System.AttestHardware, r.logger)
+	}
+
+	if next.Protection != prev.Protection || next.System.HostRoot != prev.System.HostRoot {
+		r.sysMonitor.SetProtection(protectionSettings(next))
+		r.logger.Info("Protection of the agent and Docker updated")
+	}
+
+	if next.Docker.ComposeDir != prev.Docker.ComposeDir {
+		if err := r.dockerMgr.SetComposeDir(next.Docker.ComposeDir); err != nil {
+			r.logger.Error("Failed to switch compose directory", err)
+		}
+	}
+
+	if next.Pull.RateLimit != prev.Pull.RateLimit && r.pullProxy != nil {
+		r.pullProxy.SetDefaultRate(next.Pull.RateLimit)
+		r.logger.Info(fmt.Sprintf("Default pull rate set to %d kbit/s", next.Pull.RateLimit))
+	}
+
+	if next.Pull.Retries != prev.Pull.Retries || next.Pull.RetryDelay != prev.Pull.RetryDelay {
+		r.dockerMgr.SetPullRetry(max(next.Pull.Retries, 0), time.Duration(next.Pull.RetryDelay)*time.Second)
+		r.logger.Info(fmt.Sprintf("Image pulls retried %d times, starting after %ds", max(next.Pull.Retries, 0), next.Pull.RetryDelay))
+	}
+
+	if next.Resources != prev.Resources {
+		r.dockerMgr.SetResourceLimits(next.Resources)
+		r.logger.Info("Resource limits updated, they apply from the next deployment")
+	}
+
+	if autonomy.ServiceDefaults(next) != autonomy.ServiceDefaults(prev) {
+		r.dockerMgr.SetServiceDefaults(autonomy.ServiceDefaults(next))
+		r.logger.Info("Restart policy and log rotation of services updated, they apply from the next deployment")
+	}
+
+	if !reflect.DeepEqual(next.Docker.EmulatedPlatforms, prev.Docker.EmulatedPlatforms) {
+		platforms := devicePlatforms(next)
+		r.sshClient.SetPlatforms(platforms)
+		r.dockerMgr.SetPlatforms(platforms)
+		r.logger.Info(fmt.Sprintf("Device runs images of %s", strings.Join(platforms, ", ")))
+	}
+
+	if !reflect.DeepEqual(next.Server.Backups, prev.Server.Backups) || next.SSH.Port != prev.SSH.Port ||
+		next.Server.FailoverAfter != prev.Server.FailoverAfter || next.Server.FailbackInterval != prev.Server.FailbackInterval {
+		setFailover(r.sshClient, next)
+		r.logger.Info("Backup servers updated")
+	}
+
+	if r.sshClient.UpdateTarget(next.Server.Host, next.SSH.Port, next.SSH.Key) {
+		r.logger.Info(fmt.Sprintf("Tunnel target changed, reconnecting to %s", net.JoinHostPort(next.Server.Host, strconv.Itoa(next.SSH.Port))))
+	}
+
+	if next.Health != prev.Health || next.Control != prev.Control || next.Docker.NetworkName != prev.Docker.NetworkName ||
+		next.Pull.ProxyListen != prev.Pull.ProxyListen {
+		r.logger.Warn("Health, control, network or pull proxy settings changed, restart the agent to apply them")
+	}
+
+	nextLogging, prevLogging := next.Logging, prev.Logging
+	nextLogging.Level, prevLogging.Level = "", ""
+	if nextLogging != prevLogging {
+		r.logger.Warn("Log file settings changed, restart the agent to apply them")
+	}
+
+	if next.Location != prev.Location {
+		r.logger.Warn("Location settings changed, restart the agent to apply them")
+	}
+
+	if !reflect.DeepEqual(next.Tracing, prev.Tracing) {
+		r.logger.Warn("Tracing settings changed, restart the agent to apply them")
+	}
+
+	if !reflect.DeepEqual(next.Shutdown, prev.Shutdown) {
+		r.logger.Info(fmt.Sprintf("Shutdown policy set to %s", next.Shutdown.Policy))
+	}
+
+	r.cfg = next
+	r.logger.Info("Configuration reloaded")
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/devicesim"
+	"github.com/edgetainer/edgetainer/internal/shared/logging"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	serverAddr = flag.String("server", "localhost:2222", "Address of the SSH tunnel server")
+	count      = flag.Int("count", 10, "Number of simulated devices")
+	prefix     = flag.String("prefix", "sim", "Prefix of the simulated device IDs")
+	keyDir     = flag.String("keys", "devicesim-keys", "Directory keeping the device keys across runs")
+	scriptPath = flag.String("script", "", "YAML file scripting the answers to commands, all succeed without one")
+	heartbeat  = flag.Duration("heartbeat", devicesim.DefaultHeartbeat, "Heartbeat interval")
+	reconnect  = flag.Duration("reconnect", devicesim.DefaultReconnect, "Delay before reconnecting, with up to the same again as jitter")
+	ramp       = flag.Duration("ramp", 10*time.Millisecond, "Delay between starting devices")
+	storm      = flag.Duration("storm", 0, "Drop every connection at this interval to simulate reconnection storms, 0 to disable")
+	statsEvery = flag.Duration("stats", 10*time.Second, "Interval of the statistics printed to stdout")
+	provision  = flag.String("provision", "", "Server configuration whose database the devices are registered in before connecting")
+	fleetID    = flag.String("fleet", "", "ID of the fleet provisioned devices are added to")
+	logLevel   = flag.String("log-level", "info", "Log level (debug, info, warn, error)")
+)
+
+func main() {
+	flag.Parse()
+
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	level, err := zerolog.ParseLevel(*logLevel)
+	if err != nil {
+		level = zerolog.InfoLevel
+	}
+	zerolog.SetGlobalLevel(level)
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+
+	logger := logging.WithComponent("devicesim")
+
+	script := devicesim.DefaultScript()
+	if *scriptPath != "" {
+		script, err = devicesim.LoadScript(*scriptPath)
+		if err != nil {
+			logger.Fatal("Failed to load script", err)
+		}
+	}
+
+	fleet, err := devicesim.NewFleet(devicesim.FleetConfig{
+		Count:     *count,
+		Prefix:    *prefix,
+		KeyDir:    *keyDir,
+		Dial:      devicesim.TCPDialer(*serverAddr),
+		Script:    script,
+		Heartbeat: *heartbeat,
+		Reconnect: *reconnect,
+		Ramp:      *ramp,
+	})
+	if err != nil {
+		logger.Fatal("Failed to create simulated devices", err)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	if *provision != "" {
+		if err := fleet.ProvisionServer(ctx, *provision, *fleetID); err != nil {
+			logger.Fatal("Failed to provision simulated devices", err)
+		}
+		logger.Info(fmt.Sprintf("Provisioned %d devices", len(fleet.Devices)))
+	}
+
+	logger.Info(fmt.Sprintf("Starting %d simulated devices against %s", len(fleet.Devices), *serverAddr))
+
+	go reportStats(ctx, fleet, *statsEvery)
+	if *storm > 0 {
+		go func() {
+			ticker := time.NewTicker(*storm)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					logger.Info("Dropping every connection")
+					fleet.DisconnectAll()
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	fleet.Run(ctx)
+	printStats(fleet)
+}
+
+// reportStats prints the fleet statistics at every interval
+func reportStats(ctx context.Context, fleet *devicesim.Fleet, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			printStats(fleet)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// printStats prints the fleet statistics as a JSON line
+func printStats(fleet *devicesim.Fleet) {
+	data, err := json.Marshal(fleet.Stats())
+	if err != nil {
+		return
+	}
+	fmt.Println(string(data))
+}
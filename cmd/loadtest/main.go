@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/devicesim"
+	"github.com/edgetainer/edgetainer/internal/shared/logging"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	serverAddr     = flag.String("server", "localhost:2222", "Address of the SSH tunnel server")
+	count          = flag.Int("count", 1000, "Number of simulated devices")
+	prefix         = flag.String("prefix", "load", "Prefix of the simulated device IDs")
+	keyDir         = flag.String("keys", "loadtest-keys", "Directory keeping the device keys across runs")
+	provision      = flag.String("provision", "", "Server configuration whose database the devices are registered in before connecting")
+	fleetID        = flag.String("fleet", "", "ID of the fleet provisioned devices are added to")
+	ramp           = flag.Duration("ramp", 2*time.Millisecond, "Delay between starting devices")
+	connectTimeout = flag.Duration("connect-timeout", 10*time.Minute, "How long to wait for every device to connect")
+	hold           = flag.Duration("duration", 5*time.Minute, "How long to hold the connections once the devices connected")
+	heartbeat      = flag.Duration("heartbeat", devicesim.DefaultHeartbeat, "Heartbeat interval of the devices")
+	forwards       = flag.Int("forwards", 1, "Remote port forwards each device requests")
+	metricsURL     = flag.String("metrics", "", "Metrics URL of the server, e.g. http://localhost:8080/metrics, for server figures")
+	metricsToken   = flag.String("metrics-token", os.Getenv("EDGETAINER_METRICS_TOKEN"), "Bearer token for the metrics URL")
+	reportPath     = flag.String("report", "", "File the report is written to as JSON")
+	logLevel       = flag.String("log-level", "warn", "Log level (debug, info, warn, error)")
+)
+
+func main() {
+	flag.Parse()
+
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	level, err := zerolog.ParseLevel(*logLevel)
+	if err != nil {
+		level = zerolog.WarnLevel
+	}
+	zerolog.SetGlobalLevel(level)
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+
+	logger := logging.WithComponent("loadtest")
+
+	observer := newRecorder()
+	fleet, err := devicesim.NewFleet(devicesim.FleetConfig{
+		Count:     *count,
+		Prefix:    *prefix,
+		KeyDir:    *keyDir,
+		Dial:      devicesim.TCPDialer(*serverAddr),
+		Heartbeat: *heartbeat,
+		Ramp:      *ramp,
+		Forwards:  *forwards,
+		Observer:  observer,
+	})
+	if err != nil {
+		logger.Fatal("Failed to create simulated devices", err)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	if *provision != "" {
+		fmt.Fprintf(os.Stderr, "Provisioning %d devices\n", len(fleet.Devices))
+		if err := fleet.ProvisionServer(ctx, *provision, *fleetID); err != nil {
+			logger.Fatal("Failed to provision simulated devices", err)
+		}
+	}
+
+	metrics := newScraper(*metricsURL, *metricsToken)
+	before, err := metrics.scrape(ctx)
+	if err != nil {
+		logger.Fatal("Failed to read server metrics", err)
+	}
+
+	report := run(ctx, fleet, observer, metrics, before)
+
+	report.write(os.Stdout)
+	if *reportPath != "" {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			logger.Fatal("Failed to marshal report", err)
+		}
+		if err := os.WriteFile(*reportPath, append(data, '\n'), 0644); err != nil {
+			logger.Fatal("Failed to write report", err)
+		}
+	}
+}
+
+// run connects the fleet, holds the connections and reports what happened.
+// before holds the server metrics before any device connected.
+func run(ctx context.Context, fleet *devicesim.Fleet, observer *recorder, metrics *scraper, before metricSet) *Report {
+	report := &Report{Devices: len(fleet.Devices)}
+
+	runCtx, stop := context.WithCancel(ctx)
+	done := make(chan struct{})
+	start := time.Now()
+	go func() {
+		fleet.Run(runCtx)
+		close(done)
+	}()
+	defer func() {
+		stop()
+		<-done
+	}()
+
+	// Ramp: wait until every device connected
+	fmt.Fprintf(os.Stderr, "Connecting %d devices to %s\n", len(fleet.Devices), *serverAddr)
+	waitCtx, cancelWait := context.WithTimeout(ctx, *connectTimeout)
+	if err := fleet.WaitConnected(waitCtx); err != nil {
+		fmt.Fprintf(os.Stderr, "Not every device connected: %v\n", err)
+	}
+	cancelWait()
+	report.RampSeconds = time.Since(start).Seconds()
+
+	ramped := fleet.Stats()
+	report.Connected = ramped.Connected
+	afterRamp, err := metrics.scrape(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read server metrics: %v\n", err)
+	}
+
+	// Hold: keep the connections and heartbeats going
+	fmt.Fprintf(os.Stderr, "Holding %d connections for %s\n", ramped.Connected, *hold)
+	holdStart := time.Now()
+	select {
+	case <-time.After(*hold):
+	case <-ctx.Done():
+	}
+	report.HoldSeconds = time.Since(holdStart).Seconds()
+
+	held := fleet.Stats()
+	end, err := metrics.scrape(context.Background())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read server metrics: %v\n", err)
+	}
+
+	report.Disconnects = held.Disconnects - ramped.Disconnects
+	report.Heartbeats.Sent = held.Heartbeats - ramped.Heartbeats
+	if report.HoldSeconds > 0 {
+		report.Heartbeats.SentPerSecond = float64(report.Heartbeats.Sent) / report.HoldSeconds
+	}
+
+	observer.mu.Lock()
+	report.Handshakes = summarize(observer.handshakes, observer.handshakeFails)
+	report.Forwards.Latency = summarize(observer.forwards, observer.forwardFails)
+	report.Forwards.DistinctPorts = len(observer.ports)
+	for _, allocations := range observer.ports {
+		report.Forwards.Reallocated += allocations - 1
+	}
+	observer.mu.Unlock()
+
+	if before != nil && afterRamp != nil && end != nil {
+		report.Heartbeats.Written = end[metricWritten] - afterRamp[metricWritten]
+		if report.HoldSeconds > 0 {
+			report.Heartbeats.WrittenPerSecond = report.Heartbeats.Written / report.HoldSeconds
+		}
+		report.Heartbeats.Coalesced = end[metricCoalesced] - afterRamp[metricCoalesced]
+		report.Heartbeats.Dropped = end[metricDropped] - afterRamp[metricDropped]
+		report.Heartbeats.FlushFailures = end[metricFlushFails] - afterRamp[metricFlushFails]
+		report.Heartbeats.QueueDepth = end[metricQueueDepth]
+
+		server := &ServerReport{
+			ConnectedDevices: afterRamp[metricConnected],
+			HeapInuseBytes:   end[metricHeap],
+			AuthRejections:   end[metricAuthReject] - before[metricAuthReject],
+		}
+		if added := afterRamp[metricConnected] - before[metricConnected]; added > 0 {
+			server.HeapPerConnection = (afterRamp[metricHeap] - before[metricHeap]) / added
+			server.GoroutinesPerConnection = (afterRamp[metricGoroutines] - before[metricGoroutines]) / added
+		}
+		report.Server = server
+	}
+
+	return report
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+// recorder collects what the simulated devices observe. It implements
+// devicesim.Observer.
+type recorder struct {
+	mu             sync.Mutex
+	handshakes     []time.Duration
+	handshakeFails int
+	forwards       []time.Duration
+	forwardFails   int
+	ports          map[int]int // Allocations of each server port
+}
+
+func newRecorder() *recorder {
+	return &recorder{ports: make(map[int]int)}
+}
+
+func (r *recorder) Handshake(deviceID string, latency time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err != nil {
+		r.handshakeFails++
+		return
+	}
+	r.handshakes = append(r.handshakes, latency)
+}
+
+func (r *recorder) Forward(deviceID string, port int, latency time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err != nil {
+		r.forwardFails++
+		return
+	}
+	r.forwards = append(r.forwards, latency)
+	r.ports[port]++
+}
+
+// Latency summarizes latencies in milliseconds
+type Latency struct {
+	Count  int     `json:"count"`
+	Failed int     `json:"failed"`
+	P50    float64 `json:"p50_ms"`
+	P90    float64 `json:"p90_ms"`
+	P99    float64 `json:"p99_ms"`
+	Max    float64 `json:"max_ms"`
+}
+
+// summarize computes the percentiles of latencies
+func summarize(latencies []time.Duration, failed int) Latency {
+	summary := Latency{Count: len(latencies), Failed: failed}
+	if len(latencies) == 0 {
+		return summary
+	}
+
+	sorted := slices.Clone(latencies)
+	slices.Sort(sorted)
+	percentile := func(p float64) float64 {
+		i := int(math.Ceil(p*float64(len(sorted)))) - 1
+		return float64(sorted[max(i, 0)]) / float64(time.Millisecond)
+	}
+	summary.P50 = percentile(0.50)
+	summary.P90 = percentile(0.90)
+	summary.P99 = percentile(0.99)
+	summary.Max = float64(sorted[len(sorted)-1]) / float64(time.Millisecond)
+	return summary
+}
+
+// Report is the outcome of a load test
+type Report struct {
+	Devices     int     `json:"devices"`
+	Connected   int     `json:"connected"`    // Devices connected once the ramp ended
+	RampSeconds float64 `json:"ramp_seconds"` // Until every device connected or the connect timeout
+	HoldSeconds float64 `json:"hold_seconds"`
+	Disconnects int64   `json:"disconnects"` // Connections lost while holding
+
+	Handshakes Latency `json:"handshakes"`
+
+	Forwards struct {
+		Latency
+		DistinctPorts int `json:"distinct_ports"`
+		Reallocated   int `json:"reallocated"` // Allocations of a port that was allocated before
+	} `json:"forwards"`
+
+	Heartbeats struct {
+		Sent             int64   `json:"sent"`
+		SentPerSecond    float64 `json:"sent_per_second"`
+		Written          float64 `json:"written,omitempty"`
+		WrittenPerSecond float64 `json:"written_per_second,omitempty"`
+		Coalesced        float64 `json:"coalesced,omitempty"`
+		Dropped          float64 `json:"dropped,omitempty"`
+		FlushFailures    float64 `json:"flush_failures,omitempty"`
+		QueueDepth       float64 `json:"queue_depth,omitempty"` // At the end of the test
+	} `json:"heartbeats"`
+
+	// Server figures, only with -metrics
+	Server *ServerReport `json:"server,omitempty"`
+}
+
+// ServerReport describes the load on the server process
+type ServerReport struct {
+	ConnectedDevices        float64 `json:"connected_devices"`
+	HeapInuseBytes          float64 `json:"heap_inuse_bytes"`
+	HeapPerConnection       float64 `json:"heap_per_connection_bytes"` // Heap growth during the ramp per connected device
+	GoroutinesPerConnection float64 `json:"goroutines_per_connection"`
+	AuthRejections          float64 `json:"auth_rejections"`
+}
+
+// write prints the report for humans
+func (r *Report) write(w io.Writer) {
+	fmt.Fprintf(w, "Devices:           %d, %d connected after %.1fs\n", r.Devices, r.Connected, r.RampSeconds)
+	fmt.Fprintf(w, "Held for:          %.0fs, %d connections lost\n", r.HoldSeconds, r.Disconnects)
+	fmt.Fprintf(w, "Handshakes:        %d ok, %d failed, p50 %.1fms p90 %.1fms p99 %.1fms max %.1fms\n",
+		r.Handshakes.Count, r.Handshakes.Failed, r.Handshakes.P50, r.Handshakes.P90, r.Handshakes.P99, r.Handshakes.Max)
+	if r.Forwards.Count > 0 || r.Forwards.Failed > 0 {
+		fmt.Fprintf(w, "Port forwards:     %d ok, %d failed, %d distinct ports, %d reallocated, p50 %.1fms p99 %.1fms\n",
+			r.Forwards.Count, r.Forwards.Failed, r.Forwards.DistinctPorts, r.Forwards.Reallocated, r.Forwards.P50, r.Forwards.P99)
+	}
+	fmt.Fprintf(w, "Heartbeats sent:   %d (%.1f/s)\n", r.Heartbeats.Sent, r.Heartbeats.SentPerSecond)
+	if r.Server == nil {
+		return
+	}
+	fmt.Fprintf(w, "Heartbeat writes:  %.0f (%.1f/s), %.0f coalesced, %.0f dropped, %.0f failed flushes, queue %.0f\n",
+		r.Heartbeats.Written, r.Heartbeats.WrittenPerSecond, r.Heartbeats.Coalesced, r.Heartbeats.Dropped,
+		r.Heartbeats.FlushFailures, r.Heartbeats.QueueDepth)
+	fmt.Fprintf(w, "Server:            %.0f connected, %.1f MiB heap, %.1f KiB and %.1f goroutines per connection, %.0f auth rejections\n",
+		r.Server.ConnectedDevices, r.Server.HeapInuseBytes/(1<<20), r.Server.HeapPerConnection/1024,
+		r.Server.GoroutinesPerConnection, r.Server.AuthRejections)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Server metrics read by the load test
+const (
+	metricHeap       = "edgetainer_go_heap_inuse_bytes"
+	metricGoroutines = "edgetainer_go_goroutines"
+	metricConnected  = "edgetainer_ssh_connected_devices"
+	metricWritten    = "edgetainer_ssh_heartbeats_written_total"
+	metricDropped    = "edgetainer_ssh_heartbeats_dropped_total"
+	metricCoalesced  = "edgetainer_ssh_heartbeats_coalesced_total"
+	metricFlushFails = "edgetainer_ssh_heartbeat_flush_failures_total"
+	metricQueueDepth = "edgetainer_ssh_heartbeat_queue_depth"
+	metricAuthReject = "edgetainer_ssh_auth_rejections_total"
+)
+
+// scraper reads the Prometheus metrics of the server
+type scraper struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// metricSet holds scraped values by metric name, summed over labels
+type metricSet map[string]float64
+
+// scrape fetches the current metrics, nil when no metrics URL is set
+func (s *scraper) scrape(ctx context.Context) (metricSet, error) {
+	if s == nil {
+		return nil, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scrape metrics: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to scrape metrics: %s", resp.Status)
+	}
+
+	set := make(metricSet)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		value, err := strconv.ParseFloat(fields[len(fields)-1], 64)
+		if err != nil {
+			continue
+		}
+		name, _, _ := strings.Cut(fields[0], "{")
+		set[name] += value
+	}
+	return set, scanner.Err()
+}
+
+// newScraper returns a scraper of url, nil if url is empty
+func newScraper(url, token string) *scraper {
+	if url == "" {
+		return nil
+	}
+	return &scraper{url: url, token: token, client: &http.Client{Timeout: 30 * time.Second}}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"math/big"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/server/db"
+	"github.com/edgetainer/edgetainer/internal/server/ssh"
+	"github.com/edgetainer/edgetainer/internal/shared/config"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+)
+
+// adminActor is the actor of admin CLI actions in the audit log
+const adminActor = "admin-cli"
+
+// adminOptions holds the flags shared by all admin subcommands
+type adminOptions struct {
+	username      string
+	email         string
+	role          string
+	passwordStdin bool
+	olderThan     time.Duration
+	output        string
+}
+
+// adminCommand is an admin subcommand. Those that do not need the database
+// get nil for it.
+type adminCommand struct {
+	run         func(ctx context.Context, cfg *config.ServerConfig, database *db.DB, opts adminOptions) error
+	usage       string
+	needsDB     bool
+	description string
+}
+
+// adminCommands lists the maintenance subcommands of edgetainer-server admin
+var adminCommands = map[string]adminCommand{
+	"create-user":        {runCreateUser, "-username NAME -email EMAIL [-role admin|operator|viewer] [-password-stdin]", true, "Create a user who logs in with a password"},
+	"reset-password":     {runResetPassword, "-username NAME [-password-stdin]", true, "Set a new password, restoring the user if deleted"},
+	"rotate-host-key":    {runRotateHostKey, "", false, "Replace the SSH host key, applies from the next start"},
+	"reindex":            {runReindex, "", true, "Rebuild the indexes of the database"},
+	"purge-soft-deleted": {runPurgeSoftDeleted, "[-older-than 720h]", true, "Remove rows deleted longer ago than the given time"},
+	"export":             {runExport, "[-o FILE]", true, "Write every table as JSON, to stdout without -o"},
+}
+
+// adminUsage prints the admin subcommands
+func adminUsage() {
+	names := make([]string, 0, len(adminCommands))
+	for name := range adminCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(os.Stderr, "Usage: edgetainer-server admin <command> [-config FILE] [flags]")
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-20s %s\n", name, adminCommands[name].description)
+		if usage := adminCommands[name].usage; usage != "" {
+			fmt.Fprintf(os.Stderr, "  %-20s   %s\n", "", usage)
+		}
+	}
+}
+
+// runAdmin runs a maintenance subcommand against the configuration and the
+// database of the server, which may be running at the same time
+func runAdmin(args []string) int {
+	if len(args) == 0 {
+		adminUsage()
+		return 2
+	}
+	command, ok := adminCommands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown admin command %q\n\n", args[0])
+		adminUsage()
+		return 2
+	}
+
+	fs := flag.NewFlagSet("admin "+args[0], flag.ExitOnError)
+	cfgPath := fs.String("config", "config.yaml", "Path to configuration file")
+	var opts adminOptions
+	fs.StringVar(&opts.username, "username", "", "Username (create-user, reset-password)")
+	fs.StringVar(&opts.email, "email", "", "Email address (create-user)")
+	fs.StringVar(&opts.role, "role", models.UserRoleAdmin, "Role: admin, operator or viewer (create-user)")
+	fs.BoolVar(&opts.passwordStdin, "password-stdin", false, "Read the password from the first line of stdin instead of generating one")
+	fs.DurationVar(&opts.olderThan, "older-than", 30*24*time.Hour, "Only purge rows deleted longer ago than this (purge-soft-deleted)")
+	fs.StringVar(&opts.output, "o", "", "File to write to (export)")
+	fs.Parse(args[1:])
+
+	cfg, err := config.LoadServerConfig(*cfgPath, config.Overrides{})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid configuration: %v\n", err)
+		return 1
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	var database *db.DB
+	if command.needsDB {
+		database, err = db.New(ctx, cfg.Database.Host, cfg.Database.Port,
+			cfg.Database.User, cfg.Database.Password, cfg.Database.DBName, cfg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		defer database.Close()
+		if err := database.Ping(ctx); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+	}
+
+	if err := command.run(ctx, cfg, database, opts); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// adminPassword reads the password from stdin if asked to, or generates one
+// that is printed. It reports whether the password was generated.
+func adminPassword(opts adminOptions) (string, bool, error) {
+	if !opts.passwordStdin {
+		password, err := generatePassword()
+		return password, true, err
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", false, fmt.Errorf("failed to read password from stdin: %w", err)
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if len(password) < 8 {
+		return "", false, fmt.Errorf("password must be at least 8 characters")
+	}
+	return password, false, nil
+}
+
+// generatePassword returns a random password of 20 letters and digits
+func generatePassword() (string, error) {
+	const alphabet = "abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	password := make([]byte, 20)
+	for i := range password {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(alphabet))))
+		if err != nil {
+			return "", fmt.Errorf("failed to generate password: %w", err)
+		}
+		password[i] = alphabet[n.Int64()]
+	}
+	return string(password), nil
+}
+
+// runCreateUser creates a user
+func runCreateUser(ctx context.Context, cfg *config.ServerConfig, database *db.DB, opts adminOptions) error {
+	password, generated, err := adminPassword(opts)
+	if err != nil {
+		return err
+	}
+
+	user, err := database.CreateUser(ctx, opts.username, opts.email, opts.role, password)
+	if err != nil {
+		return err
+	}
+	if err := database.Audit(ctx, models.AuditUserCreate, adminActor, "", map[string]interface{}{
+		"username": user.Username,
+		"role":     user.Role,
+	}); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to record in the audit log: %v\n", err)
+	}
+
+	fmt.Printf("Created %s %s\n", user.Role, user.Username)
+	if generated {
+		fmt.Printf("Password: %s\n", password)
+	}
+	return nil
+}
+
+// runResetPassword sets a new password for a user
+func runResetPassword(ctx context.Context, cfg *config.ServerConfig, database *db.DB, opts adminOptions) error {
+	if opts.username == "" {
+		return fmt.Errorf("-username is required")
+	}
+	password, generated, err := adminPassword(opts)
+	if err != nil {
+		return err
+	}
+
+	restored, err := database.ResetPassword(ctx, opts.username, password)
+	if err != nil {
+		return err
+	}
+	if err := database.Audit(ctx, models.AuditUserPasswordReset, adminActor, "", map[string]interface{}{
+		"username": opts.username,
+		"restored": restored,
+	}); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to record in the audit log: %v\n", err)
+	}
+
+	if restored {
+		fmt.Printf("Restored deleted user %s\n", opts.username)
+	}
+	fmt.Printf("Reset password of %s, their sessions were logged out\n", opts.username)
+	if generated {
+		fmt.Printf("Password: %s\n", password)
+	}
+	return nil
+}
+
+// runRotateHostKey replaces the SSH host key of the server
+func runRotateHostKey(ctx context.Context, cfg *config.ServerConfig, database *db.DB, opts adminOptions) error {
+	fingerprint, backup, err := ssh.RotateHostKey(cfg.SSH.HostKeyPath, cfg.SSH.Keys.HostKeyType, cfg.SSH.Keys.HostKeyBits)
+	if err != nil {
+		return err
+	}
+
+	if backup != "" {
+		fmt.Printf("Old host key kept at %s\n", backup)
+	}
+	fmt.Printf("New %s host key %s at %s, restart the server to use it\n", cfg.SSH.Keys.HostKeyType, fingerprint, cfg.SSH.HostKeyPath)
+
+	// The database is optional here, the key may be rotated while it is down
+	if database, err := db.New(ctx, cfg.Database.Host, cfg.Database.Port,
+		cfg.Database.User, cfg.Database.Password, cfg.Database.DBName, cfg); err == nil {
+		defer database.Close()
+		if database.Ping(ctx) == nil {
+			database.Audit(ctx, models.AuditHostKeyRotate, adminActor, "", map[string]interface{}{
+				"fingerprint": fingerprint,
+			})
+		}
+	}
+	return nil
+}
+
+// runReindex rebuilds the indexes of the database
+func runReindex(ctx context.Context, cfg *config.ServerConfig, database *db.DB, opts adminOptions) error {
+	started := time.Now()
+	if err := database.Reindex(ctx); err != nil {
+		return err
+	}
+	fmt.Printf("Reindexed database %s in %s\n", cfg.Database.DBName, time.Since(started).Round(time.Millisecond))
+	return nil
+}
+
+// runPurgeSoftDeleted removes rows that were deleted long enough ago
+func runPurgeSoftDeleted(ctx context.Context, cfg *config.ServerConfig, database *db.DB, opts adminOptions) error {
+	if opts.olderThan < 0 {
+		return fmt.Errorf("-older-than must not be negative")
+	}
+
+	purged, purgeErr := database.PurgeSoftDeleted(ctx, time.Now().Add(-opts.olderThan))
+	tables := make([]string, 0, len(purged))
+	var total int64
+	for table, count := range purged {
+		tables = append(tables, table)
+		total += count
+	}
+	sort.Strings(tables)
+	for _, table := range tables {
+		fmt.Printf("%-28s %d\n", table, purged[table])
+	}
+	fmt.Printf("Purged %d rows deleted more than %s ago\n", total, opts.olderThan)
+
+	if total > 0 {
+		data := make(map[string]interface{}, len(purged))
+		for table, count := range purged {
+			data[table] = count
+		}
+		if err := database.Audit(ctx, models.AuditPurgeDeleted, adminActor, "", data); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to record in the audit log: %v\n", err)
+		}
+	}
+	return purgeErr
+}
+
+// runExport writes every table as JSON
+func runExport(ctx context.Context, cfg *config.ServerConfig, database *db.DB, opts adminOptions) error {
+	if opts.output == "" {
+		return database.Export(ctx, os.Stdout)
+	}
+
+	// The export holds password hashes and encrypted secrets
+	file, err := os.OpenFile(opts.output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", opts.output, err)
+	}
+	if err := database.Export(ctx, file); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", opts.output, err)
+	}
+	fmt.Fprintf(os.Stderr, "Exported database %s to %s\n", cfg.Database.DBName, opts.output)
+	return nil
+}
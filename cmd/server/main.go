@@ -6,13 +6,33 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"sync/atomic"
 	"syscall"
+	"time"
+	_ "time/tzdata" // Device timezones are validated against it
 
+	"github.com/edgetainer/edgetainer/internal/server/alerts"
 	"github.com/edgetainer/edgetainer/internal/server/api"
+	"github.com/edgetainer/edgetainer/internal/server/artifacts"
 	"github.com/edgetainer/edgetainer/internal/server/db"
+	"github.com/edgetainer/edgetainer/internal/server/deploy"
+	"github.com/edgetainer/edgetainer/internal/server/dns"
+	"github.com/edgetainer/edgetainer/internal/server/events"
+	"github.com/edgetainer/edgetainer/internal/server/extensions"
+	"github.com/edgetainer/edgetainer/internal/server/hooks"
+	"github.com/edgetainer/edgetainer/internal/server/jobs"
+	"github.com/edgetainer/edgetainer/internal/server/mail"
+	"github.com/edgetainer/edgetainer/internal/server/proxy"
+	"github.com/edgetainer/edgetainer/internal/server/restorepoints"
+	"github.com/edgetainer/edgetainer/internal/server/secrets"
+	"github.com/edgetainer/edgetainer/internal/server/sitecache"
 	"github.com/edgetainer/edgetainer/internal/server/ssh"
+	"github.com/edgetainer/edgetainer/internal/server/storage"
+	"github.com/edgetainer/edgetainer/internal/server/webhook"
 	"github.com/edgetainer/edgetainer/internal/shared/config"
+	"github.com/edgetainer/edgetainer/internal/shared/fieldcrypt"
 	"github.com/edgetainer/edgetainer/internal/shared/logging"
+	"github.com/edgetainer/edgetainer/internal/shared/tracing"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
@@ -21,6 +41,12 @@ var (
 	configPath = flag.String("config", "config.yaml", "Path to configuration file")
 	logLevel   = flag.String("log-level", "info", "Log level (debug, info, warn, error)")
 	version    = flag.Bool("version", false, "Print version information")
+
+	encryptFields  = flag.Bool("encrypt-fields", false, "Encrypt plaintext or re-encrypt rotated sensitive columns with the active key and exit")
+	validateConfig = flag.Bool("validate-config", false, "Print the effective configuration with secrets redacted and exit")
+
+	// Every setting can also be given as a flag named after its path, e.g. -database.host
+	settingFlags = config.DefineFlags(flag.CommandLine, &config.ServerConfig{})
 )
 
 // These variables are set during build time
@@ -31,6 +57,11 @@ var (
 )
 
 func main() {
+	// Maintenance commands run on their own and exit
+	if len(os.Args) > 1 && os.Args[1] == "admin" {
+		os.Exit(runAdmin(os.Args[2:]))
+	}
+
 	// Parse command line flags
 	flag.Parse()
 
@@ -53,22 +84,106 @@ func main() {
 	logger := logging.WithComponent("server")
 	logger.Info("Starting Edgetainer management server")
 
-	// Load configuration
-	cfg, err := config.LoadServerConfig(*configPath)
+	// -log-level is a shorthand for -logging.level
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "log-level" {
+			settingFlags["logging.level"] = f.Value.String()
+		}
+	})
+
+	// Load configuration, flags take precedence over the environment and the file
+	cfg, err := config.LoadServerConfig(*configPath, settingFlags)
 	if err != nil {
 		logger.Fatal("Failed to load configuration", err)
 	}
 
+	if *validateConfig {
+		effective, err := config.Redact(cfg)
+		if err != nil {
+			logger.Fatal("Failed to print configuration", err)
+		}
+		fmt.Print(effective)
+		if err := cfg.Validate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		logger.Fatal("Invalid configuration", err)
+	}
+
+	// Log to the configured file as well
+	rotation := logging.Rotation{
+		MaxSizeMB:  cfg.Logging.MaxSizeMB,
+		MaxAgeDays: cfg.Logging.MaxAgeDays,
+		MaxBackups: cfg.Logging.MaxBackups,
+		Compress:   cfg.Logging.Compress,
+	}
+	if err := logging.Initialize(cfg.Logging.Level, cfg.Logging.LogFile, rotation); err != nil {
+		logger.Error("Failed to open log file, logging to the console only", err)
+	}
+	logger = logging.WithComponent("server")
+	if err := logging.SetLevel(cfg.Logging.Level); err != nil {
+		logger.Warn(fmt.Sprintf("Ignoring log level: %v", err))
+	}
+
+	// Enable encryption of sensitive columns
+	if len(cfg.Encryption.Keys) > 0 {
+		keyring, err := fieldcrypt.NewKeyring(cfg.Encryption.ActiveKey, cfg.Encryption.Keys)
+		if err != nil {
+			logger.Fatal("Invalid encryption configuration", err)
+		}
+		fieldcrypt.SetKeyring(keyring)
+		logger.Info(fmt.Sprintf("Column encryption enabled with key %s", cfg.Encryption.ActiveKey))
+	} else {
+		logger.Warn("No encryption key configured, sensitive columns are stored in plaintext")
+	}
+
 	// Create a context that will be canceled on SIGINT or SIGTERM
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	// Handle termination signals
-	signalCh := make(chan os.Signal, 1)
+	// Export traces to the configured collector
+	shutdownTracing, err := tracing.Setup(ctx, "edgetainer-server", BuildVersion, tracing.Options{
+		Enabled:     cfg.Tracing.Enabled,
+		Endpoint:    cfg.Tracing.Endpoint,
+		Insecure:    cfg.Tracing.Insecure,
+		Headers:     cfg.Tracing.Headers,
+		SampleRatio: cfg.Tracing.SampleRatio,
+	})
+	if err != nil {
+		logger.Fatal("Failed to set up tracing", err)
+	}
+	defer func() {
+		flushCtx, flushCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer flushCancel()
+		if err := shutdownTracing(flushCtx); err != nil {
+			logger.Warn(fmt.Sprintf("Failed to flush traces: %v", err))
+		}
+	}()
+
+	// Handle termination signals. The readiness probe fails for the shutdown
+	// delay first, so load balancers stop sending traffic before the
+	// listeners close; a second signal stops at once.
+	var draining atomic.Bool
+	signalCh := make(chan os.Signal, 2)
 	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		sig := <-signalCh
-		logger.Info(fmt.Sprintf("Received signal %s, shutting down", sig))
+		if delay := time.Duration(cfg.Server.ShutdownDelay) * time.Second; delay > 0 {
+			logger.Info(fmt.Sprintf("Received signal %s, shutting down in %s", sig, delay))
+			draining.Store(true)
+			select {
+			case <-time.After(delay):
+			case sig = <-signalCh:
+				logger.Info(fmt.Sprintf("Received signal %s, shutting down now", sig))
+			case <-ctx.Done():
+			}
+		} else {
+			logger.Info(fmt.Sprintf("Received signal %s, shutting down", sig))
+		}
 		cancel()
 	}()
 
@@ -84,17 +199,302 @@ func main() {
 		logger.Fatal("Failed to run database migrations", err)
 	}
 
+	// Log levels changed at runtime survive restarts
+	if err := database.ApplyLogLevels(); err != nil {
+		logger.Warn(fmt.Sprintf("Failed to apply saved log levels: %v", err))
+	}
+
+	// The URL and SSH ports set in the setup take precedence over the
+	// configuration
+	settings, err := database.ServerSettings(ctx)
+	if err != nil {
+		logger.Warn(fmt.Sprintf("Failed to load server settings, using the configuration: %v", err))
+	}
+	if settings.SSHPort != 0 {
+		cfg.SSH.Port = settings.SSHPort
+	}
+	if settings.SSHStartPort != 0 {
+		cfg.SSH.StartPort, cfg.SSH.EndPort = settings.SSHStartPort, settings.SSHEndPort
+	}
+
+	// Encrypt existing rows and exit when requested
+	if *encryptFields {
+		count, err := database.EncryptFields()
+		database.Close()
+		if err != nil {
+			logger.Fatal("Failed to encrypt columns", err)
+		}
+		logger.Info(fmt.Sprintf("Encrypted %d values", count))
+		return
+	}
+
+	// Create the event bus shared by all server components
+	bus := events.NewBus()
+
+	// Start webhook dispatcher
+	dispatcher := webhook.NewDispatcher(ctx, database, bus)
+	dispatcher.Start()
+
+	// Record fired alerts for the statistics
+	recorder := alerts.NewRecorder(ctx, database, bus)
+	recorder.Start()
+
 	// Start SSH tunnel server
-	sshServer, err := ssh.NewServer(ctx, cfg.SSH.Port, cfg.SSH.HostKeyPath, cfg.SSH.StartPort, cfg.SSH.EndPort, database)
+	sshServer, err := ssh.NewServer(ctx, cfg.SSH.Port, cfg.SSH.HostKeyPath, cfg.SSH.Keys.HostKeyType, cfg.SSH.Keys.HostKeyBits, cfg.SSH.StartPort, cfg.SSH.EndPort, database, bus)
 	if err != nil {
 		logger.Fatal("Failed to start SSH tunnel server", err)
 	}
+	sshServer.SetKeyAlgorithms(cfg.SSH.Keys.Algorithms)
+	sshServer.SetBindAddresses(cfg.SSH.Host, cfg.SSH.ForwardHost)
+	if cfg.SSH.CA.Enabled {
+		if err := sshServer.EnableCA(cfg.SSH.CA.KeyPath, cfg.SSH.Keys.HostKeyType, time.Duration(cfg.SSH.CA.CertTTL)*time.Second); err != nil {
+			logger.Fatal("Failed to enable SSH certificate authority", err)
+		}
+	}
+	sshServer.SetDefaultTunnelRate(cfg.SSH.TunnelRate)
+	sshServer.SetHardwareBinding(cfg.SSH.Hardware)
+	sshServer.SetMaxClockSkew(time.Duration(cfg.Clock.MaxSkew) * time.Second)
+	sshServer.SetHostHealthLimits(float64(cfg.HostHealth.MaxTemperature), cfg.HostHealth.MinBattery)
+	sshServer.SetGeoIP(cfg.GeoIP.URL)
+	sshServer.SetKeepalive(time.Duration(cfg.SSH.Keepalive.Interval)*time.Second,
+		time.Duration(cfg.SSH.Keepalive.Timeout)*time.Second, cfg.SSH.Keepalive.MaxMissed)
+	sshServer.SetHeartbeatBatching(time.Duration(cfg.SSH.Heartbeats.FlushMS)*time.Millisecond,
+		cfg.SSH.Heartbeats.BatchSize, cfg.SSH.Heartbeats.QueueSize)
+	sshServer.SetForwardDefaults(cfg.SSH.Forwards.MaxPerDevice, time.Duration(cfg.SSH.Forwards.IdleTimeout)*time.Second)
+	sshServer.SetConnectionLimits(time.Duration(cfg.SSH.Connections.IdleTimeout)*time.Second,
+		time.Duration(cfg.SSH.Connections.MaxDuration)*time.Second, cfg.SSH.Connections.MaxPerDevice)
+	if err := sshServer.SetProxyProtocol(cfg.SSH.ProxyProtocol, cfg.SSH.ProxyTrusted); err != nil {
+		logger.Fatal("Failed to set up PROXY protocol", err)
+	}
+
+	// Run the connection hooks for firewall, NAC and DNS automation
+	hookRunner, err := hooks.NewRunner(ctx, hooks.Settings{
+		Events:        cfg.Hooks.Events,
+		Timeout:       time.Duration(cfg.Hooks.Timeout) * time.Second,
+		Command:       cfg.Hooks.Exec.Command,
+		WebhookURL:    cfg.Hooks.Webhook.URL,
+		WebhookSecret: cfg.Hooks.Webhook.Secret,
+		MQTT: hooks.MQTTSettings{
+			Broker:   cfg.Hooks.MQTT.Broker,
+			Topic:    cfg.Hooks.MQTT.Topic,
+			ClientID: cfg.Hooks.MQTT.ClientID,
+			Username: cfg.Hooks.MQTT.Username,
+			Password: cfg.Hooks.MQTT.Password,
+		},
+	}, database, bus, sshServer)
+	if err != nil {
+		logger.Fatal("Failed to set up connection hooks", err)
+	}
+	hookRunner.Start()
+
+	// Extensions registered by the build in extensions.Default, plus the
+	// extension webhook if configured
+	if cfg.Extensions.Webhook.URL != "" {
+		extensions.NewWebhook(extensions.WebhookSettings{
+			URL:        cfg.Extensions.Webhook.URL,
+			Secret:     cfg.Extensions.Webhook.Secret,
+			Timeout:    time.Duration(cfg.Extensions.Webhook.Timeout) * time.Second,
+			Deploy:     cfg.Extensions.Webhook.Deploy,
+			Enrollment: cfg.Extensions.Webhook.Enrollment,
+			Auth:       cfg.Extensions.Webhook.Auth,
+			FailOpen:   cfg.Extensions.Webhook.FailOpen,
+		}).Register(extensions.Default)
+	}
+
+	// Keep DNS records for the device subdomains
+	var dnsManager *dns.Manager
+	if cfg.DNS.Provider != "" {
+		dnsManager, err = dns.NewManager(ctx, dns.Settings{
+			Provider: cfg.DNS.Provider,
+			Domain:   cfg.DNS.Domain,
+			Target:   cfg.DNS.Target,
+			TTL:      cfg.DNS.TTL,
+			Cloudflare: dns.CloudflareSettings{
+				APIToken: cfg.DNS.Cloudflare.APIToken,
+				ZoneID:   cfg.DNS.Cloudflare.ZoneID,
+			},
+			Route53: dns.Route53Settings{
+				AccessKeyID:     cfg.DNS.Route53.AccessKeyID,
+				SecretAccessKey: cfg.DNS.Route53.SecretAccessKey,
+				SessionToken:    cfg.DNS.Route53.SessionToken,
+				HostedZoneID:    cfg.DNS.Route53.HostedZoneID,
+			},
+			RFC2136: dns.RFC2136Settings{
+				Server:        cfg.DNS.RFC2136.Server,
+				Zone:          cfg.DNS.RFC2136.Zone,
+				TSIGKey:       cfg.DNS.RFC2136.TSIGKey,
+				TSIGSecret:    cfg.DNS.RFC2136.TSIGSecret,
+				TSIGAlgorithm: cfg.DNS.RFC2136.TSIGAlgorithm,
+			},
+		}, database)
+		if err != nil {
+			logger.Fatal("Failed to set up DNS records", err)
+		}
+		dnsManager.Start()
+	}
+
+	// Deployments resolve external secrets at deploy time
+	resolver := secrets.NewResolver(database)
+
+	// Track the registry caches of sites, deployments pull through them
+	caches := sitecache.NewService(ctx, database, sshServer, resolver)
+	caches.Start()
+
+	// Run long-running operations as background jobs
+	jobQueue := jobs.NewQueue(ctx, database, bus)
+	jobQueue.SetLimits(cfg.Jobs.Workers, time.Duration(cfg.Jobs.Retention)*time.Hour)
+	caches.RegisterJobs(jobQueue)
+
+	// Record applications of devices before risky changes to put them back
+	restorePoints := restorepoints.NewService(database, sshServer)
+	restorePoints.RegisterJobs(jobQueue)
+	jobQueue.Start()
+
+	// Keep the files of software versions besides their compose file
+	artifactStorage, err := artifacts.NewStorage(artifacts.Settings{
+		Store: storage.Settings{
+			Backend: cfg.Artifacts.Backend,
+			Dir:     cfg.Artifacts.Dir,
+			S3: storage.S3Settings{
+				Bucket:          cfg.Artifacts.S3.Bucket,
+				Region:          cfg.Artifacts.S3.Region,
+				Endpoint:        cfg.Artifacts.S3.Endpoint,
+				PathStyle:       cfg.Artifacts.S3.PathStyle,
+				Prefix:          cfg.Artifacts.S3.Prefix,
+				AccessKeyID:     cfg.Artifacts.S3.AccessKeyID,
+				SecretAccessKey: cfg.Artifacts.S3.SecretAccessKey,
+				SessionToken:    cfg.Artifacts.S3.SessionToken,
+			},
+		},
+		MaxSize:    int64(cfg.Artifacts.MaxSizeMB) * 1024 * 1024,
+		PresignTTL: time.Duration(cfg.Artifacts.PresignTTL) * time.Second,
+	})
+	if err != nil {
+		logger.Fatal("Failed to set up artifact storage", err)
+	}
+	sshServer.SetArtifacts(artifactStorage)
+
+	// Move old device logs, diagnostics bundles and packet captures out of
+	// the database, and remove them once the lifecycle policy ends
+	var objectStore storage.Store
+	if cfg.Storage.Backend != "" {
+		objectStore, err = storage.New(storage.Settings{
+			Backend: cfg.Storage.Backend,
+			Dir:     cfg.Storage.Dir,
+			S3: storage.S3Settings{
+				Bucket:          cfg.Storage.S3.Bucket,
+				Region:          cfg.Storage.S3.Region,
+				Endpoint:        cfg.Storage.S3.Endpoint,
+				PathStyle:       cfg.Storage.S3.PathStyle,
+				Prefix:          cfg.Storage.S3.Prefix,
+				AccessKeyID:     cfg.Storage.S3.AccessKeyID,
+				SecretAccessKey: cfg.Storage.S3.SecretAccessKey,
+				SessionToken:    cfg.Storage.S3.SessionToken,
+			},
+		})
+		if err != nil {
+			logger.Fatal("Failed to set up object storage", err)
+		}
+		sshServer.SetObjectStorage(objectStore)
+	}
+	lifecycle := storage.NewLifecycle(ctx, database, objectStore, storage.Policy{
+		ArchiveLogsAfter: time.Duration(cfg.Storage.Lifecycle.ArchiveLogsAfterDays) * 24 * time.Hour,
+		LogArchives:      time.Duration(cfg.Storage.Lifecycle.LogArchiveDays) * 24 * time.Hour,
+		Diagnostics:      time.Duration(cfg.Storage.Lifecycle.DiagnosticsDays) * 24 * time.Hour,
+		Captures:         time.Duration(cfg.Storage.Lifecycle.CapturesDays) * 24 * time.Hour,
+	})
+	lifecycle.Start()
+
+	deployer := deploy.NewService(ctx, database, sshServer, resolver, caches, bus)
+	deployer.SetArtifacts(artifactStorage)
+	deployer.SetLimits(cfg.Deploy.MaxConcurrent, cfg.Deploy.RegistryConcurrency)
+	deployer.SetRequirements(cfg.AgentRequirements())
+	deployer.SetExtensions(extensions.Default)
+	if err := deployer.Start(); err != nil {
+		logger.Error("Failed to resume rollouts", err)
+	}
 
 	// Start API server
-	apiServer, err := api.NewServer(ctx, cfg.Server.Host, cfg.Server.Port, database, sshServer)
+	apiServer, err := api.NewServer(ctx, cfg.Server.Host, cfg.Server.Port, database, sshServer, deployer, caches)
 	if err != nil {
 		logger.Fatal("Failed to start API server", err)
 	}
+	apiServer.SetDeviceKeys(cfg.SSH.Keys.DeviceKeyType, cfg.SSH.Keys.DeviceKeyBits)
+	apiServer.SetEventBus(bus)
+	apiServer.SetJobQueue(jobQueue)
+	apiServer.SetRestorePoints(restorePoints)
+	apiServer.SetSecretScanPolicy(cfg.SecretScan.Policy)
+	apiServer.SetDeviceNamePolicy(cfg.Devices.UniqueNames)
+	apiServer.SetExtensions(extensions.Default)
+	apiServer.SetArtifacts(artifactStorage)
+	apiServer.SetApprovalExpiry(time.Duration(cfg.Deploy.ApprovalExpiry) * time.Hour)
+	apiServer.SetDraining(&draining)
+	if cfg.SMTP.Host != "" {
+		mailer, err := mail.NewSender(mail.Settings{
+			Host:     cfg.SMTP.Host,
+			Port:     cfg.SMTP.Port,
+			Username: cfg.SMTP.Username,
+			Password: cfg.SMTP.Password,
+			From:     cfg.SMTP.From,
+			TLS:      cfg.SMTP.TLS,
+		})
+		if err != nil {
+			logger.Fatal("Failed to set up email", err)
+		}
+		apiServer.SetMailer(mailer, time.Duration(cfg.Auth.InviteExpiry)*time.Hour)
+	}
+	if objectStore != nil {
+		apiServer.SetObjectStorage(objectStore)
+	}
+	apiServer.SetVersionInfo(api.VersionInfo{
+		Version: BuildVersion,
+		Commit:  BuildCommit,
+		Date:    BuildDate,
+		Features: map[string]bool{
+			"proxy":     cfg.Proxy.Listen != "",
+			"udp_proxy": cfg.Proxy.Listen != "" && cfg.Proxy.UDP,
+			"dns":       cfg.DNS.Provider != "",
+			"ssh_ca":    cfg.SSH.CA.Enabled,
+			"metrics":   cfg.Metrics.Enabled,
+			"tracing":   cfg.Tracing.Enabled,
+			"oidc":      false, // Not available yet
+			"gitops":    false, // Not available yet
+		},
+		MinAgentVersion: cfg.Agents.MinVersion,
+	})
+	if dnsManager != nil {
+		apiServer.SetDNS(dnsManager)
+	}
+
+	// A new install gets its first admin through the setup, with a token
+	// only those who can read the log know
+	if pending, err := database.SetupPending(ctx); err != nil {
+		logger.Error("Failed to check whether the server is set up", err)
+	} else if pending {
+		token := apiServer.EnableSetup()
+		logger.Warn(fmt.Sprintf("Server is not set up yet, complete the setup at /api/setup with the setup token %s", token))
+	}
+	if cfg.Metrics.Enabled {
+		apiServer.EnableMetrics(cfg.Metrics.Token)
+	}
+	if cfg.Cache.TTL > 0 {
+		apiServer.EnableCache(time.Duration(cfg.Cache.TTL)*time.Second, bus)
+	}
+
+	// Serve the exposed services of devices
+	var serviceProxy *proxy.Proxy
+	if cfg.Proxy.Listen != "" {
+		serviceProxy = proxy.NewProxy(ctx, proxy.Settings{
+			Listen:    cfg.Proxy.Listen,
+			Domain:    cfg.Proxy.Domain,
+			StartPort: cfg.Proxy.Ports.Start,
+			EndPort:   cfg.Proxy.Ports.End,
+			UDP:       cfg.Proxy.UDP,
+		}, database, sshServer)
+		if err := serviceProxy.Start(); err != nil {
+			logger.Fatal("Failed to start service proxy", err)
+		}
+	}
 
 	// Start the services
 	go func() {
@@ -117,7 +517,20 @@ func main() {
 	// Perform graceful shutdown
 	logger.Info("Shutting down services")
 	apiServer.Shutdown()
+	if serviceProxy != nil {
+		serviceProxy.Shutdown()
+	}
+	deployer.Stop()
+	jobQueue.Stop()
+	lifecycle.Stop()
+	caches.Stop()
 	sshServer.Shutdown()
+	hookRunner.Stop()
+	if dnsManager != nil {
+		dnsManager.Stop()
+	}
+	dispatcher.Stop()
+	recorder.Stop()
 	database.Close()
 
 	logger.Info("Edgetainer server stopped")
@@ -0,0 +1,321 @@
+// Package artifacts keeps the files of software versions deployed to the
+// device, e.g. configs, assets and models, in a cache addressed by their
+// sha256 digest. Files are downloaded from their pre-signed URL or over the
+// tunnel once, resuming interrupted tunnel downloads, and shared by every
+// version and application that uses them.
+package artifacts
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/logging"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+// manifestFile lists the artifacts placed in an application directory, so
+// those of earlier versions can be removed
+const manifestFile = ".artifacts.json"
+
+// fetchAttempts is the number of times a download is tried, tunnel
+// downloads resume where the previous attempt stopped
+const fetchAttempts = 3
+
+// SourceFunc downloads a content over the tunnel from offset on into w
+type SourceFunc func(ctx context.Context, digest string, offset int64, w io.Writer) (int64, error)
+
+// Cache keeps downloaded artifacts by digest
+type Cache struct {
+	dir    string
+	maxAge time.Duration
+	client *http.Client
+	logger *logging.Logger
+
+	mu     sync.Mutex
+	source SourceFunc
+}
+
+// NewCache creates a cache in dir that removes contents unused for maxAge,
+// or never if it is 0
+func NewCache(dir string, maxAge time.Duration) (*Cache, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "tmp"), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create artifact cache: %w", err)
+	}
+	return &Cache{
+		dir:    dir,
+		maxAge: maxAge,
+		client: &http.Client{},
+		logger: logging.WithComponent("artifacts"),
+	}, nil
+}
+
+// SetSource sets how contents without a URL are downloaded over the tunnel
+func (c *Cache) SetSource(source SourceFunc) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.source = source
+}
+
+// path returns where a content is cached
+func (c *Cache) path(digest string) string {
+	return filepath.Join(c.dir, "sha256", strings.TrimPrefix(digest, "sha256:"))
+}
+
+// Fetch makes sure the contents of artifacts are cached, downloading those
+// that are not, and returns the cached file of each by digest
+func (c *Cache) Fetch(ctx context.Context, list []protocol.Artifact) (map[string]string, error) {
+	files := make(map[string]string, len(list))
+	for _, artifact := range list {
+		if _, ok := files[artifact.Digest]; ok {
+			continue
+		}
+		if !protocol.ValidDigest(artifact.Digest) {
+			return nil, fmt.Errorf("artifact %s has an invalid digest", artifact.Path)
+		}
+
+		path := c.path(artifact.Digest)
+		if info, err := os.Stat(path); err == nil && info.Size() == artifact.Size {
+			// The modification time tracks when the content was last used
+			now := time.Now()
+			os.Chtimes(path, now, now)
+			files[artifact.Digest] = path
+			continue
+		}
+
+		if err := c.download(ctx, artifact, path); err != nil {
+			return nil, fmt.Errorf("failed to download artifact %s: %w", artifact.Path, err)
+		}
+		files[artifact.Digest] = path
+	}
+
+	c.prune(files)
+	return files, nil
+}
+
+// download fetches a content into the cache, checking its size and digest
+func (c *Cache) download(ctx context.Context, artifact protocol.Artifact, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	partial := filepath.Join(c.dir, "tmp", strings.TrimPrefix(artifact.Digest, "sha256:"))
+	defer os.Remove(partial)
+
+	started := time.Now()
+	var err error
+	for attempt := 1; attempt <= fetchAttempts; attempt++ {
+		if artifact.URL != "" {
+			err = c.fetchURL(ctx, artifact.URL, partial)
+		} else {
+			err = c.fetchTunnel(ctx, artifact.Digest, partial)
+		}
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+		c.logger.Warn(fmt.Sprintf("Download of artifact %s failed (attempt %d of %d): %v", artifact.Path, attempt, fetchAttempts, err))
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := verify(partial, artifact); err != nil {
+		return err
+	}
+	if err := os.Rename(partial, path); err != nil {
+		return err
+	}
+	c.logger.Info(fmt.Sprintf("Downloaded artifact %s (%d bytes) in %s", artifact.Path, artifact.Size, time.Since(started).Round(time.Millisecond)))
+	return nil
+}
+
+// fetchURL downloads a content from its pre-signed URL, starting over
+func (c *Cache) fetchURL(ctx context.Context, url, partial string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download returned %s", resp.Status)
+	}
+
+	file, err := os.Create(partial)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, resp.Body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// fetchTunnel downloads a content over the tunnel, resuming after what an
+// earlier attempt left
+func (c *Cache) fetchTunnel(ctx context.Context, digest, partial string) error {
+	c.mu.Lock()
+	source := c.source
+	c.mu.Unlock()
+	if source == nil {
+		return errors.New("artifacts cannot be downloaded over the tunnel")
+	}
+
+	file, err := os.OpenFile(partial, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err == nil {
+		_, err = source(ctx, digest, info.Size(), file)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// verify checks the size and digest of a downloaded content
+func verify(path string, artifact protocol.Artifact) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return err
+	}
+	if size != artifact.Size {
+		return fmt.Errorf("received %d bytes of %d", size, artifact.Size)
+	}
+	if digest := "sha256:" + hex.EncodeToString(hash.Sum(nil)); digest != artifact.Digest {
+		return fmt.Errorf("content does not match digest %s", artifact.Digest)
+	}
+	return nil
+}
+
+// prune removes the contents that were not used for maxAge, except those in
+// use
+func (c *Cache) prune(inUse map[string]string) {
+	if c.maxAge <= 0 {
+		return
+	}
+
+	used := make(map[string]bool, len(inUse))
+	for _, path := range inUse {
+		used[path] = true
+	}
+	cutoff := time.Now().Add(-c.maxAge)
+	filepath.WalkDir(filepath.Join(c.dir, "sha256"), func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || used[path] {
+			return nil
+		}
+		if info, err := entry.Info(); err == nil && info.ModTime().Before(cutoff) {
+			if err := os.Remove(path); err == nil {
+				c.logger.Debug(fmt.Sprintf("Removed unused artifact %s", entry.Name()))
+			}
+		}
+		return nil
+	})
+}
+
+// Place copies artifacts from the cache into an application directory and
+// removes the ones placed by an earlier version that are gone. Files are
+// replaced by renaming, so running containers keep the files they opened.
+func Place(appDir string, list []protocol.Artifact, files map[string]string) error {
+	manifest := filepath.Join(appDir, manifestFile)
+	previous, _ := readManifest(manifest)
+
+	placed := make([]string, 0, len(list))
+	for _, artifact := range list {
+		if err := protocol.ValidateArtifactPath(artifact.Path); err != nil {
+			return err
+		}
+		if err := place(filepath.Join(appDir, filepath.FromSlash(artifact.Path)), files[artifact.Digest], fs.FileMode(artifact.Mode&0o777)); err != nil {
+			return fmt.Errorf("failed to place artifact %s: %w", artifact.Path, err)
+		}
+		placed = append(placed, artifact.Path)
+	}
+
+	for _, path := range previous {
+		if !slices.Contains(placed, path) && protocol.ValidateArtifactPath(path) == nil {
+			os.Remove(filepath.Join(appDir, filepath.FromSlash(path)))
+		}
+	}
+	return writeManifest(manifest, placed)
+}
+
+// place copies a cached content to its path in the application directory
+func place(path, source string, mode fs.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.CreateTemp(filepath.Dir(path), ".artifact-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Chmod(mode)
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), path)
+}
+
+// readManifest returns the artifact paths listed in a manifest
+func readManifest(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	return paths, json.Unmarshal(data, &paths)
+}
+
+// writeManifest lists the placed artifact paths, removing the manifest if
+// there are none
+func writeManifest(path string, paths []string) error {
+	if len(paths) == 0 {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.Marshal(paths)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
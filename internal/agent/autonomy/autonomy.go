@@ -0,0 +1,175 @@
+// Package autonomy keeps the applications of a device running while it
+// cannot reach the server, possibly for weeks: it restarts containers that
+// fail, applies updates staged ahead of their time and has container logs
+// rotated. What it did is kept in an events file and shipped to the server
+// once it can be reached. See docs/offline-autonomy.md.
+package autonomy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/agent/docker"
+	"github.com/edgetainer/edgetainer/internal/shared/compose"
+	"github.com/edgetainer/edgetainer/internal/shared/config"
+	"github.com/edgetainer/edgetainer/internal/shared/logging"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+const (
+	// flushInterval is how often events are shipped
+	flushInterval = 15 * time.Second
+	// maxPending is the most events kept while the server cannot be
+	// reached, the oldest are dropped beyond it
+	maxPending = 1000
+)
+
+// SendFunc ships a batch of autonomy events to the server
+type SendFunc func(events []protocol.AutonomyEvent) error
+
+// Runner enforces the autonomy policy of the agent configuration and ships
+// what it and the Docker manager did on their own
+type Runner struct {
+	config func() *config.AgentConfig
+	docker *docker.Manager
+	send   SendFunc
+	logger *logging.Logger
+
+	mu      sync.Mutex
+	pending []protocol.AutonomyEvent // Held in the events file too
+	loaded  bool                     // The events file was read
+}
+
+// NewRunner creates a runner reading the agent configuration in effect
+// through cfg
+func NewRunner(cfg func() *config.AgentConfig, dockerMgr *docker.Manager, send SendFunc) *Runner {
+	return &Runner{
+		config: cfg,
+		docker: dockerMgr,
+		send:   send,
+		logger: logging.WithComponent("autonomy"),
+	}
+}
+
+// ServiceDefaults returns the restart policy and log rotation the autonomy
+// policy gives services of applications deployed from now on
+func ServiceDefaults(cfg *config.AgentConfig) compose.ServiceDefaults {
+	if !cfg.Autonomy.Enabled {
+		return compose.ServiceDefaults{}
+	}
+	defaults := compose.ServiceDefaults{Restart: "unless-stopped"}
+	if cfg.Autonomy.LogMaxSizeMB > 0 {
+		defaults.LogMaxSize, defaults.LogMaxFiles = cfg.Autonomy.LogMaxSizeMB, cfg.Autonomy.LogMaxFiles
+	}
+	return defaults
+}
+
+// Run checks the applications and staged updates until ctx is done, the
+// first time right away so that applications come back after a reboot
+// without waiting for the server
+func (r *Runner) Run(ctx context.Context) {
+	flush := time.NewTicker(flushInterval)
+	defer flush.Stop()
+	check := time.NewTimer(0)
+	defer check.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flush.C:
+			r.flush()
+		case <-check.C:
+			cfg := r.config()
+			r.docker.ApplyStagedUpdates()
+			if cfg.Autonomy.Enabled {
+				r.docker.Heal(cfg.Autonomy.MaxRestarts)
+			}
+			r.flush()
+			check.Reset(time.Duration(r.config().Autonomy.CheckInterval) * time.Second)
+		}
+	}
+}
+
+// Record queues an event for the server, dropping the oldest beyond
+// maxPending. Events are kept in the events file until the server has them.
+func (r *Runner) Record(event protocol.AutonomyEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.load()
+	if len(r.pending) == maxPending {
+		r.logger.Warn(fmt.Sprintf("Dropping %s event of %s from %s, the server was not reached for too long",
+			r.pending[0].Kind, r.pending[0].App, r.pending[0].Time.Format(time.RFC3339)))
+		r.pending = r.pending[1:]
+	}
+	r.pending = append(r.pending, event)
+	r.save()
+}
+
+// flush ships the queued events in batches. Events are kept for the next
+// flush if the server cannot be reached.
+func (r *Runner) flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.load()
+	if len(r.pending) == 0 {
+		return
+	}
+	for len(r.pending) > 0 {
+		n := min(len(r.pending), protocol.MaxAutonomyBatch)
+		if err := r.send(r.pending[:n]); err != nil {
+			r.logger.Debug(fmt.Sprintf("Failed to ship %d autonomy events: %v", len(r.pending), err))
+			break
+		}
+		r.pending = r.pending[n:]
+	}
+	r.save()
+}
+
+// load reads the events of a previous run once. The caller holds r.mu.
+func (r *Runner) load() {
+	if r.loaded {
+		return
+	}
+	r.loaded = true
+
+	data, err := os.ReadFile(r.config().Autonomy.Events)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			r.logger.Warn(fmt.Sprintf("Failed to read autonomy events: %v", err))
+		}
+		return
+	}
+	var events []protocol.AutonomyEvent
+	if err := json.Unmarshal(data, &events); err != nil {
+		r.logger.Warn(fmt.Sprintf("Failed to parse autonomy events, dropping them: %v", err))
+		return
+	}
+	r.pending = append(events, r.pending...)
+}
+
+// save writes the queued events to the events file, removing it once all
+// were shipped. The caller holds r.mu.
+func (r *Runner) save() {
+	path := r.config().Autonomy.Events
+	if len(r.pending) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			r.logger.Warn(fmt.Sprintf("Failed to remove autonomy events: %v", err))
+		}
+		return
+	}
+
+	data, err := json.Marshal(r.pending)
+	if err == nil {
+		err = os.WriteFile(path, data, 0600)
+	}
+	if err != nil {
+		r.logger.Warn(fmt.Sprintf("Failed to save autonomy events: %v", err))
+	}
+}
@@ -0,0 +1,725 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/agent/diagnostics"
+	"github.com/edgetainer/edgetainer/internal/agent/display"
+	"github.com/edgetainer/edgetainer/internal/agent/docker"
+	"github.com/edgetainer/edgetainer/internal/agent/plugins"
+	"github.com/edgetainer/edgetainer/internal/agent/system"
+	"github.com/edgetainer/edgetainer/internal/shared/config"
+	"github.com/edgetainer/edgetainer/internal/shared/logging"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+// DecommissionFunc is called when the server decommissions the device, with
+// the shutdown policy that should be applied to running applications
+type DecommissionFunc func(policy string)
+
+// Handler dispatches commands received from the server to the agent subsystems
+type Handler struct {
+	dockerMgr      *docker.Manager
+	sysMonitor     *system.Monitor
+	onDecommission DecommissionFunc
+	diagnostics    *diagnostics.Collector
+	capturer       *diagnostics.Capturer
+	plugins        *plugins.Manager
+	display        *display.Manager
+	config         func() *config.AgentConfig // Lists the host services that may be restarted, nil until SetHostServices
+	logger         *logging.Logger
+}
+
+// NewHandler creates a new command handler
+func NewHandler(dockerMgr *docker.Manager, sysMonitor *system.Monitor, onDecommission DecommissionFunc) *Handler {
+	return &Handler{
+		dockerMgr:      dockerMgr,
+		sysMonitor:     sysMonitor,
+		onDecommission: onDecommission,
+		logger:         logging.WithComponent("command-handler"),
+	}
+}
+
+// SetDiagnostics sets the collector of diagnostics bundles, without one they
+// are rejected
+func (h *Handler) SetDiagnostics(collector *diagnostics.Collector) {
+	h.diagnostics = collector
+}
+
+// SetPlugins sets the plugin manager, without one plugin commands are
+// rejected
+func (h *Handler) SetPlugins(manager *plugins.Manager) {
+	h.plugins = manager
+}
+
+// SetDisplay sets the kiosk display manager, without one display commands
+// are rejected
+func (h *Handler) SetDisplay(manager *display.Manager) {
+	h.display = manager
+}
+
+// SetHostServices sets the configuration listing the host services the server
+// may restart, without one restarts are rejected
+func (h *Handler) SetHostServices(cfg func() *config.AgentConfig) {
+	h.config = cfg
+}
+
+// SetCapturer sets the capturer of packet captures, without one they are
+// rejected
+func (h *Handler) SetCapturer(capturer *diagnostics.Capturer) {
+	h.capturer = capturer
+}
+
+// Handle executes a command and returns its response
+func (h *Handler) Handle(cmd *protocol.Command) *protocol.Response {
+	var (
+		resp *protocol.Response
+		err  error
+	)
+
+	switch cmd.Type {
+	case protocol.CmdDeploy:
+		resp, err = h.handleDeploy(cmd)
+	case protocol.CmdUndeploy:
+		resp, err = h.handleUndeploy(cmd)
+	case protocol.CmdUpdateEnvVar:
+		resp, err = h.handleUpdateEnvVar(cmd)
+	case protocol.CmdRestart:
+		resp, err = h.handleRestart(cmd)
+	case protocol.CmdRestartApp:
+		resp, err = h.handleRestartApp(cmd)
+	case protocol.CmdExecute:
+		resp, err = h.handleExecute(cmd)
+	case protocol.CmdGetStatus:
+		resp, err = h.handleGetStatus(cmd)
+	case protocol.CmdGetLogs:
+		resp, err = h.handleGetLogs(cmd)
+	case protocol.CmdDecommission:
+		resp, err = h.handleDecommission(cmd)
+	case protocol.CmdCheckCache:
+		resp, err = h.handleCheckCache(cmd)
+	case protocol.CmdConfigureNTP:
+		resp, err = h.handleConfigureNTP(cmd)
+	case protocol.CmdSetTimezone:
+		resp, err = h.handleSetTimezone(cmd)
+	case protocol.CmdAppAction:
+		resp, err = h.handleAppAction(cmd)
+	case protocol.CmdAdoptApp:
+		resp, err = h.handleAdoptApp(cmd)
+	case protocol.CmdRestorePoint:
+		resp, err = h.handleRestorePoint(cmd)
+	case protocol.CmdRestore:
+		resp, err = h.handleRestore(cmd)
+	case protocol.CmdDeleteRestorePoint:
+		resp, err = h.handleDeleteRestorePoint(cmd)
+	case protocol.CmdDiagnostics:
+		resp, err = h.handleDiagnostics(cmd)
+	case protocol.CmdNetworkTest:
+		resp, err = h.handleNetworkTest(cmd)
+	case protocol.CmdCapture:
+		resp, err = h.handleCapture(cmd)
+	case protocol.CmdPlugins:
+		resp, err = h.handleConfigurePlugins(cmd)
+	case protocol.CmdPluginAction:
+		resp, err = h.handlePluginAction(cmd)
+	case protocol.CmdDisplay:
+		resp, err = h.handleConfigureDisplay(cmd)
+	case protocol.CmdScreenshot:
+		resp, err = h.handleScreenshot(cmd)
+	case protocol.CmdRestartHostService:
+		resp, err = h.handleRestartHostService(cmd)
+	case protocol.CmdStageUpdate:
+		resp, err = h.handleStageUpdate(cmd)
+	case protocol.CmdUnstageUpdate:
+		resp, err = h.handleUnstageUpdate(cmd)
+	case protocol.CmdActivateUpdate:
+		resp, err = h.handleActivateUpdate(cmd)
+	default:
+		err = fmt.Errorf("unsupported command type: %s", cmd.Type)
+	}
+
+	if err != nil {
+		h.logger.Error(fmt.Sprintf("Command %s (%s) failed", cmd.Type, cmd.ID), err)
+		return protocol.NewResponse(cmd.ID, protocol.RespError, false, err.Error())
+	}
+
+	return resp
+}
+
+// handleDeploy deploys an application
+func (h *Handler) handleDeploy(cmd *protocol.Command) (*protocol.Response, error) {
+	var payload protocol.DeployPayload
+	if err := cmd.DecodePayload(&payload); err != nil {
+		return nil, err
+	}
+
+	if payload.Name == "" {
+		payload.Name = payload.SoftwareID.String()
+	}
+
+	if err := h.dockerMgr.DeployApplication(payload.Name, payload.ComposeConfig, payload.Version, payload.EnvVars, payload.Registries, payload.PullRate, payload.Strategy, payload.BlueGreen, payload.Migration, payload.ComposeOverrides, payload.Artifacts, payload.Limits); err != nil {
+		return nil, err
+	}
+
+	return protocol.NewResponse(cmd.ID, protocol.RespSuccess, true,
+		fmt.Sprintf("deployed %s version %s", payload.Name, payload.Version)), nil
+}
+
+// handleStageUpdate keeps a deployment to apply at its time, fetching its
+// images and artifacts in the background
+func (h *Handler) handleStageUpdate(cmd *protocol.Command) (*protocol.Response, error) {
+	var payload protocol.StageUpdatePayload
+	if err := cmd.DecodePayload(&payload); err != nil {
+		return nil, err
+	}
+	if payload.Deploy.Name == "" {
+		payload.Deploy.Name = payload.Deploy.SoftwareID.String()
+	}
+	if err := payload.Validate(); err != nil {
+		return nil, err
+	}
+
+	if err := h.dockerMgr.StageUpdate(payload.ID, payload.Deploy, payload.ApplyAt); err != nil {
+		return nil, err
+	}
+
+	return protocol.NewResponse(cmd.ID, protocol.RespSuccess, true,
+		fmt.Sprintf("staged %s version %s", payload.Deploy.Name, payload.Deploy.Version)), nil
+}
+
+// handleUnstageUpdate drops an update staged for an application
+func (h *Handler) handleUnstageUpdate(cmd *protocol.Command) (*protocol.Response, error) {
+	var payload protocol.UnstageUpdatePayload
+	if err := cmd.DecodePayload(&payload); err != nil {
+		return nil, err
+	}
+
+	if err := h.dockerMgr.UnstageUpdate(payload.ID, payload.Name); err != nil {
+		return nil, err
+	}
+
+	return protocol.NewResponse(cmd.ID, protocol.RespSuccess, true, fmt.Sprintf("unstaged update of %s", payload.Name)), nil
+}
+
+// handleActivateUpdate deploys the update staged for an application now
+func (h *Handler) handleActivateUpdate(cmd *protocol.Command) (*protocol.Response, error) {
+	var payload protocol.ActivateUpdatePayload
+	if err := cmd.DecodePayload(&payload); err != nil {
+		return nil, err
+	}
+
+	if err := h.dockerMgr.ActivateUpdate(payload.ID, payload.Name); err != nil {
+		return nil, err
+	}
+
+	return protocol.NewResponse(cmd.ID, protocol.RespSuccess, true, fmt.Sprintf("activated staged update of %s", payload.Name)), nil
+}
+
+// handleUndeploy removes an application
+func (h *Handler) handleUndeploy(cmd *protocol.Command) (*protocol.Response, error) {
+	var payload protocol.AppPayload
+	if err := cmd.DecodePayload(&payload); err != nil {
+		return nil, err
+	}
+
+	if err := h.dockerMgr.RemoveApplication(payload.Name); err != nil {
+		return nil, err
+	}
+
+	return protocol.NewResponse(cmd.ID, protocol.RespSuccess, true, fmt.Sprintf("removed %s", payload.Name)), nil
+}
+
+// handleUpdateEnvVar updates the environment variables of an application
+func (h *Handler) handleUpdateEnvVar(cmd *protocol.Command) (*protocol.Response, error) {
+	var payload protocol.AppPayload
+	if err := cmd.DecodePayload(&payload); err != nil {
+		return nil, err
+	}
+
+	if err := h.dockerMgr.UpdateEnvironmentVariables(payload.Name, payload.EnvVars); err != nil {
+		return nil, err
+	}
+
+	return protocol.NewResponse(cmd.ID, protocol.RespSuccess, true,
+		fmt.Sprintf("updated environment of %s", payload.Name)), nil
+}
+
+// handleRestart restarts a container of an application
+func (h *Handler) handleRestart(cmd *protocol.Command) (*protocol.Response, error) {
+	var payload protocol.AppPayload
+	if err := cmd.DecodePayload(&payload); err != nil {
+		return nil, err
+	}
+
+	if err := h.dockerMgr.RestartContainer(payload.Name, payload.Container); err != nil {
+		return nil, err
+	}
+
+	return protocol.NewResponse(cmd.ID, protocol.RespSuccess, true,
+		fmt.Sprintf("restarted %s in %s", payload.Container, payload.Name)), nil
+}
+
+// handleRestartApp restarts the services of an application in dependency order
+func (h *Handler) handleRestartApp(cmd *protocol.Command) (*protocol.Response, error) {
+	var payload protocol.RestartAppPayload
+	if err := cmd.DecodePayload(&payload); err != nil {
+		return nil, err
+	}
+
+	results, err := h.dockerMgr.RestartApplication(payload.Name, payload.Services, payload.NoDeps, payload.Rolling)
+	if err != nil {
+		return nil, err
+	}
+
+	restarted := 0
+	for _, result := range results {
+		if result.Status == protocol.RestartDone {
+			restarted++
+		}
+	}
+
+	resp := protocol.NewResponse(cmd.ID, protocol.RespSuccess, restarted == len(results),
+		fmt.Sprintf("restarted %d of %d services in %s", restarted, len(results), payload.Name))
+	resp.Data["services"] = results
+	return resp, nil
+}
+
+// handleAppAction starts, stops, restarts, redeploys or purges the data of
+// an application
+func (h *Handler) handleAppAction(cmd *protocol.Command) (*protocol.Response, error) {
+	var payload protocol.AppActionPayload
+	if err := cmd.DecodePayload(&payload); err != nil {
+		return nil, err
+	}
+
+	if !protocol.IsAppAction(payload.Action) {
+		return nil, fmt.Errorf("unknown application action: %s", payload.Action)
+	}
+
+	app, err := h.dockerMgr.ApplyAction(payload.Name, payload.Action)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := protocol.NewResponse(cmd.ID, protocol.RespSuccess, true,
+		fmt.Sprintf("applied %s to %s", payload.Action, payload.Name))
+	resp.Data["application"] = app
+	return resp, nil
+}
+
+// handleAdoptApp takes over a compose project started on the device by hand
+func (h *Handler) handleAdoptApp(cmd *protocol.Command) (*protocol.Response, error) {
+	var payload protocol.AdoptPayload
+	if err := cmd.DecodePayload(&payload); err != nil {
+		return nil, err
+	}
+
+	if err := h.dockerMgr.AdoptApplication(payload.Project, payload.WorkingDir, payload.ConfigFiles); err != nil {
+		return nil, err
+	}
+
+	return protocol.NewResponse(cmd.ID, protocol.RespSuccess, true, fmt.Sprintf("adopted %s", payload.Project)), nil
+}
+
+// handleRestorePoint records applications so that they can be restored
+func (h *Handler) handleRestorePoint(cmd *protocol.Command) (*protocol.Response, error) {
+	var payload protocol.RestorePointPayload
+	if err := cmd.DecodePayload(&payload); err != nil {
+		return nil, err
+	}
+	if err := payload.Validate(); err != nil {
+		return nil, err
+	}
+
+	manifest, err := h.dockerMgr.CreateRestorePoint(payload.ID, payload.Apps, payload.Volumes)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := protocol.NewResponse(cmd.ID, protocol.RespSuccess, true, fmt.Sprintf("created restore point %s", payload.ID))
+	resp.Data["manifest"] = manifest
+	return resp, nil
+}
+
+// handleRestore puts applications back as a restore point recorded them
+func (h *Handler) handleRestore(cmd *protocol.Command) (*protocol.Response, error) {
+	var payload protocol.RestorePayload
+	if err := cmd.DecodePayload(&payload); err != nil {
+		return nil, err
+	}
+	if err := payload.Validate(); err != nil {
+		return nil, err
+	}
+
+	restored, err := h.dockerMgr.Restore(payload.ID, payload.Apps)
+	if err != nil {
+		if len(restored) > 0 {
+			return nil, fmt.Errorf("%w (restored %s)", err, strings.Join(restored, ", "))
+		}
+		return nil, err
+	}
+
+	resp := protocol.NewResponse(cmd.ID, protocol.RespSuccess, true, fmt.Sprintf("restored %s", strings.Join(restored, ", ")))
+	resp.Data["apps"] = restored
+	return resp, nil
+}
+
+// handleDeleteRestorePoint removes a restore point
+func (h *Handler) handleDeleteRestorePoint(cmd *protocol.Command) (*protocol.Response, error) {
+	var payload protocol.DeleteRestorePointPayload
+	if err := cmd.DecodePayload(&payload); err != nil {
+		return nil, err
+	}
+	if err := payload.Validate(); err != nil {
+		return nil, err
+	}
+
+	if err := h.dockerMgr.DeleteRestorePoint(payload.ID); err != nil {
+		return nil, err
+	}
+
+	return protocol.NewResponse(cmd.ID, protocol.RespSuccess, true, fmt.Sprintf("deleted restore point %s", payload.ID)), nil
+}
+
+// handleExecute runs a shell command on the device
+func (h *Handler) handleExecute(cmd *protocol.Command) (*protocol.Response, error) {
+	var payload protocol.ExecutePayload
+	if err := cmd.DecodePayload(&payload); err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	if payload.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(payload.Timeout)*time.Second)
+		defer cancel()
+	}
+
+	output, err := exec.CommandContext(ctx, "sh", "-c", payload.Command).CombinedOutput()
+
+	resp := protocol.NewResponse(cmd.ID, protocol.RespOutput, err == nil, "")
+	resp.Data["output"] = string(output)
+	if err != nil {
+		resp.Message = err.Error()
+	}
+
+	return resp, nil
+}
+
+// handleGetStatus reports the applications and optionally system metrics
+func (h *Handler) handleGetStatus(cmd *protocol.Command) (*protocol.Response, error) {
+	var payload protocol.StatusPayload
+	if err := cmd.DecodePayload(&payload); err != nil {
+		return nil, err
+	}
+
+	resp := protocol.NewResponse(cmd.ID, protocol.RespStatus, true, "")
+	resp.Data["applications"] = h.dockerMgr.GetApplications()
+	if last := h.dockerMgr.LastDeployResult(); last != nil {
+		resp.Data["last_deploy"] = last
+	}
+	if payload.IncludeMetrics || payload.IncludeSystemStats {
+		resp.Data["metrics"] = h.sysMonitor.GetMetrics()
+	}
+
+	return resp, nil
+}
+
+// handleGetLogs returns the logs of a container
+func (h *Handler) handleGetLogs(cmd *protocol.Command) (*protocol.Response, error) {
+	var payload protocol.LogsPayload
+	if err := cmd.DecodePayload(&payload); err != nil {
+		return nil, err
+	}
+
+	if payload.Lines <= 0 {
+		payload.Lines = 100
+	}
+
+	logs, err := h.dockerMgr.GetContainerLogs(payload.App, payload.Container, payload.Lines)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := protocol.NewResponse(cmd.ID, protocol.RespLogs, true, "")
+	resp.Data["logs"] = logs
+	return resp, nil
+}
+
+// handleDecommission acknowledges the decommission and hands off to the agent
+// shutdown sequence, which applies the policy and reports the final state
+func (h *Handler) handleDecommission(cmd *protocol.Command) (*protocol.Response, error) {
+	var payload protocol.DecommissionPayload
+	if err := cmd.DecodePayload(&payload); err != nil {
+		return nil, err
+	}
+
+	if payload.Policy != "" && !protocol.IsShutdownPolicy(payload.Policy) {
+		return nil, fmt.Errorf("unknown shutdown policy: %s", payload.Policy)
+	}
+
+	h.logger.Info(fmt.Sprintf("Device decommissioned by server (policy: %q)", payload.Policy))
+
+	// Run asynchronously so the response is delivered before the tunnel closes
+	go h.onDecommission(payload.Policy)
+
+	return protocol.NewResponse(cmd.ID, protocol.RespSuccess, true, "decommission started"), nil
+}
+
+// handleCheckCache probes the registry caches run by this device on behalf of
+// its site, from the device itself so that the LAN address is checked too
+func (h *Handler) handleCheckCache(cmd *protocol.Command) (*protocol.Response, error) {
+	var payload protocol.CheckCachePayload
+	if err := cmd.DecodePayload(&payload); err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	results := make([]protocol.CacheCheckResult, 0, len(payload.URLs))
+	healthy := true
+	for _, url := range payload.URLs {
+		result := protocol.CacheCheckResult{URL: url}
+
+		// The registry API root answers 200 once the registry is serving
+		resp, err := client.Get(strings.TrimSuffix(url, "/") + "/v2/")
+		if err != nil {
+			result.Error = err.Error()
+		} else {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				result.OK = true
+			} else {
+				result.Error = fmt.Sprintf("unexpected status %d", resp.StatusCode)
+			}
+		}
+
+		healthy = healthy && result.OK
+		results = append(results, result)
+	}
+
+	resp := protocol.NewResponse(cmd.ID, protocol.RespStatus, healthy, "")
+	resp.Data["results"] = results
+	return resp, nil
+}
+
+// handleDiagnostics starts collecting a diagnostics bundle, which is uploaded
+// once complete
+func (h *Handler) handleDiagnostics(cmd *protocol.Command) (*protocol.Response, error) {
+	var payload protocol.DiagnosticsPayload
+	if err := cmd.DecodePayload(&payload); err != nil {
+		return nil, err
+	}
+
+	if h.diagnostics == nil {
+		return nil, fmt.Errorf("diagnostics bundles are not supported")
+	}
+	if err := h.diagnostics.Start(payload.BundleID); err != nil {
+		return nil, err
+	}
+
+	return protocol.NewResponse(cmd.ID, protocol.RespSuccess, true, "collecting diagnostics bundle"), nil
+}
+
+// handleNetworkTest runs a ping, traceroute, DNS or bandwidth test towards a
+// target. A failed test still returns what it measured.
+func (h *Handler) handleNetworkTest(cmd *protocol.Command) (*protocol.Response, error) {
+	var payload protocol.NetworkTestPayload
+	if err := cmd.DecodePayload(&payload); err != nil {
+		return nil, err
+	}
+	if err := payload.Normalize(); err != nil {
+		return nil, err
+	}
+
+	result, err := diagnostics.RunNetworkTest(context.Background(), &payload)
+	resp := protocol.NewResponse(cmd.ID, protocol.RespSuccess, true,
+		fmt.Sprintf("%s %s done", payload.Test, payload.Target))
+	if err != nil {
+		resp = protocol.NewResponse(cmd.ID, protocol.RespError, false,
+			fmt.Sprintf("%s %s failed: %v", payload.Test, payload.Target, err))
+	}
+	resp.Data["result"] = result
+	return resp, nil
+}
+
+// handleCapture starts a packet capture, which is streamed to the server
+// while it runs
+func (h *Handler) handleCapture(cmd *protocol.Command) (*protocol.Response, error) {
+	var payload protocol.CapturePayload
+	if err := cmd.DecodePayload(&payload); err != nil {
+		return nil, err
+	}
+	if err := payload.Normalize(); err != nil {
+		return nil, err
+	}
+
+	if h.capturer == nil {
+		return nil, fmt.Errorf("packet captures are not supported")
+	}
+	if err := h.capturer.Start(&payload); err != nil {
+		return nil, err
+	}
+
+	return protocol.NewResponse(cmd.ID, protocol.RespSuccess, true,
+		fmt.Sprintf("capturing for %d seconds", payload.Duration)), nil
+}
+
+// handleConfigureNTP points the time service of the host at new NTP servers
+func (h *Handler) handleConfigureNTP(cmd *protocol.Command) (*protocol.Response, error) {
+	var payload protocol.NTPPayload
+	if err := cmd.DecodePayload(&payload); err != nil {
+		return nil, err
+	}
+
+	service, changed, err := h.sysMonitor.ConfigureNTP(payload.Servers)
+	if err != nil {
+		return nil, err
+	}
+
+	message := fmt.Sprintf("%s already uses the requested NTP servers", service)
+	if changed {
+		message = fmt.Sprintf("configured %s", service)
+	}
+
+	resp := protocol.NewResponse(cmd.ID, protocol.RespSuccess, true, message)
+	resp.Data["service"] = service
+	resp.Data["changed"] = changed
+	return resp, nil
+}
+
+// handleSetTimezone sets the timezone and locale of the host
+func (h *Handler) handleSetTimezone(cmd *protocol.Command) (*protocol.Response, error) {
+	var payload protocol.TimezonePayload
+	if err := cmd.DecodePayload(&payload); err != nil {
+		return nil, err
+	}
+
+	changed, err := h.sysMonitor.ConfigureTimezone(payload.Timezone, payload.Locale)
+	if err != nil {
+		return nil, err
+	}
+
+	message := "timezone and locale already in effect"
+	if changed {
+		message = "timezone and locale updated"
+	}
+
+	resp := protocol.NewResponse(cmd.ID, protocol.RespSuccess, true, message)
+	resp.Data["changed"] = changed
+	return resp, nil
+}
+
+// handleConfigurePlugins sets the settings of the plugins and looks for
+// newly installed ones
+func (h *Handler) handleConfigurePlugins(cmd *protocol.Command) (*protocol.Response, error) {
+	var payload protocol.PluginsPayload
+	if err := cmd.DecodePayload(&payload); err != nil {
+		return nil, err
+	}
+
+	if h.plugins == nil || !h.plugins.Enabled() {
+		return nil, fmt.Errorf("plugins are not enabled, set plugins.dir")
+	}
+	h.plugins.Configure(payload.Settings)
+	if err := h.plugins.Discover(context.Background()); err != nil {
+		return nil, err
+	}
+
+	installed := h.plugins.Plugins(context.Background())
+	resp := protocol.NewResponse(cmd.ID, protocol.RespSuccess, true,
+		fmt.Sprintf("configured %d plugins", len(installed)))
+	resp.Data["plugins"] = installed
+	return resp, nil
+}
+
+// handlePluginAction runs an action of a plugin
+func (h *Handler) handlePluginAction(cmd *protocol.Command) (*protocol.Response, error) {
+	var payload protocol.PluginActionPayload
+	if err := cmd.DecodePayload(&payload); err != nil {
+		return nil, err
+	}
+
+	if h.plugins == nil || !h.plugins.Enabled() {
+		return nil, fmt.Errorf("plugins are not enabled, set plugins.dir")
+	}
+	result, err := h.plugins.Run(context.Background(), payload.Plugin, payload.Action, payload.Params)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s failed: %w", payload.Plugin, payload.Action, err)
+	}
+
+	resp := protocol.NewResponse(cmd.ID, protocol.RespSuccess, true,
+		fmt.Sprintf("ran %s %s", payload.Plugin, payload.Action))
+	resp.Data["result"] = result
+	return resp, nil
+}
+
+// handleConfigureDisplay sets the URL, rotation and blanking periods of the
+// kiosk display
+func (h *Handler) handleConfigureDisplay(cmd *protocol.Command) (*protocol.Response, error) {
+	var payload protocol.DisplayPayload
+	if err := cmd.DecodePayload(&payload); err != nil {
+		return nil, err
+	}
+
+	if h.display == nil || !h.display.Enabled() {
+		return nil, fmt.Errorf("display is not enabled, set display.enabled")
+	}
+	changed, err := h.display.Apply(context.Background(), payload)
+	if err != nil {
+		return nil, err
+	}
+
+	message := "display unchanged"
+	if len(changed) > 0 {
+		message = "changed display " + strings.Join(changed, ", ")
+	}
+	resp := protocol.NewResponse(cmd.ID, protocol.RespSuccess, true, message)
+	resp.Data["changed"] = changed
+	return resp, nil
+}
+
+// handleScreenshot takes a picture of the kiosk display
+func (h *Handler) handleScreenshot(cmd *protocol.Command) (*protocol.Response, error) {
+	if h.display == nil || !h.display.Enabled() {
+		return nil, fmt.Errorf("display is not enabled, set display.enabled")
+	}
+	image, err := h.display.Screenshot(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	resp := protocol.NewResponse(cmd.ID, protocol.RespSuccess, true,
+		fmt.Sprintf("took screenshot of %d bytes", len(image)))
+	resp.Data["screenshot"] = protocol.Screenshot{Image: image, Taken: time.Now()}
+	return resp, nil
+}
+
+// handleRestartHostService restarts a monitored systemd unit of the host, if the
+// configuration allows it
+func (h *Handler) handleRestartHostService(cmd *protocol.Command) (*protocol.Response, error) {
+	var payload protocol.RestartHostServicePayload
+	if err := cmd.DecodePayload(&payload); err != nil {
+		return nil, err
+	}
+	if err := payload.Validate(); err != nil {
+		return nil, err
+	}
+
+	if h.config == nil || !h.config().HostServices.AllowRestart {
+		return nil, fmt.Errorf("restarting host services is not allowed, set host_services.allow_restart")
+	}
+	if !slices.Contains(h.config().HostServices.Units, payload.Name) {
+		return nil, fmt.Errorf("%s is not a monitored unit", payload.Name)
+	}
+	if err := h.sysMonitor.RestartHostService(context.Background(), payload.Name); err != nil {
+		return nil, err
+	}
+
+	return protocol.NewResponse(cmd.ID, protocol.RespSuccess, true, fmt.Sprintf("restarted %s", payload.Name)), nil
+}
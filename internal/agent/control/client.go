@@ -0,0 +1,132 @@
+package control
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// restartTimeout bounds a restart, which waits for every service to be ready
+const restartTimeout = 15 * time.Minute
+
+// rollbackTimeout bounds a rollback, which may pull images that are gone
+const rollbackTimeout = 30 * time.Minute
+
+// Client talks to a running agent over its control socket
+type Client struct {
+	httpClient *http.Client
+}
+
+// NewClient creates a new control client for the given socket path
+func NewClient(socketPath string) *Client {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socketPath)
+		},
+	}
+
+	return &Client{
+		httpClient: &http.Client{
+			Transport: transport,
+			Timeout:   60 * time.Second,
+		},
+	}
+}
+
+// Status returns the raw status document
+func (c *Client) Status() ([]byte, error) {
+	return c.do(http.MethodGet, "/status", nil)
+}
+
+// Apps returns the raw application list
+func (c *Client) Apps() ([]byte, error) {
+	return c.do(http.MethodGet, "/apps", nil)
+}
+
+// Logs returns the logs of a container
+func (c *Client) Logs(app, container string, lines int) ([]byte, error) {
+	query := url.Values{}
+	query.Set("app", app)
+	query.Set("container", container)
+	query.Set("lines", fmt.Sprintf("%d", lines))
+	return c.do(http.MethodGet, "/logs", query)
+}
+
+// Resync asks the agent to reload its state and reconnect
+func (c *Client) Resync() ([]byte, error) {
+	return c.do(http.MethodPost, "/resync", nil)
+}
+
+// Restart restarts services of an application, all of them if none are given.
+// Waiting for services to become ready may take minutes.
+func (c *Client) Restart(app string, services []string, noDeps, rolling bool) ([]byte, error) {
+	query := url.Values{}
+	query.Set("app", app)
+	query["service"] = services
+	query.Set("no_deps", strconv.FormatBool(noDeps))
+	query.Set("rolling", strconv.FormatBool(rolling))
+
+	client := *c.httpClient
+	client.Timeout = restartTimeout
+	return c.doWith(&client, http.MethodPost, "/restart", query)
+}
+
+// History returns the deployments of an application on the device
+func (c *Client) History(app string) ([]byte, error) {
+	query := url.Values{}
+	query.Set("app", app)
+	return c.do(http.MethodGet, "/history", query)
+}
+
+// Rollback deploys an earlier version of an application from the files kept
+// on the device, the last other version that succeeded if none is given
+func (c *Client) Rollback(app, version string) ([]byte, error) {
+	query := url.Values{}
+	query.Set("app", app)
+	if version != "" {
+		query.Set("version", version)
+	}
+
+	client := *c.httpClient
+	client.Timeout = rollbackTimeout
+	return c.doWith(&client, http.MethodPost, "/rollback", query)
+}
+
+// do performs a request against the control socket
+func (c *Client) do(method, path string, query url.Values) ([]byte, error) {
+	return c.doWith(c.httpClient, method, path, query)
+}
+
+// doWith performs a request against the control socket with the given client
+func (c *Client) doWith(httpClient *http.Client, method, path string, query url.Values) ([]byte, error) {
+	// The host is ignored by the unix socket dialer
+	u := url.URL{Scheme: "http", Host: "agent", Path: path, RawQuery: query.Encode()}
+
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach agent (is it running?): %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("agent returned %s: %s", resp.Status, string(body))
+	}
+
+	return body, nil
+}
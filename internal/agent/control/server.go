@@ -0,0 +1,254 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/agent/docker"
+	"github.com/edgetainer/edgetainer/internal/agent/health"
+	"github.com/edgetainer/edgetainer/internal/agent/ssh"
+	"github.com/edgetainer/edgetainer/internal/shared/logging"
+)
+
+// Server exposes agent state and maintenance actions over a local unix socket
+// so technicians can diagnose a device on-site, even without an uplink
+type Server struct {
+	socketPath string
+	collector  *health.Server
+	sshClient  *ssh.Client
+	dockerMgr  *docker.Manager
+	httpServer *http.Server
+	logger     *logging.Logger
+}
+
+// NewServer creates a new control server bound to socketPath
+func NewServer(socketPath string, collector *health.Server, sshClient *ssh.Client, dockerMgr *docker.Manager) *Server {
+	return &Server{
+		socketPath: socketPath,
+		collector:  collector,
+		sshClient:  sshClient,
+		dockerMgr:  dockerMgr,
+		logger:     logging.WithComponent("control-server"),
+	}
+}
+
+// Start starts listening on the unix socket
+func (s *Server) Start() error {
+	dir := filepath.Dir(s.socketPath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create socket directory: %w", err)
+	}
+
+	// Remove a stale socket left behind by a previous run
+	if err := os.Remove(s.socketPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale socket: %w", err)
+	}
+
+	listener, err := net.Listen("unix", s.socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.socketPath, err)
+	}
+
+	// Only root and the owning group may talk to the agent
+	if err := os.Chmod(s.socketPath, 0660); err != nil {
+		listener.Close()
+		return fmt.Errorf("failed to set socket permissions: %w", err)
+	}
+
+	router := http.NewServeMux()
+	router.HandleFunc("/status", s.handleStatus)
+	router.HandleFunc("/apps", s.handleApps)
+	router.HandleFunc("/logs", s.handleLogs)
+	router.HandleFunc("/resync", s.handleResync)
+	router.HandleFunc("/restart", s.handleRestart)
+	router.HandleFunc("/history", s.handleHistory)
+	router.HandleFunc("/rollback", s.handleRollback)
+
+	s.httpServer = &http.Server{Handler: router}
+
+	s.logger.Info(fmt.Sprintf("Control socket listening on %s", s.socketPath))
+
+	go func() {
+		if err := s.httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			s.logger.Error("Control server error", err)
+		}
+	}()
+
+	return nil
+}
+
+// Shutdown stops the control server and removes the socket
+func (s *Server) Shutdown() {
+	if s.httpServer == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := s.httpServer.Shutdown(ctx); err != nil {
+		s.logger.Error("Control server shutdown error", err)
+	}
+	os.Remove(s.socketPath)
+}
+
+// handleStatus returns the full agent status
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	jsonResponse(w, s.collector.Collect(), http.StatusOK)
+}
+
+// handleApps returns the applications managed by the agent
+func (s *Server) handleApps(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	jsonResponse(w, s.dockerMgr.GetApplications(), http.StatusOK)
+}
+
+// handleLogs returns the logs of a container
+func (s *Server) handleLogs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	app := r.URL.Query().Get("app")
+	container := r.URL.Query().Get("container")
+	if app == "" || container == "" {
+		http.Error(w, "app and container are required", http.StatusBadRequest)
+		return
+	}
+
+	lines := 100
+	if l, err := strconv.Atoi(r.URL.Query().Get("lines")); err == nil && l > 0 {
+		lines = l
+	}
+
+	logs, err := s.dockerMgr.GetContainerLogs(app, container, lines)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(logs))
+}
+
+// handleRestart restarts the services of an application in dependency order
+func (s *Server) handleRestart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	app := query.Get("app")
+	if app == "" {
+		http.Error(w, "app is required", http.StatusBadRequest)
+		return
+	}
+
+	results, err := s.dockerMgr.RestartApplication(app, query["service"], query.Get("no_deps") == "true", query.Get("rolling") == "true")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse(w, results, http.StatusOK)
+}
+
+// handleHistory returns the deployments of an application on the device
+func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	app := r.URL.Query().Get("app")
+	if app == "" {
+		http.Error(w, "app is required", http.StatusBadRequest)
+		return
+	}
+
+	records, err := s.dockerMgr.DeploymentHistory(app)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse(w, records, http.StatusOK)
+}
+
+// handleRollback deploys an earlier version of an application from the files
+// kept on the device
+func (s *Server) handleRollback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	app := query.Get("app")
+	if app == "" {
+		http.Error(w, "app is required", http.StatusBadRequest)
+		return
+	}
+
+	s.logger.Info(fmt.Sprintf("Rollback of application %s requested over control socket", app))
+	record, err := s.dockerMgr.RollbackApplication(app, query.Get("version"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse(w, record, http.StatusOK)
+}
+
+// handleResync reloads local application state and forces a tunnel reconnect
+func (s *Server) handleResync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.logger.Info("Resync requested over control socket")
+
+	response := map[string]interface{}{
+		"apps_reloaded":       true,
+		"reconnect_scheduled": true,
+	}
+
+	if err := s.dockerMgr.Resync(); err != nil {
+		s.logger.Error("Failed to resync applications", err)
+		response["apps_reloaded"] = false
+		response["error"] = err.Error()
+	}
+
+	s.sshClient.Reconnect()
+
+	jsonResponse(w, response, http.StatusOK)
+}
+
+// jsonResponse sends a JSON response
+func jsonResponse(w http.ResponseWriter, data interface{}, statusCode int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,208 @@
+package diagnostics
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/edgetainer/edgetainer/internal/shared/credentials"
+)
+
+const (
+	// commandTimeout bounds a single command run for a bundle
+	commandTimeout = 30 * time.Second
+	// maxFileSize bounds a file in a bundle, longer output is cut from the
+	// start so the most recent lines are kept
+	maxFileSize = 4 * 1024 * 1024
+)
+
+// entry describes a file of a bundle in its manifest
+type entry struct {
+	File    string  `json:"file"`
+	Source  string  `json:"source,omitempty"` // Command or file the contents came from
+	Error   string  `json:"error,omitempty"`
+	Seconds float64 `json:"seconds,omitempty"`
+}
+
+// bundle writes a gzipped tar archive of diagnostics files below a common
+// directory, and records every file in a manifest written last
+type bundle struct {
+	ctx      context.Context
+	dir      string
+	buf      bytes.Buffer
+	gz       *gzip.Writer
+	tw       *tar.Writer
+	manifest []entry
+	created  time.Time
+}
+
+// newBundle starts an archive whose files are placed below dir
+func newBundle(ctx context.Context, dir string) *bundle {
+	b := &bundle{ctx: ctx, dir: dir, created: time.Now()}
+	b.gz = gzip.NewWriter(&b.buf)
+	b.tw = tar.NewWriter(b.gz)
+	return b
+}
+
+// add writes a file to the archive
+func (b *bundle) add(name string, data []byte) error {
+	header := &tar.Header{
+		Name:    path.Join(b.dir, name),
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	}
+	if err := b.tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := b.tw.Write(data)
+	return err
+}
+
+// addEntry writes a file and records it in the manifest. A file that could
+// not be collected is still written with the error, so the bundle shows what
+// was attempted. Credentials in text files are redacted.
+func (b *bundle) addEntry(e entry, data []byte) error {
+	if e.Error != "" && len(data) == 0 {
+		data = []byte(e.Error + "\n")
+	}
+	if utf8.Valid(data) {
+		data = []byte(credentials.Redact(string(data)))
+	}
+	b.manifest = append(b.manifest, e)
+	return b.add(e.File, data)
+}
+
+// text writes a file with the given contents
+func (b *bundle) text(name, contents string) error {
+	return b.addEntry(entry{File: name}, []byte(contents))
+}
+
+// run writes the output of a command. Failing commands are recorded along
+// with their output, e.g. for tools that are not installed.
+func (b *bundle) run(name string, command ...string) error {
+	_, err := b.output(name, command...)
+	return err
+}
+
+// command is a command run for a bundle and the file its output goes to
+type command struct {
+	file string
+	args []string
+}
+
+// runAll runs commands in order like run
+func (b *bundle) runAll(commands []command) error {
+	for _, cmd := range commands {
+		if err := b.run(cmd.file, cmd.args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// output writes the output of a command like run and returns it, nil if the
+// command failed
+func (b *bundle) output(name string, command ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(b.ctx, commandTimeout)
+	defer cancel()
+
+	start := time.Now()
+	output, err := exec.CommandContext(ctx, command[0], command[1:]...).CombinedOutput()
+	e := entry{
+		File:    name,
+		Source:  strings.Join(command, " "),
+		Seconds: time.Since(start).Seconds(),
+	}
+	switch {
+	case errors.Is(err, exec.ErrNotFound):
+		e.Error = fmt.Sprintf("%s is not installed", command[0])
+	case ctx.Err() == context.DeadlineExceeded:
+		e.Error = fmt.Sprintf("timed out after %s", commandTimeout)
+	case err != nil:
+		e.Error = err.Error()
+	}
+	if err := b.addEntry(e, keepTail(output, maxFileSize)); err != nil {
+		return nil, err
+	}
+	if e.Error != "" {
+		return nil, nil
+	}
+	return output, nil
+}
+
+// file writes the end of a file of the device
+func (b *bundle) file(name, path string) error {
+	e := entry{File: name, Source: path}
+	data, err := readTail(path, maxFileSize)
+	if err != nil {
+		e.Error = err.Error()
+	}
+	return b.addEntry(e, data)
+}
+
+// close writes the manifest and returns the archive
+func (b *bundle) close() ([]byte, error) {
+	manifest, err := json.MarshalIndent(map[string]interface{}{
+		"created": b.created,
+		"files":   b.manifest,
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := b.add("manifest.json", manifest); err != nil {
+		return nil, err
+	}
+
+	if err := b.tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := b.gz.Close(); err != nil {
+		return nil, err
+	}
+	return b.buf.Bytes(), nil
+}
+
+// readTail reads at most max bytes from the end of a file
+func readTail(path string, max int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() > max {
+		if _, err := f.Seek(info.Size()-max, io.SeekStart); err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(f)
+		return append([]byte(truncated), data...), err
+	}
+	return io.ReadAll(f)
+}
+
+// truncated marks data that was cut from the start
+const truncated = "[earlier output truncated]\n"
+
+// keepTail cuts data from the start to at most max bytes
+func keepTail(data []byte, max int) []byte {
+	if len(data) <= max {
+		return data
+	}
+	return append([]byte(truncated), data[len(data)-max:]...)
+}
@@ -0,0 +1,218 @@
+package diagnostics
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/config"
+	"github.com/edgetainer/edgetainer/internal/shared/logging"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+// captureStopDelay is how long tcpdump may take to exit once interrupted
+const captureStopDelay = 5 * time.Second
+
+var (
+	// capturedPackets and droppedPackets match the statistics tcpdump
+	// prints when it exits
+	capturedPackets = regexp.MustCompile(`(\d+) packets? captured`)
+	droppedPackets  = regexp.MustCompile(`(\d+) packets? dropped by kernel`)
+	// hostName matches host names tcpdump accepts in a filter
+	hostName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9.-]*$`)
+)
+
+// ChunkFunc sends a part of a packet capture to the server, returning once
+// the server stored it
+type ChunkFunc func(chunk protocol.CaptureChunk) error
+
+// Capturer runs packet captures with tcpdump and streams them to the server
+// as they are written
+type Capturer struct {
+	config  func() *config.AgentConfig
+	send    ChunkFunc
+	running atomic.Bool
+	logger  *logging.Logger
+}
+
+// NewCapturer creates a capturer reading the agent configuration in effect
+// through cfg
+func NewCapturer(cfg func() *config.AgentConfig) *Capturer {
+	return &Capturer{
+		config: cfg,
+		logger: logging.WithComponent("capture"),
+	}
+}
+
+// SetSender sets how captured packets reach the server
+func (c *Capturer) SetSender(send ChunkFunc) {
+	c.send = send
+}
+
+// Start starts a normalized capture and streams it in the background. Only
+// one capture runs at a time.
+func (c *Capturer) Start(payload *protocol.CapturePayload) error {
+	if c.send == nil {
+		return fmt.Errorf("packet captures cannot be uploaded")
+	}
+	if _, err := exec.LookPath("tcpdump"); err != nil {
+		return fmt.Errorf("tcpdump is not installed")
+	}
+
+	iface := payload.Interface
+	if payload.Network != "" {
+		var err error
+		if iface, err = bridgeInterface(payload.Network); err != nil {
+			return err
+		}
+	}
+
+	if !c.running.CompareAndSwap(false, true) {
+		return fmt.Errorf("a packet capture is already running")
+	}
+
+	go func() {
+		defer c.running.Store(false)
+
+		start := time.Now()
+		last, err := c.capture(payload, iface)
+		if err != nil {
+			c.logger.Error(fmt.Sprintf("Packet capture %s on %s failed", payload.CaptureID, iface), err)
+			last = protocol.CaptureChunk{CaptureID: payload.CaptureID, Part: last.Part, Last: true, Error: err.Error()}
+		} else {
+			c.logger.Info(fmt.Sprintf("Captured %d packets on %s in %s", last.Packets, iface, time.Since(start).Round(time.Second)))
+		}
+
+		if err := c.send(last); err != nil {
+			c.logger.Error(fmt.Sprintf("Failed to finish upload of packet capture %s", payload.CaptureID), err)
+		}
+	}()
+	return nil
+}
+
+// capture runs tcpdump and sends what it writes as it arrives. It returns
+// the last part to send, which carries the statistics, or an error with the
+// number of the part that should have been sent next.
+func (c *Capturer) capture(payload *protocol.CapturePayload, iface string) (protocol.CaptureChunk, error) {
+	last := protocol.CaptureChunk{CaptureID: payload.CaptureID, Part: 1, Last: true}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(payload.Duration)*time.Second)
+	defer cancel()
+
+	// -U writes every packet as it is captured rather than when a buffer
+	// fills, so short captures arrive too
+	args := []string{"-i", iface, "-n", "-U", "-w", "-"}
+	if payload.SnapLen > 0 {
+		args = append(args, "-s", strconv.Itoa(payload.SnapLen))
+	}
+	if filter := c.filter(payload.Filter); filter != "" {
+		args = append(args, "--", filter)
+	}
+
+	cmd := exec.CommandContext(ctx, "tcpdump", args...)
+	// Interrupting lets tcpdump finish the file and print its statistics
+	cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
+	cmd.WaitDelay = captureStopDelay
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return last, err
+	}
+	if err := cmd.Start(); err != nil {
+		return last, fmt.Errorf("failed to start tcpdump: %w", err)
+	}
+
+	var sent int64
+	buf := make([]byte, protocol.MaxCaptureChunk)
+	for {
+		n, readErr := io.ReadFull(stdout, buf)
+		if remaining := payload.MaxBytes - sent; int64(n) >= remaining {
+			n, last.Truncated = int(remaining), true
+		}
+		if n > 0 {
+			chunk := protocol.CaptureChunk{CaptureID: payload.CaptureID, Part: last.Part, Data: buf[:n]}
+			if err := c.send(chunk); err != nil {
+				cancel()
+				cmd.Wait()
+				return last, fmt.Errorf("failed to send part %d: %w", chunk.Part, err)
+			}
+			sent += int64(n)
+			last.Part++
+		}
+		if last.Truncated || readErr != nil {
+			break
+		}
+	}
+
+	// Stop tcpdump at the size limit, and drain what it writes until it
+	// exits
+	cancel()
+	io.Copy(io.Discard, stdout)
+	waitErr := cmd.Wait()
+
+	output := stderr.Bytes()
+	if m := capturedPackets.FindSubmatch(output); m != nil {
+		last.Packets, _ = strconv.Atoi(string(m[1]))
+	}
+	if m := droppedPackets.FindSubmatch(output); m != nil {
+		last.Dropped, _ = strconv.Atoi(string(m[1]))
+	}
+
+	// Stopping tcpdump is how every capture ends, so only an exit before
+	// anything was captured is an error, e.g. for an unknown interface or an
+	// invalid filter
+	if waitErr != nil && ctx.Err() == nil && sent == 0 {
+		return last, fmt.Errorf("tcpdump failed: %s", toolError(waitErr, output))
+	}
+	return last, nil
+}
+
+// filter combines a capture filter with one excluding the tunnel to the
+// server, whose traffic would otherwise grow with the upload of the capture
+// itself
+func (c *Capturer) filter(filter string) string {
+	cfg := c.config()
+	tunnel := fmt.Sprintf("not (host %s and tcp port %d)", cfg.Server.Host, cfg.SSH.Port)
+	if ip := net.ParseIP(cfg.Server.Host); ip == nil && !hostName.MatchString(cfg.Server.Host) {
+		// A host tcpdump cannot parse would fail every capture
+		tunnel = ""
+	}
+
+	switch {
+	case filter == "":
+		return tunnel
+	case tunnel == "":
+		return filter
+	default:
+		return fmt.Sprintf("(%s) and %s", filter, tunnel)
+	}
+}
+
+// bridgeInterface returns the Linux bridge of a Docker bridge network
+func bridgeInterface(network string) (string, error) {
+	output, err := exec.Command("docker", "network", "inspect", "--format",
+		`{{.Driver}} {{.Id}} {{with index .Options "com.docker.network.bridge.name"}}{{.}}{{end}}`, network).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect network %s: %s", network, toolError(err, output))
+	}
+
+	fields := strings.Fields(string(output))
+	if len(fields) < 2 || fields[0] != "bridge" || len(fields[1]) < 12 {
+		return "", fmt.Errorf("network %s is not a bridge network", network)
+	}
+	if len(fields) > 2 {
+		return fields[2], nil
+	}
+	// Docker names the bridges of user defined networks after their ID
+	return "br-" + fields[1][:12], nil
+}
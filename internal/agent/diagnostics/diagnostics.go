@@ -0,0 +1,286 @@
+package diagnostics
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/agent/docker"
+	"github.com/edgetainer/edgetainer/internal/agent/system"
+	"github.com/edgetainer/edgetainer/internal/shared/compose"
+	"github.com/edgetainer/edgetainer/internal/shared/config"
+	"github.com/edgetainer/edgetainer/internal/shared/logging"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+// collectTimeout bounds collecting a whole bundle
+const collectTimeout = 10 * time.Minute
+
+// UploadFunc uploads a collected bundle, or reports the error that kept it
+// from being collected
+type UploadFunc func(bundleID string, bundle []byte, collectErr error) error
+
+// Collector assembles diagnostics bundles: agent logs and configuration,
+// Docker state, the compose files of the applications with secrets redacted,
+// network and disk diagnostics
+type Collector struct {
+	dockerMgr  *docker.Manager
+	sysMonitor *system.Monitor
+	config     func() *config.AgentConfig
+	upload     UploadFunc
+	running    atomic.Bool
+	logger     *logging.Logger
+}
+
+// NewCollector creates a collector reading the agent configuration in effect
+// through cfg
+func NewCollector(dockerMgr *docker.Manager, sysMonitor *system.Monitor, cfg func() *config.AgentConfig) *Collector {
+	return &Collector{
+		dockerMgr:  dockerMgr,
+		sysMonitor: sysMonitor,
+		config:     cfg,
+		logger:     logging.WithComponent("diagnostics"),
+	}
+}
+
+// SetUploader sets how collected bundles reach the server
+func (c *Collector) SetUploader(upload UploadFunc) {
+	c.upload = upload
+}
+
+// Start collects a bundle in the background and uploads it. Only one bundle
+// is collected at a time.
+func (c *Collector) Start(bundleID string) error {
+	if c.upload == nil {
+		return fmt.Errorf("diagnostics bundles cannot be uploaded")
+	}
+	if !c.running.CompareAndSwap(false, true) {
+		return fmt.Errorf("a diagnostics bundle is already being collected")
+	}
+
+	go func() {
+		defer c.running.Store(false)
+
+		ctx, cancel := context.WithTimeout(context.Background(), collectTimeout)
+		defer cancel()
+
+		start := time.Now()
+		data, err := c.Collect(ctx)
+		if err != nil {
+			c.logger.Error(fmt.Sprintf("Failed to collect diagnostics bundle %s", bundleID), err)
+		} else {
+			c.logger.Info(fmt.Sprintf("Collected diagnostics bundle %s (%d bytes) in %s",
+				bundleID, len(data), time.Since(start).Round(time.Millisecond)))
+		}
+
+		if err := c.upload(bundleID, data, err); err != nil {
+			c.logger.Error(fmt.Sprintf("Failed to upload diagnostics bundle %s", bundleID), err)
+		}
+	}()
+	return nil
+}
+
+// Collect assembles a bundle as a gzipped tar archive. Sources that fail are
+// recorded in the bundle rather than failing it.
+func (c *Collector) Collect(ctx context.Context) ([]byte, error) {
+	cfg := c.config()
+	b := newBundle(ctx, fmt.Sprintf("diagnostics-%s-%s", cfg.Device.ID, time.Now().UTC().Format("20060102-150405")))
+
+	steps := []func(*bundle, *config.AgentConfig) error{
+		c.collectAgent,
+		c.collectSystem,
+		c.collectDocker,
+		c.collectApps,
+		c.collectNetwork,
+		c.collectDisks,
+	}
+	for _, step := range steps {
+		if err := step(b, cfg); err != nil {
+			return nil, fmt.Errorf("failed to write bundle: %w", err)
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("collecting diagnostics took too long: %w", err)
+		}
+	}
+
+	data, err := b.close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to write bundle: %w", err)
+	}
+	if len(data) > protocol.MaxBundleSize {
+		return nil, fmt.Errorf("bundle of %d bytes exceeds the limit of %d bytes", len(data), protocol.MaxBundleSize)
+	}
+	return data, nil
+}
+
+// collectAgent adds the agent log and configuration
+func (c *Collector) collectAgent(b *bundle, cfg *config.AgentConfig) error {
+	if cfg.Logging.LogFile != "" {
+		if err := b.file("agent/agent.log", cfg.Logging.LogFile); err != nil {
+			return err
+		}
+	}
+
+	redacted, err := config.Redact(cfg)
+	if err != nil {
+		redacted = err.Error()
+	}
+	return b.text("agent/config.yaml", redacted)
+}
+
+// collectSystem adds the OS, kernel messages and the metrics the agent reports
+func (c *Collector) collectSystem(b *bundle, cfg *config.AgentConfig) error {
+	metrics, _ := json.MarshalIndent(c.sysMonitor.GetMetrics(), "", "  ")
+	if err := b.text("system/metrics.json", string(metrics)); err != nil {
+		return err
+	}
+	if err := b.file("system/os-release", filepath.Join(cfg.System.HostRoot, "/etc/os-release")); err != nil {
+		return err
+	}
+	return b.runAll([]command{
+		{"system/uname.txt", []string{"uname", "-a"}},
+		{"system/uptime.txt", []string{"uptime"}},
+		{"system/dmesg.txt", []string{"dmesg"}},
+	})
+}
+
+// collectDocker adds the state of the Docker engine and its containers
+func (c *Collector) collectDocker(b *bundle, cfg *config.AgentConfig) error {
+	return b.runAll([]command{
+		{"docker/version.txt", []string{"docker", "version"}},
+		{"docker/info.txt", []string{"docker", "info"}},
+		{"docker/ps.txt", []string{"docker", "ps", "--all", "--no-trunc"}},
+		{"docker/networks.txt", []string{"docker", "network", "ls"}},
+		{"docker/disk-usage.txt", []string{"docker", "system", "df"}},
+	})
+}
+
+// collectApps adds the compose files of the applications with secrets
+// redacted, and the names of their env vars without values
+func (c *Collector) collectApps(b *bundle, cfg *config.AgentConfig) error {
+	apps := c.dockerMgr.GetApplications()
+	names := make([]string, 0, len(apps))
+	for name := range apps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		app := apps[name]
+		files, _ := filepath.Glob(filepath.Join(app.Path, "*.y*ml"))
+		for _, file := range files {
+			e := entry{File: path.Join("apps", name, filepath.Base(file)), Source: file}
+			var redacted string
+			data, err := os.ReadFile(file)
+			if err == nil {
+				redacted, err = compose.Redact(string(data))
+			}
+			if err != nil {
+				e.Error = err.Error()
+			}
+			if err := b.addEntry(e, []byte(redacted)); err != nil {
+				return err
+			}
+		}
+
+		envFile := filepath.Join(app.Path, ".env")
+		if data, err := os.ReadFile(envFile); err == nil {
+			e := entry{File: path.Join("apps", name, "env"), Source: envFile}
+			if err := b.addEntry(e, redactEnvFile(data)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// collectNetwork adds the network configuration and whether the server can be
+// resolved and reached
+func (c *Collector) collectNetwork(b *bundle, cfg *config.AgentConfig) error {
+	err := b.runAll([]command{
+		{"network/addresses.txt", []string{"ip", "address"}},
+		{"network/routes.txt", []string{"ip", "route"}},
+		{"network/routes6.txt", []string{"ip", "-6", "route"}},
+		{"network/sockets.txt", []string{"ss", "-tunap"}},
+	})
+	if err != nil {
+		return err
+	}
+	if err := b.file("network/resolv.conf", "/etc/resolv.conf"); err != nil {
+		return err
+	}
+
+	if cfg.Server.Host == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(b.ctx, commandTimeout)
+	defer cancel()
+	start := time.Now()
+	addrs, err := net.DefaultResolver.LookupHost(ctx, cfg.Server.Host)
+	e := entry{File: "network/server-dns.txt", Source: "lookup " + cfg.Server.Host, Seconds: time.Since(start).Seconds()}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	if err := b.addEntry(e, []byte(strings.Join(addrs, "\n"))); err != nil {
+		return err
+	}
+
+	return b.run("network/server-ping.txt", "ping", "-c", "3", "-W", "2", cfg.Server.Host)
+}
+
+// collectDisks adds the filesystems and block devices, and the SMART data of
+// the disks smartctl finds
+func (c *Collector) collectDisks(b *bundle, cfg *config.AgentConfig) error {
+	err := b.runAll([]command{
+		{"disks/df.txt", []string{"df", "-h"}},
+		{"disks/lsblk.txt", []string{"lsblk", "-o", "NAME,SIZE,TYPE,FSTYPE,MOUNTPOINT,MODEL"}},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Lines look like "/dev/sda -d sat # /dev/sda [SAT], ATA device"
+	scan, err := b.output("disks/smart-scan.txt", "smartctl", "--scan")
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(scan))
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		args := append([]string{"smartctl", "--all"}, fields...)
+		if err := b.run(fmt.Sprintf("disks/smart-%s.txt", filepath.Base(fields[0])), args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// redactEnvFile keeps the names of the variables of a .env file and replaces
+// their values, which are secrets as often as not
+func redactEnvFile(data []byte) []byte {
+	var out bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if name, _, found := strings.Cut(line, "="); found && !strings.HasPrefix(strings.TrimSpace(line), "#") {
+			line = name + "=" + compose.Redacted
+		}
+		out.WriteString(line + "\n")
+	}
+	return out.Bytes()
+}
@@ -0,0 +1,316 @@
+package diagnostics
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+// probeTimeout bounds a single ping or traceroute probe, and probeInterval
+// spaces TCP probes like ping spaces its own
+const (
+	probeTimeout  = 2 * time.Second
+	probeInterval = time.Second
+)
+
+var (
+	// pingAddress matches the header line of iputils and BusyBox ping,
+	// e.g. "PING example.com (93.184.216.34) 56(84) bytes of data."
+	pingAddress = regexp.MustCompile(`^PING [^ ]+ \(([^)]+)\)`)
+	// pingReply matches the round trip time of a reply line
+	pingReply = regexp.MustCompile(`time[=<]([0-9.]+) ?ms`)
+	// pingSent matches the summary line
+	pingSent = regexp.MustCompile(`(\d+) packets transmitted`)
+)
+
+// RunNetworkTest runs a normalized network test. The result holds whatever
+// was measured even if the test failed part way.
+func RunNetworkTest(ctx context.Context, payload *protocol.NetworkTestPayload) (*protocol.NetworkTestResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(payload.Timeout)*time.Second)
+	defer cancel()
+
+	result := &protocol.NetworkTestResult{Test: payload.Test, Target: payload.Target}
+	start := time.Now()
+
+	var err error
+	switch payload.Test {
+	case protocol.TestPing:
+		if payload.Port > 0 {
+			result.Ping, err = tcpPing(ctx, payload.Target, payload.Port, payload.Count)
+		} else {
+			result.Ping, err = icmpPing(ctx, payload.Target, payload.Count)
+		}
+	case protocol.TestTraceroute:
+		result.Traceroute, err = traceroute(ctx, payload.Target, payload.MaxHops)
+	case protocol.TestDNS:
+		result.DNS, err = lookup(ctx, payload.Target, payload.RecordType, payload.Server)
+	case protocol.TestBandwidth:
+		result.Bandwidth, err = bandwidth(ctx, payload.Target, payload.Direction, payload.Bytes)
+	default:
+		err = fmt.Errorf("unknown test %q", payload.Test)
+	}
+
+	result.Seconds = time.Since(start).Seconds()
+	return result, err
+}
+
+// icmpPing pings a host with the ping tool of the device, which has the
+// privileges raw ICMP sockets need
+func icmpPing(ctx context.Context, host string, count int) (*protocol.PingResult, error) {
+	output, err := exec.CommandContext(ctx, "ping", "-c", strconv.Itoa(count),
+		"-W", strconv.Itoa(int(probeTimeout.Seconds())), host).CombinedOutput()
+
+	result := &protocol.PingResult{Protocol: "icmp", Sent: count, RTTs: []float64{}}
+	for _, line := range strings.Split(string(output), "\n") {
+		if m := pingAddress.FindStringSubmatch(line); m != nil {
+			result.Address = m[1]
+		} else if m := pingReply.FindStringSubmatch(line); m != nil {
+			if rtt, err := strconv.ParseFloat(m[1], 64); err == nil {
+				result.RTTs = append(result.RTTs, rtt)
+			}
+		} else if m := pingSent.FindStringSubmatch(line); m != nil {
+			result.Sent, _ = strconv.Atoi(m[1])
+		}
+	}
+	result.Summarize()
+
+	// ping exits with 1 when no reply arrived, which is a result rather than
+	// an error
+	var exitErr *exec.ExitError
+	switch {
+	case errors.Is(err, exec.ErrNotFound):
+		return nil, fmt.Errorf("ping is not installed, probe a TCP port instead")
+	case err != nil && !(errors.As(err, &exitErr) && exitErr.ExitCode() == 1):
+		return result, fmt.Errorf("ping failed: %s", toolError(err, output))
+	}
+	return result, nil
+}
+
+// tcpPing measures how long TCP connections to a port of a host take to
+// open, for targets that drop ICMP
+func tcpPing(ctx context.Context, host string, port, count int) (*protocol.PingResult, error) {
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &protocol.PingResult{Protocol: "tcp", Address: addrs[0], RTTs: []float64{}}
+	address := net.JoinHostPort(addrs[0], strconv.Itoa(port))
+	dialer := net.Dialer{Timeout: probeTimeout}
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(probeInterval):
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		result.Sent++
+		start := time.Now()
+		conn, err := dialer.DialContext(ctx, "tcp", address)
+		if err != nil {
+			continue
+		}
+		result.RTTs = append(result.RTTs, float64(time.Since(start).Microseconds())/1000)
+		conn.Close()
+	}
+	result.Summarize()
+	return result, nil
+}
+
+// traceroute traces the path to a host with the traceroute tool of the
+// device. Lines look like " 3  10.0.0.1  1.204 ms  10.0.0.2  2.113 ms  *".
+func traceroute(ctx context.Context, host string, maxHops int) ([]protocol.TracerouteHop, error) {
+	output, err := exec.CommandContext(ctx, "traceroute", "-n", "-q", "3",
+		"-w", strconv.Itoa(int(probeTimeout.Seconds())), "-m", strconv.Itoa(maxHops), host).CombinedOutput()
+
+	hops := []protocol.TracerouteHop{}
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		number, convErr := strconv.Atoi(fields[0])
+		if convErr != nil {
+			continue
+		}
+
+		hop := protocol.TracerouteHop{Hop: number, Addresses: []string{}, RTTs: []float64{}}
+		for i := 1; i < len(fields); i++ {
+			switch field := fields[i]; {
+			case field == "*":
+				hop.Lost++
+			case net.ParseIP(field) != nil:
+				if !slices.Contains(hop.Addresses, field) {
+					hop.Addresses = append(hop.Addresses, field)
+				}
+			case i+1 < len(fields) && fields[i+1] == "ms":
+				if rtt, err := strconv.ParseFloat(field, 64); err == nil {
+					hop.RTTs = append(hop.RTTs, rtt)
+				}
+				i++
+			}
+		}
+		hops = append(hops, hop)
+	}
+
+	switch {
+	case errors.Is(err, exec.ErrNotFound):
+		return nil, fmt.Errorf("traceroute is not installed")
+	case ctx.Err() != nil:
+		return hops, fmt.Errorf("traceroute did not finish in time")
+	case err != nil:
+		return hops, fmt.Errorf("traceroute failed: %s", toolError(err, output))
+	}
+	return hops, nil
+}
+
+// lookup resolves records of a name with the system resolver or the given
+// DNS server
+func lookup(ctx context.Context, name, recordType, server string) (*protocol.DNSResult, error) {
+	resolver := net.DefaultResolver
+	if server != "" {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, server)
+			},
+		}
+	}
+
+	result := &protocol.DNSResult{RecordType: recordType, Server: server, Records: []string{}}
+	start := time.Now()
+
+	var err error
+	switch recordType {
+	case "A", "AAAA":
+		network := "ip4"
+		if recordType == "AAAA" {
+			network = "ip6"
+		}
+		var ips []net.IP
+		ips, err = resolver.LookupIP(ctx, network, name)
+		for _, ip := range ips {
+			result.Records = append(result.Records, ip.String())
+		}
+	case "CNAME":
+		var cname string
+		if cname, err = resolver.LookupCNAME(ctx, name); err == nil {
+			result.Records = append(result.Records, cname)
+		}
+	case "MX":
+		var mxs []*net.MX
+		mxs, err = resolver.LookupMX(ctx, name)
+		for _, mx := range mxs {
+			result.Records = append(result.Records, fmt.Sprintf("%d %s", mx.Pref, mx.Host))
+		}
+	case "NS":
+		var nss []*net.NS
+		nss, err = resolver.LookupNS(ctx, name)
+		for _, ns := range nss {
+			result.Records = append(result.Records, ns.Host)
+		}
+	case "TXT":
+		var txts []string
+		txts, err = resolver.LookupTXT(ctx, name)
+		result.Records = append(result.Records, txts...)
+	case "PTR":
+		var names []string
+		names, err = resolver.LookupAddr(ctx, name)
+		result.Records = append(result.Records, names...)
+	default:
+		err = fmt.Errorf("unsupported record type %s", recordType)
+	}
+
+	result.Millis = float64(time.Since(start).Microseconds()) / 1000
+	return result, err
+}
+
+// bandwidth measures the throughput of a download from or an upload to a
+// URL. The transfer stops after size bytes or when the test runs out of
+// time, whichever comes first, and the throughput is taken over what was
+// transferred by then.
+func bandwidth(ctx context.Context, target, direction string, size int64) (*protocol.BandwidthResult, error) {
+	result := &protocol.BandwidthResult{Direction: direction}
+
+	method, body := http.MethodGet, io.Reader(nil)
+	if direction == protocol.BandwidthUpload {
+		method, body = http.MethodPost, io.LimitReader(zeros{}, size)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	result.Status = resp.StatusCode
+
+	if direction == protocol.BandwidthUpload {
+		result.Bytes = size
+	} else {
+		if resp.StatusCode/100 != 2 {
+			return result, fmt.Errorf("unexpected status %d", resp.StatusCode)
+		}
+		// Time the body alone, the headers carry the latency of the request
+		start = time.Now()
+		result.Bytes, err = io.CopyN(io.Discard, resp.Body, size)
+		if err == io.EOF || (err != nil && ctx.Err() != nil && result.Bytes > 0) {
+			err = nil
+		}
+	}
+
+	result.Seconds = time.Since(start).Seconds()
+	if result.Seconds > 0 {
+		result.Mbps = float64(result.Bytes) * 8 / result.Seconds / 1e6
+	}
+	if err == nil && resp.StatusCode/100 != 2 {
+		err = fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return result, err
+}
+
+// zeros reads zero bytes forever
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// toolError describes a failed tool run by its last line of output, which
+// usually says what went wrong
+func toolError(err error, output []byte) string {
+	lines := strings.Split(string(bytes.TrimSpace(output)), "\n")
+	if last := strings.TrimSpace(lines[len(lines)-1]); last != "" {
+		return last
+	}
+	return err.Error()
+}
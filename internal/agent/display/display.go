@@ -0,0 +1,268 @@
+// Package display drives the kiosk display of a device: it keeps the URL the
+// kiosk container shows in a file the container reads, restarting the
+// container when it changes, and rotates, blanks and photographs the screen
+// through the Wayland compositor (e.g. cage) with wlr-randr and grim. See
+// docs/display.md.
+package display
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/config"
+	"github.com/edgetainer/edgetainer/internal/shared/logging"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+const (
+	// urlFile is the file in the display directory the kiosk container
+	// reads its URL from
+	urlFile = "url"
+	// stateFile keeps the display settings across agent restarts
+	stateFile = "display.json"
+	// checkInterval is how often blanking periods are checked
+	checkInterval = 30 * time.Second
+	// applyTimeout bounds applying settings, restarting the kiosk container
+	// included
+	applyTimeout = 2 * time.Minute
+	// commandTimeout bounds taking a screenshot and blanking the screen
+	commandTimeout = 30 * time.Second
+)
+
+// Manager applies the display settings delivered by the server and blanks
+// the screen during their blanking periods
+type Manager struct {
+	config func() *config.AgentConfig
+	logger *logging.Logger
+
+	mu       sync.Mutex
+	settings *protocol.DisplayPayload
+	blanked  *bool // Last state set, nil if not set since the agent started
+}
+
+// NewManager creates a manager reading the agent configuration in effect
+// through cfg
+func NewManager(cfg func() *config.AgentConfig) *Manager {
+	return &Manager{
+		config: cfg,
+		logger: logging.WithComponent("display"),
+	}
+}
+
+// Enabled reports whether the display is managed
+func (m *Manager) Enabled() bool {
+	return m.config().Display.Enabled
+}
+
+// Apply sets the URL of the kiosk, the rotation of the screen and its
+// blanking periods, and keeps them for agent restarts. It reports what
+// changed.
+func (m *Manager) Apply(ctx context.Context, settings protocol.DisplayPayload) ([]string, error) {
+	if err := settings.Validate(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, applyTimeout)
+	defer cancel()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cfg := m.config().Display
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create display directory: %w", err)
+	}
+
+	previous := m.settings
+	if previous == nil {
+		previous = &protocol.DisplayPayload{}
+	}
+	var changed []string
+
+	if settings.URL == "" {
+		settings.URL = previous.URL
+	}
+	current, err := os.ReadFile(filepath.Join(cfg.Dir, urlFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read kiosk URL: %w", err)
+	}
+	if settings.URL != "" && settings.URL != string(bytes.TrimSpace(current)) {
+		if err := writeFile(filepath.Join(cfg.Dir, urlFile), []byte(settings.URL+"\n")); err != nil {
+			return nil, fmt.Errorf("failed to write kiosk URL: %w", err)
+		}
+		changed = append(changed, "url")
+		m.logger.Info(fmt.Sprintf("Kiosk URL set to %s", settings.URL))
+
+		if cfg.Container != "" {
+			if output, err := m.command(ctx, "docker", "restart", cfg.Container).CombinedOutput(); err != nil {
+				return changed, fmt.Errorf("failed to restart kiosk container %s: %v - %s", cfg.Container, err, string(output))
+			}
+		}
+	}
+
+	// A blanked screen is rotated when it is turned on again
+	blanked := m.blanked != nil && *m.blanked
+	if (m.settings == nil || settings.Rotation != previous.Rotation) && !blanked {
+		if err := m.rotate(ctx, settings.Rotation); err != nil {
+			return changed, err
+		}
+	}
+	if settings.Rotation != previous.Rotation {
+		changed = append(changed, "rotation")
+	}
+
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return changed, err
+	}
+	if err := writeFile(filepath.Join(cfg.Dir, stateFile), data); err != nil {
+		return changed, fmt.Errorf("failed to save display settings: %w", err)
+	}
+	previousBlanking, _ := json.Marshal(previous.Blanking)
+	if blanking, _ := json.Marshal(settings.Blanking); !bytes.Equal(blanking, previousBlanking) {
+		changed = append(changed, "blanking")
+	}
+	m.settings = &settings
+
+	if err := m.checkBlanking(ctx, time.Now()); err != nil {
+		return changed, err
+	}
+	return changed, nil
+}
+
+// Screenshot takes a picture of the display in PNG format
+func (m *Manager) Screenshot(ctx context.Context) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, commandTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := m.command(ctx, "grim", "-o", m.config().Display.Output, "-")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("failed to take screenshot: %v - %s", err, stderr.String())
+	}
+	if stdout.Len() > protocol.MaxScreenshotSize {
+		return nil, fmt.Errorf("screenshot exceeds %d bytes", protocol.MaxScreenshotSize)
+	}
+	return stdout.Bytes(), nil
+}
+
+// Run restores the settings kept from before the agent started and blanks
+// and unblanks the screen as blanking periods start and end, until ctx is
+// done
+func (m *Manager) Run(ctx context.Context) {
+	if !m.Enabled() {
+		return
+	}
+
+	data, err := os.ReadFile(filepath.Join(m.config().Display.Dir, stateFile))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		m.logger.Warn(fmt.Sprintf("Failed to read display settings: %v", err))
+	default:
+		var settings protocol.DisplayPayload
+		if err := json.Unmarshal(data, &settings); err != nil {
+			m.logger.Warn(fmt.Sprintf("Ignoring invalid display settings: %v", err))
+		} else if _, err := m.Apply(ctx, settings); err != nil {
+			m.logger.Warn(fmt.Sprintf("Failed to restore display settings: %v", err))
+		}
+	}
+
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if !m.Enabled() {
+				continue
+			}
+			checkCtx, cancel := context.WithTimeout(ctx, commandTimeout)
+			m.mu.Lock()
+			err := m.checkBlanking(checkCtx, now)
+			m.mu.Unlock()
+			cancel()
+			if err != nil {
+				m.logger.Warn(err.Error())
+			}
+		}
+	}
+}
+
+// checkBlanking turns the screen off or on if a blanking period started or
+// ended. The caller holds mu.
+func (m *Manager) checkBlanking(ctx context.Context, now time.Time) error {
+	if m.settings == nil {
+		return nil
+	}
+	blank := m.settings.Blanked(now)
+	if m.blanked != nil && *m.blanked == blank {
+		return nil
+	}
+
+	state := "--on"
+	if blank {
+		state = "--off"
+	}
+	if err := m.randr(ctx, state); err != nil {
+		return fmt.Errorf("failed to turn screen %s: %w", state[2:], err)
+	}
+	if !blank {
+		// Outputs come back with their default transform
+		if err := m.rotate(ctx, m.settings.Rotation); err != nil {
+			return err
+		}
+	}
+	m.blanked = &blank
+	m.logger.Info(fmt.Sprintf("Screen turned %s", state[2:]))
+	return nil
+}
+
+// rotate sets the rotation of the output in degrees clockwise
+func (m *Manager) rotate(ctx context.Context, rotation int) error {
+	transform := "normal"
+	if rotation != 0 {
+		transform = strconv.Itoa(rotation)
+	}
+	if err := m.randr(ctx, "--transform", transform); err != nil {
+		return fmt.Errorf("failed to rotate screen: %w", err)
+	}
+	return nil
+}
+
+// randr calls wlr-randr on the output
+func (m *Manager) randr(ctx context.Context, args ...string) error {
+	args = append([]string{"--output", m.config().Display.Output}, args...)
+	if output, err := m.command(ctx, "wlr-randr", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%v - %s", err, string(output))
+	}
+	return nil
+}
+
+// command prepares a command talking to the Wayland compositor of the kiosk
+func (m *Manager) command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Env = append(os.Environ(), "WAYLAND_DISPLAY="+m.config().Display.WaylandDisplay)
+	return cmd
+}
+
+// writeFile replaces a file atomically
+func writeFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,82 @@
+package docker
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+// ApplyAction performs an action on an application and returns its state
+// afterwards. Restarts follow depends_on order like RestartApplication,
+// redeploys recreate the containers from the compose file and env vars on
+// the device and purging data removes the application's volumes before
+// starting it again.
+func (m *Manager) ApplyAction(name, action string) (*Application, error) {
+	if action == protocol.AppActionRestart {
+		results, err := m.RestartApplication(name, nil, false, false)
+		if err != nil {
+			return nil, err
+		}
+		for _, result := range results {
+			if result.Status != protocol.RestartDone {
+				return nil, fmt.Errorf("service %s %s: %s", result.Service, result.Status, result.Error)
+			}
+		}
+		markStopped(filepath.Join(m.composeDir, name), false)
+		return m.application(name)
+	}
+
+	unlock := m.lockApp(name)
+	app, exists := m.registered(name)
+	if !exists {
+		unlock()
+		return nil, fmt.Errorf("application %s not found", name)
+	}
+
+	var steps [][]string
+	switch action {
+	case protocol.AppActionStart:
+		steps = [][]string{{"up", "-d"}}
+	case protocol.AppActionStop:
+		steps = [][]string{{"stop"}}
+	case protocol.AppActionRedeploy:
+		steps = [][]string{{"up", "-d", "--force-recreate", "--remove-orphans"}}
+	case protocol.AppActionPurgeData:
+		steps = [][]string{{"down", "--volumes", "--remove-orphans"}, {"up", "-d"}}
+	default:
+		unlock()
+		return nil, fmt.Errorf("unknown application action: %s", action)
+	}
+
+	m.logger.Info(fmt.Sprintf("Applying action %s to application %s", action, name))
+	var err error
+	for _, args := range steps {
+		if output, cmdErr := app.composeCommand(args...).CombinedOutput(); cmdErr != nil {
+			err = fmt.Errorf("failed to %s application: %v - %s", action, cmdErr, string(output))
+			break
+		}
+	}
+	if err == nil {
+		markStopped(app.Path, action == protocol.AppActionStop)
+	}
+
+	if containers, listErr := m.getContainers(app); listErr == nil {
+		m.setContainers(app, containers)
+	}
+	unlock()
+
+	if err != nil {
+		return nil, err
+	}
+	return m.application(name)
+}
+
+// application returns a copy of a registered application
+func (m *Manager) application(name string) (*Application, error) {
+	app, ok := m.GetApplications()[name]
+	if !ok {
+		return nil, fmt.Errorf("application %s not found", name)
+	}
+	return app, nil
+}
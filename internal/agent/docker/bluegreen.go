@@ -0,0 +1,345 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/compose"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+const (
+	// blueGreenStateFile records the running copy of a blue/green application
+	blueGreenStateFile = ".blue-green.json"
+
+	defaultHealthTimeout = 2 * time.Minute
+	defaultDrainTimeout  = 10 * time.Second
+	healthInterval       = 2 * time.Second
+	healthProbeTimeout   = 5 * time.Second
+)
+
+// errContainerFailed is returned by health checks that cannot pass anymore
+var errContainerFailed = errors.New("container failed")
+
+// blueGreenState is saved in the application directory so that the running
+// copy and its ports are known after the agent restarts
+type blueGreenState struct {
+	Color   string                  `json:"color"` // blue or green
+	Version string                  `json:"version"`
+	Ports   []compose.PublishedPort `json:"ports"`
+}
+
+// loadBlueGreenState reads the state of a blue/green application, or returns
+// nil if the application is not deployed blue/green
+func loadBlueGreenState(appDir string) (*blueGreenState, error) {
+	data, err := os.ReadFile(filepath.Join(appDir, blueGreenStateFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var state blueGreenState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// save writes the state to the application directory
+func (s *blueGreenState) save(appDir string) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(appDir, blueGreenStateFile)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// deployBlueGreen starts a new version of an application under a second
+// project next to the running one, waits for it to become healthy, points
+// the published ports at it and then removes the old copy. Without pull, only
+// images that are gone are pulled as the copy starts. The caller must hold
+// the application's lock.
+func (m *Manager) deployBlueGreen(name, composeYAML, version string, envVars map[string]string, registries []protocol.RegistryAuth, options protocol.BlueGreenOptions, pull bool) error {
+	unpublished, ports, err := compose.UnpublishPorts(composeYAML)
+	if err != nil {
+		return fmt.Errorf("compose file cannot be deployed blue-green: %w", err)
+	}
+
+	appDir := filepath.Join(m.composeDir, name)
+	if err := os.MkdirAll(appDir, 0755); err != nil {
+		return fmt.Errorf("failed to create application directory: %w", err)
+	}
+	if err := writeEnvFile(appDir, envVars); err != nil {
+		return err
+	}
+
+	existing, _ := m.registered(name)
+	color := "blue"
+	if existing != nil && existing.Color == "blue" {
+		color = "green"
+	}
+
+	next := &Application{
+		Name:     name,
+		Path:     appDir,
+		EnvVars:  envVars,
+		Version:  version,
+		Strategy: protocol.StrategyBlueGreen,
+		Color:    color,
+	}
+	if err := os.WriteFile(next.composeFile(), []byte(unpublished), 0644); err != nil {
+		return fmt.Errorf("failed to write compose file: %w", err)
+	}
+
+	if pull {
+		m.logger.Info(fmt.Sprintf("Pulling images for application %s", name))
+		if err := m.pullImages(name, version, appDir, next.composeFile(), composeYAML, registries); err != nil {
+			return err
+		}
+	}
+
+	m.stages(name).enter(protocol.StageCreating)
+	m.logger.Info(fmt.Sprintf("Starting %s copy of application %s version %s", color, name, version))
+	if output, err := next.composeCommand("up", "-d", "--remove-orphans").CombinedOutput(); err != nil {
+		m.discardCopy(next)
+		return fmt.Errorf("failed to start application: %v - %s", err, string(output))
+	}
+
+	m.stages(name).enter(protocol.StageHealthChecking)
+	if err := m.waitHealthy(next, ports, options); err != nil {
+		m.discardCopy(next)
+		return fmt.Errorf("new version is not healthy, keeping the running version: %w", err)
+	}
+
+	// Ports published by a copy deployed without blue/green have to be
+	// released before they can be switched, which briefly interrupts them
+	if existing != nil && existing.Color == "" {
+		m.logger.Warn(fmt.Sprintf("Stopping application %s to take over its ports", name))
+		if output, err := existing.composeCommand("down", "--remove-orphans").CombinedOutput(); err != nil {
+			m.logger.Error(fmt.Sprintf("Failed to stop application %s: %s", name, string(output)), err)
+		}
+		os.Remove(existing.composeFile())
+	}
+
+	if err := m.routePorts(next, ports); err != nil {
+		m.discardCopy(next)
+		return err
+	}
+
+	state := &blueGreenState{Color: color, Version: version, Ports: ports}
+	if err := state.save(appDir); err != nil {
+		m.logger.Error(fmt.Sprintf("Failed to save blue/green state of application %s", name), err)
+	}
+
+	containers, err := m.getContainers(next)
+	if err != nil {
+		m.logger.Error(fmt.Sprintf("Failed to get containers for application %s: %v", name, err), err)
+	}
+	next.Containers = containers
+	m.register(next)
+	m.logger.Info(fmt.Sprintf("Switched application %s to its %s copy", name, color))
+
+	// Let the old copy finish open connections before removing it
+	if existing != nil && existing.Color != "" {
+		drain := defaultDrainTimeout
+		if options.DrainTimeout > 0 {
+			drain = time.Duration(options.DrainTimeout) * time.Second
+		}
+		select {
+		case <-time.After(drain):
+		case <-m.ctx.Done():
+		}
+		m.discardCopy(existing)
+	}
+
+	return nil
+}
+
+// retireBlueGreen removes the running copy of a blue/green application and
+// releases its ports, before it is deployed without blue/green. The caller
+// must hold the application's lock.
+func (m *Manager) retireBlueGreen(app *Application) {
+	m.logger.Info(fmt.Sprintf("Removing %s copy of application %s", app.Color, app.Name))
+	m.switches.closeApp(app.Name)
+	m.discardCopy(app)
+	os.Remove(filepath.Join(app.Path, blueGreenStateFile))
+}
+
+// discardCopy removes the containers and compose file of a blue/green copy
+func (m *Manager) discardCopy(app *Application) {
+	if output, err := app.composeCommand("down", "--remove-orphans").CombinedOutput(); err != nil {
+		m.logger.Error(fmt.Sprintf("Failed to remove %s copy of application %s: %s", app.Color, app.Name, string(output)), err)
+	}
+	os.Remove(app.composeFile())
+}
+
+// routePorts points the published ports of an application at the containers
+// of the given copy
+func (m *Manager) routePorts(app *Application, ports []compose.PublishedPort) error {
+	resolvers := make([]resolveFunc, len(ports))
+	for i, port := range ports {
+		resolvers[i] = func() ([]string, error) {
+			return containerAddresses(app, port.Service, port.ContainerPort)
+		}
+	}
+	return m.switches.set(app.Name, ports, resolvers)
+}
+
+// containerAddresses returns the addresses of a port of the running
+// containers of a service
+func containerAddresses(app *Application, service string, port int) ([]string, error) {
+	ids, err := containerIDs(app, service)
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+
+	args := append([]string{"inspect", "-f", "{{range .NetworkSettings.Networks}}{{.IPAddress}} {{end}}"}, ids...)
+	output, err := exec.Command("docker", args...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect containers: %v - %s", err, string(output))
+	}
+
+	var addresses []string
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			addresses = append(addresses, net.JoinHostPort(fields[0], strconv.Itoa(port)))
+		}
+	}
+	return addresses, nil
+}
+
+// containerIDs returns the IDs of the containers of a service, or of all
+// services if service is empty
+func containerIDs(app *Application, service string) ([]string, error) {
+	args := []string{"ps", "-q"}
+	if service != "" {
+		args = append(args, service)
+	}
+
+	output, err := app.composeCommand(args...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %v - %s", err, string(output))
+	}
+	return strings.Fields(string(output)), nil
+}
+
+// waitHealthy waits until all containers of a copy run and pass their Docker
+// health checks, and the health path answers on every published port
+func (m *Manager) waitHealthy(app *Application, ports []compose.PublishedPort, options protocol.BlueGreenOptions) error {
+	timeout := defaultHealthTimeout
+	if options.HealthTimeout > 0 {
+		timeout = time.Duration(options.HealthTimeout) * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(m.ctx, timeout)
+	defer cancel()
+
+	for {
+		err := checkContainers(app)
+		if err == nil && options.HealthPath != "" {
+			err = probePorts(ctx, app, ports, options.HealthPath)
+		}
+		if err == nil {
+			return nil
+		}
+		if errors.Is(err, errContainerFailed) {
+			return err
+		}
+
+		select {
+		case <-time.After(healthInterval):
+		case <-ctx.Done():
+			return fmt.Errorf("not healthy after %s: %w", timeout, err)
+		}
+	}
+}
+
+// checkContainers checks that the containers of a copy are running and
+// healthy
+func checkContainers(app *Application) error {
+	ids, err := containerIDs(app, "")
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return fmt.Errorf("no containers are running")
+	}
+	return containersReady(ids)
+}
+
+// containersReady checks that containers are running and pass their Docker
+// health checks. Containers that exited successfully, such as one-off setup
+// jobs, pass. Errors wrapping errContainerFailed will not resolve by waiting.
+func containersReady(ids []string) error {
+	containers, err := inspect[containerState](ids, inspectState)
+	if err != nil {
+		return err
+	}
+
+	for _, container := range containers {
+		name := strings.TrimPrefix(container.Name, "/")
+		state := container.State
+		switch {
+		case state.Status == "exited" && state.ExitCode == 0:
+		case state.Status == "exited" || state.Status == "dead":
+			return fmt.Errorf("%w: %s exited with code %d", errContainerFailed, name, state.ExitCode)
+		case state.Status != "running":
+			return fmt.Errorf("container %s is %s", name, state.Status)
+		case state.Health != nil && state.Health.Status == "unhealthy":
+			return fmt.Errorf("%w: %s is unhealthy", errContainerFailed, name)
+		case state.Health != nil && state.Health.Status != "healthy":
+			return fmt.Errorf("container %s is %s", name, state.Health.Status)
+		}
+	}
+	return nil
+}
+
+// probePorts requests the health path from every container behind every
+// published port. Any status below 400 passes.
+func probePorts(ctx context.Context, app *Application, ports []compose.PublishedPort, path string) error {
+	client := &http.Client{Timeout: healthProbeTimeout}
+
+	for _, port := range ports {
+		addresses, err := containerAddresses(app, port.Service, port.ContainerPort)
+		if err != nil {
+			return err
+		}
+		if len(addresses) == 0 {
+			return fmt.Errorf("service %s has no running containers", port.Service)
+		}
+
+		for _, address := range addresses {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+address+path, nil)
+			if err != nil {
+				return err
+			}
+
+			resp, err := client.Do(req)
+			if err != nil {
+				return fmt.Errorf("service %s port %d: %w", port.Service, port.ContainerPort, err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode >= 400 {
+				return fmt.Errorf("service %s port %d answered %s", port.Service, port.ContainerPort, resp.Status)
+			}
+		}
+	}
+	return nil
+}
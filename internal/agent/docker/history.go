@@ -0,0 +1,268 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+const (
+	// historyFile lists the deployments of an application, newest last
+	historyFile = ".history.json"
+	// historyDir keeps the files of versions that can be rolled back to
+	historyDir = ".history"
+	// maxHistory bounds the deployments listed per application
+	maxHistory = 50
+	// maxRestorable bounds the deployments whose files are kept
+	maxRestorable = 5
+)
+
+// DeploymentRecord is a deployment in the history of an application
+type DeploymentRecord struct {
+	Version      string    `json:"version"`
+	ComposeHash  string    `json:"compose_hash"`
+	EnvHash      string    `json:"env_hash"`
+	Strategy     string    `json:"strategy,omitempty"`
+	Success      bool      `json:"success"`
+	Error        string    `json:"error,omitempty"`
+	Rollback     bool      `json:"rollback,omitempty"`      // Rolled back to on the device
+	RestorePoint string    `json:"restore_point,omitempty"` // Restored from, see Restore
+	StartedAt    time.Time `json:"started_at"`
+	FinishedAt   time.Time `json:"finished_at"`
+	Restorable   bool      `json:"restorable"` // Its files are kept to roll back to it
+}
+
+// key names the directory the files of a deployment are kept in
+func (r *DeploymentRecord) key() string {
+	short := func(hash string) string {
+		hash = strings.TrimPrefix(hash, "sha256:")
+		if len(hash) > 16 {
+			hash = hash[:16]
+		}
+		return hash
+	}
+	return short(r.ComposeHash) + "-" + short(r.EnvHash)
+}
+
+// deployedFiles is what is kept of a deployment to roll back to it
+type deployedFiles struct {
+	Version   string                     `json:"version"`
+	Strategy  string                     `json:"strategy,omitempty"`
+	BlueGreen *protocol.BlueGreenOptions `json:"blue_green,omitempty"`
+}
+
+// loadHistory reads the deployment history of an application
+func loadHistory(appDir string) ([]DeploymentRecord, error) {
+	data, err := os.ReadFile(filepath.Join(appDir, historyFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var records []DeploymentRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("invalid deployment history: %w", err)
+	}
+	return records, nil
+}
+
+// saveHistory writes the deployment history of an application
+func saveHistory(appDir string, records []DeploymentRecord) error {
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(appDir, historyFile)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// DeploymentHistory returns the deployments of an application on this
+// device, newest first
+func (m *Manager) DeploymentHistory(name string) ([]DeploymentRecord, error) {
+	app, exists := m.registered(name)
+	if !exists {
+		return nil, fmt.Errorf("application %s not found", name)
+	}
+
+	records, err := loadHistory(app.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	newest := make([]DeploymentRecord, 0, len(records))
+	for i := len(records) - 1; i >= 0; i-- {
+		newest = append(newest, records[i])
+	}
+	return newest, nil
+}
+
+// recordDeployment adds a deployment to the history of an application. The
+// files of a successful one are kept to roll back to, those of the oldest
+// ones beyond maxRestorable are removed. The caller must hold the
+// application's lock.
+func (m *Manager) recordDeployment(name string, record *DeploymentRecord, composeYAML string, envVars map[string]string, blueGreen *protocol.BlueGreenOptions) {
+	appDir := filepath.Join(m.composeDir, name)
+	if _, err := os.Stat(appDir); err != nil {
+		// Nothing was deployed
+		return
+	}
+
+	records, err := loadHistory(appDir)
+	if err != nil {
+		m.logger.Warn(fmt.Sprintf("Starting a new deployment history of application %s: %v", name, err))
+		records = nil
+	}
+
+	if record.Success {
+		if err := keepFiles(appDir, record, composeYAML, envVars, blueGreen); err != nil {
+			m.logger.Error(fmt.Sprintf("Failed to keep the files of application %s version %s", name, record.Version), err)
+		} else {
+			record.Restorable = true
+		}
+	}
+
+	records = append(records, *record)
+	if len(records) > maxHistory {
+		records = records[len(records)-maxHistory:]
+	}
+
+	// The files of the same configuration deployed again are kept once
+	kept := make(map[string]bool)
+	for i := len(records) - 1; i >= 0; i-- {
+		key := records[i].key()
+		if !records[i].Restorable {
+			continue
+		}
+		if !kept[key] && len(kept) >= maxRestorable {
+			records[i].Restorable = false
+			continue
+		}
+		kept[key] = true
+	}
+	if entries, err := os.ReadDir(filepath.Join(appDir, historyDir)); err == nil {
+		for _, entry := range entries {
+			if !kept[entry.Name()] {
+				os.RemoveAll(filepath.Join(appDir, historyDir, entry.Name()))
+			}
+		}
+	}
+
+	if err := saveHistory(appDir, records); err != nil {
+		m.logger.Error(fmt.Sprintf("Failed to save the deployment history of application %s", name), err)
+	}
+}
+
+// keepFiles keeps the compose file and env vars of a deployment. The env
+// vars may hold values resolved from secret stores.
+func keepFiles(appDir string, record *DeploymentRecord, composeYAML string, envVars map[string]string, blueGreen *protocol.BlueGreenOptions) error {
+	dir := filepath.Join(appDir, historyDir, record.key())
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "docker-compose.yml"), []byte(composeYAML), 0600); err != nil {
+		return err
+	}
+
+	env, err := json.Marshal(envVars)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "env.json"), env, 0600); err != nil {
+		return err
+	}
+
+	info, err := json.Marshal(deployedFiles{Version: record.Version, Strategy: record.Strategy, BlueGreen: blueGreen})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "deploy.json"), info, 0600)
+}
+
+// RollbackApplication deploys a version of an application again from the
+// files kept on the device, without the server. Without a version, the last
+// successful deployment of another version than the installed one is rolled
+// back to. Images are only pulled if they are gone, no migration is run and
+// the artifacts in place are kept.
+func (m *Manager) RollbackApplication(name, version string) (*DeploymentRecord, error) {
+	unlock := m.lockApp(name)
+	defer unlock()
+
+	app, exists := m.registered(name)
+	if !exists {
+		return nil, fmt.Errorf("application %s not found", name)
+	}
+
+	records, err := loadHistory(app.Path)
+	if err != nil {
+		return nil, err
+	}
+	var target *DeploymentRecord
+	for i := len(records) - 1; i >= 0 && target == nil; i-- {
+		record := &records[i]
+		if !record.Restorable {
+			continue
+		}
+		if version == record.Version || version == "" && record.Version != app.Version {
+			target = record
+		}
+	}
+	if target == nil {
+		if version == "" {
+			return nil, fmt.Errorf("no earlier version of application %s to roll back to", name)
+		}
+		return nil, fmt.Errorf("version %s of application %s cannot be rolled back to", version, name)
+	}
+
+	dir := filepath.Join(app.Path, historyDir, target.key())
+	composeYAML, err := os.ReadFile(filepath.Join(dir, "docker-compose.yml"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read kept compose file: %w", err)
+	}
+	var envVars map[string]string
+	var info deployedFiles
+	for file, value := range map[string]interface{}{"env.json": &envVars, "deploy.json": &info} {
+		data, err := os.ReadFile(filepath.Join(dir, file))
+		if err == nil {
+			err = json.Unmarshal(data, value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read kept files: %w", err)
+		}
+	}
+
+	m.logger.Info(fmt.Sprintf("Rolling back application %s from version %s to %s", name, app.Version, info.Version))
+	record := DeploymentRecord{
+		Version:     info.Version,
+		ComposeHash: target.ComposeHash,
+		EnvHash:     target.EnvHash,
+		Strategy:    info.Strategy,
+		Rollback:    true,
+		StartedAt:   time.Now(),
+	}
+	if info.Strategy == protocol.StrategyBlueGreen {
+		var options protocol.BlueGreenOptions
+		if info.BlueGreen != nil {
+			options = *info.BlueGreen
+		}
+		err = m.deployBlueGreen(name, string(composeYAML), info.Version, envVars, nil, options, false)
+	} else {
+		err = m.deployApplication(name, string(composeYAML), info.Version, envVars, nil, nil, false)
+	}
+	m.finishDeployment(name, &record, err, string(composeYAML), envVars, info.BlueGreen)
+
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
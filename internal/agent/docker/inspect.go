@@ -0,0 +1,89 @@
+package docker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// Templates rendering the parts of docker inspect output the agent reads as
+// one JSON object per container. The full output carries the environment,
+// mounts and network settings of every container and easily runs to tens of
+// kilobytes each, which adds up on small devices inspecting at every
+// heartbeat.
+const (
+	// inspectWorkload fills inspectedContainer
+	inspectWorkload = `{"Id":{{json .Id}},"Name":{{json .Name}},"Created":{{json .Created}},` +
+		`"Image":{{json .Image}},"RestartCount":{{json .RestartCount}},` +
+		`"Config":{"Image":{{json .Config.Image}},"Labels":{{json .Config.Labels}}},` +
+		`"State":{"Status":{{json .State.Status}},` +
+		`"Health":{{if .State.Health}}{"Status":{{json .State.Health.Status}}}{{else}}null{{end}}}}`
+
+	// inspectImage fills inspectedImage
+	inspectImage = `{"Id":{{json .Id}},"RepoDigests":{{json .RepoDigests}}}`
+
+	// inspectState fills containerState
+	inspectState = `{"Id":{{json .Id}},"Name":{{json .Name}},"Image":{{json .Config.Image}},` +
+		`"State":{"Status":{{json .State.Status}},"Running":{{json .State.Running}},"ExitCode":{{json .State.ExitCode}},` +
+		`"Health":{{if .State.Health}}{"Status":{{json .State.Health.Status}}}{{else}}null{{end}}}}`
+)
+
+// containerState holds the state of a container as rendered by inspectState
+type containerState struct {
+	ID    string `json:"Id"`
+	Name  string `json:"Name"`
+	Image string `json:"Image"`
+	State struct {
+		Status   string `json:"Status"`
+		Running  bool   `json:"Running"`
+		ExitCode int    `json:"ExitCode"`
+		Health   *struct {
+			Status string `json:"Status"`
+		} `json:"Health"`
+	} `json:"State"`
+}
+
+// inspect runs docker inspect on containers with one of the templates above
+// and decodes the objects as they are written, so neither the full inspect
+// output nor Docker's reply as a whole is held in memory. Containers that
+// were decoded are returned along with any error, e.g. for a container that
+// was removed in the meantime.
+func inspect[T any](ids []string, format string) ([]T, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	cmd := exec.Command("docker", append([]string{"inspect", "--format", format}, ids...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect containers: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to inspect containers: %w", err)
+	}
+
+	items := make([]T, 0, len(ids))
+	decoder := json.NewDecoder(stdout)
+	var decodeErr error
+	for {
+		var item T
+		if err := decoder.Decode(&item); err != nil {
+			if err != io.EOF {
+				decodeErr = fmt.Errorf("failed to parse container details: %w", err)
+				io.Copy(io.Discard, stdout)
+			}
+			break
+		}
+		items = append(items, item)
+	}
+
+	if err := cmd.Wait(); err != nil {
+		return items, fmt.Errorf("failed to inspect containers: %w - %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return items, decodeErr
+}
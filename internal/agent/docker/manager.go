@@ -5,13 +5,19 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"maps"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/edgetainer/edgetainer/internal/agent/artifacts"
+	"github.com/edgetainer/edgetainer/internal/agent/pullproxy"
+	"github.com/edgetainer/edgetainer/internal/shared/compose"
 	"github.com/edgetainer/edgetainer/internal/shared/logging"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
 )
 
 // ContainerState represents the state of a container
@@ -51,35 +57,117 @@ type Application struct {
 	Containers []Container       `json:"containers"`
 	EnvVars    map[string]string `json:"env_vars"`
 	Version    string            `json:"version"`
+	Strategy   string            `json:"strategy,omitempty"`
+	Color      string            `json:"color,omitempty"` // Running copy of a blue/green application
 }
 
-// Manager handles Docker operations
+// composeFile returns the compose file of the running copy of an application
+func (a *Application) composeFile() string {
+	if a.Color == "" {
+		return filepath.Join(a.Path, "docker-compose.yml")
+	}
+	return filepath.Join(a.Path, "docker-compose."+a.Color+".yml")
+}
+
+// project returns the compose project name of the running copy of an
+// application, empty for the default taken from the directory name
+func (a *Application) project() string {
+	if a.Color == "" {
+		return ""
+	}
+	return a.Name + "-" + a.Color
+}
+
+// projectName returns the compose project of the running copy of an
+// application, as its containers are labelled
+func (a *Application) projectName() string {
+	if project := a.project(); project != "" {
+		return project
+	}
+	return compose.ProjectName(filepath.Base(a.Path))
+}
+
+// composeCommand builds a docker-compose command for the running copy of an
+// application
+func (a *Application) composeCommand(args ...string) *exec.Cmd {
+	return composeCommand(a.Path, a.composeFile(), a.project(), args...)
+}
+
+// composeCommand builds a docker-compose command for a compose file
+func composeCommand(dir, file, project string, args ...string) *exec.Cmd {
+	base := []string{"-f", file}
+	if project != "" {
+		base = append(base, "-p", project)
+	}
+
+	cmd := exec.Command("docker-compose", append(base, args...)...)
+	cmd.Dir = dir
+	return cmd
+}
+
+// DeployResult describes the outcome of the most recent deployment
+type DeployResult struct {
+	Application string    `json:"application"`
+	Version     string    `json:"version"`
+	Success     bool      `json:"success"`
+	Error       string    `json:"error,omitempty"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+// Manager handles Docker operations. Operations on an application hold its
+// lock, so that different applications are managed concurrently, and those
+// on all applications hold every lock at once through ops. The fields of a
+// registered Application are written holding both its lock and mu.
 type Manager struct {
-	ctx          context.Context
-	cancelFunc   context.CancelFunc
-	composeDir   string
-	networkName  string
-	logger       *logging.Logger
-	mu           sync.Mutex
-	applications map[string]*Application
+	ctx             context.Context
+	cancelFunc      context.CancelFunc
+	composeDir      string // Changes holding ops and mu
+	networkName     string
+	logger          *logging.Logger
+	ops             sync.RWMutex // Read by operations on one application, written by those on all
+	mu              sync.RWMutex // Guards the fields below, never held while running commands
+	appLocks        map[string]*sync.Mutex
+	applications    map[string]*Application
+	lastDeploy      *DeployResult
+	pullProxy       *pullproxy.Proxy // Caps the pull rate when the daemon is configured to use it
+	pullRates       map[string]int   // Rates of the running deployments by application
+	progressHandler PullProgressHandler
+	stageHandler    DeployStageHandler
+	deploys         map[string]*stageReporter // Stages of the running deployments by application
+	pullRetry       pullRetry
+	limits          protocol.ResourceLimits // Caps the services of every application unless the server lifts them
+	platforms       []string                // Platforms the device runs images of, nil to not check images
+	switches        *portSwitch             // Serves the ports of blue/green applications
+	artifacts       *artifacts.Cache        // Downloads the artifacts of deployed versions
+	repoDigests     map[string]string       // Registry digest by image ID, images do not change
+	defaults        compose.ServiceDefaults // Given to services not setting them
+	autonomyHandler AutonomyHandler
+	healed          map[string][]time.Time // Restarts by Heal in the last hour by container
 }
 
 // NewManager creates a new Docker manager
 func NewManager(ctx context.Context, composeDir, networkName string) (*Manager, error) {
-	managerCtx, cancel := context.WithCancel(ctx)
-
 	// Ensure the compose directory exists
 	if err := os.MkdirAll(composeDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create compose directory: %w", err)
 	}
 
+	managerCtx, cancel := context.WithCancel(ctx)
+
 	return &Manager{
 		ctx:          managerCtx,
 		cancelFunc:   cancel,
 		composeDir:   composeDir,
 		networkName:  networkName,
 		logger:       logging.WithComponent("docker-manager"),
+		appLocks:     make(map[string]*sync.Mutex),
 		applications: make(map[string]*Application),
+		pullRates:    make(map[string]int),
+		deploys:      make(map[string]*stageReporter),
+		repoDigests:  make(map[string]string),
+		pullRetry:    pullRetry{retries: DefaultPullRetries, delay: DefaultPullRetryDelay},
+		switches:     newPortSwitch(),
+		healed:       make(map[string][]time.Time),
 	}, nil
 }
 
@@ -98,9 +186,14 @@ func (m *Manager) Start() error {
 	}
 
 	// Load existing applications
-	if err := m.loadExistingApplications(); err != nil {
+	apps, err := m.loadExistingApplications()
+	if err != nil {
 		m.logger.Error(fmt.Sprintf("Failed to load existing applications: %v", err), err)
 		// Continue anyway, non-fatal
+	} else {
+		m.mu.Lock()
+		m.applications = apps
+		m.mu.Unlock()
 	}
 
 	return nil
@@ -110,13 +203,312 @@ func (m *Manager) Start() error {
 func (m *Manager) Stop() {
 	m.logger.Info("Docker manager stopping")
 	m.cancelFunc()
+	m.switches.closeAll()
+}
+
+// SetPullProxy sets the proxy whose rate is adjusted for each deployment
+func (m *Manager) SetPullProxy(proxy *pullproxy.Proxy) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pullProxy = proxy
+}
+
+// SetArtifactCache sets the cache artifacts of deployed versions are
+// downloaded to, without one deployments with artifacts fail
+func (m *Manager) SetArtifactCache(cache *artifacts.Cache) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.artifacts = cache
 }
 
-// DeployApplication deploys a Docker Compose application
-func (m *Manager) DeployApplication(name, composeYAML, version string, envVars map[string]string) error {
+// SetPullProgressHandler sets the handler receiving image pull progress
+func (m *Manager) SetPullProgressHandler(handler PullProgressHandler) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	m.progressHandler = handler
+}
+
+// SetDeployStageHandler sets the handler receiving the stages of deployments
+func (m *Manager) SetDeployStageHandler(handler DeployStageHandler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stageHandler = handler
+}
+
+// SetPullRetry sets how often a failed image pull is retried and the delay
+// before the first retry, which doubles for every following one
+func (m *Manager) SetPullRetry(retries int, delay time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pullRetry = pullRetry{retries: retries, delay: delay}
+}
 
+// SetResourceLimits sets the limits capping the services of every
+// application, from the next deployment on. Those the server sends with a
+// deployment replace them limit by limit.
+func (m *Manager) SetResourceLimits(limits protocol.ResourceLimits) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.limits = limits
+}
+
+// SetServiceDefaults sets the restart policy and log rotation given to the
+// services of applications deployed from now on that do not set them
+func (m *Manager) SetServiceDefaults(defaults compose.ServiceDefaults) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.defaults = defaults
+}
+
+// serviceDefaults returns the settings given to services not setting them
+func (m *Manager) serviceDefaults() compose.ServiceDefaults {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.defaults
+}
+
+// resourceLimits returns the limits of a deployment, those of the server
+// over the agent's own
+func (m *Manager) resourceLimits(limits *protocol.ResourceLimits) protocol.ResourceLimits {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if limits == nil {
+		return m.limits
+	}
+	return m.limits.Over(*limits)
+}
+
+// lockApp takes the lock of an application and returns the function
+// releasing it. Locks are kept once created, devices run few applications.
+func (m *Manager) lockApp(name string) (unlock func()) {
+	m.ops.RLock()
+	m.mu.Lock()
+	lock, ok := m.appLocks[name]
+	if !ok {
+		lock = &sync.Mutex{}
+		m.appLocks[name] = lock
+	}
+	m.mu.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		m.ops.RUnlock()
+	}
+}
+
+// registered returns a registered application
+func (m *Manager) registered(name string) (*Application, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	app, ok := m.applications[name]
+	return app, ok
+}
+
+// register registers an application, replacing the one of the same name.
+// The caller must hold the application's lock.
+func (m *Manager) register(app *Application) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.applications[app.Name] = app
+}
+
+// setContainers records the containers of an application, the caller must
+// hold the application's lock
+func (m *Manager) setContainers(app *Application, containers []Container) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	app.Containers = containers
+}
+
+// pullRetries returns how failed image pulls are retried
+func (m *Manager) pullRetries() pullRetry {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.pullRetry
+}
+
+// setPullRate sets the pull rate of the deployment of an application. It
+// returns false if the pull proxy is not enabled.
+func (m *Manager) setPullRate(name string, rate int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pullRates[name] = rate
+	return m.applyPullRates()
+}
+
+// clearPullRate drops the pull rate of a deployment that is done
+func (m *Manager) clearPullRate(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.pullRates, name)
+	m.applyPullRates()
+}
+
+// applyPullRates sets the strictest rate of the running deployments on the
+// pull proxy they share: the lowest limit, else the default rate unless all
+// of them lift it. The caller must hold mu.
+func (m *Manager) applyPullRates() bool {
+	if m.pullProxy == nil {
+		return false
+	}
+
+	strictest := 0
+	if len(m.pullRates) > 0 {
+		strictest = -1
+	}
+	for _, rate := range m.pullRates {
+		if rate > 0 && (strictest <= 0 || rate < strictest) || rate == 0 && strictest < 0 {
+			strictest = rate
+		}
+	}
+	m.pullProxy.SetRate(strictest)
+	return true
+}
+
+// DeployApplication deploys a Docker Compose application. Registry credentials
+// are only used to pull images and are not kept on the device. A pull rate in
+// kbit/s overrides the pull proxy's default rate for this deployment. The
+// blue/green strategy starts the new version next to the running one and
+// only switches over once it is healthy. A migration that applies to the
+// installed version is run in between stopping it and starting the new one,
+// which always uses the recreate strategy. Compose overrides are merged over
+// the compose file in order before anything else, then the services are
+// capped by the resource limits and given the service defaults.
+func (m *Manager) DeployApplication(name, composeYAML, version string, envVars map[string]string, registries []protocol.RegistryAuth, pullRate int, strategy string, blueGreen *protocol.BlueGreenOptions, migration *protocol.Migration, overrides []string, files []protocol.Artifact, limits *protocol.ResourceLimits) error {
+	return m.deploy(name, composeYAML, version, envVars, registries, pullRate, strategy, blueGreen, migration, overrides, files, limits, true)
+}
+
+// deploy deploys an application as DeployApplication describes. Without
+// pull, only images that are gone are pulled as the application starts.
+func (m *Manager) deploy(name, composeYAML, version string, envVars map[string]string, registries []protocol.RegistryAuth, pullRate int, strategy string, blueGreen *protocol.BlueGreenOptions, migration *protocol.Migration, overrides []string, files []protocol.Artifact, limits *protocol.ResourceLimits, pull bool) error {
+	unlock := m.lockApp(name)
+	defer unlock()
+
+	if !m.setPullRate(name, pullRate) && pullRate > 0 {
+		m.logger.Warn(fmt.Sprintf("Pull rate limit of %d kbit/s requested but the pull proxy is not enabled", pullRate))
+	}
+	defer m.clearPullRate(name)
+
+	stages := m.newStageReporter(name, version)
+	defer m.endStages(name)
+
+	record := DeploymentRecord{
+		Version:     version,
+		ComposeHash: protocol.ComposeHash(composeYAML, overrides),
+		EnvHash:     protocol.EnvHash(envVars),
+		Strategy:    strategy,
+		StartedAt:   time.Now(),
+	}
+
+	if installed, ok := m.registered(name); !ok || installed.Version == version || !migration.AppliesTo(installed.Version) {
+		migration = nil
+	} else if strategy == protocol.StrategyBlueGreen {
+		m.logger.Info(fmt.Sprintf("Deploying application %s with the recreate strategy to migrate its data", name))
+		strategy = protocol.StrategyRecreate
+	}
+
+	stages.enter(protocol.StageValidating)
+	var err error
+	if len(overrides) > 0 {
+		composeYAML, err = m.layerCompose(name, composeYAML, overrides)
+	}
+	if err == nil {
+		composeYAML, err = compose.ApplyLimits(composeYAML, m.resourceLimits(limits))
+	}
+	if err == nil {
+		composeYAML, err = compose.ApplyDefaults(composeYAML, m.serviceDefaults())
+	}
+	if err == nil {
+		err = validateCompose(composeYAML)
+	}
+	if err == nil && migration != nil {
+		err = protocol.ValidateMigration(migration)
+	}
+	if err == nil {
+		err = m.placeArtifacts(name, files)
+	}
+	if err == nil && strategy == protocol.StrategyBlueGreen {
+		var options protocol.BlueGreenOptions
+		if blueGreen != nil {
+			options = *blueGreen
+		}
+		err = m.deployBlueGreen(name, composeYAML, version, envVars, registries, options, pull)
+	} else if err == nil {
+		err = m.deployApplication(name, composeYAML, version, envVars, registries, migration, pull)
+	}
+
+	if err != nil {
+		stages.fail(err)
+	} else {
+		stages.enter(protocol.StageDone)
+	}
+
+	if strategy == "" {
+		record.Strategy = protocol.StrategyRecreate
+	}
+	m.finishDeployment(name, &record, err, composeYAML, envVars, blueGreen)
+	return err
+}
+
+// finishDeployment records the outcome of a deployment for status reporting
+// and in the history of the application. The caller must hold the
+// application's lock.
+func (m *Manager) finishDeployment(name string, record *DeploymentRecord, err error, composeYAML string, envVars map[string]string, blueGreen *protocol.BlueGreenOptions) {
+	record.Success = err == nil
+	record.FinishedAt = time.Now()
+	if err != nil {
+		record.Error = err.Error()
+	}
+
+	m.mu.Lock()
+	m.lastDeploy = &DeployResult{
+		Application: name,
+		Version:     record.Version,
+		Success:     record.Success,
+		Error:       record.Error,
+		Timestamp:   record.FinishedAt,
+	}
+	m.mu.Unlock()
+
+	// A new version runs whether the application was stopped or not
+	if err == nil {
+		markStopped(filepath.Join(m.composeDir, name), false)
+	}
+	m.recordDeployment(name, record, composeYAML, envVars, blueGreen)
+}
+
+// placeArtifacts downloads the artifacts of a version and places them in
+// the application directory, removing those of the installed version that
+// are gone. The caller must hold the application's lock.
+func (m *Manager) placeArtifacts(name string, files []protocol.Artifact) error {
+	m.mu.RLock()
+	cache := m.artifacts
+	m.mu.RUnlock()
+
+	if cache == nil {
+		if len(files) > 0 {
+			return fmt.Errorf("artifacts are not enabled on this device")
+		}
+		return nil
+	}
+
+	cached, err := cache.Fetch(m.ctx, files)
+	if err != nil {
+		return err
+	}
+
+	appDir := filepath.Join(m.composeDir, name)
+	if err := os.MkdirAll(appDir, 0755); err != nil {
+		return fmt.Errorf("failed to create application directory: %w", err)
+	}
+	return artifacts.Place(appDir, files, cached)
+}
+
+// deployApplication performs the deployment, running the migration if it is
+// not nil. Without pull, only images that are gone are pulled as the
+// application starts. The caller must hold the application's lock.
+func (m *Manager) deployApplication(name, composeYAML, version string, envVars map[string]string, registries []protocol.RegistryAuth, migration *protocol.Migration, pull bool) error {
 	appDir := filepath.Join(m.composeDir, name)
 
 	// Create application directory if it doesn't exist
@@ -124,78 +516,121 @@ func (m *Manager) DeployApplication(name, composeYAML, version string, envVars m
 		return fmt.Errorf("failed to create application directory: %w", err)
 	}
 
-	// Create docker-compose.yml file
+	// A migration that fails puts back the files of the installed version
 	composeFile := filepath.Join(appDir, "docker-compose.yml")
+	existing, _ := m.registered(name)
+	var installedYAML []byte
+	var snapshot fileSnapshot
+	if migration != nil {
+		var err error
+		if installedYAML, err = os.ReadFile(existing.composeFile()); err != nil {
+			return fmt.Errorf("failed to read compose file of version %s: %w", existing.Version, err)
+		}
+		if snapshot, err = snapshotFiles(composeFile, filepath.Join(appDir, ".env")); err != nil {
+			return fmt.Errorf("failed to save files of version %s: %w", existing.Version, err)
+		}
+	}
+
+	// Create docker-compose.yml file
 	if err := os.WriteFile(composeFile, []byte(composeYAML), 0644); err != nil {
 		return fmt.Errorf("failed to write docker-compose.yml: %w", err)
 	}
 
 	// Create .env file with environment variables
-	if len(envVars) > 0 {
-		envContent := ""
-		for key, value := range envVars {
-			envContent += fmt.Sprintf("%s=%s\n", key, value)
+	if err := writeEnvFile(appDir, envVars); err != nil {
+		return err
+	}
+
+	// Pull images
+	if pull {
+		m.logger.Info(fmt.Sprintf("Pulling images for application %s", name))
+		if err := m.pullImages(name, version, appDir, composeFile, composeYAML, registries); err != nil {
+			return err
 		}
+	}
 
-		envFile := filepath.Join(appDir, ".env")
-		if err := os.WriteFile(envFile, []byte(envContent), 0644); err != nil {
-			return fmt.Errorf("failed to write .env file: %w", err)
+	if migration != nil {
+		m.stages(name).enter(protocol.StageMigrating)
+		if err := m.migrate(existing, string(installedYAML), composeYAML, version, snapshot, migration); err != nil {
+			return err
 		}
 	}
 
-	// Pull images
-	m.logger.Info(fmt.Sprintf("Pulling images for application %s", name))
-	cmd := exec.Command("docker-compose", "-f", composeFile, "pull")
-	cmd.Dir = appDir
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to pull images: %v - %s", err, string(output))
+	// A blue/green copy holds the published ports, so it goes first
+	if existing != nil && existing.Color != "" {
+		m.retireBlueGreen(existing)
 	}
 
 	// Start application
+	m.stages(name).enter(protocol.StageCreating)
 	m.logger.Info(fmt.Sprintf("Starting application %s", name))
-	cmd = exec.Command("docker-compose", "-f", composeFile, "up", "-d")
-	cmd.Dir = appDir
-	if output, err := cmd.CombinedOutput(); err != nil {
+	app := &Application{
+		Name:     name,
+		Path:     appDir,
+		EnvVars:  envVars,
+		Version:  version,
+		Strategy: protocol.StrategyRecreate,
+	}
+	if output, err := app.composeCommand("up", "-d").CombinedOutput(); err != nil {
 		return fmt.Errorf("failed to start application: %v - %s", err, string(output))
 	}
 
+	// A container that crashes right away fails the deployment
+	m.stages(name).enter(protocol.StageHealthChecking)
+	if err := m.waitHealthy(app, nil, protocol.BlueGreenOptions{}); err != nil {
+		return fmt.Errorf("application is not healthy: %w", err)
+	}
+
 	// Get containers
-	containers, err := m.getContainers(name, appDir)
+	containers, err := m.getContainers(app)
 	if err != nil {
 		m.logger.Error(fmt.Sprintf("Failed to get containers for application %s: %v", name, err), err)
 		// Continue anyway, non-fatal
 	}
+	app.Containers = containers
 
 	// Register application
-	m.applications[name] = &Application{
-		Name:       name,
-		Path:       appDir,
-		Containers: containers,
-		EnvVars:    envVars,
-		Version:    version,
-	}
+	m.register(app)
 
 	m.logger.Info(fmt.Sprintf("Successfully deployed application %s version %s", name, version))
 	return nil
 }
 
+// writeEnvFile writes the env vars of an application to its .env file. The
+// file may hold values resolved from secret stores.
+func writeEnvFile(appDir string, envVars map[string]string) error {
+	if len(envVars) == 0 {
+		return nil
+	}
+
+	envContent := ""
+	for key, value := range envVars {
+		envContent += fmt.Sprintf("%s=%s\n", key, value)
+	}
+
+	envFile := filepath.Join(appDir, ".env")
+	if err := os.WriteFile(envFile, []byte(envContent), 0600); err != nil {
+		return fmt.Errorf("failed to write .env file: %w", err)
+	}
+	return nil
+}
+
 // RemoveApplication removes a Docker Compose application
 func (m *Manager) RemoveApplication(name string) error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+	unlock := m.lockApp(name)
+	defer unlock()
 
-	app, exists := m.applications[name]
+	app, exists := m.registered(name)
 	if !exists {
 		return fmt.Errorf("application %s not found", name)
 	}
 
 	// Stop and remove containers
 	m.logger.Info(fmt.Sprintf("Stopping application %s", name))
-	cmd := exec.Command("docker-compose", "-f", filepath.Join(app.Path, "docker-compose.yml"), "down", "--remove-orphans")
-	cmd.Dir = app.Path
-	if output, err := cmd.CombinedOutput(); err != nil {
+	if output, err := app.composeCommand("down", "--remove-orphans").CombinedOutput(); err != nil {
 		return fmt.Errorf("failed to stop application: %v - %s", err, string(output))
 	}
+	m.switches.closeApp(name)
 
 	// Remove application directory
 	if err := os.RemoveAll(app.Path); err != nil {
@@ -204,18 +639,87 @@ func (m *Manager) RemoveApplication(name string) error {
 	}
 
 	// Unregister application
+	m.mu.Lock()
 	delete(m.applications, name)
+	m.mu.Unlock()
 
 	m.logger.Info(fmt.Sprintf("Successfully removed application %s", name))
 	return nil
 }
 
+// StopApplication stops the containers of an application without removing them
+func (m *Manager) StopApplication(name string) error {
+	unlock := m.lockApp(name)
+	defer unlock()
+
+	return m.stopApplication(name)
+}
+
+// stopApplication stops an application, the caller must hold the
+// application's lock
+func (m *Manager) stopApplication(name string) error {
+	app, exists := m.registered(name)
+	if !exists {
+		return fmt.Errorf("application %s not found", name)
+	}
+
+	m.logger.Info(fmt.Sprintf("Stopping application %s", name))
+	if output, err := app.composeCommand("stop").CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to stop application: %v - %s", err, string(output))
+	}
+
+	return nil
+}
+
+// ApplyShutdownPolicy stops applications according to the given policy and
+// returns the resulting state of every application
+func (m *Manager) ApplyShutdownPolicy(policy string, criticalApps []string) []protocol.AppShutdownState {
+	m.ops.Lock()
+	defer m.ops.Unlock()
+
+	critical := make(map[string]bool)
+	for _, name := range criticalApps {
+		critical[name] = true
+	}
+
+	m.mu.RLock()
+	apps := maps.Clone(m.applications)
+	m.mu.RUnlock()
+
+	states := make([]protocol.AppShutdownState, 0, len(apps))
+	for name, app := range apps {
+		state := protocol.AppShutdownState{
+			Name:    name,
+			Version: app.Version,
+			Action:  "left-running",
+		}
+
+		stop := policy == protocol.ShutdownStopApps ||
+			(policy == protocol.ShutdownStopNonCritical && !critical[name])
+
+		if stop {
+			if err := m.stopApplication(name); err != nil {
+				m.logger.Error(fmt.Sprintf("Failed to stop application %s during shutdown", name), err)
+				state.Action = "failed"
+				state.Error = err.Error()
+			} else {
+				state.Action = "stopped"
+			}
+		}
+
+		states = append(states, state)
+	}
+
+	m.logger.Info(fmt.Sprintf("Applied shutdown policy %s to %d applications", policy, len(states)))
+	return states
+}
+
 // RestartContainer restarts a specific container
 func (m *Manager) RestartContainer(appName, containerName string) error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+	unlock := m.lockApp(appName)
+	defer unlock()
 
-	app, exists := m.applications[appName]
+	app, exists := m.registered(appName)
 	if !exists {
 		return fmt.Errorf("application %s not found", appName)
 	}
@@ -235,9 +739,7 @@ func (m *Manager) RestartContainer(appName, containerName string) error {
 
 	// Restart the container
 	m.logger.Info(fmt.Sprintf("Restarting container %s in application %s", containerName, appName))
-	cmd := exec.Command("docker-compose", "-f", filepath.Join(app.Path, "docker-compose.yml"), "restart", containerName)
-	cmd.Dir = app.Path
-	if output, err := cmd.CombinedOutput(); err != nil {
+	if output, err := app.composeCommand("restart", containerName).CombinedOutput(); err != nil {
 		return fmt.Errorf("failed to restart container: %v - %s", err, string(output))
 	}
 
@@ -247,8 +749,8 @@ func (m *Manager) RestartContainer(appName, containerName string) error {
 
 // GetApplications returns all registered applications
 func (m *Manager) GetApplications() map[string]*Application {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 
 	// Return a copy to avoid race conditions
 	apps := make(map[string]*Application)
@@ -270,12 +772,138 @@ func (m *Manager) GetApplications() map[string]*Application {
 	return apps
 }
 
-// UpdateEnvironmentVariables updates environment variables for an application
-func (m *Manager) UpdateEnvironmentVariables(appName string, envVars map[string]string) error {
+// Resync rescans the compose directory and refreshes the container state of
+// every application
+func (m *Manager) Resync() error {
+	m.ops.Lock()
+	defer m.ops.Unlock()
+
+	return m.resync()
+}
+
+// resync reloads the applications, the caller must hold ops for writing
+func (m *Manager) resync() error {
+	m.logger.Info("Resyncing applications from compose directory")
+
+	apps, err := m.loadExistingApplications()
+	if err != nil {
+		return fmt.Errorf("failed to reload applications: %w", err)
+	}
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	app, exists := m.applications[appName]
+	// Keep the known versions since they cannot be recovered from disk
+	for name, app := range apps {
+		if known, ok := m.applications[name]; ok {
+			app.Version = known.Version
+		}
+	}
+	m.applications = apps
+
+	return nil
+}
+
+// SetComposeDir switches the directory applications are managed in and
+// reloads the applications found there
+func (m *Manager) SetComposeDir(composeDir string) error {
+	if err := os.MkdirAll(composeDir, 0755); err != nil {
+		return fmt.Errorf("failed to create compose directory: %w", err)
+	}
+
+	m.ops.Lock()
+	defer m.ops.Unlock()
+
+	m.mu.Lock()
+	m.composeDir = composeDir
+	m.mu.Unlock()
+
+	m.logger.Info(fmt.Sprintf("Compose directory set to %s", composeDir))
+	return m.resync()
+}
+
+// pullImages pulls the images of an application, retrying failed pulls.
+// Images are pulled through the Engine API so that progress can be reported,
+// falling back to docker-compose when the daemon socket is not available or
+// image names depend on env vars. Pulled images the device cannot run fail
+// the pull, before the installed version is touched.
+func (m *Manager) pullImages(name, version, appDir, composeFile, composeYAML string, registries []protocol.RegistryAuth) error {
+	images := compose.Images(composeYAML)
+	m.stages(name).pulled(0, len(images))
+	if client := engineClient(); client != nil && len(images) > 0 && !strings.Contains(strings.Join(images, " "), "$") {
+		if err := m.pullWithProgress(client, appDir, name, version, images, registries); err != nil {
+			return err
+		}
+		return m.checkPlatforms(images)
+	}
+
+	err := m.pullRetries().do(m.ctx, func(int) error {
+		return m.composePull(appDir, composeFile, registries)
+	}, func(err error, delay time.Duration) {
+		m.logger.Warn(fmt.Sprintf("Pulling images of %s failed, retrying in %s: %v", name, delay, err))
+	})
+	if err != nil {
+		return err
+	}
+	m.stages(name).pulled(len(images), len(images))
+	return m.checkPlatforms(images)
+}
+
+// composePull pulls the images of an application with docker-compose. Private
+// registries are logged in to with a temporary Docker config that is removed
+// afterwards.
+func (m *Manager) composePull(appDir, composeFile string, registries []protocol.RegistryAuth) error {
+	env := os.Environ()
+
+	if len(registries) > 0 {
+		dockerConfig, err := os.MkdirTemp("", "edgetainer-docker-")
+		if err != nil {
+			return fmt.Errorf("failed to create docker config directory: %w", err)
+		}
+		defer os.RemoveAll(dockerConfig)
+
+		env = append(env, "DOCKER_CONFIG="+dockerConfig)
+
+		for _, registry := range registries {
+			cmd := exec.Command("docker", "login", registry.Server, "--username", registry.Username, "--password-stdin")
+			cmd.Env = env
+			cmd.Stdin = strings.NewReader(registry.Password)
+			if output, err := cmd.CombinedOutput(); err != nil {
+				return fmt.Errorf("failed to log in to registry %s: %v - %s", registry.Server, err, string(output))
+			}
+		}
+	}
+
+	cmd := exec.Command("docker-compose", "-f", composeFile, "pull")
+	cmd.Dir = appDir
+	cmd.Env = env
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to pull images: %v - %s", err, string(output))
+	}
+
+	return nil
+}
+
+// LastDeployResult returns the outcome of the most recent deployment, or nil if
+// nothing has been deployed since the agent started
+func (m *Manager) LastDeployResult() *DeployResult {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.lastDeploy == nil {
+		return nil
+	}
+
+	result := *m.lastDeploy
+	return &result
+}
+
+// UpdateEnvironmentVariables updates environment variables for an application
+func (m *Manager) UpdateEnvironmentVariables(appName string, envVars map[string]string) error {
+	unlock := m.lockApp(appName)
+	defer unlock()
+
+	app, exists := m.registered(appName)
 	if !exists {
 		return fmt.Errorf("application %s not found", appName)
 	}
@@ -292,7 +920,9 @@ func (m *Manager) UpdateEnvironmentVariables(appName string, envVars map[string]
 	}
 
 	// Update application
+	m.mu.Lock()
 	app.EnvVars = envVars
+	m.mu.Unlock()
 
 	m.logger.Info(fmt.Sprintf("Successfully updated environment variables for application %s", appName))
 	return nil
@@ -300,24 +930,13 @@ func (m *Manager) UpdateEnvironmentVariables(appName string, envVars map[string]
 
 // GetContainerLogs returns logs for a specific container
 func (m *Manager) GetContainerLogs(appName, containerName string, lines int) (string, error) {
-	m.mu.Lock()
-	app, exists := m.applications[appName]
-	m.mu.Unlock()
-
+	app, exists := m.registered(appName)
 	if !exists {
 		return "", fmt.Errorf("application %s not found", appName)
 	}
 
 	// Get container logs
-	args := []string{
-		"-f", filepath.Join(app.Path, "docker-compose.yml"),
-		"logs",
-		"--tail", fmt.Sprintf("%d", lines),
-		containerName,
-	}
-
-	cmd := exec.Command("docker-compose", args...)
-	cmd.Dir = app.Path
+	cmd := app.composeCommand("logs", "--tail", fmt.Sprintf("%d", lines), containerName)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		return "", fmt.Errorf("failed to get container logs: %w", err)
@@ -365,14 +984,17 @@ func (m *Manager) ensureNetworkExists() error {
 	return nil
 }
 
-// loadExistingApplications loads existing Docker Compose applications
-func (m *Manager) loadExistingApplications() error {
+// loadExistingApplications loads existing Docker Compose applications. The
+// caller must hold ops for writing, or be starting the manager.
+func (m *Manager) loadExistingApplications() (map[string]*Application, error) {
 	// Read compose directory
 	files, err := ioutil.ReadDir(m.composeDir)
 	if err != nil {
-		return fmt.Errorf("failed to read compose directory: %w", err)
+		return nil, fmt.Errorf("failed to read compose directory: %w", err)
 	}
 
+	apps := make(map[string]*Application)
+
 	for _, file := range files {
 		if !file.IsDir() {
 			continue
@@ -381,9 +1003,20 @@ func (m *Manager) loadExistingApplications() error {
 		appName := file.Name()
 		appDir := filepath.Join(m.composeDir, appName)
 
-		// Check if docker-compose.yml exists
-		composeFile := filepath.Join(appDir, "docker-compose.yml")
-		if _, err := os.Stat(composeFile); os.IsNotExist(err) {
+		app := &Application{Name: appName, Path: appDir, Version: "unknown"}
+
+		// Blue/green applications record their running copy, others have a
+		// docker-compose.yml
+		state, err := loadBlueGreenState(appDir)
+		if err != nil {
+			m.logger.Error(fmt.Sprintf("Failed to read blue/green state of application %s", appName), err)
+			continue
+		}
+		if state != nil {
+			app.Strategy = protocol.StrategyBlueGreen
+			app.Color = state.Color
+			app.Version = state.Version
+		} else if _, err := os.Stat(app.composeFile()); os.IsNotExist(err) {
 			continue
 		}
 
@@ -410,33 +1043,35 @@ func (m *Manager) loadExistingApplications() error {
 		}
 
 		// Get containers
-		containers, err := m.getContainers(appName, appDir)
+		containers, err := m.getContainers(app)
 		if err != nil {
 			m.logger.Error(fmt.Sprintf("Failed to get containers for application %s: %v", appName, err), err)
 			// Continue anyway, non-fatal
 			containers = []Container{}
 		}
+		app.Containers = containers
+		app.EnvVars = envVars
 
-		// Register application
-		m.applications[appName] = &Application{
-			Name:       appName,
-			Path:       appDir,
-			Containers: containers,
-			EnvVars:    envVars,
-			Version:    "unknown", // Cannot determine version without metadata
+		// Serve the ports of a blue/green application again
+		if state != nil {
+			if err := m.routePorts(app, state.Ports); err != nil {
+				m.logger.Error(fmt.Sprintf("Failed to serve the ports of application %s", appName), err)
+			}
 		}
 
+		// Register application; the version is only known for blue/green
+		// applications since others keep no metadata
+		apps[appName] = app
+
 		m.logger.Info(fmt.Sprintf("Loaded existing application %s with %d containers", appName, len(containers)))
 	}
 
-	return nil
+	return apps, nil
 }
 
 // getContainers gets containers for an application
-func (m *Manager) getContainers(appName, appDir string) ([]Container, error) {
-	cmd := exec.Command("docker-compose", "-f", filepath.Join(appDir, "docker-compose.yml"), "ps", "--format", "json")
-	cmd.Dir = appDir
-	output, err := cmd.CombinedOutput()
+func (m *Manager) getContainers(app *Application) ([]Container, error) {
+	output, err := app.composeCommand("ps", "--format", "json").CombinedOutput()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get containers: %v - %s", err, string(output))
 	}
@@ -445,7 +1080,7 @@ func (m *Manager) getContainers(appName, appDir string) ([]Container, error) {
 	var result []map[string]interface{}
 	if err := json.Unmarshal(output, &result); err != nil {
 		// Fallback for older versions of docker-compose that don't support JSON output
-		return m.getContainersLegacy(appName, appDir)
+		return m.getContainersLegacy(app)
 	}
 
 	// Convert to Container structs
@@ -467,75 +1102,40 @@ func (m *Manager) getContainers(appName, appDir string) ([]Container, error) {
 }
 
 // getContainersLegacy gets containers for an application using legacy format
-func (m *Manager) getContainersLegacy(appName, appDir string) ([]Container, error) {
+func (m *Manager) getContainersLegacy(app *Application) ([]Container, error) {
 	// This is a simplified implementation for older docker-compose versions
 	// In a real implementation, you would parse the output of docker-compose ps
-	cmd := exec.Command("docker-compose", "-f", filepath.Join(appDir, "docker-compose.yml"), "ps", "-q")
-	cmd.Dir = appDir
-	output, err := cmd.CombinedOutput()
+	output, err := app.composeCommand("ps", "-q").CombinedOutput()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get container IDs: %v - %s", err, string(output))
 	}
 
-	containerIDs := strings.Split(strings.TrimSpace(string(output)), "\n")
-	containers := make([]Container, 0, len(containerIDs))
-
-	for _, id := range containerIDs {
-		if id == "" {
-			continue
-		}
-
-		cmd := exec.Command("docker", "inspect", id)
-		output, err := cmd.CombinedOutput()
-		if err != nil {
-			m.logger.Error(fmt.Sprintf("Failed to inspect container %s: %v", id, err), err)
-			continue
-		}
-
-		var inspectResult []map[string]interface{}
-		if err := json.Unmarshal(output, &inspectResult); err != nil {
-			m.logger.Error(fmt.Sprintf("Failed to parse inspect output for container %s: %v", id, err), err)
-			continue
-		}
-
-		if len(inspectResult) == 0 {
-			continue
-		}
-
-		// Extract container information
-		info := inspectResult[0]
-		name := fmt.Sprintf("%v", info["Name"])
-		if strings.HasPrefix(name, "/") {
-			name = name[1:] // Remove leading slash
-		}
+	// Containers removed since the listing are left out
+	inspected, err := inspect[containerState](strings.Fields(string(output)), inspectState)
+	if err != nil {
+		m.logger.Error(fmt.Sprintf("Failed to inspect containers of %s: %v", app.Name, err), err)
+	}
+	containers := make([]Container, 0, len(inspected))
 
+	for _, info := range inspected {
 		state := ContainerUnknown
-		if stateInfo, ok := info["State"].(map[string]interface{}); ok {
-			if running, ok := stateInfo["Running"].(bool); ok && running {
-				state = ContainerRunning
-			} else if status, ok := stateInfo["Status"].(string); ok {
-				switch status {
-				case "created":
-					state = ContainerCreated
-				case "exited":
-					state = ContainerExited
-				case "restarting":
-					state = ContainerRestarting
-				}
-			}
-		}
-
-		image := ""
-		if config, ok := info["Config"].(map[string]interface{}); ok {
-			if img, ok := config["Image"].(string); ok {
-				image = img
+		if info.State.Running {
+			state = ContainerRunning
+		} else {
+			switch info.State.Status {
+			case "created":
+				state = ContainerCreated
+			case "exited":
+				state = ContainerExited
+			case "restarting":
+				state = ContainerRestarting
 			}
 		}
 
 		container := Container{
-			ID:         id,
-			Name:       name,
-			Image:      image,
+			ID:         info.ID,
+			Name:       strings.TrimPrefix(info.Name, "/"),
+			Image:      info.Image,
 			State:      state,
 			Status:     fmt.Sprintf("%v", state),
 			Ports:      make(map[string]string),
@@ -0,0 +1,313 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/compose"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+const (
+	defaultMigrationTimeout = 10 * time.Minute
+	// volumeCopyTimeout bounds backing up and restoring a volume
+	volumeCopyTimeout = 30 * time.Minute
+	// migrationHelperImage copies volume contents for backups, volume-copy
+	// steps and restore points
+	migrationHelperImage = "busybox:stable"
+	// backupSuffix names the volume holding the backup of a volume during a migration
+	backupSuffix = "-edgetainer-backup"
+)
+
+// fileSnapshot holds the contents of files so that they can be put back,
+// nil for files that did not exist
+type fileSnapshot map[string][]byte
+
+// snapshotFiles reads files that are about to be overwritten
+func snapshotFiles(paths ...string) (fileSnapshot, error) {
+	snapshot := make(fileSnapshot, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		snapshot[path] = data
+	}
+	return snapshot, nil
+}
+
+// restore writes the files back, removing those that did not exist
+func (s fileSnapshot) restore() error {
+	var errs []error
+	for path, data := range s {
+		if data == nil {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// migration runs the migration steps of one deployment
+type migration struct {
+	m        *Manager
+	app      string
+	dir      string            // Application directory, holding the new version's .env
+	project  string            // Compose project of the new version
+	volumes  map[string]string // Docker volume by compose volume name
+	managed  map[string]bool   // Docker volumes created by compose for the new version
+	stopped  []string          // Containers of the installed version
+	backups  map[string]string // Backup volume by Docker volume
+	snapshot fileSnapshot      // Files of the installed version
+}
+
+// migrate stops the installed version of an application and runs the
+// migration to the new version. The volumes listed for backup are copied
+// first. If a step fails, the volumes and the files in snapshot are
+// restored and the installed version is started again. The new version's
+// files must have been written, installedYAML is the compose file of the
+// installed version. The caller must hold the application's lock.
+func (m *Manager) migrate(installed *Application, installedYAML, composeYAML, version string, snapshot fileSnapshot, spec *protocol.Migration) error {
+	run := &migration{
+		m:        m,
+		app:      installed.Name,
+		dir:      installed.Path,
+		project:  compose.ProjectName(installed.Name),
+		volumes:  make(map[string]string),
+		managed:  make(map[string]bool),
+		backups:  make(map[string]string),
+		snapshot: snapshot,
+	}
+
+	// Volumes of the new version take precedence over those of the installed one
+	if previous, err := compose.Volumes(installedYAML, installed.projectName()); err == nil {
+		for key, volume := range previous {
+			run.volumes[key] = volume
+		}
+	}
+	next, err := compose.Volumes(composeYAML, run.project)
+	if err != nil {
+		return err
+	}
+	for key, volume := range next {
+		run.volumes[key] = volume
+		run.managed[volume] = volume == run.project+"_"+key
+	}
+
+	m.logger.Info(fmt.Sprintf("Migrating application %s from version %s to %s", installed.Name, installed.Version, version))
+	if err := run.stop(installed); err != nil {
+		return run.rollback(installed, fmt.Errorf("failed to stop version %s: %w", installed.Version, err))
+	}
+
+	for _, volume := range spec.Backup {
+		if err := run.backup(run.volume(volume)); err != nil {
+			return run.rollback(installed, fmt.Errorf("failed to back up volume %s: %w", volume, err))
+		}
+	}
+
+	for i, step := range spec.Steps {
+		name := step.Name
+		if name == "" {
+			name = fmt.Sprintf("step %d", i+1)
+		}
+
+		m.logger.Info(fmt.Sprintf("Running migration %s of application %s", name, installed.Name))
+		if err := run.step(i, step); err != nil {
+			return run.rollback(installed, fmt.Errorf("migration %s failed: %w", name, err))
+		}
+	}
+
+	run.removeBackups()
+	m.logger.Info(fmt.Sprintf("Migrated application %s to version %s", installed.Name, version))
+	return nil
+}
+
+// volume returns the Docker volume of a volume named in a migration
+func (r *migration) volume(name string) string {
+	if volume, ok := r.volumes[name]; ok {
+		return volume
+	}
+	return name
+}
+
+// stop stops the containers of the installed version, remembering them so
+// that they can be started again
+func (r *migration) stop(installed *Application) error {
+	output, err := exec.Command("docker", "ps", "-q", "--filter", "label="+labelProject+"="+installed.projectName()).Output()
+	if err != nil {
+		return err
+	}
+
+	r.stopped = strings.Fields(string(output))
+	if len(r.stopped) == 0 {
+		return nil
+	}
+	return r.m.docker(defaultMigrationTimeout, append([]string{"stop"}, r.stopped...)...)
+}
+
+// step runs one migration step
+func (r *migration) step(index int, step protocol.MigrationStep) error {
+	timeout := defaultMigrationTimeout
+	if step.Timeout > 0 {
+		timeout = time.Duration(step.Timeout) * time.Second
+	}
+
+	switch step.Type {
+	case protocol.MigrationContainer:
+		name := fmt.Sprintf("%s-migration-%d", r.project, index+1)
+		exec.Command("docker", "rm", "-f", name).Run()
+
+		args := []string{"run", "--rm", "--name", name}
+		if _, err := os.Stat(filepath.Join(r.dir, ".env")); err == nil {
+			args = append(args, "--env-file", filepath.Join(r.dir, ".env"))
+		}
+		for _, mount := range step.Volumes {
+			volume, path, _ := strings.Cut(mount, ":")
+			if err := r.ensureVolume(r.volume(volume)); err != nil {
+				return err
+			}
+			args = append(args, "-v", r.volume(volume)+":"+path)
+		}
+		args = append(args, step.Image)
+		args = append(args, step.Command...)
+
+		err := r.m.docker(timeout, args...)
+		if err != nil {
+			// A container that timed out is still running
+			exec.Command("docker", "rm", "-f", name).Run()
+		}
+		return err
+
+	case protocol.MigrationVolumeCopy:
+		from, to := r.volume(step.From), r.volume(step.To)
+		if err := exec.Command("docker", "volume", "inspect", from).Run(); err != nil {
+			return fmt.Errorf("volume %s does not exist", step.From)
+		}
+		if err := r.ensureVolume(to); err != nil {
+			return err
+		}
+		return r.m.copyVolume(timeout, from, to, false)
+
+	default:
+		return fmt.Errorf("unknown step type %q", step.Type)
+	}
+}
+
+// ensureVolume creates a volume that does not exist yet. Volumes the new
+// version's compose file declares are labelled as compose creates them, so
+// that compose uses them when the new version starts.
+func (r *migration) ensureVolume(volume string) error {
+	if exec.Command("docker", "volume", "inspect", volume).Run() == nil {
+		return nil
+	}
+
+	args := []string{"volume", "create"}
+	if r.managed[volume] {
+		args = append(args,
+			"--label", labelProject+"="+r.project,
+			"--label", "com.docker.compose.volume="+strings.TrimPrefix(volume, r.project+"_"))
+	}
+	return r.m.docker(time.Minute, append(args, volume)...)
+}
+
+// backup copies a volume so that it can be restored if the migration fails
+func (r *migration) backup(volume string) error {
+	if exec.Command("docker", "volume", "inspect", volume).Run() != nil {
+		// Nothing to restore, the volume is removed on rollback instead
+		r.backups[volume] = ""
+		return nil
+	}
+
+	backup := volume + backupSuffix
+	exec.Command("docker", "volume", "rm", "-f", backup).Run()
+	if err := r.m.docker(time.Minute, "volume", "create", backup); err != nil {
+		return err
+	}
+	r.backups[volume] = backup
+	return r.m.copyVolume(volumeCopyTimeout, volume, backup, false)
+}
+
+// copyVolume copies the contents of a volume into another, replacing the
+// target's contents if clear is set
+func (m *Manager) copyVolume(timeout time.Duration, from, to string, clear bool) error {
+	script := "cp -a /from/. /to/"
+	if clear {
+		script = "rm -rf /to/* /to/.[!.]* /to/..?* && " + script
+	}
+	return m.docker(timeout, "run", "--rm", "-v", from+":/from:ro", "-v", to+":/to", migrationHelperImage, "sh", "-c", script)
+}
+
+// rollback restores the backed up volumes and the files of the installed
+// version and starts its containers again. It returns the migration error,
+// along with anything that could not be restored.
+func (r *migration) rollback(installed *Application, cause error) error {
+	r.m.logger.Warn(fmt.Sprintf("Rolling back application %s to version %s: %v", r.app, installed.Version, cause))
+
+	errs := []error{cause}
+	for volume, backup := range r.backups {
+		var err error
+		if backup == "" {
+			err = exec.Command("docker", "volume", "rm", "-f", volume).Run()
+		} else {
+			err = r.m.copyVolume(volumeCopyTimeout, backup, volume, true)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to restore volume %s: %w", volume, err))
+		}
+	}
+
+	if err := r.snapshot.restore(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to restore files: %w", err))
+	}
+
+	if len(r.stopped) > 0 {
+		if err := r.m.docker(defaultMigrationTimeout, append([]string{"start"}, r.stopped...)...); err != nil {
+			errs = append(errs, fmt.Errorf("failed to start version %s: %w", installed.Version, err))
+		}
+	}
+
+	if len(errs) == 1 {
+		r.removeBackups()
+		return fmt.Errorf("%w, rolled back to version %s", cause, installed.Version)
+	}
+	// Backups are kept for manual recovery when they could not be restored
+	return errors.Join(errs...)
+}
+
+// removeBackups removes the backup volumes
+func (r *migration) removeBackups() {
+	for _, backup := range r.backups {
+		if backup == "" {
+			continue
+		}
+		if output, err := exec.Command("docker", "volume", "rm", backup).CombinedOutput(); err != nil {
+			r.m.logger.Error(fmt.Sprintf("Failed to remove backup volume %s: %s", backup, string(output)), err)
+		}
+	}
+}
+
+// docker runs a docker command, failing it after timeout
+func (m *Manager) docker(timeout time.Duration, args ...string) error {
+	ctx, cancel := context.WithTimeout(m.ctx, timeout)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, "docker", args...).CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("%v - %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
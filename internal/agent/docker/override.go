@@ -0,0 +1,50 @@
+package docker
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+)
+
+// layersDir holds the compose files of an application while they are merged
+const layersDir = ".compose-layers"
+
+// layerCompose merges compose file fragments over a compose file the way
+// docker-compose layers files given with -f, later fragments taking
+// precedence. Variables are left for compose to interpolate when the
+// application starts. The caller must hold the application's lock.
+func (m *Manager) layerCompose(name, composeYAML string, overrides []string) (string, error) {
+	appDir := filepath.Join(m.composeDir, name)
+	dir := filepath.Join(appDir, layersDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create compose layers directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var args []string
+	for i, layer := range append([]string{composeYAML}, overrides...) {
+		file := filepath.Join(dir, strconv.Itoa(i)+".yml")
+		if err := os.WriteFile(file, []byte(layer), 0600); err != nil {
+			return "", fmt.Errorf("failed to write compose layer: %w", err)
+		}
+		args = append(args, "-f", file)
+	}
+
+	// Relative paths in every layer are taken from the application directory
+	args = append(args, "--project-directory", appDir, "config", "--no-interpolate")
+	cmd := exec.Command("docker-compose", args...)
+	cmd.Dir = appDir
+
+	output, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return "", fmt.Errorf("failed to merge compose overrides: %v - %s", err, string(exitErr.Stderr))
+		}
+		return "", fmt.Errorf("failed to merge compose overrides: %w", err)
+	}
+
+	m.logger.Info(fmt.Sprintf("Merged %d compose overrides into application %s", len(overrides), name))
+	return string(output), nil
+}
@@ -0,0 +1,74 @@
+package docker
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+// inspectPlatform fills imagePlatform
+const inspectPlatform = `{"Os":{{json .Os}},"Architecture":{{json .Architecture}},"Variant":{{json .Variant}}}`
+
+// imagePlatform is the platform an image was built for as rendered by
+// inspectPlatform
+type imagePlatform struct {
+	OS           string `json:"Os"`
+	Architecture string `json:"Architecture"`
+	Variant      string `json:"Variant"`
+}
+
+// String returns the platform as os/arch[/variant]
+func (p imagePlatform) String() string {
+	platform := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		platform += "/" + p.Variant
+	}
+	return platform
+}
+
+// SetPlatforms sets the platforms the device runs images of, its own first
+// and then those it runs under emulation. Images pulled for a deployment
+// must be built for one of them, nil lets any image through.
+func (m *Manager) SetPlatforms(platforms []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.platforms = platforms
+}
+
+// checkPlatforms fails if one of the images of a deployment is built for a
+// platform the device does not run. A multi-arch image is pulled for the
+// platform of the daemon, so only single-platform images of another one are
+// caught here; they would start and fail with exec format errors.
+func (m *Manager) checkPlatforms(images []string) error {
+	m.mu.RLock()
+	platforms := m.platforms
+	m.mu.RUnlock()
+	if len(platforms) == 0 {
+		return nil
+	}
+
+	var refs []string
+	for _, image := range images {
+		if !strings.Contains(image, "$") {
+			refs = append(refs, image)
+		}
+	}
+
+	// Images that fail to inspect are not decoded, so the rest cannot be
+	// matched up with their references
+	inspected, err := inspect[imagePlatform](refs, inspectPlatform)
+	if err != nil {
+		m.logger.Warn(fmt.Sprintf("Failed to check the platforms of images: %v", err))
+		return nil
+	}
+	for i, platform := range inspected {
+		if platform.OS == "" || platform.Architecture == "" {
+			continue
+		}
+		if !protocol.PlatformsRun(platforms, []string{platform.String()}) {
+			return fmt.Errorf("image %s is built for %s, this device runs %s", refs[i], platform, strings.Join(platforms, ", "))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,376 @@
+package docker
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/compose"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+const (
+	// defaultDockerSocket is the Engine API socket used unless DOCKER_HOST
+	// points elsewhere
+	defaultDockerSocket = "/var/run/docker.sock"
+	// pullProgressInterval is how often progress is reported while pulling
+	pullProgressInterval = 2 * time.Second
+)
+
+// PullProgressHandler receives the progress of image pulls during a deployment
+type PullProgressHandler func(progress *protocol.PullProgress)
+
+// pullMessage is one message of the JSON stream returned by the Engine API
+// while pulling an image
+type pullMessage struct {
+	ID             string `json:"id"`
+	Status         string `json:"status"`
+	ProgressDetail struct {
+		Current int64 `json:"current"`
+		Total   int64 `json:"total"`
+	} `json:"progressDetail"`
+	Error string `json:"error"`
+}
+
+// engineClient returns an HTTP client for the Docker Engine API, or nil if
+// the daemon is not reachable over a unix socket
+func engineClient() *http.Client {
+	socketPath := defaultDockerSocket
+	if host := os.Getenv("DOCKER_HOST"); host != "" {
+		path, ok := strings.CutPrefix(host, "unix://")
+		if !ok {
+			return nil
+		}
+		socketPath = path
+	}
+
+	if _, err := os.Stat(socketPath); err != nil {
+		return nil
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}
+}
+
+// splitReference splits an image reference into the name and the tag or
+// digest expected by the Engine API
+func splitReference(image string) (name, tag string) {
+	if name, digest, found := strings.Cut(image, "@"); found {
+		return name, digest
+	}
+
+	slash := strings.LastIndex(image, "/")
+	if colon := strings.LastIndex(image, ":"); colon > slash {
+		return image[:colon], image[colon+1:]
+	}
+	return image, "latest"
+}
+
+// registryAuthHeader encodes the credentials of the registry an image is
+// pulled from, or returns "" if there are none
+func registryAuthHeader(image string, registries []protocol.RegistryAuth) (string, error) {
+	registry, _ := compose.SplitImage(image)
+	for _, auth := range registries {
+		if compose.NormalizeRegistry(auth.Server) != registry {
+			continue
+		}
+
+		data, err := json.Marshal(map[string]string{
+			"username":      auth.Username,
+			"password":      auth.Password,
+			"serveraddress": auth.Server,
+		})
+		if err != nil {
+			return "", err
+		}
+		return base64.URLEncoding.EncodeToString(data), nil
+	}
+	return "", nil
+}
+
+// pullImage pulls one image through the Engine API, passing every progress
+// message to onMessage
+func pullImage(ctx context.Context, client *http.Client, image string, registries []protocol.RegistryAuth, onMessage func(pullMessage)) error {
+	name, tag := splitReference(image)
+	query := url.Values{}
+	query.Set("fromImage", name)
+	query.Set("tag", tag)
+
+	// The host is ignored by the unix socket dialer
+	u := url.URL{Scheme: "http", Host: "docker", Path: "/images/create", RawQuery: query.Encode()}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	auth, err := registryAuthHeader(image, registries)
+	if err != nil {
+		return fmt.Errorf("failed to encode registry credentials: %w", err)
+	}
+	if auth != "" {
+		req.Header.Set("X-Registry-Auth", auth)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		var message struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(body, &message) == nil && message.Message != "" {
+			return errors.New(message.Message)
+		}
+		return fmt.Errorf("docker returned %s", resp.Status)
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var message pullMessage
+		if err := decoder.Decode(&message); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("failed to read pull progress: %w", err)
+		}
+
+		if message.Error != "" {
+			return errors.New(message.Error)
+		}
+		onMessage(message)
+	}
+}
+
+// pullTracker aggregates the progress messages of the images of a deployment
+type pullTracker struct {
+	mu       sync.Mutex
+	progress protocol.PullProgress
+	layers   []map[string]int // Per image, layer ID to index in Layers
+}
+
+// newPullTracker creates a tracker with every image waiting
+func newPullTracker(app, version string, images []string) *pullTracker {
+	t := &pullTracker{
+		progress: protocol.PullProgress{App: app, Version: version},
+		layers:   make([]map[string]int, len(images)),
+	}
+	for i, image := range images {
+		t.progress.Images = append(t.progress.Images, protocol.ImageProgress{Image: image, Status: protocol.PullWaiting})
+		t.layers[i] = make(map[string]int)
+	}
+	return t
+}
+
+// setStatus sets the status of an image. The error of a failed attempt is
+// kept until the image is done.
+func (t *pullTracker) setStatus(i int, status string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	image := &t.progress.Images[i]
+	image.Status = status
+	switch {
+	case err != nil:
+		image.Error = err.Error()
+	case status == protocol.PullDone:
+		image.Error = ""
+	}
+	if status == protocol.PullPulling {
+		image.Attempt++
+	}
+}
+
+// status returns the status of an image
+func (t *pullTracker) status(i int) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.progress.Images[i].Status
+}
+
+// update records a progress message of an image. Only download progress is
+// counted, later stages mark the layer as fully downloaded.
+func (t *pullTracker) update(i int, message pullMessage) {
+	if message.ID == "" || strings.HasPrefix(message.Status, "Pulling from") {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	image := &t.progress.Images[i]
+	index, ok := t.layers[i][message.ID]
+	if !ok {
+		index = len(image.Layers)
+		t.layers[i][message.ID] = index
+		image.Layers = append(image.Layers, protocol.LayerProgress{ID: message.ID})
+	}
+
+	layer := &image.Layers[index]
+	layer.Status = message.Status
+	switch message.Status {
+	case "Downloading":
+		layer.Current = message.ProgressDetail.Current
+		layer.Total = message.ProgressDetail.Total
+	case "Verifying Checksum", "Download complete", "Extracting", "Pull complete", "Already exists":
+		layer.Current = layer.Total
+	}
+}
+
+// snapshot returns a copy of the progress with percentages filled in
+func (t *pullTracker) snapshot() *protocol.PullProgress {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	progress := t.progress
+	progress.Updated = time.Now()
+	progress.Images = make([]protocol.ImageProgress, len(t.progress.Images))
+
+	var current, total int64
+	done := 0
+	for i, image := range t.progress.Images {
+		image.Layers = append([]protocol.LayerProgress(nil), image.Layers...)
+
+		var imageCurrent, imageTotal int64
+		for j := range image.Layers {
+			layer := &image.Layers[j]
+			switch {
+			case layer.Status == "Pull complete" || layer.Status == "Already exists":
+				layer.Percent = 100
+			case layer.Total > 0:
+				layer.Percent = percent(layer.Current, layer.Total)
+			}
+			imageCurrent += layer.Current
+			imageTotal += layer.Total
+		}
+
+		switch {
+		case image.Status == protocol.PullDone:
+			image.Percent = 100
+			done++
+		case imageTotal > 0:
+			image.Percent = percent(imageCurrent, imageTotal)
+		}
+		current += imageCurrent
+		total += imageTotal
+		progress.Images[i] = image
+	}
+
+	switch {
+	case len(progress.Images) > 0 && done == len(progress.Images):
+		progress.Percent = 100
+	case total > 0:
+		progress.Percent = percent(current, total)
+	case len(progress.Images) > 0:
+		progress.Percent = percent(int64(done), int64(len(progress.Images)))
+	}
+	return &progress
+}
+
+// percent returns current as a percentage of total, rounded to one decimal
+func percent(current, total int64) float64 {
+	if current >= total {
+		return 100
+	}
+	return float64(current*1000/total) / 10
+}
+
+// pullWithProgress pulls the images one at a time through the Engine API,
+// reporting progress periodically and once more when done. Failed pulls are
+// retried, and progress is saved in the application directory so that a
+// later attempt at the same version skips the images already pulled. The
+// caller must hold the application's lock.
+func (m *Manager) pullWithProgress(client *http.Client, appDir, name, version string, images []string, registries []protocol.RegistryAuth) (err error) {
+	tracker := newPullTracker(name, version, images)
+	statePath := filepath.Join(appDir, pullStateFile)
+	if tracker.restore(statePath) {
+		m.logger.Info(fmt.Sprintf("Resuming image pulls of %s version %s", name, version))
+	}
+
+	m.mu.RLock()
+	report := m.progressHandler
+	m.mu.RUnlock()
+	if report == nil {
+		report = func(*protocol.PullProgress) {}
+	}
+
+	stop := make(chan struct{})
+	reported := make(chan struct{})
+	go func() {
+		defer close(reported)
+
+		ticker := time.NewTicker(pullProgressInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				report(tracker.snapshot())
+				tracker.save(statePath)
+			case <-stop:
+				report(tracker.snapshot())
+				return
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-reported
+		if err == nil {
+			os.Remove(statePath)
+		}
+	}()
+
+	for i, image := range images {
+		if tracker.status(i) == protocol.PullDone && imageExists(m.ctx, client, image) {
+			m.logger.Debug(fmt.Sprintf("Image %s was pulled by an earlier attempt", image))
+			m.stages(name).pulled(i+1, len(images))
+			continue
+		}
+
+		err = m.pullRetries().do(m.ctx, func(attempt int) error {
+			tracker.setStatus(i, protocol.PullPulling, nil)
+			m.logger.Info(fmt.Sprintf("Pulling image %s (attempt %d)", image, attempt))
+
+			return pullImage(m.ctx, client, image, registries, func(message pullMessage) {
+				tracker.update(i, message)
+			})
+		}, func(err error, delay time.Duration) {
+			tracker.setStatus(i, protocol.PullRetrying, err)
+			tracker.save(statePath)
+			m.logger.Warn(fmt.Sprintf("Pulling image %s failed, retrying in %s: %v", image, delay, err))
+		})
+		if err != nil {
+			tracker.setStatus(i, protocol.PullFailed, err)
+			tracker.save(statePath)
+			return fmt.Errorf("failed to pull image %s: %w", image, err)
+		}
+
+		tracker.setStatus(i, protocol.PullDone, nil)
+		tracker.save(statePath)
+		m.stages(name).pulled(i+1, len(images))
+	}
+
+	return nil
+}
@@ -0,0 +1,134 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/compose"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+// serviceReadyTimeout bounds how long a restarted service may take to run
+// and pass its health checks before its dependents are restarted
+const serviceReadyTimeout = 2 * time.Minute
+
+// RestartApplication restarts services of an application in depends_on
+// order, waiting for each service to be running and healthy before the
+// services depending on it. Unless noDeps is set, the services the named ones
+// depend on are restarted first. With rolling, the containers of scaled
+// services are restarted one at a time. Services depending on a service that
+// failed to restart are skipped.
+func (m *Manager) RestartApplication(name string, services []string, noDeps, rolling bool) ([]protocol.ServiceRestartResult, error) {
+	unlock := m.lockApp(name)
+	defer unlock()
+
+	app, exists := m.registered(name)
+	if !exists {
+		return nil, fmt.Errorf("application %s not found", name)
+	}
+
+	data, err := os.ReadFile(app.composeFile())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read compose file: %w", err)
+	}
+	deps, err := compose.Dependencies(string(data))
+	if err != nil {
+		return nil, err
+	}
+	order, err := compose.StartOrder(deps, services, !noDeps)
+	if err != nil {
+		return nil, err
+	}
+
+	m.logger.Info(fmt.Sprintf("Restarting services of application %s in order %v", name, order))
+
+	results := make([]protocol.ServiceRestartResult, 0, len(order))
+	failed := make(map[string]bool)
+	for _, service := range order {
+		result := protocol.ServiceRestartResult{Service: service}
+
+		for _, dep := range deps[service] {
+			if failed[dep] {
+				result.Status = protocol.RestartSkipped
+				result.Error = fmt.Sprintf("depends on %s, which failed", dep)
+				break
+			}
+		}
+		if result.Status == protocol.RestartSkipped {
+			failed[service] = true
+			results = append(results, result)
+			continue
+		}
+
+		start := time.Now()
+		result.Containers, err = m.restartService(app, service, rolling)
+		result.Duration = time.Since(start).Round(time.Millisecond).Seconds()
+		if err != nil {
+			m.logger.Error(fmt.Sprintf("Failed to restart service %s of application %s", service, name), err)
+			result.Status = protocol.RestartFailed
+			result.Error = err.Error()
+			failed[service] = true
+		} else {
+			result.Status = protocol.RestartDone
+		}
+		results = append(results, result)
+	}
+
+	if containers, err := m.getContainers(app); err == nil {
+		m.setContainers(app, containers)
+	}
+
+	return results, nil
+}
+
+// restartService restarts the containers of a service and waits until they
+// are ready. It returns the number of containers restarted.
+func (m *Manager) restartService(app *Application, service string, rolling bool) (int, error) {
+	ids, err := containerIDs(app, service)
+	if err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, fmt.Errorf("service has no containers")
+	}
+
+	if !rolling || len(ids) == 1 {
+		if output, err := app.composeCommand("restart", service).CombinedOutput(); err != nil {
+			return 0, fmt.Errorf("failed to restart: %v - %s", err, string(output))
+		}
+		return len(ids), m.waitReady(ids)
+	}
+
+	for i, id := range ids {
+		if output, err := exec.Command("docker", "restart", id).CombinedOutput(); err != nil {
+			return i, fmt.Errorf("failed to restart container %d of %d: %v - %s", i+1, len(ids), err, string(output))
+		}
+		if err := m.waitReady([]string{id}); err != nil {
+			return i + 1, fmt.Errorf("container %d of %d: %w", i+1, len(ids), err)
+		}
+	}
+	return len(ids), nil
+}
+
+// waitReady waits until containers are running and healthy
+func (m *Manager) waitReady(ids []string) error {
+	ctx, cancel := context.WithTimeout(m.ctx, serviceReadyTimeout)
+	defer cancel()
+
+	for {
+		err := containersReady(ids)
+		if err == nil || errors.Is(err, errContainerFailed) {
+			return err
+		}
+
+		select {
+		case <-time.After(healthInterval):
+		case <-ctx.Done():
+			return fmt.Errorf("not ready after %s: %w", serviceReadyTimeout, err)
+		}
+	}
+}
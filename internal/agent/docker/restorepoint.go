@@ -0,0 +1,270 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/compose"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+const (
+	// restorePointsDir holds the files of restore points in the compose
+	// directory
+	restorePointsDir = ".restore-points"
+	// labelRestorePoint marks the volume snapshots of a restore point
+	labelRestorePoint = "io.edgetainer.restore-point"
+)
+
+// CreateRestorePoint records the compose file, env vars and version of
+// applications, all of them if none are named, so that they can be put back
+// with Restore. With volumes, each application is stopped while its named
+// volumes are copied, then started again. Applications are recorded one at
+// a time, the others keep running meanwhile.
+func (m *Manager) CreateRestorePoint(id string, apps []string, volumes bool) (*protocol.RestorePointManifest, error) {
+	if len(apps) == 0 {
+		m.mu.RLock()
+		apps = slices.Sorted(maps.Keys(m.applications))
+		m.mu.RUnlock()
+	}
+	if len(apps) == 0 {
+		return nil, fmt.Errorf("no applications to create a restore point of")
+	}
+
+	dir := m.restorePointDir(id)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create restore point directory: %w", err)
+	}
+
+	manifest := &protocol.RestorePointManifest{ID: id, CreatedAt: time.Now()}
+	for _, name := range apps {
+		app, err := m.recordApp(dir, id, name, volumes)
+		if err != nil {
+			m.DeleteRestorePoint(id)
+			return nil, fmt.Errorf("failed to record application %s: %w", name, err)
+		}
+		manifest.Apps = append(manifest.Apps, *app)
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dir, "manifest.json"), data, 0600)
+	}
+	if err != nil {
+		m.DeleteRestorePoint(id)
+		return nil, fmt.Errorf("failed to save restore point: %w", err)
+	}
+
+	m.logger.Info(fmt.Sprintf("Created restore point %s of %d applications", id, len(manifest.Apps)))
+	return manifest, nil
+}
+
+// restorePointDir returns the directory of the files of a restore point
+func (m *Manager) restorePointDir(id string) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return filepath.Join(m.composeDir, restorePointsDir, id)
+}
+
+// recordApp records an application in a restore point, copying its volumes
+// if asked to
+func (m *Manager) recordApp(dir, id, name string, volumes bool) (*protocol.RestorePointApp, error) {
+	unlock := m.lockApp(name)
+	defer unlock()
+
+	app, exists := m.registered(name)
+	if !exists {
+		return nil, fmt.Errorf("application %s not found", name)
+	}
+
+	composeYAML, err := os.ReadFile(app.composeFile())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read compose file: %w", err)
+	}
+	env, err := json.Marshal(app.EnvVars)
+	if err != nil {
+		return nil, err
+	}
+
+	appDir := filepath.Join(dir, name)
+	if err := os.MkdirAll(appDir, 0700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(appDir, "docker-compose.yml"), composeYAML, 0600); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(appDir, "env.json"), env, 0600); err != nil {
+		return nil, err
+	}
+
+	recorded := &protocol.RestorePointApp{
+		Name:        name,
+		Version:     app.Version,
+		Strategy:    app.Strategy,
+		ComposeHash: protocol.ComposeHash(string(composeYAML), nil),
+		EnvHash:     protocol.EnvHash(app.EnvVars),
+	}
+	if !volumes {
+		return recorded, nil
+	}
+
+	// Volumes that were never created have nothing to copy
+	declared, err := compose.Volumes(string(composeYAML), app.projectName())
+	if err != nil {
+		return nil, err
+	}
+	var existing []string
+	for _, volume := range declared {
+		if exec.Command("docker", "volume", "inspect", volume).Run() == nil && !slices.Contains(existing, volume) {
+			existing = append(existing, volume)
+		}
+	}
+	if len(existing) == 0 {
+		return recorded, nil
+	}
+	slices.Sort(existing)
+
+	// Stopped so that the copies are consistent
+	m.logger.Info(fmt.Sprintf("Stopping application %s to copy its volumes", name))
+	if output, err := app.composeCommand("stop").CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("failed to stop application: %v - %s", err, string(output))
+	}
+	defer func() {
+		if output, err := app.composeCommand("start").CombinedOutput(); err != nil {
+			m.logger.Error(fmt.Sprintf("Failed to start application %s again: %s", name, string(output)), err)
+		}
+	}()
+
+	for _, volume := range existing {
+		snapshot := volume + "-restore-" + id
+		if err := m.docker(time.Minute, "volume", "create", "--label", labelRestorePoint+"="+id, snapshot); err != nil {
+			return nil, err
+		}
+		if err := m.copyVolume(volumeCopyTimeout, volume, snapshot, false); err != nil {
+			return nil, fmt.Errorf("failed to copy volume %s: %w", volume, err)
+		}
+		recorded.Volumes = append(recorded.Volumes, protocol.VolumeSnapshot{Volume: volume, Snapshot: snapshot})
+	}
+	return recorded, nil
+}
+
+// Restore puts applications back as a restore point recorded them, all of
+// them if none are named. Their volume snapshots are copied back and they
+// are deployed again from the recorded compose file and env vars with the
+// recreate strategy, pulling only images that are gone. Applications removed
+// since are deployed again.
+func (m *Manager) Restore(id string, apps []string) ([]string, error) {
+	dir := m.restorePointDir(id)
+	data, err := os.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("restore point %s not found", id)
+		}
+		return nil, err
+	}
+	var manifest protocol.RestorePointManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid restore point manifest: %w", err)
+	}
+
+	targets := manifest.Apps
+	if len(apps) > 0 {
+		targets = nil
+		for _, name := range apps {
+			index := slices.IndexFunc(manifest.Apps, func(app protocol.RestorePointApp) bool { return app.Name == name })
+			if index < 0 {
+				return nil, fmt.Errorf("application %s is not in restore point %s", name, id)
+			}
+			targets = append(targets, manifest.Apps[index])
+		}
+	}
+
+	restored := make([]string, 0, len(targets))
+	for _, app := range targets {
+		if err := m.restoreApp(dir, id, app); err != nil {
+			return restored, fmt.Errorf("failed to restore application %s: %w", app.Name, err)
+		}
+		restored = append(restored, app.Name)
+	}
+
+	m.logger.Info(fmt.Sprintf("Restored %s from restore point %s", strings.Join(restored, ", "), id))
+	return restored, nil
+}
+
+// restoreApp puts back one application of a restore point
+func (m *Manager) restoreApp(dir, id string, recorded protocol.RestorePointApp) error {
+	unlock := m.lockApp(recorded.Name)
+	defer unlock()
+
+	appDir := filepath.Join(dir, recorded.Name)
+	composeYAML, err := os.ReadFile(filepath.Join(appDir, "docker-compose.yml"))
+	if err != nil {
+		return fmt.Errorf("failed to read recorded compose file: %w", err)
+	}
+	var envVars map[string]string
+	data, err := os.ReadFile(filepath.Join(appDir, "env.json"))
+	if err == nil {
+		err = json.Unmarshal(data, &envVars)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read recorded env vars: %w", err)
+	}
+
+	if len(recorded.Volumes) > 0 {
+		if app, exists := m.registered(recorded.Name); exists {
+			m.logger.Info(fmt.Sprintf("Stopping application %s to restore its volumes", recorded.Name))
+			if output, err := app.composeCommand("stop").CombinedOutput(); err != nil {
+				return fmt.Errorf("failed to stop application: %v - %s", err, string(output))
+			}
+		}
+		for _, volume := range recorded.Volumes {
+			if exec.Command("docker", "volume", "inspect", volume.Volume).Run() != nil {
+				if err := m.docker(time.Minute, "volume", "create", volume.Volume); err != nil {
+					return err
+				}
+			}
+			if err := m.copyVolume(volumeCopyTimeout, volume.Snapshot, volume.Volume, true); err != nil {
+				return fmt.Errorf("failed to restore volume %s: %w", volume.Volume, err)
+			}
+		}
+	}
+
+	m.logger.Info(fmt.Sprintf("Restoring application %s version %s from restore point %s", recorded.Name, recorded.Version, id))
+	record := DeploymentRecord{
+		Version:      recorded.Version,
+		ComposeHash:  recorded.ComposeHash,
+		EnvHash:      recorded.EnvHash,
+		Strategy:     protocol.StrategyRecreate,
+		RestorePoint: id,
+		StartedAt:    time.Now(),
+	}
+	err = m.deployApplication(recorded.Name, string(composeYAML), recorded.Version, envVars, nil, nil, false)
+	m.finishDeployment(recorded.Name, &record, err, string(composeYAML), envVars, nil)
+	return err
+}
+
+// DeleteRestorePoint removes the files and volume snapshots of a restore
+// point
+func (m *Manager) DeleteRestorePoint(id string) error {
+	if err := os.RemoveAll(m.restorePointDir(id)); err != nil {
+		return fmt.Errorf("failed to remove restore point files: %w", err)
+	}
+
+	output, err := exec.Command("docker", "volume", "ls", "-q", "--filter", "label="+labelRestorePoint+"="+id).Output()
+	if err != nil {
+		return fmt.Errorf("failed to list volume snapshots: %w", err)
+	}
+	if snapshots := strings.Fields(string(output)); len(snapshots) > 0 {
+		if err := m.docker(time.Minute, append([]string{"volume", "rm"}, snapshots...)...); err != nil {
+			return fmt.Errorf("failed to remove volume snapshots: %w", err)
+		}
+	}
+	return nil
+}
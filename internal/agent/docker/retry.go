@@ -0,0 +1,152 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+const (
+	// pullStateFile holds the progress of an interrupted pull in the
+	// application directory
+	pullStateFile = ".pull-state.json"
+	// pullStateMaxAge is how long the progress of an interrupted pull is
+	// trusted, after that all images are pulled again
+	pullStateMaxAge = 24 * time.Hour
+	// maxRetryDelay caps the backoff between pull attempts
+	maxRetryDelay = 5 * time.Minute
+
+	// DefaultPullRetries is the number of retries of a failed image pull
+	DefaultPullRetries = 5
+	// DefaultPullRetryDelay is the delay before the first retry
+	DefaultPullRetryDelay = 5 * time.Second
+)
+
+// permanentPullErrors are error messages from Docker that retrying will not fix
+var permanentPullErrors = []string{
+	"manifest unknown",
+	"not found",
+	"unauthorized",
+	"denied",
+	"invalid reference format",
+}
+
+// pullRetry retries failed pulls with exponential backoff
+type pullRetry struct {
+	retries int           // Retries after the first attempt, 0 for none
+	delay   time.Duration // Before the first retry, doubled for every following one
+}
+
+// do runs fn until it succeeds, fails permanently or runs out of retries.
+// onRetry is called before waiting for the next attempt.
+func (r pullRetry) do(ctx context.Context, fn func(attempt int) error, onRetry func(err error, delay time.Duration)) error {
+	delay := r.delay
+	for attempt := 1; ; attempt++ {
+		err := fn(attempt)
+		if err == nil || attempt > r.retries || !retryable(ctx, err) {
+			return err
+		}
+
+		onRetry(err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+
+		delay = min(delay*2, maxRetryDelay)
+	}
+}
+
+// retryable tells whether a failed pull may succeed when tried again
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	message := strings.ToLower(err.Error())
+	for _, permanent := range permanentPullErrors {
+		if strings.Contains(message, permanent) {
+			return false
+		}
+	}
+	return true
+}
+
+// imageExists tells whether an image is present in the local image store
+func imageExists(ctx context.Context, client *http.Client, image string) bool {
+	// The host is ignored by the unix socket dialer
+	u := url.URL{Scheme: "http", Host: "docker", Path: "/images/" + image + "/json"}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return false
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// save writes the progress to path, so that an interrupted pull can be resumed
+func (t *pullTracker) save(path string) {
+	data, err := json.Marshal(t.snapshot())
+	if err != nil {
+		return
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return
+	}
+	os.Rename(tmp, path)
+}
+
+// restore loads the progress saved by an earlier attempt to pull the same
+// images of the same version. Images that were not done are pulled again but
+// keep their layer progress. It reports whether progress was restored.
+func (t *pullTracker) restore(path string) bool {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+
+	var saved protocol.PullProgress
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return false
+	}
+	if saved.App != t.progress.App || saved.Version != t.progress.Version ||
+		time.Since(saved.Updated) > pullStateMaxAge || len(saved.Images) != len(t.progress.Images) {
+		return false
+	}
+	for i, image := range saved.Images {
+		if image.Image != t.progress.Images[i].Image {
+			return false
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i, image := range saved.Images {
+		if image.Status != protocol.PullDone {
+			image.Status = protocol.PullWaiting
+		}
+		image.Attempt = 0
+		t.progress.Images[i] = image
+
+		for j, layer := range image.Layers {
+			t.layers[i][layer.ID] = j
+		}
+	}
+	return true
+}
@@ -0,0 +1,168 @@
+package docker
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+// stoppedMarker is left in the directory of an application stopped on
+// purpose, so that Heal leaves it stopped until it is started or deployed
+const stoppedMarker = ".stopped"
+
+// AutonomyHandler receives what the manager did without being asked by the
+// server
+type AutonomyHandler func(event protocol.AutonomyEvent)
+
+// SetAutonomyHandler sets the handler receiving the restarts of Heal and the
+// outcome of staged updates
+func (m *Manager) SetAutonomyHandler(handler AutonomyHandler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.autonomyHandler = handler
+}
+
+// reportAutonomy passes an event to the autonomy handler, if there is one
+func (m *Manager) reportAutonomy(event protocol.AutonomyEvent) {
+	m.mu.RLock()
+	handler := m.autonomyHandler
+	m.mu.RUnlock()
+
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if handler != nil {
+		handler(event)
+	}
+}
+
+// markStopped records whether an application was stopped on purpose
+func markStopped(appDir string, stopped bool) {
+	marker := filepath.Join(appDir, stoppedMarker)
+	if stopped {
+		os.WriteFile(marker, nil, 0644)
+		return
+	}
+	os.Remove(marker)
+}
+
+// isStopped reports whether an application was stopped on purpose
+func isStopped(appDir string) bool {
+	_, err := os.Stat(filepath.Join(appDir, stoppedMarker))
+	return err == nil
+}
+
+// Heal starts containers of applications that exited with an error, restarts
+// those failing their health check and starts applications left without any
+// containers. Applications stopped on purpose or being deployed are left
+// alone, as are containers restarted maxRestarts times in the last hour,
+// unless it is -1. What was done is passed to the autonomy handler.
+func (m *Manager) Heal(maxRestarts int) {
+	for name := range m.GetApplications() {
+		if m.stages(name) != nil {
+			continue
+		}
+		m.healApplication(name, maxRestarts)
+	}
+}
+
+// healApplication heals the containers of one application
+func (m *Manager) healApplication(name string, maxRestarts int) {
+	unlock := m.lockApp(name)
+	defer unlock()
+
+	app, ok := m.registered(name)
+	if !ok || isStopped(app.Path) {
+		return
+	}
+
+	output, err := app.composeCommand("ps", "-a", "-q").CombinedOutput()
+	if err != nil {
+		m.logger.Error(fmt.Sprintf("Failed to list containers of %s: %s", name, string(output)), err)
+		return
+	}
+	ids := strings.Fields(string(output))
+
+	if len(ids) == 0 {
+		m.logger.Warn(fmt.Sprintf("Application %s has no containers, starting it", name))
+		event := protocol.AutonomyEvent{Kind: protocol.AutonomyStarted, App: name, Version: app.Version, Success: true}
+		if output, err := app.composeCommand("up", "-d").CombinedOutput(); err != nil {
+			event.Success, event.Error = false, fmt.Sprintf("%v - %s", err, string(output))
+		}
+		m.reportAutonomy(event)
+		m.refreshContainers(app)
+		return
+	}
+
+	containers, err := inspect[containerState](ids, inspectState)
+	if err != nil {
+		m.logger.Error(fmt.Sprintf("Failed to inspect containers of %s", name), err)
+	}
+
+	healed := false
+	for _, container := range containers {
+		containerName := strings.TrimPrefix(container.Name, "/")
+		state := container.State
+
+		// Containers that exited successfully are one-off jobs
+		var action string
+		switch {
+		case state.Status == "dead", state.Status == "exited" && state.ExitCode != 0:
+			action = "start"
+		case state.Running && state.Health != nil && state.Health.Status == "unhealthy":
+			action = "restart"
+		default:
+			continue
+		}
+		if !m.allowRestart(containerName, maxRestarts) {
+			m.logger.Debug(fmt.Sprintf("Container %s of %s was restarted %d times in the last hour, leaving it", containerName, name, maxRestarts))
+			continue
+		}
+
+		m.logger.Warn(fmt.Sprintf("Container %s of %s is %s, running docker %s", containerName, name, state.Status, action))
+		event := protocol.AutonomyEvent{Kind: protocol.AutonomyRestarted, App: name, Container: containerName, Version: app.Version, Success: true}
+		if output, err := exec.Command("docker", action, container.ID).CombinedOutput(); err != nil {
+			event.Success, event.Error = false, fmt.Sprintf("%v - %s", err, string(output))
+		}
+		m.reportAutonomy(event)
+		healed = true
+	}
+
+	if healed {
+		m.refreshContainers(app)
+	}
+}
+
+// allowRestart records a restart of a container by Heal, unless it was
+// restarted maxRestarts times in the last hour already
+func (m *Manager) allowRestart(container string, maxRestarts int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cutoff := time.Now().Add(-time.Hour)
+	var recent []time.Time
+	for _, at := range m.healed[container] {
+		if at.After(cutoff) {
+			recent = append(recent, at)
+		}
+	}
+	if maxRestarts >= 0 && len(recent) >= maxRestarts {
+		m.healed[container] = recent
+		return false
+	}
+	m.healed[container] = append(recent, time.Now())
+	return true
+}
+
+// refreshContainers records the containers of an application as they are
+// now. The caller must hold the application's lock.
+func (m *Manager) refreshContainers(app *Application) {
+	if containers, err := m.getContainers(app); err == nil {
+		m.setContainers(app, containers)
+	}
+}
@@ -0,0 +1,96 @@
+package docker
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/compose"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+// DeployStageHandler receives the stages of a deployment as it reaches them
+type DeployStageHandler func(stage *protocol.DeployStage)
+
+// stageReporter reports the stages of one deployment
+type stageReporter struct {
+	handler DeployStageHandler
+	stage   protocol.DeployStage
+}
+
+// newStageReporter starts reporting the stages of a deployment, the caller
+// must hold the application's lock and end it with endStages
+func (m *Manager) newStageReporter(name, version string) *stageReporter {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	handler := m.stageHandler
+	if handler == nil {
+		handler = func(*protocol.DeployStage) {}
+	}
+	reporter := &stageReporter{handler: handler, stage: protocol.DeployStage{App: name, Version: version}}
+	m.deploys[name] = reporter
+	return reporter
+}
+
+// stages returns the reporter of the running deployment of an application,
+// nil if it is not being deployed
+func (m *Manager) stages(name string) *stageReporter {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.deploys[name]
+}
+
+// endStages stops reporting the stages of the deployment of an application
+func (m *Manager) endStages(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.deploys, name)
+}
+
+// enter reports that the deployment reached a stage
+func (r *stageReporter) enter(stage string) {
+	if r == nil {
+		return
+	}
+	r.stage.Stage = stage
+	r.report()
+}
+
+// pulled reports the number of images pulled so far
+func (r *stageReporter) pulled(pulled, total int) {
+	if r == nil {
+		return
+	}
+	r.stage.Stage = protocol.StagePulling
+	r.stage.ImagesPulled, r.stage.ImagesTotal = pulled, total
+	r.report()
+}
+
+// fail reports that the deployment failed
+func (r *stageReporter) fail(err error) {
+	if r == nil {
+		return
+	}
+	r.stage.Stage = protocol.StageFailed
+	r.stage.Error = err.Error()
+	r.report()
+}
+
+func (r *stageReporter) report() {
+	r.stage.Updated = time.Now()
+	stage := r.stage
+	r.handler(&stage)
+}
+
+// validateCompose checks that a compose file can be deployed before anything
+// is written or pulled
+func validateCompose(composeYAML string) error {
+	services, err := compose.Dependencies(composeYAML)
+	if err != nil {
+		return fmt.Errorf("invalid compose file: %w", err)
+	}
+	if len(services) == 0 {
+		return fmt.Errorf("invalid compose file: no services")
+	}
+	return nil
+}
@@ -0,0 +1,291 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/compose"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+// Files of the update staged for an application, in its directory
+const (
+	stagedUpdateFile    = ".staged-update.json"
+	stagedComposeLayers = ".staged-update.yml" // The merged compose file while its images are pulled and it is verified
+)
+
+// stagedUpdate is an update waiting for its time on the device. Registry
+// credentials are not kept, the images were pulled when it was staged.
+type stagedUpdate struct {
+	ID      string                 `json:"id"`
+	ApplyAt time.Time              `json:"apply_at"` // Zero to wait for ActivateUpdate
+	Fetched bool                   `json:"fetched"`  // Its images and artifacts are on the device
+	Deploy  protocol.DeployPayload `json:"deploy"`
+}
+
+// StageUpdate keeps an update to deploy at applyAt, or when activated if it is
+// zero, replacing the one staged for the application before, and fetches its
+// images and artifacts in the background. Whether they could be fetched is
+// passed to the autonomy handler.
+func (m *Manager) StageUpdate(id string, deploy protocol.DeployPayload, applyAt time.Time) error {
+	registries := deploy.Registries
+	deploy.Registries = nil
+	update := &stagedUpdate{ID: id, ApplyAt: applyAt, Deploy: deploy}
+
+	unlock := m.lockApp(deploy.Name)
+	err := m.saveStaged(update)
+	unlock()
+	if err != nil {
+		return err
+	}
+
+	if applyAt.IsZero() {
+		m.logger.Info(fmt.Sprintf("Staged version %s of %s until it is activated", deploy.Version, deploy.Name))
+	} else {
+		m.logger.Info(fmt.Sprintf("Staged version %s of %s for %s", deploy.Version, deploy.Name, applyAt.Format(time.RFC3339)))
+	}
+	go m.fetchStaged(update, registries)
+	return nil
+}
+
+// UnstageUpdate drops the update staged for an application if it has the ID,
+// or whichever is staged if the ID is empty
+func (m *Manager) UnstageUpdate(id, name string) error {
+	unlock := m.lockApp(name)
+	defer unlock()
+
+	update, err := m.loadStaged(name)
+	if err != nil || update == nil || (id != "" && update.ID != id) {
+		return err
+	}
+	if err := os.Remove(filepath.Join(m.appDir(name), stagedUpdateFile)); err != nil {
+		return fmt.Errorf("failed to remove staged update: %w", err)
+	}
+	m.logger.Info(fmt.Sprintf("Dropped staged version %s of %s", update.Deploy.Version, name))
+	return nil
+}
+
+// ApplyStagedUpdates deploys the staged updates whose time has come. Images
+// are only pulled if they are gone, so updates fetched when they were staged
+// deploy without the server or the registries. The outcome of each is passed
+// to the autonomy handler.
+func (m *Manager) ApplyStagedUpdates() {
+	m.mu.RLock()
+	composeDir := m.composeDir
+	m.mu.RUnlock()
+
+	entries, err := os.ReadDir(composeDir)
+	if err != nil {
+		m.logger.Error("Failed to read compose directory for staged updates", err)
+		return
+	}
+
+	now := time.Now()
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		name := entry.Name()
+
+		// Taken off before deploying, so that an update failing or killing
+		// the agent is not tried again and again
+		unlock := m.lockApp(name)
+		update, err := m.loadStaged(name)
+		if err == nil && update != nil && !update.ApplyAt.IsZero() && !now.Before(update.ApplyAt) {
+			err = os.Remove(filepath.Join(m.appDir(name), stagedUpdateFile))
+		} else {
+			update = nil
+		}
+		unlock()
+		if err != nil {
+			m.logger.Error(fmt.Sprintf("Failed to take staged update of %s", name), err)
+			continue
+		}
+		if update != nil {
+			m.applyStaged(update)
+		}
+	}
+}
+
+// ActivateUpdate deploys the update staged for an application now, if it has
+// the ID and its images and artifacts were fetched. The outcome is passed to
+// the autonomy handler as well.
+func (m *Manager) ActivateUpdate(id, name string) error {
+	unlock := m.lockApp(name)
+	update, err := m.loadStaged(name)
+	switch {
+	case err != nil:
+	case update == nil || update.ID != id:
+		err = fmt.Errorf("update %s is not staged for %s", id, name)
+	case !update.Fetched:
+		err = fmt.Errorf("staged version %s of %s was not fetched", update.Deploy.Version, name)
+	default:
+		err = os.Remove(filepath.Join(m.appDir(name), stagedUpdateFile))
+	}
+	unlock()
+	if err != nil {
+		return err
+	}
+
+	return m.applyStaged(update)
+}
+
+// applyStaged deploys a staged update taken off the device, without pulling
+// images that are present
+func (m *Manager) applyStaged(update *stagedUpdate) error {
+	deploy := update.Deploy
+	m.logger.Info(fmt.Sprintf("Applying staged version %s of %s", deploy.Version, deploy.Name))
+	event := protocol.AutonomyEvent{Kind: protocol.AutonomyApplied, App: deploy.Name, Version: deploy.Version, UpdateID: update.ID, Success: true}
+	err := m.deploy(deploy.Name, deploy.ComposeConfig, deploy.Version, deploy.EnvVars, nil, deploy.PullRate, deploy.Strategy,
+		deploy.BlueGreen, deploy.Migration, deploy.ComposeOverrides, deploy.Artifacts, deploy.Limits, false)
+	if err != nil {
+		m.logger.Error(fmt.Sprintf("Failed to apply staged version %s of %s", deploy.Version, deploy.Name), err)
+		event.Success, event.Error = false, err.Error()
+	}
+	m.reportAutonomy(event)
+	return err
+}
+
+// fetchStaged fetches the images and artifacts of a staged update
+func (m *Manager) fetchStaged(update *stagedUpdate, registries []protocol.RegistryAuth) {
+	name := update.Deploy.Name
+	event := protocol.AutonomyEvent{Kind: protocol.AutonomyStaged, App: name, Version: update.Deploy.Version, UpdateID: update.ID, Success: true}
+
+	if err := m.prefetch(&update.Deploy, registries); err != nil {
+		m.logger.Error(fmt.Sprintf("Failed to fetch staged version %s of %s", update.Deploy.Version, name), err)
+		event.Success, event.Error = false, err.Error()
+	} else {
+		unlock := m.lockApp(name)
+		if current, err := m.loadStaged(name); err == nil && current != nil && current.ID == update.ID {
+			current.Fetched = true
+			if err := m.saveStaged(current); err != nil {
+				m.logger.Error(fmt.Sprintf("Failed to save staged update of %s", name), err)
+			}
+		}
+		unlock()
+	}
+	m.reportAutonomy(event)
+}
+
+// prefetch pulls the images of a deployment, downloads its artifacts and
+// checks that its compose file is valid with its env vars, without touching
+// the installed version
+func (m *Manager) prefetch(deploy *protocol.DeployPayload, registries []protocol.RegistryAuth) error {
+	name := deploy.Name
+	appDir := m.appDir(name)
+
+	composeYAML := deploy.ComposeConfig
+	if len(deploy.ComposeOverrides) > 0 {
+		unlock := m.lockApp(name)
+		var err error
+		composeYAML, err = m.layerCompose(name, composeYAML, deploy.ComposeOverrides)
+		unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	composeFile := filepath.Join(appDir, stagedComposeLayers)
+	if err := os.WriteFile(composeFile, []byte(composeYAML), 0600); err != nil {
+		return fmt.Errorf("failed to write staged compose file: %w", err)
+	}
+	defer os.Remove(composeFile)
+
+	m.setPullRate(name, deploy.PullRate)
+	defer m.clearPullRate(name)
+
+	err := m.pullRetries().do(m.ctx, func(int) error {
+		return m.composePull(appDir, composeFile, registries)
+	}, func(err error, delay time.Duration) {
+		m.logger.Warn(fmt.Sprintf("Pulling staged images of %s failed, retrying in %s: %v", name, delay, err))
+	})
+	if err != nil {
+		return err
+	}
+	if err := m.checkPlatforms(compose.Images(composeYAML)); err != nil {
+		return err
+	}
+	if err := verifyCompose(appDir, composeFile, deploy.EnvVars); err != nil {
+		return err
+	}
+
+	m.mu.RLock()
+	cache := m.artifacts
+	m.mu.RUnlock()
+	if len(deploy.Artifacts) > 0 {
+		if cache == nil {
+			return fmt.Errorf("artifacts are not enabled on this device")
+		}
+		if _, err := cache.Fetch(m.ctx, deploy.Artifacts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyCompose checks that a compose file is valid and its variables are
+// set once the env vars are written, the way docker-compose interpolates it
+// when the application starts
+func verifyCompose(appDir, composeFile string, envVars map[string]string) error {
+	cmd := exec.Command("docker-compose", "-f", composeFile, "--project-directory", appDir, "config", "-q")
+	cmd.Dir = appDir
+	// Variables of the environment take precedence over the .env file of the
+	// installed version
+	cmd.Env = os.Environ()
+	for key, value := range envVars {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("invalid compose file: %v - %s", err, string(output))
+	}
+	return nil
+}
+
+// loadStaged reads the update staged for an application, nil if there is
+// none. The caller must hold the application's lock.
+func (m *Manager) loadStaged(name string) (*stagedUpdate, error) {
+	data, err := os.ReadFile(filepath.Join(m.appDir(name), stagedUpdateFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read staged update: %w", err)
+	}
+
+	var update stagedUpdate
+	if err := json.Unmarshal(data, &update); err != nil {
+		return nil, fmt.Errorf("failed to parse staged update: %w", err)
+	}
+	return &update, nil
+}
+
+// saveStaged writes the update staged for an application. It holds the env
+// vars of the new version, so only root may read it. The caller must hold
+// the application's lock.
+func (m *Manager) saveStaged(update *stagedUpdate) error {
+	appDir := m.appDir(update.Deploy.Name)
+	if err := os.MkdirAll(appDir, 0755); err != nil {
+		return fmt.Errorf("failed to create application directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(update, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode staged update: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(appDir, stagedUpdateFile), data, 0600); err != nil {
+		return fmt.Errorf("failed to write staged update: %w", err)
+	}
+	return nil
+}
+
+// appDir returns the directory of an application
+func (m *Manager) appDir(name string) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return filepath.Join(m.composeDir, name)
+}
@@ -0,0 +1,207 @@
+package docker
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/compose"
+	"github.com/edgetainer/edgetainer/internal/shared/logging"
+)
+
+// dialTimeout bounds connecting to a container behind a switched port
+const dialTimeout = 5 * time.Second
+
+// resolveFunc returns the addresses of the containers serving a port
+type resolveFunc func() ([]string, error)
+
+// portSwitch serves the published ports of blue/green applications and
+// forwards connections to the containers of their running copy, so that a
+// deployment can switch copies without releasing the ports
+type portSwitch struct {
+	mu     sync.Mutex
+	routes map[string]*route // By listen address
+	logger *logging.Logger
+}
+
+// route forwards the connections of one published port
+type route struct {
+	app      string
+	listener net.Listener
+
+	mu      sync.Mutex
+	resolve resolveFunc
+	targets []string // Cached result of resolve
+	next    int
+}
+
+// newPortSwitch creates a switch without routes
+func newPortSwitch() *portSwitch {
+	return &portSwitch{
+		routes: make(map[string]*route),
+		logger: logging.WithComponent("port-switch"),
+	}
+}
+
+// set points the ports of an application at new targets, listening on ports
+// that are not served yet and closing the ones the application no longer
+// publishes. Open connections are left alone.
+func (s *portSwitch) set(app string, ports []compose.PublishedPort, resolvers []resolveFunc) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	wanted := make(map[string]bool)
+	var created []string
+	for i, port := range ports {
+		addr := net.JoinHostPort(port.HostIP, strconv.Itoa(port.HostPort))
+		wanted[addr] = true
+
+		if r, ok := s.routes[addr]; ok {
+			if r.app != app {
+				s.closeRoutes(created)
+				return fmt.Errorf("port %s is already served for application %s", addr, r.app)
+			}
+			r.setResolve(resolvers[i])
+			continue
+		}
+
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			s.closeRoutes(created)
+			return fmt.Errorf("failed to listen on %s: %w", addr, err)
+		}
+
+		r := &route{app: app, listener: listener, resolve: resolvers[i]}
+		s.routes[addr] = r
+		created = append(created, addr)
+		go s.serve(r)
+	}
+
+	for addr, r := range s.routes {
+		if r.app == app && !wanted[addr] {
+			r.listener.Close()
+			delete(s.routes, addr)
+		}
+	}
+	return nil
+}
+
+// closeApp stops serving the ports of an application
+func (s *portSwitch) closeApp(app string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for addr, r := range s.routes {
+		if r.app == app {
+			r.listener.Close()
+			delete(s.routes, addr)
+		}
+	}
+}
+
+// closeAll stops serving all ports
+func (s *portSwitch) closeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for addr, r := range s.routes {
+		r.listener.Close()
+		delete(s.routes, addr)
+	}
+}
+
+// closeRoutes closes routes by address, the caller must hold the lock
+func (s *portSwitch) closeRoutes(addrs []string) {
+	for _, addr := range addrs {
+		s.routes[addr].listener.Close()
+		delete(s.routes, addr)
+	}
+}
+
+// serve accepts connections until the route is closed
+func (s *portSwitch) serve(r *route) {
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.forward(r, conn)
+	}
+}
+
+// forward copies a connection to a container of the route in both directions
+func (s *portSwitch) forward(r *route, conn net.Conn) {
+	defer conn.Close()
+
+	upstream, err := r.dial()
+	if err != nil {
+		s.logger.Warn(fmt.Sprintf("No container of application %s accepted a connection on %s: %v", r.app, r.listener.Addr(), err))
+		return
+	}
+	defer upstream.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// setResolve switches the route to new targets
+func (r *route) setResolve(resolve resolveFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.resolve = resolve
+	r.targets = nil
+}
+
+// dial connects to the next target. Targets are resolved again once if they
+// fail, since containers get new addresses when they are recreated.
+func (r *route) dial() (net.Conn, error) {
+	var lastErr error
+	for refresh := false; ; refresh = true {
+		target, err := r.pick(refresh)
+		if err != nil {
+			return nil, err
+		}
+
+		conn, err := net.DialTimeout("tcp", target, dialTimeout)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+		if refresh {
+			return nil, lastErr
+		}
+	}
+}
+
+// pick returns the next target in turn, resolving the targets if there are
+// none cached or refresh is set
+func (r *route) pick(refresh bool) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.targets) == 0 || refresh {
+		targets, err := r.resolve()
+		if err != nil {
+			return "", err
+		}
+		if len(targets) == 0 {
+			return "", fmt.Errorf("no running containers")
+		}
+		r.targets = targets
+	}
+
+	r.next = (r.next + 1) % len(r.targets)
+	return r.targets[r.next], nil
+}
@@ -0,0 +1,282 @@
+package docker
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+// Labels docker-compose puts on the containers of a project
+const (
+	labelProject     = "com.docker.compose.project"
+	labelWorkingDir  = "com.docker.compose.project.working_dir"
+	labelConfigFiles = "com.docker.compose.project.config_files"
+)
+
+// inspectedContainer holds the parts of docker inspect output needed to tell
+// workloads apart, as rendered by inspectWorkload
+type inspectedContainer struct {
+	ID           string `json:"Id"`
+	Name         string `json:"Name"`
+	Created      string `json:"Created"`
+	Image        string `json:"Image"` // ID of the image
+	RestartCount int    `json:"RestartCount"`
+	Config       struct {
+		Image  string            `json:"Image"`
+		Labels map[string]string `json:"Labels"`
+	} `json:"Config"`
+	State struct {
+		Status string `json:"Status"`
+		Health *struct {
+			Status string `json:"Status"`
+		} `json:"Health"`
+	} `json:"State"`
+}
+
+// inspectedImage holds the registry digests of an image, as rendered by
+// inspectImage
+type inspectedImage struct {
+	ID          string   `json:"Id"`
+	RepoDigests []string `json:"RepoDigests"`
+}
+
+// inspectContainers inspects every container on the device, running or not
+func inspectContainers() ([]inspectedContainer, error) {
+	output, err := exec.Command("docker", "ps", "-aq", "--no-trunc").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %w", err)
+	}
+	ids := strings.Fields(string(output))
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	return inspect[inspectedContainer](ids, inspectWorkload)
+}
+
+// managedProjects returns the applications by compose project name, the
+// caller must hold mu
+func (m *Manager) managedProjects() map[string]string {
+	projects := make(map[string]string)
+	for _, app := range m.applications {
+		if project := app.project(); project != "" {
+			projects[project] = app.Name
+		} else {
+			projects[strings.ToLower(filepath.Base(app.Path))] = app.Name
+		}
+	}
+	return projects
+}
+
+// ScanWorkloads inspects every container on the device. It returns the
+// containers of the applications the agent deployed, and the compose
+// projects and standalone containers it did not deploy. Projects started
+// from the compose directory count as managed, and the agent's own
+// container, recognized by the hostname Docker gives it, is left out.
+func (m *Manager) ScanWorkloads() ([]protocol.ContainerStatus, []protocol.Workload, error) {
+	containers, err := inspectContainers()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	m.mu.RLock()
+	composeDir := m.composeDir
+	managed := m.managedProjects()
+	m.mu.RUnlock()
+
+	digests := m.repoDigestsOf(containers)
+	self, _ := os.Hostname()
+
+	apps := make([]protocol.ContainerStatus, 0)
+	workloads := make([]protocol.Workload, 0)
+	projects := make(map[string]*protocol.Workload)
+	for _, c := range containers {
+		if len(self) == 12 && strings.HasPrefix(c.ID, self) {
+			continue
+		}
+
+		status := protocol.ContainerStatus{
+			Name:    strings.TrimPrefix(c.Name, "/"),
+			Status:  c.State.Status,
+			Image:   c.Config.Image,
+			Created: c.Created,
+		}
+
+		project := c.Config.Labels[labelProject]
+		workingDir := c.Config.Labels[labelWorkingDir]
+		if app, ok := managed[project]; ok || (project != "" && isWithin(composeDir, workingDir)) {
+			if !ok {
+				app = appOf(composeDir, workingDir)
+			}
+			status.ID = c.ID
+			status.App = app
+			status.Restarts = c.RestartCount
+			status.ImageID = c.Image
+			status.RepoDigest = digests[c.Image]
+			if c.State.Health != nil {
+				status.Health = c.State.Health.Status
+			}
+			apps = append(apps, status)
+			continue
+		}
+
+		if project == "" {
+			workloads = append(workloads, protocol.Workload{
+				Kind:       protocol.WorkloadContainer,
+				Name:       status.Name,
+				Containers: []protocol.ContainerStatus{status},
+			})
+			continue
+		}
+
+		workload, ok := projects[project]
+		if !ok {
+			workload = &protocol.Workload{
+				Kind:       protocol.WorkloadCompose,
+				Name:       project,
+				WorkingDir: workingDir,
+			}
+			if files := c.Config.Labels[labelConfigFiles]; files != "" {
+				workload.ConfigFiles = strings.Split(files, ",")
+			}
+			projects[project] = workload
+		}
+		workload.Containers = append(workload.Containers, status)
+	}
+
+	for _, workload := range projects {
+		workloads = append(workloads, *workload)
+	}
+	sort.Slice(workloads, func(i, j int) bool {
+		if workloads[i].Kind != workloads[j].Kind {
+			return workloads[i].Kind < workloads[j].Kind
+		}
+		return workloads[i].Name < workloads[j].Name
+	})
+	sort.Slice(apps, func(i, j int) bool { return apps[i].Name < apps[j].Name })
+
+	return apps, workloads, nil
+}
+
+// appOf returns the application of a compose project started from a
+// directory below the compose directory
+func appOf(composeDir, workingDir string) string {
+	rel, err := filepath.Rel(composeDir, workingDir)
+	if err != nil || rel == "." {
+		return ""
+	}
+	return strings.Split(filepath.ToSlash(rel), "/")[0]
+}
+
+// repoDigestsOf returns the registry digests of the images of containers by
+// image ID, inspecting only the images it has not seen before
+func (m *Manager) repoDigestsOf(containers []inspectedContainer) map[string]string {
+	var unknown []string
+	m.mu.Lock()
+	for _, c := range containers {
+		if _, ok := m.repoDigests[c.Image]; !ok && c.Image != "" && !slices.Contains(unknown, c.Image) {
+			unknown = append(unknown, c.Image)
+		}
+	}
+	m.mu.Unlock()
+
+	// Images removed meanwhile are left out and looked up again next time
+	images, err := inspect[inspectedImage](unknown, inspectImage)
+	if err != nil {
+		m.logger.Debug(fmt.Sprintf("Failed to inspect images: %v", err))
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, image := range images {
+		digest := ""
+		if len(image.RepoDigests) > 0 {
+			digest = image.RepoDigests[0]
+		}
+		m.repoDigests[image.ID] = digest
+	}
+
+	// Only the images in use are remembered
+	digests := make(map[string]string, len(containers))
+	for _, c := range containers {
+		if digest, ok := m.repoDigests[c.Image]; ok {
+			digests[c.Image] = digest
+		}
+	}
+	m.repoDigests = digests
+	return maps.Clone(digests)
+}
+
+// isWithin reports whether path is dir or below it
+func isWithin(dir, path string) bool {
+	if path == "" {
+		return false
+	}
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// AdoptApplication takes over a compose project that was started on the
+// device by hand. The project's configuration is resolved with docker-compose
+// config, so relative paths and env vars keep their meaning, and saved as a
+// new application named after the project. Its containers keep running.
+func (m *Manager) AdoptApplication(project, workingDir string, configFiles []string) error {
+	unlock := m.lockApp(project)
+	defer unlock()
+
+	if _, exists := m.registered(project); exists {
+		return fmt.Errorf("application %s already exists", project)
+	}
+	if len(configFiles) == 0 {
+		return fmt.Errorf("compose files of project %s are not known", project)
+	}
+
+	args := []string{"-p", project}
+	for _, file := range configFiles {
+		args = append(args, "-f", file)
+	}
+	cmd := exec.Command("docker-compose", append(args, "config")...)
+	cmd.Dir = workingDir
+	resolved, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return fmt.Errorf("failed to read compose files of project %s: %v - %s", project, err, string(exitErr.Stderr))
+		}
+		return fmt.Errorf("failed to read compose files of project %s: %w", project, err)
+	}
+
+	appDir := filepath.Join(m.composeDir, project)
+	if err := os.Mkdir(appDir, 0755); err != nil {
+		return fmt.Errorf("failed to create application directory: %w", err)
+	}
+
+	app := &Application{
+		Name:     project,
+		Path:     appDir,
+		EnvVars:  map[string]string{},
+		Version:  "unknown",
+		Strategy: protocol.StrategyRecreate,
+	}
+	if err := os.WriteFile(app.composeFile(), resolved, 0644); err != nil {
+		os.RemoveAll(appDir)
+		return fmt.Errorf("failed to write docker-compose.yml: %w", err)
+	}
+
+	containers, err := m.getContainers(app)
+	if err != nil {
+		m.logger.Error(fmt.Sprintf("Failed to get containers for application %s: %v", project, err), err)
+		containers = []Container{}
+	}
+	app.Containers = containers
+	m.register(app)
+
+	m.logger.Info(fmt.Sprintf("Adopted compose project %s from %s with %d containers", project, workingDir, len(containers)))
+	return nil
+}
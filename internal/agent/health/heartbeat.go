@@ -0,0 +1,186 @@
+package health
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/agent/docker"
+	"github.com/edgetainer/edgetainer/internal/agent/location"
+	"github.com/edgetainer/edgetainer/internal/agent/plugins"
+	"github.com/edgetainer/edgetainer/internal/agent/ssh"
+	"github.com/edgetainer/edgetainer/internal/agent/system"
+	"github.com/edgetainer/edgetainer/internal/shared/config"
+	"github.com/edgetainer/edgetainer/internal/shared/logging"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+// clockSkewWarning is the skew above which the agent warns about its clock.
+// Token and certificate validation usually tolerate less than a minute.
+const clockSkewWarning = 30 * time.Second
+
+// usbPollInterval is how often USB devices are checked between heartbeats,
+// so that one is sent as soon as a device is plugged in or out
+const usbPollInterval = 5 * time.Second
+
+// Heartbeater checks the device clock against the server and reports the
+// device status through the tunnel at a fixed interval
+type Heartbeater struct {
+	sshClient  *ssh.Client
+	dockerMgr  *docker.Manager
+	sysMonitor *system.Monitor
+	tracker    *location.Tracker          // Nil without a location source
+	plugins    *plugins.Manager           // Nil until SetPlugins
+	config     func() *config.AgentConfig // Lists the host services, nil until SetHostServices
+	logger     *logging.Logger
+
+	mu       sync.Mutex
+	interval time.Duration
+
+	usb []byte // USB devices of the last heartbeat, only used by Run
+}
+
+// NewHeartbeater creates a heartbeater sending at the given interval. The
+// tracker may be nil if the device has no location source.
+func NewHeartbeater(sshClient *ssh.Client, dockerMgr *docker.Manager, sysMonitor *system.Monitor, tracker *location.Tracker, interval time.Duration) *Heartbeater {
+	return &Heartbeater{
+		sshClient:  sshClient,
+		dockerMgr:  dockerMgr,
+		sysMonitor: sysMonitor,
+		tracker:    tracker,
+		interval:   interval,
+		logger:     logging.WithComponent("heartbeat"),
+	}
+}
+
+// SetInterval changes the interval between heartbeats, taking effect after
+// the next one
+func (h *Heartbeater) SetInterval(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.interval = interval
+}
+
+// SetPlugins sets the plugins whose metrics are reported with heartbeats
+func (h *Heartbeater) SetPlugins(manager *plugins.Manager) {
+	h.plugins = manager
+}
+
+// SetHostServices sets the configuration listing the host services reported
+// with heartbeats
+func (h *Heartbeater) SetHostServices(cfg func() *config.AgentConfig) {
+	h.config = cfg
+}
+
+// Run sends heartbeats until the context is canceled
+func (h *Heartbeater) Run(ctx context.Context) {
+	h.mu.Lock()
+	interval := h.interval
+	h.mu.Unlock()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	usbTicker := time.NewTicker(usbPollInterval)
+	defer usbTicker.Stop()
+
+	for {
+		select {
+		case <-usbTicker.C:
+			// Hotplugged devices are reported right away
+			if usb, err := system.ScanUSB(); err == nil && h.usb != nil && !bytes.Equal(usbFingerprint(usb), h.usb) {
+				h.beat()
+			}
+
+		case <-ticker.C:
+			h.beat()
+
+			h.mu.Lock()
+			if h.interval != interval {
+				// The interval was changed by a config reload
+				interval = h.interval
+				ticker.Reset(interval)
+			}
+			h.mu.Unlock()
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// beat checks the clock and sends one heartbeat
+func (h *Heartbeater) beat() {
+	if !h.sshClient.IsConnected() {
+		return
+	}
+
+	clock, err := h.sshClient.CheckClock()
+	switch {
+	case err != nil:
+		h.logger.Debug(fmt.Sprintf("Failed to check clock: %v", err))
+	case math.Abs(clock.Skew) > clockSkewWarning.Seconds():
+		h.logger.Warn(fmt.Sprintf("Device clock is %.1fs off the server clock, check NTP", clock.Skew))
+	}
+
+	var metrics map[string]interface{}
+	if data, err := json.Marshal(h.sysMonitor.GetMetrics()); err == nil {
+		json.Unmarshal(data, &metrics)
+	}
+
+	var fix *protocol.GeoLocation
+	if h.tracker != nil {
+		fix = h.tracker.Location()
+	}
+
+	// Containers of the applications and workloads started outside the
+	// agent, left out if the scan fails so the server keeps what it knows
+	containers, unmanaged, err := h.dockerMgr.ScanWorkloads()
+	if err != nil {
+		h.logger.Debug(fmt.Sprintf("Failed to scan containers: %v", err))
+	}
+
+	var (
+		installed     []protocol.PluginInfo
+		pluginMetrics map[string]map[string]float64
+	)
+	if h.plugins != nil {
+		installed, pluginMetrics = h.plugins.Report(context.Background())
+	}
+
+	// Left out if the scan fails, e.g. without sysfs
+	usb, err := system.ScanUSB()
+	if err != nil {
+		h.logger.Debug(fmt.Sprintf("Failed to scan USB devices: %v", err))
+	}
+
+	var services []protocol.HostService
+	if h.config != nil {
+		cfg := h.config().HostServices
+		if len(cfg.Units) > 0 || len(cfg.Processes) > 0 {
+			services = h.sysMonitor.HostServices(cfg.Units, cfg.Processes, cfg.AllowRestart)
+		}
+	}
+
+	if err := h.sshClient.SendHeartbeat(protocol.StatusOK, metrics, containers, fix, unmanaged, installed, pluginMetrics, usb, services); err != nil {
+		h.logger.Debug(fmt.Sprintf("Failed to send heartbeat: %v", err))
+		return
+	}
+	if usb != nil {
+		h.usb = usbFingerprint(usb)
+	}
+}
+
+// usbFingerprint returns what a list of USB devices is compared by
+func usbFingerprint(usb []protocol.USBDevice) []byte {
+	data, _ := json.Marshal(usb)
+	return data
+}
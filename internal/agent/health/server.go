@@ -0,0 +1,213 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/agent/docker"
+	"github.com/edgetainer/edgetainer/internal/agent/ssh"
+	"github.com/edgetainer/edgetainer/internal/agent/system"
+	"github.com/edgetainer/edgetainer/internal/shared/logging"
+)
+
+// Status is the document served by the health endpoint
+type Status struct {
+	DeviceID   string                `json:"device_id"`
+	Healthy    bool                  `json:"healthy"`
+	Timestamp  time.Time             `json:"timestamp"`
+	Uptime     string                `json:"uptime"`
+	Tunnel     ssh.TunnelStatus      `json:"tunnel"`
+	Apps       []AppStatus           `json:"apps"`
+	LastDeploy *docker.DeployResult  `json:"last_deploy,omitempty"`
+	Metrics    *system.SystemMetrics `json:"metrics,omitempty"`
+}
+
+// AppStatus summarizes an application running on the device
+type AppStatus struct {
+	Name       string `json:"name"`
+	Version    string `json:"version"`
+	Containers int    `json:"containers"`
+	Running    int    `json:"running"`
+}
+
+// Server exposes a read-only local HTTP health endpoint for site operators
+type Server struct {
+	addr       string
+	deviceID   string
+	started    time.Time
+	sshClient  *ssh.Client
+	dockerMgr  *docker.Manager
+	sysMonitor *system.Monitor
+	httpServer *http.Server
+	logger     *logging.Logger
+}
+
+// NewServer creates a new health server listening on addr
+func NewServer(addr, deviceID string, sshClient *ssh.Client, dockerMgr *docker.Manager, sysMonitor *system.Monitor) *Server {
+	return &Server{
+		addr:       addr,
+		deviceID:   deviceID,
+		started:    time.Now(),
+		sshClient:  sshClient,
+		dockerMgr:  dockerMgr,
+		sysMonitor: sysMonitor,
+		logger:     logging.WithComponent("health-server"),
+	}
+}
+
+// Start starts serving the health endpoint
+func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.addr, err)
+	}
+
+	router := http.NewServeMux()
+	router.HandleFunc("/health", s.handleHealth)
+	router.HandleFunc("/health/tunnel", s.handleTunnel)
+	router.HandleFunc("/health/apps", s.handleApps)
+	router.HandleFunc("/health/metrics", s.handleMetrics)
+
+	s.httpServer = &http.Server{
+		Handler:      router,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+
+	s.logger.Info(fmt.Sprintf("Health endpoint listening on %s", s.addr))
+
+	go func() {
+		if err := s.httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			s.logger.Error("Health server error", err)
+		}
+	}()
+
+	return nil
+}
+
+// Shutdown stops the health server
+func (s *Server) Shutdown() {
+	if s.httpServer == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := s.httpServer.Shutdown(ctx); err != nil {
+		s.logger.Error("Health server shutdown error", err)
+	}
+}
+
+// Collect builds the current status document
+func (s *Server) Collect() *Status {
+	status := &Status{
+		DeviceID:   s.deviceID,
+		Timestamp:  time.Now(),
+		Uptime:     time.Since(s.started).Round(time.Second).String(),
+		Tunnel:     s.sshClient.Status(),
+		Apps:       s.collectApps(),
+		LastDeploy: s.dockerMgr.LastDeployResult(),
+		Metrics:    s.sysMonitor.GetMetrics(),
+	}
+
+	// The device is healthy when its tunnel is up and every app container is running
+	status.Healthy = status.Tunnel.Connected
+	for _, app := range status.Apps {
+		if app.Running < app.Containers {
+			status.Healthy = false
+		}
+	}
+
+	return status
+}
+
+// collectApps summarizes the applications known to the Docker manager
+func (s *Server) collectApps() []AppStatus {
+	apps := s.dockerMgr.GetApplications()
+
+	result := make([]AppStatus, 0, len(apps))
+	for _, app := range apps {
+		appStatus := AppStatus{
+			Name:       app.Name,
+			Version:    app.Version,
+			Containers: len(app.Containers),
+		}
+		for _, container := range app.Containers {
+			if container.State == docker.ContainerRunning {
+				appStatus.Running++
+			}
+		}
+		result = append(result, appStatus)
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// handleHealth serves the full status document
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status := s.Collect()
+
+	code := http.StatusOK
+	if !status.Healthy {
+		code = http.StatusServiceUnavailable
+	}
+
+	jsonResponse(w, status, code)
+}
+
+// handleTunnel serves the tunnel status
+func (s *Server) handleTunnel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	jsonResponse(w, s.sshClient.Status(), http.StatusOK)
+}
+
+// handleApps serves the application summaries and the last deploy result
+func (s *Server) handleApps(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	response := map[string]interface{}{
+		"apps":        s.collectApps(),
+		"last_deploy": s.dockerMgr.LastDeployResult(),
+	}
+
+	jsonResponse(w, response, http.StatusOK)
+}
+
+// handleMetrics serves the latest system metrics
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	jsonResponse(w, s.sysMonitor.GetMetrics(), http.StatusOK)
+}
+
+// jsonResponse sends a JSON response
+func jsonResponse(w http.ResponseWriter, data interface{}, statusCode int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
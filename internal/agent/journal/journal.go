@@ -0,0 +1,328 @@
+// Package journal ships the journald entries of selected units of the host
+// to the server, where they join the device logs. It follows the journal
+// with journalctl and keeps its position in a cursor file, so that entries
+// written while the agent was stopped or offline are shipped later. See
+// docs/journal.md.
+package journal
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/edgetainer/edgetainer/internal/shared/config"
+	"github.com/edgetainer/edgetainer/internal/shared/logging"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+const (
+	// flushInterval is how often entries are shipped and the configured
+	// units checked for changes
+	flushInterval = 5 * time.Second
+	// maxPending is the most entries kept while the server cannot be
+	// reached, the oldest are dropped beyond it
+	maxPending = 5000
+	// retryDelay is how long journalctl is left alone after it exited
+	retryDelay = 30 * time.Second
+)
+
+// SendFunc ships a batch of journal entries to the server
+type SendFunc func(entries []protocol.JournalEntry) error
+
+// record is a journal entry read from journalctl along with its position
+type record struct {
+	entry  protocol.JournalEntry
+	cursor string
+	skip   bool // Below the configured priority, only the cursor counts
+}
+
+// exit is how a run of journalctl ended
+type exit struct {
+	read bool // Whether it read any entry
+	err  error
+}
+
+// Shipper follows the journal and ships the entries of the configured units
+type Shipper struct {
+	config func() *config.AgentConfig
+	send   SendFunc
+	logger *logging.Logger
+
+	// Only used by Run
+	pending []protocol.JournalEntry
+	cursor  string // Of the last entry read
+	saved   string // Last cursor written to the cursor file
+	dropped int    // Entries dropped since the last warning
+}
+
+// NewShipper creates a shipper reading the agent configuration in effect
+// through cfg
+func NewShipper(cfg func() *config.AgentConfig, send SendFunc) *Shipper {
+	return &Shipper{
+		config: cfg,
+		send:   send,
+		logger: logging.WithComponent("journal"),
+	}
+}
+
+// Run follows the journal until ctx is done, starting over when the
+// configured units or priority change
+func (s *Shipper) Run(ctx context.Context) {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	var (
+		following []string // Units journalctl follows
+		priority  string
+		stop      = func() {}
+		records   <-chan record
+		exited    <-chan exit
+		retryAt   time.Time
+	)
+	defer func() { stop() }()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case rec, ok := <-records:
+			if !ok {
+				records = nil
+				continue
+			}
+			s.cursor = rec.cursor
+			if !rec.skip {
+				s.add(rec.entry)
+			}
+
+		case result := <-exited:
+			if result.err != nil && ctx.Err() == nil {
+				s.logger.Warn(fmt.Sprintf("journalctl stopped, retrying in %s: %v", retryDelay, result.err))
+				if !result.read && s.saved != "" {
+					// A cursor journalctl cannot seek to would keep it failing
+					os.Remove(s.config().Journal.Cursor)
+					s.saved = ""
+				}
+			}
+			exited, following, retryAt = nil, nil, time.Now().Add(retryDelay)
+
+		case now := <-ticker.C:
+			s.flush()
+
+			cfg := s.config()
+			if slices.Equal(cfg.Journal.Units, following) && cfg.Journal.Priority == priority && exited != nil {
+				continue
+			}
+			if now.Before(retryAt) {
+				continue
+			}
+			// Entries of a previous run still waiting are dropped, the cursor
+			// makes the next run read them again
+			stop()
+			following, priority, records, exited = nil, cfg.Journal.Priority, nil, nil
+			if len(cfg.Journal.Units) == 0 {
+				continue
+			}
+
+			maxPriority, err := protocol.ParsePriority(cfg.Journal.Priority)
+			if err != nil {
+				s.logger.Warn(fmt.Sprintf("%v, shipping info and more severe", err))
+				maxPriority = 6
+			}
+			if s.pending == nil {
+				// Start after what was shipped
+				data, _ := os.ReadFile(cfg.Journal.Cursor)
+				s.cursor = strings.TrimSpace(string(data))
+				s.saved = s.cursor
+			}
+			runCtx, cancel := context.WithCancel(ctx)
+			out := make(chan record, protocol.MaxJournalBatch)
+			done := make(chan exit, 1)
+			go func() {
+				done <- s.follow(runCtx, cfg, s.cursor, maxPriority, out)
+				close(out)
+			}()
+			stop, records, exited = cancel, out, done
+			following = slices.Clone(cfg.Journal.Units)
+			s.logger.Info(fmt.Sprintf("Shipping journal of %s", strings.Join(following, ", ")))
+		}
+	}
+}
+
+// add queues an entry to be shipped, dropping the oldest beyond maxPending
+func (s *Shipper) add(entry protocol.JournalEntry) {
+	if len(s.pending) == maxPending {
+		s.pending = s.pending[1:]
+		s.dropped++
+	}
+	s.pending = append(s.pending, entry)
+}
+
+// flush ships the queued entries in batches and records how far the journal
+// was shipped. Entries are kept for the next flush if the server cannot be
+// reached.
+func (s *Shipper) flush() {
+	if s.dropped > 0 {
+		s.logger.Warn(fmt.Sprintf("Dropped %d journal entries the server could not take", s.dropped))
+		s.dropped = 0
+	}
+
+	for len(s.pending) > 0 {
+		n, size := 0, 0
+		for n < len(s.pending) && n < protocol.MaxJournalBatch {
+			size += len(s.pending[n].Message)
+			if n > 0 && size > protocol.MaxLogChunk {
+				break
+			}
+			n++
+		}
+		if err := s.send(s.pending[:n]); err != nil {
+			s.logger.Debug(fmt.Sprintf("Failed to ship %d journal entries: %v", len(s.pending), err))
+			return
+		}
+		s.pending = s.pending[n:]
+	}
+	s.pending = nil
+
+	if s.cursor != "" && s.cursor != s.saved {
+		if err := os.WriteFile(s.config().Journal.Cursor, []byte(s.cursor), 0600); err != nil {
+			s.logger.Warn(fmt.Sprintf("Failed to save journal cursor: %v", err))
+			return
+		}
+		s.saved = s.cursor
+	}
+}
+
+// follow runs journalctl on the configured units, after the cursor or from
+// now on without one, until it exits or ctx is done
+func (s *Shipper) follow(ctx context.Context, cfg *config.AgentConfig, cursor string, maxPriority int, out chan<- record) exit {
+	args := []string{"--follow", "--output=json", "--no-pager"}
+	if root := cfg.System.HostRoot; root != "" && root != "/" {
+		args = append(args, "--root="+root)
+	}
+	if cursor != "" {
+		args = append(args, "--after-cursor="+cursor)
+	} else {
+		args = append(args, "--lines=0")
+	}
+	args = append(args, matches(cfg.Journal.Units)...)
+
+	cmd := exec.CommandContext(ctx, "journalctl", args...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return exit{err: err}
+	}
+	if err := cmd.Start(); err != nil {
+		return exit{err: err}
+	}
+
+	read := false
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		rec, err := parse(scanner.Bytes())
+		if err != nil {
+			continue
+		}
+		rec.skip = rec.entry.Priority > maxPriority
+		read = true
+		select {
+		case out <- rec:
+		case <-ctx.Done():
+		}
+	}
+
+	err = cmd.Wait()
+	if ctx.Err() != nil {
+		return exit{read: read}
+	}
+	if err == nil {
+		err = errors.New("exited")
+	}
+	if message := strings.TrimSpace(stderr.String()); message != "" {
+		err = fmt.Errorf("%w - %s", err, message)
+	}
+	return exit{read: read, err: err}
+}
+
+// matches returns the journalctl matches selecting the entries of units,
+// what the units log themselves and what systemd logs about them, like
+// journalctl -u. kernel selects kernel messages. Units without a type are
+// services.
+func matches(units []string) []string {
+	var args []string
+	for _, unit := range units {
+		if len(args) > 0 {
+			args = append(args, "+")
+		}
+		if unit == protocol.JournalKernel {
+			args = append(args, "_TRANSPORT=kernel")
+			continue
+		}
+		if !strings.Contains(unit, ".") {
+			unit += ".service"
+		}
+		args = append(args, "_SYSTEMD_UNIT="+unit, "+", "UNIT="+unit, "_PID=1")
+	}
+	return args
+}
+
+// journalRecord is the part of a journalctl JSON entry the shipper reads
+type journalRecord struct {
+	Cursor    string          `json:"__CURSOR"`
+	Realtime  string          `json:"__REALTIME_TIMESTAMP"` // Microseconds since the epoch
+	Priority  string          `json:"PRIORITY"`
+	Message   json.RawMessage `json:"MESSAGE"` // A string, or an array of bytes if it is not UTF-8
+	Unit      string          `json:"_SYSTEMD_UNIT"`
+	About     string          `json:"UNIT"` // Unit systemd logs about
+	Transport string          `json:"_TRANSPORT"`
+}
+
+// parse reads a line of journalctl JSON output
+func parse(line []byte) (record, error) {
+	var raw journalRecord
+	if err := json.Unmarshal(line, &raw); err != nil {
+		return record{}, err
+	}
+
+	entry := protocol.JournalEntry{Unit: raw.Unit, Priority: 6}
+	switch {
+	case raw.Transport == "kernel":
+		entry.Unit = protocol.JournalKernel
+	case raw.About != "":
+		entry.Unit = raw.About
+	}
+	if priority, err := strconv.Atoi(raw.Priority); err == nil {
+		entry.Priority = priority
+	}
+	if usec, err := strconv.ParseInt(raw.Realtime, 10, 64); err == nil {
+		entry.Time = time.UnixMicro(usec).UTC()
+	}
+
+	var message []byte
+	if err := json.Unmarshal(raw.Message, &entry.Message); err != nil {
+		if json.Unmarshal(raw.Message, &message) == nil {
+			entry.Message = strings.ToValidUTF8(string(message), "�")
+		}
+	}
+	if len(entry.Message) > protocol.MaxJournalMessage {
+		cut := protocol.MaxJournalMessage
+		for cut > 0 && !utf8.RuneStart(entry.Message[cut]) {
+			cut--
+		}
+		entry.Message = entry.Message[:cut]
+	}
+	return record{entry: entry, cursor: raw.Cursor}, nil
+}
@@ -0,0 +1,99 @@
+package location
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+// gpsdWatch asks gpsd to stream reports as JSON
+const gpsdWatch = `?WATCH={"enable":true,"json":true};` + "\n"
+
+// GPSD reads position fixes from a gpsd daemon
+type GPSD struct {
+	Address string // host:port of gpsd, usually localhost:2947
+}
+
+// gpsdReport is the part of a gpsd report the agent uses. TPV reports carry
+// the position; mode 2 is a 2D fix and mode 3 a 3D fix.
+type gpsdReport struct {
+	Class  string   `json:"class"`
+	Mode   int      `json:"mode"`
+	Time   string   `json:"time"`
+	Lat    *float64 `json:"lat"`
+	Lon    *float64 `json:"lon"`
+	AltMSL *float64 `json:"altMSL"`
+	Alt    *float64 `json:"alt"` // Older gpsd releases only
+	Eph    float64  `json:"eph"`
+	Epx    float64  `json:"epx"`
+	Epy    float64  `json:"epy"`
+}
+
+func (g *GPSD) String() string {
+	return "gpsd at " + g.Address
+}
+
+// Read streams fixes from gpsd until the context is canceled or the
+// connection fails
+func (g *GPSD) Read(ctx context.Context, fix func(protocol.GeoLocation)) error {
+	dialer := net.Dialer{Timeout: 10 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", g.Address)
+	if err != nil {
+		return fmt.Errorf("failed to connect to gpsd: %w", err)
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	if _, err := conn.Write([]byte(gpsdWatch)); err != nil {
+		return fmt.Errorf("failed to start gpsd watch: %w", err)
+	}
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var report gpsdReport
+		if err := json.Unmarshal(scanner.Bytes(), &report); err != nil {
+			continue
+		}
+		if report.Class != "TPV" || report.Mode < 2 || report.Lat == nil || report.Lon == nil {
+			continue
+		}
+
+		location := protocol.GeoLocation{
+			Latitude:  *report.Lat,
+			Longitude: *report.Lon,
+			Accuracy:  report.Eph,
+		}
+		if location.Accuracy == 0 {
+			location.Accuracy = max(report.Epx, report.Epy)
+		}
+		if report.Mode == 3 {
+			if report.AltMSL != nil {
+				location.Altitude = report.AltMSL
+			} else {
+				location.Altitude = report.Alt
+			}
+		}
+		if t, err := time.Parse(time.RFC3339Nano, report.Time); err == nil {
+			location.Time = t
+		}
+		fix(location)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read from gpsd: %w", err)
+	}
+	return fmt.Errorf("gpsd closed the connection")
+}
@@ -0,0 +1,108 @@
+// Package location reads the position of the device from a GPS receiver so
+// the agent can report it with its heartbeats
+package location
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/logging"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+// retryDelay is how long the tracker waits before reopening a failed source
+const retryDelay = 30 * time.Second
+
+// Source reads position fixes, passing each to fix, until the context is
+// canceled or reading fails
+type Source interface {
+	Read(ctx context.Context, fix func(protocol.GeoLocation)) error
+	String() string
+}
+
+// NewSource creates the source named in the agent configuration: gpsd
+// connects to gpsd at address, nmea reads NMEA sentences from a serial device
+func NewSource(name, address, device string, baud int) (Source, error) {
+	switch name {
+	case "gpsd":
+		return &GPSD{Address: address}, nil
+	case "nmea":
+		if device == "" {
+			return nil, fmt.Errorf("location.device is required for the nmea source")
+		}
+		return &NMEA{Device: device, Baud: baud}, nil
+	default:
+		return nil, fmt.Errorf("unknown location source: %s", name)
+	}
+}
+
+// Tracker keeps the last position fix read from a source
+type Tracker struct {
+	source Source
+	logger *logging.Logger
+
+	mu  sync.Mutex
+	fix *protocol.GeoLocation
+}
+
+// NewTracker creates a tracker reading from source
+func NewTracker(source Source) *Tracker {
+	return &Tracker{
+		source: source,
+		logger: logging.WithComponent("location"),
+	}
+}
+
+// Run reads fixes until the context is canceled, reopening the source when
+// it fails
+func (t *Tracker) Run(ctx context.Context) {
+	t.logger.Info(fmt.Sprintf("Reading location from %s", t.source))
+
+	for {
+		err := t.source.Read(ctx, t.record)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			t.logger.Warn(fmt.Sprintf("Failed to read location from %s, retrying in %s: %v", t.source, retryDelay, err))
+		}
+
+		select {
+		case <-time.After(retryDelay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Location returns the last position fix, or nil if there was none yet
+func (t *Tracker) Location() *protocol.GeoLocation {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.fix == nil {
+		return nil
+	}
+	fix := *t.fix
+	return &fix
+}
+
+// record stores a fix read from the source
+func (t *Tracker) record(fix protocol.GeoLocation) {
+	if protocol.ValidateCoordinates(fix.Latitude, fix.Longitude) != nil {
+		return
+	}
+	if fix.Time.IsZero() {
+		fix.Time = time.Now()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.fix == nil {
+		t.logger.Info(fmt.Sprintf("Got first position fix %.5f,%.5f", fix.Latitude, fix.Longitude))
+	}
+	t.fix = &fix
+}
@@ -0,0 +1,157 @@
+package location
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+// NMEA reads position fixes from NMEA 0183 sentences on a serial device
+type NMEA struct {
+	Device string // Serial device, e.g. /dev/ttyUSB0
+	Baud   int    // Set with stty before reading, 0 leaves the device as configured
+}
+
+func (n *NMEA) String() string {
+	return "NMEA device " + n.Device
+}
+
+// Read parses GGA and RMC sentences until the context is canceled or the
+// device fails
+func (n *NMEA) Read(ctx context.Context, fix func(protocol.GeoLocation)) error {
+	if n.Baud > 0 {
+		if output, err := exec.CommandContext(ctx, "stty", "-F", n.Device, strconv.Itoa(n.Baud), "raw", "-echo").CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to set baud rate of %s: %v - %s", n.Device, err, strings.TrimSpace(string(output)))
+		}
+	}
+
+	file, err := os.Open(n.Device)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", n.Device, err)
+	}
+	defer file.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			file.Close()
+		case <-done:
+		}
+	}()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if location, ok := parseNMEA(scanner.Text()); ok {
+			fix(location)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read %s: %w", n.Device, err)
+	}
+	return fmt.Errorf("%s was closed", n.Device)
+}
+
+// parseNMEA parses a GGA or RMC sentence from any talker (GP, GN, GL, ...).
+// Sentences without a valid fix or with a bad checksum are skipped.
+func parseNMEA(line string) (protocol.GeoLocation, bool) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "$") {
+		return protocol.GeoLocation{}, false
+	}
+
+	body := line[1:]
+	if i := strings.LastIndexByte(body, '*'); i >= 0 {
+		expected, err := strconv.ParseUint(body[i+1:], 16, 8)
+		if err != nil {
+			return protocol.GeoLocation{}, false
+		}
+		var sum byte
+		for j := 0; j < i; j++ {
+			sum ^= body[j]
+		}
+		if uint64(sum) != expected {
+			return protocol.GeoLocation{}, false
+		}
+		body = body[:i]
+	}
+
+	fields := strings.Split(body, ",")
+	if len(fields[0]) != 5 {
+		return protocol.GeoLocation{}, false
+	}
+
+	var location protocol.GeoLocation
+	var ok bool
+	switch fields[0][2:] {
+	case "GGA":
+		// time, lat, N/S, lon, E/W, quality, satellites, HDOP, altitude, M, ...
+		if len(fields) < 10 || fields[6] == "" || fields[6] == "0" {
+			return location, false
+		}
+		location, ok = nmeaCoordinates(fields[2], fields[3], fields[4], fields[5])
+		if altitude, err := strconv.ParseFloat(fields[9], 64); err == nil && ok {
+			location.Altitude = &altitude
+		}
+	case "RMC":
+		// time, status, lat, N/S, lon, E/W, ...
+		if len(fields) < 7 || fields[2] != "A" {
+			return location, false
+		}
+		location, ok = nmeaCoordinates(fields[3], fields[4], fields[5], fields[6])
+	}
+	return location, ok
+}
+
+// nmeaCoordinates converts NMEA ddmm.mmmm and dddmm.mmmm coordinates with
+// their hemispheres to decimal degrees
+func nmeaCoordinates(lat, ns, lon, ew string) (protocol.GeoLocation, bool) {
+	latitude, ok := nmeaDegrees(lat, 2)
+	if !ok {
+		return protocol.GeoLocation{}, false
+	}
+	longitude, ok := nmeaDegrees(lon, 3)
+	if !ok {
+		return protocol.GeoLocation{}, false
+	}
+
+	switch ns {
+	case "N":
+	case "S":
+		latitude = -latitude
+	default:
+		return protocol.GeoLocation{}, false
+	}
+	switch ew {
+	case "E":
+	case "W":
+		longitude = -longitude
+	default:
+		return protocol.GeoLocation{}, false
+	}
+
+	return protocol.GeoLocation{Latitude: latitude, Longitude: longitude}, true
+}
+
+// nmeaDegrees converts a coordinate with the given number of degree digits
+func nmeaDegrees(value string, digits int) (float64, bool) {
+	if len(value) < digits+2 {
+		return 0, false
+	}
+	degrees, err := strconv.Atoi(value[:digits])
+	if err != nil {
+		return 0, false
+	}
+	minutes, err := strconv.ParseFloat(value[digits:], 64)
+	if err != nil || minutes >= 60 {
+		return 0, false
+	}
+	return float64(degrees) + minutes/60, true
+}
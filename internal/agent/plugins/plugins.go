@@ -0,0 +1,311 @@
+// Package plugins runs agent plugins: executables in the plugin directory
+// that report custom metrics with heartbeats and run custom actions, e.g. to
+// read CAN bus or serial meters. Plugins are called as
+//
+//	<plugin> describe
+//	<plugin> metrics
+//	<plugin> action <name>
+//
+// with a JSON request on stdin holding their settings from the server, and
+// answer with JSON on stdout. See docs/plugins.md.
+package plugins
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/config"
+	"github.com/edgetainer/edgetainer/internal/shared/logging"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+// maxOutput is the most a plugin may write to stdout
+const maxOutput = 1024 * 1024
+
+// request is what a plugin reads from stdin
+type request struct {
+	DeviceID string          `json:"device_id"`
+	Settings json.RawMessage `json:"settings"`
+	Params   json.RawMessage `json:"params,omitempty"` // Of actions only
+}
+
+// description is what a plugin answers to describe
+type description struct {
+	Version string   `json:"version"`
+	Actions []string `json:"actions"`
+	Metrics bool     `json:"metrics"`
+}
+
+// plugin is an executable in the plugin directory
+type plugin struct {
+	path string
+	info protocol.PluginInfo
+}
+
+// Manager discovers the plugins of the device and runs them with the
+// settings delivered by the server
+type Manager struct {
+	config func() *config.AgentConfig
+	logger *logging.Logger
+
+	mu       sync.Mutex
+	dir      string
+	plugins  map[string]*plugin
+	settings map[string]json.RawMessage
+}
+
+// NewManager creates a manager reading the agent configuration in effect
+// through cfg
+func NewManager(cfg func() *config.AgentConfig) *Manager {
+	return &Manager{
+		config:   cfg,
+		plugins:  make(map[string]*plugin),
+		settings: make(map[string]json.RawMessage),
+		logger:   logging.WithComponent("plugins"),
+	}
+}
+
+// Enabled reports whether a plugin directory is configured
+func (m *Manager) Enabled() bool {
+	return m.config().Plugins.Dir != ""
+}
+
+// Discover describes the executables in the plugin directory, replacing the
+// plugins known so far. Plugins that fail to describe themselves are listed
+// with the error.
+func (m *Manager) Discover(ctx context.Context) error {
+	dir := m.config().Plugins.Dir
+	plugins := make(map[string]*plugin)
+	defer func() {
+		m.mu.Lock()
+		m.dir, m.plugins = dir, plugins
+		m.mu.Unlock()
+	}()
+	if dir == "" {
+		return nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read plugin directory: %w", err)
+	}
+
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() || info.Mode().Perm()&0o111 == 0 {
+			continue
+		}
+		name := entry.Name()
+		if protocol.ValidatePluginName(name) != nil {
+			m.logger.Warn(fmt.Sprintf("Ignoring plugin %s, its name is not valid", name))
+			continue
+		}
+
+		p := &plugin{path: filepath.Join(dir, name), info: protocol.PluginInfo{Name: name, Actions: []string{}}}
+		var desc description
+		if err := m.call(ctx, p, nil, &desc, "describe"); err != nil {
+			p.info.Error = err.Error()
+			m.logger.Warn(fmt.Sprintf("Plugin %s could not describe itself: %v", name, err))
+		} else {
+			p.info.Version, p.info.Metrics = desc.Version, desc.Metrics
+			for _, action := range desc.Actions {
+				if protocol.ValidatePluginName(action) == nil {
+					p.info.Actions = append(p.info.Actions, action)
+				}
+			}
+		}
+		plugins[name] = p
+	}
+
+	m.logger.Info(fmt.Sprintf("Found %d plugins in %s", len(plugins), dir))
+	return nil
+}
+
+// Configure replaces the settings of the plugins
+func (m *Manager) Configure(settings map[string]json.RawMessage) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.settings = make(map[string]json.RawMessage, len(settings))
+	for name, raw := range settings {
+		m.settings[name] = raw
+	}
+}
+
+// Plugins lists the known plugins by name, rediscovering them if the plugin
+// directory changed with a config reload. It returns nil if plugins are
+// disabled.
+func (m *Manager) Plugins(ctx context.Context) []protocol.PluginInfo {
+	if !m.Enabled() {
+		return nil
+	}
+
+	m.mu.Lock()
+	stale := m.dir != m.config().Plugins.Dir
+	m.mu.Unlock()
+	if stale {
+		if err := m.Discover(ctx); err != nil {
+			m.logger.Warn(err.Error())
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	infos := make([]protocol.PluginInfo, 0, len(m.plugins))
+	for _, p := range m.plugins {
+		infos = append(infos, p.info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// Collect runs the plugins that report metrics, in parallel, and returns
+// their metrics by plugin. A plugin that fails is left out and its error
+// recorded in its info until it succeeds again.
+func (m *Manager) Collect(ctx context.Context) map[string]map[string]float64 {
+	m.mu.Lock()
+	var reporting []*plugin
+	for _, p := range m.plugins {
+		if p.info.Metrics {
+			reporting = append(reporting, p)
+		}
+	}
+	m.mu.Unlock()
+
+	var (
+		wg      sync.WaitGroup
+		metrics = make(map[string]map[string]float64)
+	)
+	for _, p := range reporting {
+		wg.Add(1)
+		go func(p *plugin) {
+			defer wg.Done()
+
+			var values map[string]float64
+			err := m.call(ctx, p, nil, &values, "metrics")
+			if err == nil && len(values) > protocol.MaxPluginMetrics {
+				err = fmt.Errorf("reported %d metrics, at most %d are allowed", len(values), protocol.MaxPluginMetrics)
+			}
+			for name := range values {
+				if err == nil && protocol.ValidatePluginName(name) != nil {
+					err = fmt.Errorf("reported a metric with the invalid name %q", name)
+				}
+			}
+
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			if err != nil {
+				m.logger.Debug(fmt.Sprintf("Plugin %s failed to report metrics: %v", p.info.Name, err))
+				p.info.Error = err.Error()
+				return
+			}
+			p.info.Error = ""
+			metrics[p.info.Name] = values
+		}(p)
+	}
+	wg.Wait()
+	return metrics
+}
+
+// Report collects the metrics of the plugins and lists them for a heartbeat.
+// Both are nil if plugins are disabled.
+func (m *Manager) Report(ctx context.Context) ([]protocol.PluginInfo, map[string]map[string]float64) {
+	if m.Plugins(ctx) == nil {
+		return nil, nil
+	}
+	metrics := m.Collect(ctx)
+	return m.Plugins(ctx), metrics
+}
+
+// Run runs an action of a plugin and returns what the plugin answered
+func (m *Manager) Run(ctx context.Context, name, action string, params json.RawMessage) (json.RawMessage, error) {
+	m.mu.Lock()
+	p, ok := m.plugins[name]
+	m.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("plugin %s is not installed", name)
+	}
+	if !slices.Contains(p.info.Actions, action) {
+		return nil, fmt.Errorf("plugin %s has no action %s", name, action)
+	}
+
+	var result json.RawMessage
+	if err := m.call(ctx, p, params, &result, "action", action); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// call runs a plugin with its settings on stdin and decodes its answer
+func (m *Manager) call(ctx context.Context, p *plugin, params json.RawMessage, answer interface{}, args ...string) error {
+	cfg := m.config()
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(cfg.Plugins.Timeout)*time.Second)
+	defer cancel()
+
+	m.mu.Lock()
+	settings := m.settings[p.info.Name]
+	m.mu.Unlock()
+	if settings == nil {
+		settings = json.RawMessage("{}")
+	}
+	input, err := json.Marshal(request{DeviceID: cfg.Device.ID, Settings: settings, Params: params})
+	if err != nil {
+		return err
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, p.path, args...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &limitedBuffer{buf: &stdout, limit: maxOutput}
+	cmd.Stderr = &limitedBuffer{buf: &stderr, limit: 4096}
+	cmd.Env = append(os.Environ(), "EDGETAINER_DEVICE_ID="+cfg.Device.ID)
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("%s did not answer within %ds", args[0], cfg.Plugins.Timeout)
+		}
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			if message := lastLine(stderr.String()); message != "" {
+				return errors.New(message)
+			}
+		}
+		return err
+	}
+
+	if err := json.Unmarshal(stdout.Bytes(), answer); err != nil {
+		return fmt.Errorf("invalid answer to %s: %w", args[0], err)
+	}
+	return nil
+}
+
+// limitedBuffer keeps up to limit bytes and discards the rest
+type limitedBuffer struct {
+	buf   *bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.buf.Len(); room > 0 {
+		b.buf.Write(p[:min(len(p), room)])
+	}
+	return len(p), nil
+}
+
+// lastLine returns the last non-empty line of a text
+func lastLine(text string) string {
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
@@ -0,0 +1,230 @@
+package pullproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/logging"
+	"github.com/edgetainer/edgetainer/internal/shared/ratelimit"
+)
+
+// Proxy is a local HTTP proxy for the Docker daemon that caps the download
+// rate of image pulls. It supports CONNECT tunnels for HTTPS registries and
+// plain HTTP requests. All clients share the same limit.
+type Proxy struct {
+	addr        string
+	defaultRate atomic.Int64 // kbit/s used when no rate is set for a deployment
+	limiter     *ratelimit.Limiter
+	transport   *http.Transport
+	httpServer  *http.Server
+	logger      *logging.Logger
+
+	mu       sync.Mutex
+	override int // kbit/s set for the current deployment, 0 to use the default
+}
+
+// New creates a pull proxy listening on addr with a default rate in kbit/s,
+// zero for unlimited
+func New(addr string, defaultRate int) *Proxy {
+	p := &Proxy{
+		addr:    addr,
+		limiter: ratelimit.New(0),
+		transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			DialContext:         (&net.Dialer{Timeout: 30 * time.Second}).DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+			MaxIdleConns:        10,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		logger: logging.WithComponent("pull-proxy"),
+	}
+	p.SetDefaultRate(defaultRate)
+	return p
+}
+
+// Start starts accepting connections
+func (p *Proxy) Start() error {
+	listener, err := net.Listen("tcp", p.addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", p.addr, err)
+	}
+
+	p.httpServer = &http.Server{
+		Handler:           http.HandlerFunc(p.handle),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	p.logger.Info(fmt.Sprintf("Pull proxy listening on %s", p.addr))
+
+	go func() {
+		if err := p.httpServer.Serve(&limitedListener{Listener: listener, limiter: p.limiter}); err != nil && err != http.ErrServerClosed {
+			p.logger.Error("Pull proxy error", err)
+		}
+	}()
+
+	return nil
+}
+
+// Stop stops the proxy. Tunnels that are still open are closed.
+func (p *Proxy) Stop() {
+	if p.httpServer == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := p.httpServer.Shutdown(ctx); err != nil {
+		p.httpServer.Close()
+	}
+	p.transport.CloseIdleConnections()
+}
+
+// SetDefaultRate changes the rate in kbit/s used when no rate is set for a
+// deployment, zero for unlimited
+func (p *Proxy) SetDefaultRate(kbps int) {
+	p.defaultRate.Store(int64(kbps))
+	p.apply()
+}
+
+// SetRate sets the rate in kbit/s for the current deployment, as configured
+// on the server. Zero falls back to the default rate.
+func (p *Proxy) SetRate(kbps int) {
+	p.mu.Lock()
+	p.override = kbps
+	p.mu.Unlock()
+	p.apply()
+}
+
+// Rate returns the rate currently applied in kbit/s, zero if unlimited
+func (p *Proxy) Rate() int {
+	return int(p.limiter.Rate() * 8 / 1000)
+}
+
+// apply updates the limiter to the effective rate
+func (p *Proxy) apply() {
+	p.mu.Lock()
+	kbps := ratelimit.Effective(p.override, int(p.defaultRate.Load()))
+	p.mu.Unlock()
+	p.limiter.SetRate(ratelimit.KbpsToBytes(kbps))
+}
+
+// handle serves a proxy request
+func (p *Proxy) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		p.handleConnect(w, r)
+		return
+	}
+
+	if !r.URL.IsAbs() {
+		http.Error(w, "Only proxy requests are supported", http.StatusBadRequest)
+		return
+	}
+
+	outReq := r.Clone(r.Context())
+	outReq.RequestURI = ""
+	removeHopHeaders(outReq.Header)
+
+	resp, err := p.transport.RoundTrip(outReq)
+	if err != nil {
+		p.logger.Error(fmt.Sprintf("Failed to proxy request to %s", r.URL.Host), err)
+		http.Error(w, "Bad gateway", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	removeHopHeaders(resp.Header)
+	for key, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// handleConnect tunnels a connection to the requested host, usually a
+// registry served over HTTPS
+func (p *Proxy) handleConnect(w http.ResponseWriter, r *http.Request) {
+	upstream, err := net.DialTimeout("tcp", r.Host, 30*time.Second)
+	if err != nil {
+		p.logger.Error(fmt.Sprintf("Failed to connect to %s", r.Host), err)
+		http.Error(w, "Bad gateway", http.StatusBadGateway)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		upstream.Close()
+		http.Error(w, "Tunneling not supported", http.StatusInternalServerError)
+		return
+	}
+
+	client, buffered, err := hijacker.Hijack()
+	if err != nil {
+		upstream.Close()
+		p.logger.Error("Failed to hijack proxy connection", err)
+		return
+	}
+
+	if _, err := client.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		client.Close()
+		upstream.Close()
+		return
+	}
+
+	go func() {
+		// Data already read by the HTTP server belongs to the tunnel
+		if buffered.Reader.Buffered() > 0 {
+			io.CopyN(upstream, buffered, int64(buffered.Reader.Buffered()))
+		}
+		io.Copy(upstream, client)
+		upstream.Close()
+	}()
+
+	// Downloads are limited by the client connection
+	io.Copy(client, upstream)
+	client.Close()
+}
+
+// hopHeaders are removed when forwarding plain HTTP requests
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders removes the headers that only apply to a single connection
+func removeHopHeaders(header http.Header) {
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+// limitedListener limits what is written to accepted connections, which is
+// what the Docker daemon downloads through the proxy
+type limitedListener struct {
+	net.Listener
+	limiter *ratelimit.Limiter
+}
+
+// Accept implements net.Listener
+func (l *limitedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return ratelimit.Conn(conn, nil, l.limiter), nil
+}
@@ -0,0 +1,41 @@
+package ssh
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+	"golang.org/x/crypto/ssh"
+)
+
+// FetchArtifact downloads a software artifact over the tunnel from offset on
+// into w, returning the bytes written. Cancelling ctx closes the channel.
+func (c *Client) FetchArtifact(ctx context.Context, digest string, offset int64, w io.Writer) (int64, error) {
+	conn := c.current()
+	if conn == nil {
+		return 0, fmt.Errorf("not connected to SSH server")
+	}
+
+	request, err := json.Marshal(protocol.ArtifactRequest{Digest: digest, Offset: offset})
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal artifact request: %w", err)
+	}
+
+	channel, requests, err := conn.client.OpenChannel(protocol.ChannelArtifact, request)
+	if err != nil {
+		return 0, fmt.Errorf("failed to request artifact %s: %w", digest, err)
+	}
+	defer channel.Close()
+	go ssh.DiscardRequests(requests)
+
+	stop := context.AfterFunc(ctx, func() { channel.Close() })
+	defer stop()
+
+	n, err := io.Copy(w, channel)
+	if ctx.Err() != nil {
+		return n, ctx.Err()
+	}
+	return n, err
+}
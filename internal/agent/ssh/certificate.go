@@ -0,0 +1,111 @@
+package ssh
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+	"golang.org/x/crypto/ssh"
+)
+
+// certificateCheckInterval is how often the device certificate is checked
+// for renewal while connected
+const certificateCheckInterval = time.Hour
+
+// certificatePath returns where the certificate of a key is kept, next to
+// the key like OpenSSH does
+func certificatePath(keyPath string) string {
+	return keyPath + "-cert.pub"
+}
+
+// loadCertificate returns a signer presenting the stored certificate of key,
+// or nil if there is none that is still valid
+func loadCertificate(keyPath string, key ssh.Signer) ssh.Signer {
+	cert := readCertificate(keyPath, key)
+	if cert == nil || time.Now().Unix() >= int64(cert.ValidBefore) {
+		return nil
+	}
+
+	signer, err := ssh.NewCertSigner(cert, key)
+	if err != nil {
+		return nil
+	}
+	return signer
+}
+
+// readCertificate reads the stored certificate of key, nil if there is none
+// or it belongs to another key
+func readCertificate(keyPath string, key ssh.Signer) *ssh.Certificate {
+	data, err := os.ReadFile(certificatePath(keyPath))
+	if err != nil {
+		return nil
+	}
+
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil
+	}
+	cert, ok := parsed.(*ssh.Certificate)
+	if !ok || !bytes.Equal(cert.Key.Marshal(), key.PublicKey().Marshal()) {
+		return nil
+	}
+	return cert
+}
+
+// keepCertificate renews the device certificate while the connection is up,
+// once half of its lifetime has passed. A server without a certificate
+// authority declines, the device then keeps logging in with its key alone.
+func (c *Client) keepCertificate(conn *connection, keyPath string, key ssh.Signer) {
+	ticker := time.NewTicker(certificateCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		if !c.renewCertificate(conn, keyPath, key) {
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-conn.ctx.Done():
+			return
+		}
+	}
+}
+
+// renewCertificate requests a new certificate when the stored one is missing
+// or past half of its lifetime. It reports false when the server issues no
+// certificates.
+func (c *Client) renewCertificate(conn *connection, keyPath string, key ssh.Signer) bool {
+	if cert := readCertificate(keyPath, key); cert != nil {
+		renewAt := int64(cert.ValidAfter) + int64(cert.ValidBefore-cert.ValidAfter)/2
+		if time.Now().Unix() < renewAt {
+			return true
+		}
+	}
+
+	ok, payload, err := conn.client.SendRequest(protocol.RequestCert, true, nil)
+	if err != nil {
+		c.logger.Error("Failed to request device certificate", err)
+		return true
+	}
+	if !ok {
+		c.logger.Debug("Server issues no device certificates")
+		return false
+	}
+
+	var reply protocol.CertificateReply
+	if err := json.Unmarshal(payload, &reply); err != nil {
+		c.logger.Error("Failed to parse device certificate reply", err)
+		return true
+	}
+	if err := os.WriteFile(certificatePath(keyPath), []byte(reply.Certificate+"\n"), 0644); err != nil {
+		c.logger.Error("Failed to save device certificate", err)
+		return true
+	}
+
+	c.logger.Info(fmt.Sprintf("Device certificate renewed, valid until %s", reply.ValidBefore.Format(time.RFC3339)))
+	return true
+}
@@ -1,20 +1,34 @@
 package ssh
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/edgetainer/edgetainer/internal/shared/forwarding"
 	"github.com/edgetainer/edgetainer/internal/shared/logging"
 	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+	"github.com/edgetainer/edgetainer/internal/shared/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/crypto/ssh"
 )
 
+// CommandHandler executes a command received from the server and returns the response
+type CommandHandler func(cmd *protocol.Command) *protocol.Response
+
 // Client handles SSH connections to the management server
 type Client struct {
 	ctx         context.Context
@@ -23,17 +37,46 @@ type Client struct {
 	serverPort  int
 	deviceID    string
 	keyPath     string
-	client      *ssh.Client
+	build       protocol.BuildInfo // Agent build reported in heartbeats
+	hardwareID  string             // Hardware attestation reported in heartbeats, empty if disabled
+	platforms   []string           // Platforms the device runs images of, reported in heartbeats
+	os          *protocol.OSInfo   // Operating system of the host, reported in heartbeats
+	conn        *connection        // Current connection, nil while disconnected
 	logger      *logging.Logger
 	mu          sync.Mutex
-	connected   bool
+	lastError   string
+	keepalive   time.Duration
+	keyAlgos    []string     // Signature algorithms offered with the device key, empty for all
+	hostAlgos   []string     // Host key algorithms accepted from the server, empty for all
+	forwards    forwardGuard // Limits of forwarded connections
+	handler     CommandHandler
+	commands    commandLog   // Received commands, to answer resends without running them again
+	clock       *ClockStatus // Last clock check, nil until the first one
 	reconnectCh chan struct{}
 	done        chan struct{}
+
+	backups          []Endpoint    // Servers to fail over to, in order
+	active           int           // Server connected to or tried, 0 for the primary, i for backups[i-1]
+	failoverAfter    time.Duration // How long a server is unreachable before the next is tried
+	failbackInterval time.Duration // Between checks whether the primary is back, zero or less to stay
+	unreachableSince time.Time     // First failed attempt on the active server, zero after a connection
+}
+
+// TunnelStatus describes the current state of the tunnel to the server
+type TunnelStatus struct {
+	Connected      bool         `json:"connected"`
+	Server         string       `json:"server"`
+	Backup         bool         `json:"backup,omitempty"` // Server is a backup the agent failed over to
+	ConnectedSince time.Time    `json:"connected_since,omitempty"`
+	LastError      string       `json:"last_error,omitempty"`
+	Clock          *ClockStatus `json:"clock,omitempty"`
 }
 
 // NewClient creates a new SSH client
 func NewClient(ctx context.Context, serverHost string, serverPort int, deviceID, keyPath string) (*Client, error) {
-	clientCtx, cancel := context.WithCancel(ctx)
+	// The tunnel outlives the agent context so the final state can still be
+	// reported during shutdown, it is closed explicitly by Disconnect
+	clientCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
 
 	return &Client{
 		ctx:         clientCtx,
@@ -42,8 +85,9 @@ func NewClient(ctx context.Context, serverHost string, serverPort int, deviceID,
 		serverPort:  serverPort,
 		deviceID:    deviceID,
 		keyPath:     keyPath,
+		build:       protocol.BuildInfo{Version: "dev", Features: protocol.AgentFeatures},
 		logger:      logging.WithComponent("ssh-client"),
-		connected:   false,
+		keepalive:   30 * time.Second,
 		reconnectCh: make(chan struct{}, 1),
 		done:        make(chan struct{}),
 	}, nil
@@ -54,21 +98,16 @@ func (c *Client) Connect() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if c.connected {
+	if c.conn != nil {
 		return nil
 	}
 
-	c.logger.Info(fmt.Sprintf("Connecting to SSH server at %s:%d", c.serverHost, c.serverPort))
+	c.logger.Info(fmt.Sprintf("Connecting to SSH server at %s", net.JoinHostPort(c.serverHost, strconv.Itoa(c.serverPort))))
 
 	// Start connection loop
 	go c.connectionLoop()
 
-	// Signal reconnection channel
-	select {
-	case c.reconnectCh <- struct{}{}:
-	default:
-		// Channel already has a signal
-	}
+	c.scheduleReconnect()
 
 	return nil
 }
@@ -80,7 +119,9 @@ func (c *Client) Disconnect() {
 	<-c.done
 }
 
-// connectionLoop manages the SSH connection and reconnects when necessary
+// connectionLoop manages the SSH connection and reconnects when necessary.
+// Waiting between attempts is done with a single timer in this loop, so no
+// goroutine is left sleeping while the device is offline.
 func (c *Client) connectionLoop() {
 	defer close(c.done)
 
@@ -88,157 +129,351 @@ func (c *Client) connectionLoop() {
 	backoff := 5 * time.Second
 	maxBackoff := 5 * time.Minute
 
+	// Armed only while an attempt is pending
+	retry := time.NewTimer(maxBackoff)
+	retry.Stop()
+	defer retry.Stop()
+
 	for {
 		select {
 		case <-c.reconnectCh:
-			// Check if we need to wait before reconnecting
-			if !lastReconnectAttempt.IsZero() && time.Since(lastReconnectAttempt) < backoff {
-				time.Sleep(backoff - time.Since(lastReconnectAttempt))
-			}
+		case <-retry.C:
+		case <-c.ctx.Done():
+			c.closeConnection()
+			return
+		}
 
-			lastReconnectAttempt = time.Now()
+		// A late retry signal must not replace a working connection
+		if c.current() != nil {
+			continue
+		}
+
+		// Check if we need to wait before reconnecting
+		if wait := backoff - time.Since(lastReconnectAttempt); !lastReconnectAttempt.IsZero() && wait > 0 {
+			retry.Reset(wait)
+			continue
+		}
 
-			// Attempt to connect
-			if err := c.doConnect(); err != nil {
-				c.logger.Error(fmt.Sprintf("Failed to connect to SSH server: %v", err), err)
+		lastReconnectAttempt = time.Now()
 
-				// Schedule a reconnection attempt
-				go func() {
-					time.Sleep(backoff)
-					select {
-					case c.reconnectCh <- struct{}{}:
-					case <-c.ctx.Done():
-						return
-					}
-				}()
+		// Attempt to connect
+		if err := c.doConnect(); err != nil {
+			c.logger.Error(fmt.Sprintf("Failed to connect to SSH server: %v", err), err)
 
-				// Increase backoff up to maximum
-				backoff = backoff * 2
-				if backoff > maxBackoff {
-					backoff = maxBackoff
-				}
+			c.mu.Lock()
+			c.lastError = err.Error()
+			c.mu.Unlock()
 
+			// The next server is tried right away
+			if c.failOver() {
+				backoff = 5 * time.Second
+				lastReconnectAttempt = time.Time{}
+				c.scheduleReconnect()
 				continue
 			}
 
-			// Reset backoff on successful connection
-			backoff = 5 * time.Second
+			// Schedule a reconnection attempt
+			retry.Reset(backoff)
 
-		case <-c.ctx.Done():
-			c.closeConnection()
-			return
+			// Increase backoff up to maximum
+			backoff = backoff * 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+
+			continue
 		}
+
+		// Reset backoff on successful connection
+		backoff = 5 * time.Second
 	}
 }
 
 // doConnect performs the actual SSH connection
 func (c *Client) doConnect() error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	// Tear down the old connection first, so nothing of it lingers
+	c.closeConnection()
 
-	// Close any existing connection
-	if c.client != nil {
-		c.client.Close()
-		c.client = nil
-		c.connected = false
-	}
+	c.mu.Lock()
+	addr := c.targetLocked().String()
+	backup := c.active > 0
+	failback := c.failbackInterval
+	keyPath := c.keyPath
+	keyAlgos := c.keyAlgos
+	hostAlgos := c.hostAlgos
+	build := c.build
+	c.mu.Unlock()
 
 	// Load the private key
-	key, err := loadPrivateKey(c.keyPath)
+	key, err := loadPrivateKey(keyPath)
 	if err != nil {
 		return fmt.Errorf("failed to load private key: %w", err)
 	}
+	key, err = restrictAlgorithms(key, keyAlgos)
+	if err != nil {
+		return err
+	}
+
+	// Present the device certificate first when there is a valid one, the
+	// key alone still works should the server reject it
+	signers := []ssh.Signer{key}
+	if cert := loadCertificate(keyPath, key); cert != nil {
+		signers = []ssh.Signer{cert, key}
+	}
 
 	// Configure SSH client
 	config := &ssh.ClientConfig{
 		User: c.deviceID,
 		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(key),
+			ssh.PublicKeys(signers...),
 		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(), // TODO: Use a proper host key verification in production
-		Timeout:         30 * time.Second,
+		HostKeyCallback:   ssh.InsecureIgnoreHostKey(), // TODO: Use a proper host key verification in production
+		HostKeyAlgorithms: hostAlgos,
+		Timeout:           30 * time.Second,
 	}
 
-	// Connect to the server
-	addr := fmt.Sprintf("%s:%d", c.serverHost, c.serverPort)
+	// Connect to the server without holding the lock, dialing can take as
+	// long as the timeout
 	client, err := ssh.Dial("tcp", addr, config)
 	if err != nil {
 		return fmt.Errorf("failed to connect to SSH server: %w", err)
 	}
 
-	c.client = client
-	c.connected = true
-	c.logger.Info("Connected to SSH server")
+	// Accept command channels opened by the server
+	commands := client.HandleChannelOpen(protocol.ChannelCommand)
+	directTCP := client.HandleChannelOpen(protocol.ChannelDirectTCP)
+	directUnix := client.HandleChannelOpen(protocol.ChannelDirectUnix)
+	directUDP := client.HandleChannelOpen(protocol.ChannelDirectUDP)
+	conn := newConnection(c.ctx, client, c.logger)
+	conn.negotiate(build)
 
-	// Start handling the connection
-	go c.handleConnection()
+	c.mu.Lock()
+	if c.ctx.Err() != nil {
+		c.mu.Unlock()
+		client.Close()
+		return fmt.Errorf("client is shutting down")
+	}
+	c.conn = conn
+	c.lastError = ""
+	c.unreachableSince = time.Time{}
+	c.mu.Unlock()
+
+	c.logger.Info(fmt.Sprintf("Connected to SSH server %s", addr))
+	if backup && failback > 0 {
+		conn.spawn(func() { c.watchPrimary(conn, failback) })
+	}
+
+	conn.spawn(func() { c.handleCommands(conn, commands) })
+	conn.spawn(func() { c.keepCertificate(conn, keyPath, key) })
+	conn.spawn(func() { conn.serveDirect(directTCP, &c.forwards) })
+	conn.spawn(func() { conn.serveDirect(directUnix, &c.forwards) })
+	conn.spawn(func() { conn.serveDirect(directUDP, &c.forwards) })
+	conn.spawn(func() {
+		conn.keepalive(c.keepaliveInterval, func(err error) {
+			c.connectionLost(conn, fmt.Errorf("failed to send keepalive: %w", err))
+		})
+	})
+	conn.spawn(func() {
+		// Notice a connection closed by the server right away rather than
+		// at the next keepalive
+		err := client.Wait()
+		if conn.ctx.Err() == nil {
+			c.connectionLost(conn, fmt.Errorf("connection closed: %v", err))
+		}
+	})
 
 	return nil
 }
 
-// handleConnection manages the SSH connection lifecycle
-func (c *Client) handleConnection() {
-	// Keep connection alive
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ticker.C:
-			// Send a keep-alive packet
-			c.mu.Lock()
-			if c.client != nil {
-				_, _, err := c.client.SendRequest("keepalive@edgetainer", true, nil)
-				if err != nil {
-					c.logger.Error(fmt.Sprintf("Failed to send keepalive: %v", err), err)
-					// Connection may be dead, close it
-					c.client.Close()
-					c.client = nil
-					c.connected = false
-
-					// Schedule a reconnection
-					select {
-					case c.reconnectCh <- struct{}{}:
-					default:
-						// Channel already has a signal
-					}
-				}
-			}
-			c.mu.Unlock()
+// connectionLost closes a connection that broke and schedules a reconnect,
+// unless it was already replaced
+func (c *Client) connectionLost(conn *connection, err error) {
+	c.mu.Lock()
+	current := c.conn == conn
+	if current {
+		c.conn = nil
+		c.lastError = err.Error()
+	}
+	c.mu.Unlock()
 
-		case <-c.ctx.Done():
-			c.closeConnection()
-			return
-		}
+	conn.close()
+	if current {
+		c.logger.Error("Lost connection to SSH server", err)
+		c.scheduleReconnect()
 	}
 }
 
-// closeConnection closes the SSH connection
+// closeConnection closes the current connection and waits until everything
+// it owns has stopped
 func (c *Client) closeConnection() {
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	conn := c.conn
+	c.conn = nil
+	c.mu.Unlock()
 
-	if c.client != nil {
-		c.client.Close()
-		c.client = nil
+	if conn != nil {
+		conn.close()
+		conn.wait()
 	}
-	c.connected = false
+}
+
+// scheduleReconnect asks the connection loop to connect
+func (c *Client) scheduleReconnect() {
+	select {
+	case c.reconnectCh <- struct{}{}:
+	default:
+		// Channel already has a signal
+	}
+}
+
+// current returns the current connection, nil while disconnected
+func (c *Client) current() *connection {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.conn
+}
+
+// keepaliveInterval returns the interval between keepalive probes
+func (c *Client) keepaliveInterval() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.keepalive
 }
 
 // IsConnected returns true if the client is connected to the server
 func (c *Client) IsConnected() bool {
+	return c.current() != nil
+}
+
+// SetBuildInfo sets the agent build reported in heartbeats
+func (c *Client) SetBuildInfo(build protocol.BuildInfo) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	return c.connected
+	c.build = build
 }
 
-// OpenPortForward sets up port forwarding via SSH
-func (c *Client) OpenPortForward(localPort, remotePort int) error {
+// SetHardwareID sets the hardware attestation reported in heartbeats, empty
+// to report none
+func (c *Client) SetHardwareID(hardwareID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.hardwareID = hardwareID
+}
+
+// SetPlatforms sets the platforms the device runs images of, its own first,
+// reported in heartbeats
+func (c *Client) SetPlatforms(platforms []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.platforms = platforms
+}
+
+// SetOSInfo sets the operating system of the host reported in heartbeats,
+// nil to report none
+func (c *Client) SetOSInfo(info *protocol.OSInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.os = info
+}
+
+// SetKeepaliveInterval changes the interval between keepalive probes
+func (c *Client) SetKeepaliveInterval(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.keepalive = interval
+}
+
+// SetKeyAlgorithms limits the signature algorithms offered with the device
+// key and the host key algorithms accepted from the server, empty for all
+// that are supported. They apply from the next connection.
+func (c *Client) SetKeyAlgorithms(keyAlgorithms, hostKeyAlgorithms []string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if !c.connected || c.client == nil {
+	c.keyAlgos = keyAlgorithms
+	c.hostAlgos = nil
+	// An empty but non-nil list would accept no host key at all
+	if len(hostKeyAlgorithms) > 0 {
+		c.hostAlgos = hostKeyAlgorithms
+	}
+}
+
+// SetForwardLimits sets how long a forwarded connection may go without
+// traffic, how long it may stay open at all and how many may be open at
+// once. Zero or negative values disable a limit. Connections already open
+// keep the limits they were opened with.
+func (c *Client) SetForwardLimits(idleTimeout, maxDuration time.Duration, maxConnections int) {
+	c.forwards.settings.Store(&forwardSettings{
+		limits:         forwarding.Limits{IdleTimeout: idleTimeout, MaxDuration: maxDuration},
+		maxConnections: maxConnections,
+	})
+}
+
+// UpdateTarget changes the server address and key used by the tunnel and
+// reconnects only when one of them actually changed
+func (c *Client) UpdateTarget(serverHost string, serverPort int, keyPath string) bool {
+	c.mu.Lock()
+	changed := c.serverHost != serverHost || c.serverPort != serverPort || c.keyPath != keyPath
+	c.serverHost = serverHost
+	c.serverPort = serverPort
+	c.keyPath = keyPath
+	if changed {
+		c.active = 0
+		c.unreachableSince = time.Time{}
+	}
+	c.mu.Unlock()
+
+	if changed {
+		c.Reconnect()
+	}
+
+	return changed
+}
+
+// Reconnect drops the current connection and schedules an immediate reconnect
+func (c *Client) Reconnect() {
+	c.logger.Info("Forcing reconnection to SSH server")
+
+	c.closeConnection()
+	c.scheduleReconnect()
+}
+
+// Status returns the current tunnel status
+func (c *Client) Status() TunnelStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	status := TunnelStatus{
+		Connected: c.conn != nil,
+		Server:    c.targetLocked().String(),
+		Backup:    c.active > 0,
+		LastError: c.lastError,
+		Clock:     c.clock,
+	}
+	if c.conn != nil {
+		status.ConnectedSince = c.conn.since
+	}
+
+	return status
+}
+
+// OpenPortForward forwards connections to localPort to remotePort on the
+// server. The forward belongs to the current connection and is closed along
+// with it.
+func (c *Client) OpenPortForward(localPort, remotePort int) error {
+	conn := c.current()
+	if conn == nil {
 		return fmt.Errorf("not connected to SSH server")
 	}
 
@@ -248,127 +483,404 @@ func (c *Client) OpenPortForward(localPort, remotePort int) error {
 		return fmt.Errorf("failed to start local listener: %w", err)
 	}
 
+	conn.forward(listener, remotePort, &c.forwards)
 	c.logger.Info(fmt.Sprintf("Opened port forward from local %d to remote %d", localPort, remotePort))
 
-	// Handle incoming connections
-	go func() {
-		defer listener.Close()
+	return nil
+}
 
-		for {
-			conn, err := listener.Accept()
-			if err != nil {
-				if !c.connected {
-					// Client disconnected, exit loop
-					return
-				}
+// SendHeartbeat sends a heartbeat to the server
+func (c *Client) SendHeartbeat(status string, metrics map[string]interface{}, containers []protocol.ContainerStatus, location *protocol.GeoLocation, unmanaged []protocol.Workload, plugins []protocol.PluginInfo, pluginMetrics map[string]map[string]float64, usb []protocol.USBDevice, hostServices []protocol.HostService) error {
+	// Construct heartbeat message
+	heartbeat := protocol.NewHeartbeat(c.deviceID, status)
+	heartbeat.IP, heartbeat.Addresses = localAddresses()
 
-				c.logger.Error(fmt.Sprintf("Failed to accept port forward connection: %v", err), err)
-				continue
-			}
+	// Set version
+	c.mu.Lock()
+	build := c.build
+	heartbeat.Version = build.Version
+	heartbeat.Build = &build
+	heartbeat.HardwareID = c.hardwareID
+	heartbeat.Platforms = c.platforms
+	heartbeat.OS = c.os
+	c.mu.Unlock()
 
-			// Open connection to remote port via SSH
-			c.mu.Lock()
-			if !c.connected || c.client == nil {
-				conn.Close()
-				c.mu.Unlock()
-				return
-			}
+	// Set metrics
+	if metrics != nil {
+		heartbeat.Metrics = metrics
+	}
 
-			go c.handlePortForwardConnection(conn, remotePort)
-			c.mu.Unlock()
-		}
-	}()
+	// Set containers, nil tells the server they were not scanned
+	heartbeat.Containers = containers
+
+	// Report the skew measured by the last clock check
+	if clock := c.Clock(); clock != nil {
+		heartbeat.ClockSkew = &clock.Skew
+	}
+
+	// Set the last position fix
+	heartbeat.Location = location
 
+	// Set the workloads not deployed by the agent
+	heartbeat.Unmanaged = unmanaged
+
+	// Set the plugins and what they measured
+	heartbeat.Plugins = plugins
+	heartbeat.PluginMetrics = pluginMetrics
+
+	// Set the USB devices, nil tells the server they were not scanned
+	heartbeat.USB = usb
+
+	// Set the monitored host services
+	heartbeat.HostServices = hostServices
+
+	// Serialize heartbeat
+	data, err := json.Marshal(heartbeat)
+	if err != nil {
+		return fmt.Errorf("failed to marshal heartbeat: %w", err)
+	}
+
+	// Send heartbeat via SSH
+	conn := c.current()
+	if conn == nil {
+		return fmt.Errorf("not connected to SSH server")
+	}
+
+	// Send heartbeat as an SSH request
+	_, _, err = conn.sendRequest(protocol.RequestHeartbeat, false, data)
+	if err != nil {
+		return fmt.Errorf("failed to send heartbeat: %w", err)
+	}
+
+	return nil
+}
+
+// SendPullProgress reports the image pull progress of a running deployment.
+// Progress is best effort and not acknowledged by the server.
+func (c *Client) SendPullProgress(progress *protocol.PullProgress) error {
+	data, err := json.Marshal(progress)
+	if err != nil {
+		return fmt.Errorf("failed to marshal pull progress: %w", err)
+	}
+
+	conn := c.current()
+	if conn == nil {
+		return fmt.Errorf("not connected to SSH server")
+	}
+
+	if _, _, err := conn.sendRequest(protocol.RequestPull, false, data); err != nil {
+		return fmt.Errorf("failed to send pull progress: %w", err)
+	}
 	return nil
 }
 
-// handlePortForwardConnection forwards traffic from a local connection to a remote port
-func (c *Client) handlePortForwardConnection(local net.Conn, remotePort int) {
-	defer local.Close()
+// SendDeployStage reports the stage a running deployment reached. Like pull
+// progress it is best effort and not acknowledged by the server.
+func (c *Client) SendDeployStage(stage *protocol.DeployStage) error {
+	data, err := json.Marshal(stage)
+	if err != nil {
+		return fmt.Errorf("failed to marshal deployment stage: %w", err)
+	}
+
+	conn := c.current()
+	if conn == nil {
+		return fmt.Errorf("not connected to SSH server")
+	}
 
+	if _, _, err := conn.sendRequest(protocol.RequestStage, false, data); err != nil {
+		return fmt.Errorf("failed to send deployment stage: %w", err)
+	}
+	return nil
+}
+
+// SetCommandHandler sets the handler used to execute commands from the server
+func (c *Client) SetCommandHandler(handler CommandHandler) {
 	c.mu.Lock()
-	if !c.connected || c.client == nil {
-		c.mu.Unlock()
+	defer c.mu.Unlock()
+
+	c.handler = handler
+}
+
+// handleCommands accepts command channels for the lifetime of a connection
+func (c *Client) handleCommands(conn *connection, channels <-chan ssh.NewChannel) {
+	for newChannel := range channels {
+		go c.handleCommandChannel(conn, newChannel)
+	}
+}
+
+// handleCommandChannel reads a single command, executes it and writes the response
+func (c *Client) handleCommandChannel(conn *connection, newChannel ssh.NewChannel) {
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		c.logger.Error("Failed to accept command channel", err)
 		return
 	}
+	defer channel.Close()
 
-	// Connect to remote port
-	remote, err := c.client.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", remotePort))
+	go ssh.DiscardRequests(requests)
+
+	var cmd protocol.Command
+	if err := protocol.ReadMessage(channel, &cmd); err != nil {
+		c.logger.Error("Failed to decode command", err)
+		return
+	}
+
+	c.mu.Lock()
+	handler := c.handler
 	c.mu.Unlock()
 
-	if err != nil {
-		c.logger.Error(fmt.Sprintf("Failed to connect to remote port %d: %v", remotePort, err), err)
+	var resp *protocol.Response
+	if handler == nil {
+		const reason = "agent is not ready to handle commands"
+		c.acknowledge(channel, &cmd, reason)
+		resp = protocol.NewResponse(cmd.ID, protocol.RespError, false, reason)
+	} else {
+		resp = c.runOnce(channel, &cmd, handler)
+	}
+
+	if err := protocol.WriteMessage(channel, resp, conn.compress.Load()); err != nil {
+		c.logger.Error(fmt.Sprintf("Failed to send response for command %s", cmd.ID), err)
 		return
 	}
-	defer remote.Close()
+	channel.CloseWrite()
+}
+
+// executeCommand runs a command with the handler, continuing the trace of the
+// server that sent it
+func (c *Client) executeCommand(cmd *protocol.Command, handler CommandHandler) *protocol.Response {
+	_, span := tracing.Start(tracing.Extract(c.ctx, cmd.TraceParent), "agent.command "+cmd.Type,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("device.id", c.deviceID),
+			attribute.String("command.id", cmd.ID),
+		))
+	defer span.End()
+
+	c.logger.Info(fmt.Sprintf("Executing command %s (%s)", cmd.Type, cmd.ID))
+	resp := handler(cmd)
+
+	span.SetAttributes(attribute.Bool("command.success", resp.Success))
+	if !resp.Success {
+		span.SetStatus(codes.Error, resp.Message)
+	}
+	return resp
+}
+
+// SendShutdownReport sends the final application state to the server before
+// disconnecting, waiting at most timeout for the server to acknowledge it
+func (c *Client) SendShutdownReport(report *protocol.ShutdownReport, timeout time.Duration) error {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("failed to marshal shutdown report: %w", err)
+	}
+
+	conn := c.current()
+	if conn == nil {
+		return fmt.Errorf("not connected to SSH server")
+	}
 
-	// Set up bidirectional copy
-	done := make(chan struct{}, 2)
+	result := make(chan error, 1)
 	go func() {
-		_, err := io.Copy(remote, local)
-		if err != nil && !isClosedConnError(err) {
-			c.logger.Error(fmt.Sprintf("Failed to copy local to remote: %v", err), err)
-		}
-		remote.Close()
-		done <- struct{}{}
+		_, _, err := conn.sendRequest(protocol.RequestShutdown, true, data)
+		result <- err
 	}()
 
-	go func() {
-		_, err := io.Copy(local, remote)
-		if err != nil && !isClosedConnError(err) {
-			c.logger.Error(fmt.Sprintf("Failed to copy remote to local: %v", err), err)
+	select {
+	case err := <-result:
+		if err != nil {
+			return fmt.Errorf("failed to send shutdown report: %w", err)
 		}
-		local.Close()
-		done <- struct{}{}
-	}()
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out sending shutdown report")
+	}
+}
+
+// SendLogFile uploads a rotated log file to the server in chunks split at
+// line boundaries. Gzipped files are decompressed first.
+func (c *Client) SendLogFile(path string) error {
+	data, err := readLogFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read log file: %w", err)
+	}
 
-	// Wait for both copies to complete
-	<-done
-	<-done
+	conn := c.current()
+	if conn == nil {
+		return fmt.Errorf("not connected to SSH server")
+	}
+
+	chunks := splitLogData(data, protocol.MaxLogChunk)
+	name := filepath.Base(path)
+	for i, chunk := range chunks {
+		payload, err := json.Marshal(protocol.LogChunk{
+			File:  name,
+			Part:  i + 1,
+			Parts: len(chunks),
+			Data:  string(chunk),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to marshal log chunk: %w", err)
+		}
+
+		ok, _, err := conn.sendRequest(protocol.RequestLogs, true, payload)
+		if err != nil {
+			return fmt.Errorf("failed to send log file: %w", err)
+		}
+		if !ok {
+			return fmt.Errorf("server rejected part %d of %s", i+1, name)
+		}
+	}
+
+	c.logger.Debug(fmt.Sprintf("Shipped log file %s in %d parts", name, len(chunks)))
+	return nil
 }
 
-// SendHeartbeat sends a heartbeat to the server
-func (c *Client) SendHeartbeat(status string, metrics map[string]interface{}, containers []protocol.ContainerStatus) error {
-	// Construct heartbeat message
-	heartbeat := protocol.NewHeartbeat(c.deviceID, status)
-	heartbeat.IP = getLocalIP()
+// SendJournal ships journald entries of the host to the server
+func (c *Client) SendJournal(entries []protocol.JournalEntry) error {
+	conn := c.current()
+	if conn == nil {
+		return fmt.Errorf("not connected to SSH server")
+	}
 
-	// Set version
-	heartbeat.Version = "dev" // TODO: Use version from build info
+	payload, err := json.Marshal(protocol.JournalBatch{Entries: entries})
+	if err != nil {
+		return fmt.Errorf("failed to marshal journal entries: %w", err)
+	}
 
-	// Set metrics
-	if metrics != nil {
-		heartbeat.Metrics = metrics
+	ok, _, err := conn.sendRequest(protocol.RequestJournal, true, payload)
+	if err != nil {
+		return fmt.Errorf("failed to send journal entries: %w", err)
+	}
+	if !ok {
+		return fmt.Errorf("server rejected %d journal entries", len(entries))
 	}
+	return nil
+}
 
-	// Set containers
-	if containers != nil {
-		heartbeat.Containers = containers
+// SendAutonomy ships events of what the agent did without the server
+func (c *Client) SendAutonomy(events []protocol.AutonomyEvent) error {
+	conn := c.current()
+	if conn == nil {
+		return fmt.Errorf("not connected to SSH server")
 	}
 
-	// Serialize heartbeat
-	data, err := json.Marshal(heartbeat)
+	payload, err := json.Marshal(protocol.AutonomyBatch{Events: events})
 	if err != nil {
-		return fmt.Errorf("failed to marshal heartbeat: %w", err)
+		return fmt.Errorf("failed to marshal autonomy events: %w", err)
 	}
 
-	// Send heartbeat via SSH
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	ok, _, err := conn.sendRequest(protocol.RequestAutonomy, true, payload)
+	if err != nil {
+		return fmt.Errorf("failed to send autonomy events: %w", err)
+	}
+	if !ok {
+		return fmt.Errorf("server rejected %d autonomy events", len(events))
+	}
+	return nil
+}
 
-	if !c.connected || c.client == nil {
+// SendBundle uploads a diagnostics bundle to the server in parts, or reports
+// the error that kept it from being collected
+func (c *Client) SendBundle(bundleID string, bundle []byte, collectErr error) error {
+	conn := c.current()
+	if conn == nil {
 		return fmt.Errorf("not connected to SSH server")
 	}
 
-	// Send heartbeat as an SSH request
-	_, _, err = c.client.SendRequest("heartbeat@edgetainer", false, data)
+	var chunks []protocol.BundleChunk
+	if collectErr != nil {
+		chunks = append(chunks, protocol.BundleChunk{BundleID: bundleID, Error: collectErr.Error()})
+	}
+	for offset := 0; collectErr == nil && offset < len(bundle); offset += protocol.MaxBundleChunk {
+		end := min(offset+protocol.MaxBundleChunk, len(bundle))
+		chunks = append(chunks, protocol.BundleChunk{BundleID: bundleID, Data: bundle[offset:end]})
+	}
+	for i := range chunks {
+		chunks[i].Part = i + 1
+		chunks[i].Parts = len(chunks)
+	}
+
+	for _, chunk := range chunks {
+		payload, err := json.Marshal(chunk)
+		if err != nil {
+			return fmt.Errorf("failed to marshal bundle chunk: %w", err)
+		}
+
+		ok, _, err := conn.sendRequest(protocol.RequestBundle, true, payload)
+		if err != nil {
+			return fmt.Errorf("failed to send diagnostics bundle: %w", err)
+		}
+		if !ok {
+			return fmt.Errorf("server rejected part %d of diagnostics bundle %s", chunk.Part, bundleID)
+		}
+	}
+
+	c.logger.Debug(fmt.Sprintf("Uploaded diagnostics bundle %s in %d parts", bundleID, len(chunks)))
+	return nil
+}
+
+// SendCaptureChunk uploads a part of a packet capture, returning once the
+// server stored it
+func (c *Client) SendCaptureChunk(chunk protocol.CaptureChunk) error {
+	conn := c.current()
+	if conn == nil {
+		return fmt.Errorf("not connected to SSH server")
+	}
+
+	payload, err := json.Marshal(chunk)
 	if err != nil {
-		return fmt.Errorf("failed to send heartbeat: %w", err)
+		return fmt.Errorf("failed to marshal capture chunk: %w", err)
 	}
 
+	ok, _, err := conn.sendRequest(protocol.RequestCapture, true, payload)
+	if err != nil {
+		return fmt.Errorf("failed to send packet capture: %w", err)
+	}
+	if !ok {
+		return fmt.Errorf("server rejected part %d of packet capture %s", chunk.Part, chunk.CaptureID)
+	}
 	return nil
 }
 
+// readLogFile reads a log file, decompressing it when gzipped
+func readLogFile(path string) ([]byte, error) {
+	if !strings.HasSuffix(path, ".gz") {
+		return os.ReadFile(path)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	return io.ReadAll(gz)
+}
+
+// splitLogData splits data into chunks of at most size bytes, preferably at
+// line boundaries
+func splitLogData(data []byte, size int) [][]byte {
+	var chunks [][]byte
+	for len(data) > size {
+		end := bytes.LastIndexByte(data[:size], '\n') + 1
+		if end == 0 {
+			end = size
+		}
+		chunks = append(chunks, data[:end])
+		data = data[end:]
+	}
+	if len(data) > 0 {
+		chunks = append(chunks, data)
+	}
+	return chunks
+}
+
 // loadPrivateKey loads an SSH private key from a file
 func loadPrivateKey(path string) (ssh.Signer, error) {
 	keyData, err := ioutil.ReadFile(path)
@@ -384,38 +896,63 @@ func loadPrivateKey(path string) (ssh.Signer, error) {
 	return key, nil
 }
 
-// getLocalIP returns the local IP address
-func getLocalIP() string {
-	addrs, err := net.InterfaceAddrs()
-	if err != nil {
-		return ""
+// restrictAlgorithms limits the signature algorithms of a key to those of
+// algorithms it supports. RSA keys can sign with several, other keys only with
+// their own.
+func restrictAlgorithms(key ssh.Signer, algorithms []string) (ssh.Signer, error) {
+	if len(algorithms) == 0 {
+		return key, nil
 	}
 
-	for _, addr := range addrs {
-		if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
-			if ipnet.IP.To4() != nil {
-				return ipnet.IP.String()
+	keyType := key.PublicKey().Type()
+	supported := []string{keyType}
+	if keyType == ssh.KeyAlgoRSA {
+		supported = []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+
+	var allowed []string
+	for _, algorithm := range algorithms {
+		for _, candidate := range supported {
+			if algorithm == candidate {
+				allowed = append(allowed, algorithm)
 			}
 		}
 	}
+	if len(allowed) == 0 {
+		return nil, fmt.Errorf("device key of type %s cannot sign with any of the configured key algorithms", keyType)
+	}
 
-	return ""
+	algorithmSigner, ok := key.(ssh.AlgorithmSigner)
+	if !ok {
+		return nil, fmt.Errorf("device key of type %s does not support choosing algorithms", keyType)
+	}
+	return ssh.NewSignerWithAlgorithms(algorithmSigner, allowed)
 }
 
-// isClosedConnError returns true if the error is due to a closed connection
-func isClosedConnError(err error) bool {
-	if err == nil {
-		return false
+// localAddresses returns the IPv4 and IPv6 addresses of the device, leaving
+// out loopback and link-local ones, and the address to show for it: the
+// first IPv4 address, or the first IPv6 address on IPv6-only devices
+func localAddresses() (string, []string) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", nil
 	}
 
-	if err == io.EOF {
-		return true
+	var preferred string
+	var all []string
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || !ipnet.IP.IsGlobalUnicast() {
+			continue
+		}
+		all = append(all, ipnet.IP.String())
+		if preferred == "" && ipnet.IP.To4() != nil {
+			preferred = ipnet.IP.String()
+		}
 	}
-
-	netErr, ok := err.(*net.OpError)
-	if !ok {
-		return false
+	if preferred == "" && len(all) > 0 {
+		preferred = all[0]
 	}
 
-	return netErr.Err.Error() == "use of closed network connection"
+	return preferred, all
 }
@@ -0,0 +1,65 @@
+package ssh
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+// ClockStatus is the result of the last clock check against the server
+type ClockStatus struct {
+	Skew      float64   `json:"skew_seconds"` // Device clock minus server clock
+	RTT       float64   `json:"rtt_seconds"`  // Round trip of the check, bounds its accuracy
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// CheckClock measures how far the device clock is ahead of the server clock,
+// assuming the server answered halfway through the round trip
+func (c *Client) CheckClock() (*ClockStatus, error) {
+	conn := c.current()
+	if conn == nil {
+		return nil, fmt.Errorf("not connected to SSH server")
+	}
+	client := conn.client
+
+	sent := time.Now()
+	ok, payload, err := client.SendRequest(protocol.RequestTime, true, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send clock check: %w", err)
+	}
+	received := time.Now()
+	if !ok {
+		return nil, fmt.Errorf("server does not support clock checks")
+	}
+
+	var reply protocol.TimeReply
+	if err := json.Unmarshal(payload, &reply); err != nil {
+		return nil, fmt.Errorf("failed to parse clock check reply: %w", err)
+	}
+
+	// The monotonic clock gives the round trip, the wall clock the skew
+	rtt := received.Sub(sent)
+	midpoint := sent.Round(0).Add(rtt / 2)
+	status := &ClockStatus{
+		Skew:      midpoint.Sub(reply.ServerTime).Seconds(),
+		RTT:       rtt.Seconds(),
+		CheckedAt: received,
+	}
+
+	c.mu.Lock()
+	c.clock = status
+	c.mu.Unlock()
+
+	return status, nil
+}
+
+// Clock returns the result of the last clock check, or nil if the clock was
+// not checked yet
+func (c *Client) Clock() *ClockStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.clock
+}
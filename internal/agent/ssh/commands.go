@@ -0,0 +1,103 @@
+package ssh
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+	"golang.org/x/crypto/ssh"
+)
+
+// maxCommandLog bounds the executed commands remembered to answer resends
+const maxCommandLog = 256
+
+// commandLog remembers recent commands by ID, so that a command the server
+// resends after a reconnect is answered from its first execution rather than
+// run twice. It lives in memory: a command interrupted by an agent restart
+// runs again when resent.
+type commandLog struct {
+	mu      sync.Mutex
+	entries map[string]*commandEntry
+	order   []string // IDs, oldest first
+}
+
+// commandEntry is a received command, done is closed once it was executed
+type commandEntry struct {
+	done     chan struct{}
+	response *protocol.Response
+}
+
+// begin returns the entry of a command and whether it was received for the
+// first time, in which case the caller executes it and calls finish
+func (l *commandLog) begin(id string) (*commandEntry, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if entry, ok := l.entries[id]; ok {
+		return entry, false
+	}
+	if l.entries == nil {
+		l.entries = make(map[string]*commandEntry)
+	}
+
+	entry := &commandEntry{done: make(chan struct{})}
+	l.entries[id] = entry
+	l.order = append(l.order, id)
+	if len(l.order) > maxCommandLog {
+		delete(l.entries, l.order[0])
+		l.order = l.order[1:]
+	}
+	return entry, true
+}
+
+// finish records the response of a command and wakes up resends waiting for
+// it
+func (l *commandLog) finish(entry *commandEntry, response *protocol.Response) {
+	entry.response = response
+	close(entry.done)
+}
+
+// acknowledge tells the server a command was received, or why it was
+// rejected when reason is set. Servers predating acknowledgements reject the
+// request, which is harmless.
+func (c *Client) acknowledge(channel ssh.Channel, cmd *protocol.Command, reason string) {
+	data, err := json.Marshal(protocol.CommandAck{
+		ID:       cmd.ID,
+		Seq:      cmd.Seq,
+		Accepted: reason == "",
+		Reason:   reason,
+	})
+	if err != nil {
+		c.logger.Error("Failed to marshal command acknowledgement", err)
+		return
+	}
+	if _, err := channel.SendRequest(protocol.RequestAck, true, data); err != nil {
+		c.logger.Error(fmt.Sprintf("Failed to acknowledge command %s", cmd.ID), err)
+	}
+}
+
+// runOnce acknowledges a command and executes it, unless it was received
+// before: a resent command is answered with the response of its first
+// execution, once that finished
+func (c *Client) runOnce(channel ssh.Channel, cmd *protocol.Command, handler CommandHandler) *protocol.Response {
+	entry, first := c.commands.begin(cmd.ID)
+	c.acknowledge(channel, cmd, "")
+
+	if first {
+		response := c.executeCommand(cmd, handler)
+		c.commands.finish(entry, response)
+		return response
+	}
+
+	c.logger.Info(fmt.Sprintf("Command %s (%s) was resent, answering from its first execution", cmd.Type, cmd.ID))
+	select {
+	case <-entry.done:
+	case <-c.ctx.Done():
+		return protocol.NewResponse(cmd.ID, protocol.RespError, false, "agent is shutting down")
+	}
+
+	response := *entry.response
+	response.Duplicate = true
+	return &response
+}
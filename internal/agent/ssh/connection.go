@@ -0,0 +1,285 @@
+package ssh
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/forwarding"
+	"github.com/edgetainer/edgetainer/internal/shared/logging"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+	"golang.org/x/crypto/ssh"
+)
+
+// connection is one SSH connection to the server. Its keepalive loop, the
+// acceptance of command and forwarded channels, port forward listeners and
+// the copies of forwarded connections belong to it and stop when it is
+// closed, so nothing of an old connection lingers after a reconnect. Commands
+// that are already executing run to completion.
+type connection struct {
+	client *ssh.Client
+	since  time.Time
+	ctx    context.Context
+	cancel context.CancelFunc
+	logger *logging.Logger
+	wg     sync.WaitGroup
+
+	compress atomic.Bool // The server understands compressed and chunked messages
+}
+
+// newConnection wraps an established SSH client
+func newConnection(ctx context.Context, client *ssh.Client, logger *logging.Logger) *connection {
+	connCtx, cancel := context.WithCancel(ctx)
+	return &connection{
+		client: client,
+		since:  time.Now(),
+		ctx:    connCtx,
+		cancel: cancel,
+		logger: logger,
+	}
+}
+
+// spawn runs fn in a goroutine owned by the connection
+func (conn *connection) spawn(fn func()) {
+	conn.wg.Add(1)
+	go func() {
+		defer conn.wg.Done()
+		fn()
+	}()
+}
+
+// close tears the connection down. It does not wait for the goroutines of
+// the connection, since it may be called from one of them; use wait for that.
+func (conn *connection) close() {
+	conn.cancel()
+	conn.client.Close()
+}
+
+// wait blocks until every goroutine of the connection has stopped
+func (conn *connection) wait() {
+	conn.wg.Wait()
+}
+
+// keepalive probes the server until the connection closes. A probe that fails
+// calls dead, which is expected to close the connection.
+func (conn *connection) keepalive(interval func() time.Duration, dead func(error)) {
+	current := interval()
+	ticker := time.NewTicker(current)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-conn.ctx.Done():
+			return
+		}
+
+		// The interval may change with a config reload
+		if next := interval(); next != current {
+			current = next
+			ticker.Reset(current)
+		}
+
+		if _, _, err := conn.client.SendRequest(protocol.RequestKeepalive, true, nil); err != nil {
+			if conn.ctx.Err() == nil {
+				dead(err)
+			}
+			return
+		}
+	}
+}
+
+// forward accepts connections on listener and forwards them to remotePort on
+// the server until the connection closes, within the limits of the guard
+func (conn *connection) forward(listener net.Listener, remotePort int, guard *forwardGuard) {
+	// Accept only returns once the listener is closed
+	conn.spawn(func() {
+		<-conn.ctx.Done()
+		listener.Close()
+	})
+
+	conn.spawn(func() {
+		defer listener.Close()
+
+		for {
+			local, err := listener.Accept()
+			if err != nil {
+				if conn.ctx.Err() != nil {
+					return
+				}
+				conn.logger.Error(fmt.Sprintf("Failed to accept port forward connection: %v", err), err)
+				continue
+			}
+
+			conn.spawn(func() {
+				conn.forwardConnection(local, remotePort, guard)
+			})
+		}
+	})
+}
+
+// forwardConnection copies traffic between a local connection and remotePort
+// on the server
+func (conn *connection) forwardConnection(local net.Conn, remotePort int, guard *forwardGuard) {
+	defer local.Close()
+
+	if !forwarding.Acquire(&guard.open, guard.current().maxConnections) {
+		conn.logger.Warn(fmt.Sprintf("Refusing port forward connection to remote %d, too many forwarded connections open", remotePort))
+		return
+	}
+	defer guard.open.Add(-1)
+
+	remote, err := conn.client.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", remotePort))
+	if err != nil {
+		conn.logger.Error(fmt.Sprintf("Failed to connect to remote port %d: %v", remotePort, err), err)
+		return
+	}
+	defer remote.Close()
+
+	// Closing both ends stops the copies when the connection closes
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-conn.ctx.Done():
+			local.Close()
+			remote.Close()
+		case <-done:
+		}
+	}()
+
+	settings := guard.current()
+	if ended := forwarding.Pipe(local, remote, settings.limits); ended != forwarding.EndClosed {
+		conn.logger.Info(fmt.Sprintf("Closed port forward connection to remote %d, %s limit reached", remotePort, ended))
+	}
+}
+
+// serveDirect accepts the direct-tcpip, direct-streamlocal and direct-udp
+// channels the server opens for its forwards and connects them to the device-local address
+// they ask for. Which targets may be reached is decided by the server from
+// the device's tunnel policy.
+func (conn *connection) serveDirect(channels <-chan ssh.NewChannel, guard *forwardGuard) {
+	for newChannel := range channels {
+		newChannel := newChannel
+		conn.spawn(func() {
+			conn.directChannel(newChannel, guard)
+		})
+	}
+}
+
+// directChannel dials the target of a direct channel and copies traffic
+// between the two until either side closes or a limit of the guard is
+// reached. Channels beyond the guard's connection limit are rejected.
+func (conn *connection) directChannel(newChannel ssh.NewChannel, guard *forwardGuard) {
+	if !forwarding.Acquire(&guard.open, guard.current().maxConnections) {
+		conn.logger.Warn("Rejecting forwarded channel, too many forwarded connections open")
+		newChannel.Reject(ssh.ResourceShortage, "too many forwarded connections")
+		return
+	}
+	defer guard.open.Add(-1)
+
+	var network, address string
+	switch newChannel.ChannelType() {
+	case protocol.ChannelDirectTCP:
+		var payload protocol.DirectTCPPayload
+		if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+			newChannel.Reject(ssh.ConnectionFailed, "invalid payload")
+			return
+		}
+		network, address = "tcp", net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port)))
+	case protocol.ChannelDirectUnix:
+		var payload protocol.DirectUnixPayload
+		if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+			newChannel.Reject(ssh.ConnectionFailed, "invalid payload")
+			return
+		}
+		network, address = "unix", payload.SocketPath
+	case protocol.ChannelDirectUDP:
+		var payload protocol.DirectUDPPayload
+		if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+			newChannel.Reject(ssh.ConnectionFailed, "invalid payload")
+			return
+		}
+		network, address = "udp", net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port)))
+	default:
+		newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+		return
+	}
+
+	dialer := net.Dialer{Timeout: 10 * time.Second}
+	local, err := dialer.DialContext(conn.ctx, network, address)
+	if err != nil {
+		conn.logger.Debug(fmt.Sprintf("Failed to connect forwarded channel to %s: %v", address, err))
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	defer local.Close()
+
+	// Datagrams travel over the channel with a length prefix each
+	var target io.ReadWriteCloser = local
+	if network == "udp" {
+		target = forwarding.NewDatagramStream(local)
+	}
+
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		conn.logger.Error("Failed to accept forwarded channel", err)
+		return
+	}
+	defer channel.Close()
+
+	go ssh.DiscardRequests(requests)
+
+	// Closing both ends stops the copies when the connection closes
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-conn.ctx.Done():
+			local.Close()
+			channel.Close()
+		case <-done:
+		}
+	}()
+
+	settings := guard.current()
+	if ended := forwarding.Pipe(target, channel, settings.limits); ended != forwarding.EndClosed {
+		conn.logger.Info(fmt.Sprintf("Closed forwarded connection to %s, %s limit reached", address, ended))
+	}
+}
+
+// Defaults for forwarded connections, used unless SetForwardLimits was called
+const (
+	defaultForwardIdle        = 10 * time.Minute
+	defaultForwardDuration    = 8 * time.Hour
+	defaultForwardConnections = 32
+)
+
+// forwardSettings bound the forwarded connections of the device
+type forwardSettings struct {
+	limits         forwarding.Limits
+	maxConnections int // Open at once, zero or negative for unlimited
+}
+
+// forwardGuard applies the forward settings across the connections of a
+// client, so a reconnect does not reset the count of open connections
+type forwardGuard struct {
+	settings atomic.Pointer[forwardSettings]
+	open     atomic.Int64
+}
+
+// current returns the settings for new forwarded connections
+func (g *forwardGuard) current() *forwardSettings {
+	if settings := g.settings.Load(); settings != nil {
+		return settings
+	}
+	return &forwardSettings{
+		limits:         forwarding.Limits{IdleTimeout: defaultForwardIdle, MaxDuration: defaultForwardDuration},
+		maxConnections: defaultForwardConnections,
+	}
+}
@@ -0,0 +1,267 @@
+package ssh
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+	"golang.org/x/crypto/ssh"
+)
+
+// testServer is an SSH server that accepts any device key, echoes the
+// connections forwarded to it and answers no global requests
+type testServer struct {
+	listener net.Listener
+	config   *ssh.ServerConfig
+
+	// When set, forwarded connections are only answered once it is closed,
+	// and opened is told about each one before
+	hold   chan struct{}
+	opened chan struct{}
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	s := &testServer{listener: listener, config: config}
+	go s.serve()
+	return s
+}
+
+func (s *testServer) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *testServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *testServer) handle(conn net.Conn) {
+	serverConn, channels, requests, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer serverConn.Close()
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != protocol.ChannelDirectTCP {
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+		go func(newChannel ssh.NewChannel) {
+			if s.hold != nil {
+				s.opened <- struct{}{}
+				<-s.hold
+			}
+			channel, requests, err := newChannel.Accept()
+			if err != nil {
+				return
+			}
+			defer channel.Close()
+			go ssh.DiscardRequests(requests)
+			io.Copy(channel, channel)
+		}(newChannel)
+	}
+}
+
+// newTestClient returns a client for the server with a fresh device key
+func newTestClient(t *testing.T, server *testServer) *Client {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(t.TempDir(), "device_key")
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewClient(context.Background(), "127.0.0.1", server.port(), "test-device", keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.closeConnection)
+	return client
+}
+
+// freePort returns a local port nothing listens on
+func freePort(t *testing.T) int {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// waitGoroutines waits until no more than want goroutines run
+func waitGoroutines(t *testing.T, want int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > want {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			t.Fatalf("%d goroutines running, want at most %d:\n%s", runtime.NumGoroutine(), want, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// echo sends a line through conn and checks that it comes back
+func echo(t *testing.T, conn net.Conn, line string) {
+	t.Helper()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, line); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, len(line))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(buf) != line {
+		t.Fatalf("echoed %q, want %q", buf, line)
+	}
+}
+
+func TestReconnectReleasesConnection(t *testing.T) {
+	server := newTestServer(t)
+	client := newTestClient(t, server)
+
+	if err := client.doConnect(); err != nil {
+		t.Fatal(err)
+	}
+	// Let the requests sent on connecting settle
+	time.Sleep(100 * time.Millisecond)
+	baseline := runtime.NumGoroutine()
+
+	for i := 0; i < 20; i++ {
+		localPort := freePort(t)
+		if err := client.OpenPortForward(localPort, 8080); err != nil {
+			t.Fatalf("reconnect %d: %v", i, err)
+		}
+		local, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", localPort))
+		if err != nil {
+			t.Fatalf("reconnect %d: %v", i, err)
+		}
+		echo(t, local, fmt.Sprintf("reconnect %d\n", i))
+
+		old := client.current()
+		if err := client.doConnect(); err != nil {
+			t.Fatalf("reconnect %d: %v", i, err)
+		}
+		if client.current() == old {
+			t.Fatalf("reconnect %d kept the old connection", i)
+		}
+
+		// The forwarded connection of the old connection is closed
+		local.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := local.Read(make([]byte, 1)); err == nil {
+			t.Fatalf("reconnect %d: forwarded connection still open", i)
+		} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			t.Fatalf("reconnect %d: forwarded connection still open", i)
+		}
+		local.Close()
+
+		// The listener of the old connection is gone
+		listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", localPort))
+		if err != nil {
+			t.Fatalf("reconnect %d: port %d still in use: %v", i, localPort, err)
+		}
+		listener.Close()
+
+		// And so are its goroutines
+		waitGoroutines(t, baseline)
+	}
+}
+
+func TestOpenPortForwardDoesNotHoldLock(t *testing.T) {
+	server := newTestServer(t)
+	server.hold = make(chan struct{})
+	server.opened = make(chan struct{}, 1)
+	defer close(server.hold)
+	client := newTestClient(t, server)
+
+	if err := client.doConnect(); err != nil {
+		t.Fatal(err)
+	}
+	localPort := freePort(t)
+	if err := client.OpenPortForward(localPort, 8080); err != nil {
+		t.Fatal(err)
+	}
+
+	// A forwarded connection dials the server, which does not answer
+	local, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", localPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	select {
+	case <-server.opened:
+	case <-time.After(5 * time.Second):
+		t.Fatal("forwarded connection did not reach the server")
+	}
+
+	// Meanwhile the client is not locked
+	otherPort := freePort(t)
+	done := make(chan error, 1)
+	go func() {
+		client.Status()
+		done <- client.OpenPortForward(otherPort, 8081)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("client locked while a forwarded connection is dialing")
+	}
+}
@@ -0,0 +1,133 @@
+package ssh
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// failbackProbeTimeout bounds a check whether the primary server is back
+const failbackProbeTimeout = 10 * time.Second
+
+// Endpoint is a tunnel server the agent can connect to
+type Endpoint struct {
+	Host string
+	Port int
+}
+
+func (e Endpoint) String() string {
+	return net.JoinHostPort(e.Host, strconv.Itoa(e.Port))
+}
+
+// SetFailover sets the servers to fail over to when the current one is
+// unreachable for failoverAfter, in order and then back to the primary.
+// While on a backup, the primary is checked every failbackInterval and
+// connected to again once it answers; zero or less stays on the backup.
+func (c *Client) SetFailover(backups []Endpoint, failoverAfter, failbackInterval time.Duration) {
+	c.mu.Lock()
+	c.backups = backups
+	c.failoverAfter = failoverAfter
+	c.failbackInterval = failbackInterval
+	removed := c.active > len(backups)
+	if removed {
+		c.active = 0
+		c.unreachableSince = time.Time{}
+	}
+	c.mu.Unlock()
+
+	// The backup in use is no longer configured
+	if removed {
+		c.Reconnect()
+	}
+}
+
+// targetLocked returns the server to connect to. The caller holds c.mu.
+func (c *Client) targetLocked() Endpoint {
+	if c.active > 0 && c.active <= len(c.backups) {
+		return c.backups[c.active-1]
+	}
+	return Endpoint{Host: c.serverHost, Port: c.serverPort}
+}
+
+// failOver records a failed connection attempt and moves on to the next
+// server once the current one was unreachable for long enough. It reports
+// whether it did.
+func (c *Client) failOver() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if c.unreachableSince.IsZero() {
+		c.unreachableSince = now
+	}
+	if len(c.backups) == 0 || now.Sub(c.unreachableSince) < c.failoverAfter {
+		return false
+	}
+
+	from := c.targetLocked()
+	c.active = (c.active + 1) % (len(c.backups) + 1)
+	c.unreachableSince = time.Time{}
+	c.logger.Warn(fmt.Sprintf("Server %s is unreachable, failing over to %s", from, c.targetLocked()))
+	return true
+}
+
+// watchPrimary checks whether the primary server is back while conn runs to
+// a backup, and connects to it again once it is
+func (c *Client) watchPrimary(conn *connection, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-conn.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		c.mu.Lock()
+		primary := Endpoint{Host: c.serverHost, Port: c.serverPort}
+		c.mu.Unlock()
+		if err := probeServer(primary); err != nil {
+			continue
+		}
+
+		c.mu.Lock()
+		if c.conn != conn {
+			c.mu.Unlock()
+			return
+		}
+		c.conn = nil
+		c.active = 0
+		c.unreachableSince = time.Time{}
+		c.mu.Unlock()
+
+		c.logger.Info(fmt.Sprintf("Primary server %s is back, failing back", primary))
+		conn.close()
+		c.scheduleReconnect()
+		return
+	}
+}
+
+// probeServer checks that an SSH server answers at an endpoint by reading its
+// version banner, without authenticating, so the server does not see the
+// device connect
+func probeServer(endpoint Endpoint) error {
+	conn, err := net.DialTimeout("tcp", endpoint.String(), failbackProbeTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(failbackProbeTimeout))
+	banner := make([]byte, 255)
+	n, err := conn.Read(banner)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(string(banner[:n]), "SSH-") {
+		return fmt.Errorf("%s is not an SSH server", endpoint)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package ssh
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+	"github.com/google/uuid"
+)
+
+// negotiate announces the agent build to the server and turns compression on
+// when the server supports it. Servers predating RequestFeatures reject the
+// request, which leaves every message plain JSON.
+func (conn *connection) negotiate(build protocol.BuildInfo) {
+	data, err := json.Marshal(build)
+	if err != nil {
+		conn.logger.Error("Failed to marshal agent features", err)
+		return
+	}
+
+	ok, payload, err := conn.client.SendRequest(protocol.RequestFeatures, true, data)
+	if err != nil {
+		conn.logger.Error("Failed to announce agent features", err)
+		return
+	}
+	if !ok {
+		conn.logger.Debug("Server does not negotiate features, messages are sent uncompressed")
+		return
+	}
+
+	var reply protocol.FeaturesReply
+	if err := json.Unmarshal(payload, &reply); err != nil {
+		conn.logger.Error("Failed to parse server features", err)
+		return
+	}
+	conn.compress.Store(protocol.HasFeature(reply.Features, protocol.FeatureCompression))
+}
+
+// sendRequest sends a global request. When the server supports compression
+// the payload is gzipped and, should it still not fit in a single request,
+// sent as RequestChunk requests; the reply to the last one is that of the
+// request.
+func (conn *connection) sendRequest(name string, wantReply bool, data []byte) (bool, []byte, error) {
+	if !conn.compress.Load() {
+		return conn.client.SendRequest(name, wantReply, data)
+	}
+
+	data, err := protocol.Compress(data)
+	if err != nil {
+		return false, nil, fmt.Errorf("failed to compress request: %w", err)
+	}
+	if len(data) <= protocol.MaxChunkData {
+		return conn.client.SendRequest(name, wantReply, data)
+	}
+	if len(data) > protocol.MaxChunkedSize {
+		return false, nil, protocol.ErrMessageTooLarge
+	}
+
+	chunks := protocol.SplitMessage(uuid.NewString(), name, data)
+	for i := range chunks {
+		payload, err := json.Marshal(&chunks[i])
+		if err != nil {
+			return false, nil, fmt.Errorf("failed to marshal request chunk: %w", err)
+		}
+
+		// Earlier parts are acknowledged so that a rejected message stops
+		// early
+		last := i == len(chunks)-1
+		ok, reply, err := conn.client.SendRequest(protocol.RequestChunk, wantReply || !last, payload)
+		if err != nil || last {
+			return ok, reply, err
+		}
+		if !ok {
+			return false, nil, fmt.Errorf("server rejected part %d of %s request", i+1, name)
+		}
+	}
+	return false, nil, nil
+}
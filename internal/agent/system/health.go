@@ -0,0 +1,251 @@
+package system
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+const (
+	// diskHealthInterval is how often disk health is read, smartctl may wake
+	// disks up and take a while
+	diskHealthInterval = time.Hour
+	// smartTimeout bounds reading the SMART data of one disk
+	smartTimeout = 30 * time.Second
+)
+
+// Where the kernel lists thermal zones, block devices and power supplies.
+// Containers see those of the host there too.
+const (
+	thermalZones  = "/sys/class/thermal"
+	blockDevices  = "/sys/block"
+	powerSupplies = "/sys/class/power_supply"
+)
+
+// virtualDisks are prefixes of block devices without health to read
+var virtualDisks = []string{"loop", "ram", "zram", "dm-", "md", "sr", "nbd", "fd"}
+
+// watchDiskHealth reads the health of the disks when the monitor starts and
+// every diskHealthInterval after, until it stops
+func (m *Monitor) watchDiskHealth() {
+	ticker := time.NewTicker(diskHealthInterval)
+	defer ticker.Stop()
+
+	for {
+		m.mu.RLock()
+		root := m.hostRoot
+		m.mu.RUnlock()
+
+		disks := readDiskHealth(m.ctx, root)
+		m.mu.Lock()
+		m.disks = disks
+		m.mu.Unlock()
+
+		select {
+		case <-ticker.C:
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
+
+// readTemperatures fills temperatures with the thermal zones of the device
+// in degrees Celsius, by zone type and numbered if several share a type
+func readTemperatures(temperatures map[string]float64) {
+	entries, err := os.ReadDir(thermalZones)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), "thermal_zone") {
+			continue
+		}
+		dir := filepath.Join(thermalZones, entry.Name())
+		millidegrees, err := strconv.ParseFloat(readAttribute(dir, "temp"), 64)
+		if err != nil {
+			continue
+		}
+
+		name := readAttribute(dir, "type")
+		if name == "" {
+			name = entry.Name()
+		}
+		if _, taken := temperatures[name]; taken {
+			name += "-" + strings.TrimPrefix(entry.Name(), "thermal_zone")
+		}
+		temperatures[name] = millidegrees / 1000
+	}
+}
+
+// readPowerSupplies lists the batteries, UPSes and mains supplies of the
+// device
+func readPowerSupplies() []protocol.PowerSupply {
+	entries, err := os.ReadDir(powerSupplies)
+	if err != nil {
+		return nil
+	}
+
+	var supplies []protocol.PowerSupply
+	for _, entry := range entries {
+		dir := filepath.Join(powerSupplies, entry.Name())
+		supply := protocol.PowerSupply{
+			Name:   entry.Name(),
+			Type:   readAttribute(dir, "type"),
+			Status: readAttribute(dir, "status"),
+			Health: readAttribute(dir, "health"),
+		}
+		switch supply.Type {
+		case protocol.PowerBattery, protocol.PowerUPS:
+			if capacity, err := strconv.Atoi(readAttribute(dir, "capacity")); err == nil {
+				supply.Capacity = &capacity
+			}
+		case protocol.PowerMains:
+			online := readAttribute(dir, "online") == "1"
+			supply.Online = &online
+		default:
+			// USB ports and wireless chargers
+			continue
+		}
+		supplies = append(supplies, supply)
+	}
+	return supplies
+}
+
+// readDiskHealth reads the health of the disks of the device, from SMART
+// through smartctl on the host or from the wear attributes of eMMC storage
+func readDiskHealth(ctx context.Context, root string) []protocol.DiskHealth {
+	entries, err := os.ReadDir(blockDevices)
+	if err != nil {
+		return nil
+	}
+
+	var disks []protocol.DiskHealth
+	for _, entry := range entries {
+		name := entry.Name()
+		virtual := false
+		for _, prefix := range virtualDisks {
+			virtual = virtual || strings.HasPrefix(name, prefix)
+		}
+		if virtual || strings.Contains(name, "boot") || strings.Contains(name, "rpmb") {
+			continue
+		}
+
+		var (
+			disk *protocol.DiskHealth
+			err  error
+		)
+		if strings.HasPrefix(name, "mmcblk") {
+			disk, err = readEMMCHealth(name)
+		} else {
+			disk, err = readSMART(ctx, root, name)
+		}
+		if err == nil {
+			disks = append(disks, *disk)
+		}
+	}
+	return disks
+}
+
+// readEMMCHealth reads the end of life and wear estimates eMMC storage
+// reports
+func readEMMCHealth(name string) (*protocol.DiskHealth, error) {
+	dir := filepath.Join(blockDevices, name, "device")
+	preEOL, err := strconv.ParseInt(readAttribute(dir, "pre_eol_info"), 0, 64)
+	if err != nil {
+		return nil, errors.New("no end of life information")
+	}
+
+	disk := &protocol.DiskHealth{
+		Name:    name,
+		Model:   readAttribute(dir, "name"),
+		Source:  protocol.DiskHealthEMMC,
+		Healthy: preEOL <= 1, // 2 warns of 80% of the reserved blocks used, 3 is urgent
+	}
+
+	// Estimates of the two kinds of memory in steps of 10%, 11 past the end
+	var worst int64
+	for _, value := range strings.Fields(readAttribute(dir, "life_time")) {
+		if estimate, err := strconv.ParseInt(value, 0, 64); err == nil && estimate > worst {
+			worst = estimate
+		}
+	}
+	if worst > 0 {
+		used := int(worst * 10)
+		disk.PercentUsed = &used
+	}
+	return disk, nil
+}
+
+// smartReport is the part of the JSON output of smartctl the agent reads
+type smartReport struct {
+	ModelName   string `json:"model_name"`
+	SmartStatus *struct {
+		Passed bool `json:"passed"`
+	} `json:"smart_status"`
+	Temperature struct {
+		Current *float64 `json:"current"`
+	} `json:"temperature"`
+	PowerOnTime struct {
+		Hours int `json:"hours"`
+	} `json:"power_on_time"`
+	ATAAttributes struct {
+		Table []struct {
+			ID  int `json:"id"`
+			Raw struct {
+				Value int `json:"value"`
+			} `json:"raw"`
+		} `json:"table"`
+	} `json:"ata_smart_attributes"`
+	NVMeLog *struct {
+		PercentageUsed int `json:"percentage_used"`
+	} `json:"nvme_smart_health_information_log"`
+}
+
+// readSMART reads the SMART health of a disk with smartctl on the host
+func readSMART(ctx context.Context, root, name string) (*protocol.DiskHealth, error) {
+	ctx, cancel := context.WithTimeout(ctx, smartTimeout)
+	defer cancel()
+
+	output, err := hostCommandContext(ctx, root, "smartctl", "--json", "--health", "--info", "--attributes", "/dev/"+name).Output()
+
+	// The exit status is a bit mask, bits from 3 on report what SMART found
+	var exitErr *exec.ExitError
+	if err != nil && (!errors.As(err, &exitErr) || exitErr.ExitCode()&0x7 != 0) {
+		return nil, err
+	}
+
+	var report smartReport
+	if err := json.Unmarshal(output, &report); err != nil {
+		return nil, err
+	}
+	if report.SmartStatus == nil {
+		return nil, errors.New("no SMART status")
+	}
+
+	disk := &protocol.DiskHealth{
+		Name:         name,
+		Model:        report.ModelName,
+		Source:       protocol.DiskHealthSMART,
+		Healthy:      report.SmartStatus.Passed,
+		Temperature:  report.Temperature.Current,
+		PowerOnHours: report.PowerOnTime.Hours,
+	}
+	for _, attribute := range report.ATAAttributes.Table {
+		if attribute.ID == 5 { // Reallocated sectors count
+			disk.Reallocated = attribute.Raw.Value
+		}
+	}
+	if report.NVMeLog != nil {
+		used := report.NVMeLog.PercentageUsed
+		disk.PercentUsed = &used
+	}
+	return disk, nil
+}
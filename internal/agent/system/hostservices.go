@@ -0,0 +1,171 @@
+package system
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+// serviceTimeout bounds reading the state of the monitored units
+const serviceTimeout = 10 * time.Second
+
+// restartTimeout bounds restarting a unit
+const restartTimeout = 2 * time.Minute
+
+// unitTimestamp is how systemctl show prints timestamps
+const unitTimestamp = "Mon 2006-01-02 15:04:05 MST"
+
+// unitProperties are read from systemd for each monitored unit, in the order
+// systemctl show prints them in
+var unitProperties = []string{"Id", "ActiveState", "SubState", "MainPID", "NRestarts", "StateChangeTimestamp"}
+
+// Services reports the state of the given systemd units and processes of the
+// host. Units are read with systemctl, processes by their name in /proc, the
+// first 15 characters of it as the kernel keeps them. Without systemd every
+// unit is reported inactive.
+func (m *Monitor) HostServices(units, processes []string, restartable bool) []protocol.HostService {
+	m.mu.RLock()
+	root := m.hostRoot
+	m.mu.RUnlock()
+
+	services := make([]protocol.HostService, 0, len(units)+len(processes))
+	states := readUnits(root, units)
+	for _, unit := range units {
+		status, ok := states[unit]
+		if !ok {
+			status = protocol.HostService{State: protocol.HostServiceInactive}
+		}
+		status.Name, status.Kind, status.Restartable = unit, protocol.HostServiceUnit, restartable
+		services = append(services, status)
+	}
+
+	pids := findProcesses(processes)
+	for _, name := range processes {
+		status := protocol.HostService{Name: name, Kind: protocol.HostServiceProcess, State: protocol.HostServiceInactive}
+		if pid, ok := pids[processName(name)]; ok {
+			status.State, status.PID = protocol.HostServiceActive, pid
+		}
+		services = append(services, status)
+	}
+
+	if len(services) > protocol.MaxHostServices {
+		services = services[:protocol.MaxHostServices]
+	}
+	return services
+}
+
+// RestartService restarts a systemd unit of the host
+func (m *Monitor) RestartHostService(ctx context.Context, unit string) error {
+	m.mu.RLock()
+	root := m.hostRoot
+	m.mu.RUnlock()
+
+	ctx, cancel := context.WithTimeout(ctx, restartTimeout)
+	defer cancel()
+
+	if output, err := hostCommandContext(ctx, root, "systemctl", "restart", "--", unit).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to restart %s: %v - %s", unit, err, strings.TrimSpace(string(output)))
+	}
+	m.logger.Info(fmt.Sprintf("Restarted host service %s", unit))
+	return nil
+}
+
+// readUnits reads the state of systemd units by the names they were asked
+// for, leaving out those systemd could not tell about
+func readUnits(root string, units []string) map[string]protocol.HostService {
+	states := make(map[string]protocol.HostService, len(units))
+	if len(units) == 0 {
+		return states
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), serviceTimeout)
+	defer cancel()
+
+	args := []string{"show", "--property=" + strings.Join(unitProperties, ","), "--"}
+	output, err := hostCommandContext(ctx, root, "systemctl", append(args, units...)...).Output()
+	if err != nil {
+		return states
+	}
+
+	// One block of properties per unit, in the order they were given
+	for i, block := range bytes.Split(bytes.TrimSpace(output), []byte("\n\n")) {
+		if i >= len(units) {
+			break
+		}
+		var status protocol.HostService
+		scanner := bufio.NewScanner(bytes.NewReader(block))
+		for scanner.Scan() {
+			key, value, _ := strings.Cut(scanner.Text(), "=")
+			switch key {
+			case "ActiveState":
+				status.State = value
+			case "SubState":
+				status.SubState = value
+			case "MainPID":
+				status.PID, _ = strconv.Atoi(value)
+			case "NRestarts":
+				status.Restarts, _ = strconv.Atoi(value)
+			case "StateChangeTimestamp":
+				// e.g. Sat 2026-10-17 08:12:03 UTC, empty if it never changed
+				if since, err := time.Parse(unitTimestamp, value); err == nil {
+					since = since.UTC()
+					status.Since = &since
+				}
+			}
+		}
+		if status.State != "" {
+			states[units[i]] = status
+		}
+	}
+	return states
+}
+
+// findProcesses returns the lowest PID of a running process for each of the
+// given names
+func findProcesses(names []string) map[string]int {
+	pids := make(map[string]int, len(names))
+	if len(names) == 0 {
+		return pids
+	}
+	wanted := make([]string, len(names))
+	for i, name := range names {
+		wanted[i] = processName(name)
+	}
+
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return pids
+	}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		comm := readAttribute(filepath.Join("/proc", entry.Name()), "comm")
+		if !slices.Contains(wanted, comm) {
+			continue
+		}
+		if found, ok := pids[comm]; !ok || pid < found {
+			pids[comm] = pid
+		}
+	}
+	return pids
+}
+
+// processName returns the name the kernel keeps for a process, its first 15
+// characters
+func processName(name string) string {
+	if len(name) > 15 {
+		return name[:15]
+	}
+	return name
+}
@@ -0,0 +1,59 @@
+package system
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// hardwareSource is a file identifying the device hardware
+type hardwareSource struct {
+	name     string
+	path     string
+	hostFile bool // Read below the host root, the others come from the kernel
+}
+
+// hardwareSources are read in this order, missing or unreadable ones are
+// left out. DMI covers x86 machines, the device tree serial ARM boards.
+var hardwareSources = []hardwareSource{
+	{"machine_id", "/etc/machine-id", true},
+	{"product_uuid", "/sys/class/dmi/id/product_uuid", false},
+	{"board_serial", "/sys/class/dmi/id/board_serial", false},
+	{"dt_serial", "/proc/device-tree/serial-number", false},
+}
+
+// HardwareID derives an identifier of the device hardware from the machine
+// ID and the serial numbers the firmware exposes. It is a hash, so none of
+// them leave the device, and stays the same as long as they do.
+func (m *Monitor) HardwareID() (string, error) {
+	m.mu.RLock()
+	root := m.hostRoot
+	m.mu.RUnlock()
+
+	hash := sha256.New()
+	found := 0
+	for _, source := range hardwareSources {
+		path := source.path
+		if source.hostFile {
+			path = filepath.Join(root, path)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		value := bytes.TrimSpace(bytes.TrimRight(data, "\x00"))
+		if len(value) == 0 {
+			continue
+		}
+		fmt.Fprintf(hash, "%s=%s\n", source.name, value)
+		found++
+	}
+
+	if found == 0 {
+		return "", fmt.Errorf("no machine ID or hardware serial found")
+	}
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -3,12 +3,15 @@ package system
 import (
 	"context"
 	"fmt"
+	"maps"
 	"os/exec"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/edgetainer/edgetainer/internal/shared/logging"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
 )
 
 // SystemMetrics represents various system metrics
@@ -23,6 +26,12 @@ type SystemMetrics struct {
 	Uptime      int64              `json:"uptime"`       // seconds
 	LoadAvg     [3]float64         `json:"load_avg"`     // 1, 5, 15 min load averages
 	Timestamp   time.Time          `json:"timestamp"`
+
+	// Hardware health, see protocol.HostHealth
+	Temperatures map[string]float64     `json:"temperatures,omitempty"` // degrees Celsius by thermal zone
+	Disks        []protocol.DiskHealth  `json:"disks,omitempty"`
+	Power        []protocol.PowerSupply `json:"power,omitempty"`
+	Protection   *protocol.Protection   `json:"protection,omitempty"` // Nil unless protection is enabled
 }
 
 // Monitor collects system metrics and reports them
@@ -31,8 +40,18 @@ type Monitor struct {
 	cancelFunc context.CancelFunc
 	interval   time.Duration
 	logger     *logging.Logger
+	mu         sync.RWMutex
 	metrics    *SystemMetrics
+	intervalCh chan time.Duration
+	proc       *procReader    // Owned by the collection loop
+	spare      *SystemMetrics // Filled by the next collection, then swapped with metrics
 	done       chan struct{}
+	hostRoot   string                // Where the host filesystem is mounted, see SetHostRoot
+	disks      []protocol.DiskHealth // Read every diskHealthInterval, see watchDiskHealth
+
+	protection      ProtectionSettings   // See SetProtection
+	protectionState *protocol.Protection // Result of the last check, replaced by the next one
+	protectionCh    chan struct{}        // Wakes watchProtection up when the settings change
 }
 
 // NewMonitor creates a new system monitor
@@ -44,8 +63,13 @@ func NewMonitor(ctx context.Context) (*Monitor, error) {
 		cancelFunc: cancel,
 		interval:   30 * time.Second, // Default to 30s
 		logger:     logging.WithComponent("system-monitor"),
-		metrics:    &SystemMetrics{},
+		metrics:    newSystemMetrics(),
+		intervalCh: make(chan time.Duration, 1),
+		proc:       newProcReader(),
+		spare:      newSystemMetrics(),
 		done:       make(chan struct{}),
+
+		protectionCh: make(chan struct{}, 1),
 	}, nil
 }
 
@@ -55,10 +79,18 @@ func (m *Monitor) Start() {
 
 	// Do an initial collection
 	m.collectMetrics()
+	if runtime.GOOS == "linux" {
+		go m.watchDiskHealth()
+		go m.watchProtection()
+	}
+
+	m.mu.RLock()
+	interval := m.interval
+	m.mu.RUnlock()
 
 	// Start the collection loop
 	go func() {
-		ticker := time.NewTicker(m.interval)
+		ticker := time.NewTicker(interval)
 		defer ticker.Stop()
 		defer close(m.done)
 
@@ -66,6 +98,8 @@ func (m *Monitor) Start() {
 			select {
 			case <-ticker.C:
 				m.collectMetrics()
+			case interval := <-m.intervalCh:
+				ticker.Reset(interval)
 			case <-m.ctx.Done():
 				m.logger.Info("System monitor stopping")
 				return
@@ -74,26 +108,77 @@ func (m *Monitor) Start() {
 	}()
 }
 
+// SetInterval changes the collection interval, taking effect immediately
+func (m *Monitor) SetInterval(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	m.mu.Lock()
+	started := m.interval
+	m.interval = interval
+	m.mu.Unlock()
+
+	if started == interval {
+		return
+	}
+
+	// Replace any pending change that has not been picked up yet
+	select {
+	case <-m.intervalCh:
+	default:
+	}
+	m.intervalCh <- interval
+
+	m.logger.Info(fmt.Sprintf("Metrics collection interval set to %s", interval))
+}
+
 // Stop halts the monitoring process
 func (m *Monitor) Stop() {
 	m.cancelFunc()
 	<-m.done
+	m.proc.close()
 }
 
 // GetMetrics returns the current system metrics
 func (m *Monitor) GetMetrics() *SystemMetrics {
-	// Return a copy to avoid race conditions
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	// Return a copy, the maps are reused by later collections
 	metrics := *m.metrics
+	metrics.DiskUsage = maps.Clone(m.metrics.DiskUsage)
+	metrics.DiskTotal = maps.Clone(m.metrics.DiskTotal)
+	metrics.DiskFree = maps.Clone(m.metrics.DiskFree)
+	metrics.Temperatures = maps.Clone(m.metrics.Temperatures)
 	return &metrics
 }
 
-// collectMetrics gathers system information
+// newSystemMetrics creates empty metrics
+func newSystemMetrics() *SystemMetrics {
+	return &SystemMetrics{
+		DiskUsage:    make(map[string]float64),
+		DiskTotal:    make(map[string]int64),
+		DiskFree:     make(map[string]int64),
+		Temperatures: make(map[string]float64),
+	}
+}
+
+// collectMetrics gathers system information. Collections alternate between
+// two sets of metrics, so the maps of the previous one are reused rather than
+// allocated anew.
 func (m *Monitor) collectMetrics() {
-	metrics := &SystemMetrics{
-		DiskUsage: make(map[string]float64),
-		DiskTotal: make(map[string]int64),
-		DiskFree:  make(map[string]int64),
-		Timestamp: time.Now(),
+	metrics := m.spare
+	clear(metrics.DiskUsage)
+	clear(metrics.DiskTotal)
+	clear(metrics.DiskFree)
+	clear(metrics.Temperatures)
+	*metrics = SystemMetrics{
+		DiskUsage:    metrics.DiskUsage,
+		DiskTotal:    metrics.DiskTotal,
+		DiskFree:     metrics.DiskFree,
+		Temperatures: metrics.Temperatures,
+		Timestamp:    time.Now(),
 	}
 
 	// Collection methods depend on the OS
@@ -113,73 +198,26 @@ func (m *Monitor) collectMetrics() {
 	}
 
 	// Update the metrics
-	m.metrics = metrics
+	m.mu.Lock()
+	m.metrics, m.spare = metrics, m.metrics
+	m.mu.Unlock()
 
 	m.logger.Debug(fmt.Sprintf("Collected system metrics: CPU: %.1f%%, Mem: %.1f%%",
 		metrics.CPUUsage, metrics.MemoryUsage))
 }
 
-// collectLinuxMetrics gathers system metrics on Linux
+// collectLinuxMetrics gathers system metrics on Linux from /proc, and the
+// hardware health from /sys
 func (m *Monitor) collectLinuxMetrics(metrics *SystemMetrics) error {
-	// Simplified implementation - in a real agent, use proper Linux stats APIs
-	// or libraries like github.com/shirou/gopsutil
+	readTemperatures(metrics.Temperatures)
+	metrics.Power = readPowerSupplies()
 
-	// Simulate CPU usage collection
-	cmd := exec.Command("bash", "-c", "top -bn1 | grep 'Cpu(s)' | sed 's/.*, *\\([0-9.]*\\)%* id.*/\\1/' | awk '{print 100 - $1}'")
-	output, err := cmd.Output()
-	if err == nil {
-		fmt.Sscanf(strings.TrimSpace(string(output)), "%f", &metrics.CPUUsage)
-	}
-
-	// Simulate memory usage collection
-	cmd = exec.Command("bash", "-c", "free | grep Mem | awk '{print $3/$2 * 100.0, $2, $4}'")
-	output, err = cmd.Output()
-	if err == nil {
-		fmt.Sscanf(strings.TrimSpace(string(output)), "%f %d %d",
-			&metrics.MemoryUsage, &metrics.MemoryTotal, &metrics.MemoryFree)
-	}
-
-	// Simulate disk usage collection
-	cmd = exec.Command("bash", "-c", "df -P | grep -v Filesystem")
-	output, err = cmd.Output()
-	if err == nil {
-		lines := strings.Split(string(output), "\n")
-		for _, line := range lines {
-			if line == "" {
-				continue
-			}
-
-			var device, mountpoint string
-			var total, used, available int64
-			var usePct float64
-
-			fmt.Sscanf(line, "%s %d %d %d %f%% %s",
-				&device, &total, &used, &available, &usePct, &mountpoint)
+	m.mu.RLock()
+	metrics.Disks = m.disks
+	metrics.Protection = m.protectionState
+	m.mu.RUnlock()
 
-			metrics.DiskUsage[mountpoint] = usePct
-			metrics.DiskTotal[mountpoint] = total * 1024 // df reports in KB
-			metrics.DiskFree[mountpoint] = available * 1024
-		}
-	}
-
-	// Simulate uptime collection
-	cmd = exec.Command("bash", "-c", "cat /proc/uptime | awk '{print $1}'")
-	output, err = cmd.Output()
-	if err == nil {
-		var uptime float64
-		fmt.Sscanf(strings.TrimSpace(string(output)), "%f", &uptime)
-		metrics.Uptime = int64(uptime)
-	}
-
-	// Simulate load average collection
-	cmd = exec.Command("bash", "-c", "cat /proc/loadavg | awk '{print $1, $2, $3}'")
-	output, err = cmd.Output()
-	if err == nil {
-		fmt.Sscanf(strings.TrimSpace(string(output)), "%f %f %f",
-			&metrics.LoadAvg[0], &metrics.LoadAvg[1], &metrics.LoadAvg[2])
-	}
-
-	return nil
+	return m.proc.collect(metrics)
 }
 
 // collectDarwinMetrics gathers system metrics on macOS
@@ -0,0 +1,184 @@
+package system
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+const (
+	// timesyncdDropIn overrides the servers of systemd-timesyncd
+	timesyncdDropIn = "/etc/systemd/timesyncd.conf.d/edgetainer.conf"
+
+	// The servers set for chrony are kept between these markers, the servers
+	// of the distribution are commented out with chronyDisabled
+	chronyBegin    = "# BEGIN edgetainer"
+	chronyEnd      = "# END edgetainer"
+	chronyDisabled = "#edgetainer: "
+)
+
+var (
+	chronyConfigs     = []string{"/etc/chrony/chrony.conf", "/etc/chrony.conf"}
+	timesyncdBinaries = []string{"/usr/lib/systemd/systemd-timesyncd", "/lib/systemd/systemd-timesyncd"}
+)
+
+// SetHostRoot sets where the host filesystem is mounted, empty when the agent
+// runs on the host itself
+func (m *Monitor) SetHostRoot(root string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.hostRoot = root
+}
+
+// ConfigureNTP points the time service of the host at the given servers, or
+// restores the servers it was configured with if there are none. chrony and
+// systemd-timesyncd are supported. It returns the service configured and
+// whether its configuration changed.
+func (m *Monitor) ConfigureNTP(servers []string) (string, bool, error) {
+	if err := protocol.ValidateNTPServers(servers); err != nil {
+		return "", false, err
+	}
+
+	m.mu.RLock()
+	root := m.hostRoot
+	m.mu.RUnlock()
+
+	for _, path := range chronyConfigs {
+		if _, err := os.Stat(filepath.Join(root, path)); err != nil {
+			continue
+		}
+
+		changed, err := configureChrony(filepath.Join(root, path), servers)
+		if err != nil || !changed {
+			return "chrony", false, err
+		}
+
+		// The unit is called chronyd on Fedora and chrony on Debian
+		if _, err := hostCommand(root, "systemctl", "restart", "chronyd").CombinedOutput(); err != nil {
+			if output, err := hostCommand(root, "systemctl", "restart", "chrony").CombinedOutput(); err != nil {
+				return "chrony", true, fmt.Errorf("failed to restart chrony: %v - %s", err, string(output))
+			}
+		}
+		m.logger.Info(fmt.Sprintf("Configured chrony with NTP servers %v", servers))
+		return "chrony", true, nil
+	}
+
+	for _, path := range timesyncdBinaries {
+		if _, err := os.Stat(filepath.Join(root, path)); err != nil {
+			continue
+		}
+
+		changed, err := configureTimesyncd(filepath.Join(root, timesyncdDropIn), servers)
+		if err != nil || !changed {
+			return "systemd-timesyncd", false, err
+		}
+
+		if output, err := hostCommand(root, "systemctl", "restart", "systemd-timesyncd").CombinedOutput(); err != nil {
+			return "systemd-timesyncd", true, fmt.Errorf("failed to restart systemd-timesyncd: %v - %s", err, string(output))
+		}
+		m.logger.Info(fmt.Sprintf("Configured systemd-timesyncd with NTP servers %v", servers))
+		return "systemd-timesyncd", true, nil
+	}
+
+	return "", false, fmt.Errorf("neither chrony nor systemd-timesyncd was found on the host")
+}
+
+// configureChrony rewrites a chrony configuration file to use the given
+// servers instead of its own, or restores its own servers if there are none
+func configureChrony(path string, servers []string) (bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	var lines []string
+	managed := false
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		switch {
+		case line == chronyBegin:
+			managed = true
+			continue
+		case line == chronyEnd:
+			managed = false
+			continue
+		case managed:
+			continue
+		}
+
+		line = strings.TrimPrefix(line, chronyDisabled)
+		if fields := strings.Fields(line); len(servers) > 0 && len(fields) > 0 && (fields[0] == "server" || fields[0] == "pool") {
+			line = chronyDisabled + line
+		}
+		lines = append(lines, line)
+	}
+
+	if len(servers) > 0 {
+		lines = append(lines, chronyBegin)
+		for _, server := range servers {
+			lines = append(lines, "server "+server+" iburst")
+		}
+		lines = append(lines, chronyEnd)
+	}
+
+	content := strings.Join(lines, "\n") + "\n"
+	if content == string(data) {
+		return false, nil
+	}
+	if err := os.WriteFile(path, []byte(content), info.Mode().Perm()); err != nil {
+		return false, fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return true, nil
+}
+
+// configureTimesyncd writes a drop-in setting the servers of
+// systemd-timesyncd, or removes it if there are none
+func configureTimesyncd(path string, servers []string) (bool, error) {
+	current, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	if len(servers) == 0 {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return true, os.Remove(path)
+	}
+
+	content := "# Managed by edgetainer\n[Time]\nNTP=" + strings.Join(servers, " ") + "\n"
+	if content == string(current) {
+		return false, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return false, fmt.Errorf("failed to create %s: %w", filepath.Dir(path), err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		return false, fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return true, nil
+}
+
+// hostCommand runs a command on the host, inside the host filesystem if it is
+// mounted into the agent container
+func hostCommand(root, name string, args ...string) *exec.Cmd {
+	return hostCommandContext(context.Background(), root, name, args...)
+}
+
+// hostCommandContext is hostCommand killed when ctx is done
+func hostCommandContext(ctx context.Context, root, name string, args ...string) *exec.Cmd {
+	if root == "" || root == "/" {
+		return exec.CommandContext(ctx, name, args...)
+	}
+	return exec.CommandContext(ctx, "chroot", append([]string{root, name}, args...)...)
+}
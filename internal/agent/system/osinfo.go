@@ -0,0 +1,57 @@
+package system
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+// OSInfo returns the operating system of the host from its os-release and
+// the running kernel
+func (m *Monitor) OSInfo() (*protocol.OSInfo, error) {
+	m.mu.RLock()
+	root := m.hostRoot
+	m.mu.RUnlock()
+
+	data, err := os.ReadFile(filepath.Join(root, "/etc/os-release"))
+	if err != nil {
+		if data, err = os.ReadFile(filepath.Join(root, "/usr/lib/os-release")); err != nil {
+			return nil, fmt.Errorf("failed to read os-release: %w", err)
+		}
+	}
+
+	info := &protocol.OSInfo{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		key, value, found := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !found {
+			continue
+		}
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		} else {
+			value = strings.Trim(value, `'"`)
+		}
+		switch key {
+		case "ID":
+			info.ID = value
+		case "VERSION_ID":
+			info.VersionID = value
+		case "PRETTY_NAME":
+			info.Name = value
+		}
+	}
+
+	// The kernel is shared with containers, so no need for the host root
+	if output, err := exec.Command("uname", "-r").Output(); err == nil {
+		info.Kernel = strings.TrimSpace(string(output))
+	}
+	return info, nil
+}
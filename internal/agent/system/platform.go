@@ -0,0 +1,25 @@
+package system
+
+import (
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+// Platform returns the platform of the images the device runs natively, as
+// Docker names it, e.g. linux/arm/v7. The machine name of the kernel tells
+// ARM variants apart where the architecture the agent was built for does
+// not; the latter is used if the kernel reports one Docker does not know.
+func Platform() string {
+	if output, err := exec.Command("uname", "-m").Output(); err == nil {
+		if platform, err := protocol.NormalizePlatform(strings.TrimSpace(string(output))); err == nil {
+			return platform
+		}
+	}
+	if platform, err := protocol.NormalizePlatform(runtime.GOARCH); err == nil {
+		return platform
+	}
+	return runtime.GOOS + "/" + runtime.GOARCH
+}
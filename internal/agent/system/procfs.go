@@ -0,0 +1,266 @@
+package system
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// procReader reads system metrics from /proc. The files stay open and are
+// re-read from the start, which procfs answers with fresh contents, and the
+// read buffer, field slices and list of mounted filesystems are reused
+// between collections, so a collection allocates next to nothing once the
+// first one sized them.
+type procReader struct {
+	files  map[string]*os.File
+	buf    []byte
+	fields [][]byte
+
+	cpuTotal uint64 // Jiffies of the previous CPU sample, zero before the first
+	cpuIdle  uint64
+
+	mountTable []byte   // Contents of /proc/mounts when mounts was built
+	mounts     []string // Mount points of the filesystems in mountTable
+}
+
+// newProcReader creates a reader with a buffer large enough for the files it
+// usually reads
+func newProcReader() *procReader {
+	return &procReader{
+		files:  make(map[string]*os.File),
+		buf:    make([]byte, 0, 8192),
+		fields: make([][]byte, 0, 16),
+	}
+}
+
+// collect fills metrics from /proc. CPU usage is measured since the previous
+// collection, or since boot for the first one.
+func (p *procReader) collect(metrics *SystemMetrics) error {
+	if err := p.collectCPU(metrics); err != nil {
+		return err
+	}
+	if err := p.collectMemory(metrics); err != nil {
+		return err
+	}
+
+	if data, err := p.read("/proc/uptime"); err == nil {
+		if p.fields = splitFields(p.fields, data); len(p.fields) > 0 {
+			uptime, _ := strconv.ParseFloat(string(p.fields[0]), 64)
+			metrics.Uptime = int64(uptime)
+		}
+	}
+
+	if data, err := p.read("/proc/loadavg"); err == nil {
+		p.fields = splitFields(p.fields, data)
+		for i := 0; i < len(metrics.LoadAvg) && i < len(p.fields); i++ {
+			metrics.LoadAvg[i], _ = strconv.ParseFloat(string(p.fields[i]), 64)
+		}
+	}
+
+	p.collectDisks(metrics)
+	return nil
+}
+
+// collectCPU sets the CPU usage from the first line of /proc/stat
+func (p *procReader) collectCPU(metrics *SystemMetrics) error {
+	data, err := p.read("/proc/stat")
+	if err != nil {
+		return fmt.Errorf("failed to read CPU statistics: %w", err)
+	}
+	line, _ := nextLine(data)
+	p.fields = splitFields(p.fields, line)
+	if len(p.fields) < 5 || string(p.fields[0]) != "cpu" {
+		return fmt.Errorf("unexpected CPU statistics")
+	}
+
+	// user nice system idle iowait irq softirq steal, guest time is already
+	// part of user
+	var total, idle uint64
+	for i := 1; i < len(p.fields) && i <= 8; i++ {
+		value, _ := strconv.ParseUint(string(p.fields[i]), 10, 64)
+		total += value
+		if i == 4 || i == 5 {
+			idle += value
+		}
+	}
+
+	deltaTotal, deltaIdle := total-p.cpuTotal, idle-p.cpuIdle
+	if total > p.cpuTotal && deltaTotal > 0 {
+		metrics.CPUUsage = 100 * float64(deltaTotal-deltaIdle) / float64(deltaTotal)
+	}
+	p.cpuTotal, p.cpuIdle = total, idle
+	return nil
+}
+
+// collectMemory sets the memory figures from /proc/meminfo. Memory in use
+// excludes caches the kernel can reclaim, like free(1) does.
+func (p *procReader) collectMemory(metrics *SystemMetrics) error {
+	data, err := p.read("/proc/meminfo")
+	if err != nil {
+		return fmt.Errorf("failed to read memory statistics: %w", err)
+	}
+
+	var total, free, available int64 = 0, 0, -1
+	for len(data) > 0 {
+		var line []byte
+		line, data = nextLine(data)
+		p.fields = splitFields(p.fields, line)
+		if len(p.fields) < 2 {
+			continue
+		}
+
+		value, _ := strconv.ParseInt(string(p.fields[1]), 10, 64)
+		switch string(p.fields[0]) {
+		case "MemTotal:":
+			total = value * 1024
+		case "MemFree:":
+			free = value * 1024
+		case "MemAvailable:":
+			available = value * 1024
+		}
+	}
+
+	// Kernels before 3.14 do not report MemAvailable
+	if available < 0 {
+		available = free
+	}
+
+	metrics.MemoryTotal = total
+	metrics.MemoryFree = free
+	if total > 0 {
+		metrics.MemoryUsage = 100 * float64(total-available) / float64(total)
+	}
+	return nil
+}
+
+// collectDisks sets the usage of every mounted filesystem with a size, like
+// df(1) lists them
+func (p *procReader) collectDisks(metrics *SystemMetrics) {
+	p.refreshMounts()
+
+	for _, mount := range p.mounts {
+		total, free, usage, err := diskUsage(mount)
+		if err != nil || total == 0 {
+			continue
+		}
+		metrics.DiskUsage[mount] = usage
+		metrics.DiskTotal[mount] = total
+		metrics.DiskFree[mount] = free
+	}
+}
+
+// refreshMounts rebuilds the list of mount points when /proc/mounts changed
+// since the last collection
+func (p *procReader) refreshMounts() {
+	data, err := p.read("/proc/mounts")
+	if err != nil || bytes.Equal(data, p.mountTable) {
+		return
+	}
+	p.mountTable = append(p.mountTable[:0], data...)
+
+	p.mounts = p.mounts[:0]
+	seen := make(map[string]bool)
+	for len(data) > 0 {
+		var line []byte
+		line, data = nextLine(data)
+		p.fields = splitFields(p.fields, line)
+		if len(p.fields) < 2 {
+			continue
+		}
+
+		mount := unescapeMount(p.fields[1])
+		if !seen[mount] {
+			seen[mount] = true
+			p.mounts = append(p.mounts, mount)
+		}
+	}
+}
+
+// read reads a whole file into the reused buffer. The data is only valid
+// until the next read.
+func (p *procReader) read(path string) ([]byte, error) {
+	f, ok := p.files[path]
+	if !ok {
+		var err error
+		if f, err = os.Open(path); err != nil {
+			return nil, err
+		}
+		p.files[path] = f
+	}
+
+	p.buf = p.buf[:0]
+	for {
+		if len(p.buf) == cap(p.buf) {
+			p.buf = append(p.buf, 0)[:len(p.buf)]
+		}
+		n, err := f.ReadAt(p.buf[len(p.buf):cap(p.buf)], int64(len(p.buf)))
+		p.buf = p.buf[:len(p.buf)+n]
+		if err == io.EOF {
+			return p.buf, nil
+		}
+		if err != nil {
+			f.Close()
+			delete(p.files, path)
+			return nil, err
+		}
+	}
+}
+
+// close closes the files kept open
+func (p *procReader) close() {
+	for path, f := range p.files {
+		f.Close()
+		delete(p.files, path)
+	}
+}
+
+// nextLine splits the first line off data
+func nextLine(data []byte) (line, rest []byte) {
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		return data[:i], data[i+1:]
+	}
+	return data, nil
+}
+
+// splitFields splits a line at spaces and tabs into dst, reusing its storage
+func splitFields(dst [][]byte, line []byte) [][]byte {
+	dst = dst[:0]
+	start := -1
+	for i, c := range line {
+		if c == ' ' || c == '\t' {
+			if start >= 0 {
+				dst = append(dst, line[start:i])
+				start = -1
+			}
+		} else if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		dst = append(dst, line[start:])
+	}
+	return dst
+}
+
+// unescapeMount decodes the octal escapes /proc/mounts uses for spaces and
+// other special characters in mount points
+func unescapeMount(field []byte) string {
+	if bytes.IndexByte(field, '\\') < 0 {
+		return string(field)
+	}
+
+	out := make([]byte, 0, len(field))
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+3 < len(field) {
+			if c, err := strconv.ParseUint(string(field[i+1:i+4]), 8, 8); err == nil {
+				out = append(out, byte(c))
+				i += 3
+				continue
+			}
+		}
+		out = append(out, field[i])
+	}
+	return string(out)
+}
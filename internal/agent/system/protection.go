@@ -0,0 +1,378 @@
+package system
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+const (
+	// protectionDropIn is the name of the drop-ins protecting units, next to
+	// those of the distribution and the administrator
+	protectionDropIn = "50-edgetainer-protection.conf"
+	// protectionSlice holds the agent and Docker. Memory protection of a unit
+	// only takes effect up to that of its parents.
+	protectionSlice = "system.slice"
+	// protectionTimeout bounds a check and repair of the protection
+	protectionTimeout = 30 * time.Second
+	// DefaultProtectionInterval is how often the protection is checked
+	DefaultProtectionInterval = 5 * time.Minute
+)
+
+// containerID finds the ID of the container the agent runs in among the
+// files Docker mounts into it
+var containerID = regexp.MustCompile(`/containers/([0-9a-f]{64})/`)
+
+// ProtectionSettings are the resources guaranteed to the agent and the Docker
+// daemon so that applications cannot take down remote management
+type ProtectionSettings struct {
+	Enabled        bool
+	AgentUnit      string        // Unit running the agent, skipped if the host has none
+	DockerUnit     string        // Unit running the Docker daemon
+	AgentMemoryMB  int           // MemoryMin of the agent, the memory the kernel does not reclaim from it
+	DockerMemoryMB int           // MemoryMin of the Docker daemon
+	CPUWeight      int           // CPUWeight of both, systemd's default is 100
+	OOMScoreAdjust int           // Of both, -1000 keeps the OOM killer away entirely
+	Interval       time.Duration // Between checks, drift found is repaired
+}
+
+// unitProtection is the protection of one systemd unit
+type unitProtection struct {
+	unit      string
+	section   string // Section of the drop-in, empty for transient units that have none
+	memoryMin int64  // Bytes
+	cpuWeight int    // 0 leaves it alone
+	oomScore  bool   // Adjust the OOM score of the main process
+}
+
+// SetProtection sets the resources guaranteed to the agent and the Docker
+// daemon, checked right away and every interval after. Disabling it removes
+// the drop-ins; the properties in effect stay until the units restart.
+func (m *Monitor) SetProtection(settings ProtectionSettings) {
+	if settings.Interval <= 0 {
+		settings.Interval = DefaultProtectionInterval
+	}
+
+	m.mu.Lock()
+	m.protection = settings
+	m.mu.Unlock()
+
+	select {
+	case m.protectionCh <- struct{}{}:
+	default:
+	}
+}
+
+// watchProtection checks and repairs the protection whenever the settings
+// change and every interval while it is enabled, until the monitor stops
+func (m *Monitor) watchProtection() {
+	// The settings set before the monitor started are checked right away
+	select {
+	case <-m.protectionCh:
+	default:
+	}
+
+	repairs := 0
+	for {
+		m.mu.RLock()
+		settings, root := m.protection, m.hostRoot
+		m.mu.RUnlock()
+
+		var wait <-chan time.Time
+		if settings.Enabled {
+			state := m.protect(root, settings)
+			if len(state.Drift) > 0 {
+				repairs++
+			}
+			state.Repairs = repairs
+
+			m.mu.Lock()
+			m.protectionState = state
+			m.mu.Unlock()
+			wait = time.After(settings.Interval)
+		} else {
+			m.mu.Lock()
+			m.protectionState = nil
+			m.mu.Unlock()
+			m.unprotect(root, settings)
+		}
+
+		select {
+		case <-wait:
+		case <-m.protectionCh:
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
+
+// protect checks the protection of the agent and Docker, repairs what is
+// off and checks again
+func (m *Monitor) protect(root string, settings ProtectionSettings) *protocol.Protection {
+	ctx, cancel := context.WithTimeout(m.ctx, protectionTimeout)
+	defer cancel()
+
+	units := protectedUnits(settings)
+	state := &protocol.Protection{CheckedAt: time.Now()}
+	for _, unit := range units {
+		state.Units = append(state.Units, unit.unit)
+	}
+
+	drift, err := checkProtection(ctx, root, units, settings.OOMScoreAdjust, true)
+	state.Drift = drift
+	if err == nil && len(drift) > 0 {
+		m.logger.Warn(fmt.Sprintf("Repaired protection of the agent and Docker: %s", strings.Join(drift, ", ")))
+		var remaining []string
+		if remaining, err = checkProtection(ctx, root, units, settings.OOMScoreAdjust, false); err == nil && len(remaining) > 0 {
+			err = fmt.Errorf("still off after repair: %s", strings.Join(remaining, ", "))
+		}
+	}
+	if err != nil {
+		m.logger.Error("Failed to protect the agent and Docker", err)
+		state.Error = err.Error()
+		return state
+	}
+	state.OK = true
+	return state
+}
+
+// unprotect removes the drop-ins of the protection, if there are any
+func (m *Monitor) unprotect(root string, settings ProtectionSettings) {
+	removed := false
+	for _, unit := range protectedUnits(settings) {
+		if unit.section == "" {
+			continue
+		}
+		if err := os.Remove(dropInPath(root, unit.unit)); err == nil {
+			removed = true
+		}
+	}
+	if !removed {
+		return
+	}
+
+	if output, err := hostCommand(root, "systemctl", "daemon-reload").CombinedOutput(); err != nil {
+		m.logger.Error(fmt.Sprintf("Failed to reload systemd: %s", strings.TrimSpace(string(output))), err)
+		return
+	}
+	m.logger.Info("Removed protection of the agent and Docker, it stays in effect until they restart")
+}
+
+// protectedUnits returns the units protected by settings: Docker, the agent's
+// unit and the container the agent runs in if any, and their slice holding
+// the memory of both
+func protectedUnits(settings ProtectionSettings) []unitProtection {
+	agentMemory, dockerMemory := int64(settings.AgentMemoryMB)<<20, int64(settings.DockerMemoryMB)<<20
+	units := []unitProtection{
+		{unit: protectionSlice, section: "Slice", memoryMin: agentMemory + dockerMemory},
+		{unit: settings.DockerUnit, section: "Service", memoryMin: dockerMemory, cpuWeight: settings.CPUWeight, oomScore: true},
+	}
+	if settings.AgentUnit != "" {
+		units = append(units, unitProtection{unit: settings.AgentUnit, section: "Service", memoryMin: agentMemory, cpuWeight: settings.CPUWeight, oomScore: true})
+	}
+	if own := ownUnit(); own != "" && own != settings.AgentUnit {
+		// A container's scope is transient, it is protected anew when the
+		// agent restarts
+		units = append(units, unitProtection{unit: own, memoryMin: agentMemory, cpuWeight: settings.CPUWeight})
+	}
+	return units
+}
+
+// checkProtection returns what is off in the protection of units, repairing
+// it with repair. Units the host does not have are skipped. The agent's own
+// OOM score is adjusted directly, since the container it may run in is not
+// the main process of a unit.
+func checkProtection(ctx context.Context, root string, units []unitProtection, oomScore int, repair bool) ([]string, error) {
+	var drift []string
+
+	names := make([]string, len(units))
+	for i, unit := range units {
+		names[i] = unit.unit
+	}
+	properties, err := showUnits(ctx, root, names)
+	if err != nil {
+		return drift, err
+	}
+
+	// Drop-ins apply the protection whenever the units start
+	reload := false
+	for i, unit := range units {
+		if unit.section == "" || properties[i]["LoadState"] != "loaded" {
+			continue
+		}
+		file, want := dropInPath(root, unit.unit), dropIn(unit, oomScore)
+		if current, err := os.ReadFile(file); err == nil && string(current) == want {
+			continue
+		}
+		drift = append(drift, unit.unit+" drop-in")
+		if !repair {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return drift, fmt.Errorf("failed to create drop-in directory of %s: %w", unit.unit, err)
+		}
+		if err := os.WriteFile(file, []byte(want), 0644); err != nil {
+			return drift, fmt.Errorf("failed to write drop-in of %s: %w", unit.unit, err)
+		}
+		reload = true
+	}
+	if reload {
+		if output, err := hostCommandContext(ctx, root, "systemctl", "daemon-reload").CombinedOutput(); err != nil {
+			return drift, fmt.Errorf("failed to reload systemd: %v - %s", err, strings.TrimSpace(string(output)))
+		}
+		if properties, err = showUnits(ctx, root, names); err != nil {
+			return drift, err
+		}
+	}
+
+	// The running units, which systemctl set-property by someone else may
+	// have changed
+	for i, unit := range units {
+		props := properties[i]
+		if props["LoadState"] != "loaded" {
+			continue
+		}
+
+		var set []string
+		if memoryMin, _ := strconv.ParseInt(props["MemoryMin"], 10, 64); memoryMin != unit.memoryMin {
+			drift = append(drift, unit.unit+" MemoryMin")
+			set = append(set, "MemoryMin="+strconv.FormatInt(unit.memoryMin, 10))
+		}
+		if unit.cpuWeight > 0 {
+			if weight, _ := strconv.Atoi(props["CPUWeight"]); weight != unit.cpuWeight {
+				drift = append(drift, unit.unit+" CPUWeight")
+				set = append(set, "CPUWeight="+strconv.Itoa(unit.cpuWeight))
+			}
+		}
+		if len(set) > 0 && repair {
+			args := append([]string{"set-property", "--runtime", "--", unit.unit}, set...)
+			if output, err := hostCommandContext(ctx, root, "systemctl", args...).CombinedOutput(); err != nil {
+				return drift, fmt.Errorf("failed to set properties of %s: %v - %s", unit.unit, err, strings.TrimSpace(string(output)))
+			}
+		}
+
+		// The OOM score is only read when a process starts
+		if pid := props["MainPID"]; unit.oomScore && pid != "" && pid != "0" {
+			file := filepath.Join(root, "/proc", pid, "oom_score_adj")
+			ok, err := adjustOOMScore(file, oomScore, repair)
+			if err != nil {
+				return drift, fmt.Errorf("failed to adjust OOM score of %s: %w", unit.unit, err)
+			}
+			if !ok {
+				drift = append(drift, unit.unit+" OOMScoreAdjust")
+			}
+		}
+	}
+
+	ok, err := adjustOOMScore("/proc/self/oom_score_adj", oomScore, repair)
+	if err != nil {
+		return drift, fmt.Errorf("failed to adjust OOM score of the agent: %w", err)
+	}
+	if !ok {
+		drift = append(drift, "agent OOMScoreAdjust")
+	}
+	return drift, nil
+}
+
+// showUnits reads the properties of systemd units that the protection sets,
+// in the order of units
+func showUnits(ctx context.Context, root string, units []string) ([]map[string]string, error) {
+	args := append([]string{"show", "--property=LoadState,MemoryMin,CPUWeight,MainPID", "--"}, units...)
+	output, err := hostCommandContext(ctx, root, "systemctl", args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read units: %w", err)
+	}
+
+	properties := make([]map[string]string, len(units))
+	blocks := bytes.Split(bytes.TrimSpace(output), []byte("\n\n"))
+	for i := range units {
+		properties[i] = make(map[string]string)
+		if i >= len(blocks) {
+			continue
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(blocks[i]))
+		for scanner.Scan() {
+			key, value, _ := strings.Cut(scanner.Text(), "=")
+			properties[i][key] = value
+		}
+	}
+	return properties, nil
+}
+
+// adjustOOMScore reports whether the OOM score adjustment in file is score,
+// writing it if not and repair is set
+func adjustOOMScore(file string, score int, repair bool) (bool, error) {
+	current, err := os.ReadFile(file)
+	if err != nil {
+		return false, err
+	}
+	if strings.TrimSpace(string(current)) == strconv.Itoa(score) {
+		return true, nil
+	}
+	if repair {
+		return false, os.WriteFile(file, []byte(strconv.Itoa(score)), 0644)
+	}
+	return false, nil
+}
+
+// dropIn returns the drop-in protecting a unit
+func dropIn(unit unitProtection, oomScore int) string {
+	var b strings.Builder
+	b.WriteString("# Managed by the edgetainer agent, changes are reverted\n")
+	fmt.Fprintf(&b, "[%s]\n", unit.section)
+	fmt.Fprintf(&b, "MemoryMin=%d\n", unit.memoryMin)
+	if unit.cpuWeight > 0 {
+		fmt.Fprintf(&b, "CPUWeight=%d\n", unit.cpuWeight)
+	}
+	if unit.oomScore {
+		fmt.Fprintf(&b, "OOMScoreAdjust=%d\n", oomScore)
+	}
+	return b.String()
+}
+
+// dropInPath returns where the drop-in protecting a unit is written
+func dropInPath(root, unit string) string {
+	return filepath.Join(root, "/etc/systemd/system", unit+".d", protectionDropIn)
+}
+
+// ownUnit returns the systemd unit the agent runs in: its service, or the
+// scope of the container it runs in. Empty if it cannot be told, e.g. with
+// Docker's cgroupfs driver.
+func ownUnit() string {
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if cgroup, ok := strings.CutPrefix(line, "0::"); ok {
+			name := path.Base(cgroup)
+			if strings.HasSuffix(name, ".service") || strings.HasSuffix(name, ".scope") {
+				return name
+			}
+		}
+	}
+
+	// A private cgroup namespace hides the path, the scope is named after
+	// the container
+	if _, err := os.Stat("/.dockerenv"); err != nil {
+		return ""
+	}
+	mounts, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return ""
+	}
+	if match := containerID.FindSubmatch(mounts); match != nil {
+		return "docker-" + string(match[1]) + ".scope"
+	}
+	return ""
+}
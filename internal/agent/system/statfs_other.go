@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package system
+
+import "fmt"
+
+// diskUsage is not supported on this platform
+func diskUsage(path string) (total, free int64, usage float64, err error) {
+	return 0, 0, 0, fmt.Errorf("disk usage is not supported on this platform")
+}
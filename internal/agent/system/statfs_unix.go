@@ -0,0 +1,21 @@
+//go:build linux || darwin
+
+package system
+
+import "syscall"
+
+// diskUsage returns the size and space available to unprivileged users of the
+// filesystem mounted at path, and the percentage in use as df(1) reports it
+func diskUsage(path string) (total, free int64, usage float64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, 0, 0, err
+	}
+
+	blockSize := int64(st.Bsize)
+	used := st.Blocks - st.Bfree
+	if used+st.Bavail > 0 {
+		usage = 100 * float64(used) / float64(used+st.Bavail)
+	}
+	return int64(st.Blocks) * blockSize, int64(st.Bavail) * blockSize, usage, nil
+}
@@ -0,0 +1,72 @@
+package system
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/edgetainer/edgetainer/internal/shared/logging"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+// HostTimezone returns the timezone the host is configured with
+func (m *Monitor) HostTimezone() (string, error) {
+	m.mu.RLock()
+	root := m.hostRoot
+	m.mu.RUnlock()
+
+	output, err := hostCommand(root, "timedatectl", "show", "--property=Timezone", "--value").Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to read timezone: %w", err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// ConfigureTimezone sets the timezone and locale of the host, leaving empty
+// values and settings that are already in effect alone. The agent logs in the
+// new timezone afterwards. It reports whether anything changed.
+func (m *Monitor) ConfigureTimezone(timezone, locale string) (bool, error) {
+	if err := protocol.ValidateTimezone(timezone); err != nil {
+		return false, err
+	}
+	if err := protocol.ValidateLocale(locale); err != nil {
+		return false, err
+	}
+
+	m.mu.RLock()
+	root := m.hostRoot
+	m.mu.RUnlock()
+
+	changed := false
+	if timezone != "" {
+		current, err := m.HostTimezone()
+		if err != nil {
+			return false, err
+		}
+		if current != timezone {
+			if output, err := hostCommand(root, "timedatectl", "set-timezone", timezone).CombinedOutput(); err != nil {
+				return false, fmt.Errorf("failed to set timezone: %v - %s", err, string(output))
+			}
+			m.logger.Info(fmt.Sprintf("Timezone set to %s", timezone))
+			changed = true
+		}
+		if err := logging.SetTimezone(timezone); err != nil {
+			m.logger.Warn(fmt.Sprintf("Failed to log in timezone %s: %v", timezone, err))
+		}
+	}
+
+	if locale != "" {
+		output, err := hostCommand(root, "localectl", "status").Output()
+		if err != nil {
+			return changed, fmt.Errorf("failed to read locale: %w", err)
+		}
+		if !strings.Contains(string(output), "LANG="+locale+"\n") {
+			if output, err := hostCommand(root, "localectl", "set-locale", "LANG="+locale).CombinedOutput(); err != nil {
+				return changed, fmt.Errorf("failed to set locale: %v - %s", err, string(output))
+			}
+			m.logger.Info(fmt.Sprintf("Locale set to %s", locale))
+			changed = true
+		}
+	}
+
+	return changed, nil
+}
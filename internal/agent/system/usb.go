@@ -0,0 +1,68 @@
+package system
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+// usbDevices is where the kernel lists USB devices. Containers see the
+// devices of the host there too, so it is read without the host root.
+const usbDevices = "/sys/bus/usb/devices"
+
+// ScanUSB lists the USB devices connected to the device, sorted by port.
+// Root hubs and interfaces are left out.
+func ScanUSB() ([]protocol.USBDevice, error) {
+	entries, err := os.ReadDir(usbDevices)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list USB devices: %w", err)
+	}
+
+	devices := []protocol.USBDevice{}
+	for _, entry := range entries {
+		port := entry.Name()
+		// Interfaces are named like 1-1.2:1.0, root hubs like usb1
+		if strings.Contains(port, ":") || strings.HasPrefix(port, "usb") {
+			continue
+		}
+
+		dir := filepath.Join(usbDevices, port)
+		device := protocol.USBDevice{
+			Port:         port,
+			VendorID:     readAttribute(dir, "idVendor"),
+			ProductID:    readAttribute(dir, "idProduct"),
+			Serial:       readAttribute(dir, "serial"),
+			Manufacturer: readAttribute(dir, "manufacturer"),
+			Product:      readAttribute(dir, "product"),
+			Class:        readAttribute(dir, "bDeviceClass"),
+		}
+		if device.VendorID == "" || device.ProductID == "" {
+			continue
+		}
+		if speed, err := strconv.ParseFloat(readAttribute(dir, "speed"), 64); err == nil {
+			device.Speed = int(speed)
+		}
+		devices = append(devices, device)
+
+		if len(devices) == protocol.MaxUSBDevices {
+			break
+		}
+	}
+
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Port < devices[j].Port })
+	return devices, nil
+}
+
+// readAttribute reads a sysfs attribute, empty if the device has none
+func readAttribute(dir, name string) string {
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
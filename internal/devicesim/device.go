@@ -0,0 +1,385 @@
+package devicesim
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/logging"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+	"golang.org/x/crypto/ssh"
+)
+
+// Defaults of simulated devices
+const (
+	DefaultHeartbeat = 30 * time.Second
+	DefaultReconnect = 5 * time.Second
+	handshakeTimeout = 30 * time.Second
+	maxResponses     = 256 // Responses remembered per device to answer resends
+)
+
+// Stats counts what simulated devices did
+type Stats struct {
+	Connected   int   `json:"connected"` // Devices connected right now
+	Connects    int64 `json:"connects"`
+	Failures    int64 `json:"failures"` // Connection attempts that failed
+	Heartbeats  int64 `json:"heartbeats"`
+	Commands    int64 `json:"commands"`
+	Duplicates  int64 `json:"duplicates"` // Resent commands answered from the first execution
+	Disconnects int64 `json:"disconnects"`
+}
+
+// add adds the counters of other
+func (s *Stats) add(other Stats) {
+	s.Connected += other.Connected
+	s.Connects += other.Connects
+	s.Failures += other.Failures
+	s.Heartbeats += other.Heartbeats
+	s.Commands += other.Commands
+	s.Duplicates += other.Duplicates
+	s.Disconnects += other.Disconnects
+}
+
+// Observer is told how the connections of simulated devices went, e.g. to
+// measure latencies. It is called from many goroutines at once.
+type Observer interface {
+	// Handshake reports a connection attempt, from dialing to authenticated
+	Handshake(deviceID string, latency time.Duration, err error)
+	// Forward reports a remote port forward request and the server port
+	// allocated for it
+	Forward(deviceID string, port int, latency time.Duration, err error)
+}
+
+// Device emulates the agent of one device: it connects with its key, sends
+// heartbeats, answers commands as its script says and reconnects whenever
+// the connection drops
+type Device struct {
+	ID        string
+	Key       ssh.Signer
+	Dial      DialFunc
+	Script    *Script
+	Build     protocol.BuildInfo
+	Heartbeat time.Duration // Interval of heartbeats
+	Reconnect time.Duration // Delay before reconnecting, with up to the same again as jitter
+	Forwards  int           // Remote port forwards requested after connecting
+	Observer  Observer      // Told about handshakes and forwards, may be nil
+
+	logger *logging.Logger
+
+	mu        sync.Mutex
+	client    *ssh.Client                   // Current connection, nil while disconnected
+	responses map[string]*protocol.Response // Answered commands by ID, to answer resends
+	answered  []string                      // IDs of responses, oldest first
+	dropped   map[string]bool               // Commands that dropped the connection once
+
+	connects, failures, heartbeats atomic.Int64
+	commands, duplicates           atomic.Int64
+	disconnects                    atomic.Int64
+}
+
+// NewDevice creates a simulated device connecting with dial
+func NewDevice(id string, key ssh.Signer, dial DialFunc, script *Script) *Device {
+	if script == nil {
+		script = DefaultScript()
+	}
+	return &Device{
+		ID:        id,
+		Key:       key,
+		Dial:      dial,
+		Script:    script,
+		Build:     protocol.BuildInfo{Version: "devicesim", Features: protocol.AgentFeatures},
+		Heartbeat: DefaultHeartbeat,
+		Reconnect: DefaultReconnect,
+		logger:    logging.WithComponent("devicesim").WithField("device_id", id),
+		responses: make(map[string]*protocol.Response),
+		dropped:   make(map[string]bool),
+	}
+}
+
+// Run keeps the device connected until ctx is cancelled
+func (d *Device) Run(ctx context.Context) {
+	for {
+		if err := d.session(ctx); err != nil && ctx.Err() == nil {
+			d.logger.Debug(fmt.Sprintf("Connection ended: %v", err))
+		}
+
+		delay := d.Reconnect
+		if delay > 0 {
+			delay += time.Duration(rand.Int63n(int64(delay)))
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Connected reports whether the device is connected
+func (d *Device) Connected() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.client != nil
+}
+
+// Disconnect drops the current connection, the device reconnects after its
+// reconnect delay
+func (d *Device) Disconnect() {
+	d.mu.Lock()
+	client := d.client
+	d.mu.Unlock()
+
+	if client != nil {
+		client.Close()
+	}
+}
+
+// Stats returns the counters of the device
+func (d *Device) Stats() Stats {
+	stats := Stats{
+		Connects:    d.connects.Load(),
+		Failures:    d.failures.Load(),
+		Heartbeats:  d.heartbeats.Load(),
+		Commands:    d.commands.Load(),
+		Duplicates:  d.duplicates.Load(),
+		Disconnects: d.disconnects.Load(),
+	}
+	if d.Connected() {
+		stats.Connected = 1
+	}
+	return stats
+}
+
+// session connects once and serves the connection until it closes
+func (d *Device) session(ctx context.Context) error {
+	dialCtx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+	defer cancel()
+
+	start := time.Now()
+	conn, err := d.Dial(dialCtx)
+	if err != nil {
+		d.failures.Add(1)
+		d.observeHandshake(start, err)
+		return fmt.Errorf("failed to dial: %w", err)
+	}
+
+	config := &ssh.ClientConfig{
+		User:            d.ID,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(d.Key)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         handshakeTimeout,
+	}
+	sshConn, channels, requests, err := ssh.NewClientConn(conn, conn.RemoteAddr().String(), config)
+	if err != nil {
+		conn.Close()
+		d.failures.Add(1)
+		d.observeHandshake(start, err)
+		return fmt.Errorf("failed to establish SSH connection: %w", err)
+	}
+	d.observeHandshake(start, nil)
+	client := ssh.NewClient(sshConn, channels, requests)
+	commands := client.HandleChannelOpen(protocol.ChannelCommand)
+
+	d.mu.Lock()
+	d.client = client
+	d.mu.Unlock()
+	d.connects.Add(1)
+
+	defer func() {
+		d.mu.Lock()
+		d.client = nil
+		d.mu.Unlock()
+		d.disconnects.Add(1)
+	}()
+
+	// Stop everything when the connection closes or the simulation ends
+	sessionCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	go func() {
+		<-sessionCtx.Done()
+		client.Close()
+	}()
+
+	compress := d.negotiate(client)
+	d.requestForwards(client)
+	go d.sendHeartbeats(sessionCtx, client)
+	go func() {
+		for newChannel := range commands {
+			go d.handleCommand(client, newChannel, compress)
+		}
+	}()
+
+	return client.Wait()
+}
+
+// negotiate announces the device features and reports whether the server
+// supports compression
+func (d *Device) negotiate(client *ssh.Client) bool {
+	data, err := json.Marshal(d.Build)
+	if err != nil {
+		return false
+	}
+	ok, payload, err := client.SendRequest(protocol.RequestFeatures, true, data)
+	if err != nil || !ok {
+		return false
+	}
+
+	var reply protocol.FeaturesReply
+	if err := json.Unmarshal(payload, &reply); err != nil {
+		return false
+	}
+	return protocol.HasFeature(reply.Features, protocol.FeatureCompression)
+}
+
+// observeHandshake reports a connection attempt that started at start
+func (d *Device) observeHandshake(start time.Time, err error) {
+	if d.Observer != nil {
+		d.Observer.Handshake(d.ID, time.Since(start), err)
+	}
+}
+
+// requestForwards asks the server to forward a port to each of the first
+// Forwards ports from 8000 on the device, as agents do for their port
+// forwards
+func (d *Device) requestForwards(client *ssh.Client) {
+	for i := 0; i < d.Forwards; i++ {
+		payload := ssh.Marshal(struct {
+			BindAddr string
+			BindPort uint32
+		}{"localhost", uint32(8000 + i)})
+
+		start := time.Now()
+		ok, reply, err := client.SendRequest("tcpip-forward", true, payload)
+		latency := time.Since(start)
+
+		var allocated struct{ Port uint32 }
+		if err == nil && !ok {
+			err = fmt.Errorf("server refused to forward port %d", 8000+i)
+		} else if err == nil {
+			err = ssh.Unmarshal(reply, &allocated)
+		}
+		if d.Observer != nil {
+			d.Observer.Forward(d.ID, int(allocated.Port), latency, err)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// sendHeartbeats sends a heartbeat right away and then at every interval
+func (d *Device) sendHeartbeats(ctx context.Context, client *ssh.Client) {
+	interval := d.Heartbeat
+	if interval <= 0 {
+		interval = DefaultHeartbeat
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		heartbeat := protocol.NewHeartbeat(d.ID, protocol.StatusOK)
+		heartbeat.Version = d.Build.Version
+		build := d.Build
+		heartbeat.Build = &build
+
+		data, err := json.Marshal(heartbeat)
+		if err != nil {
+			d.logger.Error("Failed to marshal heartbeat", err)
+			return
+		}
+		if _, _, err := client.SendRequest(protocol.RequestHeartbeat, false, data); err != nil {
+			return
+		}
+		d.heartbeats.Add(1)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// handleCommand answers a command as the script says. A command resent after
+// a reconnect gets the response of its first execution, like a real agent.
+func (d *Device) handleCommand(client *ssh.Client, newChannel ssh.NewChannel, compress bool) {
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+	go ssh.DiscardRequests(requests)
+
+	var cmd protocol.Command
+	if err := protocol.ReadMessage(channel, &cmd); err != nil {
+		d.logger.Error("Failed to decode command", err)
+		return
+	}
+	d.commands.Add(1)
+
+	ack, err := json.Marshal(protocol.CommandAck{ID: cmd.ID, Seq: cmd.Seq, Accepted: true})
+	if err == nil {
+		channel.SendRequest(protocol.RequestAck, true, ack)
+	}
+
+	d.mu.Lock()
+	previous, seen := d.responses[cmd.ID]
+	d.mu.Unlock()
+
+	var resp *protocol.Response
+	if seen {
+		d.duplicates.Add(1)
+		duplicate := *previous
+		duplicate.Duplicate = true
+		resp = &duplicate
+	} else {
+		reply := d.Script.reply(cmd.Type)
+		if reply.Delay > 0 {
+			time.Sleep(reply.Delay)
+		}
+
+		d.mu.Lock()
+		drop := reply.Disconnect && !d.dropped[cmd.ID]
+		d.dropped[cmd.ID] = true
+		d.mu.Unlock()
+		if drop {
+			client.Close()
+			return
+		}
+
+		resp = protocol.NewResponse(cmd.ID, protocol.RespSuccess, reply.Success, reply.Message)
+		if !reply.Success {
+			resp.Type = protocol.RespError
+		}
+		for key, value := range reply.Data {
+			resp.Data[key] = value
+		}
+
+		d.remember(cmd.ID, resp)
+	}
+
+	if err := protocol.WriteMessage(channel, resp, compress); err != nil {
+		return
+	}
+	channel.CloseWrite()
+}
+
+// remember keeps the response to a command for resends, forgetting the oldest
+// beyond maxResponses
+func (d *Device) remember(id string, resp *protocol.Response) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.responses[id] = resp
+	d.answered = append(d.answered, id)
+	if len(d.answered) > maxResponses {
+		delete(d.responses, d.answered[0])
+		delete(d.dropped, d.answered[0])
+		d.answered = d.answered[1:]
+	}
+}
@@ -0,0 +1,7 @@
+// Package devicesim emulates edgetainer agents, so that server features such
+// as rollouts, port allocation and reconnection storms can be exercised
+// without hardware. Simulated devices go through the real SSH handshake, send
+// heartbeats and answer commands from a script. They connect over TCP to a
+// running server, or over an in-memory Listener to a server in the same
+// process.
+package devicesim
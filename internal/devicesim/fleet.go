@@ -0,0 +1,146 @@
+package devicesim
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/sshkeys"
+	"golang.org/x/crypto/ssh"
+)
+
+// FleetConfig describes a fleet of simulated devices
+type FleetConfig struct {
+	Count     int
+	Prefix    string // Device IDs are the prefix followed by a number
+	KeyDir    string // Keeps device keys across runs, empty for keys in memory only
+	Dial      DialFunc
+	Script    *Script
+	Heartbeat time.Duration
+	Reconnect time.Duration
+	Ramp      time.Duration // Delay between starting devices, 0 to start them all at once
+	Forwards  int           // Remote port forwards each device requests
+	Observer  Observer
+}
+
+// Fleet runs many simulated devices
+type Fleet struct {
+	Devices []*Device
+	ramp    time.Duration
+}
+
+// NewFleet creates the devices of a fleet. Keys in KeyDir are reused, missing
+// ones are generated.
+func NewFleet(cfg FleetConfig) (*Fleet, error) {
+	if cfg.Count < 1 {
+		return nil, fmt.Errorf("a fleet needs at least one device")
+	}
+	if cfg.Prefix == "" {
+		cfg.Prefix = "sim"
+	}
+	if cfg.KeyDir != "" {
+		if err := os.MkdirAll(cfg.KeyDir, 0700); err != nil {
+			return nil, fmt.Errorf("failed to create key directory: %w", err)
+		}
+	}
+
+	fleet := &Fleet{ramp: cfg.Ramp}
+	for i := 1; i <= cfg.Count; i++ {
+		id := fmt.Sprintf("%s-%04d", cfg.Prefix, i)
+		key, err := deviceKey(cfg.KeyDir, id)
+		if err != nil {
+			return nil, err
+		}
+
+		device := NewDevice(id, key, cfg.Dial, cfg.Script)
+		if cfg.Heartbeat > 0 {
+			device.Heartbeat = cfg.Heartbeat
+		}
+		if cfg.Reconnect > 0 {
+			device.Reconnect = cfg.Reconnect
+		}
+		device.Forwards = cfg.Forwards
+		device.Observer = cfg.Observer
+		fleet.Devices = append(fleet.Devices, device)
+	}
+	return fleet, nil
+}
+
+// deviceKey loads the key of a device from dir, generating it if missing
+func deviceKey(dir, id string) (ssh.Signer, error) {
+	path := filepath.Join(dir, id)
+	if dir != "" {
+		if data, err := os.ReadFile(path); err == nil {
+			return ssh.ParsePrivateKey(data)
+		}
+	}
+
+	data, _, err := sshkeys.Generate(sshkeys.TypeED25519, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key of %s: %w", id, err)
+	}
+	if dir != "" {
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			return nil, fmt.Errorf("failed to save key of %s: %w", id, err)
+		}
+	}
+	return ssh.ParsePrivateKey(data)
+}
+
+// Run starts the devices, spaced by the ramp delay, and keeps them connected
+// until ctx is cancelled
+func (f *Fleet) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, device := range f.Devices {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			device.Run(ctx)
+		}()
+
+		if f.ramp > 0 {
+			select {
+			case <-time.After(f.ramp):
+			case <-ctx.Done():
+			}
+		}
+	}
+	wg.Wait()
+}
+
+// DisconnectAll drops every connection at once, the devices reconnect after
+// their jittered reconnect delay like a fleet after a network outage
+func (f *Fleet) DisconnectAll() {
+	for _, device := range f.Devices {
+		device.Disconnect()
+	}
+}
+
+// WaitConnected waits until every device is connected
+func (f *Fleet) WaitConnected(ctx context.Context) error {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		if f.Stats().Connected == len(f.Devices) {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Stats sums the counters of the devices
+func (f *Fleet) Stats() Stats {
+	var stats Stats
+	for _, device := range f.Devices {
+		stats.add(device.Stats())
+	}
+	return stats
+}
@@ -0,0 +1,200 @@
+package devicesim
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/server/db"
+	"github.com/edgetainer/edgetainer/internal/server/events"
+	sshserver "github.com/edgetainer/edgetainer/internal/server/ssh"
+	"github.com/edgetainer/edgetainer/internal/shared/config"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/edgetainer/edgetainer/internal/shared/sshkeys"
+)
+
+// Tunnel ports of the test server, twice what the fleet needs
+const (
+	testDevices  = 10
+	testForwards = 2
+	testPortBase = 42000
+	testPortEnd  = testPortBase + 2*testDevices*testForwards - 1
+)
+
+// forwardRecorder remembers the ports allocated for forwards
+type forwardRecorder struct {
+	mu     sync.Mutex
+	ports  map[string][]int // By device, in the order allocated
+	errors []error
+}
+
+func (r *forwardRecorder) Handshake(string, time.Duration, error) {}
+
+func (r *forwardRecorder) Forward(deviceID string, port int, _ time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err != nil {
+		r.errors = append(r.errors, fmt.Errorf("%s: %w", deviceID, err))
+		return
+	}
+	r.ports[deviceID] = append(r.ports[deviceID], port)
+}
+
+// reset forgets the ports recorded so far and returns the errors
+func (r *forwardRecorder) reset() []error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	errors := r.errors
+	r.ports = make(map[string][]int)
+	r.errors = nil
+	return errors
+}
+
+// latest returns the ports of the last connection of every device
+func (r *forwardRecorder) latest() map[string][]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	latest := make(map[string][]int, len(r.ports))
+	for deviceID, ports := range r.ports {
+		if len(ports) >= testForwards {
+			latest[deviceID] = ports[len(ports)-testForwards:]
+		}
+	}
+	return latest
+}
+
+// testDatabase connects to the database configured in the EDGETAINER_DATABASE_*
+// variables, the test is skipped without one
+func testDatabase(t *testing.T) *db.DB {
+	t.Helper()
+
+	if os.Getenv("EDGETAINER_DATABASE_HOST") == "" {
+		t.Skip("EDGETAINER_DATABASE_HOST is not set")
+	}
+	cfg, err := config.LoadServerConfig(filepath.Join(t.TempDir(), "server.yaml"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	database, err := db.New(context.Background(), cfg.Database.Host, cfg.Database.Port,
+		cfg.Database.User, cfg.Database.Password, cfg.Database.DBName, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(database.Close)
+	if err := database.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	return database
+}
+
+// eventually waits until check passes
+func eventually(t *testing.T, what string, check func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(30 * time.Second)
+	for !check() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestFleetReconnectionStorm(t *testing.T) {
+	database := testDatabase(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server, err := sshserver.NewServer(ctx, 0, filepath.Join(t.TempDir(), "host_key"), sshkeys.TypeED25519, 0,
+		testPortBase, testPortEnd, database, events.NewBus())
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := NewListener()
+	if err := server.Serve(listener); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Shutdown()
+
+	recorder := &forwardRecorder{}
+	recorder.reset()
+	prefix := fmt.Sprintf("simtest%d", time.Now().UnixNano())
+	fleet, err := NewFleet(FleetConfig{
+		Count:     testDevices,
+		Prefix:    prefix,
+		Dial:      listener.Dial,
+		Heartbeat: time.Second,
+		Reconnect: 20 * time.Millisecond,
+		Forwards:  testForwards,
+		Observer:  recorder,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fleet.Provision(database.GetDB(), nil); err != nil {
+		t.Fatal(err)
+	}
+	defer database.GetDB().Where("device_id LIKE ?", prefix+"-%").Delete(&models.Device{})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		fleet.Run(ctx)
+	}()
+	defer wg.Wait()
+	defer cancel()
+
+	for round := 0; round < 5; round++ {
+		if err := fleet.WaitConnected(ctx); err != nil {
+			t.Fatalf("round %d: %v", round, err)
+		}
+		eventually(t, "every device to be registered", func() bool {
+			return server.ConnectionCount() == testDevices
+		})
+		eventually(t, "every forward to be allocated", func() bool {
+			return len(recorder.latest()) == testDevices
+		})
+
+		// The ports of closed connections went back to the pool
+		eventually(t, "the ports of closed connections to be released", func() bool {
+			used, _ := server.PortUsage()
+			return used == testDevices*testForwards
+		})
+
+		// And no port is handed out twice
+		seen := make(map[int]string)
+		for deviceID, ports := range recorder.latest() {
+			for _, port := range ports {
+				if port < testPortBase || port > testPortEnd {
+					t.Fatalf("round %d: %s got port %d outside of %d-%d", round, deviceID, port, testPortBase, testPortEnd)
+				}
+				if other, ok := seen[port]; ok {
+					t.Fatalf("round %d: port %d allocated to both %s and %s", round, port, other, deviceID)
+				}
+				seen[port] = deviceID
+			}
+		}
+		if errors := recorder.reset(); len(errors) > 0 {
+			t.Fatalf("round %d: forwards failed: %v", round, errors)
+		}
+
+		// Every device drops its connection at once and reconnects
+		fleet.DisconnectAll()
+		eventually(t, "the fleet to disconnect", func() bool {
+			return fleet.Stats().Disconnects >= int64((round+1)*testDevices)
+		})
+	}
+
+	stats := fleet.Stats()
+	if stats.Connects < 5*testDevices {
+		t.Errorf("%d connects, want at least %d", stats.Connects, 5*testDevices)
+	}
+}
@@ -0,0 +1,74 @@
+package devicesim
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// DialFunc opens the transport of a simulated device to the SSH server
+type DialFunc func(ctx context.Context) (net.Conn, error)
+
+// TCPDialer dials the SSH server at addr over TCP
+func TCPDialer(addr string) DialFunc {
+	return func(ctx context.Context) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+}
+
+// Listener is an in-memory net.Listener. A server serving it accepts the
+// connections of devices dialing it with Dial, without any network.
+type Listener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+// NewListener creates an in-memory listener
+func NewListener() *Listener {
+	return &Listener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// Accept waits for the next device to dial
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting connections, open ones are not affected
+func (l *Listener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+// Addr returns a placeholder address
+func (l *Listener) Addr() net.Addr {
+	return memoryAddr{}
+}
+
+// Dial connects to the server accepting on the listener. It is a DialFunc.
+func (l *Listener) Dial(ctx context.Context) (net.Conn, error) {
+	server, client := newMemoryConns()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// memoryAddr is the address of an in-memory listener
+type memoryAddr struct{}
+
+func (memoryAddr) Network() string { return "memory" }
+func (memoryAddr) String() string  { return "devicesim" }
@@ -0,0 +1,84 @@
+package devicesim
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// pipe is one direction of an in-memory connection. Unlike with net.Pipe,
+// writes do not wait for the reader, since both ends of an SSH handshake
+// write before they read.
+type pipe struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	buf    bytes.Buffer
+	closed bool
+}
+
+func newPipe() *pipe {
+	p := &pipe{}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+func (p *pipe) read(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for p.buf.Len() == 0 && !p.closed {
+		p.cond.Wait()
+	}
+	if p.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+	return p.buf.Read(b)
+}
+
+func (p *pipe) write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return 0, io.ErrClosedPipe
+	}
+	p.cond.Broadcast()
+	return p.buf.Write(b)
+}
+
+func (p *pipe) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	p.cond.Broadcast()
+}
+
+// memoryConn is one end of an in-memory connection. Deadlines are not
+// supported.
+type memoryConn struct {
+	in, out *pipe
+}
+
+// newMemoryConns returns the two ends of an in-memory connection
+func newMemoryConns() (net.Conn, net.Conn) {
+	a, b := newPipe(), newPipe()
+	return &memoryConn{in: a, out: b}, &memoryConn{in: b, out: a}
+}
+
+func (c *memoryConn) Read(b []byte) (int, error)  { return c.in.read(b) }
+func (c *memoryConn) Write(b []byte) (int, error) { return c.out.write(b) }
+
+func (c *memoryConn) Close() error {
+	c.in.close()
+	c.out.close()
+	return nil
+}
+
+func (c *memoryConn) LocalAddr() net.Addr                { return memoryAddr{} }
+func (c *memoryConn) RemoteAddr() net.Addr               { return memoryAddr{} }
+func (c *memoryConn) SetDeadline(t time.Time) error      { return nil }
+func (c *memoryConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *memoryConn) SetWriteDeadline(t time.Time) error { return nil }
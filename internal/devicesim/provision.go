@@ -0,0 +1,75 @@
+package devicesim
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/edgetainer/edgetainer/internal/server/db"
+	"github.com/edgetainer/edgetainer/internal/shared/config"
+	"github.com/edgetainer/edgetainer/internal/shared/fieldcrypt"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/ssh"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Provision registers the devices with their public keys in the server
+// database, in the given fleet if not nil. Devices already registered get
+// their key updated.
+func (f *Fleet) Provision(db *gorm.DB, fleetID *uuid.UUID) error {
+	for _, device := range f.Devices {
+		record := models.Device{
+			DeviceID:     device.ID,
+			Name:         device.ID,
+			FleetID:      fleetID,
+			Status:       models.DeviceStatusPending,
+			SSHPublicKey: strings.TrimSpace(string(ssh.MarshalAuthorizedKey(device.Key.PublicKey()))),
+		}
+		err := db.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "device_id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"ssh_public_key", "fleet_id"}),
+		}).Create(&record).Error
+		if err != nil {
+			return fmt.Errorf("failed to provision %s: %w", device.ID, err)
+		}
+	}
+	return nil
+}
+
+// ProvisionServer registers the devices in the database of the server
+// configured in configPath, in the fleet with the given ID if not empty
+func (f *Fleet) ProvisionServer(ctx context.Context, configPath, fleetID string) error {
+	cfg, err := config.LoadServerConfig(configPath, nil)
+	if err != nil {
+		return fmt.Errorf("failed to load server configuration: %w", err)
+	}
+
+	// Device keys are stored encrypted when the server encrypts columns
+	if len(cfg.Encryption.Keys) > 0 {
+		keyring, err := fieldcrypt.NewKeyring(cfg.Encryption.ActiveKey, cfg.Encryption.Keys)
+		if err != nil {
+			return fmt.Errorf("invalid encryption configuration: %w", err)
+		}
+		fieldcrypt.SetKeyring(keyring)
+	}
+
+	var fleetUUID *uuid.UUID
+	if fleetID != "" {
+		id, err := uuid.Parse(fleetID)
+		if err != nil {
+			return fmt.Errorf("invalid fleet ID: %w", err)
+		}
+		fleetUUID = &id
+	}
+
+	database, err := db.New(ctx, cfg.Database.Host, cfg.Database.Port,
+		cfg.Database.User, cfg.Database.Password, cfg.Database.DBName, cfg)
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	return f.Provision(database.GetDB(), fleetUUID)
+}
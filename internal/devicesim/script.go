@@ -0,0 +1,66 @@
+package devicesim
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Reply is the scripted answer of simulated devices to a command type
+type Reply struct {
+	Success    bool                   `yaml:"success"`
+	Message    string                 `yaml:"message"`
+	Data       map[string]interface{} `yaml:"data"`
+	Delay      time.Duration          `yaml:"delay"`      // How long executing the command takes
+	FailRate   float64                `yaml:"fail_rate"`  // Share of commands answered with an error instead, 0 to 1
+	Disconnect bool                   `yaml:"disconnect"` // Drop the connection instead of answering, a resend is answered
+}
+
+// Script tells simulated devices how to answer commands
+type Script struct {
+	Default  Reply            `yaml:"default"`  // For command types not listed
+	Commands map[string]Reply `yaml:"commands"` // By command type
+}
+
+// DefaultScript answers every command with success right away
+func DefaultScript() *Script {
+	return &Script{Default: Reply{Success: true}}
+}
+
+// LoadScript reads a script from a YAML file
+func LoadScript(path string) (*Script, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read script: %w", err)
+	}
+
+	script := DefaultScript()
+	if err := yaml.Unmarshal(data, script); err != nil {
+		return nil, fmt.Errorf("failed to parse script: %w", err)
+	}
+	for cmdType, reply := range script.Commands {
+		if reply.FailRate < 0 || reply.FailRate > 1 {
+			return nil, fmt.Errorf("fail_rate of %s must be between 0 and 1", cmdType)
+		}
+	}
+	if script.Default.FailRate < 0 || script.Default.FailRate > 1 {
+		return nil, fmt.Errorf("default fail_rate must be between 0 and 1")
+	}
+	return script, nil
+}
+
+// reply returns the reply to a command type, with its fail rate applied
+func (s *Script) reply(cmdType string) Reply {
+	reply, ok := s.Commands[cmdType]
+	if !ok {
+		reply = s.Default
+	}
+	if reply.FailRate > 0 && rand.Float64() < reply.FailRate {
+		reply.Success = false
+		reply.Message = "simulated failure"
+	}
+	return reply
+}
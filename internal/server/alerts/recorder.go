@@ -0,0 +1,90 @@
+package alerts
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/edgetainer/edgetainer/internal/server/db"
+	"github.com/edgetainer/edgetainer/internal/server/events"
+	"github.com/edgetainer/edgetainer/internal/shared/logging"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+)
+
+// subscriber is the name the recorder subscribes to the event bus under
+const subscriber = "alerts"
+
+// Recorder stores the alerts fired on the event bus, so they can be counted
+// after the fact
+type Recorder struct {
+	ctx        context.Context
+	cancelFunc context.CancelFunc
+	database   *db.DB
+	bus        *events.Bus
+	logger     *logging.Logger
+	wg         sync.WaitGroup
+}
+
+// NewRecorder creates a new alert recorder
+func NewRecorder(ctx context.Context, database *db.DB, bus *events.Bus) *Recorder {
+	recorderCtx, cancel := context.WithCancel(ctx)
+
+	return &Recorder{
+		ctx:        recorderCtx,
+		cancelFunc: cancel,
+		database:   database,
+		bus:        bus,
+		logger:     logging.WithComponent("alerts"),
+	}
+}
+
+// Start subscribes to the event bus and begins recording
+func (r *Recorder) Start() {
+	eventCh := r.bus.Subscribe(subscriber, 64)
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+
+		for {
+			select {
+			case evt, ok := <-eventCh:
+				if !ok {
+					return
+				}
+				if evt.Type == events.AlertFiring {
+					r.record(evt)
+				}
+			case <-r.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops recording
+func (r *Recorder) Stop() {
+	r.cancelFunc()
+	r.bus.Unsubscribe(subscriber)
+	r.wg.Wait()
+}
+
+// record stores one alert.firing event
+func (r *Recorder) record(evt events.Event) {
+	var device models.Device
+	if err := r.database.GetDB().Where("device_id = ?", evt.DeviceID).First(&device).Error; err != nil {
+		r.logger.Error(fmt.Sprintf("Failed to load device %s of alert", evt.DeviceID), err)
+		return
+	}
+
+	name, _ := evt.Data["alert"].(string)
+	alert := models.Alert{
+		DeviceID: device.ID,
+		Name:     name,
+		Data:     evt.Data,
+		FiredAt:  evt.Timestamp,
+	}
+	if err := r.database.GetDB().Create(&alert).Error; err != nil {
+		r.logger.Error(fmt.Sprintf("Failed to record alert %s of device %s", name, evt.DeviceID), err)
+	}
+}
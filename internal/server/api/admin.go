@@ -0,0 +1,122 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/edgetainer/edgetainer/internal/shared/logging"
+)
+
+// LoggingSettings represents the runtime log levels of the server
+type LoggingSettings struct {
+	Level      string            `json:"level"`
+	Components map[string]string `json:"components"`          // Components with their own level
+	Available  []string          `json:"available,omitempty"` // Components that can be configured
+}
+
+// LoggingRequest represents a request to change log levels. An empty
+// component level makes the component follow the global level again.
+type LoggingRequest struct {
+	Level      string            `json:"level,omitempty"`
+	Components map[string]string `json:"components,omitempty"`
+}
+
+// handleAdminLogging handles the runtime log level endpoint. Changes apply
+// immediately and are saved, so they survive a restart.
+func (s *Server) handleAdminLogging(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		jsonResponse(w, loggingSettings(), http.StatusOK)
+
+	case http.MethodPut:
+		var request LoggingRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		// Validate everything before changing anything
+		if request.Level != "" && !validLogLevel(request.Level) {
+			http.Error(w, fmt.Sprintf("Invalid log level %q", request.Level), http.StatusBadRequest)
+			return
+		}
+		known := logging.Components()
+		for component, level := range request.Components {
+			if !slices.Contains(known, component) {
+				http.Error(w, fmt.Sprintf("Unknown component %q", component), http.StatusBadRequest)
+				return
+			}
+			if level != "" && !validLogLevel(level) {
+				http.Error(w, fmt.Sprintf("Invalid log level %q for %s", level, component), http.StatusBadRequest)
+				return
+			}
+		}
+
+		if request.Level != "" {
+			if err := s.database.SaveLogLevel("", request.Level); err != nil {
+				s.logger.Error("Failed to save log level", err)
+				http.Error(w, "Failed to save log level", http.StatusInternalServerError)
+				return
+			}
+			logging.SetLevel(request.Level)
+			s.logger.Info(fmt.Sprintf("Global log level set to %s", request.Level))
+		}
+
+		for component, level := range request.Components {
+			if err := s.database.SaveLogLevel(component, level); err != nil {
+				s.logger.Error(fmt.Sprintf("Failed to save log level of %s", component), err)
+				http.Error(w, "Failed to save log level", http.StatusInternalServerError)
+				return
+			}
+			logging.SetComponentLevel(component, level)
+			if level == "" {
+				s.logger.Info(fmt.Sprintf("Log level of %s reset to the global level", component))
+			} else {
+				s.logger.Info(fmt.Sprintf("Log level of %s set to %s", component, level))
+			}
+		}
+
+		jsonResponse(w, loggingSettings(), http.StatusOK)
+
+	case http.MethodDelete:
+		if err := s.database.ResetLogLevels(); err != nil {
+			s.logger.Error("Failed to reset log levels", err)
+			http.Error(w, "Failed to reset log levels", http.StatusInternalServerError)
+			return
+		}
+		s.logger.Info("Log levels reset to the configuration")
+
+		jsonResponse(w, loggingSettings(), http.StatusOK)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// SSHCA describes the certificate authority signing device certificates
+type SSHCA struct {
+	Enabled   bool   `json:"enabled"`
+	PublicKey string `json:"public_key,omitempty"` // In authorized_keys format, for trusting it elsewhere
+}
+
+// handleAdminSSHCA returns the public key of the SSH certificate authority
+func (s *Server) handleAdminSSHCA(w http.ResponseWriter, r *http.Request) {
+	publicKey := s.sshServer.CAPublicKey()
+	jsonResponse(w, SSHCA{Enabled: publicKey != "", PublicKey: publicKey}, http.StatusOK)
+}
+
+// loggingSettings returns the current log levels
+func loggingSettings() LoggingSettings {
+	return LoggingSettings{
+		Level:      logging.GetLevel(),
+		Components: logging.ComponentLevels(),
+		Available:  logging.Components(),
+	}
+}
+
+// validLogLevel reports whether level is a level the server can log at
+func validLogLevel(level string) bool {
+	return slices.Contains([]string{"trace", "debug", "info", "warn", "error"}, level)
+}
@@ -0,0 +1,349 @@
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/edgetainer/edgetainer/internal/server/customfields"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/google/uuid"
+)
+
+const (
+	// aggregateMaxGroups is the most groupings of an aggregation
+	aggregateMaxGroups = 2
+	// aggregateMaxValues is the most values computed per group
+	aggregateMaxValues = 10
+	// aggregateDefaultLimit and aggregateMaxLimit bound the groups returned
+	aggregateDefaultLimit = 50
+	aggregateMaxLimit     = 500
+)
+
+// aggregateGroupings are the device columns devices can be grouped by,
+// besides custom fields as field.<name>
+var aggregateGroupings = map[string]string{
+	"fleet":           "fleet_id::text",
+	"site":            "site_id::text",
+	"status":          "status",
+	"agent_version":   "coalesce(nullif(agent_version, ''), 'unknown')",
+	"os_version":      "nullif(os_version, '')",
+	"location_source": "nullif(location_source, '')",
+	"timezone":        "nullif(timezone, '')",
+}
+
+// aggregateFunctions are the functions metrics are aggregated with
+var aggregateFunctions = map[string]bool{"avg": true, "min": true, "max": true, "sum": true}
+
+// Aggregation is the result of grouping devices and aggregating their
+// metrics. Keys, labels and values of a group are in the order of GroupBy
+// and Aggregates.
+type Aggregation struct {
+	GroupBy    []string         `json:"group_by"`
+	Aggregates []string         `json:"aggregates"`
+	Groups     []AggregateGroup `json:"groups"`    // Largest first aggregate first
+	Truncated  bool             `json:"truncated"` // More groups than the limit exist
+}
+
+// AggregateGroup is a group of devices with its aggregated values
+type AggregateGroup struct {
+	Keys   []*string  `json:"keys"`   // Nil for devices without a value
+	Labels []string   `json:"labels"` // Names of fleets and sites, the key otherwise
+	Values []*float64 `json:"values"` // Nil where no device of the group has the metric
+}
+
+// aggregation is a parsed aggregation request
+type aggregation struct {
+	groupBy    []string
+	aggregates []string
+	limit      int
+	selects    []string
+	args       []interface{}
+}
+
+// parseAggregation reads group_by, aggregate and limit of an aggregation
+// request. group_by takes up to two groupings, aggregate up to ten values
+// of count or avg, min, max or sum of a metric, e.g. avg:clock_skew.
+func parseAggregation(query url.Values) (*aggregation, error) {
+	agg := &aggregation{limit: aggregateDefaultLimit}
+
+	if value := query.Get("group_by"); value != "" {
+		agg.groupBy = strings.Split(value, ",")
+	}
+	if len(agg.groupBy) > aggregateMaxGroups {
+		return nil, fmt.Errorf("at most %d groupings are allowed", aggregateMaxGroups)
+	}
+	for i, grouping := range agg.groupBy {
+		expression, args, err := groupingExpression(grouping)
+		if err != nil {
+			return nil, err
+		}
+		agg.selects = append(agg.selects, fmt.Sprintf("%s AS g%d", expression, i))
+		agg.args = append(agg.args, args...)
+	}
+
+	agg.aggregates = []string{"count"}
+	if value := query.Get("aggregate"); value != "" {
+		agg.aggregates = strings.Split(value, ",")
+	}
+	if len(agg.aggregates) > aggregateMaxValues {
+		return nil, fmt.Errorf("at most %d aggregates are allowed", aggregateMaxValues)
+	}
+	for i, aggregate := range agg.aggregates {
+		expression, args, err := aggregateExpression(aggregate)
+		if err != nil {
+			return nil, err
+		}
+		agg.selects = append(agg.selects, fmt.Sprintf("%s AS a%d", expression, i))
+		agg.args = append(agg.args, args...)
+	}
+
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > aggregateMaxLimit {
+			return nil, fmt.Errorf("limit must be between 1 and %d", aggregateMaxLimit)
+		}
+		agg.limit = limit
+	}
+	return agg, nil
+}
+
+// groupingExpression returns the SQL a grouping groups devices by
+func groupingExpression(grouping string) (string, []interface{}, error) {
+	if name, ok := strings.CutPrefix(grouping, fieldFilterPrefix); ok {
+		if !customfields.ValidName(name) {
+			return "", nil, fmt.Errorf("invalid custom field %s", name)
+		}
+		return "nullif(custom_fields->>?::text, '')", []interface{}{name}, nil
+	}
+	if expression, ok := aggregateGroupings[grouping]; ok {
+		return expression, nil, nil
+	}
+	return "", nil, fmt.Errorf("unknown grouping %q, expected fleet, site, status, agent_version, os_version, location_source, timezone or field.<name>", grouping)
+}
+
+// aggregateExpression returns the SQL of an aggregate: count, or a function
+// and a metric as avg:<metric>. Metrics are clock_skew, location_accuracy,
+// temperature.<zone> and plugin.<plugin>.<metric>.
+func aggregateExpression(aggregate string) (string, []interface{}, error) {
+	if aggregate == "count" {
+		return "count(*)::double precision", nil, nil
+	}
+
+	function, metric, ok := strings.Cut(aggregate, ":")
+	if !ok || !aggregateFunctions[function] {
+		return "", nil, fmt.Errorf("unknown aggregate %q, expected count or avg, min, max or sum of a metric, e.g. avg:clock_skew", aggregate)
+	}
+	if err := validStrings("metric names", metric); err != nil {
+		return "", nil, err
+	}
+
+	var expression string
+	var args []interface{}
+	switch {
+	case metric == "clock_skew":
+		// Only devices whose agent reported its clock have a skew
+		expression = "CASE WHEN clock_checked_at IS NOT NULL THEN clock_skew END"
+	case metric == "location_accuracy":
+		expression = "nullif(location_accuracy, 0)"
+	case strings.HasPrefix(metric, "temperature."):
+		zone := strings.TrimPrefix(metric, "temperature.")
+		expression = "(nullif(host_health, '')::jsonb->'temperatures'->>?::text)::double precision"
+		args = []interface{}{zone}
+	case strings.HasPrefix(metric, "plugin."):
+		plugin, name, ok := strings.Cut(strings.TrimPrefix(metric, "plugin."), ".")
+		if !ok || plugin == "" || name == "" {
+			return "", nil, fmt.Errorf("plugin metrics are named plugin.<plugin>.<metric>")
+		}
+		expression = "(nullif(plugin_metrics, '')::jsonb->?::text->>?::text)::double precision"
+		args = []interface{}{plugin, name}
+	default:
+		return "", nil, fmt.Errorf("unknown metric %q, expected clock_skew, location_accuracy, temperature.<zone> or plugin.<plugin>.<metric>", metric)
+	}
+	return fmt.Sprintf("%s(%s)::double precision", function, expression), args, nil
+}
+
+// handleDeviceAggregate groups the devices matching the list filters and
+// aggregates their metrics for dashboard widgets, in one query instead of
+// the UI loading every device. Decommissioned, replaced and revoked devices
+// are left out unless status asks for them.
+func (s *Server) handleDeviceAggregate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	agg, err := parseAggregation(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query, err := s.deviceQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if status := r.URL.Query().Get("status"); status != "" {
+		query = query.Where("status IN ?", strings.Split(status, ","))
+	} else {
+		query = query.Where("status NOT IN ?", retiredStatuses)
+	}
+
+	query = query.WithContext(r.Context()).Model(&models.Device{}).
+		Select(strings.Join(agg.selects, ", "), agg.args...)
+	var order []string
+	for i := range agg.groupBy {
+		order = append(order, fmt.Sprintf("g%d", i))
+	}
+	if len(order) > 0 {
+		query = query.Group(strings.Join(order, ", "))
+	}
+	order = append([]string{"a0 DESC NULLS LAST"}, order...)
+
+	rows, err := query.Order(strings.Join(order, ", ")).Limit(agg.limit + 1).Rows()
+	if err != nil {
+		s.logger.Error("Failed to aggregate devices", err)
+		http.Error(w, "Failed to aggregate devices", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	result := Aggregation{GroupBy: agg.groupBy, Aggregates: agg.aggregates, Groups: []AggregateGroup{}}
+	if result.GroupBy == nil {
+		result.GroupBy = []string{}
+	}
+	for rows.Next() {
+		if len(result.Groups) == agg.limit {
+			result.Truncated = true
+			break
+		}
+		keys := make([]sql.NullString, len(agg.groupBy))
+		values := make([]sql.NullFloat64, len(agg.aggregates))
+		dest := make([]interface{}, 0, len(keys)+len(values))
+		for i := range keys {
+			dest = append(dest, &keys[i])
+		}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			s.logger.Error("Failed to read device aggregation", err)
+			http.Error(w, "Failed to aggregate devices", http.StatusInternalServerError)
+			return
+		}
+
+		group := AggregateGroup{
+			Keys:   make([]*string, len(keys)),
+			Labels: make([]string, len(keys)),
+			Values: make([]*float64, len(values)),
+		}
+		for i, key := range keys {
+			if key.Valid {
+				group.Keys[i] = &key.String
+				group.Labels[i] = key.String
+			}
+		}
+		for i, value := range values {
+			if value.Valid {
+				group.Values[i] = &value.Float64
+			}
+		}
+		result.Groups = append(result.Groups, group)
+	}
+	if err := rows.Err(); err != nil {
+		s.logger.Error("Failed to aggregate devices", err)
+		http.Error(w, "Failed to aggregate devices", http.StatusInternalServerError)
+		return
+	}
+
+	if err := s.labelGroups(&result); err != nil {
+		s.logger.Error("Failed to name aggregated groups", err)
+		http.Error(w, "Failed to aggregate devices", http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, result, http.StatusOK)
+}
+
+// labelGroups labels the fleet and site keys of an aggregation with their
+// names
+func (s *Server) labelGroups(result *Aggregation) error {
+	for i, grouping := range result.GroupBy {
+		var model interface{}
+		switch grouping {
+		case "fleet":
+			model = &models.Fleet{}
+		case "site":
+			model = &models.Site{}
+		default:
+			continue
+		}
+
+		var ids []uuid.UUID
+		for _, group := range result.Groups {
+			if group.Keys[i] != nil {
+				if id, err := uuid.Parse(*group.Keys[i]); err == nil {
+					ids = append(ids, id)
+				}
+			}
+		}
+		if len(ids) == 0 {
+			continue
+		}
+
+		var names []struct {
+			ID   uuid.UUID
+			Name string
+		}
+		if err := s.database.GetDB().Model(model).Select("id, name").Where("id IN ?", ids).Scan(&names).Error; err != nil {
+			return err
+		}
+		byID := make(map[string]string, len(names))
+		for _, name := range names {
+			byID[name.ID.String()] = name.Name
+		}
+		for j := range result.Groups {
+			if key := result.Groups[j].Keys[i]; key != nil {
+				if name, ok := byID[*key]; ok {
+					result.Groups[j].Labels[i] = name
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// validateWidget checks a dashboard widget a user saves, its query must be
+// one the aggregation takes
+func validateWidget(widget *models.DashboardWidget) error {
+	if widget.Title == "" {
+		return fmt.Errorf("widgets need a title")
+	}
+	if err := validStrings("widget titles", widget.Title); err != nil {
+		return err
+	}
+	switch widget.Chart {
+	case models.WidgetChartNumber, models.WidgetChartBar, models.WidgetChartPie, models.WidgetChartTable:
+	default:
+		return fmt.Errorf("widget %s: chart must be %s, %s, %s or %s", widget.Title,
+			models.WidgetChartNumber, models.WidgetChartBar, models.WidgetChartPie, models.WidgetChartTable)
+	}
+
+	if len(widget.Query) > maxPreferenceItems {
+		return fmt.Errorf("widget %s: at most %d query parameters are allowed", widget.Title, maxPreferenceItems)
+	}
+	query := url.Values{}
+	for key, value := range widget.Query {
+		if err := validStrings("widget query parameters", key, value); err != nil {
+			return err
+		}
+		query.Set(key, value)
+	}
+	if _, err := parseAggregation(query); err != nil {
+		return fmt.Errorf("widget %s: %w", widget.Title, err)
+	}
+	return nil
+}
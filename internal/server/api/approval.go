@@ -0,0 +1,408 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/server/deploy"
+	"github.com/edgetainer/edgetainer/internal/server/events"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/google/uuid"
+)
+
+// FleetApprovalRequest turns the approval of deploys to a fleet on or off
+type FleetApprovalRequest struct {
+	RequireApproval bool `json:"require_approval"`
+}
+
+// RejectApprovalRequest represents the rejection of a deploy
+type RejectApprovalRequest struct {
+	Reason string `json:"reason"`
+}
+
+// SetApprovalExpiry sets how long deploys wait for approval, zero or less
+// waits forever
+func (s *Server) SetApprovalExpiry(expiry time.Duration) {
+	s.approvalTTL = expiry
+}
+
+// approvalFleet returns the fleet a device belongs to if its deploys need
+// approval, nil otherwise
+func (s *Server) approvalFleet(fleetID *uuid.UUID) (*models.Fleet, error) {
+	if fleetID == nil {
+		return nil, nil
+	}
+
+	var fleet models.Fleet
+	if err := s.database.GetDB().Where("id = ?", *fleetID).First(&fleet).Error; err != nil {
+		return nil, err
+	}
+	if !fleet.RequireApproval {
+		return nil, nil
+	}
+	return &fleet, nil
+}
+
+// requestApproval records a deploy that waits for a second user instead of
+// starting it
+func (s *Server) requestApproval(w http.ResponseWriter, r *http.Request, approval *models.DeploymentApproval, deviceID string, software *models.Software) {
+	if err := s.recordApproval(r, approval, deviceID, software); err != nil {
+		s.logger.Error("Failed to record deployment approval", err)
+		http.Error(w, "Failed to request approval", http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse(w, approval, http.StatusAccepted)
+}
+
+// recordApproval records a deploy that waits for a second user and
+// notifies about it
+func (s *Server) recordApproval(r *http.Request, approval *models.DeploymentApproval, deviceID string, software *models.Software) error {
+	user, _ := r.Context().Value("user").(models.User)
+
+	approval.Status = models.ApprovalStatusPending
+	approval.RequestedBy = user.Username
+	if s.approvalTTL > 0 {
+		expiresAt := time.Now().Add(s.approvalTTL)
+		approval.ExpiresAt = &expiresAt
+	}
+	if err := s.database.GetDB().Create(approval).Error; err != nil {
+		return err
+	}
+
+	s.audit(r, models.AuditApprovalRequest, deviceID, "", map[string]interface{}{
+		"approval_id": approval.ID.String(),
+		"fleet_id":    approval.FleetID.String(),
+		"software":    software.Name,
+		"version":     approval.Version,
+	})
+	s.publishApproval(events.ApprovalRequested, approval, deviceID, software)
+	s.logger.Info(fmt.Sprintf("%s asked to deploy %s version %s to fleet %s, waiting for approval", user.Username, software.Name, approval.Version, approval.FleetID))
+	return nil
+}
+
+// publishApproval notifies webhooks and event streams about an approval
+func (s *Server) publishApproval(eventType string, approval *models.DeploymentApproval, deviceID string, software *models.Software) {
+	if s.bus == nil {
+		return
+	}
+
+	data := map[string]interface{}{
+		"approval_id":   approval.ID.String(),
+		"fleet_id":      approval.FleetID.String(),
+		"software_id":   software.ID.String(),
+		"software_name": software.Name,
+		"version":       approval.Version,
+		"status":        approval.Status,
+		"requested_by":  approval.RequestedBy,
+	}
+	if approval.DecidedBy != "" {
+		data["decided_by"] = approval.DecidedBy
+	}
+	if approval.Reason != "" {
+		data["reason"] = approval.Reason
+	}
+	s.bus.Publish(events.NewEvent(eventType, deviceID, data))
+}
+
+// expireApprovals marks the pending approvals that were not decided on in
+// time as expired
+func (s *Server) expireApprovals() {
+	if err := s.database.GetDB().Model(&models.DeploymentApproval{}).
+		Where("status = ? AND expires_at < ?", models.ApprovalStatusPending, time.Now()).
+		Update("status", models.ApprovalStatusExpired).Error; err != nil {
+		s.logger.Error("Failed to expire deployment approvals", err)
+	}
+}
+
+// handleApprovals lists deployment approvals, newest first, filtered by
+// status or fleet
+func (s *Server) handleApprovals(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.expireApprovals()
+
+	query := s.database.GetDB()
+	if status := r.URL.Query().Get("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if value := r.URL.Query().Get("fleet_id"); value != "" {
+		fleetID, err := uuid.Parse(value)
+		if err != nil {
+			http.Error(w, "Invalid fleet ID", http.StatusBadRequest)
+			return
+		}
+		query = query.Where("fleet_id = ?", fleetID)
+	}
+
+	approvals := []models.DeploymentApproval{}
+	if err := query.Order("created_at DESC").Limit(500).Find(&approvals).Error; err != nil {
+		s.logger.Error("Failed to fetch deployment approvals", err)
+		http.Error(w, "Failed to fetch approvals", http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse(w, approvals, http.StatusOK)
+}
+
+// handleApprovalByID returns a deployment approval
+func (s *Server) handleApprovalByID(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.expireApprovals()
+
+	approval, ok := s.findApproval(w, r)
+	if !ok {
+		return
+	}
+	jsonResponse(w, approval, http.StatusOK)
+}
+
+// findApproval loads the approval named in the path
+func (s *Server) findApproval(w http.ResponseWriter, r *http.Request) (*models.DeploymentApproval, bool) {
+	approvalID, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Approval not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	var approval models.DeploymentApproval
+	if err := s.database.GetDB().Where("id = ?", approvalID).First(&approval).Error; err != nil {
+		http.Error(w, "Approval not found", http.StatusNotFound)
+		return nil, false
+	}
+	return &approval, true
+}
+
+// handleApprovalApprove approves a deploy and starts it. Only admins and
+// operators approve, and the user who asked for the deploy cannot.
+func (s *Server) handleApprovalApprove(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, _ := r.Context().Value("user").(models.User)
+	if user.Role != models.UserRoleAdmin && user.Role != models.UserRoleOperator {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	s.expireApprovals()
+
+	approval, ok := s.findApproval(w, r)
+	if !ok {
+		return
+	}
+	if approval.Status != models.ApprovalStatusPending {
+		http.Error(w, fmt.Sprintf("Approval is %s", approval.Status), http.StatusConflict)
+		return
+	}
+	if approval.RequestedBy == user.Username {
+		http.Error(w, "Deploys must be approved by another user", http.StatusForbidden)
+		return
+	}
+
+	var software models.Software
+	if err := s.database.GetDB().Where("id = ?", approval.SoftwareID).First(&software).Error; err != nil {
+		http.Error(w, "Software no longer exists", http.StatusConflict)
+		return
+	}
+
+	// Claim the approval, so that approving it twice at once deploys once
+	now := time.Now()
+	result := s.database.GetDB().Model(&models.DeploymentApproval{}).
+		Where("id = ? AND status = ?", approval.ID, models.ApprovalStatusPending).
+		Updates(map[string]interface{}{"status": models.ApprovalStatusApproved, "decided_by": user.Username, "decided_at": now, "error": ""})
+	if result.Error != nil {
+		s.logger.Error(fmt.Sprintf("Failed to approve deployment approval %s", approval.ID), result.Error)
+		http.Error(w, "Failed to approve", http.StatusInternalServerError)
+		return
+	}
+	if result.RowsAffected == 0 {
+		http.Error(w, "Approval was decided on meanwhile", http.StatusConflict)
+		return
+	}
+	approval.Status = models.ApprovalStatusApproved
+	approval.DecidedBy = user.Username
+	approval.DecidedAt = &now
+	approval.Error = ""
+
+	deviceID := ""
+	if approval.DeviceID != nil {
+		var device models.Device
+		if err := s.database.GetDB().Where("id = ?", *approval.DeviceID).First(&device).Error; err != nil {
+			s.releaseApproval(approval, err)
+			http.Error(w, "Device no longer exists", http.StatusConflict)
+			return
+		}
+		deviceID = device.DeviceID
+
+		deployment, err := s.deployer.DeployToDevice(r.Context(), &device, &software, approval.Version)
+		if deployment == nil {
+			// Nothing was deployed, the approval can be given again once
+			// the device is back or its env fixed
+			s.releaseApproval(approval, err)
+			s.deployFailed(w, deviceID, nil, err)
+			return
+		}
+		approval.DeploymentID = &deployment.ID
+	} else {
+		var fleet models.Fleet
+		if err := s.database.GetDB().Where("id = ?", approval.FleetID).First(&fleet).Error; err != nil {
+			s.releaseApproval(approval, err)
+			http.Error(w, "Fleet no longer exists", http.StatusConflict)
+			return
+		}
+
+		retry := deploy.RetryPolicy{
+			MaxAttempts: approval.MaxAttempts,
+			Backoff:     time.Duration(approval.RetryBackoff) * time.Second,
+		}
+		rollout, err := s.deployer.StartRollout(r.Context(), &fleet, &software, approval.Version, approval.MaxConcurrent, retry)
+		if err != nil {
+			s.releaseApproval(approval, err)
+			s.rolloutFailed(w, fleet.ID.String(), err)
+			return
+		}
+		approval.RolloutID = &rollout.ID
+	}
+
+	if err := s.database.GetDB().Model(approval).
+		Updates(map[string]interface{}{"deployment_id": approval.DeploymentID, "rollout_id": approval.RolloutID}).Error; err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to update deployment approval %s", approval.ID), err)
+	}
+
+	s.audit(r, models.AuditApprovalApprove, deviceID, "", map[string]interface{}{
+		"approval_id":  approval.ID.String(),
+		"fleet_id":     approval.FleetID.String(),
+		"software":     software.Name,
+		"version":      approval.Version,
+		"requested_by": approval.RequestedBy,
+	})
+	s.publishApproval(events.ApprovalDecided, approval, deviceID, &software)
+
+	jsonResponse(w, approval, http.StatusOK)
+}
+
+// releaseApproval makes an approval pending again after its deploy could not
+// start
+func (s *Server) releaseApproval(approval *models.DeploymentApproval, cause error) {
+	if err := s.database.GetDB().Model(approval).
+		Updates(map[string]interface{}{"status": models.ApprovalStatusPending, "decided_by": "", "decided_at": nil, "error": cause.Error()}).Error; err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to release deployment approval %s", approval.ID), err)
+	}
+}
+
+// handleApprovalReject rejects a deploy. The user who asked for it may
+// reject it to withdraw it.
+func (s *Server) handleApprovalReject(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, _ := r.Context().Value("user").(models.User)
+
+	var request RejectApprovalRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if request.Reason == "" {
+		http.Error(w, "Reason is required", http.StatusBadRequest)
+		return
+	}
+
+	s.expireApprovals()
+
+	approval, ok := s.findApproval(w, r)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	result := s.database.GetDB().Model(&models.DeploymentApproval{}).
+		Where("id = ? AND status = ?", approval.ID, models.ApprovalStatusPending).
+		Updates(map[string]interface{}{"status": models.ApprovalStatusRejected, "decided_by": user.Username, "decided_at": now, "reason": request.Reason})
+	if result.Error != nil {
+		s.logger.Error(fmt.Sprintf("Failed to reject deployment approval %s", approval.ID), result.Error)
+		http.Error(w, "Failed to reject", http.StatusInternalServerError)
+		return
+	}
+	if result.RowsAffected == 0 {
+		s.database.GetDB().Where("id = ?", approval.ID).First(approval)
+		http.Error(w, fmt.Sprintf("Approval is %s", approval.Status), http.StatusConflict)
+		return
+	}
+	approval.Status = models.ApprovalStatusRejected
+	approval.DecidedBy = user.Username
+	approval.DecidedAt = &now
+	approval.Reason = request.Reason
+
+	deviceID := ""
+	if approval.DeviceID != nil {
+		s.database.GetDB().Model(&models.Device{}).Where("id = ?", *approval.DeviceID).Pluck("device_id", &deviceID)
+	}
+	var software models.Software
+	s.database.GetDB().Where("id = ?", approval.SoftwareID).First(&software)
+
+	s.audit(r, models.AuditApprovalReject, deviceID, request.Reason, map[string]interface{}{
+		"approval_id":  approval.ID.String(),
+		"fleet_id":     approval.FleetID.String(),
+		"software":     software.Name,
+		"version":      approval.Version,
+		"requested_by": approval.RequestedBy,
+	})
+	s.publishApproval(events.ApprovalDecided, approval, deviceID, &software)
+
+	jsonResponse(w, approval, http.StatusOK)
+}
+
+// handleFleetApproval shows and changes whether deploys to a fleet need
+// approval
+func (s *Server) handleFleetApproval(w http.ResponseWriter, r *http.Request) {
+	fleetID := r.PathValue("id")
+
+	var fleet models.Fleet
+	if err := s.database.GetDB().Where("id = ?", fleetID).First(&fleet).Error; err != nil {
+		http.Error(w, "Fleet not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+
+	case http.MethodPut:
+		var request FleetApprovalRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		fleet.RequireApproval = request.RequireApproval
+		if err := s.database.GetDB().Model(&fleet).Select("RequireApproval").Updates(&fleet).Error; err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to set approval of fleet %s", fleetID), err)
+			http.Error(w, "Failed to update fleet", http.StatusInternalServerError)
+			return
+		}
+		s.audit(r, models.AuditFleetApproval, "", "", map[string]interface{}{
+			"fleet_id":         fleetID,
+			"require_approval": fleet.RequireApproval,
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	jsonResponse(w, FleetApprovalRequest{RequireApproval: fleet.RequireApproval}, http.StatusOK)
+}
@@ -0,0 +1,189 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+// DeviceApp is an application on a device as reported by its agent. Env vars
+// are left out, they may hold secrets.
+type DeviceApp struct {
+	Name       string         `json:"name"`
+	Version    string         `json:"version"`
+	Strategy   string         `json:"strategy,omitempty"`
+	Color      string         `json:"color,omitempty"` // Running copy of a blue/green application
+	Containers []AppContainer `json:"containers"`
+}
+
+// AppContainer is a container of an application
+type AppContainer struct {
+	ID     string            `json:"id"`
+	Name   string            `json:"name"`
+	Image  string            `json:"image"`
+	State  string            `json:"state"`
+	Status string            `json:"status"`
+	Ports  map[string]string `json:"ports,omitempty"`
+}
+
+// AppActionRequest performs an action on an application
+type AppActionRequest struct {
+	Action string `json:"action"` // start, stop, restart, redeploy or purge-data
+}
+
+// AppActionResponse reports the outcome of an application action
+type AppActionResponse struct {
+	Action      string     `json:"action"`
+	Message     string     `json:"message"`
+	Application *DeviceApp `json:"application"`
+}
+
+// decodeApp converts an application from an agent response
+func decodeApp(value interface{}) (*DeviceApp, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var app DeviceApp
+	if err := json.Unmarshal(data, &app); err != nil {
+		return nil, err
+	}
+	if app.Containers == nil {
+		app.Containers = []AppContainer{}
+	}
+	return &app, nil
+}
+
+// connectedDevice looks up a device for a request that needs its tunnel,
+// writing the error response if it is unknown or not connected
+func (s *Server) connectedDevice(w http.ResponseWriter, deviceID string) bool {
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return false
+	}
+
+	if _, connected := s.sshServer.GetDeviceConnection(deviceID); !connected {
+		http.Error(w, "Device is not connected", http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+// handleDeviceApps lists the applications on a connected device with the
+// state of their containers, ordered by name
+func (s *Server) handleDeviceApps(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	deviceID := r.PathValue("id")
+	if !s.connectedDevice(w, deviceID) {
+		return
+	}
+
+	command, err := protocol.NewCommandWithPayload(protocol.CmdGetStatus, protocol.StatusPayload{IncludeContainers: true})
+	if err != nil {
+		s.logger.Error("Failed to build status command", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response, err := s.sshServer.SendCommand(r.Context(), deviceID, command)
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to fetch applications of device %s", deviceID), err)
+		http.Error(w, "Failed to fetch applications", http.StatusBadGateway)
+		return
+	}
+	if !response.Success {
+		http.Error(w, response.Message, http.StatusBadGateway)
+		return
+	}
+
+	reported, _ := response.Data["applications"].(map[string]interface{})
+	apps := make([]*DeviceApp, 0, len(reported))
+	for name, value := range reported {
+		app, err := decodeApp(value)
+		if err != nil {
+			s.logger.Warn(fmt.Sprintf("Invalid application %s reported by device %s: %v", name, deviceID, err))
+			continue
+		}
+		apps = append(apps, app)
+	}
+	sort.Slice(apps, func(i, j int) bool { return apps[i].Name < apps[j].Name })
+
+	jsonResponse(w, apps, http.StatusOK)
+}
+
+// handleDeviceAppActions performs an action on an application of a connected
+// device. Purging data removes the application's volumes and needs an admin.
+func (s *Server) handleDeviceAppActions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	deviceID := r.PathValue("id")
+	appName := r.PathValue("app")
+
+	var request AppActionRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if !protocol.IsAppAction(request.Action) {
+		http.Error(w, "Action must be start, stop, restart, redeploy or purge-data", http.StatusBadRequest)
+		return
+	}
+
+	user, _ := r.Context().Value("user").(models.User)
+	if request.Action == protocol.AppActionPurgeData && user.Role != models.UserRoleAdmin {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if !s.connectedDevice(w, deviceID) {
+		return
+	}
+
+	command, err := protocol.NewCommandWithPayload(protocol.CmdAppAction, protocol.AppActionPayload{
+		Name:   appName,
+		Action: request.Action,
+	})
+	if err != nil {
+		s.logger.Error("Failed to build application action command", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	s.logger.Info(fmt.Sprintf("User %s requested %s of application %s on device %s", user.Username, request.Action, appName, deviceID))
+
+	response, err := s.sshServer.SendCommand(r.Context(), deviceID, command)
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to %s application %s on device %s", request.Action, appName, deviceID), err)
+		http.Error(w, "Failed to perform action", http.StatusBadGateway)
+		return
+	}
+	if !response.Success {
+		http.Error(w, response.Message, http.StatusBadGateway)
+		return
+	}
+
+	app, err := decodeApp(response.Data["application"])
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("Invalid application %s reported by device %s", appName, deviceID), err)
+		http.Error(w, "Invalid response from device", http.StatusBadGateway)
+		return
+	}
+
+	jsonResponse(w, AppActionResponse{
+		Action:      request.Action,
+		Message:     response.Message,
+		Application: app,
+	}, http.StatusOK)
+}
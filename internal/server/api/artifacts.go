@@ -0,0 +1,174 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+
+	"github.com/edgetainer/edgetainer/internal/server/artifacts"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+	"gorm.io/gorm"
+)
+
+// SetArtifacts sets the storage of software artifacts, without one they
+// cannot be uploaded
+func (s *Server) SetArtifacts(storage *artifacts.Storage) {
+	s.artifacts = storage
+}
+
+// handleSoftwareArtifacts lists the artifacts of a software version by path
+func (s *Server) handleSoftwareArtifacts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var software models.Software
+	if err := s.database.GetDB().Where("id = ?", r.PathValue("id")).First(&software).Error; err != nil {
+		http.Error(w, "Software not found", http.StatusNotFound)
+		return
+	}
+
+	var records []models.SoftwareArtifact
+	if err := s.database.GetDB().Where("software_id = ? AND version = ?", software.ID, r.PathValue("version")).
+		Order("path").Find(&records).Error; err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to fetch artifacts of %s", software.ID), err)
+		http.Error(w, "Failed to fetch artifacts", http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse(w, records, http.StatusOK)
+}
+
+// handleSoftwareArtifact uploads, downloads or deletes an artifact of a
+// software version. Uploads are the raw content, with the permission bits
+// in the mode query parameter.
+func (s *Server) handleSoftwareArtifact(w http.ResponseWriter, r *http.Request) {
+	if s.artifacts == nil {
+		http.Error(w, "Artifact storage is not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	var software models.Software
+	if err := s.database.GetDB().Where("id = ?", r.PathValue("id")).First(&software).Error; err != nil {
+		http.Error(w, "Software not found", http.StatusNotFound)
+		return
+	}
+	version, artifactPath := r.PathValue("version"), r.PathValue("path")
+	if err := protocol.ValidateArtifactPath(artifactPath); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var record models.SoftwareArtifact
+	err := s.database.GetDB().Where("software_id = ? AND version = ? AND path = ?", software.ID, version, artifactPath).First(&record).Error
+	found := err == nil
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		s.logger.Error(fmt.Sprintf("Failed to fetch artifact %s of %s %s", artifactPath, software.ID, version), err)
+		http.Error(w, "Failed to fetch artifact", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if !found {
+			http.Error(w, "Artifact not found", http.StatusNotFound)
+			return
+		}
+		content, err := s.artifacts.Open(r.Context(), record.Digest, 0)
+		if err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to open artifact %s", record.Digest), err)
+			http.Error(w, "Failed to read artifact", http.StatusInternalServerError)
+			return
+		}
+		defer content.Close()
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(record.Path)))
+		w.Header().Set("Content-Length", strconv.FormatInt(record.Size, 10))
+		w.Header().Set("Digest", record.Digest)
+		io.Copy(w, content)
+
+	case http.MethodPut:
+		mode := uint64(0o644)
+		if value := r.URL.Query().Get("mode"); value != "" {
+			if mode, err = strconv.ParseUint(value, 8, 32); err != nil || mode > 0o777 {
+				http.Error(w, "mode must be octal permission bits, e.g. 0644", http.StatusBadRequest)
+				return
+			}
+		}
+		if !found {
+			var count int64
+			s.database.GetDB().Model(&models.SoftwareArtifact{}).Where("software_id = ? AND version = ?", software.ID, version).Count(&count)
+			if count >= protocol.MaxArtifacts {
+				http.Error(w, fmt.Sprintf("A version has at most %d artifacts", protocol.MaxArtifacts), http.StatusBadRequest)
+				return
+			}
+		}
+
+		digest, size, err := s.artifacts.Put(r.Context(), r.Body)
+		if errors.Is(err, artifacts.ErrTooLarge) {
+			http.Error(w, "Artifact too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to store artifact %s of %s %s", artifactPath, software.ID, version), err)
+			http.Error(w, "Failed to store artifact", http.StatusInternalServerError)
+			return
+		}
+
+		previous := record.Digest
+		record.Digest, record.Size, record.Mode = digest, size, uint32(mode)
+		status := http.StatusOK
+		if found {
+			err = s.database.GetDB().Model(&record).Select("Digest", "Size", "Mode").Updates(&record).Error
+		} else {
+			record.SoftwareID, record.Version, record.Path = software.ID, version, artifactPath
+			err = s.database.GetDB().Create(&record).Error
+			status = http.StatusCreated
+		}
+		if err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to save artifact %s of %s %s", artifactPath, software.ID, version), err)
+			http.Error(w, "Failed to save artifact", http.StatusInternalServerError)
+			return
+		}
+		if found && previous != digest {
+			s.releaseArtifact(r, previous)
+		}
+
+		s.logger.Info(fmt.Sprintf("Stored artifact %s of %s version %s (%d bytes, %s)", artifactPath, software.Name, version, size, digest))
+		jsonResponse(w, record, status)
+
+	case http.MethodDelete:
+		if !found {
+			http.Error(w, "Artifact not found", http.StatusNotFound)
+			return
+		}
+		if err := s.database.GetDB().Delete(&record).Error; err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to delete artifact %s of %s %s", artifactPath, software.ID, version), err)
+			http.Error(w, "Failed to delete artifact", http.StatusInternalServerError)
+			return
+		}
+		s.releaseArtifact(r, record.Digest)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// releaseArtifact removes a content from the storage once no artifact uses
+// it anymore
+func (s *Server) releaseArtifact(r *http.Request, digest string) {
+	var count int64
+	if err := s.database.GetDB().Model(&models.SoftwareArtifact{}).Where("digest = ?", digest).Count(&count).Error; err != nil || count > 0 {
+		return
+	}
+	if err := s.artifacts.Delete(r.Context(), digest); err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to remove artifact content %s", digest), err)
+	}
+}
@@ -0,0 +1,51 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+)
+
+// audit records an action of the requesting user in the audit log. Failing
+// to record it is logged but does not undo the action.
+func (s *Server) audit(r *http.Request, action, deviceID, reason string, data map[string]interface{}) {
+	user, _ := r.Context().Value("user").(models.User)
+
+	entry := models.AuditEntry{
+		Action:   action,
+		Actor:    user.Username,
+		DeviceID: deviceID,
+		Reason:   reason,
+		Data:     data,
+	}
+	if err := s.database.GetDB().Create(&entry).Error; err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to record %s of %s in the audit log", action, deviceID), err)
+	}
+}
+
+// handleAdminAudit returns the audit log, newest first
+func (s *Server) handleAdminAudit(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= 1000 {
+		limit = l
+	}
+
+	query := s.database.GetDB()
+	if action := r.URL.Query().Get("action"); action != "" {
+		query = query.Where("action = ?", action)
+	}
+	if deviceID := r.URL.Query().Get("device_id"); deviceID != "" {
+		query = query.Where("device_id = ?", deviceID)
+	}
+
+	var entries []models.AuditEntry
+	if err := query.Order("created_at DESC").Limit(limit).Find(&entries).Error; err != nil {
+		s.logger.Error("Failed to fetch audit log", err)
+		http.Error(w, "Failed to fetch audit log", http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse(w, entries, http.StatusOK)
+}
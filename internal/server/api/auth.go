@@ -4,10 +4,14 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"time"
 
+	"github.com/edgetainer/edgetainer/internal/server/extensions"
 	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // handleLogin handles the login endpoint
@@ -27,31 +31,58 @@ func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// In a real implementation, we would fetch the user from the database and validate the password
+	// Auth backends come first, the built-in users are only tried for
+	// users none of them handles
 	var user models.User
-	result := s.database.GetDB().Where("username = ?", loginRequest.Username).First(&user)
-	if result.Error != nil {
-		s.logger.Error("Failed to find user", result.Error)
+	backendUser, err := s.extensionUser(r.Context(), loginRequest.Username, loginRequest.Password)
+	switch {
+	case err == nil:
+		user = *backendUser
+
+	case errors.Is(err, extensions.ErrUnknownUser):
+		result := s.database.GetDB().Where("username = ?", loginRequest.Username).First(&user)
+		if result.Error != nil {
+			s.logger.Error("Failed to find user", result.Error)
+			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+			return
+		}
+
+		// Users of auth backends are stored with an unusable hash
+		if bcrypt.CompareHashAndPassword([]byte(user.HashedPwd), []byte(loginRequest.Password)) != nil {
+			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+			return
+		}
+
+	case errors.Is(err, extensions.ErrRejected):
+		s.logger.Info(fmt.Sprintf("Login of %s refused: %v", loginRequest.Username, err))
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
-	}
 
-	// Check password (this would use proper hashing in a real implementation)
-	// For demo purposes, we're using a simple check
-	if loginRequest.Password != "password" {
-		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+	default:
+		s.logger.Error(fmt.Sprintf("Failed to log in %s through an auth backend", loginRequest.Username), err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
+	s.respondLogin(w, r, user, http.StatusOK)
+}
+
+// respondLogin gives a user who logged in a token for the API and responds
+// with it
+func (s *Server) respondLogin(w http.ResponseWriter, r *http.Request, user models.User, status int) {
 	// Generate a token
 	token := generateAuthToken()
 
 	// Store token in database
+	now := time.Now()
 	apiToken := models.APIToken{
 		UserID:      user.ID,
 		Token:       token,
 		Description: "Login token",
-		ExpiresAt:   time.Now().AddDate(0, 0, 7), // 7 days expiration
+		ExpiresAt:   now.AddDate(0, 0, 7), // 7 days expiration
+		LastUsedAt:  &now,
+		IPAddress:   requestIP(r),
+		UserAgent:   requestUserAgent(r),
 	}
 
 	if err := s.database.GetDB().Create(&apiToken).Error; err != nil {
@@ -70,7 +101,7 @@ func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 		},
 	}
 
-	jsonResponse(w, response, http.StatusOK)
+	jsonResponse(w, response, status)
 }
 
 // generateAuthToken creates a new random token for authentication
@@ -0,0 +1,304 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/server/events"
+	"github.com/edgetainer/edgetainer/internal/server/metrics"
+)
+
+// cacheSubscriber is the name the response cache subscribes to the event bus under
+const cacheSubscriber = "api-cache"
+
+// maxCacheEntries bounds the number of cached responses, one per path and query
+const maxCacheEntries = 512
+
+// Paths of cached responses an event changes, by event type. Events not
+// listed, e.g. the progress of a deployment or a forward being opened, leave
+// the cache alone.
+var (
+	deviceCachePaths = []string{"/api/devices", "/api/fleets", "/api/stats"}
+	statsCachePaths  = []string{"/api/stats"}
+
+	cacheInvalidations = map[string][]string{
+		events.DeviceOnline:       deviceCachePaths,
+		events.DeviceOffline:      deviceCachePaths,
+		events.DeviceEnrolled:     deviceCachePaths,
+		events.DeviceReplaced:     deviceCachePaths,
+		events.DeviceRevoked:      deviceCachePaths,
+		events.DeploymentFinished: statsCachePaths,
+		events.DeploymentFailed:   statsCachePaths,
+		events.RolloutFinished:    statsCachePaths,
+		events.AlertFiring:        statsCachePaths,
+	}
+)
+
+// Cache lookup results
+const (
+	cacheHit         = "hit"
+	cacheMiss        = "miss"
+	cacheNotModified = "not_modified"
+)
+
+var cacheRequests = metrics.NewCounterVec("edgetainer_api_cache_requests_total",
+	"Requests to cached API endpoints by how they were answered.",
+	"result")
+
+// cachedResponse is a stored response of a hot read endpoint
+type cachedResponse struct {
+	contentType string
+	etag        string
+	body        []byte
+	expires     time.Time
+}
+
+// responseCache keeps responses of hot read endpoints in memory. Every write
+// through the API drops all entries, events on the bus drop those they
+// change, e.g. a device going online or offline. The generation makes sure a response computed
+// while an invalidation happened is not stored.
+type responseCache struct {
+	ttl        time.Duration
+	bus        *events.Bus
+	mu         sync.Mutex
+	generation uint64
+	entries    map[string]*cachedResponse
+	wg         sync.WaitGroup
+}
+
+// EnableCache serves device and fleet listings and stats from memory for up
+// to ttl once the server starts. Events published on bus invalidate the
+// cache, so status changes show up right away.
+func (s *Server) EnableCache(ttl time.Duration, bus *events.Bus) {
+	s.cache = &responseCache{
+		ttl:     ttl,
+		bus:     bus,
+		entries: make(map[string]*cachedResponse),
+	}
+}
+
+// start invalidates the responses events change until the bus subscription
+// ends
+func (c *responseCache) start() {
+	eventCh := c.bus.Subscribe(cacheSubscriber, 64)
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		for event := range eventCh {
+			if paths, ok := cacheInvalidations[event.Type]; ok {
+				c.invalidatePaths(paths)
+			}
+		}
+	}()
+}
+
+// stop ends the bus subscription
+func (c *responseCache) stop() {
+	c.bus.Unsubscribe(cacheSubscriber)
+	c.wg.Wait()
+}
+
+// get returns an unexpired response and the current generation
+func (c *responseCache) get(key string, now time.Time) (*cachedResponse, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || now.After(entry.expires) {
+		return nil, c.generation
+	}
+	return entry, c.generation
+}
+
+// put stores a response unless the cache was invalidated since generation
+func (c *responseCache) put(key string, entry *cachedResponse, generation uint64, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+	if len(c.entries) >= maxCacheEntries {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxCacheEntries {
+			c.entries = make(map[string]*cachedResponse)
+		}
+	}
+	entry.expires = now.Add(c.ttl)
+	c.entries[key] = entry
+}
+
+// invalidate drops all cached responses
+func (c *responseCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	if len(c.entries) > 0 {
+		c.entries = make(map[string]*cachedResponse)
+	}
+}
+
+// invalidatePaths drops the cached responses of paths starting with one of
+// prefixes
+func (c *responseCache) invalidatePaths(prefixes []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	for key := range c.entries {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(key, prefix) {
+				delete(c.entries, key)
+				break
+			}
+		}
+	}
+}
+
+// bufferedResponse holds a response back so it can be hashed and stored
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+// Header returns the header map of the response
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+// WriteHeader records the status code
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+// Write buffers the body
+func (b *bufferedResponse) Write(data []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(data)
+}
+
+// cached serves GET requests of a read endpoint with an ETag, answering
+// If-None-Match with 304 Not Modified. With caching enabled successful
+// responses are kept in memory, other methods pass straight through.
+func (s *Server) cached(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			next(w, r)
+			return
+		}
+
+		key := r.URL.Path + "?" + r.URL.RawQuery
+		now := time.Now()
+
+		var generation uint64
+		if s.cache != nil {
+			var entry *cachedResponse
+			entry, generation = s.cache.get(key, now)
+			if entry != nil {
+				if etagMatches(r.Header.Get("If-None-Match"), entry.etag) {
+					cacheRequests.WithLabelValues(cacheNotModified).Inc()
+				} else {
+					cacheRequests.WithLabelValues(cacheHit).Inc()
+				}
+				writeCached(w, r, entry)
+				return
+			}
+			cacheRequests.WithLabelValues(cacheMiss).Inc()
+		}
+
+		buffered := &bufferedResponse{header: make(http.Header)}
+		next(buffered, r)
+
+		if buffered.status != http.StatusOK {
+			for name, values := range buffered.header {
+				w.Header()[name] = values
+			}
+			if buffered.status != 0 {
+				w.WriteHeader(buffered.status)
+			}
+			w.Write(buffered.body.Bytes())
+			return
+		}
+
+		sum := sha256.Sum256(buffered.body.Bytes())
+		entry := &cachedResponse{
+			contentType: buffered.header.Get("Content-Type"),
+			etag:        `"` + hex.EncodeToString(sum[:16]) + `"`,
+			body:        buffered.body.Bytes(),
+		}
+		if s.cache != nil {
+			s.cache.put(key, entry, generation, now)
+		}
+		writeCached(w, r, entry)
+	}
+}
+
+// writeCached writes a response with its ETag, or 304 Not Modified when the
+// client already has it
+func writeCached(w http.ResponseWriter, r *http.Request, entry *cachedResponse) {
+	// Clients have to revalidate, the data changes with every device status
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Header().Set("ETag", entry.etag)
+
+	if etagMatches(r.Header.Get("If-None-Match"), entry.etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if entry.contentType != "" {
+		w.Header().Set("Content-Type", entry.contentType)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(entry.body)
+}
+
+// etagMatches reports whether an If-None-Match header names etag
+func etagMatches(header, etag string) bool {
+	if header == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheInvalidationMiddleware drops cached responses after every API request
+// that may have changed data, so writes show up in listings right away
+func (s *Server) cacheInvalidationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions,
+			!strings.HasPrefix(r.URL.Path, "/api/"),
+			strings.HasPrefix(r.URL.Path, "/api/auth/"):
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		if recorder.status < http.StatusBadRequest {
+			s.cache.invalidate()
+		}
+	})
+}
@@ -0,0 +1,54 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/server/events"
+)
+
+func TestCacheInvalidatesOnlyChangedPaths(t *testing.T) {
+	bus := events.NewBus()
+	cache := &responseCache{ttl: time.Minute, bus: bus, entries: make(map[string]*cachedResponse)}
+	cache.start()
+	defer cache.stop()
+
+	now := time.Now()
+	fill := func() {
+		for _, key := range []string{"/api/devices?", "/api/fleets?", "/api/stats?days=7"} {
+			_, generation := cache.get(key, now)
+			cache.put(key, &cachedResponse{}, generation, now)
+		}
+	}
+	cached := func(key string) bool {
+		entry, _ := cache.get(key, now)
+		return entry != nil
+	}
+	waitUncached := func(key string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for cached(key) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s still cached", key)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	// Progress leaves the cache alone, the stats of a finished deployment
+	// are dropped
+	fill()
+	bus.Publish(events.NewEvent(events.DeploymentProgress, "dev-1", nil))
+	bus.Publish(events.NewEvent(events.DeploymentFinished, "dev-1", nil))
+	waitUncached("/api/stats?days=7")
+	if !cached("/api/devices?") || !cached("/api/fleets?") {
+		t.Fatal("deployment events dropped device and fleet listings")
+	}
+
+	// A device going offline changes every cached endpoint
+	fill()
+	bus.Publish(events.NewEvent(events.DeviceOffline, "dev-1", nil))
+	for _, key := range []string{"/api/devices?", "/api/fleets?", "/api/stats?days=7"} {
+		waitUncached(key)
+	}
+}
@@ -0,0 +1,256 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+	"github.com/google/uuid"
+)
+
+const (
+	// captureMargin is how long after its duration a packet capture may take
+	// to arrive before it is marked failed
+	captureMargin = 5 * time.Minute
+	// capturesKept is the number of packet captures kept per device, older
+	// ones are removed when a new one is started
+	capturesKept = 5
+)
+
+// CaptureRequest starts a packet capture on a device. The reason is recorded
+// in the audit log.
+type CaptureRequest struct {
+	Interface string `json:"interface"`
+	Network   string `json:"network"`
+	Filter    string `json:"filter"`
+	Duration  int    `json:"duration"`
+	MaxBytes  int64  `json:"max_bytes"`
+	SnapLen   int    `json:"snap_len"`
+	Reason    string `json:"reason"`
+}
+
+// handleDeviceCaptures lists the packet captures of a device, newest first,
+// or starts a new one
+func (s *Server) handleDeviceCaptures(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.PathValue("id")
+
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	s.expireCaptures(device.ID)
+
+	switch r.Method {
+	case http.MethodGet:
+		var captures []models.PacketCapture
+		if err := s.database.GetDB().Omit("data").Where("device_id = ?", device.ID).
+			Order("created_at DESC").Find(&captures).Error; err != nil {
+			s.logger.Error("Failed to fetch packet captures", err)
+			http.Error(w, "Failed to fetch packet captures", http.StatusInternalServerError)
+			return
+		}
+		jsonResponse(w, captures, http.StatusOK)
+
+	case http.MethodPost:
+		s.startCapture(w, r, &device)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// startCapture asks a connected device to capture packets and answers with
+// the running capture
+func (s *Server) startCapture(w http.ResponseWriter, r *http.Request, device *models.Device) {
+	var request CaptureRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	payload := protocol.CapturePayload{
+		Interface: request.Interface,
+		Network:   request.Network,
+		Filter:    request.Filter,
+		Duration:  request.Duration,
+		MaxBytes:  request.MaxBytes,
+		SnapLen:   request.SnapLen,
+	}
+	if err := payload.Normalize(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, connected := s.sshServer.GetDeviceConnection(device.DeviceID); !connected {
+		http.Error(w, "Device is not connected", http.StatusConflict)
+		return
+	}
+	if !protocol.HasFeature(device.AgentFeatures, protocol.FeatureCapture) {
+		http.Error(w, fmt.Sprintf("Agent version %s does not support packet captures", device.AgentVersion), http.StatusConflict)
+		return
+	}
+
+	user, _ := r.Context().Value("user").(models.User)
+	capture := models.PacketCapture{
+		DeviceID:    device.ID,
+		Interface:   payload.Interface,
+		Network:     payload.Network,
+		Filter:      payload.Filter,
+		Duration:    payload.Duration,
+		MaxBytes:    payload.MaxBytes,
+		Status:      models.CaptureStatusCapturing,
+		Reason:      request.Reason,
+		RequestedBy: user.Username,
+	}
+	if err := s.database.GetDB().Create(&capture).Error; err != nil {
+		s.logger.Error("Failed to create packet capture", err)
+		http.Error(w, "Failed to create packet capture", http.StatusInternalServerError)
+		return
+	}
+	payload.CaptureID = capture.ID.String()
+
+	// Captures can see any traffic of the site, so every attempt is recorded
+	s.audit(r, models.AuditCaptureStart, device.DeviceID, request.Reason, map[string]interface{}{
+		"capture_id": capture.ID.String(),
+		"interface":  payload.Interface,
+		"network":    payload.Network,
+		"filter":     payload.Filter,
+		"duration":   payload.Duration,
+		"max_bytes":  payload.MaxBytes,
+	})
+
+	// The agent turns the request down while another capture runs, or when
+	// tcpdump or the network is missing
+	response, err := s.sshServer.RequestCapture(r.Context(), device.DeviceID, payload)
+	if err != nil || !response.Success {
+		status, message := http.StatusConflict, ""
+		if err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to request packet capture from device %s", device.DeviceID), err)
+			status, message = http.StatusBadGateway, err.Error()
+		} else {
+			message = response.Message
+		}
+		s.database.GetDB().Model(&capture).Updates(map[string]interface{}{
+			"status":       models.CaptureStatusFailed,
+			"error":        message,
+			"completed_at": time.Now(),
+		})
+		http.Error(w, fmt.Sprintf("Failed to start packet capture: %s", message), status)
+		return
+	}
+
+	s.logger.Info(fmt.Sprintf("User %s started a packet capture on %s of device %s", user.Username, payload.Interface+payload.Network, device.DeviceID))
+
+	// Keep the newest captures only, they can be large
+	var old []uuid.UUID
+	s.database.GetDB().Model(&models.PacketCapture{}).Where("device_id = ?", device.ID).
+		Order("created_at DESC").Offset(capturesKept).Pluck("id", &old)
+	if len(old) > 0 {
+		s.deleteObjects(r, &models.PacketCapture{}, old)
+		s.database.GetDB().Where("id IN ?", old).Delete(&models.PacketCapture{})
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/api/devices/%s/captures/%s", device.DeviceID, capture.ID))
+	jsonResponse(w, capture, http.StatusAccepted)
+}
+
+// handleDeviceCapture returns or deletes a packet capture
+func (s *Server) handleDeviceCapture(w http.ResponseWriter, r *http.Request) {
+	device, capture, ok := s.deviceCapture(w, r, false)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		jsonResponse(w, capture, http.StatusOK)
+
+	case http.MethodDelete:
+		s.deleteObjects(r, &models.PacketCapture{}, []uuid.UUID{capture.ID})
+		if err := s.database.GetDB().Delete(capture).Error; err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to delete packet capture %s of device %s", capture.ID, device.DeviceID), err)
+			http.Error(w, "Failed to delete packet capture", http.StatusInternalServerError)
+			return
+		}
+		s.audit(r, models.AuditCaptureDelete, device.DeviceID, "", map[string]interface{}{
+			"capture_id": capture.ID.String(),
+		})
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleCaptureDownload serves a packet capture as a pcap file
+func (s *Server) handleCaptureDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	device, capture, ok := s.deviceCapture(w, r, true)
+	if !ok {
+		return
+	}
+	if capture.Status != models.CaptureStatusReady {
+		http.Error(w, fmt.Sprintf("Packet capture is %s", capture.Status), http.StatusConflict)
+		return
+	}
+
+	s.audit(r, models.AuditCaptureDownload, device.DeviceID, "", map[string]interface{}{
+		"capture_id": capture.ID.String(),
+	})
+
+	filename := fmt.Sprintf("capture-%s-%s.pcap", device.DeviceID, capture.CreatedAt.UTC().Format("20060102-150405"))
+	w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	s.writeData(w, r, capture.Object, capture.Data, capture.Size)
+}
+
+// deviceCapture looks up the device and packet capture of a request, writing
+// the error response if either is unknown. The capture data is only loaded
+// if asked for.
+func (s *Server) deviceCapture(w http.ResponseWriter, r *http.Request, withData bool) (*models.Device, *models.PacketCapture, bool) {
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", r.PathValue("id")).First(&device).Error; err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+
+	captureID, err := uuid.Parse(r.PathValue("capture"))
+	if err != nil {
+		http.Error(w, "Packet capture not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+	s.expireCaptures(device.ID)
+
+	query := s.database.GetDB()
+	if !withData {
+		query = query.Omit("data")
+	}
+	var capture models.PacketCapture
+	if err := query.Where("id = ? AND device_id = ?", captureID, device.ID).First(&capture).Error; err != nil {
+		http.Error(w, "Packet capture not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+	return &device, &capture, true
+}
+
+// expireCaptures marks the captures of a device that did not finish well
+// after their duration as failed, e.g. because the device went offline while
+// capturing
+func (s *Server) expireCaptures(deviceID uuid.UUID) {
+	s.database.GetDB().Model(&models.PacketCapture{}).
+		Where("device_id = ? AND status = ? AND created_at + (duration + ?) * interval '1 second' < ?", deviceID,
+			models.CaptureStatusCapturing, int(captureMargin.Seconds()), time.Now()).
+		Updates(map[string]interface{}{
+			"status":       models.CaptureStatusFailed,
+			"error":        "the device did not finish the capture in time",
+			"data":         nil,
+			"completed_at": time.Now(),
+		})
+}
@@ -0,0 +1,58 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/edgetainer/edgetainer/internal/server/ssh"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+)
+
+// handleAdminConnections lists the live device tunnels with their remote
+// address, forwarded ports and traffic, for debugging NAT and firewall
+// issues at sites
+func (s *Server) handleAdminConnections(w http.ResponseWriter, r *http.Request) {
+	jsonResponse(w, s.sshServer.Connections(), http.StatusOK)
+}
+
+// handleAdminConnectionDisconnect closes the tunnel of a device, which then
+// reconnects on its own
+func (s *Server) handleAdminConnectionDisconnect(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.PathValue("id")
+
+	if !s.sshServer.Disconnect(deviceID) {
+		http.Error(w, "Device is not connected", http.StatusNotFound)
+		return
+	}
+
+	s.logger.Info(fmt.Sprintf("Connection of device %s closed by an admin", deviceID))
+	s.audit(r, models.AuditConnectionDisconnect, deviceID, "", nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAdminConnectionReallocate moves the forwards of a device to new
+// server ports
+func (s *Server) handleAdminConnectionReallocate(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.PathValue("id")
+
+	moved, err := s.sshServer.ReallocatePorts(deviceID)
+	if len(moved) > 0 {
+		ports := make(map[string]interface{}, len(moved))
+		for _, m := range moved {
+			ports[fmt.Sprint(m.OldPort)] = m.Forward.Port
+		}
+		s.audit(r, models.AuditConnectionReallocate, deviceID, "", map[string]interface{}{"ports": ports})
+	}
+	if err != nil {
+		if errors.Is(err, ssh.ErrNotConnected) {
+			http.Error(w, "Device is not connected", http.StatusNotFound)
+			return
+		}
+		s.logger.Error(fmt.Sprintf("Failed to reallocate ports of device %s", deviceID), err)
+		http.Error(w, "Failed to reallocate ports", http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse(w, moved, http.StatusOK)
+}
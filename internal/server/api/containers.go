@@ -0,0 +1,84 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/google/uuid"
+)
+
+// FleetContainer is an application container with the device it runs on
+type FleetContainer struct {
+	models.DeviceContainer
+	Device     string `json:"device"` // Device ID of the device
+	DeviceName string `json:"device_name"`
+}
+
+// handleDeviceContainers lists the application containers of a device as
+// its last heartbeat reported them, without asking the device
+func (s *Server) handleDeviceContainers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	deviceID := r.PathValue("id")
+
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	containers := []models.DeviceContainer{}
+	if err := s.database.GetDB().Where("device_id = ?", device.ID).Order("app, name").Find(&containers).Error; err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to fetch containers of device %s", deviceID), err)
+		http.Error(w, "Failed to fetch containers", http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse(w, containers, http.StatusOK)
+}
+
+// handleContainers lists the application containers of every device,
+// filtered by fleet, application, state, health or image
+func (s *Server) handleContainers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := s.database.GetDB().Table("device_containers").
+		Select("device_containers.*, devices.device_id AS device, devices.name AS device_name").
+		Joins("JOIN devices ON devices.id = device_containers.device_id")
+
+	params := r.URL.Query()
+	if value := params.Get("fleet_id"); value != "" {
+		fleetID, err := uuid.Parse(value)
+		if err != nil {
+			http.Error(w, "Invalid fleet ID", http.StatusBadRequest)
+			return
+		}
+		query = query.Where("devices.fleet_id = ?", fleetID)
+	}
+	for param, column := range map[string]string{
+		"app":    "device_containers.app",
+		"state":  "device_containers.state",
+		"health": "device_containers.health",
+		"image":  "device_containers.image",
+	} {
+		if value := params.Get(param); value != "" {
+			query = query.Where(column+" = ?", value)
+		}
+	}
+
+	containers := []FleetContainer{}
+	if err := query.Order("devices.name, device_containers.app, device_containers.name").Scan(&containers).Error; err != nil {
+		s.logger.Error("Failed to fetch containers", err)
+		http.Error(w, "Failed to fetch containers", http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse(w, containers, http.StatusOK)
+}
@@ -0,0 +1,286 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/edgetainer/edgetainer/internal/server/customfields"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// fieldFilterPrefix marks query parameters filtering devices by a custom
+// field, e.g. ?field.store_number=42
+const fieldFilterPrefix = "field."
+
+// DeviceCustomFields is the custom fields of a device and their values
+type DeviceCustomFields struct {
+	Fields []models.CustomField `json:"fields"`
+	Values map[string]string    `json:"values"`
+}
+
+// isAdmin reports whether the authenticated user is an admin
+func isAdmin(r *http.Request) bool {
+	user, ok := r.Context().Value("user").(models.User)
+	return ok && user.Role == models.UserRoleAdmin
+}
+
+// checkCustomFields validates the custom field values of a device in a fleet,
+// writing the error response if they are invalid
+func (s *Server) checkCustomFields(w http.ResponseWriter, fleetID *uuid.UUID, values map[string]string) bool {
+	fields, err := customfields.ForFleet(s.database.GetDB(), fleetID)
+	if err != nil {
+		s.logger.Error("Failed to fetch custom fields", err)
+		http.Error(w, "Failed to fetch custom fields", http.StatusInternalServerError)
+		return false
+	}
+
+	if err := customfields.Check(fields, values); err != nil {
+		var validationErr *customfields.ValidationError
+		if errors.As(err, &validationErr) {
+			jsonResponse(w, validationErr, http.StatusUnprocessableEntity)
+		} else {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return false
+	}
+	return true
+}
+
+// filterByCustomFields restricts a device query to the custom field values
+// given as field.<name> query parameters
+func filterByCustomFields(query *gorm.DB, r *http.Request) (*gorm.DB, error) {
+	for key, values := range r.URL.Query() {
+		name, ok := strings.CutPrefix(key, fieldFilterPrefix)
+		if !ok {
+			continue
+		}
+		if !customfields.ValidName(name) {
+			return nil, fmt.Errorf("invalid custom field filter %s", key)
+		}
+		query = query.Where("custom_fields->>?::text IN ?", name, values)
+	}
+	return query, nil
+}
+
+// handleCustomFields handles the custom field definitions endpoint. Anyone
+// may list the fields, only admins define them.
+func (s *Server) handleCustomFields(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		// List all fields, or those that apply to the devices of a fleet
+		var fields []models.CustomField
+		var err error
+		if fleetID := r.URL.Query().Get("fleet_id"); fleetID != "" {
+			id, parseErr := uuid.Parse(fleetID)
+			if parseErr != nil {
+				http.Error(w, "Invalid fleet ID", http.StatusBadRequest)
+				return
+			}
+			fields, err = customfields.ForFleet(s.database.GetDB(), &id)
+		} else {
+			err = s.database.GetDB().Order("name").Find(&fields).Error
+		}
+		if err != nil {
+			s.logger.Error("Failed to fetch custom fields", err)
+			http.Error(w, "Failed to fetch custom fields", http.StatusInternalServerError)
+			return
+		}
+
+		jsonResponse(w, fields, http.StatusOK)
+
+	case http.MethodPost:
+		if !isAdmin(r) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		var field models.CustomField
+		if err := json.NewDecoder(r.Body).Decode(&field); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		field.ID = uuid.Nil
+
+		if err := customfields.ValidateDefinition(&field); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if field.FleetID != nil {
+			if err := s.database.GetDB().First(&models.Fleet{}, "id = ?", *field.FleetID).Error; err != nil {
+				http.Error(w, "Fleet not found", http.StatusBadRequest)
+				return
+			}
+		}
+
+		// A name is either global or used by fleets, so a device never sees
+		// two fields of the same name
+		conflicts := s.database.GetDB().Model(&models.CustomField{}).Where("name = ?", field.Name)
+		if field.FleetID != nil {
+			conflicts = conflicts.Where("fleet_id IS NULL OR fleet_id = ?", *field.FleetID)
+		}
+		var count int64
+		if err := conflicts.Count(&count).Error; err != nil {
+			s.logger.Error("Failed to check custom fields", err)
+			http.Error(w, "Failed to create custom field", http.StatusInternalServerError)
+			return
+		}
+		if count > 0 {
+			http.Error(w, fmt.Sprintf("Custom field %s already exists", field.Name), http.StatusConflict)
+			return
+		}
+
+		if err := s.database.GetDB().Create(&field).Error; err != nil {
+			s.logger.Error("Failed to create custom field", err)
+			http.Error(w, "Failed to create custom field", http.StatusInternalServerError)
+			return
+		}
+
+		jsonResponse(w, field, http.StatusCreated)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleCustomFieldByID handles a custom field definition. The name and fleet
+// of a field cannot change, since devices hold values under them.
+func (s *Server) handleCustomFieldByID(w http.ResponseWriter, r *http.Request) {
+	fieldID := r.PathValue("id")
+
+	var field models.CustomField
+	if err := s.database.GetDB().Where("id = ?", fieldID).First(&field).Error; err != nil {
+		http.Error(w, "Custom field not found", http.StatusNotFound)
+		return
+	}
+
+	if r.Method != http.MethodGet && !isAdmin(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		jsonResponse(w, field, http.StatusOK)
+
+	case http.MethodPut:
+		var request models.CustomField
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		field.Label = request.Label
+		field.Description = request.Description
+		field.Type = request.Type
+		field.Options = request.Options
+		field.Required = request.Required
+		if err := customfields.ValidateDefinition(&field); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := s.database.GetDB().Save(&field).Error; err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to update custom field %s", fieldID), err)
+			http.Error(w, "Failed to update custom field", http.StatusInternalServerError)
+			return
+		}
+
+		jsonResponse(w, field, http.StatusOK)
+
+	case http.MethodDelete:
+		// Remove the values of the field along with it
+		err := s.database.GetDB().Transaction(func(tx *gorm.DB) error {
+			if err := tx.Delete(&field).Error; err != nil {
+				return err
+			}
+
+			devices := tx.Model(&models.Device{}).Where("custom_fields->>?::text IS NOT NULL", field.Name)
+			if field.FleetID != nil {
+				devices = devices.Where("fleet_id = ?", *field.FleetID)
+			}
+			return devices.Update("custom_fields", gorm.Expr("custom_fields - ?::text", field.Name)).Error
+		})
+		if err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to delete custom field %s", fieldID), err)
+			http.Error(w, "Failed to delete custom field", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleDeviceCustomFields handles the custom field values of a device. PUT
+// merges the given values; null or an empty string removes a value. Values of
+// fields that no longer apply to the device, e.g. after it moved to another
+// fleet, are dropped.
+func (s *Server) handleDeviceCustomFields(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.PathValue("id")
+
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	fields, err := customfields.ForFleet(s.database.GetDB(), device.FleetID)
+	if err != nil {
+		s.logger.Error("Failed to fetch custom fields", err)
+		http.Error(w, "Failed to fetch custom fields", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+
+	case http.MethodPut:
+		var request map[string]*string
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		values := make(map[string]string)
+		for _, field := range fields {
+			if value, ok := device.CustomFields[field.Name]; ok {
+				values[field.Name] = value
+			}
+		}
+		for name, value := range request {
+			if value == nil || *value == "" {
+				delete(values, name)
+			} else {
+				values[name] = *value
+			}
+		}
+
+		if !s.checkCustomFields(w, device.FleetID, values) {
+			return
+		}
+
+		if err := s.database.GetDB().Model(&device).Select("custom_fields").Updates(models.Device{CustomFields: values}).Error; err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to update custom fields of device %s", deviceID), err)
+			http.Error(w, "Failed to update custom fields", http.StatusInternalServerError)
+			return
+		}
+		device.CustomFields = values
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if device.CustomFields == nil {
+		device.CustomFields = map[string]string{}
+	}
+	jsonResponse(w, DeviceCustomFields{Fields: fields, Values: device.CustomFields}, http.StatusOK)
+}
@@ -0,0 +1,730 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/edgetainer/edgetainer/internal/server/deploy"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// externalIDPattern matches the external IDs of declared resources, which
+// appear in paths
+var externalIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._:@-]{0,254}$`)
+
+// FleetSpec declares a fleet. Settings changed by admins through their own
+// routes, like the forward policy or freeze, are left alone.
+type FleetSpec struct {
+	Name           string `json:"name"`
+	Description    string `json:"description"`
+	DeviceIDPrefix string `json:"device_id_prefix"`
+	Timezone       string `json:"timezone"`
+	Locale         string `json:"locale"`
+	TunnelRate     int    `json:"tunnel_rate_kbps"`
+	PullRate       int    `json:"pull_rate_kbps"`
+	MaxDeploys     int    `json:"max_concurrent_deploys"`
+}
+
+// SoftwareSpec declares a software
+type SoftwareSpec struct {
+	Name           string            `json:"name"`
+	Source         string            `json:"source"` // manual unless set
+	RepoURL        string            `json:"repo_url"`
+	Version        string            `json:"version"` // Current version
+	ComposeYAML    string            `json:"docker_compose_yaml"`
+	DefaultEnvVars map[string]string `json:"default_env_vars"`
+	Strategy       string            `json:"strategy"`
+	Platforms      []string          `json:"platforms"`
+}
+
+// DeploymentSpec declares a software running on a fleet. It is the default
+// software of the fleet, so devices that join get it, and is rolled out to
+// the devices in the fleet when its version changes.
+type DeploymentSpec struct {
+	Fleet           string                          `json:"fleet"`    // External ID of the fleet
+	Software        string                          `json:"software"` // External ID of the software
+	Version         string                          `json:"version"`  // Empty for the current version of the software
+	ExposedServices []models.ExposedServiceTemplate `json:"exposed_services"`
+	Rollout         *bool                           `json:"rollout,omitempty"` // Roll out version changes, true unless set to false
+}
+
+// ExposedServiceSpec declares a service exposed on a device
+type ExposedServiceSpec struct {
+	Device         string   `json:"device"` // Device ID
+	Name           string   `json:"name"`
+	ContainerName  string   `json:"container_name"`
+	InternalPort   int      `json:"internal_port"`
+	ExternalPort   int      `json:"external_port"`
+	Protocol       string   `json:"protocol"`
+	URLPath        string   `json:"url_path"`
+	AuthRequired   *bool    `json:"auth_required,omitempty"` // True unless set to false
+	AllowedSources []string `json:"allowed_sources"`
+	Enabled        *bool    `json:"enabled,omitempty"` // True unless set to false
+}
+
+// ResourceResponse reports a declared resource and its current state
+type ResourceResponse struct {
+	models.ResourceRef
+	Changed    bool        `json:"changed"`               // The PUT applied a changed spec
+	Missing    bool        `json:"missing,omitempty"`     // The resource was deleted outside the declarative API, the next PUT creates it again
+	RolloutID  *uuid.UUID  `json:"rollout_id,omitempty"`  // Started by the PUT
+	ApprovalID *uuid.UUID  `json:"approval_id,omitempty"` // Requested by the PUT, the fleet needs approval for deploys
+	Resource   interface{} `json:"resource,omitempty"`
+}
+
+// appliedResource is the outcome of applying a spec
+type appliedResource struct {
+	id         uuid.UUID
+	rolloutID  *uuid.UUID
+	approvalID *uuid.UUID
+}
+
+// handleResources lists the declared resources of a kind
+func (s *Server) handleResources(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	kind := r.PathValue("kind")
+	if !validResourceKind(kind) {
+		http.Error(w, "Unknown resource kind", http.StatusNotFound)
+		return
+	}
+
+	refs := []models.ResourceRef{}
+	if err := s.database.GetDB().Where("kind = ?", kind).Order("external_id").Find(&refs).Error; err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to fetch declared %s", kind), err)
+		http.Error(w, "Failed to fetch resources", http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, refs, http.StatusOK)
+}
+
+// handleResource reads, applies or deletes a declared resource. PUT creates
+// the resource on the first call and updates it on later ones, so applying
+// the same spec again changes nothing.
+func (s *Server) handleResource(w http.ResponseWriter, r *http.Request) {
+	kind := r.PathValue("kind")
+	externalID := r.PathValue("external_id")
+	if !validResourceKind(kind) {
+		http.Error(w, "Unknown resource kind", http.StatusNotFound)
+		return
+	}
+	if !externalIDPattern.MatchString(externalID) {
+		http.Error(w, "External IDs have up to 255 letters, digits and . _ : @ -, starting with a letter or digit", http.StatusBadRequest)
+		return
+	}
+
+	var ref models.ResourceRef
+	err := s.database.GetDB().Where("kind = ? AND external_id = ?", kind, externalID).First(&ref).Error
+	found := err == nil
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		s.logger.Error(fmt.Sprintf("Failed to fetch declared %s %s", kind, externalID), err)
+		http.Error(w, "Failed to fetch resource", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if !found {
+			http.Error(w, "Resource not found", http.StatusNotFound)
+			return
+		}
+		response := ResourceResponse{ResourceRef: ref}
+		response.Resource, response.Missing = s.loadResource(kind, ref.ResourceID)
+		w.Header().Set("ETag", strconv.Quote(ref.SpecHash))
+		jsonResponse(w, response, http.StatusOK)
+
+	case http.MethodPut:
+		if !s.mayChangeResource(w, r, kind) {
+			return
+		}
+		s.applyResource(w, r, kind, externalID, &ref, found)
+
+	case http.MethodDelete:
+		if !found {
+			http.Error(w, "Resource not found", http.StatusNotFound)
+			return
+		}
+		if !s.mayChangeResource(w, r, kind) {
+			return
+		}
+		if err := s.deleteResource(kind, ref.ResourceID); err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to delete declared %s %s", kind, externalID), err)
+			http.Error(w, "Failed to delete resource", http.StatusInternalServerError)
+			return
+		}
+		if err := s.database.GetDB().Delete(&ref).Error; err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to delete declared %s %s", kind, externalID), err)
+			http.Error(w, "Failed to delete resource", http.StatusInternalServerError)
+			return
+		}
+		s.audit(r, models.AuditResourceDelete, "", "", map[string]interface{}{
+			"kind":        kind,
+			"external_id": externalID,
+			"id":          ref.ResourceID,
+		})
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// validResourceKind reports whether the declarative API manages a kind
+func validResourceKind(kind string) bool {
+	switch kind {
+	case models.ResourceKindFleet, models.ResourceKindSoftware, models.ResourceKindDeployment, models.ResourceKindExposedService:
+		return true
+	}
+	return false
+}
+
+// mayChangeResource checks that the user may change resources of a kind.
+// How exposed services are protected is changed by admins only. It writes
+// the error response and returns false if not.
+func (s *Server) mayChangeResource(w http.ResponseWriter, r *http.Request, kind string) bool {
+	user, _ := r.Context().Value("user").(models.User)
+	if kind == models.ResourceKindExposedService && user.Role != models.UserRoleAdmin {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// declaredFleet returns the fleet of the declared resource in the path, so
+// changes to it are held back by the fleet's freeze
+func (s *Server) declaredFleet(r *http.Request) *uuid.UUID {
+	var ref models.ResourceRef
+	if err := s.database.GetDB().Where("kind = ? AND external_id = ?", r.PathValue("kind"), r.PathValue("external_id")).First(&ref).Error; err != nil {
+		return nil
+	}
+
+	switch ref.Kind {
+	case models.ResourceKindFleet:
+		return &ref.ResourceID
+	case models.ResourceKindDeployment:
+		var entry models.FleetDefaultSoftware
+		if err := s.database.GetDB().Select("fleet_id").Where("id = ?", ref.ResourceID).First(&entry).Error; err == nil {
+			return &entry.FleetID
+		}
+	case models.ResourceKindExposedService:
+		var service models.ExposedService
+		if err := s.database.GetDB().Select("device_id").Where("id = ?", ref.ResourceID).First(&service).Error; err != nil {
+			return nil
+		}
+		var device models.Device
+		if err := s.database.GetDB().Select("fleet_id").Where("id = ?", service.DeviceID).First(&device).Error; err == nil {
+			return device.FleetID
+		}
+	}
+	return nil
+}
+
+// applyResource applies the spec in the request to a declared resource
+func (s *Server) applyResource(w http.ResponseWriter, r *http.Request, kind, externalID string, ref *models.ResourceRef, found bool) {
+	var spec interface{}
+	switch kind {
+	case models.ResourceKindFleet:
+		spec = &FleetSpec{}
+	case models.ResourceKindSoftware:
+		spec = &SoftwareSpec{}
+	case models.ResourceKindDeployment:
+		spec = &DeploymentSpec{}
+	case models.ResourceKindExposedService:
+		spec = &ExposedServiceSpec{}
+	}
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(spec); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid spec: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	encoded, _ := json.Marshal(spec)
+	sum := sha256.Sum256(encoded)
+	specHash := hex.EncodeToString(sum[:])
+
+	// The same spec as last time changes nothing, unless the resource was
+	// deleted since
+	if found && ref.SpecHash == specHash {
+		if resource, missing := s.loadResource(kind, ref.ResourceID); !missing {
+			w.Header().Set("ETag", strconv.Quote(ref.SpecHash))
+			jsonResponse(w, ResourceResponse{ResourceRef: *ref, Resource: resource}, http.StatusOK)
+			return
+		}
+	}
+
+	// Resources are updated in place while they exist
+	var current *uuid.UUID
+	if found {
+		if _, missing := s.loadResource(kind, ref.ResourceID); !missing {
+			current = &ref.ResourceID
+		}
+	}
+	adopt, _ := strconv.ParseBool(r.URL.Query().Get("adopt"))
+
+	var applied *appliedResource
+	var ok bool
+	switch spec := spec.(type) {
+	case *FleetSpec:
+		applied, ok = s.applyFleetSpec(w, spec, current, adopt)
+	case *SoftwareSpec:
+		applied, ok = s.applySoftwareSpec(w, r, spec, current, adopt)
+	case *DeploymentSpec:
+		var previous DeploymentSpec
+		if found {
+			json.Unmarshal([]byte(ref.Spec), &previous)
+		}
+		applied, ok = s.applyDeploymentSpec(w, r, spec, &previous, current)
+	case *ExposedServiceSpec:
+		applied, ok = s.applyExposedServiceSpec(w, spec, current)
+	}
+	if !ok {
+		return
+	}
+
+	user, _ := r.Context().Value("user").(models.User)
+	ref.Kind = kind
+	ref.ExternalID = externalID
+	ref.ResourceID = applied.id
+	ref.Spec = string(encoded)
+	ref.SpecHash = specHash
+	ref.Generation++
+	ref.AppliedBy = user.Username
+	if err := s.database.GetDB().Save(ref).Error; err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to record declared %s %s", kind, externalID), err)
+		http.Error(w, "Failed to record resource", http.StatusInternalServerError)
+		return
+	}
+
+	s.audit(r, models.AuditResourceApply, "", "", map[string]interface{}{
+		"kind":        kind,
+		"external_id": externalID,
+		"id":          applied.id,
+		"generation":  ref.Generation,
+	})
+
+	response := ResourceResponse{
+		ResourceRef: *ref,
+		Changed:     true,
+		RolloutID:   applied.rolloutID,
+		ApprovalID:  applied.approvalID,
+	}
+	response.Resource, _ = s.loadResource(kind, ref.ResourceID)
+	w.Header().Set("ETag", strconv.Quote(ref.SpecHash))
+	status := http.StatusOK
+	if !found {
+		status = http.StatusCreated
+	}
+	jsonResponse(w, response, status)
+}
+
+// loadResource returns the current state of a declared resource, or true
+// if it no longer exists
+func (s *Server) loadResource(kind string, id uuid.UUID) (interface{}, bool) {
+	switch kind {
+	case models.ResourceKindFleet:
+		var fleet models.Fleet
+		if err := s.database.GetDB().Where("id = ?", id).First(&fleet).Error; err != nil {
+			return nil, true
+		}
+		return fleet, false
+	case models.ResourceKindSoftware:
+		var software models.Software
+		if err := s.database.GetDB().Where("id = ?", id).First(&software).Error; err != nil {
+			return nil, true
+		}
+		redactSoftware(&software)
+		return software, false
+	case models.ResourceKindDeployment:
+		var entry models.FleetDefaultSoftware
+		if err := s.database.GetDB().Where("id = ?", id).First(&entry).Error; err != nil {
+			return nil, true
+		}
+		return entry, false
+	case models.ResourceKindExposedService:
+		var service models.ExposedService
+		if err := s.database.GetDB().Where("id = ?", id).First(&service).Error; err != nil {
+			return nil, true
+		}
+		return ExposedServiceResponse{ExposedService: service, HasPassword: service.PasswordHash != ""}, false
+	}
+	return nil, true
+}
+
+// deleteResource deletes a declared resource. Deleting a deployment removes
+// the software from the defaults of the fleet, devices keep running it.
+func (s *Server) deleteResource(kind string, id uuid.UUID) error {
+	switch kind {
+	case models.ResourceKindFleet:
+		return s.database.GetDB().Where("id = ?", id).Delete(&models.Fleet{}).Error
+	case models.ResourceKindSoftware:
+		return s.database.GetDB().Where("id = ?", id).Delete(&models.Software{}).Error
+	case models.ResourceKindDeployment:
+		return s.database.GetDB().Where("id = ?", id).Delete(&models.FleetDefaultSoftware{}).Error
+	case models.ResourceKindExposedService:
+		return s.database.GetDB().Where("id = ?", id).Delete(&models.ExposedService{}).Error
+	}
+	return nil
+}
+
+// declaredID returns the resource declared under an external ID. It writes
+// the error response and returns false if there is none.
+func (s *Server) declaredID(w http.ResponseWriter, kind, externalID string) (uuid.UUID, bool) {
+	var ref models.ResourceRef
+	if err := s.database.GetDB().Where("kind = ? AND external_id = ?", kind, externalID).First(&ref).Error; err != nil {
+		http.Error(w, fmt.Sprintf("No %s is declared as %q", strings.TrimSuffix(kind, "s"), externalID), http.StatusUnprocessableEntity)
+		return uuid.Nil, false
+	}
+	return ref.ResourceID, true
+}
+
+// checkAdopt checks that a resource of the same name as a new one may be
+// taken over. It writes the error response and returns false if not.
+func (s *Server) checkAdopt(w http.ResponseWriter, kind, name string, id uuid.UUID, adopt bool) bool {
+	var count int64
+	if err := s.database.GetDB().Model(&models.ResourceRef{}).Where("kind = ? AND resource_id = ?", kind, id).Count(&count).Error; err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to check declared %s", kind), err)
+		http.Error(w, "Failed to check resource", http.StatusInternalServerError)
+		return false
+	}
+	if count > 0 {
+		http.Error(w, fmt.Sprintf("%q is declared under another external ID", name), http.StatusConflict)
+		return false
+	}
+	if !adopt {
+		http.Error(w, fmt.Sprintf("%q exists, apply with adopt=true to manage it", name), http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+// applyFleetSpec creates or updates a declared fleet
+func (s *Server) applyFleetSpec(w http.ResponseWriter, spec *FleetSpec, current *uuid.UUID, adopt bool) (*appliedResource, bool) {
+	if spec.Name == "" {
+		http.Error(w, "Fleet name is required", http.StatusBadRequest)
+		return nil, false
+	}
+	if spec.TunnelRate < -1 || spec.PullRate < -1 {
+		http.Error(w, "Rate limits must be -1, 0 or positive", http.StatusBadRequest)
+		return nil, false
+	}
+	if spec.MaxDeploys < -1 {
+		http.Error(w, "max_concurrent_deploys must be -1, 0 or positive", http.StatusBadRequest)
+		return nil, false
+	}
+	if !validateTimezone(w, spec.Timezone, spec.Locale) {
+		return nil, false
+	}
+	if err := validateDeviceIDPrefix(spec.DeviceIDPrefix); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+
+	var fleet models.Fleet
+	if current != nil {
+		s.database.GetDB().Where("id = ?", *current).First(&fleet)
+	} else if err := s.database.GetDB().Where("LOWER(name) = LOWER(?)", spec.Name).First(&fleet).Error; err == nil {
+		if !s.checkAdopt(w, models.ResourceKindFleet, fleet.Name, fleet.ID, adopt) {
+			return nil, false
+		}
+	}
+
+	timezoneChanged := fleet.Timezone != spec.Timezone || fleet.Locale != spec.Locale
+	fleet.Name = spec.Name
+	fleet.Description = spec.Description
+	fleet.DeviceIDPrefix = spec.DeviceIDPrefix
+	fleet.Timezone = spec.Timezone
+	fleet.Locale = spec.Locale
+	fleet.TunnelRate = spec.TunnelRate
+	fleet.PullRate = spec.PullRate
+	fleet.MaxDeploys = spec.MaxDeploys
+
+	var err error
+	if fleet.ID == uuid.Nil {
+		err = s.database.GetDB().Create(&fleet).Error
+	} else {
+		// Select the columns so zero values are written too
+		err = s.database.GetDB().Model(&fleet).
+			Select("Name", "Description", "DeviceIDPrefix", "Timezone", "Locale", "TunnelRate", "PullRate", "MaxDeploys").
+			Updates(&fleet).Error
+	}
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to apply fleet %s", spec.Name), err)
+		http.Error(w, "Failed to apply fleet", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	// Rate limits, timezones and locales apply to the fleet's connected
+	// devices
+	s.sshServer.RefreshRateLimits()
+	if timezoneChanged {
+		var devices []models.Device
+		s.database.GetDB().Select("device_id").Where("fleet_id = ?", fleet.ID).Find(&devices)
+		deviceIDs := make([]string, 0, len(devices))
+		for _, device := range devices {
+			deviceIDs = append(deviceIDs, device.DeviceID)
+		}
+		s.applyTimezones(deviceIDs)
+	}
+
+	return &appliedResource{id: fleet.ID}, true
+}
+
+// applySoftwareSpec creates or updates a declared software
+func (s *Server) applySoftwareSpec(w http.ResponseWriter, r *http.Request, spec *SoftwareSpec, current *uuid.UUID, adopt bool) (*appliedResource, bool) {
+	if spec.Name == "" {
+		http.Error(w, "Software name is required", http.StatusBadRequest)
+		return nil, false
+	}
+
+	var stored models.Software
+	if current != nil {
+		s.database.GetDB().Where("id = ?", *current).First(&stored)
+	} else if err := s.database.GetDB().Where("LOWER(name) = LOWER(?)", spec.Name).First(&stored).Error; err == nil {
+		if !s.checkAdopt(w, models.ResourceKindSoftware, stored.Name, stored.ID, adopt) {
+			return nil, false
+		}
+	}
+
+	envVars, _ := json.Marshal(spec.DefaultEnvVars)
+	if spec.DefaultEnvVars == nil {
+		envVars = []byte("{}")
+	}
+	software := stored
+	software.Name = spec.Name
+	software.Source = spec.Source
+	if software.Source == "" {
+		software.Source = models.SoftwareSourceManual
+	}
+	software.RepoURL = spec.RepoURL
+	software.CurrentVersion = spec.Version
+	software.DockerComposeYAML = spec.ComposeYAML
+	software.DefaultEnvVars = string(envVars)
+	software.Strategy = spec.Strategy
+	software.Platforms = spec.Platforms
+
+	if err := validateStrategy(&software); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	if err := validatePlatforms(&software); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	if !s.checkSoftwareCredentials(w, r, &software, &stored) {
+		return nil, false
+	}
+	if software.Strategy == "" {
+		software.Strategy = "recreate"
+	}
+
+	var err error
+	if software.ID == uuid.Nil {
+		software.Versions = "[]"
+		err = s.database.GetDB().Create(&software).Error
+	} else {
+		err = s.database.GetDB().Model(&software).
+			Select("Name", "Source", "RepoURL", "CurrentVersion", "DockerComposeYAML", "DefaultEnvVars", "Strategy", "Platforms").
+			Updates(&software).Error
+	}
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to apply software %s", spec.Name), err)
+		http.Error(w, "Failed to apply software", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	return &appliedResource{id: software.ID}, true
+}
+
+// applyDeploymentSpec makes a software default software of a fleet and
+// rolls it out when its version changed
+func (s *Server) applyDeploymentSpec(w http.ResponseWriter, r *http.Request, spec, previous *DeploymentSpec, current *uuid.UUID) (*appliedResource, bool) {
+	if spec.Fleet == "" || spec.Software == "" {
+		http.Error(w, "fleet and software are required", http.StatusBadRequest)
+		return nil, false
+	}
+	for _, template := range spec.ExposedServices {
+		if err := validateExposedService(template); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil, false
+		}
+	}
+
+	fleetID, ok := s.declaredID(w, models.ResourceKindFleet, spec.Fleet)
+	if !ok {
+		return nil, false
+	}
+	softwareID, ok := s.declaredID(w, models.ResourceKindSoftware, spec.Software)
+	if !ok {
+		return nil, false
+	}
+	var fleet models.Fleet
+	if err := s.database.GetDB().Where("id = ?", fleetID).First(&fleet).Error; err != nil {
+		http.Error(w, fmt.Sprintf("Fleet %q was deleted, apply it again", spec.Fleet), http.StatusUnprocessableEntity)
+		return nil, false
+	}
+	var software models.Software
+	if err := s.database.GetDB().Where("id = ?", softwareID).First(&software).Error; err != nil {
+		http.Error(w, fmt.Sprintf("Software %q was deleted, apply it again", spec.Software), http.StatusUnprocessableEntity)
+		return nil, false
+	}
+
+	version := spec.Version
+	if version == "" {
+		version = software.CurrentVersion
+	}
+	previousVersion := ""
+	if current != nil && previous.Fleet == spec.Fleet && previous.Software == spec.Software {
+		previousVersion = previous.Version
+		if previousVersion == "" {
+			previousVersion = version
+		}
+	}
+
+	// Roll out first, so a spec the fleet's devices cannot run is refused
+	// without being recorded
+	applied := &appliedResource{}
+	if (spec.Rollout == nil || *spec.Rollout) && version != previousVersion {
+		if fleet.RequireApproval {
+			approval := &models.DeploymentApproval{
+				FleetID:    fleet.ID,
+				SoftwareID: software.ID,
+				Version:    version,
+			}
+			if err := s.recordApproval(r, approval, "", &software); err != nil {
+				s.logger.Error("Failed to record deployment approval", err)
+				http.Error(w, "Failed to request approval", http.StatusInternalServerError)
+				return nil, false
+			}
+			applied.approvalID = &approval.ID
+		} else {
+			rollout, err := s.deployer.StartRollout(r.Context(), &fleet, &software, version, 0, deploy.RetryPolicy{})
+			switch {
+			case errors.Is(err, deploy.ErrEmptyFleet):
+				// Devices get it when they join
+			case err != nil:
+				s.rolloutFailed(w, fleet.ID.String(), err)
+				return nil, false
+			default:
+				applied.rolloutID = &rollout.ID
+			}
+		}
+	}
+
+	// Software already in the fleet's defaults is taken over
+	var entry models.FleetDefaultSoftware
+	if current != nil {
+		s.database.GetDB().Where("id = ?", *current).First(&entry)
+	}
+	if entry.FleetID != fleet.ID || entry.SoftwareID != software.ID {
+		entry = models.FleetDefaultSoftware{}
+		if err := s.database.GetDB().Where("fleet_id = ? AND software_id = ?", fleet.ID, software.ID).First(&entry).Error; err != nil {
+			var last models.FleetDefaultSoftware
+			if s.database.GetDB().Where("fleet_id = ?", fleet.ID).Order("position DESC").First(&last).Error == nil {
+				entry.Position = last.Position + 1
+			}
+		}
+	}
+	entry.FleetID = fleet.ID
+	entry.SoftwareID = software.ID
+	entry.Version = spec.Version
+	entry.ExposedServices = spec.ExposedServices
+
+	err := s.database.GetDB().Transaction(func(tx *gorm.DB) error {
+		// A deployment moved to another fleet or software leaves the old one
+		if current != nil && *current != entry.ID {
+			if err := tx.Where("id = ?", *current).Delete(&models.FleetDefaultSoftware{}).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Save(&entry).Error
+	})
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to apply default software of fleet %s", fleet.ID), err)
+		http.Error(w, "Failed to apply deployment", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	applied.id = entry.ID
+	return applied, true
+}
+
+// applyExposedServiceSpec creates or updates a declared service exposed on
+// a device
+func (s *Server) applyExposedServiceSpec(w http.ResponseWriter, spec *ExposedServiceSpec, current *uuid.UUID) (*appliedResource, bool) {
+	if err := validateExposedService(models.ExposedServiceTemplate{
+		Name:           spec.Name,
+		ContainerName:  spec.ContainerName,
+		InternalPort:   spec.InternalPort,
+		ExternalPort:   spec.ExternalPort,
+		Protocol:       spec.Protocol,
+		URLPath:        spec.URLPath,
+		AllowedSources: spec.AllowedSources,
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", spec.Device).First(&device).Error; err != nil {
+		http.Error(w, fmt.Sprintf("Device %q not found", spec.Device), http.StatusUnprocessableEntity)
+		return nil, false
+	}
+
+	var service models.ExposedService
+	if current != nil {
+		s.database.GetDB().Where("id = ?", *current).First(&service)
+	}
+	if service.DeviceID != device.ID || service.Name != spec.Name {
+		var existing models.ExposedService
+		if err := s.database.GetDB().Where("device_id = ? AND name = ?", device.ID, spec.Name).First(&existing).Error; err == nil && existing.ID != service.ID {
+			http.Error(w, fmt.Sprintf("Device %s already exposes a service %s", device.DeviceID, spec.Name), http.StatusConflict)
+			return nil, false
+		}
+	}
+
+	service.DeviceID = device.ID
+	service.Name = spec.Name
+	service.ContainerName = spec.ContainerName
+	service.InternalPort = spec.InternalPort
+	service.ExternalPort = spec.ExternalPort
+	service.Protocol = spec.Protocol
+	if service.Protocol == "" {
+		service.Protocol = models.ServiceProtocolHTTP
+	}
+	service.URLPath = spec.URLPath
+	service.AuthRequired = spec.AuthRequired == nil || *spec.AuthRequired
+	service.AllowedSources = spec.AllowedSources
+	service.Enabled = spec.Enabled == nil || *spec.Enabled
+
+	// Select all columns so false values are not replaced by the column
+	// defaults
+	var err error
+	if service.ID == uuid.Nil {
+		service.ID = uuid.New()
+		err = s.database.GetDB().Select("*").Omit("DeletedAt").Create(&service).Error
+	} else {
+		err = s.database.GetDB().Model(&service).
+			Select("DeviceID", "Name", "ContainerName", "InternalPort", "ExternalPort", "Protocol", "URLPath", "AuthRequired", "AllowedSources", "Enabled").
+			Updates(&service).Error
+	}
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to apply exposed service %s of device %s", spec.Name, device.DeviceID), err)
+		http.Error(w, "Failed to apply exposed service", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	return &appliedResource{id: service.ID}, true
+}
@@ -0,0 +1,120 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/edgetainer/edgetainer/internal/server/proxy"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// FleetDefaultRequest is one entry of the default software of a fleet
+type FleetDefaultRequest struct {
+	SoftwareID      uuid.UUID                       `json:"software_id"`
+	Version         string                          `json:"version"` // Empty for the current version when a device joins
+	ExposedServices []models.ExposedServiceTemplate `json:"exposed_services"`
+}
+
+// validateExposedService checks an exposed service template
+func validateExposedService(template models.ExposedServiceTemplate) error {
+	if template.Name == "" || template.ContainerName == "" {
+		return fmt.Errorf("exposed services need a name and a container name")
+	}
+	if template.InternalPort < 1 || template.InternalPort > 65535 || template.ExternalPort < 1 || template.ExternalPort > 65535 {
+		return fmt.Errorf("exposed service %s: ports must be between 1 and 65535", template.Name)
+	}
+	switch template.Protocol {
+	case "", models.ServiceProtocolHTTP, models.ServiceProtocolHTTPS, models.ServiceProtocolTCP, models.ServiceProtocolUDP:
+	default:
+		return fmt.Errorf("exposed service %s: protocol must be http, https, tcp or udp", template.Name)
+	}
+	if _, err := proxy.ParseSources(template.AllowedSources); err != nil {
+		return fmt.Errorf("exposed service %s: %w", template.Name, err)
+	}
+	return nil
+}
+
+// handleFleetDefaults handles the default software of a fleet, which is
+// deployed to devices that join it. PUT replaces the list; entries are
+// deployed in the order given.
+func (s *Server) handleFleetDefaults(w http.ResponseWriter, r *http.Request) {
+	fleetID := r.PathValue("id")
+
+	var fleet models.Fleet
+	if err := s.database.GetDB().Where("id = ?", fleetID).First(&fleet).Error; err != nil {
+		http.Error(w, "Fleet not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+
+	case http.MethodPut:
+		var request []FleetDefaultRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		defaults := make([]models.FleetDefaultSoftware, 0, len(request))
+		seen := make(map[uuid.UUID]bool)
+		for i, entry := range request {
+			var software models.Software
+			if err := s.database.GetDB().Where("id = ?", entry.SoftwareID).First(&software).Error; err != nil {
+				http.Error(w, fmt.Sprintf("Software %s not found", entry.SoftwareID), http.StatusBadRequest)
+				return
+			}
+			if seen[software.ID] {
+				http.Error(w, fmt.Sprintf("Software %s is listed twice", software.Name), http.StatusBadRequest)
+				return
+			}
+			seen[software.ID] = true
+
+			for _, template := range entry.ExposedServices {
+				if err := validateExposedService(template); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+
+			defaults = append(defaults, models.FleetDefaultSoftware{
+				FleetID:         fleet.ID,
+				SoftwareID:      software.ID,
+				Version:         entry.Version,
+				Position:        i,
+				ExposedServices: entry.ExposedServices,
+			})
+		}
+
+		err := s.database.GetDB().Transaction(func(tx *gorm.DB) error {
+			if err := tx.Where("fleet_id = ?", fleet.ID).Delete(&models.FleetDefaultSoftware{}).Error; err != nil {
+				return err
+			}
+			if len(defaults) == 0 {
+				return nil
+			}
+			return tx.Create(&defaults).Error
+		})
+		if err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to update default software of fleet %s", fleetID), err)
+			http.Error(w, "Failed to update default software", http.StatusInternalServerError)
+			return
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var defaults []models.FleetDefaultSoftware
+	if err := s.database.GetDB().Where("fleet_id = ?", fleet.ID).Order("position").Find(&defaults).Error; err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to fetch default software of fleet %s", fleetID), err)
+		http.Error(w, "Failed to fetch default software", http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse(w, defaults, http.StatusOK)
+}
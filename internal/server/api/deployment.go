@@ -0,0 +1,171 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/google/uuid"
+)
+
+// deviceDeploymentsLimit is the number of recent deployments listed per device
+const deviceDeploymentsLimit = 50
+
+// handleDeploymentByID returns a deployment, with the image pull progress
+// reported by its device while it is pending
+func (s *Server) handleDeploymentByID(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var deployment models.Deployment
+	if err := s.database.GetDB().Where("id = ?", r.PathValue("id")).First(&deployment).Error; err != nil {
+		http.Error(w, "Deployment not found", http.StatusNotFound)
+		return
+	}
+
+	deployments := []models.Deployment{deployment}
+	s.deployer.AttachPullProgress(r.Context(), deployments)
+	redactDeployments(deployments)
+
+	jsonResponse(w, deployments[0], http.StatusOK)
+}
+
+// handleDeviceDeployments lists the most recent deployments of a device, so
+// that a deployment can be followed while the deploy request is still running
+func (s *Server) handleDeviceDeployments(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	deviceID := r.PathValue("id")
+
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	var deployments []models.Deployment
+	if err := s.database.GetDB().Where("device_id = ?", device.ID).
+		Order("created_at DESC").Limit(deviceDeploymentsLimit).Find(&deployments).Error; err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to fetch deployments of device %s", deviceID), err)
+		http.Error(w, "Failed to fetch deployments", http.StatusInternalServerError)
+		return
+	}
+	s.deployer.AttachPullProgress(r.Context(), deployments)
+	redactDeployments(deployments)
+
+	jsonResponse(w, deployments, http.StatusOK)
+}
+
+// DeploymentHistoryEntry is a deployment that was applied to a device
+type DeploymentHistoryEntry struct {
+	models.Deployment
+	SoftwareName string `json:"software_name"`
+}
+
+// handleDeviceDeploymentHistory lists the deployments that succeeded or
+// failed on a device, newest first, filtered by software, status and time.
+// With at, it lists the versions of each software that were running then.
+func (s *Server) handleDeviceDeploymentHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", r.PathValue("id")).First(&device).Error; err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	params := r.URL.Query()
+	limit := 100
+	if l, err := strconv.Atoi(params.Get("limit")); err == nil && l > 0 && l <= 1000 {
+		limit = l
+	}
+
+	// Deployments finished before the column was added count as finished
+	// when last updated
+	const finishedAt = "COALESCE(finished_at, updated_at)"
+	query := s.database.GetDB().Where("device_id = ?", device.ID)
+	if softwareID := params.Get("software_id"); softwareID != "" {
+		id, err := uuid.Parse(softwareID)
+		if err != nil {
+			http.Error(w, "Invalid software_id", http.StatusBadRequest)
+			return
+		}
+		query = query.Where("software_id = ?", id)
+	}
+	switch status := params.Get("status"); status {
+	case "":
+		query = query.Where("status IN ?", []string{models.DeploymentStatusDeployed, models.DeploymentStatusFailed})
+	case models.DeploymentStatusDeployed, models.DeploymentStatusFailed:
+		query = query.Where("status = ?", status)
+	default:
+		http.Error(w, "Invalid status, use deployed or failed", http.StatusBadRequest)
+		return
+	}
+	times := make(map[string]time.Time)
+	for _, param := range []string{"since", "until", "at"} {
+		if value := params.Get(param); value != "" {
+			at, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				http.Error(w, "Invalid "+param+", use RFC 3339", http.StatusBadRequest)
+				return
+			}
+			times[param] = at
+		}
+	}
+	if since, ok := times["since"]; ok {
+		query = query.Where(finishedAt+" >= ?", since)
+	}
+	if until, ok := times["until"]; ok {
+		query = query.Where(finishedAt+" < ?", until)
+	}
+
+	deployments := []models.Deployment{}
+	if at, ok := times["at"]; ok {
+		// The last successful deployment of each software before then
+		query = query.Where("status = ? AND "+finishedAt+" <= ?", models.DeploymentStatusDeployed, at).
+			Select("DISTINCT ON (software_id) *").
+			Order("software_id, " + finishedAt + " DESC")
+		latest := s.database.GetDB().Table("(?) AS running", query.Model(&models.Deployment{}))
+		if err := latest.Order(finishedAt + " DESC").Limit(limit).Find(&deployments).Error; err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to fetch deployment history of device %s", device.DeviceID), err)
+			http.Error(w, "Failed to fetch deployment history", http.StatusInternalServerError)
+			return
+		}
+	} else if err := query.Order(finishedAt + " DESC").Limit(limit).Find(&deployments).Error; err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to fetch deployment history of device %s", device.DeviceID), err)
+		http.Error(w, "Failed to fetch deployment history", http.StatusInternalServerError)
+		return
+	}
+
+	softwareIDs := make([]uuid.UUID, 0, len(deployments))
+	for _, deployment := range deployments {
+		softwareIDs = append(softwareIDs, deployment.SoftwareID)
+	}
+	var software []models.Software
+	if len(softwareIDs) > 0 {
+		if err := s.database.GetDB().Unscoped().Select("id", "name").Where("id IN ?", softwareIDs).Find(&software).Error; err != nil {
+			s.logger.Error("Failed to fetch software of deployments", err)
+		}
+	}
+	names := make(map[uuid.UUID]string, len(software))
+	for _, sw := range software {
+		names[sw.ID] = sw.Name
+	}
+
+	redactDeployments(deployments)
+	entries := make([]DeploymentHistoryEntry, 0, len(deployments))
+	for _, deployment := range deployments {
+		entries = append(entries, DeploymentHistoryEntry{Deployment: deployment, SoftwareName: names[deployment.SoftwareID]})
+	}
+	jsonResponse(w, entries, http.StatusOK)
+}
@@ -2,28 +2,45 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"path/filepath"
+	"time"
 
+	"github.com/edgetainer/edgetainer/internal/server/deploy"
+	"github.com/edgetainer/edgetainer/internal/server/envschema"
 	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+	"github.com/google/uuid"
 )
 
 // handleDevices handles the devices endpoint
 func (s *Server) handleDevices(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
-		// List devices
+		// List devices, optionally filtered for a map or by custom fields
 		var devices []models.Device
 
+		query, err := s.deviceQuery(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		// Fetch devices from the database
-		result := s.database.GetDB().Find(&devices)
+		result := query.Find(&devices)
 		if result.Error != nil {
 			s.logger.Error("Failed to fetch devices", result.Error)
 			http.Error(w, "Failed to fetch devices", http.StatusInternalServerError)
 			return
 		}
 
+		for i := range devices {
+			devices[i].Tunnel = s.sshServer.TunnelStats(devices[i].DeviceID)
+			s.flagAgent(&devices[i])
+		}
+
 		jsonResponse(w, devices, http.StatusOK)
 
 	case http.MethodPost:
@@ -40,18 +57,70 @@ func (s *Server) handleDevices(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Device name is required", http.StatusBadRequest)
 			return
 		}
+		if device.TunnelRate < -1 || device.PullRate < -1 {
+			http.Error(w, "Rate limits must be -1, 0 or positive", http.StatusBadRequest)
+			return
+		}
+		if !validateTimezone(w, device.Timezone, device.Locale) {
+			return
+		}
+		if !validateLocation(w, device.Latitude, device.Longitude) {
+			return
+		}
+		if !s.checkCustomFields(w, device.FleetID, device.CustomFields) {
+			return
+		}
+		if !s.checkSubdomain(w, "", device.Subdomain) {
+			return
+		}
+		if !s.checkDeviceName(w, device.DeviceID, device.FleetID, device.Name) {
+			return
+		}
+		if err := validateRequiredUSB(device.RequiredUSB); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := validateResourcePolicy(device.Resources); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// A location given at creation is a manual one
+		device.LocationSource, device.LocationAccuracy, device.LocationUpdatedAt = "", 0, nil
+
+		// Only admins set the tunnel policy, through /tunnel-policy
+		device.TunnelPolicy = models.TunnelPolicy{}
+
+		// The hardware binding comes from the agent's attestation
+		device.HardwareID, device.HardwareBoundAt = "", nil
+		if device.Latitude != nil {
+			now := time.Now()
+			device.LocationSource, device.LocationUpdatedAt = protocol.LocationManual, &now
+		}
 
 		// Ensure hardware_info is a valid JSON object
 		if device.HardwareInfo == "" {
 			device.HardwareInfo = "{}" // Initialize with empty JSON object
 		}
 
+		// Devices created without an ID get one like provisioned devices
+		if device.DeviceID == "" {
+			deviceID, err := s.newDeviceID(r.Context(), device.FleetID)
+			if err != nil {
+				s.logger.Error("Failed to generate device ID", err)
+				http.Error(w, "Failed to generate device ID", http.StatusInternalServerError)
+				return
+			}
+			device.DeviceID = deviceID
+		}
+
 		// Save to the database
 		if err := s.database.GetDB().Create(&device).Error; err != nil {
 			s.logger.Error("Failed to create device", err)
 			http.Error(w, "Failed to create device", http.StatusInternalServerError)
 			return
 		}
+		s.syncDNS()
 
 		jsonResponse(w, device, http.StatusCreated)
 
@@ -80,6 +149,8 @@ func (s *Server) handleDeviceByID(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		device.Tunnel = s.sshServer.TunnelStats(deviceID)
+		s.flagAgent(&device)
 		jsonResponse(w, device, http.StatusOK)
 
 	case http.MethodPut:
@@ -96,6 +167,36 @@ func (s *Server) handleDeviceByID(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Device name is required", http.StatusBadRequest)
 			return
 		}
+		if device.TunnelRate < -1 || device.PullRate < -1 {
+			http.Error(w, "Rate limits must be -1, 0 or positive", http.StatusBadRequest)
+			return
+		}
+		if !validateTimezone(w, device.Timezone, device.Locale) {
+			return
+		}
+		if !s.checkSubdomain(w, deviceID, device.Subdomain) {
+			return
+		}
+
+		var current models.Device
+		if err := s.database.GetDB().Where("device_id = ?", deviceID).First(&current).Error; err != nil {
+			http.Error(w, "Device not found", http.StatusNotFound)
+			return
+		}
+		fleetID := current.FleetID
+		if device.FleetID != nil {
+			fleetID = device.FleetID
+		}
+		fleetChanged := device.FleetID != nil && (current.FleetID == nil || *current.FleetID != *device.FleetID)
+		if !s.checkDeviceName(w, deviceID, fleetID, device.Name) {
+			return
+		}
+
+		// Custom fields given are replaced as a whole and checked against
+		// the fleet the device ends up in
+		if device.CustomFields != nil && !s.checkCustomFields(w, fleetID, device.CustomFields) {
+			return
+		}
 
 		// Ensure hardware_info is a valid JSON object
 		if device.HardwareInfo == "" {
@@ -105,6 +206,25 @@ func (s *Server) handleDeviceByID(w http.ResponseWriter, r *http.Request) {
 		// Ensure deviceID from URL matches the one in the request
 		device.DeviceID = deviceID
 
+		// The location is changed through /location
+		device.Latitude, device.Longitude, device.Address = nil, nil, ""
+		device.LocationSource, device.LocationAccuracy, device.LocationUpdatedAt = "", 0, nil
+
+		// Only admins change the tunnel policy, through /tunnel-policy
+		device.TunnelPolicy = models.TunnelPolicy{}
+
+		// The hardware binding is reset through /hardware-binding
+		device.HardwareID, device.HardwareBoundAt = "", nil
+
+		// Plugins, their metrics, the host health and host services are reported
+		// by the agent
+		device.Plugins, device.PluginMetrics, device.HostHealth, device.HostServices = nil, nil, nil, nil
+
+		// Required USB devices are changed through /required-usb, resource
+		// limits through /resource-limits
+		device.RequiredUSB = nil
+		device.Resources = models.ResourcePolicy{}
+
 		// Update in the database
 		result := s.database.GetDB().Where("device_id = ?", deviceID).Updates(&device)
 		if result.Error != nil {
@@ -118,8 +238,24 @@ func (s *Server) handleDeviceByID(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		timezoneChanged := device.Timezone != "" || device.Locale != ""
+
 		// Fetch the updated device to return
 		s.database.GetDB().Where("device_id = ?", deviceID).First(&device)
+		if device.Name != current.Name {
+			s.recordDeviceRename(r, &device, current.Name, "")
+		}
+		s.sshServer.RefreshRateLimit(deviceID)
+		s.syncDNS()
+		if timezoneChanged {
+			s.applyTimezones([]string{deviceID})
+		}
+		if fleetChanged {
+			// Moving into a fleet queues its default software
+			if err := s.deployer.FleetChanged(r.Context(), &device, current.FleetID); err != nil {
+				s.logger.Error(fmt.Sprintf("Failed to queue fleet defaults for device %s", deviceID), err)
+			}
+		}
 		jsonResponse(w, device, http.StatusOK)
 
 	case http.MethodDelete:
@@ -136,9 +272,234 @@ func (s *Server) handleDeviceByID(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		s.sshServer.ForgetDevice(deviceID)
+		s.syncDNS()
 		w.WriteHeader(http.StatusNoContent)
 
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
+
+// handleDeviceDecommission handles decommissioning a connected device
+func (s *Server) handleDeviceDecommission(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	deviceID := r.PathValue("id")
+
+	var payload protocol.DecommissionPayload
+	if r.ContentLength > 0 {
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if payload.Policy != "" && !protocol.IsShutdownPolicy(payload.Policy) {
+		http.Error(w, "Unknown shutdown policy", http.StatusBadRequest)
+		return
+	}
+
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	if _, connected := s.sshServer.GetDeviceConnection(deviceID); !connected {
+		http.Error(w, "Device is not connected", http.StatusConflict)
+		return
+	}
+
+	command, err := protocol.NewCommandWithPayload(protocol.CmdDecommission, payload)
+	if err != nil {
+		s.logger.Error("Failed to build decommission command", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response, err := s.sshServer.SendCommand(r.Context(), deviceID, command)
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to decommission device %s", deviceID), err)
+		http.Error(w, "Failed to decommission device", http.StatusBadGateway)
+		return
+	}
+
+	if !response.Success {
+		http.Error(w, response.Message, http.StatusBadGateway)
+		return
+	}
+
+	s.logger.Info(fmt.Sprintf("Decommissioning device %s", deviceID))
+	jsonResponse(w, response, http.StatusAccepted)
+}
+
+// RestartAppRequest represents a request to restart an application on a device
+type RestartAppRequest struct {
+	Services []string `json:"services,omitempty"` // Defaults to all services
+	NoDeps   bool     `json:"no_deps,omitempty"`
+	Rolling  bool     `json:"rolling,omitempty"`
+}
+
+// RestartAppResponse reports the outcome of an application restart
+type RestartAppResponse struct {
+	Success  bool                            `json:"success"`
+	Message  string                          `json:"message"`
+	Services []protocol.ServiceRestartResult `json:"services"`
+}
+
+// handleDeviceAppRestart handles restarting the services of an application
+// on a connected device
+func (s *Server) handleDeviceAppRestart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	deviceID := r.PathValue("id")
+
+	var request RestartAppRequest
+	if r.ContentLength > 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	if _, connected := s.sshServer.GetDeviceConnection(deviceID); !connected {
+		http.Error(w, "Device is not connected", http.StatusConflict)
+		return
+	}
+
+	command, err := protocol.NewCommandWithPayload(protocol.CmdRestartApp, protocol.RestartAppPayload{
+		Name:     r.PathValue("app"),
+		Services: request.Services,
+		NoDeps:   request.NoDeps,
+		Rolling:  request.Rolling,
+	})
+	if err != nil {
+		s.logger.Error("Failed to build restart command", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response, err := s.sshServer.SendCommand(r.Context(), deviceID, command)
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to restart application on device %s", deviceID), err)
+		http.Error(w, "Failed to restart application", http.StatusBadGateway)
+		return
+	}
+
+	// Without per-service results the restart did not start, e.g. because the
+	// application is unknown
+	var results []protocol.ServiceRestartResult
+	if data, err := json.Marshal(response.Data["services"]); err == nil {
+		json.Unmarshal(data, &results)
+	}
+	if len(results) == 0 && !response.Success {
+		http.Error(w, response.Message, http.StatusBadGateway)
+		return
+	}
+
+	jsonResponse(w, RestartAppResponse{
+		Success:  response.Success,
+		Message:  response.Message,
+		Services: results,
+	}, http.StatusOK)
+}
+
+// DeployRequest represents a request to deploy software to a device
+type DeployRequest struct {
+	SoftwareID uuid.UUID `json:"software_id"`
+	Version    string    `json:"version,omitempty"` // Defaults to the software's current version
+}
+
+// handleDeviceDeploy handles deploying a software version to a connected device
+func (s *Server) handleDeviceDeploy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	deviceID := r.PathValue("id")
+
+	var request DeployRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	var software models.Software
+	if err := s.database.GetDB().Where("id = ?", request.SoftwareID).First(&software).Error; err != nil {
+		http.Error(w, "Software not found", http.StatusBadRequest)
+		return
+	}
+
+	fleet, err := s.approvalFleet(device.FleetID)
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to fetch fleet of device %s", deviceID), err)
+		http.Error(w, "Failed to fetch fleet", http.StatusInternalServerError)
+		return
+	}
+	if fleet != nil {
+		version := request.Version
+		if version == "" {
+			version = software.CurrentVersion
+		}
+		s.requestApproval(w, r, &models.DeploymentApproval{
+			FleetID:    fleet.ID,
+			DeviceID:   &device.ID,
+			SoftwareID: software.ID,
+			Version:    version,
+		}, deviceID, &software)
+		return
+	}
+
+	deployment, err := s.deployer.DeployToDevice(r.Context(), &device, &software, request.Version)
+	if err != nil {
+		s.deployFailed(w, deviceID, deployment, err)
+		return
+	}
+
+	deployments := []models.Deployment{*deployment}
+	redactDeployments(deployments)
+	jsonResponse(w, deployments[0], http.StatusOK)
+}
+
+// deployFailed reports why a deploy to a device failed. The deployment is
+// nil unless it was recorded before it failed.
+func (s *Server) deployFailed(w http.ResponseWriter, deviceID string, deployment *models.Deployment, err error) {
+	if frozenFailed(w, err) {
+		return
+	}
+
+	var validationErr *envschema.ValidationError
+	switch {
+	case errors.Is(err, deploy.ErrDeviceNotConnected):
+		http.Error(w, "Device is not connected", http.StatusConflict)
+	case errors.Is(err, deploy.ErrPlatform), errors.Is(err, deploy.ErrRequirements):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.As(err, &validationErr):
+		jsonResponse(w, validationErr, http.StatusUnprocessableEntity)
+	case deployment == nil:
+		s.logger.Error(fmt.Sprintf("Failed to deploy to device %s", deviceID), err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
+}
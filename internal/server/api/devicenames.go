@@ -0,0 +1,168 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/edgetainer/edgetainer/internal/server/db"
+	"github.com/edgetainer/edgetainer/internal/shared/config"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// deviceIDPrefixPattern matches prefixes of device IDs, which end up in
+// hostnames and key comments
+var deviceIDPrefixPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,22}[a-z0-9])?$`)
+
+// DeviceRenameRequest represents a request to rename a device
+type DeviceRenameRequest struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// SetDeviceNamePolicy sets the scope device names are unique in, see
+// config.DeviceNamesFleet
+func (s *Server) SetDeviceNamePolicy(scope string) {
+	s.uniqueNames = scope
+}
+
+// validateDeviceIDPrefix checks the device ID prefix of a fleet
+func validateDeviceIDPrefix(prefix string) error {
+	if prefix != "" && !deviceIDPrefixPattern.MatchString(prefix) {
+		return fmt.Errorf("device_id_prefix %q must be up to 24 lowercase letters, digits and hyphens", prefix)
+	}
+	return nil
+}
+
+// newDeviceID returns an unused device ID with the prefix of the fleet
+func (s *Server) newDeviceID(ctx context.Context, fleetID *uuid.UUID) (string, error) {
+	return db.NewDeviceID(s.database.GetDB().WithContext(ctx), fleetID)
+}
+
+// checkDeviceName checks that no other device in the scope of the name
+// policy has a name, ignoring case. Replaced and decommissioned devices
+// keep their names but do not count. It writes the error response and
+// returns false if one does.
+func (s *Server) checkDeviceName(w http.ResponseWriter, deviceID string, fleetID *uuid.UUID, name string) bool {
+	if s.uniqueNames == config.DeviceNamesOff {
+		return true
+	}
+
+	query := s.database.GetDB().Model(&models.Device{}).
+		Where("LOWER(name) = LOWER(?) AND device_id <> ?", name, deviceID).
+		Where("status NOT IN ?", []string{models.DeviceStatusReplaced, models.DeviceStatusDecommissioned})
+	if s.uniqueNames == config.DeviceNamesFleet {
+		if fleetID != nil {
+			query = query.Where("fleet_id = ?", *fleetID)
+		} else {
+			query = query.Where("fleet_id IS NULL")
+		}
+	}
+
+	var existing models.Device
+	err := query.Select("device_id").First(&existing).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return true
+	}
+	if err != nil {
+		s.logger.Error("Failed to check device name", err)
+		http.Error(w, "Failed to check device name", http.StatusInternalServerError)
+		return false
+	}
+	http.Error(w, fmt.Sprintf("Device name %q is taken by device %s", name, existing.DeviceID), http.StatusConflict)
+	return false
+}
+
+// recordDeviceRename keeps the previous name of a renamed device in its
+// name history
+func (s *Server) recordDeviceRename(r *http.Request, device *models.Device, oldName, reason string) {
+	user, _ := r.Context().Value("user").(models.User)
+	change := models.DeviceNameChange{
+		DeviceID:  device.ID,
+		OldName:   oldName,
+		NewName:   device.Name,
+		ChangedBy: user.Username,
+		Reason:    reason,
+	}
+	if err := s.database.GetDB().Create(&change).Error; err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to record rename of device %s", device.DeviceID), err)
+	}
+	s.audit(r, models.AuditDeviceRename, device.DeviceID, reason, map[string]interface{}{
+		"old_name": oldName,
+		"new_name": device.Name,
+	})
+}
+
+// handleDeviceRename renames a device. Its device ID, and so its key,
+// connection and history, stay the same.
+func (s *Server) handleDeviceRename(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	deviceID := r.PathValue("id")
+
+	var request DeviceRenameRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	request.Name = strings.TrimSpace(request.Name)
+	if request.Name == "" {
+		http.Error(w, "Device name is required", http.StatusBadRequest)
+		return
+	}
+
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	if device.Name == request.Name {
+		jsonResponse(w, device, http.StatusOK)
+		return
+	}
+	if !s.checkDeviceName(w, deviceID, device.FleetID, request.Name) {
+		return
+	}
+
+	oldName := device.Name
+	if err := s.database.GetDB().Model(&device).Update("name", request.Name).Error; err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to rename device %s", deviceID), err)
+		http.Error(w, "Failed to rename device", http.StatusInternalServerError)
+		return
+	}
+	s.recordDeviceRename(r, &device, oldName, request.Reason)
+	s.logger.Info(fmt.Sprintf("Device %s renamed from %q to %q", deviceID, oldName, device.Name))
+
+	jsonResponse(w, device, http.StatusOK)
+}
+
+// handleDeviceNames returns the name history of a device, newest first
+func (s *Server) handleDeviceNames(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	deviceID := r.PathValue("id")
+
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	changes := []models.DeviceNameChange{}
+	if err := s.database.GetDB().Where("device_id = ?", device.ID).Order("created_at DESC").Find(&changes).Error; err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to fetch name history of device %s", deviceID), err)
+		http.Error(w, "Failed to fetch name history", http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, changes, http.StatusOK)
+}
@@ -0,0 +1,203 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+	"github.com/google/uuid"
+)
+
+const (
+	// bundleTimeout is how long a device may take to collect and upload a
+	// diagnostics bundle before it is marked failed
+	bundleTimeout = 15 * time.Minute
+	// bundlesKept is the number of diagnostics bundles kept per device, older
+	// ones are removed when a new one is requested
+	bundlesKept = 5
+)
+
+// handleDeviceDiagnostics lists the diagnostics bundles of a device, newest
+// first, or asks the device for a new one
+func (s *Server) handleDeviceDiagnostics(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.PathValue("id")
+
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	s.expireBundles(device.ID)
+
+	switch r.Method {
+	case http.MethodGet:
+		var bundles []models.DiagnosticsBundle
+		if err := s.database.GetDB().Omit("data").Where("device_id = ?", device.ID).
+			Order("created_at DESC").Find(&bundles).Error; err != nil {
+			s.logger.Error("Failed to fetch diagnostics bundles", err)
+			http.Error(w, "Failed to fetch diagnostics bundles", http.StatusInternalServerError)
+			return
+		}
+		jsonResponse(w, bundles, http.StatusOK)
+
+	case http.MethodPost:
+		s.requestBundle(w, r, &device)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// requestBundle asks a connected device for a diagnostics bundle and answers
+// with the pending bundle
+func (s *Server) requestBundle(w http.ResponseWriter, r *http.Request, device *models.Device) {
+	if _, connected := s.sshServer.GetDeviceConnection(device.DeviceID); !connected {
+		http.Error(w, "Device is not connected", http.StatusConflict)
+		return
+	}
+	if !protocol.HasFeature(device.AgentFeatures, protocol.FeatureDiagnostics) {
+		http.Error(w, fmt.Sprintf("Agent version %s does not support diagnostics bundles", device.AgentVersion), http.StatusConflict)
+		return
+	}
+
+	user, _ := r.Context().Value("user").(models.User)
+	bundle := models.DiagnosticsBundle{
+		DeviceID:    device.ID,
+		Status:      models.BundleStatusPending,
+		RequestedBy: user.Username,
+	}
+	if err := s.database.GetDB().Create(&bundle).Error; err != nil {
+		s.logger.Error("Failed to create diagnostics bundle", err)
+		http.Error(w, "Failed to create diagnostics bundle", http.StatusInternalServerError)
+		return
+	}
+
+	// The agent turns the request down while it collects another bundle
+	response, err := s.sshServer.RequestDiagnostics(r.Context(), device.DeviceID, bundle.ID)
+	if err != nil || !response.Success {
+		status, message := http.StatusConflict, ""
+		if err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to request diagnostics bundle from device %s", device.DeviceID), err)
+			status, message = http.StatusBadGateway, err.Error()
+		} else {
+			message = response.Message
+		}
+		s.database.GetDB().Model(&bundle).Updates(map[string]interface{}{
+			"status":       models.BundleStatusFailed,
+			"error":        message,
+			"completed_at": time.Now(),
+		})
+		http.Error(w, fmt.Sprintf("Failed to request diagnostics bundle: %s", message), status)
+		return
+	}
+
+	// Keep the newest bundles only, they can be large
+	var old []uuid.UUID
+	s.database.GetDB().Model(&models.DiagnosticsBundle{}).Where("device_id = ?", device.ID).
+		Order("created_at DESC").Offset(bundlesKept).Pluck("id", &old)
+	if len(old) > 0 {
+		s.deleteObjects(r, &models.DiagnosticsBundle{}, old)
+		s.database.GetDB().Where("id IN ?", old).Delete(&models.DiagnosticsBundle{})
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/api/devices/%s/diagnostics/%s", device.DeviceID, bundle.ID))
+	jsonResponse(w, bundle, http.StatusAccepted)
+}
+
+// handleDeviceDiagnosticsBundle returns or deletes a diagnostics bundle
+func (s *Server) handleDeviceDiagnosticsBundle(w http.ResponseWriter, r *http.Request) {
+	device, bundle, ok := s.deviceBundle(w, r, false)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		jsonResponse(w, bundle, http.StatusOK)
+
+	case http.MethodDelete:
+		s.deleteObjects(r, &models.DiagnosticsBundle{}, []uuid.UUID{bundle.ID})
+		if err := s.database.GetDB().Delete(bundle).Error; err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to delete diagnostics bundle %s of device %s", bundle.ID, device.DeviceID), err)
+			http.Error(w, "Failed to delete diagnostics bundle", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleDiagnosticsDownload serves a diagnostics bundle as a gzipped tar
+// archive
+func (s *Server) handleDiagnosticsDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	device, bundle, ok := s.deviceBundle(w, r, true)
+	if !ok {
+		return
+	}
+	if bundle.Status != models.BundleStatusReady {
+		http.Error(w, fmt.Sprintf("Diagnostics bundle is %s", bundle.Status), http.StatusConflict)
+		return
+	}
+
+	// Bundles show how the device is set up, so downloads are recorded
+	s.audit(r, models.AuditDiagnosticsDownload, device.DeviceID, "", map[string]interface{}{
+		"bundle_id": bundle.ID.String(),
+	})
+
+	filename := fmt.Sprintf("diagnostics-%s-%s.tar.gz", device.DeviceID, bundle.CreatedAt.UTC().Format("20060102-150405"))
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	s.writeData(w, r, bundle.Object, bundle.Data, bundle.Size)
+}
+
+// deviceBundle looks up the device and diagnostics bundle of a request,
+// writing the error response if either is unknown. The bundle data is only
+// loaded if asked for.
+func (s *Server) deviceBundle(w http.ResponseWriter, r *http.Request, withData bool) (*models.Device, *models.DiagnosticsBundle, bool) {
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", r.PathValue("id")).First(&device).Error; err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+
+	bundleID, err := uuid.Parse(r.PathValue("bundle"))
+	if err != nil {
+		http.Error(w, "Diagnostics bundle not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+	s.expireBundles(device.ID)
+
+	query := s.database.GetDB()
+	if !withData {
+		query = query.Omit("data")
+	}
+	var bundle models.DiagnosticsBundle
+	if err := query.Where("id = ? AND device_id = ?", bundleID, device.ID).First(&bundle).Error; err != nil {
+		http.Error(w, "Diagnostics bundle not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+	return &device, &bundle, true
+}
+
+// expireBundles marks the bundles of a device that took too long to arrive
+// as failed, e.g. because the device went offline while collecting
+func (s *Server) expireBundles(deviceID uuid.UUID) {
+	s.database.GetDB().Model(&models.DiagnosticsBundle{}).
+		Where("device_id = ? AND status IN ? AND created_at < ?", deviceID,
+			[]string{models.BundleStatusPending, models.BundleStatusUploading}, time.Now().Add(-bundleTimeout)).
+		Updates(map[string]interface{}{
+			"status":       models.BundleStatusFailed,
+			"error":        "the device did not upload the bundle in time",
+			"data":         nil,
+			"completed_at": time.Now(),
+		})
+}
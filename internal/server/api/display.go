@@ -0,0 +1,242 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	// displayTimeout bounds applying display settings to a device, which
+	// may restart its kiosk container
+	displayTimeout = 3 * time.Minute
+	// screenshotTimeout bounds taking a screenshot
+	screenshotTimeout = time.Minute
+	// screenshotsKept is the number of screenshots kept per device, older
+	// ones are removed when a new one is taken
+	screenshotsKept = 10
+)
+
+// DisplayResponse holds the kiosk display settings of a device and the
+// outcome of applying them if the device was connected
+type DisplayResponse struct {
+	models.DeviceDisplay
+	Applied *bool  `json:"applied,omitempty"` // Set if the device was asked to take the settings
+	Message string `json:"message,omitempty"`
+}
+
+// canOperateDisplay reports whether the user of a request may change a
+// kiosk display, writing the error response if not
+func canOperateDisplay(w http.ResponseWriter, r *http.Request) bool {
+	user, _ := r.Context().Value("user").(models.User)
+	if user.Role != models.UserRoleAdmin && user.Role != models.UserRoleOperator {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// handleDeviceDisplay reads and replaces the kiosk display settings of a
+// device, applying them right away if the device is connected
+func (s *Server) handleDeviceDisplay(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.PathValue("id")
+
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		display := models.DeviceDisplay{DeviceID: device.ID, Blanking: []protocol.BlankingPeriod{}}
+		err := s.database.GetDB().Where("device_id = ?", device.ID).First(&display).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			s.logger.Error(fmt.Sprintf("Failed to fetch display settings of device %s", deviceID), err)
+			http.Error(w, "Failed to fetch display settings", http.StatusInternalServerError)
+			return
+		}
+		jsonResponse(w, DisplayResponse{DeviceDisplay: display}, http.StatusOK)
+
+	case http.MethodPut:
+		if !canOperateDisplay(w, r) {
+			return
+		}
+
+		var payload protocol.DisplayPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if err := payload.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if payload.Blanking == nil {
+			payload.Blanking = []protocol.BlankingPeriod{}
+		}
+
+		display := models.DeviceDisplay{
+			DeviceID: device.ID,
+			URL:      payload.URL,
+			Rotation: payload.Rotation,
+			Blanking: payload.Blanking,
+		}
+		if err := s.database.GetDB().Save(&display).Error; err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to save display settings of device %s", deviceID), err)
+			http.Error(w, "Failed to save display settings", http.StatusInternalServerError)
+			return
+		}
+		s.audit(r, models.AuditDisplayConfigure, deviceID, "", map[string]interface{}{
+			"url":      payload.URL,
+			"rotation": payload.Rotation,
+			"blanking": len(payload.Blanking),
+		})
+
+		response := DisplayResponse{DeviceDisplay: display}
+		if _, connected := s.sshServer.GetDeviceConnection(deviceID); connected && protocol.HasFeature(device.AgentFeatures, protocol.FeatureDisplay) {
+			ctx, cancel := context.WithTimeout(r.Context(), displayTimeout)
+			result, err := s.sshServer.ApplyDisplay(ctx, &device)
+			cancel()
+
+			applied := err == nil && result.Success
+			response.Applied = &applied
+			if err != nil {
+				s.logger.Error(fmt.Sprintf("Failed to apply display settings to device %s", deviceID), err)
+				response.Message = err.Error()
+			} else {
+				response.Message = result.Message
+			}
+			s.database.GetDB().Where("device_id = ?", device.ID).First(&response.DeviceDisplay)
+		}
+
+		jsonResponse(w, response, http.StatusOK)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleDeviceScreenshots lists the screenshots of the kiosk display of a
+// device, newest first, or takes a new one
+func (s *Server) handleDeviceScreenshots(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.PathValue("id")
+
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		screenshots := []models.DisplayScreenshot{}
+		if err := s.database.GetDB().Omit("data").Where("device_id = ?", device.ID).
+			Order("created_at DESC").Find(&screenshots).Error; err != nil {
+			s.logger.Error("Failed to fetch screenshots", err)
+			http.Error(w, "Failed to fetch screenshots", http.StatusInternalServerError)
+			return
+		}
+		jsonResponse(w, screenshots, http.StatusOK)
+
+	case http.MethodPost:
+		s.takeScreenshot(w, r, &device)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// takeScreenshot asks a connected device for a screenshot of its kiosk
+// display and stores it
+func (s *Server) takeScreenshot(w http.ResponseWriter, r *http.Request, device *models.Device) {
+	if !canOperateDisplay(w, r) {
+		return
+	}
+	if _, connected := s.sshServer.GetDeviceConnection(device.DeviceID); !connected {
+		http.Error(w, "Device is not connected", http.StatusConflict)
+		return
+	}
+	if !protocol.HasFeature(device.AgentFeatures, protocol.FeatureDisplay) {
+		http.Error(w, fmt.Sprintf("Agent version %s does not support kiosk displays", device.AgentVersion), http.StatusConflict)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), screenshotTimeout)
+	defer cancel()
+
+	taken, err := s.sshServer.TakeScreenshot(ctx, device.DeviceID)
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to take screenshot of device %s", device.DeviceID), err)
+		http.Error(w, fmt.Sprintf("Failed to take screenshot: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	user, _ := r.Context().Value("user").(models.User)
+	screenshot := models.DisplayScreenshot{
+		DeviceID:    device.ID,
+		Size:        int64(len(taken.Image)),
+		Data:        taken.Image,
+		RequestedBy: user.Username,
+		TakenAt:     taken.Taken,
+	}
+	if err := s.database.GetDB().Create(&screenshot).Error; err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to store screenshot of device %s", device.DeviceID), err)
+		http.Error(w, "Failed to store screenshot", http.StatusInternalServerError)
+		return
+	}
+	s.audit(r, models.AuditDisplayScreenshot, device.DeviceID, "", map[string]interface{}{
+		"screenshot_id": screenshot.ID.String(),
+	})
+
+	// Keep the newest screenshots only
+	var old []uuid.UUID
+	s.database.GetDB().Model(&models.DisplayScreenshot{}).Where("device_id = ?", device.ID).
+		Order("created_at DESC").Offset(screenshotsKept).Pluck("id", &old)
+	if len(old) > 0 {
+		s.database.GetDB().Where("id IN ?", old).Delete(&models.DisplayScreenshot{})
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/api/devices/%s/display/screenshots/%s", device.DeviceID, screenshot.ID))
+	jsonResponse(w, screenshot, http.StatusCreated)
+}
+
+// handleDeviceScreenshot serves a screenshot of the kiosk display of a
+// device as a PNG image
+func (s *Server) handleDeviceScreenshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", r.PathValue("id")).First(&device).Error; err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	screenshotID, err := uuid.Parse(strings.TrimSuffix(r.PathValue("screenshot"), ".png"))
+	if err != nil {
+		http.Error(w, "Screenshot not found", http.StatusNotFound)
+		return
+	}
+	var screenshot models.DisplayScreenshot
+	if err := s.database.GetDB().Where("id = ? AND device_id = ?", screenshotID, device.ID).First(&screenshot).Error; err != nil {
+		http.Error(w, "Screenshot not found", http.StatusNotFound)
+		return
+	}
+
+	filename := fmt.Sprintf("screenshot-%s-%s.png", device.DeviceID, screenshot.CreatedAt.UTC().Format("20060102-150405"))
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", filename))
+	http.ServeContent(w, r, filename, screenshot.CreatedAt, bytes.NewReader(screenshot.Data))
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/edgetainer/edgetainer/internal/server/dns"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+)
+
+// SetDNS makes the server keep the DNS records of device subdomains up to
+// date as devices are created, changed and deleted
+func (s *Server) SetDNS(manager *dns.Manager) {
+	s.dns = manager
+}
+
+// syncDNS updates the DNS records after devices changed, if enabled
+func (s *Server) syncDNS() {
+	if s.dns != nil {
+		s.dns.Sync()
+	}
+}
+
+// checkSubdomain checks that a subdomain is a DNS label no other device
+// uses. It writes an error response and returns false otherwise.
+func (s *Server) checkSubdomain(w http.ResponseWriter, deviceID, subdomain string) bool {
+	if subdomain == "" {
+		return true
+	}
+	if !dns.ValidSubdomain(subdomain) {
+		http.Error(w, fmt.Sprintf("Subdomain %q must be a lowercase DNS label", subdomain), http.StatusBadRequest)
+		return false
+	}
+
+	var count int64
+	err := s.database.GetDB().Model(&models.Device{}).
+		Where("subdomain = ? AND device_id <> ?", subdomain, deviceID).
+		Count(&count).Error
+	if err != nil {
+		s.logger.Error("Failed to check subdomain", err)
+		http.Error(w, "Failed to check subdomain", http.StatusInternalServerError)
+		return false
+	}
+	if count > 0 {
+		http.Error(w, fmt.Sprintf("Subdomain %q is taken by another device", subdomain), http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+// handleAdminDNS returns the DNS records kept for device subdomains
+func (s *Server) handleAdminDNS(w http.ResponseWriter, r *http.Request) {
+	if s.dns == nil {
+		http.Error(w, "DNS records are not enabled", http.StatusNotFound)
+		return
+	}
+
+	status, err := s.dns.Status()
+	if err != nil {
+		s.logger.Error("Failed to fetch DNS records", err)
+		http.Error(w, "Failed to fetch DNS records", http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, status, http.StatusOK)
+}
+
+// handleAdminDNSSync synchronizes the DNS records right away, e.g. after
+// fixing the provider settings
+func (s *Server) handleAdminDNSSync(w http.ResponseWriter, r *http.Request) {
+	if s.dns == nil {
+		http.Error(w, "DNS records are not enabled", http.StatusNotFound)
+		return
+	}
+
+	s.dns.Sync()
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,128 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"path"
+	"regexp"
+
+	"github.com/edgetainer/edgetainer/internal/server/ssh"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+)
+
+// defaultDockerSocket is the Docker socket of devices whose tunnel policy
+// names none
+const defaultDockerSocket = "/var/run/docker.sock"
+
+// dockerVersionPrefix matches the API version of Docker API paths, e.g. /v1.43
+var dockerVersionPrefix = regexp.MustCompile(`^/v[0-9]+\.[0-9]+`)
+
+// dockerReadDenied are read requests that go beyond inspecting containers,
+// they return file contents, image tarballs, attached streams or the swarm
+// unlock key. They need read-write access like any change.
+var dockerReadDenied = []*regexp.Regexp{
+	regexp.MustCompile(`^/containers/[^/]+/(archive|export|attach/ws)$`),
+	regexp.MustCompile(`^/images/(.+/)?get$`),
+	regexp.MustCompile(`^/swarm/unlockkey$`),
+}
+
+// isDockerRead reports whether a Docker API request only reads state
+func isDockerRead(method, apiPath string) bool {
+	if method != http.MethodGet && method != http.MethodHead {
+		return false
+	}
+
+	apiPath = dockerVersionPrefix.ReplaceAllString(apiPath, "")
+	for _, denied := range dockerReadDenied {
+		if denied.MatchString(apiPath) {
+			return false
+		}
+	}
+	return true
+}
+
+// handleDeviceDocker proxies the Docker Engine API of a device through its
+// tunnel. The device's tunnel policy decides whether it is disabled,
+// read-only or read-write. Operators may read, changes need an admin.
+func (s *Server) handleDeviceDocker(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.PathValue("id")
+	user, _ := r.Context().Value("user").(models.User)
+
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	access := device.TunnelPolicy.DockerAPI
+	if access == "" {
+		access = models.DockerAPIReadOnly
+	}
+	if access == models.DockerAPIDisabled {
+		http.Error(w, "Docker API access is disabled for this device", http.StatusForbidden)
+		return
+	}
+
+	apiPath := path.Clean("/" + r.PathValue("path"))
+	if isDockerRead(r.Method, apiPath) {
+		if user.Role != models.UserRoleAdmin && user.Role != models.UserRoleOperator {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+	} else {
+		if access != models.DockerAPIReadWrite {
+			http.Error(w, "Docker API access is read-only for this device", http.StatusForbidden)
+			return
+		}
+		if user.Role != models.UserRoleAdmin {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		s.logger.Info(fmt.Sprintf("User %s sent %s %s to the Docker API of device %s", user.Username, r.Method, apiPath, deviceID))
+	}
+
+	if _, connected := s.sshServer.GetDeviceConnection(deviceID); !connected {
+		http.Error(w, "Device is not connected", http.StatusConflict)
+		return
+	}
+
+	socket := device.TunnelPolicy.DockerSocket
+	if socket == "" {
+		socket = defaultDockerSocket
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL.Scheme = "http"
+			pr.Out.URL.Host = "docker"
+			pr.Out.URL.Path = apiPath
+			pr.Out.URL.RawPath = ""
+			pr.Out.Host = "docker"
+
+			// Credentials for the server are not for the device
+			pr.Out.Header.Del("Authorization")
+			pr.Out.Header.Del("Cookie")
+		},
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return s.sshServer.DialUnix(deviceID, socket)
+			},
+			DisableKeepAlives: true,
+		},
+		// Stream logs, events and stats as they arrive
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			if errors.Is(err, ssh.ErrConnectionLimit) {
+				http.Error(w, "Device has reached its connection limit", http.StatusTooManyRequests)
+				return
+			}
+			s.logger.Error(fmt.Sprintf("Failed to proxy Docker API request of device %s", deviceID), err)
+			http.Error(w, "Failed to reach the Docker API of the device", http.StatusBadGateway)
+		},
+	}
+	proxy.ServeHTTP(w, r)
+}
@@ -0,0 +1,375 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/edgetainer/edgetainer/internal/server/deploy"
+	"github.com/edgetainer/edgetainer/internal/server/envschema"
+	"github.com/edgetainer/edgetainer/internal/server/secrets"
+	"github.com/edgetainer/edgetainer/internal/shared/credentials"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// EnvVarsRequest represents a request to set fleet or device env var overrides
+type EnvVarsRequest struct {
+	SoftwareID    uuid.UUID         `json:"software_id"`
+	Version       string            `json:"version,omitempty"`        // Defaults to the software's current version
+	ContainerName string            `json:"container_name,omitempty"` // Defaults to the software name
+	EnvVars       map[string]string `json:"env_vars"`
+}
+
+// EnvVarsResponse represents env var overrides with secret values and
+// credentials masked
+type EnvVarsResponse struct {
+	ID            uuid.UUID         `json:"id"`
+	SoftwareID    uuid.UUID         `json:"software_id,omitempty"`
+	ContainerName string            `json:"container_name"`
+	EnvVars       map[string]string `json:"env_vars"`
+}
+
+// handleSoftwareEnvSchema handles the env var schema of a software version
+func (s *Server) handleSoftwareEnvSchema(w http.ResponseWriter, r *http.Request) {
+	softwareID := r.PathValue("id")
+	version := r.PathValue("version")
+
+	var software models.Software
+	if err := s.database.GetDB().Where("id = ?", softwareID).First(&software).Error; err != nil {
+		http.Error(w, "Software not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		schema, err := s.deployer.LoadEnvSchema(r.Context(), software, version)
+		if err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to load env schema of %s %s", softwareID, version), err)
+			http.Error(w, "Failed to load env schema", http.StatusInternalServerError)
+			return
+		}
+
+		jsonResponse(w, schema, http.StatusOK)
+
+	case http.MethodPut:
+		var schema envschema.Schema
+		if err := json.NewDecoder(r.Body).Decode(&schema); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		if schema == nil {
+			schema = envschema.Schema{}
+		}
+		if err := schema.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		variables, _ := json.Marshal(schema)
+
+		var record models.SoftwareEnvSchema
+		err := s.database.GetDB().Where("software_id = ? AND version = ?", software.ID, version).First(&record).Error
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			record = models.SoftwareEnvSchema{
+				SoftwareID: software.ID,
+				Version:    version,
+				Variables:  string(variables),
+			}
+			err = s.database.GetDB().Create(&record).Error
+		case err == nil:
+			err = s.database.GetDB().Model(&record).Update("variables", string(variables)).Error
+		}
+		if err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to save env schema of %s %s", softwareID, version), err)
+			http.Error(w, "Failed to save env schema", http.StatusInternalServerError)
+			return
+		}
+
+		s.logger.Info(fmt.Sprintf("Updated env schema of %s version %s (%d variables)", software.Name, version, len(schema)))
+		jsonResponse(w, schema, http.StatusOK)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleFleetEnvVars handles the env var overrides of a fleet
+func (s *Server) handleFleetEnvVars(w http.ResponseWriter, r *http.Request) {
+	fleetID := r.PathValue("id")
+
+	var fleet models.Fleet
+	if err := s.database.GetDB().Where("id = ?", fleetID).First(&fleet).Error; err != nil {
+		http.Error(w, "Fleet not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		var records []models.FleetEnvVars
+		if err := s.database.GetDB().Where("fleet_id = ?", fleet.ID).Find(&records).Error; err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to fetch env vars of fleet %s", fleetID), err)
+			http.Error(w, "Failed to fetch env vars", http.StatusInternalServerError)
+			return
+		}
+
+		response := make([]EnvVarsResponse, 0, len(records))
+		for _, record := range records {
+			response = append(response, s.envVarsResponse(record.ID, record.SoftwareID, record.ContainerName, record.EnvVars))
+		}
+
+		jsonResponse(w, response, http.StatusOK)
+
+	case http.MethodPut:
+		request, ok := s.decodeEnvVarsRequest(w, r)
+		if !ok {
+			return
+		}
+
+		var record models.FleetEnvVars
+		err := s.database.GetDB().Where("fleet_id = ? AND container_name = ?", fleet.ID, request.ContainerName).First(&record).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			s.logger.Error(fmt.Sprintf("Failed to fetch env vars of fleet %s", fleetID), err)
+			http.Error(w, "Failed to save env vars", http.StatusInternalServerError)
+			return
+		}
+
+		values := keepMaskedSecrets(request.EnvVars, record.EnvVars)
+		encoded, _ := json.Marshal(values)
+
+		record.FleetID = fleet.ID
+		record.SoftwareID = request.SoftwareID
+		record.ContainerName = request.ContainerName
+		record.EnvVars = string(encoded)
+
+		if err := s.database.GetDB().Save(&record).Error; err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to save env vars of fleet %s", fleetID), err)
+			http.Error(w, "Failed to save env vars", http.StatusInternalServerError)
+			return
+		}
+
+		jsonResponse(w, s.envVarsResponse(record.ID, record.SoftwareID, record.ContainerName, record.EnvVars), http.StatusOK)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleDeviceEnvVars handles the env var overrides of a device
+func (s *Server) handleDeviceEnvVars(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.PathValue("id")
+
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		var records []models.DeviceEnvVars
+		if err := s.database.GetDB().Where("device_id = ?", device.ID).Find(&records).Error; err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to fetch env vars of device %s", deviceID), err)
+			http.Error(w, "Failed to fetch env vars", http.StatusInternalServerError)
+			return
+		}
+
+		response := make([]EnvVarsResponse, 0, len(records))
+		for _, record := range records {
+			response = append(response, s.envVarsResponse(record.ID, record.SoftwareID, record.ContainerName, record.EnvVars))
+		}
+
+		jsonResponse(w, response, http.StatusOK)
+
+	case http.MethodPut:
+		request, ok := s.decodeEnvVarsRequest(w, r)
+		if !ok {
+			return
+		}
+
+		var record models.DeviceEnvVars
+		err := s.database.GetDB().Where("device_id = ? AND container_name = ?", device.ID, request.ContainerName).First(&record).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			s.logger.Error(fmt.Sprintf("Failed to fetch env vars of device %s", deviceID), err)
+			http.Error(w, "Failed to save env vars", http.StatusInternalServerError)
+			return
+		}
+
+		values := keepMaskedSecrets(request.EnvVars, record.EnvVars)
+		encoded, _ := json.Marshal(values)
+
+		record.DeviceID = device.ID
+		record.SoftwareID = request.SoftwareID
+		record.ContainerName = request.ContainerName
+		record.EnvVars = string(encoded)
+
+		if err := s.database.GetDB().Save(&record).Error; err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to save env vars of device %s", deviceID), err)
+			http.Error(w, "Failed to save env vars", http.StatusInternalServerError)
+			return
+		}
+
+		jsonResponse(w, s.envVarsResponse(record.ID, record.SoftwareID, record.ContainerName, record.EnvVars), http.StatusOK)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleDeviceResolvedEnv returns the env vars a device would be deployed
+// with: schema defaults, then software defaults, then fleet and device
+// overrides, with templates expanded and secrets masked
+func (s *Server) handleDeviceResolvedEnv(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	deviceID := r.PathValue("id")
+
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	var software models.Software
+	if err := s.database.GetDB().Where("id = ?", r.URL.Query().Get("software_id")).First(&software).Error; err != nil {
+		http.Error(w, "Software not found", http.StatusNotFound)
+		return
+	}
+
+	version := r.URL.Query().Get("version")
+	if version == "" {
+		version = software.CurrentVersion
+	}
+
+	schema, values, err := s.deployer.ResolveEnv(r.Context(), &device, &software, version)
+	if err != nil {
+		var validationErr *envschema.ValidationError
+		if errors.As(err, &validationErr) {
+			jsonResponse(w, validationErr, http.StatusUnprocessableEntity)
+			return
+		}
+		s.logger.Error(fmt.Sprintf("Failed to resolve env vars of device %s", deviceID), err)
+		http.Error(w, "Failed to resolve env vars", http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse(w, credentials.MaskEnv(schema.MaskSecrets(values), envschema.Mask), http.StatusOK)
+}
+
+// decodeEnvVarsRequest decodes and validates an env var override request,
+// responding with an error and returning false when it is invalid
+func (s *Server) decodeEnvVarsRequest(w http.ResponseWriter, r *http.Request) (*EnvVarsRequest, bool) {
+	var request EnvVarsRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return nil, false
+	}
+
+	var software models.Software
+	if err := s.database.GetDB().Where("id = ?", request.SoftwareID).First(&software).Error; err != nil {
+		http.Error(w, "Software not found", http.StatusBadRequest)
+		return nil, false
+	}
+
+	if request.Version == "" {
+		request.Version = software.CurrentVersion
+	}
+	if request.ContainerName == "" {
+		request.ContainerName = software.Name
+	}
+	if request.EnvVars == nil {
+		request.EnvVars = map[string]string{}
+	}
+
+	for name, value := range request.EnvVars {
+		if secrets.IsReference(value) {
+			if _, err := secrets.ParseReference(value); err != nil {
+				http.Error(w, fmt.Sprintf("%s: %v", name, err), http.StatusBadRequest)
+				return nil, false
+			}
+		}
+	}
+
+	schema, err := s.deployer.LoadEnvSchema(r.Context(), software, request.Version)
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to load env schema of %s %s", software.ID, request.Version), err)
+		http.Error(w, "Failed to load env schema", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	// Variables the schema declares secret are meant to hold credentials
+	scanned := make(map[string]string, len(request.EnvVars))
+	for name, value := range request.EnvVars {
+		if v, ok := schema.Lookup(name); !ok || !v.Secret {
+			scanned[name] = value
+		}
+	}
+	if !s.checkCredentials(w, r, "Env vars of "+request.ContainerName, credentials.ScanEnv(scanned, "env_vars")) {
+		return nil, false
+	}
+
+	// Without a declared schema any values are accepted
+	if len(schema) > 0 {
+		overrides := make(map[string]string, len(request.EnvVars))
+		for name, value := range request.EnvVars {
+			if value == envschema.Mask {
+				continue
+			}
+			overrides[name] = value
+		}
+		if err := schema.CheckOverrides(overrides); err != nil {
+			jsonResponse(w, err, http.StatusUnprocessableEntity)
+			return nil, false
+		}
+	}
+
+	return &request, true
+}
+
+// envVarsResponse builds an override response with secret values masked
+func (s *Server) envVarsResponse(id, softwareID uuid.UUID, containerName, envVars string) EnvVarsResponse {
+	values := deploy.DecodeEnvVars(envVars)
+
+	var software models.Software
+	if softwareID != uuid.Nil {
+		if err := s.database.GetDB().Where("id = ?", softwareID).First(&software).Error; err == nil {
+			if schema, err := s.deployer.LoadEnvSchema(s.ctx, software, ""); err == nil {
+				values = schema.MaskSecrets(values)
+			}
+		}
+	}
+
+	return EnvVarsResponse{
+		ID:            id,
+		SoftwareID:    softwareID,
+		ContainerName: containerName,
+		EnvVars:       credentials.MaskEnv(values, envschema.Mask),
+	}
+}
+
+// keepMaskedSecrets replaces masked values sent back by a client with the
+// stored values, so forms can round-trip secrets without ever seeing them
+func keepMaskedSecrets(values map[string]string, stored string) map[string]string {
+	previous := deploy.DecodeEnvVars(stored)
+
+	result := make(map[string]string, len(values))
+	for name, value := range values {
+		if value == envschema.Mask {
+			old, ok := previous[name]
+			if !ok {
+				continue
+			}
+			value = old
+		}
+		result[name] = value
+	}
+
+	return result
+}
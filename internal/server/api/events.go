@@ -0,0 +1,96 @@
+package api
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"slices"
+
+	"github.com/edgetainer/edgetainer/internal/server/events"
+	"github.com/google/uuid"
+	"golang.org/x/net/websocket"
+)
+
+// eventStreamBuffer is the number of events held for a slow client before
+// they are dropped
+const eventStreamBuffer = 64
+
+// SetEventBus sets the bus the events WebSocket streams from
+func (s *Server) SetEventBus(bus *events.Bus) {
+	s.bus = bus
+}
+
+// handleEvents streams the events published on the bus over a WebSocket as
+// JSON, one event per message. The type and device_id query parameters
+// select events, type may be given several times. Messages from the client
+// are ignored.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if s.bus == nil {
+		http.Error(w, "Events are not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	types := r.URL.Query()["type"]
+	deviceID := r.URL.Query().Get("device_id")
+	for _, eventType := range types {
+		if !slices.Contains(events.Types, eventType) {
+			http.Error(w, "Unknown event type "+eventType, http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Authentication is by token rather than cookie, so any origin may
+	// connect
+	server := websocket.Server{Handler: func(ws *websocket.Conn) {
+		defer ws.Close()
+
+		name := "events-" + uuid.NewString()
+		eventCh := s.bus.Subscribe(name, eventStreamBuffer)
+		defer s.bus.Unsubscribe(name)
+
+		// Reading notices when the client goes away
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			var discard []byte
+			for websocket.Message.Receive(ws, &discard) == nil {
+			}
+		}()
+
+		for {
+			select {
+			case evt, ok := <-eventCh:
+				if !ok {
+					return
+				}
+				if (len(types) > 0 && !slices.Contains(types, evt.Type)) || (deviceID != "" && evt.DeviceID != deviceID) {
+					continue
+				}
+				if err := websocket.JSON.Send(ws, evt); err != nil {
+					return
+				}
+			case <-closed:
+				return
+			case <-s.ctx.Done():
+				return
+			}
+		}
+	}}
+	server.ServeHTTP(w, r)
+}
+
+// tokenQuery takes the API token from the token query parameter when there
+// is no Authorization header, as browsers cannot set headers on WebSockets
+func tokenQuery(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token := r.URL.Query().Get("token"); token != "" && r.Header.Get("Authorization") == "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		next(w, r)
+	}
+}
+
+// Hijack lets the events WebSocket take over the connection
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(r.ResponseWriter).Hijack()
+}
@@ -0,0 +1,364 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// exportColumns are the standard columns of a device export, followed by one
+// column per custom field
+var exportColumns = []string{
+	"device_id", "name", "status", "fleet_id", "site_id", "ip_address", "last_seen",
+	"latitude", "longitude", "address", "location_source",
+}
+
+// deviceExportColumns are the columns a device export can have besides the
+// custom fields
+var deviceExportColumns = []exportColumn[models.Device]{
+	{name: "device_id", value: func(d *models.Device) string { return d.DeviceID }},
+	{name: "name", value: func(d *models.Device) string { return d.Name }},
+	{name: "status", value: func(d *models.Device) string { return d.Status }},
+	{name: "fleet_id", value: func(d *models.Device) string { return exportID(d.FleetID) }},
+	{name: "site_id", value: func(d *models.Device) string { return exportID(d.SiteID) }},
+	{name: "ip_address", value: func(d *models.Device) string { return d.IPAddress }},
+	{name: "ip_addresses", value: func(d *models.Device) string { return strings.Join(d.IPAddresses, " ") }},
+	{name: "last_seen", value: func(d *models.Device) string { return exportTime(d.LastSeen) }},
+	{name: "latitude", numeric: true, value: func(d *models.Device) string { return exportFloat(d.Latitude) }},
+	{name: "longitude", numeric: true, value: func(d *models.Device) string { return exportFloat(d.Longitude) }},
+	{name: "address", value: func(d *models.Device) string { return d.Address }},
+	{name: "location_source", value: func(d *models.Device) string { return d.LocationSource }},
+	{name: "agent_version", value: func(d *models.Device) string { return d.AgentVersion }},
+	{name: "os_version", value: func(d *models.Device) string { return d.OSVersion }},
+	{name: "subdomain", value: func(d *models.Device) string { return d.Subdomain }},
+	{name: "timezone", value: func(d *models.Device) string { return d.Timezone }},
+	{name: "hardware_id", value: func(d *models.Device) string { return d.HardwareID }},
+	{name: "created_at", value: func(d *models.Device) string { return exportTime(d.CreatedAt) }},
+}
+
+// deploymentExportColumns are the columns of a deployment export
+var deploymentExportColumns = []exportColumn[deploymentExportRow]{
+	{name: "id", value: func(d *deploymentExportRow) string { return d.ID.String() }},
+	{name: "device_id", value: func(d *deploymentExportRow) string { return d.DeviceID }},
+	{name: "device_name", value: func(d *deploymentExportRow) string { return d.DeviceName }},
+	{name: "software", value: func(d *deploymentExportRow) string { return d.Software }},
+	{name: "version", value: func(d *deploymentExportRow) string { return d.Version }},
+	{name: "status", value: func(d *deploymentExportRow) string { return d.Status }},
+	{name: "stage", value: func(d *deploymentExportRow) string { return d.Stage }},
+	{name: "attempts", numeric: true, value: func(d *deploymentExportRow) string { return strconv.Itoa(d.Attempts) }},
+	{name: "error", value: func(d *deploymentExportRow) string { return d.Error }},
+	{name: "rollout_id", value: func(d *deploymentExportRow) string { return exportID(d.RolloutID) }},
+	{name: "fleet_id", value: func(d *deploymentExportRow) string { return exportID(d.FleetID) }},
+	{name: "created_at", value: func(d *deploymentExportRow) string { return exportTime(d.CreatedAt) }},
+	{name: "finished_at", value: func(d *deploymentExportRow) string { return exportTimePtr(d.FinishedAt) }},
+	{name: "duration_seconds", numeric: true, value: func(d *deploymentExportRow) string {
+		if d.FinishedAt == nil {
+			return ""
+		}
+		return strconv.FormatFloat(d.FinishedAt.Sub(d.CreatedAt).Seconds(), 'f', 0, 64)
+	}},
+}
+
+// deploymentExportRow is a deployment with the names of its device and
+// software. Env vars are left out, they may hold secrets.
+type deploymentExportRow struct {
+	ID         uuid.UUID
+	DeviceID   string
+	DeviceName string
+	Software   string
+	Version    string
+	Status     string
+	Stage      string
+	Attempts   int
+	Error      string
+	RolloutID  *uuid.UUID
+	FleetID    *uuid.UUID
+	CreatedAt  time.Time
+	FinishedAt *time.Time
+}
+
+// uptimeExportColumns are the columns of an uptime export
+var uptimeExportColumns = []exportColumn[Uptime]{
+	{name: "device_id", value: func(u *Uptime) string { return u.DeviceID }},
+	{name: "name", value: func(u *Uptime) string { return u.Name }},
+	{name: "status", value: func(u *Uptime) string { return u.Status }},
+	{name: "window_seconds", numeric: true, value: func(u *Uptime) string { return strconv.FormatFloat(u.WindowSeconds, 'f', 0, 64) }},
+	{name: "online_seconds", numeric: true, value: func(u *Uptime) string { return strconv.FormatFloat(u.OnlineSeconds, 'f', 0, 64) }},
+	{name: "uptime", numeric: true, value: func(u *Uptime) string {
+		if u.Uptime == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*u.Uptime, 'f', 2, 64)
+	}},
+	{name: "disconnects", numeric: true, value: func(u *Uptime) string { return strconv.FormatInt(u.Disconnects, 10) }},
+}
+
+// deviceQuery builds a device query from the filters of a list or export
+// request: fleet_id, bbox and field.<name>
+func (s *Server) deviceQuery(r *http.Request) (*gorm.DB, error) {
+	query := s.database.GetDB()
+
+	if fleetID := r.URL.Query().Get("fleet_id"); fleetID != "" {
+		if _, err := uuid.Parse(fleetID); err != nil {
+			return nil, fmt.Errorf("invalid fleet ID")
+		}
+		query = query.Where("fleet_id = ?", fleetID)
+	}
+
+	if bbox := r.URL.Query().Get("bbox"); bbox != "" {
+		box, err := parseBoundingBox(bbox)
+		if err != nil {
+			return nil, err
+		}
+		query = box.apply(query)
+	}
+
+	return filterByCustomFields(query, r)
+}
+
+// handleDeviceExport exports the devices matching the list filters with their
+// custom fields, as CSV by default, as an Excel workbook with format=xlsx or
+// as JSON with format=json. CSV and Excel exports are streamed and take the
+// columns to export.
+func (s *Server) handleDeviceExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query, err := s.deviceQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query = query.WithContext(r.Context())
+
+	if r.URL.Query().Get("format") == "json" {
+		var devices []models.Device
+		if err := query.Order("name").Find(&devices).Error; err != nil {
+			s.logger.Error("Failed to fetch devices", err)
+			http.Error(w, "Failed to fetch devices", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Disposition", `attachment; filename="devices.json"`)
+		jsonResponse(w, devices, http.StatusOK)
+		return
+	}
+
+	// Every defined field gets a column, so exports of different fleets
+	// line up as long as the same fields are defined
+	var fieldNames []string
+	if err := s.database.GetDB().Model(&models.CustomField{}).Distinct("name").Order("name").Pluck("name", &fieldNames).Error; err != nil {
+		s.logger.Error("Failed to fetch custom fields", err)
+		http.Error(w, "Failed to fetch custom fields", http.StatusInternalServerError)
+		return
+	}
+
+	available := append([]exportColumn[models.Device]{}, deviceExportColumns...)
+	defaults := append([]string{}, exportColumns...)
+	for _, name := range fieldNames {
+		field := name
+		column := name
+		// Fields named like a standard column are told apart as in filters
+		for _, standard := range deviceExportColumns {
+			if standard.name == name {
+				column = "field." + name
+				break
+			}
+		}
+		available = append(available, exportColumn[models.Device]{name: column, value: func(d *models.Device) string {
+			return d.CustomFields[field]
+		}})
+		defaults = append(defaults, column)
+	}
+
+	export, err := newExport(r, available, defaults)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rows, err := query.Model(&models.Device{}).Order("name").Rows()
+	if err != nil {
+		s.logger.Error("Failed to fetch devices", err)
+		http.Error(w, "Failed to fetch devices", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	if err := export.begin(w, "devices", "Devices"); err != nil {
+		s.logger.Error("Failed to write device export", err)
+		return
+	}
+	for rows.Next() {
+		var device models.Device
+		if err := query.ScanRows(rows, &device); err != nil {
+			s.logger.Error("Failed to read device for export", err)
+			return
+		}
+		if err := export.write(&device); err != nil {
+			s.logger.Error("Failed to write device export", err)
+			return
+		}
+	}
+	if err := rows.Err(); err != nil {
+		s.logger.Error("Failed to fetch devices", err)
+		return
+	}
+	if err := export.end(); err != nil {
+		s.logger.Error("Failed to write device export", err)
+	}
+}
+
+// handleFleetUptimeExport exports the uptime report of a fleet, one row per
+// device, lowest uptime first
+func (s *Server) handleFleetUptimeExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fleetID := r.PathValue("id")
+
+	from, to, err := parseWindow(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	export, err := newExport(r, uptimeExportColumns, []string{
+		"device_id", "name", "status", "window_seconds", "online_seconds", "uptime", "disconnects",
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var fleet models.Fleet
+	if err := s.database.GetDB().Where("id = ?", fleetID).First(&fleet).Error; err != nil {
+		http.Error(w, "Fleet not found", http.StatusNotFound)
+		return
+	}
+
+	uptimes, err := s.fleetUptimes(r, fleet.ID, from, to)
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to compute uptime of fleet %s", fleetID), err)
+		http.Error(w, "Failed to compute uptime", http.StatusInternalServerError)
+		return
+	}
+
+	filename := fmt.Sprintf("uptime-%s-%s-%s", fleet.Name, from.UTC().Format("20060102"), to.UTC().Format("20060102"))
+	if err := export.begin(w, exportFilename(filename), "Uptime"); err != nil {
+		s.logger.Error("Failed to write uptime export", err)
+		return
+	}
+	for i := range uptimes {
+		if err := export.write(&uptimes[i]); err != nil {
+			s.logger.Error("Failed to write uptime export", err)
+			return
+		}
+	}
+	if err := export.end(); err != nil {
+		s.logger.Error("Failed to write uptime export", err)
+	}
+}
+
+// handleDeploymentExport exports deployments, newest first, filtered by
+// fleet_id, device_id, software_id, rollout_id, status and the from and to
+// of their creation
+func (s *Server) handleDeploymentExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	export, err := newExport(r, deploymentExportColumns, []string{
+		"id", "device_id", "device_name", "software", "version", "status", "stage",
+		"attempts", "error", "rollout_id", "created_at", "finished_at", "duration_seconds",
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query := s.database.GetDB().WithContext(r.Context()).Table("deployments").
+		Select("deployments.id, devices.device_id, devices.name AS device_name, softwares.name AS software, " +
+			"deployments.version, deployments.status, deployments.stage, deployments.attempts, deployments.error, " +
+			"deployments.rollout_id, coalesce(devices.fleet_id, deployments.fleet_id) AS fleet_id, " +
+			"deployments.created_at, deployments.finished_at").
+		Joins("LEFT JOIN devices ON devices.id = deployments.device_id").
+		Joins("LEFT JOIN softwares ON softwares.id = deployments.software_id").
+		Where("deployments.deleted_at IS NULL")
+
+	params := r.URL.Query()
+	for _, filter := range []struct{ param, column string }{
+		{"fleet_id", "coalesce(devices.fleet_id, deployments.fleet_id)"},
+		{"software_id", "deployments.software_id"},
+		{"rollout_id", "deployments.rollout_id"},
+	} {
+		if value := params.Get(filter.param); value != "" {
+			id, err := uuid.Parse(value)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid %s", filter.param), http.StatusBadRequest)
+				return
+			}
+			query = query.Where(filter.column+" = ?", id)
+		}
+	}
+	if deviceID := params.Get("device_id"); deviceID != "" {
+		query = query.Where("devices.device_id = ?", deviceID)
+	}
+	if status := params.Get("status"); status != "" {
+		query = query.Where("deployments.status = ?", status)
+	}
+	for _, bound := range []struct{ param, condition string }{
+		{"from", "deployments.created_at >= ?"},
+		{"to", "deployments.created_at < ?"},
+	} {
+		if value := params.Get(bound.param); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid %s, expected an RFC 3339 timestamp", bound.param), http.StatusBadRequest)
+				return
+			}
+			query = query.Where(bound.condition, parsed)
+		}
+	}
+
+	rows, err := query.Order("deployments.created_at DESC").Rows()
+	if err != nil {
+		s.logger.Error("Failed to fetch deployments", err)
+		http.Error(w, "Failed to fetch deployments", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	if err := export.begin(w, "deployments", "Deployments"); err != nil {
+		s.logger.Error("Failed to write deployment export", err)
+		return
+	}
+	for rows.Next() {
+		var deployment deploymentExportRow
+		if err := query.ScanRows(rows, &deployment); err != nil {
+			s.logger.Error("Failed to read deployment for export", err)
+			return
+		}
+		if err := export.write(&deployment); err != nil {
+			s.logger.Error("Failed to write deployment export", err)
+			return
+		}
+	}
+	if err := rows.Err(); err != nil {
+		s.logger.Error("Failed to fetch deployments", err)
+		return
+	}
+	if err := export.end(); err != nil {
+		s.logger.Error("Failed to write deployment export", err)
+	}
+}
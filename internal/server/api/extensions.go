@@ -0,0 +1,59 @@
+package api
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/edgetainer/edgetainer/internal/server/extensions"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+)
+
+// SetExtensions sets the registry whose enrollment validators and auth
+// backends the API calls
+func (s *Server) SetExtensions(registry *extensions.Registry) {
+	s.extensions = registry
+}
+
+// extensionUser checks a login with the auth backends. It returns the user,
+// created on its first login, or extensions.ErrUnknownUser if no backend
+// handles it and the built-in users are to be tried.
+func (s *Server) extensionUser(ctx context.Context, username, password string) (*models.User, error) {
+	if s.extensions == nil || !s.extensions.HasAuthBackends() {
+		return nil, extensions.ErrUnknownUser
+	}
+
+	identity, err := s.extensions.Authenticate(ctx, username, password)
+	if err != nil {
+		return nil, err
+	}
+	switch identity.Role {
+	case models.UserRoleAdmin, models.UserRoleOperator, models.UserRoleViewer:
+	case "":
+		identity.Role = models.UserRoleViewer
+	default:
+		return nil, fmt.Errorf("%w: unknown role %q", extensions.ErrRejected, identity.Role)
+	}
+	if identity.Email == "" {
+		identity.Email = identity.Username
+	}
+
+	var user models.User
+	err = s.database.GetDB().Where("username = ?", identity.Username).First(&user).Error
+	if err != nil {
+		user = models.User{Username: identity.Username, Email: identity.Email, Role: identity.Role, HashedPwd: "-"}
+		if err := s.database.GetDB().Create(&user).Error; err != nil {
+			return nil, fmt.Errorf("failed to create user: %w", err)
+		}
+		s.logger.Info(fmt.Sprintf("Created user %s with role %s from an auth backend", user.Username, user.Role))
+		return &user, nil
+	}
+
+	// The backend stays the source of truth for email and role
+	if user.Email != identity.Email || user.Role != identity.Role {
+		user.Email, user.Role = identity.Email, identity.Role
+		if err := s.database.GetDB().Model(&user).Select("Email", "Role").Updates(&user).Error; err != nil {
+			return nil, fmt.Errorf("failed to update user: %w", err)
+		}
+	}
+	return &user, nil
+}
@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"net/http"
 	"path/filepath"
+	"sync"
 
 	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
 )
 
 // handleFleets handles the fleets endpoint
@@ -45,6 +47,40 @@ func (s *Server) handleFleets(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Fleet name is required", http.StatusBadRequest)
 			return
 		}
+		if fleet.TunnelRate < -1 || fleet.PullRate < -1 {
+			http.Error(w, "Rate limits must be -1, 0 or positive", http.StatusBadRequest)
+			return
+		}
+		if fleet.MaxDeploys < -1 {
+			http.Error(w, "max_concurrent_deploys must be -1, 0 or positive", http.StatusBadRequest)
+			return
+		}
+		if !validateTimezone(w, fleet.Timezone, fleet.Locale) {
+			return
+		}
+		if err := validateDeviceIDPrefix(fleet.DeviceIDPrefix); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := protocol.ValidateNTPServers(fleet.NTPServers); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := validateRequiredUSB(fleet.RequiredUSB); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := validateResourcePolicy(fleet.Resources); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Only admins set the forward policy, through /forward-policy,
+		// whether deploys need approval, through /approval, and the freeze,
+		// through /freeze
+		fleet.Forwards = models.ForwardPolicy{}
+		fleet.RequireApproval = false
+		fleet.Freeze = nil
 
 		// Save to the database
 		if err := s.database.GetDB().Create(&fleet).Error; err != nil {
@@ -99,6 +135,35 @@ func (s *Server) handleFleetByID(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Fleet name is required", http.StatusBadRequest)
 			return
 		}
+		if fleet.TunnelRate < -1 || fleet.PullRate < -1 {
+			http.Error(w, "Rate limits must be -1, 0 or positive", http.StatusBadRequest)
+			return
+		}
+		if fleet.MaxDeploys < -1 {
+			http.Error(w, "max_concurrent_deploys must be -1, 0 or positive", http.StatusBadRequest)
+			return
+		}
+		if !validateTimezone(w, fleet.Timezone, fleet.Locale) {
+			return
+		}
+		if err := validateDeviceIDPrefix(fleet.DeviceIDPrefix); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// NTP servers are changed through /ntp, which also applies them
+		fleet.NTPServers = nil
+		// The forward policy is changed by admins through /forward-policy
+		fleet.Forwards = models.ForwardPolicy{}
+		// So is whether deploys need approval, through /approval, and the
+		// freeze, through /freeze
+		fleet.RequireApproval = false
+		fleet.Freeze = nil
+		// Required USB devices are changed through /required-usb, resource
+		// limits through /resource-limits
+		fleet.RequiredUSB = nil
+		fleet.Resources = models.ResourcePolicy{}
+		timezoneChanged := fleet.Timezone != "" || fleet.Locale != ""
 
 		// Update in the database
 		result := s.database.GetDB().Model(&models.Fleet{}).Where("id = ?", fleetID).Updates(fleet)
@@ -117,6 +182,18 @@ func (s *Server) handleFleetByID(w http.ResponseWriter, r *http.Request) {
 		s.database.GetDB().First(&fleet, fleetID)
 		s.database.GetDB().Model(&fleet).Association("Devices").Find(&fleet.Devices)
 
+		// The fleet's tunnel rate limit applies to its connected devices
+		s.sshServer.RefreshRateLimits()
+
+		// So do its timezone and locale, unless a device sets its own
+		if timezoneChanged {
+			deviceIDs := make([]string, 0, len(fleet.Devices))
+			for _, device := range fleet.Devices {
+				deviceIDs = append(deviceIDs, device.DeviceID)
+			}
+			s.applyTimezones(deviceIDs)
+		}
+
 		jsonResponse(w, fleet, http.StatusOK)
 
 	case http.MethodDelete:
@@ -139,3 +216,104 @@ func (s *Server) handleFleetByID(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
+
+// NTPRequest sets the NTP servers of a fleet
+type NTPRequest struct {
+	Servers []string `json:"servers"` // Empty restores the servers of the device operating system
+}
+
+// NTPResult is the outcome of applying NTP servers to one device
+type NTPResult struct {
+	DeviceID string `json:"device_id"`
+	Success  bool   `json:"success"`
+	Message  string `json:"message"`
+}
+
+// NTPResponse reports the NTP servers of a fleet and, after a change, the
+// devices they were applied to
+type NTPResponse struct {
+	Servers []string    `json:"servers"`
+	Devices []NTPResult `json:"devices,omitempty"` // Connected devices only, the others are configured when they connect
+}
+
+// handleFleetNTP handles the NTP servers of a fleet
+func (s *Server) handleFleetNTP(w http.ResponseWriter, r *http.Request) {
+	fleetID := r.PathValue("id")
+
+	var fleet models.Fleet
+	if err := s.database.GetDB().Where("id = ?", fleetID).First(&fleet).Error; err != nil {
+		http.Error(w, "Fleet not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		jsonResponse(w, NTPResponse{Servers: fleet.NTPServers}, http.StatusOK)
+
+	case http.MethodPut:
+		var request NTPRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if err := protocol.ValidateNTPServers(request.Servers); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		fleet.NTPServers = request.Servers
+		if err := s.database.GetDB().Model(&fleet).Select("NTPServers").Updates(&fleet).Error; err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to update NTP servers of fleet %s", fleetID), err)
+			http.Error(w, "Failed to update fleet", http.StatusInternalServerError)
+			return
+		}
+
+		var devices []models.Device
+		if err := s.database.GetDB().Where("fleet_id = ?", fleet.ID).Find(&devices).Error; err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to fetch devices of fleet %s", fleetID), err)
+			http.Error(w, "Failed to fetch devices", http.StatusInternalServerError)
+			return
+		}
+
+		command := protocol.NTPPayload{Servers: request.Servers}
+		var (
+			mu      sync.Mutex
+			wg      sync.WaitGroup
+			results []NTPResult
+		)
+		for _, device := range devices {
+			if _, connected := s.sshServer.GetDeviceConnection(device.DeviceID); !connected {
+				continue
+			}
+
+			wg.Add(1)
+			go func(deviceID string) {
+				defer wg.Done()
+
+				result := NTPResult{DeviceID: deviceID}
+				cmd, err := protocol.NewCommandWithPayload(protocol.CmdConfigureNTP, command)
+				if err == nil {
+					var response *protocol.Response
+					if response, err = s.sshServer.SendCommand(r.Context(), deviceID, cmd); err == nil {
+						result.Success = response.Success
+						result.Message = response.Message
+					}
+				}
+				if err != nil {
+					result.Message = err.Error()
+				}
+
+				mu.Lock()
+				results = append(results, result)
+				mu.Unlock()
+			}(device.DeviceID)
+		}
+		wg.Wait()
+
+		s.logger.Info(fmt.Sprintf("Set NTP servers of fleet %s to %v on %d connected devices", fleetID, request.Servers, len(results)))
+		jsonResponse(w, NTPResponse{Servers: fleet.NTPServers, Devices: results}, http.StatusOK)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,232 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+
+	"github.com/edgetainer/edgetainer/internal/server/ssh"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+)
+
+// ForwardRequest opens a forward to a device
+type ForwardRequest struct {
+	Type    string `json:"type"`    // tcp, udp, unix or dynamic
+	Target  string `json:"target"`  // Device port for tcp, socket path for unix, empty for dynamic
+	Purpose string `json:"purpose"` // terminal, service or manual, manual if empty
+}
+
+// validateForwardPolicy checks a device or fleet forward policy, returning
+// the message for the response if it is invalid
+func validateForwardPolicy(policy models.ForwardPolicy) string {
+	if policy.MaxForwards < -1 {
+		return "max_forwards must be -1, 0 or positive"
+	}
+	if policy.IdleTimeout < -1 {
+		return "idle_timeout must be -1, 0 or positive"
+	}
+	for _, purpose := range policy.Purposes {
+		if !models.IsForwardPurpose(purpose) {
+			return fmt.Sprintf("Unknown forward purpose %q", purpose)
+		}
+	}
+	for _, port := range policy.Ports {
+		if port < 1 || port > 65535 {
+			return fmt.Sprintf("Port %d is out of range", port)
+		}
+	}
+	return ""
+}
+
+// handleDeviceTunnelPolicy handles the tunnel policy of a device, which
+// decides which unix sockets and hosts forwards may reach and how far the
+// Docker API proxy may be used. Changes apply to the open tunnel right away
+// and close forwards that are no longer allowed.
+func (s *Server) handleDeviceTunnelPolicy(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.PathValue("id")
+
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+
+	case http.MethodPut:
+		var policy models.TunnelPolicy
+		if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		for i, path := range policy.UnixSockets {
+			if !filepath.IsAbs(path) {
+				http.Error(w, fmt.Sprintf("Socket path %q is not absolute", path), http.StatusBadRequest)
+				return
+			}
+			policy.UnixSockets[i] = filepath.Clean(path)
+		}
+		switch policy.DockerAPI {
+		case "", models.DockerAPIDisabled, models.DockerAPIReadOnly, models.DockerAPIReadWrite:
+		default:
+			http.Error(w, "Docker API access must be disabled, read-only or read-write", http.StatusBadRequest)
+			return
+		}
+		if policy.DockerSocket != "" {
+			if !filepath.IsAbs(policy.DockerSocket) {
+				http.Error(w, "Docker socket path is not absolute", http.StatusBadRequest)
+				return
+			}
+			policy.DockerSocket = filepath.Clean(policy.DockerSocket)
+		}
+		if message := validateForwardPolicy(policy.Forwards); message != "" {
+			http.Error(w, message, http.StatusBadRequest)
+			return
+		}
+
+		device.TunnelPolicy = policy
+		if err := s.database.GetDB().Model(&device).Select("TunnelPolicy").Updates(&device).Error; err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to set tunnel policy of device %s", deviceID), err)
+			http.Error(w, "Failed to set tunnel policy", http.StatusInternalServerError)
+			return
+		}
+		s.sshServer.RefreshTunnelPolicy(deviceID)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	jsonResponse(w, device.TunnelPolicy, http.StatusOK)
+}
+
+// handleFleetForwardPolicy handles the forward policy of a fleet, which
+// applies to its devices unless their tunnel policy overrides it. Changes
+// apply to open tunnels right away.
+func (s *Server) handleFleetForwardPolicy(w http.ResponseWriter, r *http.Request) {
+	fleetID := r.PathValue("id")
+
+	var fleet models.Fleet
+	if err := s.database.GetDB().Where("id = ?", fleetID).First(&fleet).Error; err != nil {
+		http.Error(w, "Fleet not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+
+	case http.MethodPut:
+		var policy models.ForwardPolicy
+		if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if message := validateForwardPolicy(policy); message != "" {
+			http.Error(w, message, http.StatusBadRequest)
+			return
+		}
+
+		fleet.Forwards = policy
+		if err := s.database.GetDB().Model(&fleet).Select("Forwards").Updates(&fleet).Error; err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to set forward policy of fleet %s", fleetID), err)
+			http.Error(w, "Failed to set forward policy", http.StatusInternalServerError)
+			return
+		}
+
+		var devices []models.Device
+		s.database.GetDB().Where("fleet_id = ?", fleet.ID).Find(&devices)
+		for _, device := range devices {
+			s.sshServer.RefreshTunnelPolicy(device.DeviceID)
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	jsonResponse(w, fleet.Forwards, http.StatusOK)
+}
+
+// handleDeviceForwards lists the open forwards of a device and opens new ones
+func (s *Server) handleDeviceForwards(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.PathValue("id")
+
+	switch r.Method {
+	case http.MethodGet:
+		jsonResponse(w, s.sshServer.Forwards(deviceID), http.StatusOK)
+
+	case http.MethodPost:
+		var req ForwardRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		if req.Purpose == "" {
+			req.Purpose = models.ForwardPurposeManual
+		}
+		if !models.IsForwardPurpose(req.Purpose) || req.Purpose == models.ForwardPurposeDevice {
+			http.Error(w, "Purpose must be terminal, service or manual", http.StatusBadRequest)
+			return
+		}
+
+		forward, opened, err := s.sshServer.OpenForward(deviceID, req.Type, req.Target, req.Purpose)
+		if err != nil {
+			forwardError(w, err)
+			return
+		}
+
+		if !opened {
+			jsonResponse(w, forward, http.StatusOK)
+			return
+		}
+		s.logger.Info(fmt.Sprintf("Opened %s forward on port %d to device %s for %s", forward.Type, forward.Port, deviceID, forward.Purpose))
+		jsonResponse(w, forward, http.StatusCreated)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleDeviceForwardByPort closes a forward of a device
+func (s *Server) handleDeviceForwardByPort(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	port, err := strconv.Atoi(r.PathValue("port"))
+	if err != nil {
+		http.Error(w, "Invalid port", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.sshServer.CloseForward(r.PathValue("id"), port); err != nil {
+		forwardError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// forwardError writes the response for an error of the SSH server's forwards
+func forwardError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ssh.ErrNotConnected):
+		http.Error(w, "Device is not connected", http.StatusConflict)
+	case errors.Is(err, ssh.ErrInvalidForward):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ssh.ErrForwardDenied):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, ssh.ErrForwardNotFound):
+		http.Error(w, "Forward not found", http.StatusNotFound)
+	case errors.Is(err, ssh.ErrForwardLimit):
+		http.Error(w, "Device has reached its forward limit", http.StatusConflict)
+	default:
+		http.Error(w, "Failed to open forward", http.StatusInternalServerError)
+	}
+}
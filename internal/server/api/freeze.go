@@ -0,0 +1,221 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/server/deploy"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/google/uuid"
+)
+
+// overrideHeader carries the reason of an admin overriding a fleet freeze
+const overrideHeader = "X-Edgetainer-Override"
+
+// FreezeRequest represents a request to freeze a fleet
+type FreezeRequest struct {
+	Reason string     `json:"reason"`
+	Until  *time.Time `json:"until,omitempty"` // Frozen until lifted if not set
+}
+
+// FrozenResponse is returned for changes refused because a fleet is frozen
+type FrozenResponse struct {
+	Error   string             `json:"error"`
+	FleetID uuid.UUID          `json:"fleet_id"`
+	Freeze  models.FleetFreeze `json:"freeze"`
+}
+
+// handleFleetFreeze shows, sets and lifts the freeze of a fleet
+func (s *Server) handleFleetFreeze(w http.ResponseWriter, r *http.Request) {
+	fleetID := r.PathValue("id")
+	user, _ := r.Context().Value("user").(models.User)
+
+	var fleet models.Fleet
+	if err := s.database.GetDB().Where("id = ?", fleetID).First(&fleet).Error; err != nil {
+		http.Error(w, "Fleet not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if !fleet.Freeze.Active(time.Now()) {
+			fleet.Freeze = nil
+		}
+
+	case http.MethodPut:
+		var request FreezeRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if request.Reason == "" {
+			http.Error(w, "Reason is required", http.StatusBadRequest)
+			return
+		}
+		if request.Until != nil && !request.Until.After(time.Now()) {
+			http.Error(w, "until must be in the future", http.StatusBadRequest)
+			return
+		}
+
+		fleet.Freeze = &models.FleetFreeze{
+			Reason: request.Reason,
+			By:     user.Username,
+			Since:  time.Now(),
+			Until:  request.Until,
+		}
+		if err := s.database.GetDB().Model(&fleet).Select("Freeze").Updates(&fleet).Error; err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to freeze fleet %s", fleetID), err)
+			http.Error(w, "Failed to freeze fleet", http.StatusInternalServerError)
+			return
+		}
+		data := map[string]interface{}{"fleet_id": fleetID}
+		if request.Until != nil {
+			data["until"] = request.Until.UTC().Format(time.RFC3339)
+		}
+		s.audit(r, models.AuditFleetFreeze, "", request.Reason, data)
+		s.logger.Info(fmt.Sprintf("%s froze fleet %s: %s", user.Username, fleet.Name, request.Reason))
+
+	case http.MethodDelete:
+		if fleet.Freeze == nil {
+			http.Error(w, "Fleet is not frozen", http.StatusConflict)
+			return
+		}
+
+		fleet.Freeze = nil
+		if err := s.database.GetDB().Model(&fleet).Select("Freeze").Updates(&fleet).Error; err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to unfreeze fleet %s", fleetID), err)
+			http.Error(w, "Failed to unfreeze fleet", http.StatusInternalServerError)
+			return
+		}
+		s.audit(r, models.AuditFleetUnfreeze, "", "", map[string]interface{}{"fleet_id": fleetID})
+		s.logger.Info(fmt.Sprintf("%s lifted the freeze of fleet %s", user.Username, fleet.Name))
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	jsonResponse(w, fleet.Freeze, http.StatusOK)
+}
+
+// freezeMiddleware refuses changes to a frozen fleet or its devices, unless
+// an admin overrides the freeze. fleetOf returns the fleet a request is
+// about, nil for none.
+func (s *Server) freezeMiddleware(fleetOf func(r *http.Request) *uuid.UUID, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next(w, r)
+			return
+		}
+
+		fleetID := fleetOf(r)
+		if fleetID == nil {
+			next(w, r)
+			return
+		}
+		var fleet models.Fleet
+		if err := s.database.GetDB().Where("id = ?", *fleetID).First(&fleet).Error; err != nil || !fleet.Freeze.Active(time.Now()) {
+			next(w, r)
+			return
+		}
+
+		ctx, ok := s.overrideFreeze(w, r, &fleet)
+		if !ok {
+			return
+		}
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// overrideFreeze lets an admin act on a frozen fleet if the request gives a
+// reason in the override header, and records that in the audit log.
+// Otherwise it refuses the request and returns false.
+func (s *Server) overrideFreeze(w http.ResponseWriter, r *http.Request, fleet *models.Fleet) (context.Context, bool) {
+	reason := r.Header.Get(overrideHeader)
+	if reason == "" {
+		jsonResponse(w, FrozenResponse{
+			Error:   fmt.Sprintf("Fleet %s is frozen", fleet.Name),
+			FleetID: fleet.ID,
+			Freeze:  *fleet.Freeze,
+		}, http.StatusLocked)
+		return nil, false
+	}
+
+	user, _ := r.Context().Value("user").(models.User)
+	if user.Role != models.UserRoleAdmin {
+		http.Error(w, "Only admins can override a freeze", http.StatusForbidden)
+		return nil, false
+	}
+
+	s.audit(r, models.AuditFreezeOverride, "", reason, map[string]interface{}{
+		"fleet_id": fleet.ID.String(),
+		"method":   r.Method,
+		"path":     r.URL.Path,
+	})
+	s.logger.Warn(fmt.Sprintf("%s overrode the freeze of fleet %s for %s %s: %s", user.Username, fleet.Name, r.Method, r.URL.Path, reason))
+	return deploy.WithOverride(r.Context()), true
+}
+
+// frozenFailed reports a deploy refused by the deploy service because the
+// fleet is frozen, returning false for other errors
+func frozenFailed(w http.ResponseWriter, err error) bool {
+	var frozenErr *deploy.FrozenError
+	if !errors.As(err, &frozenErr) {
+		return false
+	}
+	http.Error(w, frozenErr.Error(), http.StatusLocked)
+	return true
+}
+
+// pathFleet returns the fleet named in the path of a fleet route
+func (s *Server) pathFleet(r *http.Request) *uuid.UUID {
+	value := r.PathValue("id")
+	if value == "" {
+		// Routes registered by prefix, e.g. /api/fleets/{id}
+		value = filepath.Base(r.URL.Path)
+	}
+	fleetID, err := uuid.Parse(value)
+	if err != nil {
+		return nil
+	}
+	return &fleetID
+}
+
+// deviceFleet returns the fleet of the device named in the path of a device
+// route
+func (s *Server) deviceFleet(r *http.Request) *uuid.UUID {
+	deviceID := r.PathValue("id")
+	if deviceID == "" {
+		deviceID = filepath.Base(r.URL.Path)
+	}
+
+	var device models.Device
+	if err := s.database.GetDB().Select("fleet_id").Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		return nil
+	}
+	return device.FleetID
+}
+
+// rolloutFleet returns the fleet of the rollout named in the path
+func (s *Server) rolloutFleet(r *http.Request) *uuid.UUID {
+	var rollout models.Rollout
+	if err := s.database.GetDB().Select("fleet_id").Where("id = ?", r.PathValue("id")).First(&rollout).Error; err != nil {
+		return nil
+	}
+	return &rollout.FleetID
+}
+
+// approvalFleetOf returns the fleet of the deployment approval named in the
+// path
+func (s *Server) approvalFleetOf(r *http.Request) *uuid.UUID {
+	var approval models.DeploymentApproval
+	if err := s.database.GetDB().Select("fleet_id").Where("id = ?", r.PathValue("id")).First(&approval).Error; err != nil {
+		return nil
+	}
+	return &approval.FleetID
+}
@@ -0,0 +1,49 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+)
+
+// HardwareBinding describes the hardware a device is bound to
+type HardwareBinding struct {
+	HardwareID string     `json:"hardware_id,omitempty"` // Empty until the agent attests its hardware
+	BoundAt    *time.Time `json:"bound_at,omitempty"`
+}
+
+// handleDeviceHardwareBinding shows the hardware a device is bound to, and
+// resets the binding so the device binds to the hardware it reports next,
+// e.g. after its mainboard was replaced
+func (s *Server) handleDeviceHardwareBinding(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.PathValue("id")
+
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		jsonResponse(w, HardwareBinding{HardwareID: device.HardwareID, BoundAt: device.HardwareBoundAt}, http.StatusOK)
+
+	case http.MethodDelete:
+		result := s.database.GetDB().Model(&device).Updates(map[string]interface{}{
+			"hardware_id":       "",
+			"hardware_bound_at": nil,
+		})
+		if result.Error != nil {
+			s.logger.Error(fmt.Sprintf("Failed to reset hardware binding of device %s", deviceID), result.Error)
+			http.Error(w, "Failed to reset hardware binding", http.StatusInternalServerError)
+			return
+		}
+		s.logger.Info(fmt.Sprintf("Hardware binding of device %s reset", deviceID))
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,142 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Health check statuses
+const (
+	checkPass = "pass"
+	checkFail = "fail"
+)
+
+// checkTimeout bounds each readiness check, so a hanging dependency cannot
+// stall the probe
+const checkTimeout = 2 * time.Second
+
+// HealthCheck is the result of a single readiness check
+type HealthCheck struct {
+	Status     string                 `json:"status"`
+	Message    string                 `json:"message,omitempty"`
+	DurationMs int64                  `json:"duration_ms"`
+	Details    map[string]interface{} `json:"details,omitempty"`
+}
+
+// HealthResponse is the result of a liveness or readiness probe
+type HealthResponse struct {
+	Status string                 `json:"status"`
+	Time   string                 `json:"time"`
+	Checks map[string]HealthCheck `json:"checks,omitempty"`
+}
+
+// SetDraining makes the readiness probe fail once draining is set, so load
+// balancers stop sending requests and devices before the server stops
+func (s *Server) SetDraining(draining *atomic.Bool) {
+	s.draining = draining
+}
+
+// handleHealthLive reports whether the server process is running. It does
+// not check dependencies, so a database outage does not restart the server.
+func (s *Server) handleHealthLive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	response := HealthResponse{Status: checkPass, Time: time.Now().Format(time.RFC3339)}
+	if s.ctx.Err() != nil {
+		response.Status = checkFail
+		jsonResponse(w, response, http.StatusServiceUnavailable)
+		return
+	}
+
+	jsonResponse(w, response, http.StatusOK)
+}
+
+// handleHealthReady reports whether the server can serve devices and users,
+// with the result of every dependency check
+func (s *Server) handleHealthReady(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	checks := map[string]func(ctx context.Context) HealthCheck{
+		"database": s.checkDatabase,
+		"ssh":      s.checkSSHListener,
+		"ports":    s.checkPortPool,
+	}
+	if s.draining != nil {
+		checks["shutdown"] = s.checkShutdown
+	}
+
+	response := HealthResponse{
+		Status: checkPass,
+		Time:   time.Now().Format(time.RFC3339),
+		Checks: make(map[string]HealthCheck, len(checks)),
+	}
+
+	for name, check := range checks {
+		ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+		start := time.Now()
+		result := check(ctx)
+		cancel()
+
+		result.DurationMs = time.Since(start).Milliseconds()
+		if result.Status != checkPass {
+			response.Status = checkFail
+		}
+		response.Checks[name] = result
+	}
+
+	status := http.StatusOK
+	if response.Status != checkPass {
+		status = http.StatusServiceUnavailable
+	}
+	jsonResponse(w, response, status)
+}
+
+// checkDatabase verifies that the database answers
+func (s *Server) checkDatabase(ctx context.Context) HealthCheck {
+	if err := s.database.Ping(ctx); err != nil {
+		return HealthCheck{Status: checkFail, Message: err.Error()}
+	}
+	return HealthCheck{Status: checkPass}
+}
+
+// checkSSHListener verifies that devices can connect
+func (s *Server) checkSSHListener(ctx context.Context) HealthCheck {
+	if !s.sshServer.Listening() {
+		return HealthCheck{Status: checkFail, Message: "SSH server is not accepting connections"}
+	}
+	return HealthCheck{
+		Status:  checkPass,
+		Details: map[string]interface{}{"connected_devices": s.sshServer.ConnectionCount()},
+	}
+}
+
+// checkShutdown fails once the server is draining before it stops
+func (s *Server) checkShutdown(ctx context.Context) HealthCheck {
+	if s.draining.Load() {
+		return HealthCheck{Status: checkFail, Message: "server is shutting down"}
+	}
+	return HealthCheck{Status: checkPass}
+}
+
+// checkPortPool verifies that tunnel ports are left for new forwards
+func (s *Server) checkPortPool(ctx context.Context) HealthCheck {
+	used, total := s.sshServer.PortUsage()
+	result := HealthCheck{
+		Status:  checkPass,
+		Details: map[string]interface{}{"used": used, "total": total, "free": total - used},
+	}
+	if used >= total {
+		result.Status = checkFail
+		result.Message = fmt.Sprintf("all %d tunnel ports are in use", total)
+	}
+	return result
+}
@@ -0,0 +1,70 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+// HostServiceRestartResponse is the outcome of restarting a host service
+type HostServiceRestartResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+}
+
+// handleDeviceHostServiceRestart restarts a monitored systemd unit of a device,
+// e.g. after a service_down alert. The agent only restarts the units it
+// monitors, and only if its configuration allows it.
+func (s *Server) handleDeviceHostServiceRestart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, _ := r.Context().Value("user").(models.User)
+	if user.Role != models.UserRoleAdmin && user.Role != models.UserRoleOperator {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	deviceID := r.PathValue("id")
+	payload := protocol.RestartHostServicePayload{Name: r.PathValue("service")}
+	if err := payload.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	if _, connected := s.sshServer.GetDeviceConnection(deviceID); !connected {
+		http.Error(w, "Device is not connected", http.StatusConflict)
+		return
+	}
+	if !protocol.HasFeature(device.AgentFeatures, protocol.FeatureHostServices) {
+		http.Error(w, fmt.Sprintf("Agent version %s does not support host services", device.AgentVersion), http.StatusConflict)
+		return
+	}
+
+	command, err := protocol.NewCommandWithPayload(protocol.CmdRestartHostService, payload)
+	if err != nil {
+		s.logger.Error("Failed to build service restart command", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	s.audit(r, models.AuditHostServiceRestart, deviceID, "", map[string]interface{}{"service": payload.Name})
+
+	response, err := s.sshServer.SendCommand(r.Context(), deviceID, command)
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to restart %s on device %s", payload.Name, deviceID), err)
+		http.Error(w, "Failed to restart service", http.StatusBadGateway)
+		return
+	}
+
+	jsonResponse(w, HostServiceRestartResponse{Success: response.Success, Message: response.Message}, http.StatusOK)
+}
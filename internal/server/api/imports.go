@@ -0,0 +1,326 @@
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/server/importer"
+	"github.com/edgetainer/edgetainer/internal/server/provisioning"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"gopkg.in/yaml.v3"
+	"gorm.io/gorm"
+)
+
+// maxImportSize caps the exports uploaded to /api/imports
+const maxImportSize = 64 << 20
+
+// importAgentConfig is the agent configuration in the migration bundle, the
+// agent defaults the rest
+type importAgentConfig struct {
+	Device struct {
+		ID   string `yaml:"id"`
+		Name string `yaml:"name"`
+	} `yaml:"device"`
+	Server struct {
+		Host string `yaml:"host"`
+		Port int    `yaml:"port"`
+	} `yaml:"server"`
+	SSH struct {
+		Port int    `yaml:"port"`
+		Key  string `yaml:"key"`
+	} `yaml:"ssh"`
+}
+
+// handleImports imports the export of another platform, or lists the imports
+func (s *Server) handleImports(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		imports := []models.Import{}
+		if err := s.database.GetDB().Order("created_at DESC").Find(&imports).Error; err != nil {
+			s.logger.Error("Failed to fetch imports", err)
+			http.Error(w, "Failed to fetch imports", http.StatusInternalServerError)
+			return
+		}
+		jsonResponse(w, imports, http.StatusOK)
+
+	case http.MethodPost:
+		source := r.URL.Query().Get("source")
+		dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+
+		data, err := io.ReadAll(io.LimitReader(r.Body, maxImportSize+1))
+		if err != nil {
+			http.Error(w, "Failed to read export", http.StatusBadRequest)
+			return
+		}
+		if len(data) > maxImportSize {
+			http.Error(w, fmt.Sprintf("Export is larger than %d MB", maxImportSize>>20), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		export, err := importer.Parse(source, data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !s.checkImportCredentials(w, r, export) {
+			return
+		}
+
+		user, _ := r.Context().Value("user").(models.User)
+		_, _, sshPort := s.provisioningTarget(r.Context())
+		result, err := importer.Apply(r.Context(), s.database, export, importer.Options{
+			DryRun:        dryRun,
+			FleetDefaults: true,
+			UniqueNames:   s.uniqueNames,
+			KeyType:       s.deviceKeyType,
+			KeyBits:       s.deviceKeyBits,
+			SSHPort:       sshPort,
+			ImportedBy:    user.Username,
+		})
+		if err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to import %s export", source), err)
+			http.Error(w, "Failed to import export", http.StatusInternalServerError)
+			return
+		}
+
+		if dryRun {
+			jsonResponse(w, result, http.StatusOK)
+			return
+		}
+
+		s.audit(r, models.AuditImport, "", "", map[string]interface{}{
+			"import_id": result.ImportID,
+			"source":    source,
+			"fleets":    len(result.Fleets),
+			"software":  len(result.Software),
+			"devices":   len(result.Devices),
+		})
+		s.logger.Info(fmt.Sprintf("Imported %d devices from %s as import %s", len(result.Devices), source, result.ImportID))
+		jsonResponse(w, result, http.StatusCreated)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// checkImportCredentials applies the secret scan policy to the compose
+// files and env vars of an export
+func (s *Server) checkImportCredentials(w http.ResponseWriter, r *http.Request, export *importer.Export) bool {
+	for _, software := range export.Software {
+		findings, err := scanUpload(software.ComposeYAML, nil, "")
+		if err != nil {
+			// Invalid compose files are imported without deployments
+			continue
+		}
+		if !s.checkCredentials(w, r, "Software "+software.Name, findings) {
+			return false
+		}
+	}
+	for _, fleet := range export.Fleets {
+		findings, _ := scanUpload("", fleet.EnvVars, "env_vars")
+		if !s.checkCredentials(w, r, "Env vars of fleet "+fleet.Name, findings) {
+			return false
+		}
+	}
+	for _, device := range export.Devices {
+		for _, envVars := range device.EnvVars {
+			findings, _ := scanUpload("", envVars, "env_vars")
+			if !s.checkCredentials(w, r, "Env vars of device "+device.Name, findings) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// handleImportByID returns an import with its devices
+func (s *Server) handleImportByID(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	record, ok := s.importByID(w, r)
+	if !ok {
+		return
+	}
+
+	devices := []models.ImportedDevice{}
+	if err := s.database.GetDB().Where("import_id = ?", record.ID).Order("created_at").Find(&devices).Error; err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to fetch devices of import %s", record.ID), err)
+		http.Error(w, "Failed to fetch devices of import", http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse(w, map[string]interface{}{
+		"import":  record,
+		"devices": devices,
+	}, http.StatusOK)
+}
+
+// importByID loads the import in the path. It writes the error response and
+// returns false if there is none.
+func (s *Server) importByID(w http.ResponseWriter, r *http.Request) (*models.Import, bool) {
+	var record models.Import
+	err := s.database.GetDB().Where("id = ?", r.PathValue("id")).First(&record).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "Import not found", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to fetch import %s", r.PathValue("id")), err)
+		http.Error(w, "Failed to fetch import", http.StatusInternalServerError)
+		return nil, false
+	}
+	return &record, true
+}
+
+// handleImportBundle returns the migration bundle of an import: a zip with
+// the agent configuration, key and Butane config of every device, and a
+// list mapping the devices of the source platform to theirs
+func (s *Server) handleImportBundle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	record, ok := s.importByID(w, r)
+	if !ok {
+		return
+	}
+	if record.KeysDeletedAt != nil {
+		http.Error(w, "The device keys of the import were deleted", http.StatusGone)
+		return
+	}
+
+	var linked []models.ImportedDevice
+	if err := s.database.GetDB().Where("import_id = ?", record.ID).Order("created_at").Find(&linked).Error; err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to fetch devices of import %s", record.ID), err)
+		http.Error(w, "Failed to fetch devices of import", http.StatusInternalServerError)
+		return
+	}
+
+	serverHost, serverPort, sshPort := s.provisioningTarget(r.Context())
+
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	var list bytes.Buffer
+	table := csv.NewWriter(&list)
+	table.Write([]string{"source_id", "source_name", "device_id", "name"})
+
+	for _, link := range linked {
+		var device models.Device
+		if err := s.database.GetDB().Where("id = ?", link.DeviceID).First(&device).Error; err != nil {
+			// Deleted since the import
+			continue
+		}
+		table.Write([]string{link.SourceID, link.SourceName, device.DeviceID, device.Name})
+
+		var agentConfig importAgentConfig
+		agentConfig.Device.ID = device.DeviceID
+		agentConfig.Device.Name = device.Name
+		agentConfig.Server.Host = serverHost
+		agentConfig.Server.Port = serverPort
+		agentConfig.SSH.Port = sshPort
+		agentConfig.SSH.Key = "/app/ssh/id_rsa"
+		agentYAML, _ := yaml.Marshal(agentConfig)
+
+		butaneConfig, err := provisioning.RenderButaneTemplate(butaneTemplatePath(), &provisioning.TemplateData{
+			DeviceID:      device.DeviceID,
+			SSHPrivateKey: link.SSHPrivateKey,
+			ServerHost:    serverHost,
+			ServerPort:    serverPort,
+			SSHPort:       sshPort,
+		})
+		if err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to render butane template for device %s", device.DeviceID), err)
+			http.Error(w, "Failed to render butane template", http.StatusInternalServerError)
+			return
+		}
+
+		files := []struct {
+			name    string
+			content string
+		}{
+			{"agent-config.yaml", string(agentYAML)},
+			{"id_rsa", link.SSHPrivateKey},
+			{"config.bu", butaneConfig},
+		}
+		for _, file := range files {
+			header := &zip.FileHeader{Name: device.DeviceID + "/" + file.name, Method: zip.Deflate, Modified: time.Now()}
+			header.SetMode(0600)
+			writer, err := archive.CreateHeader(header)
+			if err == nil {
+				_, err = writer.Write([]byte(file.content))
+			}
+			if err != nil {
+				s.logger.Error(fmt.Sprintf("Failed to write bundle of import %s", record.ID), err)
+				http.Error(w, "Failed to write bundle", http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	table.Flush()
+	writer, err := archive.Create("devices.csv")
+	if err == nil {
+		_, err = writer.Write(list.Bytes())
+	}
+	if err == nil {
+		err = archive.Close()
+	}
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to write bundle of import %s", record.ID), err)
+		http.Error(w, "Failed to write bundle", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "import-"+record.ID.String()+".zip"))
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+// handleImportKeys deletes the device keys of an import once its devices
+// are migrated, after which the bundle can no longer be downloaded
+func (s *Server) handleImportKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	record, ok := s.importByID(w, r)
+	if !ok {
+		return
+	}
+	if record.KeysDeletedAt != nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	now := time.Now()
+	err := s.database.GetDB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.ImportedDevice{}).Where("import_id = ?", record.ID).
+			Update("ssh_private_key", "").Error; err != nil {
+			return err
+		}
+		return tx.Model(record).Update("keys_deleted_at", now).Error
+	})
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to delete keys of import %s", record.ID), err)
+		http.Error(w, "Failed to delete keys", http.StatusInternalServerError)
+		return
+	}
+
+	s.audit(r, models.AuditImportKeysDelete, "", "", map[string]interface{}{
+		"import_id": record.ID,
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,448 @@
+package api
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/server/db"
+	"github.com/edgetainer/edgetainer/internal/server/extensions"
+	serverMail "github.com/edgetainer/edgetainer/internal/server/mail"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// InvitationRequest invites someone to become a user
+type InvitationRequest struct {
+	Email string `json:"email"`
+	Role  string `json:"role"` // admin, operator or viewer
+}
+
+// InvitationPreview is what the link of an invitation grants, shown before
+// it is accepted
+type InvitationPreview struct {
+	Email        string    `json:"email"`
+	Role         string    `json:"role"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	AuthBackends bool      `json:"auth_backends"` // The invitee may sign in through an auth backend instead of setting a password
+}
+
+// AcceptInvitationRequest accepts an invitation, either with the username
+// and password of a new user or, with link, by signing in through an auth
+// backend
+type AcceptInvitationRequest struct {
+	Token    string `json:"token"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Link     bool   `json:"link"`
+}
+
+// SetMailer sets how invitations are sent and how long their links can be
+// used. Without a mailer nobody can be invited.
+func (s *Server) SetMailer(mailer *serverMail.Sender, inviteExpiry time.Duration) {
+	s.mailer = mailer
+	s.inviteTTL = inviteExpiry
+}
+
+// handleInvitations lists invitations and invites someone by email
+func (s *Server) handleInvitations(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		query := s.database.GetDB().Order("created_at DESC")
+		switch status := r.URL.Query().Get("status"); status {
+		case "":
+		case models.InvitationStatusExpired:
+			query = query.Where("status = ? AND expires_at <= ?", models.InvitationStatusPending, time.Now())
+		case models.InvitationStatusPending:
+			query = query.Where("status = ? AND expires_at > ?", status, time.Now())
+		default:
+			query = query.Where("status = ?", status)
+		}
+		var invitations []models.Invitation
+		if err := query.Find(&invitations).Error; err != nil {
+			s.logger.Error("Failed to list invitations", err)
+			http.Error(w, "Failed to list invitations", http.StatusInternalServerError)
+			return
+		}
+		for i := range invitations {
+			showExpiry(&invitations[i])
+		}
+		jsonResponse(w, invitations, http.StatusOK)
+
+	case http.MethodPost:
+		if s.mailer == nil {
+			http.Error(w, "Invitations need an SMTP server, set smtp.host in the server configuration", http.StatusServiceUnavailable)
+			return
+		}
+		var request InvitationRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		address, err := mail.ParseAddress(request.Email)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid email address %q", request.Email), http.StatusBadRequest)
+			return
+		}
+		switch request.Role {
+		case models.UserRoleAdmin, models.UserRoleOperator, models.UserRoleViewer:
+		default:
+			http.Error(w, fmt.Sprintf("Unknown role %q, use admin, operator or viewer", request.Role), http.StatusBadRequest)
+			return
+		}
+
+		var existing int64
+		if err := s.database.GetDB().Model(&models.User{}).Where("LOWER(email) = LOWER(?)", address.Address).Count(&existing).Error; err != nil {
+			s.logger.Error("Failed to check users", err)
+			http.Error(w, "Failed to create invitation", http.StatusInternalServerError)
+			return
+		}
+		if existing > 0 {
+			http.Error(w, "A user with this email address exists", http.StatusConflict)
+			return
+		}
+		if err := s.database.GetDB().Model(&models.Invitation{}).
+			Where("LOWER(email) = LOWER(?) AND status = ? AND expires_at > ?", address.Address, models.InvitationStatusPending, time.Now()).
+			Count(&existing).Error; err != nil {
+			s.logger.Error("Failed to check invitations", err)
+			http.Error(w, "Failed to create invitation", http.StatusInternalServerError)
+			return
+		}
+		if existing > 0 {
+			http.Error(w, "This email address was already invited, resend or revoke the invitation", http.StatusConflict)
+			return
+		}
+
+		user, _ := r.Context().Value("user").(models.User)
+		invitation := models.Invitation{
+			Email:     address.Address,
+			Role:      request.Role,
+			LinkKey:   generateAuthToken(),
+			Status:    models.InvitationStatusPending,
+			InvitedBy: user.Username,
+			SentAt:    time.Now(),
+			ExpiresAt: time.Now().Add(s.inviteTTL).Truncate(time.Second),
+		}
+		if err := s.database.GetDB().Create(&invitation).Error; err != nil {
+			s.logger.Error("Failed to create invitation", err)
+			http.Error(w, "Failed to create invitation", http.StatusInternalServerError)
+			return
+		}
+
+		// An invitation that could not be sent is of no use
+		if err := s.sendInvitation(r, &invitation); err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to send invitation to %s", invitation.Email), err)
+			if dbErr := s.database.GetDB().Delete(&invitation).Error; dbErr != nil {
+				s.logger.Error(fmt.Sprintf("Failed to remove invitation %s", invitation.ID), dbErr)
+			}
+			http.Error(w, fmt.Sprintf("Failed to send the invitation: %v", err), http.StatusBadGateway)
+			return
+		}
+
+		s.audit(r, models.AuditInvitationCreate, "", "", map[string]interface{}{
+			"invitation_id": invitation.ID.String(),
+			"email":         invitation.Email,
+			"role":          invitation.Role,
+		})
+		jsonResponse(w, invitation, http.StatusCreated)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleInvitationByID shows and revokes an invitation
+func (s *Server) handleInvitationByID(w http.ResponseWriter, r *http.Request) {
+	invitation, ok := s.pathInvitation(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		showExpiry(invitation)
+		jsonResponse(w, invitation, http.StatusOK)
+
+	case http.MethodDelete:
+		if invitation.Status != models.InvitationStatusPending {
+			http.Error(w, fmt.Sprintf("Invitation is %s", invitation.Status), http.StatusConflict)
+			return
+		}
+		result := s.database.GetDB().Model(invitation).
+			Where("status = ?", models.InvitationStatusPending).
+			Update("status", models.InvitationStatusRevoked)
+		if result.Error != nil {
+			s.logger.Error("Failed to revoke invitation", result.Error)
+			http.Error(w, "Failed to revoke invitation", http.StatusInternalServerError)
+			return
+		}
+		if result.RowsAffected == 0 {
+			http.Error(w, "Invitation was accepted meanwhile", http.StatusConflict)
+			return
+		}
+		s.audit(r, models.AuditInvitationRevoke, "", "", map[string]interface{}{
+			"invitation_id": invitation.ID.String(),
+			"email":         invitation.Email,
+		})
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleInvitationResend sends a pending or expired invitation again with a
+// new link valid for the full time. The link sent before stops working.
+func (s *Server) handleInvitationResend(w http.ResponseWriter, r *http.Request) {
+	invitation, ok := s.pathInvitation(w, r)
+	if !ok {
+		return
+	}
+	if s.mailer == nil {
+		http.Error(w, "Invitations need an SMTP server, set smtp.host in the server configuration", http.StatusServiceUnavailable)
+		return
+	}
+	if invitation.Status != models.InvitationStatusPending {
+		http.Error(w, fmt.Sprintf("Invitation is %s", invitation.Status), http.StatusConflict)
+		return
+	}
+
+	previousKey := invitation.LinkKey
+	invitation.LinkKey = generateAuthToken()
+	invitation.SentAt = time.Now()
+	invitation.ExpiresAt = time.Now().Add(s.inviteTTL).Truncate(time.Second)
+	// The new key is saved first, a link that cannot be accepted must not
+	// be sent
+	result := s.database.GetDB().Model(invitation).
+		Where("status = ? AND link_key = ?", models.InvitationStatusPending, previousKey).
+		Select("link_key", "sent_at", "expires_at").Updates(invitation)
+	if result.Error != nil {
+		s.logger.Error("Failed to update invitation", result.Error)
+		http.Error(w, "Failed to resend invitation", http.StatusInternalServerError)
+		return
+	}
+	if result.RowsAffected == 0 {
+		http.Error(w, "Invitation was accepted, revoked or sent again meanwhile", http.StatusConflict)
+		return
+	}
+
+	if err := s.sendInvitation(r, invitation); err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to send invitation to %s", invitation.Email), err)
+		http.Error(w, fmt.Sprintf("Failed to send the invitation: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	s.audit(r, models.AuditInvitationResend, "", "", map[string]interface{}{
+		"invitation_id": invitation.ID.String(),
+		"email":         invitation.Email,
+	})
+	jsonResponse(w, invitation, http.StatusOK)
+}
+
+// handleInvitationAccept shows what the link of an invitation grants and
+// accepts it, logging the new user in. It needs no login, the signed token
+// of the link stands for the invitee.
+func (s *Server) handleInvitationAccept(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		invitation, status, message := s.verifyInvitation(r.URL.Query().Get("token"))
+		if invitation == nil {
+			http.Error(w, message, status)
+			return
+		}
+		jsonResponse(w, InvitationPreview{
+			Email:        invitation.Email,
+			Role:         invitation.Role,
+			ExpiresAt:    invitation.ExpiresAt,
+			AuthBackends: s.extensions != nil && s.extensions.HasAuthBackends(),
+		}, http.StatusOK)
+
+	case http.MethodPost:
+		var request AcceptInvitationRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		invitation, status, message := s.verifyInvitation(request.Token)
+		if invitation == nil {
+			http.Error(w, message, status)
+			return
+		}
+
+		var user models.User
+		if request.Link {
+			// The auth backend stays the source of truth for the role of
+			// its users
+			backendUser, err := s.extensionUser(r.Context(), request.Username, request.Password)
+			switch {
+			case err == nil:
+				user = *backendUser
+			case errors.Is(err, extensions.ErrUnknownUser):
+				http.Error(w, "No auth backend knows these credentials", http.StatusUnauthorized)
+				return
+			case errors.Is(err, extensions.ErrRejected):
+				s.logger.Info(fmt.Sprintf("Invitation %s not linked to %s: %v", invitation.ID, request.Username, err))
+				http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+				return
+			default:
+				s.logger.Error(fmt.Sprintf("Failed to check %s with the auth backends", request.Username), err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+		} else {
+			request.Username = strings.TrimSpace(request.Username)
+			if request.Username == "" {
+				http.Error(w, "Username is required", http.StatusBadRequest)
+				return
+			}
+			if len(request.Password) < 8 {
+				http.Error(w, "Password must be at least 8 characters", http.StatusBadRequest)
+				return
+			}
+			hashed, err := db.HashPassword(request.Password)
+			if err != nil {
+				s.logger.Error("Failed to hash password", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			user = models.User{
+				Username:  request.Username,
+				Email:     invitation.Email,
+				HashedPwd: hashed,
+				Role:      invitation.Role,
+			}
+		}
+
+		err := s.database.AcceptInvitation(r.Context(), invitation.ID, &user)
+		switch {
+		case errors.Is(err, db.ErrInvitationUsed):
+			http.Error(w, "Invitation was accepted, revoked or has expired", http.StatusGone)
+			return
+		case errors.Is(err, db.ErrUserExists):
+			http.Error(w, "Username or email address is taken", http.StatusConflict)
+			return
+		case err != nil:
+			s.logger.Error("Failed to accept invitation", err)
+			http.Error(w, "Failed to accept invitation", http.StatusInternalServerError)
+			return
+		}
+
+		s.logger.Info(fmt.Sprintf("User %s with role %s joined through the invitation of %s", user.Username, user.Role, invitation.InvitedBy))
+		r = r.WithContext(context.WithValue(r.Context(), "user", user))
+		s.audit(r, models.AuditInvitationAccept, "", "", map[string]interface{}{
+			"invitation_id": invitation.ID.String(),
+			"email":         invitation.Email,
+			"role":          user.Role,
+			"linked":        request.Link,
+		})
+		s.respondLogin(w, r, user, http.StatusCreated)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// pathInvitation loads the invitation in the path, responding if it cannot
+func (s *Server) pathInvitation(w http.ResponseWriter, r *http.Request) (*models.Invitation, bool) {
+	id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid invitation ID", http.StatusBadRequest)
+		return nil, false
+	}
+	var invitation models.Invitation
+	if err := s.database.GetDB().Where("id = ?", id).First(&invitation).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, "Invitation not found", http.StatusNotFound)
+		} else {
+			s.logger.Error("Failed to load invitation", err)
+			http.Error(w, "Failed to load invitation", http.StatusInternalServerError)
+		}
+		return nil, false
+	}
+	return &invitation, true
+}
+
+// verifyInvitation returns the pending invitation a link token is for, or
+// the status and message to respond with if it is not valid
+func (s *Server) verifyInvitation(token string) (*models.Invitation, int, string) {
+	idPart, signature, found := strings.Cut(token, ".")
+	id, err := uuid.Parse(idPart)
+	if !found || err != nil {
+		return nil, http.StatusBadRequest, "Invalid invitation token"
+	}
+
+	var invitation models.Invitation
+	if err := s.database.GetDB().Where("id = ?", id).First(&invitation).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, http.StatusNotFound, "Invitation not found"
+		}
+		s.logger.Error("Failed to load invitation", err)
+		return nil, http.StatusInternalServerError, "Failed to load invitation"
+	}
+	if !hmac.Equal([]byte(signature), []byte(inviteSignature(&invitation))) {
+		// Also the link of an invitation that was sent again
+		return nil, http.StatusNotFound, "Invitation not found"
+	}
+	if invitation.Status != models.InvitationStatusPending || !time.Now().Before(invitation.ExpiresAt) {
+		return nil, http.StatusGone, "Invitation was accepted, revoked or has expired"
+	}
+	return &invitation, 0, ""
+}
+
+// sendInvitation emails the link of an invitation to the invitee
+func (s *Server) sendInvitation(r *http.Request, invitation *models.Invitation) error {
+	settings, err := s.database.ServerSettings(r.Context())
+	if err != nil {
+		return err
+	}
+	if settings.ServerURL == "" {
+		return fmt.Errorf("the server URL is not set, set it in the server settings")
+	}
+	link := settings.ServerURL + "/invite?token=" + url.QueryEscape(inviteToken(invitation))
+
+	inviter := invitation.InvitedBy
+	if inviter == "" {
+		inviter = "an administrator"
+	}
+	body := fmt.Sprintf(`You have been invited by %s to manage devices with Edgetainer at %s, with the role %s.
+
+Choose your username and password, or sign in with your company account if offered, at:
+
+%s
+
+The link can be used once, until %s. If you did not expect this invitation, you can ignore this email.
+`, inviter, settings.ServerURL, invitation.Role, link, invitation.ExpiresAt.UTC().Format(time.RFC1123))
+
+	return s.mailer.Send(r.Context(), invitation.Email, "You have been invited to Edgetainer", body)
+}
+
+// inviteToken returns the token of the link of an invitation: its ID and a
+// signature over what it grants, so a link cannot be altered and stops
+// working once the invitation is sent again
+func inviteToken(invitation *models.Invitation) string {
+	return invitation.ID.String() + "." + inviteSignature(invitation)
+}
+
+// inviteSignature signs an invitation with its key
+func inviteSignature(invitation *models.Invitation) string {
+	mac := hmac.New(sha256.New, []byte(invitation.LinkKey))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%d", invitation.ID, strings.ToLower(invitation.Email), invitation.Role, invitation.ExpiresAt.Unix())
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// showExpiry shows a pending invitation past its time as expired
+func showExpiry(invitation *models.Invitation) {
+	if invitation.Status == models.InvitationStatusPending && !time.Now().Before(invitation.ExpiresAt) {
+		invitation.Status = models.InvitationStatusExpired
+	}
+}
@@ -0,0 +1,124 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/server/jobs"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/google/uuid"
+)
+
+// SetJobQueue sets the queue long-running operations are run on
+func (s *Server) SetJobQueue(queue *jobs.Queue) {
+	s.jobs = queue
+}
+
+// enqueue starts a job for the user of a request and answers with it
+func (s *Server) enqueue(w http.ResponseWriter, r *http.Request, jobType string, payload interface{}) {
+	user, _ := r.Context().Value("user").(models.User)
+
+	job, err := s.jobs.Enqueue(r.Context(), jobType, payload, time.Time{}, user.Username)
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to start %s job", jobType), err)
+		http.Error(w, "Failed to start job", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", "/api/jobs/"+job.ID.String())
+	jsonResponse(w, job, http.StatusAccepted)
+}
+
+// handleJobs lists jobs, newest first, optionally by status and type
+func (s *Server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= 1000 {
+		limit = l
+	}
+
+	query := s.database.GetDB()
+	if status := r.URL.Query().Get("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if jobType := r.URL.Query().Get("type"); jobType != "" {
+		query = query.Where("type = ?", jobType)
+	}
+
+	var list []models.Job
+	if err := query.Order("created_at DESC").Limit(limit).Find(&list).Error; err != nil {
+		s.logger.Error("Failed to fetch jobs", err)
+		http.Error(w, "Failed to fetch jobs", http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse(w, list, http.StatusOK)
+}
+
+// handleJobByID returns a job, including its result once it finished
+func (s *Server) handleJobByID(w http.ResponseWriter, r *http.Request) {
+	jobID, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	job, err := s.jobs.Get(r.Context(), jobID)
+	if err != nil {
+		s.jobError(w, jobID, "fetch", err)
+		return
+	}
+
+	jsonResponse(w, job, http.StatusOK)
+}
+
+// handleJobCancel cancels a queued or running job
+func (s *Server) handleJobCancel(w http.ResponseWriter, r *http.Request) {
+	jobID, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	job, err := s.jobs.Cancel(r.Context(), jobID)
+	if err != nil {
+		s.jobError(w, jobID, "cancel", err)
+		return
+	}
+
+	jsonResponse(w, job, http.StatusOK)
+}
+
+// handleJobRetry queues a failed or cancelled job again
+func (s *Server) handleJobRetry(w http.ResponseWriter, r *http.Request) {
+	jobID, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	job, err := s.jobs.Retry(r.Context(), jobID)
+	if err != nil {
+		s.jobError(w, jobID, "retry", err)
+		return
+	}
+
+	jsonResponse(w, job, http.StatusOK)
+}
+
+// jobError answers a request for a job that failed
+func (s *Server) jobError(w http.ResponseWriter, jobID uuid.UUID, action string, err error) {
+	switch {
+	case errors.Is(err, jobs.ErrNotFound):
+		http.Error(w, "Job not found", http.StatusNotFound)
+	case errors.Is(err, jobs.ErrFinished) && action == "retry":
+		http.Error(w, "Job has not failed", http.StatusConflict)
+	case errors.Is(err, jobs.ErrFinished):
+		http.Error(w, "Job already finished", http.StatusConflict)
+	default:
+		s.logger.Error(fmt.Sprintf("Failed to %s job %s", action, jobID), err)
+		http.Error(w, fmt.Sprintf("Failed to %s job", action), http.StatusInternalServerError)
+	}
+}
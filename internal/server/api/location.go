@@ -0,0 +1,173 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+	"gorm.io/gorm"
+)
+
+// LocationRequest sets the manual location of a device
+type LocationRequest struct {
+	Latitude  *float64 `json:"latitude"`
+	Longitude *float64 `json:"longitude"`
+	Address   string   `json:"address"`
+}
+
+// DeviceLocation is the location of a device
+type DeviceLocation struct {
+	DeviceID  string     `json:"device_id"`
+	Latitude  *float64   `json:"latitude"`
+	Longitude *float64   `json:"longitude"`
+	Address   string     `json:"address"`
+	Source    string     `json:"source"`             // manual, gps or geoip, empty without a location
+	Accuracy  float64    `json:"accuracy,omitempty"` // Horizontal error in meters, 0 if unknown
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// boundingBox is an area of the map, minLon may exceed maxLon for a box
+// crossing the antimeridian
+type boundingBox struct {
+	minLon, minLat, maxLon, maxLat float64
+}
+
+// parseBoundingBox parses minLon,minLat,maxLon,maxLat, the order used by
+// GeoJSON and most map libraries
+func parseBoundingBox(value string) (*boundingBox, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("bbox must be minLon,minLat,maxLon,maxLat")
+	}
+
+	var coords [4]float64
+	for i, part := range parts {
+		coord, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, fmt.Errorf("bbox must be minLon,minLat,maxLon,maxLat")
+		}
+		coords[i] = coord
+	}
+
+	box := &boundingBox{minLon: coords[0], minLat: coords[1], maxLon: coords[2], maxLat: coords[3]}
+	if err := protocol.ValidateCoordinates(box.minLat, box.minLon); err != nil {
+		return nil, fmt.Errorf("bbox: %w", err)
+	}
+	if err := protocol.ValidateCoordinates(box.maxLat, box.maxLon); err != nil {
+		return nil, fmt.Errorf("bbox: %w", err)
+	}
+	if box.minLat > box.maxLat {
+		return nil, fmt.Errorf("bbox minimum latitude is above the maximum")
+	}
+	return box, nil
+}
+
+// apply restricts a device query to the box
+func (b *boundingBox) apply(query *gorm.DB) *gorm.DB {
+	query = query.Where("latitude BETWEEN ? AND ?", b.minLat, b.maxLat)
+	if b.minLon <= b.maxLon {
+		return query.Where("longitude BETWEEN ? AND ?", b.minLon, b.maxLon)
+	}
+	return query.Where("(longitude >= ? OR longitude <= ?)", b.minLon, b.maxLon)
+}
+
+// validateLocation checks a manual location from a request, writing the
+// error response if it is invalid. Latitude and longitude go together.
+func validateLocation(w http.ResponseWriter, latitude, longitude *float64) bool {
+	if (latitude == nil) != (longitude == nil) {
+		http.Error(w, "Latitude and longitude must be set together", http.StatusBadRequest)
+		return false
+	}
+	if latitude != nil {
+		if err := protocol.ValidateCoordinates(*latitude, *longitude); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return false
+		}
+	}
+	return true
+}
+
+// handleDeviceLocation handles the location of a device. PUT pins a manual
+// location that GPS and GeoIP do not override, DELETE removes it so they can
+// locate the device again.
+func (s *Server) handleDeviceLocation(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.PathValue("id")
+
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+
+	case http.MethodPut:
+		var req LocationRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if req.Latitude == nil || req.Longitude == nil {
+			http.Error(w, "Latitude and longitude are required", http.StatusBadRequest)
+			return
+		}
+		if !validateLocation(w, req.Latitude, req.Longitude) {
+			return
+		}
+
+		updates := map[string]interface{}{
+			"latitude":            *req.Latitude,
+			"longitude":           *req.Longitude,
+			"address":             req.Address,
+			"location_source":     protocol.LocationManual,
+			"location_accuracy":   0,
+			"location_updated_at": time.Now(),
+		}
+		if err := s.database.GetDB().Model(&device).Updates(updates).Error; err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to set location of device %s", deviceID), err)
+			http.Error(w, "Failed to set location", http.StatusInternalServerError)
+			return
+		}
+
+	case http.MethodDelete:
+		updates := map[string]interface{}{
+			"latitude":            nil,
+			"longitude":           nil,
+			"address":             "",
+			"location_source":     "",
+			"location_accuracy":   0,
+			"location_updated_at": nil,
+		}
+		if err := s.database.GetDB().Model(&device).Updates(updates).Error; err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to clear location of device %s", deviceID), err)
+			http.Error(w, "Failed to clear location", http.StatusInternalServerError)
+			return
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := s.database.GetDB().First(&device, "id = ?", device.ID).Error; err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to fetch device %s", deviceID), err)
+		http.Error(w, "Failed to fetch device", http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse(w, DeviceLocation{
+		DeviceID:  device.DeviceID,
+		Latitude:  device.Latitude,
+		Longitude: device.Longitude,
+		Address:   device.Address,
+		Source:    device.LocationSource,
+		Accuracy:  device.LocationAccuracy,
+		UpdatedAt: device.LocationUpdatedAt,
+	}, http.StatusOK)
+}
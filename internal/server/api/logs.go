@@ -0,0 +1,71 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+// handleDeviceLogs returns the logs of a device still in the database, newest
+// first, filtered by log type, journald unit, priority, time and text.
+// Entries moved to the object storage are listed by handleDeviceLogArchives.
+func (s *Server) handleDeviceLogs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", r.PathValue("id")).First(&device).Error; err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	params := r.URL.Query()
+	limit := 100
+	if l, err := strconv.Atoi(params.Get("limit")); err == nil && l > 0 && l <= 1000 {
+		limit = l
+	}
+
+	query := s.database.GetDB().Where("device_id = ?", device.ID)
+	if logType := params.Get("type"); logType != "" {
+		query = query.Where("log_type = ?", logType)
+	}
+	if units := params["unit"]; len(units) > 0 {
+		query = query.Where("unit IN ?", units)
+	}
+	if value := params.Get("priority"); value != "" {
+		// Entries at least as severe, which only journal entries have
+		priority, err := protocol.ParsePriority(value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		query = query.Where("priority <= ?", priority)
+	}
+	for param, condition := range map[string]string{"since": "created_at >= ?", "until": "created_at < ?"} {
+		if value := params.Get(param); value != "" {
+			at, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				http.Error(w, "Invalid "+param+", use RFC 3339", http.StatusBadRequest)
+				return
+			}
+			query = query.Where(condition, at)
+		}
+	}
+	if text := params.Get("q"); text != "" {
+		query = query.Where("message ILIKE ?", "%"+strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(text)+"%")
+	}
+
+	logs := []models.DeviceLog{}
+	if err := query.Order("created_at DESC").Limit(limit).Find(&logs).Error; err != nil {
+		s.logger.Error("Failed to fetch device logs", err)
+		http.Error(w, "Failed to fetch device logs", http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, logs, http.StatusOK)
+}
@@ -0,0 +1,37 @@
+package api
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/edgetainer/edgetainer/internal/server/metrics"
+)
+
+// metricsSettings configures the metrics endpoint
+type metricsSettings struct {
+	token string
+}
+
+// EnableMetrics serves Prometheus metrics on /metrics once the server starts.
+// When token is set, scrapers must send it as a bearer token.
+func (s *Server) EnableMetrics(token string) {
+	s.metrics = &metricsSettings{token: token}
+}
+
+// handleMetrics serves the metrics of all server components
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if s.metrics.token != "" {
+		expected := "Bearer " + s.metrics.token
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(expected)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	metrics.Handler().ServeHTTP(w, r)
+}
@@ -4,9 +4,14 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/edgetainer/edgetainer/internal/shared/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // loggingMiddleware logs incoming requests
@@ -22,6 +27,55 @@ func (s *Server) loggingMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader records the status code
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// tracingMiddleware starts a span for every request, continuing the trace of
+// the caller when a traceparent header is present. Health probes are not traced.
+func (s *Server) tracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/health") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx := tracing.Extract(r.Context(), r.Header.Get("traceparent"))
+		ctx, span := tracing.Start(ctx, r.Method, trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("url.path", r.URL.Path),
+			))
+		defer span.End()
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		r = r.WithContext(ctx)
+		next.ServeHTTP(recorder, r)
+
+		// The route pattern is only known once the router matched the request
+		if r.Pattern != "" {
+			span.SetName(r.Method + " " + r.Pattern)
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", recorder.status))
+		if recorder.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(recorder.status))
+		}
+	})
+}
+
 // authMiddleware handles authentication for API routes
 func (s *Server) authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -61,10 +115,27 @@ func (s *Server) authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		// Create context with user
+		s.touchToken(&apiToken, r)
+
+		// Create context with user and the session it came with
 		ctx := context.WithValue(r.Context(), "user", user)
+		ctx = context.WithValue(ctx, "token_id", apiToken.ID)
 		r = r.WithContext(ctx)
 
 		next(w, r)
 	}
 }
+
+// adminMiddleware restricts a route to admin users. It must be wrapped by
+// authMiddleware, which puts the user in the request context.
+func (s *Server) adminMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := r.Context().Value("user").(models.User)
+		if !ok || user.Role != models.UserRoleAdmin {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		next(w, r)
+	}
+}
@@ -0,0 +1,94 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+	"gorm.io/gorm"
+)
+
+// handleSoftwareMigration handles the data migration run by agents when
+// updating to a software version
+func (s *Server) handleSoftwareMigration(w http.ResponseWriter, r *http.Request) {
+	softwareID := r.PathValue("id")
+	version := r.PathValue("version")
+
+	var software models.Software
+	if err := s.database.GetDB().Where("id = ?", softwareID).First(&software).Error; err != nil {
+		http.Error(w, "Software not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		migration, err := s.deployer.LoadMigration(r.Context(), software, version)
+		if err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to load migration of %s %s", softwareID, version), err)
+			http.Error(w, "Failed to load migration", http.StatusInternalServerError)
+			return
+		}
+		if migration == nil {
+			http.Error(w, "Migration not found", http.StatusNotFound)
+			return
+		}
+
+		jsonResponse(w, migration, http.StatusOK)
+
+	case http.MethodPut:
+		var migration protocol.Migration
+		if err := json.NewDecoder(r.Body).Decode(&migration); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		if err := protocol.ValidateMigration(&migration); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var record models.SoftwareMigration
+		err := s.database.GetDB().Where("software_id = ? AND version = ?", software.ID, version).First(&record).Error
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			record = models.SoftwareMigration{
+				SoftwareID: software.ID,
+				Version:    version,
+				Migration:  migration,
+			}
+			err = s.database.GetDB().Create(&record).Error
+		case err == nil:
+			record.Migration = migration
+			err = s.database.GetDB().Model(&record).Select("migration").Updates(&record).Error
+		}
+		if err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to save migration of %s %s", softwareID, version), err)
+			http.Error(w, "Failed to save migration", http.StatusInternalServerError)
+			return
+		}
+
+		s.logger.Info(fmt.Sprintf("Updated migration of %s version %s (%d steps)", software.Name, version, len(migration.Steps)))
+		jsonResponse(w, migration, http.StatusOK)
+
+	case http.MethodDelete:
+		result := s.database.GetDB().Where("software_id = ? AND version = ?", software.ID, version).Delete(&models.SoftwareMigration{})
+		if result.Error != nil {
+			s.logger.Error(fmt.Sprintf("Failed to delete migration of %s %s", softwareID, version), result.Error)
+			http.Error(w, "Failed to delete migration", http.StatusInternalServerError)
+			return
+		}
+		if result.RowsAffected == 0 {
+			http.Error(w, "Migration not found", http.StatusNotFound)
+			return
+		}
+
+		s.logger.Info(fmt.Sprintf("Removed migration of %s version %s", software.Name, version))
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
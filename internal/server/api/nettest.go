@@ -0,0 +1,106 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+// networkTestMargin is added to the timeout of a network test for the
+// command to reach the device and the result to come back
+const networkTestMargin = 15 * time.Second
+
+// NetworkTestResponse is the outcome of a network test run on a device.
+// Result holds what was measured even if the test failed.
+type NetworkTestResponse struct {
+	Success bool                        `json:"success"`
+	Error   string                      `json:"error,omitempty"`
+	Result  *protocol.NetworkTestResult `json:"result,omitempty"`
+}
+
+// handleDeviceNetworkTest runs a ping, traceroute, DNS or bandwidth test from
+// a connected device and waits for its result
+func (s *Server) handleDeviceNetworkTest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Tests reach arbitrary targets from inside the site network
+	user, _ := r.Context().Value("user").(models.User)
+	if user.Role != models.UserRoleAdmin && user.Role != models.UserRoleOperator {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var payload protocol.NetworkTestPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if err := payload.Normalize(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	deviceID := r.PathValue("id")
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	if _, connected := s.sshServer.GetDeviceConnection(deviceID); !connected {
+		http.Error(w, "Device is not connected", http.StatusConflict)
+		return
+	}
+	if !protocol.HasFeature(device.AgentFeatures, protocol.FeatureNetworkTests) {
+		http.Error(w, fmt.Sprintf("Agent version %s does not support network tests", device.AgentVersion), http.StatusConflict)
+		return
+	}
+
+	command, err := protocol.NewCommandWithPayload(protocol.CmdNetworkTest, payload)
+	if err != nil {
+		s.logger.Error("Failed to build network test command", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Tests reach out to arbitrary targets from inside the site network
+	s.audit(r, models.AuditNetworkTest, deviceID, "", map[string]interface{}{
+		"test":   payload.Test,
+		"target": payload.Target,
+	})
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(payload.Timeout)*time.Second+networkTestMargin)
+	defer cancel()
+
+	response, err := s.sshServer.SendCommand(ctx, deviceID, command)
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to run %s test on device %s", payload.Test, deviceID), err)
+		http.Error(w, "Failed to run network test", http.StatusBadGateway)
+		return
+	}
+
+	result := NetworkTestResponse{Success: response.Success}
+	if !response.Success {
+		result.Error = response.Message
+	}
+	if value, ok := response.Data["result"]; ok && value != nil {
+		data, err := json.Marshal(value)
+		if err == nil {
+			err = json.Unmarshal(data, &result.Result)
+		}
+		if err != nil {
+			s.logger.Error(fmt.Sprintf("Invalid network test result reported by device %s", deviceID), err)
+			http.Error(w, "Invalid response from device", http.StatusBadGateway)
+			return
+		}
+	}
+
+	jsonResponse(w, result, http.StatusOK)
+}
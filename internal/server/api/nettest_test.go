@@ -0,0 +1,25 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+)
+
+func TestDeviceNetworkTestForbiddenForViewers(t *testing.T) {
+	s := &Server{}
+	body := strings.NewReader(`{"test":"ping","target":"192.0.2.1"}`)
+	r := httptest.NewRequest(http.MethodPost, "/api/devices/dev-1/network-tests", body)
+	r = r.WithContext(context.WithValue(r.Context(), "user", models.User{Role: models.UserRoleViewer}))
+	w := httptest.NewRecorder()
+
+	s.handleDeviceNetworkTest(w, r)
+
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("viewer got %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
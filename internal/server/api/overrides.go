@@ -0,0 +1,220 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/edgetainer/edgetainer/internal/shared/compose"
+	"github.com/edgetainer/edgetainer/internal/shared/credentials"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// ComposeOverrideRequest represents a request to set the compose override of
+// a fleet or device for a software
+type ComposeOverrideRequest struct {
+	SoftwareID  uuid.UUID `json:"software_id"`
+	ComposeYAML string    `json:"compose_yaml"`
+}
+
+// handleFleetComposeOverrides handles the compose overrides of a fleet
+func (s *Server) handleFleetComposeOverrides(w http.ResponseWriter, r *http.Request) {
+	fleetID := r.PathValue("id")
+
+	var fleet models.Fleet
+	if err := s.database.GetDB().Where("id = ?", fleetID).First(&fleet).Error; err != nil {
+		http.Error(w, "Fleet not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		overrides := []models.FleetComposeOverride{}
+		if err := s.database.GetDB().Where("fleet_id = ?", fleet.ID).Find(&overrides).Error; err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to fetch compose overrides of fleet %s", fleetID), err)
+			http.Error(w, "Failed to fetch compose overrides", http.StatusInternalServerError)
+			return
+		}
+
+		for i := range overrides {
+			overrides[i].ComposeYAML = redactCompose(overrides[i].ComposeYAML)
+		}
+		jsonResponse(w, overrides, http.StatusOK)
+
+	case http.MethodPut:
+		request, ok := s.decodeComposeOverrideRequest(w, r)
+		if !ok {
+			return
+		}
+
+		var record models.FleetComposeOverride
+		err := s.database.GetDB().Where("fleet_id = ? AND software_id = ?", fleet.ID, request.SoftwareID).First(&record).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			s.logger.Error(fmt.Sprintf("Failed to fetch compose override of fleet %s", fleetID), err)
+			http.Error(w, "Failed to save compose override", http.StatusInternalServerError)
+			return
+		}
+		if !s.checkOverrideCredentials(w, r, request, record.ComposeYAML) {
+			return
+		}
+
+		record.FleetID = fleet.ID
+		record.SoftwareID = request.SoftwareID
+		record.ComposeYAML = request.ComposeYAML
+
+		if err := s.database.GetDB().Save(&record).Error; err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to save compose override of fleet %s", fleetID), err)
+			http.Error(w, "Failed to save compose override", http.StatusInternalServerError)
+			return
+		}
+
+		s.logger.Info(fmt.Sprintf("Updated compose override of fleet %s for software %s", fleet.Name, request.SoftwareID))
+		record.ComposeYAML = redactCompose(record.ComposeYAML)
+		jsonResponse(w, record, http.StatusOK)
+
+	case http.MethodDelete:
+		result := s.database.GetDB().Where("fleet_id = ? AND software_id = ?", fleet.ID, r.URL.Query().Get("software_id")).
+			Delete(&models.FleetComposeOverride{})
+		if result.Error != nil {
+			s.logger.Error(fmt.Sprintf("Failed to delete compose override of fleet %s", fleetID), result.Error)
+			http.Error(w, "Failed to delete compose override", http.StatusInternalServerError)
+			return
+		}
+		if result.RowsAffected == 0 {
+			http.Error(w, "Compose override not found", http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleDeviceComposeOverrides handles the compose overrides of a device
+func (s *Server) handleDeviceComposeOverrides(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.PathValue("id")
+
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		overrides := []models.DeviceComposeOverride{}
+		if err := s.database.GetDB().Where("device_id = ?", device.ID).Find(&overrides).Error; err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to fetch compose overrides of device %s", deviceID), err)
+			http.Error(w, "Failed to fetch compose overrides", http.StatusInternalServerError)
+			return
+		}
+
+		for i := range overrides {
+			overrides[i].ComposeYAML = redactCompose(overrides[i].ComposeYAML)
+		}
+		jsonResponse(w, overrides, http.StatusOK)
+
+	case http.MethodPut:
+		request, ok := s.decodeComposeOverrideRequest(w, r)
+		if !ok {
+			return
+		}
+
+		var record models.DeviceComposeOverride
+		err := s.database.GetDB().Where("device_id = ? AND software_id = ?", device.ID, request.SoftwareID).First(&record).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			s.logger.Error(fmt.Sprintf("Failed to fetch compose override of device %s", deviceID), err)
+			http.Error(w, "Failed to save compose override", http.StatusInternalServerError)
+			return
+		}
+		if !s.checkOverrideCredentials(w, r, request, record.ComposeYAML) {
+			return
+		}
+
+		record.DeviceID = device.ID
+		record.SoftwareID = request.SoftwareID
+		record.ComposeYAML = request.ComposeYAML
+
+		if err := s.database.GetDB().Save(&record).Error; err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to save compose override of device %s", deviceID), err)
+			http.Error(w, "Failed to save compose override", http.StatusInternalServerError)
+			return
+		}
+
+		s.logger.Info(fmt.Sprintf("Updated compose override of device %s for software %s", deviceID, request.SoftwareID))
+		record.ComposeYAML = redactCompose(record.ComposeYAML)
+		jsonResponse(w, record, http.StatusOK)
+
+	case http.MethodDelete:
+		result := s.database.GetDB().Where("device_id = ? AND software_id = ?", device.ID, r.URL.Query().Get("software_id")).
+			Delete(&models.DeviceComposeOverride{})
+		if result.Error != nil {
+			s.logger.Error(fmt.Sprintf("Failed to delete compose override of device %s", deviceID), result.Error)
+			http.Error(w, "Failed to delete compose override", http.StatusInternalServerError)
+			return
+		}
+		if result.RowsAffected == 0 {
+			http.Error(w, "Compose override not found", http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// decodeComposeOverrideRequest decodes a compose override and checks it
+// against the software's compose file, responding with an error and
+// returning false when it is invalid
+func (s *Server) decodeComposeOverrideRequest(w http.ResponseWriter, r *http.Request) (*ComposeOverrideRequest, bool) {
+	var request ComposeOverrideRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return nil, false
+	}
+
+	var software models.Software
+	if err := s.database.GetDB().Where("id = ?", request.SoftwareID).First(&software).Error; err != nil {
+		http.Error(w, "Software not found", http.StatusBadRequest)
+		return nil, false
+	}
+
+	if strings.TrimSpace(request.ComposeYAML) == "" {
+		http.Error(w, "compose_yaml is required", http.StatusBadRequest)
+		return nil, false
+	}
+	if err := compose.ValidateOverride(request.ComposeYAML, software.DockerComposeYAML); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+
+	return &request, true
+}
+
+// checkOverrideCredentials puts the credentials of the stored override back
+// where the request sent them redacted, then applies the secret scan policy
+// to the override. It responds with an error and returns false if the
+// override cannot be saved.
+func (s *Server) checkOverrideCredentials(w http.ResponseWriter, r *http.Request, request *ComposeOverrideRequest, stored string) bool {
+	composeYAML, err := credentials.RestoreYAML(request.ComposeYAML, stored)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("compose_yaml: %v", err), http.StatusBadRequest)
+		return false
+	}
+	request.ComposeYAML = composeYAML
+
+	findings, err := credentials.ScanYAML(composeYAML)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("compose_yaml: %v", err), http.StatusBadRequest)
+		return false
+	}
+	return s.checkCredentials(w, r, "Compose override", findings)
+}
@@ -0,0 +1,306 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/edgetainer/edgetainer/internal/server/ssh"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+// PluginSettingsRequest replaces the plugin settings of a fleet or device
+type PluginSettingsRequest struct {
+	Settings models.PluginConfig `json:"settings"` // JSON object per plugin name
+}
+
+// PluginSettingsResult is the outcome of sending plugin settings to one
+// device
+type PluginSettingsResult struct {
+	DeviceID string `json:"device_id"`
+	Success  bool   `json:"success"`
+	Message  string `json:"message"`
+}
+
+// PluginSettingsResponse reports the plugin settings of a fleet or device and,
+// after a change, the devices they were sent to
+type PluginSettingsResponse struct {
+	Settings  models.PluginConfig    `json:"settings"`
+	Effective models.PluginConfig    `json:"effective,omitempty"` // Of a device, merged with those of its fleet
+	Devices   []PluginSettingsResult `json:"devices,omitempty"`   // Connected devices only, the others get them when they connect
+}
+
+// PluginActionResponse is the outcome of a plugin action
+type PluginActionResponse struct {
+	Success bool            `json:"success"`
+	Error   string          `json:"error,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"` // What the plugin answered
+}
+
+// handleFleetPluginSettings handles the plugin settings of a fleet
+func (s *Server) handleFleetPluginSettings(w http.ResponseWriter, r *http.Request) {
+	fleetID := r.PathValue("id")
+
+	var fleet models.Fleet
+	if err := s.database.GetDB().Where("id = ?", fleetID).First(&fleet).Error; err != nil {
+		http.Error(w, "Fleet not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		jsonResponse(w, PluginSettingsResponse{Settings: orEmpty(fleet.PluginSettings)}, http.StatusOK)
+
+	case http.MethodPut:
+		settings, ok := decodePluginSettings(w, r)
+		if !ok {
+			return
+		}
+
+		fleet.PluginSettings = settings
+		if err := s.database.GetDB().Model(&fleet).Select("PluginSettings").Updates(&fleet).Error; err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to update plugin settings of fleet %s", fleetID), err)
+			http.Error(w, "Failed to update fleet", http.StatusInternalServerError)
+			return
+		}
+		s.audit(r, models.AuditPluginSettings, "", "", map[string]interface{}{
+			"fleet_id": fleetID,
+			"plugins":  pluginNames(settings),
+		})
+
+		var devices []models.Device
+		if err := s.database.GetDB().Where("fleet_id = ?", fleet.ID).Find(&devices).Error; err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to fetch devices of fleet %s", fleetID), err)
+			http.Error(w, "Failed to fetch devices", http.StatusInternalServerError)
+			return
+		}
+
+		results := s.applyPluginSettings(r.Context(), devices)
+		s.logger.Info(fmt.Sprintf("Set plugin settings of fleet %s on %d connected devices", fleetID, len(results)))
+		jsonResponse(w, PluginSettingsResponse{Settings: settings, Devices: results}, http.StatusOK)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleDevicePluginSettings handles the plugin settings of a device
+func (s *Server) handleDevicePluginSettings(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.PathValue("id")
+
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		jsonResponse(w, PluginSettingsResponse{
+			Settings:  orEmpty(device.PluginSettings),
+			Effective: s.effectivePluginSettings(&device),
+		}, http.StatusOK)
+
+	case http.MethodPut:
+		settings, ok := decodePluginSettings(w, r)
+		if !ok {
+			return
+		}
+
+		device.PluginSettings = settings
+		if err := s.database.GetDB().Model(&device).Select("PluginSettings").Updates(&device).Error; err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to update plugin settings of device %s", deviceID), err)
+			http.Error(w, "Failed to update device", http.StatusInternalServerError)
+			return
+		}
+		s.audit(r, models.AuditPluginSettings, deviceID, "", map[string]interface{}{
+			"plugins": pluginNames(settings),
+		})
+
+		jsonResponse(w, PluginSettingsResponse{
+			Settings:  settings,
+			Effective: s.effectivePluginSettings(&device),
+			Devices:   s.applyPluginSettings(r.Context(), []models.Device{device}),
+		}, http.StatusOK)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleDevicePluginAction runs an action of a plugin on a connected device.
+// The request body, if any, is handed to the plugin as its parameters.
+func (s *Server) handleDevicePluginAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, _ := r.Context().Value("user").(models.User)
+	if user.Role != models.UserRoleAdmin && user.Role != models.UserRoleOperator {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	deviceID := r.PathValue("id")
+	payload := protocol.PluginActionPayload{Plugin: r.PathValue("plugin"), Action: r.PathValue("action")}
+	if err := protocol.ValidatePluginName(payload.Plugin); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := protocol.ValidatePluginName(payload.Action); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, protocol.MaxPluginSettings+1))
+	if err != nil || len(body) > protocol.MaxPluginSettings {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if len(body) > 0 {
+		var params map[string]interface{}
+		if err := json.Unmarshal(body, &params); err != nil || params == nil {
+			http.Error(w, "Parameters must be a JSON object", http.StatusBadRequest)
+			return
+		}
+		payload.Params = body
+	}
+
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	if _, connected := s.sshServer.GetDeviceConnection(deviceID); !connected {
+		http.Error(w, "Device is not connected", http.StatusConflict)
+		return
+	}
+	if !protocol.HasFeature(device.AgentFeatures, protocol.FeaturePlugins) {
+		http.Error(w, fmt.Sprintf("Agent version %s does not support plugins", device.AgentVersion), http.StatusConflict)
+		return
+	}
+
+	command, err := protocol.NewCommandWithPayload(protocol.CmdPluginAction, payload)
+	if err != nil {
+		s.logger.Error("Failed to build plugin action command", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	s.audit(r, models.AuditPluginAction, deviceID, "", map[string]interface{}{
+		"plugin": payload.Plugin,
+		"action": payload.Action,
+	})
+
+	response, err := s.sshServer.SendCommand(r.Context(), deviceID, command)
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to run %s %s on device %s", payload.Plugin, payload.Action, deviceID), err)
+		http.Error(w, "Failed to run plugin action", http.StatusBadGateway)
+		return
+	}
+
+	result := PluginActionResponse{Success: response.Success}
+	if !response.Success {
+		result.Error = response.Message
+	}
+	if value, ok := response.Data["result"]; ok && value != nil {
+		if result.Result, err = json.Marshal(value); err != nil {
+			s.logger.Error(fmt.Sprintf("Invalid plugin action result reported by device %s", deviceID), err)
+			http.Error(w, "Invalid response from device", http.StatusBadGateway)
+			return
+		}
+	}
+
+	jsonResponse(w, result, http.StatusOK)
+}
+
+// decodePluginSettings reads and checks the plugin settings of a request,
+// writing the error response if they are invalid
+func decodePluginSettings(w http.ResponseWriter, r *http.Request) (models.PluginConfig, bool) {
+	var request PluginSettingsRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return nil, false
+	}
+	if err := protocol.ValidatePluginSettings(request.Settings); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return orEmpty(request.Settings), true
+}
+
+// applyPluginSettings sends the plugin settings to the connected devices
+// among the given ones that support plugins
+func (s *Server) applyPluginSettings(ctx context.Context, devices []models.Device) []PluginSettingsResult {
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		results []PluginSettingsResult
+	)
+	for _, device := range devices {
+		if _, connected := s.sshServer.GetDeviceConnection(device.DeviceID); !connected {
+			continue
+		}
+		if !protocol.HasFeature(device.AgentFeatures, protocol.FeaturePlugins) {
+			continue
+		}
+
+		wg.Add(1)
+		go func(deviceID string) {
+			defer wg.Done()
+
+			result := PluginSettingsResult{DeviceID: deviceID}
+			response, err := s.sshServer.ApplyPluginSettings(ctx, deviceID)
+			if err != nil {
+				result.Message = err.Error()
+			} else {
+				result.Success, result.Message = response.Success, response.Message
+			}
+
+			mu.Lock()
+			results = append(results, result)
+			mu.Unlock()
+		}(device.DeviceID)
+	}
+	wg.Wait()
+
+	sort.Slice(results, func(i, j int) bool { return results[i].DeviceID < results[j].DeviceID })
+	return results
+}
+
+// effectivePluginSettings returns the plugin settings a device gets
+func (s *Server) effectivePluginSettings(device *models.Device) models.PluginConfig {
+	var fleet *models.Fleet
+	if device.FleetID != nil {
+		var f models.Fleet
+		if err := s.database.GetDB().Where("id = ?", *device.FleetID).First(&f).Error; err == nil {
+			fleet = &f
+		}
+	}
+	return ssh.EffectivePluginSettings(device, fleet)
+}
+
+// pluginNames lists the plugins of settings, for the audit log which leaves
+// out the settings themselves
+func pluginNames(settings models.PluginConfig) []string {
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// orEmpty returns empty settings for nil ones, so they encode as {}
+func orEmpty(settings models.PluginConfig) models.PluginConfig {
+	if settings == nil {
+		return models.PluginConfig{}
+	}
+	return settings
+}
@@ -0,0 +1,285 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	// maxSavedViews is the most views a user can save
+	maxSavedViews = 100
+	// maxPreferenceItems bounds the tables and columns of a layout and the
+	// filters of a view
+	maxPreferenceItems = 50
+	// maxPreferenceLength bounds names, keys and values
+	maxPreferenceLength = 200
+)
+
+// validStrings checks the length of the strings of a preference
+func validStrings(what string, values ...string) error {
+	for _, value := range values {
+		if len(value) > maxPreferenceLength {
+			return fmt.Errorf("%s must be at most %d characters", what, maxPreferenceLength)
+		}
+	}
+	return nil
+}
+
+// validateColumns checks a column layout
+func validateColumns(columns []string) error {
+	if len(columns) > maxPreferenceItems {
+		return fmt.Errorf("at most %d columns are allowed", maxPreferenceItems)
+	}
+	return validStrings("column names", columns...)
+}
+
+// validatePreferences checks the preferences a user sets
+func (s *Server) validatePreferences(preferences *models.UserPreferences) error {
+	switch preferences.Theme {
+	case "", models.ThemeLight, models.ThemeDark:
+	default:
+		return fmt.Errorf("theme must be %s, %s or empty", models.ThemeLight, models.ThemeDark)
+	}
+
+	if len(preferences.Columns) > maxPreferenceItems {
+		return fmt.Errorf("at most %d table layouts are allowed", maxPreferenceItems)
+	}
+	for table, columns := range preferences.Columns {
+		if err := validStrings("table names", table); err != nil {
+			return err
+		}
+		if err := validateColumns(columns); err != nil {
+			return fmt.Errorf("table %s: %w", table, err)
+		}
+	}
+
+	if len(preferences.Widgets) > maxPreferenceItems {
+		return fmt.Errorf("at most %d widgets are allowed", maxPreferenceItems)
+	}
+	for i := range preferences.Widgets {
+		if err := validateWidget(&preferences.Widgets[i]); err != nil {
+			return err
+		}
+	}
+
+	if preferences.DefaultFleetID != nil {
+		if err := s.database.GetDB().First(&models.Fleet{}, "id = ?", *preferences.DefaultFleetID).Error; err != nil {
+			return fmt.Errorf("fleet %s not found", *preferences.DefaultFleetID)
+		}
+	}
+	return nil
+}
+
+// validateSavedView checks a view a user saves
+func validateSavedView(view *models.SavedView) error {
+	if view.Page == "" || view.Name == "" {
+		return errors.New("page and name are required")
+	}
+	if err := validStrings("page and name", view.Page, view.Name); err != nil {
+		return err
+	}
+
+	if len(view.Filters) > maxPreferenceItems {
+		return fmt.Errorf("at most %d filters are allowed", maxPreferenceItems)
+	}
+	for key, value := range view.Filters {
+		if err := validStrings("filters", key, value); err != nil {
+			return err
+		}
+	}
+	return validateColumns(view.Columns)
+}
+
+// handlePreferences reads and replaces the web UI preferences of the
+// authenticated user
+func (s *Server) handlePreferences(w http.ResponseWriter, r *http.Request) {
+	user, _ := r.Context().Value("user").(models.User)
+
+	switch r.Method {
+	case http.MethodGet:
+		preferences := models.UserPreferences{UserID: user.ID}
+		err := s.database.GetDB().Where("user_id = ?", user.ID).First(&preferences).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			s.logger.Error(fmt.Sprintf("Failed to fetch preferences of %s", user.Username), err)
+			http.Error(w, "Failed to fetch preferences", http.StatusInternalServerError)
+			return
+		}
+		if preferences.Columns == nil {
+			preferences.Columns = map[string][]string{}
+		}
+		if preferences.Widgets == nil {
+			preferences.Widgets = []models.DashboardWidget{}
+		}
+
+		jsonResponse(w, preferences, http.StatusOK)
+
+	case http.MethodPut:
+		var preferences models.UserPreferences
+		if err := json.NewDecoder(r.Body).Decode(&preferences); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if err := s.validatePreferences(&preferences); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if preferences.Columns == nil {
+			preferences.Columns = map[string][]string{}
+		}
+		if preferences.Widgets == nil {
+			preferences.Widgets = []models.DashboardWidget{}
+		}
+
+		preferences.UserID = user.ID
+		if err := s.database.GetDB().Save(&preferences).Error; err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to save preferences of %s", user.Username), err)
+			http.Error(w, "Failed to save preferences", http.StatusInternalServerError)
+			return
+		}
+
+		jsonResponse(w, preferences, http.StatusOK)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleSavedViews lists and saves the views of the authenticated user,
+// optionally those of one page
+func (s *Server) handleSavedViews(w http.ResponseWriter, r *http.Request) {
+	user, _ := r.Context().Value("user").(models.User)
+
+	switch r.Method {
+	case http.MethodGet:
+		query := s.database.GetDB().Where("user_id = ?", user.ID)
+		if page := r.URL.Query().Get("page"); page != "" {
+			query = query.Where("page = ?", page)
+		}
+
+		views := []models.SavedView{}
+		if err := query.Order("page, name").Find(&views).Error; err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to fetch saved views of %s", user.Username), err)
+			http.Error(w, "Failed to fetch saved views", http.StatusInternalServerError)
+			return
+		}
+
+		jsonResponse(w, views, http.StatusOK)
+
+	case http.MethodPost:
+		var view models.SavedView
+		if err := json.NewDecoder(r.Body).Decode(&view); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if err := validateSavedView(&view); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var count int64
+		if err := s.database.GetDB().Model(&models.SavedView{}).Where("user_id = ?", user.ID).Count(&count).Error; err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to count saved views of %s", user.Username), err)
+			http.Error(w, "Failed to save view", http.StatusInternalServerError)
+			return
+		}
+		if count >= maxSavedViews {
+			http.Error(w, fmt.Sprintf("At most %d views can be saved", maxSavedViews), http.StatusConflict)
+			return
+		}
+		if s.savedViewExists(user.ID, &view) {
+			http.Error(w, fmt.Sprintf("View %s already exists", view.Name), http.StatusConflict)
+			return
+		}
+
+		view.ID = uuid.Nil
+		view.UserID = user.ID
+		if err := s.database.GetDB().Create(&view).Error; err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to save view of %s", user.Username), err)
+			http.Error(w, "Failed to save view", http.StatusInternalServerError)
+			return
+		}
+
+		jsonResponse(w, view, http.StatusCreated)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// savedViewExists reports whether a user has another view of the same name
+// on the page of view
+func (s *Server) savedViewExists(userID uuid.UUID, view *models.SavedView) bool {
+	var count int64
+	s.database.GetDB().Model(&models.SavedView{}).
+		Where("user_id = ? AND page = ? AND name = ? AND id <> ?", userID, view.Page, view.Name, view.ID).
+		Count(&count)
+	return count > 0
+}
+
+// handleSavedViewByID reads, replaces and deletes a view of the
+// authenticated user. Views of other users are not found.
+func (s *Server) handleSavedViewByID(w http.ResponseWriter, r *http.Request) {
+	user, _ := r.Context().Value("user").(models.User)
+
+	viewID, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "View not found", http.StatusNotFound)
+		return
+	}
+	var view models.SavedView
+	if err := s.database.GetDB().Where("id = ? AND user_id = ?", viewID, user.ID).First(&view).Error; err != nil {
+		http.Error(w, "View not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		jsonResponse(w, view, http.StatusOK)
+
+	case http.MethodPut:
+		var request models.SavedView
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		view.Page = request.Page
+		view.Name = request.Name
+		view.Filters = request.Filters
+		view.Columns = request.Columns
+		if err := validateSavedView(&view); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if s.savedViewExists(user.ID, &view) {
+			http.Error(w, fmt.Sprintf("View %s already exists", view.Name), http.StatusConflict)
+			return
+		}
+
+		if err := s.database.GetDB().Save(&view).Error; err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to update view %s", viewID), err)
+			http.Error(w, "Failed to update view", http.StatusInternalServerError)
+			return
+		}
+
+		jsonResponse(w, view, http.StatusOK)
+
+	case http.MethodDelete:
+		if err := s.database.GetDB().Delete(&view).Error; err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to delete view %s", viewID), err)
+			http.Error(w, "Failed to delete view", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
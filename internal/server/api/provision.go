@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/edgetainer/edgetainer/internal/server/auth"
+	"github.com/edgetainer/edgetainer/internal/server/extensions"
 	"github.com/edgetainer/edgetainer/internal/server/provisioning"
 	"github.com/edgetainer/edgetainer/internal/shared/models"
 	"github.com/google/uuid"
@@ -30,6 +31,24 @@ type DeviceProvisionResponse struct {
 	ConfigURL string `json:"config_url"`
 }
 
+// SetDeviceKeys sets the type and size of the SSH keys generated for new
+// devices, ed25519 unless set
+func (s *Server) SetDeviceKeys(keyType string, bits int) {
+	s.deviceKeyType = keyType
+	s.deviceKeyBits = bits
+}
+
+// butaneTemplatePath returns the path of the Butane template devices are
+// provisioned with
+func butaneTemplatePath() string {
+	templatePath := filepath.Join("config", "templates", "base.bu")
+	if _, err := os.Stat(templatePath); os.IsNotExist(err) {
+		// If not found in development path, try the Docker container path
+		templatePath = filepath.Join("/app", "templates", "base.bu")
+	}
+	return templatePath
+}
+
 // handleDeviceProvisioning handles creating a new device provisioning configuration
 func (s *Server) handleDeviceProvisioning(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -50,11 +69,31 @@ func (s *Server) handleDeviceProvisioning(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	// Generate a unique device ID
-	deviceID := generateDeviceID(request.Name)
+	// Parse the fleet ID if provided
+	var fleetID *uuid.UUID
+	if request.FleetID != "" {
+		parsedID, err := uuid.Parse(request.FleetID)
+		if err != nil {
+			s.logger.Error(fmt.Sprintf("Invalid fleet ID: %v", err), err)
+			http.Error(w, "Invalid fleet ID", http.StatusBadRequest)
+			return
+		}
+		fleetID = &parsedID
+	}
+	if !s.checkDeviceName(w, "", fleetID, request.Name) {
+		return
+	}
+
+	// Generate a unique device ID with the prefix of the fleet
+	deviceID, err := s.newDeviceID(r.Context(), fleetID)
+	if err != nil {
+		s.logger.Error("Failed to generate device ID", err)
+		http.Error(w, "Failed to generate device ID", http.StatusInternalServerError)
+		return
+	}
 
 	// Generate SSH key pair for the device
-	keyPair, err := auth.GenerateKeyPair(deviceID, 4096)
+	keyPair, err := auth.GenerateKeyPair(deviceID, s.deviceKeyType, s.deviceKeyBits)
 	if err != nil {
 		s.logger.Error(fmt.Sprintf("Failed to generate key pair: %v", err), err)
 		http.Error(w, "Failed to generate key pair", http.StatusInternalServerError)
@@ -65,20 +104,34 @@ func (s *Server) handleDeviceProvisioning(w http.ResponseWriter, r *http.Request
 	publicKeyString := string(keyPair.PublicKey)
 	privateKeyString := string(keyPair.PrivateKey)
 
-	// Parse the fleet ID if provided
-	var fleetID *uuid.UUID
-	if request.FleetID != "" {
-		parsedID, err := uuid.Parse(request.FleetID)
-		if err != nil {
-			s.logger.Error(fmt.Sprintf("Invalid fleet ID: %v", err), err)
-			http.Error(w, "Invalid fleet ID", http.StatusBadRequest)
+	// Let the enrollment validators turn the device down before it is
+	// recorded
+	if s.extensions != nil {
+		enrollment := &extensions.Enrollment{
+			DeviceID:    deviceID,
+			Name:        request.Name,
+			FleetID:     request.FleetID,
+			Labels:      request.Labels,
+			Description: request.Description,
+			RemoteAddr:  r.RemoteAddr,
+		}
+		if err := s.extensions.ValidateEnrollment(r.Context(), enrollment); err != nil {
+			s.logger.Info(fmt.Sprintf("Enrollment of device %s (%s) rejected: %v", request.Name, deviceID, err))
+			s.audit(r, models.AuditEnrollmentRejected, deviceID, err.Error(), map[string]interface{}{
+				"name":        request.Name,
+				"fleet_id":    request.FleetID,
+				"remote_addr": r.RemoteAddr,
+			})
+			http.Error(w, err.Error(), http.StatusForbidden)
 			return
 		}
-		fleetID = &parsedID
 	}
 
 	// No need to handle labels separately, as we're using the Device model directly
 
+	// Devices reach the server at the URL and SSH port set in the setup
+	serverHost, serverPort, sshPort := s.provisioningTarget(r.Context())
+
 	// Create a pending device record in the database
 	device := models.Device{
 		DeviceID:     deviceID,
@@ -87,7 +140,7 @@ func (s *Server) handleDeviceProvisioning(w http.ResponseWriter, r *http.Request
 		Status:       models.DeviceStatusPending,
 		LastSeen:     time.Now(),
 		SSHPublicKey: publicKeyString,
-		SSHPort:      2222, // Default SSH port
+		SSHPort:      sshPort,
 		HardwareInfo: "{}", // Initialize with empty JSON object
 	}
 
@@ -104,20 +157,13 @@ func (s *Server) handleDeviceProvisioning(w http.ResponseWriter, r *http.Request
 	templateData := &provisioning.TemplateData{
 		DeviceID:      deviceID,
 		SSHPrivateKey: privateKeyString,
-		ServerHost:    s.host,
-		ServerPort:    s.port,
-		SSHPort:       2222,
-	}
-
-	// Get the template path
-	templatePath := filepath.Join("config", "templates", "base.bu")
-	if _, err := os.Stat(templatePath); os.IsNotExist(err) {
-		// If not found in development path, try the Docker container path
-		templatePath = filepath.Join("/app", "templates", "base.bu")
+		ServerHost:    serverHost,
+		ServerPort:    serverPort,
+		SSHPort:       sshPort,
 	}
 
 	// Render the Butane template
-	butaneConfig, err := provisioning.RenderButaneTemplate(templatePath, templateData)
+	butaneConfig, err := provisioning.RenderButaneTemplate(butaneTemplatePath(), templateData)
 	if err != nil {
 		s.logger.Error(fmt.Sprintf("Failed to render butane template: %v", err), err)
 		http.Error(w, "Failed to render butane template", http.StatusInternalServerError)
@@ -147,10 +193,3 @@ func (s *Server) handleDeviceProvisioning(w http.ResponseWriter, r *http.Request
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(ignitionJSON))
 }
-
-// generateDeviceID generates a unique device ID
-func generateDeviceID(name string) string {
-	// This is a simplified implementation
-	timestamp := time.Now().UnixNano()
-	return fmt.Sprintf("device-%s-%d", name, timestamp%100000) // Shorten the ID a bit
-}
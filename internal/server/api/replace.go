@@ -0,0 +1,83 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/edgetainer/edgetainer/internal/server/deploy"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+)
+
+// ReplaceDeviceRequest represents a request to replace a device with a newly
+// enrolled one
+type ReplaceDeviceRequest struct {
+	ReplacementDeviceID string `json:"replacement_device_id"`
+	Force               bool   `json:"force,omitempty"` // Replace the device even though it is connected
+}
+
+// ReplaceDeviceResponse reports the outcome of a device replacement
+type ReplaceDeviceResponse struct {
+	Device models.Device `json:"device"`
+	Queued int           `json:"queued"` // Deployments queued to carry over the software
+}
+
+// handleDeviceReplace handles moving the role of a failed device onto a new
+// one. The old device is kept, marked replaced, with its history.
+func (s *Server) handleDeviceReplace(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	deviceID := r.PathValue("id")
+
+	var request ReplaceDeviceRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if request.ReplacementDeviceID == "" {
+		http.Error(w, "Replacement device ID is required", http.StatusBadRequest)
+		return
+	}
+
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	var replacement models.Device
+	if err := s.database.GetDB().Where("device_id = ?", request.ReplacementDeviceID).First(&replacement).Error; err != nil {
+		http.Error(w, "Replacement device not found", http.StatusBadRequest)
+		return
+	}
+
+	// A connected device is most likely not dead, and would keep running
+	// the same software as its replacement
+	if _, connected := s.sshServer.GetDeviceConnection(deviceID); connected && !request.Force {
+		http.Error(w, "Device is connected, set force to replace it anyway", http.StatusConflict)
+		return
+	}
+
+	queued, err := s.deployer.ReplaceDevice(r.Context(), &device, &replacement)
+	if err != nil {
+		switch {
+		case errors.Is(err, deploy.ErrSameDevice):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, deploy.ErrDeviceRetired):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			s.logger.Error(fmt.Sprintf("Failed to replace device %s", deviceID), err)
+			http.Error(w, "Failed to replace device", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// The subdomain moved to the replacement
+	s.syncDNS()
+
+	jsonResponse(w, ReplaceDeviceResponse{Device: replacement, Queued: queued}, http.StatusOK)
+}
@@ -0,0 +1,186 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// UpgradeBlockers lists the devices of a fleet that are too old to be
+// deployed a software version
+type UpgradeBlockers struct {
+	FleetID            uuid.UUID              `json:"fleet_id"`
+	SoftwareID         uuid.UUID              `json:"software_id"`
+	Version            string                 `json:"version"`
+	Requirements       *protocol.Requirements `json:"requirements"`        // Of the version, nil if it declares none
+	ServerRequirements protocol.Requirements  `json:"server_requirements"` // Apply to every deployment
+	Checked            int                    `json:"checked"`             // Devices of the fleet that were checked
+	Devices            []BlockingDevice       `json:"devices"`
+}
+
+// BlockingDevice is a device that does not meet the requirements of a
+// deployment
+type BlockingDevice struct {
+	DeviceID     string           `json:"device_id"`
+	Name         string           `json:"name"`
+	AgentVersion string           `json:"agent_version"`
+	OS           *protocol.OSInfo `json:"os"`
+	Unmet        []string         `json:"unmet"`
+}
+
+// handleSoftwareRequirements handles the oldest agent, OS and kernel versions
+// devices must run to be deployed a software version
+func (s *Server) handleSoftwareRequirements(w http.ResponseWriter, r *http.Request) {
+	softwareID := r.PathValue("id")
+	version := r.PathValue("version")
+
+	var software models.Software
+	if err := s.database.GetDB().Where("id = ?", softwareID).First(&software).Error; err != nil {
+		http.Error(w, "Software not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		requirements, err := s.deployer.LoadRequirements(r.Context(), software, version)
+		if err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to load requirements of %s %s", softwareID, version), err)
+			http.Error(w, "Failed to load requirements", http.StatusInternalServerError)
+			return
+		}
+		if requirements == nil {
+			http.Error(w, "Requirements not found", http.StatusNotFound)
+			return
+		}
+
+		jsonResponse(w, requirements, http.StatusOK)
+
+	case http.MethodPut:
+		var requirements protocol.Requirements
+		if err := json.NewDecoder(r.Body).Decode(&requirements); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		if err := requirements.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var record models.SoftwareRequirements
+		err := s.database.GetDB().Where("software_id = ? AND version = ?", software.ID, version).First(&record).Error
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			record = models.SoftwareRequirements{
+				SoftwareID:   software.ID,
+				Version:      version,
+				Requirements: requirements,
+			}
+			err = s.database.GetDB().Create(&record).Error
+		case err == nil:
+			record.Requirements = requirements
+			err = s.database.GetDB().Model(&record).Select("requirements").Updates(&record).Error
+		}
+		if err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to save requirements of %s %s", softwareID, version), err)
+			http.Error(w, "Failed to save requirements", http.StatusInternalServerError)
+			return
+		}
+
+		s.logger.Info(fmt.Sprintf("Updated requirements of %s version %s", software.Name, version))
+		jsonResponse(w, requirements, http.StatusOK)
+
+	case http.MethodDelete:
+		result := s.database.GetDB().Where("software_id = ? AND version = ?", software.ID, version).Delete(&models.SoftwareRequirements{})
+		if result.Error != nil {
+			s.logger.Error(fmt.Sprintf("Failed to delete requirements of %s %s", softwareID, version), result.Error)
+			http.Error(w, "Failed to delete requirements", http.StatusInternalServerError)
+			return
+		}
+		if result.RowsAffected == 0 {
+			http.Error(w, "Requirements not found", http.StatusNotFound)
+			return
+		}
+
+		s.logger.Info(fmt.Sprintf("Removed requirements of %s version %s", software.Name, version))
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleFleetUpgradeBlockers reports the devices of a fleet whose agent, OS
+// or kernel is too old to be deployed a software version, the current one
+// unless the version parameter names another
+func (s *Server) handleFleetUpgradeBlockers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fleetID := r.PathValue("id")
+
+	var fleet models.Fleet
+	if err := s.database.GetDB().Where("id = ?", fleetID).First(&fleet).Error; err != nil {
+		http.Error(w, "Fleet not found", http.StatusNotFound)
+		return
+	}
+
+	var software models.Software
+	if err := s.database.GetDB().Where("id = ?", r.URL.Query().Get("software_id")).First(&software).Error; err != nil {
+		http.Error(w, "Software not found", http.StatusNotFound)
+		return
+	}
+	version := r.URL.Query().Get("version")
+	if version == "" {
+		version = software.CurrentVersion
+	}
+
+	requirements, err := s.deployer.LoadRequirements(r.Context(), software, version)
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to load requirements of %s %s", software.ID, version), err)
+		http.Error(w, "Failed to load requirements", http.StatusInternalServerError)
+		return
+	}
+
+	var devices []models.Device
+	if err := s.database.GetDB().WithContext(r.Context()).
+		Where("fleet_id = ? AND status NOT IN ?", fleet.ID, append([]string{models.DeviceStatusPending}, retiredStatuses...)).
+		Order("name").Find(&devices).Error; err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to list devices of fleet %s", fleetID), err)
+		http.Error(w, "Failed to list devices", http.StatusInternalServerError)
+		return
+	}
+
+	report := UpgradeBlockers{
+		FleetID:            fleet.ID,
+		SoftwareID:         software.ID,
+		Version:            version,
+		Requirements:       requirements,
+		ServerRequirements: s.deployer.Requirements(),
+		Checked:            len(devices),
+		Devices:            []BlockingDevice{},
+	}
+	for i := range devices {
+		unmet := s.deployer.Unmet(&devices[i], software, version, requirements)
+		if len(unmet) == 0 {
+			continue
+		}
+		report.Devices = append(report.Devices, BlockingDevice{
+			DeviceID:     devices[i].DeviceID,
+			Name:         devices[i].Name,
+			AgentVersion: devices[i].AgentVersion,
+			OS:           devices[i].OS,
+			Unmet:        unmet,
+		})
+	}
+
+	jsonResponse(w, report, http.StatusOK)
+}
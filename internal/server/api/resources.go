@@ -0,0 +1,139 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+// maxResourceApps is the most software a fleet or device can set resource
+// limits for by name
+const maxResourceApps = 100
+
+// DeviceResourceLimits is the resource policy of a device and the limits its
+// applications get along with those of its fleet
+type DeviceResourceLimits struct {
+	models.ResourcePolicy
+	Effective models.ResourcePolicy `json:"effective"` // Those of the fleet with the device's over them
+}
+
+// validateResourcePolicy checks the resource limits of a fleet or device
+func validateResourcePolicy(policy models.ResourcePolicy) error {
+	if err := policy.Default.Validate(); err != nil {
+		return fmt.Errorf("default: %w", err)
+	}
+	if len(policy.Apps) > maxResourceApps {
+		return fmt.Errorf("limits can be set for at most %d software", maxResourceApps)
+	}
+	for name, limits := range policy.Apps {
+		if name == "" {
+			return fmt.Errorf("apps: software name is required")
+		}
+		if err := limits.Validate(); err != nil {
+			return fmt.Errorf("apps %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// decodeResourcePolicy reads the resource limits of a request, writing the
+// error response if they are invalid
+func decodeResourcePolicy(w http.ResponseWriter, r *http.Request) (models.ResourcePolicy, bool) {
+	var policy models.ResourcePolicy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return policy, false
+	}
+	if err := validateResourcePolicy(policy); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return policy, false
+	}
+	return policy, true
+}
+
+// handleFleetResourceLimits reads and replaces the resource limits of the
+// applications on the devices of a fleet. They apply from the next
+// deployment.
+func (s *Server) handleFleetResourceLimits(w http.ResponseWriter, r *http.Request) {
+	fleetID := r.PathValue("id")
+
+	var fleet models.Fleet
+	if err := s.database.GetDB().Where("id = ?", fleetID).First(&fleet).Error; err != nil {
+		http.Error(w, "Fleet not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		policy, ok := decodeResourcePolicy(w, r)
+		if !ok {
+			return
+		}
+		fleet.Resources = policy
+		if err := s.database.GetDB().Model(&fleet).Select("Resources").Updates(&fleet).Error; err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to update resource limits of fleet %s", fleetID), err)
+			http.Error(w, "Failed to update fleet", http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	jsonResponse(w, fleet.Resources, http.StatusOK)
+}
+
+// handleDeviceResourceLimits reads and replaces the resource limits of the
+// applications on a device, which override those of its fleet limit by
+// limit. They apply from the next deployment.
+func (s *Server) handleDeviceResourceLimits(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.PathValue("id")
+
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		policy, ok := decodeResourcePolicy(w, r)
+		if !ok {
+			return
+		}
+		device.Resources = policy
+		if err := s.database.GetDB().Model(&device).Select("Resources").Updates(&device).Error; err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to update resource limits of device %s", deviceID), err)
+			http.Error(w, "Failed to update device", http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var fleet models.ResourcePolicy
+	if device.FleetID != nil {
+		var f models.Fleet
+		if err := s.database.GetDB().Where("id = ?", *device.FleetID).First(&f).Error; err == nil {
+			fleet = f.Resources
+		}
+	}
+
+	effective := models.ResourcePolicy{
+		Default: fleet.Default.Over(device.Resources.Default),
+		Apps:    make(map[string]protocol.ResourceLimits),
+	}
+	for _, apps := range []map[string]protocol.ResourceLimits{fleet.Apps, device.Resources.Apps} {
+		for name := range apps {
+			effective.Apps[name] = fleet.For(name).Over(device.Resources.For(name))
+		}
+	}
+
+	jsonResponse(w, DeviceResourceLimits{ResourcePolicy: device.Resources, Effective: effective}, http.StatusOK)
+}
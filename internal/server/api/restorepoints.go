@@ -0,0 +1,256 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/edgetainer/edgetainer/internal/server/restorepoints"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+	"github.com/google/uuid"
+)
+
+// restorePointsKept is the number of restore points a device may have, they
+// can hold copies of large volumes
+const restorePointsKept = 10
+
+// RestorePointRequest creates a restore point of a device
+type RestorePointRequest struct {
+	Name    string   `json:"name"`
+	Apps    []string `json:"apps"`    // Applications to include, empty for all
+	Volumes bool     `json:"volumes"` // Copy their named volumes, stopping them meanwhile
+}
+
+// RestoreRequest restores applications of a restore point
+type RestoreRequest struct {
+	Apps []string `json:"apps"` // Empty for all in the restore point
+}
+
+// SetRestorePoints sets the service creating and restoring restore points
+func (s *Server) SetRestorePoints(service *restorepoints.Service) {
+	s.restorePoints = service
+}
+
+// handleDeviceRestorePoints lists the restore points of a device, newest
+// first, or starts creating a new one
+func (s *Server) handleDeviceRestorePoints(w http.ResponseWriter, r *http.Request) {
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", r.PathValue("id")).First(&device).Error; err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		var points []models.RestorePoint
+		if err := s.database.GetDB().Where("device_id = ?", device.ID).
+			Order("created_at DESC").Find(&points).Error; err != nil {
+			s.logger.Error("Failed to fetch restore points", err)
+			http.Error(w, "Failed to fetch restore points", http.StatusInternalServerError)
+			return
+		}
+		jsonResponse(w, points, http.StatusOK)
+
+	case http.MethodPost:
+		s.createRestorePoint(w, r, &device)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// createRestorePoint records a restore point and starts the job creating it
+// on the device
+func (s *Server) createRestorePoint(w http.ResponseWriter, r *http.Request, device *models.Device) {
+	user, _ := r.Context().Value("user").(models.User)
+	if user.Role != models.UserRoleAdmin && user.Role != models.UserRoleOperator {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var request RestorePointRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	request.Name = strings.TrimSpace(request.Name)
+	if request.Name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+
+	if _, connected := s.sshServer.GetDeviceConnection(device.DeviceID); !connected {
+		http.Error(w, "Device is not connected", http.StatusConflict)
+		return
+	}
+	if !protocol.HasFeature(device.AgentFeatures, protocol.FeatureRestorePoints) {
+		http.Error(w, fmt.Sprintf("Agent version %s does not support restore points", device.AgentVersion), http.StatusConflict)
+		return
+	}
+
+	var count int64
+	s.database.GetDB().Model(&models.RestorePoint{}).
+		Where("device_id = ? AND status <> ?", device.ID, models.RestorePointStatusFailed).Count(&count)
+	if count >= restorePointsKept {
+		http.Error(w, fmt.Sprintf("Device has %d restore points, delete one first", count), http.StatusConflict)
+		return
+	}
+
+	point := models.RestorePoint{
+		DeviceID:  device.ID,
+		Name:      request.Name,
+		Apps:      request.Apps,
+		Volumes:   request.Volumes,
+		Status:    models.RestorePointStatusCreating,
+		CreatedBy: user.Username,
+	}
+	if err := s.database.GetDB().Create(&point).Error; err != nil {
+		s.logger.Error("Failed to create restore point", err)
+		http.Error(w, "Failed to create restore point", http.StatusInternalServerError)
+		return
+	}
+
+	s.audit(r, models.AuditRestorePointCreate, device.DeviceID, "", map[string]interface{}{
+		"restore_point_id": point.ID.String(),
+		"name":             point.Name,
+		"apps":             point.Apps,
+		"volumes":          point.Volumes,
+	})
+
+	s.enqueue(w, r, restorepoints.JobCreate, restorepoints.JobPayload{RestorePointID: point.ID})
+}
+
+// handleDeviceRestorePoint returns or deletes a restore point. Deleting
+// removes it from the device too, which must be connected.
+func (s *Server) handleDeviceRestorePoint(w http.ResponseWriter, r *http.Request) {
+	device, point, ok := s.deviceRestorePoint(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		jsonResponse(w, point, http.StatusOK)
+
+	case http.MethodDelete:
+		user, _ := r.Context().Value("user").(models.User)
+		if user.Role != models.UserRoleAdmin && user.Role != models.UserRoleOperator {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if point.Status == models.RestorePointStatusCreating || point.Status == models.RestorePointStatusRestoring {
+			http.Error(w, fmt.Sprintf("Restore point is %s", point.Status), http.StatusConflict)
+			return
+		}
+
+		if err := s.restorePoints.Delete(r.Context(), point, device); err != nil {
+			if errors.Is(err, restorepoints.ErrDeviceNotConnected) {
+				http.Error(w, "Device is not connected", http.StatusConflict)
+				return
+			}
+			s.logger.Error(fmt.Sprintf("Failed to delete restore point %s of device %s", point.ID, device.DeviceID), err)
+			http.Error(w, fmt.Sprintf("Failed to delete restore point: %v", err), http.StatusBadGateway)
+			return
+		}
+		s.audit(r, models.AuditRestorePointDelete, device.DeviceID, "", map[string]interface{}{
+			"restore_point_id": point.ID.String(),
+			"name":             point.Name,
+		})
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleRestorePointRestore starts the job putting back the applications of
+// a restore point
+func (s *Server) handleRestorePointRestore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, _ := r.Context().Value("user").(models.User)
+	if user.Role != models.UserRoleAdmin && user.Role != models.UserRoleOperator {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	device, point, ok := s.deviceRestorePoint(w, r)
+	if !ok {
+		return
+	}
+
+	var request RestoreRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+	}
+	if point.Status != models.RestorePointStatusReady {
+		http.Error(w, fmt.Sprintf("Restore point is %s", point.Status), http.StatusConflict)
+		return
+	}
+	for _, app := range request.Apps {
+		found := false
+		for _, recorded := range point.Manifest.Apps {
+			found = found || recorded.Name == app
+		}
+		if !found {
+			http.Error(w, fmt.Sprintf("Application %s is not in the restore point", app), http.StatusBadRequest)
+			return
+		}
+	}
+	if _, connected := s.sshServer.GetDeviceConnection(device.DeviceID); !connected {
+		http.Error(w, "Device is not connected", http.StatusConflict)
+		return
+	}
+
+	// Only one restore at a time
+	result := s.database.GetDB().Model(point).Where("status = ?", models.RestorePointStatusReady).
+		Update("status", models.RestorePointStatusRestoring)
+	if result.Error != nil {
+		s.logger.Error("Failed to update restore point", result.Error)
+		http.Error(w, "Failed to update restore point", http.StatusInternalServerError)
+		return
+	}
+	if result.RowsAffected == 0 {
+		http.Error(w, "Restore point is being restored", http.StatusConflict)
+		return
+	}
+
+	s.audit(r, models.AuditRestorePointRestore, device.DeviceID, "", map[string]interface{}{
+		"restore_point_id": point.ID.String(),
+		"name":             point.Name,
+		"apps":             request.Apps,
+	})
+
+	s.enqueue(w, r, restorepoints.JobRestore, restorepoints.JobPayload{RestorePointID: point.ID, Apps: request.Apps})
+}
+
+// deviceRestorePoint looks up the device and restore point of a request,
+// writing the error response if either is unknown
+func (s *Server) deviceRestorePoint(w http.ResponseWriter, r *http.Request) (*models.Device, *models.RestorePoint, bool) {
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", r.PathValue("id")).First(&device).Error; err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+
+	pointID, err := uuid.Parse(r.PathValue("point"))
+	if err != nil {
+		http.Error(w, "Restore point not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+	var point models.RestorePoint
+	if err := s.database.GetDB().Where("id = ? AND device_id = ?", pointID, device.ID).First(&point).Error; err != nil {
+		http.Error(w, "Restore point not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+	return &device, &point, true
+}
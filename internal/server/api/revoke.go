@@ -0,0 +1,109 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"golang.org/x/crypto/ssh"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// RevokeDeviceRequest represents a request to revoke the key of a device
+type RevokeDeviceRequest struct {
+	Reason string `json:"reason"`
+}
+
+// RevokeDeviceResponse reports the outcome of a revocation
+type RevokeDeviceResponse struct {
+	Fingerprint  string `json:"fingerprint"`
+	Disconnected bool   `json:"disconnected"` // The device was connected and got cut off
+}
+
+// handleDeviceRevoke revokes the key of a device, e.g. after it was stolen.
+// The key is turned away from then on, a connection using it is closed at
+// once and the revocation is recorded in the audit log.
+func (s *Server) handleDeviceRevoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	deviceID := r.PathValue("id")
+	user, _ := r.Context().Value("user").(models.User)
+
+	var request RevokeDeviceRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if request.Reason == "" {
+		http.Error(w, "Reason is required", http.StatusBadRequest)
+		return
+	}
+
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	if device.Status == models.DeviceStatusRevoked {
+		http.Error(w, "Device is already revoked", http.StatusConflict)
+		return
+	}
+
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(device.SSHPublicKey))
+	if err != nil {
+		http.Error(w, "Device has no valid key to revoke", http.StatusConflict)
+		return
+	}
+	fingerprint := ssh.FingerprintSHA256(key)
+
+	err = s.database.GetDB().Transaction(func(tx *gorm.DB) error {
+		revoked := models.RevokedKey{
+			DeviceID:    deviceID,
+			Fingerprint: fingerprint,
+			Reason:      request.Reason,
+			RevokedBy:   user.Username,
+		}
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&revoked).Error; err != nil {
+			return err
+		}
+		return tx.Model(&device).Update("status", models.DeviceStatusRevoked).Error
+	})
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to revoke device %s", deviceID), err)
+		http.Error(w, "Failed to revoke device", http.StatusInternalServerError)
+		return
+	}
+
+	disconnected := s.sshServer.RevokeDevice(deviceID, fingerprint, request.Reason)
+	s.syncDNS()
+	s.logger.Warn(fmt.Sprintf("Device %s revoked by %s: %s", deviceID, user.Username, request.Reason))
+
+	s.audit(r, models.AuditDeviceRevoke, deviceID, request.Reason, map[string]interface{}{
+		"fingerprint":  fingerprint,
+		"disconnected": disconnected,
+	})
+
+	jsonResponse(w, RevokeDeviceResponse{Fingerprint: fingerprint, Disconnected: disconnected}, http.StatusOK)
+}
+
+// handleAdminRevocations lists the revoked device keys
+func (s *Server) handleAdminRevocations(w http.ResponseWriter, r *http.Request) {
+	query := s.database.GetDB()
+	if deviceID := r.URL.Query().Get("device_id"); deviceID != "" {
+		query = query.Where("device_id = ?", deviceID)
+	}
+
+	var keys []models.RevokedKey
+	if err := query.Order("created_at DESC").Find(&keys).Error; err != nil {
+		s.logger.Error("Failed to fetch revoked keys", err)
+		http.Error(w, "Failed to fetch revoked keys", http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse(w, keys, http.StatusOK)
+}
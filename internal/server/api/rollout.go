@@ -0,0 +1,266 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/server/deploy"
+	"github.com/edgetainer/edgetainer/internal/server/envschema"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// RolloutRequest represents a request to deploy software to a whole fleet
+type RolloutRequest struct {
+	SoftwareID    uuid.UUID `json:"software_id"`
+	Version       string    `json:"version,omitempty"`        // Defaults to the software's current version
+	MaxConcurrent int       `json:"max_concurrent,omitempty"` // Defaults to the fleet's limit, -1 for all devices at once
+	MaxAttempts   int       `json:"max_attempts,omitempty"`   // Per device, defaults to 1 for no retries
+	RetryBackoff  int       `json:"retry_backoff,omitempty"`  // Seconds before the first retry, defaults to 30
+}
+
+// RolloutRetryRequest represents a request to retry the failed devices of a rollout
+type RolloutRetryRequest struct {
+	IncludeSkipped bool `json:"include_skipped"` // Also retry devices that were not connected
+}
+
+// RolloutValidationError reports the device whose env vars prevent a rollout
+type RolloutValidationError struct {
+	DeviceID string                 `json:"device_id"`
+	Fields   []envschema.FieldError `json:"fields"`
+}
+
+// handleFleetRollouts handles listing and starting the rollouts of a fleet
+func (s *Server) handleFleetRollouts(w http.ResponseWriter, r *http.Request) {
+	fleetID := r.PathValue("id")
+
+	var fleet models.Fleet
+	if err := s.database.GetDB().Where("id = ?", fleetID).First(&fleet).Error; err != nil {
+		http.Error(w, "Fleet not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		var rollouts []models.Rollout
+		if err := s.database.GetDB().Where("fleet_id = ?", fleet.ID).Order("created_at DESC").Find(&rollouts).Error; err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to fetch rollouts of fleet %s", fleetID), err)
+			http.Error(w, "Failed to fetch rollouts", http.StatusInternalServerError)
+			return
+		}
+
+		jsonResponse(w, rollouts, http.StatusOK)
+
+	case http.MethodPost:
+		var request RolloutRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		if request.MaxConcurrent < -1 {
+			http.Error(w, "max_concurrent must be -1, 0 or positive", http.StatusBadRequest)
+			return
+		}
+
+		var software models.Software
+		if err := s.database.GetDB().Where("id = ?", request.SoftwareID).First(&software).Error; err != nil {
+			http.Error(w, "Software not found", http.StatusBadRequest)
+			return
+		}
+
+		retry := deploy.RetryPolicy{
+			MaxAttempts: request.MaxAttempts,
+			Backoff:     time.Duration(request.RetryBackoff) * time.Second,
+		}
+
+		if fleet.RequireApproval {
+			if err := retry.Validate(); err != nil {
+				http.Error(w, "Invalid retry policy: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			version := request.Version
+			if version == "" {
+				version = software.CurrentVersion
+			}
+			s.requestApproval(w, r, &models.DeploymentApproval{
+				FleetID:       fleet.ID,
+				SoftwareID:    software.ID,
+				Version:       version,
+				MaxConcurrent: request.MaxConcurrent,
+				MaxAttempts:   request.MaxAttempts,
+				RetryBackoff:  request.RetryBackoff,
+			}, "", &software)
+			return
+		}
+
+		rollout, err := s.deployer.StartRollout(r.Context(), &fleet, &software, request.Version, request.MaxConcurrent, retry)
+		if err != nil {
+			s.rolloutFailed(w, fleetID, err)
+			return
+		}
+
+		jsonResponse(w, rollout, http.StatusAccepted)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// rolloutFailed reports why a rollout could not start
+func (s *Server) rolloutFailed(w http.ResponseWriter, fleetID string, err error) {
+	if frozenFailed(w, err) {
+		return
+	}
+
+	var deviceErr *deploy.DeviceError
+	var validationErr *envschema.ValidationError
+	switch {
+	case errors.Is(err, deploy.ErrInvalidRetryPolicy):
+		http.Error(w, "Invalid retry policy: "+err.Error(), http.StatusBadRequest)
+	case errors.Is(err, deploy.ErrEmptyFleet):
+		http.Error(w, "Fleet has no devices", http.StatusConflict)
+	case errors.As(err, &deviceErr) && errors.As(err, &validationErr):
+		jsonResponse(w, RolloutValidationError{DeviceID: deviceErr.DeviceID, Fields: validationErr.Fields}, http.StatusUnprocessableEntity)
+	default:
+		s.logger.Error(fmt.Sprintf("Failed to start rollout on fleet %s", fleetID), err)
+		http.Error(w, "Failed to start rollout", http.StatusInternalServerError)
+	}
+}
+
+// handleRolloutByID returns the progress of a rollout
+func (s *Server) handleRolloutByID(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rolloutID, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Rollout not found", http.StatusNotFound)
+		return
+	}
+
+	progress, err := s.deployer.RolloutProgress(r.Context(), rolloutID)
+	if err != nil {
+		http.Error(w, "Rollout not found", http.StatusNotFound)
+		return
+	}
+
+	jsonResponse(w, progress, http.StatusOK)
+}
+
+// handleRolloutCancel stops a rollout from deploying to more devices
+func (s *Server) handleRolloutCancel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rolloutID, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Rollout not found", http.StatusNotFound)
+		return
+	}
+
+	if err := s.deployer.CancelRollout(r.Context(), rolloutID); err != nil {
+		if errors.Is(err, deploy.ErrRolloutNotRunning) {
+			http.Error(w, "Rollout is not running", http.StatusConflict)
+			return
+		}
+		s.logger.Error(fmt.Sprintf("Failed to cancel rollout %s", rolloutID), err)
+		http.Error(w, "Failed to cancel rollout", http.StatusInternalServerError)
+		return
+	}
+
+	progress, err := s.deployer.RolloutProgress(r.Context(), rolloutID)
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to fetch rollout %s", rolloutID), err)
+		http.Error(w, "Failed to fetch rollout", http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse(w, progress, http.StatusOK)
+}
+
+// handleRolloutRetry runs an ended rollout again for its failed devices
+func (s *Server) handleRolloutRetry(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rolloutID, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Rollout not found", http.StatusNotFound)
+		return
+	}
+
+	var request RolloutRetryRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if _, err := s.deployer.RetryFailed(r.Context(), rolloutID, request.IncludeSkipped); err != nil {
+		if frozenFailed(w, err) {
+			return
+		}
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			http.Error(w, "Rollout not found", http.StatusNotFound)
+		case errors.Is(err, deploy.ErrRolloutRunning):
+			http.Error(w, "Rollout is still running", http.StatusConflict)
+		case errors.Is(err, deploy.ErrNothingToRetry):
+			http.Error(w, "Rollout has no devices to retry", http.StatusConflict)
+		default:
+			s.logger.Error(fmt.Sprintf("Failed to retry rollout %s", rolloutID), err)
+			http.Error(w, "Failed to retry rollout", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	progress, err := s.deployer.RolloutProgress(r.Context(), rolloutID)
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to fetch rollout %s", rolloutID), err)
+		http.Error(w, "Failed to fetch rollout", http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse(w, progress, http.StatusAccepted)
+}
+
+// handleRolloutFailures lists the devices of a rollout that were not deployed
+func (s *Server) handleRolloutFailures(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rolloutID, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Rollout not found", http.StatusNotFound)
+		return
+	}
+
+	var rollout models.Rollout
+	if err := s.database.GetDB().Where("id = ?", rolloutID).First(&rollout).Error; err != nil {
+		http.Error(w, "Rollout not found", http.StatusNotFound)
+		return
+	}
+
+	failures, err := s.deployer.RolloutFailures(r.Context(), rolloutID)
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to fetch failures of rollout %s", rolloutID), err)
+		http.Error(w, "Failed to fetch rollout failures", http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse(w, failures, http.StatusOK)
+}
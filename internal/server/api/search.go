@@ -0,0 +1,282 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Search result types
+const (
+	SearchTypeDevice   = "device"
+	SearchTypeFleet    = "fleet"
+	SearchTypeSoftware = "software"
+)
+
+const (
+	// searchMinLength is the shortest query searched for. Trigram indexes
+	// only narrow down queries of three characters or more, two character
+	// queries fall back to a sequential scan.
+	searchMinLength = 2
+	// searchDefaultLimit is the number of results per type by default
+	searchDefaultLimit = 10
+	// searchMaxLimit is the highest number of results per type
+	searchMaxLimit = 50
+)
+
+// SearchResult is one match of a search
+type SearchResult struct {
+	Type   string `json:"type"`   // device, fleet or software
+	ID     string `json:"id"`     // Device ID for devices, UUID otherwise
+	Name   string `json:"name"`   // Display name
+	Detail string `json:"detail"` // Secondary text, e.g. the status and IP of a device
+	Match  string `json:"match"`  // Field that matched the query
+}
+
+// SearchResponse is the response of a search
+type SearchResponse struct {
+	Query   string         `json:"query"`
+	Results []SearchResult `json:"results"`
+}
+
+// searchQuery is a parsed search query
+type searchQuery struct {
+	text    string     // The query as given, trimmed
+	pattern string     // ILIKE pattern matching the text anywhere
+	words   string     // Prefix tsquery of the words of the text, empty if it has none
+	id      *uuid.UUID // Set when the text is a UUID
+}
+
+// parseSearchQuery prepares a query for the search statements
+func parseSearchQuery(text string) searchQuery {
+	query := searchQuery{
+		text:    text,
+		pattern: "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(text) + "%",
+	}
+
+	// Only letters and digits make it into the tsquery, so it cannot be
+	// malformed
+	words := strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for i, word := range words {
+		words[i] = word + ":*"
+	}
+	query.words = strings.Join(words, " & ")
+
+	if id, err := uuid.Parse(text); err == nil {
+		query.id = &id
+	}
+	return query
+}
+
+// containsFold reports whether value contains the query text, ignoring case
+func (q searchQuery) containsFold(value string) bool {
+	return strings.Contains(strings.ToLower(value), strings.ToLower(q.text))
+}
+
+// handleSearch searches devices, fleets and software for an omnibox. Devices
+// match on their name, device ID, IP address and custom field values, fleets
+// on their name and software on its name and current version. Results are
+// grouped by type, best matches first.
+func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	text := strings.TrimSpace(r.URL.Query().Get("q"))
+	if utf8.RuneCountInString(text) < searchMinLength {
+		http.Error(w, fmt.Sprintf("Query must be at least %d characters", searchMinLength), http.StatusBadRequest)
+		return
+	}
+
+	limit := searchDefaultLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > searchMaxLimit {
+			http.Error(w, fmt.Sprintf("Limit must be between 1 and %d", searchMaxLimit), http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	types := map[string]bool{SearchTypeDevice: true, SearchTypeFleet: true, SearchTypeSoftware: true}
+	if value := r.URL.Query().Get("types"); value != "" {
+		types = make(map[string]bool)
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name != SearchTypeDevice && name != SearchTypeFleet && name != SearchTypeSoftware {
+				http.Error(w, fmt.Sprintf("Unknown result type %s", name), http.StatusBadRequest)
+				return
+			}
+			types[name] = true
+		}
+	}
+
+	query := parseSearchQuery(text)
+	db := s.database.GetDB().WithContext(r.Context())
+	response := SearchResponse{Query: text, Results: []SearchResult{}}
+
+	if types[SearchTypeDevice] {
+		results, err := searchDevices(db, query, limit)
+		if err != nil {
+			s.logger.Error("Failed to search devices", err)
+			http.Error(w, "Failed to search", http.StatusInternalServerError)
+			return
+		}
+		response.Results = append(response.Results, results...)
+	}
+
+	if types[SearchTypeFleet] {
+		results, err := searchFleets(db, query, limit)
+		if err != nil {
+			s.logger.Error("Failed to search fleets", err)
+			http.Error(w, "Failed to search", http.StatusInternalServerError)
+			return
+		}
+		response.Results = append(response.Results, results...)
+	}
+
+	if types[SearchTypeSoftware] {
+		results, err := searchSoftware(db, query, limit)
+		if err != nil {
+			s.logger.Error("Failed to search software", err)
+			http.Error(w, "Failed to search", http.StatusInternalServerError)
+			return
+		}
+		response.Results = append(response.Results, results...)
+	}
+
+	jsonResponse(w, response, http.StatusOK)
+}
+
+// orderBy orders by an expression with arguments, such as the similarity of
+// a column to the query
+func orderBy(sql string, vars ...interface{}) clause.OrderBy {
+	return clause.OrderBy{Expression: clause.Expr{SQL: sql, Vars: vars, WithoutParentheses: true}}
+}
+
+// searchDevices finds devices by name, device ID, IP address or custom field
+// value. The expressions match the search indexes created by the migration.
+func searchDevices(db *gorm.DB, query searchQuery, limit int) ([]SearchResult, error) {
+	conditions := []string{"name ILIKE @pattern", "device_id ILIKE @pattern", "ip_address ILIKE @pattern"}
+	if query.words != "" {
+		conditions = append(conditions, "to_tsvector('simple', coalesce(custom_fields, '{}'::jsonb)) @@ to_tsquery('simple', @words)")
+	}
+	if query.id != nil {
+		conditions = append(conditions, "id = @id")
+	}
+
+	var devices []models.Device
+	err := db.Where(strings.Join(conditions, " OR "), map[string]interface{}{
+		"pattern": query.pattern,
+		"words":   query.words,
+		"id":      query.id,
+	}).
+		Clauses(orderBy("greatest(similarity(name, ?), similarity(device_id, ?)) DESC, name", query.text, query.text)).
+		Limit(limit).Find(&devices).Error
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]SearchResult, 0, len(devices))
+	for _, device := range devices {
+		detail := device.Status
+		if device.IPAddress != "" {
+			detail += ", " + device.IPAddress
+		}
+
+		match := "custom_fields"
+		switch {
+		case query.containsFold(device.Name):
+			match = "name"
+		case query.containsFold(device.DeviceID):
+			match = "device_id"
+		case query.containsFold(device.IPAddress):
+			match = "ip_address"
+		case query.id != nil && device.ID == *query.id:
+			match = "id"
+		}
+
+		results = append(results, SearchResult{
+			Type:   SearchTypeDevice,
+			ID:     device.DeviceID,
+			Name:   device.Name,
+			Detail: detail,
+			Match:  match,
+		})
+	}
+	return results, nil
+}
+
+// searchFleets finds fleets by name
+func searchFleets(db *gorm.DB, query searchQuery, limit int) ([]SearchResult, error) {
+	search := db.Where("name ILIKE ?", query.pattern)
+	if query.id != nil {
+		search = search.Or("id = ?", *query.id)
+	}
+
+	var fleets []models.Fleet
+	if err := search.Clauses(orderBy("similarity(name, ?) DESC, name", query.text)).
+		Limit(limit).Find(&fleets).Error; err != nil {
+		return nil, err
+	}
+
+	results := make([]SearchResult, 0, len(fleets))
+	for _, fleet := range fleets {
+		match := "name"
+		if !query.containsFold(fleet.Name) {
+			match = "id"
+		}
+		results = append(results, SearchResult{
+			Type:   SearchTypeFleet,
+			ID:     fleet.ID.String(),
+			Name:   fleet.Name,
+			Detail: fleet.Description,
+			Match:  match,
+		})
+	}
+	return results, nil
+}
+
+// searchSoftware finds software by name or current version
+func searchSoftware(db *gorm.DB, query searchQuery, limit int) ([]SearchResult, error) {
+	search := db.Where("name ILIKE ? OR current_version ILIKE ?", query.pattern, query.pattern)
+	if query.id != nil {
+		search = search.Or("id = ?", *query.id)
+	}
+
+	var software []models.Software
+	if err := search.Clauses(orderBy("greatest(similarity(name, ?), similarity(current_version, ?)) DESC, name", query.text, query.text)).
+		Limit(limit).Find(&software).Error; err != nil {
+		return nil, err
+	}
+
+	results := make([]SearchResult, 0, len(software))
+	for _, item := range software {
+		match := "id"
+		switch {
+		case query.containsFold(item.Name):
+			match = "name"
+		case query.containsFold(item.CurrentVersion):
+			match = "version"
+		}
+		results = append(results, SearchResult{
+			Type:   SearchTypeSoftware,
+			ID:     item.ID.String(),
+			Name:   item.Name,
+			Detail: item.CurrentVersion,
+			Match:  match,
+		})
+	}
+	return results, nil
+}
@@ -0,0 +1,310 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/edgetainer/edgetainer/internal/server/deploy"
+	"github.com/edgetainer/edgetainer/internal/server/envschema"
+	"github.com/edgetainer/edgetainer/internal/server/secrets"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/google/uuid"
+)
+
+// SecretStoreRequest represents a request to create or update a secret store
+type SecretStoreRequest struct {
+	Name    string            `json:"name"`
+	Type    string            `json:"type"`
+	FleetID *uuid.UUID        `json:"fleet_id,omitempty"` // Empty for a global store
+	Config  map[string]string `json:"config"`
+}
+
+// SecretStoreResponse represents a secret store with sensitive settings masked
+type SecretStoreResponse struct {
+	ID      uuid.UUID         `json:"id"`
+	Name    string            `json:"name"`
+	Type    string            `json:"type"`
+	FleetID *uuid.UUID        `json:"fleet_id,omitempty"`
+	Config  map[string]string `json:"config"`
+}
+
+// RegistryCredentialRequest represents a request to add registry credentials
+type RegistryCredentialRequest struct {
+	Server   string     `json:"server"`
+	Username string     `json:"username"`
+	Password string     `json:"password"` // Plain value or secret://<store>/<path>#<key>
+	FleetID  *uuid.UUID `json:"fleet_id,omitempty"`
+}
+
+// validate checks the secret store request for errors, including whether the
+// store client can be configured from it
+func (req *SecretStoreRequest) validate() error {
+	if req.Name == "" {
+		return fmt.Errorf("store name is required")
+	}
+
+	config, _ := json.Marshal(req.Config)
+	if _, err := secrets.NewStore(req.Type, string(config)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// handleSecretStores handles the secret stores endpoint
+func (s *Server) handleSecretStores(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		var stores []models.SecretStore
+		if err := s.database.GetDB().Find(&stores).Error; err != nil {
+			s.logger.Error("Failed to fetch secret stores", err)
+			http.Error(w, "Failed to fetch secret stores", http.StatusInternalServerError)
+			return
+		}
+
+		response := make([]SecretStoreResponse, 0, len(stores))
+		for _, store := range stores {
+			response = append(response, secretStoreResponse(store))
+		}
+
+		jsonResponse(w, response, http.StatusOK)
+
+	case http.MethodPost:
+		var request SecretStoreRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		if err := request.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if s.secretStoreExists(request.Name, request.FleetID, uuid.Nil) {
+			http.Error(w, "A secret store with this name already exists", http.StatusConflict)
+			return
+		}
+
+		config, _ := json.Marshal(request.Config)
+		store := models.SecretStore{
+			Name:    request.Name,
+			Type:    request.Type,
+			FleetID: request.FleetID,
+			Config:  string(config),
+		}
+
+		if err := s.database.GetDB().Create(&store).Error; err != nil {
+			s.logger.Error("Failed to create secret store", err)
+			http.Error(w, "Failed to create secret store", http.StatusInternalServerError)
+			return
+		}
+
+		jsonResponse(w, secretStoreResponse(store), http.StatusCreated)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleSecretStoreByID handles the secret store by ID endpoint
+func (s *Server) handleSecretStoreByID(w http.ResponseWriter, r *http.Request) {
+	storeID := r.PathValue("id")
+
+	var store models.SecretStore
+	if err := s.database.GetDB().Where("id = ?", storeID).First(&store).Error; err != nil {
+		http.Error(w, "Secret store not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		jsonResponse(w, secretStoreResponse(store), http.StatusOK)
+
+	case http.MethodPut:
+		var request SecretStoreRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		// Masked settings sent back by a client keep their stored value,
+		// unless the store now points elsewhere: the credentials would be
+		// sent there, so they must be entered again
+		previous := deploy.DecodeEnvVars(store.Config)
+		retargeted := request.Type != store.Type
+		for _, key := range secrets.TargetConfigKeys {
+			if request.Config[key] != previous[key] {
+				retargeted = true
+			}
+		}
+		for key, value := range request.Config {
+			if value != envschema.Mask {
+				continue
+			}
+			if retargeted {
+				http.Error(w, fmt.Sprintf("Enter %s again when changing the type, address or endpoint of a store", key), http.StatusBadRequest)
+				return
+			}
+			request.Config[key] = previous[key]
+		}
+
+		if err := request.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if s.secretStoreExists(request.Name, request.FleetID, store.ID) {
+			http.Error(w, "A secret store with this name already exists", http.StatusConflict)
+			return
+		}
+
+		config, _ := json.Marshal(request.Config)
+		store.Name = request.Name
+		store.Type = request.Type
+		store.FleetID = request.FleetID
+		store.Config = string(config)
+
+		if err := s.database.GetDB().Save(&store).Error; err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to update secret store %s", storeID), err)
+			http.Error(w, "Failed to update secret store", http.StatusInternalServerError)
+			return
+		}
+
+		jsonResponse(w, secretStoreResponse(store), http.StatusOK)
+
+	case http.MethodDelete:
+		if err := s.database.GetDB().Delete(&store).Error; err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to delete secret store %s", storeID), err)
+			http.Error(w, "Failed to delete secret store", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleRegistryCredentials handles the registry credentials endpoint
+func (s *Server) handleRegistryCredentials(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		var credentials []models.RegistryCredential
+		if err := s.database.GetDB().Find(&credentials).Error; err != nil {
+			s.logger.Error("Failed to fetch registry credentials", err)
+			http.Error(w, "Failed to fetch registry credentials", http.StatusInternalServerError)
+			return
+		}
+
+		// Only references to secret stores are safe to show
+		for i := range credentials {
+			if !secrets.IsReference(credentials[i].Password) {
+				credentials[i].Password = envschema.Mask
+			}
+		}
+
+		jsonResponse(w, credentials, http.StatusOK)
+
+	case http.MethodPost:
+		var request RegistryCredentialRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		if request.Server == "" || request.Username == "" || request.Password == "" {
+			http.Error(w, "Server, username and password are required", http.StatusBadRequest)
+			return
+		}
+
+		if secrets.IsReference(request.Password) {
+			if _, err := secrets.ParseReference(request.Password); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		credential := models.RegistryCredential{
+			Server:   request.Server,
+			Username: request.Username,
+			Password: request.Password,
+			FleetID:  request.FleetID,
+		}
+
+		if err := s.database.GetDB().Create(&credential).Error; err != nil {
+			s.logger.Error("Failed to create registry credential", err)
+			http.Error(w, "Failed to create registry credential", http.StatusInternalServerError)
+			return
+		}
+
+		if !secrets.IsReference(credential.Password) {
+			credential.Password = envschema.Mask
+		}
+		jsonResponse(w, credential, http.StatusCreated)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleRegistryCredentialByID handles deleting registry credentials
+func (s *Server) handleRegistryCredentialByID(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	credentialID := r.PathValue("id")
+
+	result := s.database.GetDB().Where("id = ?", credentialID).Delete(&models.RegistryCredential{})
+	if result.Error != nil {
+		s.logger.Error(fmt.Sprintf("Failed to delete registry credential %s", credentialID), result.Error)
+		http.Error(w, "Failed to delete registry credential", http.StatusInternalServerError)
+		return
+	}
+
+	if result.RowsAffected == 0 {
+		http.Error(w, "Registry credential not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// secretStoreExists reports whether another store has the same name in the
+// same scope
+func (s *Server) secretStoreExists(name string, fleetID *uuid.UUID, exclude uuid.UUID) bool {
+	query := s.database.GetDB().Model(&models.SecretStore{}).Where("name = ? AND id <> ?", name, exclude)
+	if fleetID != nil {
+		query = query.Where("fleet_id = ?", *fleetID)
+	} else {
+		query = query.Where("fleet_id IS NULL")
+	}
+
+	var count int64
+	if err := query.Count(&count).Error; err != nil {
+		return false
+	}
+	return count > 0
+}
+
+// secretStoreResponse builds a store response with sensitive settings masked
+func secretStoreResponse(store models.SecretStore) SecretStoreResponse {
+	config := deploy.DecodeEnvVars(store.Config)
+	for _, key := range secrets.SensitiveConfigKeys {
+		if config[key] != "" {
+			config[key] = envschema.Mask
+		}
+	}
+
+	return SecretStoreResponse{
+		ID:      store.ID,
+		Name:    store.Name,
+		Type:    store.Type,
+		FleetID: store.FleetID,
+		Config:  config,
+	}
+}
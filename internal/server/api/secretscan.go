@@ -0,0 +1,142 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/edgetainer/edgetainer/internal/server/deploy"
+	"github.com/edgetainer/edgetainer/internal/server/envschema"
+	"github.com/edgetainer/edgetainer/internal/shared/config"
+	"github.com/edgetainer/edgetainer/internal/shared/credentials"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+)
+
+// SecretScanRequest asks which credentials a compose file and env vars
+// hold, e.g. from CI before uploading them
+type SecretScanRequest struct {
+	ComposeYAML string            `json:"compose_yaml"`
+	EnvVars     map[string]string `json:"env_vars"`
+}
+
+// SecretScanResponse lists the credentials found and what uploading them
+// would do under the server's policy
+type SecretScanResponse struct {
+	Policy   string                `json:"policy"`
+	Findings []credentials.Finding `json:"findings"`
+}
+
+// SecretScanError refuses an upload holding credentials
+type SecretScanError struct {
+	Error    string                `json:"error"`
+	Findings []credentials.Finding `json:"findings"`
+}
+
+// SetSecretScanPolicy sets what happens to uploads holding credentials, see
+// config.SecretScanWarn
+func (s *Server) SetSecretScanPolicy(policy string) {
+	s.secretScan = policy
+}
+
+// handleSecretScan scans a compose file and env vars without saving them
+func (s *Server) handleSecretScan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request SecretScanRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	findings, err := scanUpload(request.ComposeYAML, request.EnvVars, "env_vars")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if findings == nil {
+		findings = []credentials.Finding{}
+	}
+
+	jsonResponse(w, SecretScanResponse{Policy: s.secretScan, Findings: findings}, http.StatusOK)
+}
+
+// scanUpload returns the credentials in a compose file and env vars, whose
+// findings are located below envLocation. Masked values sent back by forms
+// are not scanned.
+func scanUpload(composeYAML string, envVars map[string]string, envLocation string) ([]credentials.Finding, error) {
+	var findings []credentials.Finding
+	if strings.TrimSpace(composeYAML) != "" {
+		found, err := credentials.ScanYAML(composeYAML)
+		if err != nil {
+			return nil, err
+		}
+		findings = append(findings, found...)
+	}
+	return append(findings, credentials.ScanEnv(envVars, envLocation)...), nil
+}
+
+// checkCredentials applies the secret scan policy to the credentials found
+// in an upload. Under warn the request goes on with a Warning header per
+// finding; under block it is refused and false returned.
+func (s *Server) checkCredentials(w http.ResponseWriter, r *http.Request, what string, findings []credentials.Finding) bool {
+	if len(findings) == 0 || s.secretScan == config.SecretScanOff {
+		return true
+	}
+
+	user, _ := r.Context().Value("user").(models.User)
+	described := make([]string, len(findings))
+	for i, f := range findings {
+		described[i] = f.String()
+	}
+
+	if s.secretScan == config.SecretScanBlock {
+		s.logger.Warn(fmt.Sprintf("Refused %s from %s holding credentials: %s", what, user.Username, strings.Join(described, ", ")))
+		jsonResponse(w, SecretScanError{
+			Error:    fmt.Sprintf("%s holds credentials, refer to them with ${VAR} or a secret store instead", what),
+			Findings: findings,
+		}, http.StatusUnprocessableEntity)
+		return false
+	}
+
+	s.logger.Warn(fmt.Sprintf("Saving %s from %s holding credentials: %s", what, user.Username, strings.Join(described, ", ")))
+	for _, d := range described {
+		w.Header().Add("Warning", "199 edgetainer "+strconv.Quote("credential found: "+d))
+	}
+	return true
+}
+
+// redactSoftware replaces the credentials in the compose file and default
+// env vars of a software before it is returned
+func redactSoftware(software *models.Software) {
+	software.DockerComposeYAML = redactCompose(software.DockerComposeYAML)
+	if values := deploy.DecodeEnvVars(software.DefaultEnvVars); len(values) > 0 {
+		masked, _ := json.Marshal(credentials.MaskEnv(values, envschema.Mask))
+		software.DefaultEnvVars = string(masked)
+	}
+}
+
+// redactDeployments masks the credentials in the env vars of deployments
+// before they are returned
+func redactDeployments(deployments []models.Deployment) {
+	for i := range deployments {
+		if values := deploy.DecodeEnvVars(deployments[i].EnvVars); len(values) > 0 {
+			masked, _ := json.Marshal(credentials.MaskEnv(values, envschema.Mask))
+			deployments[i].EnvVars = string(masked)
+		}
+	}
+}
+
+// redactCompose replaces the credentials in a compose file or override
+// before it is returned. Files that cannot be parsed are redacted like text.
+func redactCompose(composeYAML string) string {
+	redacted, err := credentials.RedactYAML(composeYAML)
+	if err != nil {
+		return credentials.Redact(composeYAML)
+	}
+	return redacted
+}
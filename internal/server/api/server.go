@@ -3,76 +3,278 @@ package api
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/edgetainer/edgetainer/internal/server/artifacts"
 	"github.com/edgetainer/edgetainer/internal/server/db"
+	"github.com/edgetainer/edgetainer/internal/server/deploy"
+	"github.com/edgetainer/edgetainer/internal/server/dns"
+	"github.com/edgetainer/edgetainer/internal/server/events"
+	"github.com/edgetainer/edgetainer/internal/server/extensions"
+	"github.com/edgetainer/edgetainer/internal/server/jobs"
+	"github.com/edgetainer/edgetainer/internal/server/mail"
+	"github.com/edgetainer/edgetainer/internal/server/restorepoints"
+	"github.com/edgetainer/edgetainer/internal/server/sitecache"
 	"github.com/edgetainer/edgetainer/internal/server/ssh"
+	"github.com/edgetainer/edgetainer/internal/server/storage"
+	"github.com/edgetainer/edgetainer/internal/shared/config"
 	"github.com/edgetainer/edgetainer/internal/shared/logging"
 )
 
 // Server represents the API server
 type Server struct {
-	host       string
-	port       int
-	httpServer *http.Server
-	database   *db.DB
-	sshServer  *ssh.Server
-	logger     *logging.Logger
-	ctx        context.Context
-	cancelFunc context.CancelFunc
+	host          string
+	port          int
+	httpServer    *http.Server
+	database      *db.DB
+	sshServer     *ssh.Server
+	deployer      *deploy.Service
+	caches        *sitecache.Service
+	logger        *logging.Logger
+	metrics       *metricsSettings
+	cache         *responseCache
+	deviceKeyType string               // Type of the keys generated for new devices
+	deviceKeyBits int                  // Size of generated RSA keys, 0 for the default
+	dns           *dns.Manager         // Keeps DNS records of device subdomains, nil unless enabled
+	jobs          *jobs.Queue          // Runs long-running operations in the background
+	bus           *events.Bus          // Streamed over the events WebSocket
+	version       VersionInfo          // Returned by /api/version
+	extensions    *extensions.Registry // Enrollment validators and auth backends, nil for none
+	artifacts     *artifacts.Storage   // Software artifacts, nil unless configured
+	objects       storage.Store        // Archived logs, bundles and captures, nil keeps them in the database
+	approvalTTL   time.Duration        // How long deploys wait for approval, zero for no limit
+	mailer        *mail.Sender         // Sends invitations, nil unless SMTP is configured
+	inviteTTL     time.Duration        // How long invitation links can be used
+	restorePoints *restorepoints.Service
+	secretScan    string       // Policy for credentials in uploads, see config.SecretScanWarn
+	uniqueNames   string       // Scope device names are unique in, see config.DeviceNamesFleet
+	draining      *atomic.Bool // Set once the server is shutting down, nil for never
+	setup         setupState
+	ctx           context.Context
+	cancelFunc    context.CancelFunc
 }
 
 // NewServer creates a new API server
-func NewServer(ctx context.Context, host string, port int, database *db.DB, sshServer *ssh.Server) (*Server, error) {
+func NewServer(ctx context.Context, host string, port int, database *db.DB, sshServer *ssh.Server, deployer *deploy.Service, caches *sitecache.Service) (*Server, error) {
 	serverCtx, cancel := context.WithCancel(ctx)
 
 	logger := logging.WithComponent("api-server")
 
 	return &Server{
-		host:       host,
-		port:       port,
-		database:   database,
-		sshServer:  sshServer,
-		logger:     logger,
-		ctx:        serverCtx,
-		cancelFunc: cancel,
+		host:        host,
+		port:        port,
+		database:    database,
+		sshServer:   sshServer,
+		deployer:    deployer,
+		caches:      caches,
+		secretScan:  config.SecretScanWarn,
+		uniqueNames: config.DeviceNamesFleet,
+		inviteTTL:   72 * time.Hour,
+		logger:      logger,
+		ctx:         serverCtx,
+		cancelFunc:  cancel,
 	}, nil
 }
 
 // Start starts the API server
 func (s *Server) Start() error {
-	addr := fmt.Sprintf("%s:%d", s.host, s.port)
+	addr := net.JoinHostPort(s.host, strconv.Itoa(s.port))
 
 	// Setup router
 	router := http.NewServeMux()
 
 	// Register API routes
 	router.HandleFunc("/api/health", s.handleHealth)
+	router.HandleFunc("/api/health/live", s.handleHealthLive)
+	router.HandleFunc("/api/health/ready", s.handleHealthReady)
+	router.HandleFunc("GET /api/version", s.handleVersion)
 
 	// Auth routes
 	router.HandleFunc("/api/auth/login", s.handleLogin)
+	router.HandleFunc("/api/setup", s.handleSetup)
 	router.HandleFunc("/api/auth/logout", s.handleLogout)
+	router.HandleFunc("/api/invitations/accept", s.handleInvitationAccept)
 	router.HandleFunc("/api/auth/me", s.authMiddleware(s.handleGetCurrentUser))
+	router.HandleFunc("/api/auth/me/preferences", s.authMiddleware(s.handlePreferences))
+	router.HandleFunc("/api/auth/me/views", s.authMiddleware(s.handleSavedViews))
+	router.HandleFunc("/api/auth/me/views/{id}", s.authMiddleware(s.handleSavedViewByID))
+	router.HandleFunc("/api/auth/sessions", s.authMiddleware(s.handleSessions))
+	router.HandleFunc("/api/auth/sessions/{id}", s.authMiddleware(s.handleSessionByID))
 
 	// Fleet routes
-	router.HandleFunc("/api/fleets", s.authMiddleware(s.handleFleets))
-	router.HandleFunc("/api/fleets/", s.authMiddleware(s.handleFleetByID)) // Handles /api/fleets/{id}
+	router.HandleFunc("/api/fleets", s.authMiddleware(s.cached(s.handleFleets)))
+	router.HandleFunc("/api/fleets/", s.authMiddleware(s.cached(s.freezeMiddleware(s.pathFleet, s.handleFleetByID)))) // Handles /api/fleets/{id}
+	router.HandleFunc("/api/fleets/{id}/env-vars", s.authMiddleware(s.freezeMiddleware(s.pathFleet, s.handleFleetEnvVars)))
+	router.HandleFunc("/api/fleets/{id}/compose-overrides", s.authMiddleware(s.freezeMiddleware(s.pathFleet, s.handleFleetComposeOverrides)))
+	router.HandleFunc("/api/fleets/{id}/rollouts", s.authMiddleware(s.freezeMiddleware(s.pathFleet, s.handleFleetRollouts)))
+	router.HandleFunc("/api/fleets/{id}/ntp", s.authMiddleware(s.freezeMiddleware(s.pathFleet, s.handleFleetNTP)))
+	router.HandleFunc("/api/fleets/{id}/required-usb", s.authMiddleware(s.freezeMiddleware(s.pathFleet, s.handleFleetRequiredUSB)))
+	router.HandleFunc("/api/fleets/{id}/resource-limits", s.authMiddleware(s.freezeMiddleware(s.pathFleet, s.handleFleetResourceLimits)))
+	router.HandleFunc("/api/fleets/{id}/plugin-settings", s.authMiddleware(s.adminMiddleware(s.freezeMiddleware(s.pathFleet, s.handleFleetPluginSettings))))
+	router.HandleFunc("/api/fleets/{id}/defaults", s.authMiddleware(s.freezeMiddleware(s.pathFleet, s.handleFleetDefaults)))
+	router.HandleFunc("/api/fleets/{id}/snapshots", s.authMiddleware(s.handleFleetSnapshots))
+	router.HandleFunc("/api/fleets/{id}/snapshots/diff", s.authMiddleware(s.handleFleetSnapshotDiff))
+	router.HandleFunc("/api/fleets/{id}/snapshots/{snapshot}", s.authMiddleware(s.handleFleetSnapshot))
+	router.HandleFunc("/api/fleets/{id}/snapshots/{snapshot}/restore", s.authMiddleware(s.freezeMiddleware(s.pathFleet, s.handleFleetSnapshotRestore)))
+	router.HandleFunc("/api/fleets/{id}/uptime", s.authMiddleware(s.cached(s.handleFleetUptime)))
+	router.HandleFunc("/api/fleets/{id}/uptime/export", s.authMiddleware(s.handleFleetUptimeExport))
+	router.HandleFunc("/api/fleets/{id}/upgrade-blockers", s.authMiddleware(s.handleFleetUpgradeBlockers))
+	router.HandleFunc("/api/fleets/{id}/forward-policy", s.authMiddleware(s.adminMiddleware(s.freezeMiddleware(s.pathFleet, s.handleFleetForwardPolicy))))
+	router.HandleFunc("/api/fleets/{id}/freeze", s.authMiddleware(s.adminMiddleware(s.handleFleetFreeze)))
+	router.HandleFunc("/api/fleets/{id}/approval", s.authMiddleware(s.adminMiddleware(s.handleFleetApproval)))
+	router.HandleFunc("/api/approvals", s.authMiddleware(s.handleApprovals))
+	router.HandleFunc("/api/approvals/{id}", s.authMiddleware(s.handleApprovalByID))
+	router.HandleFunc("/api/approvals/{id}/approve", s.authMiddleware(s.freezeMiddleware(s.approvalFleetOf, s.handleApprovalApprove)))
+	router.HandleFunc("/api/approvals/{id}/reject", s.authMiddleware(s.handleApprovalReject))
+	router.HandleFunc("/api/rollouts/{id}", s.authMiddleware(s.handleRolloutByID))
+	router.HandleFunc("/api/rollouts/{id}/cancel", s.authMiddleware(s.handleRolloutCancel))
+	router.HandleFunc("/api/rollouts/{id}/retry", s.authMiddleware(s.freezeMiddleware(s.rolloutFleet, s.handleRolloutRetry)))
+	router.HandleFunc("/api/rollouts/{id}/failures", s.authMiddleware(s.handleRolloutFailures))
+
+	// Site routes
+	router.HandleFunc("/api/sites", s.authMiddleware(s.handleSites))
+	router.HandleFunc("/api/sites/{id}", s.authMiddleware(s.handleSiteByID))
+	router.HandleFunc("/api/sites/{id}/cache/deploy", s.authMiddleware(s.handleSiteCacheDeploy))
+	router.HandleFunc("/api/sites/{id}/cache/check", s.authMiddleware(s.handleSiteCacheCheck))
 
 	// Device routes
-	router.HandleFunc("/api/devices", s.authMiddleware(s.handleDevices))
-	router.HandleFunc("/api/devices/", s.authMiddleware(s.handleDeviceByID)) // Handles /api/devices/{id}
+	router.HandleFunc("/api/devices", s.authMiddleware(s.cached(s.handleDevices)))
+	router.HandleFunc("/api/containers", s.authMiddleware(s.handleContainers))
+	router.HandleFunc("/api/usb-devices", s.authMiddleware(s.handleUSBDevices))
+	router.HandleFunc("/api/devices/", s.authMiddleware(s.freezeMiddleware(s.deviceFleet, s.handleDeviceByID))) // Handles /api/devices/{id}
+	router.HandleFunc("/api/devices/{id}/rename", s.authMiddleware(s.freezeMiddleware(s.deviceFleet, s.handleDeviceRename)))
+	router.HandleFunc("/api/devices/{id}/names", s.authMiddleware(s.handleDeviceNames))
+	router.HandleFunc("/api/devices/{id}/decommission", s.authMiddleware(s.freezeMiddleware(s.deviceFleet, s.handleDeviceDecommission)))
+	router.HandleFunc("/api/devices/{id}/replace", s.authMiddleware(s.freezeMiddleware(s.deviceFleet, s.handleDeviceReplace)))
+	router.HandleFunc("/api/devices/{id}/env-vars", s.authMiddleware(s.freezeMiddleware(s.deviceFleet, s.handleDeviceEnvVars)))
+	router.HandleFunc("/api/devices/{id}/env-vars/resolved", s.authMiddleware(s.handleDeviceResolvedEnv))
+	router.HandleFunc("/api/devices/{id}/compose-overrides", s.authMiddleware(s.freezeMiddleware(s.deviceFleet, s.handleDeviceComposeOverrides)))
+	router.HandleFunc("/api/devices/{id}/deploy", s.authMiddleware(s.freezeMiddleware(s.deviceFleet, s.handleDeviceDeploy)))
+	router.HandleFunc("/api/devices/{id}/deployments", s.authMiddleware(s.handleDeviceDeployments))
+	router.HandleFunc("/api/devices/{id}/deployments/history", s.authMiddleware(s.handleDeviceDeploymentHistory))
+	router.HandleFunc("/api/devices/{id}/apps", s.authMiddleware(s.handleDeviceApps))
+	router.HandleFunc("/api/devices/{id}/apps/{app}/actions", s.authMiddleware(s.freezeMiddleware(s.deviceFleet, s.handleDeviceAppActions)))
+	router.HandleFunc("/api/devices/{id}/apps/{app}/restart", s.authMiddleware(s.freezeMiddleware(s.deviceFleet, s.handleDeviceAppRestart)))
+	router.HandleFunc("/api/devices/{id}/containers", s.authMiddleware(s.handleDeviceContainers))
+	router.HandleFunc("/api/devices/{id}/usb", s.authMiddleware(s.handleDeviceUSB))
+	router.HandleFunc("/api/devices/{id}/required-usb", s.authMiddleware(s.freezeMiddleware(s.deviceFleet, s.handleDeviceRequiredUSB)))
+	router.HandleFunc("/api/devices/{id}/resource-limits", s.authMiddleware(s.freezeMiddleware(s.deviceFleet, s.handleDeviceResourceLimits)))
+	router.HandleFunc("/api/devices/{id}/unmanaged", s.authMiddleware(s.handleDeviceUnmanaged))
+	router.HandleFunc("/api/devices/{id}/unmanaged/{wid}", s.authMiddleware(s.handleDeviceUnmanagedByID))
+	router.HandleFunc("/api/devices/{id}/unmanaged/{wid}/adopt", s.authMiddleware(s.freezeMiddleware(s.deviceFleet, s.handleDeviceUnmanagedAdopt)))
+	router.HandleFunc("/api/devices/{id}/location", s.authMiddleware(s.freezeMiddleware(s.deviceFleet, s.handleDeviceLocation)))
+	router.HandleFunc("/api/devices/{id}/custom-fields", s.authMiddleware(s.freezeMiddleware(s.deviceFleet, s.handleDeviceCustomFields)))
+	router.HandleFunc("/api/devices/{id}/uptime", s.authMiddleware(s.cached(s.handleDeviceUptime)))
+	router.HandleFunc("/api/devices/{id}/tunnel-policy", s.authMiddleware(s.adminMiddleware(s.freezeMiddleware(s.deviceFleet, s.handleDeviceTunnelPolicy))))
+	router.HandleFunc("/api/devices/{id}/revoke", s.authMiddleware(s.adminMiddleware(s.handleDeviceRevoke)))
+	router.HandleFunc("/api/devices/{id}/hardware-binding", s.authMiddleware(s.adminMiddleware(s.handleDeviceHardwareBinding)))
+	router.HandleFunc("/api/devices/{id}/exposed-services", s.authMiddleware(s.freezeMiddleware(s.deviceFleet, s.handleDeviceExposedServices)))
+	router.HandleFunc("/api/devices/{id}/exposed-services/{name}/auth", s.authMiddleware(s.adminMiddleware(s.handleExposedServiceAuth)))
+	router.HandleFunc("/api/devices/{id}/forwards", s.authMiddleware(s.freezeMiddleware(s.deviceFleet, s.handleDeviceForwards)))
+	router.HandleFunc("/api/devices/{id}/forwards/{port}", s.authMiddleware(s.freezeMiddleware(s.deviceFleet, s.handleDeviceForwardByPort)))
+	router.HandleFunc("/api/devices/{id}/docker/{path...}", s.authMiddleware(s.handleDeviceDocker))
+	router.HandleFunc("/api/devices/{id}/diagnostics", s.authMiddleware(s.handleDeviceDiagnostics))
+	router.HandleFunc("/api/devices/{id}/diagnostics/{bundle}", s.authMiddleware(s.handleDeviceDiagnosticsBundle))
+	router.HandleFunc("/api/devices/{id}/diagnostics/{bundle}/download", s.authMiddleware(s.handleDiagnosticsDownload))
+	router.HandleFunc("/api/devices/{id}/logs", s.authMiddleware(s.handleDeviceLogs))
+	router.HandleFunc("/api/devices/{id}/log-archives", s.authMiddleware(s.handleDeviceLogArchives))
+	router.HandleFunc("/api/devices/{id}/log-archives/{archive}/download", s.authMiddleware(s.handleLogArchiveDownload))
+	router.HandleFunc("/api/devices/{id}/network-tests", s.authMiddleware(s.handleDeviceNetworkTest))
+	router.HandleFunc("/api/devices/{id}/captures", s.authMiddleware(s.adminMiddleware(s.handleDeviceCaptures)))
+	router.HandleFunc("/api/devices/{id}/captures/{capture}", s.authMiddleware(s.adminMiddleware(s.handleDeviceCapture)))
+	router.HandleFunc("/api/devices/{id}/captures/{capture}/download", s.authMiddleware(s.adminMiddleware(s.handleCaptureDownload)))
+	router.HandleFunc("/api/devices/{id}/plugin-settings", s.authMiddleware(s.adminMiddleware(s.freezeMiddleware(s.deviceFleet, s.handleDevicePluginSettings))))
+	router.HandleFunc("/api/devices/{id}/plugins/{plugin}/actions/{action}", s.authMiddleware(s.handleDevicePluginAction))
+	router.HandleFunc("/api/devices/{id}/host-services/{service}/restart", s.authMiddleware(s.freezeMiddleware(s.deviceFleet, s.handleDeviceHostServiceRestart)))
+	router.HandleFunc("/api/devices/{id}/restore-points", s.authMiddleware(s.handleDeviceRestorePoints))
+	router.HandleFunc("/api/devices/{id}/restore-points/{point}", s.authMiddleware(s.handleDeviceRestorePoint))
+	router.HandleFunc("/api/devices/{id}/restore-points/{point}/restore", s.authMiddleware(s.freezeMiddleware(s.deviceFleet, s.handleRestorePointRestore)))
+	router.HandleFunc("/api/devices/{id}/staged-updates", s.authMiddleware(s.freezeMiddleware(s.deviceFleet, s.handleDeviceStagedUpdates)))
+	router.HandleFunc("/api/devices/{id}/staged-updates/{update}", s.authMiddleware(s.handleDeviceStagedUpdate))
+	router.HandleFunc("/api/devices/{id}/staged-updates/{update}/activate", s.authMiddleware(s.freezeMiddleware(s.deviceFleet, s.handleStagedUpdateActivate)))
+	router.HandleFunc("/api/devices/{id}/display", s.authMiddleware(s.freezeMiddleware(s.deviceFleet, s.handleDeviceDisplay)))
+	router.HandleFunc("/api/devices/{id}/display/screenshots", s.authMiddleware(s.handleDeviceScreenshots))
+	router.HandleFunc("/api/devices/{id}/display/screenshots/{screenshot}", s.authMiddleware(s.handleDeviceScreenshot))
+	router.HandleFunc("/api/devices/export", s.authMiddleware(s.handleDeviceExport))
+	router.HandleFunc("/api/devices/aggregate", s.authMiddleware(s.cached(s.handleDeviceAggregate)))
+	router.HandleFunc("/api/search", s.authMiddleware(s.handleSearch))
+	router.HandleFunc("/api/stats", s.authMiddleware(s.cached(s.handleStats)))
+	router.HandleFunc("/api/custom-fields", s.authMiddleware(s.handleCustomFields))
+	router.HandleFunc("/api/custom-fields/{id}", s.authMiddleware(s.handleCustomFieldByID))
+	router.HandleFunc("/api/deployments/export", s.authMiddleware(s.handleDeploymentExport))
+	router.HandleFunc("/api/deployments/{id}", s.authMiddleware(s.handleDeploymentByID))
+
+	// Background job routes
+	router.HandleFunc("GET /api/jobs", s.authMiddleware(s.handleJobs))
+	router.HandleFunc("GET /api/jobs/{id}", s.authMiddleware(s.handleJobByID))
+	router.HandleFunc("POST /api/jobs/{id}/cancel", s.authMiddleware(s.handleJobCancel))
+	router.HandleFunc("POST /api/jobs/{id}/retry", s.authMiddleware(s.handleJobRetry))
 
 	// Software routes
 	router.HandleFunc("/api/software", s.authMiddleware(s.handleSoftware))
 	router.HandleFunc("/api/software/", s.authMiddleware(s.handleSoftwareByID)) // Handles /api/software/{id}
+	router.HandleFunc("/api/secret-scan", s.authMiddleware(s.handleSecretScan))
+	router.HandleFunc("/api/software/{id}/versions/{version}/env-schema", s.authMiddleware(s.handleSoftwareEnvSchema))
+	router.HandleFunc("/api/software/{id}/versions/{version}/migration", s.authMiddleware(s.handleSoftwareMigration))
+	router.HandleFunc("/api/software/{id}/versions/{version}/requirements", s.authMiddleware(s.handleSoftwareRequirements))
+	router.HandleFunc("/api/software/{id}/versions/{version}/artifacts", s.authMiddleware(s.handleSoftwareArtifacts))
+	router.HandleFunc("/api/software/{id}/versions/{version}/artifacts/{path...}", s.authMiddleware(s.handleSoftwareArtifact))
 
 	// Agent routes
 	router.HandleFunc("/api/agent/heartbeat", s.handleAgentHeartbeat)
 	router.HandleFunc("/api/agent/status", s.handleAgentStatus)
 
+	router.HandleFunc("GET /api/events", tokenQuery(s.authMiddleware(s.handleEvents)))
+
+	// Webhook routes
+	router.HandleFunc("/api/webhooks", s.authMiddleware(s.adminMiddleware(s.handleWebhooks)))
+	router.HandleFunc("/api/webhooks/{id}", s.authMiddleware(s.adminMiddleware(s.handleWebhookByID)))
+	router.HandleFunc("/api/webhooks/{id}/deliveries", s.authMiddleware(s.adminMiddleware(s.handleWebhookDeliveries)))
+
+	// Secret store and registry credential routes
+	router.HandleFunc("/api/secret-stores", s.authMiddleware(s.adminMiddleware(s.handleSecretStores)))
+	router.HandleFunc("/api/secret-stores/{id}", s.authMiddleware(s.adminMiddleware(s.handleSecretStoreByID)))
+	router.HandleFunc("/api/registry-credentials", s.authMiddleware(s.adminMiddleware(s.handleRegistryCredentials)))
+	router.HandleFunc("/api/registry-credentials/{id}", s.authMiddleware(s.adminMiddleware(s.handleRegistryCredentialByID)))
+
+	// Prometheus metrics
+	if s.metrics != nil {
+		router.HandleFunc("/metrics", s.handleMetrics)
+	}
+
+	// Admin routes
+	router.HandleFunc("/api/admin/logging", s.authMiddleware(s.adminMiddleware(s.handleAdminLogging)))
+	router.HandleFunc("/api/admin/server-settings", s.authMiddleware(s.adminMiddleware(s.handleAdminServerSettings)))
+	router.HandleFunc("/api/admin/users/{user}/sessions", s.authMiddleware(s.adminMiddleware(s.handleAdminUserSessions)))
+	router.HandleFunc("/api/invitations", s.authMiddleware(s.adminMiddleware(s.handleInvitations)))
+	router.HandleFunc("/api/invitations/{id}", s.authMiddleware(s.adminMiddleware(s.handleInvitationByID)))
+	router.HandleFunc("POST /api/invitations/{id}/resend", s.authMiddleware(s.adminMiddleware(s.handleInvitationResend)))
+	router.HandleFunc("GET /api/admin/ssh-ca", s.authMiddleware(s.adminMiddleware(s.handleAdminSSHCA)))
+	router.HandleFunc("GET /api/admin/connections", s.authMiddleware(s.adminMiddleware(s.handleAdminConnections)))
+	router.HandleFunc("DELETE /api/admin/connections/{id}", s.authMiddleware(s.adminMiddleware(s.handleAdminConnectionDisconnect)))
+	router.HandleFunc("POST /api/admin/connections/{id}/reallocate", s.authMiddleware(s.adminMiddleware(s.handleAdminConnectionReallocate)))
+	router.HandleFunc("GET /api/admin/dns", s.authMiddleware(s.adminMiddleware(s.handleAdminDNS)))
+	router.HandleFunc("POST /api/admin/dns/sync", s.authMiddleware(s.adminMiddleware(s.handleAdminDNSSync)))
+	router.HandleFunc("GET /api/admin/exposed-ports", s.authMiddleware(s.adminMiddleware(s.handleAdminExposedPorts)))
+	router.HandleFunc("GET /api/admin/revocations", s.authMiddleware(s.adminMiddleware(s.handleAdminRevocations)))
+	router.HandleFunc("GET /api/admin/audit", s.authMiddleware(s.adminMiddleware(s.handleAdminAudit)))
+
+	// Declarative resources, keyed by external IDs
+	router.HandleFunc("/api/resources/{kind}", s.authMiddleware(s.handleResources))
+	router.HandleFunc("/api/resources/{kind}/{external_id}", s.authMiddleware(s.freezeMiddleware(s.declaredFleet, s.handleResource)))
+
+	// Imports from other platforms
+	router.HandleFunc("/api/imports", s.authMiddleware(s.adminMiddleware(s.handleImports)))
+	router.HandleFunc("/api/imports/{id}", s.authMiddleware(s.adminMiddleware(s.handleImportByID)))
+	router.HandleFunc("/api/imports/{id}/bundle", s.authMiddleware(s.adminMiddleware(s.handleImportBundle)))
+	router.HandleFunc("/api/imports/{id}/keys", s.authMiddleware(s.adminMiddleware(s.handleImportKeys)))
+
 	// Provision routes
 	router.HandleFunc("/api/provision/device", s.handleDeviceProvisioning) // Create new device provisioning config
 
@@ -113,9 +315,14 @@ func (s *Server) Start() error {
 	}
 
 	// Create HTTP server
+	var handler http.Handler = router
+	if s.cache != nil {
+		s.cache.start()
+		handler = s.cacheInvalidationMiddleware(handler)
+	}
 	s.httpServer = &http.Server{
 		Addr:    addr,
-		Handler: s.loggingMiddleware(router),
+		Handler: s.loggingMiddleware(s.tracingMiddleware(handler)),
 	}
 
 	s.logger.Info(fmt.Sprintf("API server listening on %s", addr))
@@ -145,6 +352,10 @@ func (s *Server) Shutdown() {
 		}
 	}
 
+	if s.cache != nil {
+		s.cache.stop()
+	}
+
 	// Signal the server context to cancel
 	s.cancelFunc()
 
@@ -0,0 +1,178 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/edgetainer/edgetainer/internal/server/proxy"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// minServicePasswordLength is the shortest shared password of a service
+const minServicePasswordLength = 8
+
+// ExposedServiceResponse is an exposed service along with whether it has a
+// shared password, which itself is never returned
+type ExposedServiceResponse struct {
+	models.ExposedService
+	HasPassword bool `json:"has_password"`
+}
+
+// ServiceAuthRequest sets how access to an exposed service is protected
+type ServiceAuthRequest struct {
+	AuthRequired   bool      `json:"auth_required"`
+	Password       *string   `json:"password,omitempty"`        // Shared password for kiosk-style access, empty removes it, omitted keeps it
+	AllowedSources *[]string `json:"allowed_sources,omitempty"` // Addresses or CIDR ranges allowed to connect to tcp and udp services, omitted keeps them
+}
+
+// ExposedPort is a public port of the proxy relayed to a tcp or udp service
+type ExposedPort struct {
+	Port           int      `json:"port"`
+	Protocol       string   `json:"protocol"`
+	DeviceID       string   `json:"device_id"`
+	Service        string   `json:"service"`
+	Enabled        bool     `json:"enabled"`
+	AllowedSources []string `json:"allowed_sources,omitempty"`
+}
+
+// handleDeviceExposedServices lists the exposed services of a device
+func (s *Server) handleDeviceExposedServices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", r.PathValue("id")).First(&device).Error; err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	var services []models.ExposedService
+	if err := s.database.GetDB().Where("device_id = ?", device.ID).Order("name").Find(&services).Error; err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to fetch exposed services of device %s", device.DeviceID), err)
+		http.Error(w, "Failed to fetch exposed services", http.StatusInternalServerError)
+		return
+	}
+
+	response := make([]ExposedServiceResponse, 0, len(services))
+	for _, service := range services {
+		response = append(response, ExposedServiceResponse{ExposedService: service, HasPassword: service.PasswordHash != ""})
+	}
+
+	jsonResponse(w, response, http.StatusOK)
+}
+
+// handleExposedServiceAuth sets whether an exposed service requires
+// authentication and its shared password
+func (s *Server) handleExposedServiceAuth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request ServiceAuthRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if request.Password != nil && *request.Password != "" && len(*request.Password) < minServicePasswordLength {
+		http.Error(w, fmt.Sprintf("Password must be at least %d characters", minServicePasswordLength), http.StatusBadRequest)
+		return
+	}
+	if request.AllowedSources != nil {
+		if _, err := proxy.ParseSources(*request.AllowedSources); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid allowed sources: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", r.PathValue("id")).First(&device).Error; err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	var service models.ExposedService
+	if err := s.database.GetDB().Where("device_id = ? AND name = ?", device.ID, r.PathValue("name")).First(&service).Error; err != nil {
+		http.Error(w, "Exposed service not found", http.StatusNotFound)
+		return
+	}
+
+	// Select the columns so a false auth_required or a removed password is
+	// written too
+	columns := []string{"auth_required"}
+	service.AuthRequired = request.AuthRequired
+	if request.Password != nil {
+		service.PasswordHash = ""
+		if *request.Password != "" {
+			hashed, err := bcrypt.GenerateFromPassword([]byte(*request.Password), bcrypt.DefaultCost)
+			if err != nil {
+				s.logger.Error("Failed to hash service password", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			service.PasswordHash = string(hashed)
+		}
+		columns = append(columns, "password_hash")
+	}
+	if request.AllowedSources != nil {
+		service.AllowedSources = *request.AllowedSources
+		columns = append(columns, "allowed_sources")
+	}
+
+	if err := s.database.GetDB().Model(&service).Select(columns).Updates(&service).Error; err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to update auth of %s on device %s", service.Name, device.DeviceID), err)
+		http.Error(w, "Failed to update exposed service", http.StatusInternalServerError)
+		return
+	}
+
+	s.audit(r, models.AuditServiceAuth, device.DeviceID, "", map[string]interface{}{
+		"service":          service.Name,
+		"auth_required":    request.AuthRequired,
+		"password_changed": request.Password != nil,
+		"allowed_sources":  service.AllowedSources,
+	})
+
+	jsonResponse(w, ExposedServiceResponse{ExposedService: service, HasPassword: service.PasswordHash != ""}, http.StatusOK)
+}
+
+// handleAdminExposedPorts lists the public ports relayed to tcp and udp
+// services, e.g. to generate firewall rules from
+func (s *Server) handleAdminExposedPorts(w http.ResponseWriter, r *http.Request) {
+	var services []models.ExposedService
+	if err := s.database.GetDB().Where("public_port > 0").Order("public_port").Find(&services).Error; err != nil {
+		s.logger.Error("Failed to fetch exposed ports", err)
+		http.Error(w, "Failed to fetch exposed ports", http.StatusInternalServerError)
+		return
+	}
+
+	ids := make([]uuid.UUID, 0, len(services))
+	for _, service := range services {
+		ids = append(ids, service.DeviceID)
+	}
+	deviceIDs := make(map[uuid.UUID]string)
+	var devices []models.Device
+	if err := s.database.GetDB().Select("id", "device_id").Where("id IN ?", ids).Find(&devices).Error; err == nil {
+		for _, device := range devices {
+			deviceIDs[device.ID] = device.DeviceID
+		}
+	}
+
+	ports := make([]ExposedPort, 0, len(services))
+	for _, service := range services {
+		ports = append(ports, ExposedPort{
+			Port:           service.PublicPort,
+			Protocol:       service.Protocol,
+			DeviceID:       deviceIDs[service.DeviceID],
+			Service:        service.Name,
+			Enabled:        service.Enabled,
+			AllowedSources: service.AllowedSources,
+		})
+	}
+
+	jsonResponse(w, ports, http.StatusOK)
+}
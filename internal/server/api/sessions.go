@@ -0,0 +1,203 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	// tokenUsageInterval is how often the last use of a token is written
+	// while it is used from the same address and user agent
+	tokenUsageInterval = time.Minute
+	// maxUserAgent is the longest user agent kept for a session
+	maxUserAgent = 512
+)
+
+// SessionResponse is a login token of a user, without the token itself
+type SessionResponse struct {
+	ID          uuid.UUID  `json:"id"`
+	Description string     `json:"description"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	LastUsedAt  *time.Time `json:"last_used_at,omitempty"`
+	IPAddress   string     `json:"ip_address,omitempty"` // Of the last use
+	UserAgent   string     `json:"user_agent,omitempty"` // Of the last use
+	Current     bool       `json:"current"`              // The session of the request
+}
+
+// handleSessions lists the active sessions of the current user and revokes
+// all but the current one, e.g. after a laptop was lost
+func (s *Server) handleSessions(w http.ResponseWriter, r *http.Request) {
+	user, _ := r.Context().Value("user").(models.User)
+	current, _ := r.Context().Value("token_id").(uuid.UUID)
+
+	switch r.Method {
+	case http.MethodGet:
+		s.listSessions(w, r, user.ID)
+
+	case http.MethodDelete:
+		result := s.database.GetDB().Where("user_id = ? AND id <> ?", user.ID, current).Delete(&models.APIToken{})
+		if result.Error != nil {
+			s.logger.Error("Failed to revoke sessions", result.Error)
+			http.Error(w, "Failed to revoke sessions", http.StatusInternalServerError)
+			return
+		}
+		s.audit(r, models.AuditSessionRevoke, "", "", map[string]interface{}{
+			"revoked": result.RowsAffected,
+			"others":  true,
+		})
+		jsonResponse(w, map[string]interface{}{"revoked": result.RowsAffected}, http.StatusOK)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleSessionByID revokes a session of the current user, logging out
+// wherever it is used. Revoking the current session is a logout.
+func (s *Server) handleSessionByID(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid session ID", http.StatusBadRequest)
+		return
+	}
+
+	user, _ := r.Context().Value("user").(models.User)
+	result := s.database.GetDB().Where("id = ? AND user_id = ?", id, user.ID).Delete(&models.APIToken{})
+	if result.Error != nil {
+		s.logger.Error("Failed to revoke session", result.Error)
+		http.Error(w, "Failed to revoke session", http.StatusInternalServerError)
+		return
+	}
+	if result.RowsAffected == 0 {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	s.audit(r, models.AuditSessionRevoke, "", "", map[string]interface{}{
+		"session_id": id.String(),
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAdminUserSessions lists the active sessions of any user and revokes
+// all of them, logging the user out everywhere
+func (s *Server) handleAdminUserSessions(w http.ResponseWriter, r *http.Request) {
+	// Users are found by ID or username
+	ref := r.PathValue("user")
+	query := s.database.GetDB().Where("username = ?", ref)
+	if id, err := uuid.Parse(ref); err == nil {
+		query = s.database.GetDB().Where("id = ?", id)
+	}
+	var user models.User
+	if err := query.First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, "User not found", http.StatusNotFound)
+		} else {
+			s.logger.Error("Failed to load user", err)
+			http.Error(w, "Failed to load user", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s.listSessions(w, r, user.ID)
+
+	case http.MethodDelete:
+		result := s.database.GetDB().Where("user_id = ?", user.ID).Delete(&models.APIToken{})
+		if result.Error != nil {
+			s.logger.Error(fmt.Sprintf("Failed to revoke sessions of %s", user.Username), result.Error)
+			http.Error(w, "Failed to revoke sessions", http.StatusInternalServerError)
+			return
+		}
+		s.logger.Info(fmt.Sprintf("Revoked %d sessions of %s", result.RowsAffected, user.Username))
+		s.audit(r, models.AuditUserSessionsRevoke, "", "", map[string]interface{}{
+			"user":    user.Username,
+			"revoked": result.RowsAffected,
+		})
+		jsonResponse(w, map[string]interface{}{"revoked": result.RowsAffected}, http.StatusOK)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// listSessions responds with the sessions of a user that have not expired,
+// most recently used first
+func (s *Server) listSessions(w http.ResponseWriter, r *http.Request, userID uuid.UUID) {
+	var tokens []models.APIToken
+	if err := s.database.GetDB().
+		Where("user_id = ? AND expires_at > ?", userID, time.Now()).
+		Order("last_used_at DESC NULLS LAST, created_at DESC").
+		Find(&tokens).Error; err != nil {
+		s.logger.Error("Failed to list sessions", err)
+		http.Error(w, "Failed to list sessions", http.StatusInternalServerError)
+		return
+	}
+
+	current, _ := r.Context().Value("token_id").(uuid.UUID)
+	sessions := make([]SessionResponse, 0, len(tokens))
+	for _, token := range tokens {
+		sessions = append(sessions, SessionResponse{
+			ID:          token.ID,
+			Description: token.Description,
+			CreatedAt:   token.CreatedAt,
+			ExpiresAt:   token.ExpiresAt,
+			LastUsedAt:  token.LastUsedAt,
+			IPAddress:   token.IPAddress,
+			UserAgent:   token.UserAgent,
+			Current:     token.ID == current,
+		})
+	}
+	jsonResponse(w, sessions, http.StatusOK)
+}
+
+// touchToken records the last use of a token, at most every
+// tokenUsageInterval unless it comes from elsewhere
+func (s *Server) touchToken(token *models.APIToken, r *http.Request) {
+	now := time.Now()
+	ip, agent := requestIP(r), requestUserAgent(r)
+	if token.LastUsedAt != nil && now.Sub(*token.LastUsedAt) < tokenUsageInterval &&
+		token.IPAddress == ip && token.UserAgent == agent {
+		return
+	}
+
+	// UpdateColumns leaves updated_at alone, it tells when the token changed
+	if err := s.database.GetDB().Model(token).UpdateColumns(map[string]interface{}{
+		"last_used_at": now,
+		"ip_address":   ip,
+		"user_agent":   agent,
+	}).Error; err != nil {
+		s.logger.Warn(fmt.Sprintf("Failed to record the use of session %s: %v", token.ID, err))
+	}
+}
+
+// requestIP returns the address a request came from
+func requestIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// requestUserAgent returns the user agent of a request, cut to maxUserAgent
+func requestUserAgent(r *http.Request) string {
+	agent := strings.ToValidUTF8(r.UserAgent(), "")
+	if len(agent) > maxUserAgent {
+		agent = strings.ToValidUTF8(agent[:maxUserAgent], "")
+	}
+	return agent
+}
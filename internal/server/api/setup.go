@@ -0,0 +1,280 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/edgetainer/edgetainer/internal/server/db"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+)
+
+// setupState holds the token of a pending setup
+type setupState struct {
+	mu    sync.Mutex
+	token string // Empty once the server is set up
+}
+
+// SetupStatus tells whether the server waits for its setup
+type SetupStatus struct {
+	Required bool `json:"required"`
+}
+
+// ServerSettingsRequest represents the server URL and SSH ports to set
+type ServerSettingsRequest struct {
+	ServerURL    string `json:"server_url"`               // URL or domain, https:// is assumed without a scheme
+	SSHPort      int    `json:"ssh_port,omitempty"`       // Zero for ssh.port
+	SSHStartPort int    `json:"ssh_start_port,omitempty"` // Zero for ssh.start_port
+	SSHEndPort   int    `json:"ssh_end_port,omitempty"`   // Zero for ssh.end_port
+}
+
+// SetupRequest represents the setup of a new server
+type SetupRequest struct {
+	Token    string `json:"token"` // Printed in the log of the server
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	ServerSettingsRequest
+}
+
+// ServerSettingsResponse represents the server settings and whether they
+// are all in effect
+type ServerSettingsResponse struct {
+	models.ServerSettings
+	RestartRequired bool `json:"restart_required"` // SSH ports apply from the next start
+}
+
+// SetupResponse represents a completed setup
+type SetupResponse struct {
+	User     models.User            `json:"user"`
+	Settings ServerSettingsResponse `json:"settings"`
+}
+
+// EnableSetup makes the server accept its setup at /api/setup and returns
+// the token the setup needs
+func (s *Server) EnableSetup() string {
+	s.setup.mu.Lock()
+	defer s.setup.mu.Unlock()
+
+	s.setup.token = generateAuthToken()
+	return s.setup.token
+}
+
+// handleSetup handles the first-boot setup, which creates the first admin
+// and sets the server URL and SSH ports. It locks itself once done.
+func (s *Server) handleSetup(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.setup.mu.Lock()
+		required := s.setup.token != ""
+		s.setup.mu.Unlock()
+		jsonResponse(w, SetupStatus{Required: required}, http.StatusOK)
+
+	case http.MethodPost:
+		var request SetupRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		// One setup at a time, so the token is only cleared by the one
+		// that succeeds
+		s.setup.mu.Lock()
+		defer s.setup.mu.Unlock()
+		if s.setup.token == "" {
+			http.Error(w, "Server is already set up", http.StatusGone)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(request.Token), []byte(s.setup.token)) != 1 {
+			s.logger.Warn(fmt.Sprintf("Setup from %s refused, wrong setup token", r.RemoteAddr))
+			http.Error(w, "Invalid setup token", http.StatusForbidden)
+			return
+		}
+
+		if request.Username == "" || request.Email == "" {
+			http.Error(w, "Username and email are required", http.StatusBadRequest)
+			return
+		}
+		if len(request.Password) < 8 {
+			http.Error(w, "Password must be at least 8 characters", http.StatusBadRequest)
+			return
+		}
+		settings, err := parseServerSettings(request.ServerSettingsRequest)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		user, err := s.database.CompleteSetup(r.Context(), request.Username, request.Email, request.Password, settings)
+		if errors.Is(err, db.ErrSetupDone) {
+			s.setup.token = ""
+			http.Error(w, "Server is already set up", http.StatusGone)
+			return
+		}
+		if err != nil {
+			s.logger.Error("Failed to complete setup", err)
+			http.Error(w, "Failed to complete setup", http.StatusInternalServerError)
+			return
+		}
+		s.setup.token = ""
+
+		s.logger.Info(fmt.Sprintf("Server set up by %s, server URL %s", user.Username, settings.ServerURL))
+		r = r.WithContext(context.WithValue(r.Context(), "user", *user))
+		s.audit(r, models.AuditSetupComplete, "", "", map[string]interface{}{
+			"server_url": settings.ServerURL,
+			"ssh_port":   settings.SSHPort,
+		})
+
+		jsonResponse(w, SetupResponse{User: *user, Settings: s.serverSettingsResponse(r.Context(), settings)}, http.StatusCreated)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAdminServerSettings handles the server URL and SSH ports set in the
+// setup, which take precedence over the configuration
+func (s *Server) handleAdminServerSettings(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		settings, err := s.database.ServerSettings(r.Context())
+		if err != nil {
+			s.logger.Error("Failed to load server settings", err)
+			http.Error(w, "Failed to load server settings", http.StatusInternalServerError)
+			return
+		}
+		jsonResponse(w, ServerSettingsResponse{ServerSettings: settings, RestartRequired: s.sshRestartRequired(settings)}, http.StatusOK)
+
+	case http.MethodPut:
+		var request ServerSettingsRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		settings, err := parseServerSettings(request)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := s.database.SaveServerSettings(r.Context(), settings); err != nil {
+			s.logger.Error("Failed to save server settings", err)
+			http.Error(w, "Failed to save server settings", http.StatusInternalServerError)
+			return
+		}
+		s.audit(r, models.AuditServerSettings, "", "", map[string]interface{}{
+			"server_url":     settings.ServerURL,
+			"ssh_port":       settings.SSHPort,
+			"ssh_start_port": settings.SSHStartPort,
+			"ssh_end_port":   settings.SSHEndPort,
+		})
+
+		jsonResponse(w, s.serverSettingsResponse(r.Context(), settings), http.StatusOK)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// parseServerSettings validates a request to set the server URL and SSH
+// ports
+func parseServerSettings(request ServerSettingsRequest) (models.ServerSettings, error) {
+	serverURL, err := normalizeServerURL(request.ServerURL)
+	if err != nil {
+		return models.ServerSettings{}, err
+	}
+
+	for name, port := range map[string]int{"ssh_port": request.SSHPort, "ssh_start_port": request.SSHStartPort, "ssh_end_port": request.SSHEndPort} {
+		if port < 0 || port > 65535 {
+			return models.ServerSettings{}, fmt.Errorf("%s must be a port between 1 and 65535", name)
+		}
+	}
+	if (request.SSHStartPort == 0) != (request.SSHEndPort == 0) {
+		return models.ServerSettings{}, fmt.Errorf("ssh_start_port and ssh_end_port are set together")
+	}
+	if request.SSHStartPort > request.SSHEndPort {
+		return models.ServerSettings{}, fmt.Errorf("ssh_start_port must not be above ssh_end_port")
+	}
+	if request.SSHPort != 0 && request.SSHPort >= request.SSHStartPort && request.SSHPort <= request.SSHEndPort {
+		return models.ServerSettings{}, fmt.Errorf("ssh_port must not be one of the forwarded ports")
+	}
+
+	return models.ServerSettings{
+		ServerURL:    serverURL,
+		SSHPort:      request.SSHPort,
+		SSHStartPort: request.SSHStartPort,
+		SSHEndPort:   request.SSHEndPort,
+	}, nil
+}
+
+// normalizeServerURL turns a URL or domain into a URL with a scheme and
+// without a path
+func normalizeServerURL(serverURL string) (string, error) {
+	serverURL = strings.TrimSpace(serverURL)
+	if serverURL == "" {
+		return "", fmt.Errorf("server_url is required")
+	}
+	if !strings.Contains(serverURL, "://") {
+		serverURL = "https://" + serverURL
+	}
+
+	u, err := url.Parse(serverURL)
+	if err != nil || u.Hostname() == "" || (u.Scheme != "https" && u.Scheme != "http") {
+		return "", fmt.Errorf("server_url %q must be a domain or an http(s) URL", serverURL)
+	}
+	if strings.Trim(u.Path, "/") != "" || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return "", fmt.Errorf("server_url %q must not have a path", serverURL)
+	}
+	return u.Scheme + "://" + u.Host, nil
+}
+
+// serverSettingsResponse returns the saved settings, or those just saved if
+// they cannot be loaded
+func (s *Server) serverSettingsResponse(ctx context.Context, settings models.ServerSettings) ServerSettingsResponse {
+	if saved, err := s.database.ServerSettings(ctx); err == nil {
+		settings = saved
+	}
+	return ServerSettingsResponse{ServerSettings: settings, RestartRequired: s.sshRestartRequired(settings)}
+}
+
+// sshRestartRequired reports whether the SSH server uses other ports than
+// the settings set
+func (s *Server) sshRestartRequired(settings models.ServerSettings) bool {
+	startPort, endPort := s.sshServer.PortRange()
+	return (settings.SSHPort != 0 && settings.SSHPort != s.sshServer.Port()) ||
+		(settings.SSHStartPort != 0 && (settings.SSHStartPort != startPort || settings.SSHEndPort != endPort))
+}
+
+// provisioningTarget returns where provisioned devices reach the server: the
+// host and port of the server URL and the SSH port, from the settings if
+// they are set
+func (s *Server) provisioningTarget(ctx context.Context) (string, int, int) {
+	host, port, sshPort := s.host, s.port, s.sshServer.Port()
+
+	settings, err := s.database.ServerSettings(ctx)
+	if err != nil {
+		s.logger.Warn(fmt.Sprintf("Provisioning with the configured host and ports: %v", err))
+		return host, port, sshPort
+	}
+	if settings.SSHPort != 0 {
+		sshPort = settings.SSHPort
+	}
+	if u, err := url.Parse(settings.ServerURL); err == nil && u.Hostname() != "" {
+		host = u.Hostname()
+		port = 443
+		if u.Scheme == "http" {
+			port = 80
+		}
+		if p, err := strconv.Atoi(u.Port()); err == nil {
+			port = p
+		}
+	}
+	return host, port, sshPort
+}
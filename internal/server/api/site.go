@@ -0,0 +1,236 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+
+	"github.com/edgetainer/edgetainer/internal/server/sitecache"
+	"github.com/edgetainer/edgetainer/internal/shared/compose"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"gorm.io/gorm"
+)
+
+// siteColumns are the site settings replaced by an update
+var siteColumns = []string{"name", "description", "cache_device_id", "cache_host", "cache_port", "cache_upstreams", "cache_status"}
+
+// validateSite checks a site and fills in cache defaults
+func (s *Server) validateSite(site *models.Site) error {
+	if site.Name == "" {
+		return fmt.Errorf("site name is required")
+	}
+
+	if site.CacheDeviceID == nil {
+		site.CacheStatus = models.CacheStatusNone
+		return nil
+	}
+
+	var device models.Device
+	if err := s.database.GetDB().Where("id = ?", *site.CacheDeviceID).First(&device).Error; err != nil {
+		return fmt.Errorf("cache device not found")
+	}
+	if site.CacheHost == "" {
+		return fmt.Errorf("cache_host is required with a cache device")
+	}
+
+	upstreams := make([]string, 0, len(site.CacheUpstreams))
+	seen := make(map[string]bool)
+	for _, upstream := range site.CacheUpstreams {
+		upstream = compose.NormalizeRegistry(upstream)
+		if upstream == "" || seen[upstream] {
+			continue
+		}
+		seen[upstream] = true
+		upstreams = append(upstreams, upstream)
+	}
+	if len(upstreams) == 0 {
+		upstreams = []string{compose.DefaultRegistry}
+	}
+	site.CacheUpstreams = upstreams
+
+	if site.CachePort == 0 {
+		site.CachePort = sitecache.DefaultPort
+	}
+	if site.CachePort < 1 || site.CachePort+len(upstreams)-1 > 65535 {
+		return fmt.Errorf("cache_port %d is out of range", site.CachePort)
+	}
+
+	site.CacheStatus = models.CacheStatusUnknown
+	return nil
+}
+
+// assignCacheDevice makes sure the cache device belongs to its site
+func (s *Server) assignCacheDevice(site *models.Site) {
+	if site.CacheDeviceID == nil {
+		return
+	}
+	if err := s.database.GetDB().Model(&models.Device{}).Where("id = ?", *site.CacheDeviceID).
+		Update("site_id", site.ID).Error; err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to assign cache device to site %s", site.Name), err)
+	}
+}
+
+// removeCache removes the cache of a site from a device that no longer runs it
+func (s *Server) removeCache(r *http.Request, site *models.Site) {
+	if site.CacheDeviceID == nil {
+		return
+	}
+
+	var device models.Device
+	if err := s.database.GetDB().Where("id = ?", *site.CacheDeviceID).First(&device).Error; err != nil {
+		return
+	}
+	if err := s.caches.Remove(r.Context(), device.DeviceID); err != nil {
+		s.logger.Warn(fmt.Sprintf("Failed to remove registry cache from device %s: %v", device.DeviceID, err))
+	}
+}
+
+// handleSites handles the sites endpoint
+func (s *Server) handleSites(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		var sites []models.Site
+		if err := s.database.GetDB().Order("name").Find(&sites).Error; err != nil {
+			s.logger.Error("Failed to fetch sites", err)
+			http.Error(w, "Failed to fetch sites", http.StatusInternalServerError)
+			return
+		}
+
+		jsonResponse(w, sites, http.StatusOK)
+
+	case http.MethodPost:
+		var site models.Site
+		if err := json.NewDecoder(r.Body).Decode(&site); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		if err := s.validateSite(&site); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		site.CacheError, site.CacheCheckedAt = "", nil
+
+		if err := s.database.GetDB().Create(&site).Error; err != nil {
+			s.logger.Error("Failed to create site", err)
+			http.Error(w, "Failed to create site", http.StatusInternalServerError)
+			return
+		}
+		s.assignCacheDevice(&site)
+
+		jsonResponse(w, site, http.StatusCreated)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleSiteByID handles the site by ID endpoint
+func (s *Server) handleSiteByID(w http.ResponseWriter, r *http.Request) {
+	siteID := r.PathValue("id")
+
+	var existing models.Site
+	if err := s.database.GetDB().Where("id = ?", siteID).First(&existing).Error; err != nil {
+		http.Error(w, "Site not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		jsonResponse(w, existing, http.StatusOK)
+
+	case http.MethodPut:
+		var site models.Site
+		if err := json.NewDecoder(r.Body).Decode(&site); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		if err := s.validateSite(&site); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Keep the health of a cache whose settings did not change
+		cacheChanged := !reflect.DeepEqual(site.CacheDeviceID, existing.CacheDeviceID) ||
+			site.CacheHost != existing.CacheHost || site.CachePort != existing.CachePort ||
+			!reflect.DeepEqual(site.CacheUpstreams, existing.CacheUpstreams)
+		if !cacheChanged && site.CacheDeviceID != nil {
+			site.CacheStatus = existing.CacheStatus
+		}
+
+		site.ID = existing.ID
+		if err := s.database.GetDB().Model(&site).Select(siteColumns).Updates(&site).Error; err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to update site %s", siteID), err)
+			http.Error(w, "Failed to update site", http.StatusInternalServerError)
+			return
+		}
+		s.assignCacheDevice(&site)
+
+		if !reflect.DeepEqual(site.CacheDeviceID, existing.CacheDeviceID) {
+			s.removeCache(r, &existing)
+		}
+
+		s.database.GetDB().Where("id = ?", existing.ID).First(&site)
+		jsonResponse(w, site, http.StatusOK)
+
+	case http.MethodDelete:
+		err := s.database.GetDB().Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(&models.Device{}).Where("site_id = ?", existing.ID).Update("site_id", nil).Error; err != nil {
+				return err
+			}
+			return tx.Delete(&existing).Error
+		})
+		if err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to delete site %s", siteID), err)
+			http.Error(w, "Failed to delete site", http.StatusInternalServerError)
+			return
+		}
+
+		s.removeCache(r, &existing)
+		s.caches.Forget(&existing)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleSiteCacheDeploy starts a job deploying the registry cache of a site
+// to its cache device
+func (s *Server) handleSiteCacheDeploy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var site models.Site
+	if err := s.database.GetDB().Where("id = ?", r.PathValue("id")).First(&site).Error; err != nil {
+		http.Error(w, "Site not found", http.StatusNotFound)
+		return
+	}
+	if site.CacheDeviceID == nil {
+		http.Error(w, "Site has no cache device", http.StatusBadRequest)
+		return
+	}
+
+	s.enqueue(w, r, sitecache.JobDeploy, sitecache.JobPayload{SiteID: site.ID})
+}
+
+// handleSiteCacheCheck starts a job checking the registry cache of a site
+// right away
+func (s *Server) handleSiteCacheCheck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var site models.Site
+	if err := s.database.GetDB().Where("id = ?", r.PathValue("id")).First(&site).Error; err != nil {
+		http.Error(w, "Site not found", http.StatusNotFound)
+		return
+	}
+
+	s.enqueue(w, r, sitecache.JobCheck, sitecache.JobPayload{SiteID: site.ID})
+}
@@ -0,0 +1,193 @@
+package api
+
+import (
+	"reflect"
+	"sort"
+
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/google/uuid"
+)
+
+// Kinds of changes between fleet states
+const (
+	changeAdded   = "added"
+	changeRemoved = "removed"
+	changeChanged = "changed"
+)
+
+// SnapshotChange is a difference between two states of a fleet
+type SnapshotChange struct {
+	Path   string      `json:"path"`   // e.g. software/pos/version or devices/store-1/env_vars/app/LOG_LEVEL
+	Change string      `json:"change"` // added, removed or changed
+	From   interface{} `json:"from,omitempty"`
+	To     interface{} `json:"to,omitempty"`
+}
+
+// stateDiff collects the changes between two fleet states
+type stateDiff struct {
+	changes []SnapshotChange
+	mask    func(softwareID uuid.UUID, name, value string) string
+}
+
+// diffFleetStates lists what changed from one state of a fleet to another,
+// with secret env var values masked and credentials in compose overrides
+// redacted
+func (s *Server) diffFleetStates(from, to *models.FleetState) []SnapshotChange {
+	d := &stateDiff{changes: []SnapshotChange{}, mask: s.envMasker()}
+
+	fromSoftware := make(map[string]models.SnapshotSoftware, len(from.Software))
+	for _, entry := range from.Software {
+		fromSoftware[entry.Name] = entry
+	}
+	toSoftware := make(map[string]models.SnapshotSoftware, len(to.Software))
+	for _, entry := range to.Software {
+		toSoftware[entry.Name] = entry
+	}
+	for _, name := range unionKeys(fromSoftware, toSoftware) {
+		before, hadBefore := fromSoftware[name]
+		after, hasAfter := toSoftware[name]
+		path := "software/" + name
+		switch {
+		case !hadBefore:
+			d.add(path, changeAdded, nil, after.Version)
+		case !hasAfter:
+			d.add(path, changeRemoved, before.Version, nil)
+		default:
+			if before.Version != after.Version {
+				d.add(path+"/version", changeChanged, before.Version, after.Version)
+			}
+			d.compare(path+"/exposed_services", before.ExposedServices, after.ExposedServices)
+		}
+	}
+
+	d.envVars("env_vars", from.EnvVars, to.EnvVars)
+
+	fromOverrides := make(map[string]string, len(from.ComposeOverrides))
+	for _, override := range from.ComposeOverrides {
+		fromOverrides[override.Software] = redactCompose(override.ComposeYAML)
+	}
+	toOverrides := make(map[string]string, len(to.ComposeOverrides))
+	for _, override := range to.ComposeOverrides {
+		toOverrides[override.Software] = redactCompose(override.ComposeYAML)
+	}
+	d.strings("compose_overrides", fromOverrides, toOverrides)
+
+	fromDevices := make(map[string]models.SnapshotDevice, len(from.Devices))
+	for _, device := range from.Devices {
+		fromDevices[device.DeviceID] = device
+	}
+	toDevices := make(map[string]models.SnapshotDevice, len(to.Devices))
+	for _, device := range to.Devices {
+		toDevices[device.DeviceID] = device
+	}
+	for _, id := range unionKeys(fromDevices, toDevices) {
+		before, hadBefore := fromDevices[id]
+		after, hasAfter := toDevices[id]
+		path := "devices/" + id
+		switch {
+		case !hadBefore:
+			d.add(path, changeAdded, nil, after.Name)
+		case !hasAfter:
+			d.add(path, changeRemoved, before.Name, nil)
+		default:
+			d.strings(path+"/software", before.Software, after.Software)
+			d.envVars(path+"/env_vars", before.EnvVars, after.EnvVars)
+
+			fromServices := make(map[string]models.SnapshotService, len(before.ExposedServices))
+			for _, service := range before.ExposedServices {
+				fromServices[service.Name] = service
+			}
+			toServices := make(map[string]models.SnapshotService, len(after.ExposedServices))
+			for _, service := range after.ExposedServices {
+				toServices[service.Name] = service
+			}
+			for _, name := range unionKeys(fromServices, toServices) {
+				oldService, hadService := fromServices[name]
+				newService, hasService := toServices[name]
+				switch {
+				case !hadService:
+					d.add(path+"/exposed_services/"+name, changeAdded, nil, newService)
+				case !hasService:
+					d.add(path+"/exposed_services/"+name, changeRemoved, oldService, nil)
+				default:
+					d.compare(path+"/exposed_services/"+name, oldService, newService)
+				}
+			}
+		}
+	}
+
+	return d.changes
+}
+
+// add records a change
+func (d *stateDiff) add(path, change string, from, to interface{}) {
+	d.changes = append(d.changes, SnapshotChange{Path: path, Change: change, From: from, To: to})
+}
+
+// compare records a change of a value if it is not the same in both states
+func (d *stateDiff) compare(path string, from, to interface{}) {
+	if !reflect.DeepEqual(from, to) {
+		d.add(path, changeChanged, from, to)
+	}
+}
+
+// strings records the changes of a map of strings, by key
+func (d *stateDiff) strings(path string, from, to map[string]string) {
+	for _, key := range unionKeys(from, to) {
+		before, hadBefore := from[key]
+		after, hasAfter := to[key]
+		switch {
+		case !hadBefore:
+			d.add(path+"/"+key, changeAdded, nil, after)
+		case !hasAfter:
+			d.add(path+"/"+key, changeRemoved, before, nil)
+		case before != after:
+			d.add(path+"/"+key, changeChanged, before, after)
+		}
+	}
+}
+
+// envVars records the changes of the env vars of containers, by container
+// and variable, masking secret values
+func (d *stateDiff) envVars(path string, from, to []models.SnapshotEnvVars) {
+	fromContainers := make(map[string]models.SnapshotEnvVars, len(from))
+	for _, record := range from {
+		fromContainers[record.ContainerName] = record
+	}
+	toContainers := make(map[string]models.SnapshotEnvVars, len(to))
+	for _, record := range to {
+		toContainers[record.ContainerName] = record
+	}
+
+	for _, container := range unionKeys(fromContainers, toContainers) {
+		before, after := fromContainers[container], toContainers[container]
+		for _, name := range unionKeys(before.EnvVars, after.EnvVars) {
+			oldValue, hadValue := before.EnvVars[name]
+			newValue, hasValue := after.EnvVars[name]
+			varPath := path + "/" + container + "/" + name
+			switch {
+			case !hadValue:
+				d.add(varPath, changeAdded, nil, d.mask(after.SoftwareID, name, newValue))
+			case !hasValue:
+				d.add(varPath, changeRemoved, d.mask(before.SoftwareID, name, oldValue), nil)
+			case oldValue != newValue:
+				d.add(varPath, changeChanged, d.mask(before.SoftwareID, name, oldValue), d.mask(after.SoftwareID, name, newValue))
+			}
+		}
+	}
+}
+
+// unionKeys returns the keys of two maps, sorted
+func unionKeys[V any](a, b map[string]V) []string {
+	keys := make([]string, 0, len(a)+len(b))
+	for key := range a {
+		keys = append(keys, key)
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,575 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/edgetainer/edgetainer/internal/server/deploy"
+	"github.com/edgetainer/edgetainer/internal/server/envschema"
+	"github.com/edgetainer/edgetainer/internal/shared/credentials"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// currentState names the live state of a fleet in place of a snapshot when
+// comparing
+const currentState = "current"
+
+// SnapshotRequest takes a snapshot of a fleet
+type SnapshotRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+// SnapshotResponse is a snapshot with its state, secrets masked
+type SnapshotResponse struct {
+	models.FleetSnapshot
+	State *models.FleetState `json:"state"`
+}
+
+// SnapshotRestoreResponse lists what restoring a snapshot started
+type SnapshotRestoreResponse struct {
+	Snapshot  uuid.UUID   `json:"snapshot_id"`
+	Backup    uuid.UUID   `json:"backup_id"` // Snapshot of the state before it was restored
+	Rollouts  []uuid.UUID `json:"rollouts"`
+	Approvals []uuid.UUID `json:"approvals"`
+}
+
+// handleFleetSnapshots lists the snapshots of a fleet, newest first, or
+// takes a new one
+func (s *Server) handleFleetSnapshots(w http.ResponseWriter, r *http.Request) {
+	var fleet models.Fleet
+	if err := s.database.GetDB().Where("id = ?", r.PathValue("id")).First(&fleet).Error; err != nil {
+		http.Error(w, "Fleet not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		snapshots := []models.FleetSnapshot{}
+		if err := s.database.GetDB().Omit("state").Where("fleet_id = ?", fleet.ID).
+			Order("created_at DESC").Find(&snapshots).Error; err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to fetch snapshots of fleet %s", fleet.ID), err)
+			http.Error(w, "Failed to fetch snapshots", http.StatusInternalServerError)
+			return
+		}
+		jsonResponse(w, snapshots, http.StatusOK)
+
+	case http.MethodPost:
+		user, _ := r.Context().Value("user").(models.User)
+		if user.Role != models.UserRoleAdmin && user.Role != models.UserRoleOperator {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		var request SnapshotRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		request.Name = strings.TrimSpace(request.Name)
+		if request.Name == "" {
+			http.Error(w, "Name is required", http.StatusBadRequest)
+			return
+		}
+
+		snapshot, state, err := s.takeSnapshot(r.Context(), &fleet, request.Name, request.Description, user.Username)
+		if err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to take snapshot of fleet %s", fleet.ID), err)
+			http.Error(w, "Failed to take snapshot", http.StatusInternalServerError)
+			return
+		}
+
+		s.audit(r, models.AuditFleetSnapshotCreate, "", "", map[string]interface{}{
+			"fleet_id":    fleet.ID.String(),
+			"snapshot_id": snapshot.ID.String(),
+			"name":        snapshot.Name,
+		})
+		jsonResponse(w, SnapshotResponse{FleetSnapshot: *snapshot, State: s.maskState(state)}, http.StatusCreated)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleFleetSnapshot returns or deletes a snapshot of a fleet
+func (s *Server) handleFleetSnapshot(w http.ResponseWriter, r *http.Request) {
+	snapshot, ok := s.fleetSnapshot(w, r, r.PathValue("snapshot"))
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		state, err := decodeFleetState(snapshot)
+		if err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to decode snapshot %s", snapshot.ID), err)
+			http.Error(w, "Failed to decode snapshot", http.StatusInternalServerError)
+			return
+		}
+		jsonResponse(w, SnapshotResponse{FleetSnapshot: *snapshot, State: s.maskState(state)}, http.StatusOK)
+
+	case http.MethodDelete:
+		user, _ := r.Context().Value("user").(models.User)
+		if user.Role != models.UserRoleAdmin && user.Role != models.UserRoleOperator {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		if err := s.database.GetDB().Delete(snapshot).Error; err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to delete snapshot %s", snapshot.ID), err)
+			http.Error(w, "Failed to delete snapshot", http.StatusInternalServerError)
+			return
+		}
+		s.audit(r, models.AuditFleetSnapshotDelete, "", "", map[string]interface{}{
+			"fleet_id":    snapshot.FleetID.String(),
+			"snapshot_id": snapshot.ID.String(),
+			"name":        snapshot.Name,
+		})
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleFleetSnapshotDiff compares two snapshots of a fleet, or a snapshot
+// with the fleet as it is now
+func (s *Server) handleFleetSnapshotDiff(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	from, to := r.URL.Query().Get("from"), r.URL.Query().Get("to")
+	if from == "" {
+		http.Error(w, "from is required", http.StatusBadRequest)
+		return
+	}
+	if to == "" {
+		to = currentState
+	}
+
+	var fleet models.Fleet
+	if err := s.database.GetDB().Where("id = ?", r.PathValue("id")).First(&fleet).Error; err != nil {
+		http.Error(w, "Fleet not found", http.StatusNotFound)
+		return
+	}
+
+	states := make([]*models.FleetState, 2)
+	for i, ref := range []string{from, to} {
+		if ref == currentState {
+			state, err := s.captureFleetState(r.Context(), &fleet)
+			if err != nil {
+				s.logger.Error(fmt.Sprintf("Failed to read state of fleet %s", fleet.ID), err)
+				http.Error(w, "Failed to read fleet state", http.StatusInternalServerError)
+				return
+			}
+			states[i] = state
+			continue
+		}
+
+		snapshot, ok := s.fleetSnapshot(w, r, ref)
+		if !ok {
+			return
+		}
+		state, err := decodeFleetState(snapshot)
+		if err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to decode snapshot %s", snapshot.ID), err)
+			http.Error(w, "Failed to decode snapshot", http.StatusInternalServerError)
+			return
+		}
+		states[i] = state
+	}
+
+	jsonResponse(w, s.diffFleetStates(states[0], states[1]), http.StatusOK)
+}
+
+// handleFleetSnapshotRestore puts the fleet's default software, env vars and
+// compose overrides back as they were in a snapshot and rolls the software
+// versions of the snapshot out to its devices
+func (s *Server) handleFleetSnapshotRestore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, _ := r.Context().Value("user").(models.User)
+	if user.Role != models.UserRoleAdmin && user.Role != models.UserRoleOperator {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	snapshot, ok := s.fleetSnapshot(w, r, r.PathValue("snapshot"))
+	if !ok {
+		return
+	}
+	var fleet models.Fleet
+	if err := s.database.GetDB().Where("id = ?", snapshot.FleetID).First(&fleet).Error; err != nil {
+		http.Error(w, "Fleet not found", http.StatusNotFound)
+		return
+	}
+	state, err := decodeFleetState(snapshot)
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to decode snapshot %s", snapshot.ID), err)
+		http.Error(w, "Failed to decode snapshot", http.StatusInternalServerError)
+		return
+	}
+
+	// Software deleted since cannot be rolled out again
+	software := make([]models.Software, len(state.Software))
+	for i, entry := range state.Software {
+		if err := s.database.GetDB().Where("id = ?", entry.SoftwareID).First(&software[i]).Error; err != nil {
+			http.Error(w, fmt.Sprintf("Software %s of the snapshot was deleted", entry.Name), http.StatusConflict)
+			return
+		}
+	}
+
+	backup, _, err := s.takeSnapshot(r.Context(), &fleet, fmt.Sprintf("Before restoring %s", snapshot.Name), "", user.Username)
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to take snapshot of fleet %s", fleet.ID), err)
+		http.Error(w, "Failed to take snapshot of the current state", http.StatusInternalServerError)
+		return
+	}
+
+	if err := s.restoreFleetState(&fleet, state); err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to restore snapshot %s of fleet %s", snapshot.ID, fleet.ID), err)
+		http.Error(w, "Failed to restore snapshot", http.StatusInternalServerError)
+		return
+	}
+
+	s.audit(r, models.AuditFleetSnapshotRestore, "", "", map[string]interface{}{
+		"fleet_id":    fleet.ID.String(),
+		"snapshot_id": snapshot.ID.String(),
+		"name":        snapshot.Name,
+		"backup_id":   backup.ID.String(),
+	})
+
+	// The fleet's env vars are back before the rollouts build their payloads
+	response := SnapshotRestoreResponse{Snapshot: snapshot.ID, Backup: backup.ID, Rollouts: []uuid.UUID{}, Approvals: []uuid.UUID{}}
+	for i, entry := range state.Software {
+		if fleet.RequireApproval {
+			approval := &models.DeploymentApproval{
+				FleetID:    fleet.ID,
+				SoftwareID: software[i].ID,
+				Version:    entry.Version,
+			}
+			if err := s.recordApproval(r, approval, "", &software[i]); err != nil {
+				s.logger.Error("Failed to record deployment approval", err)
+				http.Error(w, "Failed to request approval", http.StatusInternalServerError)
+				return
+			}
+			response.Approvals = append(response.Approvals, approval.ID)
+			continue
+		}
+
+		rollout, err := s.deployer.StartRollout(r.Context(), &fleet, &software[i], entry.Version, 0, deploy.RetryPolicy{})
+		switch {
+		case errors.Is(err, deploy.ErrEmptyFleet):
+			// Devices get it when they join
+		case err != nil:
+			s.rolloutFailed(w, fleet.ID.String(), err)
+			return
+		default:
+			response.Rollouts = append(response.Rollouts, rollout.ID)
+		}
+	}
+
+	jsonResponse(w, response, http.StatusAccepted)
+}
+
+// fleetSnapshot looks up a snapshot of the fleet of a request, writing the
+// error response if it is unknown
+func (s *Server) fleetSnapshot(w http.ResponseWriter, r *http.Request, id string) (*models.FleetSnapshot, bool) {
+	snapshotID, err := uuid.Parse(id)
+	if err != nil {
+		http.Error(w, "Snapshot not found", http.StatusNotFound)
+		return nil, false
+	}
+	var snapshot models.FleetSnapshot
+	if err := s.database.GetDB().Where("id = ? AND fleet_id = ?", snapshotID, r.PathValue("id")).First(&snapshot).Error; err != nil {
+		http.Error(w, "Snapshot not found", http.StatusNotFound)
+		return nil, false
+	}
+	return &snapshot, true
+}
+
+// takeSnapshot records the state of a fleet as it is now
+func (s *Server) takeSnapshot(ctx context.Context, fleet *models.Fleet, name, description, createdBy string) (*models.FleetSnapshot, *models.FleetState, error) {
+	state, err := s.captureFleetState(ctx, fleet)
+	if err != nil {
+		return nil, nil, err
+	}
+	encoded, err := json.Marshal(state)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	snapshot := &models.FleetSnapshot{
+		FleetID:     fleet.ID,
+		Name:        name,
+		Description: description,
+		State:       string(encoded),
+		CreatedBy:   createdBy,
+	}
+	if err := s.database.GetDB().WithContext(ctx).Create(snapshot).Error; err != nil {
+		return nil, nil, err
+	}
+	return snapshot, state, nil
+}
+
+// decodeFleetState decodes the state held by a snapshot
+func decodeFleetState(snapshot *models.FleetSnapshot) (*models.FleetState, error) {
+	var state models.FleetState
+	if err := json.Unmarshal([]byte(snapshot.State), &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// captureFleetState reads the desired state of a fleet and its devices: its
+// default software, env vars and compose overrides, and for each device the
+// versions last deployed to it, its env vars and exposed services
+func (s *Server) captureFleetState(ctx context.Context, fleet *models.Fleet) (*models.FleetState, error) {
+	db := s.database.GetDB().WithContext(ctx)
+	state := &models.FleetState{
+		Software:         []models.SnapshotSoftware{},
+		EnvVars:          []models.SnapshotEnvVars{},
+		ComposeOverrides: []models.SnapshotComposeOverride{},
+		Devices:          []models.SnapshotDevice{},
+	}
+
+	// Deleted software keeps its name in the state
+	names := make(map[uuid.UUID]string)
+	var software []models.Software
+	if err := db.Unscoped().Select("id", "name", "current_version").Find(&software).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch software: %w", err)
+	}
+	current := make(map[uuid.UUID]string, len(software))
+	for _, sw := range software {
+		names[sw.ID], current[sw.ID] = sw.Name, sw.CurrentVersion
+	}
+
+	var defaults []models.FleetDefaultSoftware
+	if err := db.Where("fleet_id = ?", fleet.ID).Order("position").Find(&defaults).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch default software: %w", err)
+	}
+	for _, entry := range defaults {
+		version := entry.Version
+		if version == "" {
+			version = current[entry.SoftwareID]
+		}
+		state.Software = append(state.Software, models.SnapshotSoftware{
+			SoftwareID:      entry.SoftwareID,
+			Name:            names[entry.SoftwareID],
+			Version:         version,
+			ExposedServices: entry.ExposedServices,
+		})
+	}
+
+	var envVars []models.FleetEnvVars
+	if err := db.Where("fleet_id = ?", fleet.ID).Order("container_name").Find(&envVars).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch env vars: %w", err)
+	}
+	for _, record := range envVars {
+		state.EnvVars = append(state.EnvVars, models.SnapshotEnvVars{
+			SoftwareID:    record.SoftwareID,
+			ContainerName: record.ContainerName,
+			EnvVars:       deploy.DecodeEnvVars(record.EnvVars),
+		})
+	}
+
+	var overrides []models.FleetComposeOverride
+	if err := db.Where("fleet_id = ?", fleet.ID).Find(&overrides).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch compose overrides: %w", err)
+	}
+	for _, override := range overrides {
+		state.ComposeOverrides = append(state.ComposeOverrides, models.SnapshotComposeOverride{
+			SoftwareID:  override.SoftwareID,
+			Software:    names[override.SoftwareID],
+			ComposeYAML: override.ComposeYAML,
+		})
+	}
+	sort.Slice(state.ComposeOverrides, func(i, j int) bool {
+		return state.ComposeOverrides[i].Software < state.ComposeOverrides[j].Software
+	})
+
+	var devices []models.Device
+	if err := db.Select("id", "device_id", "name").Where("fleet_id = ?", fleet.ID).Order("device_id").Find(&devices).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch devices: %w", err)
+	}
+	if len(devices) == 0 {
+		return state, nil
+	}
+	ids := make([]uuid.UUID, len(devices))
+	byID := make(map[uuid.UUID]*models.SnapshotDevice, len(devices))
+	state.Devices = make([]models.SnapshotDevice, len(devices))
+	for i, device := range devices {
+		ids[i] = device.ID
+		state.Devices[i] = models.SnapshotDevice{DeviceID: device.DeviceID, Name: device.Name, Software: map[string]string{}}
+		byID[device.ID] = &state.Devices[i]
+	}
+
+	// The version a device runs is that of its last successful deployment of
+	// the software
+	var running []struct {
+		DeviceID   uuid.UUID
+		SoftwareID uuid.UUID
+		Version    string
+	}
+	if err := db.Model(&models.Deployment{}).
+		Select("DISTINCT ON (device_id, software_id) device_id, software_id, version").
+		Where("status = ? AND device_id IN ?", models.DeploymentStatusDeployed, ids).
+		Order("device_id, software_id, created_at DESC").
+		Scan(&running).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch deployed versions: %w", err)
+	}
+	for _, deployed := range running {
+		byID[deployed.DeviceID].Software[names[deployed.SoftwareID]] = deployed.Version
+	}
+
+	var deviceEnvVars []models.DeviceEnvVars
+	if err := db.Where("device_id IN ?", ids).Order("container_name").Find(&deviceEnvVars).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch device env vars: %w", err)
+	}
+	for _, record := range deviceEnvVars {
+		device := byID[record.DeviceID]
+		device.EnvVars = append(device.EnvVars, models.SnapshotEnvVars{
+			SoftwareID:    record.SoftwareID,
+			ContainerName: record.ContainerName,
+			EnvVars:       deploy.DecodeEnvVars(record.EnvVars),
+		})
+	}
+
+	var services []models.ExposedService
+	if err := db.Where("device_id IN ?", ids).Order("name").Find(&services).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch exposed services: %w", err)
+	}
+	for _, service := range services {
+		device := byID[service.DeviceID]
+		device.ExposedServices = append(device.ExposedServices, models.SnapshotService{
+			Name:           service.Name,
+			ContainerName:  service.ContainerName,
+			InternalPort:   service.InternalPort,
+			ExternalPort:   service.ExternalPort,
+			Protocol:       service.Protocol,
+			URLPath:        service.URLPath,
+			AuthRequired:   service.AuthRequired,
+			AllowedSources: service.AllowedSources,
+			Enabled:        service.Enabled,
+		})
+	}
+
+	return state, nil
+}
+
+// restoreFleetState replaces the default software, env vars and compose
+// overrides of a fleet with those of a state. Default software is pinned to
+// the version it had in the state.
+func (s *Server) restoreFleetState(fleet *models.Fleet, state *models.FleetState) error {
+	return s.database.GetDB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("fleet_id = ?", fleet.ID).Delete(&models.FleetDefaultSoftware{}).Error; err != nil {
+			return err
+		}
+		for i, entry := range state.Software {
+			if err := tx.Create(&models.FleetDefaultSoftware{
+				FleetID:         fleet.ID,
+				SoftwareID:      entry.SoftwareID,
+				Version:         entry.Version,
+				Position:        i,
+				ExposedServices: entry.ExposedServices,
+			}).Error; err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Where("fleet_id = ?", fleet.ID).Delete(&models.FleetEnvVars{}).Error; err != nil {
+			return err
+		}
+		for _, record := range state.EnvVars {
+			encoded, _ := json.Marshal(record.EnvVars)
+			if err := tx.Create(&models.FleetEnvVars{
+				FleetID:       fleet.ID,
+				SoftwareID:    record.SoftwareID,
+				ContainerName: record.ContainerName,
+				EnvVars:       string(encoded),
+			}).Error; err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Where("fleet_id = ?", fleet.ID).Delete(&models.FleetComposeOverride{}).Error; err != nil {
+			return err
+		}
+		for _, override := range state.ComposeOverrides {
+			if err := tx.Create(&models.FleetComposeOverride{
+				FleetID:     fleet.ID,
+				SoftwareID:  override.SoftwareID,
+				ComposeYAML: override.ComposeYAML,
+			}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// maskState returns a copy of a state with secret env var values masked and
+// credentials in compose overrides redacted
+func (s *Server) maskState(state *models.FleetState) *models.FleetState {
+	mask := s.envMasker()
+	maskEnv := func(records []models.SnapshotEnvVars) []models.SnapshotEnvVars {
+		masked := make([]models.SnapshotEnvVars, len(records))
+		for i, record := range records {
+			masked[i] = record
+			masked[i].EnvVars = make(map[string]string, len(record.EnvVars))
+			for name, value := range record.EnvVars {
+				masked[i].EnvVars[name] = mask(record.SoftwareID, name, value)
+			}
+		}
+		return masked
+	}
+
+	masked := *state
+	masked.EnvVars = maskEnv(state.EnvVars)
+	masked.ComposeOverrides = make([]models.SnapshotComposeOverride, len(state.ComposeOverrides))
+	for i, override := range state.ComposeOverrides {
+		masked.ComposeOverrides[i] = override
+		masked.ComposeOverrides[i].ComposeYAML = redactCompose(override.ComposeYAML)
+	}
+	masked.Devices = make([]models.SnapshotDevice, len(state.Devices))
+	for i, device := range state.Devices {
+		masked.Devices[i] = device
+		masked.Devices[i].EnvVars = maskEnv(device.EnvVars)
+	}
+	return &masked
+}
+
+// envMasker returns a function masking an env var value if the current env
+// schema of its software declares it secret or it holds credentials. Schemas
+// are loaded once per software.
+func (s *Server) envMasker() func(softwareID uuid.UUID, name, value string) string {
+	schemas := make(map[uuid.UUID]envschema.Schema)
+	return func(softwareID uuid.UUID, name, value string) string {
+		schema, ok := schemas[softwareID]
+		if !ok && softwareID != uuid.Nil {
+			var software models.Software
+			if err := s.database.GetDB().Where("id = ?", softwareID).First(&software).Error; err == nil {
+				schema, _ = s.deployer.LoadEnvSchema(s.ctx, software, "")
+			}
+			schemas[softwareID] = schema
+		}
+
+		values := map[string]string{name: value}
+		if schema != nil {
+			values = schema.MaskSecrets(values)
+		}
+		return credentials.MaskEnv(values, envschema.Mask)[name]
+	}
+}
@@ -5,8 +5,12 @@ import (
 	"fmt"
 	"net/http"
 	"path/filepath"
+	"strings"
 
+	"github.com/edgetainer/edgetainer/internal/shared/compose"
+	"github.com/edgetainer/edgetainer/internal/shared/credentials"
 	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
 )
 
 // handleSoftware handles the software endpoint
@@ -24,6 +28,9 @@ func (s *Server) handleSoftware(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		for i := range software {
+			redactSoftware(&software[i])
+		}
 		jsonResponse(w, software, http.StatusOK)
 
 	case http.MethodPost:
@@ -46,6 +53,20 @@ func (s *Server) handleSoftware(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		if err := validateStrategy(&software); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := validatePlatforms(&software); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if !s.checkSoftwareCredentials(w, r, &software, &models.Software{}) {
+			return
+		}
+
 		// Save to the database
 		if err := s.database.GetDB().Create(&software).Error; err != nil {
 			s.logger.Error("Failed to create software", err)
@@ -53,6 +74,7 @@ func (s *Server) handleSoftware(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		redactSoftware(&software)
 		jsonResponse(w, software, http.StatusCreated)
 
 	default:
@@ -80,6 +102,7 @@ func (s *Server) handleSoftwareByID(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		redactSoftware(&software)
 		jsonResponse(w, software, http.StatusOK)
 
 	case http.MethodPut:
@@ -97,6 +120,25 @@ func (s *Server) handleSoftwareByID(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		var stored models.Software
+		if err := s.database.GetDB().First(&stored, softwareID).Error; err != nil {
+			http.Error(w, "Software not found", http.StatusNotFound)
+			return
+		}
+		if !s.checkSoftwareCredentials(w, r, &software, &stored) {
+			return
+		}
+
+		if err := validateStrategy(&software); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := validatePlatforms(&software); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		// Update in the database
 		result := s.database.GetDB().Model(&models.Software{}).Where("id = ?", softwareID).Updates(software)
 		if result.Error != nil {
@@ -113,6 +155,7 @@ func (s *Server) handleSoftwareByID(w http.ResponseWriter, r *http.Request) {
 		// Fetch the updated software to return
 		s.database.GetDB().First(&software, softwareID)
 
+		redactSoftware(&software)
 		jsonResponse(w, software, http.StatusOK)
 
 	case http.MethodDelete:
@@ -135,3 +178,70 @@ func (s *Server) handleSoftwareByID(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
+
+// checkSoftwareCredentials puts the credentials of the stored software back
+// where the request sent them redacted, then applies the secret scan policy
+// to the compose file and default env vars. It responds with an error and
+// returns false if the software cannot be saved.
+func (s *Server) checkSoftwareCredentials(w http.ResponseWriter, r *http.Request, software, stored *models.Software) bool {
+	composeYAML, err := credentials.RestoreYAML(software.DockerComposeYAML, stored.DockerComposeYAML)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("docker_compose_yaml: %v", err), http.StatusBadRequest)
+		return false
+	}
+	software.DockerComposeYAML = composeYAML
+
+	var envVars map[string]string
+	if software.DefaultEnvVars != "" {
+		if err := json.Unmarshal([]byte(software.DefaultEnvVars), &envVars); err != nil {
+			http.Error(w, "default_env_vars must be a JSON object of strings", http.StatusBadRequest)
+			return false
+		}
+		envVars = keepMaskedSecrets(envVars, stored.DefaultEnvVars)
+		encoded, _ := json.Marshal(envVars)
+		software.DefaultEnvVars = string(encoded)
+	}
+
+	findings, err := scanUpload(software.DockerComposeYAML, envVars, "default_env_vars")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("docker_compose_yaml: %v", err), http.StatusBadRequest)
+		return false
+	}
+	return s.checkCredentials(w, r, "Software "+software.Name, findings)
+}
+
+// validatePlatforms normalizes the platforms the images of a software are
+// built for, e.g. aarch64 to linux/arm64
+func validatePlatforms(software *models.Software) error {
+	platforms, err := protocol.NormalizePlatforms(software.Platforms)
+	if err != nil {
+		return fmt.Errorf("platforms: %w", err)
+	}
+	software.Platforms = platforms
+	return nil
+}
+
+// validateStrategy checks the deployment strategy of a software and whether
+// its compose file can be deployed with it
+func validateStrategy(software *models.Software) error {
+	switch software.Strategy {
+	case "", protocol.StrategyRecreate:
+	case protocol.StrategyBlueGreen:
+		if software.DockerComposeYAML == "" {
+			break
+		}
+		if _, _, err := compose.UnpublishPorts(software.DockerComposeYAML); err != nil {
+			return fmt.Errorf("compose file cannot be deployed blue-green: %v", err)
+		}
+	default:
+		return fmt.Errorf("unknown strategy %q, use recreate or blue-green", software.Strategy)
+	}
+
+	if software.BlueGreen.HealthTimeout < 0 || software.BlueGreen.DrainTimeout < 0 {
+		return fmt.Errorf("blue_green timeouts must not be negative")
+	}
+	if path := software.BlueGreen.HealthPath; path != "" && !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("blue_green health_path must start with /")
+	}
+	return nil
+}
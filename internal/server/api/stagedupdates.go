@@ -0,0 +1,248 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/server/deploy"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/google/uuid"
+)
+
+// StageUpdateRequest hands a software version to a device to deploy later,
+// whether it can reach the server then or not
+type StageUpdateRequest struct {
+	SoftwareID uuid.UUID  `json:"software_id"`
+	Version    string     `json:"version,omitempty"`  // Defaults to the software's current version
+	ApplyAt    *time.Time `json:"apply_at,omitempty"` // Omitted to wait until the update is activated
+}
+
+// handleDeviceStagedUpdates lists the staged updates of a device, newest
+// first, or stages a new one
+func (s *Server) handleDeviceStagedUpdates(w http.ResponseWriter, r *http.Request) {
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", r.PathValue("id")).First(&device).Error; err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		var updates []models.StagedUpdate
+		if err := s.database.GetDB().Where("device_id = ?", device.ID).
+			Order("created_at DESC").Find(&updates).Error; err != nil {
+			s.logger.Error("Failed to fetch staged updates", err)
+			http.Error(w, "Failed to fetch staged updates", http.StatusInternalServerError)
+			return
+		}
+		jsonResponse(w, updates, http.StatusOK)
+
+	case http.MethodPost:
+		s.stageUpdate(w, r, &device)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// stageUpdate hands a software version to a connected device, which fetches
+// it right away and deploys it at the requested time or once activated
+func (s *Server) stageUpdate(w http.ResponseWriter, r *http.Request, device *models.Device) {
+	user, _ := r.Context().Value("user").(models.User)
+	if user.Role != models.UserRoleAdmin && user.Role != models.UserRoleOperator {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var request StageUpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if request.ApplyAt != nil && request.ApplyAt.IsZero() {
+		request.ApplyAt = nil
+	}
+
+	var software models.Software
+	if err := s.database.GetDB().Where("id = ?", request.SoftwareID).First(&software).Error; err != nil {
+		http.Error(w, "Software not found", http.StatusBadRequest)
+		return
+	}
+
+	// The device deploys staged updates on its own, there is no point at
+	// which an approval could be waited for
+	fleet, err := s.approvalFleet(device.FleetID)
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to fetch fleet of device %s", device.DeviceID), err)
+		http.Error(w, "Failed to fetch fleet", http.StatusInternalServerError)
+		return
+	}
+	if fleet != nil {
+		http.Error(w, fmt.Sprintf("Deploys to fleet %s need approval, updates cannot be staged", fleet.Name), http.StatusConflict)
+		return
+	}
+
+	update, err := s.deployer.StageOnDevice(r.Context(), device, &software, request.Version, request.ApplyAt, user.Username)
+	if err != nil {
+		switch {
+		case update != nil:
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		case errors.Is(err, deploy.ErrAgentFeature):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			s.deployFailed(w, device.DeviceID, nil, err)
+		}
+		return
+	}
+
+	s.audit(r, models.AuditStagedUpdateCreate, device.DeviceID, "", map[string]interface{}{
+		"staged_update_id": update.ID.String(),
+		"software_id":      software.ID.String(),
+		"software_name":    software.Name,
+		"version":          update.Version,
+		"apply_at":         update.ApplyAt,
+	})
+
+	jsonResponse(w, update, http.StatusCreated)
+}
+
+// handleDeviceStagedUpdate returns or cancels a staged update. Cancelling
+// drops it from the device too, which must be connected.
+func (s *Server) handleDeviceStagedUpdate(w http.ResponseWriter, r *http.Request) {
+	device, update, ok := s.deviceStagedUpdate(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		jsonResponse(w, update, http.StatusOK)
+
+	case http.MethodDelete:
+		user, _ := r.Context().Value("user").(models.User)
+		if user.Role != models.UserRoleAdmin && user.Role != models.UserRoleOperator {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		// Updates that failed to be fetched are still on the device
+		if update.Status != models.StagedUpdateStatusStaging && update.Status != models.StagedUpdateStatusStaged &&
+			(update.Status != models.StagedUpdateStatusFailed || update.DeploymentID != nil) {
+			http.Error(w, fmt.Sprintf("Staged update is %s", update.Status), http.StatusConflict)
+			return
+		}
+
+		software, ok := s.stagedSoftware(w, update)
+		if !ok {
+			return
+		}
+
+		if err := s.deployer.CancelStaged(r.Context(), update, device, software); err != nil {
+			if errors.Is(err, deploy.ErrDeviceNotConnected) {
+				http.Error(w, "Device is not connected", http.StatusConflict)
+				return
+			}
+			s.logger.Error(fmt.Sprintf("Failed to cancel staged update %s of device %s", update.ID, device.DeviceID), err)
+			http.Error(w, fmt.Sprintf("Failed to cancel staged update: %v", err), http.StatusBadGateway)
+			return
+		}
+		s.audit(r, models.AuditStagedUpdateCancel, device.DeviceID, "", map[string]interface{}{
+			"staged_update_id": update.ID.String(),
+			"software_name":    software.Name,
+			"version":          update.Version,
+		})
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleStagedUpdateActivate has the device deploy a staged update it fetched
+// now instead of at its time
+func (s *Server) handleStagedUpdateActivate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, _ := r.Context().Value("user").(models.User)
+	if user.Role != models.UserRoleAdmin && user.Role != models.UserRoleOperator {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	device, update, ok := s.deviceStagedUpdate(w, r)
+	if !ok {
+		return
+	}
+	if update.Status != models.StagedUpdateStatusStaged {
+		http.Error(w, fmt.Sprintf("Staged update is %s", update.Status), http.StatusConflict)
+		return
+	}
+
+	software, ok := s.stagedSoftware(w, update)
+	if !ok {
+		return
+	}
+
+	s.audit(r, models.AuditStagedUpdateActivate, device.DeviceID, "", map[string]interface{}{
+		"staged_update_id": update.ID.String(),
+		"software_name":    software.Name,
+		"version":          update.Version,
+	})
+
+	if err := s.deployer.ActivateStaged(r.Context(), update, device, software); err != nil {
+		switch {
+		case frozenFailed(w, err):
+		case errors.Is(err, deploy.ErrDeviceNotConnected):
+			http.Error(w, "Device is not connected", http.StatusConflict)
+		case errors.Is(err, deploy.ErrAgentFeature):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, fmt.Sprintf("Failed to activate staged update: %v", err), http.StatusBadGateway)
+		}
+		return
+	}
+
+	if err := s.database.GetDB().Where("id = ?", update.ID).First(update).Error; err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to fetch staged update %s", update.ID), err)
+	}
+	jsonResponse(w, update, http.StatusOK)
+}
+
+// deviceStagedUpdate looks up the device and staged update of a request,
+// writing the error response if either is unknown
+func (s *Server) deviceStagedUpdate(w http.ResponseWriter, r *http.Request) (*models.Device, *models.StagedUpdate, bool) {
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", r.PathValue("id")).First(&device).Error; err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+
+	updateID, err := uuid.Parse(r.PathValue("update"))
+	if err != nil {
+		http.Error(w, "Staged update not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+	var update models.StagedUpdate
+	if err := s.database.GetDB().Where("id = ? AND device_id = ?", updateID, device.ID).First(&update).Error; err != nil {
+		http.Error(w, "Staged update not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+	return &device, &update, true
+}
+
+// stagedSoftware looks up the software of a staged update, which names the
+// application on the device, writing the error response if it fails
+func (s *Server) stagedSoftware(w http.ResponseWriter, update *models.StagedUpdate) (*models.Software, bool) {
+	var software models.Software
+	if err := s.database.GetDB().Unscoped().Where("id = ?", update.SoftwareID).First(&software).Error; err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to fetch software of staged update %s", update.ID), err)
+		http.Error(w, "Failed to fetch software", http.StatusInternalServerError)
+		return nil, false
+	}
+	return &software, true
+}
@@ -0,0 +1,236 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	// statsDefaultDays is the period the time based statistics cover by default
+	statsDefaultDays = 14
+	// statsMaxDays is the longest period the time based statistics cover
+	statsMaxDays = 90
+	// statsTopDevices is the number of devices listed by alert count
+	statsTopDevices = 10
+)
+
+// retiredStatuses are the statuses of devices that no longer run anything
+var retiredStatuses = []string{models.DeviceStatusDecommissioned, models.DeviceStatusReplaced, models.DeviceStatusRevoked}
+
+// Stats is the overview of a server for a dashboard
+type Stats struct {
+	Since            time.Time          `json:"since"` // Start of the period the time based statistics cover
+	Fleets           FleetStats         `json:"fleets"`
+	Devices          DeviceStats        `json:"devices"`
+	Deployments      DeploymentStats    `json:"deployments"`
+	TopAlertDevices  []AlertDeviceCount `json:"top_alert_devices"`
+	AgentVersions    []VersionCount     `json:"agent_versions"`
+	SoftwareVersions []SoftwareVersions `json:"software_versions"`
+}
+
+// FleetStats counts fleets and their devices
+type FleetStats struct {
+	Total   int64        `json:"total"`
+	Devices []FleetCount `json:"devices"` // Devices per fleet, largest first
+}
+
+// FleetCount is the number of devices of a fleet
+type FleetCount struct {
+	FleetID uuid.UUID `json:"fleet_id"`
+	Name    string    `json:"name"`
+	Devices int64     `json:"devices"`
+}
+
+// DeviceStats counts devices
+type DeviceStats struct {
+	Total    int64            `json:"total"`
+	ByStatus map[string]int64 `json:"by_status"`
+}
+
+// DeploymentStats counts the deployments created in the period
+type DeploymentStats struct {
+	ByStatus map[string]int64 `json:"by_status"`
+	Daily    []DailyCount     `json:"daily"` // One entry per day of the period, oldest first
+}
+
+// DailyCount counts deployments created on one day by status
+type DailyCount struct {
+	Date     string           `json:"date"` // YYYY-MM-DD in UTC
+	ByStatus map[string]int64 `json:"by_status"`
+}
+
+// AlertDeviceCount is the number of alerts fired on a device in the period
+type AlertDeviceCount struct {
+	DeviceID string `json:"device_id"`
+	Name     string `json:"name"`
+	Alerts   int64  `json:"alerts"`
+}
+
+// VersionCount is the number of devices running a version
+type VersionCount struct {
+	Version string `json:"version"`
+	Devices int64  `json:"devices"`
+}
+
+// SoftwareVersions is the version distribution of one software
+type SoftwareVersions struct {
+	SoftwareID uuid.UUID      `json:"software_id"`
+	Name       string         `json:"name"`
+	Versions   []VersionCount `json:"versions"` // Most common first
+}
+
+// handleStats returns the statistics of the server for a dashboard landing
+// page. days sets the period of the deployment and alert statistics.
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	days := statsDefaultDays
+	if value := r.URL.Query().Get("days"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > statsMaxDays {
+			http.Error(w, fmt.Sprintf("Days must be between 1 and %d", statsMaxDays), http.StatusBadRequest)
+			return
+		}
+		days = parsed
+	}
+
+	// The period starts at midnight UTC, so the first day is complete
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	since := today.AddDate(0, 0, 1-days)
+
+	stats, err := computeStats(s.database.GetDB().WithContext(r.Context()), since, days)
+	if err != nil {
+		s.logger.Error("Failed to compute statistics", err)
+		http.Error(w, "Failed to compute statistics", http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse(w, stats, http.StatusOK)
+}
+
+// computeStats runs one grouped query per statistic
+func computeStats(db *gorm.DB, since time.Time, days int) (*Stats, error) {
+	stats := &Stats{
+		Since:            since,
+		Devices:          DeviceStats{ByStatus: map[string]int64{}},
+		Deployments:      DeploymentStats{ByStatus: map[string]int64{}},
+		TopAlertDevices:  []AlertDeviceCount{},
+		AgentVersions:    []VersionCount{},
+		SoftwareVersions: []SoftwareVersions{},
+	}
+
+	if err := db.Model(&models.Fleet{}).Count(&stats.Fleets.Total).Error; err != nil {
+		return nil, fmt.Errorf("failed to count fleets: %w", err)
+	}
+
+	stats.Fleets.Devices = []FleetCount{}
+	if err := db.Model(&models.Fleet{}).
+		Select("fleets.id AS fleet_id, fleets.name, count(devices.id) AS devices").
+		Joins("LEFT JOIN devices ON devices.fleet_id = fleets.id AND devices.deleted_at IS NULL AND devices.status NOT IN ?", retiredStatuses).
+		Group("fleets.id, fleets.name").Order("devices DESC, fleets.name").
+		Scan(&stats.Fleets.Devices).Error; err != nil {
+		return nil, fmt.Errorf("failed to count devices per fleet: %w", err)
+	}
+
+	var statusCounts []struct {
+		Status string
+		Count  int64
+	}
+	if err := db.Model(&models.Device{}).Select("status, count(*) AS count").
+		Group("status").Scan(&statusCounts).Error; err != nil {
+		return nil, fmt.Errorf("failed to count devices: %w", err)
+	}
+	for _, count := range statusCounts {
+		stats.Devices.ByStatus[count.Status] = count.Count
+		stats.Devices.Total += count.Count
+	}
+
+	var dailyCounts []struct {
+		Day    time.Time
+		Status string
+		Count  int64
+	}
+	if err := db.Model(&models.Deployment{}).
+		Select("date_trunc('day', created_at AT TIME ZONE 'UTC') AS day, status, count(*) AS count").
+		Where("created_at >= ?", since).
+		Group("day, status").Scan(&dailyCounts).Error; err != nil {
+		return nil, fmt.Errorf("failed to count deployments: %w", err)
+	}
+
+	// Every day of the period gets an entry, also those without deployments
+	stats.Deployments.Daily = make([]DailyCount, days)
+	for i := range stats.Deployments.Daily {
+		stats.Deployments.Daily[i] = DailyCount{
+			Date:     since.AddDate(0, 0, i).Format(time.DateOnly),
+			ByStatus: map[string]int64{},
+		}
+	}
+	for _, count := range dailyCounts {
+		i := int(count.Day.Sub(since).Hours() / 24)
+		if i < 0 || i >= days {
+			continue
+		}
+		stats.Deployments.Daily[i].ByStatus[count.Status] += count.Count
+		stats.Deployments.ByStatus[count.Status] += count.Count
+	}
+
+	if err := db.Model(&models.Alert{}).
+		Select("devices.device_id, devices.name, count(*) AS alerts").
+		Joins("JOIN devices ON devices.id = alerts.device_id AND devices.deleted_at IS NULL").
+		Where("alerts.fired_at >= ?", since).
+		Group("devices.device_id, devices.name").Order("alerts DESC, devices.name").
+		Limit(statsTopDevices).Scan(&stats.TopAlertDevices).Error; err != nil {
+		return nil, fmt.Errorf("failed to count alerts: %w", err)
+	}
+
+	if err := db.Model(&models.Device{}).
+		Select("coalesce(nullif(agent_version, ''), 'unknown') AS version, count(*) AS devices").
+		Where("status NOT IN ?", append([]string{models.DeviceStatusPending}, retiredStatuses...)).
+		Group("version").Order("devices DESC, version").Scan(&stats.AgentVersions).Error; err != nil {
+		return nil, fmt.Errorf("failed to count agent versions: %w", err)
+	}
+
+	// The version a device runs is that of its last successful deployment of
+	// the software
+	var versionCounts []struct {
+		SoftwareID uuid.UUID
+		Name       string
+		Version    string
+		Devices    int64
+	}
+	latest := db.Model(&models.Deployment{}).
+		Select("DISTINCT ON (device_id, software_id) device_id, software_id, version").
+		Where("status = ?", models.DeploymentStatusDeployed).
+		Order("device_id, software_id, created_at DESC")
+	if err := db.Table("(?) AS running", latest).
+		Select("softwares.id AS software_id, softwares.name, running.version, count(*) AS devices").
+		Joins("JOIN softwares ON softwares.id = running.software_id AND softwares.deleted_at IS NULL").
+		Joins("JOIN devices ON devices.id = running.device_id AND devices.deleted_at IS NULL AND devices.status NOT IN ?", retiredStatuses).
+		Group("softwares.id, softwares.name, running.version").
+		Order("softwares.name, softwares.id, devices DESC, running.version").
+		Scan(&versionCounts).Error; err != nil {
+		return nil, fmt.Errorf("failed to count software versions: %w", err)
+	}
+	for _, count := range versionCounts {
+		last := len(stats.SoftwareVersions) - 1
+		if last < 0 || stats.SoftwareVersions[last].SoftwareID != count.SoftwareID {
+			stats.SoftwareVersions = append(stats.SoftwareVersions, SoftwareVersions{SoftwareID: count.SoftwareID, Name: count.Name})
+			last++
+		}
+		stats.SoftwareVersions[last].Versions = append(stats.SoftwareVersions[last].Versions, VersionCount{
+			Version: count.Version,
+			Devices: count.Devices,
+		})
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,111 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/edgetainer/edgetainer/internal/server/storage"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/google/uuid"
+)
+
+// SetObjectStorage sets the store holding archived logs, and the diagnostics
+// bundles and packet captures moved out of the database
+func (s *Server) SetObjectStorage(store storage.Store) {
+	s.objects = store
+}
+
+// writeData writes the data of a bundle or capture, from the object storage
+// once it was moved there
+func (s *Server) writeData(w http.ResponseWriter, r *http.Request, object string, data []byte, size int64) {
+	if object == "" {
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+		return
+	}
+
+	if s.objects == nil {
+		http.Error(w, "Object storage is not configured", http.StatusServiceUnavailable)
+		return
+	}
+	content, err := s.objects.Open(r.Context(), object, 0)
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to open %s", object), err)
+		http.Error(w, "Failed to read from the object storage", http.StatusBadGateway)
+		return
+	}
+	defer content.Close()
+
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	io.Copy(w, content)
+}
+
+// deleteObjects removes the objects of the records of a model that are about
+// to be deleted
+func (s *Server) deleteObjects(r *http.Request, model interface{}, ids []uuid.UUID) {
+	if s.objects == nil || len(ids) == 0 {
+		return
+	}
+
+	var objects []string
+	s.database.GetDB().Model(model).Where("id IN ? AND object <> ''", ids).Pluck("object", &objects)
+	for _, object := range objects {
+		if err := s.objects.Delete(r.Context(), object); err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to remove %s", object), err)
+		}
+	}
+}
+
+// handleDeviceLogArchives lists the archived logs of a device, newest first
+func (s *Server) handleDeviceLogArchives(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", r.PathValue("id")).First(&device).Error; err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	var archives []models.LogArchive
+	if err := s.database.GetDB().Where("device_id = ?", device.ID).Order("\"from\" DESC").Find(&archives).Error; err != nil {
+		s.logger.Error("Failed to fetch log archives", err)
+		http.Error(w, "Failed to fetch log archives", http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, archives, http.StatusOK)
+}
+
+// handleLogArchiveDownload serves an archive of device logs as gzipped JSON
+// lines
+func (s *Server) handleLogArchiveDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", r.PathValue("id")).First(&device).Error; err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	archiveID, err := uuid.Parse(r.PathValue("archive"))
+	if err != nil {
+		http.Error(w, "Log archive not found", http.StatusNotFound)
+		return
+	}
+	var archive models.LogArchive
+	if err := s.database.GetDB().Where("id = ? AND device_id = ?", archiveID, device.ID).First(&archive).Error; err != nil {
+		http.Error(w, "Log archive not found", http.StatusNotFound)
+		return
+	}
+
+	filename := fmt.Sprintf("logs-%s-%s.jsonl.gz", device.DeviceID, archive.From.UTC().Format("20060102-150405"))
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	s.writeData(w, r, archive.Object, nil, archive.Size)
+}
@@ -0,0 +1,197 @@
+package api
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/edgetainer/edgetainer/internal/server/xlsx"
+	"github.com/google/uuid"
+)
+
+// Formats of table exports
+const (
+	exportCSV  = "csv"
+	exportXLSX = "xlsx"
+)
+
+// exportFlushRows is how many rows of an export are written between
+// flushes, so large exports reach the client while they are produced
+const exportFlushRows = 500
+
+// exportColumn is a column of an export of rows of type T
+type exportColumn[T any] struct {
+	name    string
+	numeric bool // Written as a number to spreadsheets
+	value   func(row *T) string
+}
+
+// tableExport streams rows as CSV or as an Excel workbook, with the columns
+// chosen by the request
+type tableExport[T any] struct {
+	format  string
+	columns []exportColumn[T]
+	w       http.ResponseWriter
+	csv     *csv.Writer
+	xlsx    *xlsx.Writer
+	rows    int
+}
+
+// newExport reads the format and columns of an export request: format is
+// csv, the default, or xlsx, and columns a comma separated list of column
+// names in the order wanted, defaults without it
+func newExport[T any](r *http.Request, available []exportColumn[T], defaults []string) (*tableExport[T], error) {
+	export := &tableExport[T]{format: r.URL.Query().Get("format")}
+	switch export.format {
+	case "":
+		export.format = exportCSV
+	case exportCSV, exportXLSX:
+	default:
+		return nil, fmt.Errorf("format must be csv or xlsx")
+	}
+
+	byName := make(map[string]exportColumn[T], len(available))
+	names := make([]string, 0, len(available))
+	for _, column := range available {
+		byName[column.name] = column
+		names = append(names, column.name)
+	}
+
+	selected := defaults
+	if value := r.URL.Query().Get("columns"); value != "" {
+		selected = strings.Split(value, ",")
+	}
+	for _, name := range selected {
+		column, ok := byName[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown column %q, available are %s", name, strings.Join(names, ", "))
+		}
+		export.columns = append(export.columns, column)
+	}
+	return export, nil
+}
+
+// begin starts the response with the header row. filename is without an
+// extension, sheet names the sheet of a workbook.
+func (e *tableExport[T]) begin(w http.ResponseWriter, filename, sheet string) error {
+	e.w = w
+	names := make([]string, len(e.columns))
+	for i, column := range e.columns {
+		names[i] = column.name
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, filename, e.format))
+	if e.format == exportXLSX {
+		w.Header().Set("Content-Type", xlsx.ContentType)
+		writer, err := xlsx.NewWriter(w, sheet)
+		if err != nil {
+			return err
+		}
+		e.xlsx = writer
+		return writer.WriteHeader(names)
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	e.csv = csv.NewWriter(w)
+	return e.csv.Write(names)
+}
+
+// write adds a row
+func (e *tableExport[T]) write(row *T) error {
+	var err error
+	if e.xlsx != nil {
+		cells := make([]xlsx.Cell, len(e.columns))
+		for i, column := range e.columns {
+			cells[i] = xlsx.Cell{Value: column.value(row), Number: column.numeric}
+		}
+		err = e.xlsx.WriteRow(cells)
+	} else {
+		values := make([]string, len(e.columns))
+		for i, column := range e.columns {
+			values[i] = column.value(row)
+		}
+		err = e.csv.Write(values)
+	}
+	if err != nil {
+		return err
+	}
+
+	e.rows++
+	if e.rows%exportFlushRows == 0 {
+		return e.flush()
+	}
+	return nil
+}
+
+// flush sends the rows written so far to the client
+func (e *tableExport[T]) flush() error {
+	if e.xlsx != nil {
+		if err := e.xlsx.Flush(); err != nil {
+			return err
+		}
+	} else {
+		e.csv.Flush()
+		if err := e.csv.Error(); err != nil {
+			return err
+		}
+	}
+	// Not every writer flushes, the rows are sent at the end then
+	http.NewResponseController(e.w).Flush()
+	return nil
+}
+
+// end completes the export
+func (e *tableExport[T]) end() error {
+	if e.xlsx != nil {
+		return e.xlsx.Close()
+	}
+	e.csv.Flush()
+	return e.csv.Error()
+}
+
+// exportTime formats a time for exports, empty for the zero time
+func exportTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// exportTimePtr formats an optional time for exports
+func exportTimePtr(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return exportTime(*t)
+}
+
+// exportID formats an optional ID for exports
+func exportID(id *uuid.UUID) string {
+	if id == nil {
+		return ""
+	}
+	return id.String()
+}
+
+// exportFloat formats an optional number for exports
+func exportFloat(value *float64) string {
+	if value == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*value, 'f', -1, 64)
+}
+
+// exportFilename makes a name safe for the Content-Disposition header,
+// replacing all but ASCII letters, digits, - and _ with -
+func exportFilename(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 128 && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_') {
+			return r
+		}
+		return '-'
+	}, name)
+}
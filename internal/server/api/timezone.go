@@ -0,0 +1,51 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+// timezoneTimeout bounds applying the timezone of one device
+const timezoneTimeout = time.Minute
+
+// validateTimezone checks a timezone and locale from a request, writing the
+// error response if they are invalid
+func validateTimezone(w http.ResponseWriter, timezone, locale string) bool {
+	if err := protocol.ValidateTimezone(timezone); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	if err := protocol.ValidateLocale(locale); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// applyTimezones sets the timezone and locale of the connected devices among
+// the given ones in the background. Devices that are offline get them when
+// they connect.
+func (s *Server) applyTimezones(deviceIDs []string) {
+	go func() {
+		for _, deviceID := range deviceIDs {
+			if _, connected := s.sshServer.GetDeviceConnection(deviceID); !connected {
+				continue
+			}
+
+			ctx, cancel := context.WithTimeout(s.ctx, timezoneTimeout)
+			response, err := s.sshServer.ApplyTimezone(ctx, deviceID)
+			cancel()
+
+			switch {
+			case err != nil:
+				s.logger.Error(fmt.Sprintf("Failed to apply timezone to device %s", deviceID), err)
+			case !response.Success:
+				s.logger.Warn(fmt.Sprintf("Failed to apply timezone to device %s: %s", deviceID, response.Message))
+			}
+		}
+	}()
+}
@@ -0,0 +1,158 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+// UnmanagedWorkloadRequest changes whether an unmanaged workload fires alerts
+type UnmanagedWorkloadRequest struct {
+	Ignored bool `json:"ignored"`
+}
+
+// lookupUnmanaged finds an unmanaged workload of a device by its ID, writing
+// the error response if there is none
+func (s *Server) lookupUnmanaged(w http.ResponseWriter, r *http.Request) (*models.Device, *models.UnmanagedWorkload, bool) {
+	deviceID := r.PathValue("id")
+
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+
+	var workload models.UnmanagedWorkload
+	if err := s.database.GetDB().Where("id = ? AND device_id = ?", r.PathValue("wid"), device.ID).First(&workload).Error; err != nil {
+		http.Error(w, "Workload not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+
+	return &device, &workload, true
+}
+
+// handleDeviceUnmanaged lists the workloads on a device that were not
+// deployed through edgetainer. Workloads that are gone are only included
+// with ?all=true.
+func (s *Server) handleDeviceUnmanaged(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	deviceID := r.PathValue("id")
+
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	query := s.database.GetDB().Where("device_id = ?", device.ID)
+	if r.URL.Query().Get("all") != "true" {
+		query = query.Where("present = ?", true)
+	}
+
+	workloads := []models.UnmanagedWorkload{}
+	if err := query.Order("kind, name").Find(&workloads).Error; err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to fetch unmanaged workloads of device %s", deviceID), err)
+		http.Error(w, "Failed to fetch unmanaged workloads", http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse(w, workloads, http.StatusOK)
+}
+
+// handleDeviceUnmanagedByID returns an unmanaged workload or changes whether
+// it fires alerts when it shows up
+func (s *Server) handleDeviceUnmanagedByID(w http.ResponseWriter, r *http.Request) {
+	_, workload, ok := s.lookupUnmanaged(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+
+	case http.MethodPut:
+		var request UnmanagedWorkloadRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		workload.Ignored = request.Ignored
+		if err := s.database.GetDB().Model(workload).Update("ignored", workload.Ignored).Error; err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to update unmanaged workload %s", workload.ID), err)
+			http.Error(w, "Failed to update workload", http.StatusInternalServerError)
+			return
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	jsonResponse(w, workload, http.StatusOK)
+}
+
+// handleDeviceUnmanagedAdopt hands an unmanaged compose project over to the
+// agent, which manages it as an application from then on. Standalone
+// containers cannot be adopted.
+func (s *Server) handleDeviceUnmanagedAdopt(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	device, workload, ok := s.lookupUnmanaged(w, r)
+	if !ok {
+		return
+	}
+
+	if workload.Kind != protocol.WorkloadCompose {
+		http.Error(w, "Only compose projects can be adopted", http.StatusBadRequest)
+		return
+	}
+	if !workload.Present {
+		http.Error(w, "Workload is no longer running on the device", http.StatusConflict)
+		return
+	}
+	if _, connected := s.sshServer.GetDeviceConnection(device.DeviceID); !connected {
+		http.Error(w, "Device is not connected", http.StatusConflict)
+		return
+	}
+
+	command, err := protocol.NewCommandWithPayload(protocol.CmdAdoptApp, protocol.AdoptPayload{
+		Project:     workload.Name,
+		WorkingDir:  workload.WorkingDir,
+		ConfigFiles: workload.ConfigFiles,
+	})
+	if err != nil {
+		s.logger.Error("Failed to build adopt command", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response, err := s.sshServer.SendCommand(r.Context(), device.DeviceID, command)
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to adopt %s on device %s", workload.Name, device.DeviceID), err)
+		http.Error(w, "Failed to adopt workload", http.StatusBadGateway)
+		return
+	}
+	if !response.Success {
+		http.Error(w, response.Message, http.StatusBadGateway)
+		return
+	}
+
+	// The agent no longer reports the project, so forget it
+	if err := s.database.GetDB().Delete(workload).Error; err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to remove adopted workload %s", workload.ID), err)
+	}
+
+	s.logger.Info(fmt.Sprintf("Adopted compose project %s on device %s", workload.Name, device.DeviceID))
+	jsonResponse(w, response, http.StatusOK)
+}
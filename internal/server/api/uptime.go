@@ -0,0 +1,268 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	// uptimeDefaultWindow is the period an uptime report covers by default
+	uptimeDefaultWindow = 30 * 24 * time.Hour
+	// uptimeMaxSessions is the number of sessions listed in a device report,
+	// the most recent ones
+	uptimeMaxSessions = 500
+)
+
+// uptimeQuery sums up the connected time of devices within a window. A
+// device's window starts when it was created if that is later. Sessions are
+// clipped to the window; open sessions last to its end, which is never in the
+// future.
+const uptimeQuery = `
+SELECT d.id, d.device_id, d.name, d.status,
+	greatest(@from, d.created_at) AS start,
+	coalesce(sum(extract(epoch FROM least(coalesce(s.disconnected_at, @to), @to) - greatest(s.connected_at, @from, d.created_at))), 0) AS online_seconds,
+	count(s.disconnected_at) FILTER (WHERE s.disconnected_at >= greatest(@from, d.created_at) AND s.disconnected_at < @to) AS disconnects
+FROM devices d
+LEFT JOIN device_sessions s ON s.device_id = d.id
+	AND s.connected_at < @to
+	AND (s.disconnected_at IS NULL OR s.disconnected_at > greatest(@from, d.created_at))
+WHERE d.deleted_at IS NULL AND %s
+GROUP BY d.id`
+
+// Uptime is the availability of a device within a window
+type Uptime struct {
+	DeviceID      string   `json:"device_id"`
+	Name          string   `json:"name"`
+	Status        string   `json:"status"`
+	WindowSeconds float64  `json:"window_seconds"` // From the later of the window start and the device's creation
+	OnlineSeconds float64  `json:"online_seconds"`
+	Uptime        *float64 `json:"uptime"`      // Percent of the window the device was connected, nil for an empty window
+	Disconnects   int64    `json:"disconnects"` // Connections that ended within the window
+}
+
+// DeviceUptime is the uptime report of a device
+type DeviceUptime struct {
+	Uptime
+	From     time.Time              `json:"from"`
+	To       time.Time              `json:"to"`
+	Sessions []models.DeviceSession `json:"sessions"` // Connections within the window, most recent first, clipped to it
+}
+
+// FleetUptime is the uptime report of a fleet
+type FleetUptime struct {
+	FleetID       uuid.UUID `json:"fleet_id"`
+	From          time.Time `json:"from"`
+	To            time.Time `json:"to"`
+	WindowSeconds float64   `json:"window_seconds"` // Summed over the devices
+	OnlineSeconds float64   `json:"online_seconds"`
+	Uptime        *float64  `json:"uptime"` // Percent of the device windows the devices were connected
+	Disconnects   int64     `json:"disconnects"`
+	Devices       []Uptime  `json:"devices"` // Lowest uptime first
+}
+
+// uptimeRow is a row of the uptime query
+type uptimeRow struct {
+	ID            uuid.UUID
+	DeviceID      string
+	Name          string
+	Status        string
+	Start         time.Time
+	OnlineSeconds float64
+	Disconnects   int64
+}
+
+// parseWindow reads the window of an uptime report from the from and to query
+// parameters, RFC 3339 timestamps. The window ends now and covers 30 days by
+// default; it cannot reach into the future.
+func parseWindow(r *http.Request) (time.Time, time.Time, error) {
+	now := time.Now()
+	to := now
+	if value := r.URL.Query().Get("to"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid to, expected an RFC 3339 timestamp")
+		}
+		if parsed.Before(now) {
+			to = parsed
+		}
+	}
+
+	from := to.Add(-uptimeDefaultWindow)
+	if value := r.URL.Query().Get("from"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid from, expected an RFC 3339 timestamp")
+		}
+		from = parsed
+	}
+
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, fmt.Errorf("from must be before to")
+	}
+	return from, to, nil
+}
+
+// queryUptime runs the uptime query for the devices matching a condition
+func queryUptime(db *gorm.DB, from, to time.Time, condition string, args map[string]interface{}) ([]Uptime, error) {
+	args["from"], args["to"] = from, to
+
+	var rows []uptimeRow
+	if err := db.Raw(fmt.Sprintf(uptimeQuery, condition), args).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	uptimes := make([]Uptime, 0, len(rows))
+	for _, row := range rows {
+		uptime := Uptime{
+			DeviceID:      row.DeviceID,
+			Name:          row.Name,
+			Status:        row.Status,
+			OnlineSeconds: row.OnlineSeconds,
+			Disconnects:   row.Disconnects,
+		}
+		if window := to.Sub(row.Start).Seconds(); window > 0 {
+			uptime.WindowSeconds = window
+			uptime.Uptime = percent(row.OnlineSeconds, window)
+		}
+		uptimes = append(uptimes, uptime)
+	}
+	return uptimes, nil
+}
+
+// percent returns part of whole in percent, nil for an empty whole
+func percent(part, whole float64) *float64 {
+	if whole <= 0 {
+		return nil
+	}
+	value := min(part/whole*100, 100)
+	return &value
+}
+
+// handleDeviceUptime reports how long a device was connected within a window
+func (s *Server) handleDeviceUptime(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	deviceID := r.PathValue("id")
+
+	from, to, err := parseWindow(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	uptimes, err := queryUptime(s.database.GetDB().WithContext(r.Context()), from, to, "d.id = @device", map[string]interface{}{"device": device.ID})
+	if err != nil || len(uptimes) == 0 {
+		s.logger.Error(fmt.Sprintf("Failed to compute uptime of device %s", deviceID), err)
+		http.Error(w, "Failed to compute uptime", http.StatusInternalServerError)
+		return
+	}
+
+	var sessions []models.DeviceSession
+	if err := s.database.GetDB().
+		Where("device_id = ? AND connected_at < ? AND (disconnected_at IS NULL OR disconnected_at > ?)", device.ID, to, from).
+		Order("connected_at DESC").Limit(uptimeMaxSessions).Find(&sessions).Error; err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to fetch sessions of device %s", deviceID), err)
+		http.Error(w, "Failed to compute uptime", http.StatusInternalServerError)
+		return
+	}
+	for i := range sessions {
+		if sessions[i].ConnectedAt.Before(from) {
+			sessions[i].ConnectedAt = from
+		}
+		if end := sessions[i].DisconnectedAt; end != nil && end.After(to) {
+			sessions[i].DisconnectedAt = &to
+		}
+	}
+
+	jsonResponse(w, DeviceUptime{
+		Uptime:   uptimes[0],
+		From:     from,
+		To:       to,
+		Sessions: sessions,
+	}, http.StatusOK)
+}
+
+// handleFleetUptime reports how long the devices of a fleet were connected
+// within a window. Pending, decommissioned and replaced devices are left out.
+func (s *Server) handleFleetUptime(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fleetID := r.PathValue("id")
+
+	from, to, err := parseWindow(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var fleet models.Fleet
+	if err := s.database.GetDB().Where("id = ?", fleetID).First(&fleet).Error; err != nil {
+		http.Error(w, "Fleet not found", http.StatusNotFound)
+		return
+	}
+
+	uptimes, err := s.fleetUptimes(r, fleet.ID, from, to)
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to compute uptime of fleet %s", fleetID), err)
+		http.Error(w, "Failed to compute uptime", http.StatusInternalServerError)
+		return
+	}
+
+	report := FleetUptime{
+		FleetID: fleet.ID,
+		From:    from,
+		To:      to,
+		Devices: uptimes,
+	}
+	for _, uptime := range uptimes {
+		report.WindowSeconds += uptime.WindowSeconds
+		report.OnlineSeconds += uptime.OnlineSeconds
+		report.Disconnects += uptime.Disconnects
+	}
+	report.Uptime = percent(report.OnlineSeconds, report.WindowSeconds)
+
+	jsonResponse(w, report, http.StatusOK)
+}
+
+// fleetUptimes computes the uptime of the devices of a fleet within a window,
+// lowest first. Pending, decommissioned and replaced devices are left out.
+func (s *Server) fleetUptimes(r *http.Request, fleetID uuid.UUID, from, to time.Time) ([]Uptime, error) {
+	uptimes, err := queryUptime(s.database.GetDB().WithContext(r.Context()), from, to,
+		"d.fleet_id = @fleet AND d.status NOT IN @excluded", map[string]interface{}{
+			"fleet":    fleetID,
+			"excluded": append([]string{models.DeviceStatusPending}, retiredStatuses...),
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	// Devices with the lowest uptime need attention first
+	sort.SliceStable(uptimes, func(i, j int) bool {
+		if uptimes[i].Uptime == nil || uptimes[j].Uptime == nil {
+			return uptimes[j].Uptime == nil && uptimes[i].Uptime != nil
+		}
+		if *uptimes[i].Uptime != *uptimes[j].Uptime {
+			return *uptimes[i].Uptime < *uptimes[j].Uptime
+		}
+		return uptimes[i].Disconnects > uptimes[j].Disconnects
+	})
+	return uptimes, nil
+}
@@ -0,0 +1,239 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/edgetainer/edgetainer/internal/server/ssh"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/google/uuid"
+)
+
+// maxRequiredUSB is the most USB devices a fleet or device can require
+const maxRequiredUSB = 32
+
+// usbID matches USB vendor and product IDs
+var usbID = regexp.MustCompile(`^[0-9a-f]{4}$`)
+
+// RequiredUSBRequest replaces the USB devices required on a fleet or device
+type RequiredUSBRequest struct {
+	Devices []models.USBMatch `json:"devices"`
+}
+
+// RequiredUSBStatus is a USB device required on a device and whether it is
+// connected
+type RequiredUSBStatus struct {
+	models.USBMatch
+	Present bool `json:"present"`
+}
+
+// DeviceUSBResponse lists the USB devices of a device and those it requires
+type DeviceUSBResponse struct {
+	Devices  []models.DeviceUSB  `json:"devices"`
+	Required []RequiredUSBStatus `json:"required"`
+}
+
+// FleetUSB is a USB device with the device it is connected to
+type FleetUSB struct {
+	models.DeviceUSB
+	Device     string `json:"device"` // Device ID of the device
+	DeviceName string `json:"device_name"`
+}
+
+// validateRequiredUSB checks and normalizes the USB devices required on a
+// fleet or device
+func validateRequiredUSB(devices []models.USBMatch) error {
+	if len(devices) > maxRequiredUSB {
+		return fmt.Errorf("at most %d USB devices can be required", maxRequiredUSB)
+	}
+	for i := range devices {
+		match := &devices[i]
+		match.VendorID = strings.ToLower(match.VendorID)
+		match.ProductID = strings.ToLower(match.ProductID)
+		if match.Name == "" || len(match.Name) > 100 {
+			return fmt.Errorf("device %d: name is required, at most 100 characters", i+1)
+		}
+		if !usbID.MatchString(match.VendorID) || !usbID.MatchString(match.ProductID) {
+			return fmt.Errorf("device %d: vendor_id and product_id must be four hex digits", i+1)
+		}
+	}
+	return nil
+}
+
+// decodeRequiredUSB reads the USB devices required by a request, writing
+// the error response if they are invalid
+func decodeRequiredUSB(w http.ResponseWriter, r *http.Request) ([]models.USBMatch, bool) {
+	var request RequiredUSBRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return nil, false
+	}
+	if err := validateRequiredUSB(request.Devices); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	if request.Devices == nil {
+		request.Devices = []models.USBMatch{}
+	}
+	return request.Devices, true
+}
+
+// handleDeviceUSB lists the USB devices of a device as its last heartbeat
+// reported them, and whether those it requires are connected
+func (s *Server) handleDeviceUSB(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	deviceID := r.PathValue("id")
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	response := DeviceUSBResponse{Devices: []models.DeviceUSB{}, Required: []RequiredUSBStatus{}}
+	if err := s.database.GetDB().Where("device_id = ?", device.ID).Order("port").Find(&response.Devices).Error; err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to fetch USB devices of device %s", deviceID), err)
+		http.Error(w, "Failed to fetch USB devices", http.StatusInternalServerError)
+		return
+	}
+
+	var fleet *models.Fleet
+	if device.FleetID != nil {
+		fleet = &models.Fleet{}
+		if err := s.database.GetDB().Where("id = ?", *device.FleetID).First(fleet).Error; err != nil {
+			fleet = nil
+		}
+	}
+	for _, match := range ssh.RequiredUSB(&device, fleet) {
+		status := RequiredUSBStatus{USBMatch: match}
+		for _, usb := range response.Devices {
+			if match.Matches(usb.VendorID, usb.ProductID, usb.Serial) {
+				status.Present = true
+				break
+			}
+		}
+		response.Required = append(response.Required, status)
+	}
+
+	jsonResponse(w, response, http.StatusOK)
+}
+
+// handleUSBDevices lists the USB devices of every device, filtered by fleet,
+// vendor, product or serial number, e.g. to find where a dongle is plugged in
+func (s *Server) handleUSBDevices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := s.database.GetDB().Table("device_usbs").
+		Select("device_usbs.*, devices.device_id AS device, devices.name AS device_name").
+		Joins("JOIN devices ON devices.id = device_usbs.device_id AND devices.deleted_at IS NULL")
+
+	params := r.URL.Query()
+	if value := params.Get("fleet_id"); value != "" {
+		fleetID, err := uuid.Parse(value)
+		if err != nil {
+			http.Error(w, "Invalid fleet ID", http.StatusBadRequest)
+			return
+		}
+		query = query.Where("devices.fleet_id = ?", fleetID)
+	}
+	for param, column := range map[string]string{
+		"vendor_id":  "device_usbs.vendor_id",
+		"product_id": "device_usbs.product_id",
+		"serial":     "device_usbs.serial",
+	} {
+		if value := params.Get(param); value != "" {
+			if param != "serial" {
+				value = strings.ToLower(value)
+			}
+			query = query.Where(column+" = ?", value)
+		}
+	}
+
+	devices := []FleetUSB{}
+	if err := query.Order("devices.name, device_usbs.port").Scan(&devices).Error; err != nil {
+		s.logger.Error("Failed to fetch USB devices", err)
+		http.Error(w, "Failed to fetch USB devices", http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse(w, devices, http.StatusOK)
+}
+
+// handleFleetRequiredUSB reads and replaces the USB devices required on the
+// devices of a fleet
+func (s *Server) handleFleetRequiredUSB(w http.ResponseWriter, r *http.Request) {
+	fleetID := r.PathValue("id")
+
+	var fleet models.Fleet
+	if err := s.database.GetDB().Where("id = ?", fleetID).First(&fleet).Error; err != nil {
+		http.Error(w, "Fleet not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		devices, ok := decodeRequiredUSB(w, r)
+		if !ok {
+			return
+		}
+		fleet.RequiredUSB = devices
+		if err := s.database.GetDB().Model(&fleet).Select("RequiredUSB").Updates(&fleet).Error; err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to update required USB devices of fleet %s", fleetID), err)
+			http.Error(w, "Failed to update fleet", http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if fleet.RequiredUSB == nil {
+		fleet.RequiredUSB = []models.USBMatch{}
+	}
+	jsonResponse(w, RequiredUSBRequest{Devices: fleet.RequiredUSB}, http.StatusOK)
+}
+
+// handleDeviceRequiredUSB reads and replaces the USB devices required on a
+// device besides those of its fleet
+func (s *Server) handleDeviceRequiredUSB(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.PathValue("id")
+
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		devices, ok := decodeRequiredUSB(w, r)
+		if !ok {
+			return
+		}
+		device.RequiredUSB = devices
+		if err := s.database.GetDB().Model(&device).Select("RequiredUSB").Updates(&device).Error; err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to update required USB devices of device %s", deviceID), err)
+			http.Error(w, "Failed to update device", http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if device.RequiredUSB == nil {
+		device.RequiredUSB = []models.USBMatch{}
+	}
+	jsonResponse(w, RequiredUSBRequest{Devices: device.RequiredUSB}, http.StatusOK)
+}
@@ -0,0 +1,36 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+// VersionInfo describes the server build and the features it has enabled
+type VersionInfo struct {
+	Version         string          `json:"version"`
+	Commit          string          `json:"commit"`
+	Date            string          `json:"date"`
+	Features        map[string]bool `json:"features"`
+	MinAgentVersion string          `json:"min_agent_version,omitempty"` // Older agents are flagged unsupported
+	AgentFeatures   []string        `json:"agent_features"`              // Protocol features of agents built with this server
+}
+
+// SetVersionInfo sets the build and features returned by /api/version, and
+// the versions agents are flagged against
+func (s *Server) SetVersionInfo(info VersionInfo) {
+	info.AgentFeatures = protocol.AgentFeatures
+	s.version = info
+}
+
+// handleVersion returns the server build and its enabled features
+func (s *Server) handleVersion(w http.ResponseWriter, r *http.Request) {
+	jsonResponse(w, s.version, http.StatusOK)
+}
+
+// flagAgent fills in how the agent of a device compares to the server and
+// the minimum supported agent version
+func (s *Server) flagAgent(device *models.Device) {
+	device.AgentStatus = protocol.AgentStatus(device.AgentVersion, s.version.Version, s.version.MinAgentVersion)
+}
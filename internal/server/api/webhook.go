@@ -0,0 +1,220 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/edgetainer/edgetainer/internal/server/events"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+)
+
+// WebhookRequest represents a request to create or update a webhook
+type WebhookRequest struct {
+	Name    string   `json:"name"`
+	URL     string   `json:"url"`
+	Secret  string   `json:"secret,omitempty"`
+	Events  []string `json:"events"`
+	Enabled *bool    `json:"enabled,omitempty"`
+}
+
+// validate checks the webhook request for errors
+func (req *WebhookRequest) validate() error {
+	if req.Name == "" {
+		return fmt.Errorf("webhook name is required")
+	}
+
+	parsed, err := url.Parse(req.URL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("webhook URL must be an absolute http(s) URL")
+	}
+
+	for _, eventType := range req.Events {
+		if eventType == "*" {
+			continue
+		}
+		known := false
+		for _, t := range events.Types {
+			if t == eventType {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("unknown event type: %s", eventType)
+		}
+	}
+
+	return nil
+}
+
+// handleWebhooks handles the webhooks endpoint
+func (s *Server) handleWebhooks(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		// List webhooks
+		var webhooks []models.Webhook
+
+		result := s.database.GetDB().Find(&webhooks)
+		if result.Error != nil {
+			s.logger.Error("Failed to fetch webhooks", result.Error)
+			http.Error(w, "Failed to fetch webhooks", http.StatusInternalServerError)
+			return
+		}
+
+		// Never expose signing secrets
+		for i := range webhooks {
+			webhooks[i].Secret = ""
+		}
+
+		jsonResponse(w, webhooks, http.StatusOK)
+
+	case http.MethodPost:
+		// Create webhook
+		var request WebhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		if err := request.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if request.Events == nil {
+			request.Events = []string{}
+		}
+		eventsJSON, _ := json.Marshal(request.Events)
+
+		webhook := models.Webhook{
+			Name:    request.Name,
+			URL:     request.URL,
+			Secret:  request.Secret,
+			Events:  string(eventsJSON),
+			Enabled: request.Enabled == nil || *request.Enabled,
+		}
+
+		if err := s.database.GetDB().Create(&webhook).Error; err != nil {
+			s.logger.Error("Failed to create webhook", err)
+			http.Error(w, "Failed to create webhook", http.StatusInternalServerError)
+			return
+		}
+
+		webhook.Secret = ""
+		jsonResponse(w, webhook, http.StatusCreated)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleWebhookByID handles the webhook by ID endpoint
+func (s *Server) handleWebhookByID(w http.ResponseWriter, r *http.Request) {
+	webhookID := r.PathValue("id")
+
+	var webhook models.Webhook
+	if err := s.database.GetDB().Where("id = ?", webhookID).First(&webhook).Error; err != nil {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		webhook.Secret = ""
+		jsonResponse(w, webhook, http.StatusOK)
+
+	case http.MethodPut:
+		// Update webhook
+		var request WebhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		if err := request.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if request.Events == nil {
+			request.Events = []string{}
+		}
+		eventsJSON, _ := json.Marshal(request.Events)
+
+		updates := map[string]interface{}{
+			"name":   request.Name,
+			"url":    request.URL,
+			"events": string(eventsJSON),
+		}
+		if request.Enabled != nil {
+			updates["enabled"] = *request.Enabled
+		}
+
+		if err := s.database.GetDB().Model(&webhook).Updates(updates).Error; err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to update webhook %s", webhookID), err)
+			http.Error(w, "Failed to update webhook", http.StatusInternalServerError)
+			return
+		}
+
+		// Only replace the secret when a new one is supplied. It is updated
+		// through the struct so the column is encrypted by its serializer.
+		if request.Secret != "" {
+			if err := s.database.GetDB().Model(&webhook).Updates(models.Webhook{Secret: request.Secret}).Error; err != nil {
+				s.logger.Error(fmt.Sprintf("Failed to update secret of webhook %s", webhookID), err)
+				http.Error(w, "Failed to update webhook", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		s.database.GetDB().Where("id = ?", webhookID).First(&webhook)
+		webhook.Secret = ""
+		jsonResponse(w, webhook, http.StatusOK)
+
+	case http.MethodDelete:
+		if err := s.database.GetDB().Delete(&webhook).Error; err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to delete webhook %s", webhookID), err)
+			http.Error(w, "Failed to delete webhook", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleWebhookDeliveries handles the webhook delivery log endpoint
+func (s *Server) handleWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	webhookID := r.PathValue("id")
+
+	limit := 100
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= 1000 {
+		limit = l
+	}
+
+	query := s.database.GetDB().Where("webhook_id = ?", webhookID)
+	if eventType := r.URL.Query().Get("event_type"); eventType != "" {
+		query = query.Where("event_type = ?", eventType)
+	}
+	if success := r.URL.Query().Get("success"); success != "" {
+		query = query.Where("success = ?", success == "true")
+	}
+
+	var deliveries []models.WebhookDelivery
+	if err := query.Order("created_at DESC").Limit(limit).Find(&deliveries).Error; err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to fetch deliveries for webhook %s", webhookID), err)
+		http.Error(w, "Failed to fetch webhook deliveries", http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse(w, deliveries, http.StatusOK)
+}
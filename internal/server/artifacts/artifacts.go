@@ -0,0 +1,120 @@
+// Package artifacts stores the files of software versions besides their
+// compose file, e.g. configs, static assets and models. Contents are
+// addressed by their sha256 digest, so a file shared by versions or
+// software is stored once, in a local directory or an S3 bucket. Devices
+// download them over the tunnel or, from S3, through pre-signed URLs.
+package artifacts
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/server/storage"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+// ErrNotFound is returned for contents that are not stored
+var ErrNotFound = storage.ErrNotFound
+
+// ErrTooLarge is returned for uploads over the size limit
+var ErrTooLarge = errors.New("artifact too large")
+
+// Settings configure the artifact storage
+type Settings struct {
+	Store      storage.Settings
+	MaxSize    int64         // Largest artifact in bytes
+	PresignTTL time.Duration // How long pre-signed URLs are valid, 0 to serve artifacts over the tunnel only
+}
+
+// Storage stores artifacts in the configured backend
+type Storage struct {
+	store      storage.Store
+	maxSize    int64
+	presignTTL time.Duration
+}
+
+// NewStorage creates the artifact storage
+func NewStorage(settings Settings) (*Storage, error) {
+	store, err := storage.New(settings.Store)
+	if err != nil {
+		return nil, fmt.Errorf("artifacts: %w", err)
+	}
+
+	return &Storage{
+		store:      store,
+		maxSize:    settings.MaxSize,
+		presignTTL: settings.PresignTTL,
+	}, nil
+}
+
+// Put stores the content read from r, spooling it to a temporary file to
+// compute its digest first. Contents already stored are not stored again.
+func (s *Storage) Put(ctx context.Context, r io.Reader) (string, int64, error) {
+	temp, err := os.CreateTemp("", "artifact-*")
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(temp.Name())
+	defer temp.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(temp, hash), io.LimitReader(r, s.maxSize+1))
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to read artifact: %w", err)
+	}
+	if size > s.maxSize {
+		return "", 0, ErrTooLarge
+	}
+	digest := "sha256:" + hex.EncodeToString(hash.Sum(nil))
+
+	if exists, err := s.store.Exists(ctx, key(digest)); err != nil {
+		return "", 0, err
+	} else if exists {
+		return digest, size, nil
+	}
+
+	if _, err := temp.Seek(0, io.SeekStart); err != nil {
+		return "", 0, err
+	}
+	if err := s.store.Put(ctx, key(digest), temp, size); err != nil {
+		return "", 0, err
+	}
+	return digest, size, nil
+}
+
+// Open reads a stored content from offset on
+func (s *Storage) Open(ctx context.Context, digest string, offset int64) (io.ReadCloser, error) {
+	if !protocol.ValidDigest(digest) {
+		return nil, ErrNotFound
+	}
+	return s.store.Open(ctx, key(digest), offset)
+}
+
+// Delete removes a stored content
+func (s *Storage) Delete(ctx context.Context, digest string) error {
+	if !protocol.ValidDigest(digest) {
+		return nil
+	}
+	return s.store.Delete(ctx, key(digest))
+}
+
+// URL returns a pre-signed download URL of a content, or "" if artifacts
+// are served over the tunnel only
+func (s *Storage) URL(ctx context.Context, digest string) (string, error) {
+	if s.presignTTL <= 0 {
+		return "", nil
+	}
+	return s.store.URL(ctx, key(digest), s.presignTTL)
+}
+
+// key returns the name of the object holding a content. Digests are
+// checked before they get here, the algorithm leaves room for others.
+func key(digest string) string {
+	return "sha256/" + digest[len("sha256:"):]
+}
@@ -1,14 +1,11 @@
 package auth
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/x509"
-	"encoding/pem"
 	"fmt"
 	"os"
 	"path/filepath"
 
+	"github.com/edgetainer/edgetainer/internal/shared/sshkeys"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -21,30 +18,19 @@ type KeyPair struct {
 	PublicKeyPath  string // Path to the public key file (if saved)
 }
 
-// GenerateKeyPair creates a new SSH key pair
-func GenerateKeyPair(deviceID string, bits int) (*KeyPair, error) {
-	if bits == 0 {
-		bits = 4096 // Default to 4096 bits
+// GenerateKeyPair creates a new SSH key pair of the given type, ed25519
+// unless set. bits only applies to RSA keys, 0 picks the default size.
+func GenerateKeyPair(deviceID string, keyType string, bits int) (*KeyPair, error) {
+	if keyType == "" {
+		keyType = sshkeys.TypeED25519
 	}
 
 	// Generate private key
-	privateKey, err := rsa.GenerateKey(rand.Reader, bits)
+	privateKeyPEM, publicKey, err := sshkeys.Generate(keyType, bits)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate private key: %w", err)
 	}
 
-	// Convert private key to PEM format
-	privateKeyPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
-	})
-
-	// Convert to SSH public key
-	publicKey, err := ssh.NewPublicKey(&privateKey.PublicKey)
-	if err != nil {
-		return nil, fmt.Errorf("failed to convert to public key: %w", err)
-	}
-
 	// Get public key in OpenSSH authorized_keys format
 	pubKeyStr := string(ssh.MarshalAuthorizedKey(publicKey))
 	pubKeyStr = pubKeyStr[:len(pubKeyStr)-1] // Remove trailing newline
@@ -0,0 +1,174 @@
+// Package customfields validates the custom metadata fields operators define
+// for devices and the values devices hold for them
+package customfields
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Field types
+const (
+	TypeString = "string"
+	TypeNumber = "number"
+	TypeBool   = "bool"
+	TypeDate   = "date" // YYYY-MM-DD
+	TypeEnum   = "enum"
+)
+
+// Types lists the supported field types
+var Types = []string{TypeString, TypeNumber, TypeBool, TypeDate, TypeEnum}
+
+// maxValueLength bounds a single value
+const maxValueLength = 1024
+
+// namePattern matches valid field names, which are also used as query
+// parameters and CSV columns
+var namePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,62}$`)
+
+// FieldError describes a value that does not satisfy its field
+type FieldError struct {
+	Name    string `json:"name"`
+	Message string `json:"message"`
+}
+
+// ValidationError collects all field errors of a validation run
+type ValidationError struct {
+	Fields []FieldError `json:"fields"`
+}
+
+// Error implements the error interface
+func (e *ValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Fields))
+	for _, f := range e.Fields {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", f.Name, f.Message))
+	}
+	return "invalid custom fields: " + strings.Join(msgs, "; ")
+}
+
+// ValidName reports whether a field name is valid
+func ValidName(name string) bool {
+	return namePattern.MatchString(name)
+}
+
+// ValidateDefinition checks a field definition, defaulting its type to string
+func ValidateDefinition(field *models.CustomField) error {
+	if !ValidName(field.Name) {
+		return fmt.Errorf("invalid field name %q, use lower case letters, digits and underscores", field.Name)
+	}
+
+	if field.Type == "" {
+		field.Type = TypeString
+	}
+	if !slices.Contains(Types, field.Type) {
+		return fmt.Errorf("unknown field type %q", field.Type)
+	}
+
+	if field.Type == TypeEnum {
+		if len(field.Options) == 0 {
+			return fmt.Errorf("enum field %s needs options", field.Name)
+		}
+		seen := make(map[string]bool)
+		for _, option := range field.Options {
+			if option == "" || seen[option] {
+				return fmt.Errorf("enum field %s has an empty or duplicate option", field.Name)
+			}
+			seen[option] = true
+		}
+	} else {
+		field.Options = nil
+	}
+
+	return nil
+}
+
+// ForFleet returns the fields that apply to devices of a fleet: the global
+// fields and those of the fleet. A nil fleet gives the global fields only.
+func ForFleet(db *gorm.DB, fleetID *uuid.UUID) ([]models.CustomField, error) {
+	query := db.Where("fleet_id IS NULL")
+	if fleetID != nil {
+		query = db.Where("fleet_id IS NULL OR fleet_id = ?", *fleetID)
+	}
+
+	var fields []models.CustomField
+	if err := query.Order("name").Find(&fields).Error; err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// Check validates the complete set of values of a device: every value must
+// belong to a field that applies to it and match its type, and required
+// fields must be set
+func Check(fields []models.CustomField, values map[string]string) error {
+	var errs []FieldError
+
+	byName := make(map[string]models.CustomField, len(fields))
+	for _, field := range fields {
+		byName[field.Name] = field
+		if field.Required && values[field.Name] == "" {
+			errs = append(errs, FieldError{Name: field.Name, Message: "required"})
+		}
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		field, ok := byName[name]
+		if !ok {
+			errs = append(errs, FieldError{Name: name, Message: "not defined for this device"})
+			continue
+		}
+		if values[name] == "" {
+			continue
+		}
+		if err := checkValue(field, values[name]); err != nil {
+			errs = append(errs, FieldError{Name: name, Message: err.Error()})
+		}
+	}
+
+	if len(errs) > 0 {
+		return &ValidationError{Fields: errs}
+	}
+	return nil
+}
+
+// checkValue checks a value against the type of its field
+func checkValue(field models.CustomField, value string) error {
+	if len(value) > maxValueLength {
+		return fmt.Errorf("longer than %d characters", maxValueLength)
+	}
+
+	switch field.Type {
+	case TypeNumber:
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return fmt.Errorf("not a number")
+		}
+	case TypeBool:
+		if value != "true" && value != "false" {
+			return fmt.Errorf("must be true or false")
+		}
+	case TypeDate:
+		if _, err := time.Parse(time.DateOnly, value); err != nil {
+			return fmt.Errorf("not a date in YYYY-MM-DD form")
+		}
+	case TypeEnum:
+		if !slices.Contains(field.Options, value) {
+			return fmt.Errorf("must be one of %s", strings.Join(field.Options, ", "))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package db
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// Maintenance of the database by operators, run from the admin CLI against
+// the database of a server that may be running
+
+// HashPassword hashes the password of a user for storage
+func HashPassword(password string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash password: %w", err)
+	}
+	return string(hashed), nil
+}
+
+// CreateUser creates a user who logs in with a password
+func (db *DB) CreateUser(ctx context.Context, username, email, role, password string) (*models.User, error) {
+	switch role {
+	case models.UserRoleAdmin, models.UserRoleOperator, models.UserRoleViewer:
+	default:
+		return nil, fmt.Errorf("unknown role %q, use admin, operator or viewer", role)
+	}
+	if username == "" || email == "" {
+		return nil, fmt.Errorf("username and email are required")
+	}
+
+	hashed, err := HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	user := &models.User{
+		Username:  username,
+		Email:     email,
+		HashedPwd: hashed,
+		Role:      role,
+	}
+	if err := db.db.WithContext(ctx).Create(user).Error; err != nil {
+		return nil, fmt.Errorf("failed to create user %s: %w", username, err)
+	}
+	return user, nil
+}
+
+// ResetPassword sets the password of a user and revokes their tokens. A
+// deleted user is restored, so an install whose only admin was deleted can
+// be recovered. It reports whether the user was restored.
+func (db *DB) ResetPassword(ctx context.Context, username, password string) (bool, error) {
+	var user models.User
+	if err := db.db.WithContext(ctx).Unscoped().Where("username = ?", username).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return false, fmt.Errorf("user %s not found", username)
+		}
+		return false, err
+	}
+
+	hashed, err := HashPassword(password)
+	if err != nil {
+		return false, err
+	}
+
+	restored := user.DeletedAt.Valid
+	err = db.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Model(&user).Updates(map[string]interface{}{
+			"password_hash": hashed,
+			"deleted_at":    nil,
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", user.ID).Delete(&models.APIToken{}).Error
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to reset password of %s: %w", username, err)
+	}
+	return restored, nil
+}
+
+// Reindex rebuilds the indexes of the database, e.g. after corruption or to
+// reclaim the space of bloated ones. Tables are locked against writes while
+// their indexes are rebuilt.
+func (db *DB) Reindex(ctx context.Context) error {
+	var name string
+	if err := db.db.WithContext(ctx).Raw("SELECT current_database()").Scan(&name).Error; err != nil {
+		return fmt.Errorf("failed to read database name: %w", err)
+	}
+
+	stmt := &gorm.Statement{DB: db.db}
+	if err := db.db.WithContext(ctx).Exec("REINDEX DATABASE " + stmt.Quote(name)).Error; err != nil {
+		return fmt.Errorf("failed to reindex database %s: %w", name, err)
+	}
+	return nil
+}
+
+// PurgeSoftDeleted removes the rows deleted before a time from the tables
+// that keep deleted rows, returning the number removed by table. Tables
+// whose rows are still referenced are skipped and named in the error.
+func (db *DB) PurgeSoftDeleted(ctx context.Context, before time.Time) (map[string]int64, error) {
+	purged := make(map[string]int64)
+	var errs []error
+	for _, model := range allModels {
+		stmt := &gorm.Statement{DB: db.db}
+		if err := stmt.Parse(model); err != nil {
+			return purged, fmt.Errorf("failed to parse model: %w", err)
+		}
+		if stmt.Schema.LookUpField("DeletedAt") == nil {
+			continue
+		}
+
+		result := db.db.WithContext(ctx).Unscoped().Where("deleted_at IS NOT NULL AND deleted_at < ?", before).Delete(model)
+		if result.Error != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", stmt.Schema.Table, result.Error))
+			continue
+		}
+		if result.RowsAffected > 0 {
+			purged[stmt.Schema.Table] = result.RowsAffected
+		}
+	}
+	return purged, errors.Join(errs...)
+}
+
+// Export writes every table as a JSON object of arrays of rows by table
+// name. Rows are written as stored, encrypted columns stay encrypted and
+// password hashes are included, so the export must be kept as safe as the
+// database. Each table is read in one query, the export is not a consistent
+// snapshot across tables.
+func (db *DB) Export(ctx context.Context, w io.Writer) error {
+	out := bufio.NewWriter(w)
+	fmt.Fprintf(out, "{\"exported_at\":%q,\"tables\":{", time.Now().UTC().Format(time.RFC3339))
+
+	for i, model := range allModels {
+		stmt := &gorm.Statement{DB: db.db}
+		if err := stmt.Parse(model); err != nil {
+			return fmt.Errorf("failed to parse model: %w", err)
+		}
+		table := stmt.Schema.Table
+		if i > 0 {
+			out.WriteString(",")
+		}
+		fmt.Fprintf(out, "%q:[", table)
+
+		rows, err := db.db.WithContext(ctx).Raw(fmt.Sprintf("SELECT row_to_json(t)::text FROM %s t", stmt.Quote(table))).Rows()
+		if err != nil {
+			return fmt.Errorf("failed to export %s: %w", table, err)
+		}
+		first := true
+		for rows.Next() {
+			var row string
+			if err := rows.Scan(&row); err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to export %s: %w", table, err)
+			}
+			if !first {
+				out.WriteString(",")
+			}
+			out.WriteString(row)
+			first = false
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return fmt.Errorf("failed to export %s: %w", table, err)
+		}
+		out.WriteString("]")
+	}
+
+	out.WriteString("}}\n")
+	return out.Flush()
+}
+
+// Audit records an action taken outside the API in the audit log
+func (db *DB) Audit(ctx context.Context, action, actor, reason string, data map[string]interface{}) error {
+	entry := models.AuditEntry{
+		Action: action,
+		Actor:  actor,
+		Reason: reason,
+		Data:   data,
+	}
+	return db.db.WithContext(ctx).Create(&entry).Error
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/edgetainer/edgetainer/internal/shared/config"
 	"github.com/edgetainer/edgetainer/internal/shared/logging"
 	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/edgetainer/edgetainer/internal/shared/tracing"
 
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
@@ -23,8 +24,8 @@ type DB struct {
 
 // New creates a new database connection
 func New(ctx context.Context, host string, port int, user, password, dbname string, cfg *config.ServerConfig) (*DB, error) {
-	dsn := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
-		host, port, user, password, dbname)
+	dsn := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+		host, port, user, password, dbname, cfg.Database.SSLMode)
 
 	logger := logging.WithComponent("db")
 
@@ -37,14 +38,19 @@ func New(ctx context.Context, host string, port int, user, password, dbname stri
 		return nil, fmt.Errorf("failed to connect to database: %w", err)
 	}
 
+	// Trace statements of traced requests
+	if err := db.Use(tracing.GormPlugin{}); err != nil {
+		return nil, fmt.Errorf("failed to register tracing: %w", err)
+	}
+
 	// Set connection pool settings
 	sqlDB, err := db.DB()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get sql.DB connection: %w", err)
 	}
-	sqlDB.SetMaxIdleConns(10)
-	sqlDB.SetMaxOpenConns(100)
-	sqlDB.SetConnMaxLifetime(time.Hour)
+	sqlDB.SetMaxIdleConns(cfg.Database.MaxIdleConns)
+	sqlDB.SetMaxOpenConns(cfg.Database.MaxOpenConns)
+	sqlDB.SetConnMaxLifetime(time.Duration(cfg.Database.ConnMaxLifetime) * time.Second)
 
 	return &DB{
 		db:     db,
@@ -54,57 +60,100 @@ func New(ctx context.Context, host string, port int, user, password, dbname stri
 	}, nil
 }
 
+// allModels lists the models of the database, in the order their tables are
+// created
+var allModels = []interface{}{
+	&models.User{},
+	&models.UserPreferences{},
+	&models.SavedView{},
+	&models.Fleet{},
+	&models.Site{},
+	&models.Device{},
+	&models.CustomField{},
+	&models.Software{},
+	&models.Deployment{},
+	&models.Rollout{},
+	&models.DeploymentApproval{},
+	&models.FleetDefaultSoftware{},
+	&models.SoftwareEnvSchema{},
+	&models.SoftwareMigration{},
+	&models.SoftwareRequirements{},
+	&models.SoftwareArtifact{},
+	&models.FleetComposeOverride{},
+	&models.DeviceComposeOverride{},
+	&models.FleetEnvVars{},
+	&models.DeviceEnvVars{},
+	&models.SecretStore{},
+	&models.RegistryCredential{},
+	&models.DeviceLog{},
+	&models.LogArchive{},
+	&models.DeviceSession{},
+	&models.APIToken{},
+	&models.ExposedService{},
+	&models.Webhook{},
+	&models.WebhookDelivery{},
+	&models.UnmanagedWorkload{},
+	&models.DeviceContainer{},
+	&models.Alert{},
+	&models.LogLevel{},
+	&models.ServerSettings{},
+	&models.DeviceNameChange{},
+	&models.Import{},
+	&models.ImportedDevice{},
+	&models.ResourceRef{},
+	&models.RevokedKey{},
+	&models.AuditEntry{},
+	&models.DNSRecord{},
+	&models.Job{},
+	&models.DiagnosticsBundle{},
+	&models.PacketCapture{},
+	&models.DeviceDisplay{},
+	&models.DisplayScreenshot{},
+	&models.DeviceUSB{},
+	&models.RestorePoint{},
+	&models.StagedUpdate{},
+	&models.FleetSnapshot{},
+	&models.Invitation{},
+}
+
 // Migrate runs database migrations to ensure the schema is up to date
 func (db *DB) Migrate() error {
 	db.logger.Info("Running database migrations")
 
 	// Auto migrate the models
-	err := db.db.AutoMigrate(
-		&models.User{},
-		&models.Fleet{},
-		&models.Device{},
-		&models.Software{},
-		&models.Deployment{},
-		&models.FleetEnvVars{},
-		&models.DeviceEnvVars{},
-		&models.DeviceLog{},
-		&models.APIToken{},
-		&models.ExposedService{},
-	)
+	err := db.db.AutoMigrate(allModels...)
 	if err != nil {
 		return fmt.Errorf("failed to run migrations: %w", err)
 	}
 
-	// Create default admin user if no users exist
+	if err := db.createSearchIndexes(); err != nil {
+		return err
+	}
+
+	// Create the admin user if no users exist and a password is configured,
+	// otherwise the first admin is created through the setup
 	var count int64
 	db.db.Model(&models.User{}).Count(&count)
-	if count == 0 {
+	if count == 0 && (db.config == nil || db.config.Auth.AdminPassword == "") {
+		db.logger.Info("No users yet, the server waits for its setup")
+	} else if count == 0 {
 		db.logger.Info("Creating default admin user")
 
 		// Get admin credentials from config
 		username := "admin"
 		email := "admin@example.com"
-
-		// For now we're using a static hash for 'password', regardless of actual config
-		// This is just a placeholder - in a real application, we would dynamically hash the password
-
-		// Use config values if available
-		if db.config != nil {
-			if db.config.Auth.AdminUsername != "" {
-				username = db.config.Auth.AdminUsername
-			}
-			if db.config.Auth.AdminEmail != "" {
-				email = db.config.Auth.AdminEmail
-			}
-
-			// Log the configured password for verification (would not do this in production)
-			if db.config.Auth.AdminPassword != "" {
-				db.logger.Info(fmt.Sprintf("Admin password from config: %s (this will be hashed)", db.config.Auth.AdminPassword))
-			}
+		password := db.config.Auth.AdminPassword
+		if db.config.Auth.AdminUsername != "" {
+			username = db.config.Auth.AdminUsername
+		}
+		if db.config.Auth.AdminEmail != "" {
+			email = db.config.Auth.AdminEmail
 		}
 
-		// This is a bcrypt hash for "password"
-		hashedPassword := "$2a$10$Ix7/3hCQ1JgmWz5i8HzN9uJR9MQ7DP.v4mZ3o49nZqi0vLS/h2pEC"
+		hashedPassword, err := HashPassword(password)
+		if err != nil {
+			return err
+		}
 
 		db.logger.Info(fmt.Sprintf("Creating admin user with username: %s and email: %s", username, email))
 
@@ -137,6 +186,16 @@ func (db *DB) Close() {
 	}
 }
 
+// Ping checks that the database is reachable
+func (db *DB) Ping(ctx context.Context) error {
+	sqlDB, err := db.db.DB()
+	if err != nil {
+		return fmt.Errorf("failed to get sql.DB connection: %w", err)
+	}
+
+	return sqlDB.PingContext(ctx)
+}
+
 // GetDB returns the underlying GORM DB instance
 func (db *DB) GetDB() *gorm.DB {
 	return db.db
@@ -0,0 +1,53 @@
+package db
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// DefaultDeviceIDPrefix starts the IDs of devices in fleets without a prefix
+const DefaultDeviceIDPrefix = "device"
+
+// deviceIDEncoding writes the random part of device IDs in lowercase
+// letters and digits
+var deviceIDEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// NewDeviceID returns an unused device ID of the form <prefix>-<random>,
+// with the prefix of the fleet. The random part holds 60 bits, so a
+// collision is unlikely but still checked for, including with deleted
+// devices. tx may be a transaction.
+func NewDeviceID(tx *gorm.DB, fleetID *uuid.UUID) (string, error) {
+	prefix := DefaultDeviceIDPrefix
+	if fleetID != nil {
+		var fleet models.Fleet
+		if err := tx.Select("device_id_prefix").First(&fleet, "id = ?", *fleetID).Error; err != nil {
+			return "", fmt.Errorf("failed to fetch fleet: %w", err)
+		}
+		if fleet.DeviceIDPrefix != "" {
+			prefix = fleet.DeviceIDPrefix
+		}
+	}
+
+	for attempt := 0; attempt < 5; attempt++ {
+		random := make([]byte, 8)
+		if _, err := rand.Read(random); err != nil {
+			return "", fmt.Errorf("failed to generate device ID: %w", err)
+		}
+		deviceID := prefix + "-" + deviceIDEncoding.EncodeToString(random)[:12]
+
+		var count int64
+		if err := tx.Unscoped().Model(&models.Device{}).Where("device_id = ?", deviceID).Count(&count).Error; err != nil {
+			return "", fmt.Errorf("failed to check device ID: %w", err)
+		}
+		if count == 0 {
+			return deviceID, nil
+		}
+	}
+	return "", errors.New("failed to generate an unused device ID")
+}
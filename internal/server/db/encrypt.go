@@ -0,0 +1,114 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/edgetainer/edgetainer/internal/shared/fieldcrypt"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// encryptedModels lists the models that have encrypted columns
+var encryptedModels = []interface{}{
+	&models.Device{},
+	&models.Software{},
+	&models.Deployment{},
+	&models.FleetEnvVars{},
+	&models.DeviceEnvVars{},
+	&models.Webhook{},
+	&models.SecretStore{},
+	&models.RegistryCredential{},
+}
+
+// rawValue is a row of an encrypted column read without its serializer
+type rawValue struct {
+	ID    string
+	Value *string
+}
+
+// EncryptFields encrypts plaintext values of encrypted columns and re-encrypts
+// values written with a retired key, so old keys can be removed afterwards.
+// It returns the number of values rewritten.
+func (db *DB) EncryptFields() (int, error) {
+	if !fieldcrypt.Enabled() {
+		return 0, fmt.Errorf("no encryption key is configured")
+	}
+
+	total := 0
+	for _, model := range encryptedModels {
+		stmt := &gorm.Statement{DB: db.db}
+		if err := stmt.Parse(model); err != nil {
+			return total, fmt.Errorf("failed to parse model: %w", err)
+		}
+
+		for _, field := range stmt.Schema.Fields {
+			if field.TagSettings["SERIALIZER"] != fieldcrypt.SerializerName {
+				continue
+			}
+
+			count, err := db.encryptColumn(stmt.Schema.Table, field)
+			total += count
+			if err != nil {
+				return total, fmt.Errorf("failed to encrypt %s.%s: %w", stmt.Schema.Table, field.DBName, err)
+			}
+			if count > 0 {
+				db.logger.Info(fmt.Sprintf("Encrypted %d values in %s.%s", count, stmt.Schema.Table, field.DBName))
+			}
+		}
+	}
+
+	return total, nil
+}
+
+// encryptColumn rewrites the values of one column that need it. Rows are read
+// and written as raw text so the serializer does not interfere.
+func (db *DB) encryptColumn(table string, field *schema.Field) (int, error) {
+	var rows []rawValue
+	query := fmt.Sprintf("SELECT id::text AS id, %s::text AS value FROM %s", field.DBName, table)
+	if err := db.db.Raw(query).Scan(&rows).Error; err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, row := range rows {
+		if row.Value == nil {
+			continue
+		}
+
+		value := *row.Value
+		if fieldcrypt.IsJSONColumn(field) {
+			// Encrypted jsonb values are stored as a JSON string
+			var wrapped string
+			if json.Unmarshal([]byte(value), &wrapped) == nil && fieldcrypt.IsEncrypted(wrapped) {
+				value = wrapped
+			}
+		}
+
+		if !fieldcrypt.NeedsRewrite(value) {
+			continue
+		}
+
+		encrypted, err := fieldcrypt.Encrypt(value)
+		if err != nil {
+			return count, fmt.Errorf("row %s: %w", row.ID, err)
+		}
+
+		var stored interface{} = encrypted
+		cast := ""
+		if fieldcrypt.IsJSONColumn(field) {
+			wrapped, _ := json.Marshal(encrypted)
+			stored = string(wrapped)
+			cast = "::jsonb"
+		}
+
+		update := fmt.Sprintf("UPDATE %s SET %s = ?%s WHERE id = ?", table, field.DBName, cast)
+		if err := db.db.Exec(update, stored, row.ID).Error; err != nil {
+			return count, fmt.Errorf("row %s: %w", row.ID, err)
+		}
+		count++
+	}
+
+	return count, nil
+}
@@ -0,0 +1,62 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	// ErrInvitationUsed is returned when accepting an invitation that was
+	// accepted, revoked or has expired
+	ErrInvitationUsed = errors.New("invitation is no longer valid")
+	// ErrUserExists is returned when an invitation would create a user
+	// whose username or email is taken
+	ErrUserExists = errors.New("a user with this username or email exists")
+)
+
+// AcceptInvitation marks a pending invitation accepted by a user, creating
+// the user first unless it has an ID. The invitation is locked, so it is
+// accepted once even if its link is followed twice at the same time.
+func (db *DB) AcceptInvitation(ctx context.Context, id uuid.UUID, user *models.User) error {
+	return db.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var invitation models.Invitation
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ? AND status = ? AND expires_at > ?", id, models.InvitationStatusPending, time.Now()).
+			First(&invitation).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInvitationUsed
+		}
+		if err != nil {
+			return err
+		}
+
+		if user.ID == uuid.Nil {
+			// Deleted users keep their username and email until purged
+			var taken int64
+			if err := tx.Unscoped().Model(&models.User{}).
+				Where("username = ? OR LOWER(email) = LOWER(?)", user.Username, user.Email).
+				Count(&taken).Error; err != nil {
+				return err
+			}
+			if taken > 0 {
+				return ErrUserExists
+			}
+			if err := tx.Create(user).Error; err != nil {
+				return fmt.Errorf("failed to create user %s: %w", user.Username, err)
+			}
+		}
+
+		return tx.Model(&invitation).Updates(map[string]interface{}{
+			"status":      models.InvitationStatusAccepted,
+			"accepted_at": time.Now(),
+			"user_id":     user.ID,
+		}).Error
+	})
+}
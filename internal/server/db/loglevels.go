@@ -0,0 +1,64 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/edgetainer/edgetainer/internal/shared/logging"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"gorm.io/gorm/clause"
+)
+
+// ApplyLogLevels applies the log levels saved at runtime, which take
+// precedence over the configured level
+func (db *DB) ApplyLogLevels() error {
+	var levels []models.LogLevel
+	if err := db.db.Find(&levels).Error; err != nil {
+		return fmt.Errorf("failed to load log levels: %w", err)
+	}
+
+	for _, level := range levels {
+		var err error
+		if level.Component == "" {
+			err = logging.SetLevel(level.Level)
+		} else {
+			err = logging.SetComponentLevel(level.Component, level.Level)
+		}
+		if err != nil {
+			db.logger.Warn(fmt.Sprintf("Ignoring saved log level of %q: %v", level.Component, err))
+			continue
+		}
+		if level.Component != "" {
+			db.logger.Info(fmt.Sprintf("Log level of %s set to %s", level.Component, level.Level))
+		}
+	}
+
+	return nil
+}
+
+// SaveLogLevel saves the log level of a component, or the global level when
+// component is empty. An empty level removes the saved level.
+func (db *DB) SaveLogLevel(component, level string) error {
+	if level == "" {
+		return db.db.Where("component = ?", component).Delete(&models.LogLevel{}).Error
+	}
+
+	record := models.LogLevel{Component: component, Level: level}
+	return db.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "component"}},
+		DoUpdates: clause.AssignmentColumns([]string{"level", "updated_at"}),
+	}).Create(&record).Error
+}
+
+// ResetLogLevels removes every saved log level and restores the configured
+// global level
+func (db *DB) ResetLogLevels() error {
+	if err := db.db.Where("1 = 1").Delete(&models.LogLevel{}).Error; err != nil {
+		return fmt.Errorf("failed to remove log levels: %w", err)
+	}
+
+	logging.ResetComponentLevels()
+	if db.config != nil {
+		return logging.SetLevel(db.config.Logging.Level)
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package db
+
+import "fmt"
+
+// searchIndexes keep the search API fast on large installations. Trigram
+// indexes serve substring matches, the full-text index custom field values.
+var searchIndexes = []string{
+	"CREATE INDEX IF NOT EXISTS idx_devices_name_trgm ON devices USING gin (name gin_trgm_ops)",
+	"CREATE INDEX IF NOT EXISTS idx_devices_device_id_trgm ON devices USING gin (device_id gin_trgm_ops)",
+	"CREATE INDEX IF NOT EXISTS idx_devices_ip_address_trgm ON devices USING gin (ip_address gin_trgm_ops)",
+	"CREATE INDEX IF NOT EXISTS idx_devices_custom_fields_fts ON devices USING gin (to_tsvector('simple', coalesce(custom_fields, '{}'::jsonb)))",
+	"CREATE INDEX IF NOT EXISTS idx_fleets_name_trgm ON fleets USING gin (name gin_trgm_ops)",
+	"CREATE INDEX IF NOT EXISTS idx_softwares_name_trgm ON softwares USING gin (name gin_trgm_ops)",
+	"CREATE INDEX IF NOT EXISTS idx_softwares_current_version_trgm ON softwares USING gin (current_version gin_trgm_ops)",
+}
+
+// createSearchIndexes enables pg_trgm and creates the search indexes. pg_trgm
+// is a trusted extension, so the owner of the database can create it.
+func (db *DB) createSearchIndexes() error {
+	if err := db.db.Exec("CREATE EXTENSION IF NOT EXISTS pg_trgm").Error; err != nil {
+		return fmt.Errorf("failed to create the pg_trgm extension: %w", err)
+	}
+
+	for _, statement := range searchIndexes {
+		if err := db.db.Exec(statement).Error; err != nil {
+			return fmt.Errorf("failed to create search index: %w", err)
+		}
+	}
+	return nil
+}
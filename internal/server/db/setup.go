@@ -0,0 +1,115 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrSetupDone is returned when setting up a server that already is
+var ErrSetupDone = errors.New("server is already set up")
+
+// serverSettingsID is the ID of the single row of server settings
+const serverSettingsID = 1
+
+// ServerSettings returns the settings made in the setup, empty if there are
+// none
+func (db *DB) ServerSettings(ctx context.Context) (models.ServerSettings, error) {
+	var settings models.ServerSettings
+	err := db.db.WithContext(ctx).First(&settings, serverSettingsID).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return models.ServerSettings{}, fmt.Errorf("failed to load server settings: %w", err)
+	}
+	return settings, nil
+}
+
+// SaveServerSettings saves the server URL and SSH ports of settings
+func (db *DB) SaveServerSettings(ctx context.Context, settings models.ServerSettings) error {
+	settings.ID = serverSettingsID
+	err := db.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"server_url", "ssh_port", "ssh_start_port", "ssh_end_port", "updated_at"}),
+	}).Create(&settings).Error
+	if err != nil {
+		return fmt.Errorf("failed to save server settings: %w", err)
+	}
+	return nil
+}
+
+// SetupPending reports whether the server still waits for its setup, which
+// is the case until it has a user
+func (db *DB) SetupPending(ctx context.Context) (bool, error) {
+	settings, err := db.ServerSettings(ctx)
+	if err != nil {
+		return false, err
+	}
+	if settings.SetupCompletedAt != nil {
+		return false, nil
+	}
+
+	var users int64
+	if err := db.db.WithContext(ctx).Unscoped().Model(&models.User{}).Count(&users).Error; err != nil {
+		return false, fmt.Errorf("failed to count users: %w", err)
+	}
+	return users == 0, nil
+}
+
+// CompleteSetup creates the first admin and saves the settings of the
+// server. It fails with ErrSetupDone once the server has a user, so it
+// succeeds only once even if called concurrently.
+func (db *DB) CompleteSetup(ctx context.Context, username, email, password string, settings models.ServerSettings) (*models.User, error) {
+	hashed, err := HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	user := &models.User{
+		Username:  username,
+		Email:     email,
+		HashedPwd: hashed,
+		Role:      models.UserRoleAdmin,
+	}
+	err = db.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// The row is locked so concurrent setups wait for each other
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&models.ServerSettings{ID: serverSettingsID}).Error; err != nil {
+			return err
+		}
+		var current models.ServerSettings
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&current, serverSettingsID).Error; err != nil {
+			return err
+		}
+		if current.SetupCompletedAt != nil {
+			return ErrSetupDone
+		}
+		var users int64
+		if err := tx.Unscoped().Model(&models.User{}).Count(&users).Error; err != nil {
+			return err
+		}
+		if users > 0 {
+			return ErrSetupDone
+		}
+
+		if err := tx.Create(user).Error; err != nil {
+			return err
+		}
+
+		now := time.Now()
+		settings.ID = serverSettingsID
+		settings.SetupCompletedAt = &now
+		settings.SetupBy = username
+		return tx.Save(&settings).Error
+	})
+	if errors.Is(err, ErrSetupDone) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to complete setup: %w", err)
+	}
+	return user, nil
+}
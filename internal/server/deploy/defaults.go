@@ -0,0 +1,258 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/edgetainer/edgetainer/internal/server/events"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// joinSubscriber is the name the service subscribes to device events under
+const joinSubscriber = "deploy-join"
+
+// watchJoins queues the fleet default software of devices that enroll and
+// deploys queued fleet default and replacement software when devices come
+// online. Events are handled in order, so an enrolling device has its
+// software queued before it is deployed.
+func (s *Service) watchJoins() {
+	if s.bus == nil {
+		return
+	}
+
+	eventCh := s.bus.Subscribe(joinSubscriber, 64)
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer s.bus.Unsubscribe(joinSubscriber)
+
+		for {
+			select {
+			case evt, ok := <-eventCh:
+				if !ok {
+					return
+				}
+				s.handleJoinEvent(evt)
+			case <-s.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// handleJoinEvent reacts to one device event
+func (s *Service) handleJoinEvent(evt events.Event) {
+	if evt.Type != events.DeviceEnrolled && evt.Type != events.DeviceOnline {
+		return
+	}
+
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", evt.DeviceID).First(&device).Error; err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to load device %s", evt.DeviceID), err)
+		return
+	}
+
+	if evt.Type == events.DeviceEnrolled {
+		if _, err := s.QueueFleetDefaults(s.ctx, &device); err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to queue fleet defaults for device %s", device.DeviceID), err)
+		}
+		return
+	}
+
+	s.deployQueuedSoftware(device)
+}
+
+// FleetChanged cancels the queued default software of the fleet a device left
+// and queues that of the fleet it joined. Pending devices get their fleet's
+// software when they enroll instead.
+func (s *Service) FleetChanged(ctx context.Context, device *models.Device, previous *uuid.UUID) error {
+	if previous != nil {
+		result := s.database.GetDB().WithContext(ctx).Model(&models.Deployment{}).
+			Where("device_id = ? AND fleet_id = ? AND fleet_default AND status = ?", device.ID, *previous, models.DeploymentStatusQueued).
+			Update("status", models.DeploymentStatusCancelled)
+		if result.Error != nil {
+			return fmt.Errorf("failed to cancel queued deployments: %w", result.Error)
+		}
+	}
+
+	if device.Status == models.DeviceStatusPending {
+		return nil
+	}
+
+	queued, err := s.QueueFleetDefaults(ctx, device)
+	if err != nil || queued == 0 {
+		return err
+	}
+
+	if _, connected := s.sshServer.GetDeviceConnection(device.DeviceID); connected {
+		s.deployQueuedSoftware(*device)
+	}
+	return nil
+}
+
+// QueueFleetDefaults queues the default software of the device's fleet and
+// exposes its services on the device. Software the device already has a
+// queued or pending deployment of is left out. It returns the number of
+// deployments queued.
+func (s *Service) QueueFleetDefaults(ctx context.Context, device *models.Device) (int, error) {
+	if device.FleetID == nil {
+		return 0, nil
+	}
+
+	var defaults []models.FleetDefaultSoftware
+	if err := s.database.GetDB().WithContext(ctx).Where("fleet_id = ?", *device.FleetID).
+		Order("position").Find(&defaults).Error; err != nil {
+		return 0, fmt.Errorf("failed to load fleet defaults: %w", err)
+	}
+
+	queued := 0
+	for _, entry := range defaults {
+		var software models.Software
+		if err := s.database.GetDB().WithContext(ctx).Where("id = ?", entry.SoftwareID).First(&software).Error; err != nil {
+			s.logger.Warn(fmt.Sprintf("Skipping default software %s of fleet %s, it no longer exists", entry.SoftwareID, entry.FleetID))
+			continue
+		}
+
+		var inFlight int64
+		if err := s.database.GetDB().WithContext(ctx).Model(&models.Deployment{}).
+			Where("device_id = ? AND software_id = ? AND status IN ?", device.ID, software.ID,
+				[]string{models.DeploymentStatusQueued, models.DeploymentStatusPending}).
+			Count(&inFlight).Error; err != nil {
+			return queued, fmt.Errorf("failed to check deployments: %w", err)
+		}
+		if inFlight > 0 {
+			continue
+		}
+
+		version := entry.Version
+		if version == "" {
+			version = software.CurrentVersion
+		}
+
+		// The env is checked again when the deployment is sent, a device that
+		// is missing required values fails then
+		envJSON := []byte("{}")
+		if _, values, err := s.ResolveEnv(ctx, device, &software, version); err == nil {
+			envJSON, _ = json.Marshal(values)
+		}
+
+		deployment := &models.Deployment{
+			SoftwareID:   software.ID,
+			FleetID:      *device.FleetID,
+			DeviceID:     device.ID,
+			Version:      version,
+			Pinned:       entry.Version != "",
+			Status:       models.DeploymentStatusQueued,
+			EnvVars:      string(envJSON),
+			FleetDefault: true,
+		}
+		err := s.database.GetDB().WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(deployment).Error; err != nil {
+				return err
+			}
+			return exposeServices(tx, device, entry.ExposedServices)
+		})
+		if err != nil {
+			return queued, fmt.Errorf("failed to queue %s: %w", software.Name, err)
+		}
+
+		s.logger.Info(fmt.Sprintf("Queued %s version %s for device %s from fleet defaults", software.Name, version, device.DeviceID))
+		queued++
+	}
+
+	return queued, nil
+}
+
+// exposeServices creates the exposed services of default software on a
+// device, leaving services of the same name alone
+func exposeServices(tx *gorm.DB, device *models.Device, templates []models.ExposedServiceTemplate) error {
+	for _, template := range templates {
+		var count int64
+		if err := tx.Model(&models.ExposedService{}).Where("device_id = ? AND name = ?", device.ID, template.Name).
+			Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			continue
+		}
+
+		service := models.ExposedService{
+			ID:             uuid.New(),
+			DeviceID:       device.ID,
+			Name:           template.Name,
+			ContainerName:  template.ContainerName,
+			InternalPort:   template.InternalPort,
+			ExternalPort:   template.ExternalPort,
+			Protocol:       template.Protocol,
+			URLPath:        template.URLPath,
+			AuthRequired:   template.AuthRequired == nil || *template.AuthRequired,
+			AllowedSources: template.AllowedSources,
+			Enabled:        true,
+		}
+		if service.Protocol == "" {
+			service.Protocol = models.ServiceProtocolHTTP
+		}
+
+		// Select all columns so a false auth_required is not replaced by the
+		// column default
+		if err := tx.Select("*").Omit("DeletedAt").Create(&service).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deployQueuedSoftware sends the queued fleet default, replacement and
+// imported deployments of a device one after another in the background. A
+// device is only worked on by one goroutine at a time.
+func (s *Service) deployQueuedSoftware(device models.Device) {
+	s.mu.Lock()
+	if s.joining[device.ID] {
+		s.mu.Unlock()
+		return
+	}
+	s.joining[device.ID] = true
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer func() {
+			s.mu.Lock()
+			delete(s.joining, device.ID)
+			s.mu.Unlock()
+		}()
+
+		for s.ctx.Err() == nil {
+			var deployment models.Deployment
+			err := s.database.GetDB().Where("device_id = ? AND (fleet_default OR replacement OR imported) AND status = ?", device.ID, models.DeploymentStatusQueued).
+				Order("created_at").First(&deployment).Error
+			if err != nil {
+				return
+			}
+
+			var software models.Software
+			if err := s.database.GetDB().Where("id = ?", deployment.SoftwareID).First(&software).Error; err != nil {
+				s.logger.Error(fmt.Sprintf("Failed to load software of deployment %s", deployment.ID), err)
+				s.setStatus(&deployment, models.DeploymentStatusFailed, "software not found")
+				continue
+			}
+
+			if _, connected := s.sshServer.GetDeviceConnection(device.DeviceID); !connected {
+				// Left queued until the device is back
+				return
+			}
+			if err := s.checkFreeze(s.ctx, &deployment.FleetID); err != nil {
+				// Left queued until the device connects after the freeze
+				s.logger.Info(fmt.Sprintf("Holding back deployments to device %s: %s", device.DeviceID, err))
+				return
+			}
+
+			s.run(s.ctx, &deployment, &device, &software)
+		}
+	}()
+}
@@ -0,0 +1,64 @@
+package deploy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// FrozenError is returned when deploying to a fleet that is frozen
+type FrozenError struct {
+	Fleet  string
+	Freeze models.FleetFreeze
+}
+
+// Error implements the error interface
+func (e *FrozenError) Error() string {
+	return fmt.Sprintf("fleet %s is frozen: %s", e.Fleet, e.Freeze.Reason)
+}
+
+// overrideKey marks a context as overriding fleet freezes
+type overrideKey struct{}
+
+// WithOverride returns a context whose deployments go ahead even if their
+// fleet is frozen. Only admins may override a freeze, callers check that.
+func WithOverride(ctx context.Context) context.Context {
+	return context.WithValue(ctx, overrideKey{}, true)
+}
+
+// Overridden reports whether ctx overrides fleet freezes
+func Overridden(ctx context.Context) bool {
+	override, _ := ctx.Value(overrideKey{}).(bool)
+	return override
+}
+
+// frozen returns a FrozenError if the fleet is frozen and ctx does not
+// override the freeze
+func frozen(ctx context.Context, fleet *models.Fleet) error {
+	if !fleet.Freeze.Active(time.Now()) || Overridden(ctx) {
+		return nil
+	}
+	return &FrozenError{Fleet: fleet.Name, Freeze: *fleet.Freeze}
+}
+
+// checkFreeze loads a fleet and returns a FrozenError if it is frozen and
+// ctx does not override the freeze. Devices without a fleet are never frozen.
+func (s *Service) checkFreeze(ctx context.Context, fleetID *uuid.UUID) error {
+	if fleetID == nil || *fleetID == uuid.Nil {
+		return nil
+	}
+
+	var fleet models.Fleet
+	if err := s.database.GetDB().WithContext(ctx).Where("id = ?", *fleetID).First(&fleet).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return fmt.Errorf("failed to load fleet: %w", err)
+	}
+	return frozen(ctx, &fleet)
+}
@@ -0,0 +1,173 @@
+package deploy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/server/events"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrSameDevice is returned when replacing a device with itself
+	ErrSameDevice = errors.New("a device cannot replace itself")
+	// ErrDeviceRetired is returned when replacing with or replacing a device
+	// that was replaced or decommissioned
+	ErrDeviceRetired = errors.New("device was replaced or decommissioned")
+)
+
+// ReplaceDevice moves the role of a failed device onto a newly enrolled one:
+// its name, fleet, site, custom fields, settings, env overrides and exposed
+// services. The software last deployed to the old device is queued on the new
+// one at the same versions. The old device is marked replaced and linked to
+// the new one, keeping its deployment history. It returns the number of
+// deployments queued.
+func (s *Service) ReplaceDevice(ctx context.Context, old, replacement *models.Device) (int, error) {
+	if old.ID == replacement.ID {
+		return 0, ErrSameDevice
+	}
+	for _, device := range []*models.Device{old, replacement} {
+		if device.Status == models.DeviceStatusReplaced || device.Status == models.DeviceStatusDecommissioned {
+			return 0, &DeviceError{DeviceID: device.DeviceID, Err: ErrDeviceRetired}
+		}
+	}
+	// A revoked device can hand its role over, but not take one
+	if replacement.Status == models.DeviceStatusRevoked {
+		return 0, &DeviceError{DeviceID: replacement.DeviceID, Err: ErrDeviceRetired}
+	}
+
+	now := time.Now()
+	queued := 0
+	err := s.database.GetDB().WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// The subdomain moves, so clear it first in case it is unique
+		if err := tx.Model(old).Updates(map[string]interface{}{
+			"status":            models.DeviceStatusReplaced,
+			"replaced_by":       replacement.ID,
+			"replaced_at":       now,
+			"subdomain":         "",
+			"subdomain_enabled": false,
+		}).Error; err != nil {
+			return fmt.Errorf("failed to mark device replaced: %w", err)
+		}
+
+		takeover := models.Device{
+			Name:             old.Name,
+			FleetID:          old.FleetID,
+			SiteID:           old.SiteID,
+			CustomFields:     old.CustomFields,
+			Timezone:         old.Timezone,
+			Locale:           old.Locale,
+			TunnelRate:       old.TunnelRate,
+			PullRate:         old.PullRate,
+			Subdomain:        old.Subdomain,
+			SubdomainEnabled: old.SubdomainEnabled,
+			RequiredUSB:      old.RequiredUSB,
+			Resources:        old.Resources,
+			Replaces:         &old.ID,
+		}
+		columns := []string{"name", "fleet_id", "site_id", "custom_fields", "timezone", "locale",
+			"tunnel_rate", "pull_rate", "subdomain", "subdomain_enabled", "required_usb", "resources", "replaces"}
+		if old.LocationSource == protocol.LocationManual {
+			takeover.Latitude, takeover.Longitude, takeover.Address = old.Latitude, old.Longitude, old.Address
+			takeover.LocationSource, takeover.LocationUpdatedAt = old.LocationSource, &now
+			columns = append(columns, "latitude", "longitude", "address", "location_source", "location_updated_at")
+		}
+		if err := tx.Model(replacement).Select(columns).Updates(&takeover).Error; err != nil {
+			return fmt.Errorf("failed to update replacement device: %w", err)
+		}
+
+		// Env overrides and exposed services move over, except where the new
+		// device already has its own
+		if err := tx.Model(&models.DeviceEnvVars{}).
+			Where("device_id = ?", old.ID).
+			Where("NOT EXISTS (SELECT 1 FROM device_env_vars n WHERE n.device_id = ? AND n.software_id = device_env_vars.software_id AND n.container_name = device_env_vars.container_name AND n.deleted_at IS NULL)", replacement.ID).
+			Update("device_id", replacement.ID).Error; err != nil {
+			return fmt.Errorf("failed to move env overrides: %w", err)
+		}
+		if err := tx.Model(&models.ExposedService{}).
+			Where("device_id = ?", old.ID).
+			Where("NOT EXISTS (SELECT 1 FROM exposed_services n WHERE n.device_id = ? AND n.name = exposed_services.name AND n.deleted_at IS NULL)", replacement.ID).
+			Update("device_id", replacement.ID).Error; err != nil {
+			return fmt.Errorf("failed to move exposed services: %w", err)
+		}
+
+		// A site cache run by the old device has to be deployed again
+		if err := tx.Model(&models.Site{}).Where("cache_device_id = ?", old.ID).
+			Updates(map[string]interface{}{"cache_device_id": replacement.ID, "cache_status": models.CacheStatusUnknown}).Error; err != nil {
+			return fmt.Errorf("failed to move site cache: %w", err)
+		}
+
+		// Queued deployments of the old device will never run
+		if err := tx.Model(&models.Deployment{}).
+			Where("device_id = ? AND status = ?", old.ID, models.DeploymentStatusQueued).
+			Update("status", models.DeploymentStatusCancelled).Error; err != nil {
+			return fmt.Errorf("failed to cancel queued deployments: %w", err)
+		}
+
+		var err error
+		queued, err = queueReplacementSoftware(tx, old, replacement)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	s.logger.Info(fmt.Sprintf("Device %s replaced by %s, %d deployments queued", old.DeviceID, replacement.DeviceID, queued))
+
+	if s.bus != nil {
+		s.bus.Publish(events.NewEvent(events.DeviceReplaced, old.DeviceID, map[string]interface{}{
+			"name":           old.Name,
+			"replacement_id": replacement.DeviceID,
+			"queued":         queued,
+		}))
+	}
+
+	if err := s.database.GetDB().WithContext(ctx).First(replacement, "id = ?", replacement.ID).Error; err != nil {
+		return queued, err
+	}
+	if _, connected := s.sshServer.GetDeviceConnection(replacement.DeviceID); connected && queued > 0 {
+		s.deployQueuedSoftware(*replacement)
+	}
+	return queued, nil
+}
+
+// queueReplacementSoftware queues the last deployed version of every software
+// of the old device on its replacement
+func queueReplacementSoftware(tx *gorm.DB, old, replacement *models.Device) (int, error) {
+	var deployed []models.Deployment
+	if err := tx.Where("device_id = ? AND status = ?", old.ID, models.DeploymentStatusDeployed).
+		Order("created_at DESC").Find(&deployed).Error; err != nil {
+		return 0, fmt.Errorf("failed to load deployments: %w", err)
+	}
+
+	queued := 0
+	seen := make(map[string]bool)
+	for _, last := range deployed {
+		if seen[last.SoftwareID.String()] {
+			continue
+		}
+		seen[last.SoftwareID.String()] = true
+
+		deployment := &models.Deployment{
+			SoftwareID:  last.SoftwareID,
+			DeviceID:    replacement.ID,
+			Version:     last.Version,
+			Pinned:      last.Pinned,
+			Status:      models.DeploymentStatusQueued,
+			EnvVars:     last.EnvVars,
+			Replacement: true,
+		}
+		if old.FleetID != nil {
+			deployment.FleetID = *old.FleetID
+		}
+		if err := tx.Create(deployment).Error; err != nil {
+			return queued, fmt.Errorf("failed to queue deployment: %w", err)
+		}
+		queued++
+	}
+	return queued, nil
+}
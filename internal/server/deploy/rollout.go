@@ -0,0 +1,575 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/server/events"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	// resumeDelay gives devices time to reconnect before rollouts are resumed
+	// after a restart, so that they are not skipped
+	resumeDelay = time.Minute
+
+	// defaultRetryBackoff is used when retries are enabled without a backoff
+	defaultRetryBackoff = 30 * time.Second
+	// maxRetryBackoff caps the doubling of the backoff between retries
+	maxRetryBackoff = 10 * time.Minute
+	// maxAttempts bounds the attempts a rollout may make per device
+	maxAttempts = 10
+)
+
+var (
+	// ErrEmptyFleet is returned when starting a rollout on a fleet without devices
+	ErrEmptyFleet = errors.New("fleet has no devices")
+	// ErrRolloutNotRunning is returned when cancelling a rollout that has ended
+	ErrRolloutNotRunning = errors.New("rollout is not running")
+	// ErrRolloutRunning is returned when retrying a rollout that has not ended
+	ErrRolloutRunning = errors.New("rollout is still running")
+	// ErrNothingToRetry is returned when retrying a rollout without failed devices
+	ErrNothingToRetry = errors.New("rollout has no devices to retry")
+	// ErrInvalidRetryPolicy is returned for retry policies out of bounds
+	ErrInvalidRetryPolicy = fmt.Errorf("max attempts must be between 0 and %d and the backoff must not be negative", maxAttempts)
+)
+
+// RetryPolicy controls how often a rollout attempts to deploy to a device
+// that fails or is not connected
+type RetryPolicy struct {
+	MaxAttempts int           // Per device, 0 or 1 for no retries
+	Backoff     time.Duration // Before the first retry, doubled for each further one
+}
+
+// Validate returns ErrInvalidRetryPolicy if the policy is out of bounds
+func (p RetryPolicy) Validate() error {
+	if p.MaxAttempts < 0 || p.MaxAttempts > maxAttempts || p.Backoff < 0 {
+		return ErrInvalidRetryPolicy
+	}
+	return nil
+}
+
+// DeviceError is returned when a rollout cannot start because of one device
+type DeviceError struct {
+	DeviceID string
+	Err      error
+}
+
+// Error implements the error interface
+func (e *DeviceError) Error() string {
+	return fmt.Sprintf("device %s: %v", e.DeviceID, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *DeviceError) Unwrap() error {
+	return e.Err
+}
+
+// Progress summarizes the deployments of a rollout
+type Progress struct {
+	Rollout     models.Rollout      `json:"rollout"`
+	Total       int                 `json:"total"`
+	Queued      int                 `json:"queued"`
+	Retrying    int                 `json:"retrying"` // Queued again after a failed attempt
+	Deploying   int                 `json:"deploying"`
+	Deployed    int                 `json:"deployed"`
+	Failed      int                 `json:"failed"`
+	Skipped     int                 `json:"skipped"`
+	Cancelled   int                 `json:"cancelled"`
+	Deployments []models.Deployment `json:"deployments"`
+}
+
+// Failure describes a device of a rollout that was not deployed
+type Failure struct {
+	DeploymentID uuid.UUID `json:"deployment_id"`
+	DeviceID     string    `json:"device_id"`
+	DeviceName   string    `json:"device_name"`
+	Status       string    `json:"status"` // failed or skipped
+	Attempts     int       `json:"attempts"`
+	Error        string    `json:"error"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// StartRollout deploys a software version to every device of a fleet, at most
+// maxConcurrent devices at a time. Zero uses the fleet's limit or the server
+// default, a negative value deploys to all devices at once. Devices that fail
+// or are not connected are retried as allowed by the retry policy. The env of
+// every device is validated before anything is deployed.
+func (s *Service) StartRollout(ctx context.Context, fleet *models.Fleet, software *models.Software, version string, maxConcurrent int, retry RetryPolicy) (*models.Rollout, error) {
+	if err := retry.Validate(); err != nil {
+		return nil, err
+	}
+	if err := frozen(ctx, fleet); err != nil {
+		return nil, err
+	}
+	if retry.MaxAttempts == 0 {
+		retry.MaxAttempts = 1
+	}
+	if retry.MaxAttempts > 1 && retry.Backoff == 0 {
+		retry.Backoff = defaultRetryBackoff
+	}
+	if version == "" {
+		version = software.CurrentVersion
+	}
+	if maxConcurrent == 0 {
+		maxConcurrent = fleet.MaxDeploys
+	}
+	if maxConcurrent == 0 {
+		maxConcurrent = int(s.maxConcurrent.Load())
+	}
+	if maxConcurrent < 0 {
+		maxConcurrent = 0
+	}
+
+	var devices []models.Device
+	if err := s.database.GetDB().WithContext(ctx).
+		Where("fleet_id = ? AND status NOT IN ?", fleet.ID, []string{models.DeviceStatusDecommissioned, models.DeviceStatusReplaced, models.DeviceStatusRevoked}).
+		Order("device_id").Find(&devices).Error; err != nil {
+		return nil, fmt.Errorf("failed to load fleet devices: %w", err)
+	}
+	if len(devices) == 0 {
+		return nil, ErrEmptyFleet
+	}
+
+	rollout := &models.Rollout{
+		FleetID:       fleet.ID,
+		SoftwareID:    software.ID,
+		Version:       version,
+		MaxConcurrent: maxConcurrent,
+		MaxAttempts:   retry.MaxAttempts,
+		RetryBackoff:  int(retry.Backoff / time.Second),
+		Status:        models.RolloutStatusRunning,
+		Override:      fleet.Freeze.Active(time.Now()),
+	}
+
+	deployments := make([]*models.Deployment, 0, len(devices))
+	for i := range devices {
+		_, values, err := s.ResolveEnv(ctx, &devices[i], software, version)
+		if err != nil {
+			return nil, &DeviceError{DeviceID: devices[i].DeviceID, Err: err}
+		}
+		envJSON, _ := json.Marshal(values)
+
+		deployments = append(deployments, &models.Deployment{
+			SoftwareID: software.ID,
+			FleetID:    fleet.ID,
+			DeviceID:   devices[i].ID,
+			Version:    version,
+			Status:     models.DeploymentStatusQueued,
+			EnvVars:    string(envJSON),
+		})
+	}
+
+	err := s.database.GetDB().WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(rollout).Error; err != nil {
+			return err
+		}
+		for _, deployment := range deployments {
+			deployment.RolloutID = &rollout.ID
+			if err := tx.Create(deployment).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to record rollout: %w", err)
+	}
+
+	s.logger.Info(fmt.Sprintf("Rolling out %s version %s to %d devices of fleet %s", software.Name, version, len(devices), fleet.Name))
+	s.startRollout(rollout, 0)
+
+	return rollout, nil
+}
+
+// CancelRollout stops a rollout from deploying to more devices. Deployments
+// already being sent are allowed to finish.
+func (s *Service) CancelRollout(ctx context.Context, id uuid.UUID) error {
+	s.mu.Lock()
+	cancel, ok := s.rollouts[id]
+	s.mu.Unlock()
+	if !ok {
+		return ErrRolloutNotRunning
+	}
+
+	now := time.Now()
+	err := s.database.GetDB().WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.Rollout{}).Where("id = ?", id).
+			Updates(map[string]interface{}{"status": models.RolloutStatusCancelled, "finished_at": now}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.Deployment{}).
+			Where("rollout_id = ? AND status = ?", id, models.DeploymentStatusQueued).
+			Update("status", models.DeploymentStatusCancelled).Error
+	})
+	if err != nil {
+		return fmt.Errorf("failed to cancel rollout: %w", err)
+	}
+
+	cancel()
+	s.logger.Info(fmt.Sprintf("Rollout %s cancelled", id))
+	return nil
+}
+
+// RetryFailed runs an ended rollout again for its devices that failed, and
+// also those that were skipped if includeSkipped is set. Each device gets the
+// attempts of the rollout's retry policy anew and keeps its last error until
+// it is attempted again.
+func (s *Service) RetryFailed(ctx context.Context, id uuid.UUID, includeSkipped bool) (*models.Rollout, error) {
+	var rollout models.Rollout
+	if err := s.database.GetDB().WithContext(ctx).Where("id = ?", id).First(&rollout).Error; err != nil {
+		return nil, err
+	}
+	if rollout.Status == models.RolloutStatusRunning {
+		return nil, ErrRolloutRunning
+	}
+	if err := s.checkFreeze(ctx, &rollout.FleetID); err != nil {
+		return nil, err
+	}
+	// A retry during a freeze is an override again, one after it is not
+	rollout.Override = Overridden(ctx)
+
+	statuses := []string{models.DeploymentStatusFailed}
+	if includeSkipped {
+		statuses = append(statuses, models.DeploymentStatusSkipped)
+	}
+
+	var requeued int64
+	err := s.database.GetDB().WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// Guards against a concurrent retry of the same rollout
+		result := tx.Model(&models.Rollout{}).Where("id = ? AND status <> ?", id, models.RolloutStatusRunning).
+			Updates(map[string]interface{}{"status": models.RolloutStatusRunning, "finished_at": nil, "override": rollout.Override})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrRolloutRunning
+		}
+
+		result = tx.Model(&models.Deployment{}).Where("rollout_id = ? AND status IN ?", id, statuses).
+			Updates(map[string]interface{}{"status": models.DeploymentStatusQueued, "attempts": 0})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrNothingToRetry
+		}
+		requeued = result.RowsAffected
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, ErrRolloutRunning) || errors.Is(err, ErrNothingToRetry) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to requeue deployments: %w", err)
+	}
+
+	rollout.Status, rollout.FinishedAt = models.RolloutStatusRunning, nil
+	s.logger.Info(fmt.Sprintf("Retrying %d devices of rollout %s", requeued, id))
+	s.startRollout(&rollout, 0)
+
+	return &rollout, nil
+}
+
+// RolloutFailures lists the devices of a rollout that failed or were skipped,
+// with the error of their last attempt
+func (s *Service) RolloutFailures(ctx context.Context, id uuid.UUID) ([]Failure, error) {
+	failures := []Failure{}
+	err := s.database.GetDB().WithContext(ctx).Table("deployments").
+		Select("deployments.id AS deployment_id, devices.device_id, devices.name AS device_name, deployments.status, deployments.attempts, deployments.error, deployments.updated_at").
+		Joins("JOIN devices ON devices.id = deployments.device_id").
+		Where("deployments.rollout_id = ? AND deployments.status IN ? AND deployments.deleted_at IS NULL",
+			id, []string{models.DeploymentStatusFailed, models.DeploymentStatusSkipped}).
+		Order("devices.device_id").Scan(&failures).Error
+	if err != nil {
+		return nil, err
+	}
+	return failures, nil
+}
+
+// RolloutProgress returns a rollout with the state of its deployments
+func (s *Service) RolloutProgress(ctx context.Context, id uuid.UUID) (*Progress, error) {
+	progress := &Progress{}
+	if err := s.database.GetDB().WithContext(ctx).Where("id = ?", id).First(&progress.Rollout).Error; err != nil {
+		return nil, err
+	}
+
+	if err := s.database.GetDB().WithContext(ctx).Where("rollout_id = ?", id).
+		Order("created_at").Find(&progress.Deployments).Error; err != nil {
+		return nil, err
+	}
+
+	s.AttachPullProgress(ctx, progress.Deployments)
+
+	progress.Total = len(progress.Deployments)
+	for _, deployment := range progress.Deployments {
+		switch deployment.Status {
+		case models.DeploymentStatusQueued:
+			if deployment.Attempts > 0 {
+				progress.Retrying++
+			} else {
+				progress.Queued++
+			}
+		case models.DeploymentStatusPending:
+			progress.Deploying++
+		case models.DeploymentStatusDeployed:
+			progress.Deployed++
+		case models.DeploymentStatusFailed:
+			progress.Failed++
+		case models.DeploymentStatusSkipped:
+			progress.Skipped++
+		case models.DeploymentStatusCancelled:
+			progress.Cancelled++
+		}
+	}
+
+	return progress, nil
+}
+
+// Start resumes the rollouts that were running when the server stopped and
+// starts deploying fleet defaults to devices that join a fleet. Deployments
+// that were being sent at the time are marked failed, since their outcome is
+// unknown.
+func (s *Service) Start() error {
+	if err := s.database.GetDB().Model(&models.Deployment{}).
+		Where("(fleet_default OR replacement OR imported) AND status = ?", models.DeploymentStatusPending).
+		Update("status", models.DeploymentStatusFailed).Error; err != nil {
+		return fmt.Errorf("failed to update interrupted deployments: %w", err)
+	}
+	s.watchJoins()
+
+	var rollouts []models.Rollout
+	if err := s.database.GetDB().Where("status = ?", models.RolloutStatusRunning).Find(&rollouts).Error; err != nil {
+		return fmt.Errorf("failed to load running rollouts: %w", err)
+	}
+
+	for i := range rollouts {
+		if err := s.database.GetDB().Model(&models.Deployment{}).
+			Where("rollout_id = ? AND status = ?", rollouts[i].ID, models.DeploymentStatusPending).
+			Update("status", models.DeploymentStatusFailed).Error; err != nil {
+			return fmt.Errorf("failed to update interrupted deployments: %w", err)
+		}
+
+		s.logger.Info(fmt.Sprintf("Resuming rollout %s in %s", rollouts[i].ID, resumeDelay))
+		s.startRollout(&rollouts[i], resumeDelay)
+	}
+
+	return nil
+}
+
+// Stop stops running rollouts and waits for them to wind down. Queued
+// deployments are resumed on the next start.
+func (s *Service) Stop() {
+	s.cancelFunc()
+	s.wg.Wait()
+	s.logger.Info("Deploy service stopped")
+}
+
+// startRollout runs a rollout in the background after a delay
+func (s *Service) startRollout(rollout *models.Rollout, delay time.Duration) {
+	ctx, cancel := context.WithCancel(s.ctx)
+
+	s.mu.Lock()
+	s.rollouts[rollout.ID] = cancel
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer func() {
+			s.mu.Lock()
+			delete(s.rollouts, rollout.ID)
+			s.mu.Unlock()
+			cancel()
+		}()
+
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+			}
+		}
+		s.runRollout(ctx, rollout)
+	}()
+}
+
+// runRollout deploys the queued deployments of a rollout. Cancelling ctx stops
+// new deployments from starting.
+func (s *Service) runRollout(ctx context.Context, rollout *models.Rollout) {
+	var software models.Software
+	if err := s.database.GetDB().Where("id = ?", rollout.SoftwareID).First(&software).Error; err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to load software of rollout %s", rollout.ID), err)
+		return
+	}
+
+	var deployments []models.Deployment
+	if err := s.database.GetDB().Where("rollout_id = ? AND status = ?", rollout.ID, models.DeploymentStatusQueued).
+		Order("created_at").Find(&deployments).Error; err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to load deployments of rollout %s", rollout.ID), err)
+		return
+	}
+
+	limit := rollout.MaxConcurrent
+	if limit <= 0 {
+		limit = len(deployments)
+	}
+	slots := make(semaphore, max(limit, 1))
+
+	deploysQueued.Add(float64(len(deployments)))
+	var wg sync.WaitGroup
+	for i := range deployments {
+		if err := slots.acquire(ctx); err != nil {
+			deploysQueued.Add(-float64(len(deployments) - i))
+			break
+		}
+		deploysQueued.Dec()
+
+		wg.Add(1)
+		go func(deployment *models.Deployment) {
+			defer wg.Done()
+			defer slots.release()
+
+			s.deployQueued(ctx, rollout, deployment, &software)
+		}(&deployments[i])
+	}
+	wg.Wait()
+
+	// Cancelled rollouts are finalized by CancelRollout, and rollouts
+	// interrupted by a shutdown are resumed on the next start
+	if ctx.Err() != nil {
+		return
+	}
+
+	progress, err := s.RolloutProgress(s.ctx, rollout.ID)
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to load progress of rollout %s", rollout.ID), err)
+		return
+	}
+
+	now := time.Now()
+	rollout.Status = rolloutOutcome(progress)
+	rollout.FinishedAt = &now
+	if err := s.database.GetDB().Model(rollout).
+		Updates(map[string]interface{}{"status": rollout.Status, "finished_at": now}).Error; err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to update rollout %s", rollout.ID), err)
+	}
+
+	s.logger.Info(fmt.Sprintf("Rollout %s %s: %d deployed, %d failed, %d skipped",
+		rollout.ID, rollout.Status, progress.Deployed, progress.Failed, progress.Skipped))
+
+	if s.bus != nil {
+		s.bus.Publish(events.NewEvent(events.RolloutFinished, "", map[string]interface{}{
+			"rollout_id":    rollout.ID.String(),
+			"fleet_id":      rollout.FleetID.String(),
+			"software_id":   software.ID.String(),
+			"software_name": software.Name,
+			"version":       rollout.Version,
+			"status":        rollout.Status,
+			"deployed":      progress.Deployed,
+			"failed":        progress.Failed,
+			"skipped":       progress.Skipped,
+		}))
+	}
+}
+
+// rolloutOutcome returns the final status of a rollout from its deployments
+func rolloutOutcome(progress *Progress) string {
+	switch {
+	case progress.Failed+progress.Skipped == 0:
+		return models.RolloutStatusCompleted
+	case progress.Deployed == 0:
+		return models.RolloutStatusFailed
+	default:
+		return models.RolloutStatusPartial
+	}
+}
+
+// deployQueued sends a queued rollout deployment, making as many attempts as
+// the rollout allows. A device that is not connected uses up an attempt and
+// is skipped once none remain. The deployment keeps its slot while waiting to
+// be retried, so a rollout only moves on once a device is done. Cancelling ctx
+// stops further attempts, an attempt in progress finishes regardless.
+func (s *Service) deployQueued(ctx context.Context, rollout *models.Rollout, deployment *models.Deployment, software *models.Software) {
+	var device models.Device
+	if err := s.database.GetDB().WithContext(s.ctx).Where("id = ?", deployment.DeviceID).First(&device).Error; err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to load device of deployment %s", deployment.ID), err)
+		s.setStatus(deployment, models.DeploymentStatusFailed, "device not found")
+		return
+	}
+
+	for {
+		// A freeze that starts during the rollout skips the devices it has
+		// not reached, a retry after the freeze deploys them
+		if !rollout.Override {
+			if err := s.checkFreeze(s.ctx, &rollout.FleetID); err != nil {
+				s.setStatus(deployment, models.DeploymentStatusSkipped, err.Error())
+				return
+			}
+		}
+
+		deployment.Attempts++
+		if err := s.database.GetDB().Model(deployment).Update("attempts", deployment.Attempts).Error; err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to update deployment %s", deployment.ID), err)
+		}
+		last := deployment.Attempts >= rollout.MaxAttempts
+
+		var reason string
+		if _, connected := s.sshServer.GetDeviceConnection(device.DeviceID); !connected {
+			reason = "device was not connected"
+			if last {
+				s.logger.Info(fmt.Sprintf("Skipping device %s, it is not connected", device.DeviceID))
+				s.setStatus(deployment, models.DeploymentStatusSkipped, reason)
+				return
+			}
+		} else {
+			// The outcome is recorded by run, which finishes even if the
+			// rollout is cancelled meanwhile
+			err := s.run(s.ctx, deployment, &device, software)
+			if err == nil || last {
+				return
+			}
+			reason = err.Error()
+		}
+
+		delay := retryDelay(rollout, deployment.Attempts)
+		s.logger.Info(fmt.Sprintf("Retrying device %s in %s, attempt %d of %d: %s",
+			device.DeviceID, delay, deployment.Attempts+1, rollout.MaxAttempts, reason))
+		s.setStatus(deployment, models.DeploymentStatusQueued, reason)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			// Left queued on shutdown, so the rollout resumes it on the next start
+			if s.ctx.Err() == nil {
+				s.setStatus(deployment, models.DeploymentStatusCancelled, reason)
+			}
+			return
+		}
+	}
+}
+
+// retryDelay returns how long to wait after the given attempt before the next
+func retryDelay(rollout *models.Rollout, attempt int) time.Duration {
+	delay := time.Duration(rollout.RetryBackoff) * time.Second
+	for i := 1; i < attempt && delay < maxRetryBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxRetryBackoff)
+}
+
+// setStatus records the status of a deployment along with why it did not
+// deploy, if it did not
+func (s *Service) setStatus(deployment *models.Deployment, status, reason string) {
+	deployment.Status, deployment.Error = status, reason
+	if err := s.database.GetDB().Model(deployment).
+		Updates(map[string]interface{}{"status": status, "error": reason}).Error; err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to update deployment %s", deployment.ID), err)
+	}
+}
@@ -0,0 +1,85 @@
+package deploy
+
+import (
+	"context"
+	"sync"
+
+	"github.com/edgetainer/edgetainer/internal/server/metrics"
+)
+
+var (
+	deploysQueued = metrics.NewGauge("edgetainer_deploy_queued",
+		"Deployments waiting for a rollout or registry slot.")
+	deploysRunning = metrics.NewGauge("edgetainer_deploy_running",
+		"Deployments currently being sent to devices.")
+)
+
+// semaphore limits how many holders may run at once. Waiters are served in
+// arrival order.
+type semaphore chan struct{}
+
+// acquire takes a slot, blocking until one is free or ctx is done
+func (s semaphore) acquire(ctx context.Context) error {
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release frees a slot
+func (s semaphore) release() {
+	<-s
+}
+
+// registrySlots limits the number of devices pulling from the same registry at
+// once, across rollouts and single device deployments
+type registrySlots struct {
+	mu    sync.Mutex
+	limit int // 0 or less for unlimited
+	slots map[string]semaphore
+}
+
+// setLimit changes the limit. Deployments already holding a slot keep it.
+func (r *registrySlots) setLimit(limit int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.limit = limit
+	r.slots = make(map[string]semaphore)
+}
+
+// acquire takes a slot for every registry, in a fixed order so that two
+// deployments never wait on each other. It returns a function releasing them.
+func (r *registrySlots) acquire(ctx context.Context, registries []string) (func(), error) {
+	r.mu.Lock()
+	if r.limit <= 0 {
+		r.mu.Unlock()
+		return func() {}, nil
+	}
+	held := make([]semaphore, 0, len(registries))
+	for _, registry := range registries {
+		slot, ok := r.slots[registry]
+		if !ok {
+			slot = make(semaphore, r.limit)
+			r.slots[registry] = slot
+		}
+		held = append(held, slot)
+	}
+	r.mu.Unlock()
+
+	release := func(slots []semaphore) {
+		for _, slot := range slots {
+			slot.release()
+		}
+	}
+
+	for i, slot := range held {
+		if err := slot.acquire(ctx); err != nil {
+			release(held[:i])
+			return nil, err
+		}
+	}
+	return func() { release(held) }, nil
+}
@@ -0,0 +1,691 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/server/artifacts"
+	"github.com/edgetainer/edgetainer/internal/server/db"
+	"github.com/edgetainer/edgetainer/internal/server/envschema"
+	"github.com/edgetainer/edgetainer/internal/server/events"
+	"github.com/edgetainer/edgetainer/internal/server/extensions"
+	"github.com/edgetainer/edgetainer/internal/server/secrets"
+	"github.com/edgetainer/edgetainer/internal/server/sitecache"
+	"github.com/edgetainer/edgetainer/internal/server/ssh"
+	"github.com/edgetainer/edgetainer/internal/shared/compose"
+	"github.com/edgetainer/edgetainer/internal/shared/logging"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+	"github.com/edgetainer/edgetainer/internal/shared/tracing"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+// ErrDeviceNotConnected is returned when deploying to a device without a tunnel
+var ErrDeviceNotConnected = errors.New("device is not connected")
+
+// ErrAgentFeature is returned when a deployment needs a protocol feature the
+// agent of the device does not report
+var ErrAgentFeature = errors.New("agent does not support")
+
+// ErrPlatform is returned when the images of a software are not built for a
+// platform the device runs
+var ErrPlatform = errors.New("software is not built for the platform of the device")
+
+// ErrRequirements is returned when a device runs an agent, OS or kernel older
+// than a deployment requires
+var ErrRequirements = errors.New("device does not meet the requirements")
+
+// Service builds deploy payloads, sends them to devices and runs fleet rollouts
+type Service struct {
+	ctx        context.Context
+	cancelFunc context.CancelFunc
+	wg         sync.WaitGroup
+	database   *db.DB
+	sshServer  *ssh.Server
+	resolver   *secrets.Resolver
+	caches     *sitecache.Service
+	bus        *events.Bus
+	extensions *extensions.Registry  // Deploy hooks, nil for none
+	artifacts  *artifacts.Storage    // Signs artifact download URLs, nil to serve artifacts over the tunnel only
+	requires   protocol.Requirements // Of the server release, on top of those of software versions
+	logger     *logging.Logger
+
+	registries    registrySlots
+	maxConcurrent atomic.Int64 // Default rollout concurrency, 0 or less for unlimited
+
+	mu       sync.Mutex
+	rollouts map[uuid.UUID]context.CancelFunc // Running rollouts
+	joining  map[uuid.UUID]bool               // Devices whose fleet defaults are being deployed
+}
+
+// NewService creates a new deploy service
+func NewService(ctx context.Context, database *db.DB, sshServer *ssh.Server, resolver *secrets.Resolver, caches *sitecache.Service, bus *events.Bus) *Service {
+	serviceCtx, cancel := context.WithCancel(ctx)
+
+	return &Service{
+		ctx:        serviceCtx,
+		cancelFunc: cancel,
+		database:   database,
+		sshServer:  sshServer,
+		resolver:   resolver,
+		caches:     caches,
+		bus:        bus,
+		logger:     logging.WithComponent("deploy"),
+		rollouts:   make(map[uuid.UUID]context.CancelFunc),
+		joining:    make(map[uuid.UUID]bool),
+	}
+}
+
+// SetExtensions sets the registry whose deploy hooks run around every
+// deployment
+func (s *Service) SetExtensions(registry *extensions.Registry) {
+	s.extensions = registry
+}
+
+// SetArtifacts sets the artifact storage, which gives pre-signed download
+// URLs of artifacts if it can
+func (s *Service) SetArtifacts(storage *artifacts.Storage) {
+	s.artifacts = storage
+}
+
+// SetRequirements sets the oldest agent, OS and kernel versions the server
+// deploys to, whatever the software version
+func (s *Service) SetRequirements(requirements protocol.Requirements) {
+	s.requires = requirements
+}
+
+// Requirements returns the oldest agent, OS and kernel versions the server
+// deploys to
+func (s *Service) Requirements() protocol.Requirements {
+	return s.requires
+}
+
+// SetLimits sets the default number of devices a rollout deploys to at once
+// and the number of devices pulling from the same registry at once. Zero or
+// less removes a limit.
+func (s *Service) SetLimits(maxConcurrent, registryConcurrency int) {
+	s.maxConcurrent.Store(int64(maxConcurrent))
+	s.registries.setLimit(registryConcurrency)
+}
+
+// LoadEnvSchema returns the env schema of a software version, or an empty
+// schema when none was declared. An empty version means the current version.
+func (s *Service) LoadEnvSchema(ctx context.Context, software models.Software, version string) (envschema.Schema, error) {
+	if version == "" {
+		version = software.CurrentVersion
+	}
+
+	var record models.SoftwareEnvSchema
+	err := s.database.GetDB().WithContext(ctx).Where("software_id = ? AND version = ?", software.ID, version).First(&record).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return envschema.Schema{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return envschema.Parse(record.Variables)
+}
+
+// LoadRequirements returns the requirements declared for a software
+// version, or nil if there are none
+func (s *Service) LoadRequirements(ctx context.Context, software models.Software, version string) (*protocol.Requirements, error) {
+	var record models.SoftwareRequirements
+	err := s.database.GetDB().WithContext(ctx).Where("software_id = ? AND version = ?", software.ID, version).First(&record).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &record.Requirements, nil
+}
+
+// UnmetRequirements lists the requirements of the server and of a software
+// version a device does not meet, nil if it meets all
+func (s *Service) UnmetRequirements(ctx context.Context, device *models.Device, software models.Software, version string) ([]string, error) {
+	requirements, err := s.LoadRequirements(ctx, software, version)
+	if err != nil {
+		return nil, err
+	}
+	return s.Unmet(device, software, version, requirements), nil
+}
+
+// Unmet lists the requirements of the server and those loaded for a software
+// version, which may be nil, that a device does not meet
+func (s *Service) Unmet(device *models.Device, software models.Software, version string, requirements *protocol.Requirements) []string {
+	var unmet []string
+	for _, reason := range s.requires.Unmet(device.AgentVersion, device.OS) {
+		unmet = append(unmet, reason+" required by the server")
+	}
+	if requirements != nil {
+		for _, reason := range requirements.Unmet(device.AgentVersion, device.OS) {
+			unmet = append(unmet, fmt.Sprintf("%s required by %s %s", reason, software.Name, version))
+		}
+	}
+	return unmet
+}
+
+// LoadMigration returns the data migration declared for a software version,
+// or nil if there is none
+func (s *Service) LoadMigration(ctx context.Context, software models.Software, version string) (*protocol.Migration, error) {
+	var record models.SoftwareMigration
+	err := s.database.GetDB().WithContext(ctx).Where("software_id = ? AND version = ?", software.ID, version).First(&record).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &record.Migration, nil
+}
+
+// LoadArtifacts returns the artifacts of a software version by path, with a
+// download URL if the storage gives one
+func (s *Service) LoadArtifacts(ctx context.Context, software models.Software, version string) ([]protocol.Artifact, error) {
+	var records []models.SoftwareArtifact
+	if err := s.database.GetDB().WithContext(ctx).Where("software_id = ? AND version = ?", software.ID, version).
+		Order("path").Find(&records).Error; err != nil {
+		return nil, err
+	}
+
+	result := make([]protocol.Artifact, 0, len(records))
+	for _, record := range records {
+		artifact := protocol.Artifact{
+			Path:   record.Path,
+			Digest: record.Digest,
+			Size:   record.Size,
+			Mode:   record.Mode,
+		}
+		if s.artifacts != nil {
+			url, err := s.artifacts.URL(ctx, record.Digest)
+			if err != nil {
+				return nil, fmt.Errorf("failed to sign download of artifact %s: %w", record.Path, err)
+			}
+			artifact.URL = url
+		}
+		result = append(result, artifact)
+	}
+	return result, nil
+}
+
+// ComposeOverrides returns the compose file fragments layered over the
+// compose file of a software on a device: the fleet's, then the device's
+func (s *Service) ComposeOverrides(ctx context.Context, device *models.Device, software *models.Software) ([]string, error) {
+	var overrides []string
+
+	if device.FleetID != nil {
+		var fleet models.FleetComposeOverride
+		err := s.database.GetDB().WithContext(ctx).Where("fleet_id = ? AND software_id = ?", *device.FleetID, software.ID).First(&fleet).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+		if err == nil {
+			overrides = append(overrides, fleet.ComposeYAML)
+		}
+	}
+
+	var own models.DeviceComposeOverride
+	err := s.database.GetDB().WithContext(ctx).Where("device_id = ? AND software_id = ?", device.ID, software.ID).First(&own).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	if err == nil {
+		overrides = append(overrides, own.ComposeYAML)
+	}
+
+	return overrides, nil
+}
+
+// ResolveEnv computes the env vars of a software version on a device: schema
+// defaults, then software defaults, then fleet and device overrides, with
+// templates expanded. Secret references are left unresolved.
+func (s *Service) ResolveEnv(ctx context.Context, device *models.Device, software *models.Software, version string) (envschema.Schema, map[string]string, error) {
+	schema, err := s.LoadEnvSchema(ctx, *software, version)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	vars := map[string]string{
+		"device.id":        device.DeviceID,
+		"device.name":      device.Name,
+		"device.subdomain": device.Subdomain,
+		"software.name":    software.Name,
+		"software.version": version,
+	}
+
+	layers := []map[string]string{DecodeEnvVars(software.DefaultEnvVars)}
+
+	if device.FleetID != nil {
+		var fleet models.Fleet
+		if err := s.database.GetDB().WithContext(ctx).Where("id = ?", *device.FleetID).First(&fleet).Error; err == nil {
+			vars["fleet.id"] = fleet.ID.String()
+			vars["fleet.name"] = fleet.Name
+		}
+
+		var fleetVars models.FleetEnvVars
+		if err := s.database.GetDB().WithContext(ctx).Where("fleet_id = ? AND software_id = ?", *device.FleetID, software.ID).First(&fleetVars).Error; err == nil {
+			layers = append(layers, DecodeEnvVars(fleetVars.EnvVars))
+		}
+	}
+
+	var deviceVars models.DeviceEnvVars
+	if err := s.database.GetDB().WithContext(ctx).Where("device_id = ? AND software_id = ?", device.ID, software.ID).First(&deviceVars).Error; err == nil {
+		layers = append(layers, DecodeEnvVars(deviceVars.EnvVars))
+	}
+
+	values, err := schema.Resolve(vars, layers...)
+	return schema, values, err
+}
+
+// BuildPayload builds the deploy command payload for a software version on a
+// device. Secret references and registry credentials are resolved here, so
+// the payload must never be persisted.
+func (s *Service) BuildPayload(ctx context.Context, device *models.Device, software *models.Software, version string) (_ *protocol.DeployPayload, err error) {
+	ctx, span := tracing.Start(ctx, "deploy.build_payload")
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
+	if err := s.checkPlatform(device, software); err != nil {
+		return nil, err
+	}
+	unmet, err := s.UnmetRequirements(ctx, device, *software, version)
+	if err != nil {
+		return nil, err
+	}
+	if len(unmet) > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrRequirements, strings.Join(unmet, ", "))
+	}
+
+	schema, values, err := s.ResolveEnv(ctx, device, software, version)
+	if err != nil {
+		return nil, err
+	}
+
+	resolved, err := s.resolver.ResolveEnv(ctx, device.FleetID, values)
+	if err != nil {
+		return nil, err
+	}
+
+	// Values from secret stores are only checked once resolved
+	if err := schema.Check(resolved); err != nil {
+		return nil, err
+	}
+
+	registries, err := s.resolver.RegistryAuth(ctx, device.FleetID)
+	if err != nil {
+		return nil, err
+	}
+
+	// The agent decides whether it applies to the installed version
+	migration, err := s.LoadMigration(ctx, *software, version)
+	if err != nil {
+		return nil, err
+	}
+
+	overrides, err := s.ComposeOverrides(ctx, device, software)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := s.LoadArtifacts(ctx, *software, version)
+	if err != nil {
+		return nil, err
+	}
+
+	// Older agents would silently ignore them
+	if migration != nil && !protocol.HasFeature(device.AgentFeatures, protocol.FeatureMigrations) {
+		return nil, fmt.Errorf("%w %s, update agent version %s", ErrAgentFeature, protocol.FeatureMigrations, device.AgentVersion)
+	}
+	if len(overrides) > 0 && !protocol.HasFeature(device.AgentFeatures, protocol.FeatureComposeOverrides) {
+		return nil, fmt.Errorf("%w %s, update agent version %s", ErrAgentFeature, protocol.FeatureComposeOverrides, device.AgentVersion)
+	}
+	if len(files) > 0 && !protocol.HasFeature(device.AgentFeatures, protocol.FeatureArtifacts) {
+		return nil, fmt.Errorf("%w %s, update agent version %s", ErrAgentFeature, protocol.FeatureArtifacts, device.AgentVersion)
+	}
+	limits := s.resourceLimits(ctx, device, software)
+	if limits != nil && !protocol.HasFeature(device.AgentFeatures, protocol.FeatureResourceLimits) {
+		return nil, fmt.Errorf("%w %s, update agent version %s", ErrAgentFeature, protocol.FeatureResourceLimits, device.AgentVersion)
+	}
+
+	// Devices at a site with a healthy cache pull through it
+	composeYAML := software.DockerComposeYAML
+	if mirrors := s.caches.DeviceMirrors(ctx, device); len(mirrors) > 0 {
+		composeYAML, err = compose.RewriteImages(composeYAML, mirrors)
+		if err != nil {
+			return nil, err
+		}
+		for i := range overrides {
+			if overrides[i], err = compose.RewriteImages(overrides[i], mirrors); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	payload := &protocol.DeployPayload{
+		Name:             software.Name,
+		SoftwareID:       software.ID,
+		Version:          version,
+		ComposeConfig:    composeYAML,
+		ComposeOverrides: overrides,
+		EnvVars:          resolved,
+		Registries:       registries,
+		PullRate:         s.pullRate(ctx, device),
+		Strategy:         software.Strategy,
+		Migration:        migration,
+		Artifacts:        files,
+		Limits:           limits,
+	}
+	if software.Strategy == protocol.StrategyBlueGreen {
+		options := software.BlueGreen
+		payload.BlueGreen = &options
+	}
+	return payload, nil
+}
+
+// checkPlatform fails if a software declares the platforms its images are
+// built for and the device runs none of them. Without declared platforms the
+// agent checks the images it pulls, which also covers multi-arch images
+// lacking the platform of the device.
+func (s *Service) checkPlatform(device *models.Device, software *models.Software) error {
+	if len(software.Platforms) == 0 {
+		return nil
+	}
+	if len(device.Platforms) == 0 {
+		s.logger.Warn(fmt.Sprintf("Device %s did not report its platform, deploying %s built for %s unchecked",
+			device.DeviceID, software.Name, strings.Join(software.Platforms, ", ")))
+		return nil
+	}
+	if !protocol.PlatformsRun(device.Platforms, software.Platforms) {
+		return fmt.Errorf("%w: %s is built for %s, device %s runs %s", ErrPlatform, software.Name,
+			strings.Join(software.Platforms, ", "), device.DeviceID, strings.Join(device.Platforms, ", "))
+	}
+	return nil
+}
+
+// pullRate returns the image pull rate limit of a device in kbit/s. Zero
+// leaves the agent's own default in effect and -1 lifts it.
+func (s *Service) pullRate(ctx context.Context, device *models.Device) int {
+	if device.PullRate != 0 || device.FleetID == nil {
+		return device.PullRate
+	}
+
+	var fleet models.Fleet
+	if err := s.database.GetDB().WithContext(ctx).Where("id = ?", *device.FleetID).First(&fleet).Error; err != nil {
+		return 0
+	}
+	return fleet.PullRate
+}
+
+// resourceLimits returns the resource limits of the application of a
+// software on a device, those of the device over those of its fleet. Nil
+// when neither sets any, leaving the agent's own limits in effect.
+func (s *Service) resourceLimits(ctx context.Context, device *models.Device, software *models.Software) *protocol.ResourceLimits {
+	var limits protocol.ResourceLimits
+	if device.FleetID != nil {
+		var fleet models.Fleet
+		if err := s.database.GetDB().WithContext(ctx).Where("id = ?", *device.FleetID).First(&fleet).Error; err == nil {
+			limits = fleet.Resources.For(software.Name)
+		}
+	}
+
+	limits = limits.Over(device.Resources.For(software.Name))
+	if limits == (protocol.ResourceLimits{}) {
+		return nil
+	}
+	return &limits
+}
+
+// DeployToDevice deploys a software version to a connected device and records
+// the deployment. The recorded env vars keep secret references unresolved.
+// Devices of a frozen fleet are only deployed to if ctx overrides the freeze.
+func (s *Service) DeployToDevice(ctx context.Context, device *models.Device, software *models.Software, version string) (_ *models.Deployment, err error) {
+	if version == "" {
+		version = software.CurrentVersion
+	}
+
+	ctx, span := tracing.Start(ctx, "deploy", trace.WithAttributes(
+		attribute.String("device.id", device.DeviceID),
+		attribute.String("software.name", software.Name),
+		attribute.String("software.version", version),
+	))
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
+	if err := s.checkFreeze(ctx, device.FleetID); err != nil {
+		return nil, err
+	}
+	if _, connected := s.sshServer.GetDeviceConnection(device.DeviceID); !connected {
+		return nil, ErrDeviceNotConnected
+	}
+
+	_, values, err := s.ResolveEnv(ctx, device, software, version)
+	if err != nil {
+		return nil, err
+	}
+	envJSON, _ := json.Marshal(values)
+
+	deployment := &models.Deployment{
+		SoftwareID: software.ID,
+		DeviceID:   device.ID,
+		Version:    version,
+		Status:     models.DeploymentStatusQueued,
+		EnvVars:    string(envJSON),
+	}
+	if device.FleetID != nil {
+		deployment.FleetID = *device.FleetID
+	}
+	if err := s.database.GetDB().WithContext(ctx).Create(deployment).Error; err != nil {
+		return nil, fmt.Errorf("failed to record deployment: %w", err)
+	}
+
+	return deployment, s.run(ctx, deployment, device, software)
+}
+
+// run waits for the registries of a deployment to have room, then sends it
+// and records the outcome
+func (s *Service) run(ctx context.Context, deployment *models.Deployment, device *models.Device, software *models.Software) error {
+	if s.extensions != nil {
+		if err := s.extensions.BeforeDeploy(ctx, extensionDeployment(deployment, device, software, nil)); err != nil {
+			s.finish(context.WithoutCancel(ctx), deployment, device, software, err)
+			return err
+		}
+	}
+
+	registries := compose.Registries(software.DockerComposeYAML)
+
+	deploysQueued.Inc()
+	release, err := s.registries.acquire(ctx, registries)
+	deploysQueued.Dec()
+	if err != nil {
+		s.finish(context.WithoutCancel(ctx), deployment, device, software, err)
+		return err
+	}
+	defer release()
+
+	deploysRunning.Inc()
+	defer deploysRunning.Dec()
+
+	deployment.Status = models.DeploymentStatusPending
+	if err := s.database.GetDB().WithContext(ctx).Model(deployment).Update("status", deployment.Status).Error; err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to update deployment %s", deployment.ID), err)
+	}
+
+	s.logger.Info(fmt.Sprintf("Deploying %s version %s to device %s", software.Name, deployment.Version, device.DeviceID))
+
+	err = s.send(ctx, deployment, device, software)
+	// The outcome is recorded even if the request was cancelled meanwhile
+	s.finish(context.WithoutCancel(ctx), deployment, device, software, err)
+	return err
+}
+
+// send builds the payload and sends the deploy command to the device. The
+// hashes of what it applies are kept on the deployment for its history.
+func (s *Service) send(ctx context.Context, deployment *models.Deployment, device *models.Device, software *models.Software) error {
+	payload, err := s.BuildPayload(ctx, device, software, deployment.Version)
+	if err != nil {
+		return err
+	}
+	deployment.ComposeHash = protocol.ComposeHash(payload.ComposeConfig, payload.ComposeOverrides)
+	deployment.EnvHash = protocol.EnvHash(payload.EnvVars)
+
+	command, err := protocol.NewCommandWithPayload(protocol.CmdDeploy, payload)
+	if err != nil {
+		return fmt.Errorf("failed to build deploy command: %w", err)
+	}
+
+	response, err := s.sshServer.SendCommand(ctx, device.DeviceID, command)
+	if err != nil {
+		return err
+	}
+	if !response.Success {
+		return fmt.Errorf("device reported failure: %s", response.Message)
+	}
+
+	return nil
+}
+
+// finish records the outcome of a deployment and publishes it
+func (s *Service) finish(ctx context.Context, deployment *models.Deployment, device *models.Device, software *models.Software, deployErr error) {
+	status, stage := models.DeploymentStatusDeployed, protocol.StageDone
+	eventType := events.DeploymentFinished
+	data := map[string]interface{}{
+		"deployment_id": deployment.ID.String(),
+		"software_id":   software.ID.String(),
+		"software_name": software.Name,
+		"version":       deployment.Version,
+	}
+
+	errMsg := ""
+	if deployErr != nil {
+		status, stage = models.DeploymentStatusFailed, protocol.StageFailed
+		eventType = events.DeploymentFailed
+		errMsg = deployErr.Error()
+		data["error"] = errMsg
+		s.logger.Error(fmt.Sprintf("Deployment of %s to device %s failed", software.Name, device.DeviceID), deployErr)
+	} else {
+		s.logger.Info(fmt.Sprintf("Deployed %s version %s to device %s", software.Name, deployment.Version, device.DeviceID))
+	}
+
+	// Agents that do not report stages get the final one here
+	now := time.Now()
+	deployment.Status, deployment.Stage, deployment.Progress = status, stage, protocol.StagePercent(stage, 0, 0)
+	deployment.Error, deployment.FinishedAt = errMsg, &now
+	if err := s.database.GetDB().WithContext(ctx).Model(deployment).Updates(map[string]interface{}{
+		"status":       status,
+		"stage":        stage,
+		"progress":     protocol.StagePercent(stage, 0, 0),
+		"error":        errMsg,
+		"compose_hash": deployment.ComposeHash,
+		"env_hash":     deployment.EnvHash,
+		"finished_at":  now,
+	}).Error; err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to update deployment %s", deployment.ID), err)
+	}
+	s.sshServer.ClearPullProgress(device.DeviceID)
+
+	if s.bus != nil {
+		s.bus.Publish(events.NewEvent(eventType, device.DeviceID, data))
+	}
+
+	if s.extensions != nil && s.extensions.HasDeployHooks() {
+		finished := extensionDeployment(deployment, device, software, deployErr)
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.extensions.AfterDeploy(s.ctx, finished)
+		}()
+	}
+}
+
+// extensionDeployment describes a deployment to the deploy hooks
+func extensionDeployment(deployment *models.Deployment, device *models.Device, software *models.Software, deployErr error) *extensions.Deployment {
+	result := &extensions.Deployment{
+		DeploymentID: deployment.ID.String(),
+		DeviceID:     device.DeviceID,
+		DeviceName:   device.Name,
+		SoftwareID:   software.ID.String(),
+		SoftwareName: software.Name,
+		Version:      deployment.Version,
+		Success:      deployErr == nil,
+	}
+	if device.FleetID != nil {
+		result.FleetID = device.FleetID.String()
+	}
+	if deployErr != nil {
+		result.Error = deployErr.Error()
+	}
+	return result
+}
+
+// AttachPullProgress fills in the image pull progress of pending deployments
+// from what their devices last reported
+func (s *Service) AttachPullProgress(ctx context.Context, deployments []models.Deployment) {
+	var deviceIDs, softwareIDs []uuid.UUID
+	for _, deployment := range deployments {
+		if deployment.Status == models.DeploymentStatusPending {
+			deviceIDs = append(deviceIDs, deployment.DeviceID)
+			softwareIDs = append(softwareIDs, deployment.SoftwareID)
+		}
+	}
+	if len(deviceIDs) == 0 {
+		return
+	}
+
+	var devices []models.Device
+	var software []models.Software
+	if err := s.database.GetDB().WithContext(ctx).Where("id IN ?", deviceIDs).Find(&devices).Error; err != nil {
+		s.logger.Error("Failed to load devices for pull progress", err)
+		return
+	}
+	if err := s.database.GetDB().WithContext(ctx).Where("id IN ?", softwareIDs).Find(&software).Error; err != nil {
+		s.logger.Error("Failed to load software for pull progress", err)
+		return
+	}
+
+	deviceNames := make(map[uuid.UUID]string, len(devices))
+	for _, device := range devices {
+		deviceNames[device.ID] = device.DeviceID
+	}
+	softwareNames := make(map[uuid.UUID]string, len(software))
+	for _, sw := range software {
+		softwareNames[sw.ID] = sw.Name
+	}
+
+	for i := range deployments {
+		deployment := &deployments[i]
+		if deployment.Status != models.DeploymentStatusPending {
+			continue
+		}
+
+		// Progress of another app, e.g. a site cache, is not this deployment's
+		progress := s.sshServer.PullProgress(deviceNames[deployment.DeviceID])
+		if progress != nil && progress.App == softwareNames[deployment.SoftwareID] && progress.Version == deployment.Version {
+			deployment.Pull = progress
+		}
+	}
+}
+
+// DecodeEnvVars decodes an env var JSON object, ignoring invalid data
+func DecodeEnvVars(data string) map[string]string {
+	values := make(map[string]string)
+	if data != "" {
+		json.Unmarshal([]byte(data), &values)
+	}
+	return values
+}
@@ -0,0 +1,168 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+// StageOnDevice hands a software version to a connected device, which fetches
+// its images and artifacts now and deploys it at applyAt whether it can reach
+// the server then or not, or when it is activated if applyAt is nil. The
+// staged update is recorded with the env vars keeping secret references
+// unresolved; the device reports how it went once connected.
+func (s *Service) StageOnDevice(ctx context.Context, device *models.Device, software *models.Software, version string, applyAt *time.Time, createdBy string) (*models.StagedUpdate, error) {
+	if version == "" {
+		version = software.CurrentVersion
+	}
+
+	if err := s.checkFreeze(ctx, device.FleetID); err != nil {
+		return nil, err
+	}
+	if _, connected := s.sshServer.GetDeviceConnection(device.DeviceID); !connected {
+		return nil, ErrDeviceNotConnected
+	}
+	if !protocol.HasFeature(device.AgentFeatures, protocol.FeatureStagedUpdates) {
+		return nil, fmt.Errorf("%w %s, update agent version %s", ErrAgentFeature, protocol.FeatureStagedUpdates, device.AgentVersion)
+	}
+	if applyAt == nil && !protocol.HasFeature(device.AgentFeatures, protocol.FeatureUpdateActivation) {
+		return nil, fmt.Errorf("%w %s, update agent version %s", ErrAgentFeature, protocol.FeatureUpdateActivation, device.AgentVersion)
+	}
+
+	_, values, err := s.ResolveEnv(ctx, device, software, version)
+	if err != nil {
+		return nil, err
+	}
+	envJSON, _ := json.Marshal(values)
+
+	payload, err := s.BuildPayload(ctx, device, software, version)
+	if err != nil {
+		return nil, err
+	}
+
+	update := &models.StagedUpdate{
+		DeviceID:    device.ID,
+		SoftwareID:  software.ID,
+		Version:     version,
+		ApplyAt:     applyAt,
+		Status:      models.StagedUpdateStatusStaging,
+		EnvVars:     string(envJSON),
+		ComposeHash: protocol.ComposeHash(payload.ComposeConfig, payload.ComposeOverrides),
+		EnvHash:     protocol.EnvHash(payload.EnvVars),
+		CreatedBy:   createdBy,
+	}
+	if err := s.database.GetDB().WithContext(ctx).Create(update).Error; err != nil {
+		return nil, fmt.Errorf("failed to record staged update: %w", err)
+	}
+
+	stage := protocol.StageUpdatePayload{ID: update.ID.String(), Deploy: *payload}
+	if applyAt != nil {
+		stage.ApplyAt = *applyAt
+	}
+	err = s.sendStaged(ctx, device, protocol.CmdStageUpdate, stage)
+	if err != nil {
+		update.Status, update.Error = models.StagedUpdateStatusFailed, err.Error()
+		if dbErr := s.database.GetDB().WithContext(context.WithoutCancel(ctx)).Model(update).
+			Select("status", "error").Updates(update).Error; dbErr != nil {
+			s.logger.Error(fmt.Sprintf("Failed to update staged update %s", update.ID), dbErr)
+		}
+		return update, err
+	}
+
+	if applyAt == nil {
+		s.logger.Info(fmt.Sprintf("Staged %s version %s on device %s until it is activated", software.Name, version, device.DeviceID))
+	} else {
+		s.logger.Info(fmt.Sprintf("Staged %s version %s on device %s for %s", software.Name, version, device.DeviceID, applyAt.Format(time.RFC3339)))
+	}
+	return update, nil
+}
+
+// ActivateStaged has a connected device deploy a staged update it fetched
+// now, e.g. in a maintenance window, instead of at its time. The outcome is
+// recorded like that of an update applied at its time, with a deployment.
+func (s *Service) ActivateStaged(ctx context.Context, update *models.StagedUpdate, device *models.Device, software *models.Software) error {
+	if err := s.checkFreeze(ctx, device.FleetID); err != nil {
+		return err
+	}
+	if _, connected := s.sshServer.GetDeviceConnection(device.DeviceID); !connected {
+		return ErrDeviceNotConnected
+	}
+	if !protocol.HasFeature(device.AgentFeatures, protocol.FeatureUpdateActivation) {
+		return fmt.Errorf("%w %s, update agent version %s", ErrAgentFeature, protocol.FeatureUpdateActivation, device.AgentVersion)
+	}
+
+	command, err := protocol.NewCommandWithPayload(protocol.CmdActivateUpdate, protocol.ActivateUpdatePayload{
+		ID:   update.ID.String(),
+		Name: software.Name,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to build %s command: %w", protocol.CmdActivateUpdate, err)
+	}
+
+	// Without a response the outcome is settled by the autonomy event of the
+	// agent once it is connected again
+	response, err := s.sshServer.SendCommand(ctx, device.DeviceID, command)
+	if err != nil {
+		return err
+	}
+	event := protocol.AutonomyEvent{
+		Kind:     protocol.AutonomyApplied,
+		App:      software.Name,
+		Version:  update.Version,
+		UpdateID: update.ID.String(),
+		Success:  response.Success,
+		Time:     time.Now(),
+	}
+	if !response.Success {
+		event.Error = response.Message
+	}
+	if err := s.sshServer.SettleStagedUpdate(device, event); err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to settle staged update %s", update.ID), err)
+	}
+	if !response.Success {
+		return fmt.Errorf("device reported failure: %s", response.Message)
+	}
+
+	s.logger.Info(fmt.Sprintf("Activated staged %s version %s on device %s", software.Name, update.Version, device.DeviceID))
+	return nil
+}
+
+// CancelStaged drops a staged update that was not applied yet from its
+// device, which must be connected, and marks it cancelled
+func (s *Service) CancelStaged(ctx context.Context, update *models.StagedUpdate, device *models.Device, software *models.Software) error {
+	if _, connected := s.sshServer.GetDeviceConnection(device.DeviceID); !connected {
+		return ErrDeviceNotConnected
+	}
+	err := s.sendStaged(ctx, device, protocol.CmdUnstageUpdate, protocol.UnstageUpdatePayload{
+		ID:   update.ID.String(),
+		Name: software.Name,
+	})
+	if err != nil {
+		return err
+	}
+
+	update.Status = models.StagedUpdateStatusCancelled
+	return s.database.GetDB().WithContext(ctx).Model(update).Update("status", update.Status).Error
+}
+
+// sendStaged sends a command about a staged update, failing if the agent
+// reported a failure
+func (s *Service) sendStaged(ctx context.Context, device *models.Device, cmdType string, payload interface{}) error {
+	command, err := protocol.NewCommandWithPayload(cmdType, payload)
+	if err != nil {
+		return fmt.Errorf("failed to build %s command: %w", cmdType, err)
+	}
+
+	response, err := s.sshServer.SendCommand(ctx, device.DeviceID, command)
+	if err != nil {
+		return err
+	}
+	if !response.Success {
+		return fmt.Errorf("device reported failure: %s", response.Message)
+	}
+	return nil
+}
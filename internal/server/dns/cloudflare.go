@@ -0,0 +1,130 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// cloudflareAPI is the base URL of the Cloudflare API
+const cloudflareAPI = "https://api.cloudflare.com/client/v4"
+
+// CloudflareSettings configure the Cloudflare provider
+type CloudflareSettings struct {
+	APIToken string // Needs the Zone.DNS edit permission
+	ZoneID   string
+}
+
+// cloudflare keeps records through the Cloudflare API
+type cloudflare struct {
+	settings CloudflareSettings
+	client   *http.Client
+}
+
+// cloudflareRecord is a DNS record in the Cloudflare API
+type cloudflareRecord struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl"`
+	Proxied bool   `json:"proxied"`
+}
+
+// cloudflareResponse wraps every Cloudflare API response
+type cloudflareResponse struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+	Result json.RawMessage `json:"result"`
+}
+
+func newCloudflare(settings CloudflareSettings) (*cloudflare, error) {
+	if settings.APIToken == "" || settings.ZoneID == "" {
+		return nil, fmt.Errorf("cloudflare needs an API token and a zone ID")
+	}
+	return &cloudflare{settings: settings, client: &http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+func (c *cloudflare) Upsert(ctx context.Context, record Record) error {
+	existing, err := c.find(ctx, record)
+	if err != nil {
+		return err
+	}
+
+	body := cloudflareRecord{Type: record.Type, Name: record.Name, Content: record.Value, TTL: record.TTL}
+	if len(existing) == 0 {
+		return c.do(ctx, http.MethodPost, "/dns_records", body, nil)
+	}
+	return c.do(ctx, http.MethodPut, "/dns_records/"+existing[0].ID, body, nil)
+}
+
+func (c *cloudflare) Delete(ctx context.Context, record Record) error {
+	existing, err := c.find(ctx, record)
+	if err != nil {
+		return err
+	}
+	for _, found := range existing {
+		if err := c.do(ctx, http.MethodDelete, "/dns_records/"+found.ID, nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// find returns the records of the zone with the name and type of record
+func (c *cloudflare) find(ctx context.Context, record Record) ([]cloudflareRecord, error) {
+	query := url.Values{"type": {record.Type}, "name": {record.Name}}
+	var found []cloudflareRecord
+	if err := c.do(ctx, http.MethodGet, "/dns_records?"+query.Encode(), nil, &found); err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+// do calls the API below the zone and decodes the result into result
+func (c *cloudflare) do(ctx context.Context, method, path string, body, result interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, cloudflareAPI+"/zones/"+c.settings.ZoneID+path, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.settings.APIToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var response cloudflareResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return fmt.Errorf("unexpected response with status %d: %w", resp.StatusCode, err)
+	}
+	if !response.Success {
+		messages := make([]string, 0, len(response.Errors))
+		for _, e := range response.Errors {
+			messages = append(messages, fmt.Sprintf("%d %s", e.Code, e.Message))
+		}
+		return fmt.Errorf("cloudflare: %s", strings.Join(messages, ", "))
+	}
+	if result != nil {
+		return json.Unmarshal(response.Result, result)
+	}
+	return nil
+}
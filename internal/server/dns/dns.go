@@ -0,0 +1,334 @@
+// Package dns keeps a DNS record for the subdomain of every device that has
+// one enabled, <subdomain>.<domain> pointing at the proxy, at a pluggable
+// provider, and removes it once the device is gone.
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/server/db"
+	"github.com/edgetainer/edgetainer/internal/server/metrics"
+	"github.com/edgetainer/edgetainer/internal/shared/logging"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm/clause"
+)
+
+// Providers that can be configured
+const (
+	ProviderCloudflare = "cloudflare"
+	ProviderRoute53    = "route53"
+	ProviderRFC2136    = "rfc2136"
+)
+
+// resyncInterval is how often records are compared with the devices even
+// without a change, which retries failed updates
+const resyncInterval = 10 * time.Minute
+
+var (
+	syncFailures = metrics.NewCounter("edgetainer_dns_sync_failures_total",
+		"DNS records that could not be created, updated or removed at the provider.")
+	managedRecords = metrics.NewGauge("edgetainer_dns_records",
+		"DNS records the server keeps for device subdomains.")
+)
+
+// subdomainPattern matches a single DNS label
+var subdomainPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// ValidSubdomain reports whether a subdomain is a single lowercase DNS label
+func ValidSubdomain(subdomain string) bool {
+	return subdomainPattern.MatchString(subdomain)
+}
+
+// Record is a DNS record at the provider
+type Record struct {
+	Name  string // Fully qualified, without the trailing dot
+	Type  string // A, AAAA or CNAME
+	Value string
+	TTL   int
+}
+
+// Provider creates and removes records at a DNS service
+type Provider interface {
+	// Upsert creates the record or replaces the value of an existing one
+	Upsert(ctx context.Context, record Record) error
+	// Delete removes the record, a missing one is no error
+	Delete(ctx context.Context, record Record) error
+}
+
+// Settings configure the records and the provider keeping them
+type Settings struct {
+	Provider   string // One of the Provider constants
+	Domain     string // Device records are created below it
+	Target     string // Host name for CNAME records, or the IP address of the proxy
+	TTL        int
+	Cloudflare CloudflareSettings
+	Route53    Route53Settings
+	RFC2136    RFC2136Settings
+}
+
+// Status describes the records kept and the last synchronization
+type Status struct {
+	Provider  string             `json:"provider"`
+	Domain    string             `json:"domain"`
+	Target    string             `json:"target"`
+	LastSync  *time.Time         `json:"last_sync,omitempty"`
+	LastError string             `json:"last_error,omitempty"`
+	Records   []models.DNSRecord `json:"records"`
+}
+
+// Manager keeps the records of the device subdomains in line with the
+// devices
+type Manager struct {
+	ctx        context.Context
+	cancelFunc context.CancelFunc
+	database   *db.DB
+	provider   Provider
+	settings   Settings
+	recordType string
+	trigger    chan struct{}
+	logger     *logging.Logger
+	wg         sync.WaitGroup
+
+	mu        sync.Mutex
+	lastSync  time.Time
+	lastError error
+}
+
+// NewManager creates a manager for the provider named in settings
+func NewManager(ctx context.Context, settings Settings, database *db.DB) (*Manager, error) {
+	var provider Provider
+	var err error
+	switch settings.Provider {
+	case ProviderCloudflare:
+		provider, err = newCloudflare(settings.Cloudflare)
+	case ProviderRoute53:
+		provider, err = newRoute53(settings.Route53)
+	case ProviderRFC2136:
+		provider, err = newRFC2136(settings.RFC2136)
+	default:
+		return nil, fmt.Errorf("unknown DNS provider %q", settings.Provider)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	settings.Domain = strings.TrimSuffix(strings.ToLower(settings.Domain), ".")
+	recordType := "CNAME"
+	if ip := net.ParseIP(settings.Target); ip != nil {
+		recordType = "AAAA"
+		if ip.To4() != nil {
+			recordType = "A"
+		}
+	} else {
+		settings.Target = strings.TrimSuffix(settings.Target, ".")
+	}
+
+	managerCtx, cancel := context.WithCancel(ctx)
+	return &Manager{
+		ctx:        managerCtx,
+		cancelFunc: cancel,
+		database:   database,
+		provider:   provider,
+		settings:   settings,
+		recordType: recordType,
+		trigger:    make(chan struct{}, 1),
+		logger:     logging.WithComponent("dns"),
+	}, nil
+}
+
+// Start synchronizes the records right away, on every Sync and periodically
+func (m *Manager) Start() {
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+
+		ticker := time.NewTicker(resyncInterval)
+		defer ticker.Stop()
+
+		for {
+			m.reconcile()
+
+			select {
+			case <-m.trigger:
+			case <-ticker.C:
+			case <-m.ctx.Done():
+				return
+			}
+		}
+	}()
+
+	m.logger.Info(fmt.Sprintf("Managing device records below %s with %s", m.settings.Domain, m.settings.Provider))
+}
+
+// Stop stops synchronizing and waits for a running synchronization
+func (m *Manager) Stop() {
+	m.cancelFunc()
+	m.wg.Wait()
+}
+
+// Sync asks for the records to be synchronized after devices changed. It
+// does not wait for it.
+func (m *Manager) Sync() {
+	select {
+	case m.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Status returns the records kept and the outcome of the last
+// synchronization
+func (m *Manager) Status() (*Status, error) {
+	status := &Status{Provider: m.settings.Provider, Domain: m.settings.Domain, Target: m.settings.Target}
+	if err := m.database.GetDB().Order("name").Find(&status.Records).Error; err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.lastSync.IsZero() {
+		lastSync := m.lastSync
+		status.LastSync = &lastSync
+	}
+	if m.lastError != nil {
+		status.LastError = m.lastError.Error()
+	}
+	return status, nil
+}
+
+// Name returns the record name of a subdomain
+func (m *Manager) Name(subdomain string) string {
+	return subdomain + "." + m.settings.Domain
+}
+
+// reconcile creates and updates the records of devices with an enabled
+// subdomain and removes the others
+func (m *Manager) reconcile() {
+	// Retired devices lose their record like deleted ones, for a subdomain
+	// used twice the older device keeps it
+	var devices []models.Device
+	err := m.database.GetDB().Select("id", "device_id", "subdomain").
+		Where("subdomain_enabled = ? AND subdomain <> ''", true).
+		Where("status NOT IN ?", []string{models.DeviceStatusDecommissioned, models.DeviceStatusReplaced, models.DeviceStatusRevoked}).
+		Order("created_at").Find(&devices).Error
+	if err != nil {
+		m.finish(fmt.Errorf("failed to load devices: %w", err))
+		return
+	}
+
+	var existing []models.DNSRecord
+	if err := m.database.GetDB().Find(&existing).Error; err != nil {
+		m.finish(fmt.Errorf("failed to load records: %w", err))
+		return
+	}
+	current := make(map[string]models.DNSRecord, len(existing))
+	for _, record := range existing {
+		current[record.Name] = record
+	}
+
+	var errs []error
+	wanted := make(map[string]bool, len(devices))
+	for _, device := range devices {
+		if !ValidSubdomain(device.Subdomain) {
+			m.logger.Warn(fmt.Sprintf("Skipping invalid subdomain %q of device %s", device.Subdomain, device.DeviceID))
+			continue
+		}
+		name := m.Name(device.Subdomain)
+		if wanted[name] {
+			m.logger.Warn(fmt.Sprintf("Subdomain %s of device %s is taken by another device", device.Subdomain, device.DeviceID))
+			continue
+		}
+		wanted[name] = true
+
+		if err := m.apply(name, device.ID, current); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for name, record := range current {
+		if wanted[name] {
+			continue
+		}
+		if err := m.remove(record); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	managedRecords.Set(float64(len(wanted)))
+	m.finish(errors.Join(errs...))
+}
+
+// apply creates or updates the record of a device
+func (m *Manager) apply(name string, deviceID uuid.UUID, current map[string]models.DNSRecord) error {
+	record := Record{Name: name, Type: m.recordType, Value: m.settings.Target, TTL: m.settings.TTL}
+
+	stored, exists := current[name]
+	if exists && stored.Type == record.Type && stored.Value == record.Value && stored.TTL == record.TTL {
+		// Unchanged, but it may have moved to a replacement device
+		if stored.DeviceID != deviceID {
+			return m.database.GetDB().Model(&stored).Update("device_id", deviceID).Error
+		}
+		return nil
+	}
+
+	// A CNAME cannot live next to other records of the same name
+	if exists && stored.Type != record.Type {
+		if err := m.provider.Delete(m.ctx, Record{Name: name, Type: stored.Type, Value: stored.Value, TTL: stored.TTL}); err != nil {
+			syncFailures.Inc()
+			return fmt.Errorf("failed to remove %s record of %s: %w", stored.Type, name, err)
+		}
+	}
+
+	if err := m.provider.Upsert(m.ctx, record); err != nil {
+		syncFailures.Inc()
+		return fmt.Errorf("failed to set %s: %w", name, err)
+	}
+
+	row := models.DNSRecord{Name: name, Type: record.Type, Value: record.Value, TTL: record.TTL, DeviceID: deviceID}
+	err := m.database.GetDB().Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "name"}},
+		DoUpdates: clause.AssignmentColumns([]string{"type", "value", "ttl", "device_id", "updated_at"}),
+	}).Create(&row).Error
+	if err != nil {
+		return fmt.Errorf("failed to store record %s: %w", name, err)
+	}
+
+	m.logger.Info(fmt.Sprintf("Set %s %s %s", name, record.Type, record.Value))
+	return nil
+}
+
+// remove deletes a record no device wants anymore
+func (m *Manager) remove(stored models.DNSRecord) error {
+	record := Record{Name: stored.Name, Type: stored.Type, Value: stored.Value, TTL: stored.TTL}
+	if err := m.provider.Delete(m.ctx, record); err != nil {
+		syncFailures.Inc()
+		return fmt.Errorf("failed to remove %s: %w", stored.Name, err)
+	}
+	if err := m.database.GetDB().Delete(&stored).Error; err != nil {
+		return fmt.Errorf("failed to forget record %s: %w", stored.Name, err)
+	}
+
+	m.logger.Info(fmt.Sprintf("Removed %s", stored.Name))
+	return nil
+}
+
+// finish records the outcome of a synchronization
+func (m *Manager) finish(err error) {
+	if err != nil && m.ctx.Err() == nil {
+		m.logger.Error("DNS synchronization failed", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lastSync = time.Now()
+	m.lastError = err
+}
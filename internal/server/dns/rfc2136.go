@@ -0,0 +1,256 @@
+package dns
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// DNS constants used by dynamic updates, see RFC 1035, 2136 and 8945
+const (
+	dnsOpcodeUpdate = 5
+	dnsClassIN      = 1
+	dnsClassANY     = 255
+	dnsTypeA        = 1
+	dnsTypeCNAME    = 5
+	dnsTypeSOA      = 6
+	dnsTypeAAAA     = 28
+	dnsTypeTSIG     = 250
+	tsigFudge       = 300
+)
+
+// dnsTypes maps the record types the server creates to their codes
+var dnsTypes = map[string]uint16{"A": dnsTypeA, "AAAA": dnsTypeAAAA, "CNAME": dnsTypeCNAME}
+
+// tsigAlgorithms maps the supported TSIG algorithms to their hashes
+var tsigAlgorithms = map[string]func() hash.Hash{
+	"hmac-sha256": sha256.New,
+	"hmac-sha512": sha512.New,
+}
+
+// RFC2136Settings configure dynamic updates of a name server
+type RFC2136Settings struct {
+	Server        string // host:port of the primary name server
+	Zone          string // Zone the device records are in
+	TSIGKey       string // Name of the TSIG key, empty for unsigned updates
+	TSIGSecret    string // Base64 encoded TSIG secret
+	TSIGAlgorithm string // hmac-sha256 or hmac-sha512
+}
+
+// rfc2136 keeps records with dynamic updates sent to the primary name
+// server of the zone over TCP
+type rfc2136 struct {
+	settings RFC2136Settings
+	secret   []byte
+	hash     func() hash.Hash
+}
+
+func newRFC2136(settings RFC2136Settings) (*rfc2136, error) {
+	if settings.Server == "" || settings.Zone == "" {
+		return nil, fmt.Errorf("rfc2136 needs a server and a zone")
+	}
+	if _, _, err := net.SplitHostPort(settings.Server); err != nil {
+		settings.Server = net.JoinHostPort(settings.Server, "53")
+	}
+	settings.Zone = strings.TrimSuffix(strings.ToLower(settings.Zone), ".")
+
+	p := &rfc2136{settings: settings}
+	if settings.TSIGKey != "" {
+		if settings.TSIGAlgorithm == "" {
+			settings.TSIGAlgorithm = "hmac-sha256"
+		}
+		p.hash = tsigAlgorithms[settings.TSIGAlgorithm]
+		if p.hash == nil {
+			return nil, fmt.Errorf("unsupported TSIG algorithm %q, must be hmac-sha256 or hmac-sha512", settings.TSIGAlgorithm)
+		}
+		secret, err := base64.StdEncoding.DecodeString(settings.TSIGSecret)
+		if err != nil {
+			return nil, fmt.Errorf("TSIG secret must be base64 encoded: %w", err)
+		}
+		p.secret = secret
+		p.settings.TSIGAlgorithm = settings.TSIGAlgorithm
+		p.settings.TSIGKey = strings.TrimSuffix(strings.ToLower(settings.TSIGKey), ".")
+	}
+	return p, nil
+}
+
+func (p *rfc2136) Upsert(ctx context.Context, record Record) error {
+	rdata, err := encodeRdata(record)
+	if err != nil {
+		return err
+	}
+
+	// Replace the whole record set: delete it, then add the record
+	var updates []byte
+	updates = appendRR(updates, record.Name, dnsTypes[record.Type], dnsClassANY, 0, nil)
+	updates = appendRR(updates, record.Name, dnsTypes[record.Type], dnsClassIN, uint32(record.TTL), rdata)
+	return p.update(ctx, updates, 2)
+}
+
+func (p *rfc2136) Delete(ctx context.Context, record Record) error {
+	if _, ok := dnsTypes[record.Type]; !ok {
+		return fmt.Errorf("unsupported record type %s", record.Type)
+	}
+	updates := appendRR(nil, record.Name, dnsTypes[record.Type], dnsClassANY, 0, nil)
+	return p.update(ctx, updates, 1)
+}
+
+// update sends an UPDATE message with the given update section and checks
+// the response code
+func (p *rfc2136) update(ctx context.Context, updates []byte, count uint16) error {
+	var idBytes [2]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		return err
+	}
+	id := binary.BigEndian.Uint16(idBytes[:])
+
+	// Header, with one zone and count updates
+	msg := binary.BigEndian.AppendUint16(nil, id)
+	msg = binary.BigEndian.AppendUint16(msg, dnsOpcodeUpdate<<11)
+	msg = binary.BigEndian.AppendUint16(msg, 1)
+	msg = binary.BigEndian.AppendUint16(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, count)
+	msg = binary.BigEndian.AppendUint16(msg, 0)
+
+	// Zone section
+	msg = appendName(msg, p.settings.Zone)
+	msg = binary.BigEndian.AppendUint16(msg, dnsTypeSOA)
+	msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+	msg = append(msg, updates...)
+
+	if p.secret != nil {
+		msg = p.sign(msg, id, time.Now())
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", p.settings.Server)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", p.settings.Server, err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(30 * time.Second))
+	}
+
+	// Messages over TCP are prefixed with their length
+	if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...)); err != nil {
+		return fmt.Errorf("failed to send update: %w", err)
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+	response := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if len(response) < 12 || binary.BigEndian.Uint16(response) != id {
+		return fmt.Errorf("malformed response")
+	}
+	if rcode := binary.BigEndian.Uint16(response[2:]) & 0x0f; rcode != 0 {
+		return fmt.Errorf("name server answered with %s", rcodeName(rcode))
+	}
+	return nil
+}
+
+// sign appends a TSIG record to a message, see RFC 8945
+func (p *rfc2136) sign(msg []byte, id uint16, now time.Time) []byte {
+	signed := uint64(now.Unix())
+	timeBytes := []byte{byte(signed >> 40), byte(signed >> 32), byte(signed >> 24), byte(signed >> 16), byte(signed >> 8), byte(signed)}
+
+	// The MAC covers the message and the TSIG variables
+	mac := hmac.New(p.hash, p.secret)
+	mac.Write(msg)
+	variables := appendName(nil, p.settings.TSIGKey)
+	variables = binary.BigEndian.AppendUint16(variables, dnsClassANY)
+	variables = binary.BigEndian.AppendUint32(variables, 0)
+	variables = appendName(variables, p.settings.TSIGAlgorithm)
+	variables = append(variables, timeBytes...)
+	variables = binary.BigEndian.AppendUint16(variables, tsigFudge)
+	variables = binary.BigEndian.AppendUint16(variables, 0) // Error
+	variables = binary.BigEndian.AppendUint16(variables, 0) // Other length
+	mac.Write(variables)
+	sum := mac.Sum(nil)
+
+	rdata := appendName(nil, p.settings.TSIGAlgorithm)
+	rdata = append(rdata, timeBytes...)
+	rdata = binary.BigEndian.AppendUint16(rdata, tsigFudge)
+	rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(sum)))
+	rdata = append(rdata, sum...)
+	rdata = binary.BigEndian.AppendUint16(rdata, id)
+	rdata = binary.BigEndian.AppendUint16(rdata, 0) // Error
+	rdata = binary.BigEndian.AppendUint16(rdata, 0) // Other length
+
+	msg = appendRR(msg, p.settings.TSIGKey, dnsTypeTSIG, dnsClassANY, 0, rdata)
+	binary.BigEndian.PutUint16(msg[10:], 1) // Additional count
+	return msg
+}
+
+// encodeRdata encodes the value of a record
+func encodeRdata(record Record) ([]byte, error) {
+	switch record.Type {
+	case "A":
+		ip := net.ParseIP(record.Value).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv4 address %q", record.Value)
+		}
+		return ip, nil
+	case "AAAA":
+		ip := net.ParseIP(record.Value).To16()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv6 address %q", record.Value)
+		}
+		return ip, nil
+	case "CNAME":
+		return appendName(nil, record.Value), nil
+	default:
+		return nil, fmt.Errorf("unsupported record type %s", record.Type)
+	}
+}
+
+// appendRR appends a resource record
+func appendRR(buf []byte, name string, rrType, class uint16, ttl uint32, rdata []byte) []byte {
+	buf = appendName(buf, name)
+	buf = binary.BigEndian.AppendUint16(buf, rrType)
+	buf = binary.BigEndian.AppendUint16(buf, class)
+	buf = binary.BigEndian.AppendUint32(buf, ttl)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(rdata)))
+	return append(buf, rdata...)
+}
+
+// appendName appends a domain name in wire format, without compression
+func appendName(buf []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		buf = append(buf, byte(len(label)))
+		buf = append(buf, label...)
+	}
+	return append(buf, 0)
+}
+
+// rcodeName names the response codes an update can fail with
+func rcodeName(rcode uint16) string {
+	names := map[uint16]string{
+		1: "FORMERR", 2: "SERVFAIL", 3: "NXDOMAIN", 4: "NOTIMP", 5: "REFUSED",
+		6: "YXDOMAIN", 7: "YXRRSET", 8: "NXRRSET", 9: "NOTAUTH", 10: "NOTZONE",
+	}
+	if name, ok := names[rcode]; ok {
+		return name
+	}
+	return fmt.Sprintf("rcode %d", rcode)
+}
@@ -0,0 +1,128 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/awsauth"
+)
+
+// Route 53 is a global service, requests are signed for us-east-1
+const (
+	route53Host   = "route53.amazonaws.com"
+	route53Region = "us-east-1"
+)
+
+// Route53Settings configure the Route 53 provider
+type Route53Settings struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string // Of temporary credentials
+	HostedZoneID    string
+}
+
+// route53 keeps records through the Route 53 API, signing requests with
+// AWS Signature Version 4
+type route53 struct {
+	settings Route53Settings
+	client   *http.Client
+}
+
+// route53Change is a ChangeResourceRecordSets request with a single change
+type route53Change struct {
+	XMLName xml.Name `xml:"https://route53.amazonaws.com/doc/2013-04-01/ ChangeResourceRecordSetsRequest"`
+	Action  string   `xml:"ChangeBatch>Changes>Change>Action"`
+	Name    string   `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>Name"`
+	Type    string   `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>Type"`
+	TTL     int      `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>TTL"`
+	Value   string   `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>ResourceRecords>ResourceRecord>Value"`
+}
+
+// route53Error is the error response of the Route 53 API
+type route53Error struct {
+	Code    string `xml:"Error>Code"`
+	Message string `xml:"Error>Message"`
+}
+
+// newRoute53 creates the provider. Credentials fall back to the standard AWS
+// environment variables of the server.
+func newRoute53(settings Route53Settings) (*route53, error) {
+	if settings.AccessKeyID == "" {
+		settings.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		settings.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		settings.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if settings.AccessKeyID == "" || settings.SecretAccessKey == "" || settings.HostedZoneID == "" {
+		return nil, fmt.Errorf("route53 needs an access key and a hosted zone ID")
+	}
+	settings.HostedZoneID = strings.TrimPrefix(settings.HostedZoneID, "/hostedzone/")
+	return &route53{settings: settings, client: &http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+func (r *route53) Upsert(ctx context.Context, record Record) error {
+	return r.change(ctx, "UPSERT", record)
+}
+
+func (r *route53) Delete(ctx context.Context, record Record) error {
+	err := r.change(ctx, "DELETE", record)
+	if err != nil && strings.Contains(err.Error(), "not found") {
+		return nil
+	}
+	return err
+}
+
+// change submits a change of a record set
+func (r *route53) change(ctx context.Context, action string, record Record) error {
+	value := record.Value
+	if record.Type == "CNAME" {
+		value += "."
+	}
+	body, err := xml.Marshal(route53Change{
+		Action: action,
+		Name:   record.Name + ".",
+		Type:   record.Type,
+		TTL:    record.TTL,
+		Value:  value,
+	})
+	if err != nil {
+		return err
+	}
+	body = append([]byte(xml.Header), body...)
+
+	path := "/2013-04-01/hostedzone/" + r.settings.HostedZoneID + "/rrset"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://"+route53Host+path, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/xml")
+	awsauth.Signer{
+		AccessKeyID:     r.settings.AccessKeyID,
+		SecretAccessKey: r.settings.SecretAccessKey,
+		SessionToken:    r.settings.SessionToken,
+		Region:          route53Region,
+		Service:         "route53",
+	}.Sign(req, awsauth.PayloadHash(body), time.Now())
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(resp.Body)
+		var apiErr route53Error
+		if xml.Unmarshal(data, &apiErr) == nil && apiErr.Code != "" {
+			return fmt.Errorf("route53: %s: %s", apiErr.Code, apiErr.Message)
+		}
+		return fmt.Errorf("route53: unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,302 @@
+package envschema
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/edgetainer/edgetainer/internal/server/secrets"
+)
+
+// Variable types
+const (
+	TypeString = "string"
+	TypeInt    = "int"
+	TypeBool   = "bool"
+	TypeURL    = "url"
+)
+
+// Types lists the supported variable types
+var Types = []string{TypeString, TypeInt, TypeBool, TypeURL}
+
+// Mask replaces secret values in API responses
+const Mask = "********"
+
+// namePattern matches valid environment variable names
+var namePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Variable describes one environment variable a software version accepts
+type Variable struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Required    bool   `json:"required"`
+	Default     string `json:"default,omitempty"`
+	Secret      bool   `json:"secret"`
+	Pattern     string `json:"pattern,omitempty"` // Regular expression the value must match
+	Description string `json:"description,omitempty"`
+}
+
+// Schema is the set of environment variables declared for a software version
+type Schema []Variable
+
+// FieldError describes a value that does not satisfy the schema
+type FieldError struct {
+	Name    string `json:"name"`
+	Message string `json:"message"`
+}
+
+// ValidationError collects all field errors of a validation run
+type ValidationError struct {
+	Fields []FieldError `json:"fields"`
+}
+
+// Error implements the error interface
+func (e *ValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Fields))
+	for _, f := range e.Fields {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", f.Name, f.Message))
+	}
+	return "invalid environment variables: " + strings.Join(msgs, "; ")
+}
+
+// Parse decodes a schema stored as JSON. An empty string is an empty schema.
+func Parse(data string) (Schema, error) {
+	if data == "" {
+		return Schema{}, nil
+	}
+
+	var schema Schema
+	if err := json.Unmarshal([]byte(data), &schema); err != nil {
+		return nil, fmt.Errorf("failed to parse env schema: %w", err)
+	}
+
+	return schema, nil
+}
+
+// Validate checks the schema itself for errors
+func (s Schema) Validate() error {
+	seen := make(map[string]bool)
+	for i, v := range s {
+		if !namePattern.MatchString(v.Name) {
+			return fmt.Errorf("variable %d: invalid name %q", i, v.Name)
+		}
+		if seen[v.Name] {
+			return fmt.Errorf("variable %s is declared twice", v.Name)
+		}
+		seen[v.Name] = true
+
+		if v.Type == "" {
+			s[i].Type = TypeString
+		} else if !isType(v.Type) {
+			return fmt.Errorf("variable %s: unknown type %q", v.Name, v.Type)
+		}
+
+		if v.Pattern != "" {
+			if _, err := regexp.Compile(v.Pattern); err != nil {
+				return fmt.Errorf("variable %s: invalid pattern: %w", v.Name, err)
+			}
+		}
+
+		if v.Default != "" && !hasTemplate(v.Default) {
+			if err := s[i].check(v.Default); err != nil {
+				return fmt.Errorf("variable %s: invalid default: %w", v.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Lookup returns the declaration of a variable
+func (s Schema) Lookup(name string) (Variable, bool) {
+	for _, v := range s {
+		if v.Name == name {
+			return v, true
+		}
+	}
+	return Variable{}, false
+}
+
+// CheckOverrides validates a partial set of values, such as a fleet or device
+// override. Unknown variables and invalid values are rejected; missing
+// required variables are not, since they may be set at another level.
+func (s Schema) CheckOverrides(values map[string]string) error {
+	var fields []FieldError
+
+	for _, name := range sortedKeys(values) {
+		v, ok := s.Lookup(name)
+		if !ok {
+			fields = append(fields, FieldError{Name: name, Message: "not declared in the schema"})
+			continue
+		}
+		if isDeferred(values[name]) {
+			continue
+		}
+		if err := v.check(values[name]); err != nil {
+			fields = append(fields, FieldError{Name: name, Message: err.Error()})
+		}
+	}
+
+	if len(fields) > 0 {
+		return &ValidationError{Fields: fields}
+	}
+	return nil
+}
+
+// Resolve merges the schema defaults with the given layers of overrides, in
+// increasing order of precedence, expands ${...} templates from vars and
+// checks the result. Variables not in the schema are passed through when the
+// schema is empty.
+func (s Schema) Resolve(vars map[string]string, layers ...map[string]string) (map[string]string, error) {
+	result := make(map[string]string)
+
+	for _, v := range s {
+		if v.Default != "" {
+			result[v.Name] = v.Default
+		}
+	}
+	for _, layer := range layers {
+		for name, value := range layer {
+			result[name] = value
+		}
+	}
+
+	for name, value := range result {
+		result[name] = Expand(value, vars)
+	}
+
+	if err := s.Check(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Check validates a complete set of values: required variables must be set,
+// every value must match its declaration and, unless the schema is empty, no
+// undeclared variables may be present. Secret references are only checked
+// once resolved.
+func (s Schema) Check(values map[string]string) error {
+	var fields []FieldError
+	for _, v := range s {
+		value, ok := values[v.Name]
+		if !ok || value == "" {
+			if v.Required {
+				fields = append(fields, FieldError{Name: v.Name, Message: "required"})
+			}
+			continue
+		}
+		if secrets.IsReference(value) {
+			continue
+		}
+		if err := v.check(value); err != nil {
+			fields = append(fields, FieldError{Name: v.Name, Message: err.Error()})
+		}
+	}
+
+	if len(s) > 0 {
+		for _, name := range sortedKeys(values) {
+			if _, ok := s.Lookup(name); !ok {
+				fields = append(fields, FieldError{Name: name, Message: "not declared in the schema"})
+			}
+		}
+	}
+
+	if len(fields) > 0 {
+		return &ValidationError{Fields: fields}
+	}
+	return nil
+}
+
+// MaskSecrets returns a copy of values with secret variables masked
+func (s Schema) MaskSecrets(values map[string]string) map[string]string {
+	masked := make(map[string]string, len(values))
+	for name, value := range values {
+		if v, ok := s.Lookup(name); ok && v.Secret && value != "" {
+			value = Mask
+		}
+		masked[name] = value
+	}
+	return masked
+}
+
+// Expand replaces ${name} references with values from vars, such as
+// ${device.name} or ${fleet.id}. Unknown references are left untouched.
+func Expand(value string, vars map[string]string) string {
+	if !hasTemplate(value) {
+		return value
+	}
+
+	return os.Expand(value, func(key string) string {
+		if v, ok := vars[key]; ok {
+			return v
+		}
+		return "${" + key + "}"
+	})
+}
+
+// check validates a single value against the variable declaration
+func (v Variable) check(value string) error {
+	switch v.Type {
+	case TypeInt:
+		if _, err := strconv.Atoi(value); err != nil {
+			return fmt.Errorf("must be an integer")
+		}
+	case TypeBool:
+		if _, err := strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("must be a boolean")
+		}
+	case TypeURL:
+		parsed, err := url.Parse(value)
+		if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			return fmt.Errorf("must be an absolute URL")
+		}
+	}
+
+	if v.Pattern != "" {
+		re, err := regexp.Compile(v.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern in schema: %w", err)
+		}
+		if !re.MatchString(value) {
+			return fmt.Errorf("does not match pattern %s", v.Pattern)
+		}
+	}
+
+	return nil
+}
+
+// isType reports whether t is a supported variable type
+func isType(t string) bool {
+	for _, known := range Types {
+		if known == t {
+			return true
+		}
+	}
+	return false
+}
+
+// hasTemplate reports whether value contains a ${...} reference
+func hasTemplate(value string) bool {
+	return strings.Contains(value, "${")
+}
+
+// isDeferred reports whether a value can only be checked later, after
+// templates are expanded or secret references are resolved
+func isDeferred(value string) bool {
+	return hasTemplate(value) || secrets.IsReference(value)
+}
+
+// sortedKeys returns the keys of m in a stable order
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,128 @@
+package events
+
+import (
+	"sync"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/logging"
+	"github.com/google/uuid"
+)
+
+// Event types published on the bus
+const (
+	DeviceOnline       = "device.online"
+	DeviceOffline      = "device.offline"
+	DeviceEnrolled     = "device.enrolled"
+	DeviceReplaced     = "device.replaced"
+	DeviceRevoked      = "device.revoked"
+	ForwardOpened      = "forward.opened"
+	ForwardClosed      = "forward.closed"
+	DeploymentProgress = "deployment.progress"
+	DeploymentFinished = "deployment.finished"
+	DeploymentFailed   = "deployment.failed"
+	RolloutFinished    = "rollout.finished"
+	ApprovalRequested  = "approval.requested"
+	ApprovalDecided    = "approval.decided"
+	AlertFiring        = "alert.firing"
+	USBAttached        = "usb.attached"
+	USBDetached        = "usb.detached"
+	JobFinished        = "job.finished"
+	JobFailed          = "job.failed"
+)
+
+// Types lists every event type that can be published
+var Types = []string{
+	DeviceOnline,
+	DeviceOffline,
+	DeviceEnrolled,
+	DeviceReplaced,
+	DeviceRevoked,
+	ForwardOpened,
+	ForwardClosed,
+	DeploymentProgress,
+	DeploymentFinished,
+	DeploymentFailed,
+	RolloutFinished,
+	ApprovalRequested,
+	ApprovalDecided,
+	AlertFiring,
+	USBAttached,
+	USBDetached,
+	JobFinished,
+	JobFailed,
+}
+
+// Event represents a lifecycle event inside the server
+type Event struct {
+	ID        string                 `json:"id"`
+	Type      string                 `json:"type"`
+	Timestamp time.Time              `json:"timestamp"`
+	DeviceID  string                 `json:"device_id,omitempty"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+}
+
+// NewEvent creates a new event with a unique ID
+func NewEvent(eventType, deviceID string, data map[string]interface{}) Event {
+	if data == nil {
+		data = make(map[string]interface{})
+	}
+
+	return Event{
+		ID:        uuid.New().String(),
+		Type:      eventType,
+		Timestamp: time.Now(),
+		DeviceID:  deviceID,
+		Data:      data,
+	}
+}
+
+// Bus fans out published events to all subscribers
+type Bus struct {
+	mu          sync.RWMutex
+	subscribers map[string]chan Event
+	logger      *logging.Logger
+}
+
+// NewBus creates a new event bus
+func NewBus() *Bus {
+	return &Bus{
+		subscribers: make(map[string]chan Event),
+		logger:      logging.WithComponent("event-bus"),
+	}
+}
+
+// Subscribe registers a named subscriber and returns its event channel
+func (b *Bus) Subscribe(name string, buffer int) <-chan Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan Event, buffer)
+	b.subscribers[name] = ch
+	return ch
+}
+
+// Unsubscribe removes a subscriber and closes its channel
+func (b *Bus) Unsubscribe(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ch, ok := b.subscribers[name]; ok {
+		close(ch)
+		delete(b.subscribers, name)
+	}
+}
+
+// Publish delivers an event to all subscribers without blocking
+func (b *Bus) Publish(evt Event) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for name, ch := range b.subscribers {
+		select {
+		case ch <- evt:
+		default:
+			// Subscriber is not keeping up, drop the event rather than block the publisher
+			b.logger.Warn("Dropping event %s for slow subscriber %s", evt.Type, name)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+// Package extensions lets downstream builds and external services customize
+// the server without changing the API handlers. Three points can be
+// extended: hooks run before and after every deployment, validators that
+// accept or reject device enrollments, and backends that check the
+// credentials of users logging in.
+//
+// Go code registers implementations on Default from an init function in a
+// file added to cmd/server, other systems are called through a webhook set
+// up in the server configuration. See docs/extensions.md.
+package extensions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/edgetainer/edgetainer/internal/server/metrics"
+)
+
+// ErrUnknownUser is returned by an auth backend for users it does not
+// handle, so the next backend or the built-in users are tried
+var ErrUnknownUser = errors.New("unknown user")
+
+// ErrRejected wraps the reason an extension rejected a deployment,
+// enrollment or login
+var ErrRejected = errors.New("rejected by extension")
+
+var extensionCalls = metrics.NewCounterVec("edgetainer_extension_calls_total",
+	"Server extensions called, by extension point and result.", "point", "result")
+
+// Deployment is what deploy hooks receive about a deployment. Error is only
+// set for a failed deployment after it finished.
+type Deployment struct {
+	DeploymentID string `json:"deployment_id"`
+	DeviceID     string `json:"device_id"`
+	DeviceName   string `json:"device_name,omitempty"`
+	FleetID      string `json:"fleet_id,omitempty"`
+	SoftwareID   string `json:"software_id"`
+	SoftwareName string `json:"software_name"`
+	Version      string `json:"version"`
+	Success      bool   `json:"success"`
+	Error        string `json:"error,omitempty"`
+}
+
+// Enrollment is what enrollment validators receive about a device being
+// provisioned
+type Enrollment struct {
+	DeviceID    string            `json:"device_id"`
+	Name        string            `json:"name"`
+	FleetID     string            `json:"fleet_id,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Description string            `json:"description,omitempty"`
+	RemoteAddr  string            `json:"remote_addr"`
+}
+
+// Identity is a user an auth backend accepted. Users are created on their
+// first login, and their email and role follow the backend afterwards.
+type Identity struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Role     string `json:"role"` // admin, operator or viewer
+}
+
+// DeployHook is called around every deployment to a device
+type DeployHook interface {
+	// BeforeDeploy runs before the deployment is sent to the device, an
+	// error fails the deployment with it as reason
+	BeforeDeploy(ctx context.Context, deployment *Deployment) error
+	// AfterDeploy runs once the deployment succeeded or failed, in the
+	// background
+	AfterDeploy(ctx context.Context, deployment *Deployment)
+}
+
+// EnrollmentValidator decides whether a device may be provisioned
+type EnrollmentValidator interface {
+	// ValidateEnrollment returns an error to reject the device, with the
+	// reason the client is told
+	ValidateEnrollment(ctx context.Context, enrollment *Enrollment) error
+}
+
+// AuthBackend checks the credentials of users logging in
+type AuthBackend interface {
+	// Authenticate returns the identity of a user whose password is valid,
+	// ErrUnknownUser for users it does not handle and any other error to
+	// refuse the login
+	Authenticate(ctx context.Context, username, password string) (*Identity, error)
+}
+
+// Default is the registry the server uses
+var Default = NewRegistry()
+
+// Registry holds the extensions in the order they were added and calls them
+// at their extension points
+type Registry struct {
+	mu           sync.RWMutex
+	deployHooks  []DeployHook
+	validators   []EnrollmentValidator
+	authBackends []AuthBackend
+}
+
+// NewRegistry creates a registry without extensions
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// AddDeployHook adds a hook run around every deployment
+func (r *Registry) AddDeployHook(hook DeployHook) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.deployHooks = append(r.deployHooks, hook)
+}
+
+// AddEnrollmentValidator adds a validator every enrollment must pass
+func (r *Registry) AddEnrollmentValidator(validator EnrollmentValidator) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.validators = append(r.validators, validator)
+}
+
+// AddAuthBackend adds a backend tried for logins, after the ones added
+// before it
+func (r *Registry) AddAuthBackend(backend AuthBackend) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.authBackends = append(r.authBackends, backend)
+}
+
+// HasAuthBackends reports whether logins are checked by a backend
+func (r *Registry) HasAuthBackends() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.authBackends) > 0
+}
+
+// BeforeDeploy runs the deploy hooks in order and stops at the first that
+// rejects the deployment
+func (r *Registry) BeforeDeploy(ctx context.Context, deployment *Deployment) error {
+	r.mu.RLock()
+	hooks := r.deployHooks
+	r.mu.RUnlock()
+
+	for _, hook := range hooks {
+		if err := hook.BeforeDeploy(ctx, deployment); err != nil {
+			extensionCalls.WithLabelValues("deploy.before", "rejected").Inc()
+			return fmt.Errorf("%w: %w", ErrRejected, err)
+		}
+		extensionCalls.WithLabelValues("deploy.before", "ok").Inc()
+	}
+	return nil
+}
+
+// AfterDeploy runs every deploy hook for a finished deployment
+func (r *Registry) AfterDeploy(ctx context.Context, deployment *Deployment) {
+	r.mu.RLock()
+	hooks := r.deployHooks
+	r.mu.RUnlock()
+
+	for _, hook := range hooks {
+		hook.AfterDeploy(ctx, deployment)
+		extensionCalls.WithLabelValues("deploy.after", "ok").Inc()
+	}
+}
+
+// HasDeployHooks reports whether deployments run through any hook
+func (r *Registry) HasDeployHooks() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.deployHooks) > 0
+}
+
+// ValidateEnrollment runs the validators in order and stops at the first
+// that rejects the device
+func (r *Registry) ValidateEnrollment(ctx context.Context, enrollment *Enrollment) error {
+	r.mu.RLock()
+	validators := r.validators
+	r.mu.RUnlock()
+
+	for _, validator := range validators {
+		if err := validator.ValidateEnrollment(ctx, enrollment); err != nil {
+			extensionCalls.WithLabelValues("enrollment", "rejected").Inc()
+			return fmt.Errorf("%w: %w", ErrRejected, err)
+		}
+		extensionCalls.WithLabelValues("enrollment", "ok").Inc()
+	}
+	return nil
+}
+
+// Authenticate asks the auth backends in order for the identity of a user.
+// It returns ErrUnknownUser if none of them handles the user.
+func (r *Registry) Authenticate(ctx context.Context, username, password string) (*Identity, error) {
+	r.mu.RLock()
+	backends := r.authBackends
+	r.mu.RUnlock()
+
+	for _, backend := range backends {
+		identity, err := backend.Authenticate(ctx, username, password)
+		if errors.Is(err, ErrUnknownUser) {
+			extensionCalls.WithLabelValues("auth", "unknown").Inc()
+			continue
+		}
+		if err != nil {
+			extensionCalls.WithLabelValues("auth", "rejected").Inc()
+			return nil, fmt.Errorf("%w: %w", ErrRejected, err)
+		}
+		if identity.Username == "" {
+			identity.Username = username
+		}
+		extensionCalls.WithLabelValues("auth", "ok").Inc()
+		return identity, nil
+	}
+	return nil, ErrUnknownUser
+}
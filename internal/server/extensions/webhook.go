@@ -0,0 +1,203 @@
+package extensions
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/server/webhook"
+	"github.com/edgetainer/edgetainer/internal/shared/logging"
+	"github.com/google/uuid"
+)
+
+// Extension points as sent in the event header and payload of webhook calls
+const (
+	PointBeforeDeploy = "deploy.before"
+	PointAfterDeploy  = "deploy.after"
+	PointEnrollment   = "enrollment"
+	PointAuth         = "auth"
+)
+
+// WebhookSettings configure the webhook extension
+type WebhookSettings struct {
+	URL        string        // Receives a POST for every extension point it handles
+	Secret     string        // Signs payloads like outbound webhooks, empty for none
+	Timeout    time.Duration // How long a call may take
+	Deploy     bool          // Call before and after deployments
+	Enrollment bool          // Call to validate enrollments
+	Auth       bool          // Call to check logins
+	FailOpen   bool          // Allow deployments and enrollments when the webhook cannot be reached
+}
+
+// webhookRequest is what the webhook receives
+type webhookRequest struct {
+	ID        string      `json:"id"`
+	Point     string      `json:"point"`
+	Timestamp time.Time   `json:"timestamp"`
+	Data      interface{} `json:"data"`
+}
+
+// webhookAnswer is what the webhook answers to the extension points that
+// decide something
+type webhookAnswer struct {
+	Allow  bool      `json:"allow"`
+	Reason string    `json:"reason"`
+	User   *Identity `json:"user,omitempty"` // Of auth calls that allow the login
+}
+
+// authData is the data of auth calls
+type authData struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Webhook calls an external service at the extension points it is set up
+// for. Calls are signed like the outbound webhooks so receivers can verify
+// both the same way.
+type Webhook struct {
+	settings WebhookSettings
+	client   *http.Client
+	logger   *logging.Logger
+}
+
+// NewWebhook creates the webhook extension
+func NewWebhook(settings WebhookSettings) *Webhook {
+	return &Webhook{
+		settings: settings,
+		client:   &http.Client{Timeout: settings.Timeout},
+		logger:   logging.WithComponent("extensions"),
+	}
+}
+
+// Register adds the webhook to a registry at the extension points it is set
+// up for
+func (h *Webhook) Register(registry *Registry) {
+	if h.settings.Deploy {
+		registry.AddDeployHook(h)
+	}
+	if h.settings.Enrollment {
+		registry.AddEnrollmentValidator(h)
+	}
+	if h.settings.Auth {
+		registry.AddAuthBackend(h)
+	}
+}
+
+// BeforeDeploy asks the webhook whether a deployment may go ahead
+func (h *Webhook) BeforeDeploy(ctx context.Context, deployment *Deployment) error {
+	return h.decide(ctx, PointBeforeDeploy, deployment)
+}
+
+// AfterDeploy tells the webhook how a deployment went, its answer is ignored
+func (h *Webhook) AfterDeploy(ctx context.Context, deployment *Deployment) {
+	if _, _, err := h.call(ctx, PointAfterDeploy, deployment); err != nil {
+		h.logger.Warn(fmt.Sprintf("Extension webhook failed for %s of deployment %s: %v", PointAfterDeploy, deployment.DeploymentID, err))
+	}
+}
+
+// ValidateEnrollment asks the webhook whether a device may be provisioned
+func (h *Webhook) ValidateEnrollment(ctx context.Context, enrollment *Enrollment) error {
+	return h.decide(ctx, PointEnrollment, enrollment)
+}
+
+// Authenticate asks the webhook to check the credentials of a user. A 404
+// answer means the webhook does not handle the user. Logins are refused
+// while the webhook cannot be reached, whatever FailOpen says.
+func (h *Webhook) Authenticate(ctx context.Context, username, password string) (*Identity, error) {
+	status, answer, err := h.call(ctx, PointAuth, authData{Username: username, Password: password})
+	if status == http.StatusNotFound {
+		return nil, ErrUnknownUser
+	}
+	if err != nil {
+		h.logger.Warn(fmt.Sprintf("Extension webhook failed for %s of user %s: %v", PointAuth, username, err))
+		return nil, errors.New("authentication service unavailable")
+	}
+	if !answer.Allow {
+		return nil, errors.New(reason(answer, "invalid credentials"))
+	}
+	if answer.User == nil {
+		answer.User = &Identity{}
+	}
+	return answer.User, nil
+}
+
+// decide calls the webhook for an extension point that can reject what it
+// is about
+func (h *Webhook) decide(ctx context.Context, point string, data interface{}) error {
+	_, answer, err := h.call(ctx, point, data)
+	if err != nil {
+		h.logger.Warn(fmt.Sprintf("Extension webhook failed for %s: %v", point, err))
+		if h.settings.FailOpen {
+			return nil
+		}
+		return fmt.Errorf("extension webhook failed: %w", err)
+	}
+	if !answer.Allow {
+		return errors.New(reason(answer, "not allowed"))
+	}
+	return nil
+}
+
+// call POSTs the data of an extension point and decodes the answer, if any.
+// Answers other than 2xx are errors.
+func (h *Webhook) call(ctx context.Context, point string, data interface{}) (int, *webhookAnswer, error) {
+	payload, err := json.Marshal(webhookRequest{
+		ID:        uuid.New().String(),
+		Point:     point,
+		Timestamp: time.Now().UTC(),
+		Data:      data,
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.settings.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Edgetainer-Extension")
+	req.Header.Set(webhook.HeaderEvent, point)
+	req.Header.Set(webhook.HeaderTimestamp, timestamp)
+	if h.settings.Secret != "" {
+		req.Header.Set(webhook.HeaderSignature, "sha256="+webhook.Sign(h.settings.Secret, timestamp, payload))
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return 0, nil, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	var answer webhookAnswer
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return resp.StatusCode, nil, fmt.Errorf("failed to read answer: %w", err)
+	}
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, &answer); err != nil {
+			return resp.StatusCode, nil, fmt.Errorf("invalid answer: %w", err)
+		}
+	}
+	return resp.StatusCode, &answer, nil
+}
+
+// reason returns the reason of an answer, or fallback if it gives none
+func reason(answer *webhookAnswer, fallback string) string {
+	if answer.Reason != "" {
+		return answer.Reason
+	}
+	return fallback
+}
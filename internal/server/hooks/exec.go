@@ -0,0 +1,58 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// execHook runs a script with the payload on stdin and the most used fields
+// in its environment
+type execHook struct {
+	command string
+}
+
+func (h *execHook) name() string {
+	return "exec"
+}
+
+func (h *execHook) run(ctx context.Context, payload *Payload, data []byte) error {
+	cmd := exec.CommandContext(ctx, h.command)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Env = append(os.Environ(), environment(payload)...)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// environment returns the variables a script gets about an event
+func environment(payload *Payload) []string {
+	ports := make([]string, 0, len(payload.Device.Forwards))
+	for _, forward := range payload.Device.Forwards {
+		ports = append(ports, strconv.Itoa(forward.Port))
+	}
+
+	env := []string{
+		"EDGETAINER_EVENT=" + payload.Event,
+		"EDGETAINER_EVENT_ID=" + payload.ID,
+		"EDGETAINER_DEVICE_ID=" + payload.Device.DeviceID,
+		"EDGETAINER_DEVICE_NAME=" + payload.Device.Name,
+		"EDGETAINER_FLEET_ID=" + payload.Device.FleetID,
+		"EDGETAINER_SUBDOMAIN=" + payload.Device.Subdomain,
+		"EDGETAINER_PORTS=" + strings.Join(ports, ","),
+	}
+	if addr, ok := payload.Data["remote_addr"].(string); ok {
+		env = append(env, "EDGETAINER_REMOTE_ADDR="+addr)
+	}
+	if port, ok := payload.Data["port"].(int); ok {
+		env = append(env, "EDGETAINER_PORT="+strconv.Itoa(port))
+	}
+	return env
+}
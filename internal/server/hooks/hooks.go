@@ -0,0 +1,224 @@
+// Package hooks tells external systems, e.g. firewalls, NAC or DNS, when
+// devices connect and disconnect and which tunnel ports they are given. An
+// event can run a script, call a webhook and publish to an MQTT broker.
+package hooks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/server/db"
+	"github.com/edgetainer/edgetainer/internal/server/events"
+	"github.com/edgetainer/edgetainer/internal/server/metrics"
+	"github.com/edgetainer/edgetainer/internal/server/ssh"
+	"github.com/edgetainer/edgetainer/internal/shared/logging"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+)
+
+// subscriber is the name the runner subscribes to the event bus under
+const subscriber = "hooks"
+
+// DefaultEvents are the events hooks run for unless configured otherwise
+var DefaultEvents = []string{
+	events.DeviceOnline,
+	events.DeviceOffline,
+	events.ForwardOpened,
+	events.ForwardClosed,
+}
+
+var hookRuns = metrics.NewCounterVec("edgetainer_hook_runs_total",
+	"Connection hooks run, by hook and result.", "hook", "result")
+
+// Settings configure the hooks, each one is disabled while its target is
+// empty
+type Settings struct {
+	Events        []string      // Event types that run the hooks
+	Timeout       time.Duration // How long a single hook may take
+	Command       string        // Script run for every event
+	WebhookURL    string        // URL the payload is POSTed to
+	WebhookSecret string        // Signs webhook payloads like outbound webhooks, empty for none
+	MQTT          MQTTSettings
+}
+
+// Payload is what hooks receive about an event
+type Payload struct {
+	ID        string                 `json:"id"`
+	Event     string                 `json:"event"`
+	Timestamp time.Time              `json:"timestamp"`
+	Device    Device                 `json:"device"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+}
+
+// Device is the metadata of the device an event is about
+type Device struct {
+	DeviceID     string            `json:"device_id"`
+	Name         string            `json:"name,omitempty"`
+	FleetID      string            `json:"fleet_id,omitempty"`
+	SiteID       string            `json:"site_id,omitempty"`
+	Subdomain    string            `json:"subdomain,omitempty"`
+	IPAddress    string            `json:"ip_address,omitempty"` // Reported by the agent, the address it connects from is in the data of device.online
+	CustomFields map[string]string `json:"custom_fields,omitempty"`
+	Forwards     []ssh.Forward     `json:"forwards"` // Tunnel ports open on the server, none once the device is offline
+}
+
+// hook delivers a payload to one target
+type hook interface {
+	name() string
+	run(ctx context.Context, payload *Payload, data []byte) error
+}
+
+// Runner runs the hooks for the connection events on the bus, one event
+// after the other so a disconnect never overtakes the connect before it
+type Runner struct {
+	ctx        context.Context
+	cancelFunc context.CancelFunc
+	database   *db.DB
+	bus        *events.Bus
+	sshServer  *ssh.Server
+	settings   Settings
+	hooks      []hook
+	logger     *logging.Logger
+	wg         sync.WaitGroup
+}
+
+// NewRunner creates a runner for the hooks configured in settings
+func NewRunner(ctx context.Context, settings Settings, database *db.DB, bus *events.Bus, sshServer *ssh.Server) (*Runner, error) {
+	if len(settings.Events) == 0 {
+		settings.Events = DefaultEvents
+	}
+	for _, eventType := range settings.Events {
+		if !slices.Contains(events.Types, eventType) {
+			return nil, fmt.Errorf("unknown event %q", eventType)
+		}
+	}
+
+	var hooks []hook
+	if settings.Command != "" {
+		hooks = append(hooks, &execHook{command: settings.Command})
+	}
+	if settings.WebhookURL != "" {
+		hooks = append(hooks, newWebhookHook(settings.WebhookURL, settings.WebhookSecret))
+	}
+	if settings.MQTT.Broker != "" {
+		mqtt, err := newMQTTHook(settings.MQTT)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, mqtt)
+	}
+
+	runnerCtx, cancel := context.WithCancel(ctx)
+	return &Runner{
+		ctx:        runnerCtx,
+		cancelFunc: cancel,
+		database:   database,
+		bus:        bus,
+		sshServer:  sshServer,
+		settings:   settings,
+		hooks:      hooks,
+		logger:     logging.WithComponent("hooks"),
+	}, nil
+}
+
+// Start subscribes to the event bus and begins running hooks. Without any
+// hook configured it does nothing.
+func (r *Runner) Start() {
+	if len(r.hooks) == 0 {
+		return
+	}
+	eventCh := r.bus.Subscribe(subscriber, 256)
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+
+		for {
+			select {
+			case evt, ok := <-eventCh:
+				if !ok {
+					return
+				}
+				if slices.Contains(r.settings.Events, evt.Type) {
+					r.run(evt)
+				}
+			case <-r.ctx.Done():
+				return
+			}
+		}
+	}()
+
+	r.logger.Info(fmt.Sprintf("Running %d connection hooks for %v", len(r.hooks), r.settings.Events))
+}
+
+// Stop stops running hooks and waits for the running ones to finish
+func (r *Runner) Stop() {
+	if len(r.hooks) == 0 {
+		return
+	}
+	r.cancelFunc()
+	r.bus.Unsubscribe(subscriber)
+	r.wg.Wait()
+}
+
+// run runs every hook for an event at once and waits for all of them
+func (r *Runner) run(evt events.Event) {
+	payload := &Payload{
+		ID:        evt.ID,
+		Event:     evt.Type,
+		Timestamp: evt.Timestamp,
+		Device:    r.device(evt.DeviceID),
+		Data:      evt.Data,
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		r.logger.Error(fmt.Sprintf("Failed to marshal event %s for hooks", evt.ID), err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, h := range r.hooks {
+		wg.Add(1)
+		go func(h hook) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(r.ctx, r.settings.Timeout)
+			defer cancel()
+
+			if err := h.run(ctx, payload, data); err != nil {
+				hookRuns.WithLabelValues(h.name(), "failed").Inc()
+				r.logger.Warn(fmt.Sprintf("Hook %s failed for %s of device %s: %v", h.name(), evt.Type, evt.DeviceID, err))
+				return
+			}
+			hookRuns.WithLabelValues(h.name(), "ok").Inc()
+			r.logger.Debug(fmt.Sprintf("Hook %s ran for %s of device %s", h.name(), evt.Type, evt.DeviceID))
+		}(h)
+	}
+	wg.Wait()
+}
+
+// device loads the metadata of a device, a device that is gone is described
+// by its ID alone
+func (r *Runner) device(deviceID string) Device {
+	info := Device{DeviceID: deviceID, Forwards: r.sshServer.Forwards(deviceID)}
+
+	var device models.Device
+	if err := r.database.GetDB().Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		return info
+	}
+
+	info.Name = device.Name
+	info.Subdomain = device.Subdomain
+	info.IPAddress = device.IPAddress
+	info.CustomFields = device.CustomFields
+	if device.FleetID != nil {
+		info.FleetID = device.FleetID.String()
+	}
+	if device.SiteID != nil {
+		info.SiteID = device.SiteID.String()
+	}
+	return info
+}
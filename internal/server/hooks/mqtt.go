@@ -0,0 +1,207 @@
+package hooks
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync/atomic"
+)
+
+// MQTT control packet types, see the MQTT 3.1.1 specification
+const (
+	mqttConnect    = 0x10
+	mqttConnack    = 0x20
+	mqttPublish    = 0x30
+	mqttPuback     = 0x40
+	mqttDisconnect = 0xe0
+)
+
+// mqttKeepalive is the keep alive announced to the broker in seconds. The
+// connection only lives for one publish, so it never comes into play.
+const mqttKeepalive = 30
+
+// MQTTSettings configure the MQTT hook
+type MQTTSettings struct {
+	Broker   string // tcp://host:1883 or tls://host:8883
+	Topic    string // {device_id} and {event} are replaced
+	ClientID string
+	Username string
+	Password string
+}
+
+// mqttHook publishes the payload to a broker with QoS 1. It connects for
+// every event, connection events are rare enough for that and nothing is
+// left to reconnect.
+type mqttHook struct {
+	settings MQTTSettings
+	addr     string
+	tls      *tls.Config // Nil for plain TCP
+	packetID atomic.Uint32
+}
+
+func newMQTTHook(settings MQTTSettings) (*mqttHook, error) {
+	broker, err := url.Parse(settings.Broker)
+	if err != nil || broker.Host == "" {
+		return nil, fmt.Errorf("invalid MQTT broker %q, must look like tcp://host:1883", settings.Broker)
+	}
+
+	h := &mqttHook{settings: settings, addr: broker.Host}
+	port := "1883"
+	switch broker.Scheme {
+	case "tcp", "mqtt":
+	case "tls", "ssl", "mqtts":
+		h.tls = &tls.Config{ServerName: broker.Hostname()}
+		port = "8883"
+	default:
+		return nil, fmt.Errorf("unsupported MQTT broker scheme %q, must be tcp or tls", broker.Scheme)
+	}
+	if broker.Port() == "" {
+		h.addr = net.JoinHostPort(broker.Hostname(), port)
+	}
+	if settings.Topic == "" || settings.ClientID == "" {
+		return nil, fmt.Errorf("MQTT topic and client ID are required")
+	}
+	return h, nil
+}
+
+func (h *mqttHook) name() string {
+	return "mqtt"
+}
+
+func (h *mqttHook) run(ctx context.Context, payload *Payload, data []byte) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", h.addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to broker: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if h.tls != nil {
+		tlsConn := tls.Client(conn, h.tls)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return fmt.Errorf("TLS handshake with broker failed: %w", err)
+		}
+		conn = tlsConn
+	}
+	reader := bufio.NewReader(conn)
+
+	if _, err := conn.Write(h.connectPacket()); err != nil {
+		return fmt.Errorf("failed to send CONNECT: %w", err)
+	}
+	packetType, body, err := readPacket(reader)
+	if err != nil {
+		return fmt.Errorf("failed to read CONNACK: %w", err)
+	}
+	if packetType != mqttConnack || len(body) != 2 {
+		return fmt.Errorf("broker answered CONNECT with packet type %#x", packetType)
+	}
+	if body[1] != 0 {
+		return fmt.Errorf("broker refused the connection with code %d", body[1])
+	}
+
+	id := uint16((h.packetID.Add(1)-1)%0xffff + 1) // Packet IDs run from 1 to 65535
+	topic := strings.NewReplacer("{device_id}", payload.Device.DeviceID, "{event}", payload.Event).Replace(h.settings.Topic)
+	if _, err := conn.Write(publishPacket(topic, id, data)); err != nil {
+		return fmt.Errorf("failed to send PUBLISH: %w", err)
+	}
+	packetType, body, err = readPacket(reader)
+	if err != nil {
+		return fmt.Errorf("failed to read PUBACK: %w", err)
+	}
+	if packetType != mqttPuback || len(body) != 2 || binary.BigEndian.Uint16(body) != id {
+		return fmt.Errorf("broker answered PUBLISH with packet type %#x", packetType)
+	}
+
+	conn.Write([]byte{mqttDisconnect, 0})
+	return nil
+}
+
+// connectPacket builds a CONNECT packet with a clean session
+func (h *mqttHook) connectPacket() []byte {
+	flags := byte(0x02)
+	payload := appendString(nil, h.settings.ClientID)
+	if h.settings.Username != "" {
+		flags |= 0x80
+		payload = appendString(payload, h.settings.Username)
+	}
+	if h.settings.Password != "" {
+		flags |= 0x40
+		payload = appendString(payload, h.settings.Password)
+	}
+
+	body := appendString(nil, "MQTT")
+	body = append(body, 4, flags) // Protocol level 4 is MQTT 3.1.1
+	body = binary.BigEndian.AppendUint16(body, mqttKeepalive)
+	body = append(body, payload...)
+	return packet(mqttConnect, body)
+}
+
+// publishPacket builds a QoS 1 PUBLISH packet
+func publishPacket(topic string, id uint16, data []byte) []byte {
+	body := appendString(nil, topic)
+	body = binary.BigEndian.AppendUint16(body, id)
+	body = append(body, data...)
+	return packet(mqttPublish|0x02, body)
+}
+
+// packet prefixes a packet body with its fixed header
+func packet(header byte, body []byte) []byte {
+	buf := []byte{header}
+	length := len(body)
+	for {
+		b := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			b |= 0x80
+		}
+		buf = append(buf, b)
+		if length == 0 {
+			break
+		}
+	}
+	return append(buf, body...)
+}
+
+// appendString appends a length prefixed UTF-8 string
+func appendString(buf []byte, s string) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(s)))
+	return append(buf, s...)
+}
+
+// readPacket reads a packet and returns its type and body
+func readPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, nil, fmt.Errorf("malformed remaining length")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(b&0x7f) * multiplier
+		multiplier *= 128
+		if b&0x80 == 0 {
+			break
+		}
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header & 0xf0, body, nil
+}
@@ -0,0 +1,57 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/server/webhook"
+)
+
+// webhookHook POSTs the payload to a URL, signed like the outbound webhooks
+// so receivers can verify both the same way. Unlike those it is not retried,
+// a late firewall rule is of little use.
+type webhookHook struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+func newWebhookHook(url, secret string) *webhookHook {
+	return &webhookHook{url: url, secret: secret, client: &http.Client{}}
+}
+
+func (h *webhookHook) name() string {
+	return "webhook"
+}
+
+func (h *webhookHook) run(ctx context.Context, payload *Payload, data []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Edgetainer-Hook")
+	req.Header.Set(webhook.HeaderEvent, payload.Event)
+	req.Header.Set(webhook.HeaderDelivery, payload.ID)
+	req.Header.Set(webhook.HeaderTimestamp, timestamp)
+	if h.secret != "" {
+		req.Header.Set(webhook.HeaderSignature, "sha256="+webhook.Sign(h.secret, timestamp, data))
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
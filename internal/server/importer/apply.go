@@ -0,0 +1,345 @@
+package importer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/server/auth"
+	"github.com/edgetainer/edgetainer/internal/server/db"
+	"github.com/edgetainer/edgetainer/internal/shared/config"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// errDryRun rolls back the transaction of a dry run
+var errDryRun = errors.New("dry run")
+
+// Options control how an export is applied
+type Options struct {
+	DryRun        bool   // Report what would be created without creating it
+	FleetDefaults bool   // Make the software of new fleets their default software
+	UniqueNames   string // Scope device names are unique in, see config.DeviceNamesFleet
+	KeyType       string // Of the device keys, see auth.GenerateKeyPair
+	KeyBits       int
+	SSHPort       int // Devices connect to
+	ImportedBy    string
+}
+
+// Result is what an import created, or would create in a dry run
+type Result struct {
+	ImportID uuid.UUID        `json:"import_id,omitempty"`
+	Source   string           `json:"source"`
+	DryRun   bool             `json:"dry_run"`
+	Fleets   []ResultFleet    `json:"fleets"`
+	Software []ResultSoftware `json:"software"`
+	Devices  []ResultDevice   `json:"devices"`
+	Warnings []string         `json:"warnings"`
+}
+
+// ResultFleet is a fleet of an import
+type ResultFleet struct {
+	ID      uuid.UUID `json:"id,omitempty"`
+	Name    string    `json:"name"`
+	Created bool      `json:"created"` // False if a fleet of the name existed
+}
+
+// ResultSoftware is a software of an import
+type ResultSoftware struct {
+	ID         uuid.UUID `json:"id,omitempty"`
+	Name       string    `json:"name"`
+	Version    string    `json:"version"`
+	Created    bool      `json:"created"` // False if a software of the name existed
+	Deployable bool      `json:"deployable"`
+}
+
+// ResultDevice is a device of an import
+type ResultDevice struct {
+	SourceID   string   `json:"source_id"`
+	SourceName string   `json:"source_name"`
+	DeviceID   string   `json:"device_id"`
+	Name       string   `json:"name"`
+	Fleet      string   `json:"fleet,omitempty"`
+	Software   []string `json:"software"` // Queued once the device connects
+}
+
+// Apply creates the fleets, software and devices of an export in one
+// transaction. Fleets and software are matched to existing ones by name.
+// Devices are created pending, each with a new key kept with the import for
+// its migration bundle, and get the deployable software they ran queued for
+// when they first connect.
+func Apply(ctx context.Context, database *db.DB, export *Export, opts Options) (*Result, error) {
+	result := &Result{
+		Source:   export.Source,
+		DryRun:   opts.DryRun,
+		Fleets:   []ResultFleet{},
+		Software: []ResultSoftware{},
+		Devices:  []ResultDevice{},
+		Warnings: append([]string{}, export.Warnings...),
+	}
+	warnf := func(format string, args ...interface{}) {
+		result.Warnings = append(result.Warnings, fmt.Sprintf(format, args...))
+	}
+
+	err := database.GetDB().WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		record := models.Import{Source: export.Source, ImportedBy: opts.ImportedBy}
+		if err := tx.Create(&record).Error; err != nil {
+			return fmt.Errorf("failed to record import: %w", err)
+		}
+
+		software := make(map[string]*models.Software)
+		deployable := make(map[string]bool)
+		for _, imported := range export.Software {
+			var existing models.Software
+			err := tx.Where("LOWER(name) = LOWER(?)", imported.Name).First(&existing).Error
+			switch {
+			case err == nil:
+				warnf("Software %s exists, the imported devices get it instead of the imported compose file", existing.Name)
+				software[imported.Key] = &existing
+				deployable[imported.Key] = existing.CurrentVersion != ""
+				result.Software = append(result.Software, ResultSoftware{
+					ID: existing.ID, Name: existing.Name, Version: existing.CurrentVersion, Deployable: deployable[imported.Key],
+				})
+				continue
+			case !errors.Is(err, gorm.ErrRecordNotFound):
+				return fmt.Errorf("failed to fetch software %s: %w", imported.Name, err)
+			}
+
+			versions, _ := json.Marshal([]map[string]string{{"version": imported.Version}})
+			created := &models.Software{
+				Name:              imported.Name,
+				Source:            models.SoftwareSourceManual,
+				CurrentVersion:    imported.Version,
+				Versions:          string(versions),
+				DockerComposeYAML: imported.ComposeYAML,
+				DefaultEnvVars:    "{}",
+			}
+			if err := tx.Create(created).Error; err != nil {
+				return fmt.Errorf("failed to create software %s: %w", imported.Name, err)
+			}
+			software[imported.Key] = created
+			deployable[imported.Key] = imported.Deployable
+			record.Software++
+			result.Software = append(result.Software, ResultSoftware{
+				ID: created.ID, Name: created.Name, Version: created.CurrentVersion, Created: true, Deployable: imported.Deployable,
+			})
+		}
+
+		fleets := make(map[string]*models.Fleet)
+		for _, imported := range export.Fleets {
+			var fleet models.Fleet
+			created := false
+			err := tx.Where("LOWER(name) = LOWER(?)", imported.Name).First(&fleet).Error
+			switch {
+			case err == nil:
+				warnf("Fleet %s exists, the imported devices join it", fleet.Name)
+			case errors.Is(err, gorm.ErrRecordNotFound):
+				fleet = models.Fleet{Name: imported.Name, Description: imported.Description}
+				if err := tx.Create(&fleet).Error; err != nil {
+					return fmt.Errorf("failed to create fleet %s: %w", imported.Name, err)
+				}
+				created = true
+				record.Fleets++
+			default:
+				return fmt.Errorf("failed to fetch fleet %s: %w", imported.Name, err)
+			}
+			fleets[imported.Key] = &fleet
+			result.Fleets = append(result.Fleets, ResultFleet{ID: fleet.ID, Name: fleet.Name, Created: created})
+
+			fleetSoftware := software[imported.Software]
+			if fleetSoftware == nil {
+				continue
+			}
+			if len(imported.EnvVars) > 0 {
+				encoded, _ := json.Marshal(imported.EnvVars)
+				envVars := models.FleetEnvVars{
+					FleetID:       fleet.ID,
+					SoftwareID:    fleetSoftware.ID,
+					ContainerName: fleetSoftware.Name,
+					EnvVars:       string(encoded),
+				}
+				if err := tx.Create(&envVars).Error; err != nil {
+					return fmt.Errorf("failed to create env vars of fleet %s: %w", fleet.Name, err)
+				}
+			}
+			if created && opts.FleetDefaults && deployable[imported.Software] {
+				entry := models.FleetDefaultSoftware{FleetID: fleet.ID, SoftwareID: fleetSoftware.ID}
+				if err := tx.Create(&entry).Error; err != nil {
+					return fmt.Errorf("failed to set default software of fleet %s: %w", fleet.Name, err)
+				}
+			}
+		}
+
+		for _, imported := range export.Devices {
+			var fleetID *uuid.UUID
+			fleetName := ""
+			if fleet := fleets[imported.Fleet]; fleet != nil {
+				fleetID = &fleet.ID
+				fleetName = fleet.Name
+			}
+
+			name, err := uniqueName(tx, opts.UniqueNames, fleetID, imported.Name)
+			if err != nil {
+				return err
+			}
+			if name != imported.Name {
+				warnf("Device %s is imported as %s, the name is taken", imported.Name, name)
+			}
+
+			deviceID, err := db.NewDeviceID(tx, fleetID)
+			if err != nil {
+				return err
+			}
+
+			// Dry runs skip the keys, they take long to generate for RSA
+			publicKey, privateKey := "", ""
+			if !opts.DryRun {
+				keyPair, err := auth.GenerateKeyPair(deviceID, opts.KeyType, opts.KeyBits)
+				if err != nil {
+					return fmt.Errorf("failed to generate key pair: %w", err)
+				}
+				publicKey, privateKey = string(keyPair.PublicKey), string(keyPair.PrivateKey)
+			}
+
+			device := models.Device{
+				DeviceID:     deviceID,
+				Name:         name,
+				FleetID:      fleetID,
+				Status:       models.DeviceStatusPending,
+				LastSeen:     time.Now(),
+				SSHPublicKey: publicKey,
+				SSHPort:      opts.SSHPort,
+				HardwareInfo: "{}",
+			}
+			if err := tx.Create(&device).Error; err != nil {
+				return fmt.Errorf("failed to create device %s: %w", name, err)
+			}
+			link := models.ImportedDevice{
+				ImportID:      record.ID,
+				DeviceID:      device.ID,
+				SourceID:      imported.Key,
+				SourceName:    imported.Name,
+				SSHPrivateKey: privateKey,
+			}
+			if err := tx.Create(&link).Error; err != nil {
+				return fmt.Errorf("failed to link device %s: %w", name, err)
+			}
+
+			queued := []string{}
+			for _, key := range imported.Software {
+				deviceSoftware := software[key]
+				if deviceSoftware == nil {
+					continue
+				}
+				if envVars := imported.EnvVars[key]; len(envVars) > 0 {
+					encoded, _ := json.Marshal(envVars)
+					deviceEnv := models.DeviceEnvVars{
+						DeviceID:      device.ID,
+						SoftwareID:    deviceSoftware.ID,
+						ContainerName: deviceSoftware.Name,
+						EnvVars:       string(encoded),
+					}
+					if err := tx.Create(&deviceEnv).Error; err != nil {
+						return fmt.Errorf("failed to create env vars of device %s: %w", name, err)
+					}
+				}
+				if !deployable[key] {
+					continue
+				}
+
+				// The env is resolved when the deployment is sent
+				deployment := models.Deployment{
+					SoftwareID: deviceSoftware.ID,
+					DeviceID:   device.ID,
+					Version:    deviceSoftware.CurrentVersion,
+					Status:     models.DeploymentStatusQueued,
+					EnvVars:    "{}",
+					Imported:   true,
+				}
+				if fleetID != nil {
+					deployment.FleetID = *fleetID
+				}
+				if err := tx.Create(&deployment).Error; err != nil {
+					return fmt.Errorf("failed to queue %s for device %s: %w", deviceSoftware.Name, name, err)
+				}
+				queued = append(queued, deviceSoftware.Name)
+			}
+
+			record.Devices++
+			result.Devices = append(result.Devices, ResultDevice{
+				SourceID:   imported.Key,
+				SourceName: imported.Name,
+				DeviceID:   deviceID,
+				Name:       name,
+				Fleet:      fleetName,
+				Software:   queued,
+			})
+		}
+
+		record.Warnings = result.Warnings
+		if err := tx.Save(&record).Error; err != nil {
+			return fmt.Errorf("failed to record import: %w", err)
+		}
+		result.ImportID = record.ID
+
+		if opts.DryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errDryRun) {
+		return nil, err
+	}
+
+	// Nothing of a dry run exists, so it has no IDs
+	if opts.DryRun {
+		result.ImportID = uuid.Nil
+		for i := range result.Fleets {
+			if result.Fleets[i].Created {
+				result.Fleets[i].ID = uuid.Nil
+			}
+		}
+		for i := range result.Software {
+			if result.Software[i].Created {
+				result.Software[i].ID = uuid.Nil
+			}
+		}
+	}
+	return result, nil
+}
+
+// uniqueName returns the name with the lowest suffix, -2, -3 and so on, that
+// no device in the scope of the name policy has, ignoring case
+func uniqueName(tx *gorm.DB, scope string, fleetID *uuid.UUID, name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if scope == config.DeviceNamesOff {
+		return name, nil
+	}
+
+	candidate := name
+	for suffix := 2; ; suffix++ {
+		query := tx.Model(&models.Device{}).
+			Where("LOWER(name) = LOWER(?)", candidate).
+			Where("status NOT IN ?", []string{models.DeviceStatusReplaced, models.DeviceStatusDecommissioned})
+		if scope != config.DeviceNamesGlobal {
+			if fleetID != nil {
+				query = query.Where("fleet_id = ?", *fleetID)
+			} else {
+				query = query.Where("fleet_id IS NULL")
+			}
+		}
+
+		var count int64
+		if err := query.Count(&count).Error; err != nil {
+			return "", fmt.Errorf("failed to check device name: %w", err)
+		}
+		if count == 0 {
+			return candidate, nil
+		}
+		candidate = fmt.Sprintf("%s-%d", name, suffix)
+	}
+}
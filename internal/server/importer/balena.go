@@ -0,0 +1,247 @@
+package importer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// balenaRef is a reference to another resource in a balena API response:
+// an ID, {"__id": ID} when not expanded or [{"id": ID, ...}] when expanded
+type balenaRef int64
+
+// UnmarshalJSON accepts every form of reference, null for none
+func (r *balenaRef) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	switch {
+	case bytes.Equal(data, []byte("null")):
+		*r = 0
+		return nil
+	case len(data) > 0 && data[0] == '[':
+		var expanded []balenaRef
+		if err := json.Unmarshal(data, &expanded); err != nil {
+			return err
+		}
+		*r = 0
+		if len(expanded) > 0 {
+			*r = expanded[0]
+		}
+		return nil
+	case len(data) > 0 && data[0] == '{':
+		var object struct {
+			ID         *int64 `json:"id"`
+			DeferredID *int64 `json:"__id"`
+		}
+		if err := json.Unmarshal(data, &object); err != nil {
+			return err
+		}
+		switch {
+		case object.ID != nil:
+			*r = balenaRef(*object.ID)
+		case object.DeferredID != nil:
+			*r = balenaRef(*object.DeferredID)
+		default:
+			*r = 0
+		}
+		return nil
+	default:
+		var id int64
+		if err := json.Unmarshal(data, &id); err != nil {
+			return fmt.Errorf("invalid reference %s", data)
+		}
+		*r = balenaRef(id)
+		return nil
+	}
+}
+
+// balenaExport holds the resources of the balena API an import reads, as
+// returned by GET /v6/<resource>
+type balenaExport struct {
+	Applications []struct {
+		ID            int64     `json:"id"`
+		AppName       string    `json:"app_name"`
+		Slug          string    `json:"slug"`
+		TargetRelease balenaRef `json:"should_be_running__release"`
+	} `json:"application"`
+	Releases []struct {
+		ID          int64           `json:"id"`
+		Application balenaRef       `json:"belongs_to__application"`
+		Commit      string          `json:"commit"`
+		RawVersion  string          `json:"raw_version"`
+		Semver      string          `json:"semver"`
+		Status      string          `json:"status"`
+		Composition json.RawMessage `json:"composition"`
+	} `json:"release"`
+	Devices []struct {
+		ID          int64     `json:"id"`
+		UUID        string    `json:"uuid"`
+		DeviceName  string    `json:"device_name"`
+		Application balenaRef `json:"belongs_to__application"`
+		Release     balenaRef `json:"is_running__release"`
+	} `json:"device"`
+	ApplicationEnv []struct {
+		Application balenaRef `json:"application"`
+		Name        string    `json:"name"`
+		Value       string    `json:"value"`
+	} `json:"application_environment_variable"`
+	DeviceEnv []struct {
+		Device balenaRef `json:"device"`
+		Name   string    `json:"name"`
+		Value  string    `json:"value"`
+	} `json:"device_environment_variable"`
+}
+
+// parseBalena parses a balenaCloud export. Every fleet gets the software of
+// the release it should run, or its last successful one.
+func parseBalena(data []byte) (*Export, error) {
+	var source balenaExport
+	if err := json.Unmarshal(data, &source); err != nil {
+		return nil, fmt.Errorf("invalid balena export: %w", err)
+	}
+	if len(source.Applications) == 0 && len(source.Devices) == 0 {
+		return nil, fmt.Errorf("invalid balena export: no application or device")
+	}
+
+	export := &Export{Source: SourceBalena}
+
+	// The release of every fleet, the target one or the last successful one
+	releases := make(map[balenaRef]int)
+	for i, release := range source.Releases {
+		if release.Status != "" && release.Status != "success" {
+			continue
+		}
+		if current, ok := releases[release.Application]; !ok || source.Releases[current].ID < release.ID {
+			releases[release.Application] = i
+		}
+	}
+	for i, release := range source.Releases {
+		for _, application := range source.Applications {
+			if application.TargetRelease == balenaRef(release.ID) {
+				releases[balenaRef(application.ID)] = i
+			}
+		}
+	}
+
+	fleetKeys := make(map[balenaRef]string)
+	for _, application := range source.Applications {
+		key := strconv.FormatInt(application.ID, 10)
+		fleetKeys[balenaRef(application.ID)] = key
+		fleet := Fleet{
+			Key:         key,
+			Name:        application.AppName,
+			Description: "Imported from balenaCloud fleet " + application.Slug,
+			EnvVars:     map[string]string{},
+		}
+
+		if i, ok := releases[balenaRef(application.ID)]; ok {
+			release := source.Releases[i]
+			software, err := balenaSoftware(export, application.AppName, release.Commit, release.RawVersion, release.Semver, release.Composition)
+			if err != nil {
+				export.warnf("Fleet %s: release %s is not imported: %v", application.AppName, release.Commit, err)
+			} else {
+				software.Key = "release-" + strconv.FormatInt(release.ID, 10)
+				export.Software = append(export.Software, *software)
+				fleet.Software = software.Key
+			}
+		} else {
+			export.warnf("Fleet %s has no successful release, it is imported without software", application.AppName)
+		}
+
+		export.Fleets = append(export.Fleets, fleet)
+	}
+
+	for _, variable := range source.ApplicationEnv {
+		for i := range export.Fleets {
+			if export.Fleets[i].Key == fleetKeys[variable.Application] {
+				export.Fleets[i].EnvVars[variable.Name] = variable.Value
+			}
+		}
+	}
+
+	deviceIndex := make(map[balenaRef]int)
+	for _, device := range source.Devices {
+		name := device.DeviceName
+		if name == "" && len(device.UUID) >= 7 {
+			name = device.UUID[:7]
+		}
+		imported := Device{
+			Key:     device.UUID,
+			Name:    name,
+			Fleet:   fleetKeys[device.Application],
+			EnvVars: map[string]map[string]string{},
+		}
+		if imported.Key == "" {
+			imported.Key = strconv.FormatInt(device.ID, 10)
+		}
+		if device.Application != 0 && imported.Fleet == "" {
+			export.warnf("Device %s belongs to fleet %d, which is not in the export", name, device.Application)
+		}
+		for _, fleet := range export.Fleets {
+			if fleet.Key == imported.Fleet && fleet.Software != "" {
+				imported.Software = []string{fleet.Software}
+				if device.Release != 0 && "release-"+strconv.FormatInt(int64(device.Release), 10) != fleet.Software {
+					export.warnf("Device %s ran another release than its fleet, it gets that of the fleet", name)
+				}
+			}
+		}
+		deviceIndex[balenaRef(device.ID)] = len(export.Devices)
+		export.Devices = append(export.Devices, imported)
+	}
+
+	for _, variable := range source.DeviceEnv {
+		i, ok := deviceIndex[variable.Device]
+		if !ok {
+			continue
+		}
+		device := &export.Devices[i]
+		if len(device.Software) == 0 {
+			export.warnf("Device %s: env var %s is not imported, the device has no software", device.Name, variable.Name)
+			continue
+		}
+		software := device.Software[0]
+		if device.EnvVars[software] == nil {
+			device.EnvVars[software] = map[string]string{}
+		}
+		device.EnvVars[software][variable.Name] = variable.Value
+	}
+
+	return export, nil
+}
+
+// balenaSoftware turns a release into software, with its composition as
+// the compose file
+func balenaSoftware(export *Export, name, commit, rawVersion, semver string, composition json.RawMessage) (*Software, error) {
+	var compose interface{}
+	if len(composition) == 0 || bytes.Equal(bytes.TrimSpace(composition), []byte("null")) {
+		return nil, fmt.Errorf("it has no composition")
+	}
+	if err := json.Unmarshal(composition, &compose); err != nil {
+		return nil, fmt.Errorf("invalid composition: %w", err)
+	}
+	composeYAML, err := yaml.Marshal(compose)
+	if err != nil {
+		return nil, fmt.Errorf("invalid composition: %w", err)
+	}
+
+	version := rawVersion
+	if version == "" {
+		version = semver
+	}
+	if version == "" || version == "0.0.0" {
+		version = commit
+		if len(version) > 7 {
+			version = version[:7]
+		}
+	}
+
+	software := &Software{
+		Name:        name,
+		Version:     version,
+		ComposeYAML: string(composeYAML),
+	}
+	software.Deployable = export.checkCompose(name, software.ComposeYAML)
+	return software, nil
+}
@@ -0,0 +1,117 @@
+// Package importer creates fleets, software and devices from the exports of
+// other device management platforms, so their devices can be migrated.
+package importer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Platforms exports are imported from
+const (
+	SourceBalena    = "balena"    // balenaCloud
+	SourcePortainer = "portainer" // Portainer, including Edge environments
+)
+
+// Export is what an import creates, parsed from the export of a platform
+type Export struct {
+	Source   string
+	Fleets   []Fleet
+	Software []Software
+	Devices  []Device
+	Warnings []string // About what could not be imported as it was
+}
+
+// Fleet is a group of devices on the source platform, a balena fleet or a
+// Portainer environment group
+type Fleet struct {
+	Key         string // Identifies it in the export
+	Name        string
+	Description string
+	Software    string            // Key of the software its devices run, empty for none
+	EnvVars     map[string]string // Of Software
+}
+
+// Software is an application on the source platform, a balena release or a
+// Portainer stack
+type Software struct {
+	Key         string
+	Name        string
+	Version     string
+	ComposeYAML string
+	Deployable  bool // Every service has an image, so it can be deployed as is
+}
+
+// Device is a device on the source platform
+type Device struct {
+	Key      string // ID on the source platform
+	Name     string
+	Fleet    string                       // Key of its fleet, empty for none
+	Software []string                     // Keys of the software it ran
+	EnvVars  map[string]map[string]string // Its own env vars, by software key
+}
+
+// Parse parses the export of a source platform, see docs/imports.md for the
+// formats
+func Parse(source string, data []byte) (*Export, error) {
+	switch source {
+	case SourceBalena:
+		return parseBalena(data)
+	case SourcePortainer:
+		return parsePortainer(data)
+	default:
+		return nil, fmt.Errorf("unknown source %q, use %s or %s", source, SourceBalena, SourcePortainer)
+	}
+}
+
+// warnf adds a warning to the export
+func (e *Export) warnf(format string, args ...interface{}) {
+	e.Warnings = append(e.Warnings, fmt.Sprintf(format, args...))
+}
+
+// checkCompose reports whether every service of a compose file has an image
+// and warns about those that do not
+func (e *Export) checkCompose(name, composeYAML string) bool {
+	var compose struct {
+		Services map[string]struct {
+			Image string      `yaml:"image"`
+			Build interface{} `yaml:"build"`
+		} `yaml:"services"`
+	}
+	if err := yaml.Unmarshal([]byte(composeYAML), &compose); err != nil {
+		e.warnf("Software %s: compose file is invalid, it is not deployed: %v", name, err)
+		return false
+	}
+	if len(compose.Services) == 0 {
+		e.warnf("Software %s: compose file has no services, it is not deployed", name)
+		return false
+	}
+
+	services := make([]string, 0, len(compose.Services))
+	for service := range compose.Services {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+
+	deployable := true
+	for _, service := range services {
+		definition := compose.Services[service]
+		switch {
+		case definition.Image == "" && definition.Build != nil:
+			e.warnf("Software %s: service %s is built by the source platform, set its image before deploying", name, service)
+			deployable = false
+		case definition.Image == "":
+			e.warnf("Software %s: service %s has no image, set one before deploying", name, service)
+			deployable = false
+		case strings.Contains(definition.Image, "balena-cloud.com"):
+			e.warnf("Software %s: service %s pulls %s from the balena registry, which devices can no longer pull once they leave balena", name, service, definition.Image)
+		}
+	}
+	if !deployable {
+		e.warnf("Software %s is imported without deployments until its images are set", name)
+	}
+	return deployable
+}
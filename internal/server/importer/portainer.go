@@ -0,0 +1,164 @@
+package importer
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Portainer environment types that are not Docker hosts
+const (
+	portainerTypeKubernetes      = 3
+	portainerTypeAzure           = 5
+	portainerTypeEdgeKubernetes  = 6
+	portainerTypeKubernetesAgent = 7
+)
+
+// portainerUnassigned is the group of environments without one
+const portainerUnassigned = 1
+
+// portainerExport holds the resources of the Portainer API an import reads,
+// as returned by GET /api/<resource>, with the compose file of every stack
+// from GET /api/stacks/{id}/file in StackFileContent
+type portainerExport struct {
+	EndpointGroups []struct {
+		ID          int64  `json:"Id"`
+		Name        string `json:"Name"`
+		Description string `json:"Description"`
+	} `json:"endpoint_groups"`
+	Endpoints []struct {
+		ID      int64  `json:"Id"`
+		Name    string `json:"Name"`
+		GroupID int64  `json:"GroupId"`
+		Type    int    `json:"Type"`
+		EdgeID  string `json:"EdgeID"`
+	} `json:"endpoints"`
+	Stacks []struct {
+		ID         int64  `json:"Id"`
+		Name       string `json:"Name"`
+		EndpointID int64  `json:"EndpointId"`
+		Env        []struct {
+			Name  string `json:"name"`
+			Value string `json:"value"`
+		} `json:"Env"`
+		StackFileContent string `json:"StackFileContent"`
+	} `json:"stacks"`
+	EdgeStacks []struct {
+		ID               int64  `json:"Id"`
+		Name             string `json:"Name"`
+		StackFileContent string `json:"StackFileContent"`
+	} `json:"edge_stacks"`
+}
+
+// parsePortainer parses a Portainer export. Environment groups become fleets
+// and stacks become software, one per stack name, with the env of each stack
+// as env vars of its device.
+func parsePortainer(data []byte) (*Export, error) {
+	var source portainerExport
+	if err := json.Unmarshal(data, &source); err != nil {
+		return nil, fmt.Errorf("invalid portainer export: %w", err)
+	}
+	if len(source.Endpoints) == 0 {
+		return nil, fmt.Errorf("invalid portainer export: no endpoints")
+	}
+
+	export := &Export{Source: SourcePortainer}
+
+	fleetKeys := make(map[int64]string)
+	for _, group := range source.EndpointGroups {
+		if group.ID == portainerUnassigned {
+			continue
+		}
+		key := strconv.FormatInt(group.ID, 10)
+		fleetKeys[group.ID] = key
+		description := group.Description
+		if description == "" {
+			description = "Imported from Portainer environment group " + group.Name
+		}
+		export.Fleets = append(export.Fleets, Fleet{
+			Key:         key,
+			Name:        group.Name,
+			Description: description,
+		})
+	}
+
+	deviceIndex := make(map[int64]int)
+	for _, endpoint := range source.Endpoints {
+		switch endpoint.Type {
+		case portainerTypeKubernetes, portainerTypeAzure, portainerTypeEdgeKubernetes, portainerTypeKubernetesAgent:
+			export.warnf("Environment %s is not a Docker host, it is not imported", endpoint.Name)
+			continue
+		}
+
+		device := Device{
+			Key:     strconv.FormatInt(endpoint.ID, 10),
+			Name:    endpoint.Name,
+			Fleet:   fleetKeys[endpoint.GroupID],
+			EnvVars: map[string]map[string]string{},
+		}
+		if endpoint.GroupID != 0 && endpoint.GroupID != portainerUnassigned && device.Fleet == "" {
+			export.warnf("Environment %s belongs to group %d, which is not in the export", endpoint.Name, endpoint.GroupID)
+		}
+		deviceIndex[endpoint.ID] = len(export.Devices)
+		export.Devices = append(export.Devices, device)
+	}
+
+	// Stacks of the same name are one software, the compose file of the first
+	// is taken
+	softwareKeys := make(map[string]string)
+	addSoftware := func(name, composeYAML string) string {
+		key := strings.ToLower(name)
+		if existing, ok := softwareKeys[key]; ok {
+			for _, software := range export.Software {
+				if software.Key == existing && strings.TrimSpace(software.ComposeYAML) != strings.TrimSpace(composeYAML) {
+					export.warnf("Stack %s differs between environments, the compose file of the first is imported", name)
+					break
+				}
+			}
+			return existing
+		}
+		softwareKeys[key] = "stack-" + key
+		export.Software = append(export.Software, Software{
+			Key:         "stack-" + key,
+			Name:        name,
+			Version:     "1.0.0",
+			ComposeYAML: composeYAML,
+			Deployable:  export.checkCompose(name, composeYAML),
+		})
+		return "stack-" + key
+	}
+
+	for _, stack := range source.Stacks {
+		if stack.StackFileContent == "" {
+			export.warnf("Stack %s has no StackFileContent, it is not imported", stack.Name)
+			continue
+		}
+		key := addSoftware(stack.Name, stack.StackFileContent)
+
+		i, ok := deviceIndex[stack.EndpointID]
+		if !ok {
+			continue
+		}
+		device := &export.Devices[i]
+		device.Software = append(device.Software, key)
+		if len(stack.Env) > 0 {
+			envVars := map[string]string{}
+			for _, variable := range stack.Env {
+				envVars[variable.Name] = variable.Value
+			}
+			device.EnvVars[key] = envVars
+		}
+	}
+
+	for _, stack := range source.EdgeStacks {
+		if stack.StackFileContent == "" {
+			export.warnf("Edge stack %s has no StackFileContent, it is not imported", stack.Name)
+			continue
+		}
+		addSoftware(stack.Name, stack.StackFileContent)
+		export.warnf("Edge stack %s is imported as software without deployments, deploy it to its devices", stack.Name)
+	}
+
+	return export, nil
+}
@@ -0,0 +1,539 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/server/db"
+	"github.com/edgetainer/edgetainer/internal/server/events"
+	"github.com/edgetainer/edgetainer/internal/server/metrics"
+	"github.com/edgetainer/edgetainer/internal/shared/logging"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	// pollInterval is how often idle workers look for due jobs. Jobs enqueued
+	// on this server wake a worker right away.
+	pollInterval = 2 * time.Second
+	// leaseDuration is how long a job stays claimed by its worker without a
+	// renewal. Jobs of a server that died are picked up again after it.
+	leaseDuration = time.Minute
+	// initialBackoff is the delay before the first retry, doubled for every
+	// further one up to maxBackoff
+	initialBackoff = 10 * time.Second
+	maxBackoff     = 10 * time.Minute
+	// cleanupInterval is how often finished jobs past the retention are removed
+	cleanupInterval = time.Hour
+
+	defaultTimeout     = 10 * time.Minute
+	defaultMaxAttempts = 3
+)
+
+// ErrNotFound is returned for jobs that do not exist
+var ErrNotFound = errors.New("job not found")
+
+// ErrFinished is returned when cancelling a job that already finished, or
+// retrying one that did not
+var ErrFinished = errors.New("job already finished")
+
+// ErrUnknownType is returned when enqueueing a job nothing is registered for
+var ErrUnknownType = errors.New("unknown job type")
+
+var (
+	jobsRunning = metrics.NewGauge("edgetainer_jobs_running",
+		"Background jobs running on this server.")
+	jobsFinished = metrics.NewCounterVec("edgetainer_jobs_finished_total",
+		"Background job attempts finished on this server, by type and outcome.",
+		"type", "status")
+)
+
+// Handler runs a job. The payload given to Enqueue is on the job, the value
+// returned is stored as its result. A failed attempt is retried with backoff
+// until the job runs out of attempts, unless the error is Permanent.
+type Handler func(ctx context.Context, job *models.Job) (interface{}, error)
+
+// Options tune how the jobs of a type run
+type Options struct {
+	MaxAttempts int           // Attempts before the job fails, defaults to 3
+	Timeout     time.Duration // Bound of a single attempt, defaults to 10 minutes
+}
+
+// permanentError marks an error that retrying will not resolve
+type permanentError struct{ err error }
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent wraps an error so the job fails without further attempts
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+type registration struct {
+	handler Handler
+	options Options
+}
+
+// Queue runs background jobs kept in the database with a pool of workers.
+// Workers claim due jobs with SELECT ... FOR UPDATE SKIP LOCKED, so several
+// servers can share the queue, and hold a lease on them while they run.
+type Queue struct {
+	ctx        context.Context
+	cancelFunc context.CancelFunc
+	database   *db.DB
+	bus        *events.Bus
+	logger     *logging.Logger
+	workerID   string // Identifies this server in locked_by
+	wake       chan struct{}
+	wg         sync.WaitGroup
+
+	mu        sync.Mutex
+	handlers  map[string]registration
+	running   map[uuid.UUID]context.CancelFunc
+	workers   int
+	retention time.Duration // Zero keeps finished jobs
+}
+
+// NewQueue creates a job queue. Handlers must be registered before Start.
+func NewQueue(ctx context.Context, database *db.DB, bus *events.Bus) *Queue {
+	queueCtx, cancel := context.WithCancel(ctx)
+
+	hostname, _ := os.Hostname()
+	return &Queue{
+		ctx:        queueCtx,
+		cancelFunc: cancel,
+		database:   database,
+		bus:        bus,
+		logger:     logging.WithComponent("jobs"),
+		workerID:   fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), uuid.NewString()[:8]),
+		wake:       make(chan struct{}, 1),
+		handlers:   make(map[string]registration),
+		running:    make(map[uuid.UUID]context.CancelFunc),
+		workers:    4,
+		retention:  7 * 24 * time.Hour,
+	}
+}
+
+// SetLimits sets the number of workers and how long finished jobs are kept,
+// zero or less to keep them. It must be called before Start.
+func (q *Queue) SetLimits(workers int, retention time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if workers > 0 {
+		q.workers = workers
+	}
+	q.retention = max(retention, 0)
+}
+
+// Register sets the handler of a job type
+func (q *Queue) Register(jobType string, handler Handler, options Options) {
+	if options.MaxAttempts <= 0 {
+		options.MaxAttempts = defaultMaxAttempts
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = defaultTimeout
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.handlers[jobType] = registration{handler: handler, options: options}
+}
+
+// Start starts the workers and the removal of old jobs
+func (q *Queue) Start() {
+	q.mu.Lock()
+	workers := q.workers
+	q.mu.Unlock()
+
+	q.logger.Info(fmt.Sprintf("Starting %d job workers", workers))
+
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go func() {
+			defer q.wg.Done()
+			q.work()
+		}()
+	}
+
+	q.wg.Add(1)
+	go func() {
+		defer q.wg.Done()
+		q.cleanup()
+	}()
+}
+
+// Stop stops the workers. Running jobs are interrupted and picked up again
+// once their lease expires.
+func (q *Queue) Stop() {
+	q.cancelFunc()
+	q.wg.Wait()
+}
+
+// Enqueue adds a job running handler of jobType with payload, as soon as a
+// worker is free or at runAt if it is later. createdBy names the user who
+// started it, empty for the server itself.
+func (q *Queue) Enqueue(ctx context.Context, jobType string, payload interface{}, runAt time.Time, createdBy string) (*models.Job, error) {
+	q.mu.Lock()
+	reg, ok := q.handlers[jobType]
+	q.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownType, jobType)
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode job payload: %w", err)
+	}
+
+	if runAt.IsZero() {
+		runAt = time.Now()
+	}
+	job := &models.Job{
+		Type:        jobType,
+		Status:      models.JobStatusQueued,
+		Payload:     data,
+		MaxAttempts: reg.options.MaxAttempts,
+		RunAt:       runAt,
+		CreatedBy:   createdBy,
+	}
+	if err := q.database.GetDB().WithContext(ctx).Create(job).Error; err != nil {
+		return nil, fmt.Errorf("failed to enqueue job: %w", err)
+	}
+
+	if !runAt.After(time.Now()) {
+		q.notify()
+	}
+	return job, nil
+}
+
+// Get returns a job
+func (q *Queue) Get(ctx context.Context, id uuid.UUID) (*models.Job, error) {
+	var job models.Job
+	if err := q.database.GetDB().WithContext(ctx).Where("id = ?", id).First(&job).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &job, nil
+}
+
+// Cancel stops a job that is queued or running. A running job is
+// interrupted by the server running it.
+func (q *Queue) Cancel(ctx context.Context, id uuid.UUID) (*models.Job, error) {
+	now := time.Now()
+	result := q.database.GetDB().WithContext(ctx).Model(&models.Job{}).
+		Where("id = ? AND status IN ?", id, []string{models.JobStatusQueued, models.JobStatusRunning}).
+		Updates(map[string]interface{}{
+			"status":       models.JobStatusCancelled,
+			"finished_at":  now,
+			"locked_by":    "",
+			"locked_until": nil,
+		})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	job, err := q.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if result.RowsAffected == 0 {
+		return job, ErrFinished
+	}
+
+	q.mu.Lock()
+	stop, ok := q.running[id]
+	q.mu.Unlock()
+	if ok {
+		stop()
+	}
+	return job, nil
+}
+
+// Retry queues a failed or cancelled job again with fresh attempts
+func (q *Queue) Retry(ctx context.Context, id uuid.UUID) (*models.Job, error) {
+	result := q.database.GetDB().WithContext(ctx).Model(&models.Job{}).
+		Where("id = ? AND status IN ?", id, []string{models.JobStatusFailed, models.JobStatusCancelled}).
+		Updates(map[string]interface{}{
+			"status":      models.JobStatusQueued,
+			"attempts":    0,
+			"run_at":      time.Now(),
+			"finished_at": nil,
+		})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	job, err := q.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if result.RowsAffected == 0 {
+		return job, ErrFinished
+	}
+
+	q.notify()
+	return job, nil
+}
+
+// notify wakes an idle worker
+func (q *Queue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// work runs due jobs until the queue stops
+func (q *Queue) work() {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		job, err := q.claim()
+		if err != nil && q.ctx.Err() == nil {
+			q.logger.Error("Failed to claim job", err)
+		}
+		if job != nil {
+			q.run(job)
+			continue
+		}
+
+		select {
+		case <-q.wake:
+		case <-ticker.C:
+		case <-q.ctx.Done():
+			return
+		}
+	}
+}
+
+// claim takes the job due first, including jobs whose worker lost its lease,
+// and returns nil if there is none
+func (q *Queue) claim() (*models.Job, error) {
+	q.mu.Lock()
+	types := make([]string, 0, len(q.handlers))
+	for jobType := range q.handlers {
+		types = append(types, jobType)
+	}
+	q.mu.Unlock()
+	if len(types) == 0 {
+		return nil, nil
+	}
+
+	now := time.Now()
+	var ids []uuid.UUID
+	err := q.database.GetDB().WithContext(q.ctx).Raw(`
+		UPDATE jobs SET status = ?, attempts = attempts + 1, locked_by = ?, locked_until = ?,
+			started_at = COALESCE(started_at, ?), updated_at = ?
+		WHERE id = (
+			SELECT id FROM jobs
+			WHERE type IN ? AND ((status = ? AND run_at <= ?) OR (status = ? AND locked_until < ?))
+			ORDER BY run_at
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id`,
+		models.JobStatusRunning, q.workerID, now.Add(leaseDuration), now, now,
+		types, models.JobStatusQueued, now, models.JobStatusRunning, now,
+	).Scan(&ids).Error
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+
+	return q.Get(q.ctx, ids[0])
+}
+
+// run runs an attempt of a claimed job and records its outcome
+func (q *Queue) run(job *models.Job) {
+	q.mu.Lock()
+	reg, ok := q.handlers[job.Type]
+	q.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	// A job whose worker died on its last attempt does not get another one
+	if job.Attempts > job.MaxAttempts {
+		q.finish(job, nil, Permanent(fmt.Errorf("worker stopped during the last attempt")))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(q.ctx, reg.options.Timeout)
+	defer cancel()
+
+	q.mu.Lock()
+	q.running[job.ID] = cancel
+	q.mu.Unlock()
+	defer func() {
+		q.mu.Lock()
+		delete(q.running, job.ID)
+		q.mu.Unlock()
+	}()
+
+	jobsRunning.Inc()
+	defer jobsRunning.Dec()
+
+	// Renew the lease while the job runs, and notice a cancellation through
+	// another server
+	done := make(chan struct{})
+	defer close(done)
+	go q.renewLease(job.ID, cancel, done)
+
+	q.logger.Debug(fmt.Sprintf("Running job %s (%s), attempt %d of %d", job.ID, job.Type, job.Attempts, job.MaxAttempts))
+	result, err := reg.handler(ctx, job)
+
+	// The server shutting down is not the job's fault, it runs again once
+	// its lease expires
+	if q.ctx.Err() != nil {
+		return
+	}
+	q.finish(job, result, err)
+}
+
+// renewLease extends the lease of a running job until done is closed. It
+// cancels the job when it is no longer running, e.g. cancelled through the
+// API of another server.
+func (q *Queue) renewLease(id uuid.UUID, cancel context.CancelFunc, done <-chan struct{}) {
+	ticker := time.NewTicker(leaseDuration / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			result := q.database.GetDB().Model(&models.Job{}).
+				Where("id = ? AND status = ? AND locked_by = ?", id, models.JobStatusRunning, q.workerID).
+				Update("locked_until", time.Now().Add(leaseDuration))
+			if result.Error == nil && result.RowsAffected == 0 {
+				cancel()
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// finish records the outcome of an attempt: success, a retry after backoff,
+// or failure once the job is out of attempts
+func (q *Queue) finish(job *models.Job, result interface{}, runErr error) {
+	now := time.Now()
+	updates := map[string]interface{}{
+		"locked_by":    "",
+		"locked_until": nil,
+	}
+
+	var permanent *permanentError
+	switch {
+	case runErr == nil:
+		data, err := json.Marshal(result)
+		if err != nil {
+			data, _ = json.Marshal(map[string]string{"error": err.Error()})
+		}
+		job.Status = models.JobStatusSucceeded
+		updates["result"] = string(data)
+		updates["error"] = ""
+		updates["finished_at"] = now
+	case errors.As(runErr, &permanent) || job.Attempts >= job.MaxAttempts:
+		job.Status = models.JobStatusFailed
+		updates["error"] = runErr.Error()
+		updates["finished_at"] = now
+	default:
+		job.Status = models.JobStatusQueued
+		updates["error"] = runErr.Error()
+		updates["run_at"] = now.Add(backoff(job.Attempts))
+	}
+	updates["status"] = job.Status
+
+	// Cancelled jobs keep their status
+	res := q.database.GetDB().Model(&models.Job{}).
+		Where("id = ? AND status = ? AND locked_by = ?", job.ID, models.JobStatusRunning, q.workerID).
+		Updates(updates)
+	if res.Error != nil {
+		q.logger.Error(fmt.Sprintf("Failed to record outcome of job %s", job.ID), res.Error)
+		return
+	}
+	if res.RowsAffected == 0 {
+		jobsFinished.WithLabelValues(job.Type, models.JobStatusCancelled).Inc()
+		return
+	}
+	jobsFinished.WithLabelValues(job.Type, job.Status).Inc()
+
+	switch job.Status {
+	case models.JobStatusSucceeded:
+		q.logger.Info(fmt.Sprintf("Job %s (%s) succeeded", job.ID, job.Type))
+		q.publish(events.JobFinished, job, "")
+	case models.JobStatusFailed:
+		q.logger.Error(fmt.Sprintf("Job %s (%s) failed after %d attempts", job.ID, job.Type, job.Attempts), runErr)
+		q.publish(events.JobFailed, job, runErr.Error())
+	default:
+		q.logger.Warn(fmt.Sprintf("Attempt %d of job %s (%s) failed, retrying: %v", job.Attempts, job.ID, job.Type, runErr))
+	}
+}
+
+// publish announces a finished job on the event bus
+func (q *Queue) publish(eventType string, job *models.Job, message string) {
+	if q.bus == nil {
+		return
+	}
+
+	data := map[string]interface{}{
+		"job_id":   job.ID.String(),
+		"type":     job.Type,
+		"attempts": job.Attempts,
+	}
+	if message != "" {
+		data["error"] = message
+	}
+	q.bus.Publish(events.NewEvent(eventType, "", data))
+}
+
+// cleanup removes finished jobs past the retention
+func (q *Queue) cleanup() {
+	ticker := time.NewTicker(cleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		q.mu.Lock()
+		retention := q.retention
+		q.mu.Unlock()
+
+		if retention > 0 {
+			result := q.database.GetDB().WithContext(q.ctx).
+				Where("status IN ? AND finished_at < ?",
+					[]string{models.JobStatusSucceeded, models.JobStatusFailed, models.JobStatusCancelled},
+					time.Now().Add(-retention)).
+				Delete(&models.Job{})
+			if result.Error != nil && q.ctx.Err() == nil {
+				q.logger.Error("Failed to remove old jobs", result.Error)
+			} else if result.RowsAffected > 0 {
+				q.logger.Debug(fmt.Sprintf("Removed %d finished jobs", result.RowsAffected))
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-q.ctx.Done():
+			return
+		}
+	}
+}
+
+// backoff returns the delay before retrying a job that failed attempt
+func backoff(attempt int) time.Duration {
+	delay := initialBackoff
+	for i := 1; i < attempt && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxBackoff)
+}
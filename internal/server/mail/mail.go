@@ -0,0 +1,162 @@
+// Package mail sends the emails of the server, e.g. user invitations,
+// through an SMTP server
+package mail
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sendTimeout limits a delivery to the SMTP server unless the context of the
+// caller ends it earlier
+const sendTimeout = 30 * time.Second
+
+// Modes of securing the connection to the SMTP server, as in smtp.tls of the
+// server configuration
+const (
+	TLSStartTLS = "starttls"
+	TLSImplicit = "tls"
+	TLSNone     = "none"
+)
+
+// Settings configure a sender
+type Settings struct {
+	Host     string
+	Port     int
+	Username string // Empty to send without authentication
+	Password string
+	From     string // Sender address, may have a display name
+	TLS      string // starttls, tls or none
+}
+
+// Sender delivers emails to one SMTP server
+type Sender struct {
+	settings Settings
+	from     *mail.Address
+}
+
+// NewSender creates a sender for an SMTP server
+func NewSender(settings Settings) (*Sender, error) {
+	if settings.Host == "" {
+		return nil, fmt.Errorf("no SMTP host")
+	}
+	from, err := mail.ParseAddress(settings.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender address %q: %w", settings.From, err)
+	}
+	switch settings.TLS {
+	case TLSStartTLS, TLSImplicit, TLSNone:
+	default:
+		return nil, fmt.Errorf("unknown SMTP TLS mode %q", settings.TLS)
+	}
+	return &Sender{settings: settings, from: from}, nil
+}
+
+// Send delivers a plain text email to one recipient
+func (s *Sender) Send(ctx context.Context, to, subject, body string) error {
+	recipient, err := mail.ParseAddress(to)
+	if err != nil {
+		return fmt.Errorf("invalid recipient %q: %w", to, err)
+	}
+	message, err := s.message(recipient, subject, body)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, sendTimeout)
+	defer cancel()
+
+	addr := net.JoinHostPort(s.settings.Host, strconv.Itoa(s.settings.Port))
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	tlsConfig := &tls.Config{ServerName: s.settings.Host}
+	if s.settings.TLS == TLSImplicit {
+		conn = tls.Client(conn, tlsConfig)
+	}
+	client, err := smtp.NewClient(conn, s.settings.Host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to greet %s: %w", addr, err)
+	}
+	defer client.Close()
+
+	if s.settings.TLS == TLSStartTLS {
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("failed to start TLS with %s: %w", addr, err)
+		}
+	}
+	if s.settings.Username != "" {
+		// PLAIN sends the password as is, net/smtp only allows it over TLS or
+		// to localhost
+		auth := smtp.PlainAuth("", s.settings.Username, s.settings.Password, s.settings.Host)
+		if err := client.Auth(auth); err != nil {
+			return fmt.Errorf("failed to authenticate with %s: %w", addr, err)
+		}
+	}
+
+	if err := client.Mail(s.from.Address); err != nil {
+		return fmt.Errorf("sender refused: %w", err)
+	}
+	if err := client.Rcpt(recipient.Address); err != nil {
+		return fmt.Errorf("recipient refused: %w", err)
+	}
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("failed to send message: %w", err)
+	}
+	if _, err := w.Write(message); err != nil {
+		return fmt.Errorf("failed to send message: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("message refused: %w", err)
+	}
+	return client.Quit()
+}
+
+// message builds the headers and body of an email, with CRLF line endings
+func (s *Sender) message(to *mail.Address, subject, body string) ([]byte, error) {
+	if strings.ContainsAny(subject, "\r\n") {
+		return nil, fmt.Errorf("subject must be a single line")
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	domain := s.from.Address[strings.LastIndex(s.from.Address, "@")+1:]
+
+	var buf bytes.Buffer
+	headers := [][2]string{
+		{"From", s.from.String()},
+		{"To", to.String()},
+		{"Subject", mime.QEncoding.Encode("utf-8", subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", "<" + hex.EncodeToString(id) + "@" + domain + ">"},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "text/plain; charset=utf-8"},
+		{"Content-Transfer-Encoding", "8bit"},
+	}
+	for _, header := range headers {
+		fmt.Fprintf(&buf, "%s: %s\r\n", header[0], header[1])
+	}
+	buf.WriteString("\r\n")
+	for _, line := range strings.Split(strings.ReplaceAll(body, "\r\n", "\n"), "\n") {
+		buf.WriteString(line)
+		buf.WriteString("\r\n")
+	}
+	return buf.Bytes(), nil
+}
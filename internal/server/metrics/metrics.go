@@ -0,0 +1,329 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Metric types in the Prometheus exposition format
+const (
+	typeCounter = "counter"
+	typeGauge   = "gauge"
+)
+
+// metric is a named family of samples
+type metric interface {
+	describe() (name, help, kind string)
+	samples() []sample
+}
+
+// sample is a single value with its labels
+type sample struct {
+	labels string // Rendered label pairs, e.g. device_id="a",direction="in"
+	value  float64
+}
+
+// Registry holds metrics and renders them for scraping
+type Registry struct {
+	mu      sync.RWMutex
+	metrics map[string]metric
+}
+
+// Default is the registry served by Handler
+var Default = NewRegistry()
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]metric)}
+}
+
+// register adds a metric, panicking on duplicate names since that is a
+// programming error
+func (r *Registry) register(m metric) {
+	name, _, _ := m.describe()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.metrics[name]; ok {
+		panic(fmt.Sprintf("metric %s registered twice", name))
+	}
+	r.metrics[name] = m
+}
+
+// WriteTo writes all metrics in the Prometheus text format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.RLock()
+	metrics := make([]metric, 0, len(r.metrics))
+	for _, m := range r.metrics {
+		metrics = append(metrics, m)
+	}
+	r.mu.RUnlock()
+	sort.Slice(metrics, func(i, j int) bool {
+		a, _, _ := metrics[i].describe()
+		b, _, _ := metrics[j].describe()
+		return a < b
+	})
+
+	var b strings.Builder
+	for _, m := range metrics {
+		name, help, kind := m.describe()
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, s := range m.samples() {
+			if s.labels == "" {
+				fmt.Fprintf(&b, "%s %s\n", name, formatValue(s.value))
+			} else {
+				fmt.Fprintf(&b, "%s{%s} %s\n", name, s.labels, formatValue(s.value))
+			}
+		}
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// Handler serves the default registry
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		Default.WriteTo(w)
+	})
+}
+
+// value is a float64 that can be updated atomically
+type value struct {
+	bits atomic.Uint64
+}
+
+// add adds delta to the value
+func (v *value) add(delta float64) {
+	for {
+		old := v.bits.Load()
+		next := math.Float64bits(math.Float64frombits(old) + delta)
+		if v.bits.CompareAndSwap(old, next) {
+			return
+		}
+	}
+}
+
+// set replaces the value
+func (v *value) set(f float64) {
+	v.bits.Store(math.Float64bits(f))
+}
+
+// get returns the value
+func (v *value) get() float64 {
+	return math.Float64frombits(v.bits.Load())
+}
+
+// Counter is a value that only goes up
+type Counter struct {
+	v value
+}
+
+// Inc increments the counter by one
+func (c *Counter) Inc() {
+	c.v.add(1)
+}
+
+// Add increments the counter by delta, which must not be negative
+func (c *Counter) Add(delta float64) {
+	if delta > 0 {
+		c.v.add(delta)
+	}
+}
+
+// Value returns the current count
+func (c *Counter) Value() float64 {
+	return c.v.get()
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	v value
+}
+
+// Set replaces the value of the gauge
+func (g *Gauge) Set(f float64) {
+	g.v.set(f)
+}
+
+// Inc increments the gauge by one
+func (g *Gauge) Inc() {
+	g.v.add(1)
+}
+
+// Dec decrements the gauge by one
+func (g *Gauge) Dec() {
+	g.v.add(-1)
+}
+
+// Add adds delta to the gauge
+func (g *Gauge) Add(delta float64) {
+	g.v.add(delta)
+}
+
+// Value returns the current value
+func (g *Gauge) Value() float64 {
+	return g.v.get()
+}
+
+// single is a metric without labels
+type single struct {
+	name, help, kind string
+	get              func() float64
+}
+
+func (m *single) describe() (string, string, string) { return m.name, m.help, m.kind }
+func (m *single) samples() []sample                  { return []sample{{value: m.get()}} }
+
+// NewCounter registers a counter in the default registry
+func NewCounter(name, help string) *Counter {
+	c := &Counter{}
+	Default.register(&single{name: name, help: help, kind: typeCounter, get: c.Value})
+	return c
+}
+
+// NewGauge registers a gauge in the default registry
+func NewGauge(name, help string) *Gauge {
+	g := &Gauge{}
+	Default.register(&single{name: name, help: help, kind: typeGauge, get: g.Value})
+	return g
+}
+
+// NewGaugeFunc registers a gauge whose value is computed on every scrape
+func NewGaugeFunc(name, help string, fn func() float64) {
+	Default.register(&single{name: name, help: help, kind: typeGauge, get: fn})
+}
+
+// vec is a family of metrics partitioned by labels
+type vec[T any] struct {
+	name, help, kind string
+	labelNames       []string
+	get              func(*T) float64
+
+	mu       sync.RWMutex
+	children map[string]*T
+}
+
+func (v *vec[T]) describe() (string, string, string) { return v.name, v.help, v.kind }
+
+func (v *vec[T]) samples() []sample {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	result := make([]sample, 0, len(v.children))
+	for labels, child := range v.children {
+		result = append(result, sample{labels: labels, value: v.get(child)})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].labels < result[j].labels })
+	return result
+}
+
+// with returns the child for the given label values, creating it if needed
+func (v *vec[T]) with(values []string) *T {
+	if len(values) != len(v.labelNames) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", v.name, len(v.labelNames), len(values)))
+	}
+	key := renderLabels(v.labelNames, values)
+
+	v.mu.RLock()
+	child, ok := v.children[key]
+	v.mu.RUnlock()
+	if ok {
+		return child
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if child, ok := v.children[key]; ok {
+		return child
+	}
+	child = new(T)
+	v.children[key] = child
+	return child
+}
+
+// delete removes the child for the given label values
+func (v *vec[T]) delete(values []string) {
+	key := renderLabels(v.labelNames, values)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.children, key)
+}
+
+// CounterVec is a family of counters partitioned by labels
+type CounterVec struct {
+	v *vec[Counter]
+}
+
+// NewCounterVec registers a labeled counter in the default registry
+func NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	v := &vec[Counter]{name: name, help: help, kind: typeCounter, labelNames: labelNames,
+		get: (*Counter).Value, children: make(map[string]*Counter)}
+	Default.register(v)
+	return &CounterVec{v: v}
+}
+
+// WithLabelValues returns the counter for the given label values
+func (c *CounterVec) WithLabelValues(values ...string) *Counter {
+	return c.v.with(values)
+}
+
+// Delete removes the counter for the given label values
+func (c *CounterVec) Delete(values ...string) {
+	c.v.delete(values)
+}
+
+// GaugeVec is a family of gauges partitioned by labels
+type GaugeVec struct {
+	v *vec[Gauge]
+}
+
+// NewGaugeVec registers a labeled gauge in the default registry
+func NewGaugeVec(name, help string, labelNames ...string) *GaugeVec {
+	v := &vec[Gauge]{name: name, help: help, kind: typeGauge, labelNames: labelNames,
+		get: (*Gauge).Value, children: make(map[string]*Gauge)}
+	Default.register(v)
+	return &GaugeVec{v: v}
+}
+
+// WithLabelValues returns the gauge for the given label values
+func (g *GaugeVec) WithLabelValues(values ...string) *Gauge {
+	return g.v.with(values)
+}
+
+// Delete removes the gauge for the given label values
+func (g *GaugeVec) Delete(values ...string) {
+	g.v.delete(values)
+}
+
+// renderLabels renders label pairs in the exposition format
+func renderLabels(names, values []string) string {
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=" + strconv.Quote(values[i])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// formatValue renders a sample value
+func formatValue(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,16 @@
+package metrics
+
+import "runtime"
+
+// Runtime metrics of the server process, to size servers for a number of
+// devices
+func init() {
+	NewGaugeFunc("edgetainer_go_goroutines", "Goroutines of the server process.", func() float64 {
+		return float64(runtime.NumGoroutine())
+	})
+	NewGaugeFunc("edgetainer_go_heap_inuse_bytes", "Heap memory in use by the server process.", func() float64 {
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		return float64(stats.HeapInuse)
+	})
+}
@@ -0,0 +1,251 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// TokenParam is the query parameter an edgetainer API token can be
+	// passed in, e.g. from a link in the web UI. It is moved into a cookie.
+	TokenParam = "edgetainer_token"
+	// TokenCookie is the cookie holding an edgetainer API token
+	TokenCookie = "edgetainer_token"
+
+	// Access of the same service by the same client with the same outcome is
+	// recorded in the audit log at most once per auditInterval
+	auditInterval = time.Hour
+
+	// A service password that passed bcrypt is trusted for passwordTTL, so
+	// that the assets of a page do not each cost a bcrypt comparison
+	passwordTTL = 5 * time.Minute
+)
+
+// Ways a request was authorized
+const (
+	authNone     = "none"
+	authToken    = "token"
+	authPassword = "password"
+)
+
+type auditKey struct {
+	client    string
+	serviceID string
+	action    string
+}
+
+// authorize checks the credentials of a request for a service that requires
+// authentication and records the access in the audit log. Edgetainer
+// credentials are removed from the request before it is forwarded. It
+// writes the response and returns false if the request must not be
+// forwarded.
+func (p *Proxy) authorize(w http.ResponseWriter, r *http.Request, device *models.Device, service *models.ExposedService) bool {
+	if query := r.URL.Query(); query.Has(TokenParam) {
+		p.exchangeToken(w, r, query.Get(TokenParam))
+		return false
+	}
+
+	cookieToken := stripCookie(r, TokenCookie)
+
+	if !service.AuthRequired {
+		p.auditRequest(r, models.AuditServiceAccess, "", authNone, device, service)
+		return true
+	}
+
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		if user, ok := p.tokenUser(strings.TrimPrefix(header, "Bearer ")); ok {
+			r.Header.Del("Authorization")
+			p.auditRequest(r, models.AuditServiceAccess, user.Username, authToken, device, service)
+			return true
+		}
+	}
+
+	if cookieToken != "" {
+		if user, ok := p.tokenUser(cookieToken); ok {
+			p.auditRequest(r, models.AuditServiceAccess, user.Username, authToken, device, service)
+			return true
+		}
+	}
+
+	if _, password, ok := r.BasicAuth(); ok && service.PasswordHash != "" {
+		if p.checkPassword(service, password) {
+			r.Header.Del("Authorization")
+			p.auditRequest(r, models.AuditServiceAccess, "", authPassword, device, service)
+			return true
+		}
+	}
+
+	p.auditRequest(r, models.AuditServiceDenied, "", authNone, device, service)
+	if service.PasswordHash != "" {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", service.Name))
+	}
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+// checkPassword reports whether password is the password of a service. A
+// password that passed is trusted for passwordTTL without bcrypt, as long as
+// the password of the service stays the same. Wrong passwords always go
+// through bcrypt.
+func (p *Proxy) checkPassword(service *models.ExposedService, password string) bool {
+	mac := hmac.New(sha256.New, p.passwordKey)
+	mac.Write(service.ID[:])
+	mac.Write([]byte{0})
+	mac.Write([]byte(service.PasswordHash))
+	mac.Write([]byte{0})
+	mac.Write([]byte(password))
+	var key [32]byte
+	copy(key[:], mac.Sum(nil))
+
+	now := time.Now()
+	p.passwordMu.Lock()
+	until, ok := p.passwords[key]
+	p.passwordMu.Unlock()
+	if ok && now.Before(until) {
+		return true
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(service.PasswordHash), []byte(password)) != nil {
+		return false
+	}
+
+	p.passwordMu.Lock()
+	p.passwords[key] = now.Add(passwordTTL)
+	if len(p.passwords) > 10000 {
+		for k, until := range p.passwords {
+			if now.After(until) {
+				delete(p.passwords, k)
+			}
+		}
+	}
+	p.passwordMu.Unlock()
+	return true
+}
+
+// exchangeToken stores a valid token from the query in a cookie and
+// redirects to the URL without it, so the token does not end up in the
+// history or in the logs of the device's service
+func (p *Proxy) exchangeToken(w http.ResponseWriter, r *http.Request, token string) {
+	var apiToken models.APIToken
+	if err := p.database.GetDB().Where("token = ?", token).First(&apiToken).Error; err != nil || apiToken.ExpiresAt.Before(time.Now()) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     TokenCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  apiToken.ExpiresAt,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	redirect := *r.URL
+	query := redirect.Query()
+	query.Del(TokenParam)
+	redirect.RawQuery = query.Encode()
+	http.Redirect(w, r, redirect.RequestURI(), http.StatusFound)
+}
+
+// tokenUser returns the user of a valid edgetainer API token
+func (p *Proxy) tokenUser(token string) (models.User, bool) {
+	var apiToken models.APIToken
+	if err := p.database.GetDB().Where("token = ?", token).First(&apiToken).Error; err != nil {
+		return models.User{}, false
+	}
+	if apiToken.ExpiresAt.Before(time.Now()) {
+		return models.User{}, false
+	}
+
+	var user models.User
+	if err := p.database.GetDB().First(&user, apiToken.UserID).Error; err != nil {
+		return models.User{}, false
+	}
+	return user, true
+}
+
+// stripCookie removes a cookie from a request and returns its value
+func stripCookie(r *http.Request, name string) string {
+	cookies := r.Cookies()
+	if len(cookies) == 0 {
+		return ""
+	}
+
+	var value string
+	kept := make([]string, 0, len(cookies))
+	for _, cookie := range cookies {
+		if cookie.Name == name {
+			value = cookie.Value
+			continue
+		}
+		kept = append(kept, cookie.String())
+	}
+
+	r.Header.Del("Cookie")
+	if len(kept) > 0 {
+		r.Header.Set("Cookie", strings.Join(kept, "; "))
+	}
+	return value
+}
+
+// auditRequest records a request to an HTTP service in the audit log
+func (p *Proxy) auditRequest(r *http.Request, action, actor, method string, device *models.Device, service *models.ExposedService) {
+	p.audit(action, actor, r.RemoteAddr, device, service, map[string]interface{}{
+		"method": r.Method,
+		"path":   r.URL.Path,
+		"auth":   method,
+	})
+}
+
+// audit records an access of a service in the audit log, at most once per
+// auditInterval for the same client, service and outcome
+func (p *Proxy) audit(action, actor, remoteAddr string, device *models.Device, service *models.ExposedService, data map[string]interface{}) {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		remoteAddr = host
+	}
+
+	client := actor
+	if client == "" {
+		client = remoteAddr
+	}
+	key := auditKey{client: client, serviceID: service.ID.String(), action: action}
+
+	now := time.Now()
+	p.auditMu.Lock()
+	if last, ok := p.audited[key]; ok && now.Sub(last) < auditInterval {
+		p.auditMu.Unlock()
+		return
+	}
+	p.audited[key] = now
+	if len(p.audited) > 10000 {
+		for k, last := range p.audited {
+			if now.Sub(last) >= auditInterval {
+				delete(p.audited, k)
+			}
+		}
+	}
+	p.auditMu.Unlock()
+
+	data["service"] = service.Name
+	data["protocol"] = service.Protocol
+	data["remote_addr"] = remoteAddr
+	entry := models.AuditEntry{
+		Action:   action,
+		Actor:    actor,
+		DeviceID: device.DeviceID,
+		Data:     data,
+	}
+	if err := p.database.GetDB().Create(&entry).Error; err != nil {
+		p.logger.Error(fmt.Sprintf("Failed to record access of %s on %s in the audit log", service.Name, device.DeviceID), err)
+	}
+}
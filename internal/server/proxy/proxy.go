@@ -0,0 +1,246 @@
+// Package proxy serves the exposed services of devices through the device
+// tunnels: HTTP services at <subdomain>.<domain>, TCP and UDP services on
+// public ports allocated to them.
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/server/db"
+	"github.com/edgetainer/edgetainer/internal/server/ssh"
+	"github.com/edgetainer/edgetainer/internal/shared/logging"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/google/uuid"
+)
+
+// Settings configure the proxy
+type Settings struct {
+	Listen    string // Address serving HTTP services
+	Domain    string // HTTP services are served at <subdomain>.<domain>
+	StartPort int    // First public port for tcp and udp services
+	EndPort   int    // Last public port for tcp and udp services
+	UDP       bool   // Relay udp services
+}
+
+// Proxy serves exposed services of devices
+type Proxy struct {
+	settings     Settings
+	database     *db.DB
+	sshServer    *ssh.Server
+	transport    *http.Transport
+	tlsTransport *http.Transport
+	httpServer   *http.Server
+	logger       *logging.Logger
+	ctx          context.Context
+	cancelFunc   context.CancelFunc
+	wg           sync.WaitGroup
+
+	mu        sync.Mutex
+	listeners map[uuid.UUID]*portListener // Public port listeners of tcp and udp services
+
+	auditMu sync.Mutex
+	audited map[auditKey]time.Time // When an access was last recorded in the audit log
+
+	passwordMu  sync.Mutex
+	passwordKey []byte                 // Keys the hashes of verified passwords, random per process
+	passwords   map[[32]byte]time.Time // Until when a verified service password is trusted, by keyed hash
+}
+
+// NewProxy creates a proxy
+func NewProxy(ctx context.Context, settings Settings, database *db.DB, sshServer *ssh.Server) *Proxy {
+	settings.Domain = strings.TrimSuffix(strings.ToLower(settings.Domain), ".")
+	proxyCtx, cancel := context.WithCancel(ctx)
+	passwordKey := make([]byte, 32)
+	rand.Read(passwordKey)
+	return &Proxy{
+		settings:  settings,
+		database:  database,
+		sshServer: sshServer,
+		transport: &http.Transport{
+			MaxIdleConnsPerHost: 4,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		// Services speaking TLS on a device have certificates for its own
+		// names, if any. The tunnel already makes sure it is the device.
+		tlsTransport: &http.Transport{
+			MaxIdleConnsPerHost: 4,
+			IdleConnTimeout:     90 * time.Second,
+			TLSClientConfig:     &tls.Config{InsecureSkipVerify: true},
+		},
+		logger:      logging.WithComponent("proxy"),
+		ctx:         proxyCtx,
+		cancelFunc:  cancel,
+		listeners:   make(map[uuid.UUID]*portListener),
+		audited:     make(map[auditKey]time.Time),
+		passwordKey: passwordKey,
+		passwords:   make(map[[32]byte]time.Time),
+	}
+}
+
+// Start starts listening for HTTP services and on the public ports of tcp
+// and udp services
+func (p *Proxy) Start() error {
+	listener, err := net.Listen("tcp", p.settings.Listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", p.settings.Listen, err)
+	}
+
+	p.httpServer = &http.Server{Handler: p, ReadHeaderTimeout: 30 * time.Second}
+	go func() {
+		if err := p.httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			p.logger.Error("Proxy server error", err)
+		}
+	}()
+
+	p.logger.Info(fmt.Sprintf("Serving exposed services of *.%s on %s", p.settings.Domain, p.settings.Listen))
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.syncListeners()
+
+		ticker := time.NewTicker(listenerSyncInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.syncListeners()
+			case <-p.ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Shutdown stops the proxy, waiting a few seconds for running requests
+func (p *Proxy) Shutdown() {
+	p.cancelFunc()
+	p.wg.Wait()
+	p.closeListeners()
+
+	if p.httpServer == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := p.httpServer.Shutdown(ctx); err != nil {
+		p.logger.Error("Proxy shutdown error", err)
+	}
+	p.transport.CloseIdleConnections()
+	p.tlsTransport.CloseIdleConnections()
+}
+
+// ServeHTTP routes a request by its host to a device and by its path to one
+// of the device's exposed services
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	subdomain, ok := p.subdomain(r.Host)
+	if !ok {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	var device models.Device
+	err := p.database.GetDB().Where("subdomain = ? AND subdomain_enabled = ?", subdomain, true).First(&device).Error
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	service, err := p.service(&device, r.URL.Path)
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	if !p.authorize(w, r, &device, service) {
+		return
+	}
+
+	forward, _, err := p.sshServer.OpenForward(device.DeviceID, ssh.ForwardTCP, strconv.Itoa(service.ExternalPort), models.ForwardPurposeService)
+	if err != nil {
+		switch {
+		case errors.Is(err, ssh.ErrNotConnected):
+			http.Error(w, "Device is offline", http.StatusBadGateway)
+		case errors.Is(err, ssh.ErrForwardDenied), errors.Is(err, ssh.ErrForwardLimit):
+			http.Error(w, "Service is not reachable", http.StatusForbidden)
+		default:
+			p.logger.Error(fmt.Sprintf("Failed to forward to %s of device %s", service.Name, device.DeviceID), err)
+			http.Error(w, "Service is not reachable", http.StatusBadGateway)
+		}
+		return
+	}
+
+	target := &url.URL{Scheme: "http", Host: forward.Addr()}
+	transport := p.transport
+	if service.Protocol == models.ServiceProtocolHTTPS {
+		target.Scheme, transport = "https", p.tlsTransport
+	}
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(out *httputil.ProxyRequest) {
+			out.SetURL(target)
+			out.Out.Host = out.In.Host
+			out.SetXForwarded()
+		},
+		Transport: transport,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			p.logger.Warn(fmt.Sprintf("Request to %s of device %s failed: %v", service.Name, device.DeviceID, err))
+			http.Error(w, "Service is not reachable", http.StatusBadGateway)
+		},
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+// subdomain returns the subdomain of a request host below the proxy domain
+func (p *Proxy) subdomain(host string) (string, bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+
+	subdomain, found := strings.CutSuffix(host, "."+p.settings.Domain)
+	if !found || subdomain == "" || strings.Contains(subdomain, ".") {
+		return "", false
+	}
+	return subdomain, true
+}
+
+// service returns the enabled HTTP service of a device with the longest URL
+// path the request path starts with
+func (p *Proxy) service(device *models.Device, path string) (*models.ExposedService, error) {
+	var services []models.ExposedService
+	err := p.database.GetDB().Where("device_id = ? AND enabled = ? AND protocol IN ?", device.ID, true,
+		[]string{models.ServiceProtocolHTTP, models.ServiceProtocolHTTPS}).Find(&services).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var best *models.ExposedService
+	for i := range services {
+		prefix := "/" + strings.Trim(services[i].URLPath, "/")
+		if prefix != "/" && path != prefix && !strings.HasPrefix(path, prefix+"/") {
+			continue
+		}
+		if best == nil || len(services[i].URLPath) > len(best.URLPath) {
+			best = &services[i]
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("no service for %s", path)
+	}
+	return best, nil
+}
@@ -0,0 +1,394 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/server/ssh"
+	"github.com/edgetainer/edgetainer/internal/shared/forwarding"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/google/uuid"
+)
+
+const (
+	// How often the public port listeners are matched against the tcp and
+	// udp services
+	listenerSyncInterval = 30 * time.Second
+
+	// A UDP client is forgotten after this long without datagrams
+	udpSessionIdle = 2 * time.Minute
+)
+
+// portListener listens on the public port of a tcp or udp service
+type portListener struct {
+	serviceID uuid.UUID
+	protocol  string
+	port      int
+	closer    interface{ Close() error }
+}
+
+// ParseSources parses the allowed sources of a service, addresses or CIDR
+// ranges
+func ParseSources(sources []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(sources))
+	for _, source := range sources {
+		if !strings.Contains(source, "/") {
+			ip := net.ParseIP(source)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid source %q", source)
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			source = fmt.Sprintf("%s/%d", source, bits)
+		}
+		_, ipNet, err := net.ParseCIDR(source)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source %q", source)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// allowsSource reports whether a client may connect to a tcp or udp
+// service. Raw streams carry no credentials, services requiring
+// authentication are only reachable from their allowed sources.
+func allowsSource(service *models.ExposedService, addr net.Addr) bool {
+	if len(service.AllowedSources) == 0 {
+		return !service.AuthRequired
+	}
+
+	nets, err := ParseSources(service.AllowedSources)
+	if err != nil {
+		return false
+	}
+
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	}
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// syncListeners allocates public ports to tcp and udp services without one
+// and listens on the ports of enabled services, closing the listeners of
+// services that are gone
+func (p *Proxy) syncListeners() {
+	protocols := []string{models.ServiceProtocolTCP}
+	if p.settings.UDP {
+		protocols = append(protocols, models.ServiceProtocolUDP)
+	}
+
+	var services []models.ExposedService
+	if err := p.database.GetDB().Where("enabled = ? AND protocol IN ?", true, protocols).Find(&services).Error; err != nil {
+		p.logger.Error("Failed to fetch tcp and udp services", err)
+		return
+	}
+
+	wanted := make(map[uuid.UUID]*models.ExposedService, len(services))
+	for i := range services {
+		service := &services[i]
+		if service.PublicPort == 0 {
+			if err := p.allocatePort(service); err != nil {
+				p.logger.Error(fmt.Sprintf("Failed to allocate a public port to service %s", service.Name), err)
+				continue
+			}
+		}
+		wanted[service.ID] = service
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for id, listener := range p.listeners {
+		if service, ok := wanted[id]; !ok || service.PublicPort != listener.port || service.Protocol != listener.protocol {
+			listener.closer.Close()
+			delete(p.listeners, id)
+		}
+	}
+
+	for id, service := range wanted {
+		if _, ok := p.listeners[id]; ok || p.ctx.Err() != nil {
+			continue
+		}
+		listener, err := p.listen(service)
+		if err != nil {
+			p.logger.Error(fmt.Sprintf("Failed to listen for %s service %s", service.Protocol, service.Name), err)
+			continue
+		}
+		p.listeners[id] = listener
+	}
+}
+
+// closeListeners closes all public port listeners
+func (p *Proxy) closeListeners() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for id, listener := range p.listeners {
+		listener.closer.Close()
+		delete(p.listeners, id)
+	}
+}
+
+// allocatePort assigns the lowest public port no other service uses
+func (p *Proxy) allocatePort(service *models.ExposedService) error {
+	var used []int
+	if err := p.database.GetDB().Model(&models.ExposedService{}).Where("public_port > 0").Pluck("public_port", &used).Error; err != nil {
+		return err
+	}
+
+	for port := p.settings.StartPort; port <= p.settings.EndPort; port++ {
+		if slices.Contains(used, port) {
+			continue
+		}
+		result := p.database.GetDB().Model(service).Where("public_port = 0").Update("public_port", port)
+		if result.Error != nil {
+			return result.Error
+		}
+		service.PublicPort = port
+		p.logger.Info(fmt.Sprintf("Allocated public port %d to %s service %s", port, service.Protocol, service.Name))
+		return nil
+	}
+	return fmt.Errorf("all public ports %d-%d are in use", p.settings.StartPort, p.settings.EndPort)
+}
+
+// listen opens the public port of a service
+func (p *Proxy) listen(service *models.ExposedService) (*portListener, error) {
+	host, _, _ := net.SplitHostPort(p.settings.Listen)
+	addr := net.JoinHostPort(host, strconv.Itoa(service.PublicPort))
+	listener := &portListener{serviceID: service.ID, protocol: service.Protocol, port: service.PublicPort}
+
+	if service.Protocol == models.ServiceProtocolUDP {
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		listener.closer = conn
+		go p.serveUDP(service.ID, conn)
+	} else {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		listener.closer = l
+		go p.serveTCP(service.ID, l)
+	}
+
+	p.logger.Info(fmt.Sprintf("Relaying %s service %s from port %d", service.Protocol, service.Name, service.PublicPort))
+	return listener, nil
+}
+
+// lookup fetches a service along with its device for a new client, so
+// changes to it apply right away, and checks the client may connect
+func (p *Proxy) lookup(serviceID uuid.UUID, addr net.Addr) (*models.Device, *models.ExposedService, bool) {
+	var service models.ExposedService
+	if err := p.database.GetDB().Where("id = ? AND enabled = ?", serviceID, true).First(&service).Error; err != nil {
+		return nil, nil, false
+	}
+	var device models.Device
+	if err := p.database.GetDB().Where("id = ?", service.DeviceID).First(&device).Error; err != nil {
+		return nil, nil, false
+	}
+
+	if !allowsSource(&service, addr) {
+		p.audit(models.AuditServiceDenied, "", addr.String(), &device, &service, map[string]interface{}{"auth": authNone})
+		return nil, nil, false
+	}
+	p.audit(models.AuditServiceAccess, "", addr.String(), &device, &service, map[string]interface{}{"auth": authNone})
+	return &device, &service, true
+}
+
+// dial connects to a service of a device through its tunnel
+func (p *Proxy) dial(device *models.Device, service *models.ExposedService, forwardType string) (net.Conn, error) {
+	forward, _, err := p.sshServer.OpenForward(device.DeviceID, forwardType, strconv.Itoa(service.ExternalPort), models.ForwardPurposeService)
+	if err != nil {
+		return nil, err
+	}
+	return net.DialTimeout("tcp", forward.Addr(), 10*time.Second)
+}
+
+// serveTCP relays the connections to the public port of a tcp service
+func (p *Proxy) serveTCP(serviceID uuid.UUID, listener net.Listener) {
+	for {
+		client, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			p.logger.Error("Failed to accept connection on public port", err)
+			continue
+		}
+
+		go func() {
+			defer client.Close()
+
+			device, service, ok := p.lookup(serviceID, client.RemoteAddr())
+			if !ok {
+				return
+			}
+
+			upstream, err := p.dial(device, service, ssh.ForwardTCP)
+			if err != nil {
+				p.logger.Warn(fmt.Sprintf("Failed to relay %s to service %s of device %s: %v", client.RemoteAddr(), service.Name, device.DeviceID, err))
+				return
+			}
+			defer upstream.Close()
+
+			forwarding.Pipe(client, upstream, forwarding.Limits{})
+		}()
+	}
+}
+
+// udpRelay relays the datagrams on the public port of a udp service. Each
+// client gets a stream through the tunnel of its own.
+type udpRelay struct {
+	proxy     *Proxy
+	serviceID uuid.UUID
+	conn      net.PacketConn
+
+	mu       sync.Mutex
+	sessions map[string]*udpSession
+}
+
+// udpSession is the stream of one client of a udp service
+type udpSession struct {
+	upstream   net.Conn // Stream of length-prefixed datagrams, nil while connecting
+	lastActive time.Time
+}
+
+// serveUDP relays the datagrams on the public port of a udp service
+func (p *Proxy) serveUDP(serviceID uuid.UUID, conn net.PacketConn) {
+	relay := &udpRelay{proxy: p, serviceID: serviceID, conn: conn, sessions: make(map[string]*udpSession)}
+
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		relay.closeIdle(0)
+	}()
+	go func() {
+		ticker := time.NewTicker(udpSessionIdle / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				relay.closeIdle(udpSessionIdle)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, forwarding.MaxDatagram)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			p.logger.Error("Failed to read datagram on public port", err)
+			continue
+		}
+
+		relay.mu.Lock()
+		session, ok := relay.sessions[addr.String()]
+		if !ok {
+			session = &udpSession{}
+			relay.sessions[addr.String()] = session
+			go relay.connect(addr, session, slices.Clone(buf[:n]))
+		}
+		session.lastActive = time.Now()
+		upstream := session.upstream
+		relay.mu.Unlock()
+
+		// Datagrams arriving while the stream is connected are dropped
+		if ok && upstream != nil {
+			forwarding.WriteDatagram(upstream, buf[:n])
+		}
+	}
+}
+
+// closeIdle closes the streams of clients without datagrams for idle
+func (r *udpRelay) closeIdle(idle time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for key, session := range r.sessions {
+		if time.Since(session.lastActive) >= idle {
+			if session.upstream != nil {
+				session.upstream.Close()
+			}
+			delete(r.sessions, key)
+		}
+	}
+}
+
+// forget removes the session of a client once its stream failed, so its
+// next datagram connects again
+func (r *udpRelay) forget(addr net.Addr, session *udpSession) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.sessions[addr.String()] == session {
+		delete(r.sessions, addr.String())
+	}
+}
+
+// connect connects the stream of a new client, sends it the first datagram
+// and relays the replies until the stream is closed. Clients that may not
+// connect keep their session until it goes idle, so their datagrams are
+// dropped without looking up the service again.
+func (r *udpRelay) connect(addr net.Addr, session *udpSession, first []byte) {
+	device, service, ok := r.proxy.lookup(r.serviceID, addr)
+	if !ok {
+		return
+	}
+
+	upstream, err := r.proxy.dial(device, service, ssh.ForwardUDP)
+	if err != nil {
+		r.proxy.logger.Warn(fmt.Sprintf("Failed to relay %s to service %s of device %s: %v", addr, service.Name, device.DeviceID, err))
+		r.forget(addr, session)
+		return
+	}
+	defer upstream.Close()
+
+	r.mu.Lock()
+	if r.sessions[addr.String()] != session {
+		// Closed while connecting
+		r.mu.Unlock()
+		return
+	}
+	session.upstream = upstream
+	r.mu.Unlock()
+
+	if err := forwarding.WriteDatagram(upstream, first); err != nil {
+		r.forget(addr, session)
+		return
+	}
+
+	buf := make([]byte, forwarding.MaxDatagram)
+	for {
+		n, err := forwarding.ReadDatagram(upstream, buf)
+		if err != nil {
+			r.forget(addr, session)
+			return
+		}
+		r.conn.WriteTo(buf[:n], addr)
+	}
+}
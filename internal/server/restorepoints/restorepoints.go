@@ -0,0 +1,209 @@
+package restorepoints
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/server/db"
+	"github.com/edgetainer/edgetainer/internal/server/jobs"
+	"github.com/edgetainer/edgetainer/internal/server/ssh"
+	"github.com/edgetainer/edgetainer/internal/shared/logging"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Job types of the restore point service
+const (
+	JobCreate  = "restore_point.create"
+	JobRestore = "restore_point.restore"
+)
+
+// ErrDeviceNotConnected is returned when the device of a restore point has
+// no tunnel
+var ErrDeviceNotConnected = errors.New("device is not connected")
+
+// JobPayload names the restore point of a job
+type JobPayload struct {
+	RestorePointID uuid.UUID `json:"restore_point_id"`
+	Apps           []string  `json:"apps,omitempty"` // Applications to restore, empty for all
+}
+
+// Service creates and restores the restore points of devices through their
+// agents
+type Service struct {
+	database  *db.DB
+	sshServer *ssh.Server
+	logger    *logging.Logger
+}
+
+// NewService creates a new restore point service
+func NewService(database *db.DB, sshServer *ssh.Server) *Service {
+	return &Service{
+		database:  database,
+		sshServer: sshServer,
+		logger:    logging.WithComponent("restore-points"),
+	}
+}
+
+// RegisterJobs registers the handlers of the restore point jobs. They are not
+// retried, applications were stopped and started by the failed attempt.
+func (s *Service) RegisterJobs(queue *jobs.Queue) {
+	queue.Register(JobCreate, s.createJob, jobs.Options{MaxAttempts: 1, Timeout: 11 * time.Minute})
+	queue.Register(JobRestore, s.restoreJob, jobs.Options{MaxAttempts: 1, Timeout: 11 * time.Minute})
+}
+
+// createJob has the agent record the applications of a restore point and
+// returns the restore point with its manifest
+func (s *Service) createJob(ctx context.Context, job *models.Job) (interface{}, error) {
+	point, device, _, err := s.jobRestorePoint(ctx, job)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := s.create(ctx, point, device)
+	if err != nil {
+		s.database.GetDB().Model(point).Updates(map[string]interface{}{
+			"status": models.RestorePointStatusFailed,
+			"error":  err.Error(),
+		})
+		return nil, jobs.Permanent(err)
+	}
+
+	point.Status, point.Manifest = models.RestorePointStatusReady, manifest
+	if err := s.database.GetDB().Model(point).Select("status", "manifest").Updates(point).Error; err != nil {
+		return nil, err
+	}
+	s.logger.Info(fmt.Sprintf("Created restore point %s of device %s", point.Name, device.DeviceID))
+	return point, nil
+}
+
+// create sends the command creating a restore point and returns what the
+// agent recorded
+func (s *Service) create(ctx context.Context, point *models.RestorePoint, device *models.Device) (*protocol.RestorePointManifest, error) {
+	command, err := protocol.NewCommandWithPayload(protocol.CmdRestorePoint, protocol.RestorePointPayload{
+		ID:      point.ID.String(),
+		Apps:    point.Apps,
+		Volumes: point.Volumes,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := s.send(ctx, device, command)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest protocol.RestorePointManifest
+	data, err := json.Marshal(response.Data["manifest"])
+	if err == nil {
+		err = json.Unmarshal(data, &manifest)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid restore point manifest: %w", err)
+	}
+	return &manifest, nil
+}
+
+// restoreJob has the agent put back the applications of a restore point and
+// returns the restore point
+func (s *Service) restoreJob(ctx context.Context, job *models.Job) (interface{}, error) {
+	point, device, payload, err := s.jobRestorePoint(ctx, job)
+	if err != nil {
+		return nil, err
+	}
+
+	command, err := protocol.NewCommandWithPayload(protocol.CmdRestore, protocol.RestorePayload{
+		ID:   point.ID.String(),
+		Apps: payload.Apps,
+	})
+	if err != nil {
+		return nil, jobs.Permanent(err)
+	}
+
+	_, err = s.send(ctx, device, command)
+
+	// Ready to be restored again either way, the error tells what went wrong
+	now := time.Now()
+	updates := map[string]interface{}{"status": models.RestorePointStatusReady}
+	if err != nil {
+		updates["error"] = err.Error()
+	} else {
+		updates["error"], updates["restored_at"], updates["restored_by"] = "", now, job.CreatedBy
+	}
+	if dbErr := s.database.GetDB().Model(point).Updates(updates).Error; dbErr != nil {
+		s.logger.Error(fmt.Sprintf("Failed to update restore point %s", point.ID), dbErr)
+	}
+	if err != nil {
+		return nil, jobs.Permanent(err)
+	}
+
+	point.Status, point.Error, point.RestoredAt, point.RestoredBy = models.RestorePointStatusReady, "", &now, job.CreatedBy
+	s.logger.Info(fmt.Sprintf("Restored device %s from restore point %s", device.DeviceID, point.Name))
+	return point, nil
+}
+
+// send sends a command to the device of a restore point, failing if the
+// agent reported a failure
+func (s *Service) send(ctx context.Context, device *models.Device, command *protocol.Command) (*protocol.Response, error) {
+	if _, connected := s.sshServer.GetDeviceConnection(device.DeviceID); !connected {
+		return nil, ErrDeviceNotConnected
+	}
+
+	response, err := s.sshServer.SendCommand(ctx, device.DeviceID, command)
+	if err != nil {
+		return nil, err
+	}
+	if !response.Success {
+		return nil, fmt.Errorf("device reported failure: %s", response.Message)
+	}
+	return response, nil
+}
+
+// jobRestorePoint loads the restore point named by the payload of a job and
+// its device
+func (s *Service) jobRestorePoint(ctx context.Context, job *models.Job) (*models.RestorePoint, *models.Device, *JobPayload, error) {
+	var payload JobPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return nil, nil, nil, jobs.Permanent(fmt.Errorf("invalid payload: %w", err))
+	}
+
+	var point models.RestorePoint
+	if err := s.database.GetDB().WithContext(ctx).Where("id = ?", payload.RestorePointID).First(&point).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, nil, jobs.Permanent(fmt.Errorf("restore point %s no longer exists", payload.RestorePointID))
+		}
+		return nil, nil, nil, err
+	}
+
+	var device models.Device
+	if err := s.database.GetDB().WithContext(ctx).Where("id = ?", point.DeviceID).First(&device).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, nil, jobs.Permanent(fmt.Errorf("device of restore point %s no longer exists", point.ID))
+		}
+		return nil, nil, nil, err
+	}
+	return &point, &device, &payload, nil
+}
+
+// Delete removes a restore point from its device, then from the database.
+// Failed ones left nothing on the device.
+func (s *Service) Delete(ctx context.Context, point *models.RestorePoint, device *models.Device) error {
+	if point.Status != models.RestorePointStatusFailed {
+		command, err := protocol.NewCommandWithPayload(protocol.CmdDeleteRestorePoint, protocol.DeleteRestorePointPayload{
+			ID: point.ID.String(),
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := s.send(ctx, device, command); err != nil {
+			return err
+		}
+	}
+	return s.database.GetDB().WithContext(ctx).Delete(point).Error
+}
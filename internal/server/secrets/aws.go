@@ -0,0 +1,103 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/awsauth"
+)
+
+// awsStore reads secrets from AWS Secrets Manager
+type awsStore struct {
+	region          string
+	endpoint        string
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+	client          *http.Client
+}
+
+// newAWSStore creates an AWS Secrets Manager store. Settings: region,
+// access_key_id, secret_access_key, session_token and endpoint. Credentials
+// fall back to the standard AWS environment variables of the server.
+func newAWSStore(settings map[string]string) (*awsStore, error) {
+	store := &awsStore{
+		region:          settings["region"],
+		endpoint:        strings.TrimRight(settings["endpoint"], "/"),
+		accessKeyID:     settings["access_key_id"],
+		secretAccessKey: settings["secret_access_key"],
+		sessionToken:    settings["session_token"],
+		client:          &http.Client{Timeout: 10 * time.Second},
+	}
+
+	if store.region == "" {
+		store.region = os.Getenv("AWS_REGION")
+	}
+	if store.accessKeyID == "" {
+		store.accessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		store.secretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		store.sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+
+	if store.region == "" {
+		return nil, fmt.Errorf("aws region is required")
+	}
+	if store.accessKeyID == "" || store.secretAccessKey == "" {
+		return nil, fmt.Errorf("aws credentials are required")
+	}
+	if store.endpoint == "" {
+		store.endpoint = fmt.Sprintf("https://secretsmanager.%s.amazonaws.com", store.region)
+	}
+
+	return store, nil
+}
+
+// Get implements Store
+func (a *awsStore) Get(ctx context.Context, path, key string) (string, error) {
+	body, _ := json.Marshal(map[string]string{"SecretId": path})
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.endpoint+"/", bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("failed to create aws request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	awsauth.Signer{
+		AccessKeyID:     a.accessKeyID,
+		SecretAccessKey: a.secretAccessKey,
+		SessionToken:    a.sessionToken,
+		Region:          a.region,
+		Service:         "secretsmanager",
+	}.Sign(req, awsauth.PayloadHash(body), time.Now())
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to reach aws secrets manager: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", fmt.Errorf("failed to read aws response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("aws secrets manager returned %s for %s", resp.Status, path)
+	}
+
+	var result struct {
+		SecretString string `json:"SecretString"`
+	}
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return "", fmt.Errorf("failed to parse aws response: %w", err)
+	}
+
+	return pickKey(result.SecretString, nil, key)
+}
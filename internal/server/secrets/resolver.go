@@ -0,0 +1,147 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/edgetainer/edgetainer/internal/server/db"
+	"github.com/edgetainer/edgetainer/internal/shared/logging"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+	"github.com/edgetainer/edgetainer/internal/shared/tracing"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Resolver resolves secret references against the stores configured for a
+// fleet. Resolved values are only held in memory for the deploy at hand and
+// are never written to the database.
+type Resolver struct {
+	database *db.DB
+	logger   *logging.Logger
+}
+
+// NewResolver creates a new secret resolver
+func NewResolver(database *db.DB) *Resolver {
+	return &Resolver{
+		database: database,
+		logger:   logging.WithComponent("secrets"),
+	}
+}
+
+// ResolveEnv returns a copy of values with every secret reference replaced by
+// the value it refers to
+func (r *Resolver) ResolveEnv(ctx context.Context, fleetID *uuid.UUID, values map[string]string) (map[string]string, error) {
+	stores := make(map[string]Store)
+	result := make(map[string]string, len(values))
+
+	for name, value := range values {
+		if !IsReference(value) {
+			result[name] = value
+			continue
+		}
+
+		resolved, err := r.resolve(ctx, fleetID, value, stores)
+		if err != nil {
+			return nil, fmt.Errorf("env var %s: %w", name, err)
+		}
+		result[name] = resolved
+	}
+
+	return result, nil
+}
+
+// RegistryAuth returns the registry credentials that apply to a fleet, with
+// password references resolved. Fleet credentials override global ones for
+// the same registry.
+func (r *Resolver) RegistryAuth(ctx context.Context, fleetID *uuid.UUID) ([]protocol.RegistryAuth, error) {
+	var credentials []models.RegistryCredential
+	query := r.database.GetDB().WithContext(ctx).Where("fleet_id IS NULL")
+	if fleetID != nil {
+		query = r.database.GetDB().WithContext(ctx).Where("fleet_id IS NULL OR fleet_id = ?", *fleetID)
+	}
+	if err := query.Order("fleet_id NULLS FIRST").Find(&credentials).Error; err != nil {
+		return nil, fmt.Errorf("failed to load registry credentials: %w", err)
+	}
+
+	stores := make(map[string]Store)
+	byServer := make(map[string]int)
+	var result []protocol.RegistryAuth
+
+	for _, credential := range credentials {
+		password := credential.Password
+		if IsReference(password) {
+			resolved, err := r.resolve(ctx, fleetID, password, stores)
+			if err != nil {
+				return nil, fmt.Errorf("registry %s: %w", credential.Server, err)
+			}
+			password = resolved
+		}
+
+		auth := protocol.RegistryAuth{
+			Server:   credential.Server,
+			Username: credential.Username,
+			Password: password,
+		}
+
+		// Global credentials come first, so a fleet entry replaces them
+		if i, ok := byServer[credential.Server]; ok {
+			result[i] = auth
+			continue
+		}
+		byServer[credential.Server] = len(result)
+		result = append(result, auth)
+	}
+
+	return result, nil
+}
+
+// resolve looks up a single reference, reusing store clients across calls
+func (r *Resolver) resolve(ctx context.Context, fleetID *uuid.UUID, value string, stores map[string]Store) (_ string, err error) {
+	ref, err := ParseReference(value)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, span := tracing.Start(ctx, "secrets.resolve", trace.WithAttributes(attribute.String("secret.store", ref.Store)))
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
+	store, ok := stores[ref.Store]
+	if !ok {
+		store, err = r.store(ctx, fleetID, ref.Store)
+		if err != nil {
+			return "", err
+		}
+		stores[ref.Store] = store
+	}
+
+	secret, err := store.Get(ctx, ref.Path, ref.Key)
+	if err != nil {
+		r.logger.Warn(fmt.Sprintf("Failed to resolve %s: %v", ref, err))
+		return "", fmt.Errorf("failed to resolve %s: %w", ref, err)
+	}
+
+	return secret, nil
+}
+
+// store loads a store by name, preferring one configured for the fleet over
+// a global store of the same name
+func (r *Resolver) store(ctx context.Context, fleetID *uuid.UUID, name string) (Store, error) {
+	var record models.SecretStore
+
+	found := false
+	if fleetID != nil {
+		found = r.database.GetDB().WithContext(ctx).Where("name = ? AND fleet_id = ?", name, *fleetID).First(&record).Error == nil
+	}
+	if !found {
+		if err := r.database.GetDB().WithContext(ctx).Where("name = ? AND fleet_id IS NULL", name).First(&record).Error; err != nil {
+			return nil, fmt.Errorf("secret store %q is not configured", name)
+		}
+	}
+
+	return NewStore(record.Type, record.Config)
+}
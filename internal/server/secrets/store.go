@@ -0,0 +1,121 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Store types
+const (
+	TypeVault = "vault"
+	TypeAWS   = "aws-secrets-manager"
+)
+
+// Types lists the supported store types
+var Types = []string{TypeVault, TypeAWS}
+
+// ReferencePrefix starts a value that refers to a secret in an external store:
+// secret://<store name>/<path>#<key>
+const ReferencePrefix = "secret://"
+
+// SensitiveConfigKeys are store configuration keys that are never returned by the API
+var SensitiveConfigKeys = []string{"token", "secret_access_key", "session_token"}
+
+// TargetConfigKeys are store configuration keys that choose where secrets are
+// read from, and so where the sensitive settings are sent
+var TargetConfigKeys = []string{"address", "endpoint"}
+
+// Store reads secrets from an external secret store
+type Store interface {
+	// Get returns the secret at path. When key is not empty the secret is
+	// expected to hold several values and the one named key is returned.
+	Get(ctx context.Context, path, key string) (string, error)
+}
+
+// Reference is a parsed reference to an external secret
+type Reference struct {
+	Store string
+	Path  string
+	Key   string
+}
+
+// IsReference reports whether value refers to an external secret
+func IsReference(value string) bool {
+	return strings.HasPrefix(value, ReferencePrefix)
+}
+
+// ParseReference parses a secret://<store>/<path>#<key> reference
+func ParseReference(value string) (*Reference, error) {
+	if !IsReference(value) {
+		return nil, fmt.Errorf("not a secret reference")
+	}
+
+	rest := strings.TrimPrefix(value, ReferencePrefix)
+	rest, key, _ := strings.Cut(rest, "#")
+
+	store, path, ok := strings.Cut(rest, "/")
+	if !ok || store == "" || path == "" {
+		return nil, fmt.Errorf("invalid secret reference %q, expected %s<store>/<path>#<key>", value, ReferencePrefix)
+	}
+
+	return &Reference{Store: store, Path: path, Key: key}, nil
+}
+
+// String returns the reference in its secret:// form
+func (r *Reference) String() string {
+	s := ReferencePrefix + r.Store + "/" + r.Path
+	if r.Key != "" {
+		s += "#" + r.Key
+	}
+	return s
+}
+
+// NewStore creates a store client from its type and JSON configuration
+func NewStore(storeType, config string) (Store, error) {
+	settings := make(map[string]string)
+	if config != "" {
+		if err := json.Unmarshal([]byte(config), &settings); err != nil {
+			return nil, fmt.Errorf("invalid store configuration: %w", err)
+		}
+	}
+
+	switch storeType {
+	case TypeVault:
+		return newVaultStore(settings)
+	case TypeAWS:
+		return newAWSStore(settings)
+	default:
+		return nil, fmt.Errorf("unknown secret store type: %s", storeType)
+	}
+}
+
+// pickKey returns the value named key from a secret holding a JSON object,
+// or the whole secret when key is empty
+func pickKey(secret string, values map[string]interface{}, key string) (string, error) {
+	if key == "" {
+		if values != nil && len(values) == 1 {
+			for _, v := range values {
+				return fmt.Sprint(v), nil
+			}
+		}
+		if secret == "" {
+			return "", fmt.Errorf("secret has several values, a key is required")
+		}
+		return secret, nil
+	}
+
+	if values == nil {
+		if err := json.Unmarshal([]byte(secret), &values); err != nil {
+			return "", fmt.Errorf("secret is not a JSON object, cannot select key %q", key)
+		}
+	}
+
+	v, ok := values[key]
+	if !ok {
+		return "", fmt.Errorf("secret has no key %q", key)
+	}
+
+	return fmt.Sprint(v), nil
+}
@@ -0,0 +1,109 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// vaultStore reads secrets from a HashiCorp Vault KV secrets engine
+type vaultStore struct {
+	address   string
+	token     string
+	mount     string
+	namespace string
+	kvVersion string
+	client    *http.Client
+}
+
+// newVaultStore creates a Vault store. Settings: address, token, mount
+// (default "secret"), namespace and kv_version ("1" or "2", default "2").
+func newVaultStore(settings map[string]string) (*vaultStore, error) {
+	store := &vaultStore{
+		address:   strings.TrimRight(settings["address"], "/"),
+		token:     settings["token"],
+		mount:     strings.Trim(settings["mount"], "/"),
+		namespace: settings["namespace"],
+		kvVersion: settings["kv_version"],
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}
+
+	if store.address == "" {
+		return nil, fmt.Errorf("vault address is required")
+	}
+	if store.token == "" {
+		return nil, fmt.Errorf("vault token is required")
+	}
+	if store.mount == "" {
+		store.mount = "secret"
+	}
+	if store.kvVersion == "" {
+		store.kvVersion = "2"
+	}
+	if store.kvVersion != "1" && store.kvVersion != "2" {
+		return nil, fmt.Errorf("unsupported vault kv_version %q", store.kvVersion)
+	}
+
+	return store, nil
+}
+
+// Get implements Store
+func (v *vaultStore) Get(ctx context.Context, path, key string) (string, error) {
+	url := fmt.Sprintf("%s/v1/%s/%s", v.address, v.mount, strings.Trim(path, "/"))
+	if v.kvVersion == "2" {
+		url = fmt.Sprintf("%s/v1/%s/data/%s", v.address, v.mount, strings.Trim(path, "/"))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create vault request: %w", err)
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	if v.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.namespace)
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to reach vault: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", fmt.Errorf("failed to read vault response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault returned %s for %s", resp.Status, path)
+	}
+
+	var result struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", fmt.Errorf("failed to parse vault response: %w", err)
+	}
+
+	data := result.Data
+	if v.kvVersion == "2" {
+		var versioned struct {
+			Data json.RawMessage `json:"data"`
+		}
+		if err := json.Unmarshal(result.Data, &versioned); err != nil {
+			return "", fmt.Errorf("failed to parse vault response: %w", err)
+		}
+		data = versioned.Data
+	}
+
+	var values map[string]interface{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return "", fmt.Errorf("failed to parse vault secret: %w", err)
+	}
+
+	return pickKey("", values, key)
+}
@@ -0,0 +1,77 @@
+package sitecache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/server/jobs"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Job types of the site cache service
+const (
+	JobDeploy = "site_cache.deploy"
+	JobCheck  = "site_cache.check"
+)
+
+// JobPayload names the site of a site cache job
+type JobPayload struct {
+	SiteID uuid.UUID `json:"site_id"`
+}
+
+// RegisterJobs registers the handlers of the site cache jobs. Deployments are
+// retried for about five minutes while the cache device is offline.
+func (s *Service) RegisterJobs(queue *jobs.Queue) {
+	queue.Register(JobDeploy, s.deployJob, jobs.Options{MaxAttempts: 6, Timeout: 10 * time.Minute})
+	queue.Register(JobCheck, s.checkJob, jobs.Options{MaxAttempts: 1, Timeout: 2 * checkTimeout})
+}
+
+// deployJob deploys the cache of the site of a job and returns the site
+func (s *Service) deployJob(ctx context.Context, job *models.Job) (interface{}, error) {
+	site, err := s.jobSite(ctx, job)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.Deploy(ctx, site); err != nil {
+		if errors.Is(err, ErrNoCacheDevice) {
+			return nil, jobs.Permanent(err)
+		}
+		return nil, err
+	}
+	return site, nil
+}
+
+// checkJob checks the cache of the site of a job and returns the site with
+// the outcome
+func (s *Service) checkJob(ctx context.Context, job *models.Job) (interface{}, error) {
+	site, err := s.jobSite(ctx, job)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Check(ctx, site)
+	return site, nil
+}
+
+// jobSite loads the site named by the payload of a job
+func (s *Service) jobSite(ctx context.Context, job *models.Job) (*models.Site, error) {
+	var payload JobPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return nil, jobs.Permanent(fmt.Errorf("invalid payload: %w", err))
+	}
+
+	var site models.Site
+	if err := s.database.GetDB().WithContext(ctx).Where("id = ?", payload.SiteID).First(&site).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, jobs.Permanent(fmt.Errorf("site %s no longer exists", payload.SiteID))
+		}
+		return nil, err
+	}
+	return &site, nil
+}
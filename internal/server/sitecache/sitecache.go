@@ -0,0 +1,383 @@
+package sitecache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/server/db"
+	"github.com/edgetainer/edgetainer/internal/server/metrics"
+	"github.com/edgetainer/edgetainer/internal/server/secrets"
+	"github.com/edgetainer/edgetainer/internal/server/ssh"
+	"github.com/edgetainer/edgetainer/internal/shared/compose"
+	"github.com/edgetainer/edgetainer/internal/shared/logging"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// AppName is the application name of the cache on the cache device
+	AppName = "edgetainer-registry-cache"
+	// DefaultPort is the port of the first mirrored registry
+	DefaultPort = 5000
+
+	registryImage = "registry:2"
+	checkInterval = time.Minute
+	checkTimeout  = 30 * time.Second
+)
+
+// ErrNoCacheDevice is returned when deploying the cache of a site without a cache device
+var ErrNoCacheDevice = errors.New("site has no cache device")
+
+// ErrDeviceNotConnected is returned when the cache device has no tunnel
+var ErrDeviceNotConnected = errors.New("cache device is not connected")
+
+var cacheHealthy = metrics.NewGaugeVec("edgetainer_site_cache_healthy",
+	"Whether the registry cache of a site answered its last check.",
+	"site")
+
+// Service deploys the registry caches of sites, checks their health and
+// points the devices of a site at their cache
+type Service struct {
+	ctx        context.Context
+	cancelFunc context.CancelFunc
+	wg         sync.WaitGroup
+	database   *db.DB
+	sshServer  *ssh.Server
+	resolver   *secrets.Resolver
+	logger     *logging.Logger
+}
+
+// NewService creates a new site cache service
+func NewService(ctx context.Context, database *db.DB, sshServer *ssh.Server, resolver *secrets.Resolver) *Service {
+	serviceCtx, cancel := context.WithCancel(ctx)
+
+	return &Service{
+		ctx:        serviceCtx,
+		cancelFunc: cancel,
+		database:   database,
+		sshServer:  sshServer,
+		resolver:   resolver,
+		logger:     logging.WithComponent("site-cache"),
+	}
+}
+
+// Start begins checking the caches of all sites periodically
+func (s *Service) Start() {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		ticker := time.NewTicker(checkInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				s.checkAll()
+			case <-s.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the health checks
+func (s *Service) Stop() {
+	s.cancelFunc()
+	s.wg.Wait()
+	s.logger.Info("Site cache service stopped")
+}
+
+// Upstreams returns the registries mirrored by the cache of a site
+func Upstreams(site *models.Site) []string {
+	if len(site.CacheUpstreams) == 0 {
+		return []string{compose.DefaultRegistry}
+	}
+	return site.CacheUpstreams
+}
+
+// Mirrors maps the registries mirrored by the cache of a site to the address
+// of their mirror
+func Mirrors(site *models.Site) map[string]string {
+	port := site.CachePort
+	if port == 0 {
+		port = DefaultPort
+	}
+
+	mirrors := make(map[string]string)
+	for i, upstream := range Upstreams(site) {
+		mirrors[compose.NormalizeRegistry(upstream)] = net.JoinHostPort(site.CacheHost, strconv.Itoa(port+i))
+	}
+	return mirrors
+}
+
+// DeviceMirrors returns the mirrors a device should pull through, or nil if
+// its site has no healthy cache. The cache device itself pulls directly.
+func (s *Service) DeviceMirrors(ctx context.Context, device *models.Device) map[string]string {
+	if device.SiteID == nil {
+		return nil
+	}
+
+	var site models.Site
+	if err := s.database.GetDB().WithContext(ctx).Where("id = ?", *device.SiteID).First(&site).Error; err != nil {
+		return nil
+	}
+	if site.CacheDeviceID == nil || *site.CacheDeviceID == device.ID || site.CacheStatus != models.CacheStatusHealthy {
+		return nil
+	}
+
+	return Mirrors(&site)
+}
+
+// Deploy deploys the registry cache of a site to its cache device. Upstream
+// registry credentials of the device's fleet are passed to the cache.
+func (s *Service) Deploy(ctx context.Context, site *models.Site) error {
+	device, err := s.cacheDevice(ctx, site)
+	if err != nil {
+		return err
+	}
+	if _, connected := s.sshServer.GetDeviceConnection(device.DeviceID); !connected {
+		return ErrDeviceNotConnected
+	}
+
+	credentials, err := s.resolver.RegistryAuth(ctx, device.FleetID)
+	if err != nil {
+		return err
+	}
+
+	composeYAML, envVars, err := buildCompose(site, credentials)
+	if err != nil {
+		return err
+	}
+
+	command, err := protocol.NewCommandWithPayload(protocol.CmdDeploy, &protocol.DeployPayload{
+		Name:          AppName,
+		Version:       registryImage,
+		ComposeConfig: composeYAML,
+		EnvVars:       envVars,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to build deploy command: %w", err)
+	}
+
+	s.logger.Info(fmt.Sprintf("Deploying registry cache of site %s to device %s", site.Name, device.DeviceID))
+
+	response, err := s.sshServer.SendCommand(ctx, device.DeviceID, command)
+	if err != nil {
+		return err
+	}
+	if !response.Success {
+		return fmt.Errorf("device reported failure: %s", response.Message)
+	}
+
+	s.Check(ctx, site)
+	return nil
+}
+
+// Remove removes the registry cache from a device, e.g. once another device
+// of the site takes over
+func (s *Service) Remove(ctx context.Context, deviceID string) error {
+	if _, connected := s.sshServer.GetDeviceConnection(deviceID); !connected {
+		return ErrDeviceNotConnected
+	}
+
+	command, err := protocol.NewCommandWithPayload(protocol.CmdUndeploy, &protocol.AppPayload{Name: AppName})
+	if err != nil {
+		return fmt.Errorf("failed to build undeploy command: %w", err)
+	}
+
+	response, err := s.sshServer.SendCommand(ctx, deviceID, command)
+	if err != nil {
+		return err
+	}
+	if !response.Success {
+		return fmt.Errorf("device reported failure: %s", response.Message)
+	}
+	return nil
+}
+
+// Check probes the cache of a site from its cache device and records the result
+func (s *Service) Check(ctx context.Context, site *models.Site) {
+	status, checkErr := s.probe(ctx, site)
+
+	now := time.Now()
+	message := ""
+	if checkErr != nil {
+		message = checkErr.Error()
+	}
+
+	if status != site.CacheStatus {
+		if checkErr != nil {
+			s.logger.Warn(fmt.Sprintf("Registry cache of site %s is %s: %s", site.Name, status, message))
+		} else {
+			s.logger.Info(fmt.Sprintf("Registry cache of site %s is %s", site.Name, status))
+		}
+	}
+
+	site.CacheStatus = status
+	site.CacheError = message
+	site.CacheCheckedAt = &now
+	if err := s.database.GetDB().WithContext(ctx).Model(site).Updates(map[string]interface{}{
+		"cache_status":     status,
+		"cache_error":      message,
+		"cache_checked_at": now,
+	}).Error; err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to update cache status of site %s", site.Name), err)
+	}
+
+	if status == models.CacheStatusHealthy {
+		cacheHealthy.WithLabelValues(site.Name).Set(1)
+	} else {
+		cacheHealthy.WithLabelValues(site.Name).Set(0)
+	}
+}
+
+// Forget drops the health metric of a deleted site
+func (s *Service) Forget(site *models.Site) {
+	cacheHealthy.Delete(site.Name)
+}
+
+// probe asks the cache device to query every mirror of the site
+func (s *Service) probe(ctx context.Context, site *models.Site) (string, error) {
+	device, err := s.cacheDevice(ctx, site)
+	if errors.Is(err, ErrNoCacheDevice) {
+		return models.CacheStatusNone, nil
+	}
+	if err != nil {
+		return models.CacheStatusUnknown, err
+	}
+	if _, connected := s.sshServer.GetDeviceConnection(device.DeviceID); !connected {
+		return models.CacheStatusOffline, ErrDeviceNotConnected
+	}
+
+	var urls []string
+	for _, mirror := range Mirrors(site) {
+		urls = append(urls, "http://"+mirror)
+	}
+
+	command, err := protocol.NewCommandWithPayload(protocol.CmdCheckCache, &protocol.CheckCachePayload{URLs: urls})
+	if err != nil {
+		return models.CacheStatusUnknown, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	response, err := s.sshServer.SendCommand(ctx, device.DeviceID, command)
+	if err != nil {
+		return models.CacheStatusUnknown, err
+	}
+	if response.Success {
+		return models.CacheStatusHealthy, nil
+	}
+
+	// Older agents do not know the command and answer with a message only
+	var results []protocol.CacheCheckResult
+	if data, err := json.Marshal(response.Data["results"]); err == nil {
+		json.Unmarshal(data, &results)
+	}
+	var failures []string
+	for _, result := range results {
+		if !result.OK {
+			failures = append(failures, fmt.Sprintf("%s: %s", result.URL, result.Error))
+		}
+	}
+	if len(failures) == 0 {
+		failures = append(failures, response.Message)
+	}
+	return models.CacheStatusUnhealthy, errors.New(strings.Join(failures, "; "))
+}
+
+// cacheDevice loads the cache device of a site
+func (s *Service) cacheDevice(ctx context.Context, site *models.Site) (*models.Device, error) {
+	if site.CacheDeviceID == nil {
+		return nil, ErrNoCacheDevice
+	}
+
+	var device models.Device
+	if err := s.database.GetDB().WithContext(ctx).Where("id = ?", *site.CacheDeviceID).First(&device).Error; err != nil {
+		return nil, fmt.Errorf("failed to load cache device: %w", err)
+	}
+	return &device, nil
+}
+
+// checkAll checks the caches of all sites that have a cache device
+func (s *Service) checkAll() {
+	var sites []models.Site
+	if err := s.database.GetDB().WithContext(s.ctx).Where("cache_device_id IS NOT NULL").Find(&sites).Error; err != nil {
+		s.logger.Error("Failed to load sites", err)
+		return
+	}
+
+	for i := range sites {
+		s.Check(s.ctx, &sites[i])
+	}
+}
+
+// buildCompose builds the Docker Compose file of a site cache with one
+// registry:2 pull-through mirror per upstream. Credentials for upstreams are
+// returned as env vars so that they stay out of the compose file.
+func buildCompose(site *models.Site, credentials []protocol.RegistryAuth) (string, map[string]string, error) {
+	if site.CacheHost == "" {
+		return "", nil, fmt.Errorf("site %s has no cache host", site.Name)
+	}
+
+	port := site.CachePort
+	if port == 0 {
+		port = DefaultPort
+	}
+
+	services := make(map[string]interface{})
+	volumes := make(map[string]interface{})
+	envVars := make(map[string]string)
+
+	for i, upstream := range Upstreams(site) {
+		upstream = compose.NormalizeRegistry(upstream)
+		name := fmt.Sprintf("mirror-%d", i)
+
+		remoteURL := "https://" + upstream
+		if upstream == compose.DefaultRegistry {
+			remoteURL = "https://registry-1.docker.io"
+		}
+
+		environment := map[string]string{
+			"REGISTRY_PROXY_REMOTEURL": remoteURL,
+		}
+		for _, credential := range credentials {
+			if compose.NormalizeRegistry(credential.Server) != upstream {
+				continue
+			}
+			prefix := fmt.Sprintf("MIRROR_%d_", i)
+			envVars[prefix+"USERNAME"] = credential.Username
+			envVars[prefix+"PASSWORD"] = credential.Password
+			environment["REGISTRY_PROXY_USERNAME"] = "${" + prefix + "USERNAME}"
+			environment["REGISTRY_PROXY_PASSWORD"] = "${" + prefix + "PASSWORD}"
+		}
+
+		services[name] = map[string]interface{}{
+			"image":       registryImage,
+			"restart":     "unless-stopped",
+			"ports":       []string{fmt.Sprintf("%d:5000", port+i)},
+			"environment": environment,
+			"volumes":     []string{name + ":/var/lib/registry"},
+		}
+		volumes[name] = map[string]interface{}{}
+	}
+
+	out, err := yaml.Marshal(map[string]interface{}{
+		"services": services,
+		"volumes":  volumes,
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to encode compose file: %w", err)
+	}
+	return string(out), envVars, nil
+}
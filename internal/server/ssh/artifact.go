@@ -0,0 +1,71 @@
+package ssh
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+	"golang.org/x/crypto/ssh"
+)
+
+// ArtifactSource opens the software artifacts devices download
+type ArtifactSource interface {
+	Open(ctx context.Context, digest string, offset int64) (io.ReadCloser, error)
+}
+
+// SetArtifacts sets where devices download software artifacts from over the
+// tunnel, without one ChannelArtifact channels are rejected
+func (s *Server) SetArtifacts(source ArtifactSource) {
+	s.artifacts.Store(&source)
+}
+
+// handleArtifactChannel streams an artifact to the device. Only contents of
+// software artifacts are served, and the agent checks the digest of what it
+// received.
+func (h *ConnectionHandler) handleArtifactChannel(newChannel ssh.NewChannel) {
+	source := h.server.artifacts.Load()
+	if source == nil {
+		newChannel.Reject(ssh.Prohibited, "artifacts are not available")
+		return
+	}
+
+	var request protocol.ArtifactRequest
+	if err := json.Unmarshal(newChannel.ExtraData(), &request); err != nil || !protocol.ValidDigest(request.Digest) || request.Offset < 0 {
+		newChannel.Reject(ssh.ConnectionFailed, "invalid artifact request")
+		return
+	}
+
+	var count int64
+	h.server.database.GetDB().Model(&models.SoftwareArtifact{}).Where("digest = ?", request.Digest).Count(&count)
+	if count == 0 {
+		newChannel.Reject(ssh.ConnectionFailed, "unknown artifact")
+		return
+	}
+
+	content, err := (*source).Open(h.server.ctx, request.Digest, request.Offset)
+	if err != nil {
+		h.logger.Error(fmt.Sprintf("Failed to open artifact %s", request.Digest), err)
+		newChannel.Reject(ssh.ConnectionFailed, "artifact not available")
+		return
+	}
+	defer content.Close()
+
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		h.logger.Error("Failed to accept artifact channel", err)
+		return
+	}
+	defer channel.Close()
+	go ssh.DiscardRequests(requests)
+
+	sent, err := io.Copy(channel, content)
+	if err != nil {
+		h.logger.Warn(fmt.Sprintf("Artifact %s interrupted after %d bytes: %v", request.Digest, sent, err))
+		return
+	}
+	channel.CloseWrite()
+	h.logger.Debug(fmt.Sprintf("Sent %d bytes of artifact %s", sent, request.Digest))
+}
@@ -0,0 +1,216 @@
+package ssh
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/server/events"
+	"github.com/edgetainer/edgetainer/internal/server/metrics"
+	"github.com/edgetainer/edgetainer/internal/shared/credentials"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/ssh"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var autonomyEvents = metrics.NewCounterVec("edgetainer_ssh_autonomy_events_total",
+	"Events of agents acting on their own, such as restarting containers or applying staged updates.",
+	"kind", "result")
+
+// handleAutonomy stores what the agent did on its own while the server may
+// not have been reachable as device logs, and reconciles the staged updates
+// it fetched or applied
+func (h *ConnectionHandler) handleAutonomy(req *ssh.Request) {
+	var batch protocol.AutonomyBatch
+	if err := json.Unmarshal(req.Payload, &batch); err != nil || len(batch.Events) > protocol.MaxAutonomyBatch {
+		h.logger.Error("Failed to parse autonomy events", err)
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+		return
+	}
+
+	var device models.Device
+	if err := h.server.database.GetDB().Where("device_id = ?", h.deviceID).First(&device).Error; err != nil {
+		h.logger.Error("Failed to load device for autonomy events", err)
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+		return
+	}
+
+	now := time.Now()
+	logs := make([]models.DeviceLog, 0, len(batch.Events))
+	for _, event := range batch.Events {
+		kind, result := event.Kind, "success"
+		switch kind {
+		case protocol.AutonomyRestarted, protocol.AutonomyStarted, protocol.AutonomyStaged, protocol.AutonomyApplied:
+		default:
+			kind = "other"
+		}
+		if !event.Success {
+			result = "failure"
+		}
+		autonomyEvents.WithLabelValues(kind, result).Inc()
+
+		// Events from a clock far off are kept in order of arrival
+		if event.Time.IsZero() || event.Time.After(now.Add(time.Hour)) {
+			event.Time = now
+		}
+
+		log := models.DeviceLog{
+			DeviceID:  device.ID,
+			LogType:   models.DeviceLogTypeAutonomy,
+			Unit:      event.App,
+			Message:   credentials.Redact(autonomyMessage(event)),
+			CreatedAt: event.Time,
+		}
+		if len(log.Unit) > maxJournalUnit {
+			log.Unit = log.Unit[:maxJournalUnit]
+		}
+		if len(log.Message) > protocol.MaxJournalMessage {
+			log.Message = log.Message[:protocol.MaxJournalMessage]
+		}
+		log.Unit = strings.ToValidUTF8(strings.ReplaceAll(log.Unit, "\x00", ""), "")
+		log.Message = strings.ToValidUTF8(strings.ReplaceAll(log.Message, "\x00", ""), "")
+		logs = append(logs, log)
+
+		if event.UpdateID != "" {
+			if err := h.server.SettleStagedUpdate(&device, event); err != nil {
+				h.logger.Error(fmt.Sprintf("Failed to reconcile staged update %s", event.UpdateID), err)
+			}
+		}
+	}
+
+	if len(logs) > 0 {
+		if err := h.server.database.GetDB().Create(&logs).Error; err != nil {
+			h.logger.Error(fmt.Sprintf("Failed to store %d autonomy events", len(logs)), err)
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+			return
+		}
+	}
+
+	if req.WantReply {
+		req.Reply(true, nil)
+	}
+}
+
+// autonomyMessage describes an autonomy event for the device logs
+func autonomyMessage(event protocol.AutonomyEvent) string {
+	var message string
+	switch event.Kind {
+	case protocol.AutonomyRestarted:
+		message = fmt.Sprintf("Restarted container %s", event.Container)
+	case protocol.AutonomyStarted:
+		message = "Started application without containers"
+	case protocol.AutonomyStaged:
+		message = fmt.Sprintf("Fetched staged version %s", event.Version)
+	case protocol.AutonomyApplied:
+		message = fmt.Sprintf("Applied staged version %s", event.Version)
+	default:
+		message = fmt.Sprintf("Unknown autonomy event %q", event.Kind)
+	}
+	if !event.Success {
+		return fmt.Sprintf("%s failed: %s", message, event.Error)
+	}
+	return message
+}
+
+// SettleStagedUpdate moves a staged update of the device along as reported
+// by an event, recording a deployment once it was applied. Events of updates
+// that were cancelled or already settled are ignored, as both the response to
+// an activation and the autonomy event of the agent report its outcome, and
+// events may be shipped again after a lost reply.
+func (s *Server) SettleStagedUpdate(device *models.Device, event protocol.AutonomyEvent) error {
+	id, err := uuid.Parse(event.UpdateID)
+	if err != nil {
+		return err
+	}
+
+	from := []string{models.StagedUpdateStatusStaging}
+	status := models.StagedUpdateStatusStaged
+	switch event.Kind {
+	case protocol.AutonomyStaged:
+	case protocol.AutonomyApplied:
+		from = append(from, models.StagedUpdateStatusStaged)
+		status = models.StagedUpdateStatusApplied
+	default:
+		return nil
+	}
+	if !event.Success {
+		status = models.StagedUpdateStatusFailed
+	}
+
+	var published *events.Event
+	err = s.database.GetDB().Transaction(func(tx *gorm.DB) error {
+		// Taking the update in the statement that settles it keeps an update
+		// reported twice at once from being recorded twice
+		var update models.StagedUpdate
+		result := tx.Model(&update).Clauses(clause.Returning{}).
+			Where("id = ? AND device_id = ? AND status IN ?", id, device.ID, from).
+			Updates(map[string]interface{}{"status": status, "error": event.Error})
+		if result.Error != nil || result.RowsAffected == 0 || event.Kind != protocol.AutonomyApplied {
+			return result.Error
+		}
+
+		deployStatus, stage := models.DeploymentStatusDeployed, protocol.StageDone
+		if !event.Success {
+			deployStatus, stage = models.DeploymentStatusFailed, protocol.StageFailed
+		}
+		deployment := models.Deployment{
+			SoftwareID:  update.SoftwareID,
+			DeviceID:    device.ID,
+			Version:     update.Version,
+			Status:      deployStatus,
+			Stage:       stage,
+			Progress:    protocol.StagePercent(stage, 0, 0),
+			Error:       event.Error,
+			EnvVars:     update.EnvVars,
+			ComposeHash: update.ComposeHash,
+			EnvHash:     update.EnvHash,
+			FinishedAt:  &event.Time,
+		}
+		if device.FleetID != nil {
+			deployment.FleetID = *device.FleetID
+		}
+		if err := tx.Create(&deployment).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&update).Updates(map[string]interface{}{
+			"applied_at":    event.Time,
+			"deployment_id": deployment.ID,
+		}).Error; err != nil {
+			return err
+		}
+
+		eventType := events.DeploymentFinished
+		data := map[string]interface{}{
+			"deployment_id":    deployment.ID.String(),
+			"software_id":      update.SoftwareID.String(),
+			"software_name":    event.App,
+			"version":          update.Version,
+			"staged_update_id": update.ID.String(),
+		}
+		if !event.Success {
+			eventType = events.DeploymentFailed
+			data["error"] = event.Error
+		}
+		evt := events.NewEvent(eventType, device.DeviceID, data)
+		published = &evt
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if published != nil && s.bus != nil {
+		s.bus.Publish(*published)
+	}
+	return nil
+}
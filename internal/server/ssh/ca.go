@@ -0,0 +1,173 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/server/metrics"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+	"github.com/edgetainer/edgetainer/internal/shared/sshkeys"
+	"golang.org/x/crypto/ssh"
+)
+
+// certBackdate is how far before issuing a certificate becomes valid, so a
+// device clock running slightly behind does not reject it
+const certBackdate = 5 * time.Minute
+
+var certificatesIssued = metrics.NewCounter("edgetainer_ssh_certificates_issued_total",
+	"Device certificates signed by the SSH certificate authority.")
+
+// certAuthority signs device certificates
+type certAuthority struct {
+	signer ssh.Signer
+	ttl    time.Duration
+}
+
+// EnableCA makes the server sign short-lived certificates for devices and
+// accept them instead of looking up the device key on every login. The CA
+// key is loaded from keyPath, or generated with the given type if missing.
+// Devices that have no valid certificate still log in with their key.
+func (s *Server) EnableCA(keyPath, keyType string, ttl time.Duration) error {
+	keyData, err := os.ReadFile(keyPath)
+	if os.IsNotExist(err) {
+		s.logger.Info(fmt.Sprintf("CA key not found, generating new %s key", keyType))
+		keyData, _, err = sshkeys.Generate(keyType, 0)
+		if err != nil {
+			return fmt.Errorf("failed to generate CA key: %w", err)
+		}
+		if err := os.WriteFile(keyPath, keyData, 0600); err != nil {
+			return fmt.Errorf("failed to write CA key: %w", err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("failed to load CA key: %w", err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(keyData)
+	if err != nil {
+		return fmt.Errorf("failed to parse CA key: %w", err)
+	}
+
+	s.ca.Store(&certAuthority{signer: signer, ttl: ttl})
+	s.logger.Info(fmt.Sprintf("SSH certificate authority enabled (%s)", ssh.FingerprintSHA256(signer.PublicKey())))
+	return nil
+}
+
+// CAPublicKey returns the public key of the certificate authority in
+// authorized_keys format, empty if it is not enabled
+func (s *Server) CAPublicKey() string {
+	ca := s.ca.Load()
+	if ca == nil {
+		return ""
+	}
+	return string(bytes.TrimSpace(ssh.MarshalAuthorizedKey(ca.signer.PublicKey())))
+}
+
+// authenticateCertificate checks a device certificate against the CA. The
+// certificate names the device as its principal. Whether the device was
+// replaced or its key revoked, possibly through another server, is looked up
+// in the database at most every certificateCheckTTL.
+func (s *Server) authenticateCertificate(conn ssh.ConnMetadata, cert *ssh.Certificate) (*ssh.Permissions, error) {
+	ca := s.ca.Load()
+	if ca == nil {
+		authRejections.WithLabelValues(rejectInvalidCert).Inc()
+		return nil, fmt.Errorf("certificates are not accepted")
+	}
+
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return bytes.Equal(auth.Marshal(), ca.signer.PublicKey().Marshal())
+		},
+	}
+	if _, err := checker.Authenticate(conn, cert); err != nil {
+		s.logger.Warn(fmt.Sprintf("Rejecting certificate of device %s: %v", conn.User(), err))
+		authRejections.WithLabelValues(rejectInvalidCert).Inc()
+		return nil, fmt.Errorf("invalid certificate")
+	}
+	if reason, err := s.checkCertificateDevice(conn.User(), cert.Key); err != nil {
+		s.logger.Warn(fmt.Sprintf("Rejecting certificate of device %s: %v", conn.User(), err))
+		authRejections.WithLabelValues(reason).Inc()
+		return nil, err
+	}
+
+	s.logger.Info(fmt.Sprintf("Successfully authenticated device %s with certificate %d", conn.User(), cert.Serial))
+	return &ssh.Permissions{
+		Extensions: map[string]string{
+			"device_id": conn.User(),
+		},
+	}, nil
+}
+
+// signCertificate issues a certificate for the key of a device
+func (ca *certAuthority) signCertificate(deviceID string, key ssh.PublicKey) (*ssh.Certificate, error) {
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             key,
+		Serial:          uint64(now.UnixNano()),
+		CertType:        ssh.UserCert,
+		KeyId:           deviceID,
+		ValidPrincipals: []string{deviceID},
+		ValidAfter:      uint64(now.Add(-certBackdate).Unix()),
+		ValidBefore:     uint64(now.Add(ca.ttl).Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, ca.signer); err != nil {
+		return nil, fmt.Errorf("failed to sign certificate: %w", err)
+	}
+	return cert, nil
+}
+
+// handleCertificateRequest signs a certificate for the registered key of the
+// device. Replaced, decommissioned and revoked devices get none, so they are
+// cut off once their certificate expires.
+func (h *ConnectionHandler) handleCertificateRequest(req *ssh.Request) {
+	ca := h.server.ca.Load()
+	if ca == nil || !req.WantReply {
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+		return
+	}
+
+	var device models.Device
+	if err := h.server.database.GetDB().Where("device_id = ?", h.deviceID).First(&device).Error; err != nil {
+		h.logger.Error("Failed to load device for certificate", err)
+		req.Reply(false, nil)
+		return
+	}
+	if device.Status == models.DeviceStatusReplaced || device.Status == models.DeviceStatusDecommissioned || device.Status == models.DeviceStatusRevoked {
+		h.logger.Warn(fmt.Sprintf("Refusing certificate, device is %s", device.Status))
+		req.Reply(false, nil)
+		return
+	}
+
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(device.SSHPublicKey))
+	if err != nil {
+		h.logger.Error("Failed to parse device public key for certificate", err)
+		req.Reply(false, nil)
+		return
+	}
+
+	cert, err := ca.signCertificate(h.deviceID, key)
+	if err != nil {
+		h.logger.Error("Failed to issue device certificate", err)
+		req.Reply(false, nil)
+		return
+	}
+
+	data, err := json.Marshal(protocol.CertificateReply{
+		Certificate: string(bytes.TrimSpace(ssh.MarshalAuthorizedKey(cert))),
+		ValidBefore: time.Unix(int64(cert.ValidBefore), 0),
+	})
+	if err != nil {
+		req.Reply(false, nil)
+		return
+	}
+
+	certificatesIssued.Inc()
+	h.logger.Info(fmt.Sprintf("Issued certificate %d valid until %s", cert.Serial, time.Unix(int64(cert.ValidBefore), 0).Format(time.RFC3339)))
+	req.Reply(true, data)
+}
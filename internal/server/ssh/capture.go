@@ -0,0 +1,118 @@
+package ssh
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/ssh"
+	"gorm.io/gorm"
+)
+
+// RequestCapture asks a device to capture packets. The agent answers once
+// tcpdump started and streams the capture while it runs.
+func (s *Server) RequestCapture(ctx context.Context, deviceID string, payload protocol.CapturePayload) (*protocol.Response, error) {
+	command, err := protocol.NewCommandWithPayload(protocol.CmdCapture, payload)
+	if err != nil {
+		return nil, err
+	}
+	return s.SendCommand(ctx, deviceID, command)
+}
+
+// handleCaptureChunk stores a part of a packet capture
+func (h *ConnectionHandler) handleCaptureChunk(req *ssh.Request) {
+	var chunk protocol.CaptureChunk
+	if err := json.Unmarshal(req.Payload, &chunk); err != nil {
+		h.logger.Error("Failed to parse packet capture chunk", err)
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+		return
+	}
+
+	if err := h.storeCaptureChunk(&chunk); err != nil {
+		h.logger.Error(fmt.Sprintf("Failed to store part %d of packet capture %s", chunk.Part, chunk.CaptureID), err)
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+		return
+	}
+
+	if req.WantReply {
+		req.Reply(true, nil)
+	}
+}
+
+// storeCaptureChunk appends a part to a capture of the device, completing it
+// with the last part. Parts arrive in order as the agent waits for each to be
+// acknowledged, and a capture that grows past its limit is failed, which
+// makes the agent stop it.
+func (h *ConnectionHandler) storeCaptureChunk(chunk *protocol.CaptureChunk) error {
+	captureID, err := uuid.Parse(chunk.CaptureID)
+	if err != nil {
+		return fmt.Errorf("invalid capture ID: %w", err)
+	}
+
+	db := h.server.database.GetDB()
+	var device models.Device
+	if err := db.Where("device_id = ?", h.deviceID).First(&device).Error; err != nil {
+		return fmt.Errorf("failed to load device: %w", err)
+	}
+
+	var capture models.PacketCapture
+	if err := db.Omit("data").Where("id = ? AND device_id = ?", captureID, device.ID).First(&capture).Error; err != nil {
+		return fmt.Errorf("failed to load capture: %w", err)
+	}
+	if capture.Status != models.CaptureStatusCapturing {
+		return fmt.Errorf("capture is %s", capture.Status)
+	}
+
+	now := time.Now()
+	updates := map[string]interface{}{}
+	switch {
+	case capture.Size+int64(len(chunk.Data)) > capture.MaxBytes:
+		db.Model(&capture).Updates(map[string]interface{}{
+			"status":       models.CaptureStatusFailed,
+			"error":        "capture exceeds its size limit",
+			"data":         nil,
+			"completed_at": now,
+		})
+		return fmt.Errorf("capture exceeds %d bytes", capture.MaxBytes)
+	case len(chunk.Data) == 0:
+	case chunk.Part == 1:
+		updates["data"] = chunk.Data
+		updates["size"] = len(chunk.Data)
+	default:
+		updates["data"] = gorm.Expr("data || ?", chunk.Data)
+		updates["size"] = gorm.Expr("size + ?", len(chunk.Data))
+	}
+
+	if chunk.Last {
+		updates["status"] = models.CaptureStatusReady
+		updates["truncated"] = chunk.Truncated
+		updates["packets"] = chunk.Packets
+		updates["dropped"] = chunk.Dropped
+		updates["completed_at"] = now
+		if chunk.Error != "" {
+			h.logger.Warn(fmt.Sprintf("Packet capture %s failed on the device: %s", captureID, chunk.Error))
+			updates["status"] = models.CaptureStatusFailed
+			updates["error"] = chunk.Error
+		}
+	}
+
+	if len(updates) == 0 {
+		return nil
+	}
+	if err := db.Model(&capture).Updates(updates).Error; err != nil {
+		return err
+	}
+	if updates["status"] == models.CaptureStatusReady {
+		h.logger.Info(fmt.Sprintf("Received packet capture %s of %d packets", captureID, chunk.Packets))
+		go h.server.offload(&models.PacketCapture{}, captureID, fmt.Sprintf("captures/%s/%s.pcap", device.ID, captureID))
+	}
+	return nil
+}
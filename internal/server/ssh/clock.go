@@ -0,0 +1,172 @@
+package ssh
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/server/events"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+	"golang.org/x/crypto/ssh"
+)
+
+// AlertClockSkew is the alert fired when a device clock drifts too far
+const AlertClockSkew = "clock_skew"
+
+// SetMaxClockSkew sets how far a device clock may be off the server clock
+// before an alert fires, zero to never alert
+func (s *Server) SetMaxClockSkew(skew time.Duration) {
+	s.maxClockSkew.Store(int64(skew))
+}
+
+// handleTimeRequest answers an agent clock check with the server time
+func (h *ConnectionHandler) handleTimeRequest(req *ssh.Request) {
+	if !req.WantReply {
+		return
+	}
+
+	data, err := json.Marshal(protocol.TimeReply{ServerTime: time.Now()})
+	if err != nil {
+		req.Reply(false, nil)
+		return
+	}
+	req.Reply(true, data)
+}
+
+// handleHeartbeat checks the hardware the device reports, queues the columns
+// reported in a heartbeat to be written with those of other devices, records
+// containers, unmanaged workloads, USB devices, host health and host services
+// and fires an alert when the device clock drifts beyond the allowed skew
+func (h *ConnectionHandler) handleHeartbeat(req *ssh.Request) {
+	var heartbeat protocol.Heartbeat
+	if err := json.Unmarshal(req.Payload, &heartbeat); err != nil {
+		h.logger.Error("Failed to parse heartbeat", err)
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+		return
+	}
+
+	var device models.Device
+	if err := h.server.database.GetDB().Where("device_id = ?", h.deviceID).First(&device).Error; err != nil {
+		h.logger.Error("Failed to load device for heartbeat", err)
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+		return
+	}
+
+	now := time.Now()
+	if !h.checkHardware(&device, heartbeat.HardwareID, now) {
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+		h.conn.Close()
+		return
+	}
+
+	updates := map[string]interface{}{"last_seen": now}
+	if net.ParseIP(heartbeat.IP) != nil {
+		updates["ip_address"] = heartbeat.IP
+	}
+	if heartbeat.Addresses != nil {
+		addresses := make([]string, 0, len(heartbeat.Addresses))
+		for _, address := range heartbeat.Addresses {
+			if net.ParseIP(address) != nil {
+				addresses = append(addresses, address)
+			}
+		}
+		data, _ := json.Marshal(addresses)
+		updates["ip_addresses"] = string(data)
+	}
+	if heartbeat.Version != "" {
+		updates["agent_version"] = heartbeat.Version
+	}
+	if heartbeat.Build != nil {
+		features, _ := json.Marshal(heartbeat.Build.Features)
+		updates["agent_commit"] = heartbeat.Build.Commit
+		updates["agent_build_date"] = heartbeat.Build.Date
+		updates["agent_features"] = string(features)
+	}
+	if heartbeat.Platforms != nil {
+		if platforms, err := protocol.NormalizePlatforms(heartbeat.Platforms); err == nil {
+			data, _ := json.Marshal(platforms)
+			updates["platforms"] = string(data)
+		}
+	}
+	if heartbeat.OS != nil {
+		data, _ := json.Marshal(heartbeat.OS)
+		updates["os"] = string(data)
+		updates["os_version"] = heartbeat.OS.Name
+	}
+	if heartbeat.ClockSkew != nil {
+		updates["clock_skew"] = *heartbeat.ClockSkew
+		updates["clock_checked_at"] = now
+	}
+	if heartbeat.Plugins != nil {
+		plugins, _ := json.Marshal(heartbeat.Plugins)
+		pluginMetrics, _ := json.Marshal(heartbeat.PluginMetrics)
+		updates["plugins"] = string(plugins)
+		updates["plugin_metrics"] = string(pluginMetrics)
+	}
+	var health *protocol.HostHealth
+	if heartbeat.Metrics != nil {
+		var err error
+		if health, err = hostHealth(heartbeat.Metrics, device.HostHealth); err != nil {
+			h.logger.Error("Failed to read host health from heartbeat", err)
+		} else {
+			data, _ := json.Marshal(health)
+			updates["host_health"] = string(data)
+		}
+	}
+	if len(heartbeat.HostServices) > protocol.MaxHostServices {
+		heartbeat.HostServices = heartbeat.HostServices[:protocol.MaxHostServices]
+	}
+	if heartbeat.HostServices != nil {
+		services, _ := json.Marshal(heartbeat.HostServices)
+		updates["host_services"] = string(services)
+	}
+	for column, value := range locationUpdates(&device, heartbeat.Location) {
+		updates[column] = value
+	}
+	h.server.heartbeats.add(h.deviceID, updates)
+	if heartbeat.Unmanaged != nil {
+		h.recordUnmanaged(&device, heartbeat.Unmanaged, now)
+	}
+	if heartbeat.Containers != nil {
+		h.recordContainers(&device, heartbeat.Containers, now)
+	}
+	if heartbeat.USB != nil {
+		h.recordUSB(&device, heartbeat.USB, now)
+	}
+	if health != nil {
+		h.checkHostHealth(&device, health)
+	}
+	if heartbeat.HostServices != nil {
+		h.checkHostServices(&device, heartbeat.HostServices)
+	}
+
+	// Only a clock that starts drifting fires, not every heartbeat after it
+	maxSkew := time.Duration(h.server.maxClockSkew.Load()).Seconds()
+	if heartbeat.ClockSkew != nil && maxSkew > 0 {
+		skew := *heartbeat.ClockSkew
+		wasSkewed := device.ClockCheckedAt != nil && math.Abs(device.ClockSkew) > maxSkew
+		if math.Abs(skew) > maxSkew && !wasSkewed {
+			h.logger.Warn(fmt.Sprintf("Device clock is %.1fs off the server clock", skew))
+			data := map[string]interface{}{
+				"alert":                  AlertClockSkew,
+				"name":                   device.Name,
+				"clock_skew_seconds":     skew,
+				"max_clock_skew_seconds": maxSkew,
+			}
+			h.server.bus.Publish(events.NewEvent(events.AlertFiring, h.deviceID, data))
+		}
+	}
+
+	if req.WantReply {
+		req.Reply(true, nil)
+	}
+}
@@ -0,0 +1,152 @@
+package ssh
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+	"golang.org/x/crypto/ssh"
+)
+
+// errConnectionLost is returned by deliverCommand when the device connection
+// closed before the command was answered
+var errConnectionLost = errors.New("connection lost")
+
+// deliverCommand sends a command over a new command channel of conn and waits
+// for the response. Acknowledgements of agents that send them are checked
+// on the way: a rejected command fails right away.
+func (s *Server) deliverCommand(ctx context.Context, conn *DeviceConnection, command *protocol.Command, timeout <-chan time.Time) (*protocol.Response, error) {
+	handler := conn.Handler
+
+	// Every command gets its own channel so responses cannot be mixed up
+	channel, requests, err := conn.Connection.OpenChannel(protocol.ChannelCommand, nil)
+	if err != nil {
+		if handler.lost() {
+			return nil, errConnectionLost
+		}
+		return nil, fmt.Errorf("failed to open command channel: %w", err)
+	}
+	defer channel.Close()
+
+	acks := make(chan protocol.CommandAck, 1)
+	go readAcks(requests, acks)
+
+	// Agents that did not announce compression get plain JSON
+	if err := protocol.WriteMessage(channel, command, handler.supports(protocol.FeatureCompression)); err != nil {
+		if handler.lost() {
+			return nil, errConnectionLost
+		}
+		return nil, fmt.Errorf("failed to send command: %w", err)
+	}
+
+	result := make(chan error, 1)
+	var response protocol.Response
+	go func() {
+		result <- protocol.ReadMessage(channel, &response)
+	}()
+
+	for {
+		select {
+		case ack := <-acks:
+			if ack.ID != command.ID || ack.Seq != command.Seq {
+				handler.logger.Warn(fmt.Sprintf("Ignoring acknowledgement of command %s (%d) while waiting for %s (%d)", ack.ID, ack.Seq, command.ID, command.Seq))
+				continue
+			}
+			if !ack.Accepted {
+				return nil, fmt.Errorf("device rejected command %s: %s", command.ID, ack.Reason)
+			}
+			handler.logger.Debug(fmt.Sprintf("Device acknowledged command %s (%d)", command.ID, command.Seq))
+		case err := <-result:
+			if err != nil {
+				if handler.lost() {
+					return nil, errConnectionLost
+				}
+				return nil, fmt.Errorf("failed to read command response: %w", err)
+			}
+			if response.Duplicate {
+				handler.logger.Info(fmt.Sprintf("Device answered resent command %s from its first execution", command.ID))
+			}
+			return &response, nil
+		case <-handler.ctx.Done():
+			if s.ctx.Err() != nil {
+				return nil, fmt.Errorf("server shutting down")
+			}
+			return nil, errConnectionLost
+		case <-timeout:
+			return nil, fmt.Errorf("timed out waiting for response to command %s", command.ID)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-s.ctx.Done():
+			return nil, fmt.Errorf("server shutting down")
+		}
+	}
+}
+
+// lostGrace is how long a failed command channel waits for its connection to
+// be noticed as closed
+const lostGrace = time.Second
+
+// lost reports whether the connection closed. A command channel fails
+// slightly before the handler notices, so it waits a moment for that.
+func (h *ConnectionHandler) lost() bool {
+	select {
+	case <-h.ctx.Done():
+		return true
+	case <-time.After(lostGrace):
+		return false
+	}
+}
+
+// readAcks passes the acknowledgements sent on a command channel to acks and
+// rejects any other channel request
+func readAcks(requests <-chan *ssh.Request, acks chan<- protocol.CommandAck) {
+	for req := range requests {
+		var ack protocol.CommandAck
+		if req.Type != protocol.RequestAck || json.Unmarshal(req.Payload, &ack) != nil {
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+			continue
+		}
+
+		select {
+		case acks <- ack:
+		default:
+			// A command is acknowledged once per channel
+		}
+		if req.WantReply {
+			req.Reply(true, nil)
+		}
+	}
+}
+
+// awaitReconnect waits until a device replaces the connection that was lost
+func (s *Server) awaitReconnect(ctx context.Context, deviceID string, lost *DeviceConnection, timeout <-chan time.Time) (*DeviceConnection, error) {
+	for {
+		s.mu.Lock()
+		conn, ok := s.connections[deviceID]
+		if ok && conn != lost {
+			s.mu.Unlock()
+			return conn, nil
+		}
+		reconnected, ok := s.reconnects[deviceID]
+		if !ok {
+			reconnected = make(chan struct{})
+			s.reconnects[deviceID] = reconnected
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-reconnected:
+		case <-timeout:
+			return nil, fmt.Errorf("device %s did not reconnect in time", deviceID)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-s.ctx.Done():
+			return nil, fmt.Errorf("server shutting down")
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package ssh
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ConnectionInfo describes a live device tunnel
+type ConnectionInfo struct {
+	DeviceID       string    `json:"device_id"`
+	RemoteAddr     string    `json:"remote_addr"`          // Address the device connects from, as seen by the server
+	ProxyAddr      string    `json:"proxy_addr,omitempty"` // Load balancer that passed on RemoteAddr in a PROXY header
+	ClientVersion  string    `json:"client_version"`       // SSH version string of the agent
+	ConnectedSince time.Time `json:"connected_since"`
+	Forwards       []Forward `json:"forwards"`
+	BytesIn        uint64    `json:"bytes_in"`  // Received from the device since the server started
+	BytesOut       uint64    `json:"bytes_out"` // Sent to the device since the server started
+}
+
+// PortReallocation pairs the old and new server port of a forward
+type PortReallocation struct {
+	OldPort int     `json:"old_port"`
+	Forward Forward `json:"forward"`
+}
+
+// Connections returns the live device tunnels ordered by device ID
+func (s *Server) Connections() []ConnectionInfo {
+	s.mu.Lock()
+	infos := make([]ConnectionInfo, 0, len(s.connections))
+	for deviceID, conn := range s.connections {
+		info := ConnectionInfo{
+			DeviceID:       deviceID,
+			RemoteAddr:     conn.Connection.RemoteAddr().String(),
+			ProxyAddr:      conn.ProxyAddr,
+			ClientVersion:  string(conn.Connection.ClientVersion()),
+			ConnectedSince: conn.Established,
+			Forwards:       make([]Forward, 0, len(conn.ForwardPorts)),
+		}
+		for _, forward := range conn.ForwardPorts {
+			info.Forwards = append(info.Forwards, forward.snapshot())
+		}
+		sort.Slice(info.Forwards, func(i, j int) bool { return info.Forwards[i].Port < info.Forwards[j].Port })
+		infos = append(infos, info)
+	}
+	s.mu.Unlock()
+
+	for i := range infos {
+		if stats := s.TunnelStats(infos[i].DeviceID); stats != nil {
+			infos[i].BytesIn = stats.BytesIn
+			infos[i].BytesOut = stats.BytesOut
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].DeviceID < infos[j].DeviceID })
+	return infos
+}
+
+// Disconnect closes the tunnel of a device. The agent reconnects on its own,
+// so this mostly helps to get a device through a fresh NAT mapping. It
+// reports whether the device was connected.
+func (s *Server) Disconnect(deviceID string) bool {
+	s.mu.Lock()
+	conn, connected := s.connections[deviceID]
+	s.mu.Unlock()
+
+	if connected {
+		conn.Connection.Close()
+	}
+	return connected
+}
+
+// ReallocatePorts moves every forward of a device to a newly allocated
+// server port, e.g. when a firewall at the server side blocks the old ones.
+// Each new port is open before the old one closes, connections already made
+// through the old port stay open.
+func (s *Server) ReallocatePorts(deviceID string) ([]PortReallocation, error) {
+	s.mu.Lock()
+	conn, ok := s.connections[deviceID]
+	if !ok {
+		s.mu.Unlock()
+		return nil, ErrNotConnected
+	}
+	forwards := make([]*Forward, 0, len(conn.ForwardPorts))
+	for _, forward := range conn.ForwardPorts {
+		forwards = append(forwards, forward)
+	}
+	s.mu.Unlock()
+	sort.Slice(forwards, func(i, j int) bool { return forwards[i].Port < forwards[j].Port })
+
+	moved := []PortReallocation{}
+	for _, old := range forwards {
+		// Unregister the old forward first, so it does not count against the
+		// forward limit of the device, and keep its port until the new one
+		// is open so that a different port is picked
+		s.mu.Lock()
+		if conn.ForwardPorts[old.Port] != old {
+			s.mu.Unlock()
+			continue
+		}
+		delete(conn.ForwardPorts, old.Port)
+		s.mu.Unlock()
+
+		forward, err := conn.Handler.openForward(old.Type, old.Target, old.Purpose, old.OnDemand)
+		old.listener.Close()
+		if err != nil {
+			return moved, fmt.Errorf("failed to reallocate forward on port %d: %w", old.Port, err)
+		}
+
+		conn.Handler.logger.Info(fmt.Sprintf("Moved %s forward to %s from port %d to %d", old.Type, old.Target, old.Port, forward.Port))
+		moved = append(moved, PortReallocation{OldPort: old.Port, Forward: forward.snapshot()})
+	}
+	return moved, nil
+}
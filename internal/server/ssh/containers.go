@@ -0,0 +1,142 @@
+package ssh
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/server/events"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+// AlertContainerUnhealthy is the alert fired when the health check of an
+// application container starts failing
+const AlertContainerUnhealthy = "container_unhealthy"
+
+// recordContainers reconciles the containers of a device with those
+// reported in a heartbeat. Only containers that changed are written, and a
+// heartbeat reporting the same containers as the previous one on the
+// connection is not even compared.
+func (h *ConnectionHandler) recordContainers(device *models.Device, reported []protocol.ContainerStatus, now time.Time) {
+	fingerprint, _ := json.Marshal(reported)
+	if h.containers != nil && bytes.Equal(fingerprint, h.containers) {
+		return
+	}
+
+	db := h.server.database.GetDB()
+	var known []models.DeviceContainer
+	if err := db.Where("device_id = ?", device.ID).Find(&known).Error; err != nil {
+		h.logger.Error("Failed to load containers", err)
+		return
+	}
+	byName := make(map[string]*models.DeviceContainer, len(known))
+	for i := range known {
+		byName[known[i].Name] = &known[i]
+	}
+
+	failed := false
+	seen := make(map[string]bool, len(reported))
+	for _, status := range reported {
+		if status.Name == "" || seen[status.Name] {
+			continue
+		}
+		seen[status.Name] = true
+
+		record, exists := byName[status.Name]
+		if !exists {
+			record = &models.DeviceContainer{DeviceID: device.ID, Name: status.Name, ChangedAt: now}
+		}
+		wasUnhealthy := exists && record.Health == "unhealthy"
+
+		var err error
+		if exists {
+			updates := containerUpdates(record, status)
+			if len(updates) == 0 {
+				continue
+			}
+			_, stateChanged := updates["state"]
+			_, healthChanged := updates["health"]
+			if stateChanged || healthChanged {
+				updates["changed_at"] = now
+			}
+			err = db.Model(record).Updates(updates).Error
+		} else {
+			applyContainer(record, status)
+			err = db.Create(record).Error
+		}
+		if err != nil {
+			h.logger.Error(fmt.Sprintf("Failed to record container %s", status.Name), err)
+			failed = true
+			continue
+		}
+
+		if status.Health == "unhealthy" && !wasUnhealthy {
+			h.logger.Warn(fmt.Sprintf("Container %s of application %s is unhealthy", status.Name, status.App))
+			data := map[string]interface{}{
+				"alert":     AlertContainerUnhealthy,
+				"name":      device.Name,
+				"container": status.Name,
+				"app":       status.App,
+				"image":     status.Image,
+				"restarts":  status.Restarts,
+			}
+			h.server.bus.Publish(events.NewEvent(events.AlertFiring, h.deviceID, data))
+		}
+	}
+
+	var gone []string
+	for _, record := range known {
+		if !seen[record.Name] {
+			gone = append(gone, record.Name)
+		}
+	}
+	if len(gone) > 0 {
+		if err := db.Where("device_id = ? AND name IN ?", device.ID, gone).Delete(&models.DeviceContainer{}).Error; err != nil {
+			h.logger.Error("Failed to remove containers that are gone", err)
+			failed = true
+		}
+	}
+
+	// A failed write is retried with the next heartbeat
+	if failed {
+		h.containers = nil
+	} else {
+		h.containers = fingerprint
+	}
+}
+
+// containerUpdates returns the columns of a recorded container that differ
+// from a reported status
+func containerUpdates(record *models.DeviceContainer, status protocol.ContainerStatus) map[string]interface{} {
+	updates := map[string]interface{}{}
+	set := func(column string, current, value interface{}) {
+		if current != value {
+			updates[column] = value
+		}
+	}
+	set("container_id", record.ContainerID, status.ID)
+	set("app", record.App, status.App)
+	set("image", record.Image, status.Image)
+	set("image_id", record.ImageID, status.ImageID)
+	set("repo_digest", record.RepoDigest, status.RepoDigest)
+	set("state", record.State, status.Status)
+	set("health", record.Health, status.Health)
+	set("restarts", record.Restarts, status.Restarts)
+	set("created", record.Created, status.Created)
+	return updates
+}
+
+// applyContainer copies a reported status to a new record
+func applyContainer(record *models.DeviceContainer, status protocol.ContainerStatus) {
+	record.ContainerID = status.ID
+	record.App = status.App
+	record.Image = status.Image
+	record.ImageID = status.ImageID
+	record.RepoDigest = status.RepoDigest
+	record.State = status.Status
+	record.Health = status.Health
+	record.Restarts = status.Restarts
+	record.Created = status.Created
+}
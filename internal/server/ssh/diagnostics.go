@@ -0,0 +1,115 @@
+package ssh
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/ssh"
+	"gorm.io/gorm"
+)
+
+// RequestDiagnostics asks a device to collect a diagnostics bundle. The agent
+// answers once it started collecting and uploads the bundle when done.
+func (s *Server) RequestDiagnostics(ctx context.Context, deviceID string, bundleID uuid.UUID) (*protocol.Response, error) {
+	command, err := protocol.NewCommandWithPayload(protocol.CmdDiagnostics, protocol.DiagnosticsPayload{
+		BundleID: bundleID.String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.SendCommand(ctx, deviceID, command)
+}
+
+// handleBundleChunk stores a part of a diagnostics bundle
+func (h *ConnectionHandler) handleBundleChunk(req *ssh.Request) {
+	var chunk protocol.BundleChunk
+	if err := json.Unmarshal(req.Payload, &chunk); err != nil {
+		h.logger.Error("Failed to parse diagnostics bundle chunk", err)
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+		return
+	}
+
+	if err := h.storeBundleChunk(&chunk); err != nil {
+		h.logger.Error(fmt.Sprintf("Failed to store part %d of diagnostics bundle %s", chunk.Part, chunk.BundleID), err)
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+		return
+	}
+
+	if req.WantReply {
+		req.Reply(true, nil)
+	}
+}
+
+// storeBundleChunk appends a part to a bundle of the device, completing it
+// with the last part. Parts arrive in order as the agent waits for each to be
+// acknowledged.
+func (h *ConnectionHandler) storeBundleChunk(chunk *protocol.BundleChunk) error {
+	bundleID, err := uuid.Parse(chunk.BundleID)
+	if err != nil {
+		return fmt.Errorf("invalid bundle ID: %w", err)
+	}
+
+	db := h.server.database.GetDB()
+	var device models.Device
+	if err := db.Where("device_id = ?", h.deviceID).First(&device).Error; err != nil {
+		return fmt.Errorf("failed to load device: %w", err)
+	}
+
+	var bundle models.DiagnosticsBundle
+	if err := db.Omit("data").Where("id = ? AND device_id = ?", bundleID, device.ID).First(&bundle).Error; err != nil {
+		return fmt.Errorf("failed to load bundle: %w", err)
+	}
+	if bundle.Status != models.BundleStatusPending && bundle.Status != models.BundleStatusUploading {
+		return fmt.Errorf("bundle is %s", bundle.Status)
+	}
+
+	now := time.Now()
+	updates := map[string]interface{}{}
+	switch {
+	case chunk.Error != "":
+		h.logger.Warn(fmt.Sprintf("Device could not collect diagnostics bundle %s: %s", bundleID, chunk.Error))
+		updates["status"] = models.BundleStatusFailed
+		updates["error"] = chunk.Error
+		updates["completed_at"] = now
+	case chunk.Part == 1:
+		updates["status"] = models.BundleStatusUploading
+		updates["data"] = chunk.Data
+		updates["size"] = len(chunk.Data)
+	case bundle.Status != models.BundleStatusUploading:
+		return fmt.Errorf("part %d arrived before the first one", chunk.Part)
+	case bundle.Size+int64(len(chunk.Data)) > protocol.MaxBundleSize:
+		db.Model(&bundle).Updates(map[string]interface{}{
+			"status":       models.BundleStatusFailed,
+			"error":        "bundle exceeds the size limit",
+			"data":         nil,
+			"completed_at": now,
+		})
+		return fmt.Errorf("bundle exceeds %d bytes", protocol.MaxBundleSize)
+	default:
+		updates["data"] = gorm.Expr("data || ?", chunk.Data)
+		updates["size"] = gorm.Expr("size + ?", len(chunk.Data))
+	}
+
+	if chunk.Error == "" && chunk.Part == chunk.Parts {
+		updates["status"] = models.BundleStatusReady
+		updates["completed_at"] = now
+	}
+
+	if err := db.Model(&bundle).Updates(updates).Error; err != nil {
+		return err
+	}
+	if updates["status"] == models.BundleStatusReady {
+		h.logger.Info(fmt.Sprintf("Received diagnostics bundle %s in %d parts", bundleID, chunk.Parts))
+		go h.server.offload(&models.DiagnosticsBundle{}, bundleID, fmt.Sprintf("diagnostics/%s/%s.tar.gz", device.ID, bundleID))
+	}
+	return nil
+}
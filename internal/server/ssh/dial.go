@@ -0,0 +1,77 @@
+package ssh
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+	"golang.org/x/crypto/ssh"
+)
+
+// DialUnix connects to a unix socket on a connected device through its
+// tunnel. Unlike forwards it is not checked against the tunnel policy, the
+// caller decides what may be reached. It counts against the device's
+// connection limit.
+func (s *Server) DialUnix(deviceID, path string) (net.Conn, error) {
+	conn, ok := s.GetDeviceConnection(deviceID)
+	if !ok {
+		return nil, ErrNotConnected
+	}
+
+	done, err := s.trackForward(deviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := ssh.Marshal(protocol.DirectUnixPayload{SocketPath: path})
+	ch, reqs, err := conn.Connection.OpenChannel(protocol.ChannelDirectUnix, payload)
+	if err != nil {
+		done()
+		return nil, fmt.Errorf("failed to open channel to %s: %w", path, err)
+	}
+	go ssh.DiscardRequests(reqs)
+
+	return &channelConn{
+		Channel: ch,
+		device:  deviceID,
+		path:    path,
+		done:    done,
+	}, nil
+}
+
+// channelConn is a net.Conn on top of an SSH channel. Deadlines are not
+// supported, a connection that hangs is closed along with the tunnel.
+type channelConn struct {
+	ssh.Channel
+	device string
+	path   string
+	done   func()
+	once   sync.Once
+}
+
+// Close closes the channel
+func (c *channelConn) Close() error {
+	c.once.Do(c.done)
+	return c.Channel.Close()
+}
+
+// LocalAddr returns the device the channel leads to
+func (c *channelConn) LocalAddr() net.Addr {
+	return &net.UnixAddr{Name: c.device, Net: "unix"}
+}
+
+// RemoteAddr returns the socket on the device
+func (c *channelConn) RemoteAddr() net.Addr {
+	return &net.UnixAddr{Name: c.path, Net: "unix"}
+}
+
+// SetDeadline is a no-op
+func (c *channelConn) SetDeadline(t time.Time) error { return nil }
+
+// SetReadDeadline is a no-op
+func (c *channelConn) SetReadDeadline(t time.Time) error { return nil }
+
+// SetWriteDeadline is a no-op
+func (c *channelConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,67 @@
+package ssh
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+// ApplyDisplay sends the kiosk display settings of a connected device to it
+// and records whether it took them
+func (s *Server) ApplyDisplay(ctx context.Context, device *models.Device) (*protocol.Response, error) {
+	db := s.database.GetDB()
+	var display models.DeviceDisplay
+	if err := db.Where("device_id = ?", device.ID).First(&display).Error; err != nil {
+		return nil, err
+	}
+
+	command, err := protocol.NewCommandWithPayload(protocol.CmdDisplay, display.Payload())
+	if err != nil {
+		return nil, err
+	}
+	response, err := s.SendCommand(ctx, device.DeviceID, command)
+	if err != nil {
+		return nil, err
+	}
+
+	updates := map[string]interface{}{"error": ""}
+	if response.Success {
+		updates["applied_at"] = time.Now()
+	} else {
+		updates["error"] = response.Message
+	}
+	if err := db.Model(&display).UpdateColumns(updates).Error; err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to record display settings of device %s", device.DeviceID), err)
+	}
+	return response, nil
+}
+
+// TakeScreenshot asks a connected device for a picture of its kiosk display
+func (s *Server) TakeScreenshot(ctx context.Context, deviceID string) (*protocol.Screenshot, error) {
+	command := protocol.NewCommand(protocol.CmdScreenshot, nil)
+	response, err := s.SendCommand(ctx, deviceID, command)
+	if err != nil {
+		return nil, err
+	}
+	if !response.Success {
+		return nil, errors.New(response.Message)
+	}
+
+	var screenshot protocol.Screenshot
+	data, err := json.Marshal(response.Data["screenshot"])
+	if err == nil {
+		err = json.Unmarshal(data, &screenshot)
+	}
+	if err != nil || len(screenshot.Image) == 0 {
+		return nil, fmt.Errorf("invalid screenshot reported by device %s", deviceID)
+	}
+	if len(screenshot.Image) > protocol.MaxScreenshotSize {
+		return nil, fmt.Errorf("screenshot exceeds %d bytes", protocol.MaxScreenshotSize)
+	}
+	return &screenshot, nil
+}
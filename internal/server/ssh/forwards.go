@@ -0,0 +1,558 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/server/events"
+	"github.com/edgetainer/edgetainer/internal/shared/forwarding"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+	"golang.org/x/crypto/ssh"
+)
+
+// Forward types
+const (
+	ForwardTCP     = "tcp"     // A TCP port on the device's loopback interface
+	ForwardUDP     = "udp"     // A UDP port on the device's loopback interface, carrying length-prefixed datagrams
+	ForwardUnix    = "unix"    // A unix socket on the device
+	ForwardDynamic = "dynamic" // A SOCKS5 proxy to the addresses the device's tunnel policy allows
+)
+
+var (
+	// ErrNotConnected is returned for devices without a tunnel
+	ErrNotConnected = errors.New("device is not connected")
+	// ErrInvalidForward is returned for forwards with a malformed target
+	ErrInvalidForward = errors.New("invalid forward")
+	// ErrForwardDenied is returned for forwards the device's tunnel policy
+	// does not allow
+	ErrForwardDenied = errors.New("forward not allowed by the device's tunnel policy")
+	// ErrForwardNotFound is returned when closing a forward that is not open
+	ErrForwardNotFound = errors.New("forward not found")
+	// ErrForwardLimit is returned when a device already has as many forwards
+	// open as its forward policy allows
+	ErrForwardLimit = errors.New("device has reached its forward limit")
+)
+
+// Defaults for forward policies, used unless SetForwardDefaults was called
+const (
+	defaultMaxForwards  = 10
+	defaultForwardsIdle = 5 * time.Minute
+)
+
+// forwardDefaults apply to devices whose fleet and own policy leave them open
+type forwardDefaults struct {
+	maxForwards int           // -1 for unlimited
+	idleTimeout time.Duration // Zero or negative to keep on-demand forwards open
+}
+
+// Forward is a listener on the server's loopback interface whose connections
+// are forwarded through a device tunnel. It is closed along with the tunnel,
+// on-demand forwards also once they went unused for the idle timeout.
+type Forward struct {
+	Port        int       `json:"port"` // Port on the server
+	Host        string    `json:"host"` // Address on the server the port is open on
+	Type        string    `json:"type"`
+	Target      string    `json:"target,omitempty"` // Device port or socket path, empty for dynamic forwards
+	Purpose     string    `json:"purpose"`
+	OnDemand    bool      `json:"on_demand"`              // Closed after the idle timeout
+	IdleTimeout int       `json:"idle_timeout,omitempty"` // Seconds, set for on-demand forwards
+	Created     time.Time `json:"created"`
+	LastUsed    time.Time `json:"last_used"`   // When the last connection through it ended, or it was opened
+	Connections int       `json:"connections"` // Connections currently open through it
+
+	listener net.Listener
+	idle     time.Duration
+	activity *forwardActivity
+}
+
+// forwardActivity tracks the use of a forward to tell when it went idle
+type forwardActivity struct {
+	active   atomic.Int32
+	lastUsed atomic.Int64 // Unix nanoseconds
+}
+
+// SetForwardDefaults sets how many forwards a device may have open and how
+// long on-demand forwards stay open without connections, for devices whose
+// fleet and own policy do not set them. It applies to tunnels opened after
+// the call and to tunnels whose policy is refreshed.
+func (s *Server) SetForwardDefaults(maxForwards int, idleTimeout time.Duration) {
+	s.forwardDefaults.Store(&forwardDefaults{maxForwards: maxForwards, idleTimeout: idleTimeout})
+}
+
+// OpenForward opens an on-demand forward to a connected device for an
+// operator. The target is a port for TCP forwards, a socket path for unix
+// forwards and empty for dynamic forwards. An open on-demand forward to the
+// same target for the same purpose is reused, the returned flag tells
+// whether a new one was opened.
+func (s *Server) OpenForward(deviceID, forwardType, target, purpose string) (*Forward, bool, error) {
+	conn, ok := s.GetDeviceConnection(deviceID)
+	if !ok {
+		return nil, false, ErrNotConnected
+	}
+
+	if forwardType == ForwardUnix && filepath.IsAbs(target) {
+		target = filepath.Clean(target)
+	}
+	s.mu.Lock()
+	for _, forward := range conn.ForwardPorts {
+		if forward.OnDemand && forward.Type == forwardType && forward.Target == target && forward.Purpose == purpose {
+			s.mu.Unlock()
+			forward.activity.lastUsed.Store(time.Now().UnixNano())
+			snapshot := forward.snapshot()
+			return &snapshot, false, nil
+		}
+	}
+	s.mu.Unlock()
+
+	forward, err := conn.Handler.openForward(forwardType, target, purpose, true)
+	if err != nil {
+		return nil, false, err
+	}
+	snapshot := forward.snapshot()
+	return &snapshot, true, nil
+}
+
+// Addr returns the address to connect to the forward at
+func (f *Forward) Addr() string {
+	return net.JoinHostPort(f.Host, strconv.Itoa(f.Port))
+}
+
+// snapshot returns a copy of the forward with its current use filled in
+func (f *Forward) snapshot() Forward {
+	copied := *f
+	copied.Connections = int(f.activity.active.Load())
+	copied.LastUsed = time.Unix(0, f.activity.lastUsed.Load())
+	return copied
+}
+
+// eventData describes a forward in the events about it
+func (f *Forward) eventData() map[string]interface{} {
+	return map[string]interface{}{
+		"port":    f.Port,
+		"type":    f.Type,
+		"target":  f.Target,
+		"purpose": f.Purpose,
+	}
+}
+
+// CloseForward closes a forward of a device. Connections already made
+// through it stay open.
+func (s *Server) CloseForward(deviceID string, port int) error {
+	s.mu.Lock()
+	var forward *Forward
+	if conn, ok := s.connections[deviceID]; ok {
+		forward = conn.ForwardPorts[port]
+	}
+	s.mu.Unlock()
+
+	if forward == nil {
+		return ErrForwardNotFound
+	}
+	forward.listener.Close()
+	return nil
+}
+
+// Forwards returns the open forwards of a device ordered by port
+func (s *Server) Forwards(deviceID string) []Forward {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	forwards := []Forward{}
+	if conn, ok := s.connections[deviceID]; ok {
+		for _, forward := range conn.ForwardPorts {
+			forwards = append(forwards, forward.snapshot())
+		}
+	}
+	sort.Slice(forwards, func(i, j int) bool { return forwards[i].Port < forwards[j].Port })
+	return forwards
+}
+
+// RefreshTunnelPolicy reloads the tunnel policy of a connected device, e.g.
+// after it or the forward policy of its fleet changed, and closes the
+// forwards it no longer allows
+func (s *Server) RefreshTunnelPolicy(deviceID string) {
+	if conn, ok := s.GetDeviceConnection(deviceID); ok {
+		s.applyTunnelPolicy(conn)
+	}
+}
+
+// applyTunnelPolicy loads the tunnel policy of a device into its connection,
+// with the forward policy resolved against its fleet and the server
+// defaults. The policy is left unchanged if it cannot be looked up, a
+// connection without one only allows TCP forwards.
+func (s *Server) applyTunnelPolicy(conn *DeviceConnection) {
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", conn.DeviceID).First(&device).Error; err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to look up tunnel policy for device %s", conn.DeviceID), err)
+		return
+	}
+
+	var fleet models.ForwardPolicy
+	if device.FleetID != nil {
+		var f models.Fleet
+		if err := s.database.GetDB().Where("id = ?", *device.FleetID).First(&f).Error; err == nil {
+			fleet = f.Forwards
+		}
+	}
+
+	policy := device.TunnelPolicy
+	policy.Forwards = s.effectiveForwardPolicy(device.TunnelPolicy.Forwards, fleet)
+	conn.Handler.policy.Store(&policy)
+
+	s.mu.Lock()
+	var denied []*Forward
+	for _, forward := range conn.ForwardPorts {
+		if !allowsForward(&policy, forward.Type, forward.Target, forward.Purpose) {
+			denied = append(denied, forward)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, forward := range denied {
+		s.logger.Info(fmt.Sprintf("Closing %s forward on port %d of device %s, no longer allowed", forward.Type, forward.Port, conn.DeviceID))
+		forward.listener.Close()
+	}
+}
+
+// effectiveForwardPolicy resolves the forward policy of a device, each field
+// falling back to the fleet's and then to the server default
+func (s *Server) effectiveForwardPolicy(device, fleet models.ForwardPolicy) models.ForwardPolicy {
+	defaults := s.forwardDefaults.Load()
+	if defaults == nil {
+		defaults = &forwardDefaults{maxForwards: defaultMaxForwards, idleTimeout: defaultForwardsIdle}
+	}
+
+	policy := device
+	if policy.MaxForwards == 0 {
+		policy.MaxForwards = fleet.MaxForwards
+	}
+	if policy.MaxForwards == 0 {
+		policy.MaxForwards = defaults.maxForwards
+	}
+	if len(policy.Purposes) == 0 {
+		policy.Purposes = fleet.Purposes
+	}
+	if len(policy.Ports) == 0 {
+		policy.Ports = fleet.Ports
+	}
+	if policy.DeviceRequests == nil {
+		policy.DeviceRequests = fleet.DeviceRequests
+	}
+	if policy.IdleTimeout == 0 {
+		policy.IdleTimeout = fleet.IdleTimeout
+	}
+	if policy.IdleTimeout == 0 {
+		policy.IdleTimeout = int(defaults.idleTimeout.Seconds())
+		if defaults.idleTimeout <= 0 {
+			policy.IdleTimeout = -1
+		}
+	}
+	return policy
+}
+
+// allowsForward reports whether a policy allows a forward
+func allowsForward(policy *models.TunnelPolicy, forwardType, target, purpose string) bool {
+	if purposes := policy.Forwards.Purposes; len(purposes) > 0 && !slices.Contains(purposes, purpose) {
+		return false
+	}
+	if purpose == models.ForwardPurposeDevice && (policy.Forwards.DeviceRequests == nil || !*policy.Forwards.DeviceRequests) {
+		return false
+	}
+
+	switch forwardType {
+	case ForwardTCP, ForwardUDP:
+		port, _ := strconv.Atoi(target)
+		return allowsPort(policy, port)
+	case ForwardUnix:
+		for _, path := range policy.UnixSockets {
+			if filepath.Clean(path) == target {
+				return true
+			}
+		}
+		return false
+	case ForwardDynamic:
+		return policy.Dynamic
+	default:
+		return false
+	}
+}
+
+// allowsPort reports whether a policy lets forwards reach a port of the device
+func allowsPort(policy *models.TunnelPolicy, port int) bool {
+	ports := policy.Forwards.Ports
+	return len(ports) == 0 || slices.Contains(ports, port)
+}
+
+// allowsHost reports whether a policy lets dynamic forwards connect to a
+// host. The device itself is always allowed.
+func allowsHost(policy *models.TunnelPolicy, host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return true
+	}
+	for _, allowed := range policy.DynamicHosts {
+		if allowed == "*" || strings.EqualFold(allowed, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// currentPolicy returns the tunnel policy of the connection, empty until it
+// has been loaded
+func (h *ConnectionHandler) currentPolicy() *models.TunnelPolicy {
+	if policy := h.policy.Load(); policy != nil {
+		return policy
+	}
+	return &models.TunnelPolicy{}
+}
+
+// openForward validates a forward against the tunnel policy and starts
+// listening for it on a port of the port range. On-demand forwards are
+// closed once unused for the idle timeout of the policy.
+func (h *ConnectionHandler) openForward(forwardType, target, purpose string, onDemand bool) (*Forward, error) {
+	switch forwardType {
+	case ForwardTCP, ForwardUDP:
+		port, err := strconv.Atoi(target)
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("%w: target must be a port", ErrInvalidForward)
+		}
+	case ForwardUnix:
+		if !filepath.IsAbs(target) {
+			return nil, fmt.Errorf("%w: target must be an absolute socket path", ErrInvalidForward)
+		}
+		target = filepath.Clean(target)
+	case ForwardDynamic:
+		if target != "" {
+			return nil, fmt.Errorf("%w: dynamic forwards have no target", ErrInvalidForward)
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown type %s", ErrInvalidForward, forwardType)
+	}
+
+	policy := h.currentPolicy()
+	if !allowsForward(policy, forwardType, target, purpose) {
+		return nil, ErrForwardDenied
+	}
+
+	port, err := h.server.portManager.AllocatePort()
+	if err != nil {
+		return nil, fmt.Errorf("failed to allocate port: %w", err)
+	}
+
+	host := "127.0.0.1"
+	if forwardHost := h.server.forwardHost.Load(); forwardHost != nil && *forwardHost != "" {
+		host = *forwardHost
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		h.server.portManager.ReleasePort(port)
+		return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+
+	now := time.Now()
+	forward := &Forward{
+		Port:     port,
+		Host:     host,
+		Type:     forwardType,
+		Target:   target,
+		Purpose:  purpose,
+		OnDemand: onDemand,
+		Created:  now,
+		listener: listener,
+		activity: &forwardActivity{},
+	}
+	forward.activity.lastUsed.Store(now.UnixNano())
+	if onDemand && policy.Forwards.IdleTimeout > 0 {
+		forward.IdleTimeout = policy.Forwards.IdleTimeout
+		forward.idle = time.Duration(policy.Forwards.IdleTimeout) * time.Second
+	}
+
+	// Register the forward with the connection, unless it was replaced in
+	// the meantime or has as many forwards as the policy allows
+	h.server.mu.Lock()
+	conn, ok := h.server.connections[h.deviceID]
+	switch {
+	case !ok || conn.Handler != h:
+		err = ErrNotConnected
+	case policy.Forwards.MaxForwards > 0 && len(conn.ForwardPorts) >= policy.Forwards.MaxForwards:
+		err = ErrForwardLimit
+	default:
+		conn.ForwardPorts[port] = forward
+	}
+	h.server.mu.Unlock()
+
+	if err != nil {
+		listener.Close()
+		h.server.portManager.ReleasePort(port)
+		return nil, err
+	}
+
+	go h.serveForward(forward)
+
+	h.logger.Info(fmt.Sprintf("Opened %s forward on port %d to %s for %s", forwardType, port, target, purpose))
+	h.server.bus.Publish(events.NewEvent(events.ForwardOpened, h.deviceID, forward.eventData()))
+	return forward, nil
+}
+
+// closeWhenIdle closes an on-demand forward once no connection went through
+// it for its idle timeout
+func (h *ConnectionHandler) closeWhenIdle(forward *Forward, done <-chan struct{}) {
+	ticker := time.NewTicker(max(forward.idle/4, time.Second))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if forward.activity.active.Load() > 0 {
+				continue
+			}
+			lastUsed := time.Unix(0, forward.activity.lastUsed.Load())
+			if time.Since(lastUsed) >= forward.idle {
+				h.logger.Info(fmt.Sprintf("Closing %s forward on port %d, unused for %v", forward.Type, forward.Port, forward.idle))
+				forward.listener.Close()
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// serveForward accepts connections on a forward until it or the tunnel is
+// closed
+func (h *ConnectionHandler) serveForward(forward *Forward) {
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		forward.listener.Close()
+		h.server.portManager.ReleasePort(forward.Port)
+
+		h.server.mu.Lock()
+		if conn, ok := h.server.connections[h.deviceID]; ok && conn.ForwardPorts[forward.Port] == forward {
+			delete(conn.ForwardPorts, forward.Port)
+		}
+		h.server.mu.Unlock()
+
+		h.server.bus.Publish(events.NewEvent(events.ForwardClosed, h.deviceID, forward.eventData()))
+	}()
+
+	// Accept only returns once the listener is closed, so close it when the
+	// connection ends
+	go func() {
+		select {
+		case <-h.ctx.Done():
+			forward.listener.Close()
+		case <-done:
+		}
+	}()
+
+	if forward.idle > 0 {
+		go h.closeWhenIdle(forward, done)
+	}
+
+	for {
+		local, err := forward.listener.Accept()
+		if err != nil {
+			if h.ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			h.logger.Error("Failed to accept connection on forwarded port", err)
+			continue
+		}
+
+		go h.handleForwardedConnection(forward, local)
+	}
+}
+
+// handleForwardedConnection forwards a connection through the tunnel to the
+// target of a forward
+func (h *ConnectionHandler) handleForwardedConnection(forward *Forward, local net.Conn) {
+	defer local.Close()
+
+	done, err := h.server.trackForward(h.deviceID)
+	if err != nil {
+		h.logger.Warn(fmt.Sprintf("Refusing connection on forward %d: %v", forward.Port, err))
+		return
+	}
+	defer done()
+
+	forward.activity.active.Add(1)
+	defer func() {
+		forward.activity.lastUsed.Store(time.Now().UnixNano())
+		forward.activity.active.Add(-1)
+	}()
+
+	var channelType, target string
+	var payload []byte
+	switch forward.Type {
+	case ForwardTCP:
+		port, _ := strconv.Atoi(forward.Target)
+		channelType, target = protocol.ChannelDirectTCP, net.JoinHostPort("127.0.0.1", forward.Target)
+		payload = ssh.Marshal(protocol.DirectTCPPayload{Host: "127.0.0.1", Port: uint32(port)})
+
+	case ForwardUDP:
+		port, _ := strconv.Atoi(forward.Target)
+		channelType, target = protocol.ChannelDirectUDP, net.JoinHostPort("127.0.0.1", forward.Target)
+		payload = ssh.Marshal(protocol.DirectUDPPayload{Host: "127.0.0.1", Port: uint32(port)})
+
+	case ForwardUnix:
+		channelType, target = protocol.ChannelDirectUnix, forward.Target
+		payload = ssh.Marshal(protocol.DirectUnixPayload{SocketPath: forward.Target})
+
+	case ForwardDynamic:
+		host, port, err := readSocksRequest(local)
+		if err != nil {
+			h.logger.Debug(fmt.Sprintf("Invalid request on dynamic forward %d: %v", forward.Port, err))
+			return
+		}
+		target = net.JoinHostPort(host, strconv.Itoa(port))
+
+		// The policy is checked for every connection, it may have changed
+		// since the forward was opened
+		if policy := h.currentPolicy(); !allowsHost(policy, host) || !allowsPort(policy, port) {
+			h.logger.Warn(fmt.Sprintf("Dynamic forward %d to %s not allowed by the tunnel policy", forward.Port, target))
+			writeSocksReply(local, socksNotAllowed)
+			return
+		}
+		channelType = protocol.ChannelDirectTCP
+		payload = ssh.Marshal(protocol.DirectTCPPayload{Host: host, Port: uint32(port)})
+	}
+
+	ch, reqs, err := h.conn.OpenChannel(channelType, payload)
+	if err != nil {
+		h.logger.Error(fmt.Sprintf("Failed to open channel to %s", target), err)
+		if forward.Type == ForwardDynamic {
+			writeSocksReply(local, socksHostUnreachable)
+		}
+		return
+	}
+	defer ch.Close()
+
+	// Discard requests
+	go ssh.DiscardRequests(reqs)
+
+	if forward.Type == ForwardDynamic {
+		if err := writeSocksReply(local, socksSucceeded); err != nil {
+			return
+		}
+	}
+
+	limits := h.server.connectionLimits().Limits
+	if ended := forwarding.Pipe(local, ch, limits); ended != forwarding.EndClosed {
+		h.logger.Info(fmt.Sprintf("Closed connection to %s on forward %d, %s limit reached", target, forward.Port, ended))
+		forwardLimitHits.WithLabelValues(ended).Inc()
+	}
+}
@@ -0,0 +1,77 @@
+package ssh
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/server/events"
+	"github.com/edgetainer/edgetainer/internal/server/metrics"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+// AlertHardwareMismatch is the alert fired when a device reports other
+// hardware than it is bound to
+const AlertHardwareMismatch = "hardware_mismatch"
+
+var hardwareMismatches = metrics.NewCounter("edgetainer_ssh_hardware_mismatches_total",
+	"Heartbeats of devices that reported other hardware than they are bound to, or none.")
+
+// SetHardwareBinding sets what happens when a device reports other hardware
+// than it is bound to, see protocol.HardwareAlert and
+// protocol.HardwareReject
+func (s *Server) SetHardwareBinding(mode string) {
+	s.rejectHardware.Store(mode == protocol.HardwareReject)
+}
+
+// checkHardware binds a device to the hardware in its first attested
+// heartbeat and compares later ones against it. A bound device that reports
+// other hardware, or none, fires an alert once per connection. It reports
+// false when the connection has to be closed.
+func (h *ConnectionHandler) checkHardware(device *models.Device, hardwareID string, now time.Time) bool {
+	switch {
+	case device.HardwareID == hardwareID:
+		return true
+
+	case device.HardwareID == "":
+		result := h.server.database.GetDB().Model(&models.Device{}).
+			Where("id = ? AND hardware_id = ?", device.ID, "").
+			Updates(map[string]interface{}{"hardware_id": hardwareID, "hardware_bound_at": now})
+		if result.Error != nil {
+			h.logger.Error("Failed to bind device to its hardware", result.Error)
+		} else if result.RowsAffected > 0 {
+			h.logger.Info(fmt.Sprintf("Device bound to hardware %s", shortHardwareID(hardwareID)))
+		}
+		return true
+	}
+
+	hardwareMismatches.Inc()
+	reject := h.server.rejectHardware.Load()
+	reported := shortHardwareID(hardwareID)
+	if hardwareID == "" {
+		reported = "none"
+	}
+	h.logger.Warn(fmt.Sprintf("Device reported hardware %s, it is bound to %s", reported, shortHardwareID(device.HardwareID)))
+
+	if !h.hardwareAlerted {
+		h.hardwareAlerted = true
+		data := map[string]interface{}{
+			"alert":       AlertHardwareMismatch,
+			"name":        device.Name,
+			"bound_to":    device.HardwareID,
+			"reported":    hardwareID,
+			"remote_addr": h.conn.RemoteAddr().String(),
+			"rejected":    reject,
+		}
+		h.server.bus.Publish(events.NewEvent(events.AlertFiring, h.deviceID, data))
+	}
+	return !reject
+}
+
+// shortHardwareID shortens a hardware ID for log messages
+func shortHardwareID(hardwareID string) string {
+	if len(hardwareID) > 19 {
+		return hardwareID[:19]
+	}
+	return hardwareID
+}
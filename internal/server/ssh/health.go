@@ -0,0 +1,166 @@
+package ssh
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/edgetainer/edgetainer/internal/server/events"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+// Alerts fired on the hardware health devices report
+const (
+	AlertTemperatureHigh = "temperature_high" // A thermal zone is above the maximum temperature
+	AlertDiskFailing     = "disk_failing"     // SMART or eMMC wear reports a disk failing
+	AlertOnBattery       = "on_battery"       // A battery or UPS powers the device
+	AlertBatteryLow      = "battery_low"      // A battery or UPS powering the device is below the minimum charge
+	AlertProtectionLost  = "protection_lost"  // The agent could not protect itself and Docker from applications
+)
+
+// hostHealthLimits are the limits past which host health alerts fire
+type hostHealthLimits struct {
+	maxTemperature float64 // Degrees Celsius, negative for no alerts
+	minBattery     int     // Percent charged, negative for no alerts
+}
+
+// SetHostHealthLimits sets the temperature in degrees Celsius above which a
+// thermal zone of a device fires an alert, and the charge in percent below
+// which a battery powering a device does. Negative values disable them.
+func (s *Server) SetHostHealthLimits(maxTemperature float64, minBattery int) {
+	s.healthLimits.Store(&hostHealthLimits{maxTemperature: maxTemperature, minBattery: minBattery})
+}
+
+// hostHealth reads the hardware health from the system metrics of a
+// heartbeat. Disk health is read far less often than heartbeats are sent, so
+// the last one reported is kept while the agent has not read it yet.
+func hostHealth(metrics map[string]interface{}, previous *protocol.HostHealth) (*protocol.HostHealth, error) {
+	data, err := json.Marshal(metrics)
+	if err != nil {
+		return nil, err
+	}
+	var health protocol.HostHealth
+	if err := json.Unmarshal(data, &health); err != nil {
+		return nil, err
+	}
+	if health.Disks == nil && previous != nil {
+		health.Disks = previous.Disks
+	}
+	return &health, nil
+}
+
+// checkHostHealth fires an alert for each thermal zone, disk and power
+// supply of a device that turned unhealthy since the previous heartbeat, and
+// when the agent lost its protection. Only a change fires, not every
+// heartbeat after it.
+func (h *ConnectionHandler) checkHostHealth(device *models.Device, health *protocol.HostHealth) {
+	limits := h.server.healthLimits.Load()
+	if limits == nil {
+		return
+	}
+	previous := device.HostHealth
+	if previous == nil {
+		previous = &protocol.HostHealth{}
+	}
+
+	fire := func(alert string, data map[string]interface{}) {
+		data["alert"] = alert
+		data["name"] = device.Name
+		h.server.bus.Publish(events.NewEvent(events.AlertFiring, h.deviceID, data))
+	}
+
+	if limits.maxTemperature >= 0 {
+		for zone, temperature := range health.Temperatures {
+			if temperature <= limits.maxTemperature {
+				continue
+			}
+			if was, ok := previous.Temperatures[zone]; ok && was > limits.maxTemperature {
+				continue
+			}
+			h.logger.Warn(fmt.Sprintf("Thermal zone %s is at %.1f°C", zone, temperature))
+			fire(AlertTemperatureHigh, map[string]interface{}{
+				"zone":            zone,
+				"temperature":     temperature,
+				"max_temperature": limits.maxTemperature,
+			})
+		}
+	}
+
+	for _, disk := range health.Disks {
+		if disk.Healthy {
+			continue
+		}
+		if was := findDisk(previous.Disks, disk.Name); was != nil && !was.Healthy {
+			continue
+		}
+		h.logger.Warn(fmt.Sprintf("Disk %s (%s) is failing", disk.Name, disk.Model))
+		data := map[string]interface{}{
+			"disk":   disk.Name,
+			"model":  disk.Model,
+			"source": disk.Source,
+		}
+		if disk.PercentUsed != nil {
+			data["percent_used"] = *disk.PercentUsed
+		}
+		fire(AlertDiskFailing, data)
+	}
+
+	for _, supply := range health.Power {
+		if !supply.OnBattery() {
+			continue
+		}
+		was := findPowerSupply(previous.Power, supply.Name)
+		if was == nil || !was.OnBattery() {
+			h.logger.Warn(fmt.Sprintf("Device is running on %s", supply.Name))
+			data := map[string]interface{}{"supply": supply.Name, "type": supply.Type}
+			if supply.Capacity != nil {
+				data["capacity"] = *supply.Capacity
+			}
+			fire(AlertOnBattery, data)
+		}
+
+		if limits.minBattery < 0 || supply.Capacity == nil || *supply.Capacity >= limits.minBattery {
+			continue
+		}
+		if was != nil && was.OnBattery() && was.Capacity != nil && *was.Capacity < limits.minBattery {
+			continue
+		}
+		h.logger.Warn(fmt.Sprintf("%s is down to %d%%", supply.Name, *supply.Capacity))
+		fire(AlertBatteryLow, map[string]interface{}{
+			"supply":      supply.Name,
+			"type":        supply.Type,
+			"capacity":    *supply.Capacity,
+			"min_battery": limits.minBattery,
+		})
+	}
+
+	if protection := health.Protection; protection != nil && !protection.OK &&
+		(previous.Protection == nil || previous.Protection.OK) {
+		h.logger.Warn(fmt.Sprintf("Agent could not protect itself and Docker: %s", protection.Error))
+		fire(AlertProtectionLost, map[string]interface{}{
+			"units": protection.Units,
+			"error": protection.Error,
+		})
+	}
+}
+
+// findDisk returns the disk with the given name, nil if there is none
+func findDisk(disks []protocol.DiskHealth, name string) *protocol.DiskHealth {
+	for i := range disks {
+		if disks[i].Name == name {
+			return &disks[i]
+		}
+	}
+	return nil
+}
+
+// findPowerSupply returns the power supply with the given name, nil if there
+// is none
+func findPowerSupply(supplies []protocol.PowerSupply, name string) *protocol.PowerSupply {
+	for i := range supplies {
+		if supplies[i].Name == name {
+			return &supplies[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,270 @@
+package ssh
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/server/metrics"
+)
+
+// Defaults for heartbeat batching, used unless SetHeartbeatBatching was called
+const (
+	defaultHeartbeatFlush = time.Second
+	defaultHeartbeatBatch = 500
+	defaultHeartbeatQueue = 10000
+)
+
+var (
+	heartbeatQueueDepth = metrics.NewGauge("edgetainer_ssh_heartbeat_queue_depth",
+		"Devices with heartbeat data waiting to be written to the database.")
+	heartbeatsCoalesced = metrics.NewCounter("edgetainer_ssh_heartbeats_coalesced_total",
+		"Heartbeats merged into a write of the same device that was still queued.")
+	heartbeatsDropped = metrics.NewCounter("edgetainer_ssh_heartbeats_dropped_total",
+		"Queued heartbeat writes dropped because the queue was full.")
+	heartbeatsWritten = metrics.NewCounter("edgetainer_ssh_heartbeats_written_total",
+		"Heartbeat writes stored in the database.")
+	heartbeatFlushFailures = metrics.NewCounter("edgetainer_ssh_heartbeat_flush_failures_total",
+		"Batches of heartbeat writes the database rejected.")
+)
+
+// heartbeatColumns are the device columns a heartbeat may set, with their SQL
+// types. Columns a heartbeat did not report keep their value.
+var heartbeatColumns = []struct {
+	name    string
+	sqlType string
+}{
+	{"last_seen", "timestamptz"},
+	{"ip_address", "text"},
+	{"ip_addresses", "text"},
+	{"agent_version", "text"},
+	{"agent_commit", "text"},
+	{"agent_build_date", "text"},
+	{"agent_features", "text"},
+	{"platforms", "text"},
+	{"os", "text"},
+	{"os_version", "text"},
+	{"clock_skew", "double precision"},
+	{"clock_checked_at", "timestamptz"},
+	{"latitude", "double precision"},
+	{"longitude", "double precision"},
+	{"location_source", "text"},
+	{"location_accuracy", "double precision"},
+	{"location_updated_at", "timestamptz"},
+	{"address", "text"},
+	{"plugins", "text"},
+	{"plugin_metrics", "text"},
+	{"host_health", "text"},
+	{"host_services", "text"},
+}
+
+// maxHeartbeatRows is how many devices fit into one UPDATE. Every device
+// binds its ID and a value of every heartbeat column, and Postgres allows
+// 65535 parameters per statement.
+var maxHeartbeatRows = 65535 / (len(heartbeatColumns) + 1)
+
+// heartbeatSettings controls how heartbeat writes are batched
+type heartbeatSettings struct {
+	flush time.Duration // Longest a write waits in the queue
+	batch int           // Writes per UPDATE statement, a full batch is written right away
+	queue int           // Devices that may wait, the oldest is dropped beyond that
+}
+
+// SetHeartbeatBatching sets how long heartbeat writes may wait to be batched,
+// how many go into one UPDATE and how many devices may have writes queued.
+// It applies when the server starts.
+func (s *Server) SetHeartbeatBatching(flush time.Duration, batch, queue int) {
+	s.heartbeatSettings.Store(&heartbeatSettings{
+		flush: flush,
+		batch: max(batch, 1),
+		queue: max(queue, 1),
+	})
+}
+
+// heartbeatQueue holds the device columns reported in heartbeats until they
+// are written. A device has at most one queued write, later heartbeats are
+// merged into it, so a slow database makes writes bigger rather than the
+// queue longer. When more devices wait than the queue holds, the oldest write
+// is dropped, the device reports the same data with its next heartbeat.
+type heartbeatQueue struct {
+	mu       sync.Mutex
+	pending  map[string]map[string]interface{} // Device ID -> column values
+	order    []string                          // Device IDs, oldest first
+	capacity int
+	batch    int
+	full     chan struct{} // Signalled when a batch is ready
+}
+
+// newHeartbeatQueue creates an empty queue
+func newHeartbeatQueue(capacity, batch int) *heartbeatQueue {
+	return &heartbeatQueue{
+		pending:  make(map[string]map[string]interface{}),
+		capacity: capacity,
+		batch:    batch,
+		full:     make(chan struct{}, 1),
+	}
+}
+
+// add queues the columns reported by a device, merging them into a write that
+// is still waiting
+func (q *heartbeatQueue) add(deviceID string, columns map[string]interface{}) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if queued, ok := q.pending[deviceID]; ok {
+		for column, value := range columns {
+			queued[column] = value
+		}
+		heartbeatsCoalesced.Inc()
+		return
+	}
+
+	if len(q.order) >= q.capacity {
+		oldest := q.order[0]
+		q.order = q.order[1:]
+		delete(q.pending, oldest)
+		heartbeatsDropped.Inc()
+	}
+	q.pending[deviceID] = columns
+	q.order = append(q.order, deviceID)
+	heartbeatQueueDepth.Set(float64(len(q.order)))
+
+	if len(q.order) >= q.batch {
+		select {
+		case q.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// len returns the number of devices with a queued write
+func (q *heartbeatQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.order)
+}
+
+// take removes up to n of the oldest writes from the queue
+func (q *heartbeatQueue) take(n int) ([]string, []map[string]interface{}) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n = min(n, len(q.order))
+	deviceIDs := make([]string, n)
+	copy(deviceIDs, q.order[:n])
+	q.order = q.order[n:]
+
+	writes := make([]map[string]interface{}, n)
+	for i, deviceID := range deviceIDs {
+		writes[i] = q.pending[deviceID]
+		delete(q.pending, deviceID)
+	}
+	heartbeatQueueDepth.Set(float64(len(q.order)))
+	return deviceIDs, writes
+}
+
+// writeHeartbeats writes queued heartbeats every flush interval, or as soon as
+// a batch is full, until the server stops. What is left is written on the way
+// out.
+func (s *Server) writeHeartbeats(settings *heartbeatSettings) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(settings.flush)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.flushHeartbeats(settings.batch, true)
+		case <-s.heartbeats.full:
+			s.flushHeartbeats(settings.batch, false)
+		case <-s.ctx.Done():
+			s.flushHeartbeats(settings.batch, true)
+			return
+		}
+	}
+}
+
+// flushHeartbeats writes full batches, and with all set the partial batch
+// left after them
+func (s *Server) flushHeartbeats(batch int, all bool) {
+	for {
+		queued := s.heartbeats.len()
+		if queued == 0 || (queued < batch && !all) {
+			return
+		}
+
+		deviceIDs, writes := s.heartbeats.take(batch)
+		if err := s.updateDevices(deviceIDs, writes); err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to write heartbeats of %d devices", len(deviceIDs)), err)
+			heartbeatFlushFailures.Inc()
+			continue
+		}
+		heartbeatsWritten.Add(float64(len(deviceIDs)))
+	}
+}
+
+// heartbeatUpdate is an UPDATE of devices with the values of their heartbeats
+type heartbeatUpdate struct {
+	query string
+	args  []interface{}
+}
+
+// updateDevices writes a batch of heartbeats with an UPDATE joined against the
+// reported values, split into several when the batch binds more parameters
+// than a statement may
+func (s *Server) updateDevices(deviceIDs []string, writes []map[string]interface{}) error {
+	for _, update := range heartbeatUpdates(deviceIDs, writes) {
+		if err := s.database.GetDB().Exec(update.query, update.args...).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// heartbeatUpdates builds the UPDATEs writing a batch of heartbeats, each of
+// at most maxHeartbeatRows devices
+func heartbeatUpdates(deviceIDs []string, writes []map[string]interface{}) []heartbeatUpdate {
+	var updates []heartbeatUpdate
+	for start := 0; start < len(deviceIDs); start += maxHeartbeatRows {
+		end := min(start+maxHeartbeatRows, len(deviceIDs))
+		updates = append(updates, heartbeatUpdateOf(deviceIDs[start:end], writes[start:end]))
+	}
+	return updates
+}
+
+// heartbeatUpdateOf builds a single UPDATE writing the heartbeats of devices
+func heartbeatUpdateOf(deviceIDs []string, writes []map[string]interface{}) heartbeatUpdate {
+	names := make([]string, 0, len(heartbeatColumns)+1)
+	assignments := []string{"updated_at = v.last_seen"}
+	placeholders := make([]string, 0, len(heartbeatColumns)+1)
+
+	names = append(names, "device_id")
+	placeholders = append(placeholders, "?::text")
+	for _, column := range heartbeatColumns {
+		names = append(names, column.name)
+		placeholders = append(placeholders, "?::"+column.sqlType)
+		if column.name == "last_seen" {
+			assignments = append(assignments, "last_seen = v.last_seen")
+		} else {
+			assignments = append(assignments, fmt.Sprintf("%s = COALESCE(v.%s, devices.%s)", column.name, column.name, column.name))
+		}
+	}
+	row := "(" + strings.Join(placeholders, ", ") + ")"
+
+	rows := make([]string, len(deviceIDs))
+	args := make([]interface{}, 0, len(deviceIDs)*len(names))
+	for i, deviceID := range deviceIDs {
+		rows[i] = row
+		args = append(args, deviceID)
+		for _, column := range heartbeatColumns {
+			args = append(args, writes[i][column.name])
+		}
+	}
+
+	query := fmt.Sprintf("UPDATE devices SET %s FROM (VALUES %s) AS v(%s) WHERE devices.device_id = v.device_id AND devices.deleted_at IS NULL",
+		strings.Join(assignments, ", "), strings.Join(rows, ", "), strings.Join(names, ", "))
+	return heartbeatUpdate{query: query, args: args}
+}
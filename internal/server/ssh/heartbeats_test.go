@@ -0,0 +1,47 @@
+package ssh
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHeartbeatUpdatesOfMaximumBatch(t *testing.T) {
+	// The largest ssh.heartbeats.batch_size the configuration accepts
+	const batch = 5000
+
+	deviceIDs := make([]string, batch)
+	writes := make([]map[string]interface{}, batch)
+	for i := range deviceIDs {
+		deviceIDs[i] = fmt.Sprintf("device-%04d", i)
+		writes[i] = map[string]interface{}{"last_seen": time.Now(), "ip_address": "192.0.2.1"}
+	}
+
+	updates := heartbeatUpdates(deviceIDs, writes)
+	if len(updates) < 2 {
+		t.Fatalf("%d devices written with %d statements, want them split", batch, len(updates))
+	}
+
+	var written []string
+	for i, update := range updates {
+		if len(update.args) > 65535 {
+			t.Errorf("statement %d binds %d parameters, Postgres allows 65535", i, len(update.args))
+		}
+		if placeholders := strings.Count(update.query, "?"); placeholders != len(update.args) {
+			t.Errorf("statement %d has %d placeholders for %d parameters", i, placeholders, len(update.args))
+		}
+		for j := 0; j < len(update.args); j += len(heartbeatColumns) + 1 {
+			written = append(written, update.args[j].(string))
+		}
+	}
+
+	if len(written) != batch {
+		t.Fatalf("%d devices written, want %d", len(written), batch)
+	}
+	for i, deviceID := range written {
+		if deviceID != deviceIDs[i] {
+			t.Fatalf("device %d written as %s, want %s", i, deviceID, deviceIDs[i])
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package ssh
+
+import (
+	"fmt"
+
+	"github.com/edgetainer/edgetainer/internal/server/events"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+// AlertHostServiceDown is the alert fired when a monitored host service of a
+// device stops or fails
+const AlertHostServiceDown = "host_service_down"
+
+// checkHostServices fires an alert for each host service of a device that went
+// down since the previous heartbeat. A service first reported down fires
+// too, but not every heartbeat after it.
+func (h *ConnectionHandler) checkHostServices(device *models.Device, services []protocol.HostService) {
+	for _, service := range services {
+		if service.Up() {
+			continue
+		}
+		if was := findHostService(device.HostServices, service.Kind, service.Name); was != nil && !was.Up() {
+			continue
+		}
+
+		h.logger.Warn(fmt.Sprintf("Host service %s is %s", service.Name, service.State))
+		data := map[string]interface{}{
+			"alert":   AlertHostServiceDown,
+			"name":    device.Name,
+			"service": service.Name,
+			"kind":    service.Kind,
+			"state":   service.State,
+		}
+		if service.SubState != "" {
+			data["sub_state"] = service.SubState
+		}
+		h.server.bus.Publish(events.NewEvent(events.AlertFiring, h.deviceID, data))
+	}
+}
+
+// findHostService returns the service of the given kind and name, nil if there
+// is none
+func findHostService(services []protocol.HostService, kind, name string) *protocol.HostService {
+	for i := range services {
+		if services[i].Kind == kind && services[i].Name == name {
+			return &services[i]
+		}
+	}
+	return nil
+}
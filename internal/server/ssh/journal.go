@@ -0,0 +1,80 @@
+package ssh
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/credentials"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+	"golang.org/x/crypto/ssh"
+)
+
+// maxJournalUnit is the longest unit name stored with a journal entry
+const maxJournalUnit = 256
+
+// handleJournal stores journald entries of the host shipped by the agent as
+// device logs, timestamped when journald received them
+func (h *ConnectionHandler) handleJournal(req *ssh.Request) {
+	var batch protocol.JournalBatch
+	if err := json.Unmarshal(req.Payload, &batch); err != nil || len(batch.Entries) > protocol.MaxJournalBatch {
+		h.logger.Error("Failed to parse journal entries", err)
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+		return
+	}
+
+	var device models.Device
+	if err := h.server.database.GetDB().Where("device_id = ?", h.deviceID).First(&device).Error; err != nil {
+		h.logger.Error("Failed to load device for journal entries", err)
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+		return
+	}
+
+	now := time.Now()
+	logs := make([]models.DeviceLog, 0, len(batch.Entries))
+	for _, entry := range batch.Entries {
+		priority := min(max(entry.Priority, 0), len(protocol.JournalPriorities)-1)
+		log := models.DeviceLog{
+			DeviceID:  device.ID,
+			LogType:   models.DeviceLogTypeJournal,
+			Unit:      entry.Unit,
+			Priority:  &priority,
+			Message:   credentials.Redact(entry.Message),
+			CreatedAt: entry.Time,
+		}
+		if len(log.Unit) > maxJournalUnit {
+			log.Unit = log.Unit[:maxJournalUnit]
+		}
+		if len(log.Message) > protocol.MaxJournalMessage {
+			log.Message = log.Message[:protocol.MaxJournalMessage]
+		}
+		// Postgres takes neither invalid UTF-8, e.g. a rune cut above, nor NUL
+		log.Unit = strings.ToValidUTF8(strings.ReplaceAll(log.Unit, "\x00", ""), "")
+		log.Message = strings.ToValidUTF8(strings.ReplaceAll(log.Message, "\x00", ""), "")
+		// Entries from a clock far off are kept in order of arrival
+		if log.CreatedAt.IsZero() || log.CreatedAt.After(now.Add(time.Hour)) {
+			log.CreatedAt = now
+		}
+		logs = append(logs, log)
+	}
+
+	if len(logs) > 0 {
+		if err := h.server.database.GetDB().Create(&logs).Error; err != nil {
+			h.logger.Error(fmt.Sprintf("Failed to store %d journal entries", len(logs)), err)
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+			return
+		}
+	}
+
+	if req.WantReply {
+		req.Reply(true, nil)
+	}
+}
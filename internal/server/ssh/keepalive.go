@@ -0,0 +1,91 @@
+package ssh
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+// keepaliveSettings controls how the server probes device connections
+type keepaliveSettings struct {
+	interval  time.Duration // Between probes, zero or negative to never probe
+	timeout   time.Duration // Wait for the answer to a probe
+	maxMissed int           // Unanswered probes in a row before the connection is closed
+}
+
+// SetKeepalive sets how often connected devices are probed, how long the
+// server waits for an answer and how many probes in a row may go unanswered
+// before the connection is closed as dead. A zero or negative interval turns
+// probing off. It applies to connections made after the call.
+func (s *Server) SetKeepalive(interval, timeout time.Duration, maxMissed int) {
+	s.keepalive.Store(&keepaliveSettings{
+		interval:  interval,
+		timeout:   timeout,
+		maxMissed: max(maxMissed, 1),
+	})
+}
+
+// probeConnection sends keepalive probes until the connection closes. A
+// connection that silently dropped, e.g. behind a NAT that forgot it, would
+// otherwise hold its forwarded ports until TCP gives up on it, which can take
+// hours. Closing it releases them and marks the device offline.
+func (h *ConnectionHandler) probeConnection() {
+	settings := h.server.keepalive.Load()
+	if settings == nil || settings.interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(settings.interval)
+	defer ticker.Stop()
+
+	missed := 0
+	for {
+		select {
+		case <-ticker.C:
+		case <-h.ctx.Done():
+			return
+		}
+
+		err := h.probe(settings.timeout)
+		if err == nil {
+			missed = 0
+			continue
+		}
+
+		missed++
+		keepaliveMisses.Inc()
+		h.logger.Warn(fmt.Sprintf("Keepalive probe %d of %d failed: %v", missed, settings.maxMissed, err))
+
+		if missed >= settings.maxMissed {
+			h.logger.Warn(fmt.Sprintf("Closing dead connection after %d unanswered keepalive probes", missed))
+			deadConnections.Inc()
+			h.conn.Close()
+			return
+		}
+	}
+}
+
+// probe sends one keepalive request and waits for the answer. Any answer
+// counts, also a rejection by an agent that does not know the request.
+func (h *ConnectionHandler) probe(timeout time.Duration) error {
+	// SendRequest blocks until the connection closes if the device never
+	// answers, which it does once a dead connection is closed
+	reply := make(chan error, 1)
+	go func() {
+		_, _, err := h.conn.SendRequest(protocol.RequestKeepalive, true, nil)
+		reply <- err
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-reply:
+		return err
+	case <-timer.C:
+		return fmt.Errorf("no answer within %s", timeout)
+	case <-h.ctx.Done():
+		return nil
+	}
+}
@@ -0,0 +1,56 @@
+package ssh
+
+import (
+	"errors"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/server/metrics"
+	"github.com/edgetainer/edgetainer/internal/shared/forwarding"
+)
+
+// Defaults for forwarded connections, used unless SetConnectionLimits was
+// called
+const (
+	defaultConnectionIdle     = 10 * time.Minute
+	defaultConnectionDuration = 8 * time.Hour
+	defaultConnectionsMax     = 64
+)
+
+// Limit a forwarded connection ran into
+const limitMaxConnections = "max_connections"
+
+// ErrConnectionLimit is returned when a device already has as many forwarded
+// connections open as allowed
+var ErrConnectionLimit = errors.New("device has reached its connection limit")
+
+var forwardLimitHits = metrics.NewCounterVec("edgetainer_ssh_forward_limit_hits_total",
+	"Forwarded connections closed or refused because of a connection limit.",
+	"limit")
+
+// connectionLimits bound the connections forwarded through device tunnels
+type connectionLimits struct {
+	forwarding.Limits
+	maxPerDevice int // Connections open at once per device, zero or negative for unlimited
+}
+
+// SetConnectionLimits sets how long a forwarded connection may go without
+// traffic, how long it may stay open at all and how many a device may have
+// open at once. Zero or negative values disable a limit. Connections already
+// open keep the limits they were opened with.
+func (s *Server) SetConnectionLimits(idleTimeout, maxDuration time.Duration, maxPerDevice int) {
+	s.connLimits.Store(&connectionLimits{
+		Limits:       forwarding.Limits{IdleTimeout: idleTimeout, MaxDuration: maxDuration},
+		maxPerDevice: maxPerDevice,
+	})
+}
+
+// connectionLimits returns the limits for new forwarded connections
+func (s *Server) connectionLimits() *connectionLimits {
+	if limits := s.connLimits.Load(); limits != nil {
+		return limits
+	}
+	return &connectionLimits{
+		Limits:       forwarding.Limits{IdleTimeout: defaultConnectionIdle, MaxDuration: defaultConnectionDuration},
+		maxPerDevice: defaultConnectionsMax,
+	}
+}
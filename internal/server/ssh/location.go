@@ -0,0 +1,157 @@
+package ssh
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+// geoIPTimeout bounds a GeoIP lookup
+const geoIPTimeout = 10 * time.Second
+
+// SetGeoIP sets the lookup service used to locate devices without a GPS or
+// manual location, empty to disable lookups. {ip} in the URL is replaced with
+// the address the device connects from.
+func (s *Server) SetGeoIP(url string) {
+	s.geoIPURL.Store(&url)
+}
+
+// locationUpdates returns the columns to update for a position fix reported
+// by the agent. A manual location takes precedence over GPS.
+func locationUpdates(device *models.Device, fix *protocol.GeoLocation) map[string]interface{} {
+	if fix == nil || device.LocationSource == protocol.LocationManual {
+		return nil
+	}
+	if protocol.ValidateCoordinates(fix.Latitude, fix.Longitude) != nil {
+		return nil
+	}
+
+	fixedAt := fix.Time
+	if fixedAt.IsZero() {
+		fixedAt = time.Now()
+	}
+	updates := map[string]interface{}{
+		"latitude":            fix.Latitude,
+		"longitude":           fix.Longitude,
+		"location_source":     protocol.LocationGPS,
+		"location_accuracy":   fix.Accuracy,
+		"location_updated_at": fixedAt,
+	}
+	if device.LocationSource == protocol.LocationGeoIP {
+		// The looked up address is not where the receiver is
+		updates["address"] = ""
+	}
+	return updates
+}
+
+// locateByIP looks up the location of a device from the public address it
+// connects from, unless it has a manual or GPS location
+func (s *Server) locateByIP(device models.Device, remoteAddr string) {
+	url := s.geoIPURL.Load()
+	if url == nil || *url == "" {
+		return
+	}
+	if device.LocationSource != "" && device.LocationSource != protocol.LocationGeoIP {
+		return
+	}
+
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, geoIPTimeout)
+	defer cancel()
+
+	latitude, longitude, address, err := geoIPLookup(ctx, strings.ReplaceAll(*url, "{ip}", ip.String()))
+	if err != nil {
+		s.logger.Warn(fmt.Sprintf("Failed to look up location of device %s: %v", device.DeviceID, err))
+		return
+	}
+
+	// A GPS fix or manual location set during the lookup wins
+	result := s.database.GetDB().Model(&models.Device{}).
+		Where("id = ? AND (location_source = '' OR location_source IS NULL OR location_source = ?)", device.ID, protocol.LocationGeoIP).
+		Updates(map[string]interface{}{
+			"latitude":            latitude,
+			"longitude":           longitude,
+			"address":             address,
+			"location_source":     protocol.LocationGeoIP,
+			"location_accuracy":   0,
+			"location_updated_at": time.Now(),
+		})
+	if result.Error != nil {
+		s.logger.Error(fmt.Sprintf("Failed to record location of device %s", device.DeviceID), result.Error)
+	}
+}
+
+// geoIPLookup queries a GeoIP service. The field names of the common free
+// services are understood: latitude/lat, longitude/lon/lng and
+// city, region/regionName, country/country_name.
+func geoIPLookup(ctx context.Context, url string) (float64, float64, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, 0, "", fmt.Errorf("lookup returned %s", resp.Status)
+	}
+
+	var result map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, 0, "", fmt.Errorf("failed to parse lookup result: %w", err)
+	}
+
+	number := func(keys ...string) (float64, bool) {
+		for _, key := range keys {
+			if value, ok := result[key].(float64); ok {
+				return value, true
+			}
+		}
+		return 0, false
+	}
+	text := func(keys ...string) string {
+		for _, key := range keys {
+			if value, ok := result[key].(string); ok && value != "" {
+				return value
+			}
+		}
+		return ""
+	}
+
+	latitude, okLat := number("latitude", "lat")
+	longitude, okLon := number("longitude", "lon", "lng")
+	if !okLat || !okLon {
+		return 0, 0, "", fmt.Errorf("lookup result has no coordinates")
+	}
+	if err := protocol.ValidateCoordinates(latitude, longitude); err != nil {
+		return 0, 0, "", err
+	}
+
+	var parts []string
+	for _, part := range []string{text("city"), text("regionName", "region"), text("country_name", "country")} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return latitude, longitude, strings.Join(parts, ", "), nil
+}
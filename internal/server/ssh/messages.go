@@ -0,0 +1,101 @@
+package ssh
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+	"golang.org/x/crypto/ssh"
+)
+
+// serverFeatures are the tunnel features announced to agents in reply to
+// RequestFeatures
+var serverFeatures = []string{protocol.FeatureCompression}
+
+// handleFeatures records the features of the agent and answers with those of
+// the server
+func (h *ConnectionHandler) handleFeatures(req *ssh.Request) {
+	var build protocol.BuildInfo
+	if err := json.Unmarshal(req.Payload, &build); err != nil {
+		h.logger.Error("Failed to parse agent features", err)
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+		return
+	}
+
+	h.features.Store(&build.Features)
+
+	if !req.WantReply {
+		return
+	}
+	data, err := json.Marshal(protocol.FeaturesReply{Features: serverFeatures})
+	if err != nil {
+		req.Reply(false, nil)
+		return
+	}
+	req.Reply(true, data)
+}
+
+// supports reports whether the agent announced a feature with RequestFeatures
+func (h *ConnectionHandler) supports(feature string) bool {
+	features := h.features.Load()
+	return features != nil && protocol.HasFeature(*features, feature)
+}
+
+// handleChunk adds a part of a chunked request and dispatches the request
+// once complete. Earlier parts are acknowledged right away, the last one is
+// answered by the handler of the reassembled request.
+func (h *ConnectionHandler) handleChunk(req *ssh.Request) {
+	var chunk protocol.MessageChunk
+	if err := json.Unmarshal(req.Payload, &chunk); err != nil {
+		h.logger.Error("Failed to parse request chunk", err)
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+		return
+	}
+
+	data, err := h.chunks.Add(&chunk)
+	if err != nil {
+		h.logger.Error(fmt.Sprintf("Dropped chunked %s request", chunk.Type), err)
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+		return
+	}
+	if data == nil {
+		if req.WantReply {
+			req.Reply(true, nil)
+		}
+		return
+	}
+
+	if chunk.Type == protocol.RequestChunk {
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+		return
+	}
+
+	h.logger.Debug(fmt.Sprintf("Reassembled %s request of %d bytes from %d parts", chunk.Type, len(data), chunk.Parts))
+
+	// Replying to the last part answers the reassembled request
+	req.Type = chunk.Type
+	req.Payload = data
+	h.handleRequest(req)
+}
+
+// decompressRequest replaces a gzipped request payload with the JSON it holds
+func (h *ConnectionHandler) decompressRequest(req *ssh.Request) bool {
+	data, err := protocol.Decompress(req.Payload)
+	if err != nil {
+		h.logger.Error(fmt.Sprintf("Failed to decompress %s request", req.Type), err)
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+		return false
+	}
+	req.Payload = data
+	return true
+}
@@ -0,0 +1,177 @@
+package ssh
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/edgetainer/edgetainer/internal/server/metrics"
+	"github.com/edgetainer/edgetainer/internal/shared/forwarding"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+)
+
+// Traffic directions, seen from the server
+const (
+	directionIn  = "in"  // Device to server
+	directionOut = "out" // Server to device
+)
+
+// Auth rejection reasons
+const (
+	rejectPassword      = "password"
+	rejectUnknownDevice = "unknown_device"
+	rejectInvalidKey    = "invalid_key"
+	rejectKeyMismatch   = "key_mismatch"
+	rejectReplaced      = "replaced"
+	rejectInvalidCert   = "invalid_cert"
+	rejectRevoked       = "revoked"
+)
+
+var (
+	connectedDevices = metrics.NewGauge("edgetainer_ssh_connected_devices",
+		"Devices with an open tunnel.")
+	tunnelBytes = metrics.NewCounterVec("edgetainer_ssh_tunnel_bytes_total",
+		"Bytes transferred over device tunnels, including forwarded connections and commands.",
+		"device_id", "direction")
+	forwardedConnections = metrics.NewGauge("edgetainer_ssh_forwarded_connections",
+		"Forwarded connections currently open through device tunnels.")
+	forwardedConnectionsTotal = metrics.NewCounter("edgetainer_ssh_forwarded_connections_total",
+		"Forwarded connections opened through device tunnels.")
+	handshakeFailures = metrics.NewCounter("edgetainer_ssh_handshake_failures_total",
+		"SSH connections that failed before the handshake completed.")
+	keepaliveMisses = metrics.NewCounter("edgetainer_ssh_keepalive_misses_total",
+		"Keepalive probes of device connections that went unanswered.")
+	deadConnections = metrics.NewCounter("edgetainer_ssh_dead_connections_total",
+		"Device connections closed because they stopped answering keepalive probes.")
+	commandResends = metrics.NewCounter("edgetainer_ssh_command_resends_total",
+		"Commands resent after the device connection was lost before the response arrived.")
+	authRejections = metrics.NewCounterVec("edgetainer_ssh_auth_rejections_total",
+		"SSH authentication attempts that were rejected.",
+		"reason")
+)
+
+// deviceTraffic accumulates the traffic of a device across its connections
+type deviceTraffic struct {
+	in, out        *metrics.Counter
+	activeForwards atomic.Int64
+}
+
+// trafficStats tracks the traffic of every device seen since the server started
+type trafficStats struct {
+	mu      sync.Mutex
+	devices map[string]*deviceTraffic
+}
+
+// device returns the traffic counters of a device
+func (t *trafficStats) device(deviceID string) *deviceTraffic {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.devices == nil {
+		t.devices = make(map[string]*deviceTraffic)
+	}
+	traffic, ok := t.devices[deviceID]
+	if !ok {
+		traffic = &deviceTraffic{
+			in:  tunnelBytes.WithLabelValues(deviceID, directionIn),
+			out: tunnelBytes.WithLabelValues(deviceID, directionOut),
+		}
+		t.devices[deviceID] = traffic
+	}
+	return traffic
+}
+
+// forget drops the counters of a device, e.g. once it is deleted
+func (t *trafficStats) forget(deviceID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.devices, deviceID)
+	tunnelBytes.Delete(deviceID, directionIn)
+	tunnelBytes.Delete(deviceID, directionOut)
+}
+
+// countingConn counts the bytes read and written on a tunnel connection. The
+// bytes of the handshake are attributed once the device is known.
+type countingConn struct {
+	net.Conn
+	pendingIn, pendingOut atomic.Int64
+	traffic               atomic.Pointer[deviceTraffic]
+}
+
+// Read implements net.Conn
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if traffic := c.traffic.Load(); traffic != nil {
+		traffic.in.Add(float64(n))
+	} else {
+		c.pendingIn.Add(int64(n))
+	}
+	return n, err
+}
+
+// Write implements net.Conn
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if traffic := c.traffic.Load(); traffic != nil {
+		traffic.out.Add(float64(n))
+	} else {
+		c.pendingOut.Add(int64(n))
+	}
+	return n, err
+}
+
+// attach attributes the traffic of the connection to a device
+func (c *countingConn) attach(traffic *deviceTraffic) {
+	c.traffic.Store(traffic)
+	traffic.in.Add(float64(c.pendingIn.Swap(0)))
+	traffic.out.Add(float64(c.pendingOut.Swap(0)))
+}
+
+// TunnelStats returns the traffic statistics of a device tunnel, or nil if
+// the device has not connected since the server started
+func (s *Server) TunnelStats(deviceID string) *models.TunnelStats {
+	s.traffic.mu.Lock()
+	traffic, ok := s.traffic.devices[deviceID]
+	s.traffic.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	stats := &models.TunnelStats{
+		BytesIn:        uint64(traffic.in.Value()),
+		BytesOut:       uint64(traffic.out.Value()),
+		ActiveForwards: int(traffic.activeForwards.Load()),
+	}
+
+	s.mu.Lock()
+	if conn, ok := s.connections[deviceID]; ok {
+		established := conn.Established
+		stats.ConnectedSince = &established
+		stats.ForwardedPorts = len(conn.ForwardPorts)
+	}
+	s.mu.Unlock()
+
+	return stats
+}
+
+// ForgetDevice drops the traffic statistics of a deleted device
+func (s *Server) ForgetDevice(deviceID string) {
+	s.traffic.forget(deviceID)
+}
+
+// trackForward counts a forwarded connection for as long as it is open. It
+// fails once the device has as many open as the connection limits allow.
+func (s *Server) trackForward(deviceID string) (func(), error) {
+	traffic := s.traffic.device(deviceID)
+	if !forwarding.Acquire(&traffic.activeForwards, s.connectionLimits().maxPerDevice) {
+		forwardLimitHits.WithLabelValues(limitMaxConnections).Inc()
+		return nil, ErrConnectionLimit
+	}
+	forwardedConnections.Inc()
+	forwardedConnectionsTotal.Inc()
+	return func() {
+		forwardedConnections.Dec()
+		traffic.activeForwards.Add(-1)
+	}, nil
+}
@@ -0,0 +1,256 @@
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/server/metrics"
+	"github.com/edgetainer/edgetainer/internal/shared/config"
+)
+
+// proxyHeaderTimeout bounds how long a connection may take to send its PROXY
+// header
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyV1MaxLength is the longest PROXY protocol version 1 header, with its
+// CRLF
+const proxyV1MaxLength = 107
+
+// proxyV2Signature starts every PROXY protocol version 2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Results of reading a PROXY header
+const (
+	proxyAccepted  = "accepted"  // The header was read
+	proxyMissing   = "missing"   // The connection sent none
+	proxyUntrusted = "untrusted" // The peer is not a trusted load balancer
+	proxyInvalid   = "invalid"   // The header could not be read
+)
+
+var proxyHeaders = metrics.NewCounterVec("edgetainer_ssh_proxy_headers_total",
+	"Connections to the SSH listener by the result of reading their PROXY header.",
+	"result")
+
+// errNoProxyHeader is returned for connections required to, but not sending
+// a PROXY header
+var errNoProxyHeader = errors.New("connection sent no PROXY header")
+
+// proxySettings control which connections are read a PROXY header from
+type proxySettings struct {
+	mode    string       // See config.ProxyProtocolOff
+	trusted []*net.IPNet // Load balancers headers are taken from, nil for any
+}
+
+// SetProxyProtocol sets whether connections start with a PROXY protocol
+// header, as sent by load balancers to pass on the address of the device.
+// Headers are only taken from the trusted addresses or ranges, or from any
+// peer if there are none. Connections already open keep their address.
+func (s *Server) SetProxyProtocol(mode string, trusted []string) error {
+	settings := &proxySettings{mode: mode}
+	for _, source := range trusted {
+		if !strings.Contains(source, "/") {
+			ip := net.ParseIP(source)
+			if ip == nil {
+				return fmt.Errorf("invalid trusted proxy %q", source)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			settings.trusted = append(settings.trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(source)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %q: %w", source, err)
+		}
+		settings.trusted = append(settings.trusted, network)
+	}
+	s.proxy.Store(settings)
+	return nil
+}
+
+// trusts reports whether PROXY headers are taken from a peer
+func (p *proxySettings) trusts(addr net.Addr) bool {
+	if len(p.trusted) == 0 {
+		return true
+	}
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range p.trusted {
+		if network.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxiedConn is a connection whose PROXY header was read, reporting the
+// address of the device rather than that of the load balancer
+type proxiedConn struct {
+	net.Conn
+	reader *bufio.Reader // Holds what was read past the header
+	remote net.Addr      // Nil if the header carried no address
+}
+
+func (c *proxiedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// proxyAddr returns the address of the load balancer a connection came
+// through, empty if it came straight from the device
+func proxyAddr(conn net.Conn) string {
+	if proxied, ok := conn.(*proxiedConn); ok && proxied.remote != nil {
+		return proxied.Conn.RemoteAddr().String()
+	}
+	return ""
+}
+
+// acceptProxy reads the PROXY header of a new connection as the settings
+// require, returning the connection to run SSH over
+func (s *Server) acceptProxy(conn net.Conn) (net.Conn, error) {
+	settings := s.proxy.Load()
+	if settings == nil || settings.mode == config.ProxyProtocolOff {
+		return conn, nil
+	}
+	if !settings.trusts(conn.RemoteAddr()) {
+		proxyHeaders.WithLabelValues(proxyUntrusted).Inc()
+		if settings.mode == config.ProxyProtocolRequired {
+			return nil, fmt.Errorf("PROXY header from untrusted peer %s", conn.RemoteAddr())
+		}
+		return conn, nil
+	}
+
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	reader := bufio.NewReader(conn)
+	first, err := reader.Peek(1)
+	if err != nil {
+		proxyHeaders.WithLabelValues(proxyInvalid).Inc()
+		return nil, fmt.Errorf("failed to read PROXY header: %w", err)
+	}
+
+	var remote net.Addr
+	switch first[0] {
+	case 'P':
+		remote, err = readProxyV1(reader)
+	case proxyV2Signature[0]:
+		remote, err = readProxyV2(reader)
+	default:
+		// SSH identification, in optional mode connections may skip the header
+		proxyHeaders.WithLabelValues(proxyMissing).Inc()
+		if settings.mode == config.ProxyProtocolRequired {
+			return nil, errNoProxyHeader
+		}
+		return &proxiedConn{Conn: conn, reader: reader}, nil
+	}
+	if err != nil {
+		proxyHeaders.WithLabelValues(proxyInvalid).Inc()
+		return nil, err
+	}
+	proxyHeaders.WithLabelValues(proxyAccepted).Inc()
+
+	return &proxiedConn{Conn: conn, reader: reader, remote: remote}, nil
+}
+
+// readProxyV1 reads a text header, e.g. "PROXY TCP4 203.0.113.7 10.0.0.5
+// 51234 2222\r\n". UNKNOWN connections have no address.
+func readProxyV1(reader *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read PROXY header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("invalid PROXY header %q", line)
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, fmt.Errorf("invalid PROXY header %q", line)
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol %q", fields[1])
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("invalid PROXY header %q", line)
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("invalid PROXY source %s %s", fields[2], fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads a binary header. LOCAL connections, e.g. health checks
+// of the load balancer, and address families other than TCP have no
+// address.
+func readProxyV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, fmt.Errorf("failed to read PROXY header: %w", err)
+	}
+	if !bytes.Equal(header[:12], proxyV2Signature) || header[12]>>4 != 2 {
+		return nil, fmt.Errorf("invalid PROXY header")
+	}
+	command, family := header[12]&0x0f, header[13]
+
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, fmt.Errorf("failed to read PROXY header: %w", err)
+	}
+
+	switch command {
+	case 0x0: // LOCAL
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported PROXY command %#x", command)
+	}
+
+	// The addresses are followed by TLVs, which are ignored
+	switch family {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return nil, fmt.Errorf("invalid PROXY header")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return nil, fmt.Errorf("invalid PROXY header")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	default:
+		return nil, nil
+	}
+}
@@ -0,0 +1,56 @@
+package ssh
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+	"golang.org/x/crypto/ssh"
+)
+
+// pullStore keeps the latest image pull progress reported by each device
+type pullStore struct {
+	mu       sync.Mutex
+	progress map[string]*protocol.PullProgress
+}
+
+// PullProgress returns the latest pull progress reported by a device, or nil
+// if it is not pulling
+func (s *Server) PullProgress(deviceID string) *protocol.PullProgress {
+	s.pulls.mu.Lock()
+	defer s.pulls.mu.Unlock()
+
+	return s.pulls.progress[deviceID]
+}
+
+// ClearPullProgress drops the pull progress of a device once its deployment
+// has finished
+func (s *Server) ClearPullProgress(deviceID string) {
+	s.pulls.mu.Lock()
+	defer s.pulls.mu.Unlock()
+
+	delete(s.pulls.progress, deviceID)
+}
+
+// handlePullProgress records the pull progress reported by an agent
+func (h *ConnectionHandler) handlePullProgress(req *ssh.Request) {
+	var progress protocol.PullProgress
+	if err := json.Unmarshal(req.Payload, &progress); err != nil {
+		h.logger.Error("Failed to parse pull progress", err)
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+		return
+	}
+
+	h.server.pulls.mu.Lock()
+	if h.server.pulls.progress == nil {
+		h.server.pulls.progress = make(map[string]*protocol.PullProgress)
+	}
+	h.server.pulls.progress[h.deviceID] = &progress
+	h.server.pulls.mu.Unlock()
+
+	if req.WantReply {
+		req.Reply(true, nil)
+	}
+}
@@ -0,0 +1,76 @@
+package ssh
+
+import (
+	"fmt"
+
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/edgetainer/edgetainer/internal/shared/ratelimit"
+)
+
+// SetDefaultTunnelRate sets the tunnel rate limit in kbit/s for devices whose
+// fleet does not configure one, zero for none, and applies it to open tunnels
+func (s *Server) SetDefaultTunnelRate(kbps int) {
+	s.defaultRate.Store(int64(kbps))
+	s.RefreshRateLimits()
+}
+
+// TunnelRate returns the effective tunnel rate limit of a device in kbit/s,
+// zero if unlimited
+func (s *Server) TunnelRate(deviceID string) (int, error) {
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		return 0, err
+	}
+
+	fleetRate := 0
+	if device.FleetID != nil {
+		var fleet models.Fleet
+		if err := s.database.GetDB().Where("id = ?", *device.FleetID).First(&fleet).Error; err == nil {
+			fleetRate = fleet.TunnelRate
+		}
+	}
+	return ratelimit.Effective(device.TunnelRate, fleetRate, int(s.defaultRate.Load())), nil
+}
+
+// RefreshRateLimit reapplies the rate limit of a connected device, e.g. after
+// its settings changed
+func (s *Server) RefreshRateLimit(deviceID string) {
+	if conn, ok := s.GetDeviceConnection(deviceID); ok {
+		s.applyRateLimit(conn)
+	}
+}
+
+// RefreshRateLimits reapplies the rate limits of all connected devices
+func (s *Server) RefreshRateLimits() {
+	s.mu.Lock()
+	connections := make([]*DeviceConnection, 0, len(s.connections))
+	for _, conn := range s.connections {
+		connections = append(connections, conn)
+	}
+	s.mu.Unlock()
+
+	for _, conn := range connections {
+		s.applyRateLimit(conn)
+	}
+}
+
+// applyRateLimit limits both directions of a tunnel to the device's effective
+// rate. The limit is left unchanged if it cannot be looked up.
+func (s *Server) applyRateLimit(conn *DeviceConnection) {
+	kbps, err := s.TunnelRate(conn.DeviceID)
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to look up tunnel rate limit for device %s", conn.DeviceID), err)
+		return
+	}
+
+	rate := ratelimit.KbpsToBytes(kbps)
+	if conn.inLimit.Rate() != rate {
+		if kbps > 0 {
+			s.logger.Info(fmt.Sprintf("Limiting tunnel of device %s to %d kbit/s", conn.DeviceID, kbps))
+		} else {
+			s.logger.Info(fmt.Sprintf("Removing tunnel rate limit of device %s", conn.DeviceID))
+		}
+	}
+	conn.inLimit.SetRate(rate)
+	conn.outLimit.SetRate(rate)
+}
@@ -0,0 +1,191 @@
+package ssh
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/server/events"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"golang.org/x/crypto/ssh"
+)
+
+// revocationPollInterval is how often the revocation list is read again, to
+// learn of keys revoked through other servers on the same database
+const revocationPollInterval = 30 * time.Second
+
+// loadRevocations reads the fingerprints of revoked keys, so logins are
+// checked against them without a database lookup
+func (s *Server) loadRevocations() {
+	var keys []models.RevokedKey
+	if err := s.database.GetDB().Order("created_at").Find(&keys).Error; err != nil {
+		s.logger.Error("Failed to load revoked keys", err)
+		return
+	}
+
+	s.revokedMu.Lock()
+	defer s.revokedMu.Unlock()
+
+	for _, key := range keys {
+		s.revoked[key.Fingerprint] = true
+		s.revokedSince = key.CreatedAt
+	}
+	if len(keys) > 0 {
+		s.logger.Info(fmt.Sprintf("Loaded %d revoked keys", len(keys)))
+	}
+}
+
+// watchRevocations reads keys revoked since the last read every
+// revocationPollInterval until the server stops, and closes the tunnels of
+// their devices connected to this server
+func (s *Server) watchRevocations() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(revocationPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.ctx.Done():
+			return
+		}
+
+		s.revokedMu.RLock()
+		since := s.revokedSince
+		s.revokedMu.RUnlock()
+
+		var keys []models.RevokedKey
+		if err := s.database.GetDB().Where("created_at >= ?", since).Order("created_at").Find(&keys).Error; err != nil {
+			s.logger.Error("Failed to read revoked keys", err)
+			continue
+		}
+
+		for _, key := range keys {
+			s.revokedMu.Lock()
+			known := s.revoked[key.Fingerprint]
+			s.revoked[key.Fingerprint] = true
+			s.revokedSince = key.CreatedAt
+			s.revokedMu.Unlock()
+			if known {
+				continue
+			}
+
+			s.forgetCertificateChecks(key.DeviceID)
+			if s.Disconnect(key.DeviceID) {
+				s.logger.Warn(fmt.Sprintf("Closed connection of device %s, its key was revoked through another server", key.DeviceID))
+			}
+		}
+	}
+}
+
+// certificateCheckTTL is how long the database check of a certificate login
+// is reused for further logins of the device with the same key
+const certificateCheckTTL = 30 * time.Second
+
+// certificateCheck is the outcome of a database check of a certificate login
+type certificateCheck struct {
+	reason string // Label of the rejection, empty if the login is allowed
+	err    error
+	until  time.Time
+}
+
+// checkCertificateDevice checks in the database that a device logging in with
+// a certificate was neither replaced nor revoked and that its key is not on
+// the revocation list. It returns the label of the rejection with the error.
+func (s *Server) checkCertificateDevice(deviceID string, key ssh.PublicKey) (string, error) {
+	fingerprint := ssh.FingerprintSHA256(key)
+	cacheKey := deviceID + " " + fingerprint
+	now := time.Now()
+
+	s.certChecksMu.Lock()
+	check, ok := s.certChecks[cacheKey]
+	s.certChecksMu.Unlock()
+	if ok && now.Before(check.until) {
+		return check.reason, check.err
+	}
+
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		// Not remembered, the database may only be unavailable for a moment
+		s.logger.Error(fmt.Sprintf("Failed to find device with ID %s", deviceID), err)
+		return rejectUnknownDevice, fmt.Errorf("device not found")
+	}
+	var revokedKeys int64
+	if err := s.database.GetDB().Model(&models.RevokedKey{}).Where("fingerprint = ?", fingerprint).Count(&revokedKeys).Error; err != nil {
+		s.logger.Error("Failed to check revoked keys", err)
+		return rejectRevoked, fmt.Errorf("failed to check revocation")
+	}
+
+	check = certificateCheck{until: now.Add(certificateCheckTTL)}
+	switch {
+	case revokedKeys > 0:
+		s.revokedMu.Lock()
+		s.revoked[fingerprint] = true
+		s.revokedMu.Unlock()
+		check.reason, check.err = rejectRevoked, fmt.Errorf("key was revoked")
+	case device.Status == models.DeviceStatusRevoked:
+		check.reason, check.err = rejectRevoked, fmt.Errorf("device was revoked")
+	case device.Status == models.DeviceStatusReplaced:
+		check.reason, check.err = rejectReplaced, fmt.Errorf("device was replaced")
+	}
+
+	s.certChecksMu.Lock()
+	s.certChecks[cacheKey] = check
+	if len(s.certChecks) > 10000 {
+		for key, check := range s.certChecks {
+			if now.After(check.until) {
+				delete(s.certChecks, key)
+			}
+		}
+	}
+	s.certChecksMu.Unlock()
+	return check.reason, check.err
+}
+
+// forgetCertificateChecks drops the remembered certificate checks of a
+// device, so its next login is checked against the database again
+func (s *Server) forgetCertificateChecks(deviceID string) {
+	s.certChecksMu.Lock()
+	defer s.certChecksMu.Unlock()
+
+	for key := range s.certChecks {
+		if strings.HasPrefix(key, deviceID+" ") {
+			delete(s.certChecks, key)
+		}
+	}
+}
+
+// isRevoked reports whether a key, or the key of a certificate, was revoked
+func (s *Server) isRevoked(key ssh.PublicKey) bool {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		key = cert.Key
+	}
+
+	s.revokedMu.RLock()
+	defer s.revokedMu.RUnlock()
+
+	return s.revoked[ssh.FingerprintSHA256(key)]
+}
+
+// RevokeDevice turns the key with the given fingerprint away from now on,
+// certificates issued for it included, and closes the tunnel of the device.
+// It reports whether the device was connected.
+func (s *Server) RevokeDevice(deviceID, fingerprint, reason string) bool {
+	s.revokedMu.Lock()
+	s.revoked[fingerprint] = true
+	s.revokedMu.Unlock()
+	s.forgetCertificateChecks(deviceID)
+
+	connected := s.Disconnect(deviceID)
+	if connected {
+		s.logger.Warn(fmt.Sprintf("Closed connection of revoked device %s", deviceID))
+	}
+
+	s.bus.Publish(events.NewEvent(events.DeviceRevoked, deviceID, map[string]interface{}{
+		"fingerprint":  fingerprint,
+		"reason":       reason,
+		"disconnected": connected,
+	}))
+	return connected
+}
@@ -2,25 +2,36 @@ package ssh
 
 import (
 	"context"
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/x509"
-	"encoding/pem"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"net"
 	"os"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/edgetainer/edgetainer/internal/server/db"
+	"github.com/edgetainer/edgetainer/internal/server/events"
+	"github.com/edgetainer/edgetainer/internal/server/storage"
+	"github.com/edgetainer/edgetainer/internal/shared/credentials"
 	"github.com/edgetainer/edgetainer/internal/shared/logging"
 	"github.com/edgetainer/edgetainer/internal/shared/models"
 	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+	"github.com/edgetainer/edgetainer/internal/shared/ratelimit"
+	"github.com/edgetainer/edgetainer/internal/shared/sshkeys"
+	"github.com/edgetainer/edgetainer/internal/shared/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/crypto/ssh"
 )
 
+// commandTimeout bounds how long the server waits for a command response,
+// deployments may need to pull large images over slow links
+const commandTimeout = 10 * time.Minute
+
 // PortManager manages the allocation of ports for SSH tunnels
 type PortManager struct {
 	startPort int
@@ -63,6 +74,14 @@ func (m *PortManager) ReleasePort(port int) {
 	}
 }
 
+// Usage returns the number of allocated ports and the size of the pool
+func (m *PortManager) Usage() (int, int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.inUse), m.endPort - m.startPort + 1
+}
+
 // ConnectionHandler handles an SSH connection from a device
 type ConnectionHandler struct {
 	deviceID string
@@ -73,6 +92,13 @@ type ConnectionHandler struct {
 	ctx      context.Context
 	cancel   context.CancelFunc
 	server   *Server
+	policy   atomic.Pointer[models.TunnelPolicy] // What forwards may reach on the device
+	features atomic.Pointer[[]string]            // Features the agent announced, nil for older agents
+	chunks   *protocol.Reassembler               // Chunked requests being received
+
+	hardwareAlerted bool   // A hardware mismatch was alerted for this connection, only used by the request loop
+	containers      []byte // Containers of the last heartbeat as recorded, only used by the request loop
+	usb             []byte // USB devices of the last heartbeat as recorded, only used by the request loop
 }
 
 // DeviceConnection represents an active connection to a device
@@ -81,37 +107,66 @@ type DeviceConnection struct {
 	Connection   *ssh.ServerConn
 	Handler      *ConnectionHandler
 	Established  time.Time
-	ForwardPorts map[int]int // Local port -> Remote port
+	ForwardPorts map[int]*Forward // Server port -> forward
+	ProxyAddr    string           // Load balancer the connection came through, empty if none
+
+	inLimit, outLimit *ratelimit.Limiter
 }
 
 // Server is the SSH tunnel server
 type Server struct {
-	port        int
-	hostKeyPath string
-	config      *ssh.ServerConfig
-	portManager *PortManager
-	logger      *logging.Logger
-	listener    net.Listener
-	ctx         context.Context
-	cancelFunc  context.CancelFunc
-	wg          sync.WaitGroup
-	mu          sync.Mutex
-	connections map[string]*DeviceConnection
-	database    *db.DB
-}
-
-// NewServer creates a new SSH server
-func NewServer(ctx context.Context, port int, hostKeyPath string, startPort, endPort int, database *db.DB) (*Server, error) {
-	serverCtx, cancel := context.WithCancel(ctx)
+	port            int
+	hostKeyPath     string
+	config          *ssh.ServerConfig
+	portManager     *PortManager
+	logger          *logging.Logger
+	listener        net.Listener
+	ctx             context.Context
+	cancelFunc      context.CancelFunc
+	wg              sync.WaitGroup
+	mu              sync.Mutex
+	connections     map[string]*DeviceConnection
+	database        *db.DB
+	bus             *events.Bus
+	traffic         trafficStats
+	defaultRate     atomic.Int64                     // Default tunnel rate limit in kbit/s
+	maxClockSkew    atomic.Int64                     // Allowed device clock skew as a time.Duration, 0 for no alerts
+	healthLimits    atomic.Pointer[hostHealthLimits] // Nil until set, no host health alerts
+	geoIPURL        atomic.Pointer[string]
+	listenHost      string                 // Address Start listens on, empty for all
+	forwardHost     atomic.Pointer[string] // Address forwards listen on, nil for 127.0.0.1
+	keepalive       atomic.Pointer[keepaliveSettings]
+	forwardDefaults atomic.Pointer[forwardDefaults]
+	connLimits      atomic.Pointer[connectionLimits]
+	proxy           atomic.Pointer[proxySettings]  // PROXY headers of load balancers, nil reads none
+	ca              atomic.Pointer[certAuthority]  // Signs device certificates, nil unless enabled
+	artifacts       atomic.Pointer[ArtifactSource] // Serves ChannelArtifact, nil unless set
+	objects         atomic.Pointer[storage.Store]  // Receives completed bundles and captures, nil keeps them in the database
+	rejectHardware  atomic.Bool                    // Close connections of devices reporting other hardware
+	revokedMu       sync.RWMutex
+	revoked         map[string]bool // Fingerprints of revoked keys
+	revokedSince    time.Time       // Creation of the newest revoked key read from the database
+	certChecksMu    sync.Mutex
+	certChecks      map[string]certificateCheck // Database checks of certificate logins, by device ID and key fingerprint
+	pulls           pullStore
+	commandSeq      map[string]uint64        // Last command sequence number of each device
+	reconnects      map[string]chan struct{} // Closed once the device reconnects, for commands awaiting a resend
+
+	heartbeatSettings atomic.Pointer[heartbeatSettings]
+	heartbeats        *heartbeatQueue // Device columns reported in heartbeats, waiting to be written
+}
 
+// NewServer creates a new SSH server. A missing host key is generated with
+// the given type and size, an existing one is used whatever its type.
+func NewServer(ctx context.Context, port int, hostKeyPath, hostKeyType string, hostKeyBits int, startPort, endPort int, database *db.DB, bus *events.Bus) (*Server, error) {
 	logger := logging.WithComponent("ssh-server")
 
 	// Load host key
 	keyData, err := ioutil.ReadFile(hostKeyPath)
 	if err != nil {
 		if os.IsNotExist(err) {
-			logger.Info("Host key not found, generating new key")
-			keyData, err = generateHostKey(hostKeyPath)
+			logger.Info(fmt.Sprintf("Host key not found, generating new %s key", hostKeyType))
+			keyData, err = generateHostKey(hostKeyPath, hostKeyType, hostKeyBits)
 			if err != nil {
 				return nil, fmt.Errorf("failed to generate host key: %w", err)
 			}
@@ -125,14 +180,29 @@ func NewServer(ctx context.Context, port int, hostKeyPath string, startPort, end
 		return nil, fmt.Errorf("failed to parse host key: %w", err)
 	}
 
+	// The certificate authority is enabled on the server once it exists
+	var server *Server
+
 	// Configure server
 	config := &ssh.ServerConfig{
 		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
 			// We don't support password authentication
 			logger.Info(fmt.Sprintf("Rejecting password login attempt from %s", conn.User()))
+			authRejections.WithLabelValues(rejectPassword).Inc()
 			return nil, fmt.Errorf("password authentication not supported")
 		},
 		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			// Revoked keys are turned away first, with or without a certificate
+			if server.isRevoked(key) {
+				logger.Warn(fmt.Sprintf("Rejecting device %s, its key was revoked", conn.User()))
+				authRejections.WithLabelValues(rejectRevoked).Inc()
+				return nil, fmt.Errorf("key was revoked")
+			}
+
+			if cert, ok := key.(*ssh.Certificate); ok {
+				return server.authenticateCertificate(conn, cert)
+			}
+
 			deviceID := conn.User()
 			logger.Info(fmt.Sprintf("Public key auth attempt from device ID: %s", deviceID))
 
@@ -141,19 +211,34 @@ func NewServer(ctx context.Context, port int, hostKeyPath string, startPort, end
 			result := database.GetDB().Where("device_id = ?", deviceID).First(&device)
 			if result.Error != nil {
 				logger.Error(fmt.Sprintf("Failed to find device with ID %s", deviceID), result.Error)
+				authRejections.WithLabelValues(rejectUnknownDevice).Inc()
 				return nil, fmt.Errorf("device not found")
 			}
 
+			// A replaced device must not take its role back
+			if device.Status == models.DeviceStatusReplaced {
+				logger.Warn(fmt.Sprintf("Rejecting device %s, it was replaced", deviceID))
+				authRejections.WithLabelValues(rejectReplaced).Inc()
+				return nil, fmt.Errorf("device was replaced")
+			}
+			if device.Status == models.DeviceStatusRevoked {
+				logger.Warn(fmt.Sprintf("Rejecting device %s, it was revoked", deviceID))
+				authRejections.WithLabelValues(rejectRevoked).Inc()
+				return nil, fmt.Errorf("device was revoked")
+			}
+
 			// Parse the stored public key
 			parsedKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(device.SSHPublicKey))
 			if err != nil {
 				logger.Error(fmt.Sprintf("Failed to parse public key for device %s", deviceID), err)
+				authRejections.WithLabelValues(rejectInvalidKey).Inc()
 				return nil, fmt.Errorf("invalid device public key")
 			}
 
 			// Compare the key used for authentication with the stored key
 			if ssh.FingerprintSHA256(key) != ssh.FingerprintSHA256(parsedKey) {
 				logger.Error(fmt.Sprintf("Public key mismatch for device %s", deviceID), nil)
+				authRejections.WithLabelValues(rejectKeyMismatch).Inc()
 				return nil, fmt.Errorf("public key mismatch")
 			}
 
@@ -168,7 +253,9 @@ func NewServer(ctx context.Context, port int, hostKeyPath string, startPort, end
 
 	config.AddHostKey(hostKey)
 
-	return &Server{
+	serverCtx, cancel := context.WithCancel(ctx)
+
+	server = &Server{
 		port:        port,
 		hostKeyPath: hostKeyPath,
 		config:      config,
@@ -177,20 +264,57 @@ func NewServer(ctx context.Context, port int, hostKeyPath string, startPort, end
 		ctx:         serverCtx,
 		cancelFunc:  cancel,
 		connections: make(map[string]*DeviceConnection),
+		revoked:     make(map[string]bool),
+		certChecks:  make(map[string]certificateCheck),
+		commandSeq:  make(map[string]uint64),
+		reconnects:  make(map[string]chan struct{}),
 		database:    database,
-	}, nil
+		bus:         bus,
+	}
+	return server, nil
 }
 
-// Start starts the SSH server
+// SetBindAddresses sets the address Start listens on, empty for every IPv4
+// and IPv6 address, and the address new forwards listen on. It must be
+// called before Start.
+func (s *Server) SetBindAddresses(listen, forwards string) {
+	s.listenHost = listen
+	s.forwardHost.Store(&forwards)
+}
+
+// Start starts the SSH server on its port
 func (s *Server) Start() error {
-	addr := fmt.Sprintf(":%d", s.port)
+	addr := net.JoinHostPort(s.listenHost, strconv.Itoa(s.port))
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
 		return fmt.Errorf("failed to listen on %s: %w", addr, err)
 	}
+	return s.Serve(listener)
+}
+
+// Serve starts the SSH server on a listener that is not a TCP port, such as
+// the in-memory listener of the device simulator
+func (s *Server) Serve(listener net.Listener) error {
+	// No device is connected yet, sessions still open are from the last run
+	s.closeStaleSessions()
+	s.loadRevocations()
+
+	s.mu.Lock()
 	s.listener = listener
+	s.mu.Unlock()
+
+	s.logger.Info(fmt.Sprintf("SSH server listening on %s", listener.Addr()))
+
+	settings := s.heartbeatSettings.Load()
+	if settings == nil {
+		settings = &heartbeatSettings{flush: defaultHeartbeatFlush, batch: defaultHeartbeatBatch, queue: defaultHeartbeatQueue}
+	}
+	s.heartbeats = newHeartbeatQueue(settings.queue, settings.batch)
+	s.wg.Add(1)
+	go s.writeHeartbeats(settings)
 
-	s.logger.Info(fmt.Sprintf("SSH server listening on port %d", s.port))
+	s.wg.Add(1)
+	go s.watchRevocations()
 
 	s.wg.Add(1)
 	go s.acceptConnections()
@@ -224,14 +348,33 @@ func (s *Server) acceptConnections() {
 func (s *Server) handleConnection(conn net.Conn) {
 	defer conn.Close()
 
+	// Behind a load balancer the address of the device comes in a PROXY header
+	conn, err := s.acceptProxy(conn)
+	if err != nil {
+		handshakeFailures.Inc()
+		s.logger.Warn(fmt.Sprintf("Rejecting connection: %v", err))
+		return
+	}
+
+	// Rate limits are applied once the device is known, traffic is counted
+	// before limiting so that the metrics reflect what goes over the wire
+	inLimit, outLimit := ratelimit.New(0), ratelimit.New(0)
+	counting := &countingConn{Conn: ratelimit.Conn(conn, inLimit, outLimit)}
+
 	// Perform SSH handshake
-	sshConn, channels, requests, err := ssh.NewServerConn(conn, s.config)
+	sshConn, channels, requests, err := ssh.NewServerConn(counting, s.config)
 	if err != nil {
+		// Rejected credentials are counted by the auth callbacks
+		var authErr *ssh.ServerAuthError
+		if !errors.As(err, &authErr) {
+			handshakeFailures.Inc()
+		}
 		s.logger.Error("Failed to establish SSH connection", err)
 		return
 	}
 
 	deviceID := sshConn.Permissions.Extensions["device_id"]
+	counting.attach(s.traffic.device(deviceID))
 	s.logger.Info(fmt.Sprintf("New SSH connection from %s (%s)", sshConn.RemoteAddr(), deviceID))
 
 	// Create a context for this connection
@@ -247,6 +390,7 @@ func (s *Server) handleConnection(conn net.Conn) {
 		ctx:      ctx,
 		cancel:   cancel,
 		server:   s,
+		chunks:   protocol.NewReassembler(),
 	}
 
 	// Register the connection
@@ -255,8 +399,13 @@ func (s *Server) handleConnection(conn net.Conn) {
 		Connection:   sshConn,
 		Handler:      handler,
 		Established:  time.Now(),
-		ForwardPorts: make(map[int]int),
+		ForwardPorts: make(map[int]*Forward),
+		ProxyAddr:    proxyAddr(conn),
+		inLimit:      inLimit,
+		outLimit:     outLimit,
 	}
+	s.applyRateLimit(deviceConn)
+	s.applyTunnelPolicy(deviceConn)
 
 	s.mu.Lock()
 	// If there's an existing connection for this device, close it
@@ -265,10 +414,118 @@ func (s *Server) handleConnection(conn net.Conn) {
 		existing.Connection.Close()
 	}
 	s.connections[deviceID] = deviceConn
+	connectedDevices.Set(float64(len(s.connections)))
+	if reconnected, ok := s.reconnects[deviceID]; ok {
+		close(reconnected)
+		delete(s.reconnects, deviceID)
+	}
+	s.mu.Unlock()
+
+	s.markOnline(deviceID, sshConn.RemoteAddr().String())
+
+	// Handle the connection until it closes
+	handler.handleConnection()
+}
+
+// removeConnection unregisters a connection once it has closed and marks the
+// device offline, unless it has already been replaced by a newer connection
+func (s *Server) removeConnection(deviceID string, sshConn *ssh.ServerConn) {
+	s.mu.Lock()
+	current, ok := s.connections[deviceID]
+	if !ok || current.Connection != sshConn {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.connections, deviceID)
+	connectedDevices.Set(float64(len(s.connections)))
 	s.mu.Unlock()
 
-	// Start handling the connection
-	go handler.handleConnection()
+	s.ClearPullProgress(deviceID)
+	s.markOffline(deviceID)
+}
+
+// markOnline records a device as online and publishes the related events
+func (s *Server) markOnline(deviceID, remoteAddr string) {
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to load device %s", deviceID), err)
+		return
+	}
+
+	wasPending := device.Status == models.DeviceStatusPending
+
+	now := time.Now()
+	result := s.database.GetDB().Model(&device).Updates(map[string]interface{}{
+		"status":    models.DeviceStatusOnline,
+		"last_seen": now,
+	})
+	if result.Error != nil {
+		s.logger.Error(fmt.Sprintf("Failed to mark device %s online", deviceID), result.Error)
+	}
+	s.openSession(&device, remoteAddr, now)
+
+	data := map[string]interface{}{
+		"name":        device.Name,
+		"remote_addr": remoteAddr,
+	}
+	if device.FleetID != nil {
+		data["fleet_id"] = device.FleetID.String()
+	}
+
+	if wasPending {
+		s.bus.Publish(events.NewEvent(events.DeviceEnrolled, deviceID, data))
+	}
+	s.bus.Publish(events.NewEvent(events.DeviceOnline, deviceID, data))
+
+	go s.applyDeviceSettings(device)
+	go s.locateByIP(device, remoteAddr)
+}
+
+// markOffline records a device as offline and publishes the related event
+func (s *Server) markOffline(deviceID string) {
+	// Decommissioned, replaced and revoked devices keep their status after
+	// the tunnel closes
+	result := s.database.GetDB().Model(&models.Device{}).
+		Where("device_id = ? AND status NOT IN ?", deviceID, []string{models.DeviceStatusDecommissioned, models.DeviceStatusReplaced, models.DeviceStatusRevoked}).
+		Update("status", models.DeviceStatusOffline)
+	if result.Error != nil {
+		s.logger.Error(fmt.Sprintf("Failed to mark device %s offline", deviceID), result.Error)
+	}
+	s.closeSession(deviceID, time.Now())
+
+	s.logger.Info(fmt.Sprintf("Device %s disconnected", deviceID))
+	s.bus.Publish(events.NewEvent(events.DeviceOffline, deviceID, nil))
+}
+
+// Listening reports whether the server accepts device connections
+func (s *Server) Listening() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.listener != nil && s.ctx.Err() == nil
+}
+
+// ConnectionCount returns the number of connected devices
+func (s *Server) ConnectionCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.connections)
+}
+
+// Port returns the port the server listens on for devices
+func (s *Server) Port() int {
+	return s.port
+}
+
+// PortRange returns the first and last port forwarded for devices
+func (s *Server) PortRange() (int, int) {
+	return s.portManager.startPort, s.portManager.endPort
+}
+
+// PortUsage returns the number of allocated tunnel ports and the pool size
+func (s *Server) PortUsage() (int, int) {
+	return s.portManager.Usage()
 }
 
 // Shutdown stops the SSH server
@@ -305,34 +562,77 @@ func (s *Server) GetDeviceConnection(deviceID string) (*DeviceConnection, bool)
 	return conn, ok
 }
 
-// SendCommand sends a command to a device
-func (s *Server) SendCommand(deviceID string, command *protocol.Command) error {
+// SendCommand sends a command to a device and waits for its response. Should
+// the connection drop before the response arrives, the command is resent
+// once the device reconnects, provided the agent deduplicates commands.
+func (s *Server) SendCommand(ctx context.Context, deviceID string, command *protocol.Command) (_ *protocol.Response, err error) {
+	ctx, span := tracing.Start(ctx, "ssh.command "+command.Type, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("device.id", deviceID),
+			attribute.String("command.id", command.ID),
+		))
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
 	s.mu.Lock()
 	conn, ok := s.connections[deviceID]
+	if ok && command.Seq == 0 {
+		s.commandSeq[deviceID]++
+		command.Seq = s.commandSeq[deviceID]
+	}
 	s.mu.Unlock()
 
 	if !ok {
-		return fmt.Errorf("device %s not connected", deviceID)
+		return nil, fmt.Errorf("device %s not connected", deviceID)
 	}
 
-	// Log that we received a command to send
-	s.logger.Info(fmt.Sprintf("Sending command %s to device %s (connected: %v)",
-		command.Type, deviceID, conn.Connection.RemoteAddr() != nil))
+	s.logger.Info(fmt.Sprintf("Sending command %s (%s) to device %s", command.Type, command.ID, deviceID))
 
-	// Implement command sending logic here
-	// For now this is just a placeholder
+	// The agent continues the trace when executing the command
+	command.TraceParent = tracing.Inject(ctx)
 
-	return nil
+	deadline := time.NewTimer(commandTimeout)
+	defer deadline.Stop()
+
+	for {
+		response, err := s.deliverCommand(ctx, conn, command, deadline.C)
+		if !errors.Is(err, errConnectionLost) {
+			if response != nil {
+				span.SetAttributes(attribute.Bool("command.success", response.Success))
+			}
+			return response, err
+		}
+
+		// Agents that do not deduplicate commands could run it twice
+		if !conn.Handler.supports(protocol.FeatureCommandAcks) {
+			return nil, fmt.Errorf("connection to device %s lost waiting for response to command %s", deviceID, command.ID)
+		}
+
+		s.logger.Warn(fmt.Sprintf("Connection to device %s lost during command %s, resending once it reconnects", deviceID, command.ID))
+		span.AddEvent("connection lost")
+		commandResends.Inc()
+
+		conn, err = s.awaitReconnect(ctx, deviceID, conn, deadline.C)
+		if err != nil {
+			return nil, fmt.Errorf("command %s: %w", command.ID, err)
+		}
+	}
 }
 
 // handleConnection processes an SSH connection
 func (h *ConnectionHandler) handleConnection() {
+	defer h.server.removeConnection(h.deviceID, h.conn)
 	defer h.conn.Close()
 	defer h.cancel()
 
 	// Handle global requests
 	go h.handleRequests()
 
+	// Close the connection should the device stop answering
+	go h.probeConnection()
+
 	// Handle channels
 	h.handleChannels()
 }
@@ -340,137 +640,164 @@ func (h *ConnectionHandler) handleConnection() {
 // handleRequests handles global SSH requests
 func (h *ConnectionHandler) handleRequests() {
 	for req := range h.requests {
-		switch req.Type {
-		case "tcpip-forward":
-			h.handleTcpipForward(req)
-		default:
-			if req.WantReply {
-				req.Reply(false, nil)
-			}
-		}
+		h.handleRequest(req)
 	}
 }
 
-// handleTcpipForward handles port forwarding requests
-func (h *ConnectionHandler) handleTcpipForward(req *ssh.Request) {
-	var payload struct {
-		BindAddr string
-		BindPort uint32
+// handleRequest dispatches a global SSH request, decompressing its payload
+// first
+func (h *ConnectionHandler) handleRequest(req *ssh.Request) {
+	if req.Type != "tcpip-forward" && !h.decompressRequest(req) {
+		return
 	}
 
-	if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
-		h.logger.Error("Failed to parse tcpip-forward payload", err)
+	switch req.Type {
+	case "tcpip-forward":
+		h.handleTcpipForward(req)
+	case protocol.RequestKeepalive:
+		if req.WantReply {
+			req.Reply(true, nil)
+		}
+	case protocol.RequestFeatures:
+		h.handleFeatures(req)
+	case protocol.RequestChunk:
+		h.handleChunk(req)
+	case protocol.RequestShutdown:
+		h.handleShutdownReport(req)
+	case protocol.RequestLogs:
+		h.handleLogChunk(req)
+	case protocol.RequestJournal:
+		h.handleJournal(req)
+	case protocol.RequestAutonomy:
+		h.handleAutonomy(req)
+	case protocol.RequestBundle:
+		h.handleBundleChunk(req)
+	case protocol.RequestCapture:
+		h.handleCaptureChunk(req)
+	case protocol.RequestPull:
+		h.handlePullProgress(req)
+	case protocol.RequestStage:
+		h.handleDeployStage(req)
+	case protocol.RequestTime:
+		h.handleTimeRequest(req)
+	case protocol.RequestCert:
+		h.handleCertificateRequest(req)
+	case protocol.RequestHeartbeat:
+		h.handleHeartbeat(req)
+	default:
 		if req.WantReply {
 			req.Reply(false, nil)
 		}
-		return
 	}
+}
 
-	// Allocate a port on the server
-	port, err := h.server.portManager.AllocatePort()
-	if err != nil {
-		h.logger.Error("Failed to allocate port", err)
+// handleShutdownReport records the final state reported by a stopping agent
+func (h *ConnectionHandler) handleShutdownReport(req *ssh.Request) {
+	var report protocol.ShutdownReport
+	if err := json.Unmarshal(req.Payload, &report); err != nil {
+		h.logger.Error("Failed to parse shutdown report", err)
 		if req.WantReply {
 			req.Reply(false, nil)
 		}
 		return
 	}
 
-	// Start listening on the allocated port
-	go h.forwardPort(port, int(payload.BindPort))
+	h.logger.Info(fmt.Sprintf("Agent shutting down (reason: %s, policy: %s, %d apps)",
+		report.Reason, report.Policy, len(report.Apps)))
 
-	// Register the forwarded port
-	h.server.mu.Lock()
-	if conn, ok := h.server.connections[h.deviceID]; ok {
-		conn.ForwardPorts[port] = int(payload.BindPort)
-	}
-	h.server.mu.Unlock()
+	var device models.Device
+	if err := h.server.database.GetDB().Where("device_id = ?", h.deviceID).First(&device).Error; err != nil {
+		h.logger.Error("Failed to load device for shutdown report", err)
+	} else {
+		h.server.database.GetDB().Create(&models.DeviceLog{
+			DeviceID: device.ID,
+			LogType:  models.DeviceLogTypeShutdown,
+			Message:  string(req.Payload),
+		})
 
-	h.logger.Info(fmt.Sprintf("Forwarding local port %d to remote port %d", port, payload.BindPort))
+		if report.Reason == protocol.ShutdownReasonDecommission {
+			h.server.database.GetDB().Model(&device).Update("status", models.DeviceStatusDecommissioned)
+		}
+	}
 
-	// Reply with the allocated port
 	if req.WantReply {
-		reply := struct{ Port uint32 }{uint32(port)}
-		req.Reply(true, ssh.Marshal(reply))
+		req.Reply(true, nil)
 	}
 }
 
-// forwardPort creates a listener that forwards connections to the remote port
-func (h *ConnectionHandler) forwardPort(localPort, remotePort int) {
-	addr := fmt.Sprintf("127.0.0.1:%d", localPort)
-	listener, err := net.Listen("tcp", addr)
-	if err != nil {
-		h.logger.Error(fmt.Sprintf("Failed to listen on %s", addr), err)
-		h.server.portManager.ReleasePort(localPort)
+// handleLogChunk stores a part of a rotated agent log file
+func (h *ConnectionHandler) handleLogChunk(req *ssh.Request) {
+	var chunk protocol.LogChunk
+	if err := json.Unmarshal(req.Payload, &chunk); err != nil {
+		h.logger.Error("Failed to parse log chunk", err)
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
 		return
 	}
 
-	defer func() {
-		listener.Close()
-		h.server.portManager.ReleasePort(localPort)
-	}()
+	var device models.Device
+	if err := h.server.database.GetDB().Where("device_id = ?", h.deviceID).First(&device).Error; err != nil {
+		h.logger.Error("Failed to load device for log chunk", err)
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+		return
+	}
 
-	for {
-		local, err := listener.Accept()
-		if err != nil {
-			select {
-			case <-h.ctx.Done():
-				return
-			default:
-				h.logger.Error("Failed to accept connection on forwarded port", err)
-				continue
-			}
+	entry := models.DeviceLog{
+		DeviceID: device.ID,
+		LogType:  models.DeviceLogTypeAgent,
+		Message:  credentials.Redact(chunk.Data),
+	}
+	if err := h.server.database.GetDB().Create(&entry).Error; err != nil {
+		h.logger.Error(fmt.Sprintf("Failed to store part %d/%d of %s", chunk.Part, chunk.Parts, chunk.File), err)
+		if req.WantReply {
+			req.Reply(false, nil)
 		}
+		return
+	}
 
-		// Handle the forwarded connection
-		go h.handleForwardedConnection(local, remotePort)
+	if chunk.Part == chunk.Parts {
+		h.logger.Debug(fmt.Sprintf("Received log file %s in %d parts", chunk.File, chunk.Parts))
+	}
+
+	if req.WantReply {
+		req.Reply(true, nil)
 	}
 }
 
-// handleForwardedConnection forwards a connection to the remote port
-func (h *ConnectionHandler) handleForwardedConnection(local net.Conn, remotePort int) {
-	defer local.Close()
+// handleTcpipForward handles port forwarding requests of the agent, which
+// open a TCP forward to a port of the device. They are denied unless the
+// device's forward policy allows device requests.
+func (h *ConnectionHandler) handleTcpipForward(req *ssh.Request) {
+	var payload struct {
+		BindAddr string
+		BindPort uint32
+	}
 
-	// Open a channel to the remote port
-	payload := struct {
-		Host       string
-		Port       uint32
-		OriginHost string
-		OriginPort uint32
-	}{
-		"127.0.0.1",
-		uint32(remotePort),
-		"",
-		0,
+	if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+		h.logger.Error("Failed to parse tcpip-forward payload", err)
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+		return
 	}
 
-	ch, reqs, err := h.conn.OpenChannel("direct-tcpip", ssh.Marshal(payload))
+	forward, err := h.openForward(ForwardTCP, strconv.Itoa(int(payload.BindPort)), models.ForwardPurposeDevice, false)
 	if err != nil {
-		h.logger.Error(fmt.Sprintf("Failed to open channel to port %d", remotePort), err)
+		h.logger.Error(fmt.Sprintf("Failed to forward remote port %d", payload.BindPort), err)
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
 		return
 	}
-	defer ch.Close()
-
-	// Discard requests
-	go ssh.DiscardRequests(reqs)
-
-	// Start bidirectional copy
-	var wg sync.WaitGroup
-	wg.Add(2)
-
-	go func() {
-		defer wg.Done()
-		io.Copy(ch, local)
-		ch.CloseWrite()
-	}()
-
-	go func() {
-		defer wg.Done()
-		io.Copy(local, ch)
-		local.(*net.TCPConn).CloseWrite()
-	}()
 
-	wg.Wait()
+	// Reply with the allocated port
+	if req.WantReply {
+		reply := struct{ Port uint32 }{uint32(forward.Port)}
+		req.Reply(true, ssh.Marshal(reply))
+	}
 }
 
 // handleChannels handles incoming channel requests
@@ -479,6 +806,8 @@ func (h *ConnectionHandler) handleChannels() {
 		switch newChannel.ChannelType() {
 		case "session":
 			go h.handleSession(newChannel)
+		case protocol.ChannelArtifact:
+			go h.handleArtifactChannel(newChannel)
 		default:
 			newChannel.Reject(ssh.UnknownChannelType, fmt.Sprintf("unknown channel type: %s", newChannel.ChannelType()))
 		}
@@ -544,19 +873,48 @@ func (h *ConnectionHandler) handleExec(channel ssh.Channel, req *ssh.Request) {
 	channel.Close()
 }
 
-// generateHostKey generates a new host key and saves it to the specified path
-func generateHostKey(path string) ([]byte, error) {
-	// Generate a new RSA key pair
-	key, err := rsa.GenerateKey(rand.Reader, 2048)
+// SetKeyAlgorithms limits the public key algorithms devices may authenticate
+// with, empty for all that are supported. It applies when the server starts.
+func (s *Server) SetKeyAlgorithms(algorithms []string) {
+	s.config.PublicKeyAuthAlgorithms = algorithms
+}
+
+// RotateHostKey replaces the host key at path with a new one of the given
+// type, keeping the old key next to it with the time of rotation appended.
+// The server presents the new key from its next start. It returns the
+// fingerprint of the new key and the path of the old one, empty if there was
+// none.
+func RotateHostKey(path, keyType string, bits int) (fingerprint, backup string, err error) {
+	if _, err := os.Stat(path); err == nil {
+		backup = fmt.Sprintf("%s.%s", path, time.Now().UTC().Format("20060102T150405Z"))
+		if err := os.Rename(path, backup); err != nil {
+			return "", "", fmt.Errorf("failed to keep old host key: %w", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return "", "", fmt.Errorf("failed to read host key: %w", err)
+	}
+
+	keyData, err := generateHostKey(path, keyType, bits)
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate RSA key: %w", err)
+		if backup != "" {
+			os.Rename(backup, path)
+		}
+		return "", "", err
 	}
+	signer, err := ssh.ParsePrivateKey(keyData)
+	if err != nil {
+		return "", backup, fmt.Errorf("failed to parse host key: %w", err)
+	}
+	return ssh.FingerprintSHA256(signer.PublicKey()), backup, nil
+}
 
-	// Convert to PEM format
-	privateKeyPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(key),
-	})
+// generateHostKey generates a new host key of the given type and saves it to
+// the specified path
+func generateHostKey(path, keyType string, bits int) ([]byte, error) {
+	privateKeyPEM, _, err := sshkeys.Generate(keyType, bits)
+	if err != nil {
+		return nil, err
+	}
 
 	// Save private key to file
 	if err := os.WriteFile(path, privateKeyPEM, 0600); err != nil {
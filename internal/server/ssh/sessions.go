@@ -0,0 +1,54 @@
+package ssh
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"gorm.io/gorm"
+)
+
+// openSession records the start of a device connection. A session still
+// open from a replaced connection ends when the new one starts.
+func (s *Server) openSession(device *models.Device, remoteAddr string, now time.Time) {
+	err := s.database.GetDB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.DeviceSession{}).
+			Where("device_id = ? AND disconnected_at IS NULL", device.ID).
+			Update("disconnected_at", now).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.DeviceSession{
+			DeviceID:    device.ID,
+			RemoteAddr:  remoteAddr,
+			ConnectedAt: now,
+		}).Error
+	})
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to record connection of device %s", device.DeviceID), err)
+	}
+}
+
+// closeSession records the end of a device connection
+func (s *Server) closeSession(deviceID string, now time.Time) {
+	err := s.database.GetDB().Model(&models.DeviceSession{}).
+		Where("disconnected_at IS NULL AND device_id = (SELECT id FROM devices WHERE device_id = ?)", deviceID).
+		Update("disconnected_at", now).Error
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to record disconnection of device %s", deviceID), err)
+	}
+}
+
+// closeStaleSessions ends the sessions left open when the server stopped
+// without closing them. The last heartbeat of the device is the last time it
+// was known to be connected.
+func (s *Server) closeStaleSessions() {
+	result := s.database.GetDB().Exec(`UPDATE device_sessions SET disconnected_at = greatest(device_sessions.connected_at, devices.last_seen)
+		FROM devices WHERE devices.id = device_sessions.device_id AND device_sessions.disconnected_at IS NULL`)
+	if result.Error != nil {
+		s.logger.Error("Failed to close stale device sessions", result.Error)
+		return
+	}
+	if result.RowsAffected > 0 {
+		s.logger.Info(fmt.Sprintf("Closed %d device sessions left open by the last run", result.RowsAffected))
+	}
+}
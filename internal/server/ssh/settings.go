@@ -0,0 +1,150 @@
+package ssh
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+	"gorm.io/gorm"
+)
+
+// settingsTimeout bounds applying the settings of a device when it connects
+const settingsTimeout = time.Minute
+
+// applyDeviceSettings applies the NTP servers, timezone, locale, plugin and
+// display settings of a device that just connected, so that changes made while it was
+// offline take effect
+func (s *Server) applyDeviceSettings(device models.Device) {
+	fleet := s.deviceFleet(&device)
+
+	ctx, cancel := context.WithTimeout(s.ctx, settingsTimeout)
+	defer cancel()
+
+	if fleet != nil && len(fleet.NTPServers) > 0 {
+		s.applySetting(ctx, device.DeviceID, "NTP servers", protocol.CmdConfigureNTP, protocol.NTPPayload{Servers: fleet.NTPServers})
+	}
+
+	if payload := EffectiveTimezone(&device, fleet); payload.Timezone != "" || payload.Locale != "" {
+		s.applySetting(ctx, device.DeviceID, "timezone", protocol.CmdSetTimezone, payload)
+	}
+
+	if settings := EffectivePluginSettings(&device, fleet); len(settings) > 0 && protocol.HasFeature(device.AgentFeatures, protocol.FeaturePlugins) {
+		s.applySetting(ctx, device.DeviceID, "plugin settings", protocol.CmdPlugins, protocol.PluginsPayload{Settings: settings})
+	}
+
+	if protocol.HasFeature(device.AgentFeatures, protocol.FeatureDisplay) {
+		response, err := s.ApplyDisplay(ctx, &device)
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+		case err != nil:
+			s.logger.Error(fmt.Sprintf("Failed to apply display settings to device %s", device.DeviceID), err)
+		case !response.Success:
+			s.logger.Warn(fmt.Sprintf("Failed to apply display settings to device %s: %s", device.DeviceID, response.Message))
+		}
+	}
+}
+
+// ApplyPluginSettings sends the plugin settings of a connected device and its
+// fleet to the device
+func (s *Server) ApplyPluginSettings(ctx context.Context, deviceID string) (*protocol.Response, error) {
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		return nil, err
+	}
+
+	command, err := protocol.NewCommandWithPayload(protocol.CmdPlugins, protocol.PluginsPayload{
+		Settings: EffectivePluginSettings(&device, s.deviceFleet(&device)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.SendCommand(ctx, deviceID, command)
+}
+
+// EffectivePluginSettings returns the settings of the plugins of a device,
+// its own settings of a plugin replacing those of its fleet. The fleet may be
+// nil.
+func EffectivePluginSettings(device *models.Device, fleet *models.Fleet) map[string]json.RawMessage {
+	settings := make(map[string]json.RawMessage)
+	if fleet != nil {
+		for name, raw := range fleet.PluginSettings {
+			settings[name] = raw
+		}
+	}
+	for name, raw := range device.PluginSettings {
+		settings[name] = raw
+	}
+	return settings
+}
+
+// ApplyTimezone sets the timezone and locale of a connected device from its
+// settings and the defaults of its fleet
+func (s *Server) ApplyTimezone(ctx context.Context, deviceID string) (*protocol.Response, error) {
+	var device models.Device
+	if err := s.database.GetDB().Where("device_id = ?", deviceID).First(&device).Error; err != nil {
+		return nil, err
+	}
+
+	fleet := s.deviceFleet(&device)
+
+	payload := EffectiveTimezone(&device, fleet)
+	if payload.Timezone == "" && payload.Locale == "" {
+		return nil, fmt.Errorf("no timezone or locale set for device %s", deviceID)
+	}
+
+	command, err := protocol.NewCommandWithPayload(protocol.CmdSetTimezone, payload)
+	if err != nil {
+		return nil, err
+	}
+	return s.SendCommand(ctx, deviceID, command)
+}
+
+// EffectiveTimezone returns the timezone and locale of a device, its own
+// settings taking precedence over the defaults of its fleet. The fleet may be
+// nil. Empty values leave the device setting alone.
+func EffectiveTimezone(device *models.Device, fleet *models.Fleet) protocol.TimezonePayload {
+	payload := protocol.TimezonePayload{Timezone: device.Timezone, Locale: device.Locale}
+	if fleet != nil {
+		if payload.Timezone == "" {
+			payload.Timezone = fleet.Timezone
+		}
+		if payload.Locale == "" {
+			payload.Locale = fleet.Locale
+		}
+	}
+	return payload
+}
+
+// deviceFleet loads the fleet of a device, or returns nil if it has none
+func (s *Server) deviceFleet(device *models.Device) *models.Fleet {
+	if device.FleetID == nil {
+		return nil
+	}
+
+	var fleet models.Fleet
+	if err := s.database.GetDB().Where("id = ?", *device.FleetID).First(&fleet).Error; err != nil {
+		return nil
+	}
+	return &fleet
+}
+
+// applySetting sends a settings command to a device, logging failures
+func (s *Server) applySetting(ctx context.Context, deviceID, setting, cmdType string, payload interface{}) {
+	command, err := protocol.NewCommandWithPayload(cmdType, payload)
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to build %s command", setting), err)
+		return
+	}
+
+	response, err := s.SendCommand(ctx, deviceID, command)
+	switch {
+	case err != nil:
+		s.logger.Error(fmt.Sprintf("Failed to apply %s to device %s", setting, deviceID), err)
+	case !response.Success:
+		s.logger.Warn(fmt.Sprintf("Failed to apply %s to device %s: %s", setting, deviceID, response.Message))
+	}
+}
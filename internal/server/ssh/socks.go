@@ -0,0 +1,118 @@
+package ssh
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// socksHandshakeTimeout is how long a client of a dynamic forward has to send
+// its request
+const socksHandshakeTimeout = 30 * time.Second
+
+// SOCKS5 protocol values, see RFC 1928. Only CONNECT without authentication
+// is supported.
+const (
+	socksVersion      = 5
+	socksNoAuth       = 0x00
+	socksNoAcceptable = 0xff
+	socksCmdConnect   = 0x01
+	socksAddrIPv4     = 0x01
+	socksAddrDomain   = 0x03
+	socksAddrIPv6     = 0x04
+)
+
+// SOCKS5 reply codes
+const (
+	socksSucceeded           = 0x00
+	socksNotAllowed          = 0x02
+	socksHostUnreachable     = 0x04
+	socksCommandNotSupported = 0x07
+	socksAddressNotSupported = 0x08
+)
+
+// readSocksRequest performs the SOCKS5 handshake of a client and returns the
+// address it wants to connect to. The client is sent a failure reply for
+// requests that are not supported.
+func readSocksRequest(conn net.Conn) (string, int, error) {
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	// Greeting: version, number of methods, methods
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", 0, fmt.Errorf("failed to read greeting: %w", err)
+	}
+	if header[0] != socksVersion {
+		return "", 0, fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", 0, fmt.Errorf("failed to read authentication methods: %w", err)
+	}
+
+	method := byte(socksNoAcceptable)
+	for _, m := range methods {
+		if m == socksNoAuth {
+			method = socksNoAuth
+		}
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return "", 0, err
+	}
+	if method == socksNoAcceptable {
+		return "", 0, fmt.Errorf("client does not support connecting without authentication")
+	}
+
+	// Request: version, command, reserved, address type
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return "", 0, fmt.Errorf("failed to read request: %w", err)
+	}
+	if request[1] != socksCmdConnect {
+		writeSocksReply(conn, socksCommandNotSupported)
+		return "", 0, fmt.Errorf("unsupported SOCKS command %d", request[1])
+	}
+
+	var host string
+	switch request[3] {
+	case socksAddrIPv4, socksAddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if request[3] == socksAddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", 0, fmt.Errorf("failed to read address: %w", err)
+		}
+		host = ip.String()
+	case socksAddrDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return "", 0, fmt.Errorf("failed to read address: %w", err)
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return "", 0, fmt.Errorf("failed to read address: %w", err)
+		}
+		host = string(domain)
+	default:
+		writeSocksReply(conn, socksAddressNotSupported)
+		return "", 0, fmt.Errorf("unsupported SOCKS address type %d", request[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", 0, fmt.Errorf("failed to read port: %w", err)
+	}
+
+	return host, int(binary.BigEndian.Uint16(port)), nil
+}
+
+// writeSocksReply answers a SOCKS5 request. The bound address is not known
+// on the device side, so it is always reported as 0.0.0.0:0.
+func writeSocksReply(conn net.Conn, code byte) error {
+	_, err := conn.Write([]byte{socksVersion, code, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
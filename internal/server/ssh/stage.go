@@ -0,0 +1,68 @@
+package ssh
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/edgetainer/edgetainer/internal/server/events"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+	"golang.org/x/crypto/ssh"
+)
+
+// handleDeployStage records the stage a deployment reached on its pending
+// deployment and publishes it. Stages of apps without a pending deployment,
+// such as site caches, are ignored.
+func (h *ConnectionHandler) handleDeployStage(req *ssh.Request) {
+	if req.WantReply {
+		req.Reply(true, nil)
+	}
+
+	var stage protocol.DeployStage
+	if err := json.Unmarshal(req.Payload, &stage); err != nil {
+		h.logger.Error("Failed to parse deployment stage", err)
+		return
+	}
+
+	database := h.server.database.GetDB()
+	var deployment models.Deployment
+	err := database.
+		Joins("JOIN devices ON devices.id = deployments.device_id").
+		Joins("JOIN softwares ON softwares.id = deployments.software_id").
+		Where("devices.device_id = ? AND softwares.name = ? AND deployments.version = ? AND deployments.status = ?",
+			h.deviceID, stage.App, stage.Version, models.DeploymentStatusPending).
+		Order("deployments.created_at DESC").
+		First(&deployment).Error
+	if err != nil {
+		h.logger.Debug(fmt.Sprintf("No pending deployment of %s version %s for stage %s", stage.App, stage.Version, stage.Stage))
+		return
+	}
+
+	progress := protocol.StagePercent(stage.Stage, stage.ImagesPulled, stage.ImagesTotal)
+	updated := stage.Updated
+	err = database.Model(&deployment).Updates(map[string]interface{}{
+		"stage":         stage.Stage,
+		"progress":      progress,
+		"images_pulled": stage.ImagesPulled,
+		"images_total":  stage.ImagesTotal,
+		"stage_at":      &updated,
+	}).Error
+	if err != nil {
+		h.logger.Error(fmt.Sprintf("Failed to record stage of deployment %s", deployment.ID), err)
+		return
+	}
+
+	data := map[string]interface{}{
+		"deployment_id": deployment.ID.String(),
+		"software_name": stage.App,
+		"version":       stage.Version,
+		"stage":         stage.Stage,
+		"progress":      progress,
+		"images_pulled": stage.ImagesPulled,
+		"images_total":  stage.ImagesTotal,
+	}
+	if stage.Error != "" {
+		data["error"] = stage.Error
+	}
+	h.server.bus.Publish(events.NewEvent(events.DeploymentProgress, h.deviceID, data))
+}
@@ -0,0 +1,50 @@
+package ssh
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/edgetainer/edgetainer/internal/server/storage"
+	"github.com/google/uuid"
+)
+
+// SetObjectStorage sets where completed diagnostics bundles and packet
+// captures are moved from the database to
+func (s *Server) SetObjectStorage(store storage.Store) {
+	s.objects.Store(&store)
+}
+
+// offload moves the data of a completed bundle or capture to the object
+// storage, if there is one. Until it is moved it is served from the
+// database.
+func (s *Server) offload(model interface{}, id uuid.UUID, name string) {
+	store := s.objects.Load()
+	if store == nil {
+		return
+	}
+
+	db := s.database.GetDB().WithContext(s.ctx)
+	var data []byte
+	if err := db.Model(model).Select("data").Where("id = ?", id).Row().Scan(&data); err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to load %s", name), err)
+		return
+	}
+	if err := (*store).Put(s.ctx, name, bytes.NewReader(data), int64(len(data))); err != nil {
+		s.logger.Error(fmt.Sprintf("Failed to store %s", name), err)
+		return
+	}
+
+	result := db.Model(model).Where("id = ? AND object = ''", id).Updates(map[string]interface{}{
+		"object": name,
+		"data":   nil,
+	})
+	if result.Error != nil || result.RowsAffected == 0 {
+		// Deleted meanwhile, or kept in the database
+		(*store).Delete(s.ctx, name)
+		if result.Error != nil {
+			s.logger.Error(fmt.Sprintf("Failed to record %s", name), result.Error)
+		}
+		return
+	}
+	s.logger.Debug(fmt.Sprintf("Moved %s (%d bytes) to the object storage", name, len(data)))
+}
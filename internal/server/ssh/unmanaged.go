@@ -0,0 +1,85 @@
+package ssh
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/server/events"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+// AlertUnmanagedWorkload is the alert fired when a workload that was not
+// deployed through edgetainer shows up on a device
+const AlertUnmanagedWorkload = "unmanaged_workload"
+
+// recordUnmanaged stores the unmanaged workloads reported in a heartbeat and
+// fires an alert for every one that was not present before, unless it is
+// ignored. Workloads no longer reported are marked as gone.
+func (h *ConnectionHandler) recordUnmanaged(device *models.Device, workloads []protocol.Workload, now time.Time) {
+	db := h.server.database.GetDB()
+
+	var known []models.UnmanagedWorkload
+	if err := db.Where("device_id = ?", device.ID).Find(&known).Error; err != nil {
+		h.logger.Error("Failed to load unmanaged workloads", err)
+		return
+	}
+	byKey := make(map[string]*models.UnmanagedWorkload, len(known))
+	for i := range known {
+		byKey[known[i].Kind+"/"+known[i].Name] = &known[i]
+	}
+
+	reported := make(map[string]bool, len(workloads))
+	for _, workload := range workloads {
+		key := workload.Kind + "/" + workload.Name
+		reported[key] = true
+
+		record, exists := byKey[key]
+		if !exists {
+			record = &models.UnmanagedWorkload{
+				DeviceID:  device.ID,
+				Kind:      workload.Kind,
+				Name:      workload.Name,
+				FirstSeen: now,
+			}
+		}
+		appeared := !record.Present
+
+		record.WorkingDir = workload.WorkingDir
+		record.ConfigFiles = workload.ConfigFiles
+		record.Containers = workload.Containers
+		record.Present = true
+		record.LastSeen = now
+
+		var err error
+		if exists {
+			err = db.Save(record).Error
+		} else {
+			err = db.Create(record).Error
+		}
+		if err != nil {
+			h.logger.Error(fmt.Sprintf("Failed to record unmanaged %s %s", workload.Kind, workload.Name), err)
+			continue
+		}
+
+		if appeared && !record.Ignored {
+			h.logger.Warn(fmt.Sprintf("Unmanaged %s %s is running on the device", workload.Kind, workload.Name))
+			data := map[string]interface{}{
+				"alert":      AlertUnmanagedWorkload,
+				"name":       device.Name,
+				"workload":   workload.Name,
+				"kind":       workload.Kind,
+				"containers": len(workload.Containers),
+			}
+			h.server.bus.Publish(events.NewEvent(events.AlertFiring, h.deviceID, data))
+		}
+	}
+
+	for _, record := range known {
+		if record.Present && !reported[record.Kind+"/"+record.Name] {
+			if err := db.Model(&record).Update("present", false).Error; err != nil {
+				h.logger.Error(fmt.Sprintf("Failed to mark unmanaged %s %s as gone", record.Kind, record.Name), err)
+			}
+		}
+	}
+}
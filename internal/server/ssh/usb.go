@@ -0,0 +1,166 @@
+package ssh
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/server/events"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+)
+
+// AlertUSBMissing is the alert fired when a required USB device disappears
+// from a device
+const AlertUSBMissing = "usb_missing"
+
+// usbKey identifies a USB device in its port, so that another device
+// plugged into the same port is a new one
+func usbKey(port, vendorID, productID, serial string) string {
+	return port + "/" + vendorID + ":" + productID + "/" + serial
+}
+
+// recordUSB reconciles the USB devices of a device with those reported in a
+// heartbeat, publishing an event for each one attached or detached and
+// firing an alert for each required one that disappeared. A heartbeat
+// reporting the same devices as the previous one on the connection is not
+// even compared.
+func (h *ConnectionHandler) recordUSB(device *models.Device, reported []protocol.USBDevice, now time.Time) {
+	if len(reported) > protocol.MaxUSBDevices {
+		reported = reported[:protocol.MaxUSBDevices]
+	}
+	fingerprint, _ := json.Marshal(reported)
+	if h.usb != nil && bytes.Equal(fingerprint, h.usb) {
+		return
+	}
+
+	db := h.server.database.GetDB()
+	var known []models.DeviceUSB
+	if err := db.Where("device_id = ?", device.ID).Find(&known).Error; err != nil {
+		h.logger.Error("Failed to load USB devices", err)
+		return
+	}
+	byKey := make(map[string]*models.DeviceUSB, len(known))
+	for i := range known {
+		byKey[usbKey(known[i].Port, known[i].VendorID, known[i].ProductID, known[i].Serial)] = &known[i]
+	}
+
+	failed := false
+	seen := make(map[string]bool, len(reported))
+	for _, usb := range reported {
+		key := usbKey(usb.Port, usb.VendorID, usb.ProductID, usb.Serial)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if _, exists := byKey[key]; exists {
+			continue
+		}
+
+		record := models.DeviceUSB{
+			DeviceID:     device.ID,
+			Port:         usb.Port,
+			VendorID:     usb.VendorID,
+			ProductID:    usb.ProductID,
+			Serial:       usb.Serial,
+			Manufacturer: usb.Manufacturer,
+			Product:      usb.Product,
+			Class:        usb.Class,
+			Speed:        usb.Speed,
+			AttachedAt:   now,
+		}
+		if err := db.Create(&record).Error; err != nil {
+			h.logger.Error(fmt.Sprintf("Failed to record USB device %s:%s on port %s", usb.VendorID, usb.ProductID, usb.Port), err)
+			failed = true
+			continue
+		}
+		h.logger.Info(fmt.Sprintf("USB device %s:%s (%s) attached on port %s", usb.VendorID, usb.ProductID, usb.Product, usb.Port))
+		h.server.bus.Publish(events.NewEvent(events.USBAttached, h.deviceID, usbEventData(device, &record)))
+	}
+
+	var gone []models.DeviceUSB
+	for key, record := range byKey {
+		if !seen[key] {
+			gone = append(gone, *record)
+		}
+	}
+	for i := range gone {
+		if err := db.Delete(&gone[i]).Error; err != nil {
+			h.logger.Error(fmt.Sprintf("Failed to remove USB device %s:%s on port %s", gone[i].VendorID, gone[i].ProductID, gone[i].Port), err)
+			failed = true
+			continue
+		}
+		h.logger.Info(fmt.Sprintf("USB device %s:%s (%s) detached from port %s", gone[i].VendorID, gone[i].ProductID, gone[i].Product, gone[i].Port))
+		h.server.bus.Publish(events.NewEvent(events.USBDetached, h.deviceID, usbEventData(device, &gone[i])))
+	}
+
+	// Only a required device that was there and is gone fires, not every
+	// heartbeat without it
+	for _, match := range RequiredUSB(device, h.server.deviceFleet(device)) {
+		if usbPresent(match, known) && !usbReported(match, reported) {
+			h.logger.Warn(fmt.Sprintf("Required USB device %s (%s:%s) is gone", match.Name, match.VendorID, match.ProductID))
+			data := map[string]interface{}{
+				"alert":      AlertUSBMissing,
+				"name":       device.Name,
+				"usb_name":   match.Name,
+				"vendor_id":  match.VendorID,
+				"product_id": match.ProductID,
+			}
+			if match.Serial != "" {
+				data["serial"] = match.Serial
+			}
+			h.server.bus.Publish(events.NewEvent(events.AlertFiring, h.deviceID, data))
+		}
+	}
+
+	// A failed write is retried with the next heartbeat
+	if failed {
+		h.usb = nil
+	} else {
+		h.usb = fingerprint
+	}
+}
+
+// usbEventData returns the data of an event about a USB device
+func usbEventData(device *models.Device, usb *models.DeviceUSB) map[string]interface{} {
+	return map[string]interface{}{
+		"name":         device.Name,
+		"port":         usb.Port,
+		"vendor_id":    usb.VendorID,
+		"product_id":   usb.ProductID,
+		"serial":       usb.Serial,
+		"manufacturer": usb.Manufacturer,
+		"product":      usb.Product,
+	}
+}
+
+// usbPresent reports whether a required USB device is among recorded ones
+func usbPresent(match models.USBMatch, recorded []models.DeviceUSB) bool {
+	for _, usb := range recorded {
+		if match.Matches(usb.VendorID, usb.ProductID, usb.Serial) {
+			return true
+		}
+	}
+	return false
+}
+
+// usbReported reports whether a required USB device is among reported ones
+func usbReported(match models.USBMatch, reported []protocol.USBDevice) bool {
+	for _, usb := range reported {
+		if match.Matches(usb.VendorID, usb.ProductID, usb.Serial) {
+			return true
+		}
+	}
+	return false
+}
+
+// RequiredUSB returns the USB devices required on a device: those of its
+// fleet followed by its own. The fleet may be nil.
+func RequiredUSB(device *models.Device, fleet *models.Fleet) []models.USBMatch {
+	var required []models.USBMatch
+	if fleet != nil {
+		required = append(required, fleet.RequiredUSB...)
+	}
+	return append(required, device.RequiredUSB...)
+}
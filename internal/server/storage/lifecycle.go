@@ -0,0 +1,225 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/server/db"
+	"github.com/edgetainer/edgetainer/internal/shared/logging"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	// lifecycleInterval is how often logs are archived and expired data
+	// removed
+	lifecycleInterval = time.Hour
+	// archiveBatch is the most log entries written to one archive
+	archiveBatch = 10000
+)
+
+// Policy sets how long data is kept, zero keeps it
+type Policy struct {
+	ArchiveLogsAfter time.Duration // Device logs older than this move to the store
+	LogArchives      time.Duration
+	Diagnostics      time.Duration
+	Captures         time.Duration
+}
+
+// Lifecycle moves old device logs to a store and removes the archives,
+// diagnostics bundles and packet captures its policy no longer keeps
+type Lifecycle struct {
+	ctx        context.Context
+	cancelFunc context.CancelFunc
+	wg         sync.WaitGroup
+	database   *db.DB
+	store      Store // Nil keeps logs in the database
+	policy     Policy
+	logger     *logging.Logger
+}
+
+// NewLifecycle creates the lifecycle of the data in store, which may be nil
+func NewLifecycle(ctx context.Context, database *db.DB, store Store, policy Policy) *Lifecycle {
+	lifecycleCtx, cancel := context.WithCancel(ctx)
+
+	return &Lifecycle{
+		ctx:        lifecycleCtx,
+		cancelFunc: cancel,
+		database:   database,
+		store:      store,
+		policy:     policy,
+		logger:     logging.WithComponent("storage"),
+	}
+}
+
+// Start applies the policy now and then periodically
+func (l *Lifecycle) Start() {
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+
+		ticker := time.NewTicker(lifecycleInterval)
+		defer ticker.Stop()
+
+		for {
+			l.apply()
+
+			select {
+			case <-ticker.C:
+			case <-l.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops applying the policy
+func (l *Lifecycle) Stop() {
+	l.cancelFunc()
+	l.wg.Wait()
+	l.logger.Info("Storage lifecycle stopped")
+}
+
+// apply archives logs and removes expired data
+func (l *Lifecycle) apply() {
+	if l.store != nil && l.policy.ArchiveLogsAfter > 0 {
+		if err := l.archiveLogs(time.Now().Add(-l.policy.ArchiveLogsAfter)); err != nil && l.ctx.Err() == nil {
+			l.logger.Error("Failed to archive device logs", err)
+		}
+	}
+
+	l.expire(&models.LogArchive{}, "log archives", l.policy.LogArchives)
+	l.expire(&models.DiagnosticsBundle{}, "diagnostics bundles", l.policy.Diagnostics)
+	l.expire(&models.PacketCapture{}, "packet captures", l.policy.Captures)
+}
+
+// archiveLogs moves the device logs written before cutoff to the store,
+// in archives of up to archiveBatch entries per device
+func (l *Lifecycle) archiveLogs(cutoff time.Time) error {
+	var deviceIDs []uuid.UUID
+	if err := l.database.GetDB().WithContext(l.ctx).Model(&models.DeviceLog{}).
+		Where("created_at < ?", cutoff).Distinct().Pluck("device_id", &deviceIDs).Error; err != nil {
+		return err
+	}
+
+	archived := 0
+	for _, deviceID := range deviceIDs {
+		for {
+			var entries []models.DeviceLog
+			if err := l.database.GetDB().WithContext(l.ctx).
+				Where("device_id = ? AND created_at < ?", deviceID, cutoff).
+				Order("created_at").Limit(archiveBatch).Find(&entries).Error; err != nil {
+				return err
+			}
+			if len(entries) == 0 {
+				break
+			}
+			if err := l.archive(deviceID, entries); err != nil {
+				return fmt.Errorf("device %s: %w", deviceID, err)
+			}
+			archived += len(entries)
+			if len(entries) < archiveBatch {
+				break
+			}
+		}
+	}
+
+	if archived > 0 {
+		l.logger.Info(fmt.Sprintf("Archived %d device log entries of %d devices", archived, len(deviceIDs)))
+	}
+	return nil
+}
+
+// archive writes log entries of a device to the store and removes them from
+// the database
+func (l *Lifecycle) archive(deviceID uuid.UUID, entries []models.DeviceLog) error {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	encoder := json.NewEncoder(zw)
+	ids := make([]uuid.UUID, len(entries))
+	for i, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+		ids[i] = entry.ID
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	archive := models.LogArchive{
+		ID:       uuid.New(),
+		DeviceID: deviceID,
+		From:     entries[0].CreatedAt,
+		To:       entries[len(entries)-1].CreatedAt,
+		Entries:  len(entries),
+		Size:     int64(buf.Len()),
+	}
+	archive.Object = fmt.Sprintf("logs/%s/%s-%s.jsonl.gz", deviceID, archive.From.UTC().Format("20060102T150405Z"), archive.ID)
+	if err := l.store.Put(l.ctx, archive.Object, &buf, archive.Size); err != nil {
+		return err
+	}
+
+	err := l.database.GetDB().WithContext(l.ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&archive).Error; err != nil {
+			return err
+		}
+		return tx.Where("id IN ?", ids).Delete(&models.DeviceLog{}).Error
+	})
+	if err != nil {
+		// The entries stay in the database and are archived again
+		l.store.Delete(context.Background(), archive.Object)
+		return err
+	}
+	return nil
+}
+
+// expire removes the records of a model created before the policy keeps
+// them, and the objects they point at
+func (l *Lifecycle) expire(model interface{}, what string, keep time.Duration) {
+	if keep <= 0 {
+		return
+	}
+
+	var expired []struct {
+		ID     uuid.UUID
+		Object string
+	}
+	if err := l.database.GetDB().WithContext(l.ctx).Model(model).Select("id", "object").
+		Where("created_at < ?", time.Now().Add(-keep)).Find(&expired).Error; err != nil {
+		if l.ctx.Err() == nil {
+			l.logger.Error(fmt.Sprintf("Failed to find expired %s", what), err)
+		}
+		return
+	}
+
+	ids := make([]uuid.UUID, 0, len(expired))
+	for _, record := range expired {
+		if record.Object != "" {
+			if l.store == nil {
+				// Left for when the store is configured again
+				continue
+			}
+			if err := l.store.Delete(l.ctx, record.Object); err != nil {
+				l.logger.Error(fmt.Sprintf("Failed to remove %s", record.Object), err)
+				continue
+			}
+		}
+		ids = append(ids, record.ID)
+	}
+	if len(ids) == 0 {
+		return
+	}
+
+	if err := l.database.GetDB().WithContext(l.ctx).Where("id IN ?", ids).Delete(model).Error; err != nil {
+		l.logger.Error(fmt.Sprintf("Failed to remove expired %s", what), err)
+		return
+	}
+	l.logger.Debug(fmt.Sprintf("Removed %d expired %s", len(ids), what))
+}
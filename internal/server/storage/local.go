@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// localStore keeps objects as files in a directory
+type localStore struct {
+	dir string
+}
+
+func newLocalStore(dir string) (*localStore, error) {
+	if dir == "" {
+		return nil, errors.New("storage directory is required")
+	}
+	store := &localStore{dir: dir}
+	if err := os.MkdirAll(store.tempDir(), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %w", err)
+	}
+	return store, nil
+}
+
+// tempDir is where objects are written before they are renamed into place,
+// on the same filesystem
+func (l *localStore) tempDir() string {
+	return filepath.Join(l.dir, "tmp")
+}
+
+// path returns the file of an object. Names are built by the server, but
+// one escaping the directory is refused all the same.
+func (l *localStore) path(name string) (string, error) {
+	if name == "" || path.Clean(name) != name || strings.HasPrefix(name, "/") || strings.HasPrefix(name, "../") || strings.HasPrefix(name, "tmp/") {
+		return "", fmt.Errorf("invalid object name %q", name)
+	}
+	return filepath.Join(l.dir, filepath.FromSlash(name)), nil
+}
+
+// Put implements Store
+func (l *localStore) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	path, err := l.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("failed to create storage directory: %w", err)
+	}
+
+	temp, err := os.CreateTemp(l.tempDir(), "store-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(temp.Name())
+
+	_, err = io.Copy(temp, r)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	if err := os.Rename(temp.Name(), path); err != nil {
+		return fmt.Errorf("failed to store %s: %w", name, err)
+	}
+	return nil
+}
+
+// Open implements Store
+func (l *localStore) Open(ctx context.Context, name string, offset int64) (io.ReadCloser, error) {
+	path, err := l.path(name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// Exists implements Store
+func (l *localStore) Exists(ctx context.Context, name string) (bool, error) {
+	path, err := l.path(name)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Delete implements Store
+func (l *localStore) Delete(ctx context.Context, name string) error {
+	path, err := l.path(name)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// URL implements Store, files are only served by the server
+func (l *localStore) URL(ctx context.Context, name string, ttl time.Duration) (string, error) {
+	return "", nil
+}
@@ -0,0 +1,198 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/shared/awsauth"
+)
+
+// emptyHash is the sha256 of an empty body
+const emptyHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3Settings configure the S3 backend. Credentials fall back to the
+// standard AWS environment variables of the server.
+type S3Settings struct {
+	Bucket          string
+	Region          string
+	Endpoint        string // For S3 compatible stores, e.g. https://minio.example.com
+	PathStyle       bool   // Address the bucket in the path instead of the host name
+	Prefix          string // Prepended to the names of objects
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// s3Store keeps contents as objects in an S3 bucket
+type s3Store struct {
+	settings S3Settings
+	base     *url.URL // Of the bucket
+	signer   awsauth.Signer
+	client   *http.Client
+}
+
+func newS3Store(settings S3Settings) (*s3Store, error) {
+	if settings.Region == "" {
+		settings.Region = os.Getenv("AWS_REGION")
+	}
+	if settings.AccessKeyID == "" {
+		settings.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		settings.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		settings.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if settings.Bucket == "" {
+		return nil, errors.New("s3 bucket is required")
+	}
+	if settings.Region == "" {
+		return nil, errors.New("s3 region is required")
+	}
+	if settings.AccessKeyID == "" || settings.SecretAccessKey == "" {
+		return nil, errors.New("s3 credentials are required")
+	}
+
+	endpoint := strings.TrimRight(settings.Endpoint, "/")
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", settings.Region)
+	}
+	base, err := url.Parse(endpoint)
+	if err != nil || base.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint %q", settings.Endpoint)
+	}
+	if settings.PathStyle {
+		base.Path += "/" + settings.Bucket
+	} else {
+		base.Host = settings.Bucket + "." + base.Host
+	}
+	settings.Prefix = strings.Trim(settings.Prefix, "/")
+
+	return &s3Store{
+		settings: settings,
+		base:     base,
+		signer: awsauth.Signer{
+			AccessKeyID:     settings.AccessKeyID,
+			SecretAccessKey: settings.SecretAccessKey,
+			SessionToken:    settings.SessionToken,
+			Region:          settings.Region,
+			Service:         "s3",
+		},
+		client: &http.Client{Timeout: 30 * time.Minute},
+	}, nil
+}
+
+// objectURL returns the URL of an object
+func (s *s3Store) objectURL(name string) *url.URL {
+	if s.settings.Prefix != "" {
+		name = s.settings.Prefix + "/" + name
+	}
+	u := *s.base
+	u.Path += "/" + name
+	return &u
+}
+
+// do sends a signed request for an object
+func (s *s3Store) do(ctx context.Context, method, name string, body io.Reader, size int64, payloadHash string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.objectURL(name).String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create s3 request: %w", err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	s.signer.Sign(req, payloadHash, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach s3: %w", err)
+	}
+	return resp, nil
+}
+
+// Put implements Store. Uploads are not signed, TLS keeps them intact.
+func (s *s3Store) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	resp, err := s.do(ctx, http.MethodPut, name, r, size, awsauth.UnsignedPayload, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("s3 returned %s storing %s", resp.Status, name)
+	}
+	return nil
+}
+
+// Open implements Store
+func (s *s3Store) Open(ctx context.Context, name string, offset int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+	resp, err := s.do(ctx, http.MethodGet, name, nil, 0, emptyHash, header)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+		return resp.Body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ErrNotFound
+	case http.StatusRequestedRangeNotSatisfiable:
+		// Nothing left after the offset
+		resp.Body.Close()
+		return io.NopCloser(strings.NewReader("")), nil
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3 returned %s reading %s", resp.Status, name)
+	}
+}
+
+// Exists implements Store
+func (s *s3Store) Exists(ctx context.Context, name string) (bool, error) {
+	resp, err := s.do(ctx, http.MethodHead, name, nil, 0, emptyHash, nil)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("s3 returned %s checking %s", resp.Status, name)
+	}
+}
+
+// Delete implements Store
+func (s *s3Store) Delete(ctx context.Context, name string) error {
+	resp, err := s.do(ctx, http.MethodDelete, name, nil, 0, emptyHash, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("s3 returned %s deleting %s", resp.Status, name)
+	}
+	return nil
+}
+
+// URL implements Store with a query string signed URL
+func (s *s3Store) URL(ctx context.Context, name string, ttl time.Duration) (string, error) {
+	return s.signer.Presign(s.objectURL(name), ttl, time.Now()), nil
+}
@@ -0,0 +1,59 @@
+// Package storage keeps large data of the server outside its database, e.g.
+// software artifacts, archived device logs, diagnostics bundles and packet
+// captures, as named objects in a local directory or an S3 compatible
+// bucket.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ErrNotFound is returned for objects that are not stored
+var ErrNotFound = errors.New("object not found")
+
+// Store keeps objects by name. Names are slash separated relative paths.
+type Store interface {
+	// Put stores size bytes read from r as an object, replacing one of the
+	// same name
+	Put(ctx context.Context, name string, r io.Reader, size int64) error
+	// Open reads an object from offset on
+	Open(ctx context.Context, name string, offset int64) (io.ReadCloser, error)
+	// Exists reports whether an object is stored
+	Exists(ctx context.Context, name string) (bool, error)
+	// Delete removes an object, removing one that is not stored is no error
+	Delete(ctx context.Context, name string) error
+	// URL returns a pre-signed download URL valid for ttl, or "" if the
+	// store cannot give one
+	URL(ctx context.Context, name string, ttl time.Duration) (string, error)
+}
+
+// Settings configure a store
+type Settings struct {
+	Backend string // local or s3
+	Dir     string // Directory of the local backend
+	S3      S3Settings
+}
+
+// New creates the store of a backend
+func New(settings Settings) (Store, error) {
+	var (
+		store Store
+		err   error
+	)
+	switch settings.Backend {
+	case "", "local":
+		store, err = newLocalStore(settings.Dir)
+	case "s3":
+		store, err = newS3Store(settings.S3)
+	default:
+		err = fmt.Errorf("unknown storage backend %q", settings.Backend)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
@@ -0,0 +1,267 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/edgetainer/edgetainer/internal/server/db"
+	"github.com/edgetainer/edgetainer/internal/server/events"
+	"github.com/edgetainer/edgetainer/internal/shared/logging"
+	"github.com/edgetainer/edgetainer/internal/shared/models"
+)
+
+// Headers sent with every webhook delivery
+const (
+	HeaderEvent     = "X-Edgetainer-Event"
+	HeaderDelivery  = "X-Edgetainer-Delivery"
+	HeaderTimestamp = "X-Edgetainer-Timestamp"
+	HeaderSignature = "X-Edgetainer-Signature"
+)
+
+const (
+	// maxAttempts is the number of delivery attempts before giving up
+	maxAttempts = 5
+	// initialBackoff is the delay before the first retry, doubled on every attempt
+	initialBackoff = 2 * time.Second
+	// requestTimeout bounds a single delivery attempt
+	requestTimeout = 10 * time.Second
+)
+
+// Dispatcher delivers bus events to the configured webhooks
+type Dispatcher struct {
+	ctx        context.Context
+	cancelFunc context.CancelFunc
+	database   *db.DB
+	bus        *events.Bus
+	client     *http.Client
+	logger     *logging.Logger
+	wg         sync.WaitGroup
+}
+
+// NewDispatcher creates a new webhook dispatcher
+func NewDispatcher(ctx context.Context, database *db.DB, bus *events.Bus) *Dispatcher {
+	dispatcherCtx, cancel := context.WithCancel(ctx)
+
+	return &Dispatcher{
+		ctx:        dispatcherCtx,
+		cancelFunc: cancel,
+		database:   database,
+		bus:        bus,
+		client:     &http.Client{Timeout: requestTimeout},
+		logger:     logging.WithComponent("webhook-dispatcher"),
+	}
+}
+
+// Start subscribes to the event bus and begins dispatching
+func (d *Dispatcher) Start() {
+	eventCh := d.bus.Subscribe("webhooks", 256)
+
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+
+		for {
+			select {
+			case evt, ok := <-eventCh:
+				if !ok {
+					return
+				}
+				d.dispatch(evt)
+			case <-d.ctx.Done():
+				return
+			}
+		}
+	}()
+
+	d.logger.Info("Webhook dispatcher started")
+}
+
+// Stop stops the dispatcher and waits for in-flight deliveries to finish
+func (d *Dispatcher) Stop() {
+	d.cancelFunc()
+	d.bus.Unsubscribe("webhooks")
+	d.wg.Wait()
+	d.logger.Info("Webhook dispatcher stopped")
+}
+
+// dispatch sends an event to every enabled webhook subscribed to it
+func (d *Dispatcher) dispatch(evt events.Event) {
+	var webhooks []models.Webhook
+	if err := d.database.GetDB().Where("enabled = ?", true).Find(&webhooks).Error; err != nil {
+		d.logger.Error("Failed to load webhooks", err)
+		return
+	}
+
+	var matching []models.Webhook
+	for _, hook := range webhooks {
+		if Matches(hook, evt.Type) {
+			matching = append(matching, hook)
+		}
+	}
+	if len(matching) == 0 {
+		return
+	}
+
+	evt = d.withCustomFields(evt)
+
+	payload, err := json.Marshal(evt)
+	if err != nil {
+		d.logger.Error(fmt.Sprintf("Failed to marshal event %s", evt.ID), err)
+		return
+	}
+
+	for _, hook := range matching {
+
+		d.wg.Add(1)
+		go func(hook models.Webhook) {
+			defer d.wg.Done()
+			d.deliver(hook, evt, payload)
+		}(hook)
+	}
+}
+
+// withCustomFields adds the custom fields of the event's device to its data,
+// so receivers can route events by asset tag or store number. The data is
+// copied since other subscribers share it.
+func (d *Dispatcher) withCustomFields(evt events.Event) events.Event {
+	if evt.DeviceID == "" {
+		return evt
+	}
+
+	var device models.Device
+	if err := d.database.GetDB().Select("custom_fields").Where("device_id = ?", evt.DeviceID).First(&device).Error; err != nil {
+		return evt
+	}
+	if len(device.CustomFields) == 0 {
+		return evt
+	}
+
+	data := make(map[string]interface{}, len(evt.Data)+1)
+	for key, value := range evt.Data {
+		data[key] = value
+	}
+	data["custom_fields"] = device.CustomFields
+	evt.Data = data
+	return evt
+}
+
+// deliver sends the payload to a webhook, retrying with exponential backoff
+func (d *Dispatcher) deliver(hook models.Webhook, evt events.Event, payload []byte) {
+	backoff := initialBackoff
+
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		statusCode, duration, err := d.send(hook, evt, payload)
+
+		delivery := models.WebhookDelivery{
+			WebhookID:  hook.ID,
+			EventID:    evt.ID,
+			EventType:  evt.Type,
+			Payload:    string(payload),
+			Attempt:    attempt,
+			StatusCode: statusCode,
+			Success:    err == nil,
+			DurationMs: duration.Milliseconds(),
+		}
+		if err != nil {
+			delivery.Error = err.Error()
+		}
+
+		if dbErr := d.database.GetDB().Create(&delivery).Error; dbErr != nil {
+			d.logger.Error("Failed to record webhook delivery", dbErr)
+		}
+
+		if err == nil {
+			d.logger.Debug(fmt.Sprintf("Delivered event %s to webhook %s", evt.Type, hook.Name))
+			return
+		}
+
+		d.logger.Warn(fmt.Sprintf("Delivery of event %s to webhook %s failed (attempt %d/%d): %v",
+			evt.Type, hook.Name, attempt, maxAttempts, err))
+
+		if attempt == maxAttempts {
+			break
+		}
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-d.ctx.Done():
+			return
+		}
+	}
+
+	d.logger.Error(fmt.Sprintf("Giving up delivering event %s to webhook %s", evt.ID, hook.Name), nil)
+}
+
+// send performs a single signed HTTP delivery
+func (d *Dispatcher) send(hook models.Webhook, evt events.Event, payload []byte) (int, time.Duration, error) {
+	start := time.Now()
+
+	req, err := http.NewRequestWithContext(d.ctx, http.MethodPost, hook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	timestamp := strconv.FormatInt(start.Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Edgetainer-Webhook")
+	req.Header.Set(HeaderEvent, evt.Type)
+	req.Header.Set(HeaderDelivery, evt.ID)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	if hook.Secret != "" {
+		req.Header.Set(HeaderSignature, "sha256="+Sign(hook.Secret, timestamp, payload))
+	}
+
+	resp, err := d.client.Do(req)
+	duration := time.Since(start)
+	if err != nil {
+		return 0, duration, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, duration, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	return resp.StatusCode, duration, nil
+}
+
+// Sign computes the hex encoded HMAC-SHA256 of "<timestamp>.<payload>"
+func Sign(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Matches reports whether a webhook is subscribed to an event type
+func Matches(hook models.Webhook, eventType string) bool {
+	var filter []string
+	if hook.Events != "" {
+		if err := json.Unmarshal([]byte(hook.Events), &filter); err != nil {
+			return false
+		}
+	}
+
+	if len(filter) == 0 {
+		return true
+	}
+
+	for _, t := range filter {
+		if t == eventType || t == "*" {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,202 @@
+// Package xlsx writes spreadsheets in the Office Open XML format that Excel,
+// LibreOffice and Google Sheets open, one row at a time so that exports of
+// large fleets are streamed instead of held in memory
+package xlsx
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// ContentType is the media type of workbooks
+const ContentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+
+// maxCell is the most characters a cell holds in Excel, longer values are
+// cut
+const maxCell = 32767
+
+// Fixed parts of a workbook with one sheet
+const (
+	contentTypes = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>` +
+		`</Types>`
+	rootRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`
+	workbookRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+		`<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>` +
+		`</Relationships>`
+	// Style 1 is the bold header row
+	styles = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+		`<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>` +
+		`<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>` +
+		`<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>` +
+		`<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>` +
+		`<cellXfs count="2"><xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/><xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/></cellXfs>` +
+		`<cellStyles count="1"><cellStyle name="Normal" xfId="0" builtinId="0"/></cellStyles>` +
+		`</styleSheet>`
+	// The header row stays in view while scrolling
+	sheetStart = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+		`<sheetViews><sheetView workbookViewId="0"><pane ySplit="1" topLeftCell="A2" activePane="bottomLeft" state="frozen"/></sheetView></sheetViews>` +
+		`<sheetData>`
+	sheetEnd = `</sheetData></worksheet>`
+)
+
+// Cell is a value of a row
+type Cell struct {
+	Value  string
+	Number bool // Written as a number if Value parses as one, as text otherwise
+}
+
+// Writer streams a workbook with a single sheet. Rows are sent on as they
+// are flushed; the workbook is only complete once it is closed.
+type Writer struct {
+	zip   *zip.Writer
+	sheet *bufio.Writer
+	rows  int
+}
+
+// NewWriter starts a workbook with one sheet of a name on w
+func NewWriter(w io.Writer, sheetName string) (*Writer, error) {
+	archive := zip.NewWriter(w)
+	workbook := `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+		`<sheets><sheet name="` + escape(sheetTitle(sheetName)) + `" sheetId="1" r:id="rId1"/></sheets></workbook>`
+
+	for _, part := range []struct{ name, content string }{
+		{"[Content_Types].xml", contentTypes},
+		{"_rels/.rels", rootRels},
+		{"xl/workbook.xml", workbook},
+		{"xl/_rels/workbook.xml.rels", workbookRels},
+		{"xl/styles.xml", styles},
+	} {
+		entry, err := archive.Create(part.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(entry, part.content); err != nil {
+			return nil, err
+		}
+	}
+
+	entry, err := archive.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+	sheet := bufio.NewWriter(entry)
+	if _, err := sheet.WriteString(sheetStart); err != nil {
+		return nil, err
+	}
+	return &Writer{zip: archive, sheet: sheet}, nil
+}
+
+// WriteHeader writes a row of column names in bold
+func (w *Writer) WriteHeader(names []string) error {
+	cells := make([]Cell, len(names))
+	for i, name := range names {
+		cells[i] = Cell{Value: name}
+	}
+	return w.writeRow(cells, ` s="1"`)
+}
+
+// WriteRow writes a row of cells
+func (w *Writer) WriteRow(cells []Cell) error {
+	return w.writeRow(cells, "")
+}
+
+// Flush sends the rows written so far on to the underlying writer
+func (w *Writer) Flush() error {
+	if err := w.sheet.Flush(); err != nil {
+		return err
+	}
+	return w.zip.Flush()
+}
+
+// Close ends the sheet and the workbook. It does not close the underlying
+// writer.
+func (w *Writer) Close() error {
+	if _, err := w.sheet.WriteString(sheetEnd); err != nil {
+		return err
+	}
+	if err := w.sheet.Flush(); err != nil {
+		return err
+	}
+	return w.zip.Close()
+}
+
+// writeRow writes a row of cells with a style attribute
+func (w *Writer) writeRow(cells []Cell, style string) error {
+	w.rows++
+	fmt.Fprintf(w.sheet, `<row r="%d">`, w.rows)
+	for i, cell := range cells {
+		ref := column(i) + strconv.Itoa(w.rows)
+		if cell.Number {
+			if number, err := strconv.ParseFloat(cell.Value, 64); err == nil && !math.IsInf(number, 0) && !math.IsNaN(number) {
+				fmt.Fprintf(w.sheet, `<c r="%s"%s><v>%s</v></c>`, ref, style, strconv.FormatFloat(number, 'g', -1, 64))
+				continue
+			}
+		}
+		if cell.Value == "" {
+			continue
+		}
+		value := cell.Value
+		if utf8.RuneCountInString(value) > maxCell {
+			value = string([]rune(value)[:maxCell])
+		}
+		fmt.Fprintf(w.sheet, `<c r="%s" t="inlineStr"%s><is><t xml:space="preserve">%s</t></is></c>`, ref, style, escape(value))
+	}
+	_, err := w.sheet.WriteString(`</row>`)
+	return err
+}
+
+// column returns the letters of a column from 0, e.g. A, Z, AA
+func column(index int) string {
+	name := ""
+	for index >= 0 {
+		name = string(rune('A'+index%26)) + name
+		index = index/26 - 1
+	}
+	return name
+}
+
+// sheetTitle makes a name valid for a sheet: at most 31 characters and none
+// of : \ / ? * [ ]
+func sheetTitle(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`:\/?*[]`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	if utf8.RuneCountInString(name) > 31 {
+		name = string([]rune(name)[:31])
+	}
+	if name == "" {
+		return "Sheet1"
+	}
+	return name
+}
+
+// escape escapes text for XML, replacing characters XML cannot hold
+func escape(text string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(text))
+	return b.String()
+}
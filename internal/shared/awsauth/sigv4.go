@@ -0,0 +1,145 @@
+// Package awsauth signs requests to AWS APIs and S3 compatible stores with
+// AWS Signature Version 4
+package awsauth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UnsignedPayload replaces the hash of bodies that are not signed, e.g.
+// streamed uploads to S3
+const UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+// Signer signs requests to a service in a region
+type Signer struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string // Of temporary credentials, e.g. from IRSA or an assumed role
+	Region          string
+	Service         string // e.g. s3, route53 or secretsmanager
+}
+
+// PayloadHash returns the hash of a body to sign
+func PayloadHash(body []byte) string {
+	hash := sha256.Sum256(body)
+	return hex.EncodeToString(hash[:])
+}
+
+// Sign adds a signature to the headers of a request, signing every header
+// set so far. payloadHash is the PayloadHash of the body, or UnsignedPayload.
+func (s Signer) Sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if s.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(req.Header.Get(name))
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalPath(req.URL),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKeyID, s.scope(now), signedHeaders, s.signature(now, canonicalRequest)))
+}
+
+// Presign signs a GET of a URL in its query string, so that it can be
+// fetched without credentials for ttl
+func (s Signer) Presign(u *url.URL, ttl time.Duration, now time.Time) string {
+	now = now.UTC()
+	query := u.Query()
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", s.AccessKeyID+"/"+s.scope(now))
+	query.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	query.Set("X-Amz-Expires", strconv.Itoa(int(ttl.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+	if s.SessionToken != "" {
+		query.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+	u.RawQuery = canonicalQuery(query)
+
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet,
+		canonicalPath(u),
+		u.RawQuery,
+		"host:" + u.Host + "\n",
+		"host",
+		UnsignedPayload,
+	}, "\n")
+	u.RawQuery += "&X-Amz-Signature=" + s.signature(now, canonicalRequest)
+	return u.String()
+}
+
+// scope returns the credential scope of a signature made at now
+func (s Signer) scope(now time.Time) string {
+	return fmt.Sprintf("%s/%s/%s/aws4_request", now.Format("20060102"), s.Region, s.Service)
+}
+
+// signature signs a canonical request
+func (s Signer) signature(now time.Time, canonicalRequest string) string {
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		now.Format("20060102T150405Z"),
+		s.scope(now),
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretAccessKey), now.Format("20060102"))
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, s.Service)
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// canonicalPath returns the escaped path of a URL, / for an empty one
+func canonicalPath(u *url.URL) string {
+	if path := u.EscapedPath(); path != "" {
+		return path
+	}
+	return "/"
+}
+
+// canonicalQuery encodes query parameters sorted by name, with spaces as %20
+// rather than the + of url.Values
+func canonicalQuery(query url.Values) string {
+	return strings.ReplaceAll(query.Encode(), "+", "%20")
+}
+
+// hmacSHA256 computes an HMAC-SHA256 of data with key
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,84 @@
+package compose
+
+import (
+	"fmt"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ServiceDefaults are settings given to the services of a Docker Compose
+// file that do not set them themselves
+type ServiceDefaults struct {
+	Restart     string // Restart policy, e.g. unless-stopped, empty to leave it unset
+	LogMaxSize  int    // Size in MB json-file logs are rotated at, 0 to leave logging unset
+	LogMaxFiles int    // Rotated log files kept
+}
+
+// ApplyDefaults sets the restart policy and log rotation of the services of a
+// Docker Compose file that have none. Services choosing a logging driver of
+// their own keep it.
+func ApplyDefaults(composeYAML string, defaults ServiceDefaults) (string, error) {
+	if defaults.Restart == "" && defaults.LogMaxSize <= 0 {
+		return composeYAML, nil
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(composeYAML), &doc); err != nil {
+		return "", fmt.Errorf("failed to parse compose file: %w", err)
+	}
+	if len(doc.Content) == 0 {
+		return composeYAML, nil
+	}
+
+	services := mappingValue(doc.Content[0], "services")
+	if services == nil || services.Kind != yaml.MappingNode {
+		return composeYAML, nil
+	}
+
+	for i := 0; i+1 < len(services.Content); i += 2 {
+		name, service := services.Content[i].Value, services.Content[i+1]
+		if service.Kind != yaml.MappingNode {
+			return "", fmt.Errorf("service %s must be a mapping", name)
+		}
+
+		if defaults.Restart != "" && mappingValue(service, "restart") == nil {
+			service.Content = append(service.Content,
+				&yaml.Node{Kind: yaml.ScalarNode, Value: "restart"},
+				&yaml.Node{Kind: yaml.ScalarNode, Value: defaults.Restart})
+		}
+		if defaults.LogMaxSize > 0 && mappingValue(service, "logging") == nil {
+			service.Content = append(service.Content,
+				&yaml.Node{Kind: yaml.ScalarNode, Value: "logging"},
+				rotation(defaults.LogMaxSize, defaults.LogMaxFiles))
+		}
+	}
+
+	out, err := yaml.Marshal(&doc)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode compose file: %w", err)
+	}
+	return string(out), nil
+}
+
+// rotation is the logging of a service rotating json-file logs
+func rotation(maxSizeMB, maxFiles int) *yaml.Node {
+	scalar := func(value string) *yaml.Node {
+		return &yaml.Node{Kind: yaml.ScalarNode, Value: value}
+	}
+	// Docker takes option values as strings only
+	quoted := func(value string) *yaml.Node {
+		return &yaml.Node{Kind: yaml.ScalarNode, Style: yaml.DoubleQuotedStyle, Value: value}
+	}
+
+	options := &yaml.Node{Kind: yaml.MappingNode, Content: []*yaml.Node{
+		scalar("max-size"), quoted(strconv.Itoa(maxSizeMB) + "m"),
+	}}
+	if maxFiles > 0 {
+		options.Content = append(options.Content, scalar("max-file"), quoted(strconv.Itoa(maxFiles)))
+	}
+	return &yaml.Node{Kind: yaml.MappingNode, Content: []*yaml.Node{
+		scalar("driver"), scalar("json-file"),
+		scalar("options"), options,
+	}}
+}
@@ -0,0 +1,108 @@
+package compose
+
+import (
+	"fmt"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Dependencies returns the services of a Docker Compose file with the
+// services each depends on. Both the list and the mapping form of depends_on
+// are supported.
+func Dependencies(composeYAML string) (map[string][]string, error) {
+	var compose struct {
+		Services map[string]struct {
+			DependsOn yaml.Node `yaml:"depends_on"`
+		} `yaml:"services"`
+	}
+	if err := yaml.Unmarshal([]byte(composeYAML), &compose); err != nil {
+		return nil, fmt.Errorf("failed to parse compose file: %w", err)
+	}
+
+	deps := make(map[string][]string, len(compose.Services))
+	for name, service := range compose.Services {
+		var list []string
+		switch service.DependsOn.Kind {
+		case 0:
+		case yaml.SequenceNode:
+			if err := service.DependsOn.Decode(&list); err != nil {
+				return nil, fmt.Errorf("service %s: invalid depends_on: %w", name, err)
+			}
+		case yaml.MappingNode:
+			for i := 0; i < len(service.DependsOn.Content); i += 2 {
+				list = append(list, service.DependsOn.Content[i].Value)
+			}
+		default:
+			return nil, fmt.Errorf("service %s: invalid depends_on", name)
+		}
+
+		for _, dep := range list {
+			if _, ok := compose.Services[dep]; !ok {
+				return nil, fmt.Errorf("service %s depends on unknown service %s", name, dep)
+			}
+		}
+		sort.Strings(list)
+		deps[name] = list
+	}
+	return deps, nil
+}
+
+// StartOrder returns services ordered so that every service comes after the
+// services it depends on, directly or through others. With withDeps, the
+// services the given ones depend on are included as well. No services
+// selects all of them.
+func StartOrder(deps map[string][]string, services []string, withDeps bool) ([]string, error) {
+	if len(services) == 0 {
+		for name := range deps {
+			services = append(services, name)
+		}
+	} else {
+		services = append([]string(nil), services...)
+	}
+	sort.Strings(services)
+
+	selected := make(map[string]bool)
+	for _, name := range services {
+		if _, ok := deps[name]; !ok {
+			return nil, fmt.Errorf("unknown service %s", name)
+		}
+		selected[name] = true
+	}
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int)
+	var order []string
+
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("dependency cycle: %v", append(path, name))
+		}
+
+		state[name] = visiting
+		for _, dep := range deps[name] {
+			if err := visit(dep, append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		if withDeps || selected[name] {
+			order = append(order, name)
+		}
+		return nil
+	}
+
+	for _, name := range services {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
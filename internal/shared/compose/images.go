@@ -0,0 +1,132 @@
+package compose
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultRegistry is the registry of images without a registry host
+const DefaultRegistry = "docker.io"
+
+// Images returns the images referenced by the services of a Docker Compose file
+func Images(composeYAML string) []string {
+	var compose struct {
+		Services map[string]struct {
+			Image string `yaml:"image"`
+		} `yaml:"services"`
+	}
+	if err := yaml.Unmarshal([]byte(composeYAML), &compose); err != nil {
+		return nil
+	}
+
+	var images []string
+	for _, service := range compose.Services {
+		if service.Image != "" {
+			images = append(images, service.Image)
+		}
+	}
+	sort.Strings(images)
+	return images
+}
+
+// SplitImage splits an image reference into its registry host and the
+// repository path with tag or digest. Like Docker, the first path component is
+// only taken as a host if it looks like one. Official images get the library/
+// prefix.
+func SplitImage(image string) (registry, path string) {
+	host, rest, found := strings.Cut(image, "/")
+	if !found || (host != "localhost" && !strings.ContainsAny(host, ".:")) {
+		registry, path = DefaultRegistry, image
+	} else {
+		registry, path = NormalizeRegistry(host), rest
+	}
+
+	if registry == DefaultRegistry && !strings.Contains(path, "/") {
+		path = "library/" + path
+	}
+	return registry, path
+}
+
+// NormalizeRegistry maps the aliases of Docker Hub to DefaultRegistry and
+// strips schemes and paths, so that registry addresses can be compared
+func NormalizeRegistry(registry string) string {
+	registry = strings.TrimPrefix(strings.TrimPrefix(registry, "https://"), "http://")
+	registry, _, _ = strings.Cut(registry, "/")
+
+	switch registry {
+	case "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		return DefaultRegistry
+	}
+	return registry
+}
+
+// Registries returns the sorted registries a Docker Compose file pulls from
+func Registries(composeYAML string) []string {
+	seen := make(map[string]bool)
+	var registries []string
+	for _, image := range Images(composeYAML) {
+		registry, _ := SplitImage(image)
+		if !seen[registry] {
+			seen[registry] = true
+			registries = append(registries, registry)
+		}
+	}
+	sort.Strings(registries)
+	return registries
+}
+
+// RewriteImages points the images of a Docker Compose file at mirrors, keyed
+// by the registry they mirror. Images from other registries are left alone, as
+// is the rest of the file apart from formatting.
+func RewriteImages(composeYAML string, mirrors map[string]string) (string, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(composeYAML), &doc); err != nil {
+		return "", fmt.Errorf("failed to parse compose file: %w", err)
+	}
+	if len(doc.Content) == 0 {
+		return composeYAML, nil
+	}
+
+	changed := false
+	services := mappingValue(doc.Content[0], "services")
+	if services == nil || services.Kind != yaml.MappingNode {
+		return composeYAML, nil
+	}
+	for i := 1; i < len(services.Content); i += 2 {
+		image := mappingValue(services.Content[i], "image")
+		if image == nil || image.Kind != yaml.ScalarNode {
+			continue
+		}
+
+		registry, path := SplitImage(image.Value)
+		if mirror, ok := mirrors[registry]; ok {
+			image.Value = mirror + "/" + path
+			changed = true
+		}
+	}
+	if !changed {
+		return composeYAML, nil
+	}
+
+	out, err := yaml.Marshal(&doc)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode compose file: %w", err)
+	}
+	return string(out), nil
+}
+
+// mappingValue returns the value of a key in a YAML mapping, or nil
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
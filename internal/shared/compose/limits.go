@@ -0,0 +1,127 @@
+package compose
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+	"gopkg.in/yaml.v3"
+)
+
+// byteSize matches a Docker memory size, e.g. 512m or 1.5g
+var byteSize = regexp.MustCompile(`(?i)^(\d+(?:\.\d+)?)\s*([kmgt]?)i?b?$`)
+
+// byteUnits are the multipliers of the units of byteSize
+var byteUnits = map[string]float64{"": 1, "k": 1 << 10, "m": 1 << 20, "g": 1 << 30, "t": 1 << 40}
+
+// ApplyLimits caps the resources of every service of a Docker Compose file.
+// Lower limits a service sets itself, with the service keys or under
+// deploy.resources.limits, are kept. Limits that are not positive leave the
+// services alone.
+func ApplyLimits(composeYAML string, limits protocol.ResourceLimits) (string, error) {
+	if limits.CPUShares <= 0 && limits.MemoryMB <= 0 && limits.Pids <= 0 {
+		return composeYAML, nil
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(composeYAML), &doc); err != nil {
+		return "", fmt.Errorf("failed to parse compose file: %w", err)
+	}
+	if len(doc.Content) == 0 {
+		return composeYAML, nil
+	}
+
+	services := mappingValue(doc.Content[0], "services")
+	if services == nil || services.Kind != yaml.MappingNode {
+		return composeYAML, nil
+	}
+
+	for i := 0; i+1 < len(services.Content); i += 2 {
+		name, service := services.Content[i].Value, services.Content[i+1]
+		if service.Kind != yaml.MappingNode {
+			return "", fmt.Errorf("service %s must be a mapping", name)
+		}
+
+		var deployLimits *yaml.Node
+		if deploy := mappingValue(service, "deploy"); deploy != nil {
+			if resources := mappingValue(deploy, "resources"); resources != nil {
+				deployLimits = mappingValue(resources, "limits")
+			}
+		}
+
+		if limits.CPUShares > 0 {
+			capLimit(service, "cpu_shares", nil, "", int64(limits.CPUShares), parseCount, formatCount)
+		}
+		if limits.MemoryMB > 0 {
+			capLimit(service, "mem_limit", deployLimits, "memory", int64(limits.MemoryMB)<<20, parseByteSize, formatByteSize)
+		}
+		if limits.Pids > 0 {
+			capLimit(service, "pids_limit", deployLimits, "pids", int64(limits.Pids), parseCount, formatCount)
+		}
+	}
+
+	out, err := yaml.Marshal(&doc)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode compose file: %w", err)
+	}
+	return string(out), nil
+}
+
+// capLimit lowers the value of a limit of a service to max. Compose refuses
+// different values for a service key and its deployKey counterpart in
+// deploy.resources.limits, so both are capped if set and the key is only
+// added when neither is. Values that cannot be parsed are replaced.
+func capLimit(service *yaml.Node, key string, deployLimits *yaml.Node, deployKey string, max int64, parse func(string) (int64, bool), format func(int64) string) {
+	nodes := []*yaml.Node{mappingValue(service, key)}
+	if deployLimits != nil {
+		nodes = append(nodes, mappingValue(deployLimits, deployKey))
+	}
+
+	set := false
+	for _, node := range nodes {
+		if node == nil {
+			continue
+		}
+		set = true
+		if value, ok := parse(node.Value); ok && value > 0 && value <= max {
+			continue
+		}
+		*node = yaml.Node{Kind: yaml.ScalarNode, Value: format(max)}
+	}
+	if !set {
+		service.Content = append(service.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Value: key},
+			&yaml.Node{Kind: yaml.ScalarNode, Value: format(max)})
+	}
+}
+
+// formatCount formats a number of CPU shares or processes
+func formatCount(n int64) string {
+	return strconv.FormatInt(n, 10)
+}
+
+// parseCount parses a number of CPU shares or processes
+func parseCount(value string) (int64, bool) {
+	n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	return n, err == nil
+}
+
+// parseByteSize parses a Docker memory size in bytes
+func parseByteSize(value string) (int64, bool) {
+	match := byteSize.FindStringSubmatch(strings.TrimSpace(value))
+	if match == nil {
+		return 0, false
+	}
+	n, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0, false
+	}
+	return int64(n * byteUnits[strings.ToLower(match[2])]), true
+}
+
+// formatByteSize formats a memory size in MB the way compose files do
+func formatByteSize(bytes int64) string {
+	return strconv.FormatInt(bytes>>20, 10) + "m"
+}
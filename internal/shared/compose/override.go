@@ -0,0 +1,65 @@
+package compose
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// overrideSections are the top-level keys a compose override may set
+var overrideSections = map[string]bool{
+	"version":  true,
+	"services": true,
+	"volumes":  true,
+	"networks": true,
+	"configs":  true,
+	"secrets":  true,
+}
+
+// ValidateOverride checks that a compose file fragment can be layered over a
+// compose file with -f. Services it does not define an image or build for
+// must be defined by the compose file it overrides.
+func ValidateOverride(overrideYAML, composeYAML string) error {
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(overrideYAML), &doc); err != nil {
+		return fmt.Errorf("failed to parse compose override: %w", err)
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return fmt.Errorf("compose override must be a mapping")
+	}
+
+	root := doc.Content[0]
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key := root.Content[i].Value
+		if !overrideSections[key] && !strings.HasPrefix(key, "x-") {
+			return fmt.Errorf("compose override has unknown section %q", key)
+		}
+		if key != "version" && root.Content[i+1].Kind != yaml.MappingNode {
+			return fmt.Errorf("compose override section %s must be a mapping", key)
+		}
+	}
+
+	services := mappingValue(root, "services")
+	if services == nil {
+		return nil
+	}
+
+	base, err := Dependencies(composeYAML)
+	if err != nil {
+		return err
+	}
+	for i := 0; i+1 < len(services.Content); i += 2 {
+		name, service := services.Content[i].Value, services.Content[i+1]
+		if service.Kind != yaml.MappingNode {
+			return fmt.Errorf("service %s must be a mapping", name)
+		}
+		if _, ok := base[name]; ok {
+			continue
+		}
+		if mappingValue(service, "image") == nil && mappingValue(service, "build") == nil {
+			return fmt.Errorf("service %s is not in the compose file and has no image", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package compose
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// PublishedPort is a fixed host port published by a compose service
+type PublishedPort struct {
+	Service       string `json:"service"`
+	HostIP        string `json:"host_ip,omitempty"` // Empty for all interfaces
+	HostPort      int    `json:"host_port"`
+	ContainerPort int    `json:"container_port"`
+}
+
+// UnpublishPorts removes the published ports from the services of a Docker
+// Compose file and returns them, so that the ports can be served by a proxy
+// instead. Only fixed TCP host ports are supported. Fixed container names are
+// rejected since two copies of the file could not run side by side.
+func UnpublishPorts(composeYAML string) (string, []PublishedPort, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(composeYAML), &doc); err != nil {
+		return "", nil, fmt.Errorf("failed to parse compose file: %w", err)
+	}
+	if len(doc.Content) == 0 {
+		return composeYAML, nil, nil
+	}
+
+	services := mappingValue(doc.Content[0], "services")
+	if services == nil || services.Kind != yaml.MappingNode {
+		return composeYAML, nil, nil
+	}
+
+	var published []PublishedPort
+	seen := make(map[string]string)
+	for i := 0; i+1 < len(services.Content); i += 2 {
+		name, service := services.Content[i].Value, services.Content[i+1]
+		if mappingValue(service, "container_name") != nil {
+			return "", nil, fmt.Errorf("service %s: container_name is not supported", name)
+		}
+
+		ports := mappingValue(service, "ports")
+		if ports == nil {
+			continue
+		}
+		if ports.Kind != yaml.SequenceNode {
+			return "", nil, fmt.Errorf("service %s: ports must be a list", name)
+		}
+
+		for _, entry := range ports.Content {
+			port, err := parsePort(entry)
+			if err != nil {
+				return "", nil, fmt.Errorf("service %s: %w", name, err)
+			}
+			port.Service = name
+
+			key := bindAddress(port.HostIP, port.HostPort)
+			if other, ok := seen[key]; ok {
+				return "", nil, fmt.Errorf("service %s: host port %d is also published by %s", name, port.HostPort, other)
+			}
+			seen[key] = name
+			published = append(published, port)
+		}
+		deleteKey(service, "ports")
+	}
+
+	if len(published) == 0 {
+		return composeYAML, nil, nil
+	}
+
+	out, err := yaml.Marshal(&doc)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to encode compose file: %w", err)
+	}
+	return string(out), published, nil
+}
+
+// parsePort parses a port in short ("[ip:]host:container[/tcp]") or long
+// syntax
+func parsePort(node *yaml.Node) (PublishedPort, error) {
+	var port PublishedPort
+
+	switch node.Kind {
+	case yaml.ScalarNode:
+		spec, protocol, _ := strings.Cut(node.Value, "/")
+		if protocol != "" && protocol != "tcp" {
+			return port, fmt.Errorf("port %s: only tcp ports are supported", node.Value)
+		}
+
+		// IPv6 addresses are bracketed, e.g. "[::1]:8080:80"
+		if strings.HasPrefix(spec, "[") {
+			hostIP, rest, ok := strings.Cut(spec[1:], "]:")
+			if !ok {
+				return port, fmt.Errorf("port %s: invalid host address", node.Value)
+			}
+			port.HostIP, spec = hostIP, rest
+		}
+		parts := strings.Split(spec, ":")
+		if len(parts) == 3 && port.HostIP == "" {
+			port.HostIP = parts[0]
+			parts = parts[1:]
+		}
+		if len(parts) != 2 || parts[0] == "" {
+			return port, fmt.Errorf("port %s: a fixed host port is required", node.Value)
+		}
+
+		var err error
+		if port.HostPort, err = parsePortNumber(parts[0]); err != nil {
+			return port, fmt.Errorf("port %s: %w", node.Value, err)
+		}
+		if port.ContainerPort, err = parsePortNumber(parts[1]); err != nil {
+			return port, fmt.Errorf("port %s: %w", node.Value, err)
+		}
+
+	case yaml.MappingNode:
+		var long struct {
+			Target    string `yaml:"target"`
+			Published string `yaml:"published"`
+			HostIP    string `yaml:"host_ip"`
+			Protocol  string `yaml:"protocol"`
+		}
+		if err := node.Decode(&long); err != nil {
+			return port, fmt.Errorf("invalid port: %w", err)
+		}
+		if long.Protocol != "" && long.Protocol != "tcp" {
+			return port, fmt.Errorf("port %s: only tcp ports are supported", long.Target)
+		}
+		if long.Published == "" {
+			return port, fmt.Errorf("port %s: a fixed host port is required", long.Target)
+		}
+
+		var err error
+		if port.HostPort, err = parsePortNumber(long.Published); err != nil {
+			return port, fmt.Errorf("port %s: %w", long.Target, err)
+		}
+		if port.ContainerPort, err = parsePortNumber(long.Target); err != nil {
+			return port, fmt.Errorf("port %s: %w", long.Target, err)
+		}
+		port.HostIP = long.HostIP
+
+	default:
+		return port, fmt.Errorf("invalid port")
+	}
+
+	return port, nil
+}
+
+// parsePortNumber parses a single port, rejecting ranges
+func parsePortNumber(value string) (int, error) {
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("%q is not a single port", value)
+	}
+	return port, nil
+}
+
+// bindAddress returns the address a published port binds to
+func bindAddress(hostIP string, port int) string {
+	return net.JoinHostPort(hostIP, strconv.Itoa(port))
+}
+
+// deleteKey removes a key from a YAML mapping
+func deleteKey(node *yaml.Node, key string) {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			node.Content = append(node.Content[:i], node.Content[i+2:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package compose
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/edgetainer/edgetainer/internal/shared/credentials"
+	"gopkg.in/yaml.v3"
+)
+
+// Redacted replaces values removed by Redact
+const Redacted = credentials.Redacted
+
+// secretKey matches keys whose values are likely secrets
+var secretKey = regexp.MustCompile(`(?i)pass|secret|token|key|credential|auth`)
+
+// Redact replaces the values of the environment variables of every service
+// in a Docker Compose file, along with any value whose key suggests a secret,
+// e.g. a password in a label. Variable references like ${DB_PASSWORD} are
+// resolved by Docker Compose and never hold the secret itself, but are
+// replaced all the same.
+func Redact(composeYAML string) (string, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(composeYAML), &doc); err != nil {
+		return "", fmt.Errorf("failed to parse compose file: %w", err)
+	}
+	if len(doc.Content) == 0 {
+		return composeYAML, nil
+	}
+
+	redactSecrets(doc.Content[0])
+	if services := mappingValue(doc.Content[0], "services"); services != nil && services.Kind == yaml.MappingNode {
+		for i := 1; i < len(services.Content); i += 2 {
+			if env := mappingValue(services.Content[i], "environment"); env != nil {
+				redactEnvironment(env)
+			}
+		}
+	}
+
+	out, err := yaml.Marshal(&doc)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode compose file: %w", err)
+	}
+	return string(out), nil
+}
+
+// redactEnvironment replaces the values of an environment section, either a
+// mapping or a list of NAME=value entries
+func redactEnvironment(env *yaml.Node) {
+	switch env.Kind {
+	case yaml.MappingNode:
+		for i := 1; i < len(env.Content); i += 2 {
+			redactScalar(env.Content[i])
+		}
+	case yaml.SequenceNode:
+		for _, item := range env.Content {
+			if name, _, found := strings.Cut(item.Value, "="); found && item.Kind == yaml.ScalarNode {
+				item.Value = name + "=" + Redacted
+				item.Style = 0
+			}
+		}
+	}
+}
+
+// redactSecrets walks a node and replaces the scalar values of mapping keys
+// and list entries that look like secrets
+func redactSecrets(node *yaml.Node) {
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if secretKey.MatchString(node.Content[i].Value) {
+				redactScalar(node.Content[i+1])
+			}
+			redactSecrets(node.Content[i+1])
+		}
+	case yaml.SequenceNode:
+		for _, item := range node.Content {
+			if item.Kind != yaml.ScalarNode {
+				redactSecrets(item)
+				continue
+			}
+			if name, _, found := strings.Cut(item.Value, "="); found && secretKey.MatchString(name) {
+				item.Value = name + "=" + Redacted
+				item.Style = 0
+			}
+		}
+	}
+}
+
+// redactScalar replaces a non-empty scalar value
+func redactScalar(node *yaml.Node) {
+	if node.Kind == yaml.ScalarNode && node.Value != "" && node.Tag != "!!null" {
+		node.Value = Redacted
+		node.Tag = "!!str"
+		node.Style = 0
+	}
+}
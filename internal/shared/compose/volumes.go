@@ -0,0 +1,57 @@
+package compose
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Volumes returns the Docker volume behind each named volume of a Compose
+// file deployed as the given project. Volumes without an explicit name are
+// prefixed with the project name, as Compose creates them.
+func Volumes(composeYAML, project string) (map[string]string, error) {
+	var compose struct {
+		Volumes map[string]*struct {
+			Name     string    `yaml:"name"`
+			External yaml.Node `yaml:"external"`
+		} `yaml:"volumes"`
+	}
+	if err := yaml.Unmarshal([]byte(composeYAML), &compose); err != nil {
+		return nil, fmt.Errorf("failed to parse compose file: %w", err)
+	}
+
+	volumes := make(map[string]string, len(compose.Volumes))
+	for key, volume := range compose.Volumes {
+		volumes[key] = project + "_" + key
+		if volume == nil {
+			continue
+		}
+
+		switch {
+		case volume.Name != "":
+			volumes[key] = volume.Name
+		case volume.External.Kind == yaml.ScalarNode && volume.External.Value == "true":
+			volumes[key] = key
+		case volume.External.Kind == yaml.MappingNode:
+			// Legacy form, external: {name: ...}
+			volumes[key] = key
+			if name := mappingValue(&volume.External, "name"); name != nil && name.Value != "" {
+				volumes[key] = name.Value
+			}
+		}
+	}
+	return volumes, nil
+}
+
+// ProjectName returns the project name Compose derives from the name of a
+// project directory
+func ProjectName(dir string) string {
+	var b strings.Builder
+	for _, c := range strings.ToLower(dir) {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '_' || c == '-' {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
@@ -3,40 +3,279 @@ package config
 import (
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
+	"github.com/edgetainer/edgetainer/internal/shared/sshkeys"
 	"gopkg.in/yaml.v3"
 )
 
-// ServerConfig represents the server configuration
+// DefaultControlSocket is the default path of the agent's local control socket
+const DefaultControlSocket = "/var/run/edgetainer/agent.sock"
+
+// Policies of secret_scan for credentials in uploaded compose files and env
+// vars
+const (
+	SecretScanWarn  = "warn"  // Saved with a warning
+	SecretScanBlock = "block" // Refused
+	SecretScanOff   = "off"   // Not scanned, still redacted in responses
+)
+
+// Scopes of devices.unique_names within which device names are unique
+const (
+	DeviceNamesFleet  = "fleet"  // Unique within a fleet, and among devices without one
+	DeviceNamesGlobal = "global" // Unique across all fleets
+	DeviceNamesOff    = "off"    // Not checked
+)
+
+// Modes of ssh.proxy_protocol, for SSH listeners behind a load balancer
+const (
+	ProxyProtocolOff      = "off"      // Connections come straight from devices
+	ProxyProtocolOptional = "optional" // Connections may start with a PROXY header
+	ProxyProtocolRequired = "required" // Connections without a PROXY header are closed
+)
+
+// Modes of smtp.tls, how the connection to the mail server is secured
+const (
+	SMTPStartTLS = "starttls" // Upgraded with STARTTLS, usually on port 587
+	SMTPTLS      = "tls"      // TLS from the start, usually on port 465
+	SMTPNone     = "none"     // Plain, only for relays on the same host or network
+)
+
+// ServerConfig represents the server configuration. The API holds no state
+// of its own, but device connections, tunnels and background jobs live in
+// the process that accepted them, so a server runs as a single replica.
 type ServerConfig struct {
 	Server struct {
-		Host string `yaml:"host"`
-		Port int    `yaml:"port"`
+		Host          string `yaml:"host"`
+		Port          int    `yaml:"port"`
+		ShutdownDelay int    `yaml:"shutdown_delay"` // Seconds the readiness probe fails before a terminated server stops, so load balancers stop sending first
 	} `yaml:"server"`
 	Database struct {
-		Host     string `yaml:"host"`
-		Port     int    `yaml:"port"`
-		User     string `yaml:"user"`
-		Password string `yaml:"password"`
-		DBName   string `yaml:"dbname"`
+		Host            string `yaml:"host"`
+		Port            int    `yaml:"port"`
+		User            string `yaml:"user"`
+		Password        string `yaml:"password" secret:"true"`
+		DBName          string `yaml:"dbname"`
+		SSLMode         string `yaml:"sslmode"`           // disable, require, verify-ca or verify-full
+		MaxOpenConns    int    `yaml:"max_open_conns"`    // Per process, keep the sum over all processes below the database's max_connections
+		MaxIdleConns    int    `yaml:"max_idle_conns"`    // Kept open between requests
+		ConnMaxLifetime int    `yaml:"conn_max_lifetime"` // Seconds before a connection is replaced, so connections move to new database replicas
 	} `yaml:"database"`
 	Auth struct {
 		AdminUsername string `yaml:"admin_username"`
-		AdminPassword string `yaml:"admin_password"`
+		AdminPassword string `yaml:"admin_password" secret:"true"` // Creates the first admin on start, empty to create it in the setup
 		AdminEmail    string `yaml:"admin_email"`
+		InviteExpiry  int    `yaml:"invite_expiry"` // Hours an invitation link can be used
 	} `yaml:"auth"`
+	SMTP struct {
+		Host     string `yaml:"host"` // Mail server sending invitations, empty disables invitations
+		Port     int    `yaml:"port"`
+		Username string `yaml:"username"` // Empty to send without authentication
+		Password string `yaml:"password" secret:"true"`
+		From     string `yaml:"from"` // Sender address, e.g. Edgetainer <edgetainer@example.com>
+		TLS      string `yaml:"tls"`  // starttls, tls or none, see the SMTP constants
+	} `yaml:"smtp"`
 	SSH struct {
+		Host        string `yaml:"host"` // Address the tunnel server listens on, empty for every IPv4 and IPv6 address
 		Port        int    `yaml:"port"`
+		ForwardHost string `yaml:"forward_host"` // Address tunnel forwards listen on, ::1 on hosts without IPv4
 		HostKeyPath string `yaml:"host_key_path"`
 		StartPort   int    `yaml:"start_port"`
 		EndPort     int    `yaml:"end_port"`
+		TunnelRate  int    `yaml:"tunnel_rate_kbps"` // Default tunnel rate limit per device and direction, 0 for none
+		Hardware    string `yaml:"hardware"`         // Devices reporting other hardware than they are bound to: alert or reject
+		Keys        struct {
+			HostKeyType   string   `yaml:"host_key_type"`   // Type of a generated host key, ed25519 or rsa
+			HostKeyBits   int      `yaml:"host_key_bits"`   // Size of a generated RSA host key, 0 for 4096
+			DeviceKeyType string   `yaml:"device_key_type"` // Type of the keys generated for new devices, ed25519 or rsa
+			DeviceKeyBits int      `yaml:"device_key_bits"` // Size of generated RSA device keys, 0 for 4096
+			Algorithms    []string `yaml:"algorithms"`      // Public key algorithms devices may authenticate with, empty for all
+		} `yaml:"keys"`
+		CA struct {
+			Enabled bool   `yaml:"enabled"`  // Sign short-lived device certificates and accept them without a database lookup
+			KeyPath string `yaml:"key_path"` // CA private key, generated with ssh.keys.host_key_type if missing
+			CertTTL int    `yaml:"cert_ttl"` // Seconds a device certificate is valid
+		} `yaml:"ca"`
+		Keepalive struct {
+			Interval  int `yaml:"interval"`   // Seconds between probes of a device connection, -1 to never probe
+			Timeout   int `yaml:"timeout"`    // Seconds to wait for the answer to a probe
+			MaxMissed int `yaml:"max_missed"` // Unanswered probes in a row before the connection is closed as dead
+		} `yaml:"keepalive"`
+		Heartbeats struct {
+			FlushMS   int `yaml:"flush_ms"`   // Milliseconds heartbeat writes may wait to be batched
+			BatchSize int `yaml:"batch_size"` // Devices written per UPDATE, a full batch is written right away
+			QueueSize int `yaml:"queue_size"` // Devices with writes waiting, the oldest is dropped beyond that
+		} `yaml:"heartbeats"`
+		Forwards struct {
+			MaxPerDevice int `yaml:"max_per_device"` // Forwards a device may have open unless its fleet or policy sets a limit, -1 for unlimited
+			IdleTimeout  int `yaml:"idle_timeout"`   // Seconds on-demand forwards stay open without connections, -1 to keep them
+		} `yaml:"forwards"`
+		Connections struct {
+			IdleTimeout  int `yaml:"idle_timeout"`   // Seconds a forwarded connection may go without traffic, -1 for no limit
+			MaxDuration  int `yaml:"max_duration"`   // Seconds a forwarded connection may stay open, -1 for no limit
+			MaxPerDevice int `yaml:"max_per_device"` // Forwarded connections open at once per device, -1 for no limit
+		} `yaml:"connections"`
+		ProxyProtocol string   `yaml:"proxy_protocol"` // off, optional or required, see the ProxyProtocol constants
+		ProxyTrusted  []string `yaml:"proxy_trusted"`  // Addresses or CIDR ranges of the load balancers PROXY headers are taken from, empty for any
 	} `yaml:"ssh"`
 	Logging struct {
-		Level   string `yaml:"level"`
-		LogFile string `yaml:"log_file"`
+		Level      string `yaml:"level"`
+		LogFile    string `yaml:"log_file"`
+		MaxSizeMB  int    `yaml:"max_size_mb"`  // Rotate the log file at this size, -1 to never rotate
+		MaxAgeDays int    `yaml:"max_age_days"` // Remove rotated files older than this, 0 to keep them
+		MaxBackups int    `yaml:"max_backups"`  // Number of rotated files to keep, -1 to keep all
+		Compress   bool   `yaml:"compress"`     // Gzip rotated files
 	} `yaml:"logging"`
+	Encryption struct {
+		ActiveKey string            `yaml:"active_key"`         // ID of the key new values are encrypted with
+		Keys      map[string]string `yaml:"keys" secret:"true"` // Base64 encoded 32 byte keys by ID, keep retired keys until rows are re-encrypted
+	} `yaml:"encryption"`
+	Deploy struct {
+		MaxConcurrent       int `yaml:"max_concurrent"`       // Devices deploying at once per rollout unless the fleet sets a limit, -1 for unlimited
+		RegistryConcurrency int `yaml:"registry_concurrency"` // Devices pulling from the same registry at once across all deployments, -1 for unlimited
+		ApprovalExpiry      int `yaml:"approval_expiry"`      // Hours a deploy to a fleet requiring approval waits for it, -1 for no limit
+	} `yaml:"deploy"`
+	SecretScan struct {
+		Policy string `yaml:"policy"` // Credentials found in uploaded compose files and env vars: warn, block or off
+	} `yaml:"secret_scan"`
+	Devices struct {
+		UniqueNames string `yaml:"unique_names"` // Scope device names are unique in: fleet, global or off
+	} `yaml:"devices"`
+	Jobs struct {
+		Workers   int `yaml:"workers"`   // Background jobs run at once by this server
+		Retention int `yaml:"retention"` // Hours finished jobs are kept, -1 to keep them
+	} `yaml:"jobs"`
+	Clock struct {
+		MaxSkew int `yaml:"max_skew"` // Seconds a device clock may be off before an alert fires
+	} `yaml:"clock"`
+	HostHealth struct {
+		MaxTemperature int `yaml:"max_temperature"` // Degrees Celsius a thermal zone may reach before an alert fires, -1 for no alerts
+		MinBattery     int `yaml:"min_battery"`     // Percent charge below which a battery powering a device fires an alert, -1 for no alerts
+	} `yaml:"host_health"`
+	GeoIP struct {
+		URL string `yaml:"url"` // Lookup service returning JSON coordinates, {ip} is replaced with the device address, empty disables
+	} `yaml:"geoip"`
+	Hooks struct {
+		Events  []string `yaml:"events"`  // Events that run the hooks, empty for device.online, device.offline, forward.opened and forward.closed
+		Timeout int      `yaml:"timeout"` // Seconds a hook may take
+		Exec    struct {
+			Command string `yaml:"command"` // Script run with the event as JSON on stdin, empty disables
+		} `yaml:"exec"`
+		Webhook struct {
+			URL    string `yaml:"url"`                  // Receives the event as a POST, empty disables
+			Secret string `yaml:"secret" secret:"true"` // Signs the payload like outbound webhooks, empty for none
+		} `yaml:"webhook"`
+		MQTT struct {
+			Broker   string `yaml:"broker"` // tcp://host:1883 or tls://host:8883, empty disables
+			Topic    string `yaml:"topic"`  // {device_id} and {event} are replaced
+			ClientID string `yaml:"client_id"`
+			Username string `yaml:"username"`
+			Password string `yaml:"password" secret:"true"`
+		} `yaml:"mqtt"`
+	} `yaml:"hooks"`
+	Extensions struct {
+		Webhook struct {
+			URL        string `yaml:"url"`                  // Called at the extension points enabled below, empty disables
+			Secret     string `yaml:"secret" secret:"true"` // Signs the payload like outbound webhooks, empty for none
+			Timeout    int    `yaml:"timeout"`              // Seconds a call may take
+			Deploy     bool   `yaml:"deploy"`               // Before and after every deployment
+			Enrollment bool   `yaml:"enrollment"`           // To accept or reject device enrollments
+			Auth       bool   `yaml:"auth"`                 // To check user logins
+			FailOpen   bool   `yaml:"fail_open"`            // Allow deployments and enrollments while the webhook is unreachable
+		} `yaml:"webhook"`
+	} `yaml:"extensions"`
+	Artifacts struct {
+		Backend    string `yaml:"backend"`     // local or s3
+		Dir        string `yaml:"dir"`         // Directory of the local backend
+		MaxSizeMB  int    `yaml:"max_size_mb"` // Largest artifact accepted
+		PresignTTL int    `yaml:"presign_ttl"` // Seconds pre-signed S3 URLs are valid, 0 to serve artifacts over the tunnel only
+		S3         struct {
+			Bucket          string `yaml:"bucket"`
+			Region          string `yaml:"region"`
+			Endpoint        string `yaml:"endpoint"`   // For S3 compatible stores, empty for AWS
+			PathStyle       bool   `yaml:"path_style"` // Address the bucket in the path, as most S3 compatible stores need
+			Prefix          string `yaml:"prefix"`
+			AccessKeyID     string `yaml:"access_key_id"`
+			SecretAccessKey string `yaml:"secret_access_key" secret:"true"`
+			SessionToken    string `yaml:"session_token" secret:"true"`
+		} `yaml:"s3"`
+	} `yaml:"artifacts"`
+	Storage struct {
+		Backend string `yaml:"backend"` // local or s3, empty keeps logs, diagnostics bundles and packet captures in the database
+		Dir     string `yaml:"dir"`     // Directory of the local backend
+		S3      struct {
+			Bucket          string `yaml:"bucket"`
+			Region          string `yaml:"region"`
+			Endpoint        string `yaml:"endpoint"`   // For S3 compatible stores, empty for AWS
+			PathStyle       bool   `yaml:"path_style"` // Address the bucket in the path, as most S3 compatible stores need
+			Prefix          string `yaml:"prefix"`
+			AccessKeyID     string `yaml:"access_key_id"`
+			SecretAccessKey string `yaml:"secret_access_key" secret:"true"`
+			SessionToken    string `yaml:"session_token" secret:"true"`
+		} `yaml:"s3"`
+		Lifecycle struct {
+			ArchiveLogsAfterDays int `yaml:"archive_logs_after_days"` // Device logs older than this move to the storage, 0 keeps them in the database
+			LogArchiveDays       int `yaml:"log_archive_days"`        // Archived logs are removed after, 0 keeps them
+			DiagnosticsDays      int `yaml:"diagnostics_days"`        // Diagnostics bundles are removed after, 0 keeps them
+			CapturesDays         int `yaml:"captures_days"`           // Packet captures are removed after, 0 keeps them
+		} `yaml:"lifecycle"`
+	} `yaml:"storage"`
+	DNS struct {
+		Provider   string `yaml:"provider"` // route53, cloudflare or rfc2136, empty disables DNS records for device subdomains
+		Domain     string `yaml:"domain"`   // Records are created as <subdomain>.<domain>
+		Target     string `yaml:"target"`   // Host name of the proxy for CNAME records, or its IP address for A/AAAA records
+		TTL        int    `yaml:"ttl"`
+		Cloudflare struct {
+			APIToken string `yaml:"api_token" secret:"true"`
+			ZoneID   string `yaml:"zone_id"`
+		} `yaml:"cloudflare"`
+		Route53 struct {
+			AccessKeyID     string `yaml:"access_key_id"`
+			SecretAccessKey string `yaml:"secret_access_key" secret:"true"`
+			SessionToken    string `yaml:"session_token" secret:"true"`
+			HostedZoneID    string `yaml:"hosted_zone_id"`
+		} `yaml:"route53"`
+		RFC2136 struct {
+			Server        string `yaml:"server"` // Primary name server, host:port
+			Zone          string `yaml:"zone"`
+			TSIGKey       string `yaml:"tsig_key"` // Empty for unsigned updates
+			TSIGSecret    string `yaml:"tsig_secret" secret:"true"`
+			TSIGAlgorithm string `yaml:"tsig_algorithm"` // hmac-sha256 or hmac-sha512
+		} `yaml:"rfc2136"`
+	} `yaml:"dns"`
+	Proxy struct {
+		Listen string `yaml:"listen"` // Address serving exposed services of devices, e.g. :8443, empty disables the proxy
+		Domain string `yaml:"domain"` // Services are served at <subdomain>.<domain>, defaults to dns.domain
+		Ports  struct {
+			Start int `yaml:"start"` // First public port allocated to tcp and udp services
+			End   int `yaml:"end"`   // Last public port allocated to tcp and udp services
+		} `yaml:"ports"`
+		UDP bool `yaml:"udp"` // Relay udp services, needs agents that support UDP forwards
+	} `yaml:"proxy"`
+	Cache struct {
+		TTL int `yaml:"ttl"` // Seconds device, fleet and stats listings are served from memory, -1 to always query the database
+	} `yaml:"cache"`
+	Metrics struct {
+		Enabled bool   `yaml:"enabled"`             // Serve Prometheus metrics on /metrics
+		Token   string `yaml:"token" secret:"true"` // Bearer token required to scrape, empty for none
+	} `yaml:"metrics"`
+	Agents struct {
+		MinVersion       string            `yaml:"min_version"`        // Agents older than this are flagged unsupported and not deployed to, empty to only flag agents older than the server
+		MinOSVersions    map[string]string `yaml:"min_os_versions"`    // Oldest OS release deployed to by os-release ID, e.g. debian: "11"
+		MinKernelVersion string            `yaml:"min_kernel_version"` // Oldest kernel deployed to
+	} `yaml:"agents"`
+	Tracing struct {
+		Enabled     bool              `yaml:"enabled"`
+		Endpoint    string            `yaml:"endpoint"`              // OTLP/HTTP collector address, e.g. otel-collector:4318
+		Insecure    bool              `yaml:"insecure"`              // Use plain HTTP instead of HTTPS
+		Headers     map[string]string `yaml:"headers" secret:"true"` // Sent with every export, e.g. an API key
+		SampleRatio float64           `yaml:"sample_ratio"`          // Fraction of new traces to record, 1 records all
+	} `yaml:"tracing"`
 }
 
 // AgentConfig represents the agent configuration
@@ -46,33 +285,171 @@ type AgentConfig struct {
 		Name string `yaml:"name"`
 	} `yaml:"device"`
 	Server struct {
-		Host string `yaml:"host"`
-		Port int    `yaml:"port"`
+		Host             string   `yaml:"host"`
+		Port             int      `yaml:"port"`
+		Backups          []string `yaml:"backups"`           // Tunnel servers to fail over to in order, host or host:port with ssh.port as default port
+		FailoverAfter    int      `yaml:"failover_after"`    // Seconds a server is unreachable before the next one is tried
+		FailbackInterval int      `yaml:"failback_interval"` // Seconds between checks whether the primary is back while on a backup, -1 to stay
 	} `yaml:"server"`
 	SSH struct {
-		Port int    `yaml:"port"`
-		Key  string `yaml:"key"`
+		Port              int      `yaml:"port"`
+		Key               string   `yaml:"key"`
+		KeyAlgorithms     []string `yaml:"key_algorithms"`      // Signature algorithms offered with the key, empty for all
+		HostKeyAlgorithms []string `yaml:"host_key_algorithms"` // Server host key algorithms accepted, empty for all
 	} `yaml:"ssh"`
 	Docker struct {
-		ComposeDir  string `yaml:"compose_dir"`
-		NetworkName string `yaml:"network_name"`
+		ComposeDir        string   `yaml:"compose_dir"`
+		NetworkName       string   `yaml:"network_name"`
+		EmulatedPlatforms []string `yaml:"emulated_platforms"` // Platforms the device runs images of under emulation, e.g. with qemu binfmt handlers
 	} `yaml:"docker"`
+	Pull struct {
+		ProxyListen string `yaml:"proxy_listen"`    // Address of the rate limiting pull proxy, empty disables it
+		RateLimit   int    `yaml:"rate_limit_kbps"` // Default pull rate in kbit/s, 0 for unlimited
+		Retries     int    `yaml:"retries"`         // Retries of a failed image pull, -1 for none
+		RetryDelay  int    `yaml:"retry_delay"`     // Seconds before the first retry, doubled for every following one
+	} `yaml:"pull"`
+	Resources  protocol.ResourceLimits `yaml:"resources"` // Caps the services of every application, fleets and devices can override them
+	Protection struct {
+		Enabled        bool   `yaml:"enabled"`          // Guarantee the agent and Docker memory and CPU with systemd drop-ins, needs cgroup v2
+		AgentUnit      string `yaml:"agent_unit"`       // Unit running the agent, the container it runs in is protected too
+		DockerUnit     string `yaml:"docker_unit"`      // Unit running the Docker daemon
+		AgentMemoryMB  int    `yaml:"agent_memory_mb"`  // Memory the kernel does not reclaim from the agent
+		DockerMemoryMB int    `yaml:"docker_memory_mb"` // Memory the kernel does not reclaim from the Docker daemon
+		CPUWeight      int    `yaml:"cpu_weight"`       // CPU weight of both, systemd's default is 100
+		OOMScoreAdjust int    `yaml:"oom_score_adjust"` // Of both, -1000 to 1000, lower is killed later
+		CheckInterval  int    `yaml:"check_interval"`   // Seconds between checks, drift found is repaired
+	} `yaml:"protection"`
 	Logging struct {
-		Level   string `yaml:"level"`
-		LogFile string `yaml:"log_file"`
+		Level      string `yaml:"level"`
+		LogFile    string `yaml:"log_file"`
+		MaxSizeMB  int    `yaml:"max_size_mb"`  // Rotate the log file at this size, -1 to never rotate
+		MaxAgeDays int    `yaml:"max_age_days"` // Remove rotated files older than this, 0 to keep them
+		MaxBackups int    `yaml:"max_backups"`  // Number of rotated files to keep, -1 to keep all
+		Compress   bool   `yaml:"compress"`     // Gzip rotated files
+		Ship       bool   `yaml:"ship"`         // Upload rotated files to the server before removing them
 	} `yaml:"logging"`
+	Health struct {
+		Enabled bool   `yaml:"enabled"`
+		Listen  string `yaml:"listen"` // Bind to 127.0.0.1 for local only or a LAN address
+	} `yaml:"health"`
+	Control struct {
+		Socket string `yaml:"socket"`
+	} `yaml:"control"`
+	Shutdown struct {
+		Policy       string   `yaml:"policy"`        // leave-running, stop-apps or stop-non-critical
+		CriticalApps []string `yaml:"critical_apps"` // Kept running by the stop-non-critical policy
+	} `yaml:"shutdown"`
+	Intervals struct {
+		Metrics   int `yaml:"metrics"`   // Seconds between system metric collections
+		Keepalive int `yaml:"keepalive"` // Seconds between tunnel keepalive probes
+		Heartbeat int `yaml:"heartbeat"` // Seconds between heartbeats and clock checks
+	} `yaml:"intervals"`
+	Forwards struct {
+		IdleTimeout    int `yaml:"idle_timeout"`    // Seconds a forwarded connection may go without traffic, -1 for no limit
+		MaxDuration    int `yaml:"max_duration"`    // Seconds a forwarded connection may stay open, -1 for no limit
+		MaxConnections int `yaml:"max_connections"` // Forwarded connections open at once, -1 for no limit
+	} `yaml:"forwards"`
+	System struct {
+		HostRoot       string `yaml:"host_root"`       // Where the host filesystem is mounted when the agent runs in a container, empty on the host
+		AttestHardware bool   `yaml:"attest_hardware"` // Report a hash of the machine ID and hardware serials so the server can bind the device to its hardware
+		LowMemory      bool   `yaml:"low_memory"`      // Trade responsiveness and optional subsystems for a smaller footprint, see ApplyLowMemory
+	} `yaml:"system"`
+	Location struct {
+		Source string `yaml:"source"` // gpsd or nmea, empty to report no location
+		GPSD   string `yaml:"gpsd"`   // Address of gpsd for the gpsd source
+		Device string `yaml:"device"` // Serial device of the nmea source, e.g. /dev/ttyUSB0
+		Baud   int    `yaml:"baud"`   // Baud rate of the serial device, 0 leaves it as configured
+	} `yaml:"location"`
+	Reload struct {
+		WatchInterval int `yaml:"watch_interval"` // Seconds between config file checks, 0 disables watching
+	} `yaml:"reload"`
+	Plugins struct {
+		Dir     string `yaml:"dir"`     // Directory of plugin executables, empty disables plugins
+		Timeout int    `yaml:"timeout"` // Seconds a plugin may take to answer
+	} `yaml:"plugins"`
+	Artifacts struct {
+		CacheDir   string `yaml:"cache_dir"`    // Where software artifacts are downloaded to, empty for .artifacts in the compose directory
+		MaxAgeDays int    `yaml:"max_age_days"` // Remove artifacts unused for this long, -1 to keep them
+	} `yaml:"artifacts"`
+	Display struct {
+		Enabled        bool   `yaml:"enabled"`         // Configure the kiosk display and take screenshots on request
+		Dir            string `yaml:"dir"`             // Where the kiosk URL and display settings are kept, empty for .display in the compose directory
+		Container      string `yaml:"container"`       // Kiosk container restarted when the URL changes, empty to leave it running
+		WaylandDisplay string `yaml:"wayland_display"` // Socket of the Wayland compositor, e.g. cage, showing the kiosk
+		Output         string `yaml:"output"`          // Output to rotate and blank, e.g. HDMI-A-1
+	} `yaml:"display"`
+	HostServices struct {
+		Units        []string `yaml:"units"`         // systemd units of the host reported in heartbeats, e.g. NetworkManager.service
+		Processes    []string `yaml:"processes"`     // Host processes reported in heartbeats by name, for daemons without a unit
+		AllowRestart bool     `yaml:"allow_restart"` // Let the server restart the monitored units
+	} `yaml:"host_services"`
+	Journal struct {
+		Units    []string `yaml:"units"`    // journald units of the host shipped to the server, kernel for kernel messages, empty disables
+		Priority string   `yaml:"priority"` // Least severe priority shipped, e.g. warning or 4
+		Cursor   string   `yaml:"cursor"`   // File keeping the position in the journal across restarts, empty for .journal-cursor in the compose directory
+	} `yaml:"journal"`
+	Autonomy struct {
+		Enabled       bool   `yaml:"enabled"`         // Keep applications running without the server, see docs/offline-autonomy.md
+		CheckInterval int    `yaml:"check_interval"`  // Seconds between checks of the applications and staged updates
+		MaxRestarts   int    `yaml:"max_restarts"`    // Restarts of a container per hour before it is left alone, -1 for no limit
+		LogMaxSizeMB  int    `yaml:"log_max_size_mb"` // Rotate container logs at this size, -1 to leave the logging of services alone
+		LogMaxFiles   int    `yaml:"log_max_files"`   // Rotated container log files kept
+		Events        string `yaml:"events"`          // File keeping events until the server received them, empty for .autonomy-events in the compose directory
+	} `yaml:"autonomy"`
+	Tracing struct {
+		Enabled     bool              `yaml:"enabled"`
+		Endpoint    string            `yaml:"endpoint"`              // OTLP/HTTP collector address, e.g. otel-collector:4318
+		Insecure    bool              `yaml:"insecure"`              // Use plain HTTP instead of HTTPS
+		Headers     map[string]string `yaml:"headers" secret:"true"` // Sent with every export, e.g. an API key
+		SampleRatio float64           `yaml:"sample_ratio"`          // Fraction of new traces to record, 1 records all
+	} `yaml:"tracing"`
 }
 
-// LoadServerConfig loads the server configuration from a file
-func LoadServerConfig(path string) (*ServerConfig, error) {
+// LoadServerConfig loads the server configuration. Settings are taken from
+// overrides (usually command line flags) first, then EDGETAINER_* environment
+// variables, then the file. A missing file is not an error, so the server can
+// be configured from the environment alone.
+func LoadServerConfig(path string, overrides Overrides) (*ServerConfig, error) {
+	var cfg ServerConfig
+
 	data, err := ioutil.ReadFile(path)
-	if err != nil {
+	if err != nil && !os.IsNotExist(err) {
 		return nil, fmt.Errorf("failed to read config file: %w", err)
 	}
+	if err == nil {
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse config file: %w", err)
+		}
+	}
 
-	var cfg ServerConfig
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
-		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	// The admin credentials keep their original, shorter variable names
+	// with the lowest precedence of the environment
+	legacyEnv := map[string]string{
+		"EDGETAINER_ADMIN_USERNAME": "auth.admin_username",
+		"EDGETAINER_ADMIN_PASSWORD": "auth.admin_password",
+		"EDGETAINER_ADMIN_EMAIL":    "auth.admin_email",
+	}
+	env, err := EnvOverrides(&cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid environment: %w", err)
+	}
+	for name, path := range legacyEnv {
+		value, _, err := LookupEnv(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid environment: %w", err)
+		}
+		if value != "" {
+			if _, ok := env[path]; !ok {
+				env[path] = value
+			}
+		}
+	}
+
+	if err := env.Apply(&cfg); err != nil {
+		return nil, fmt.Errorf("invalid environment: %w", err)
+	}
+	if err := overrides.Apply(&cfg); err != nil {
+		return nil, err
 	}
 
 	// Set defaults for missing values
@@ -82,44 +459,414 @@ func LoadServerConfig(path string) (*ServerConfig, error) {
 	if cfg.Server.Port == 0 {
 		cfg.Server.Port = 8080
 	}
+	if cfg.Database.Port == 0 {
+		cfg.Database.Port = 5432
+	}
+	if cfg.Database.SSLMode == "" {
+		cfg.Database.SSLMode = "disable"
+	}
+	if cfg.Database.MaxOpenConns == 0 {
+		cfg.Database.MaxOpenConns = 100
+	}
+	if cfg.Database.MaxIdleConns == 0 {
+		cfg.Database.MaxIdleConns = 10
+	}
+	if cfg.Database.ConnMaxLifetime == 0 {
+		cfg.Database.ConnMaxLifetime = 3600
+	}
+	if cfg.SSH.ProxyProtocol == "" {
+		cfg.SSH.ProxyProtocol = ProxyProtocolOff
+	}
 	if cfg.SSH.Port == 0 {
 		cfg.SSH.Port = 2222
 	}
+	if cfg.SSH.ForwardHost == "" {
+		cfg.SSH.ForwardHost = "127.0.0.1"
+	}
 	if cfg.SSH.HostKeyPath == "" {
 		cfg.SSH.HostKeyPath = "ssh_host_key"
 	}
+	if cfg.SSH.Keys.HostKeyType == "" {
+		cfg.SSH.Keys.HostKeyType = sshkeys.TypeED25519
+	}
+	if cfg.SSH.Keys.DeviceKeyType == "" {
+		cfg.SSH.Keys.DeviceKeyType = sshkeys.TypeED25519
+	}
+	if cfg.SSH.CA.KeyPath == "" {
+		cfg.SSH.CA.KeyPath = "ssh_ca_key"
+	}
+	if cfg.SSH.Hardware == "" {
+		cfg.SSH.Hardware = protocol.HardwareAlert
+	}
+	if cfg.SSH.CA.CertTTL == 0 {
+		cfg.SSH.CA.CertTTL = 86400
+	}
 	if cfg.SSH.StartPort == 0 {
 		cfg.SSH.StartPort = 10000
 	}
 	if cfg.SSH.EndPort == 0 {
 		cfg.SSH.EndPort = 20000
 	}
+	if cfg.SSH.Keepalive.Interval == 0 {
+		cfg.SSH.Keepalive.Interval = 30
+	}
+	if cfg.SSH.Keepalive.Timeout == 0 {
+		cfg.SSH.Keepalive.Timeout = 15
+	}
+	if cfg.SSH.Keepalive.MaxMissed == 0 {
+		cfg.SSH.Keepalive.MaxMissed = 3
+	}
+	if cfg.SSH.Heartbeats.FlushMS == 0 {
+		cfg.SSH.Heartbeats.FlushMS = 1000
+	}
+	if cfg.SSH.Heartbeats.BatchSize == 0 {
+		cfg.SSH.Heartbeats.BatchSize = 500
+	}
+	if cfg.SSH.Heartbeats.QueueSize == 0 {
+		cfg.SSH.Heartbeats.QueueSize = 10000
+	}
+	if cfg.SSH.Forwards.MaxPerDevice == 0 {
+		cfg.SSH.Forwards.MaxPerDevice = 10
+	}
+	if cfg.SSH.Forwards.IdleTimeout == 0 {
+		cfg.SSH.Forwards.IdleTimeout = 300
+	}
+	if cfg.SSH.Connections.IdleTimeout == 0 {
+		cfg.SSH.Connections.IdleTimeout = 600
+	}
+	if cfg.SSH.Connections.MaxDuration == 0 {
+		cfg.SSH.Connections.MaxDuration = 28800
+	}
+	if cfg.SSH.Connections.MaxPerDevice == 0 {
+		cfg.SSH.Connections.MaxPerDevice = 64
+	}
 	if cfg.Logging.Level == "" {
 		cfg.Logging.Level = "info"
 	}
+	if cfg.Logging.MaxSizeMB == 0 {
+		cfg.Logging.MaxSizeMB = 100
+	}
+	if cfg.Logging.MaxBackups == 0 {
+		cfg.Logging.MaxBackups = 5
+	}
+	if cfg.Deploy.MaxConcurrent == 0 {
+		cfg.Deploy.MaxConcurrent = 10
+	}
+	if cfg.Deploy.RegistryConcurrency == 0 {
+		cfg.Deploy.RegistryConcurrency = 25
+	}
+	if cfg.Deploy.ApprovalExpiry == 0 {
+		cfg.Deploy.ApprovalExpiry = 72
+	}
+	if cfg.SecretScan.Policy == "" {
+		cfg.SecretScan.Policy = SecretScanWarn
+	}
+	if cfg.Devices.UniqueNames == "" {
+		cfg.Devices.UniqueNames = DeviceNamesFleet
+	}
+	if cfg.Jobs.Workers == 0 {
+		cfg.Jobs.Workers = 4
+	}
+	if cfg.Jobs.Retention == 0 {
+		cfg.Jobs.Retention = 168
+	}
+	if cfg.Clock.MaxSkew == 0 {
+		cfg.Clock.MaxSkew = 30
+	}
+	if cfg.HostHealth.MaxTemperature == 0 {
+		cfg.HostHealth.MaxTemperature = 85
+	}
+	if cfg.HostHealth.MinBattery == 0 {
+		cfg.HostHealth.MinBattery = 20
+	}
+	if cfg.Hooks.Timeout == 0 {
+		cfg.Hooks.Timeout = 10
+	}
+	if cfg.Hooks.MQTT.Topic == "" {
+		cfg.Hooks.MQTT.Topic = "edgetainer/devices/{device_id}/{event}"
+	}
+	if cfg.Hooks.MQTT.ClientID == "" {
+		cfg.Hooks.MQTT.ClientID = "edgetainer-server"
+	}
+	if cfg.Extensions.Webhook.Timeout == 0 {
+		cfg.Extensions.Webhook.Timeout = 10
+	}
+	if cfg.Artifacts.Backend == "" {
+		cfg.Artifacts.Backend = "local"
+	}
+	if cfg.Artifacts.Dir == "" {
+		cfg.Artifacts.Dir = "artifacts"
+	}
+	if cfg.Artifacts.MaxSizeMB == 0 {
+		cfg.Artifacts.MaxSizeMB = 2048
+	}
+	if cfg.Storage.Backend == "local" && cfg.Storage.Dir == "" {
+		cfg.Storage.Dir = "storage"
+	}
+	if cfg.DNS.TTL == 0 {
+		cfg.DNS.TTL = 300
+	}
+	if cfg.DNS.RFC2136.TSIGAlgorithm == "" {
+		cfg.DNS.RFC2136.TSIGAlgorithm = "hmac-sha256"
+	}
+	if cfg.Proxy.Domain == "" {
+		cfg.Proxy.Domain = cfg.DNS.Domain
+	}
+	if cfg.Proxy.Ports.Start == 0 {
+		cfg.Proxy.Ports.Start = 30000
+	}
+	if cfg.Proxy.Ports.End == 0 {
+		cfg.Proxy.Ports.End = 30999
+	}
+	if cfg.Cache.TTL == 0 {
+		cfg.Cache.TTL = 10
+	}
+	if cfg.Tracing.Endpoint == "" {
+		cfg.Tracing.Endpoint = "localhost:4318"
+	}
+	if cfg.Tracing.SampleRatio == 0 {
+		cfg.Tracing.SampleRatio = 1
+	}
 
-	// Check for environment variables for admin credentials
-	if adminUsername := os.Getenv("EDGETAINER_ADMIN_USERNAME"); adminUsername != "" {
-		cfg.Auth.AdminUsername = adminUsername
-	} else if cfg.Auth.AdminUsername == "" {
+	if cfg.Auth.AdminUsername == "" {
 		cfg.Auth.AdminUsername = "admin"
 	}
-
-	if adminPassword := os.Getenv("EDGETAINER_ADMIN_PASSWORD"); adminPassword != "" {
-		cfg.Auth.AdminPassword = adminPassword
-	} else if cfg.Auth.AdminPassword == "" {
-		cfg.Auth.AdminPassword = "password"
+	if cfg.Auth.AdminEmail == "" {
+		cfg.Auth.AdminEmail = "admin@example.com"
+	}
+	if cfg.Auth.InviteExpiry == 0 {
+		cfg.Auth.InviteExpiry = 72
+	}
+	if cfg.SMTP.Port == 0 {
+		cfg.SMTP.Port = 587
+	}
+	if cfg.SMTP.TLS == "" {
+		cfg.SMTP.TLS = SMTPStartTLS
 	}
 
-	if adminEmail := os.Getenv("EDGETAINER_ADMIN_EMAIL"); adminEmail != "" {
-		cfg.Auth.AdminEmail = adminEmail
-	} else if cfg.Auth.AdminEmail == "" {
-		cfg.Auth.AdminEmail = "admin@example.com"
+	// The active encryption key can be supplied through the environment so it
+	// does not have to be written to the config file
+	if cfg.Encryption.ActiveKey == "" {
+		cfg.Encryption.ActiveKey = "primary"
+	}
+	encryptionKey, _, err := LookupEnv("EDGETAINER_ENCRYPTION_KEY")
+	if err != nil {
+		return nil, fmt.Errorf("invalid environment: %w", err)
+	}
+	if encryptionKey != "" {
+		if cfg.Encryption.Keys == nil {
+			cfg.Encryption.Keys = make(map[string]string)
+		}
+		cfg.Encryption.Keys[cfg.Encryption.ActiveKey] = encryptionKey
 	}
 
 	return &cfg, nil
 }
 
+// Validate checks the server configuration for errors
+func (c *ServerConfig) Validate() error {
+	if c.Server.Port <= 0 || c.Server.Port > 65535 {
+		return fmt.Errorf("server.port %d is out of range", c.Server.Port)
+	}
+	if c.SSH.Port <= 0 || c.SSH.Port > 65535 {
+		return fmt.Errorf("ssh.port %d is out of range", c.SSH.Port)
+	}
+	if c.SSH.StartPort <= 0 || c.SSH.EndPort > 65535 || c.SSH.StartPort > c.SSH.EndPort {
+		return fmt.Errorf("ssh port range %d-%d is invalid", c.SSH.StartPort, c.SSH.EndPort)
+	}
+	if c.Clock.MaxSkew < 0 {
+		return fmt.Errorf("clock.max_skew %d must not be negative", c.Clock.MaxSkew)
+	}
+	if c.HostHealth.MaxTemperature < -1 {
+		return fmt.Errorf("host_health.max_temperature %d must be -1 or positive", c.HostHealth.MaxTemperature)
+	}
+	if c.HostHealth.MinBattery < -1 || c.HostHealth.MinBattery > 100 {
+		return fmt.Errorf("host_health.min_battery %d must be -1 or between 1 and 100", c.HostHealth.MinBattery)
+	}
+	if c.Deploy.MaxConcurrent < -1 || c.Deploy.RegistryConcurrency < -1 {
+		return fmt.Errorf("deploy limits must be -1 or positive")
+	}
+	if c.Deploy.ApprovalExpiry < -1 {
+		return fmt.Errorf("deploy.approval_expiry %d must be -1 or positive", c.Deploy.ApprovalExpiry)
+	}
+	switch c.SecretScan.Policy {
+	case SecretScanWarn, SecretScanBlock, SecretScanOff:
+	default:
+		return fmt.Errorf("secret_scan.policy %q must be %s, %s or %s", c.SecretScan.Policy, SecretScanWarn, SecretScanBlock, SecretScanOff)
+	}
+	switch c.Devices.UniqueNames {
+	case DeviceNamesFleet, DeviceNamesGlobal, DeviceNamesOff:
+	default:
+		return fmt.Errorf("devices.unique_names %q must be %s, %s or %s", c.Devices.UniqueNames, DeviceNamesFleet, DeviceNamesGlobal, DeviceNamesOff)
+	}
+	if c.Jobs.Workers < 1 {
+		return fmt.Errorf("jobs.workers %d must be positive", c.Jobs.Workers)
+	}
+	if c.Jobs.Retention < -1 {
+		return fmt.Errorf("jobs.retention %d must be positive or -1", c.Jobs.Retention)
+	}
+	if c.Cache.TTL < -1 {
+		return fmt.Errorf("cache.ttl %d must be positive or -1", c.Cache.TTL)
+	}
+	if c.SSH.TunnelRate < 0 {
+		return fmt.Errorf("ssh.tunnel_rate_kbps %d must not be negative", c.SSH.TunnelRate)
+	}
+	if c.Artifacts.Backend != "local" && c.Artifacts.Backend != "s3" {
+		return fmt.Errorf("artifacts.backend %q must be local or s3", c.Artifacts.Backend)
+	}
+	if c.Artifacts.MaxSizeMB < 1 || c.Artifacts.PresignTTL < 0 {
+		return fmt.Errorf("artifacts.max_size_mb must be positive and artifacts.presign_ttl not negative")
+	}
+	if c.Storage.Backend != "" && c.Storage.Backend != "local" && c.Storage.Backend != "s3" {
+		return fmt.Errorf("storage.backend %q must be local, s3 or empty", c.Storage.Backend)
+	}
+	lifecycle := c.Storage.Lifecycle
+	if lifecycle.ArchiveLogsAfterDays < 0 || lifecycle.LogArchiveDays < 0 || lifecycle.DiagnosticsDays < 0 || lifecycle.CapturesDays < 0 {
+		return fmt.Errorf("storage.lifecycle days must not be negative")
+	}
+	if lifecycle.ArchiveLogsAfterDays > 0 && c.Storage.Backend == "" {
+		return fmt.Errorf("storage.lifecycle.archive_logs_after_days needs a storage.backend")
+	}
+	if err := sshkeys.Validate(c.SSH.Keys.HostKeyType, c.SSH.Keys.HostKeyBits); err != nil {
+		return fmt.Errorf("ssh.keys host key: %w", err)
+	}
+	if err := sshkeys.Validate(c.SSH.Keys.DeviceKeyType, c.SSH.Keys.DeviceKeyBits); err != nil {
+		return fmt.Errorf("ssh.keys device key: %w", err)
+	}
+	if err := sshkeys.CheckAlgorithms(c.SSH.Keys.Algorithms); err != nil {
+		return fmt.Errorf("ssh.keys.algorithms: %w", err)
+	}
+	switch c.SSH.ProxyProtocol {
+	case ProxyProtocolOff, ProxyProtocolOptional, ProxyProtocolRequired:
+	default:
+		return fmt.Errorf("ssh.proxy_protocol %q must be %s, %s or %s", c.SSH.ProxyProtocol, ProxyProtocolOff, ProxyProtocolOptional, ProxyProtocolRequired)
+	}
+	for _, source := range c.SSH.ProxyTrusted {
+		if _, _, err := net.ParseCIDR(source); err != nil && net.ParseIP(source) == nil {
+			return fmt.Errorf("ssh.proxy_trusted %q is not an address or CIDR range", source)
+		}
+	}
+	if c.SSH.Host != "" && net.ParseIP(c.SSH.Host) == nil {
+		return fmt.Errorf("ssh.host %q is not an IP address", c.SSH.Host)
+	}
+	if net.ParseIP(c.SSH.ForwardHost) == nil {
+		return fmt.Errorf("ssh.forward_host %q is not an IP address", c.SSH.ForwardHost)
+	}
+	if c.Server.ShutdownDelay < 0 {
+		return fmt.Errorf("server.shutdown_delay must not be negative")
+	}
+	switch c.Database.SSLMode {
+	case "disable", "allow", "prefer", "require", "verify-ca", "verify-full":
+	default:
+		return fmt.Errorf("database.sslmode %q must be disable, allow, prefer, require, verify-ca or verify-full", c.Database.SSLMode)
+	}
+	if c.Database.MaxOpenConns < 1 || c.Database.MaxIdleConns < 0 || c.Database.MaxIdleConns > c.Database.MaxOpenConns {
+		return fmt.Errorf("database.max_open_conns must be positive and database.max_idle_conns at most as many")
+	}
+	if !protocol.IsHardwareBinding(c.SSH.Hardware) {
+		return fmt.Errorf("ssh.hardware %q must be %s or %s", c.SSH.Hardware, protocol.HardwareAlert, protocol.HardwareReject)
+	}
+	if c.SSH.CA.CertTTL < 300 {
+		return fmt.Errorf("ssh.ca.cert_ttl %d must be at least 300 seconds", c.SSH.CA.CertTTL)
+	}
+	if c.SSH.Keepalive.Interval > 0 {
+		// Probes are sent one after another, so one has to time out before the
+		// next is due
+		if c.SSH.Keepalive.Timeout <= 0 || c.SSH.Keepalive.Timeout > c.SSH.Keepalive.Interval {
+			return fmt.Errorf("ssh.keepalive.timeout %d must be between 1 and the interval", c.SSH.Keepalive.Timeout)
+		}
+		if c.SSH.Keepalive.MaxMissed <= 0 {
+			return fmt.Errorf("ssh.keepalive.max_missed %d must be positive", c.SSH.Keepalive.MaxMissed)
+		}
+	} else if c.SSH.Keepalive.Interval != -1 {
+		return fmt.Errorf("ssh.keepalive.interval %d must be positive or -1", c.SSH.Keepalive.Interval)
+	}
+	if c.SSH.Heartbeats.FlushMS <= 0 || c.SSH.Heartbeats.QueueSize <= 0 {
+		return fmt.Errorf("ssh.heartbeats.flush_ms and queue_size must be positive")
+	}
+	// Batches binding more parameters than Postgres allows in a statement are
+	// written with several
+	if c.SSH.Heartbeats.BatchSize <= 0 || c.SSH.Heartbeats.BatchSize > 5000 {
+		return fmt.Errorf("ssh.heartbeats.batch_size %d must be between 1 and 5000", c.SSH.Heartbeats.BatchSize)
+	}
+	if c.SSH.Forwards.MaxPerDevice < -1 || c.SSH.Forwards.IdleTimeout < -1 {
+		return fmt.Errorf("ssh.forwards limits must be -1 or positive")
+	}
+	if c.SSH.Connections.IdleTimeout < -1 || c.SSH.Connections.MaxDuration < -1 || c.SSH.Connections.MaxPerDevice < -1 {
+		return fmt.Errorf("ssh.connections limits must be -1 or positive")
+	}
+	if c.Hooks.Timeout <= 0 {
+		return fmt.Errorf("hooks.timeout %d must be positive", c.Hooks.Timeout)
+	}
+	if c.Auth.InviteExpiry <= 0 {
+		return fmt.Errorf("auth.invite_expiry %d must be positive", c.Auth.InviteExpiry)
+	}
+	switch c.SMTP.TLS {
+	case SMTPStartTLS, SMTPTLS, SMTPNone:
+	default:
+		return fmt.Errorf("smtp.tls %q must be %s, %s or %s", c.SMTP.TLS, SMTPStartTLS, SMTPTLS, SMTPNone)
+	}
+	if c.SMTP.Host != "" && c.SMTP.From == "" {
+		return fmt.Errorf("smtp.from is required with smtp.host")
+	}
+	if c.SMTP.Port <= 0 || c.SMTP.Port > 65535 {
+		return fmt.Errorf("smtp.port %d is out of range", c.SMTP.Port)
+	}
+	switch c.DNS.Provider {
+	case "":
+	case "route53", "cloudflare", "rfc2136":
+		if c.DNS.Domain == "" || c.DNS.Target == "" {
+			return fmt.Errorf("dns.domain and dns.target are required with dns.provider %s", c.DNS.Provider)
+		}
+		if c.DNS.TTL <= 0 {
+			return fmt.Errorf("dns.ttl %d must be positive", c.DNS.TTL)
+		}
+	default:
+		return fmt.Errorf("dns.provider %q must be route53, cloudflare or rfc2136", c.DNS.Provider)
+	}
+	if c.Agents.MinVersion != "" && !protocol.ValidVersion(c.Agents.MinVersion) {
+		return fmt.Errorf("agents.min_version %q is not a version like 1.2.3", c.Agents.MinVersion)
+	}
+	if err := c.AgentRequirements().Validate(); err != nil {
+		return fmt.Errorf("agents: %w", err)
+	}
+	if c.Proxy.Listen != "" && c.Proxy.Domain == "" {
+		return fmt.Errorf("proxy.domain or dns.domain is required with proxy.listen")
+	}
+	if c.Proxy.Ports.Start <= 0 || c.Proxy.Ports.End > 65535 || c.Proxy.Ports.Start > c.Proxy.Ports.End {
+		return fmt.Errorf("proxy port range %d-%d is invalid", c.Proxy.Ports.Start, c.Proxy.Ports.End)
+	}
+	if c.Proxy.Ports.Start <= c.SSH.EndPort && c.SSH.StartPort <= c.Proxy.Ports.End {
+		return fmt.Errorf("proxy port range %d-%d overlaps the ssh port range %d-%d", c.Proxy.Ports.Start, c.Proxy.Ports.End, c.SSH.StartPort, c.SSH.EndPort)
+	}
+	if c.Database.Host == "" {
+		return fmt.Errorf("database.host is required")
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		return fmt.Errorf("tracing.sample_ratio %g must be between 0 and 1", c.Tracing.SampleRatio)
+	}
+	if c.Database.DBName == "" {
+		return fmt.Errorf("database.dbname is required")
+	}
+	if len(c.Encryption.Keys) > 0 {
+		if _, ok := c.Encryption.Keys[c.Encryption.ActiveKey]; !ok {
+			return fmt.Errorf("encryption.active_key %q is not one of encryption.keys", c.Encryption.ActiveKey)
+		}
+	}
+
+	return nil
+}
+
+// AgentRequirements returns the oldest agent, OS and kernel versions this
+// server deploys to
+func (c *ServerConfig) AgentRequirements() protocol.Requirements {
+	return protocol.Requirements{
+		MinAgentVersion:  c.Agents.MinVersion,
+		MinOSVersions:    c.Agents.MinOSVersions,
+		MinKernelVersion: c.Agents.MinKernelVersion,
+	}
+}
+
 // LoadAgentConfig loads the agent configuration from a file
 func LoadAgentConfig(path string) (*AgentConfig, error) {
 	data, err := ioutil.ReadFile(path)
@@ -142,19 +889,203 @@ func LoadAgentConfig(path string) (*AgentConfig, error) {
 	if cfg.SSH.Key == "" {
 		cfg.SSH.Key = "ssh_key"
 	}
+	if cfg.Server.FailoverAfter <= 0 {
+		cfg.Server.FailoverAfter = 60
+	}
+	if cfg.Server.FailbackInterval == 0 {
+		cfg.Server.FailbackInterval = 300
+	}
 	if cfg.Docker.ComposeDir == "" {
 		cfg.Docker.ComposeDir = "compose"
 	}
 	if cfg.Docker.NetworkName == "" {
 		cfg.Docker.NetworkName = "edgetainer"
 	}
+	if cfg.Artifacts.CacheDir == "" {
+		cfg.Artifacts.CacheDir = filepath.Join(cfg.Docker.ComposeDir, ".artifacts")
+	}
+	if cfg.Artifacts.MaxAgeDays == 0 {
+		cfg.Artifacts.MaxAgeDays = 30
+	}
+	if cfg.Display.Dir == "" {
+		cfg.Display.Dir = filepath.Join(cfg.Docker.ComposeDir, ".display")
+	}
+	if cfg.Display.WaylandDisplay == "" {
+		cfg.Display.WaylandDisplay = "/run/kiosk/wayland-0"
+	}
+	if cfg.Display.Output == "" {
+		cfg.Display.Output = "HDMI-A-1"
+	}
+	if cfg.Journal.Priority == "" {
+		cfg.Journal.Priority = "info"
+	}
+	if cfg.Journal.Cursor == "" {
+		cfg.Journal.Cursor = filepath.Join(cfg.Docker.ComposeDir, ".journal-cursor")
+	}
+	if cfg.Autonomy.CheckInterval <= 0 {
+		cfg.Autonomy.CheckInterval = 60
+	}
+	if cfg.Autonomy.MaxRestarts == 0 {
+		cfg.Autonomy.MaxRestarts = 6
+	}
+	if cfg.Autonomy.LogMaxSizeMB == 0 {
+		cfg.Autonomy.LogMaxSizeMB = 10
+	}
+	if cfg.Autonomy.LogMaxFiles <= 0 {
+		cfg.Autonomy.LogMaxFiles = 3
+	}
+	if cfg.Autonomy.Events == "" {
+		cfg.Autonomy.Events = filepath.Join(cfg.Docker.ComposeDir, ".autonomy-events")
+	}
 	if cfg.Logging.Level == "" {
 		cfg.Logging.Level = "info"
 	}
+	if cfg.Logging.MaxSizeMB == 0 {
+		cfg.Logging.MaxSizeMB = 10
+	}
+	if cfg.Logging.MaxBackups == 0 {
+		cfg.Logging.MaxBackups = 3
+	}
+	if cfg.Tracing.Endpoint == "" {
+		cfg.Tracing.Endpoint = "localhost:4318"
+	}
+	if cfg.Tracing.SampleRatio == 0 {
+		cfg.Tracing.SampleRatio = 1
+	}
+	if cfg.Health.Listen == "" {
+		cfg.Health.Listen = "127.0.0.1:9110"
+	}
+	if cfg.Control.Socket == "" {
+		cfg.Control.Socket = DefaultControlSocket
+	}
+	if cfg.Shutdown.Policy == "" {
+		cfg.Shutdown.Policy = "leave-running"
+	}
+	if cfg.Pull.Retries == 0 {
+		cfg.Pull.Retries = 5
+	}
+	if cfg.Pull.RetryDelay <= 0 {
+		cfg.Pull.RetryDelay = 5
+	}
+	if cfg.Intervals.Metrics <= 0 {
+		cfg.Intervals.Metrics = 30
+	}
+	if cfg.Intervals.Keepalive <= 0 {
+		cfg.Intervals.Keepalive = 30
+	}
+	if cfg.Intervals.Heartbeat <= 0 {
+		cfg.Intervals.Heartbeat = 60
+	}
+	if cfg.Forwards.IdleTimeout == 0 {
+		cfg.Forwards.IdleTimeout = 600
+	}
+	if cfg.Forwards.MaxDuration == 0 {
+		cfg.Forwards.MaxDuration = 28800
+	}
+	if cfg.Forwards.MaxConnections == 0 {
+		cfg.Forwards.MaxConnections = 32
+	}
+	if cfg.Location.GPSD == "" {
+		cfg.Location.GPSD = "localhost:2947"
+	}
+	if cfg.Plugins.Timeout <= 0 {
+		cfg.Plugins.Timeout = 10
+	}
+	if cfg.Protection.AgentUnit == "" {
+		cfg.Protection.AgentUnit = "edgetainer-agent.service"
+	}
+	if cfg.Protection.DockerUnit == "" {
+		cfg.Protection.DockerUnit = "docker.service"
+	}
+	if cfg.Protection.AgentMemoryMB == 0 {
+		cfg.Protection.AgentMemoryMB = 64
+	}
+	if cfg.Protection.DockerMemoryMB == 0 {
+		cfg.Protection.DockerMemoryMB = 128
+	}
+	if cfg.Protection.CPUWeight == 0 {
+		cfg.Protection.CPUWeight = 1000
+	}
+	if cfg.Protection.OOMScoreAdjust == 0 {
+		cfg.Protection.OOMScoreAdjust = -900
+	}
+	if cfg.Protection.CheckInterval <= 0 {
+		cfg.Protection.CheckInterval = 300
+	}
+
+	for _, backup := range cfg.Server.Backups {
+		if _, _, err := ParseEndpoint(backup, cfg.SSH.Port); err != nil {
+			return nil, fmt.Errorf("server.backups: %w", err)
+		}
+	}
+	if err := sshkeys.CheckAlgorithms(cfg.SSH.KeyAlgorithms); err != nil {
+		return nil, fmt.Errorf("ssh.key_algorithms: %w", err)
+	}
+	if err := sshkeys.CheckAlgorithms(cfg.SSH.HostKeyAlgorithms); err != nil {
+		return nil, fmt.Errorf("ssh.host_key_algorithms: %w", err)
+	}
+	if err := cfg.Resources.Validate(); err != nil {
+		return nil, fmt.Errorf("resources: %w", err)
+	}
+	if cfg.Docker.EmulatedPlatforms, err = protocol.NormalizePlatforms(cfg.Docker.EmulatedPlatforms); err != nil {
+		return nil, fmt.Errorf("docker.emulated_platforms: %w", err)
+	}
+	if cfg.Protection.AgentMemoryMB < 0 || cfg.Protection.DockerMemoryMB < 0 {
+		return nil, fmt.Errorf("protection: memory must not be negative")
+	}
+	if cfg.Protection.CPUWeight < 1 || cfg.Protection.CPUWeight > 10000 {
+		return nil, fmt.Errorf("protection.cpu_weight must be between 1 and 10000")
+	}
+	if cfg.Protection.OOMScoreAdjust < -1000 || cfg.Protection.OOMScoreAdjust > 1000 {
+		return nil, fmt.Errorf("protection.oom_score_adjust must be between -1000 and 1000")
+	}
+
+	if cfg.System.LowMemory {
+		cfg.ApplyLowMemory()
+	}
 
 	return &cfg, nil
 }
 
+// ParseEndpoint splits a server given as host or host:port, IPv6 addresses
+// with a port in brackets, using defaultPort if there is none
+func ParseEndpoint(value string, defaultPort int) (string, int, error) {
+	host, portText, err := net.SplitHostPort(value)
+	if err != nil {
+		// Without a port, unless the colons belong to an IPv6 address
+		if strings.Contains(strings.Trim(value, "[]"), ":") && net.ParseIP(strings.Trim(value, "[]")) == nil {
+			return "", 0, fmt.Errorf("invalid server %q", value)
+		}
+		host, portText = strings.Trim(value, "[]"), strconv.Itoa(defaultPort)
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil || port < 1 || port > 65535 || host == "" {
+		return "", 0, fmt.Errorf("invalid server %q", value)
+	}
+	return host, port, nil
+}
+
+// Intervals of the low memory mode, longer ones configured are kept
+const (
+	LowMemoryMetricsInterval   = 120 // Seconds between system metric collections
+	LowMemoryHeartbeatInterval = 120 // Seconds between heartbeats
+)
+
+// ApplyLowMemory adjusts the configuration for devices with little memory:
+// metrics are collected and heartbeats sent less often, the configuration
+// file is only reloaded on SIGHUP, and the health endpoint, pull proxy,
+// location reporting and tracing are turned off.
+func (c *AgentConfig) ApplyLowMemory() {
+	c.System.LowMemory = true
+	c.Intervals.Metrics = max(c.Intervals.Metrics, LowMemoryMetricsInterval)
+	c.Intervals.Heartbeat = max(c.Intervals.Heartbeat, LowMemoryHeartbeatInterval)
+	c.Reload.WatchInterval = 0
+	c.Health.Enabled = false
+	c.Pull.ProxyListen = ""
+	c.Location.Source = ""
+	c.Tracing.Enabled = false
+}
+
 // CreateDefaultServerConfig creates a default server configuration file
 func CreateDefaultServerConfig(path string) error {
 	// Create default configuration
@@ -166,15 +1097,58 @@ func CreateDefaultServerConfig(path string) error {
 	cfg.Database.User = "postgres"
 	cfg.Database.Password = "postgres"
 	cfg.Database.DBName = "edgetainer"
+	cfg.Database.SSLMode = "disable"
+	cfg.Database.MaxOpenConns = 100
+	cfg.Database.MaxIdleConns = 10
+	cfg.Database.ConnMaxLifetime = 3600
 	cfg.Auth.AdminUsername = "admin"
-	cfg.Auth.AdminPassword = "password"
 	cfg.Auth.AdminEmail = "admin@example.com"
+	cfg.Auth.InviteExpiry = 72
+	cfg.SMTP.Port = 587
+	cfg.SMTP.TLS = SMTPStartTLS
 	cfg.SSH.Port = 2222
+	cfg.SSH.ForwardHost = "127.0.0.1"
 	cfg.SSH.HostKeyPath = "ssh_host_key"
+	cfg.SSH.Keys.HostKeyType = sshkeys.TypeED25519
+	cfg.SSH.Keys.DeviceKeyType = sshkeys.TypeED25519
+	cfg.SSH.CA.KeyPath = "ssh_ca_key"
+	cfg.SSH.CA.CertTTL = 86400
+	cfg.SSH.Hardware = protocol.HardwareAlert
+	cfg.SSH.ProxyProtocol = ProxyProtocolOff
 	cfg.SSH.StartPort = 10000
 	cfg.SSH.EndPort = 20000
+	cfg.SSH.Keepalive.Interval = 30
+	cfg.SSH.Keepalive.Timeout = 15
+	cfg.SSH.Keepalive.MaxMissed = 3
+	cfg.SSH.Heartbeats.FlushMS = 1000
+	cfg.SSH.Heartbeats.BatchSize = 500
+	cfg.SSH.Heartbeats.QueueSize = 10000
+	cfg.SSH.Forwards.MaxPerDevice = 10
+	cfg.SSH.Forwards.IdleTimeout = 300
+	cfg.SSH.Connections.IdleTimeout = 600
+	cfg.SSH.Connections.MaxDuration = 28800
+	cfg.SSH.Connections.MaxPerDevice = 64
 	cfg.Logging.Level = "info"
 	cfg.Logging.LogFile = "edgetainer-server.log"
+	cfg.Logging.MaxSizeMB = 100
+	cfg.Logging.MaxAgeDays = 30
+	cfg.Logging.MaxBackups = 5
+	cfg.Logging.Compress = true
+	cfg.Deploy.MaxConcurrent = 10
+	cfg.Deploy.RegistryConcurrency = 25
+	cfg.Deploy.ApprovalExpiry = 72
+	cfg.SecretScan.Policy = SecretScanWarn
+	cfg.Devices.UniqueNames = DeviceNamesFleet
+	cfg.Jobs.Workers = 4
+	cfg.Jobs.Retention = 168
+	cfg.Hooks.Timeout = 10
+	cfg.Hooks.MQTT.Topic = "edgetainer/devices/{device_id}/{event}"
+	cfg.Hooks.MQTT.ClientID = "edgetainer-server"
+	cfg.DNS.TTL = 300
+	cfg.DNS.RFC2136.TSIGAlgorithm = "hmac-sha256"
+	cfg.Proxy.Ports.Start = 30000
+	cfg.Proxy.Ports.End = 30999
+	cfg.Cache.TTL = 10
 
 	// Create directory if it doesn't exist
 	dir := filepath.Dir(path)
@@ -211,6 +1185,24 @@ func CreateDefaultAgentConfig(path string) error {
 	cfg.Docker.NetworkName = "edgetainer"
 	cfg.Logging.Level = "info"
 	cfg.Logging.LogFile = "edgetainer-agent.log"
+	cfg.Logging.MaxSizeMB = 10
+	cfg.Logging.MaxAgeDays = 14
+	cfg.Logging.MaxBackups = 3
+	cfg.Logging.Compress = true
+	cfg.Health.Enabled = true
+	cfg.Health.Listen = "127.0.0.1:9110"
+	cfg.Control.Socket = DefaultControlSocket
+	cfg.Shutdown.Policy = "leave-running"
+	cfg.Pull.Retries = 5
+	cfg.Pull.RetryDelay = 5
+	cfg.Intervals.Metrics = 30
+	cfg.Intervals.Keepalive = 30
+	cfg.Intervals.Heartbeat = 60
+	cfg.Forwards.IdleTimeout = 600
+	cfg.Forwards.MaxDuration = 28800
+	cfg.Forwards.MaxConnections = 32
+	cfg.Location.GPSD = "localhost:2947"
+	cfg.Reload.WatchInterval = 10
 
 	// Create directory if it doesn't exist
 	dir := filepath.Dir(path)
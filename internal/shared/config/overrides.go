@@ -0,0 +1,239 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix prefixes the environment variable of every setting, e.g. the
+// database.host setting is read from EDGETAINER_DATABASE_HOST
+const EnvPrefix = "EDGETAINER_"
+
+// redacted replaces secret settings in printed configurations
+const redacted = "<redacted>"
+
+// Overrides holds setting values by dotted YAML path, e.g. "ssh.port"
+type Overrides map[string]string
+
+// setting is a leaf of a configuration struct
+type setting struct {
+	path   string
+	value  reflect.Value
+	secret bool
+}
+
+// EnvName returns the environment variable name of a setting path
+func EnvName(path string) string {
+	return EnvPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(path))
+}
+
+// EnvFileSuffix marks environment variables naming a file that holds the
+// value, e.g. EDGETAINER_DATABASE_PASSWORD_FILE for a mounted secret
+const EnvFileSuffix = "_FILE"
+
+// LookupEnv returns the value of an environment variable, or the contents of
+// the file named by the variable with EnvFileSuffix, without the trailing
+// newline. The variable itself takes precedence.
+func LookupEnv(name string) (string, bool, error) {
+	if value, ok := os.LookupEnv(name); ok {
+		return value, true, nil
+	}
+	path, ok := os.LookupEnv(name + EnvFileSuffix)
+	if !ok {
+		return "", false, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to read %s: %w", name+EnvFileSuffix, err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), true, nil
+}
+
+// EnvOverrides collects the settings of cfg that are set in the environment,
+// directly or through a file
+func EnvOverrides(cfg interface{}) (Overrides, error) {
+	overrides := make(Overrides)
+	for _, s := range settings(cfg) {
+		value, ok, err := LookupEnv(EnvName(s.path))
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			overrides[s.path] = value
+		}
+	}
+	return overrides, nil
+}
+
+// DefineFlags defines a command line flag for every setting of cfg, named
+// after its path (e.g. -database.host). Only flags given on the command line
+// end up in the returned overrides.
+func DefineFlags(fs *flag.FlagSet, cfg interface{}) Overrides {
+	overrides := make(Overrides)
+	for _, s := range settings(cfg) {
+		path := s.path
+		usage := fmt.Sprintf("Sets %s (env %s)", path, EnvName(path))
+		fs.Func(path, usage, func(value string) error {
+			overrides[path] = value
+			return nil
+		})
+	}
+	return overrides
+}
+
+// Apply sets the overridden settings on cfg, which must be a struct pointer
+func (o Overrides) Apply(cfg interface{}) error {
+	byPath := make(map[string]setting)
+	for _, s := range settings(cfg) {
+		byPath[s.path] = s
+	}
+
+	paths := make([]string, 0, len(o))
+	for path := range o {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		s, ok := byPath[path]
+		if !ok {
+			return fmt.Errorf("unknown setting %s", path)
+		}
+		if err := setValue(s.value, o[path]); err != nil {
+			return fmt.Errorf("invalid value for %s: %w", path, err)
+		}
+	}
+
+	return nil
+}
+
+// Redact returns the configuration as YAML with secret settings replaced
+func Redact(cfg interface{}) (string, error) {
+	copied := reflect.New(reflect.TypeOf(cfg).Elem())
+	copied.Elem().Set(reflect.ValueOf(cfg).Elem())
+
+	// Maps are shared with the original, so replace them rather than edit them
+	for _, s := range settings(copied.Interface()) {
+		if !s.secret {
+			continue
+		}
+		switch s.value.Kind() {
+		case reflect.String:
+			if s.value.String() != "" {
+				s.value.SetString(redacted)
+			}
+		case reflect.Map:
+			masked := reflect.MakeMap(s.value.Type())
+			for _, key := range s.value.MapKeys() {
+				masked.SetMapIndex(key, reflect.ValueOf(redacted))
+			}
+			s.value.Set(masked)
+		}
+	}
+
+	data, err := yaml.Marshal(copied.Interface())
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal config: %w", err)
+	}
+
+	return string(data), nil
+}
+
+// settings walks the leaves of a configuration struct pointer. Fields tagged
+// `secret:"true"` are redacted when the configuration is printed.
+func settings(cfg interface{}) []setting {
+	var result []setting
+	walk(reflect.ValueOf(cfg).Elem(), "", false, &result)
+	return result
+}
+
+// walk collects the leaves of v below prefix
+func walk(v reflect.Value, prefix string, secret bool, result *[]setting) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+
+		path := name
+		if prefix != "" {
+			path = prefix + "." + name
+		}
+		fieldSecret := secret || field.Tag.Get("secret") == "true"
+
+		if field.Type.Kind() == reflect.Struct {
+			walk(v.Field(i), path, fieldSecret, result)
+			continue
+		}
+
+		*result = append(*result, setting{path: path, value: v.Field(i), secret: fieldSecret})
+	}
+}
+
+// setValue parses value into a setting. Lists are comma separated and maps
+// are comma separated key=value pairs.
+func setValue(v reflect.Value, value string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("must be an integer")
+		}
+		v.SetInt(int64(n))
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("must be a number")
+		}
+		v.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("must be a boolean")
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported list type")
+		}
+		items := reflect.MakeSlice(v.Type(), 0, 0)
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = reflect.Append(items, reflect.ValueOf(item))
+			}
+		}
+		v.Set(items)
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String || v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported map type")
+		}
+		entries := reflect.MakeMap(v.Type())
+		for _, pair := range strings.Split(value, ",") {
+			if pair = strings.TrimSpace(pair); pair == "" {
+				continue
+			}
+			key, val, ok := strings.Cut(pair, "=")
+			if !ok {
+				return fmt.Errorf("expected key=value pairs")
+			}
+			entries.SetMapIndex(reflect.ValueOf(strings.TrimSpace(key)), reflect.ValueOf(strings.TrimSpace(val)))
+		}
+		v.Set(entries)
+	default:
+		return fmt.Errorf("unsupported setting type %s", v.Kind())
+	}
+
+	return nil
+}
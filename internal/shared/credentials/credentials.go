@@ -0,0 +1,190 @@
+// Package credentials finds credentials embedded in compose files, env vars
+// and free text such as logs, so that they can be flagged when uploaded and
+// redacted wherever they are shown
+package credentials
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Redacted replaces credentials removed from compose files and text
+const Redacted = "<redacted>"
+
+// Kinds of credentials
+const (
+	KindAWSAccessKey  = "aws-access-key"
+	KindGitHubToken   = "github-token"
+	KindGitLabToken   = "gitlab-token"
+	KindSlackToken    = "slack-token"
+	KindStripeKey     = "stripe-key"
+	KindGoogleAPIKey  = "google-api-key"
+	KindPrivateKey    = "private-key"
+	KindJWT           = "jwt"
+	KindURLPassword   = "url-password"
+	KindNamedPassword = "password" // A literal value of a variable or key named like a secret
+)
+
+// pattern recognizes a kind of credential by its form. The credential is
+// the submatch named secret, or the whole match.
+type pattern struct {
+	kind string
+	re   *regexp.Regexp
+}
+
+var patterns = []pattern{
+	{KindPrivateKey, regexp.MustCompile(`-----BEGIN [A-Z0-9 ]*PRIVATE KEY-----[\s\S]*?(?:-----END [A-Z0-9 ]*PRIVATE KEY-----|$)`)},
+	{KindAWSAccessKey, regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{KindGitHubToken, regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,})\b`)},
+	{KindGitLabToken, regexp.MustCompile(`\bglpat-[A-Za-z0-9_-]{20,}\b`)},
+	{KindSlackToken, regexp.MustCompile(`\bxox[abposr]-[A-Za-z0-9-]{10,}\b`)},
+	{KindStripeKey, regexp.MustCompile(`\b[sr]k_live_[A-Za-z0-9]{16,}\b`)},
+	{KindGoogleAPIKey, regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}\b`)},
+	{KindJWT, regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{8,}\.eyJ[A-Za-z0-9_-]{8,}\.[A-Za-z0-9_-]{8,}`)},
+	{KindURLPassword, regexp.MustCompile(`\b[a-zA-Z][a-zA-Z0-9+.-]*://[^/\s:@]+:(?P<secret>[^/\s@]+)@`)},
+}
+
+// secretName matches names of variables and keys whose values are secrets.
+// Narrower than compose's redaction so that e.g. AUTH_ENABLED or KEY_PREFIX
+// are not flagged on upload.
+var secretName = regexp.MustCompile(`(?i)passw|pwd|secret|token|credential|api_?key|access_?key|private_?key`)
+
+// secretFile matches names of variables holding the path of a secret
+var secretFile = regexp.MustCompile(`(?i)_(file|path)$`)
+
+// namedValue matches name=value and "name": "value" pairs in text whose name
+// suggests a secret
+var namedValue = regexp.MustCompile(`(?i)([a-z0-9_.-]*(?:passw|pwd|secret|token|api_?key|access_?key)[a-z0-9_.-]*)(=|"\s*:\s*")([^\s"'&,;]+)`)
+
+// Finding is a credential found in a compose file or env vars. Its value is
+// never part of it.
+type Finding struct {
+	Kind     string `json:"kind"`
+	Location string `json:"location"`       // Path of the value, e.g. services.web.environment.DB_PASSWORD
+	Line     int    `json:"line,omitempty"` // Line of the value in a compose file
+	value    string
+}
+
+// String describes a finding for warnings and logs
+func (f Finding) String() string {
+	if f.Line > 0 {
+		return fmt.Sprintf("%s at %s (line %d)", f.Kind, f.Location, f.Line)
+	}
+	return fmt.Sprintf("%s at %s", f.Kind, f.Location)
+}
+
+// detect returns the kind of the first credential in a value and the
+// credential itself, empty if there is none
+func detect(value string) (kind, secret string) {
+	for _, p := range patterns {
+		match := p.re.FindStringSubmatch(value)
+		if match == nil {
+			continue
+		}
+		if i := p.re.SubexpIndex("secret"); i > 0 {
+			return p.kind, match[i]
+		}
+		return p.kind, match[0]
+	}
+	return "", ""
+}
+
+// Literal reports whether a value holds a secret itself rather than refer to
+// one, e.g. ${DB_PASSWORD} resolved by Docker Compose or a secret://
+// reference to a secret store
+func Literal(value string) bool {
+	value = strings.TrimSpace(value)
+	switch {
+	case value == "", value == Redacted, strings.Trim(value, "*") == "":
+		return false
+	case strings.HasPrefix(value, "$"), strings.HasPrefix(value, "secret://"):
+		return false
+	}
+	return true
+}
+
+// DetectNamed returns the kind of credential a named value holds and the
+// credential, empty if none. Values of names that suggest a secret count as
+// a whole unless they are references, booleans or numbers, or the name is
+// that of a file holding the secret like DB_PASSWORD_FILE.
+func DetectNamed(name, value string) (kind, secret string) {
+	if kind, secret := detect(value); kind != "" {
+		return kind, secret
+	}
+	if !secretName.MatchString(name) || !Literal(value) || secretFile.MatchString(name) {
+		return "", ""
+	}
+	switch strings.ToLower(value) {
+	case "true", "false", "yes", "no", "on", "off":
+		return "", ""
+	}
+	if _, err := strconv.ParseFloat(value, 64); err == nil {
+		return "", ""
+	}
+	return KindNamedPassword, value
+}
+
+// ScanEnv returns the credentials in env vars, by name. location prefixes
+// the location of the findings.
+func ScanEnv(vars map[string]string, location string) []Finding {
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var findings []Finding
+	for _, name := range names {
+		if kind, secret := DetectNamed(name, vars[name]); kind != "" {
+			findings = append(findings, Finding{Kind: kind, Location: join(location, name), value: secret})
+		}
+	}
+	return findings
+}
+
+// MaskEnv replaces the env vars that hold credentials with mask, e.g. the
+// mask of env var schemas that forms send back unchanged
+func MaskEnv(vars map[string]string, mask string) map[string]string {
+	masked := make(map[string]string, len(vars))
+	for name, value := range vars {
+		if kind, _ := DetectNamed(name, value); kind != "" {
+			value = mask
+		}
+		masked[name] = value
+	}
+	return masked
+}
+
+// Redact replaces the credentials recognized by their form in free text, such
+// as log lines, along with the values of name=value pairs named like secrets
+func Redact(text string) string {
+	for _, p := range patterns {
+		i := p.re.SubexpIndex("secret")
+		if i < 0 {
+			text = p.re.ReplaceAllString(text, Redacted)
+			continue
+		}
+		text = p.re.ReplaceAllStringFunc(text, func(match string) string {
+			secret := p.re.FindStringSubmatch(match)[i]
+			return strings.Replace(match, ":"+secret+"@", ":"+Redacted+"@", 1)
+		})
+	}
+	return namedValue.ReplaceAllStringFunc(text, func(match string) string {
+		parts := namedValue.FindStringSubmatch(match)
+		if !Literal(parts[3]) {
+			return match
+		}
+		return parts[1] + parts[2] + Redacted
+	})
+}
+
+// join appends a name to a location path
+func join(location, name string) string {
+	if location == "" {
+		return name
+	}
+	return location + "." + name
+}
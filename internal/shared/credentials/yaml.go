@@ -0,0 +1,142 @@
+package credentials
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// visitFunc is called for every scalar value of a YAML document, with the
+// location and name of the value. Values of NAME=value list entries are the
+// part after the =.
+type visitFunc func(node *yaml.Node, location, name, value string)
+
+// ScanYAML returns the credentials in a YAML document such as a compose file
+// or override: values recognized by their form anywhere, and literal values
+// of keys and NAME=value list entries named like secrets
+func ScanYAML(document string) ([]Finding, error) {
+	var findings []Finding
+	_, err := walkYAML(document, func(node *yaml.Node, location, name, value string) {
+		if kind, secret := DetectNamed(name, value); kind != "" {
+			findings = append(findings, Finding{Kind: kind, Location: location, Line: node.Line, value: secret})
+		}
+	})
+	return findings, err
+}
+
+// RedactYAML replaces the credentials in a YAML document with Redacted. A
+// document without credentials is returned as is, others are formatted
+// anew.
+func RedactYAML(document string) (string, error) {
+	found := false
+	doc, err := walkYAML(document, func(node *yaml.Node, location, name, value string) {
+		if kind, secret := DetectNamed(name, value); kind != "" {
+			node.Value = strings.Replace(node.Value, secret, Redacted, 1)
+			found = true
+		}
+	})
+	if err != nil || !found {
+		return document, err
+	}
+	return encodeYAML(doc)
+}
+
+// RestoreYAML puts the credentials of the stored version of a YAML document
+// back where a client sent Redacted, so that a redacted document can be
+// edited and saved without ever seeing its credentials. Values must stay at
+// their location to be restored.
+func RestoreYAML(document, stored string) (string, error) {
+	if !strings.Contains(document, Redacted) {
+		return document, nil
+	}
+
+	secrets := make(map[string]string)
+	if stored != "" {
+		findings, err := ScanYAML(stored)
+		if err != nil {
+			return "", fmt.Errorf("stored document: %w", err)
+		}
+		for _, f := range findings {
+			secrets[f.Location] = f.value
+		}
+	}
+
+	var missing []string
+	doc, err := walkYAML(document, func(node *yaml.Node, location, name, value string) {
+		if !strings.Contains(value, Redacted) {
+			return
+		}
+		secret, ok := secrets[location]
+		if !ok {
+			missing = append(missing, location)
+			return
+		}
+		node.Value = strings.Replace(node.Value, Redacted, secret, 1)
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(missing) > 0 {
+		return "", fmt.Errorf("redacted values at %s are not stored, send them again", strings.Join(missing, ", "))
+	}
+	return encodeYAML(doc)
+}
+
+// walkYAML parses a YAML document and calls visit for its scalar values
+func walkYAML(document string, visit visitFunc) (*yaml.Node, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(document), &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse YAML: %w", err)
+	}
+	if len(doc.Content) > 0 {
+		walkNode(doc.Content[0], "", "", visit)
+	}
+	return &doc, nil
+}
+
+// walkNode walks a node at location whose key is name, empty for list
+// entries
+func walkNode(node *yaml.Node, location, name string, visit visitFunc) {
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i].Value
+			walkNode(node.Content[i+1], join(location, key), key, visit)
+		}
+	case yaml.SequenceNode:
+		for i, item := range node.Content {
+			if item.Kind == yaml.ScalarNode {
+				if entry, value, found := strings.Cut(item.Value, "="); found {
+					visit(item, join(location, entry), entry, value)
+					continue
+				}
+			}
+			// Entries are not named by the key of the list, e.g. the names
+			// of the secrets of a service
+			walkNode(item, location+"["+strconv.Itoa(i)+"]", "", visit)
+		}
+	case yaml.ScalarNode:
+		if node.Tag != "!!null" {
+			visit(node, location, name, node.Value)
+		}
+	case yaml.AliasNode:
+		// Visited where the anchor is
+	}
+}
+
+// encodeYAML formats a parsed document
+func encodeYAML(doc *yaml.Node) (string, error) {
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(doc); err != nil {
+		return "", fmt.Errorf("failed to encode YAML: %w", err)
+	}
+	if err := encoder.Close(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
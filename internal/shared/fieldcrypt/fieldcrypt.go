@@ -0,0 +1,253 @@
+package fieldcrypt
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"gorm.io/gorm/schema"
+)
+
+// SerializerName is the GORM serializer that encrypts a string column, used
+// as `gorm:"serializer:encrypted"`
+const SerializerName = "encrypted"
+
+// prefix marks an encrypted value: enc:v1:<key id>:<base64 nonce+ciphertext>
+const prefix = "enc:v1:"
+
+// Keyring holds the keys used to encrypt and decrypt column values. New values
+// are always encrypted with the active key; older keys are kept for decryption
+// until every row has been re-encrypted.
+type Keyring struct {
+	active string
+	aeads  map[string]cipher.AEAD
+}
+
+var (
+	mu      sync.RWMutex
+	keyring *Keyring
+)
+
+func init() {
+	schema.RegisterSerializer(SerializerName, Serializer{})
+}
+
+// NewKeyring creates a keyring from base64 encoded 32 byte AES keys by key ID
+func NewKeyring(active string, keys map[string]string) (*Keyring, error) {
+	if _, ok := keys[active]; !ok {
+		return nil, fmt.Errorf("active key %q is not configured", active)
+	}
+
+	k := &Keyring{
+		active: active,
+		aeads:  make(map[string]cipher.AEAD, len(keys)),
+	}
+
+	for id, encoded := range keys {
+		if id == "" || strings.Contains(id, ":") {
+			return nil, fmt.Errorf("invalid key id %q", id)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("key %s is not valid base64: %w", id, err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("key %s must be 32 bytes, got %d", id, len(key))
+		}
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", id, err)
+		}
+		k.aeads[id] = aead
+	}
+
+	return k, nil
+}
+
+// SetKeyring installs the keyring used by the serializer. A nil keyring
+// disables encryption; values are then stored in plaintext.
+func SetKeyring(k *Keyring) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	keyring = k
+}
+
+// Enabled reports whether a keyring is installed
+func Enabled() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	return keyring != nil
+}
+
+// IsEncrypted reports whether value is an encrypted value
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, prefix)
+}
+
+// KeyID returns the ID of the key value was encrypted with
+func KeyID(value string) string {
+	if !IsEncrypted(value) {
+		return ""
+	}
+
+	id, _, _ := strings.Cut(strings.TrimPrefix(value, prefix), ":")
+	return id
+}
+
+// NeedsRewrite reports whether value is plaintext or encrypted with a key
+// other than the active one
+func NeedsRewrite(value string) bool {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	if keyring == nil || value == "" {
+		return false
+	}
+
+	return KeyID(value) != keyring.active
+}
+
+// Encrypt encrypts value with the active key. Empty values and values that
+// are already encrypted with the active key are returned unchanged.
+func Encrypt(value string) (string, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	if keyring == nil || value == "" {
+		return value, nil
+	}
+
+	if IsEncrypted(value) {
+		if KeyID(value) == keyring.active {
+			return value, nil
+		}
+		plain, err := keyring.decrypt(value)
+		if err != nil {
+			return "", err
+		}
+		value = plain
+	}
+
+	aead := keyring.aeads[keyring.active]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(value), []byte(keyring.active))
+	return prefix + keyring.active + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt decrypts an encrypted value. Plaintext values are returned unchanged
+// so rows written before encryption was enabled remain readable.
+func Decrypt(value string) (string, error) {
+	if !IsEncrypted(value) {
+		return value, nil
+	}
+
+	mu.RLock()
+	defer mu.RUnlock()
+
+	if keyring == nil {
+		return "", fmt.Errorf("value is encrypted but no encryption key is configured")
+	}
+
+	return keyring.decrypt(value)
+}
+
+// decrypt decrypts an encrypted value with the key it names
+func (k *Keyring) decrypt(value string) (string, error) {
+	id, encoded, ok := strings.Cut(strings.TrimPrefix(value, prefix), ":")
+	if !ok {
+		return "", fmt.Errorf("malformed encrypted value")
+	}
+
+	aead, ok := k.aeads[id]
+	if !ok {
+		return "", fmt.Errorf("value is encrypted with unknown key %q", id)
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("malformed encrypted value")
+	}
+
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(id))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt value with key %q: %w", id, err)
+	}
+
+	return string(plain), nil
+}
+
+// IsJSONColumn reports whether the field is stored in a jsonb column, where
+// the encrypted value has to be wrapped in a JSON string
+func IsJSONColumn(field *schema.Field) bool {
+	return strings.EqualFold(field.TagSettings["TYPE"], "jsonb")
+}
+
+// Serializer is a GORM serializer that transparently encrypts string fields
+type Serializer struct{}
+
+// Scan implements schema.SerializerInterface
+func (Serializer) Scan(ctx context.Context, field *schema.Field, dst reflect.Value, dbValue interface{}) error {
+	var value string
+	switch v := dbValue.(type) {
+	case nil:
+	case []byte:
+		value = string(v)
+	case string:
+		value = v
+	default:
+		return fmt.Errorf("unsupported value type %T for encrypted field %s", dbValue, field.Name)
+	}
+
+	if IsJSONColumn(field) && strings.HasPrefix(value, `"`+prefix) {
+		if err := json.Unmarshal([]byte(value), &value); err != nil {
+			return fmt.Errorf("malformed encrypted value in %s: %w", field.Name, err)
+		}
+	}
+
+	plain, err := Decrypt(value)
+	if err != nil {
+		return fmt.Errorf("%s: %w", field.Name, err)
+	}
+
+	field.ReflectValueOf(ctx, dst).SetString(plain)
+	return nil
+}
+
+// Value implements schema.SerializerValuerInterface
+func (Serializer) Value(ctx context.Context, field *schema.Field, dst reflect.Value, fieldValue interface{}) (interface{}, error) {
+	value, ok := fieldValue.(string)
+	if !ok {
+		return nil, fmt.Errorf("encrypted field %s must be a string", field.Name)
+	}
+
+	encrypted, err := Encrypt(value)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", field.Name, err)
+	}
+
+	if encrypted != value && IsJSONColumn(field) {
+		wrapped, _ := json.Marshal(encrypted)
+		return string(wrapped), nil
+	}
+
+	return encrypted, nil
+}
@@ -0,0 +1,98 @@
+package forwarding
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+)
+
+// MaxDatagram is the largest datagram relayed over a stream
+const MaxDatagram = 65535
+
+// Datagrams are relayed over streams, e.g. tunnel channels, each prefixed
+// with its length as a 16 bit big endian integer
+
+// WriteDatagram writes a datagram to a stream
+func WriteDatagram(w io.Writer, datagram []byte) error {
+	if len(datagram) > MaxDatagram {
+		return errors.New("datagram too large")
+	}
+	frame := make([]byte, 2+len(datagram))
+	binary.BigEndian.PutUint16(frame, uint16(len(datagram)))
+	copy(frame[2:], datagram)
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadDatagram reads the next datagram from a stream into buf, which must
+// hold MaxDatagram bytes, and returns its length
+func ReadDatagram(r io.Reader, buf []byte) (int, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint16(header[:]))
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// datagramStream turns a connected datagram socket into a stream of
+// length-prefixed datagrams
+type datagramStream struct {
+	conn    net.Conn
+	readBuf []byte
+	pending []byte // Part of the last frame not read yet
+	written []byte // Start of a frame not completely written yet
+}
+
+// NewDatagramStream returns a stream of the datagrams received on conn.
+// Datagrams written to the stream are sent on conn.
+func NewDatagramStream(conn net.Conn) io.ReadWriteCloser {
+	return &datagramStream{conn: conn, readBuf: make([]byte, 2+MaxDatagram)}
+}
+
+// Read returns the next received datagram as a frame, across several reads
+// if p is too short for it
+func (s *datagramStream) Read(p []byte) (int, error) {
+	if len(s.pending) == 0 {
+		n, err := s.conn.Read(s.readBuf[2:])
+		if err != nil {
+			return 0, err
+		}
+		binary.BigEndian.PutUint16(s.readBuf, uint16(n))
+		s.pending = s.readBuf[:2+n]
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+// Write sends the complete frames in p, keeping an incomplete one for the
+// next write
+func (s *datagramStream) Write(p []byte) (int, error) {
+	data := p
+	if len(s.written) > 0 {
+		data = append(s.written, p...)
+	}
+
+	for len(data) >= 2 {
+		n := int(binary.BigEndian.Uint16(data))
+		if len(data) < 2+n {
+			break
+		}
+		if _, err := s.conn.Write(data[2 : 2+n]); err != nil {
+			return 0, err
+		}
+		data = data[2+n:]
+	}
+	s.written = append(s.written[:0:0], data...)
+	return len(p), nil
+}
+
+// Close closes the datagram socket
+func (s *datagramStream) Close() error {
+	return s.conn.Close()
+}
@@ -0,0 +1,103 @@
+// Package forwarding copies forwarded connections between a device tunnel
+// and a local socket, closing them when they go idle or run too long.
+package forwarding
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Reasons a piped connection ended
+const (
+	EndClosed      = "closed"       // Either side closed it
+	EndIdle        = "idle"         // No traffic in either direction for the idle timeout
+	EndMaxDuration = "max_duration" // Open for the maximum duration
+)
+
+// Limits bound a forwarded connection. Zero or negative values disable a
+// limit.
+type Limits struct {
+	IdleTimeout time.Duration // Close the connection after this long without traffic
+	MaxDuration time.Duration // Close the connection after this long regardless of traffic
+}
+
+// Acquire takes one of max slots counted by open, zero or negative max for
+// unlimited. It reports false when all slots are taken.
+func Acquire(open *atomic.Int64, max int) bool {
+	for {
+		current := open.Load()
+		if max > 0 && current >= int64(max) {
+			return false
+		}
+		if open.CompareAndSwap(current, current+1) {
+			return true
+		}
+	}
+}
+
+// Pipe copies between a and b until both directions are done, closing the
+// write side of each once its source ends. When a limit is reached both are
+// closed. It returns why the connection ended.
+func Pipe(a, b io.ReadWriteCloser, limits Limits) string {
+	var lastActive atomic.Int64
+	lastActive.Store(time.Now().UnixNano())
+
+	copied := make(chan struct{}, 2)
+	pipeHalf := func(dst, src io.ReadWriteCloser) {
+		io.Copy(dst, &activityReader{Reader: src, lastActive: &lastActive})
+		if closer, ok := dst.(interface{ CloseWrite() error }); ok {
+			closer.CloseWrite()
+		}
+		copied <- struct{}{}
+	}
+	go pipeHalf(a, b)
+	go pipeHalf(b, a)
+
+	var idleCheck <-chan time.Time
+	if limits.IdleTimeout > 0 {
+		ticker := time.NewTicker(max(limits.IdleTimeout/4, time.Second))
+		defer ticker.Stop()
+		idleCheck = ticker.C
+	}
+	var deadline <-chan time.Time
+	if limits.MaxDuration > 0 {
+		timer := time.NewTimer(limits.MaxDuration)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	ended := EndClosed
+	for done := 0; done < 2; {
+		select {
+		case <-copied:
+			done++
+		case <-idleCheck:
+			if time.Since(time.Unix(0, lastActive.Load())) >= limits.IdleTimeout {
+				ended, idleCheck, deadline = EndIdle, nil, nil
+				a.Close()
+				b.Close()
+			}
+		case <-deadline:
+			ended, idleCheck, deadline = EndMaxDuration, nil, nil
+			a.Close()
+			b.Close()
+		}
+	}
+	return ended
+}
+
+// activityReader records when data last came through a reader
+type activityReader struct {
+	io.Reader
+	lastActive *atomic.Int64
+}
+
+// Read implements io.Reader
+func (r *activityReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.lastActive.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
@@ -5,48 +5,52 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/edgetainer/edgetainer/internal/shared/credentials"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"gorm.io/gorm/logger"
 )
 
-// Initialize sets up the global logger settings
-func Initialize(logLevel string, logFile string) error {
+// Initialize sets up the global logger settings. When logFile is set, logs
+// are also written to it and the file is rotated as configured.
+func Initialize(logLevel string, logFile string, rotation Rotation) error {
 	// Parse log level
 	level, err := zerolog.ParseLevel(logLevel)
 	if err != nil {
 		level = zerolog.InfoLevel
 	}
 
-	zerolog.SetGlobalLevel(level)
+	levelsMu.Lock()
+	globalLevel = level
+	applyLevels()
+	levelsMu.Unlock()
 
-	// Format timestamps to be human-readable
+	// Format timestamps to be human-readable, in the timezone set with
+	// SetTimezone
 	zerolog.TimeFieldFormat = time.RFC3339
+	zerolog.TimestampFunc = now
 
-	// Default logger output to console
-	output := zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339}
+	// Default logger output to console, timestamps are printed as recorded
+	// since the console writer would convert them to the process timezone
+	output := zerolog.ConsoleWriter{
+		Out:             redactingWriter{os.Stdout},
+		FormatTimestamp: func(i interface{}) string { return fmt.Sprint(i) },
+	}
 
 	// If log file is specified, also write to file
 	if logFile != "" {
-		// Create directory if it doesn't exist
-		dir := filepath.Dir(logFile)
-		if dir != "." && dir != "/" {
-			if err := os.MkdirAll(dir, 0755); err != nil {
-				return fmt.Errorf("failed to create log directory: %w", err)
-			}
-		}
-
-		// Open file for writing/appending
-		file, err := os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		file, err := OpenRotatingFile(logFile, rotation)
 		if err != nil {
-			return fmt.Errorf("failed to open log file: %w", err)
+			return err
 		}
 
 		// Use MultiWriter to write to both file and console
-		multi := zerolog.MultiLevelWriter(output, file)
+		multi := zerolog.MultiLevelWriter(output, redactingWriter{file})
 		log.Logger = zerolog.New(multi).With().Timestamp().Logger()
 	} else {
 		// Console output only
@@ -55,21 +59,174 @@ func Initialize(logLevel string, logFile string) error {
 
 	// Initialize the global logger
 	globalLogger = &Logger{
-		logger: log.Logger.With().Str("component", "global").Logger(),
+		logger:    log.Logger.With().Str("component", "global").Logger(),
+		component: "global",
+	}
+
+	return nil
+}
+
+// redactingWriter replaces credentials in log lines before they are written,
+// e.g. a connection string with a password in an error
+type redactingWriter struct {
+	out io.Writer
+}
+
+// Write writes p with its credentials redacted. The length of p is returned
+// so that callers do not take the change in length for a short write.
+func (w redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.out, credentials.Redact(string(p))); err != nil {
+		return 0, err
 	}
+	return len(p), nil
+}
+
+// location is the timezone of log timestamps, nil for the process timezone
+var location atomic.Pointer[time.Location]
 
+// SetTimezone makes log timestamps use the given IANA timezone, e.g. the one
+// configured on a device
+func SetTimezone(timezone string) error {
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return err
+	}
+	location.Store(loc)
 	return nil
 }
 
+// now returns the current time in the timezone of log timestamps
+func now() time.Time {
+	if loc := location.Load(); loc != nil {
+		return time.Now().In(loc)
+	}
+	return time.Now()
+}
+
+// Log levels. Each logger is filtered by the level of its component when one
+// is set, and by the global level otherwise.
+var (
+	levelsMu        sync.RWMutex
+	globalLevel     = zerolog.InfoLevel
+	componentLevels = make(map[string]zerolog.Level)
+	components      = make(map[string]bool)
+)
+
+// SetLevel changes the global log level at runtime
+func SetLevel(logLevel string) error {
+	level, err := zerolog.ParseLevel(logLevel)
+	if err != nil {
+		return fmt.Errorf("invalid log level %q: %w", logLevel, err)
+	}
+
+	levelsMu.Lock()
+	defer levelsMu.Unlock()
+	globalLevel = level
+	applyLevels()
+	return nil
+}
+
+// GetLevel returns the global log level
+func GetLevel() string {
+	levelsMu.RLock()
+	defer levelsMu.RUnlock()
+	return globalLevel.String()
+}
+
+// SetComponentLevel changes the log level of a component at runtime. An empty
+// level makes the component follow the global level again.
+func SetComponentLevel(component, logLevel string) error {
+	levelsMu.Lock()
+	defer levelsMu.Unlock()
+
+	if logLevel == "" {
+		delete(componentLevels, component)
+		applyLevels()
+		return nil
+	}
+
+	level, err := zerolog.ParseLevel(logLevel)
+	if err != nil {
+		return fmt.Errorf("invalid log level %q: %w", logLevel, err)
+	}
+
+	componentLevels[component] = level
+	applyLevels()
+	return nil
+}
+
+// ComponentLevels returns the components that have their own log level
+func ComponentLevels() map[string]string {
+	levelsMu.RLock()
+	defer levelsMu.RUnlock()
+
+	levels := make(map[string]string, len(componentLevels))
+	for component, level := range componentLevels {
+		levels[component] = level.String()
+	}
+	return levels
+}
+
+// ResetComponentLevels makes every component follow the global level
+func ResetComponentLevels() {
+	levelsMu.Lock()
+	defer levelsMu.Unlock()
+	componentLevels = make(map[string]zerolog.Level)
+	applyLevels()
+}
+
+// Components returns the names of the components that created a logger
+func Components() []string {
+	levelsMu.RLock()
+	defer levelsMu.RUnlock()
+
+	names := make([]string, 0, len(components))
+	for name := range components {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// applyLevels lowers the zerolog global level to the most verbose level in
+// use, so that the per-component filtering sees every event it may need.
+// The caller must hold levelsMu.
+func applyLevels() {
+	lowest := globalLevel
+	for _, level := range componentLevels {
+		if level < lowest {
+			lowest = level
+		}
+	}
+	zerolog.SetGlobalLevel(lowest)
+}
+
+// enabled reports whether a component logs events of the given level
+func enabled(component string, level zerolog.Level) bool {
+	levelsMu.RLock()
+	defer levelsMu.RUnlock()
+
+	if componentLevel, ok := componentLevels[component]; ok {
+		return level >= componentLevel
+	}
+	return level >= globalLevel
+}
+
 // Logger is a simple wrapper around zerolog.Logger
 type Logger struct {
-	logger zerolog.Logger
+	logger    zerolog.Logger
+	component string
 }
 
 // NewLogger creates a new logger with a given context name
 func NewLogger(component string) *Logger {
+	levelsMu.Lock()
+	components[component] = true
+	levelsMu.Unlock()
+
 	return &Logger{
-		logger: log.Logger.With().Str("component", component).Logger(),
+		logger:    log.Logger.With().Str("component", component).Logger(),
+		component: component,
 	}
 }
 
@@ -80,6 +237,10 @@ func (l *Logger) SetOutput(w io.Writer) {
 
 // Debug logs a debug message
 func (l *Logger) Debug(msg string, args ...interface{}) {
+	if !enabled(l.component, zerolog.DebugLevel) {
+		return
+	}
+
 	if len(args) > 0 {
 		l.logger.Debug().Msgf(msg, args...)
 	} else {
@@ -89,6 +250,10 @@ func (l *Logger) Debug(msg string, args ...interface{}) {
 
 // Info logs an info message
 func (l *Logger) Info(msg string, args ...interface{}) {
+	if !enabled(l.component, zerolog.InfoLevel) {
+		return
+	}
+
 	if len(args) > 0 {
 		l.logger.Info().Msgf(msg, args...)
 	} else {
@@ -98,6 +263,10 @@ func (l *Logger) Info(msg string, args ...interface{}) {
 
 // Warn logs a warning message
 func (l *Logger) Warn(msg string, args ...interface{}) {
+	if !enabled(l.component, zerolog.WarnLevel) {
+		return
+	}
+
 	if len(args) > 0 {
 		l.logger.Warn().Msgf(msg, args...)
 	} else {
@@ -107,6 +276,10 @@ func (l *Logger) Warn(msg string, args ...interface{}) {
 
 // Error logs an error message
 func (l *Logger) Error(msg string, err error, args ...interface{}) {
+	if !enabled(l.component, zerolog.ErrorLevel) {
+		return
+	}
+
 	event := l.logger.Error()
 	if err != nil {
 		event = event.Err(err)
@@ -136,7 +309,8 @@ func (l *Logger) Fatal(msg string, err error, args ...interface{}) {
 // WithField adds a field to the logger context
 func (l *Logger) WithField(key string, value interface{}) *Logger {
 	return &Logger{
-		logger: l.logger.With().Interface(key, value).Logger(),
+		logger:    l.logger.With().Interface(key, value).Logger(),
+		component: l.component,
 	}
 }
 
@@ -147,7 +321,8 @@ func (l *Logger) WithFields(fields map[string]interface{}) *Logger {
 		contextLogger = contextLogger.Interface(k, v)
 	}
 	return &Logger{
-		logger: contextLogger.Logger(),
+		logger:    contextLogger.Logger(),
+		component: l.component,
 	}
 }
 
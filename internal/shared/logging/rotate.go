@@ -0,0 +1,258 @@
+package logging
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat is the timestamp added to the name of rotated files
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// Rotation configures rotation and retention of a log file. Zero values
+// disable the corresponding limit.
+type Rotation struct {
+	MaxSizeMB  int  // Rotate once the file reaches this size
+	MaxAgeDays int  // Remove rotated files older than this
+	MaxBackups int  // Keep at most this many rotated files
+	Compress   bool // Gzip rotated files
+
+	// BeforeRemove is called with the path of a rotated file before it is
+	// removed, e.g. to ship it elsewhere. The file is kept if it fails.
+	BeforeRemove func(path string) error
+}
+
+// RotatingFile is a log file that is rotated once it grows too large. Rotated
+// files are named after the file with a timestamp, e.g. agent-<time>.log.
+type RotatingFile struct {
+	path     string
+	rotation Rotation
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+
+	cleanupMu sync.Mutex
+}
+
+// OpenRotatingFile opens a log file for appending, creating its directory
+func OpenRotatingFile(path string, rotation Rotation) (*RotatingFile, error) {
+	dir := filepath.Dir(path)
+	if dir != "." && dir != "/" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create log directory: %w", err)
+		}
+	}
+
+	f := &RotatingFile{path: path, rotation: rotation}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+
+	// Apply retention to files left over from previous runs
+	go f.cleanup()
+
+	return f, nil
+}
+
+// Write implements io.Writer, rotating the file first when the write would
+// exceed the maximum size
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	limit := int64(f.rotation.MaxSizeMB) * 1024 * 1024
+	if limit > 0 && f.size > 0 && f.size+int64(len(p)) > limit {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Rotate closes the current file, renames it and starts a new one
+func (f *RotatingFile) Rotate() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rotate()
+}
+
+// Close closes the log file
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// Backups returns the rotated files, newest first
+func (f *RotatingFile) Backups() ([]string, error) {
+	dir := filepath.Dir(f.path)
+	prefix, ext := f.nameParts()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if _, ok := f.backupTime(entry.Name(), prefix, ext); ok {
+			backups = append(backups, filepath.Join(dir, entry.Name()))
+		}
+	}
+
+	// Timestamps sort lexically
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+	return backups, nil
+}
+
+// open opens the log file for appending. The caller must hold mu.
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat log file: %w", err)
+	}
+
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// rotate renames the current file and opens a new one. The caller must hold mu.
+func (f *RotatingFile) rotate() error {
+	if f.file != nil {
+		if err := f.file.Close(); err != nil {
+			return fmt.Errorf("failed to close log file: %w", err)
+		}
+		f.file = nil
+	}
+
+	prefix, ext := f.nameParts()
+	backup := filepath.Join(filepath.Dir(f.path), prefix+time.Now().UTC().Format(backupTimeFormat)+ext)
+	if err := os.Rename(f.path, backup); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to rotate log file: %w", err)
+	}
+
+	if err := f.open(); err != nil {
+		return err
+	}
+
+	go f.cleanup()
+	return nil
+}
+
+// cleanup compresses rotated files and removes those beyond the retention
+// limits. Errors are ignored, the next rotation tries again.
+func (f *RotatingFile) cleanup() {
+	f.cleanupMu.Lock()
+	defer f.cleanupMu.Unlock()
+
+	backups, err := f.Backups()
+	if err != nil {
+		return
+	}
+
+	prefix, ext := f.nameParts()
+	cutoff := time.Now().AddDate(0, 0, -f.rotation.MaxAgeDays)
+
+	for i, backup := range backups {
+		rotatedAt, _ := f.backupTime(filepath.Base(backup), prefix, ext)
+
+		expired := f.rotation.MaxBackups > 0 && i >= f.rotation.MaxBackups
+		if f.rotation.MaxAgeDays > 0 && rotatedAt.Before(cutoff) {
+			expired = true
+		}
+
+		if expired {
+			if f.rotation.BeforeRemove != nil {
+				if err := f.rotation.BeforeRemove(backup); err != nil {
+					continue
+				}
+			}
+			os.Remove(backup)
+			continue
+		}
+
+		if f.rotation.Compress && !strings.HasSuffix(backup, ".gz") {
+			if err := compressFile(backup); err == nil {
+				os.Remove(backup)
+			}
+		}
+	}
+}
+
+// nameParts splits the file name into the prefix and extension of its backups
+func (f *RotatingFile) nameParts() (string, string) {
+	name := filepath.Base(f.path)
+	ext := filepath.Ext(name)
+	return strings.TrimSuffix(name, ext) + "-", ext
+}
+
+// backupTime parses the rotation time from the name of a rotated file
+func (f *RotatingFile) backupTime(name, prefix, ext string) (time.Time, bool) {
+	name = strings.TrimSuffix(name, ".gz")
+	if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) {
+		return time.Time{}, false
+	}
+
+	stamp := strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext)
+	t, err := time.Parse(backupTimeFormat, stamp)
+	return t, err == nil
+}
+
+// compressFile writes a gzipped copy of path to path.gz
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(dst)
+	if _, err := io.Copy(gz, src); err != nil {
+		gz.Close()
+		dst.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		dst.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+
+	return dst.Close()
+}
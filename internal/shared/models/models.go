@@ -1,8 +1,12 @@
 package models
 
 import (
+	"encoding/json"
 	"time"
 
+	// Registers the serializer used by encrypted columns
+	_ "github.com/edgetainer/edgetainer/internal/shared/fieldcrypt"
+	"github.com/edgetainer/edgetainer/internal/shared/protocol"
 	"github.com/google/uuid"
 	"gorm.io/gorm"
 )
@@ -20,73 +24,406 @@ type User struct {
 	DeletedAt gorm.DeletedAt `json:"-" gorm:"index"`
 }
 
+// UserPreferences are the web UI settings of a user, kept on the server so
+// they follow the user across browsers
+type UserPreferences struct {
+	UserID         uuid.UUID           `json:"-" gorm:"type:uuid;primaryKey"`
+	DefaultFleetID *uuid.UUID          `json:"default_fleet_id" gorm:"type:uuid"` // Fleet the UI opens with
+	Theme          string              `json:"theme"`                             // light, dark or empty to follow the system
+	Columns        map[string][]string `json:"columns" gorm:"serializer:json"`    // Visible columns by table, in order
+	Widgets        []DashboardWidget   `json:"widgets" gorm:"serializer:json"`    // Dashboard widgets, in order
+	UpdatedAt      time.Time           `json:"updated_at"`
+}
+
+// DashboardWidget is a chart of the dashboard of a user, drawn from a device
+// aggregation
+type DashboardWidget struct {
+	Title string            `json:"title"`
+	Chart string            `json:"chart"` // number, bar, pie or table
+	Query map[string]string `json:"query"` // Query parameters of /api/devices/aggregate
+}
+
+// SavedView is a named set of filters for a list of the web UI, e.g. the
+// devices of one site that are offline
+type SavedView struct {
+	ID        uuid.UUID         `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	UserID    uuid.UUID         `json:"-" gorm:"type:uuid;not null;uniqueIndex:idx_saved_views_name"`
+	Page      string            `json:"page" gorm:"not null;uniqueIndex:idx_saved_views_name"` // List the view is for, e.g. devices
+	Name      string            `json:"name" gorm:"not null;uniqueIndex:idx_saved_views_name"`
+	Filters   map[string]string `json:"filters" gorm:"serializer:json"`           // Query parameters of the list
+	Columns   []string          `json:"columns,omitempty" gorm:"serializer:json"` // Replaces the table's column layout if set
+	CreatedAt time.Time         `json:"created_at"`
+	UpdatedAt time.Time         `json:"updated_at"`
+}
+
 // Fleet represents a group of devices
 type Fleet struct {
-	ID          uuid.UUID      `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
-	Name        string         `json:"name" gorm:"not null"`
-	Description string         `json:"description"`
-	Devices     []Device       `json:"devices,omitempty" gorm:"foreignKey:FleetID"`
-	CreatedAt   time.Time      `json:"created_at"`
-	UpdatedAt   time.Time      `json:"updated_at"`
-	DeletedAt   gorm.DeletedAt `json:"-" gorm:"index"`
+	ID              uuid.UUID      `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	Name            string         `json:"name" gorm:"not null"`
+	Description     string         `json:"description"`
+	TunnelRate      int            `json:"tunnel_rate_kbps"`                       // kbit/s per device and direction, 0 for the server default, -1 for none
+	PullRate        int            `json:"pull_rate_kbps"`                         // kbit/s per device, 0 for the agent default, -1 for none
+	MaxDeploys      int            `json:"max_concurrent_deploys"`                 // Devices deploying at once during a rollout, 0 for the server default
+	NTPServers      []string       `json:"ntp_servers" gorm:"serializer:json"`     // Set on devices when they connect, empty leaves them alone
+	Timezone        string         `json:"timezone"`                               // Default IANA timezone of the fleet's devices, empty leaves them alone
+	Locale          string         `json:"locale"`                                 // Default locale of the fleet's devices, e.g. en_US.UTF-8
+	Forwards        ForwardPolicy  `json:"forward_policy" gorm:"serializer:json"`  // Devices override it in their tunnel policy
+	PluginSettings  PluginConfig   `json:"-" gorm:"serializer:json"`               // Of the fleet's devices, read and changed through /plugin-settings only
+	RequireApproval bool           `json:"require_approval"`                       // Deploys wait for a second user, changed by admins through /approval
+	Freeze          *FleetFreeze   `json:"freeze" gorm:"serializer:json"`          // Blocks deploys and changes, set by admins through /freeze
+	RequiredUSB     []USBMatch     `json:"required_usb" gorm:"serializer:json"`    // USB devices alerted on when they disappear, changed through /required-usb
+	Resources       ResourcePolicy `json:"resource_limits" gorm:"serializer:json"` // Caps the applications of the fleet's devices, changed through /resource-limits
+	DeviceIDPrefix  string         `json:"device_id_prefix"`                       // Starts the IDs of devices provisioned into the fleet, device if empty
+	Devices         []Device       `json:"devices,omitempty" gorm:"foreignKey:FleetID"`
+	CreatedAt       time.Time      `json:"created_at"`
+	UpdatedAt       time.Time      `json:"updated_at"`
+	DeletedAt       gorm.DeletedAt `json:"-" gorm:"index"`
+}
+
+// Site groups the devices at one location. One device per site may run a
+// pull-through registry cache that the other devices pull images from.
+type Site struct {
+	ID             uuid.UUID      `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	Name           string         `json:"name" gorm:"uniqueIndex;not null"`
+	Description    string         `json:"description"`
+	CacheDeviceID  *uuid.UUID     `json:"cache_device_id" gorm:"type:uuid"`
+	CacheHost      string         `json:"cache_host"`                                     // Address the site's devices reach the cache device on
+	CachePort      int            `json:"cache_port"`                                     // Port of the first upstream, the others use the following ports
+	CacheUpstreams []string       `json:"cache_upstreams" gorm:"serializer:json"`         // Registries mirrored by the cache, e.g. docker.io
+	CacheStatus    string         `json:"cache_status" gorm:"not null;default:'unknown'"` // See the CacheStatus constants
+	CacheError     string         `json:"cache_error,omitempty"`
+	CacheCheckedAt *time.Time     `json:"cache_checked_at,omitempty"`
+	CreatedAt      time.Time      `json:"created_at"`
+	UpdatedAt      time.Time      `json:"updated_at"`
+	DeletedAt      gorm.DeletedAt `json:"-" gorm:"index"`
 }
 
 // Device represents an edge device
 type Device struct {
-	ID               uuid.UUID      `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
-	DeviceID         string         `json:"device_id" gorm:"uniqueIndex;not null"` // Unique identifier
-	Name             string         `json:"name" gorm:"not null"`
-	FleetID          *uuid.UUID     `json:"fleet_id" gorm:"type:uuid;index"`
-	Status           string         `json:"status" gorm:"not null"`
-	LastSeen         time.Time      `json:"last_seen"`
-	IPAddress        string         `json:"ip_address"`
-	OSVersion        string         `json:"os_version"`
-	HardwareInfo     string         `json:"hardware_info" gorm:"type:jsonb"`
-	SSHPort          int            `json:"ssh_port"`
-	SSHPublicKey     string         `json:"ssh_public_key"` // Store the device's public key directly in the database
-	Subdomain        string         `json:"subdomain"`
-	SubdomainEnabled bool           `json:"subdomain_enabled" gorm:"default:false"`
-	CreatedAt        time.Time      `json:"created_at"`
-	UpdatedAt        time.Time      `json:"updated_at"`
-	DeletedAt        gorm.DeletedAt `json:"-" gorm:"index"`
+	ID                uuid.UUID              `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	DeviceID          string                 `json:"device_id" gorm:"uniqueIndex;not null"` // Unique identifier
+	Name              string                 `json:"name" gorm:"not null"`
+	FleetID           *uuid.UUID             `json:"fleet_id" gorm:"type:uuid;index"`
+	SiteID            *uuid.UUID             `json:"site_id" gorm:"type:uuid;index"`
+	Status            string                 `json:"status" gorm:"not null"`
+	LastSeen          time.Time              `json:"last_seen"`
+	IPAddress         string                 `json:"ip_address"`
+	IPAddresses       []string               `json:"ip_addresses,omitempty" gorm:"serializer:json"` // IPv4 and IPv6 addresses, reported in heartbeats
+	OSVersion         string                 `json:"os_version"`
+	OS                *protocol.OSInfo       `json:"os,omitempty" gorm:"serializer:json"` // Operating system and kernel, reported in heartbeats
+	AgentVersion      string                 `json:"agent_version"`                       // Reported in heartbeats
+	AgentCommit       string                 `json:"agent_commit,omitempty"`
+	AgentBuildDate    string                 `json:"agent_build_date,omitempty"`
+	AgentFeatures     []string               `json:"agent_features" gorm:"serializer:json"` // Protocol features the agent supports, see protocol.AgentFeatures
+	Platforms         []string               `json:"platforms" gorm:"serializer:json"`      // Platforms the device runs images of, its own first, reported in heartbeats
+	AgentStatus       string                 `json:"agent_status,omitempty" gorm:"-"`       // Filled in from the minimum supported version, not stored
+	HardwareInfo      string                 `json:"hardware_info" gorm:"type:jsonb"`
+	SSHPort           int                    `json:"ssh_port"`
+	SSHPublicKey      string                 `json:"ssh_public_key" gorm:"serializer:encrypted"` // Store the device's public key directly in the database
+	Subdomain         string                 `json:"subdomain"`
+	SubdomainEnabled  bool                   `json:"subdomain_enabled" gorm:"default:false"`
+	TunnelRate        int                    `json:"tunnel_rate_kbps"` // Overrides the fleet limit, -1 for unlimited
+	TunnelPolicy      TunnelPolicy           `json:"tunnel_policy" gorm:"serializer:json"`
+	PullRate          int                    `json:"pull_rate_kbps"`             // Overrides the fleet limit, -1 for unlimited
+	Tunnel            *TunnelStats           `json:"tunnel,omitempty" gorm:"-"`  // Filled in from the SSH server, not stored
+	ClockSkew         float64                `json:"clock_skew_seconds"`         // Device clock minus server clock at the last heartbeat
+	ClockCheckedAt    *time.Time             `json:"clock_checked_at,omitempty"` // Nil until the agent reports its clock
+	Timezone          string                 `json:"timezone"`                   // Overrides the fleet timezone
+	Locale            string                 `json:"locale"`                     // Overrides the fleet locale
+	Latitude          *float64               `json:"latitude" gorm:"index:idx_devices_location"`
+	Longitude         *float64               `json:"longitude" gorm:"index:idx_devices_location"`
+	Address           string                 `json:"address"`
+	LocationSource    string                 `json:"location_source"`                                           // manual, gps or geoip, empty without a location
+	LocationAccuracy  float64                `json:"location_accuracy,omitempty"`                               // Horizontal error in meters, 0 if unknown
+	LocationUpdatedAt *time.Time             `json:"location_updated_at,omitempty"`                             // When the location was set or fixed
+	CustomFields      map[string]string      `json:"custom_fields,omitempty" gorm:"type:jsonb;serializer:json"` // Values of the custom fields by name
+	Replaces          *uuid.UUID             `json:"replaces,omitempty" gorm:"type:uuid;index"`                 // The device this one took over from
+	ReplacedBy        *uuid.UUID             `json:"replaced_by,omitempty" gorm:"type:uuid;index"`              // Set when the device was replaced
+	ReplacedAt        *time.Time             `json:"replaced_at,omitempty"`
+	HardwareID        string                 `json:"hardware_id,omitempty"`                           // Hardware attestation the device is bound to, empty until it reports one
+	HardwareBoundAt   *time.Time             `json:"hardware_bound_at,omitempty"`                     // When the device was bound to its hardware
+	PluginSettings    PluginConfig           `json:"-" gorm:"serializer:json"`                        // Override those of the fleet by plugin, read and changed through /plugin-settings only
+	Plugins           []protocol.PluginInfo  `json:"plugins,omitempty" gorm:"serializer:json"`        // Installed plugins, reported in heartbeats
+	PluginMetrics     PluginValues           `json:"plugin_metrics,omitempty" gorm:"serializer:json"` // Last metrics reported by plugins
+	RequiredUSB       []USBMatch             `json:"required_usb" gorm:"serializer:json"`             // Added to those of the fleet, changed through /required-usb
+	HostHealth        *protocol.HostHealth   `json:"host_health,omitempty" gorm:"serializer:json"`    // Temperatures, disk and power health, reported in heartbeats
+	HostServices      []protocol.HostService `json:"host_services,omitempty" gorm:"serializer:json"`  // Monitored host services, reported in heartbeats
+	Resources         ResourcePolicy         `json:"resource_limits" gorm:"serializer:json"`          // Overrides those of the fleet limit by limit, changed through /resource-limits
+	CreatedAt         time.Time              `json:"created_at"`
+	UpdatedAt         time.Time              `json:"updated_at"`
+	DeletedAt         gorm.DeletedAt         `json:"-" gorm:"index"`
+}
+
+// ResourcePolicy caps the resources of the applications on a device, for all
+// of them and by software
+type ResourcePolicy struct {
+	Default protocol.ResourceLimits            `json:"default"`
+	Apps    map[string]protocol.ResourceLimits `json:"apps,omitempty"` // By software name, over Default
+}
+
+// For returns the limits of the application of a software
+func (p ResourcePolicy) For(software string) protocol.ResourceLimits {
+	return p.Default.Over(p.Apps[software])
+}
+
+// PluginConfig holds the settings of agent plugins by plugin name, JSON
+// objects handed to the plugins as they are. They may hold credentials, so
+// only admins see them.
+type PluginConfig map[string]json.RawMessage
+
+// PluginValues holds the metrics reported by agent plugins, by plugin and
+// metric name
+type PluginValues map[string]map[string]float64
+
+// TunnelPolicy limits what the server may reach on a device through its
+// tunnel besides TCP ports on the device's loopback interface
+type TunnelPolicy struct {
+	UnixSockets  []string      `json:"unix_sockets,omitempty"`  // Paths of the unix sockets that may be forwarded
+	Dynamic      bool          `json:"dynamic,omitempty"`       // Allow dynamic forwards, which reach any port of the device
+	DynamicHosts []string      `json:"dynamic_hosts,omitempty"` // Further hosts dynamic forwards may reach, * for any
+	DockerAPI    string        `json:"docker_api,omitempty"`    // Access to the Docker API proxy, read-only if empty
+	DockerSocket string        `json:"docker_socket,omitempty"` // Docker socket on the device, /var/run/docker.sock if empty
+	Forwards     ForwardPolicy `json:"forwards"`                // Overrides the fleet's forward policy field by field
+}
+
+// Purposes a forward is opened for
+const (
+	ForwardPurposeTerminal = "terminal" // A shell on the device
+	ForwardPurposeService  = "service"  // A service of an application exposed to operators
+	ForwardPurposeManual   = "manual"   // Opened through the API without a purpose
+	ForwardPurposeDevice   = "device"   // Requested by the agent over its tunnel
+)
+
+// IsForwardPurpose reports whether purpose is one of the forward purposes
+func IsForwardPurpose(purpose string) bool {
+	switch purpose {
+	case ForwardPurposeTerminal, ForwardPurposeService, ForwardPurposeManual, ForwardPurposeDevice:
+		return true
+	}
+	return false
+}
+
+// FleetFreeze blocks deployments to a fleet and changes to its configuration,
+// except for emergency overrides by admins
+type FleetFreeze struct {
+	Reason string     `json:"reason"`
+	By     string     `json:"by"` // Username of the admin who froze the fleet
+	Since  time.Time  `json:"since"`
+	Until  *time.Time `json:"until,omitempty"` // Nil until it is lifted
+}
+
+// Active reports whether the freeze is in effect at the given time
+func (f *FleetFreeze) Active(now time.Time) bool {
+	return f != nil && (f.Until == nil || now.Before(*f.Until))
+}
+
+// ForwardPolicy limits the forwards of a device. Zero values fall back to the
+// fleet's policy and then to the server defaults.
+type ForwardPolicy struct {
+	MaxForwards    int      `json:"max_forwards,omitempty"`    // Forwards open at once, -1 for unlimited
+	Purposes       []string `json:"purposes,omitempty"`        // Purposes forwards may be opened for, empty for any
+	Ports          []int    `json:"ports,omitempty"`           // Device ports TCP forwards may reach, empty for any
+	DeviceRequests *bool    `json:"device_requests,omitempty"` // Let the agent request forwards itself, denied unless set
+	IdleTimeout    int      `json:"idle_timeout,omitempty"`    // Seconds an on-demand forward stays open without connections, -1 to keep it
+}
+
+// TunnelStats describes the traffic of a device tunnel since the server started
+type TunnelStats struct {
+	BytesIn        uint64     `json:"bytes_in"`  // Device to server
+	BytesOut       uint64     `json:"bytes_out"` // Server to device
+	ActiveForwards int        `json:"active_forwards"`
+	ForwardedPorts int        `json:"forwarded_ports"`
+	ConnectedSince *time.Time `json:"connected_since,omitempty"`
 }
 
 // Software represents a deployable software package
 type Software struct {
-	ID                uuid.UUID      `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
-	Name              string         `json:"name" gorm:"not null"`
-	Source            string         `json:"source" gorm:"not null"` // GitHub, Manual
-	RepoURL           string         `json:"repo_url"`
-	CurrentVersion    string         `json:"current_version"`
-	Versions          string         `json:"versions" gorm:"type:jsonb"` // JSON array of version info
-	DockerComposeYAML string         `json:"docker_compose_yaml"`
-	DefaultEnvVars    string         `json:"default_env_vars" gorm:"type:jsonb"`
-	CreatedAt         time.Time      `json:"created_at"`
-	UpdatedAt         time.Time      `json:"updated_at"`
-	DeletedAt         gorm.DeletedAt `json:"-" gorm:"index"`
+	ID                uuid.UUID                 `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	Name              string                    `json:"name" gorm:"not null"`
+	Source            string                    `json:"source" gorm:"not null"` // GitHub, Manual
+	RepoURL           string                    `json:"repo_url"`
+	CurrentVersion    string                    `json:"current_version"`
+	Versions          string                    `json:"versions" gorm:"type:jsonb"` // JSON array of version info
+	DockerComposeYAML string                    `json:"docker_compose_yaml" gorm:"serializer:encrypted"`
+	DefaultEnvVars    string                    `json:"default_env_vars" gorm:"type:jsonb;serializer:encrypted"`
+	Strategy          string                    `json:"strategy" gorm:"not null;default:'recreate'"` // recreate or blue-green
+	BlueGreen         protocol.BlueGreenOptions `json:"blue_green" gorm:"serializer:json"`
+	Platforms         []string                  `json:"platforms" gorm:"serializer:json"` // Platforms the images are built for, empty if not declared
+	CreatedAt         time.Time                 `json:"created_at"`
+	UpdatedAt         time.Time                 `json:"updated_at"`
+	DeletedAt         gorm.DeletedAt            `json:"-" gorm:"index"`
 }
 
 // Deployment represents a software deployment to a fleet or device
 type Deployment struct {
+	ID           uuid.UUID      `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	SoftwareID   uuid.UUID      `json:"software_id" gorm:"type:uuid;index"`
+	FleetID      uuid.UUID      `json:"fleet_id,omitempty" gorm:"type:uuid;index"`
+	DeviceID     uuid.UUID      `json:"device_id,omitempty" gorm:"type:uuid;index"`
+	RolloutID    *uuid.UUID     `json:"rollout_id,omitempty" gorm:"type:uuid;index"`
+	Version      string         `json:"version" gorm:"not null"`
+	Pinned       bool           `json:"pinned" gorm:"not null;default:false"`
+	FleetDefault bool           `json:"fleet_default" gorm:"not null;default:false"` // Queued from the fleet's default software when the device joined
+	Replacement  bool           `json:"replacement" gorm:"not null;default:false"`   // Queued to carry over the software of a replaced device
+	Imported     bool           `json:"imported" gorm:"not null;default:false"`      // Queued for software the device ran on the platform it was imported from
+	Status       string         `json:"status" gorm:"not null"`
+	EnvVars      string         `json:"env_vars" gorm:"type:jsonb;serializer:encrypted"`
+	Stage        string         `json:"stage,omitempty"`         // Last stage reported by the agent, see protocol.DeployStage
+	Progress     int            `json:"progress"`                // Percent, estimated from the stage
+	ImagesPulled int            `json:"images_pulled,omitempty"` // While pulling
+	ImagesTotal  int            `json:"images_total,omitempty"`
+	StageAt      *time.Time     `json:"stage_at,omitempty"`     // When the stage was reported
+	Attempts     int            `json:"attempts,omitempty"`     // Made by its rollout so far
+	Error        string         `json:"error,omitempty"`        // Why the last attempt failed or the device was skipped
+	ComposeHash  string         `json:"compose_hash,omitempty"` // Of the compose file and overrides sent, see protocol.ComposeHash
+	EnvHash      string         `json:"env_hash,omitempty"`     // Of the resolved env vars sent, see protocol.EnvHash
+	FinishedAt   *time.Time     `json:"finished_at,omitempty"`  // When it succeeded or failed
+	CreatedAt    time.Time      `json:"created_at"`
+	UpdatedAt    time.Time      `json:"updated_at"`
+	DeletedAt    gorm.DeletedAt `json:"-" gorm:"index"`
+
+	Pull *protocol.PullProgress `json:"pull,omitempty" gorm:"-"` // Filled in from the SSH server while pending, not stored
+}
+
+// Rollout deploys a software version to every device of a fleet, a limited
+// number of devices at a time. Progress is tracked by its deployments.
+type Rollout struct {
+	ID            uuid.UUID      `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	FleetID       uuid.UUID      `json:"fleet_id" gorm:"type:uuid;index"`
+	SoftwareID    uuid.UUID      `json:"software_id" gorm:"type:uuid;index"`
+	Version       string         `json:"version" gorm:"not null"`
+	MaxConcurrent int            `json:"max_concurrent"`                         // 0 for unlimited
+	MaxAttempts   int            `json:"max_attempts" gorm:"not null;default:1"` // Per device, 1 for no retries
+	RetryBackoff  int            `json:"retry_backoff"`                          // Seconds before the first retry, doubled for each further one
+	Status        string         `json:"status" gorm:"not null"`
+	Override      bool           `json:"override,omitempty"` // Started by an admin overriding a freeze of the fleet, deploys while it lasts
+	FinishedAt    *time.Time     `json:"finished_at,omitempty"`
+	CreatedAt     time.Time      `json:"created_at"`
+	UpdatedAt     time.Time      `json:"updated_at"`
+	DeletedAt     gorm.DeletedAt `json:"-" gorm:"index"`
+}
+
+// DeploymentApproval is a deploy to a device or a rollout to a fleet that
+// waits for a user other than the one who asked for it
+type DeploymentApproval struct {
+	ID            uuid.UUID  `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	FleetID       uuid.UUID  `json:"fleet_id" gorm:"type:uuid;index"`
+	DeviceID      *uuid.UUID `json:"device_id,omitempty" gorm:"type:uuid"` // Nil for a rollout to the whole fleet
+	SoftwareID    uuid.UUID  `json:"software_id" gorm:"type:uuid"`
+	Version       string     `json:"version" gorm:"not null"`
+	MaxConcurrent int        `json:"max_concurrent,omitempty"` // Of a rollout, as requested
+	MaxAttempts   int        `json:"max_attempts,omitempty"`
+	RetryBackoff  int        `json:"retry_backoff,omitempty"`
+	Status        string     `json:"status" gorm:"not null;index"` // See the ApprovalStatus constants
+	RequestedBy   string     `json:"requested_by" gorm:"not null"` // Username
+	DecidedBy     string     `json:"decided_by,omitempty"`         // Username of the user who approved or rejected it
+	DecidedAt     *time.Time `json:"decided_at,omitempty"`
+	Reason        string     `json:"reason,omitempty"` // Given with a rejection
+	Error         string     `json:"error,omitempty"`  // Why the last approval could not start the deploy
+	DeploymentID  *uuid.UUID `json:"deployment_id,omitempty" gorm:"type:uuid"`
+	RolloutID     *uuid.UUID `json:"rollout_id,omitempty" gorm:"type:uuid"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+// FleetDefaultSoftware is software deployed to every device that joins a
+// fleet, in the order of Position
+type FleetDefaultSoftware struct {
+	ID              uuid.UUID                `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	FleetID         uuid.UUID                `json:"fleet_id" gorm:"type:uuid;index"`
+	SoftwareID      uuid.UUID                `json:"software_id" gorm:"type:uuid;not null"`
+	Version         string                   `json:"version"` // Empty for the current version when the device joins
+	Position        int                      `json:"position"`
+	ExposedServices []ExposedServiceTemplate `json:"exposed_services" gorm:"serializer:json"` // Exposed on the device along with the software
+	CreatedAt       time.Time                `json:"created_at"`
+	UpdatedAt       time.Time                `json:"updated_at"`
+}
+
+// ExposedServiceTemplate describes a service of fleet default software that is
+// exposed on each device it is deployed to
+type ExposedServiceTemplate struct {
+	Name           string   `json:"name"`
+	ContainerName  string   `json:"container_name"`
+	InternalPort   int      `json:"internal_port"`
+	ExternalPort   int      `json:"external_port"`
+	Protocol       string   `json:"protocol,omitempty"` // http by default
+	URLPath        string   `json:"url_path,omitempty"`
+	AuthRequired   *bool    `json:"auth_required,omitempty"`   // True unless set to false
+	AllowedSources []string `json:"allowed_sources,omitempty"` // Addresses or CIDR ranges allowed to connect to tcp and udp services
+}
+
+// CustomField defines a metadata field, such as an asset tag, that devices can
+// hold a value for. A field without a fleet applies to every device.
+type CustomField struct {
+	ID          uuid.UUID      `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	Name        string         `json:"name" gorm:"not null;index"` // Key of the value on devices
+	Label       string         `json:"label"`
+	Description string         `json:"description"`
+	Type        string         `json:"type" gorm:"not null"`           // string, number, bool, date or enum
+	Options     []string       `json:"options" gorm:"serializer:json"` // Allowed values of an enum
+	Required    bool           `json:"required" gorm:"not null;default:false"`
+	FleetID     *uuid.UUID     `json:"fleet_id,omitempty" gorm:"type:uuid;index"`
+	CreatedAt   time.Time      `json:"created_at"`
+	UpdatedAt   time.Time      `json:"updated_at"`
+	DeletedAt   gorm.DeletedAt `json:"-" gorm:"index"`
+}
+
+// SoftwareEnvSchema declares the environment variables a software version accepts
+type SoftwareEnvSchema struct {
 	ID         uuid.UUID      `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
-	SoftwareID uuid.UUID      `json:"software_id" gorm:"type:uuid;index"`
-	FleetID    uuid.UUID      `json:"fleet_id,omitempty" gorm:"type:uuid;index"`
-	DeviceID   uuid.UUID      `json:"device_id,omitempty" gorm:"type:uuid;index"`
-	Version    string         `json:"version" gorm:"not null"`
-	Pinned     bool           `json:"pinned" gorm:"not null;default:false"`
-	Status     string         `json:"status" gorm:"not null"`
-	EnvVars    string         `json:"env_vars" gorm:"type:jsonb"`
+	SoftwareID uuid.UUID      `json:"software_id" gorm:"type:uuid;uniqueIndex:idx_software_env_schema"`
+	Version    string         `json:"version" gorm:"not null;uniqueIndex:idx_software_env_schema"`
+	Variables  string         `json:"variables" gorm:"type:jsonb;not null;default:'[]'::jsonb"` // JSON array of variable declarations
 	CreatedAt  time.Time      `json:"created_at"`
 	UpdatedAt  time.Time      `json:"updated_at"`
 	DeletedAt  gorm.DeletedAt `json:"-" gorm:"index"`
 }
 
+// SoftwareRequirements declares the oldest agent, OS and kernel versions a
+// device must run to be deployed a software version
+type SoftwareRequirements struct {
+	ID           uuid.UUID             `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	SoftwareID   uuid.UUID             `json:"software_id" gorm:"type:uuid;uniqueIndex:idx_software_requirements"`
+	Version      string                `json:"version" gorm:"not null;uniqueIndex:idx_software_requirements"`
+	Requirements protocol.Requirements `json:"requirements" gorm:"serializer:json"`
+	CreatedAt    time.Time             `json:"created_at"`
+	UpdatedAt    time.Time             `json:"updated_at"`
+}
+
+// SoftwareMigration declares how the data of a software is migrated when a
+// device is updated to a version
+type SoftwareMigration struct {
+	ID         uuid.UUID          `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	SoftwareID uuid.UUID          `json:"software_id" gorm:"type:uuid;uniqueIndex:idx_software_migration"`
+	Version    string             `json:"version" gorm:"not null;uniqueIndex:idx_software_migration"` // Version migrated to
+	Migration  protocol.Migration `json:"migration" gorm:"serializer:json"`
+	CreatedAt  time.Time          `json:"created_at"`
+	UpdatedAt  time.Time          `json:"updated_at"`
+}
+
+// SoftwareArtifact is a file of a software version placed next to its
+// compose file on devices. The content is kept in the artifact storage by
+// its digest, so versions sharing a file share the content.
+type SoftwareArtifact struct {
+	ID         uuid.UUID `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	SoftwareID uuid.UUID `json:"software_id" gorm:"type:uuid;uniqueIndex:idx_software_artifact"`
+	Version    string    `json:"version" gorm:"not null;uniqueIndex:idx_software_artifact"`
+	Path       string    `json:"path" gorm:"not null;uniqueIndex:idx_software_artifact"` // Relative to the compose file
+	Digest     string    `json:"digest" gorm:"not null;index"`                           // sha256:<hex> of the content
+	Size       int64     `json:"size"`
+	Mode       uint32    `json:"mode"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
 // FleetEnvVars represents environment variables for a fleet's containers
 type FleetEnvVars struct {
 	ID            uuid.UUID      `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
 	FleetID       uuid.UUID      `json:"fleet_id" gorm:"type:uuid;index"`
+	SoftwareID    uuid.UUID      `json:"software_id,omitempty" gorm:"type:uuid;index"` // Schema the values are validated against
 	ContainerName string         `json:"container_name" gorm:"not null"`
-	EnvVars       string         `json:"env_vars" gorm:"type:jsonb;not null"`
+	EnvVars       string         `json:"env_vars" gorm:"type:jsonb;not null;serializer:encrypted"`
 	CreatedAt     time.Time      `json:"created_at"`
 	UpdatedAt     time.Time      `json:"updated_at"`
 	DeletedAt     gorm.DeletedAt `json:"-" gorm:"index"`
@@ -96,19 +433,83 @@ type FleetEnvVars struct {
 type DeviceEnvVars struct {
 	ID            uuid.UUID      `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
 	DeviceID      uuid.UUID      `json:"device_id" gorm:"type:uuid;index"`
+	SoftwareID    uuid.UUID      `json:"software_id,omitempty" gorm:"type:uuid;index"` // Schema the values are validated against
 	ContainerName string         `json:"container_name" gorm:"not null"`
-	EnvVars       string         `json:"env_vars" gorm:"type:jsonb;not null"`
+	EnvVars       string         `json:"env_vars" gorm:"type:jsonb;not null;serializer:encrypted"`
 	CreatedAt     time.Time      `json:"created_at"`
 	UpdatedAt     time.Time      `json:"updated_at"`
 	DeletedAt     gorm.DeletedAt `json:"-" gorm:"index"`
 }
 
+// FleetComposeOverride is a compose file fragment layered over the compose
+// file of a software on the devices of a fleet
+type FleetComposeOverride struct {
+	ID          uuid.UUID `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	FleetID     uuid.UUID `json:"fleet_id" gorm:"type:uuid;uniqueIndex:idx_fleet_compose_override"`
+	SoftwareID  uuid.UUID `json:"software_id" gorm:"type:uuid;uniqueIndex:idx_fleet_compose_override"`
+	ComposeYAML string    `json:"compose_yaml" gorm:"not null;serializer:encrypted"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// DeviceComposeOverride is a compose file fragment layered over the compose
+// file of a software, and the fleet's fragment, on one device
+type DeviceComposeOverride struct {
+	ID          uuid.UUID `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	DeviceID    uuid.UUID `json:"device_id" gorm:"type:uuid;uniqueIndex:idx_device_compose_override"`
+	SoftwareID  uuid.UUID `json:"software_id" gorm:"type:uuid;uniqueIndex:idx_device_compose_override"`
+	ComposeYAML string    `json:"compose_yaml" gorm:"not null;serializer:encrypted"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// SecretStore represents an external secret store that env var values and
+// registry credentials can reference. A store without a fleet is global.
+type SecretStore struct {
+	ID        uuid.UUID      `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	Name      string         `json:"name" gorm:"not null;index"`
+	Type      string         `json:"type" gorm:"not null"` // vault, aws-secrets-manager
+	FleetID   *uuid.UUID     `json:"fleet_id,omitempty" gorm:"type:uuid;index"`
+	Config    string         `json:"config" gorm:"type:jsonb;serializer:encrypted"` // JSON object of store settings
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+	DeletedAt gorm.DeletedAt `json:"-" gorm:"index"`
+}
+
+// RegistryCredential represents credentials for a private container registry.
+// The password may be a reference to an external secret store.
+type RegistryCredential struct {
+	ID        uuid.UUID      `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	Server    string         `json:"server" gorm:"not null"`
+	Username  string         `json:"username" gorm:"not null"`
+	Password  string         `json:"password,omitempty" gorm:"serializer:encrypted"`
+	FleetID   *uuid.UUID     `json:"fleet_id,omitempty" gorm:"type:uuid;index"`
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+	DeletedAt gorm.DeletedAt `json:"-" gorm:"index"`
+}
+
 // DeviceLog represents a log entry from a device
 type DeviceLog struct {
 	ID        uuid.UUID `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
 	DeviceID  uuid.UUID `json:"device_id" gorm:"type:uuid;index"`
 	LogType   string    `json:"log_type" gorm:"not null"`
+	Unit      string    `json:"unit,omitempty" gorm:"index"` // journald unit of journal entries
+	Priority  *int      `json:"priority,omitempty"`          // Syslog priority of journal entries, 0 (emerg) to 7 (debug)
 	Message   string    `json:"message" gorm:"not null"`
+	CreatedAt time.Time `json:"created_at" gorm:"index"` // When journald received journal entries
+}
+
+// LogArchive is a gzipped file of device logs moved from the database to
+// the object storage, one JSON entry per line
+type LogArchive struct {
+	ID        uuid.UUID `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	DeviceID  uuid.UUID `json:"device_id" gorm:"type:uuid;index"`
+	From      time.Time `json:"from"` // Time of the first entry
+	To        time.Time `json:"to"`   // Time of the last entry
+	Entries   int       `json:"entries"`
+	Size      int64     `json:"size"` // Bytes of the gzipped file
+	Object    string    `json:"-" gorm:"not null"`
 	CreatedAt time.Time `json:"created_at" gorm:"index"`
 }
 
@@ -119,6 +520,9 @@ type APIToken struct {
 	Token       string         `json:"token" gorm:"uniqueIndex;not null"`
 	Description string         `json:"description"`
 	ExpiresAt   time.Time      `json:"expires_at"`
+	LastUsedAt  *time.Time     `json:"last_used_at,omitempty"`
+	IPAddress   string         `json:"ip_address,omitempty"` // Of the last use
+	UserAgent   string         `json:"user_agent,omitempty"` // Of the last use
 	CreatedAt   time.Time      `json:"created_at"`
 	UpdatedAt   time.Time      `json:"updated_at"`
 	DeletedAt   gorm.DeletedAt `json:"-" gorm:"index"`
@@ -126,19 +530,531 @@ type APIToken struct {
 
 // ExposedService represents a service exposed to the internet
 type ExposedService struct {
-	ID            uuid.UUID      `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
-	DeviceID      uuid.UUID      `json:"device_id" gorm:"type:uuid;index"`
-	Name          string         `json:"name" gorm:"not null"`
-	ContainerName string         `json:"container_name" gorm:"not null"`
-	InternalPort  int            `json:"internal_port" gorm:"not null"`
-	ExternalPort  int            `json:"external_port" gorm:"not null"`
-	Protocol      string         `json:"protocol" gorm:"not null;default:'http'"`
-	URLPath       string         `json:"url_path"`
-	AuthRequired  bool           `json:"auth_required" gorm:"not null;default:true"`
-	Enabled       bool           `json:"enabled" gorm:"not null;default:true"`
-	CreatedAt     time.Time      `json:"created_at"`
-	UpdatedAt     time.Time      `json:"updated_at"`
-	DeletedAt     gorm.DeletedAt `json:"-" gorm:"index"`
+	ID             uuid.UUID      `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	DeviceID       uuid.UUID      `json:"device_id" gorm:"type:uuid;index"`
+	Name           string         `json:"name" gorm:"not null"`
+	ContainerName  string         `json:"container_name" gorm:"not null"`
+	InternalPort   int            `json:"internal_port" gorm:"not null"`
+	ExternalPort   int            `json:"external_port" gorm:"not null"`
+	Protocol       string         `json:"protocol" gorm:"not null;default:'http'"`
+	URLPath        string         `json:"url_path"`
+	AuthRequired   bool           `json:"auth_required" gorm:"not null;default:true"`
+	PasswordHash   string         `json:"-"`                                                // bcrypt hash of the shared password, empty if there is none
+	PublicPort     int            `json:"public_port,omitempty" gorm:"index"`               // Port on the proxy for tcp and udp services, allocated by the proxy
+	AllowedSources []string       `json:"allowed_sources,omitempty" gorm:"serializer:json"` // Addresses or CIDR ranges allowed to connect to tcp and udp services
+	Enabled        bool           `json:"enabled" gorm:"not null;default:true"`
+	CreatedAt      time.Time      `json:"created_at"`
+	UpdatedAt      time.Time      `json:"updated_at"`
+	DeletedAt      gorm.DeletedAt `json:"-" gorm:"index"`
+}
+
+// Protocols of exposed services
+const (
+	ServiceProtocolHTTP  = "http"  // Served at the device's subdomain
+	ServiceProtocolHTTPS = "https" // Served at the device's subdomain, the device's service speaks TLS
+	ServiceProtocolTCP   = "tcp"   // Relayed from a public port of the proxy
+	ServiceProtocolUDP   = "udp"   // Relayed from a public port of the proxy, if UDP relaying is enabled
+)
+
+// Webhook represents an outbound webhook subscription for lifecycle events
+type Webhook struct {
+	ID        uuid.UUID      `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	Name      string         `json:"name" gorm:"not null"`
+	URL       string         `json:"url" gorm:"not null"`
+	Secret    string         `json:"secret,omitempty" gorm:"serializer:encrypted"`          // Used to sign payloads, never returned by the API
+	Events    string         `json:"events" gorm:"type:jsonb;not null;default:'[]'::jsonb"` // JSON array of event types, empty means all
+	Enabled   bool           `json:"enabled" gorm:"not null;default:true"`
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+	DeletedAt gorm.DeletedAt `json:"-" gorm:"index"`
+}
+
+// WebhookDelivery represents a single delivery attempt of an event to a webhook
+type WebhookDelivery struct {
+	ID         uuid.UUID `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	WebhookID  uuid.UUID `json:"webhook_id" gorm:"type:uuid;index"`
+	EventID    string    `json:"event_id" gorm:"index;not null"`
+	EventType  string    `json:"event_type" gorm:"not null"`
+	Payload    string    `json:"payload" gorm:"type:jsonb"`
+	Attempt    int       `json:"attempt" gorm:"not null"`
+	StatusCode int       `json:"status_code"`
+	Success    bool      `json:"success" gorm:"not null;default:false"`
+	Error      string    `json:"error,omitempty"`
+	DurationMs int64     `json:"duration_ms"`
+	CreatedAt  time.Time `json:"created_at" gorm:"index"`
+}
+
+// DeviceSession is a period during which a device was connected to the
+// server. The session of a connected device has no end yet.
+type DeviceSession struct {
+	ID             uuid.UUID  `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	DeviceID       uuid.UUID  `json:"device_id" gorm:"type:uuid;not null;index:idx_device_sessions_device_connected"`
+	RemoteAddr     string     `json:"remote_addr"`
+	ConnectedAt    time.Time  `json:"connected_at" gorm:"not null;index:idx_device_sessions_device_connected"`
+	DisconnectedAt *time.Time `json:"disconnected_at,omitempty" gorm:"index"`
+}
+
+// UnmanagedWorkload is a compose project or container found on a device that
+// was not deployed through edgetainer. Workloads that go away are kept, so
+// that ignoring one survives it being stopped and started again.
+type UnmanagedWorkload struct {
+	ID          uuid.UUID                  `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	DeviceID    uuid.UUID                  `json:"device_id" gorm:"type:uuid;not null;uniqueIndex:idx_unmanaged_workloads_device_kind_name"`
+	Kind        string                     `json:"kind" gorm:"not null;uniqueIndex:idx_unmanaged_workloads_device_kind_name"` // compose or container
+	Name        string                     `json:"name" gorm:"not null;uniqueIndex:idx_unmanaged_workloads_device_kind_name"`
+	WorkingDir  string                     `json:"working_dir,omitempty"`
+	ConfigFiles []string                   `json:"config_files,omitempty" gorm:"serializer:json"`
+	Containers  []protocol.ContainerStatus `json:"containers" gorm:"serializer:json"`
+	Present     bool                       `json:"present"` // Reported by the last heartbeat
+	Ignored     bool                       `json:"ignored"` // No alert fires when it shows up
+	FirstSeen   time.Time                  `json:"first_seen"`
+	LastSeen    time.Time                  `json:"last_seen"`
+}
+
+// USBMatch names a USB device that is required on a device, e.g. a LoRa or
+// Zigbee stick, by vendor and product ID and optionally its serial number
+type USBMatch struct {
+	Name      string `json:"name"`      // What the device is, for alerts
+	VendorID  string `json:"vendor_id"` // Four lowercase hex digits, as agents report them
+	ProductID string `json:"product_id"`
+	Serial    string `json:"serial,omitempty"` // Any serial number if empty
+}
+
+// Matches reports whether a connected USB device is the required one
+func (m USBMatch) Matches(vendorID, productID, serial string) bool {
+	return m.VendorID == vendorID && m.ProductID == productID && (m.Serial == "" || m.Serial == serial)
+}
+
+// DeviceUSB is a USB device connected to a device as the last heartbeat
+// reported it
+type DeviceUSB struct {
+	ID           uuid.UUID `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	DeviceID     uuid.UUID `json:"device_id" gorm:"type:uuid;not null;index"`
+	Port         string    `json:"port"`
+	VendorID     string    `json:"vendor_id" gorm:"index:idx_device_usbs_vendor_product"`
+	ProductID    string    `json:"product_id" gorm:"index:idx_device_usbs_vendor_product"`
+	Serial       string    `json:"serial,omitempty"`
+	Manufacturer string    `json:"manufacturer,omitempty"`
+	Product      string    `json:"product,omitempty"`
+	Class        string    `json:"class,omitempty"`
+	Speed        int       `json:"speed,omitempty"` // Mbit/s
+	AttachedAt   time.Time `json:"attached_at"`     // When a heartbeat first reported it
+}
+
+// DeviceContainer is a container of an application on a device as the last
+// heartbeat reported it, so it can be listed without asking the device
+type DeviceContainer struct {
+	ID          uuid.UUID `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	DeviceID    uuid.UUID `json:"device_id" gorm:"type:uuid;not null;uniqueIndex:idx_device_containers_device_name"`
+	Name        string    `json:"name" gorm:"not null;uniqueIndex:idx_device_containers_device_name"`
+	ContainerID string    `json:"container_id,omitempty"`
+	App         string    `json:"app" gorm:"index"` // Empty if reported by an agent too old to tell
+	Image       string    `json:"image"`
+	ImageID     string    `json:"image_id,omitempty"`    // Digest of the local image
+	RepoDigest  string    `json:"repo_digest,omitempty"` // Registry digest the image was pulled by
+	State       string    `json:"state" gorm:"index"`    // e.g. running, restarting or exited
+	Health      string    `json:"health,omitempty" gorm:"index"`
+	Restarts    int       `json:"restarts"`
+	Created     string    `json:"created,omitempty"` // As reported by Docker
+	ChangedAt   time.Time `json:"changed_at"`        // When the state or health last changed
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// Alert records an alert that fired on a device
+type Alert struct {
+	ID       uuid.UUID              `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	DeviceID uuid.UUID              `json:"device_id" gorm:"type:uuid;index"`
+	Name     string                 `json:"name" gorm:"not null;index"` // e.g. clock_skew
+	Data     map[string]interface{} `json:"data" gorm:"type:jsonb;serializer:json"`
+	FiredAt  time.Time              `json:"fired_at" gorm:"index"`
+}
+
+// RevokedKey is a device key that may no longer be used to log in
+type RevokedKey struct {
+	ID          uuid.UUID `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	DeviceID    string    `json:"device_id" gorm:"index;not null"`
+	Fingerprint string    `json:"fingerprint" gorm:"uniqueIndex;not null"` // SHA256 fingerprint of the key
+	Reason      string    `json:"reason"`
+	RevokedBy   string    `json:"revoked_by"` // Username of the admin who revoked it
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// AuditEntry records an action taken by a user, e.g. revoking a device
+type AuditEntry struct {
+	ID        uuid.UUID              `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	Action    string                 `json:"action" gorm:"not null;index"` // e.g. device.revoke
+	Actor     string                 `json:"actor"`                        // Username of the user who acted
+	DeviceID  string                 `json:"device_id,omitempty" gorm:"index"`
+	Reason    string                 `json:"reason,omitempty"`
+	Data      map[string]interface{} `json:"data,omitempty" gorm:"type:jsonb;serializer:json"`
+	CreatedAt time.Time              `json:"created_at" gorm:"index"`
+}
+
+// Audited actions
+const (
+	AuditDeviceRevoke         = "device.revoke"
+	AuditDeviceRename         = "device.rename"
+	AuditImport               = "import.create"
+	AuditImportKeysDelete     = "import.keys_delete"
+	AuditConnectionDisconnect = "connection.disconnect"
+	AuditConnectionReallocate = "connection.reallocate"
+	AuditServiceAccess        = "service.access"
+	AuditServiceDenied        = "service.denied"
+	AuditServiceAuth          = "service.auth"
+	AuditDiagnosticsDownload  = "diagnostics.download"
+	AuditNetworkTest          = "diagnostics.network_test"
+	AuditCaptureStart         = "capture.start"
+	AuditCaptureDownload      = "capture.download"
+	AuditCaptureDelete        = "capture.delete"
+	AuditPluginSettings       = "plugin.settings"
+	AuditPluginAction         = "plugin.action"
+	AuditEnrollmentRejected   = "enrollment.rejected"
+	AuditApprovalRequest      = "approval.request"
+	AuditApprovalApprove      = "approval.approve"
+	AuditApprovalReject       = "approval.reject"
+	AuditFleetApproval        = "fleet.approval"
+	AuditFleetFreeze          = "fleet.freeze"
+	AuditFleetUnfreeze        = "fleet.unfreeze"
+	AuditFreezeOverride       = "fleet.freeze_override"
+	AuditDisplayConfigure     = "display.configure"
+	AuditDisplayScreenshot    = "display.screenshot"
+	AuditHostServiceRestart   = "host_service.restart"
+	AuditRestorePointCreate   = "restore_point.create"
+	AuditRestorePointRestore  = "restore_point.restore"
+	AuditRestorePointDelete   = "restore_point.delete"
+	AuditStagedUpdateCreate   = "staged_update.create"
+	AuditStagedUpdateCancel   = "staged_update.cancel"
+	AuditStagedUpdateActivate = "staged_update.activate"
+	AuditFleetSnapshotCreate  = "fleet_snapshot.create"
+	AuditFleetSnapshotRestore = "fleet_snapshot.restore"
+	AuditFleetSnapshotDelete  = "fleet_snapshot.delete"
+	AuditInvitationCreate     = "invitation.create"
+	AuditInvitationResend     = "invitation.resend"
+	AuditInvitationRevoke     = "invitation.revoke"
+	AuditInvitationAccept     = "invitation.accept"
+	AuditUserCreate           = "user.create"         // By the admin CLI
+	AuditUserPasswordReset    = "user.password_reset" // By the admin CLI
+	AuditSessionRevoke        = "session.revoke"
+	AuditUserSessionsRevoke   = "user.sessions_revoke"
+	AuditHostKeyRotate        = "ssh.host_key_rotate" // By the admin CLI
+	AuditPurgeDeleted         = "admin.purge_deleted" // By the admin CLI
+	AuditSetupComplete        = "server.setup"
+	AuditServerSettings       = "server.settings"
+	AuditResourceApply        = "resource.apply"
+	AuditResourceDelete       = "resource.delete"
+)
+
+// DNSRecord is a record the server created for the subdomain of a device
+// at the DNS provider, kept to update and remove it later
+type DNSRecord struct {
+	ID        uuid.UUID `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	Name      string    `json:"name" gorm:"uniqueIndex;not null"` // Fully qualified, without the trailing dot
+	Type      string    `json:"type" gorm:"not null"`             // A, AAAA or CNAME
+	Value     string    `json:"value" gorm:"not null"`
+	TTL       int       `json:"ttl"`
+	DeviceID  uuid.UUID `json:"device_id" gorm:"type:uuid;index"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Job is a unit of background work run by the job queue of the server. Jobs
+// survive restarts, may be scheduled to run later and are retried with
+// backoff until they run out of attempts.
+type Job struct {
+	ID          uuid.UUID       `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	Type        string          `json:"type" gorm:"not null;index"`
+	Status      string          `json:"status" gorm:"not null;index:idx_jobs_status_run_at"`
+	Payload     json.RawMessage `json:"payload,omitempty" gorm:"type:jsonb;serializer:json"`
+	Result      json.RawMessage `json:"result,omitempty" gorm:"type:jsonb;serializer:json"`
+	Error       string          `json:"error,omitempty"` // Error of the last attempt
+	Attempts    int             `json:"attempts" gorm:"not null;default:0"`
+	MaxAttempts int             `json:"max_attempts" gorm:"not null;default:1"`
+	RunAt       time.Time       `json:"run_at" gorm:"not null;index:idx_jobs_status_run_at"` // Not run before, pushed back by retries
+	LockedBy    string          `json:"locked_by,omitempty"`                                 // Worker running the job
+	LockedUntil *time.Time      `json:"locked_until,omitempty"`                              // Lease of the worker, renewed while the job runs
+	CreatedBy   string          `json:"created_by,omitempty"`                                // Username of the user who started the job, empty for the server
+	StartedAt   *time.Time      `json:"started_at,omitempty"`
+	FinishedAt  *time.Time      `json:"finished_at,omitempty" gorm:"index"`
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+}
+
+// DiagnosticsBundle is a support bundle collected by the agent of a device
+// and uploaded through its tunnel
+type DiagnosticsBundle struct {
+	ID          uuid.UUID  `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	DeviceID    uuid.UUID  `json:"device_id" gorm:"type:uuid;index"`
+	Status      string     `json:"status" gorm:"not null"`
+	Error       string     `json:"error,omitempty"`
+	Size        int64      `json:"size"`                   // Bytes of the gzipped tar archive received so far
+	Data        []byte     `json:"-" gorm:"type:bytea"`    // Loaded only for downloads
+	Object      string     `json:"-"`                      // Name in the object storage once moved there from Data
+	RequestedBy string     `json:"requested_by,omitempty"` // Username of the user who asked for the bundle
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at" gorm:"index"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+// PacketCapture is a pcap file captured by the agent of a device with
+// tcpdump, arriving while the capture runs
+type PacketCapture struct {
+	ID          uuid.UUID  `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	DeviceID    uuid.UUID  `json:"device_id" gorm:"type:uuid;index"`
+	Interface   string     `json:"interface,omitempty"` // Interface captured on, or the bridge of Network
+	Network     string     `json:"network,omitempty"`   // Docker network captured on
+	Filter      string     `json:"filter,omitempty"`
+	Duration    int        `json:"duration"`  // Seconds to capture for at most
+	MaxBytes    int64      `json:"max_bytes"` // Size limit of the pcap file
+	Status      string     `json:"status" gorm:"not null"`
+	Error       string     `json:"error,omitempty"`
+	Size        int64      `json:"size"`                // Bytes received so far
+	Truncated   bool       `json:"truncated"`           // Cut at MaxBytes
+	Packets     int        `json:"packets"`             // As reported by tcpdump once done
+	Dropped     int        `json:"dropped"`             // Packets the kernel dropped
+	Data        []byte     `json:"-" gorm:"type:bytea"` // Loaded only for downloads
+	Object      string     `json:"-"`                   // Name in the object storage once moved there from Data
+	Reason      string     `json:"reason,omitempty"`
+	RequestedBy string     `json:"requested_by,omitempty"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at" gorm:"index"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+// RestorePoint is a named record of the applications of a device, and
+// optionally copies of their volumes, kept on the device to put them back
+// after a risky change
+type RestorePoint struct {
+	ID         uuid.UUID                      `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	DeviceID   uuid.UUID                      `json:"device_id" gorm:"type:uuid;not null;index"`
+	Name       string                         `json:"name" gorm:"not null"`
+	Apps       []string                       `json:"apps" gorm:"serializer:json"` // Applications asked for, empty for all
+	Volumes    bool                           `json:"volumes"`                     // Volumes were copied
+	Status     string                         `json:"status" gorm:"not null"`
+	Error      string                         `json:"error,omitempty"` // Of the creation or the last restore
+	Manifest   *protocol.RestorePointManifest `json:"manifest,omitempty" gorm:"serializer:json"`
+	CreatedBy  string                         `json:"created_by,omitempty"`
+	RestoredAt *time.Time                     `json:"restored_at,omitempty"`
+	RestoredBy string                         `json:"restored_by,omitempty"`
+	CreatedAt  time.Time                      `json:"created_at" gorm:"index"`
+	UpdatedAt  time.Time                      `json:"updated_at"`
+}
+
+// StagedUpdate is a software version handed to a device ahead of time, which
+// the device deploys at ApplyAt whether it can reach the server then or not,
+// or when it is activated. Its status is reported back once the device is
+// connected.
+type StagedUpdate struct {
+	ID           uuid.UUID  `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	DeviceID     uuid.UUID  `json:"device_id" gorm:"type:uuid;not null;index"`
+	SoftwareID   uuid.UUID  `json:"software_id" gorm:"type:uuid;not null"`
+	Version      string     `json:"version" gorm:"not null"`
+	ApplyAt      *time.Time `json:"apply_at,omitempty"` // Nil to wait until it is activated
+	Status       string     `json:"status" gorm:"not null"`
+	Error        string     `json:"error,omitempty"`
+	EnvVars      string     `json:"-" gorm:"type:jsonb;serializer:encrypted"` // Secret references unresolved, for the deployment recorded once applied
+	ComposeHash  string     `json:"compose_hash,omitempty"`
+	EnvHash      string     `json:"env_hash,omitempty"`
+	AppliedAt    *time.Time `json:"applied_at,omitempty"`    // When the device deployed it, by its clock
+	DeploymentID *uuid.UUID `json:"deployment_id,omitempty"` // Recorded once the device reported it applied
+	CreatedBy    string     `json:"created_by,omitempty"`
+	CreatedAt    time.Time  `json:"created_at" gorm:"index"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+}
+
+// FleetSnapshot is the desired state of a fleet and its devices at one time,
+// kept under a name to compare it with other times and to restore it
+type FleetSnapshot struct {
+	ID          uuid.UUID `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	FleetID     uuid.UUID `json:"fleet_id" gorm:"type:uuid;not null;index"`
+	Name        string    `json:"name" gorm:"not null"`
+	Description string    `json:"description,omitempty"`
+	State       string    `json:"-" gorm:"type:jsonb;not null;serializer:encrypted"` // FleetState as JSON, holding env var values
+	CreatedBy   string    `json:"created_by,omitempty"`
+	CreatedAt   time.Time `json:"created_at" gorm:"index"`
+}
+
+// FleetState is the desired state of a fleet and its devices held by a
+// fleet snapshot
+type FleetState struct {
+	Software         []SnapshotSoftware        `json:"software"`          // Default software of the fleet, in order
+	EnvVars          []SnapshotEnvVars         `json:"env_vars"`          // Of the fleet
+	ComposeOverrides []SnapshotComposeOverride `json:"compose_overrides"` // Of the fleet
+	Devices          []SnapshotDevice          `json:"devices"`
+}
+
+// SnapshotSoftware is default software of a fleet in a snapshot
+type SnapshotSoftware struct {
+	SoftwareID      uuid.UUID                `json:"software_id"`
+	Name            string                   `json:"name"`
+	Version         string                   `json:"version"` // The current version of the software if the fleet took that
+	ExposedServices []ExposedServiceTemplate `json:"exposed_services,omitempty"`
+}
+
+// SnapshotEnvVars are the env vars of a container of a fleet or device in a
+// snapshot
+type SnapshotEnvVars struct {
+	SoftwareID    uuid.UUID         `json:"software_id,omitempty"`
+	ContainerName string            `json:"container_name"`
+	EnvVars       map[string]string `json:"env_vars"`
+}
+
+// SnapshotComposeOverride is a compose override of a fleet in a snapshot
+type SnapshotComposeOverride struct {
+	SoftwareID  uuid.UUID `json:"software_id"`
+	Software    string    `json:"software"` // Name
+	ComposeYAML string    `json:"compose_yaml"`
+}
+
+// SnapshotDevice is a device of a fleet in a snapshot
+type SnapshotDevice struct {
+	DeviceID        string            `json:"device_id"`
+	Name            string            `json:"name,omitempty"`
+	Software        map[string]string `json:"software"` // Version last deployed by software name
+	EnvVars         []SnapshotEnvVars `json:"env_vars,omitempty"`
+	ExposedServices []SnapshotService `json:"exposed_services,omitempty"`
+}
+
+// SnapshotService is a service exposed on a device in a snapshot
+type SnapshotService struct {
+	Name           string   `json:"name"`
+	ContainerName  string   `json:"container_name"`
+	InternalPort   int      `json:"internal_port"`
+	ExternalPort   int      `json:"external_port"`
+	Protocol       string   `json:"protocol"`
+	URLPath        string   `json:"url_path,omitempty"`
+	AuthRequired   bool     `json:"auth_required"`
+	AllowedSources []string `json:"allowed_sources,omitempty"`
+	Enabled        bool     `json:"enabled"`
+}
+
+// Invitation lets someone become a user with a role by following a signed
+// link sent to their email address, choosing their username and password or
+// signing in through an auth backend
+type Invitation struct {
+	ID         uuid.UUID  `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	Email      string     `json:"email" gorm:"not null;index"`
+	Role       string     `json:"role" gorm:"not null"`
+	LinkKey    string     `json:"-" gorm:"not null;serializer:encrypted"` // Signs the link, replaced when it is sent again
+	Status     string     `json:"status" gorm:"not null;index"`
+	InvitedBy  string     `json:"invited_by,omitempty"`
+	SentAt     time.Time  `json:"sent_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	AcceptedAt *time.Time `json:"accepted_at,omitempty"`
+	UserID     *uuid.UUID `json:"user_id,omitempty" gorm:"type:uuid"` // User who accepted it
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// DeviceDisplay holds the kiosk display settings of a device, applied when
+// they change and whenever the device connects
+type DeviceDisplay struct {
+	DeviceID  uuid.UUID                 `json:"device_id" gorm:"type:uuid;primaryKey"`
+	URL       string                    `json:"url"`
+	Rotation  int                       `json:"rotation"` // Degrees clockwise
+	Blanking  []protocol.BlankingPeriod `json:"blanking" gorm:"serializer:json"`
+	AppliedAt *time.Time                `json:"applied_at,omitempty"` // When the device last took the settings
+	Error     string                    `json:"error,omitempty"`      // Why the device last failed to take them
+	UpdatedAt time.Time                 `json:"updated_at"`
+}
+
+// Payload returns the command payload applying the settings
+func (d *DeviceDisplay) Payload() protocol.DisplayPayload {
+	return protocol.DisplayPayload{URL: d.URL, Rotation: d.Rotation, Blanking: d.Blanking}
+}
+
+// DisplayScreenshot is a picture of the kiosk display of a device in PNG
+// format
+type DisplayScreenshot struct {
+	ID          uuid.UUID `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	DeviceID    uuid.UUID `json:"device_id" gorm:"type:uuid;index"`
+	Size        int64     `json:"size"`
+	Data        []byte    `json:"-" gorm:"type:bytea"` // Loaded only for downloads
+	RequestedBy string    `json:"requested_by,omitempty"`
+	TakenAt     time.Time `json:"taken_at"` // Device clock
+	CreatedAt   time.Time `json:"created_at" gorm:"index"`
+}
+
+// Import records devices, fleets and software imported from another
+// platform, see the importer package
+type Import struct {
+	ID            uuid.UUID  `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	Source        string     `json:"source"` // balena or portainer
+	ImportedBy    string     `json:"imported_by,omitempty"`
+	Fleets        int        `json:"fleets"`   // Created
+	Software      int        `json:"software"` // Created
+	Devices       int        `json:"devices"`
+	Warnings      []string   `json:"warnings" gorm:"serializer:json"`
+	KeysDeletedAt *time.Time `json:"keys_deleted_at,omitempty"` // When the device keys were deleted, nil while the bundle can be downloaded
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// ImportedDevice links an imported device to the device it was on the source
+// platform and holds its key for the migration bundle
+type ImportedDevice struct {
+	ID            uuid.UUID `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	ImportID      uuid.UUID `json:"import_id" gorm:"type:uuid;index"`
+	DeviceID      uuid.UUID `json:"device_id" gorm:"type:uuid;index"`
+	SourceID      string    `json:"source_id"` // balena UUID or Portainer environment ID
+	SourceName    string    `json:"source_name"`
+	SSHPrivateKey string    `json:"-" gorm:"serializer:encrypted"` // Emptied when the keys of the import are deleted
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// Kinds of resources managed through the declarative API, named as in its
+// paths
+const (
+	ResourceKindFleet          = "fleets"
+	ResourceKindSoftware       = "software"
+	ResourceKindDeployment     = "deployments"      // Default software of a fleet
+	ResourceKindExposedService = "exposed-services" // Of a device
+)
+
+// ResourceRef links an external ID, e.g. of a Terraform resource, to the
+// resource applied for it through the declarative API
+type ResourceRef struct {
+	ID         uuid.UUID `json:"-" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	Kind       string    `json:"kind" gorm:"uniqueIndex:idx_resource_ref;not null"`
+	ExternalID string    `json:"external_id" gorm:"uniqueIndex:idx_resource_ref;not null"`
+	ResourceID uuid.UUID `json:"id" gorm:"type:uuid;index"`
+	Spec       string    `json:"-" gorm:"type:jsonb;serializer:encrypted"` // Last applied, holds env vars of software
+	SpecHash   string    `json:"spec_hash"`                                // SHA-256 of Spec, unchanged specs are not applied again
+	Generation int       `json:"generation"`                               // Number of changes applied
+	AppliedBy  string    `json:"applied_by,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// DeviceNameChange records a rename of a device, which keeps its device ID
+type DeviceNameChange struct {
+	ID        uuid.UUID `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	DeviceID  uuid.UUID `json:"device_id" gorm:"type:uuid;index"`
+	OldName   string    `json:"old_name"`
+	NewName   string    `json:"new_name" gorm:"index"`
+	ChangedBy string    `json:"changed_by,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// LogLevel represents a log level set at runtime, which survives restarts.
+// An empty component holds the global level.
+type LogLevel struct {
+	ID        uuid.UUID `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	Component string    `json:"component" gorm:"uniqueIndex"`
+	Level     string    `json:"level" gorm:"not null"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ServerSettings holds the settings made in the setup of the server, which
+// take precedence over the configuration. There is a single row.
+type ServerSettings struct {
+	ID               uint       `json:"-" gorm:"primaryKey"`
+	ServerURL        string     `json:"server_url,omitempty"`     // Where devices and users reach the API, e.g. https://edgetainer.example.com
+	SSHPort          int        `json:"ssh_port,omitempty"`       // Where devices connect to, zero for ssh.port
+	SSHStartPort     int        `json:"ssh_start_port,omitempty"` // First port forwarded for devices, zero for ssh.start_port
+	SSHEndPort       int        `json:"ssh_end_port,omitempty"`   // Last port forwarded for devices, zero for ssh.end_port
+	SetupCompletedAt *time.Time `json:"setup_completed_at,omitempty"`
+	SetupBy          string     `json:"setup_by,omitempty"` // Admin created in the setup
+	UpdatedAt        time.Time  `json:"updated_at"`
 }
 
 // Constants for status values
@@ -149,16 +1065,103 @@ const (
 	DeviceStatusOffline  = "offline"
 	DeviceStatusUpdating = "updating"
 	DeviceStatusError    = "error"
+	// DeviceStatusDecommissioned marks a device that was shut down for good
+	DeviceStatusDecommissioned = "decommissioned"
+	// DeviceStatusReplaced marks a device whose role was taken over by another
+	DeviceStatusReplaced = "replaced"
+	// DeviceStatusRevoked marks a device whose key was revoked
+	DeviceStatusRevoked = "revoked"
+
+	// Device log types
+	DeviceLogTypeShutdown = "shutdown"
+	DeviceLogTypeAgent    = "agent"
+	DeviceLogTypeJournal  = "journal"
+	DeviceLogTypeAutonomy = "autonomy" // What the agent did without the server
 
 	// Deployment statuses
-	DeploymentStatusPending  = "pending"
-	DeploymentStatusDeployed = "deployed"
-	DeploymentStatusFailed   = "failed"
+	DeploymentStatusQueued    = "queued" // Waiting for a rollout or registry slot
+	DeploymentStatusPending   = "pending"
+	DeploymentStatusDeployed  = "deployed"
+	DeploymentStatusFailed    = "failed"
+	DeploymentStatusSkipped   = "skipped" // The device was not connected when its turn came
+	DeploymentStatusCancelled = "cancelled"
+
+	// Site cache statuses
+	CacheStatusNone      = "none" // No cache device designated
+	CacheStatusUnknown   = "unknown"
+	CacheStatusHealthy   = "healthy"
+	CacheStatusUnhealthy = "unhealthy"
+	CacheStatusOffline   = "offline" // The cache device is not connected
+
+	// Job statuses
+	JobStatusQueued    = "queued" // Waiting for its run time or a worker
+	JobStatusRunning   = "running"
+	JobStatusSucceeded = "succeeded"
+	JobStatusFailed    = "failed" // Out of attempts or failed permanently
+	JobStatusCancelled = "cancelled"
+
+	// Diagnostics bundle statuses
+	BundleStatusPending   = "pending"   // Asked for, the agent is collecting it
+	BundleStatusUploading = "uploading" // Parts are arriving
+	BundleStatusReady     = "ready"
+	BundleStatusFailed    = "failed"
+
+	// Packet capture statuses
+	CaptureStatusCapturing = "capturing" // Asked for, parts arrive while it runs
+	CaptureStatusReady     = "ready"
+	CaptureStatusFailed    = "failed"
+
+	// Rollout statuses
+	RolloutStatusRunning   = "running"
+	RolloutStatusCompleted = "completed"
+	RolloutStatusCancelled = "cancelled"
+	RolloutStatusPartial   = "partial" // Some devices failed or were skipped
+	RolloutStatusFailed    = "failed"  // No device was deployed
+
+	// Deployment approval statuses
+	ApprovalStatusPending  = "pending"
+	ApprovalStatusApproved = "approved" // The deploy or rollout was started
+	ApprovalStatusRejected = "rejected"
+	ApprovalStatusExpired  = "expired" // Not decided on in time
+
+	// Restore point statuses
+	RestorePointStatusCreating  = "creating"
+	RestorePointStatusReady     = "ready"
+	RestorePointStatusRestoring = "restoring"
+	RestorePointStatusFailed    = "failed" // Could not be created
+
+	// Staged update statuses
+	StagedUpdateStatusStaging   = "staging" // The device is fetching its images and artifacts
+	StagedUpdateStatusStaged    = "staged"  // Fetched, waiting for its time or to be activated
+	StagedUpdateStatusApplied   = "applied"
+	StagedUpdateStatusFailed    = "failed" // Could not be fetched or deployed
+	StagedUpdateStatusCancelled = "cancelled"
+
+	// Invitation statuses
+	InvitationStatusPending  = "pending"
+	InvitationStatusAccepted = "accepted"
+	InvitationStatusRevoked  = "revoked"
+	InvitationStatusExpired  = "expired" // Shown for pending invitations past their time, not stored
 
 	// Software sources
 	SoftwareSourceGitHub = "github"
 	SoftwareSourceManual = "manual"
 
+	// Docker API proxy access
+	DockerAPIDisabled  = "disabled"
+	DockerAPIReadOnly  = "read-only"
+	DockerAPIReadWrite = "read-write"
+
+	// Web UI themes
+	ThemeLight = "light"
+	ThemeDark  = "dark"
+
+	// Charts of dashboard widgets
+	WidgetChartNumber = "number"
+	WidgetChartBar    = "bar"
+	WidgetChartPie    = "pie"
+	WidgetChartTable  = "table"
+
 	// User roles
 	UserRoleAdmin    = "admin"
 	UserRoleOperator = "operator"
@@ -0,0 +1,60 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// MaxArtifacts bounds the number of artifacts of a software version
+const MaxArtifacts = 1000
+
+// digestPattern matches the content digests artifacts are addressed by
+var digestPattern = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+
+// Artifact is a file of a software version, e.g. a config file, static
+// assets or a model, placed at its path relative to the compose file before
+// the version is started
+type Artifact struct {
+	Path   string `json:"path"`
+	Digest string `json:"digest"` // sha256:<hex> of the content
+	Size   int64  `json:"size"`
+	Mode   uint32 `json:"mode"`          // Permission bits
+	URL    string `json:"url,omitempty"` // Pre-signed download URL, empty to fetch it over ChannelArtifact
+}
+
+// ArtifactRequest is the extra data of a ChannelArtifact channel. The server
+// streams the content from the offset on and closes the channel, or rejects
+// it for an unknown digest.
+type ArtifactRequest struct {
+	Digest string `json:"digest"`
+	Offset int64  `json:"offset,omitempty"` // Resumes an interrupted download
+}
+
+// ValidDigest reports whether a digest is a sha256 content digest
+func ValidDigest(digest string) bool {
+	return digestPattern.MatchString(digest)
+}
+
+// ValidateArtifactPath checks that an artifact path is a clean relative path
+// that stays in the application directory and leaves the files the agent
+// writes itself alone
+func ValidateArtifactPath(p string) error {
+	if p == "" {
+		return errors.New("artifact path is required")
+	}
+	if path.IsAbs(p) || strings.Contains(p, `\`) || path.Clean(p) != p || p == ".." || strings.HasPrefix(p, "../") {
+		return fmt.Errorf("artifact path %q must be a clean relative path", p)
+	}
+	for _, part := range strings.Split(p, "/") {
+		if strings.HasPrefix(part, ".") {
+			return fmt.Errorf("artifact path %q must not contain hidden files or directories", p)
+		}
+	}
+	if strings.HasPrefix(p, "docker-compose.") {
+		return fmt.Errorf("artifact path %q is reserved for the compose files the agent writes", p)
+	}
+	return nil
+}
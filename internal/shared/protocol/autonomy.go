@@ -0,0 +1,72 @@
+package protocol
+
+import (
+	"fmt"
+	"time"
+)
+
+// MaxAutonomyBatch is the most autonomy events sent in a single request
+const MaxAutonomyBatch = 100
+
+// What the agent did on its own, reported in autonomy events
+const (
+	AutonomyRestarted = "restarted" // A container that exited or turned unhealthy was restarted
+	AutonomyStarted   = "started"   // An application without containers was started
+	AutonomyStaged    = "staged"    // The images and artifacts of a staged update were fetched
+	AutonomyApplied   = "applied"   // A staged update was deployed at its time or activated
+)
+
+// AutonomyEvent is something the agent did without the server, kept until
+// the server received it
+type AutonomyEvent struct {
+	Kind      string    `json:"kind"`
+	App       string    `json:"app"`
+	Container string    `json:"container,omitempty"` // Of restarts
+	Version   string    `json:"version,omitempty"`   // Of staged updates
+	UpdateID  string    `json:"update_id,omitempty"` // Of staged updates, see StageUpdatePayload
+	Success   bool      `json:"success"`
+	Error     string    `json:"error,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// AutonomyBatch carries autonomy events shipped by an agent with
+// RequestAutonomy, oldest first
+type AutonomyBatch struct {
+	Events []AutonomyEvent `json:"events"`
+}
+
+// StageUpdatePayload asks the agent to fetch what a deployment needs now and
+// deploy it at ApplyAt, whether the server can be reached then or not, or
+// when activated with CmdActivateUpdate if ApplyAt is zero. A staged update
+// replaces the one staged before for the same application.
+type StageUpdatePayload struct {
+	ID      string        `json:"id"`
+	Deploy  DeployPayload `json:"deploy"`
+	ApplyAt time.Time     `json:"apply_at,omitempty"`
+}
+
+// Validate checks that the update names its application
+func (p *StageUpdatePayload) Validate() error {
+	if p.ID == "" {
+		return fmt.Errorf("staged update ID is required")
+	}
+	if p.Deploy.Name == "" {
+		return fmt.Errorf("application name is required")
+	}
+	return nil
+}
+
+// UnstageUpdatePayload asks the agent to drop the update staged for an
+// application, if it is the one with the ID
+type UnstageUpdatePayload struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// ActivateUpdatePayload asks the agent to deploy the update staged for an
+// application now. It must have the ID and its images and artifacts must have
+// been fetched.
+type ActivateUpdatePayload struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
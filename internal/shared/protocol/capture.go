@@ -0,0 +1,87 @@
+package protocol
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Defaults and bounds of packet captures. Captures are uploaded with
+// RequestCapture in parts of at most MaxCaptureChunk bytes.
+const (
+	DefaultCaptureDuration = 30 // Seconds
+	MaxCaptureDuration     = 300
+	DefaultCaptureBytes    = 10 * 1024 * 1024
+	MaxCaptureBytes        = 50 * 1024 * 1024
+	MaxCaptureFilter       = 1024
+	MaxCaptureChunk        = 32 * 1024
+)
+
+// captureName matches interface and Docker network names
+var captureName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.:@-]*$`)
+
+// CapturePayload asks the agent to capture packets with tcpdump on an
+// interface of the device or the bridge of a Docker network. The agent
+// answers once the capture started and streams it with RequestCapture.
+type CapturePayload struct {
+	CaptureID string `json:"capture_id"`
+	Interface string `json:"interface,omitempty"` // Interface to capture on, any if neither this nor Network is set
+	Network   string `json:"network,omitempty"`   // Docker network whose bridge to capture on
+	Filter    string `json:"filter,omitempty"`    // pcap filter expression, e.g. "tcp port 443"
+	Duration  int    `json:"duration,omitempty"`  // Seconds to capture for at most
+	MaxBytes  int64  `json:"max_bytes,omitempty"` // Size of the pcap file at most
+	SnapLen   int    `json:"snap_len,omitempty"`  // Bytes kept of each packet, 0 for tcpdump's default
+}
+
+// Normalize checks a capture and fills in the defaults of parameters left
+// empty
+func (p *CapturePayload) Normalize() error {
+	if p.Interface != "" && p.Network != "" {
+		return fmt.Errorf("capture on an interface or a network, not both")
+	}
+	if p.Interface == "" && p.Network == "" {
+		p.Interface = "any"
+	}
+	if name := p.Interface + p.Network; !captureName.MatchString(name) || len(name) > 64 {
+		return fmt.Errorf("invalid interface or network %q", name)
+	}
+
+	p.Filter = strings.TrimSpace(p.Filter)
+	if len(p.Filter) > MaxCaptureFilter {
+		return fmt.Errorf("filter must be at most %d characters", MaxCaptureFilter)
+	}
+	if strings.HasPrefix(p.Filter, "-") {
+		return fmt.Errorf("invalid filter %q", p.Filter)
+	}
+
+	if p.Duration == 0 {
+		p.Duration = DefaultCaptureDuration
+	}
+	if p.Duration < 0 || p.Duration > MaxCaptureDuration {
+		return fmt.Errorf("duration must be between 1 and %d seconds", MaxCaptureDuration)
+	}
+	if p.MaxBytes == 0 {
+		p.MaxBytes = DefaultCaptureBytes
+	}
+	if p.MaxBytes < 0 || p.MaxBytes > MaxCaptureBytes {
+		return fmt.Errorf("max_bytes must be between 1 and %d", MaxCaptureBytes)
+	}
+	if p.SnapLen < 0 || p.SnapLen > 262144 {
+		return fmt.Errorf("snap_len must be between 0 and 262144")
+	}
+	return nil
+}
+
+// CaptureChunk is a part of a packet capture in pcap format. Parts are
+// numbered from 1 and the last one, which may hold no data, has Last set. A
+// capture that failed is ended by a last part with Error set.
+type CaptureChunk struct {
+	CaptureID string `json:"capture_id"`
+	Part      int    `json:"part"`
+	Data      []byte `json:"data,omitempty"`
+	Last      bool   `json:"last,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"` // The capture was cut at MaxBytes, its last packet may be incomplete
+	Packets   int    `json:"packets,omitempty"`   // Packets captured, as tcpdump reports them
+	Dropped   int    `json:"dropped,omitempty"`   // Packets the kernel dropped
+	Error     string `json:"error,omitempty"`
+}
@@ -0,0 +1,121 @@
+package protocol
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"time"
+)
+
+// Bounds of display configurations and screenshots
+const (
+	MaxDisplayURL      = 2048
+	MaxBlankingPeriods = 14
+	MaxScreenshotSize  = 8 * 1024 * 1024
+)
+
+// Screen rotations in degrees clockwise
+var displayRotations = []int{0, 90, 180, 270}
+
+// Days of blanking periods, as time.Weekday names them shortened
+var blankingDays = []string{"mon", "tue", "wed", "thu", "fri", "sat", "sun"}
+
+// BlankingPeriod turns the screen off from Off until On, local time of the
+// device, on the given days or every day if none are given. A period whose
+// On is before its Off ends the next day.
+type BlankingPeriod struct {
+	Days []string `json:"days,omitempty"` // mon, tue, wed, thu, fri, sat or sun
+	Off  string   `json:"off"`            // HH:MM
+	On   string   `json:"on"`             // HH:MM
+}
+
+// DisplayPayload configures the kiosk display of a device: the URL shown by
+// the kiosk container, the rotation of the screen and when it is blanked
+type DisplayPayload struct {
+	URL      string           `json:"url,omitempty"`      // Page shown by the kiosk, empty leaves the current one
+	Rotation int              `json:"rotation"`           // 0, 90, 180 or 270 degrees clockwise
+	Blanking []BlankingPeriod `json:"blanking,omitempty"` // Periods the screen is off, never blanked if empty
+}
+
+// Validate checks a display configuration
+func (p *DisplayPayload) Validate() error {
+	if p.URL != "" {
+		if len(p.URL) > MaxDisplayURL {
+			return fmt.Errorf("url must be at most %d characters", MaxDisplayURL)
+		}
+		u, err := url.Parse(p.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "file") {
+			return fmt.Errorf("url must be an http, https or file URL")
+		}
+	}
+
+	if !slices.Contains(displayRotations, p.Rotation) {
+		return fmt.Errorf("rotation must be 0, 90, 180 or 270")
+	}
+
+	if len(p.Blanking) > MaxBlankingPeriods {
+		return fmt.Errorf("at most %d blanking periods are allowed", MaxBlankingPeriods)
+	}
+	for i, period := range p.Blanking {
+		for _, day := range period.Days {
+			if !slices.Contains(blankingDays, day) {
+				return fmt.Errorf("blanking period %d: invalid day %q", i+1, day)
+			}
+		}
+		off, errOff := parseClock(period.Off)
+		on, errOn := parseClock(period.On)
+		if errOff != nil || errOn != nil {
+			return fmt.Errorf("blanking period %d: off and on must be times as HH:MM", i+1)
+		}
+		if off == on {
+			return fmt.Errorf("blanking period %d: off and on must differ", i+1)
+		}
+	}
+	return nil
+}
+
+// Blanked reports whether the screen is to be off at t, in the location of t
+func (p *DisplayPayload) Blanked(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	today := blankingDays[(int(t.Weekday())+6)%7]
+	yesterday := blankingDays[(int(t.Weekday())+5)%7]
+
+	for _, period := range p.Blanking {
+		off, errOff := parseClock(period.Off)
+		on, errOn := parseClock(period.On)
+		if errOff != nil || errOn != nil {
+			continue
+		}
+
+		onDay := func(day string) bool {
+			return len(period.Days) == 0 || slices.Contains(period.Days, day)
+		}
+		if off < on {
+			if onDay(today) && minute >= off && minute < on {
+				return true
+			}
+			continue
+		}
+		// Periods over midnight start on their days and end the next one
+		if (onDay(today) && minute >= off) || (onDay(yesterday) && minute < on) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseClock returns the minute of the day of a time as HH:MM
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Screenshot is a picture of the kiosk display in PNG format, sent back in
+// the "screenshot" data of the response to CmdScreenshot
+type Screenshot struct {
+	Image []byte    `json:"image"`
+	Taken time.Time `json:"taken"`
+}
@@ -0,0 +1,70 @@
+package protocol
+
+import "time"
+
+// Sources of disk health
+const (
+	DiskHealthSMART = "smart" // smartctl
+	DiskHealthEMMC  = "emmc"  // Wear and end of life attributes of eMMC storage
+)
+
+// Types of power supplies
+const (
+	PowerBattery = "Battery"
+	PowerUPS     = "UPS"
+	PowerMains   = "Mains"
+)
+
+// Status of a battery that is powering the device
+const PowerDischarging = "Discharging"
+
+// HostHealth is the hardware health of a device reported with the system
+// metrics of heartbeats. Devices without thermal zones, disks whose health
+// can be read or power supplies leave the parts out.
+type HostHealth struct {
+	Temperatures map[string]float64 `json:"temperatures,omitempty"` // Degrees Celsius by thermal zone
+	Disks        []DiskHealth       `json:"disks,omitempty"`
+	Power        []PowerSupply      `json:"power,omitempty"`
+	Protection   *Protection        `json:"protection,omitempty"` // Nil unless the agent protects itself
+}
+
+// Protection is the state of the cgroup protection that keeps the agent and
+// the Docker daemon running when applications use up the memory or CPU of a
+// device
+type Protection struct {
+	Units     []string  `json:"units"`           // Units protected, e.g. docker.service
+	OK        bool      `json:"ok"`              // Every unit had its protection after the last check
+	Drift     []string  `json:"drift,omitempty"` // What was off at the last check and repaired, e.g. docker.service MemoryMin
+	Repairs   int       `json:"repairs"`         // Checks that found drift since the agent started
+	Error     string    `json:"error,omitempty"` // Why the protection could not be applied
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// DiskHealth is the health of a disk as SMART or the kernel report it.
+// Disks whose health cannot be read, e.g. USB sticks, are left out.
+type DiskHealth struct {
+	Name         string   `json:"name"` // e.g. sda, nvme0n1, mmcblk0
+	Model        string   `json:"model,omitempty"`
+	Source       string   `json:"source"`                // smart or emmc
+	Healthy      bool     `json:"healthy"`               // SMART passed, or eMMC not near its end of life
+	Temperature  *float64 `json:"temperature,omitempty"` // Degrees Celsius
+	PowerOnHours int      `json:"power_on_hours,omitempty"`
+	PercentUsed  *int     `json:"percent_used,omitempty"` // Estimated wear of flash storage
+	Reallocated  int      `json:"reallocated,omitempty"`  // Reallocated sectors
+}
+
+// PowerSupply is a battery, UPS or mains supply of a device
+type PowerSupply struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`               // Battery, UPS or Mains
+	Status   string `json:"status,omitempty"`   // e.g. Charging, Discharging, Full
+	Capacity *int   `json:"capacity,omitempty"` // Percent charged
+	Health   string `json:"health,omitempty"`   // e.g. Good, Overheat, Dead
+	Online   *bool  `json:"online,omitempty"`   // Whether mains power is present
+}
+
+// OnBattery reports whether the supply is a battery or UPS powering the
+// device
+func (p *PowerSupply) OnBattery() bool {
+	return (p.Type == PowerBattery || p.Type == PowerUPS) && p.Status == PowerDischarging
+}
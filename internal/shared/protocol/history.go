@@ -0,0 +1,47 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"hash"
+	"sort"
+)
+
+// ComposeHash identifies the compose file and overrides a deployment applied,
+// as sha256:<hex>. The server and the agent record it in their deployment
+// history, so that deployments of the same configuration can be recognized.
+func ComposeHash(composeConfig string, overrides []string) string {
+	h := sha256.New()
+	writeField(h, composeConfig)
+	for _, override := range overrides {
+		writeField(h, override)
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// EnvHash identifies the env vars a deployment applied, as sha256:<hex>,
+// without revealing their values
+func EnvHash(envVars map[string]string) string {
+	keys := make([]string, 0, len(envVars))
+	for key := range envVars {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	for _, key := range keys {
+		writeField(h, key)
+		writeField(h, envVars[key])
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// writeField writes a length-prefixed field, so that moving text between
+// fields changes the hash
+func writeField(h hash.Hash, field string) {
+	var length [8]byte
+	binary.LittleEndian.PutUint64(length[:], uint64(len(field)))
+	h.Write(length[:])
+	h.Write([]byte(field))
+}
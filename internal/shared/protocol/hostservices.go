@@ -0,0 +1,58 @@
+package protocol
+
+import (
+	"fmt"
+	"time"
+)
+
+// MaxHostServices is the most host services an agent reports per heartbeat
+const MaxHostServices = 64
+
+// Kinds of host services
+const (
+	HostServiceUnit    = "unit"    // A systemd unit
+	HostServiceProcess = "process" // A process found by name
+)
+
+// States of host services. Units report the active state of systemd,
+// processes are active while one runs by their name.
+const (
+	HostServiceActive       = "active"
+	HostServiceReloading    = "reloading"
+	HostServiceInactive     = "inactive"
+	HostServiceFailed       = "failed"
+	HostServiceActivating   = "activating"
+	HostServiceDeactivating = "deactivating"
+)
+
+// HostService is the state of a host daemon the agent monitors, e.g.
+// NetworkManager or wg-quick, reported in heartbeats
+type HostService struct {
+	Name        string     `json:"name"` // Unit name, e.g. NetworkManager.service, or process name
+	Kind        string     `json:"kind"` // unit or process
+	State       string     `json:"state"`
+	SubState    string     `json:"sub_state,omitempty"` // Of units, e.g. running, exited, dead
+	PID         int        `json:"pid,omitempty"`       // Main process, 0 if none runs
+	Restarts    int        `json:"restarts,omitempty"`  // Automatic restarts of units by systemd
+	Since       *time.Time `json:"since,omitempty"`     // When units entered their state
+	Restartable bool       `json:"restartable"`         // The server may restart it with CmdRestartHostService
+}
+
+// Up reports whether the service runs or is about to
+func (s *HostService) Up() bool {
+	return s.State == HostServiceActive || s.State == HostServiceReloading || s.State == HostServiceActivating
+}
+
+// RestartHostServicePayload names the host service restarted by
+// CmdRestartHostService
+type RestartHostServicePayload struct {
+	Name string `json:"name"` // Unit name as the agent reports it
+}
+
+// Validate checks the payload
+func (p *RestartHostServicePayload) Validate() error {
+	if p.Name == "" || len(p.Name) > 256 {
+		return fmt.Errorf("service name is required, at most 256 characters")
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package protocol
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// JournalKernel selects kernel messages in the journald units an agent
+// ships
+const JournalKernel = "kernel"
+
+// MaxJournalBatch is the most journal entries sent in a single request, and
+// MaxJournalMessage the longest message kept of an entry
+const (
+	MaxJournalBatch   = 200
+	MaxJournalMessage = 4096
+)
+
+// JournalPriorities are the syslog priorities of journal entries by value,
+// from the most severe
+var JournalPriorities = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+// ParsePriority reads a journal priority given by name or value
+func ParsePriority(priority string) (int, error) {
+	if value := slices.Index(JournalPriorities, priority); value >= 0 {
+		return value, nil
+	}
+	value, err := strconv.Atoi(priority)
+	if err != nil || value < 0 || value >= len(JournalPriorities) {
+		return 0, fmt.Errorf("invalid priority %q, use 0-7 or one of %v", priority, JournalPriorities)
+	}
+	return value, nil
+}
+
+// JournalEntry is a message of a journald unit of the host
+type JournalEntry struct {
+	Unit     string    `json:"unit"`     // e.g. sshd.service, or kernel
+	Priority int       `json:"priority"` // 0 (emerg) to 7 (debug)
+	Message  string    `json:"message"`
+	Time     time.Time `json:"time"` // When journald received it
+}
+
+// JournalBatch carries journal entries shipped by an agent with
+// RequestJournal, oldest first
+type JournalBatch struct {
+	Entries []JournalEntry `json:"entries"`
+}
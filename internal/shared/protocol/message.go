@@ -0,0 +1,250 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Messages over the tunnel are JSON. Once both ends announced
+// FeatureCompression with RequestFeatures, messages larger than
+// CompressThreshold are gzipped, and global requests that still do not fit in
+// MaxChunkData are split into RequestChunk requests that the server
+// reassembles. Receivers tell gzipped messages from plain JSON by the gzip
+// magic bytes, so plain messages from older peers are still understood.
+const (
+	CompressThreshold = 4 * 1024         // Smaller messages are not worth compressing
+	MaxChunkData      = 64 * 1024        // Largest payload of a single global request
+	MaxMessageSize    = 64 * 1024 * 1024 // Largest message once decompressed
+	MaxChunkedSize    = 16 * 1024 * 1024 // Largest chunked message before decompression
+	MaxPendingChunked = 8                // Chunked messages being reassembled at once per connection
+	ChunkTimeout      = 2 * time.Minute  // Unfinished chunked messages are dropped after this long
+)
+
+// ErrMessageTooLarge is returned for messages exceeding the size limits
+var ErrMessageTooLarge = errors.New("message too large")
+
+// gzipMagic starts every gzip stream, and never a JSON document
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// FeaturesReply answers RequestFeatures with the features of the server
+type FeaturesReply struct {
+	Features []string `json:"features"`
+}
+
+// MessageChunk is one part of a global request too large for a single
+// request. Data holds a slice of the compressed message.
+type MessageChunk struct {
+	ID    string `json:"id"`
+	Type  string `json:"type"` // Request type of the reassembled message
+	Part  int    `json:"part"`
+	Parts int    `json:"parts"`
+	Data  []byte `json:"data"`
+}
+
+// Compress gzips a message larger than CompressThreshold, smaller ones are
+// returned as is
+func Compress(data []byte) ([]byte, error) {
+	if len(data) <= CompressThreshold {
+		return data, nil
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(data); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress returns a message as plain JSON, gunzipping it when compressed
+func Decompress(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, gzipMagic) {
+		if len(data) > MaxMessageSize {
+			return nil, ErrMessageTooLarge
+		}
+		return data, nil
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress message: %w", err)
+	}
+	defer gz.Close()
+
+	return readLimited(gz)
+}
+
+// WriteMessage writes a message to a channel as JSON, gzipped when compress
+// is set and the message is large enough
+func WriteMessage(w io.Writer, v interface{}, compress bool) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if compress {
+		if data, err = Compress(data); err != nil {
+			return err
+		}
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// ReadMessage reads a message written by WriteMessage, or a plain JSON
+// message of an older peer, from a channel
+func ReadMessage(r io.Reader, v interface{}) error {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(gzipMagic))
+	if err != nil && len(magic) == 0 {
+		return err
+	}
+
+	var src io.Reader = br
+	if bytes.Equal(magic, gzipMagic) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("failed to decompress message: %w", err)
+		}
+		defer gz.Close()
+		src = gz
+	}
+
+	decoder := json.NewDecoder(&limitedReader{r: src, n: MaxMessageSize})
+	return decoder.Decode(v)
+}
+
+// SplitMessage splits a compressed message into chunks of at most
+// MaxChunkData bytes, to be sent as RequestChunk requests
+func SplitMessage(id, requestType string, data []byte) []MessageChunk {
+	parts := (len(data) + MaxChunkData - 1) / MaxChunkData
+	chunks := make([]MessageChunk, 0, parts)
+	for i := 0; i < parts; i++ {
+		end := min((i+1)*MaxChunkData, len(data))
+		chunks = append(chunks, MessageChunk{
+			ID:    id,
+			Type:  requestType,
+			Part:  i + 1,
+			Parts: parts,
+			Data:  data[i*MaxChunkData : end],
+		})
+	}
+	return chunks
+}
+
+// Reassembler collects the chunks of messages split by SplitMessage. Chunks
+// of a message must arrive in order, which SSH guarantees for the global
+// requests of a connection.
+type Reassembler struct {
+	mu      sync.Mutex
+	pending map[string]*pendingMessage
+}
+
+type pendingMessage struct {
+	requestType string
+	parts       int
+	next        int // Part expected next
+	data        []byte
+	started     time.Time
+}
+
+// NewReassembler creates an empty reassembler
+func NewReassembler() *Reassembler {
+	return &Reassembler{pending: make(map[string]*pendingMessage)}
+}
+
+// Add adds a chunk and returns the decompressed message once its last chunk
+// arrived, nil before that. A chunk that is out of order or exceeds the
+// limits drops the message it belongs to.
+func (r *Reassembler) Add(chunk *MessageChunk) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.expire()
+
+	if chunk.Parts < 1 || chunk.Parts > MaxChunkedSize/MaxChunkData+1 {
+		return nil, fmt.Errorf("invalid chunk count %d", chunk.Parts)
+	}
+
+	msg, ok := r.pending[chunk.ID]
+	if !ok {
+		if chunk.Part != 1 {
+			return nil, fmt.Errorf("chunk %d of unknown message %s", chunk.Part, chunk.ID)
+		}
+		if len(r.pending) >= MaxPendingChunked {
+			return nil, fmt.Errorf("too many chunked messages in progress")
+		}
+		msg = &pendingMessage{requestType: chunk.Type, parts: chunk.Parts, next: 1, started: time.Now()}
+		r.pending[chunk.ID] = msg
+	}
+
+	fail := func(err error) ([]byte, error) {
+		delete(r.pending, chunk.ID)
+		return nil, err
+	}
+
+	if chunk.Type != msg.requestType || chunk.Parts != msg.parts || chunk.Part != msg.next {
+		return fail(fmt.Errorf("chunk %d/%d does not continue message %s", chunk.Part, chunk.Parts, chunk.ID))
+	}
+	if len(chunk.Data) > MaxChunkData || len(msg.data)+len(chunk.Data) > MaxChunkedSize {
+		return fail(ErrMessageTooLarge)
+	}
+	msg.data = append(msg.data, chunk.Data...)
+	msg.next++
+
+	if chunk.Part < chunk.Parts {
+		return nil, nil
+	}
+
+	delete(r.pending, chunk.ID)
+	return Decompress(msg.data)
+}
+
+// expire drops messages that did not complete within ChunkTimeout
+func (r *Reassembler) expire() {
+	for id, msg := range r.pending {
+		if time.Since(msg.started) > ChunkTimeout {
+			delete(r.pending, id)
+		}
+	}
+}
+
+// readLimited reads everything from r, failing beyond MaxMessageSize
+func readLimited(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, MaxMessageSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress message: %w", err)
+	}
+	if len(data) > MaxMessageSize {
+		return nil, ErrMessageTooLarge
+	}
+	return data, nil
+}
+
+// limitedReader fails with ErrMessageTooLarge once more than n bytes were
+// read, where io.LimitReader would end the stream silently
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		return 0, ErrMessageTooLarge
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
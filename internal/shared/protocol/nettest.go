@@ -0,0 +1,191 @@
+package protocol
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// Network tests run by CmdNetworkTest
+const (
+	TestPing       = "ping"
+	TestTraceroute = "traceroute"
+	TestDNS        = "dns"
+	TestBandwidth  = "bandwidth"
+)
+
+// Directions of bandwidth tests
+const (
+	BandwidthDownload = "download"
+	BandwidthUpload   = "upload"
+)
+
+// Defaults and bounds of network test parameters
+const (
+	DefaultPingCount      = 4
+	MaxPingCount          = 20
+	DefaultTracerouteHops = 30
+	MaxTracerouteHops     = 64
+	DefaultBandwidthBytes = 10 * 1024 * 1024
+	MaxBandwidthBytes     = 100 * 1024 * 1024
+	MaxNetworkTestTimeout = 120 // Seconds
+	DefaultNetworkTimeout = 30  // Seconds
+)
+
+// DNS record types a DNS test can look up
+var dnsRecordTypes = []string{"A", "AAAA", "CNAME", "MX", "NS", "TXT", "PTR"}
+
+// NetworkTestPayload runs a network test from the device towards a target
+type NetworkTestPayload struct {
+	Test       string `json:"test"`                  // ping, traceroute, dns or bandwidth
+	Target     string `json:"target"`                // Host name or address, the URL of a bandwidth test
+	Count      int    `json:"count,omitempty"`       // ping: probes to send
+	Port       int    `json:"port,omitempty"`        // ping: probe with TCP connections to this port instead of ICMP
+	MaxHops    int    `json:"max_hops,omitempty"`    // traceroute: hops to probe at most
+	RecordType string `json:"record_type,omitempty"` // dns: A, AAAA, CNAME, MX, NS, TXT or PTR, A if empty
+	Server     string `json:"server,omitempty"`      // dns: resolver to ask as host[:port], empty for the system resolver
+	Direction  string `json:"direction,omitempty"`   // bandwidth: download or upload, download if empty
+	Bytes      int64  `json:"bytes,omitempty"`       // bandwidth: bytes to transfer at most
+	Timeout    int    `json:"timeout,omitempty"`     // Seconds the test may take
+}
+
+// Normalize checks a network test and fills in the defaults of parameters
+// left empty
+func (p *NetworkTestPayload) Normalize() error {
+	p.Target = strings.TrimSpace(p.Target)
+	if p.Target == "" {
+		return fmt.Errorf("target is required")
+	}
+	if strings.HasPrefix(p.Target, "-") {
+		return fmt.Errorf("invalid target %q", p.Target)
+	}
+
+	if p.Timeout == 0 {
+		p.Timeout = DefaultNetworkTimeout
+	}
+	if p.Timeout < 0 || p.Timeout > MaxNetworkTestTimeout {
+		return fmt.Errorf("timeout must be between 1 and %d seconds", MaxNetworkTestTimeout)
+	}
+
+	switch p.Test {
+	case TestPing:
+		if p.Count == 0 {
+			p.Count = DefaultPingCount
+		}
+		if p.Count < 0 || p.Count > MaxPingCount {
+			return fmt.Errorf("count must be between 1 and %d", MaxPingCount)
+		}
+		if p.Port < 0 || p.Port > 65535 {
+			return fmt.Errorf("invalid port %d", p.Port)
+		}
+	case TestTraceroute:
+		if p.MaxHops == 0 {
+			p.MaxHops = DefaultTracerouteHops
+		}
+		if p.MaxHops < 0 || p.MaxHops > MaxTracerouteHops {
+			return fmt.Errorf("max_hops must be between 1 and %d", MaxTracerouteHops)
+		}
+	case TestDNS:
+		p.RecordType = strings.ToUpper(p.RecordType)
+		if p.RecordType == "" {
+			p.RecordType = "A"
+		}
+		if !slices.Contains(dnsRecordTypes, p.RecordType) {
+			return fmt.Errorf("record_type must be one of %s", strings.Join(dnsRecordTypes, ", "))
+		}
+		if p.RecordType == "PTR" && net.ParseIP(p.Target) == nil {
+			return fmt.Errorf("PTR lookups need an IP address as target")
+		}
+	case TestBandwidth:
+		u, err := url.Parse(p.Target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("bandwidth tests need an http or https URL as target")
+		}
+		if p.Direction == "" {
+			p.Direction = BandwidthDownload
+		}
+		if p.Direction != BandwidthDownload && p.Direction != BandwidthUpload {
+			return fmt.Errorf("direction must be %s or %s", BandwidthDownload, BandwidthUpload)
+		}
+		if p.Bytes == 0 {
+			p.Bytes = DefaultBandwidthBytes
+		}
+		if p.Bytes < 0 || p.Bytes > MaxBandwidthBytes {
+			return fmt.Errorf("bytes must be between 1 and %d", MaxBandwidthBytes)
+		}
+	default:
+		return fmt.Errorf("unknown test %q, use %s, %s, %s or %s", p.Test, TestPing, TestTraceroute, TestDNS, TestBandwidth)
+	}
+	return nil
+}
+
+// NetworkTestResult is the outcome of a network test. Only the field of the
+// test that ran is set.
+type NetworkTestResult struct {
+	Test       string           `json:"test"`
+	Target     string           `json:"target"`
+	Seconds    float64          `json:"seconds"` // Time the test took
+	Ping       *PingResult      `json:"ping,omitempty"`
+	Traceroute []TracerouteHop  `json:"traceroute,omitempty"`
+	DNS        *DNSResult       `json:"dns,omitempty"`
+	Bandwidth  *BandwidthResult `json:"bandwidth,omitempty"`
+}
+
+// PingResult summarises the probes of a ping test. Round trip times are in
+// milliseconds and zero when no probe was answered.
+type PingResult struct {
+	Protocol    string    `json:"protocol"`          // icmp or tcp
+	Address     string    `json:"address,omitempty"` // Address the target resolved to
+	Sent        int       `json:"sent"`
+	Received    int       `json:"received"`
+	LossPercent float64   `json:"loss_percent"`
+	RTTs        []float64 `json:"rtt_ms"` // Of the answered probes, in order
+	MinRTT      float64   `json:"min_rtt_ms"`
+	AvgRTT      float64   `json:"avg_rtt_ms"`
+	MaxRTT      float64   `json:"max_rtt_ms"`
+}
+
+// Summarize sets the loss and round trip statistics from Sent and RTTs
+func (r *PingResult) Summarize() {
+	r.Received = len(r.RTTs)
+	r.MinRTT, r.AvgRTT, r.MaxRTT = 0, 0, 0
+	if r.Sent > 0 {
+		r.LossPercent = 100 * float64(r.Sent-r.Received) / float64(r.Sent)
+	}
+	for i, rtt := range r.RTTs {
+		if i == 0 || rtt < r.MinRTT {
+			r.MinRTT = rtt
+		}
+		if rtt > r.MaxRTT {
+			r.MaxRTT = rtt
+		}
+		r.AvgRTT += rtt / float64(len(r.RTTs))
+	}
+}
+
+// TracerouteHop is a hop on the path to a traceroute target
+type TracerouteHop struct {
+	Hop       int       `json:"hop"`
+	Addresses []string  `json:"addresses"` // Routers that answered, usually one, none if all probes were lost
+	RTTs      []float64 `json:"rtt_ms"`    // Of the answered probes
+	Lost      int       `json:"lost"`      // Probes that were not answered
+}
+
+// DNSResult lists the records a DNS test found
+type DNSResult struct {
+	RecordType string   `json:"record_type"`
+	Server     string   `json:"server,omitempty"` // Empty for the system resolver
+	Records    []string `json:"records"`
+	Millis     float64  `json:"ms"` // Time the lookup took
+}
+
+// BandwidthResult is the throughput of a bandwidth test
+type BandwidthResult struct {
+	Direction string  `json:"direction"`
+	Status    int     `json:"status"` // HTTP status of the response
+	Bytes     int64   `json:"bytes"`  // Bytes transferred
+	Seconds   float64 `json:"seconds"`
+	Mbps      float64 `json:"mbps"` // Megabits per second
+}
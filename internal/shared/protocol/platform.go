@@ -0,0 +1,111 @@
+package protocol
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Platforms the agent and servers are built for, as Docker names them
+const (
+	PlatformAMD64 = "linux/amd64"
+	PlatformARM64 = "linux/arm64"
+	PlatformARMv7 = "linux/arm/v7"
+	PlatformARMv6 = "linux/arm/v6"
+)
+
+// architectures maps the names of CPU architectures used by uname, Go,
+// Debian and Docker to the platform Docker pulls images for
+var architectures = map[string]string{
+	"amd64":    PlatformAMD64,
+	"x86_64":   PlatformAMD64,
+	"x86-64":   PlatformAMD64,
+	"arm64":    PlatformARM64,
+	"aarch64":  PlatformARM64,
+	"arm64/v8": PlatformARM64,
+	"armv8":    PlatformARM64,
+	"arm":      PlatformARMv7,
+	"armhf":    PlatformARMv7,
+	"armv7":    PlatformARMv7,
+	"armv7l":   PlatformARMv7,
+	"arm/v7":   PlatformARMv7,
+	"armel":    PlatformARMv6,
+	"armv6":    PlatformARMv6,
+	"armv6l":   PlatformARMv6,
+	"arm/v6":   PlatformARMv6,
+	"arm/v5":   "linux/arm/v5",
+	"386":      "linux/386",
+	"i386":     "linux/386",
+	"i686":     "linux/386",
+	"ppc64le":  "linux/ppc64le",
+	"s390x":    "linux/s390x",
+	"riscv64":  "linux/riscv64",
+}
+
+// NormalizePlatform turns a platform or architecture name, e.g. aarch64,
+// armhf or linux/arm/v7, into the platform Docker uses, os/arch[/variant].
+// Platforms without an os are taken to be Linux.
+func NormalizePlatform(platform string) (string, error) {
+	name := strings.ToLower(strings.TrimSpace(platform))
+	name = strings.TrimPrefix(name, "linux/")
+	if normalized, ok := architectures[name]; ok {
+		return normalized, nil
+	}
+	return "", fmt.Errorf("unknown platform %q", platform)
+}
+
+// NormalizePlatforms normalizes a list of platforms, dropping duplicates.
+// Nil stays nil, telling an empty list apart from one that was not given.
+func NormalizePlatforms(platforms []string) ([]string, error) {
+	if platforms == nil {
+		return nil, nil
+	}
+	normalized := make([]string, 0, len(platforms))
+	for _, platform := range platforms {
+		p, err := NormalizePlatform(platform)
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Contains(normalized, p) {
+			normalized = append(normalized, p)
+		}
+	}
+	return normalized, nil
+}
+
+// PlatformRuns reports whether a device of a platform runs images built for
+// another, both as os/arch[/variant]. ARM CPUs run images of older ARM
+// variants, so a linux/arm/v7 device runs linux/arm/v6 images. Images
+// without a variant run on every variant of their architecture, and the
+// variants of other architectures, e.g. arm64/v8, are not told apart.
+func PlatformRuns(device, image string) bool {
+	if device == image {
+		return true
+	}
+
+	deviceOS, deviceArch, _ := strings.Cut(device, "/")
+	imageOS, imageArch, _ := strings.Cut(image, "/")
+	deviceArch, deviceVariant, _ := strings.Cut(deviceArch, "/")
+	imageArch, imageVariant, _ := strings.Cut(imageArch, "/")
+	if deviceOS != imageOS || deviceArch != imageArch {
+		return false
+	}
+	if imageVariant == "" || deviceArch != "arm" {
+		return true
+	}
+	// Variants of arm are v5, v6 and v7, which compare as strings
+	return imageVariant <= deviceVariant
+}
+
+// PlatformsRun reports whether a device running images of some platforms
+// runs one of the platforms of an image or software
+func PlatformsRun(device, image []string) bool {
+	for _, d := range device {
+		for _, i := range image {
+			if PlatformRuns(d, i) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+)
+
+// MaxPluginSettings is the largest settings document of a plugin, and
+// MaxPluginMetrics the most metrics a plugin reports per heartbeat
+const (
+	MaxPluginSettings = 64 * 1024
+	MaxPluginMetrics  = 100
+)
+
+// pluginName matches the names of plugins, their actions and metrics
+var pluginName = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,63}$`)
+
+// ValidatePluginName checks the name of a plugin, action or metric
+func ValidatePluginName(name string) error {
+	if !pluginName.MatchString(name) {
+		return fmt.Errorf("invalid name %q, use up to 64 lowercase letters, digits, '_', '.' and '-'", name)
+	}
+	return nil
+}
+
+// ValidatePluginSettings checks the settings of plugins by plugin name. Each
+// must be a JSON object.
+func ValidatePluginSettings(settings map[string]json.RawMessage) error {
+	for name, raw := range settings {
+		if err := ValidatePluginName(name); err != nil {
+			return err
+		}
+		if len(raw) > MaxPluginSettings {
+			return fmt.Errorf("settings of plugin %s exceed %d bytes", name, MaxPluginSettings)
+		}
+		var object map[string]interface{}
+		if err := json.Unmarshal(raw, &object); err != nil || object == nil {
+			return fmt.Errorf("settings of plugin %s must be a JSON object", name)
+		}
+	}
+	return nil
+}
+
+// PluginInfo describes a plugin installed on a device, as it describes
+// itself
+type PluginInfo struct {
+	Name    string   `json:"name"`
+	Version string   `json:"version,omitempty"`
+	Actions []string `json:"actions"`         // Actions the plugin runs with CmdPluginAction
+	Metrics bool     `json:"metrics"`         // The plugin reports metrics with heartbeats
+	Error   string   `json:"error,omitempty"` // Why the plugin could not be described or its last metrics not collected
+}
+
+// PluginsPayload sets the settings of the plugins of a device. Plugins not
+// listed get empty settings.
+type PluginsPayload struct {
+	Settings map[string]json.RawMessage `json:"settings"`
+}
+
+// PluginActionPayload runs an action of a plugin
+type PluginActionPayload struct {
+	Plugin string          `json:"plugin"`
+	Action string          `json:"action"`
+	Params json.RawMessage `json:"params,omitempty"` // JSON object handed to the plugin
+}
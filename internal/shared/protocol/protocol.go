@@ -1,6 +1,9 @@
 package protocol
 
 import (
+	"encoding/json"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -13,6 +16,65 @@ const (
 	DefaultEndPort   = 20000
 )
 
+// SSH request and channel types used over the tunnel
+const (
+	ChannelCommand   = "command@edgetainer"     // Server to agent command channel
+	RequestKeepalive = "keepalive@edgetainer"   // Agent keepalive probe
+	RequestHeartbeat = "heartbeat@edgetainer"   // Agent heartbeat
+	RequestShutdown  = "shutdown@edgetainer"    // Agent final state report before disconnecting
+	RequestLogs      = "logs@edgetainer"        // Agent rotated log file upload
+	RequestPull      = "pull@edgetainer"        // Agent image pull progress during a deployment
+	RequestStage     = "stage@edgetainer"       // Agent deployment stage during a deployment
+	RequestTime      = "time@edgetainer"        // Agent clock check, answered with the server time
+	RequestCert      = "cert@edgetainer"        // Agent request for a device certificate
+	RequestFeatures  = "features@edgetainer"    // Agent features, answered with the server features
+	RequestChunk     = "chunk@edgetainer"       // Part of an agent request too large for a single one
+	RequestAck       = "ack@edgetainer"         // Agent acknowledgement of a command, sent on its command channel
+	RequestBundle    = "diagnostics@edgetainer" // Agent diagnostics bundle upload
+	RequestCapture   = "capture@edgetainer"     // Agent packet capture upload
+	RequestJournal   = "journal@edgetainer"     // Agent journald entries of the host
+	RequestAutonomy  = "autonomy@edgetainer"    // Agent events of what it did without the server
+	ChannelArtifact  = "artifact@edgetainer"    // Agent to server channel streaming a software artifact
+
+	// Server to agent channels of forwarded connections, as defined for
+	// OpenSSH
+	ChannelDirectTCP  = "direct-tcpip"                   // To a TCP address reachable from the device
+	ChannelDirectUnix = "direct-streamlocal@openssh.com" // To a unix socket on the device
+	ChannelDirectUDP  = "direct-udp@edgetainer"          // To a UDP address reachable from the device, carrying length-prefixed datagrams
+)
+
+// DirectTCPPayload is the payload of a direct-tcpip channel open request
+type DirectTCPPayload struct {
+	Host       string
+	Port       uint32
+	OriginHost string
+	OriginPort uint32
+}
+
+// DirectUDPPayload is the payload of a direct-udp channel open request
+type DirectUDPPayload struct {
+	Host string
+	Port uint32
+}
+
+// DirectUnixPayload is the payload of a direct-streamlocal channel open
+// request
+type DirectUnixPayload struct {
+	SocketPath string
+	Reserved   string
+	Reserved2  uint32
+}
+
+// MaxLogChunk is the largest amount of log data sent in a single request
+const MaxLogChunk = 32 * 1024
+
+// MaxBundleChunk is the largest amount of diagnostics bundle data sent in a
+// single request, and MaxBundleSize the largest bundle the server accepts
+const (
+	MaxBundleChunk = 32 * 1024
+	MaxBundleSize  = 32 * 1024 * 1024
+)
+
 // Status constants for heartbeat messages
 const (
 	StatusOK       = "ok"
@@ -22,13 +84,69 @@ const (
 
 // Command types for server to agent communication
 const (
-	CmdDeploy       = "deploy"
-	CmdUndeploy     = "undeploy"
-	CmdUpdateEnvVar = "update_env_var"
-	CmdRestart      = "restart"
-	CmdExecute      = "execute"
-	CmdGetStatus    = "get_status"
-	CmdGetLogs      = "get_logs"
+	CmdDeploy             = "deploy"
+	CmdUndeploy           = "undeploy"
+	CmdUpdateEnvVar       = "update_env_var"
+	CmdRestart            = "restart"
+	CmdExecute            = "execute"
+	CmdGetStatus          = "get_status"
+	CmdGetLogs            = "get_logs"
+	CmdDecommission       = "decommission"
+	CmdCheckCache         = "check_cache"
+	CmdRestartApp         = "restart_app"
+	CmdConfigureNTP       = "configure_ntp"
+	CmdSetTimezone        = "set_timezone"
+	CmdAppAction          = "app_action"
+	CmdAdoptApp           = "adopt_app"
+	CmdDiagnostics        = "collect_diagnostics"
+	CmdNetworkTest        = "network_test"
+	CmdCapture            = "capture"
+	CmdPlugins            = "configure_plugins"
+	CmdPluginAction       = "plugin_action"
+	CmdDisplay            = "configure_display"
+	CmdScreenshot         = "screenshot"
+	CmdRestartHostService = "restart_host_service"
+	CmdRestorePoint       = "create_restore_point"
+	CmdRestore            = "restore"
+	CmdDeleteRestorePoint = "delete_restore_point"
+	CmdStageUpdate        = "stage_update"
+	CmdUnstageUpdate      = "unstage_update"
+	CmdActivateUpdate     = "activate_update"
+)
+
+// Shutdown policies applied to running applications when the agent stops
+const (
+	ShutdownLeaveRunning    = "leave-running"
+	ShutdownStopApps        = "stop-apps"
+	ShutdownStopNonCritical = "stop-non-critical"
+)
+
+// IsShutdownPolicy reports whether the given string is a known shutdown policy
+func IsShutdownPolicy(policy string) bool {
+	switch policy {
+	case ShutdownLeaveRunning, ShutdownStopApps, ShutdownStopNonCritical:
+		return true
+	}
+	return false
+}
+
+// What the server does about a device reporting other hardware than it is
+// bound to
+const (
+	HardwareAlert  = "alert"  // Fire an alert and keep the connection
+	HardwareReject = "reject" // Fire an alert and close the connection
+)
+
+// IsHardwareBinding reports whether the given string is a known hardware
+// binding mode
+func IsHardwareBinding(mode string) bool {
+	return mode == HardwareAlert || mode == HardwareReject
+}
+
+// Shutdown reasons reported to the server
+const (
+	ShutdownReasonSignal       = "signal"
+	ShutdownReasonDecommission = "decommission"
 )
 
 // Response types for agent to server communication
@@ -42,10 +160,22 @@ const (
 
 // Command represents a message sent from server to agent
 type Command struct {
-	ID        string                 `json:"id"`
-	Type      string                 `json:"type"`
-	Timestamp time.Time              `json:"timestamp"`
-	Payload   map[string]interface{} `json:"payload"`
+	ID          string                 `json:"id"`
+	Type        string                 `json:"type"`
+	Timestamp   time.Time              `json:"timestamp"`
+	Payload     map[string]interface{} `json:"payload"`
+	TraceParent string                 `json:"traceparent,omitempty"` // W3C trace context of the sender
+	Seq         uint64                 `json:"seq,omitempty"`         // Per device sequence number, kept when the command is resent
+}
+
+// CommandAck acknowledges or rejects a command before the agent executes it.
+// A resent command the agent already received is acknowledged again and
+// answered with the response of its first execution.
+type CommandAck struct {
+	ID       string `json:"id"`
+	Seq      uint64 `json:"seq"`
+	Accepted bool   `json:"accepted"`
+	Reason   string `json:"reason,omitempty"` // Why the command was rejected
 }
 
 // Response represents a message sent from agent to server
@@ -56,33 +186,283 @@ type Response struct {
 	Success   bool                   `json:"success"`
 	Message   string                 `json:"message,omitempty"`
 	Data      map[string]interface{} `json:"data,omitempty"`
+	Duplicate bool                   `json:"duplicate,omitempty"` // Answered from an earlier execution of the same command
 }
 
 // Heartbeat represents a periodic check-in message from agent
 type Heartbeat struct {
-	DeviceID   string                 `json:"device_id"`
-	Status     string                 `json:"status"`
-	Timestamp  time.Time              `json:"timestamp"`
-	IP         string                 `json:"ip"`
-	Version    string                 `json:"version"`
-	Metrics    map[string]interface{} `json:"metrics,omitempty"`
-	Containers []ContainerStatus      `json:"containers,omitempty"`
+	DeviceID     string                 `json:"device_id"`
+	Status       string                 `json:"status"`
+	Timestamp    time.Time              `json:"timestamp"`
+	IP           string                 `json:"ip"`                  // IPv4 address of the device, or its IPv6 address if it has none
+	Addresses    []string               `json:"addresses,omitempty"` // Every IPv4 and IPv6 address of the device but loopback and link-local ones
+	Version      string                 `json:"version"`
+	Metrics      map[string]interface{} `json:"metrics,omitempty"`
+	Containers   []ContainerStatus      `json:"containers"`                   // Of the applications, nil if the device was not scanned
+	ClockSkew    *float64               `json:"clock_skew_seconds,omitempty"` // Device clock minus server clock, nil if not measured
+	Location     *GeoLocation           `json:"location,omitempty"`           // Last position fix, nil without a location source
+	Unmanaged    []Workload             `json:"unmanaged"`                    // Workloads not deployed by the agent, nil if the device was not scanned
+	HardwareID   string                 `json:"hardware_id,omitempty"`        // Hash identifying the device hardware, empty unless attestation is enabled
+	Build        *BuildInfo             `json:"build,omitempty"`              // Not sent by agents older than build reporting
+	Plugins      []PluginInfo           `json:"plugins,omitempty"`            // Installed plugins, nil if plugins are disabled
+	USB          []USBDevice            `json:"usb"`                          // Connected USB devices, nil if the device was not scanned
+	HostServices []HostService          `json:"host_services,omitempty"`      // Monitored host services, nil if none are monitored
+	Platforms    []string               `json:"platforms,omitempty"`          // Platforms the device runs images of, its own first, nil from older agents
+	OS           *OSInfo                `json:"os,omitempty"`                 // Operating system of the host, nil if it could not be read
+	// Metrics reported by plugins, by plugin and metric name
+	PluginMetrics map[string]map[string]float64 `json:"plugin_metrics,omitempty"`
+}
+
+// Kinds of workloads found on a device
+const (
+	WorkloadCompose   = "compose"   // A docker-compose project
+	WorkloadContainer = "container" // A container started without compose
+)
+
+// Workload is a compose project or standalone container running on a device
+// that was not deployed by the agent
+type Workload struct {
+	Kind        string            `json:"kind"`
+	Name        string            `json:"name"`                   // Project or container name
+	WorkingDir  string            `json:"working_dir,omitempty"`  // Directory the project was started from
+	ConfigFiles []string          `json:"config_files,omitempty"` // Compose files of the project
+	Containers  []ContainerStatus `json:"containers"`
 }
 
-// ContainerStatus represents the status of a container on a device
+// Location sources of a device, in order of precedence
+const (
+	LocationManual = "manual" // Set through the API
+	LocationGPS    = "gps"    // Reported by the agent
+	LocationGeoIP  = "geoip"  // Looked up from the address the device connects from
+)
+
+// GeoLocation is a position fix
+type GeoLocation struct {
+	Latitude  float64   `json:"latitude"`
+	Longitude float64   `json:"longitude"`
+	Altitude  *float64  `json:"altitude,omitempty"` // Meters above mean sea level
+	Accuracy  float64   `json:"accuracy,omitempty"` // Horizontal error in meters, 0 if unknown
+	Time      time.Time `json:"time"`
+}
+
+// ValidateCoordinates checks that a latitude and longitude are in range
+func ValidateCoordinates(latitude, longitude float64) error {
+	if latitude < -90 || latitude > 90 || latitude != latitude {
+		return fmt.Errorf("latitude %v is out of range", latitude)
+	}
+	if longitude < -180 || longitude > 180 || longitude != longitude {
+		return fmt.Errorf("longitude %v is out of range", longitude)
+	}
+	return nil
+}
+
+// TimeReply answers a clock check with the time of the server
+type TimeReply struct {
+	ServerTime time.Time `json:"server_time"`
+}
+
+// CertificateReply answers a certificate request with a device certificate
+// signed by the server CA
+type CertificateReply struct {
+	Certificate string    `json:"certificate"`  // In authorized_keys format
+	ValidBefore time.Time `json:"valid_before"` // When the certificate expires
+}
+
+// ContainerStatus represents the status of a container on a device. The
+// fields after Created are only reported for the containers of applications.
 type ContainerStatus struct {
-	Name    string `json:"name"`
-	Status  string `json:"status"`
-	Image   string `json:"image"`
-	Created string `json:"created"`
+	Name       string `json:"name"`
+	Status     string `json:"status"` // State as Docker reports it, e.g. running or exited
+	Image      string `json:"image"`
+	Created    string `json:"created"`
+	ID         string `json:"id,omitempty"`
+	App        string `json:"app,omitempty"`         // Application the container belongs to
+	Health     string `json:"health,omitempty"`      // starting, healthy or unhealthy, empty without a health check
+	Restarts   int    `json:"restarts,omitempty"`    // Times Docker restarted the container
+	ImageID    string `json:"image_id,omitempty"`    // Digest of the local image
+	RepoDigest string `json:"repo_digest,omitempty"` // Registry digest the image was pulled by, empty for local builds
 }
 
 // DeployPayload represents the payload for a deployment command
 type DeployPayload struct {
-	SoftwareID    uuid.UUID         `json:"software_id"`
-	Version       string            `json:"version"`
-	ComposeConfig string            `json:"compose_config"`
-	EnvVars       map[string]string `json:"env_vars"`
+	Name             string            `json:"name"` // Application name on the device
+	SoftwareID       uuid.UUID         `json:"software_id"`
+	Version          string            `json:"version"`
+	ComposeConfig    string            `json:"compose_config"`
+	ComposeOverrides []string          `json:"compose_overrides,omitempty"` // Fragments merged over ComposeConfig in order, fleet then device
+	EnvVars          map[string]string `json:"env_vars"`
+	Registries       []RegistryAuth    `json:"registries,omitempty"`     // Used to pull images, not persisted on the device
+	PullRate         int               `json:"pull_rate_kbps,omitempty"` // Image pull rate limit in kbit/s, 0 for the agent default, -1 for none
+	Strategy         string            `json:"strategy,omitempty"`       // recreate or blue-green, empty for recreate
+	BlueGreen        *BlueGreenOptions `json:"blue_green,omitempty"`
+	Migration        *Migration        `json:"migration,omitempty"`       // Declared for this version, run if it applies to the installed one
+	Artifacts        []Artifact        `json:"artifacts,omitempty"`       // Files of the version placed next to the compose file
+	Limits           *ResourceLimits   `json:"resource_limits,omitempty"` // Caps every service, over the agent's own limits
+}
+
+// ResourceLimits caps the resources of every service of an application. A
+// zero limit is left to the next level and -1 lifts it.
+type ResourceLimits struct {
+	CPUShares int `json:"cpu_shares,omitempty" yaml:"cpu_shares"` // Relative CPU weight, Docker's default is 1024
+	MemoryMB  int `json:"memory_mb,omitempty" yaml:"memory_mb"`
+	Pids      int `json:"pids_limit,omitempty" yaml:"pids_limit"`
+}
+
+// Validate checks that Docker accepts the limits
+func (l ResourceLimits) Validate() error {
+	switch {
+	case l.CPUShares < -1 || l.MemoryMB < -1 || l.Pids < -1:
+		return fmt.Errorf("limits must be positive, 0 or -1")
+	case l.CPUShares > 0 && l.CPUShares < 2:
+		return fmt.Errorf("cpu_shares must be at least 2")
+	case l.MemoryMB > 0 && l.MemoryMB < 6:
+		return fmt.Errorf("memory_mb must be at least 6")
+	}
+	return nil
+}
+
+// Over returns the limits with those set in over replacing them
+func (l ResourceLimits) Over(over ResourceLimits) ResourceLimits {
+	if over.CPUShares != 0 {
+		l.CPUShares = over.CPUShares
+	}
+	if over.MemoryMB != 0 {
+		l.MemoryMB = over.MemoryMB
+	}
+	if over.Pids != 0 {
+		l.Pids = over.Pids
+	}
+	return l
+}
+
+// Deployment strategies
+const (
+	StrategyRecreate  = "recreate"   // Replace the containers of the running version
+	StrategyBlueGreen = "blue-green" // Start the new version next to the old one and switch over once healthy
+)
+
+// BlueGreenOptions configures blue/green deployments
+type BlueGreenOptions struct {
+	HealthPath    string `json:"health_path,omitempty"`    // HTTP path probed on every published port, empty to only wait for the containers
+	HealthTimeout int    `json:"health_timeout,omitempty"` // Seconds for the new version to become healthy, 0 for the default
+	DrainTimeout  int    `json:"drain_timeout,omitempty"`  // Seconds the old version keeps serving open connections, 0 for the default
+}
+
+// Migration step types
+const (
+	MigrationContainer  = "container"   // Run a one-off container
+	MigrationVolumeCopy = "volume-copy" // Copy the contents of one volume into another
+)
+
+// MaxMigrationTimeout bounds the seconds a single migration step may run
+const MaxMigrationTimeout = 24 * 60 * 60
+
+// Migration moves the data of an application to a new version. The agent
+// runs it after stopping the installed version and before starting the new
+// one. If a step fails, the backed up volumes are restored and the installed
+// version is started again.
+type Migration struct {
+	FromVersions []string        `json:"from_versions,omitempty"` // Installed versions it applies to, empty for any other version
+	Backup       []string        `json:"backup,omitempty"`        // Volumes restored if a step fails
+	Steps        []MigrationStep `json:"steps"`
+}
+
+// MigrationStep is one step of a migration. Volumes are named as in the
+// compose file, other names refer to Docker volumes as is.
+type MigrationStep struct {
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`              // container or volume-copy
+	Image   string   `json:"image,omitempty"`   // container: image to run
+	Command []string `json:"command,omitempty"` // container: overrides the image's command
+	Volumes []string `json:"volumes,omitempty"` // container: mounts as volume:/path
+	From    string   `json:"from,omitempty"`    // volume-copy: source volume, left as is
+	To      string   `json:"to,omitempty"`      // volume-copy: target volume
+	Timeout int      `json:"timeout,omitempty"` // Seconds, 0 for the agent default
+}
+
+// AppliesTo reports whether a migration runs when replacing the installed
+// version of an application
+func (m *Migration) AppliesTo(installed string) bool {
+	if m == nil || len(m.Steps) == 0 {
+		return false
+	}
+	if len(m.FromVersions) == 0 {
+		return true
+	}
+	for _, version := range m.FromVersions {
+		if version == installed {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateMigration checks that the steps of a migration can be run
+func ValidateMigration(migration *Migration) error {
+	if len(migration.Steps) == 0 {
+		return fmt.Errorf("migration has no steps")
+	}
+	for _, volume := range migration.Backup {
+		if !isVolumeName(volume) {
+			return fmt.Errorf("invalid backup volume %q", volume)
+		}
+	}
+
+	for i, step := range migration.Steps {
+		name := step.Name
+		if name == "" {
+			name = fmt.Sprintf("step %d", i+1)
+		}
+		if step.Timeout < 0 || step.Timeout > MaxMigrationTimeout {
+			return fmt.Errorf("%s: timeout must be between 0 and %d seconds", name, MaxMigrationTimeout)
+		}
+
+		switch step.Type {
+		case MigrationContainer:
+			if step.Image == "" {
+				return fmt.Errorf("%s: image is required", name)
+			}
+			for _, mount := range step.Volumes {
+				volume, path, ok := strings.Cut(mount, ":")
+				if !ok || !isVolumeName(volume) || !strings.HasPrefix(path, "/") {
+					return fmt.Errorf("%s: invalid volume %q, expected volume:/path", name, mount)
+				}
+			}
+		case MigrationVolumeCopy:
+			if !isVolumeName(step.From) || !isVolumeName(step.To) {
+				return fmt.Errorf("%s: from and to must be volume names", name)
+			}
+			if step.From == step.To {
+				return fmt.Errorf("%s: from and to are the same volume", name)
+			}
+		default:
+			return fmt.Errorf("%s: unknown type %q", name, step.Type)
+		}
+	}
+	return nil
+}
+
+// isVolumeName reports whether a name is a valid Docker volume name
+func isVolumeName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case i > 0 && (c == '_' || c == '.' || c == '-'):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// RegistryAuth represents credentials for a private container registry
+type RegistryAuth struct {
+	Server   string `json:"server"`
+	Username string `json:"username"`
+	Password string `json:"password"`
 }
 
 // ExecutePayload represents the payload for an execute command
@@ -98,8 +478,278 @@ type StatusPayload struct {
 	IncludeSystemStats bool `json:"include_system_stats"`
 }
 
+// AppPayload identifies an application, used by undeploy, restart and env var updates
+type AppPayload struct {
+	Name      string            `json:"name"`
+	Container string            `json:"container,omitempty"`
+	EnvVars   map[string]string `json:"env_vars,omitempty"`
+}
+
+// RestartAppPayload restarts the services of an application in depends_on order
+type RestartAppPayload struct {
+	Name     string   `json:"name"`
+	Services []string `json:"services,omitempty"` // Empty for all services
+	NoDeps   bool     `json:"no_deps,omitempty"`  // Leave the services the named ones depend on alone
+	Rolling  bool     `json:"rolling,omitempty"`  // Restart the containers of scaled services one at a time
+}
+
+// Actions on an application
+const (
+	AppActionStart     = "start"
+	AppActionStop      = "stop"
+	AppActionRestart   = "restart"    // All services in depends_on order
+	AppActionRedeploy  = "redeploy"   // Recreate the containers from the deployed compose file
+	AppActionPurgeData = "purge-data" // Remove the containers and volumes, then start again
+)
+
+// IsAppAction reports whether the given string is a known application action
+func IsAppAction(action string) bool {
+	switch action {
+	case AppActionStart, AppActionStop, AppActionRestart, AppActionRedeploy, AppActionPurgeData:
+		return true
+	}
+	return false
+}
+
+// AppActionPayload performs an action on an application
+type AppActionPayload struct {
+	Name   string `json:"name"`
+	Action string `json:"action"`
+}
+
+// AdoptPayload hands a compose project that was started on the device by
+// hand over to the agent
+type AdoptPayload struct {
+	Project     string   `json:"project"`
+	WorkingDir  string   `json:"working_dir"`
+	ConfigFiles []string `json:"config_files"`
+}
+
+// Service restart states reported in ServiceRestartResult
+const (
+	RestartDone    = "restarted"
+	RestartFailed  = "failed"
+	RestartSkipped = "skipped" // Not restarted because a service it depends on failed
+)
+
+// ServiceRestartResult is the outcome of restarting one service
+type ServiceRestartResult struct {
+	Service    string  `json:"service"`
+	Status     string  `json:"status"` // restarted, failed, skipped
+	Containers int     `json:"containers"`
+	Duration   float64 `json:"duration_seconds"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// NTPPayload sets the NTP servers of a device. No servers restores the
+// servers the operating system was configured with.
+type NTPPayload struct {
+	Servers []string `json:"servers"`
+}
+
+// ValidateNTPServers checks that NTP servers are plain host names or
+// addresses, since they are written into time service configuration files
+func ValidateNTPServers(servers []string) error {
+	for _, server := range servers {
+		if server == "" || len(server) > 253 {
+			return fmt.Errorf("invalid NTP server %q", server)
+		}
+		for _, r := range server {
+			switch {
+			case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			case r == '.' || r == '-' || r == ':' || r == '[' || r == ']':
+			default:
+				return fmt.Errorf("invalid NTP server %q", server)
+			}
+		}
+	}
+	return nil
+}
+
+// TimezonePayload sets the timezone and locale of a device, empty values
+// leave the current setting alone
+type TimezonePayload struct {
+	Timezone string `json:"timezone,omitempty"` // IANA name, e.g. Europe/Berlin
+	Locale   string `json:"locale,omitempty"`   // e.g. en_US.UTF-8
+}
+
+// ValidateTimezone checks that a timezone is a known IANA name, empty is valid
+func ValidateTimezone(timezone string) error {
+	if timezone == "" {
+		return nil
+	}
+	if timezone == "Local" || strings.HasPrefix(timezone, "-") || strings.ContainsAny(timezone, " \t\n") {
+		return fmt.Errorf("invalid timezone %q", timezone)
+	}
+	if _, err := time.LoadLocation(timezone); err != nil {
+		return fmt.Errorf("unknown timezone %q", timezone)
+	}
+	return nil
+}
+
+// ValidateLocale checks that a locale looks like en_US.UTF-8, C or POSIX,
+// empty is valid
+func ValidateLocale(locale string) error {
+	if locale == "" {
+		return nil
+	}
+	if strings.HasPrefix(locale, "-") || len(locale) > 64 {
+		return fmt.Errorf("invalid locale %q", locale)
+	}
+	for _, r := range locale {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '_' || r == '.' || r == '@' || r == '-':
+		default:
+			return fmt.Errorf("invalid locale %q", locale)
+		}
+	}
+	return nil
+}
+
+// CheckCachePayload lists the registry cache URLs a cache device should probe
+type CheckCachePayload struct {
+	URLs []string `json:"urls"`
+}
+
+// CacheCheckResult is the outcome of probing one registry cache URL
+type CacheCheckResult struct {
+	URL   string `json:"url"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// DecommissionPayload represents the payload for a decommission command
+type DecommissionPayload struct {
+	Policy string `json:"policy,omitempty"` // Overrides the agent's configured shutdown policy
+}
+
+// LogChunk is a part of a rotated agent log file shipped to the server
+type LogChunk struct {
+	File  string `json:"file"`
+	Part  int    `json:"part"`
+	Parts int    `json:"parts"`
+	Data  string `json:"data"`
+}
+
+// DiagnosticsPayload asks the agent for a diagnostics bundle, which it
+// collects in the background and uploads with RequestBundle
+type DiagnosticsPayload struct {
+	BundleID string `json:"bundle_id"`
+}
+
+// BundleChunk is a part of a diagnostics bundle, a gzipped tar archive. A
+// bundle that could not be collected is reported by a single chunk without
+// data and with Error set.
+type BundleChunk struct {
+	BundleID string `json:"bundle_id"`
+	Part     int    `json:"part"`
+	Parts    int    `json:"parts"`
+	Data     []byte `json:"data,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Image pull states reported in PullProgress
+const (
+	PullWaiting  = "waiting"
+	PullPulling  = "pulling"
+	PullRetrying = "retrying"
+	PullDone     = "done"
+	PullFailed   = "failed"
+)
+
+// PullProgress reports the image pulls of a deployment while they run
+type PullProgress struct {
+	App     string          `json:"app"`
+	Version string          `json:"version"`
+	Percent float64         `json:"percent"` // Over all layers of known size
+	Images  []ImageProgress `json:"images"`
+	Updated time.Time       `json:"updated"`
+}
+
+// ImageProgress is the pull progress of one image
+type ImageProgress struct {
+	Image   string          `json:"image"`
+	Status  string          `json:"status"` // waiting, pulling, retrying, done, failed
+	Percent float64         `json:"percent"`
+	Attempt int             `json:"attempt,omitempty"` // Starting at 1, counting retries
+	Error   string          `json:"error,omitempty"`   // Of the last failed attempt
+	Layers  []LayerProgress `json:"layers,omitempty"`
+}
+
+// LayerProgress is the pull progress of one image layer as reported by Docker
+type LayerProgress struct {
+	ID      string  `json:"id"`
+	Status  string  `json:"status"` // e.g. Downloading, Extracting, Pull complete
+	Current int64   `json:"current"`
+	Total   int64   `json:"total"`
+	Percent float64 `json:"percent"`
+}
+
+// Deployment stages reported in DeployStage
+const (
+	StageValidating     = "validating"
+	StagePulling        = "pulling"
+	StageMigrating      = "migrating" // Running the data migration of the new version
+	StageCreating       = "creating"
+	StageHealthChecking = "health_checking"
+	StageDone           = "done"
+	StageFailed         = "failed"
+)
+
+// DeployStage reports the stage a running deployment reached
+type DeployStage struct {
+	App          string    `json:"app"`
+	Version      string    `json:"version"`
+	Stage        string    `json:"stage"`
+	ImagesPulled int       `json:"images_pulled"`
+	ImagesTotal  int       `json:"images_total"`
+	Error        string    `json:"error,omitempty"` // Set for the failed stage
+	Updated      time.Time `json:"updated"`
+}
+
+// StagePercent estimates how far along a deployment is, for progress bars.
+// Pulling takes the largest share and advances with each pulled image.
+func StagePercent(stage string, imagesPulled, imagesTotal int) int {
+	switch stage {
+	case StageValidating:
+		return 0
+	case StagePulling:
+		if imagesTotal == 0 {
+			return 5
+		}
+		return 5 + 65*imagesPulled/imagesTotal
+	case StageMigrating, StageCreating:
+		return 70
+	case StageHealthChecking:
+		return 85
+	case StageDone, StageFailed:
+		return 100
+	default:
+		return 0
+	}
+}
+
+// ShutdownReport is sent by the agent right before it disconnects
+type ShutdownReport struct {
+	DeviceID  string             `json:"device_id"`
+	Reason    string             `json:"reason"`
+	Policy    string             `json:"policy"`
+	Timestamp time.Time          `json:"timestamp"`
+	Apps      []AppShutdownState `json:"apps"`
+}
+
+// AppShutdownState describes what happened to an application during shutdown
+type AppShutdownState struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Action  string `json:"action"` // left-running, stopped, failed
+	Error   string `json:"error,omitempty"`
+}
+
 // LogsPayload represents the payload for a logs command
 type LogsPayload struct {
+	App       string `json:"app"`
 	Container string `json:"container"`
 	Lines     int    `json:"lines"`
 	Follow    bool   `json:"follow"`
@@ -123,6 +773,35 @@ func NewCommand(cmdType string, payload map[string]interface{}) *Command {
 	}
 }
 
+// NewCommandWithPayload creates a new command from a typed payload struct
+func NewCommandWithPayload(cmdType string, payload interface{}) (*Command, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, fmt.Errorf("failed to convert payload: %w", err)
+	}
+
+	return NewCommand(cmdType, fields), nil
+}
+
+// DecodePayload decodes the command payload into the given struct
+func (c *Command) DecodePayload(v interface{}) error {
+	data, err := json.Marshal(c.Payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to decode %s payload: %w", c.Type, err)
+	}
+
+	return nil
+}
+
 // NewResponse creates a new response to a command
 func NewResponse(cmdID string, respType string, success bool, message string) *Response {
 	return &Response{
@@ -0,0 +1,115 @@
+package protocol
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// OSInfo identifies the operating system of a device, from its os-release
+type OSInfo struct {
+	ID        string `json:"id"`         // e.g. debian, ubuntu or raspbian
+	VersionID string `json:"version_id"` // e.g. 12 or 22.04, empty for rolling releases
+	Name      string `json:"name"`       // e.g. Debian GNU/Linux 12 (bookworm)
+	Kernel    string `json:"kernel"`     // e.g. 6.1.0-18-arm64
+}
+
+// Requirements are the oldest agent, OS and kernel versions a device must
+// run for a deployment. Empty values are not checked.
+type Requirements struct {
+	MinAgentVersion  string            `json:"min_agent_version,omitempty"`
+	MinOSVersions    map[string]string `json:"min_os_versions,omitempty"` // By os-release ID, e.g. {"debian": "12"}, other OSes are not checked
+	MinKernelVersion string            `json:"min_kernel_version,omitempty"`
+}
+
+// Validate checks that the versions can be compared
+func (r Requirements) Validate() error {
+	if r.MinAgentVersion != "" && !ValidVersion(r.MinAgentVersion) {
+		return fmt.Errorf("min_agent_version %q is not a version like 1.4.0", r.MinAgentVersion)
+	}
+	for id, version := range r.MinOSVersions {
+		if id == "" || id != strings.ToLower(id) {
+			return fmt.Errorf("min_os_versions: %q is not an os-release ID like debian", id)
+		}
+		if _, ok := parseRelease(version); !ok {
+			return fmt.Errorf("min_os_versions %s: %q is not a version like 12 or 22.04", id, version)
+		}
+	}
+	if _, ok := parseRelease(r.MinKernelVersion); r.MinKernelVersion != "" && !ok {
+		return fmt.Errorf("min_kernel_version %q is not a version like 5.10", r.MinKernelVersion)
+	}
+	return nil
+}
+
+// Unmet lists the requirements a device does not meet, given the version of
+// its agent and its OS, nil if it meets all. What the device did not report
+// or reports in another form, e.g. dev builds of the agent, is not held
+// against it.
+func (r Requirements) Unmet(agentVersion string, info *OSInfo) []string {
+	var unmet []string
+	if cmp, ok := CompareVersions(agentVersion, r.MinAgentVersion); ok && cmp < 0 {
+		unmet = append(unmet, fmt.Sprintf("agent %s is older than %s", agentVersion, r.MinAgentVersion))
+	}
+	if info == nil {
+		return unmet
+	}
+	if min, found := r.MinOSVersions[info.ID]; found {
+		if cmp, ok := CompareReleases(info.VersionID, min); ok && cmp < 0 {
+			unmet = append(unmet, fmt.Sprintf("%s %s is older than %s", info.ID, info.VersionID, min))
+		}
+	}
+	if cmp, ok := CompareReleases(info.Kernel, r.MinKernelVersion); ok && cmp < 0 {
+		unmet = append(unmet, fmt.Sprintf("kernel %s is older than %s", info.Kernel, r.MinKernelVersion))
+	}
+	return unmet
+}
+
+// CompareReleases compares versions of OS releases and kernels by their
+// leading dotted numbers, of any count, so 12 sorts before 12.1 and
+// 6.1.0-18-arm64 after 5.15. It returns false if either does not start with
+// a number.
+func CompareReleases(a, b string) (int, bool) {
+	ra, ok := parseRelease(a)
+	if !ok {
+		return 0, false
+	}
+	rb, ok := parseRelease(b)
+	if !ok {
+		return 0, false
+	}
+
+	for i := 0; i < max(len(ra), len(rb)); i++ {
+		var na, nb int
+		if i < len(ra) {
+			na = ra[i]
+		}
+		if i < len(rb) {
+			nb = rb[i]
+		}
+		if na != nb {
+			if na < nb {
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+	return 0, true
+}
+
+func parseRelease(s string) ([]int, bool) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "v")
+	end := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if end >= 0 {
+		s = s[:end]
+	}
+
+	var numbers []int
+	for _, field := range strings.Split(s, ".") {
+		n, err := strconv.Atoi(field)
+		if err != nil {
+			break
+		}
+		numbers = append(numbers, n)
+	}
+	return numbers, len(numbers) > 0
+}
@@ -0,0 +1,79 @@
+package protocol
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// restorePointID is what the server names restore points by, their UUID
+var restorePointID = regexp.MustCompile(`^[0-9a-f-]{36}$`)
+
+// RestorePointPayload asks the agent to create a restore point of
+// applications before a risky change, so that they can be put back as they
+// were. With volumes, the applications are stopped while their volumes are
+// copied.
+type RestorePointPayload struct {
+	ID      string   `json:"id"`
+	Apps    []string `json:"apps,omitempty"` // Applications to include, empty for all
+	Volumes bool     `json:"volumes"`        // Snapshot the named volumes of the applications
+}
+
+// Validate checks that the ID is usable as a file and volume name
+func (p *RestorePointPayload) Validate() error {
+	return validateRestorePointID(p.ID)
+}
+
+// RestorePayload asks the agent to put applications back as a restore point
+// recorded them
+type RestorePayload struct {
+	ID   string   `json:"id"`
+	Apps []string `json:"apps,omitempty"` // Applications to restore, empty for all in the restore point
+}
+
+// Validate checks that the ID is usable as a file and volume name
+func (p *RestorePayload) Validate() error {
+	return validateRestorePointID(p.ID)
+}
+
+// DeleteRestorePointPayload asks the agent to remove the files and volume
+// snapshots of a restore point
+type DeleteRestorePointPayload struct {
+	ID string `json:"id"`
+}
+
+// Validate checks that the ID is usable as a file and volume name
+func (p *DeleteRestorePointPayload) Validate() error {
+	return validateRestorePointID(p.ID)
+}
+
+func validateRestorePointID(id string) error {
+	if !restorePointID.MatchString(id) {
+		return fmt.Errorf("invalid restore point ID %q", id)
+	}
+	return nil
+}
+
+// RestorePointManifest lists what a restore point holds, as the agent
+// recorded it
+type RestorePointManifest struct {
+	ID        string            `json:"id"`
+	CreatedAt time.Time         `json:"created_at"`
+	Apps      []RestorePointApp `json:"apps"`
+}
+
+// RestorePointApp is an application in a restore point
+type RestorePointApp struct {
+	Name        string           `json:"name"`
+	Version     string           `json:"version"`
+	Strategy    string           `json:"strategy,omitempty"`
+	ComposeHash string           `json:"compose_hash"` // See ComposeHash, of the compose file in place
+	EnvHash     string           `json:"env_hash"`
+	Volumes     []VolumeSnapshot `json:"volumes,omitempty"`
+}
+
+// VolumeSnapshot is the copy of a volume in a restore point
+type VolumeSnapshot struct {
+	Volume   string `json:"volume"`   // Docker volume of the application
+	Snapshot string `json:"snapshot"` // Docker volume holding the copy
+}
@@ -0,0 +1,18 @@
+package protocol
+
+// MaxUSBDevices is the most USB devices a heartbeat reports
+const MaxUSBDevices = 128
+
+// USBDevice is a USB device connected to a device, as the kernel lists it
+// in /sys/bus/usb/devices. Hubs are reported like any other device, root
+// hubs are left out.
+type USBDevice struct {
+	Port         string `json:"port"`                   // Bus and port path, e.g. 1-1.2
+	VendorID     string `json:"vendor_id"`              // Four hex digits, e.g. 1a86
+	ProductID    string `json:"product_id"`             // Four hex digits, e.g. 7523
+	Serial       string `json:"serial,omitempty"`       // Empty if the device has none
+	Manufacturer string `json:"manufacturer,omitempty"` // As the device names itself
+	Product      string `json:"product,omitempty"`
+	Class        string `json:"class,omitempty"` // Device class as two hex digits, 00 if set per interface
+	Speed        int    `json:"speed,omitempty"` // Mbit/s
+}
@@ -0,0 +1,151 @@
+package protocol
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Agent features, reported in BuildInfo so that the server only uses
+// protocol features an agent understands
+const (
+	FeatureDeployStages     = "deploy-stages"     // Reports stages with RequestStage
+	FeatureUDPForwards      = "udp-forwards"      // Opens ChannelDirectUDP channels
+	FeatureMigrations       = "migrations"        // Runs DeployPayload.Migration
+	FeatureComposeOverrides = "compose-overrides" // Merges DeployPayload.ComposeOverrides
+	FeatureCompression      = "compression"       // Gzips messages and chunks large requests
+	FeatureCommandAcks      = "command-acks"      // Acknowledges commands and deduplicates resent ones
+	FeatureDiagnostics      = "diagnostics"       // Collects diagnostics bundles with CmdDiagnostics
+	FeatureNetworkTests     = "network-tests"     // Runs network tests with CmdNetworkTest
+	FeatureCapture          = "packet-capture"    // Captures packets with CmdCapture
+	FeaturePlugins          = "plugins"           // Runs plugins configured with CmdPlugins
+	FeatureArtifacts        = "artifacts"         // Places DeployPayload.Artifacts, fetched over ChannelArtifact or their URL
+	FeatureDisplay          = "display"           // Configures the kiosk display with CmdDisplay and takes screenshots with CmdScreenshot
+	FeatureHostServices     = "host-services"     // Restarts monitored host services with CmdRestartHostService
+	FeatureRestorePoints    = "restore-points"    // Creates, restores and deletes restore points with CmdRestorePoint, CmdRestore and CmdDeleteRestorePoint
+	FeatureResourceLimits   = "resource-limits"   // Caps the services of applications with DeployPayload.Limits
+	FeatureStagedUpdates    = "staged-updates"    // Applies updates staged with CmdStageUpdate offline and reports them with RequestAutonomy
+	FeatureUpdateActivation = "update-activation" // Keeps staged updates without a time until CmdActivateUpdate
+)
+
+// AgentFeatures lists the features of this agent build
+var AgentFeatures = []string{
+	FeatureDeployStages,
+	FeatureUDPForwards,
+	FeatureMigrations,
+	FeatureComposeOverrides,
+	FeatureCompression,
+	FeatureCommandAcks,
+	FeatureDiagnostics,
+	FeatureNetworkTests,
+	FeatureCapture,
+	FeaturePlugins,
+	FeatureArtifacts,
+	FeatureDisplay,
+	FeatureHostServices,
+	FeatureRestorePoints,
+	FeatureResourceLimits,
+	FeatureStagedUpdates,
+	FeatureUpdateActivation,
+}
+
+// BuildInfo describes the build of an agent, reported in heartbeats
+type BuildInfo struct {
+	Version  string   `json:"version"`
+	Commit   string   `json:"commit"`
+	Date     string   `json:"date"`
+	Features []string `json:"features"`
+}
+
+// HasFeature reports whether a feature is in a list of agent features
+func HasFeature(features []string, feature string) bool {
+	return slices.Contains(features, feature)
+}
+
+// Agent states derived from the version an agent reports
+const (
+	AgentSupported   = "supported"
+	AgentOutdated    = "outdated"    // Older than the server
+	AgentUnsupported = "unsupported" // Older than the minimum supported version
+	AgentUnknown     = "unknown"     // Not a release version, e.g. dev builds
+)
+
+// AgentStatus compares the version of an agent with that of the server and
+// the minimum supported version, which may be empty
+func AgentStatus(agentVersion, serverVersion, minVersion string) string {
+	if _, ok := parseVersion(agentVersion); !ok {
+		return AgentUnknown
+	}
+	if cmp, ok := CompareVersions(agentVersion, minVersion); ok && cmp < 0 {
+		return AgentUnsupported
+	}
+	if cmp, ok := CompareVersions(agentVersion, serverVersion); ok && cmp < 0 {
+		return AgentOutdated
+	}
+	return AgentSupported
+}
+
+// CompareVersions compares two versions of the form [v]major.minor.patch with
+// an optional -prerelease suffix, which sorts before the release. It returns
+// false if either is not such a version.
+func CompareVersions(a, b string) (int, bool) {
+	va, ok := parseVersion(a)
+	if !ok {
+		return 0, false
+	}
+	vb, ok := parseVersion(b)
+	if !ok {
+		return 0, false
+	}
+
+	for i := 0; i < 3; i++ {
+		if va.parts[i] != vb.parts[i] {
+			if va.parts[i] < vb.parts[i] {
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+
+	switch {
+	case va.pre == vb.pre:
+		return 0, true
+	case va.pre == "":
+		return 1, true
+	case vb.pre == "":
+		return -1, true
+	default:
+		return strings.Compare(va.pre, vb.pre), true
+	}
+}
+
+// ValidVersion reports whether a version can be compared with CompareVersions
+func ValidVersion(version string) bool {
+	_, ok := parseVersion(version)
+	return ok
+}
+
+type version struct {
+	parts [3]int
+	pre   string
+}
+
+func parseVersion(s string) (version, bool) {
+	var v version
+	s = strings.TrimPrefix(s, "v")
+	s, _, _ = strings.Cut(s, "+") // Build metadata does not affect ordering
+	s, v.pre, _ = strings.Cut(s, "-")
+
+	fields := strings.Split(s, ".")
+	if len(fields) < 2 || len(fields) > 3 {
+		return v, false
+	}
+	for i, field := range fields {
+		n, err := strconv.Atoi(field)
+		if err != nil || n < 0 {
+			return v, false
+		}
+		v.parts[i] = n
+	}
+	return v, true
+}
@@ -0,0 +1,167 @@
+package ratelimit
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket limiting throughput in bytes per second. A zero
+// rate means unlimited. The rate can be changed while transfers are running.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64 // Bytes per second
+	burst  float64 // Bucket size in bytes
+	tokens float64
+	last   time.Time
+}
+
+// New creates a limiter allowing bytesPerSec, with a burst of one second
+func New(bytesPerSec int64) *Limiter {
+	l := &Limiter{last: time.Now()}
+	l.SetRate(bytesPerSec)
+	return l
+}
+
+// KbpsToBytes converts a rate in kilobits per second to bytes per second
+func KbpsToBytes(kbps int) int64 {
+	return int64(kbps) * 1000 / 8
+}
+
+// Effective returns the first configured rate of a device, its fleet and the
+// server default, in that order. Zero inherits the next level and a negative
+// rate means unlimited. The result is zero when unlimited.
+func Effective(rates ...int) int {
+	for _, rate := range rates {
+		if rate < 0 {
+			return 0
+		}
+		if rate > 0 {
+			return rate
+		}
+	}
+	return 0
+}
+
+// SetRate changes the rate, zero or less removes the limit
+func (l *Limiter) SetRate(bytesPerSec int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if bytesPerSec <= 0 {
+		l.rate, l.burst, l.tokens = 0, 0, 0
+		return
+	}
+
+	l.rate = float64(bytesPerSec)
+	l.burst = l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+}
+
+// Rate returns the current rate in bytes per second, zero if unlimited
+func (l *Limiter) Rate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int64(l.rate)
+}
+
+// WaitN blocks until n bytes may be transferred or ctx is done
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	for n > 0 {
+		// Large transfers are taken in bursts so a rate change applies quickly
+		chunk, delay := l.reserve(n)
+		if delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			}
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// reserve takes up to n bytes from the bucket and returns how many were taken
+// and how long to wait before using them
+func (l *Limiter) reserve(n int) (int, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate == 0 {
+		return n, 0
+	}
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	chunk := n
+	if float64(chunk) > l.burst {
+		chunk = int(l.burst)
+	}
+	if chunk < 1 {
+		chunk = 1
+	}
+
+	l.tokens -= float64(chunk)
+	if l.tokens >= 0 {
+		return chunk, 0
+	}
+	return chunk, time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// Conn wraps a connection so that reads and writes are limited by the given
+// limiters. Either limiter may be nil.
+func Conn(conn net.Conn, read, write *Limiter) net.Conn {
+	return &limitedConn{Conn: conn, read: read, write: write}
+}
+
+// limitedConn is a rate limited connection
+type limitedConn struct {
+	net.Conn
+	read, write *Limiter
+}
+
+// Read implements net.Conn. The limit is applied after reading so that a
+// read never blocks on tokens for data that has not arrived.
+func (c *limitedConn) Read(p []byte) (int, error) {
+	if c.read != nil && c.read.Rate() > 0 && int64(len(p)) > c.read.Rate() {
+		p = p[:c.read.Rate()]
+	}
+	n, err := c.Conn.Read(p)
+	if c.read != nil && n > 0 {
+		c.read.WaitN(context.Background(), n)
+	}
+	return n, err
+}
+
+// Write implements net.Conn
+func (c *limitedConn) Write(p []byte) (int, error) {
+	if c.write == nil {
+		return c.Conn.Write(p)
+	}
+
+	written := 0
+	for written < len(p) {
+		chunk := len(p) - written
+		if rate := c.write.Rate(); rate > 0 && int64(chunk) > rate {
+			chunk = int(rate)
+		}
+		c.write.WaitN(context.Background(), chunk)
+		n, err := c.Conn.Write(p[written : written+chunk])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
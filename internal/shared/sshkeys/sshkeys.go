@@ -0,0 +1,116 @@
+// Package sshkeys generates the SSH keys of the server and devices and checks
+// the key algorithms set in the configuration.
+package sshkeys
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Key types that can be generated
+const (
+	TypeED25519 = "ed25519"
+	TypeRSA     = "rsa"
+)
+
+// Bounds and default of the RSA key size in bits
+const (
+	DefaultRSABits = 4096
+	MinRSABits     = 2048
+	MaxRSABits     = 8192
+)
+
+// Algorithms lists the public key algorithms that may be configured, in
+// order of preference
+var Algorithms = []string{
+	ssh.KeyAlgoED25519,
+	ssh.KeyAlgoECDSA256,
+	ssh.KeyAlgoECDSA384,
+	ssh.KeyAlgoECDSA521,
+	ssh.KeyAlgoRSASHA512,
+	ssh.KeyAlgoRSASHA256,
+	ssh.KeyAlgoRSA,
+}
+
+// Validate checks a key type and size. The size only applies to RSA keys,
+// 0 picks the default.
+func Validate(keyType string, bits int) error {
+	switch keyType {
+	case TypeED25519:
+		return nil
+	case TypeRSA:
+		if bits != 0 && (bits < MinRSABits || bits > MaxRSABits) {
+			return fmt.Errorf("RSA key size %d must be between %d and %d", bits, MinRSABits, MaxRSABits)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown key type %q, must be %s or %s", keyType, TypeED25519, TypeRSA)
+	}
+}
+
+// CheckAlgorithms returns an error for algorithms not in Algorithms
+func CheckAlgorithms(algorithms []string) error {
+	for _, algorithm := range algorithms {
+		known := false
+		for _, candidate := range Algorithms {
+			if algorithm == candidate {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("unknown key algorithm %q", algorithm)
+		}
+	}
+	return nil
+}
+
+// Generate creates a private key of the given type, PEM encoded, along with
+// its public key. Ed25519 keys are written in the OpenSSH format, RSA keys
+// as PKCS#1 like before, so existing tooling keeps reading them.
+func Generate(keyType string, bits int) ([]byte, ssh.PublicKey, error) {
+	if err := Validate(keyType, bits); err != nil {
+		return nil, nil, err
+	}
+
+	switch keyType {
+	case TypeED25519:
+		publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to generate ed25519 key: %w", err)
+		}
+		block, err := ssh.MarshalPrivateKey(privateKey, "")
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to encode ed25519 key: %w", err)
+		}
+		sshKey, err := ssh.NewPublicKey(publicKey)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to convert to public key: %w", err)
+		}
+		return pem.EncodeToMemory(block), sshKey, nil
+
+	default:
+		if bits == 0 {
+			bits = DefaultRSABits
+		}
+		privateKey, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to generate RSA key: %w", err)
+		}
+		privateKeyPEM := pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
+		})
+		sshKey, err := ssh.NewPublicKey(&privateKey.PublicKey)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to convert to public key: %w", err)
+		}
+		return privateKeyPEM, sshKey, nil
+	}
+}
@@ -0,0 +1,87 @@
+package tracing
+
+import (
+	"errors"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+// gormSpanKey stores the span of a statement between its callbacks
+const gormSpanKey = "tracing:span"
+
+// GormPlugin creates a span for every database statement run with a context
+// that is already traced, e.g. db.WithContext(r.Context()). Untraced
+// statements such as background polling do not start new traces.
+type GormPlugin struct{}
+
+// Name implements gorm.Plugin
+func (GormPlugin) Name() string {
+	return "tracing"
+}
+
+// Initialize implements gorm.Plugin
+func (p GormPlugin) Initialize(db *gorm.DB) error {
+	cb := db.Callback()
+	return errors.Join(
+		cb.Create().Before("gorm:create").Register("tracing:before_create", beforeGorm("create")),
+		cb.Create().After("gorm:create").Register("tracing:after_create", endGormSpan),
+		cb.Query().Before("gorm:query").Register("tracing:before_query", beforeGorm("query")),
+		cb.Query().After("gorm:query").Register("tracing:after_query", endGormSpan),
+		cb.Update().Before("gorm:update").Register("tracing:before_update", beforeGorm("update")),
+		cb.Update().After("gorm:update").Register("tracing:after_update", endGormSpan),
+		cb.Delete().Before("gorm:delete").Register("tracing:before_delete", beforeGorm("delete")),
+		cb.Delete().After("gorm:delete").Register("tracing:after_delete", endGormSpan),
+		cb.Row().Before("gorm:row").Register("tracing:before_row", beforeGorm("row")),
+		cb.Row().After("gorm:row").Register("tracing:after_row", endGormSpan),
+		cb.Raw().Before("gorm:raw").Register("tracing:before_raw", beforeGorm("raw")),
+		cb.Raw().After("gorm:raw").Register("tracing:after_raw", endGormSpan),
+	)
+}
+
+// beforeGorm returns the callback that starts the span of an operation
+func beforeGorm(operation string) func(*gorm.DB) {
+	return func(tx *gorm.DB) {
+		startGormSpan(tx, operation)
+	}
+}
+
+// startGormSpan starts the span of a statement when its context is traced
+func startGormSpan(tx *gorm.DB, operation string) {
+	ctx := tx.Statement.Context
+	if ctx == nil || !trace.SpanContextFromContext(ctx).IsValid() {
+		return
+	}
+
+	_, span := Start(ctx, "db."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "postgresql"),
+			attribute.String("db.operation", operation),
+		),
+	)
+	tx.InstanceSet(gormSpanKey, span)
+}
+
+// endGormSpan ends the span of a statement with its table, SQL and outcome
+func endGormSpan(tx *gorm.DB) {
+	value, ok := tx.InstanceGet(gormSpanKey)
+	if !ok {
+		return
+	}
+	span, ok := value.(trace.Span)
+	if !ok {
+		return
+	}
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("db.sql.table", tx.Statement.Table),
+		attribute.String("db.statement", tx.Statement.SQL.String()),
+		attribute.Int64("db.rows_affected", tx.RowsAffected),
+	)
+	if tx.Error != nil && !errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+		RecordError(span, tx.Error)
+	}
+}
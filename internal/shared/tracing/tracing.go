@@ -0,0 +1,103 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/edgetainer/edgetainer/internal/shared/logging"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName identifies the spans created by edgetainer
+const instrumentationName = "github.com/edgetainer/edgetainer"
+
+// Options configures the OTLP exporter. Tracing is a no-op unless enabled.
+type Options struct {
+	Enabled     bool
+	Endpoint    string            // OTLP/HTTP collector address, e.g. otel-collector:4318
+	Insecure    bool              // Use plain HTTP instead of HTTPS
+	Headers     map[string]string // Sent with every export, e.g. for authentication
+	SampleRatio float64           // Fraction of new traces to record, parents decide for the rest
+}
+
+// propagator carries trace context across HTTP and the SSH tunnel
+var propagator = propagation.TraceContext{}
+
+// Setup installs the global tracer provider for a service and returns a
+// function that flushes and stops it
+func Setup(ctx context.Context, serviceName, serviceVersion string, opts Options) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagator)
+
+	if !opts.Enabled {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	// Export failures must not end up on stderr in the middle of our logs
+	logger := logging.WithComponent("tracing")
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		logger.Warn(fmt.Sprintf("Tracing error: %v", err))
+	}))
+
+	exporterOpts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(opts.Endpoint)}
+	if opts.Insecure {
+		exporterOpts = append(exporterOpts, otlptracehttp.WithInsecure())
+	}
+	if len(opts.Headers) > 0 {
+		exporterOpts = append(exporterOpts, otlptracehttp.WithHeaders(opts.Headers))
+	}
+
+	exporter, err := otlptracehttp.New(ctx, exporterOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+
+	res := resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(serviceName),
+		semconv.ServiceVersion(serviceVersion),
+	)
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(opts.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// Start starts a span as a child of the span in ctx, if any
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, opts...)
+}
+
+// RecordError marks a span as failed
+func RecordError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// Inject returns the W3C traceparent of the span in ctx, or an empty string
+func Inject(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	return carrier.Get("traceparent")
+}
+
+// Extract returns ctx with the remote span described by a W3C traceparent
+func Extract(ctx context.Context, traceparent string) context.Context {
+	if traceparent == "" {
+		return ctx
+	}
+	return propagator.Extract(ctx, propagation.MapCarrier{"traceparent": traceparent})
+}
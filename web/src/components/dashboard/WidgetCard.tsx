@@ -0,0 +1,131 @@
+import { Card, CardContent, CardHeader, CardTitle } from '@/components/ui/card'
+import {
+  ChartConfig,
+  ChartContainer,
+  ChartTooltip,
+  ChartTooltipContent,
+} from '@/components/ui/chart'
+import { Skeleton } from '@/components/ui/skeleton'
+import {
+  Table,
+  TableBody,
+  TableCell,
+  TableHead,
+  TableHeader,
+  TableRow,
+} from '@/components/ui/table'
+import { useDeviceAggregate } from '@/hooks/use-api'
+import { DashboardWidget } from '@/lib/models'
+import { Bar, BarChart, Cell, Pie, PieChart, XAxis, YAxis } from 'recharts'
+
+const colors = [
+  'var(--chart-1)',
+  'var(--chart-2)',
+  'var(--chart-3)',
+  'var(--chart-4)',
+  'var(--chart-5)',
+]
+
+// Rounds aggregated values for display, counts stay whole
+function format(value: number | null) {
+  if (value === null) return '—'
+  return Number.isInteger(value) ? value.toString() : value.toFixed(2)
+}
+
+// A dashboard widget drawn from a device aggregation. Charts show the first
+// aggregate by group, tables every aggregate.
+export function WidgetCard({ widget }: { widget: DashboardWidget }) {
+  const { data, isLoading, error } = useDeviceAggregate(widget.query)
+
+  const rows = (data?.groups ?? []).map((group) => ({
+    label: group.labels.map((label) => label || 'none').join(' / ') || 'all',
+    value: group.values[0] ?? 0,
+  }))
+  const config: ChartConfig = {
+    value: { label: data?.aggregates[0] ?? 'count', color: 'var(--chart-1)' },
+  }
+
+  let content
+  if (isLoading) {
+    content = <Skeleton className="h-32 w-full" />
+  } else if (error || !data) {
+    content = <p className="text-sm text-destructive">Failed to load this widget</p>
+  } else if (widget.chart === 'number') {
+    content = (
+      <div className="text-2xl font-bold">
+        {format(data.groups[0]?.values[0] ?? null)}
+      </div>
+    )
+  } else if (widget.chart === 'bar') {
+    content = (
+      <ChartContainer config={config} className="h-48 w-full">
+        <BarChart data={rows}>
+          <XAxis dataKey="label" tickLine={false} axisLine={false} />
+          <YAxis tickLine={false} axisLine={false} />
+          <ChartTooltip content={<ChartTooltipContent />} />
+          <Bar dataKey="value" fill="var(--color-value)" radius={4} />
+        </BarChart>
+      </ChartContainer>
+    )
+  } else if (widget.chart === 'pie') {
+    content = (
+      <ChartContainer config={config} className="h-48 w-full">
+        <PieChart>
+          <ChartTooltip content={<ChartTooltipContent nameKey="label" />} />
+          <Pie data={rows} dataKey="value" nameKey="label">
+            {rows.map((row, i) => (
+              <Cell key={row.label} fill={colors[i % colors.length]} />
+            ))}
+          </Pie>
+        </PieChart>
+      </ChartContainer>
+    )
+  } else {
+    content = (
+      <Table>
+        <TableHeader>
+          <TableRow>
+            {data.group_by.map((grouping) => (
+              <TableHead key={grouping}>{grouping}</TableHead>
+            ))}
+            {data.aggregates.map((aggregate) => (
+              <TableHead key={aggregate} className="text-right">
+                {aggregate}
+              </TableHead>
+            ))}
+          </TableRow>
+        </TableHeader>
+        <TableBody>
+          {data.groups.map((group, i) => (
+            <TableRow key={i}>
+              {group.labels.map((label, j) => (
+                <TableCell key={j}>{label || 'none'}</TableCell>
+              ))}
+              {group.values.map((value, j) => (
+                <TableCell key={j} className="text-right">
+                  {format(value)}
+                </TableCell>
+              ))}
+            </TableRow>
+          ))}
+        </TableBody>
+      </Table>
+    )
+  }
+
+  return (
+    <Card>
+      <CardHeader>
+        <CardTitle className="text-sm font-medium">{widget.title}</CardTitle>
+      </CardHeader>
+      <CardContent>
+        {content}
+        {data?.truncated && (
+          <p className="mt-2 text-xs text-muted-foreground">
+            Showing the first {data.groups.length} groups
+          </p>
+        )}
+      </CardContent>
+    </Card>
+  )
+}
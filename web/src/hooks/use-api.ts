@@ -1,5 +1,13 @@
 import { httpClient } from '../lib/api-client'
-import { Device, Deployment, Fleet, Software } from '../lib/models'
+import {
+  Device,
+  DeviceAggregation,
+  Deployment,
+  DiagnosticsBundle,
+  Fleet,
+  Software,
+  UserPreferences,
+} from '../lib/models'
 import { useMutation, useQuery, useQueryClient } from '@tanstack/react-query'
 import { toast } from 'sonner'
 
@@ -24,6 +32,10 @@ export const QueryKeys = {
   fleetDeployments: (fleetId: string) => ['deployments', 'fleet', fleetId],
   softwareDeployments: (softwareId: string) => ['deployments', 'software', softwareId],
   deploymentCounts: 'deploymentCounts',
+  deviceDiagnostics: (deviceId: string) => ['devices', deviceId, 'diagnostics'],
+  invitation: (token: string) => ['invitations', token],
+  deviceAggregate: (query: Record<string, string>) => ['devices', 'aggregate', query],
+  preferences: 'preferences',
 }
 
 // ============ DEVICES ============
@@ -107,6 +119,55 @@ export function useRestartDevice() {
   })
 }
 
+export function useDiagnosticsBundles(deviceId: string) {
+  const hasToken = !!localStorage.getItem('edgetainer_token')
+
+  return useQuery({
+    queryKey: QueryKeys.deviceDiagnostics(deviceId),
+    queryFn: () =>
+      httpClient.get<DiagnosticsBundle[]>(`/api/devices/${deviceId}/diagnostics`),
+    enabled: !!deviceId && hasToken,
+    // Poll while a bundle is on its way
+    refetchInterval: (query) =>
+      query.state.data?.some((b) => b.status === 'pending' || b.status === 'uploading')
+        ? 5000
+        : false,
+  })
+}
+
+export function useRequestDiagnostics(deviceId: string) {
+  const queryClient = useQueryClient()
+
+  return useMutation({
+    mutationFn: () =>
+      httpClient.post<DiagnosticsBundle>(`/api/devices/${deviceId}/diagnostics`, {}),
+    onSuccess: () => {
+      queryClient.invalidateQueries({ queryKey: QueryKeys.deviceDiagnostics(deviceId) })
+    },
+  })
+}
+
+// Downloads a diagnostics bundle through the authenticated client and hands
+// it to the browser as a file
+export async function downloadDiagnosticsBundle(deviceId: string, bundleId: string) {
+  const response = await httpClient.fetchRaw(
+    `/api/devices/${deviceId}/diagnostics/${bundleId}/download`,
+  )
+  if (!response.ok) {
+    throw new Error(`Download failed: ${response.statusText}`)
+  }
+
+  const disposition = response.headers.get('Content-Disposition') || ''
+  const filename = /filename="([^"]+)"/.exec(disposition)?.[1] || `diagnostics-${deviceId}.tar.gz`
+
+  const url = URL.createObjectURL(await response.blob())
+  const link = document.createElement('a')
+  link.href = url
+  link.download = filename
+  link.click()
+  setTimeout(() => URL.revokeObjectURL(url), 0)
+}
+
 // ============ FLEETS ============
 
 export function useFleets() {
@@ -418,6 +479,74 @@ export function useLogout() {
   })
 }
 
+// ============ INVITATIONS ============
+
+export interface InvitationPreview {
+  email: string
+  role: string
+  expires_at: string
+  auth_backends: boolean
+}
+
+export interface AcceptInvitationRequest {
+  token: string
+  username: string
+  password: string
+  link?: boolean
+}
+
+// Needs no login, the token of the invitation link stands for the invitee
+export function useInvitation(token: string) {
+  return useQuery({
+    queryKey: QueryKeys.invitation(token),
+    queryFn: () =>
+      httpClient.get<InvitationPreview>(
+        `/api/invitations/accept?token=${encodeURIComponent(token)}`
+      ),
+    enabled: !!token,
+    retry: false,
+  })
+}
+
+export function useAcceptInvitation() {
+  return useMutation({
+    mutationFn: (request: AcceptInvitationRequest) =>
+      httpClient.post<LoginResponse>('/api/invitations/accept', request),
+    onSuccess: (data) => {
+      localStorage.setItem('edgetainer_user', JSON.stringify(data.user))
+      localStorage.setItem('edgetainer_token', data.token)
+      httpClient.configure({ apiKey: data.token })
+    },
+  })
+}
+
+// ============ DASHBOARD ============
+
+// Groups devices and aggregates their metrics on the server, instead of
+// loading every device to count them
+export function useDeviceAggregate(query: Record<string, string>) {
+  const hasToken = !!localStorage.getItem('edgetainer_token')
+
+  return useQuery({
+    queryKey: QueryKeys.deviceAggregate(query),
+    queryFn: () =>
+      httpClient.get<DeviceAggregation>(
+        `/api/devices/aggregate?${new URLSearchParams(query).toString()}`
+      ),
+    enabled: hasToken,
+  })
+}
+
+export function usePreferences() {
+  const hasToken = !!localStorage.getItem('edgetainer_token')
+
+  return useQuery({
+    queryKey: [QueryKeys.preferences],
+    queryFn: () => httpClient.get<UserPreferences>('/api/auth/me/preferences'),
+    enabled: hasToken,
+  })
+}
+
 // ============ PROVISIONING ============
 
 // Device provisioning interface
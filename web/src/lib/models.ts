@@ -32,6 +32,7 @@ export interface Device {
   status: 'pending' | 'online' | 'offline' | 'updating' | 'error'
   last_seen?: string
   ip_address?: string
+  ip_addresses?: string[]
   os_version?: string
   hardware_info?: string
   ssh_port?: number
@@ -70,6 +71,47 @@ export interface Deployment {
   updated_at?: string
 }
 
+// Diagnostics bundle collected by a device
+export interface DiagnosticsBundle {
+  id: UUID
+  device_id: UUID
+  status: 'pending' | 'uploading' | 'ready' | 'failed'
+  error?: string
+  size: number
+  requested_by?: string
+  completed_at?: string
+  created_at: string
+  updated_at?: string
+}
+
+// Devices grouped with aggregated metrics, see docs/dashboard-widgets.md.
+// Keys, labels and values follow the order of group_by and aggregates.
+export interface DeviceAggregation {
+  group_by: string[]
+  aggregates: string[]
+  groups: {
+    keys: (string | null)[]
+    labels: string[]
+    values: (number | null)[]
+  }[]
+  truncated: boolean
+}
+
+// Dashboard widget of a user, query holds the parameters of /api/devices/aggregate
+export interface DashboardWidget {
+  title: string
+  chart: 'number' | 'bar' | 'pie' | 'table'
+  query: Record<string, string>
+}
+
+export interface UserPreferences {
+  default_fleet_id?: UUID | null
+  theme: '' | 'light' | 'dark'
+  columns: Record<string, string[]>
+  widgets: DashboardWidget[]
+  updated_at?: string
+}
+
 // Auth request/response interfaces
 export interface LoginRequest {
   username: string
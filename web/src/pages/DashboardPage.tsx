@@ -1,18 +1,25 @@
 import { Card, CardContent, CardHeader, CardTitle } from '../components/ui/card'
 import { Server, Box, Package, Activity } from 'lucide-react'
-import { useFleets, useDevices, useSoftware } from '../hooks/use-api'
+import { useFleets, useDevices, useSoftware, useDeviceAggregate, usePreferences } from '../hooks/use-api'
 import { Skeleton } from '../components/ui/skeleton'
+import { WidgetCard } from '../components/dashboard/WidgetCard'
 
 export function DashboardPage() {
   // Fetch real data from API
   const { data: fleets = [], isLoading: isLoadingFleets } = useFleets();
   const { data: devices = [], isLoading: isLoadingDevices } = useDevices();
   const { data: software = [], isLoading: isLoadingSoftware } = useSoftware();
+  const { data: preferences } = usePreferences();
 
-  // Calculate online device count - in a real app, the API would provide this
-  const onlineDevices = devices.filter(device => device.status === 'online').length;
-  const onlinePercentage = devices.length > 0 
-    ? Math.round((onlineDevices / devices.length) * 100) 
+  // Devices are counted by status on the server
+  const { data: statuses, isLoading: isLoadingStatuses } = useDeviceAggregate({ group_by: 'status' });
+  const countOf = (status?: string) => (statuses?.groups ?? [])
+    .filter(group => status === undefined || group.keys[0] === status)
+    .reduce((total, group) => total + (group.values[0] ?? 0), 0);
+  const totalDevices = countOf();
+  const onlineDevices = countOf('online');
+  const onlinePercentage = totalDevices > 0
+    ? Math.round((onlineDevices / totalDevices) * 100)
     : 0;
 
   const isLoading = isLoadingFleets || isLoadingDevices || isLoadingSoftware;
@@ -47,11 +54,11 @@ export function DashboardPage() {
             <Box className="h-4 w-4 text-muted-foreground" />
           </CardHeader>
           <CardContent>
-            {isLoadingDevices ? (
+            {isLoadingStatuses ? (
               <Skeleton className="h-8 w-20" />
             ) : (
               <>
-                <div className="text-2xl font-bold">{devices.length}</div>
+                <div className="text-2xl font-bold">{totalDevices}</div>
                 <p className="text-xs text-muted-foreground">
                   Registered edge devices
                 </p>
@@ -68,7 +75,7 @@ export function DashboardPage() {
             <Activity className="h-4 w-4 text-muted-foreground" />
           </CardHeader>
           <CardContent>
-            {isLoadingDevices ? (
+            {isLoadingStatuses ? (
               <Skeleton className="h-8 w-20" />
             ) : (
               <>
@@ -101,6 +108,14 @@ export function DashboardPage() {
         </Card>
       </div>
 
+      {preferences && preferences.widgets.length > 0 && (
+        <div className="grid gap-4 grid-cols-1 md:grid-cols-2 lg:grid-cols-3">
+          {preferences.widgets.map((widget, i) => (
+            <WidgetCard key={`${i}-${widget.title}`} widget={widget} />
+          ))}
+        </div>
+      )}
+
       <div className="grid gap-4 grid-cols-1 md:grid-cols-2 lg:grid-cols-3">
         <Card className="col-span-1 md:col-span-2">
           <CardHeader>
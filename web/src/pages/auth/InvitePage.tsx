@@ -0,0 +1,146 @@
+import { Button } from '@/components/ui/button'
+import {
+  Card,
+  CardContent,
+  CardDescription,
+  CardHeader,
+  CardTitle,
+} from '@/components/ui/card'
+import {
+  Form,
+  FormControl,
+  FormField,
+  FormItem,
+  FormLabel,
+  FormMessage,
+} from '@/components/ui/form'
+import { Input } from '@/components/ui/input'
+import { Switch } from '@/components/ui/switch'
+import { useAcceptInvitation, useInvitation } from '@/hooks/use-api'
+import { zodResolver } from '@hookform/resolvers/zod'
+import { useState } from 'react'
+import { useForm } from 'react-hook-form'
+import { z } from 'zod'
+
+// Define form validation schema, a password of an auth backend may be
+// shorter than those chosen here
+const formSchema = z
+  .object({
+    username: z.string().trim().min(1, 'Username is required'),
+    password: z.string().min(1, 'Password is required'),
+    link: z.boolean(),
+  })
+  .refine((data) => data.link || data.password.length >= 8, {
+    message: 'Password must be at least 8 characters',
+    path: ['password'],
+  })
+
+type FormValues = z.infer<typeof formSchema>
+
+export function InvitePage() {
+  const token = new URLSearchParams(window.location.search).get('token') ?? ''
+  const { data: invitation, error, isLoading } = useInvitation(token)
+  const acceptMutation = useAcceptInvitation()
+  const [failed, setFailed] = useState<string | null>(null)
+
+  const form = useForm<FormValues>({
+    resolver: zodResolver(formSchema),
+    defaultValues: {
+      username: '',
+      password: '',
+      link: false,
+    },
+  })
+  const link = form.watch('link')
+
+  async function onSubmit(data: FormValues) {
+    try {
+      await acceptMutation.mutateAsync({ token, ...data })
+      // Reload so the session is picked up like after a login
+      window.location.assign('/')
+    } catch (err) {
+      setFailed(err instanceof Error ? err.message : 'Failed to accept the invitation')
+    }
+  }
+
+  let description = 'Checking your invitation...'
+  if (!token || error) {
+    description = 'This invitation link is invalid, was used or has expired. Ask an admin to send it again.'
+  } else if (invitation) {
+    description = `You were invited as ${invitation.role} with ${invitation.email}.`
+  }
+
+  return (
+    <div className="flex h-screen w-screen items-center justify-center bg-muted/40">
+      <Card className="w-full max-w-md">
+        <CardHeader className="space-y-1 text-center">
+          <CardTitle className="text-3xl font-bold">Edgetainer</CardTitle>
+          <CardDescription>{description}</CardDescription>
+        </CardHeader>
+        {invitation && !isLoading && (
+          <CardContent>
+            <Form {...form}>
+              <form onSubmit={form.handleSubmit(onSubmit)} className="space-y-4">
+                {invitation.auth_backends && (
+                  <FormField
+                    control={form.control}
+                    name="link"
+                    render={({ field }) => (
+                      <FormItem className="flex items-center justify-between">
+                        <FormLabel>Sign in with my company account</FormLabel>
+                        <FormControl>
+                          <Switch
+                            checked={field.value}
+                            onCheckedChange={field.onChange}
+                          />
+                        </FormControl>
+                      </FormItem>
+                    )}
+                  />
+                )}
+
+                <FormField
+                  control={form.control}
+                  name="username"
+                  render={({ field }) => (
+                    <FormItem>
+                      <FormLabel>Username</FormLabel>
+                      <FormControl>
+                        <Input placeholder="username" {...field} />
+                      </FormControl>
+                      <FormMessage />
+                    </FormItem>
+                  )}
+                />
+
+                <FormField
+                  control={form.control}
+                  name="password"
+                  render={({ field }) => (
+                    <FormItem>
+                      <FormLabel>{link ? 'Password' : 'Choose a password'}</FormLabel>
+                      <FormControl>
+                        <Input type="password" placeholder="••••••••" {...field} />
+                      </FormControl>
+                      <FormMessage />
+                    </FormItem>
+                  )}
+                />
+
+                {failed && <p className="text-sm text-destructive">{failed}</p>}
+
+                <Button
+                  type="submit"
+                  className="w-full"
+                  disabled={acceptMutation.isPending}
+                >
+                  {acceptMutation.isPending ? 'Joining...' : 'Join'}
+                </Button>
+              </form>
+            </Form>
+          </CardContent>
+        )}
+      </Card>
+    </div>
+  )
+}
@@ -3,7 +3,7 @@ import { Card, CardContent, CardHeader, CardTitle } from '../../components/ui/ca
 import { Tabs, TabsContent, TabsList, TabsTrigger } from '../../components/ui/tabs'
 import { Button } from '../../components/ui/button'
 import { Link } from '@tanstack/react-router'
-import { Terminal, ArrowUpDown, RefreshCcw, Edit, Trash, ChevronLeft } from 'lucide-react'
+import { Terminal, ArrowUpDown, RefreshCcw, Edit, Trash, ChevronLeft, Download, FileArchive } from 'lucide-react'
 import { Badge } from '../../components/ui/badge'
 import { formatDateTime } from '../../lib/utils'
 import { useState } from 'react'
@@ -13,7 +13,10 @@ import {
   useDeleteDevice, 
   useRestartDevice,
   useDeploymentsByDevice,
-  useDeviceMetrics
+  useDeviceMetrics,
+  useDiagnosticsBundles,
+  useRequestDiagnostics,
+  downloadDiagnosticsBundle
 } from '../../hooks/use-api'
 
 // Hardware information interface
@@ -86,6 +89,31 @@ export function DeviceDetailPage() {
     }
   }
   
+  // Diagnostics bundles collected by the device
+  const { data: bundles = [] } = useDiagnosticsBundles(deviceId)
+  const requestDiagnosticsMutation = useRequestDiagnostics(deviceId)
+
+  // Handle diagnostics bundle request
+  const handleRequestDiagnostics = async () => {
+    try {
+      await requestDiagnosticsMutation.mutateAsync()
+      toast.success('Collecting diagnostics bundle')
+    } catch (error) {
+      toast.error('Failed to request diagnostics bundle')
+      console.error(error)
+    }
+  }
+
+  // Handle diagnostics bundle download
+  const handleDownloadDiagnostics = async (bundleId: string) => {
+    try {
+      await downloadDiagnosticsBundle(deviceId, bundleId)
+    } catch (error) {
+      toast.error('Failed to download diagnostics bundle')
+      console.error(error)
+    }
+  }
+
   // Parse hardware info from JSON string (if available)
   const hardwareInfo: HardwareInfo | undefined = (() => {
     if (!device?.hardware_info) return undefined
@@ -224,6 +252,7 @@ export function DeviceDetailPage() {
           <TabsTrigger value="software">Software</TabsTrigger>
           <TabsTrigger value="metrics">Metrics</TabsTrigger>
           <TabsTrigger value="logs">Logs</TabsTrigger>
+          <TabsTrigger value="diagnostics">Diagnostics</TabsTrigger>
           <TabsTrigger value="settings">Settings</TabsTrigger>
         </TabsList>
         
@@ -399,6 +428,61 @@ export function DeviceDetailPage() {
           </Card>
         </TabsContent>
         
+        <TabsContent value="diagnostics">
+          <Card>
+            <CardHeader className="flex flex-row items-center justify-between">
+              <CardTitle>Diagnostics Bundles</CardTitle>
+              <Button
+                variant="outline"
+                onClick={handleRequestDiagnostics}
+                disabled={device.status !== 'online' || requestDiagnosticsMutation.isPending}
+              >
+                <FileArchive className="mr-2 h-4 w-4" />
+                {requestDiagnosticsMutation.isPending ? 'Requesting...' : 'Collect Bundle'}
+              </Button>
+            </CardHeader>
+            <CardContent>
+              {bundles.length > 0 ? (
+                <div className="space-y-4">
+                  {bundles.map((bundle) => (
+                    <div key={bundle.id} className="flex items-center justify-between rounded-lg border p-4">
+                      <div>
+                        <div className="font-medium">{formatDateTime(new Date(bundle.created_at))}</div>
+                        <div className="text-sm text-muted-foreground">
+                          {bundle.status === 'failed'
+                            ? bundle.error
+                            : `${(bundle.size / 1024).toFixed(1)} KB${bundle.requested_by ? `, requested by ${bundle.requested_by}` : ''}`}
+                        </div>
+                      </div>
+                      <div className="flex items-center space-x-2">
+                        <Badge
+                          variant={bundle.status === 'failed' ? 'destructive' : 'outline'}
+                          className={bundle.status === 'ready' ? 'text-green-500' : ''}
+                        >
+                          {bundle.status}
+                        </Badge>
+                        <Button
+                          variant="ghost"
+                          size="sm"
+                          disabled={bundle.status !== 'ready'}
+                          onClick={() => handleDownloadDiagnostics(bundle.id)}
+                        >
+                          <Download className="h-4 w-4" />
+                        </Button>
+                      </div>
+                    </div>
+                  ))}
+                </div>
+              ) : (
+                <div className="text-center text-muted-foreground py-6">
+                  No diagnostics bundles collected yet. A bundle holds the agent log, Docker state,
+                  compose files with secrets redacted, network and disk diagnostics.
+                </div>
+              )}
+            </CardContent>
+          </Card>
+        </TabsContent>
+
         <TabsContent value="settings">
           <Card>
             <CardHeader>
@@ -1,6 +1,7 @@
 import App from './App'
 import { AuthLayout } from './layouts/AuthLayout'
 import { DashboardPage } from './pages/DashboardPage'
+import { InvitePage } from './pages/auth/InvitePage'
 import { LoginPage } from './pages/auth/LoginPage'
 import { DeviceDetailPage } from './pages/devices/DeviceDetailPage'
 import { DevicesPage } from './pages/devices/DevicesPage'
@@ -29,6 +30,12 @@ const loginRoute = createRoute({
   component: LoginPage,
 })
 
+const inviteRoute = createRoute({
+  getParentRoute: () => rootRoute,
+  path: '/invite',
+  component: InvitePage,
+})
+
 // Protected routes with AuthLayout
 const authLayoutRoute = createRoute({
   getParentRoute: () => rootRoute,
@@ -99,6 +106,7 @@ const usersRoute = createRoute({
 // Create and export the router
 const routeTree = rootRoute.addChildren([
   loginRoute,
+  inviteRoute,
   authLayoutRoute.addChildren([
     dashboardRoute,
     fleetsRoute.addChildren([fleetDetailRoute]),